@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"karl/internal"
+)
+
+// configCheckReport is the -check-config -json output
+type configCheckReport struct {
+	File     string             `json:"file"`
+	Valid    bool               `json:"valid"`
+	Errors   []configCheckError `json:"errors"`
+	Warnings []string           `json:"warnings"`
+}
+
+type configCheckError struct {
+	Field   string      `json:"field"`
+	Value   interface{} `json:"value,omitempty"`
+	Message string      `json:"message"`
+}
+
+// runConfigCheck validates a configuration file without starting the
+// server, prints the problems found and returns the exit code: 0 when the
+// file is valid, warnings included, and 1 otherwise
+func runConfigCheck(path string, jsonOutput bool) int {
+	if path == "" {
+		path = internal.GetConfigPath()
+	}
+	result := internal.CheckConfigFile(path)
+
+	if jsonOutput {
+		report := configCheckReport{File: path, Valid: result.Valid, Errors: []configCheckError{}, Warnings: []string{}}
+		for _, e := range result.Errors {
+			report.Errors = append(report.Errors, configCheckError{Field: e.Field, Value: e.Value, Message: e.Message})
+		}
+		report.Warnings = append(report.Warnings, result.Warnings...)
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(report)
+	} else {
+		for _, e := range result.Errors {
+			if e.Value != nil {
+				fmt.Printf("ERROR   %s: %s (%v)\n", e.Field, e.Message, e.Value)
+			} else {
+				fmt.Printf("ERROR   %s: %s\n", e.Field, e.Message)
+			}
+		}
+		for _, w := range result.Warnings {
+			fmt.Printf("WARNING %s\n", w)
+		}
+		fmt.Printf("%s: %d error(s), %d warning(s)\n", path, len(result.Errors), len(result.Warnings))
+	}
+
+	if !result.Valid {
+		return 1
+	}
+	return 0
+}
@@ -24,8 +24,8 @@ func (k *KarlServer) loadConfig() error {
 	k.config = config
 	k.mu.Unlock()
 
-	// Start config watcher
-	go func() { _ = internal.WatchConfig(configPath) }()
+	// Reload on file changes and SIGHUP
+	go internal.WatchConfig(k.ctx, configPath, config)
 
 	log.Println("Configuration loaded successfully")
 
@@ -0,0 +1,138 @@
+// SPDX-License-Identifier: GPL-2.0
+//
+// XDP forwarding for Karl's kernel offload. Karl fills the karl_forward
+// map with one entry per leg port of a pass-through session; packets to
+// such a port get their addresses rewritten and go straight back out,
+// everything else is passed up the stack to Karl. Entries match only the
+// port a packet arrives on, not its source, so Karl never offloads a
+// session whose media sources it checks.
+//
+// Build:  clang -O2 -g -target bpf -c karl_xdp.c -o karl_xdp.o
+// Attach: ip link set dev eth0 xdp obj karl_xdp.o sec xdp
+//
+// The map is pinned by name, at /sys/fs/bpf/karl_forward by default.
+
+#include <linux/bpf.h>
+#include <linux/if_ether.h>
+#include <linux/in.h>
+#include <linux/ip.h>
+#include <linux/udp.h>
+#include <bpf/bpf_endian.h>
+#include <bpf/bpf_helpers.h>
+
+#ifndef AF_INET
+#define AF_INET 2
+#endif
+
+// Must match bpfForwardKey in internal/kernel_offload_linux.go
+struct forward_key {
+	__be32 addr; // Karl's address the packet arrives on
+	__be16 port; // the leg port it arrives on
+	__u16 pad;
+};
+
+// Must match bpfForwardValue in internal/kernel_offload_linux.go
+struct forward_value {
+	__be32 src_addr; // Karl's address the peer expects packets from
+	__be32 dst_addr; // the peer's address
+	__be16 src_port;
+	__be16 dst_port;
+};
+
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, 65536);
+	__type(key, struct forward_key);
+	__type(value, struct forward_value);
+	__uint(pinning, LIBBPF_PIN_BY_NAME);
+} karl_forward SEC(".maps");
+
+// csum_replace2 updates a ones' complement checksum for a changed 16-bit
+// word (RFC 1624)
+static __always_inline void csum_replace2(__u16 *sum, __u16 from, __u16 to)
+{
+	__u32 csum = (__u16)~*sum;
+
+	csum += (__u16)~from;
+	csum += to;
+	csum = (csum & 0xffff) + (csum >> 16);
+	csum = (csum & 0xffff) + (csum >> 16);
+	*sum = (__u16)~csum;
+}
+
+static __always_inline void csum_replace4(__u16 *sum, __u32 from, __u32 to)
+{
+	csum_replace2(sum, (__u16)(from >> 16), (__u16)(to >> 16));
+	csum_replace2(sum, (__u16)from, (__u16)to);
+}
+
+SEC("xdp")
+int karl_xdp_forward(struct xdp_md *ctx)
+{
+	void *data = (void *)(long)ctx->data;
+	void *data_end = (void *)(long)ctx->data_end;
+	struct ethhdr *eth = data;
+	struct iphdr *ip;
+	struct udphdr *udp;
+	struct forward_key key = {};
+	struct forward_value *fwd;
+	struct bpf_fib_lookup fib = {};
+	__u16 *udp_check;
+
+	if ((void *)(eth + 1) > data_end || eth->h_proto != bpf_htons(ETH_P_IP))
+		return XDP_PASS;
+
+	// Options and fragments are left to the stack
+	ip = (void *)(eth + 1);
+	if ((void *)(ip + 1) > data_end || ip->ihl != 5 || ip->protocol != IPPROTO_UDP ||
+	    (ip->frag_off & bpf_htons(0x3fff)))
+		return XDP_PASS;
+
+	udp = (void *)(ip + 1);
+	if ((void *)(udp + 1) > data_end)
+		return XDP_PASS;
+
+	key.addr = ip->daddr;
+	key.port = udp->dest;
+	fwd = bpf_map_lookup_elem(&karl_forward, &key);
+	if (!fwd)
+		return XDP_PASS;
+
+	// Route to the peer before touching the packet, so a packet the
+	// kernel cannot route here reaches Karl unchanged
+	fib.family = AF_INET;
+	fib.tos = ip->tos;
+	fib.l4_protocol = IPPROTO_UDP;
+	fib.tot_len = bpf_ntohs(ip->tot_len);
+	fib.ipv4_src = fwd->src_addr;
+	fib.ipv4_dst = fwd->dst_addr;
+	fib.ifindex = ctx->ingress_ifindex;
+	if (bpf_fib_lookup(ctx, &fib, sizeof(fib), 0) != BPF_FIB_LKUP_RET_SUCCESS)
+		return XDP_PASS;
+
+	// Rewrite the addresses, keeping both checksums valid. A zero UDP
+	// checksum means none was sent and stays zero
+	udp_check = (__u16 *)&udp->check;
+	if (*udp_check) {
+		csum_replace4(udp_check, ip->saddr, fwd->src_addr);
+		csum_replace4(udp_check, ip->daddr, fwd->dst_addr);
+		csum_replace2(udp_check, udp->source, fwd->src_port);
+		csum_replace2(udp_check, udp->dest, fwd->dst_port);
+		if (!*udp_check)
+			*udp_check = 0xffff;
+	}
+	csum_replace4((__u16 *)&ip->check, ip->saddr, fwd->src_addr);
+	csum_replace4((__u16 *)&ip->check, ip->daddr, fwd->dst_addr);
+	ip->saddr = fwd->src_addr;
+	ip->daddr = fwd->dst_addr;
+	udp->source = fwd->src_port;
+	udp->dest = fwd->dst_port;
+
+	__builtin_memcpy(eth->h_dest, fib.dmac, ETH_ALEN);
+	__builtin_memcpy(eth->h_source, fib.smac, ETH_ALEN);
+	if (fib.ifindex == ctx->ingress_ifindex)
+		return XDP_TX;
+	return bpf_redirect(fib.ifindex, 0);
+}
+
+char LICENSE[] SEC("license") = "GPL";
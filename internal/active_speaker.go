@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// sessionSpeakingThreshold is the level in dBov above which a party of
+	// a call counts as speaking
+	sessionSpeakingThreshold = -40.0
+
+	// sessionSpeakingHangover keeps a party speaking through short pauses
+	sessionSpeakingHangover = 300 * time.Millisecond
+)
+
+// g711Linear holds the linear value of every μ-law and A-law byte
+var g711Linear = func() (table [2][256]int16) {
+	for i := range table[0] {
+		table[0][i] = muLawLinear(byte(i))
+		table[1][i] = muLawLinear(aLawToMuLawMap[i])
+	}
+	return table
+}()
+
+// muLawLinear decodes a μ-law byte (ITU-T G.711)
+func muLawLinear(b byte) int16 {
+	b = ^b
+	magnitude := (int16(b&0x0F)<<3 + 0x84) << (b & 0x70 >> 4)
+	if b&0x80 != 0 {
+		return 0x84 - magnitude
+	}
+	return magnitude - 0x84
+}
+
+// speechLevel returns the level of a relayed audio packet in dBov: the one
+// its sender reports in an audio level header extension (RFC 6464) and its
+// voice activity flag, or else the level of its G.711 audio when decode is
+// set, as for media not encrypted end to end. ok is false otherwise
+func speechLevel(packet *RTPPacket, extmap RTPExtmap, codecs []CodecInfo, decode bool) (level float64, voice, ok bool) {
+	if id := extmap.ID(ExtmapAudioLevel); id != 0 {
+		if level, voice, ok := packet.AudioLevel(id); ok {
+			return level, voice, true
+		}
+	}
+
+	table := -1
+	switch packet.PayloadType {
+	case 0:
+		table = 0
+	case 8:
+		table = 1
+	}
+	if codec, found := findCodecByPayloadType(codecs, packet.PayloadType); found {
+		switch codec.Name {
+		case "PCMU":
+			table = 0
+		case "PCMA":
+			table = 1
+		default:
+			table = -1
+		}
+	}
+	if !decode || table < 0 || len(packet.Payload) == 0 {
+		return 0, false, false
+	}
+
+	var sum float64
+	for _, b := range packet.Payload {
+		sample := float64(g711Linear[table][b])
+		sum += sample * sample
+	}
+	rms := math.Sqrt(sum / float64(len(packet.Payload)))
+	if rms == 0 {
+		return conferenceSilenceLevel, false, true
+	}
+	return math.Max(20*math.Log10(rms/pcmMaxAmplitude), conferenceSilenceLevel), false, true
+}
+
+// observeSpeech records the speech level of the media a leg sent and
+// updates the session's active speaker: the leg that speaks, or the louder
+// one when both start speaking at once. A speaker keeps the floor until it
+// falls silent. It reports the speaker and the previous one when the
+// speaker changed
+func (s *MediaSession) observeSpeech(leg *CallLeg, level float64, voice bool, now time.Time) (speaker, previous string, changed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	leg.speechLevel = level
+	if voice || level >= sessionSpeakingThreshold {
+		leg.lastVoice = now
+	}
+
+	loudest := math.Inf(-1)
+	for _, side := range []struct {
+		name string
+		leg  *CallLeg
+	}{{"caller", s.CallerLeg}, {"callee", s.CalleeLeg}} {
+		if side.leg == nil || now.Sub(side.leg.lastVoice) >= sessionSpeakingHangover {
+			continue
+		}
+		if side.name == s.ActiveSpeaker {
+			speaker = side.name
+			break
+		}
+		if side.leg.speechLevel > loudest {
+			speaker, loudest = side.name, side.leg.speechLevel
+		}
+	}
+
+	if speaker == s.ActiveSpeaker {
+		return speaker, "", false
+	}
+	previous, s.ActiveSpeaker = s.ActiveSpeaker, speaker
+	return speaker, previous, true
+}
+
+// publishActiveSpeaker publishes a change of a session's active speaker
+func publishActiveSpeaker(session *MediaSession, speaker, previous string) {
+	data := map[string]interface{}{
+		"session_id": session.ID,
+		"leg":        speaker,
+		"previous":   previous,
+	}
+	session.mu.RLock()
+	callID, leg := session.CallID, session.CallerLeg
+	if speaker == "callee" {
+		leg = session.CalleeLeg
+	}
+	if speaker != "" && leg != nil {
+		data["tag"] = leg.Tag
+	}
+	session.mu.RUnlock()
+	PublishEvent(EventActiveSpeaker, callID, data)
+}
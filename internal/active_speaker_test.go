@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestSpeechLevel(t *testing.T) {
+	pcmu := []CodecInfo{{PayloadType: 0, Name: "PCMU", ClockRate: 8000}}
+
+	// μ-law 0xFF is silence and 0x80 close to full scale
+	if level, _, ok := speechLevel(&RTPPacket{Payload: bytes.Repeat([]byte{0xFF}, 160)}, nil, pcmu, true); !ok || level != conferenceSilenceLevel {
+		t.Errorf("silence measured at %v dBov (%v)", level, ok)
+	}
+	if level, _, ok := speechLevel(&RTPPacket{Payload: bytes.Repeat([]byte{0x80}, 160)}, nil, pcmu, true); !ok || level < -1 {
+		t.Errorf("full scale measured at %v dBov (%v)", level, ok)
+	}
+	if _, _, ok := speechLevel(&RTPPacket{Payload: bytes.Repeat([]byte{0x80}, 160)}, nil, pcmu, false); ok {
+		t.Error("measured a payload that is encrypted end to end")
+	}
+	if _, _, ok := speechLevel(&RTPPacket{PayloadType: 111, Payload: []byte{1, 2, 3}}, nil, nil, true); ok {
+		t.Error("measured a codec Karl does not decode")
+	}
+
+	// The sender's own level takes precedence, even for encrypted media
+	packet := &RTPPacket{PayloadType: 111, Payload: []byte{1, 2, 3}}
+	packet.SetHeaderExtensions([]RTPHeaderExtension{{ID: 3, Payload: []byte{0x80 | 12}}})
+	if level, voice, ok := speechLevel(packet, RTPExtmap{3: ExtmapAudioLevel}, nil, false); !ok || level != -12 || !voice {
+		t.Errorf("reported level %v %v %v, want -12 dBov with voice", level, voice, ok)
+	}
+}
+
+func TestMediaSession_ActiveSpeaker(t *testing.T) {
+	defer eventBus.Store(eventBus.Load())
+	bus := &EventBus{endpoints: []*webhookEndpoint{{queue: make(chan *Event, 10)}}}
+	eventBus.Store(bus)
+
+	session := &MediaSession{ID: "s1", CallID: "speaker-call",
+		CallerLeg: &CallLeg{Tag: "from-tag"}, CalleeLeg: &CallLeg{Tag: "to-tag"}}
+	now := time.Now()
+	observe := func(leg *CallLeg, level float64, at time.Duration) {
+		if speaker, previous, changed := session.observeSpeech(leg, level, false, now.Add(at)); changed {
+			publishActiveSpeaker(session, speaker, previous)
+		}
+	}
+	next := func() *Event {
+		select {
+		case event := <-bus.endpoints[0].queue:
+			return event
+		default:
+			return nil
+		}
+	}
+
+	// The caller speaks and keeps the floor while the callee talks louder
+	observe(session.CallerLeg, -30, 0)
+	observe(session.CalleeLeg, -10, 20*time.Millisecond)
+	observe(session.CalleeLeg, -10, 200*time.Millisecond)
+	event := next()
+	if event == nil || event.Type != EventActiveSpeaker || event.CallID != "speaker-call" ||
+		event.Data["leg"] != "caller" || event.Data["tag"] != "from-tag" || event.Data["previous"] != "" {
+		t.Fatalf("unexpected event %+v", event)
+	}
+	if event := next(); event != nil {
+		t.Fatalf("the speaker changed while the caller was speaking: %+v", event)
+	}
+
+	// Once the caller falls silent the callee takes over
+	observe(session.CallerLeg, -70, 400*time.Millisecond)
+	observe(session.CalleeLeg, -10, 400*time.Millisecond)
+	if event := next(); event == nil || event.Data["leg"] != "callee" || event.Data["previous"] != "caller" {
+		t.Fatalf("unexpected event %+v", event)
+	}
+	if session.ActiveSpeaker != "callee" {
+		t.Errorf("active speaker %q, want callee", session.ActiveSpeaker)
+	}
+
+	// and when both are silent nobody speaks
+	observe(session.CalleeLeg, -70, time.Second)
+	if event := next(); event == nil || event.Data["leg"] != "" || event.Data["previous"] != "callee" {
+		t.Fatalf("unexpected event %+v", event)
+	}
+}
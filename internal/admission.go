@@ -0,0 +1,294 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ng "karl/internal/ng_protocol"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Admission control caps what one Karl takes on: concurrent calls, calls of
+// each tenant and the bandwidth of the media it receives. An offer for a
+// new call beyond a cap is refused, and the capacity left under each cap is
+// exported so that the SIP proxy can send calls to other nodes before this
+// one refuses them.
+
+// Caps an offer can be refused under
+const (
+	LimitSessions       = "sessions"
+	LimitTenantSessions = "tenant_sessions"
+	LimitBandwidth      = "bandwidth"
+)
+
+// bandwidthInterval is how often the bandwidth of received media is measured
+const bandwidthInterval = time.Second
+
+// Admission metrics
+var (
+	sessionsRemaining = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "karl_sessions_remaining",
+			Help: "New calls admitted before sessions.max_sessions is reached, absent without a limit",
+		},
+		nil,
+	)
+
+	tenantSessionsRemaining = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "karl_tenant_sessions_remaining",
+			Help: "New calls of each tenant admitted before its max_sessions is reached, for tenants with a limit",
+		},
+		[]string{"tenant"},
+	)
+
+	bandwidthRemaining = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "karl_media_bandwidth_remaining_bps",
+			Help: "Bandwidth in bit/s left below sessions.max_bandwidth, absent without a limit",
+		},
+		nil,
+	)
+
+	mediaBandwidth = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "karl_media_bandwidth_bps",
+			Help: "Bandwidth in bit/s of the media received in user space",
+		},
+	)
+
+	admissionRejected = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "karl_admission_rejected_total",
+			Help: "Offers for new calls refused by admission control, by limit",
+		},
+		[]string{"limit"},
+	)
+)
+
+// ErrCapacityExceeded is wrapped by the AdmissionError of a refused offer
+var ErrCapacityExceeded = errors.New("capacity exceeded")
+
+// AdmissionError is returned for an offer for a new call that would go
+// beyond a cap. Max and InUse are in calls, or in bit/s for the bandwidth
+type AdmissionError struct {
+	Limit  string // LimitSessions, LimitTenantSessions or LimitBandwidth
+	Tenant string // Tenant whose cap was reached, for LimitTenantSessions
+	Max    int64
+	InUse  int64
+}
+
+func (e *AdmissionError) Error() string {
+	switch e.Limit {
+	case LimitTenantSessions:
+		return fmt.Sprintf("session limit of tenant %s reached (%d of %d)", e.Tenant, e.InUse, e.Max)
+	case LimitBandwidth:
+		return fmt.Sprintf("bandwidth limit reached (%d of %d kbit/s)", e.InUse/1000, e.Max/1000)
+	}
+	return fmt.Sprintf("session limit reached (%d of %d)", e.InUse, e.Max)
+}
+
+// Unwrap makes every AdmissionError match ErrCapacityExceeded
+func (e *AdmissionError) Unwrap() error {
+	return ErrCapacityExceeded
+}
+
+// admissionLimits is the configured caps; zero means no cap
+type admissionLimits struct {
+	maxSessions  int
+	maxBandwidth int64 // bit/s
+}
+
+var admission atomic.Pointer[admissionLimits]
+
+// receivedMediaBytes counts the media bytes received in user space, and
+// receivedBandwidth holds their rate in bit/s over the last interval
+var (
+	receivedMediaBytes atomic.Uint64
+	receivedBandwidth  atomic.Int64
+	bandwidthMeterOnce sync.Once
+)
+
+// ConfigureAdmission sets the caps new calls are admitted under from the
+// sessions settings, and starts measuring the bandwidth of received media
+func ConfigureAdmission(config *SessionConfig) {
+	limits := &admissionLimits{}
+	if config != nil {
+		limits.maxSessions = config.MaxSessions
+		limits.maxBandwidth = int64(config.MaxBandwidth) * 1000000
+	}
+	admission.Store(limits)
+	if limits.maxSessions <= 0 {
+		sessionsRemaining.Reset()
+	}
+	updateBandwidthRemaining()
+	bandwidthMeterOnce.Do(func() { go measureBandwidth() })
+}
+
+// ValidateAdmissionConfig checks the caps of the sessions settings
+func ValidateAdmissionConfig(cfg *Config) error {
+	if cfg.Sessions.MaxSessions < 0 {
+		return fmt.Errorf("sessions.max_sessions must not be negative")
+	}
+	if cfg.Sessions.MaxBandwidth < 0 {
+		return fmt.Errorf("sessions.max_bandwidth must not be negative")
+	}
+	return nil
+}
+
+// countReceivedMedia adds a received packet to the bandwidth measurement
+func countReceivedMedia(size int) {
+	receivedMediaBytes.Add(uint64(size))
+}
+
+// measureBandwidth turns the received bytes into a rate every interval
+func measureBandwidth() {
+	ticker := time.NewTicker(bandwidthInterval)
+	defer ticker.Stop()
+
+	last, lastTime := receivedMediaBytes.Load(), time.Now()
+	for now := range ticker.C {
+		total := receivedMediaBytes.Load()
+		if elapsed := now.Sub(lastTime).Seconds(); elapsed > 0 {
+			receivedBandwidth.Store(int64(float64(total-last) * 8 / elapsed))
+		}
+		last, lastTime = total, now
+		mediaBandwidth.Set(float64(receivedBandwidth.Load()))
+		updateBandwidthRemaining()
+	}
+}
+
+// updateBandwidthRemaining exports the bandwidth left below the cap
+func updateBandwidthRemaining() {
+	limits := admission.Load()
+	if limits == nil || limits.maxBandwidth <= 0 {
+		bandwidthRemaining.Reset()
+		return
+	}
+	bandwidthRemaining.WithLabelValues().Set(float64(max(limits.maxBandwidth-receivedBandwidth.Load(), 0)))
+}
+
+// CapacityUsage is the use of one cap. Max is zero without a cap
+type CapacityUsage struct {
+	Max   int64
+	InUse int64
+}
+
+// Remaining returns the capacity left under the cap, -1 without a cap
+func (u CapacityUsage) Remaining() int64 {
+	if u.Max <= 0 {
+		return -1
+	}
+	return max(u.Max-u.InUse, 0)
+}
+
+// Capacity is the use of each cap of admission control
+type Capacity struct {
+	Sessions  CapacityUsage
+	Bandwidth CapacityUsage            // bit/s
+	Tenants   map[string]CapacityUsage // Calls by tenant name
+}
+
+// Capacity returns the use of the caps new calls are admitted under
+func (m *SessionManager) Capacity() Capacity {
+	limits := admission.Load()
+	if limits == nil {
+		limits = &admissionLimits{}
+	}
+	c := Capacity{
+		Sessions:  CapacityUsage{Max: int64(limits.maxSessions), InUse: int64(m.registry.GetTotalCount())},
+		Bandwidth: CapacityUsage{Max: limits.maxBandwidth, InUse: receivedBandwidth.Load()},
+		Tenants:   make(map[string]CapacityUsage),
+	}
+	for _, t := range ListTenants() {
+		c.Tenants[t.Name] = CapacityUsage{Max: int64(t.Config.MaxSessions), InUse: int64(m.tenantSessionCount(t.Name))}
+	}
+	return c
+}
+
+// AdmitSession creates the session of a new call if it is within every
+// cap and its tenant's offer rate, and makes it a call of the tenant,
+// which may be nil. A call beyond a cap is refused with an AdmissionError
+func (m *SessionManager) AdmitSession(callID, fromTag string, tenant *Tenant) (*MediaSession, error) {
+	m.admitMu.Lock()
+	defer m.admitMu.Unlock()
+
+	if err := m.checkAdmission(tenant); err != nil {
+		admissionRejected.WithLabelValues(err.Limit).Inc()
+		if tenant != nil {
+			tenantOffers.WithLabelValues(tenant.Label(), "capacity").Inc()
+		}
+		return nil, err
+	}
+	if tenant != nil && !tenant.AllowOffer() {
+		return nil, ErrTenantOfferRate
+	}
+
+	session := m.registry.CreateSession(callID, fromTag)
+	if tenant != nil {
+		m.AssignTenant(session, tenant)
+	}
+	m.updateCapacity()
+	return session, nil
+}
+
+// checkAdmission returns the cap a new call of tenant would go beyond
+func (m *SessionManager) checkAdmission(tenant *Tenant) *AdmissionError {
+	limits := admission.Load()
+	if limits == nil {
+		limits = &admissionLimits{}
+	}
+	if n := m.registry.GetTotalCount(); limits.maxSessions > 0 && n >= limits.maxSessions {
+		return &AdmissionError{Limit: LimitSessions, Max: int64(limits.maxSessions), InUse: int64(n)}
+	}
+	if tenant != nil && tenant.Config.MaxSessions > 0 {
+		if n := m.tenantSessionCount(tenant.Name); n >= tenant.Config.MaxSessions {
+			return &AdmissionError{Limit: LimitTenantSessions, Tenant: tenant.Name, Max: int64(tenant.Config.MaxSessions), InUse: int64(n)}
+		}
+	}
+	if bw := receivedBandwidth.Load(); limits.maxBandwidth > 0 && bw >= limits.maxBandwidth {
+		return &AdmissionError{Limit: LimitBandwidth, Max: limits.maxBandwidth, InUse: bw}
+	}
+	return nil
+}
+
+// admissionResponse is the NG error response to a refused offer. A cap
+// that was reached is named in the limit key, with its max and in-use
+// values, so that the SIP proxy can retry the call on another node
+func admissionResponse(err error) *ng.NGResponse {
+	resp := &ng.NGResponse{Result: ng.ResultError, ErrorReason: err.Error()}
+	var admissionErr *AdmissionError
+	if errors.As(err, &admissionErr) {
+		resp.Extra = map[string]interface{}{
+			"limit":  admissionErr.Limit,
+			"max":    admissionErr.Max,
+			"in-use": admissionErr.InUse,
+		}
+		if admissionErr.Tenant != "" {
+			resp.Extra["tenant"] = admissionErr.Tenant
+		}
+	}
+	return resp
+}
+
+// updateCapacity exports the calls left under the session caps
+func (m *SessionManager) updateCapacity() {
+	c := m.Capacity()
+	if remaining := c.Sessions.Remaining(); remaining >= 0 {
+		sessionsRemaining.WithLabelValues().Set(float64(remaining))
+	} else {
+		sessionsRemaining.Reset()
+	}
+
+	tenantSessionsRemaining.Reset()
+	for _, t := range ListTenants() {
+		if remaining := c.Tenants[t.Name].Remaining(); remaining >= 0 {
+			tenantSessionsRemaining.WithLabelValues(t.Label()).Set(float64(remaining))
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+
+	ng "karl/internal/ng_protocol"
+)
+
+func TestAdmitSession_Caps(t *testing.T) {
+	previousLimits, previousTenants := admission.Load(), tenants.Load()
+	t.Cleanup(func() {
+		admission.Store(previousLimits)
+		tenants.Store(previousTenants)
+		receivedBandwidth.Store(0)
+	})
+	admission.Store(&admissionLimits{maxSessions: 3, maxBandwidth: 10000000})
+	ConfigureTenants(&TenantsConfig{Tenants: map[string]*TenantConfig{"acme": {MaxSessions: 1}}})
+	acme, err := LookupTenant("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manager, registry, _ := newTestSessionManager(t)
+	if _, err := manager.AdmitSession("call-1", "from-tag", acme); err != nil {
+		t.Fatal(err)
+	}
+
+	// The tenant's cap refuses its second call, but not calls of others
+	_, err = manager.AdmitSession("call-2", "from-tag", acme)
+	var admissionErr *AdmissionError
+	if !errors.As(err, &admissionErr) || admissionErr.Limit != LimitTenantSessions || admissionErr.Tenant != "acme" {
+		t.Fatalf("expected the tenant's session limit, got %v", err)
+	}
+	if !errors.Is(err, ErrCapacityExceeded) {
+		t.Errorf("expected %v to match ErrCapacityExceeded", err)
+	}
+	if _, err := manager.AdmitSession("call-3", "from-tag", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	c := manager.Capacity()
+	if c.Sessions.Remaining() != 1 || c.Tenants["acme"].Remaining() != 0 {
+		t.Errorf("unexpected capacity %+v", c)
+	}
+
+	// Received media at the bandwidth cap refuses any new call
+	receivedBandwidth.Store(10000000)
+	if _, err := manager.AdmitSession("call-4", "from-tag", nil); !errors.As(err, &admissionErr) || admissionErr.Limit != LimitBandwidth {
+		t.Fatalf("expected the bandwidth limit, got %v", err)
+	}
+	receivedBandwidth.Store(0)
+
+	if _, err := manager.AdmitSession("call-4", "from-tag", nil); err != nil {
+		t.Fatal(err)
+	}
+	_, err = manager.AdmitSession("call-5", "from-tag", nil)
+	if !errors.As(err, &admissionErr) || admissionErr.Limit != LimitSessions || admissionErr.Max != 3 || admissionErr.InUse != 3 {
+		t.Fatalf("expected the session limit, got %v", err)
+	}
+	if got := len(registry.GetSessionByCallID("call-5")); got != 0 {
+		t.Errorf("refused call has %d sessions", got)
+	}
+
+	// Ending the tenant's call frees its place
+	manager.TerminateCall("call-1")
+	if _, err := manager.AdmitSession("call-6", "from-tag", acme); err != nil {
+		t.Errorf("tenant call not admitted after its other call ended: %v", err)
+	}
+}
+
+func TestHandleOffer_FailedOfferReleasesAdmission(t *testing.T) {
+	previousLimits := admission.Load()
+	t.Cleanup(func() { admission.Store(previousLimits) })
+	admission.Store(&admissionLimits{maxSessions: 1})
+
+	manager, registry, _ := newTestSessionManager(t)
+	listener := &NGSocketListener{sessionRegistry: registry, sessionManager: manager, config: &Config{}}
+
+	// An offer that fails after admission leaves no session holding the
+	// only place, so the next call is admitted
+	resp, err := listener.handleOffer(&ng.NGRequest{CallID: "call-bad", FromTag: "from-tag", SDP: "not sdp"})
+	if err != nil || resp.Result != ng.ResultError {
+		t.Fatalf("expected the offer to fail, got %+v (%v)", resp, err)
+	}
+	if n := registry.GetTotalCount(); n != 0 {
+		t.Fatalf("failed offer left %d sessions", n)
+	}
+	resp, err = listener.handleOffer(&ng.NGRequest{CallID: "call-good", FromTag: "from-tag", SDP: sipOfferSDP})
+	if err != nil || resp.Result != ng.ResultOK {
+		t.Fatalf("expected the next call to be admitted, got %+v (%v)", resp, err)
+	}
+}
+
+func TestAdmissionResponse(t *testing.T) {
+	resp := admissionResponse(&AdmissionError{Limit: LimitTenantSessions, Tenant: "acme", Max: 10, InUse: 10})
+	if resp.Result != ng.ResultError || resp.ErrorReason != "session limit of tenant acme reached (10 of 10)" {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	if resp.Extra["limit"] != LimitTenantSessions || resp.Extra["max"] != int64(10) || resp.Extra["tenant"] != "acme" {
+		t.Errorf("unexpected limit keys %v", resp.Extra)
+	}
+
+	resp = admissionResponse(ErrTenantOfferRate)
+	if resp.ErrorReason != ErrTenantOfferRate.Error() || resp.Extra != nil {
+		t.Errorf("unexpected response %+v", resp)
+	}
+}
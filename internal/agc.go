@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"math"
+	"sync"
+
+	ng "karl/internal/ng_protocol"
+)
+
+// AGC defaults
+const (
+	agcDefaultTarget    = 20   // target speech level in -dBov
+	agcDefaultMaxGain   = 18   // largest boost in dB
+	agcDefaultAttack    = 50   // ms to lower the gain
+	agcDefaultRelease   = 1000 // ms to raise the gain
+	agcMaxAttenuationDB = 30   // largest cut in dB
+	agcPeakLimit        = -1.0 // highest peak in dBFS the gain may produce
+	agcLevelMs          = 300  // time constant of the speech level measurement
+)
+
+// AGCConfig configures automatic gain control
+type AGCConfig struct {
+	TargetLevel int // speech level in -dBov the gain aims for
+	MaxGain     int // largest boost in dB
+	AttackMs    int // time constant in ms for lowering the gain
+	ReleaseMs   int // time constant in ms for raising the gain
+}
+
+// agcConfigFromFlags returns the AGC an offer or answer asked for with the
+// agc, agc-target, agc-max-gain, agc-attack and agc-release options. Unset
+// values keep the defaults
+func agcConfigFromFlags(pf *ng.ParsedFlags) (AGCConfig, bool) {
+	if !pf.AGC {
+		return AGCConfig{}, false
+	}
+	return AGCConfig{
+		TargetLevel: pf.AGCTarget,
+		MaxGain:     pf.AGCMaxGain,
+		AttackMs:    pf.AGCAttack,
+		ReleaseMs:   pf.AGCRelease,
+	}.withDefaults(), true
+}
+
+// withDefaults fills in the unset values
+func (c AGCConfig) withDefaults() AGCConfig {
+	if c.TargetLevel <= 0 {
+		c.TargetLevel = agcDefaultTarget
+	}
+	if c.MaxGain <= 0 {
+		c.MaxGain = agcDefaultMaxGain
+	}
+	if c.AttackMs <= 0 {
+		c.AttackMs = agcDefaultAttack
+	}
+	if c.ReleaseMs <= 0 {
+		c.ReleaseMs = agcDefaultRelease
+	}
+	return c
+}
+
+// AGC levels one audio stream towards a target speech level. The gain only
+// adapts on frames the VAD classifies as speech once it has measured the
+// background noise, so pauses and noise are not pumped up. A frame is never
+// amplified past a -1 dBFS peak
+type AGC struct {
+	mu         sync.Mutex
+	config     AGCConfig
+	sampleRate int
+	vad        *VAD
+	power      float64 // speech power, averaged over speech frames
+	gain       float64 // current gain in dB
+}
+
+// NewAGC creates gain control for mono PCM at sampleRate
+func NewAGC(sampleRate int, config AGCConfig) *AGC {
+	return &AGC{
+		config:     config.withDefaults(),
+		sampleRate: sampleRate,
+		vad:        NewVAD(sampleRate, VADConfig{}),
+	}
+}
+
+// Gain returns the gain in dB the AGC currently applies
+func (a *AGC) Gain() float64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.gain
+}
+
+// Process applies the gain to a frame in place and returns it. The gain
+// ramps across the frame so changes do not click
+func (a *AGC) Process(pcm []int16) []int16 {
+	if len(pcm) == 0 {
+		return pcm
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	start := a.gain
+
+	// Follow the speech level across syllables rather than each frame's
+	frameMs := float64(len(pcm)) * 1000 / float64(a.sampleRate)
+	if a.vad.Process(pcm); a.vad.speech && a.vad.calibrated() {
+		power := pcmPower(pcm)
+		if a.power == 0 {
+			a.power = power
+		}
+		a.power += (power - a.power) * (1 - math.Exp(-frameMs/agcLevelMs))
+
+		desired := -float64(a.config.TargetLevel) - powerLevel(a.power)
+		desired = math.Max(math.Min(desired, float64(a.config.MaxGain)), -agcMaxAttenuationDB)
+
+		tau := a.config.ReleaseMs
+		if desired < a.gain {
+			tau = a.config.AttackMs
+		}
+		a.gain += (desired - a.gain) * (1 - math.Exp(-frameMs/float64(tau)))
+	}
+
+	// Limit the gain so the frame's peak stays below the peak limit
+	peak := 0.0
+	for _, s := range pcm {
+		peak = math.Max(peak, math.Abs(float64(s)))
+	}
+	if peak > 0 {
+		headroom := agcPeakLimit + 20*math.Log10(pcmMaxAmplitude/peak)
+		a.gain = math.Min(a.gain, headroom)
+		start = math.Min(start, headroom)
+	}
+
+	from, to := dbToGain(start), dbToGain(a.gain)
+	for i, s := range pcm {
+		g := from + (to-from)*float64(i+1)/float64(len(pcm))
+		pcm[i] = clampSample(math.Round(float64(s) * g))
+	}
+	return pcm
+}
+
+// dbToGain converts decibels into a linear amplitude factor
+func dbToGain(db float64) float64 {
+	return math.Pow(10, db/20)
+}
+
+var (
+	agcsMu sync.Mutex
+	agcs   = make(map[uint32]*AGC)
+)
+
+// getAGC returns the gain control of an SSRC, creating it on first use or
+// when its sample rate or configuration changed
+func getAGC(ssrc uint32, sampleRate int, config AGCConfig) *AGC {
+	agcsMu.Lock()
+	defer agcsMu.Unlock()
+
+	a, ok := agcs[ssrc]
+	if !ok || a.sampleRate != sampleRate || a.config != config.withDefaults() {
+		a = NewAGC(sampleRate, config)
+		agcs[ssrc] = a
+	}
+	return a
+}
+
+// RemoveAGC drops the gain control kept for an SSRC
+func RemoveAGC(ssrc uint32) {
+	agcsMu.Lock()
+	defer agcsMu.Unlock()
+	delete(agcs, ssrc)
+}
@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	ng "karl/internal/ng_protocol"
+)
+
+// agcRun feeds three seconds of speech over quiet noise through an AGC and
+// returns the levels in dBov of its last second before and after the AGC
+func agcRun(agc *AGC, level float64) (in, out float64) {
+	r := rand.New(rand.NewSource(3))
+	for i := 0; i < 150; i++ {
+		frame := vadSpeech(vadNoise(r, 160, -65), i*160, 8000, level)
+		before := pcmPower(frame)
+		after := pcmPower(agc.Process(frame))
+		if i >= 100 {
+			in += before / 50
+			out += after / 50
+		}
+	}
+	return powerLevel(in), powerLevel(out)
+}
+
+func TestAGC_Levels(t *testing.T) {
+	config := AGCConfig{TargetLevel: 20, MaxGain: 18, AttackMs: 20, ReleaseMs: 200}
+
+	tests := []struct {
+		level    float64
+		min, max float64 // expected output level
+	}{
+		{-25, -23, -19}, // about -36 dBov, raised by 16 dB
+		{-10, -23, -19}, // about -21 dBov, left alone
+		{0, -23, -19},   // about -11 dBov, cut by 9 dB
+		{-50, -45, -40}, // about -60 dBov, raised by the 18 dB maximum
+	}
+	for _, tt := range tests {
+		in, out := agcRun(NewAGC(8000, config), tt.level)
+		if out < tt.min || out > tt.max {
+			t.Errorf("speech at %.1f dBov: expected %.0f to %.0f dBov, got %.1f", in, tt.min, tt.max, out)
+		}
+	}
+
+	capped := NewAGC(8000, AGCConfig{MaxGain: 6, ReleaseMs: 100})
+	if agcRun(capped, -35); capped.Gain() > 6.01 {
+		t.Errorf("expected the gain to stop at 6 dB, got %.1f dB", capped.Gain())
+	}
+}
+
+func TestAGC_HoldsGainOnNoise(t *testing.T) {
+	agc := NewAGC(8000, AGCConfig{})
+	r := rand.New(rand.NewSource(4))
+	for i := 0; i < 250; i++ {
+		agc.Process(vadNoise(r, 160, -45))
+	}
+	if gain := agc.Gain(); gain > 2 {
+		t.Errorf("expected background noise not to be boosted, gain %.1f dB", gain)
+	}
+}
+
+func TestAGC_NoClipping(t *testing.T) {
+	agc := NewAGC(8000, AGCConfig{TargetLevel: 3, MaxGain: 30, AttackMs: 10, ReleaseMs: 10})
+	for i := 0; i < 50; i++ {
+		frame := vadSpeech(make([]int16, 160), i*160, 8000, -12)
+		for _, s := range agc.Process(frame) {
+			if s >= math.MaxInt16-1 || s <= -math.MaxInt16+1 {
+				t.Fatalf("frame %d clipped", i)
+			}
+		}
+	}
+}
+
+func TestTranscodeRTPPacket_AGC(t *testing.T) {
+	n := GetCodecNegotiator()
+	pcmu := []CodecInfo{{PayloadType: 0, Name: "PCMU", ClockRate: 8000}}
+	n.SetOfferCodecs("agc-call", pcmu)
+	n.SetAnswerCodecs("agc-call", pcmu)
+	n.BindSSRC(0xA6C1, "agc-call", true)
+	defer n.RemoveCall("agc-call")
+
+	packet := &RTPPacket{SSRC: 0xA6C1, PayloadType: 0}
+	if ShouldTranscodePacket(packet) {
+		t.Fatal("expected PCMU to PCMU to pass through without AGC")
+	}
+
+	config, ok := agcConfigFromFlags(ng.ParseFlags([]string{"agc-max-gain=12"}))
+	if !ok || config != (AGCConfig{TargetLevel: 20, MaxGain: 12, AttackMs: 50, ReleaseMs: 1000}) {
+		t.Fatalf("unexpected AGC from flags: %+v", config)
+	}
+	config.ReleaseMs = 200
+	n.SetAGC("agc-call", config)
+
+	r := rand.New(rand.NewSource(5))
+	var payload []byte
+	for i := 0; i < 150; i++ {
+		payload = encodeG711("PCMU", vadSpeech(vadNoise(r, 160, -65), i*160, 8000, -40))
+		packet = &RTPPacket{SSRC: 0xA6C1, PayloadType: 0, Payload: payload}
+		if !ShouldTranscodePacket(packet) {
+			t.Fatal("expected AGC to decode the same codec")
+		}
+		if err := TranscodeRTPPacket(packet); err != nil {
+			t.Fatalf("TranscodeRTPPacket failed: %v", err)
+		}
+	}
+	in := powerLevel(pcmPower(decodeG711("PCMU", payload)))
+	out := powerLevel(pcmPower(decodeG711("PCMU", packet.Payload)))
+	if out-in < 8 || packet.PayloadType != 0 {
+		t.Errorf("expected quiet PCMU to be raised, %.1f to %.1f dBov (PT %d)", in, out, packet.PayloadType)
+	}
+
+	// Telephone events are left alone
+	if ShouldTranscodePacket(&RTPPacket{SSRC: 0xA6C1, PayloadType: 101}) {
+		t.Error("expected an unnegotiated payload type not to be processed")
+	}
+}
@@ -0,0 +1,325 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Alert notification defaults
+const (
+	defaultAlertInterval   = 300 * time.Second
+	defaultSMTPServer      = "localhost:25"
+	alertDeliveryTimeout   = 10 * time.Second
+	defaultAlertMessageTpl = `Karl alert on {{.Node}}: {{.Type}} - {{.Description}}` +
+		`{{if .CallID}} on call {{.CallID}}{{end}} (value {{printf "%.2f" .Value}}, threshold {{printf "%.2f" .Threshold}})`
+)
+
+// PagerDuty Events API v2 endpoint, a variable so tests can replace it
+var pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// Alert notification metrics
+var (
+	alertNotifications = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "karl_alert_notifications_total",
+			Help: "Alert notifications by channel (email, slack, pagerduty) and result (sent, failed)",
+		},
+		[]string{"channel", "result"},
+	)
+
+	alertNotificationsSuppressed = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "karl_alert_notifications_suppressed_total",
+			Help: "Alerts not notified because of alert_interval or max_alerts_per_hour, by reason",
+		},
+		[]string{"reason"},
+	)
+)
+
+// Failed deliveries are reported at most once a minute
+var alertNotifyErrors = NewLogSampler(Logger(ComponentKarl), slog.LevelWarn, 1, time.Minute)
+
+// alertMessage is what message_template is executed with
+type alertMessage struct {
+	RTPAlert
+	Node string
+}
+
+// alertNotifier rate limits alerts and delivers them to the configured
+// channels
+type alertNotifier struct {
+	node     string
+	client   *http.Client
+	lastSent map[string]time.Time // by alert type
+	sent     []time.Time          // notifications within the last hour
+}
+
+func newAlertNotifier() *alertNotifier {
+	return &alertNotifier{
+		node:     DefaultHANodeID(),
+		client:   &http.Client{Timeout: alertDeliveryTimeout},
+		lastSent: make(map[string]time.Time),
+	}
+}
+
+// RunAlertNotifier delivers the alerts raised by the monitors to email,
+// Slack and PagerDuty until ctx is done
+func RunAlertNotifier(ctx context.Context) {
+	n := newAlertNotifier()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case alert := <-alertChan:
+			n.notify(alert, currentAlertSettings())
+		}
+	}
+}
+
+// notify sends an alert to every configured channel, unless notifications
+// are off or rate limited
+func (n *alertNotifier) notify(alert RTPAlert, settings AlertSettings) {
+	if !settings.NotifyAdmin || (settings.AdminEmail == "" && settings.SlackWebhook == "" && settings.PagerDutyKey == "") {
+		return
+	}
+	if reason := n.limit(alert.Type, settings, time.Now()); reason != "" {
+		alertNotificationsSuppressed.WithLabelValues(reason).Inc()
+		return
+	}
+
+	message := n.render(settings.MessageTemplate, alert)
+	if settings.AdminEmail != "" {
+		n.deliver("email", alert, func() error { return n.sendEmail(settings, alert, message) })
+	}
+	if settings.SlackWebhook != "" {
+		n.deliver("slack", alert, func() error {
+			return n.post(settings.SlackWebhook, map[string]string{"text": message})
+		})
+	}
+	if settings.PagerDutyKey != "" {
+		n.deliver("pagerduty", alert, func() error {
+			return n.post(pagerDutyEventsURL, n.pagerDutyEvent(settings.PagerDutyKey, alert, message))
+		})
+	}
+}
+
+// limit returns why an alert must not be notified, or "" and records it.
+// alert_interval applies per alert type, max_alerts_per_hour to all of them
+func (n *alertNotifier) limit(alertType string, settings AlertSettings, now time.Time) string {
+	interval := defaultAlertInterval
+	if settings.AlertInterval > 0 {
+		interval = time.Duration(settings.AlertInterval) * time.Second
+	}
+	if last, ok := n.lastSent[alertType]; ok && now.Sub(last) < interval {
+		return "interval"
+	}
+
+	recent := n.sent[:0]
+	for _, t := range n.sent {
+		if now.Sub(t) < time.Hour {
+			recent = append(recent, t)
+		}
+	}
+	n.sent = recent
+	if settings.MaxAlertsPerHour > 0 && len(n.sent) >= settings.MaxAlertsPerHour {
+		return "hourly_limit"
+	}
+
+	n.lastSent[alertType] = now
+	n.sent = append(n.sent, now)
+	return ""
+}
+
+// render executes the message template, falling back to the default one
+// if it fails
+func (n *alertNotifier) render(text string, alert RTPAlert) string {
+	data := alertMessage{RTPAlert: alert, Node: n.node}
+	if text != "" {
+		var buf bytes.Buffer
+		tpl, err := template.New("alert").Parse(text)
+		if err == nil {
+			err = tpl.Execute(&buf, data)
+		}
+		if err == nil {
+			return buf.String()
+		}
+		if alertNotifyErrors.Allow() {
+			alertNotifyErrors.Log("Alert message_template failed, using the default", "error", err)
+		}
+	}
+	var buf bytes.Buffer
+	_ = template.Must(template.New("alert").Parse(defaultAlertMessageTpl)).Execute(&buf, data)
+	return buf.String()
+}
+
+// deliver runs one channel's delivery and counts the result
+func (n *alertNotifier) deliver(channel string, alert RTPAlert, send func() error) {
+	if err := send(); err != nil {
+		alertNotifications.WithLabelValues(channel, "failed").Inc()
+		if alertNotifyErrors.Allow() {
+			alertNotifyErrors.Log("Alert notification failed", "channel", channel, "alert", alert.Type, "error", err)
+		}
+		return
+	}
+	alertNotifications.WithLabelValues(channel, "sent").Inc()
+}
+
+// post sends body as JSON, expecting a 2xx response
+func (n *alertNotifier) post(target string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(target, "application/json", bytes.NewReader(data))
+	if err != nil {
+		// Leave the URL, which may be a Slack webhook secret, out of the error
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// pagerDutyEvent builds a trigger event. Repeats of an alert type on a
+// node share a dedup key, so PagerDuty groups them into one incident
+func (n *alertNotifier) pagerDutyEvent(routingKey string, alert RTPAlert, message string) map[string]interface{} {
+	details := map[string]interface{}{
+		"description": alert.Description,
+		"value":       alert.Value,
+		"threshold":   alert.Threshold,
+	}
+	if alert.CallID != "" {
+		details["call_id"] = alert.CallID
+	}
+	if len(message) > 1024 {
+		message = message[:1024]
+	}
+	return map[string]interface{}{
+		"routing_key":  routingKey,
+		"event_action": "trigger",
+		"dedup_key":    "karl/" + n.node + "/" + alert.Type,
+		"payload": map[string]interface{}{
+			"summary":        message,
+			"source":         n.node,
+			"severity":       "warning",
+			"timestamp":      alert.Timestamp.UTC().Format(time.RFC3339),
+			"component":      "karl",
+			"class":          alert.Type,
+			"custom_details": details,
+		},
+	}
+}
+
+// sendEmail mails the alert to admin_email, upgrading to TLS when the
+// server offers STARTTLS
+func (n *alertNotifier) sendEmail(settings AlertSettings, alert RTPAlert, message string) error {
+	server := settings.SMTPServer
+	if server == "" {
+		server = defaultSMTPServer
+	}
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		return err
+	}
+	from := settings.SMTPFrom
+	if from == "" {
+		from = "karl@" + n.node
+	}
+	var to []string
+	for _, addr := range strings.Split(settings.AdminEmail, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			to = append(to, addr)
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", server, alertDeliveryTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(alertDeliveryTimeout))
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}); err != nil {
+			return err
+		}
+	}
+	if settings.SMTPUsername != "" {
+		if err := c.Auth(smtp.PlainAuth("", settings.SMTPUsername, settings.SMTPPassword, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	subject := mime.QEncoding.Encode("utf-8", fmt.Sprintf("Karl alert: %s on %s", alert.Type, n.node))
+	fmt.Fprintf(w, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n", from, strings.Join(to, ", "), subject, alert.Timestamp.Format(time.RFC1123Z))
+	fmt.Fprintf(w, "MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n", message)
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// ValidateAlertSettings checks the notification channels and limits
+func ValidateAlertSettings(cfg *Config) error {
+	a := cfg.AlertSettings
+	if a.AlertInterval < 0 {
+		return fmt.Errorf("invalid alert_settings.alert_interval %d", a.AlertInterval)
+	}
+	if a.MaxAlertsPerHour < 0 {
+		return fmt.Errorf("invalid alert_settings.max_alerts_per_hour %d", a.MaxAlertsPerHour)
+	}
+	if a.SMTPServer != "" {
+		if host, port, err := net.SplitHostPort(a.SMTPServer); err != nil || host == "" || port == "" {
+			return fmt.Errorf("invalid alert_settings.smtp_server %q, expected host:port", a.SMTPServer)
+		}
+	}
+	if a.SlackWebhook != "" {
+		if u, err := url.Parse(a.SlackWebhook); err != nil || u.Scheme != "https" || u.Host == "" {
+			return errors.New("invalid alert_settings.slack_webhook, expected an https URL")
+		}
+	}
+	if a.MessageTemplate != "" {
+		if _, err := template.New("alert").Parse(a.MessageTemplate); err != nil {
+			return fmt.Errorf("invalid alert_settings.message_template: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAlertNotifier_SlackAndPagerDuty(t *testing.T) {
+	requests := make(chan map[string]interface{}, 10)
+	paths := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		paths <- r.URL.Path
+		requests <- body
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+	defer func(u string) { pagerDutyEventsURL = u }(pagerDutyEventsURL)
+	pagerDutyEventsURL = server.URL + "/pagerduty"
+
+	n := newAlertNotifier()
+	n.node = "node-1"
+	n.notify(RTPAlert{Timestamp: time.Now(), Type: "MOS", CallID: "call-1", Description: "Call quality degraded", Value: 3.2, Threshold: 3.5}, AlertSettings{
+		NotifyAdmin:     true,
+		SlackWebhook:    server.URL + "/slack",
+		PagerDutyKey:    "routing-key",
+		MessageTemplate: "{{.Type}} {{.CallID}} on {{.Node}}",
+	})
+
+	if len(requests) != 2 {
+		t.Fatalf("got %d requests, want Slack and PagerDuty", len(requests))
+	}
+	if path, body := <-paths, <-requests; path != "/slack" || body["text"] != "MOS call-1 on node-1" {
+		t.Errorf("Slack got %v on %s", body, path)
+	}
+	path, body := <-paths, <-requests
+	payload, _ := body["payload"].(map[string]interface{})
+	if path != "/pagerduty" || body["routing_key"] != "routing-key" || body["event_action"] != "trigger" ||
+		body["dedup_key"] != "karl/node-1/MOS" || payload["summary"] != "MOS call-1 on node-1" || payload["source"] != "node-1" {
+		t.Errorf("PagerDuty got %v on %s", body, path)
+	}
+
+	// Notifications off
+	n.notify(RTPAlert{Type: "Jitter"}, AlertSettings{SlackWebhook: server.URL + "/slack"})
+	if len(requests) != 0 {
+		t.Error("notified with notify_admin off")
+	}
+}
+
+func TestAlertNotifier_Email(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	mail := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		var transcript strings.Builder
+		io.WriteString(conn, "220 mail.example.com ESMTP\r\n")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			transcript.WriteString(line)
+			switch cmd := strings.ToUpper(strings.Fields(line)[0]); cmd {
+			case "EHLO", "HELO":
+				io.WriteString(conn, "250 mail.example.com\r\n")
+			case "DATA":
+				io.WriteString(conn, "354 go ahead\r\n")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					transcript.WriteString(line)
+				}
+				io.WriteString(conn, "250 queued\r\n")
+			case "QUIT":
+				io.WriteString(conn, "221 bye\r\n")
+				mail <- transcript.String()
+				return
+			default:
+				io.WriteString(conn, "250 ok\r\n")
+			}
+		}
+	}()
+
+	n := newAlertNotifier()
+	n.node = "node-1"
+	n.notify(RTPAlert{Timestamp: time.Now(), Type: "Packet Loss", Description: "High packet loss detected", Value: 7, Threshold: 5}, AlertSettings{
+		NotifyAdmin: true,
+		AdminEmail:  "noc@example.com, oncall@example.com",
+		SMTPServer:  ln.Addr().String(),
+		SMTPFrom:    "karl@example.com",
+	})
+
+	select {
+	case transcript := <-mail:
+		for _, want := range []string{
+			"MAIL FROM:<karl@example.com>",
+			"RCPT TO:<noc@example.com>",
+			"RCPT TO:<oncall@example.com>",
+			"Subject: Karl alert: Packet Loss on node-1",
+			"Karl alert on node-1: Packet Loss - High packet loss detected (value 7.00, threshold 5.00)",
+		} {
+			if !strings.Contains(transcript, want) {
+				t.Errorf("mail is missing %q:\n%s", want, transcript)
+			}
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no mail sent")
+	}
+}
+
+func TestAlertNotifier_RateLimits(t *testing.T) {
+	n := newAlertNotifier()
+	settings := AlertSettings{AlertInterval: 60, MaxAlertsPerHour: 3}
+	start := time.Now()
+	for i, tt := range []struct {
+		alert  string
+		after  time.Duration
+		reason string
+	}{
+		{"MOS", 0, ""},
+		{"MOS", 30 * time.Second, "interval"},
+		{"Jitter", 30 * time.Second, ""},
+		{"MOS", 61 * time.Second, ""},
+		{"Packet Loss", 2 * time.Minute, "hourly_limit"},
+		{"Packet Loss", 61 * time.Minute, ""},
+	} {
+		if reason := n.limit(tt.alert, settings, start.Add(tt.after)); reason != tt.reason {
+			t.Errorf("%d: %s after %v limited by %q, want %q", i, tt.alert, tt.after, reason, tt.reason)
+		}
+	}
+}
+
+func TestValidateAlertSettings(t *testing.T) {
+	for i, tt := range []struct {
+		settings AlertSettings
+		valid    bool
+	}{
+		{AlertSettings{}, true},
+		{AlertSettings{SMTPServer: "smtp.example.com:587", SlackWebhook: "https://hooks.slack.com/services/T/B/X", MessageTemplate: "{{.Type}}"}, true},
+		{AlertSettings{AlertInterval: -1}, false},
+		{AlertSettings{MaxAlertsPerHour: -1}, false},
+		{AlertSettings{SMTPServer: "smtp.example.com"}, false},
+		{AlertSettings{SlackWebhook: "http://hooks.slack.com/services/T/B/X"}, false},
+		{AlertSettings{MessageTemplate: "{{.Type"}, false},
+	} {
+		if err := ValidateAlertSettings(&Config{AlertSettings: tt.settings}); (err == nil) != tt.valid {
+			t.Errorf("%d: %+v error %v", i, tt.settings, err)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+//go:build karl_amr && cgo
+
+package internal
+
+/*
+#cgo pkg-config: opencore-amrnb opencore-amrwb vo-amrwbenc
+#include <opencore-amrnb/interf_enc.h>
+#include <opencore-amrnb/interf_dec.h>
+#include <opencore-amrwb/dec_if.h>
+#include <vo-amrwbenc/enc_if.h>
+
+static void *karl_amr_enc_init(int wideband) {
+	return wideband ? E_IF_init() : Encoder_Interface_init(1);
+}
+
+static int karl_amr_encode(void *state, int wideband, int mode, const short *speech, unsigned char *out) {
+	if (wideband) {
+		return E_IF_encode(state, mode, speech, out, 1);
+	}
+	return Encoder_Interface_Encode(state, (enum Mode)mode, speech, out, 0);
+}
+
+static void karl_amr_enc_exit(void *state, int wideband) {
+	if (wideband) {
+		E_IF_exit(state);
+	} else {
+		Encoder_Interface_exit(state);
+	}
+}
+
+static void *karl_amr_dec_init(int wideband) {
+	return wideband ? D_IF_init() : Decoder_Interface_init();
+}
+
+static void karl_amr_decode(void *state, int wideband, const unsigned char *in, short *out, int bfi) {
+	if (wideband) {
+		D_IF_decode(state, in, out, bfi);
+	} else {
+		Decoder_Interface_Decode(state, in, out, bfi);
+	}
+}
+
+static void karl_amr_dec_exit(void *state, int wideband) {
+	if (wideband) {
+		D_IF_exit(state);
+	} else {
+		Decoder_Interface_exit(state);
+	}
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"runtime"
+	"unsafe"
+)
+
+// AMR from opencore-amr and AMR-WB from opencore-amrwb and vo-amrwbenc,
+// in RFC 4867 payloads. The encoders use discontinuous transmission and
+// the highest mode in the receiver's mode-set. AMR is patent encumbered;
+// check your licensing before enabling it
+func init() {
+	registerAudioCodec(MimeTypeAMR, nativeAudioCodec{
+		offer:      CodecInfo{PayloadType: 96, Name: "AMR", ClockRate: AMRNBSampleRate, Channels: 1},
+		sampleRate: func(CodecInfo) int { return AMRNBSampleRate },
+		newEncoder: func(codec CodecInfo) (audioEncoder, error) { return newAMREncoder(codec, false) },
+		newDecoder: func(codec CodecInfo) (audioDecoder, error) { return newAMRDecoder(codec, false) },
+	})
+	registerAudioCodec(MimeTypeAMRWB, nativeAudioCodec{
+		offer:      CodecInfo{PayloadType: 96, Name: "AMR-WB", ClockRate: AMRWBSampleRate, Channels: 1},
+		sampleRate: func(CodecInfo) int { return AMRWBSampleRate },
+		newEncoder: func(codec CodecInfo) (audioEncoder, error) { return newAMREncoder(codec, true) },
+		newDecoder: func(codec CodecInfo) (audioDecoder, error) { return newAMRDecoder(codec, true) },
+	})
+}
+
+// amrStorageSize is the largest frame in the storage format of RFC 4867
+// section 5: a header octet with FT and Q, then the speech bits
+const amrStorageSize = 61
+
+// amrWideband returns the cgo flag of a codec
+func amrWideband(wideband bool) C.int {
+	if wideband {
+		return 1
+	}
+	return 0
+}
+
+// amrEncoder encodes 20 ms frames into RTP payloads
+type amrEncoder struct {
+	state    unsafe.Pointer
+	wideband C.int
+	format   *AMRFormat
+	framer   pcmFramer
+}
+
+func newAMREncoder(codec CodecInfo, wideband bool) (audioEncoder, error) {
+	format, err := ParseAMRFormat(codec.Fmtp, wideband)
+	if err != nil {
+		return nil, err
+	}
+	state := C.karl_amr_enc_init(amrWideband(wideband))
+	if state == nil {
+		return nil, fmt.Errorf("failed to create %s encoder", codec.Name)
+	}
+	size := AMRNBFrameSamples
+	if wideband {
+		size = AMRWBFrameSamples
+	}
+	e := &amrEncoder{state: state, wideband: amrWideband(wideband), format: format, framer: pcmFramer{size: size}}
+	runtime.SetFinalizer(e, (*amrEncoder).Close)
+	return e, nil
+}
+
+// Encode returns a payload with the frames of pcm, or none when all of
+// them are NO_DATA during silence
+func (e *amrEncoder) Encode(pcm []int16) ([]byte, error) {
+	if e.state == nil {
+		return nil, fmt.Errorf("AMR encoder closed")
+	}
+	payload := &AMRPayload{CMR: AMRNoRequest}
+	speech := false
+	for _, frame := range e.framer.frames(pcm) {
+		var out [amrStorageSize]byte
+		n := C.karl_amr_encode(e.state, e.wideband, C.int(e.format.EncodingMode()),
+			(*C.short)(unsafe.Pointer(&frame[0])), (*C.uchar)(unsafe.Pointer(&out[0])))
+		if n < 1 {
+			return nil, fmt.Errorf("%w: encoder returned %d", ErrAMRInvalidFrame, n)
+		}
+		f := AMRFrame{Type: AMRMode(out[0] >> 3 & 0x0f), Quality: out[0]>>2&1 == 1, Data: append([]byte(nil), out[1:n]...)}
+		if f.Type != AMRModeNoData {
+			speech = true
+		}
+		payload.Frames = append(payload.Frames, f)
+	}
+	if !speech {
+		return nil, nil
+	}
+	return payload.Marshal(e.format), nil
+}
+
+// Close frees the encoder
+func (e *amrEncoder) Close() {
+	if e.state != nil {
+		C.karl_amr_enc_exit(e.state, e.wideband)
+		e.state = nil
+	}
+	runtime.SetFinalizer(e, nil)
+}
+
+// amrDecoder decodes RTP payloads, concealing damaged frames and filling
+// NO_DATA frames with comfort noise
+type amrDecoder struct {
+	state    unsafe.Pointer
+	wideband C.int
+	format   *AMRFormat
+	samples  int
+}
+
+func newAMRDecoder(codec CodecInfo, wideband bool) (audioDecoder, error) {
+	format, err := ParseAMRFormat(codec.Fmtp, wideband)
+	if err != nil {
+		return nil, err
+	}
+	state := C.karl_amr_dec_init(amrWideband(wideband))
+	if state == nil {
+		return nil, fmt.Errorf("failed to create %s decoder", codec.Name)
+	}
+	samples := AMRNBFrameSamples
+	if wideband {
+		samples = AMRWBFrameSamples
+	}
+	d := &amrDecoder{state: state, wideband: amrWideband(wideband), format: format, samples: samples}
+	runtime.SetFinalizer(d, (*amrDecoder).Close)
+	return d, nil
+}
+
+// Decode decodes the frames of a payload, 20 ms of PCM each
+func (d *amrDecoder) Decode(data []byte) ([]int16, error) {
+	if d.state == nil {
+		return nil, fmt.Errorf("AMR decoder closed")
+	}
+	payload, err := ParseAMRPayload(data, d.format)
+	if err != nil {
+		return nil, err
+	}
+	pcm := make([]int16, len(payload.Frames)*d.samples)
+	for i, f := range payload.Frames {
+		var in [amrStorageSize]byte
+		in[0] = byte(f.Type) << 3
+		bfi := C.int(1)
+		if f.Quality {
+			in[0] |= 1 << 2
+			bfi = 0
+		}
+		copy(in[1:], f.Data)
+		out := pcm[i*d.samples:]
+		C.karl_amr_decode(d.state, d.wideband, (*C.uchar)(unsafe.Pointer(&in[0])), (*C.short)(unsafe.Pointer(&out[0])), bfi)
+	}
+	return pcm, nil
+}
+
+// Close frees the decoder
+func (d *amrDecoder) Close() {
+	if d.state != nil {
+		C.karl_amr_dec_exit(d.state, d.wideband)
+		d.state = nil
+	}
+	runtime.SetFinalizer(d, nil)
+}
@@ -0,0 +1,91 @@
+//go:build karl_amr && cgo
+
+package internal
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestAMR_RoundTrip(t *testing.T) {
+	for _, codec := range []CodecInfo{
+		{Name: "AMR", ClockRate: AMRNBSampleRate},
+		{Name: "AMR", ClockRate: AMRNBSampleRate, Fmtp: "octet-align=1; mode-set=0,2,5"},
+		{Name: "AMR-WB", ClockRate: AMRWBSampleRate, Fmtp: "octet-align=1"},
+	} {
+		format, err := ParseAMRFormat(codec.Fmtp, codec.Name == "AMR-WB")
+		if err != nil {
+			t.Fatal(err)
+		}
+		payloads, pcm := nativeRoundTrip(t, codec)
+		if len(payloads) != 50 {
+			t.Fatalf("%s: expected 50 payloads, got %d", codec.Name, len(payloads))
+		}
+		p, err := ParseAMRPayload(payloads[len(payloads)-1], format)
+		if err != nil || len(p.Frames) != 1 || p.Frames[0].Type != format.EncodingMode() {
+			t.Fatalf("%s %q: expected one frame in mode %d, got %+v (%v)", codec.Name, codec.Fmtp, format.EncodingMode(), p, err)
+		}
+		checkTone(t, codec.Name, pcm, codecSampleRate(codec))
+	}
+}
+
+func TestAMR_DTX(t *testing.T) {
+	codecs := NewStreamCodecs()
+	defer codecs.close()
+	codec := CodecInfo{Name: "AMR", ClockRate: AMRNBSampleRate}
+	format, _ := ParseAMRFormat("", false)
+
+	var sid, suppressed int
+	for i := 0; i < 50; i++ {
+		payload, err := encodeAudio(codec, make([]int16, AMRNBFrameSamples), codecs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(payload) == 0 {
+			suppressed++
+			continue
+		}
+		p, err := ParseAMRPayload(payload, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Frames[0].Type == AMRModeSID {
+			sid++
+		}
+		if pcm, err := decodeAudio(codec, payload, codecs); err != nil || len(pcm) != AMRNBFrameSamples {
+			t.Fatalf("expected a frame of comfort noise, got %d samples (%v)", len(pcm), err)
+		}
+	}
+	if sid == 0 || suppressed == 0 {
+		t.Errorf("expected silence sent as SID frames then suppressed, got %d SID and %d suppressed", sid, suppressed)
+	}
+}
+
+func TestTranscodeAudio_AMR(t *testing.T) {
+	pcmu := encodeG711("PCMU", resamplerTone(440, 8000, 160))
+	amr := mimeCodec(MimeTypeAMR)
+	encoded, err := transcodeAudio(pcmu, mimeCodec(webrtc.MimeTypePCMU), amr)
+	if err != nil || len(encoded) == 0 {
+		t.Fatalf("expected an AMR payload, got %d bytes (%v)", len(encoded), err)
+	}
+	back, err := transcodeAudio(encoded, amr, mimeCodec(webrtc.MimeTypePCMU))
+	if err != nil || len(back) != len(pcmu) {
+		t.Fatalf("expected 160 PCMU samples, got %d bytes (%v)", len(back), err)
+	}
+	// AMR-WB to and from Opus goes through 16 kHz
+	wb := CodecInfo{Name: "AMR-WB", ClockRate: AMRWBSampleRate}
+	opus, err := transcodeAudio(encodeG711("PCMU", resamplerTone(440, 8000, 160)), mimeCodec(webrtc.MimeTypePCMU), mimeCodec(webrtc.MimeTypeOpus))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := transcodeAudio(opus, mimeCodec(webrtc.MimeTypeOpus), wb); err != nil || len(out) == 0 {
+		t.Errorf("expected Opus transcoded to AMR-WB, got %d bytes (%v)", len(out), err)
+	}
+	if _, err := transcodeAudio([]byte{0xf0}, amr, mimeCodec(webrtc.MimeTypePCMU)); err == nil {
+		t.Error("expected a truncated payload rejected")
+	}
+	if added := TranscodeOfferCodecs(nil, []string{"AMR", "AMR-WB"}); len(added) != 2 || added[0].PayloadType == added[1].PayloadType {
+		t.Errorf("expected AMR and AMR-WB offered under their own payload types, got %+v", added)
+	}
+}
@@ -0,0 +1,235 @@
+package internal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// AMRNoRequest is the CMR value asking for no particular mode (RFC 4867)
+const AMRNoRequest = 15
+
+// Speech bits per frame type (3GPP TS 26.101 and TS 26.201), indexed by FT
+var (
+	amrNBFrameBits = []int{95, 103, 118, 134, 148, 159, 204, 244, 39}
+	amrWBFrameBits = []int{132, 177, 253, 285, 317, 365, 397, 461, 477, 40}
+)
+
+// AMRFormat holds the fmtp parameters of an AMR or AMR-WB payload type
+type AMRFormat struct {
+	Wideband     bool
+	OctetAligned bool      // octet-align=1; bandwidth-efficient otherwise
+	ModeSet      []AMRMode // Modes the receiver accepts; empty means all
+}
+
+// ParseAMRFormat reads the fmtp parameters of an AMR payload type.
+// Interleaving and CRCs are not supported
+func ParseAMRFormat(fmtp string, wideband bool) (*AMRFormat, error) {
+	format := &AMRFormat{Wideband: wideband}
+	for _, param := range strings.Split(fmtp, ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(key) {
+		case "octet-align":
+			format.OctetAligned = value == "1"
+		case "mode-set":
+			for _, m := range strings.Split(value, ",") {
+				mode, err := strconv.Atoi(strings.TrimSpace(m))
+				if err != nil || mode < 0 || mode >= len(format.frameBits())-1 {
+					return nil, fmt.Errorf("%w: mode-set %q", ErrAMRInvalidMode, value)
+				}
+				format.ModeSet = append(format.ModeSet, AMRMode(mode))
+			}
+		case "interleaving", "crc", "robust-sorting":
+			if value != "" && value != "0" {
+				return nil, fmt.Errorf("AMR %s is not supported", key)
+			}
+		}
+	}
+	return format, nil
+}
+
+// EncodingMode returns the highest mode the receiver accepts
+func (f *AMRFormat) EncodingMode() AMRMode {
+	best := AMRMode(len(f.frameBits()) - 2)
+	if len(f.ModeSet) == 0 {
+		return best
+	}
+	mode := f.ModeSet[0]
+	for _, m := range f.ModeSet {
+		if m > mode {
+			mode = m
+		}
+	}
+	return mode
+}
+
+// frameBits returns the speech bit counts of the codec
+func (f *AMRFormat) frameBits() []int {
+	if f.Wideband {
+		return amrWBFrameBits
+	}
+	return amrNBFrameBits
+}
+
+// speechBits returns the number of speech bits for a frame type, 0 for
+// NO_DATA, or -1 if the frame type is invalid
+func (f *AMRFormat) speechBits(ft AMRMode) int {
+	bits := f.frameBits()
+	switch {
+	case int(ft) < len(bits):
+		return bits[ft]
+	case ft == AMRModeNoData:
+		return 0
+	}
+	return -1
+}
+
+// AMRFrame is one speech frame of an AMR payload. Data holds the speech
+// bits, MSB first, padded with zero bits to a whole octet
+type AMRFrame struct {
+	Type    AMRMode
+	Quality bool // Q bit; false marks a damaged frame
+	Data    []byte
+}
+
+// AMRPayload is an RFC 4867 AMR or AMR-WB RTP payload
+type AMRPayload struct {
+	CMR    uint8
+	Frames []AMRFrame
+}
+
+// amrBitReader reads MSB-first bit fields
+type amrBitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *amrBitReader) read(n int) (uint, bool) {
+	if r.pos+n > len(r.data)*8 {
+		return 0, false
+	}
+	var v uint
+	for i := 0; i < n; i++ {
+		bit := r.data[(r.pos+i)/8] >> (7 - uint((r.pos+i)%8)) & 1
+		v = v<<1 | uint(bit)
+	}
+	r.pos += n
+	return v, true
+}
+
+// amrBitWriter writes MSB-first bit fields
+type amrBitWriter struct {
+	data []byte
+	pos  int
+}
+
+func (w *amrBitWriter) write(v uint, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.pos%8 == 0 {
+			w.data = append(w.data, 0)
+		}
+		if v>>uint(i)&1 == 1 {
+			w.data[w.pos/8] |= 1 << (7 - uint(w.pos%8))
+		}
+		w.pos++
+	}
+}
+
+// align pads the written bits to a whole octet
+func (w *amrBitWriter) align() {
+	if rem := w.pos % 8; rem != 0 {
+		w.pos += 8 - rem
+	}
+}
+
+// ParseAMRPayload decodes an RTP payload in the given format
+func ParseAMRPayload(payload []byte, format *AMRFormat) (*AMRPayload, error) {
+	r := &amrBitReader{data: payload}
+	p := &AMRPayload{}
+
+	cmr, ok := r.read(4)
+	if !ok {
+		return nil, ErrAMRInvalidFrame
+	}
+	p.CMR = uint8(cmr)
+	if format.OctetAligned {
+		r.read(4) // reserved
+	}
+
+	// Table of contents: F (more frames follow), FT, Q
+	for {
+		follow, ok1 := r.read(1)
+		ft, ok2 := r.read(4)
+		q, ok3 := r.read(1)
+		if !ok1 || !ok2 || !ok3 {
+			return nil, ErrAMRInvalidFrame
+		}
+		if format.OctetAligned {
+			r.read(2) // padding
+		}
+		if format.speechBits(AMRMode(ft)) < 0 {
+			return nil, fmt.Errorf("%w: frame type %d", ErrAMRInvalidMode, ft)
+		}
+		p.Frames = append(p.Frames, AMRFrame{Type: AMRMode(ft), Quality: q == 1})
+		if follow == 0 {
+			break
+		}
+	}
+
+	for i := range p.Frames {
+		bits := format.speechBits(p.Frames[i].Type)
+		w := &amrBitWriter{}
+		for n := 0; n < bits; n++ {
+			bit, ok := r.read(1)
+			if !ok {
+				return nil, ErrAMRInvalidFrame
+			}
+			w.write(bit, 1)
+		}
+		p.Frames[i].Data = w.data
+		if format.OctetAligned {
+			r.pos = (r.pos + 7) / 8 * 8
+		}
+	}
+	return p, nil
+}
+
+// Marshal encodes the payload in the given format
+func (p *AMRPayload) Marshal(format *AMRFormat) []byte {
+	w := &amrBitWriter{}
+	w.write(uint(p.CMR), 4)
+	if format.OctetAligned {
+		w.write(0, 4)
+	}
+
+	for i, f := range p.Frames {
+		follow := uint(0)
+		if i < len(p.Frames)-1 {
+			follow = 1
+		}
+		quality := uint(0)
+		if f.Quality {
+			quality = 1
+		}
+		w.write(follow, 1)
+		w.write(uint(f.Type), 4)
+		w.write(quality, 1)
+		if format.OctetAligned {
+			w.write(0, 2)
+		}
+	}
+
+	for _, f := range p.Frames {
+		r := &amrBitReader{data: f.Data}
+		for n := format.speechBits(f.Type); n > 0; n-- {
+			bit, _ := r.read(1)
+			w.write(bit, 1)
+		}
+		if format.OctetAligned {
+			w.align()
+		}
+	}
+	return w.data
+}
+
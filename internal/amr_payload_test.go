@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseAMRFormat(t *testing.T) {
+	format, err := ParseAMRFormat("mode-set=0,2,5; octet-align=1", false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !format.OctetAligned || format.EncodingMode() != AMRMode795 {
+		t.Errorf("expected octet-aligned 7.95 kbps, got %+v", format)
+	}
+
+	format, _ = ParseAMRFormat("", true)
+	if format.OctetAligned || format.EncodingMode() != AMRWBMode2385 {
+		t.Errorf("expected bandwidth-efficient 23.85 kbps by default, got %+v", format)
+	}
+
+	if _, err := ParseAMRFormat("mode-set=8", false); err == nil {
+		t.Error("expected an error for a mode-set including SID")
+	}
+	if _, err := ParseAMRFormat("interleaving=4", false); err == nil {
+		t.Error("expected an error for interleaving")
+	}
+}
+
+func TestAMRPayload_RoundTrip(t *testing.T) {
+	speech := bytes.Repeat([]byte{0xA5}, 31)
+	speech[30] = 0xF0 // 244 bits: only the top 4 bits of the last octet
+	sid := []byte{0x12, 0x34, 0x56, 0x78, 0x80}
+	payload := &AMRPayload{
+		CMR: AMRNoRequest,
+		Frames: []AMRFrame{
+			{Type: AMRMode122, Quality: true, Data: speech},
+			{Type: AMRModeSID, Quality: true, Data: sid},
+			{Type: AMRModeNoData, Quality: true},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		format *AMRFormat
+		size   int
+	}{
+		// CMR + 3 ToC octets + 31 + 5 speech octets
+		{"octet-aligned", &AMRFormat{OctetAligned: true}, 1 + 3 + 31 + 5},
+		// 4 + 3*6 header bits + 244 + 39 speech bits, padded
+		{"bandwidth-efficient", &AMRFormat{}, (4 + 18 + 244 + 39 + 7) / 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := payload.Marshal(tt.format)
+			if len(data) != tt.size {
+				t.Fatalf("expected %d bytes, got %d", tt.size, len(data))
+			}
+			if data[0]>>4 != AMRNoRequest {
+				t.Errorf("expected CMR %d, got %d", AMRNoRequest, data[0]>>4)
+			}
+
+			parsed, err := ParseAMRPayload(data, tt.format)
+			if err != nil {
+				t.Fatalf("parse failed: %v", err)
+			}
+			if len(parsed.Frames) != 3 {
+				t.Fatalf("expected 3 frames, got %d", len(parsed.Frames))
+			}
+			for i, f := range parsed.Frames {
+				want := payload.Frames[i]
+				if f.Type != want.Type || !f.Quality || !bytes.Equal(f.Data, want.Data) {
+					t.Errorf("frame %d: expected %+v, got %+v", i, want, f)
+				}
+			}
+		})
+	}
+}
+
+func TestParseAMRPayload_Truncated(t *testing.T) {
+	format := &AMRFormat{OctetAligned: true}
+	data := (&AMRPayload{
+		CMR:    AMRNoRequest,
+		Frames: []AMRFrame{{Type: AMRMode122, Quality: true, Data: make([]byte, 31)}},
+	}).Marshal(format)
+
+	if _, err := ParseAMRPayload(data[:len(data)-1], format); err == nil {
+		t.Error("expected an error for a truncated frame")
+	}
+	if _, err := ParseAMRPayload([]byte{0xF0, 0x64}, format); err == nil {
+		t.Error("expected an error for an invalid frame type")
+	}
+}
+
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"net/http"
+	"sort"
+
+	"karl/internal"
+)
+
+// Capacity handlers - what is left under the admission caps, for load
+// balancers choosing a node for new calls
+
+// CapacityResponse represents the use of one admission cap. Without a cap,
+// max is 0 and remaining is left out
+type CapacityResponse struct {
+	Max       int64  `json:"max"`
+	InUse     int64  `json:"in_use"`
+	Remaining *int64 `json:"remaining,omitempty"`
+}
+
+// TenantCapacityResponse represents the use of a tenant's session cap
+type TenantCapacityResponse struct {
+	Tenant string `json:"tenant"`
+	CapacityResponse
+}
+
+// handleGetCapacity handles GET /api/v1/admin/capacity
+func (r *Router) handleGetCapacity(w http.ResponseWriter, req *http.Request) {
+	r.mu.RLock()
+	manager := r.sessionManager
+	r.mu.RUnlock()
+	if manager == nil {
+		r.errorResponse(w, http.StatusServiceUnavailable, "admission control not available")
+		return
+	}
+
+	capacity := manager.Capacity()
+	tenants := make([]TenantCapacityResponse, 0, len(capacity.Tenants))
+	for name, usage := range capacity.Tenants {
+		tenants = append(tenants, TenantCapacityResponse{Tenant: name, CapacityResponse: capacityToResponse(usage)})
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].Tenant < tenants[j].Tenant })
+
+	r.jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"sessions":      capacityToResponse(capacity.Sessions),
+		"bandwidth_bps": capacityToResponse(capacity.Bandwidth),
+		"tenants":       tenants,
+	})
+}
+
+func capacityToResponse(usage internal.CapacityUsage) CapacityResponse {
+	response := CapacityResponse{Max: usage.Max, InUse: usage.InUse}
+	if remaining := usage.Remaining(); remaining >= 0 {
+		response.Remaining = &remaining
+	}
+	return response
+}
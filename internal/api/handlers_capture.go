@@ -0,0 +1,204 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"karl/internal"
+)
+
+// Packet capture handlers - per-call PCAP files for troubleshooting
+
+// StartCaptureRequest represents a start capture request. Empty filters
+// capture every RTP and RTCP packet of the call; zero rotation settings use
+// the configured defaults.
+type StartCaptureRequest struct {
+	SessionID      string   `json:"session_id"`
+	CallID         string   `json:"call_id"`
+	SSRCs          []uint32 `json:"ssrcs,omitempty"`
+	PayloadTypes   []int    `json:"payload_types,omitempty"`
+	RotateSize     int64    `json:"rotate_size,omitempty"`     // Bytes per file
+	RotateInterval int      `json:"rotate_interval,omitempty"` // Seconds per file
+	MaxFiles       int      `json:"max_files,omitempty"`
+}
+
+// StopCaptureRequest represents a stop capture request
+type StopCaptureRequest struct {
+	SessionID string `json:"session_id"`
+	CallID    string `json:"call_id"`
+}
+
+// CaptureResponse represents a per-call capture in API responses
+type CaptureResponse struct {
+	CallID       string    `json:"call_id"`
+	Running      bool      `json:"running"`
+	StartTime    time.Time `json:"start_time"`
+	PacketCount  int64     `json:"packet_count"`
+	ByteCount    int64     `json:"byte_count"`
+	Files        []string  `json:"files"`
+	SSRCs        []uint32  `json:"ssrcs,omitempty"`
+	PayloadTypes []int     `json:"payload_types,omitempty"`
+}
+
+// handleStartCapture handles POST /api/v1/capture/start
+func (r *Router) handleStartCapture(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		r.errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	manager := r.captureManager()
+	if manager == nil {
+		r.errorResponse(w, http.StatusServiceUnavailable, "packet capture not available")
+		return
+	}
+
+	var startReq StartCaptureRequest
+	if err := json.NewDecoder(req.Body).Decode(&startReq); err != nil {
+		r.errorResponse(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	callID, ok := r.resolveCaptureCallID(w, startReq.SessionID, startReq.CallID)
+	if !ok {
+		return
+	}
+	if startReq.RotateSize < 0 || startReq.RotateInterval < 0 || startReq.MaxFiles < 0 {
+		r.errorResponse(w, http.StatusBadRequest, "rotation settings must not be negative")
+		return
+	}
+	payloadTypes := make([]uint8, 0, len(startReq.PayloadTypes))
+	for _, pt := range startReq.PayloadTypes {
+		if pt < 0 || pt > 127 {
+			r.errorResponse(w, http.StatusBadRequest, "payload types must be between 0 and 127")
+			return
+		}
+		payloadTypes = append(payloadTypes, uint8(pt))
+	}
+
+	capture, err := manager.StartCall(callID, &internal.CallCaptureOptions{
+		SSRCs:          startReq.SSRCs,
+		PayloadTypes:   payloadTypes,
+		RotateSize:     startReq.RotateSize,
+		RotateInterval: time.Duration(startReq.RotateInterval) * time.Second,
+		MaxFiles:       startReq.MaxFiles,
+	})
+	if errors.Is(err, internal.ErrCaptureAlreadyRunning) {
+		r.errorResponse(w, http.StatusConflict, "capture already running for call")
+		return
+	}
+	if err != nil {
+		r.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	r.jsonResponse(w, http.StatusOK, captureToResponse(capture))
+}
+
+// handleStopCapture handles POST /api/v1/capture/stop
+func (r *Router) handleStopCapture(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		r.errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	manager := r.captureManager()
+	if manager == nil {
+		r.errorResponse(w, http.StatusServiceUnavailable, "packet capture not available")
+		return
+	}
+
+	var stopReq StopCaptureRequest
+	if err := json.NewDecoder(req.Body).Decode(&stopReq); err != nil {
+		r.errorResponse(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	callID, ok := r.resolveCaptureCallID(w, stopReq.SessionID, stopReq.CallID)
+	if !ok {
+		return
+	}
+
+	capture := manager.GetCall(callID)
+	if capture == nil {
+		r.errorResponse(w, http.StatusNotFound, "active capture not found")
+		return
+	}
+	if err := manager.StopCall(callID); err != nil && !errors.Is(err, internal.ErrCaptureNotRunning) {
+		r.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	r.jsonResponse(w, http.StatusOK, captureToResponse(capture))
+}
+
+// handleListCaptures handles GET /api/v1/captures
+func (r *Router) handleListCaptures(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		r.errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	manager := r.captureManager()
+	if manager == nil {
+		r.errorResponse(w, http.StatusServiceUnavailable, "packet capture not available")
+		return
+	}
+
+	captures := manager.ListCalls()
+	response := make([]CaptureResponse, 0, len(captures))
+	for _, capture := range captures {
+		response = append(response, captureToResponse(capture))
+	}
+
+	r.jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"captures": response,
+		"total":    len(response),
+	})
+}
+
+func (r *Router) captureManager() *internal.CallCaptureManager {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.pcapManager
+}
+
+// resolveCaptureCallID returns the Call-ID named by a request, looking it up
+// from the session when only session_id is given
+func (r *Router) resolveCaptureCallID(w http.ResponseWriter, sessionID, callID string) (string, bool) {
+	if callID != "" {
+		return callID, true
+	}
+	if sessionID == "" {
+		r.errorResponse(w, http.StatusBadRequest, "session_id or call_id required")
+		return "", false
+	}
+
+	session, ok := r.sessionRegistry.GetSession(sessionID)
+	if !ok {
+		r.errorResponse(w, http.StatusNotFound, "session not found")
+		return "", false
+	}
+	return session.CallID, true
+}
+
+func captureToResponse(capture *internal.CallPCAPCapture) CaptureResponse {
+	stats := capture.GetStats()
+	options := capture.Options()
+	payloadTypes := make([]int, 0, len(options.PayloadTypes))
+	for _, pt := range options.PayloadTypes {
+		payloadTypes = append(payloadTypes, int(pt))
+	}
+	return CaptureResponse{
+		CallID:       capture.CallID(),
+		Running:      stats.Running,
+		StartTime:    capture.StartedAt(),
+		PacketCount:  stats.PacketCount,
+		ByteCount:    stats.ByteCount,
+		Files:        stats.Files,
+		SSRCs:        options.SSRCs,
+		PayloadTypes: payloadTypes,
+	}
+}
@@ -0,0 +1,304 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"karl/internal"
+)
+
+// Conference handlers - audio rooms mixed by Karl
+
+// CreateConferenceRequest represents a create room request
+type CreateConferenceRequest struct {
+	Name string `json:"name"`
+}
+
+// JoinConferenceRequest represents a request to join a call leg to a room
+type JoinConferenceRequest struct {
+	SessionID string  `json:"session_id"`
+	CallID    string  `json:"call_id"`
+	Leg       string  `json:"leg,omitempty"`  // caller (default) or callee
+	Gain      float64 `json:"gain,omitempty"` // Linear input gain, default 1.0
+	Muted     bool    `json:"muted,omitempty"`
+}
+
+// UpdateParticipantRequest represents a participant update; omitted fields
+// are left unchanged
+type UpdateParticipantRequest struct {
+	Gain  *float64 `json:"gain,omitempty"`
+	Muted *bool    `json:"muted,omitempty"`
+}
+
+// ConferenceResponse represents a conference room in API responses
+type ConferenceResponse struct {
+	Name          string                `json:"name"`
+	CreatedAt     time.Time             `json:"created_at"`
+	ActiveSpeaker string                `json:"active_speaker,omitempty"`
+	Participants  []ParticipantResponse `json:"participants"`
+}
+
+// ParticipantResponse represents a conference participant in API responses
+type ParticipantResponse struct {
+	ID         string    `json:"id"`
+	CallID     string    `json:"call_id"`
+	SessionID  string    `json:"session_id"`
+	Leg        string    `json:"leg"`
+	Codec      string    `json:"codec"`
+	Remote     string    `json:"remote"`
+	Gain       float64   `json:"gain"`
+	Muted      bool      `json:"muted"`
+	Speaking   bool      `json:"speaking"`
+	Level      float64   `json:"level_dbfs"`
+	JoinedAt   time.Time `json:"joined_at"`
+	PacketsIn  uint64    `json:"packets_in"`
+	PacketsOut uint64    `json:"packets_out"`
+}
+
+// handleListConferences handles GET /api/v1/conferences
+func (r *Router) handleListConferences(w http.ResponseWriter, req *http.Request) {
+	manager := r.conferences(w)
+	if manager == nil {
+		return
+	}
+
+	rooms := manager.ListRooms()
+	response := make([]ConferenceResponse, 0, len(rooms))
+	for _, room := range rooms {
+		response = append(response, conferenceToResponse(room.Info()))
+	}
+
+	r.jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"conferences": response,
+		"total":       len(response),
+	})
+}
+
+// handleCreateConference handles POST /api/v1/conferences
+func (r *Router) handleCreateConference(w http.ResponseWriter, req *http.Request) {
+	manager := r.conferences(w)
+	if manager == nil {
+		return
+	}
+
+	var createReq CreateConferenceRequest
+	if err := json.NewDecoder(req.Body).Decode(&createReq); err != nil {
+		r.errorResponse(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if createReq.Name == "" {
+		r.errorResponse(w, http.StatusBadRequest, "name required")
+		return
+	}
+
+	room, err := manager.CreateRoom(createReq.Name)
+	if errors.Is(err, internal.ErrConferenceExists) {
+		r.errorResponse(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		r.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	r.jsonResponse(w, http.StatusCreated, conferenceToResponse(room.Info()))
+}
+
+// handleGetConference handles GET /api/v1/conferences/{room}
+func (r *Router) handleGetConference(w http.ResponseWriter, req *http.Request) {
+	manager := r.conferences(w)
+	if manager == nil {
+		return
+	}
+
+	room, ok := manager.GetRoom(req.PathValue("room"))
+	if !ok {
+		r.errorResponse(w, http.StatusNotFound, "conference not found")
+		return
+	}
+
+	r.jsonResponse(w, http.StatusOK, conferenceToResponse(room.Info()))
+}
+
+// handleDeleteConference handles DELETE /api/v1/conferences/{room}
+func (r *Router) handleDeleteConference(w http.ResponseWriter, req *http.Request) {
+	manager := r.conferences(w)
+	if manager == nil {
+		return
+	}
+
+	if err := manager.DeleteRoom(req.PathValue("room")); err != nil {
+		r.errorResponse(w, http.StatusNotFound, "conference not found")
+		return
+	}
+
+	r.jsonResponse(w, http.StatusOK, SuccessResponse{
+		Success: true,
+		Message: "Conference deleted",
+	})
+}
+
+// handleJoinConference handles POST /api/v1/conferences/{room}/participants.
+// The room is created if it does not exist.
+func (r *Router) handleJoinConference(w http.ResponseWriter, req *http.Request) {
+	manager := r.conferences(w)
+	if manager == nil {
+		return
+	}
+
+	var joinReq JoinConferenceRequest
+	if err := json.NewDecoder(req.Body).Decode(&joinReq); err != nil {
+		r.errorResponse(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	var caller bool
+	switch joinReq.Leg {
+	case "", "caller":
+		caller = true
+	case "callee":
+		caller = false
+	default:
+		r.errorResponse(w, http.StatusBadRequest, "leg must be caller or callee")
+		return
+	}
+	if joinReq.Gain < 0 || joinReq.Gain > 10 {
+		r.errorResponse(w, http.StatusBadRequest, "gain must be between 0 and 10")
+		return
+	}
+
+	sessionID := joinReq.SessionID
+	if sessionID == "" && joinReq.CallID != "" {
+		if sessions := r.sessionRegistry.GetSessionByCallID(joinReq.CallID); len(sessions) > 0 {
+			sessionID = sessions[0].ID
+		}
+	}
+	if sessionID == "" {
+		if joinReq.CallID == "" {
+			r.errorResponse(w, http.StatusBadRequest, "session_id or call_id required")
+		} else {
+			r.errorResponse(w, http.StatusNotFound, "session not found")
+		}
+		return
+	}
+	if _, ok := r.sessionRegistry.GetSession(sessionID); !ok {
+		r.errorResponse(w, http.StatusNotFound, "session not found")
+		return
+	}
+
+	participant, err := manager.Join(req.PathValue("room"), sessionID, caller, internal.ConferenceParticipantOptions{
+		Gain:  joinReq.Gain,
+		Muted: joinReq.Muted,
+	})
+	switch {
+	case errors.Is(err, internal.ErrParticipantAlreadyJoined), errors.Is(err, internal.ErrConferenceFull):
+		r.errorResponse(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		r.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	r.jsonResponse(w, http.StatusCreated, participantToResponse(participant.Info()))
+}
+
+// handleUpdateParticipant handles PATCH /api/v1/conferences/{room}/participants/{id}
+func (r *Router) handleUpdateParticipant(w http.ResponseWriter, req *http.Request) {
+	manager := r.conferences(w)
+	if manager == nil {
+		return
+	}
+
+	var updateReq UpdateParticipantRequest
+	if err := json.NewDecoder(req.Body).Decode(&updateReq); err != nil {
+		r.errorResponse(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	roomName, participantID := req.PathValue("room"), req.PathValue("id")
+	err := manager.UpdateParticipant(roomName, participantID, updateReq.Gain, updateReq.Muted)
+	switch {
+	case errors.Is(err, internal.ErrConferenceNotFound), errors.Is(err, internal.ErrParticipantNotFound):
+		r.errorResponse(w, http.StatusNotFound, err.Error())
+		return
+	case err != nil:
+		r.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	room, ok := manager.GetRoom(roomName)
+	if !ok {
+		r.errorResponse(w, http.StatusNotFound, "conference not found")
+		return
+	}
+	participant, ok := room.GetParticipant(participantID)
+	if !ok {
+		r.errorResponse(w, http.StatusNotFound, "participant not found")
+		return
+	}
+
+	r.jsonResponse(w, http.StatusOK, participantToResponse(participant.Info()))
+}
+
+// handleLeaveConference handles DELETE /api/v1/conferences/{room}/participants/{id}
+func (r *Router) handleLeaveConference(w http.ResponseWriter, req *http.Request) {
+	manager := r.conferences(w)
+	if manager == nil {
+		return
+	}
+
+	if err := manager.Leave(req.PathValue("room"), req.PathValue("id")); err != nil {
+		r.errorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	r.jsonResponse(w, http.StatusOK, SuccessResponse{
+		Success: true,
+		Message: "Participant removed",
+	})
+}
+
+// conferences returns the conference manager, writing an error response
+// when conferencing is not enabled
+func (r *Router) conferences(w http.ResponseWriter) *internal.ConferenceManager {
+	r.mu.RLock()
+	manager := r.conferenceManager
+	r.mu.RUnlock()
+	if manager == nil {
+		r.errorResponse(w, http.StatusServiceUnavailable, "conferencing not available")
+	}
+	return manager
+}
+
+func conferenceToResponse(info internal.ConferenceRoomInfo) ConferenceResponse {
+	participants := make([]ParticipantResponse, 0, len(info.Participants))
+	for _, p := range info.Participants {
+		participants = append(participants, participantToResponse(p))
+	}
+	return ConferenceResponse{
+		Name:          info.Name,
+		CreatedAt:     info.CreatedAt,
+		ActiveSpeaker: info.ActiveSpeaker,
+		Participants:  participants,
+	}
+}
+
+func participantToResponse(info internal.ConferenceParticipantInfo) ParticipantResponse {
+	return ParticipantResponse{
+		ID:         info.ID,
+		CallID:     info.CallID,
+		SessionID:  info.SessionID,
+		Leg:        info.Leg,
+		Codec:      info.Codec,
+		Remote:     info.Remote,
+		Gain:       info.Gain,
+		Muted:      info.Muted,
+		Speaking:   info.Speaking,
+		Level:      info.Level,
+		JoinedAt:   info.JoinedAt,
+		PacketsIn:  info.PacketsIn,
+		PacketsOut: info.PacketsOut,
+	}
+}
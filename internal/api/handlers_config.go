@@ -0,0 +1,98 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"karl/internal"
+)
+
+// Runtime configuration handlers
+
+// LoggingResponse represents the logging settings in API responses
+type LoggingResponse struct {
+	internal.LoggingConfig
+	KnownComponents []string `json:"known_components"` // components that have logged so far
+}
+
+// handleGetLogging handles GET /api/v1/config/logging
+func (r *Router) handleGetLogging(w http.ResponseWriter, req *http.Request) {
+	r.jsonResponse(w, http.StatusOK, loggingResponse())
+}
+
+// handleSetLogging handles PUT /api/v1/config/logging. The body replaces
+// the default level, the format and every component override; omitted
+// fields fall back to info, the current format and no overrides
+func (r *Router) handleSetLogging(w http.ResponseWriter, req *http.Request) {
+	var config internal.LoggingConfig
+	if err := json.NewDecoder(req.Body).Decode(&config); err != nil {
+		r.errorResponse(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if err := internal.ConfigureLogging(&config); err != nil {
+		r.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	r.jsonResponse(w, http.StatusOK, loggingResponse())
+}
+
+func loggingResponse() LoggingResponse {
+	return LoggingResponse{
+		LoggingConfig:   internal.CurrentLoggingConfig(),
+		KnownComponents: internal.LogComponents(),
+	}
+}
+
+// TuningRequest represents a PATCH /api/v1/admin/tuning request; omitted
+// fields keep their current value
+type TuningRequest struct {
+	Workers     *int    `json:"workers"`
+	QueueSize   *int    `json:"queue_size"`
+	QueuePolicy *string `json:"queue_policy"`
+}
+
+// handleGetTuning handles GET /api/v1/admin/tuning
+func (r *Router) handleGetTuning(w http.ResponseWriter, req *http.Request) {
+	r.jsonResponse(w, http.StatusOK, internal.CurrentWorkerPoolTuning())
+}
+
+// handleGetPorts handles GET /api/v1/admin/ports
+func (r *Router) handleGetPorts(w http.ResponseWriter, req *http.Request) {
+	r.mu.RLock()
+	allocator := r.portAllocator
+	r.mu.RUnlock()
+	if allocator == nil {
+		r.errorResponse(w, http.StatusServiceUnavailable, "media ports are allocated by the NG listener, which is not running")
+		return
+	}
+	r.jsonResponse(w, http.StatusOK, allocator.State())
+}
+
+// handlePatchTuning handles PATCH /api/v1/admin/tuning. The worker pool and
+// its queues are resized in place; a later config reload that changes the
+// transport worker settings takes over again
+func (r *Router) handlePatchTuning(w http.ResponseWriter, req *http.Request) {
+	var body TuningRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		r.errorResponse(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	tuning := internal.CurrentWorkerPoolTuning()
+	if body.Workers != nil {
+		tuning.Workers = *body.Workers
+	}
+	if body.QueueSize != nil {
+		tuning.QueueSize = *body.QueueSize
+	}
+	if body.QueuePolicy != nil {
+		tuning.QueuePolicy = *body.QueuePolicy
+	}
+	if err := internal.TuneWorkerPool(tuning); err != nil {
+		r.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	r.jsonResponse(w, http.StatusOK, internal.CurrentWorkerPoolTuning())
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"karl/internal"
+)
+
+// Media control handlers - block, mute or force the direction of one leg
+// of a running call
+
+// UpdateMediaControlRequest represents a media control change; fields left
+// out keep their state
+type UpdateMediaControlRequest struct {
+	Blocked   *bool   `json:"blocked,omitempty"`
+	Muted     *bool   `json:"muted,omitempty"`
+	Direction *string `json:"direction,omitempty"` // sendrecv clears a forced direction
+}
+
+// MediaControlResponse represents the media control state of a leg
+type MediaControlResponse struct {
+	SessionID string `json:"session_id"`
+	Leg       string `json:"leg"`
+	Blocked   bool   `json:"blocked"`
+	Muted     bool   `json:"muted"`
+	Direction string `json:"direction"`
+}
+
+// handleGetMediaControl handles GET /api/v1/sessions/{id}/legs/{leg}/media
+func (r *Router) handleGetMediaControl(w http.ResponseWriter, req *http.Request) {
+	session, ok := r.sessionRegistry.GetSession(req.PathValue("id"))
+	if !ok {
+		r.errorResponse(w, http.StatusNotFound, "session not found")
+		return
+	}
+
+	control, err := session.MediaControl(req.PathValue("leg"))
+	if err != nil {
+		r.errorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	r.jsonResponse(w, http.StatusOK, mediaControlToResponse(session.ID, req.PathValue("leg"), control))
+}
+
+// handleUpdateMediaControl handles PATCH /api/v1/sessions/{id}/legs/{leg}/media
+func (r *Router) handleUpdateMediaControl(w http.ResponseWriter, req *http.Request) {
+	var updateReq UpdateMediaControlRequest
+	if err := json.NewDecoder(req.Body).Decode(&updateReq); err != nil {
+		r.errorResponse(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	session, ok := r.sessionRegistry.GetSession(req.PathValue("id"))
+	if !ok {
+		r.errorResponse(w, http.StatusNotFound, "session not found")
+		return
+	}
+
+	leg := req.PathValue("leg")
+	control, err := session.MediaControl(leg)
+	if err != nil {
+		r.errorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if updateReq.Blocked != nil {
+		control.Blocked = *updateReq.Blocked
+	}
+	if updateReq.Muted != nil {
+		control.Silenced = *updateReq.Muted
+	}
+	if updateReq.Direction != nil {
+		control.Direction = *updateReq.Direction
+	}
+
+	err = session.SetMediaControl(leg, control)
+	switch {
+	case errors.Is(err, internal.ErrUnknownLeg):
+		r.errorResponse(w, http.StatusNotFound, err.Error())
+		return
+	case err != nil:
+		r.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	r.mu.RLock()
+	manager := r.sessionManager
+	r.mu.RUnlock()
+	if manager != nil {
+		manager.UpdateOffload(session)
+	}
+
+	control, _ = session.MediaControl(leg)
+	r.jsonResponse(w, http.StatusOK, mediaControlToResponse(session.ID, leg, control))
+}
+
+func mediaControlToResponse(sessionID, leg string, control internal.LegMediaControl) MediaControlResponse {
+	direction := control.Direction
+	if direction == "" {
+		direction = internal.SDPDirectionSendRecv
+	}
+	return MediaControlResponse{
+		SessionID: sessionID,
+		Leg:       leg,
+		Blocked:   control.Blocked,
+		Muted:     control.Silenced,
+		Direction: direction,
+	}
+}
@@ -0,0 +1,168 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"karl/internal"
+)
+
+// Call parking handlers - detach a leg's media while its session stays
+// allocated, and re-attach it later, for transfers driven by the SIP proxy
+
+// ParkLegRequest represents a park request
+type ParkLegRequest struct {
+	Timeout int `json:"timeout,omitempty"` // Seconds before the call ends, sessions.park_timeout if unset
+}
+
+// UnparkLegRequest represents a re-attach request. Without an address the
+// leg keeps the endpoint of its last offer or answer
+type UnparkLegRequest struct {
+	Address string `json:"address,omitempty"` // host:port of the new endpoint's RTP
+	SSRC    uint32 `json:"ssrc,omitempty"`    // SSRC the new endpoint sends
+}
+
+// ParkResponse represents a parked leg in API responses
+type ParkResponse struct {
+	SessionID string    `json:"session_id"`
+	CallID    string    `json:"call_id"`
+	Leg       string    `json:"leg"`
+	Tag       string    `json:"tag"`
+	ParkedAt  time.Time `json:"parked_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Music     bool      `json:"music_on_hold"`
+}
+
+// handleListParked handles GET /api/v1/parked
+func (r *Router) handleListParked(w http.ResponseWriter, req *http.Request) {
+	manager := r.parking(w)
+	if manager == nil {
+		return
+	}
+
+	parked := manager.ListParked()
+	sort.Slice(parked, func(i, j int) bool { return parked[i].ParkedAt.Before(parked[j].ParkedAt) })
+	response := make([]ParkResponse, 0, len(parked))
+	for _, info := range parked {
+		response = append(response, parkToResponse(info))
+	}
+
+	r.jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"parked": response,
+		"total":  len(response),
+	})
+}
+
+// handleParkLeg handles POST /api/v1/sessions/{id}/legs/{leg}/park
+func (r *Router) handleParkLeg(w http.ResponseWriter, req *http.Request) {
+	manager := r.parking(w)
+	if manager == nil {
+		return
+	}
+
+	var parkReq ParkLegRequest
+	if err := json.NewDecoder(req.Body).Decode(&parkReq); err != nil && !errors.Is(err, io.EOF) {
+		r.errorResponse(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if parkReq.Timeout < 0 {
+		r.errorResponse(w, http.StatusBadRequest, "timeout must not be negative")
+		return
+	}
+	timeout := parkReq.Timeout
+	if timeout == 0 {
+		timeout = r.config.GetSessionConfig().ParkTimeout
+	}
+
+	session, ok := r.sessionRegistry.GetSession(req.PathValue("id"))
+	if !ok {
+		r.errorResponse(w, http.StatusNotFound, "session not found")
+		return
+	}
+
+	info, err := manager.ParkLeg(session, req.PathValue("leg"), time.Duration(timeout)*time.Second)
+	switch {
+	case errors.Is(err, internal.ErrUnknownLeg):
+		r.errorResponse(w, http.StatusNotFound, err.Error())
+		return
+	case err != nil:
+		r.errorResponse(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	r.jsonResponse(w, http.StatusOK, parkToResponse(info))
+}
+
+// handleUnparkLeg handles POST /api/v1/sessions/{id}/legs/{leg}/unpark
+func (r *Router) handleUnparkLeg(w http.ResponseWriter, req *http.Request) {
+	manager := r.parking(w)
+	if manager == nil {
+		return
+	}
+
+	var unparkReq UnparkLegRequest
+	if err := json.NewDecoder(req.Body).Decode(&unparkReq); err != nil && !errors.Is(err, io.EOF) {
+		r.errorResponse(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	var remote *net.UDPAddr
+	if unparkReq.Address != "" {
+		addr, err := net.ResolveUDPAddr("udp", unparkReq.Address)
+		if err != nil || addr.IP == nil || addr.Port == 0 {
+			r.errorResponse(w, http.StatusBadRequest, "invalid address, expected host:port")
+			return
+		}
+		remote = addr
+	}
+
+	session, ok := r.sessionRegistry.GetSession(req.PathValue("id"))
+	if !ok {
+		r.errorResponse(w, http.StatusNotFound, "session not found")
+		return
+	}
+
+	err := manager.UnparkLeg(session, req.PathValue("leg"), remote, unparkReq.SSRC)
+	switch {
+	case errors.Is(err, internal.ErrUnknownLeg):
+		r.errorResponse(w, http.StatusNotFound, err.Error())
+		return
+	case errors.Is(err, internal.ErrLegNotParked):
+		r.errorResponse(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		r.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	r.jsonResponse(w, http.StatusOK, SuccessResponse{
+		Success: true,
+		Message: "Leg re-attached",
+	})
+}
+
+func (r *Router) parking(w http.ResponseWriter) *internal.SessionManager {
+	r.mu.RLock()
+	manager := r.sessionManager
+	r.mu.RUnlock()
+	if manager == nil {
+		r.errorResponse(w, http.StatusServiceUnavailable, "call parking not available")
+	}
+	return manager
+}
+
+func parkToResponse(info internal.ParkInfo) ParkResponse {
+	return ParkResponse{
+		SessionID: info.SessionID,
+		CallID:    info.CallID,
+		Leg:       info.Leg,
+		Tag:       info.Tag,
+		ParkedAt:  info.ParkedAt,
+		ExpiresAt: info.ExpiresAt,
+		Music:     info.Music,
+	}
+}
@@ -5,31 +5,35 @@ import (
 	"net/http"
 	"strings"
 	"time"
+
+	"karl/internal"
 )
 
 // Recording handlers - these integrate with the recording system
 
 // RecordingResponse represents a recording in API responses
 type RecordingResponse struct {
-	ID          string    `json:"id"`
-	SessionID   string    `json:"session_id"`
-	CallID      string    `json:"call_id"`
-	Status      string    `json:"status"`
-	StartTime   time.Time `json:"start_time"`
-	EndTime     time.Time `json:"end_time,omitempty"`
-	Duration    float64   `json:"duration_seconds"`
-	FilePath    string    `json:"file_path,omitempty"`
-	FileSize    int64     `json:"file_size_bytes,omitempty"`
-	Format      string    `json:"format"`
-	Mode        string    `json:"mode"`
+	ID           string    `json:"id"`
+	SessionID    string    `json:"session_id"`
+	CallID       string    `json:"call_id"`
+	Status       string    `json:"status"`
+	StartTime    time.Time `json:"start_time"`
+	EndTime      time.Time `json:"end_time,omitempty"`
+	Duration     float64   `json:"duration_seconds"`
+	FilePath     string    `json:"file_path,omitempty"`
+	Files        []string  `json:"files,omitempty"`
+	MetadataPath string    `json:"metadata_path,omitempty"`
+	FileSize     int64     `json:"file_size_bytes,omitempty"`
+	Format       string    `json:"format"`
+	Mode         string    `json:"mode"`
 }
 
 // StartRecordingRequest represents a start recording request
 type StartRecordingRequest struct {
 	SessionID string            `json:"session_id"`
 	CallID    string            `json:"call_id"`
-	Format    string            `json:"format,omitempty"`  // wav, pcm
-	Mode      string            `json:"mode,omitempty"`    // mixed, stereo, separate
+	Format    string            `json:"format,omitempty"` // wav, pcm, opus
+	Mode      string            `json:"mode,omitempty"`   // mixed, stereo, separate
 	Metadata  map[string]string `json:"metadata,omitempty"`
 }
 
@@ -54,18 +58,20 @@ type RecordingManagerInterface interface {
 
 // RecordingInfo holds recording information
 type RecordingInfo struct {
-	ID        string
-	SessionID string
-	CallID    string
-	Status    string
-	StartTime time.Time
-	EndTime   time.Time
-	Duration  time.Duration
-	FilePath  string
-	FileSize  int64
-	Format    string
-	Mode      string
-	Metadata  map[string]string
+	ID           string
+	SessionID    string
+	CallID       string
+	Status       string
+	StartTime    time.Time
+	EndTime      time.Time
+	Duration     time.Duration
+	FilePath     string
+	Files        []string
+	MetadataPath string
+	FileSize     int64
+	Format       string
+	Mode         string
+	Metadata     map[string]string
 }
 
 // RecordingFilter holds filter options for listing recordings
@@ -101,14 +107,6 @@ func (r *Router) handleStartRecording(w http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	// Default values
-	if startReq.Format == "" {
-		startReq.Format = "wav"
-	}
-	if startReq.Mode == "" {
-		startReq.Mode = "mixed"
-	}
-
 	// If call_id provided, find session
 	sessionID := startReq.SessionID
 	if sessionID == "" && startReq.CallID != "" {
@@ -129,13 +127,25 @@ func (r *Router) handleStartRecording(w http.ResponseWriter, req *http.Request)
 		return
 	}
 
+	// A tenant's calls are recorded with its settings, into its directory
+	opts := internal.CallRecordingOptions{Format: startReq.Format, Mode: startReq.Mode, Metadata: startReq.Metadata}
+	if session, ok := r.sessionRegistry.GetSession(sessionID); ok {
+		if tenant := internal.SessionTenant(session); tenant != nil {
+			var err error
+			if opts, err = tenant.RecordingOptions(opts); err != nil {
+				r.errorResponse(w, http.StatusForbidden, err.Error())
+				return
+			}
+		}
+	}
+
 	// Start recording
 	recordingID, err := recordingManager.StartRecording(
 		sessionID,
 		startReq.CallID,
-		startReq.Format,
-		startReq.Mode,
-		startReq.Metadata,
+		opts.Format,
+		opts.Mode,
+		opts.Metadata,
 	)
 	if err != nil {
 		r.errorResponse(w, http.StatusInternalServerError, err.Error())
@@ -241,17 +251,19 @@ func (r *Router) handleListRecordings(w http.ResponseWriter, req *http.Request)
 	responses := make([]RecordingResponse, 0, len(recordings))
 	for _, rec := range recordings {
 		responses = append(responses, RecordingResponse{
-			ID:        rec.ID,
-			SessionID: rec.SessionID,
-			CallID:    rec.CallID,
-			Status:    rec.Status,
-			StartTime: rec.StartTime,
-			EndTime:   rec.EndTime,
-			Duration:  rec.Duration.Seconds(),
-			FilePath:  rec.FilePath,
-			FileSize:  rec.FileSize,
-			Format:    rec.Format,
-			Mode:      rec.Mode,
+			ID:           rec.ID,
+			SessionID:    rec.SessionID,
+			CallID:       rec.CallID,
+			Status:       rec.Status,
+			StartTime:    rec.StartTime,
+			EndTime:      rec.EndTime,
+			Duration:     rec.Duration.Seconds(),
+			FilePath:     rec.FilePath,
+			Files:        rec.Files,
+			MetadataPath: rec.MetadataPath,
+			FileSize:     rec.FileSize,
+			Format:       rec.Format,
+			Mode:         rec.Mode,
 		})
 	}
 
@@ -291,17 +303,19 @@ func (r *Router) handleRecordingByID(w http.ResponseWriter, req *http.Request) {
 	}
 
 	response := RecordingResponse{
-		ID:        rec.ID,
-		SessionID: rec.SessionID,
-		CallID:    rec.CallID,
-		Status:    rec.Status,
-		StartTime: rec.StartTime,
-		EndTime:   rec.EndTime,
-		Duration:  rec.Duration.Seconds(),
-		FilePath:  rec.FilePath,
-		FileSize:  rec.FileSize,
-		Format:    rec.Format,
-		Mode:      rec.Mode,
+		ID:           rec.ID,
+		SessionID:    rec.SessionID,
+		CallID:       rec.CallID,
+		Status:       rec.Status,
+		StartTime:    rec.StartTime,
+		EndTime:      rec.EndTime,
+		Duration:     rec.Duration.Seconds(),
+		FilePath:     rec.FilePath,
+		Files:        rec.Files,
+		MetadataPath: rec.MetadataPath,
+		FileSize:     rec.FileSize,
+		Format:       rec.Format,
+		Mode:         rec.Mode,
 	}
 
 	r.jsonResponse(w, http.StatusOK, response)
@@ -2,7 +2,9 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"sort"
 	"strings"
 	"time"
 
@@ -24,6 +26,21 @@ type SessionResponse struct {
 	Stats       *SessionStatsResp `json:"stats,omitempty"`
 	Flags       map[string]bool   `json:"flags,omitempty"`
 	Metadata    map[string]string `json:"metadata,omitempty"`
+
+	// Leg that is speaking, caller or callee, from its audio level header
+	// extension or the level of its G.711 audio
+	ActiveSpeaker string `json:"active_speaker,omitempty"`
+
+	// To-tags of the branches of a forked call that answered with early
+	// media, while none answered finally
+	Branches []string `json:"branches,omitempty"`
+
+	// Expected source check the call asked for, off, sdp, learn or any,
+	// empty when it follows media_acl
+	SourceCheck string `json:"source_check,omitempty"`
+
+	// Tenant the call belongs to
+	Tenant string `json:"tenant,omitempty"`
 }
 
 // LegResponse represents a call leg in API responses
@@ -42,6 +59,30 @@ type LegResponse struct {
 	BytesSent    uint64   `json:"bytes_sent"`
 	BytesRecv    uint64   `json:"bytes_recv"`
 	LastActivity string   `json:"last_activity"`
+
+	// Live quality of the media received from the leg
+	Codec        string  `json:"codec,omitempty"`
+	PacketsLost  int32   `json:"packets_lost"`
+	LossPercent  float64 `json:"loss_percent"`
+	BurstDensity float64 `json:"burst_density"`
+	GapDensity   float64 `json:"gap_density"`
+	JitterMs     float64 `json:"jitter_ms"`
+	RTTMs        float64 `json:"rtt_ms"`
+	RFactor      float64 `json:"r_factor"`
+	MOS          float64 `json:"mos"`
+
+	// The leg's view of the media sent to it, from RTCP XR
+	RemoteRFactor float64 `json:"remote_r_factor,omitempty"`
+	RemoteMOS     float64 `json:"remote_mos,omitempty"`
+
+	// Packets from the leg dropped by the expected source check
+	SourceRejected uint64 `json:"source_rejected,omitempty"`
+
+	// Media control set through the API or the ng protocol
+	Blocked         bool   `json:"blocked,omitempty"`
+	Muted           bool   `json:"muted,omitempty"`
+	ForcedDirection string `json:"forced_direction,omitempty"`
+	Parked          bool   `json:"parked,omitempty"`
 }
 
 // SessionStatsResp represents session statistics in API responses
@@ -53,6 +94,7 @@ type SessionStatsResp struct {
 	AvgJitter      float64   `json:"avg_jitter_ms"`
 	MaxJitter      float64   `json:"max_jitter_ms"`
 	RTT            float64   `json:"rtt_ms"`
+	RFactor        float64   `json:"r_factor"`
 	MOS            float64   `json:"mos"`
 }
 
@@ -88,6 +130,7 @@ func (r *Router) listSessions(w http.ResponseWriter, req *http.Request) {
 	// Query parameters for filtering
 	state := req.URL.Query().Get("state")
 	callID := req.URL.Query().Get("call_id")
+	tenant := req.URL.Query().Get("tenant")
 
 	for _, session := range sessions {
 		session.Lock()
@@ -101,6 +144,10 @@ func (r *Router) listSessions(w http.ResponseWriter, req *http.Request) {
 			session.Unlock()
 			continue
 		}
+		if tenant != "" && session.Tenant != tenant {
+			session.Unlock()
+			continue
+		}
 
 		resp := sessionToResponse(session)
 		session.Unlock()
@@ -132,8 +179,24 @@ func (r *Router) createSession(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// Create session
-	session := r.sessionRegistry.CreateSession(createReq.CallID, createReq.FromTag)
+	r.mu.RLock()
+	manager := r.sessionManager
+	r.mu.RUnlock()
+	if manager == nil {
+		r.errorResponse(w, http.StatusServiceUnavailable, "admission control not available")
+		return
+	}
+
+	// Create session within the admission caps
+	session, err := manager.AdmitSession(createReq.CallID, createReq.FromTag, nil)
+	if errors.Is(err, internal.ErrCapacityExceeded) {
+		r.errorResponse(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if err != nil {
+		r.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
 
 	// Set metadata
 	for k, v := range createReq.Metadata {
@@ -147,7 +210,8 @@ func (r *Router) createSession(w http.ResponseWriter, req *http.Request) {
 	r.jsonResponse(w, http.StatusCreated, resp)
 }
 
-// handleSessionByID handles GET/DELETE /api/v1/sessions/{id}
+// handleSessionByID handles GET/DELETE /api/v1/sessions/{id}. GET also
+// accepts a Call-ID in place of the session ID
 func (r *Router) handleSessionByID(w http.ResponseWriter, req *http.Request) {
 	// Extract session ID from path
 	path := req.URL.Path
@@ -169,9 +233,16 @@ func (r *Router) handleSessionByID(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-// getSession returns a single session
+// getSession returns a single session, looked up by session ID or else by
+// Call-ID. A forked call returns its first session; list the others with
+// GET /api/v1/sessions?call_id=
 func (r *Router) getSession(w http.ResponseWriter, req *http.Request, sessionID string) {
 	session, ok := r.sessionRegistry.GetSession(sessionID)
+	if !ok {
+		if sessions := r.sessionRegistry.GetSessionByCallID(sessionID); len(sessions) > 0 {
+			session, ok = sessions[0], true
+		}
+	}
 	if !ok {
 		r.errorResponse(w, http.StatusNotFound, "session not found")
 		return
@@ -207,6 +278,33 @@ func (r *Router) deleteSession(w http.ResponseWriter, req *http.Request, session
 	})
 }
 
+// handleRekeySession handles POST /api/v1/sessions/{id}/rekey
+func (r *Router) handleRekeySession(w http.ResponseWriter, req *http.Request) {
+	r.mu.RLock()
+	rekeyer := r.srtpRekeyer
+	r.mu.RUnlock()
+	if rekeyer == nil {
+		r.errorResponse(w, http.StatusServiceUnavailable, "SRTP rekeying not available")
+		return
+	}
+
+	sessionID := req.PathValue("id")
+	if _, ok := r.sessionRegistry.GetSession(sessionID); !ok {
+		r.errorResponse(w, http.StatusNotFound, "session not found")
+		return
+	}
+
+	if err := rekeyer.RekeySession(sessionID); err != nil {
+		r.errorResponse(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	r.jsonResponse(w, http.StatusOK, SuccessResponse{
+		Success: true,
+		Message: "SRTP keys rotated, re-INVITE required",
+	})
+}
+
 // handleActiveCalls handles GET /api/v1/active-calls
 func (r *Router) handleActiveCalls(w http.ResponseWriter, req *http.Request) {
 	if req.Method != http.MethodGet {
@@ -291,8 +389,11 @@ func (r *Router) handleStreams(w http.ResponseWriter, req *http.Request) {
 	})
 }
 
-// sessionToResponse converts a MediaSession to SessionResponse
+// sessionToResponse converts a MediaSession to SessionResponse with its
+// live quality. The caller must hold the session lock
 func sessionToResponse(session *internal.MediaSession) SessionResponse {
+	quality := session.LiveQuality()
+
 	resp := SessionResponse{
 		ID:        session.ID,
 		CallID:    session.CallID,
@@ -303,23 +404,26 @@ func sessionToResponse(session *internal.MediaSession) SessionResponse {
 		UpdatedAt: session.UpdatedAt,
 		Flags:     session.Flags,
 		Metadata:  session.Metadata,
+
+		ActiveSpeaker: session.ActiveSpeaker,
+		SourceCheck:   string(session.SourceCheck),
+		Tenant:        session.Tenant,
 	}
 
-	// Calculate duration
-	if session.State == internal.SessionStateActive && !session.Stats.ConnectTime.IsZero() {
-		resp.Duration = time.Since(session.Stats.ConnectTime).Seconds()
-	} else if session.Stats.Duration > 0 {
-		resp.Duration = session.Stats.Duration.Seconds()
+	resp.Duration = quality.Duration.Seconds()
+	for tag := range session.Branches {
+		resp.Branches = append(resp.Branches, tag)
 	}
+	sort.Strings(resp.Branches)
 
 	// Add caller leg
 	if session.CallerLeg != nil {
-		resp.CallerLeg = legToResponse(session.CallerLeg)
+		resp.CallerLeg = legToResponse(session.CallerLeg, quality.Caller)
 	}
 
 	// Add callee leg
 	if session.CalleeLeg != nil {
-		resp.CalleeLeg = legToResponse(session.CalleeLeg)
+		resp.CalleeLeg = legToResponse(session.CalleeLeg, quality.Callee)
 	}
 
 	// Add stats
@@ -327,11 +431,12 @@ func sessionToResponse(session *internal.MediaSession) SessionResponse {
 		resp.Stats = &SessionStatsResp{
 			StartTime:      session.Stats.StartTime,
 			ConnectTime:    session.Stats.ConnectTime,
-			Duration:       session.Stats.Duration.Seconds(),
+			Duration:       quality.Duration.Seconds(),
 			PacketLossRate: session.Stats.PacketLossRate,
 			AvgJitter:      session.Stats.AvgJitter * 1000, // Convert to ms
 			MaxJitter:      session.Stats.MaxJitter * 1000,
 			RTT:            session.Stats.RTT * 1000,
+			RFactor:        session.Stats.RFactor,
 			MOS:            session.Stats.MOS,
 		}
 	}
@@ -340,7 +445,7 @@ func sessionToResponse(session *internal.MediaSession) SessionResponse {
 }
 
 // legToResponse converts a CallLeg to LegResponse
-func legToResponse(leg *internal.CallLeg) *LegResponse {
+func legToResponse(leg *internal.CallLeg, quality internal.LegQuality) *LegResponse {
 	codecs := make([]string, len(leg.Codecs))
 	for i, c := range leg.Codecs {
 		codecs[i] = c.Name
@@ -369,5 +474,24 @@ func legToResponse(leg *internal.CallLeg) *LegResponse {
 		BytesSent:    leg.BytesSent,
 		BytesRecv:    leg.BytesRecv,
 		LastActivity: leg.LastActivity.Format(time.RFC3339),
+		Codec:        quality.Codec,
+		PacketsLost:  quality.PacketsLost,
+		LossPercent:  quality.LossPercent,
+		BurstDensity: quality.BurstDensity,
+		GapDensity:   quality.GapDensity,
+		JitterMs:     quality.JitterMs,
+		RTTMs:        quality.RTTMs,
+		RFactor:      quality.RFactor,
+		MOS:          quality.MOS,
+
+		RemoteRFactor: quality.RemoteRFactor,
+		RemoteMOS:     quality.RemoteMOS,
+
+		SourceRejected: leg.SourceRejected,
+
+		Blocked:         leg.MediaBlocked,
+		Muted:           leg.Silenced,
+		ForcedDirection: leg.ForcedDirection,
+		Parked:          leg.Parked,
 	}
 }
@@ -0,0 +1,217 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"karl/internal"
+)
+
+// SFU handlers - forwarded WebRTC video and simulcast layer selection
+
+// SetLayerRequest pins a subscriber to one simulcast layer of a track, or
+// returns it to automatic selection with layer "auto"
+type SetLayerRequest struct {
+	TrackID string `json:"track_id"`
+	Layer   string `json:"layer"`
+}
+
+// SFUTrackResponse represents a published track in API responses
+type SFUTrackResponse struct {
+	ID          string             `json:"id"`
+	StreamID    string             `json:"stream_id"`
+	PublisherID string             `json:"publisher_id"`
+	MimeType    string             `json:"mime_type"`
+	Layers      []SFULayerResponse `json:"layers"`
+	Subscribers int                `json:"subscribers"`
+}
+
+// SFULayerResponse represents a simulcast layer in API responses
+type SFULayerResponse struct {
+	RID     string `json:"rid"`
+	SSRC    uint32 `json:"ssrc"`
+	Bitrate uint64 `json:"bitrate"`
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+	Active  bool   `json:"active"`
+}
+
+// SFUSubscriberResponse represents a subscriber in API responses
+type SFUSubscriberResponse struct {
+	ID             string                 `json:"id"`
+	Estimate       uint64                 `json:"estimate"`
+	EstimateSource string                 `json:"estimate_source,omitempty"`
+	Tracks         []SFUDownTrackResponse `json:"tracks"`
+}
+
+// SFUDownTrackResponse represents a track forwarded to a subscriber
+type SFUDownTrackResponse struct {
+	TrackID      string `json:"track_id"`
+	PublisherID  string `json:"publisher_id"`
+	CurrentLayer string `json:"current_layer"`
+	TargetLayer  string `json:"target_layer,omitempty"`
+	PinnedLayer  string `json:"pinned_layer,omitempty"`
+	Estimate     uint64 `json:"estimate"`
+	Packets      uint64 `json:"packets"`
+	Bytes        uint64 `json:"bytes"`
+	PLIsReceived uint64 `json:"plis_received"`
+	FIRsReceived uint64 `json:"firs_received"`
+}
+
+// handleListSFUTracks handles GET /api/v1/sfu/tracks
+func (r *Router) handleListSFUTracks(w http.ResponseWriter, req *http.Request) {
+	sfu := r.sfu(w)
+	if sfu == nil {
+		return
+	}
+
+	tracks := sfu.ListTracks()
+	response := make([]SFUTrackResponse, 0, len(tracks))
+	for _, track := range tracks {
+		response = append(response, sfuTrackToResponse(track.Info()))
+	}
+
+	r.jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"tracks": response,
+		"total":  len(response),
+	})
+}
+
+// handleListSFUSubscribers handles GET /api/v1/sfu/subscribers
+func (r *Router) handleListSFUSubscribers(w http.ResponseWriter, req *http.Request) {
+	sfu := r.sfu(w)
+	if sfu == nil {
+		return
+	}
+
+	ids := sfu.ListSubscribers()
+	response := make([]SFUSubscriberResponse, 0, len(ids))
+	for _, id := range ids {
+		info, err := sfu.SubscriberInfo(id)
+		if err != nil {
+			continue // Left while listing
+		}
+		response = append(response, sfuSubscriberToResponse(info))
+	}
+
+	r.jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"subscribers": response,
+		"total":       len(response),
+	})
+}
+
+// handleGetSFUSubscriber handles GET /api/v1/sfu/subscribers/{id}
+func (r *Router) handleGetSFUSubscriber(w http.ResponseWriter, req *http.Request) {
+	sfu := r.sfu(w)
+	if sfu == nil {
+		return
+	}
+
+	info, err := sfu.SubscriberInfo(req.PathValue("id"))
+	if err != nil {
+		r.errorResponse(w, http.StatusNotFound, "subscriber not found")
+		return
+	}
+
+	r.jsonResponse(w, http.StatusOK, sfuSubscriberToResponse(info))
+}
+
+// handleSetSFULayer handles PUT /api/v1/sfu/subscribers/{id}/layer
+func (r *Router) handleSetSFULayer(w http.ResponseWriter, req *http.Request) {
+	sfu := r.sfu(w)
+	if sfu == nil {
+		return
+	}
+
+	var layerReq SetLayerRequest
+	if err := json.NewDecoder(req.Body).Decode(&layerReq); err != nil {
+		r.errorResponse(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if layerReq.TrackID == "" || layerReq.Layer == "" {
+		r.errorResponse(w, http.StatusBadRequest, "track_id and layer required")
+		return
+	}
+
+	subscriberID := req.PathValue("id")
+	var err error
+	if layerReq.Layer == "auto" {
+		err = sfu.UnpinLayer(subscriberID, layerReq.TrackID)
+	} else {
+		err = sfu.PinLayer(subscriberID, layerReq.TrackID, layerReq.Layer)
+	}
+	switch {
+	case errors.Is(err, internal.ErrSFUSubscriberNotFound), errors.Is(err, internal.ErrSFUTrackNotFound):
+		r.errorResponse(w, http.StatusNotFound, err.Error())
+		return
+	case err != nil:
+		r.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	info, err := sfu.SubscriberInfo(subscriberID)
+	if err != nil {
+		r.errorResponse(w, http.StatusNotFound, "subscriber not found")
+		return
+	}
+
+	r.jsonResponse(w, http.StatusOK, sfuSubscriberToResponse(info))
+}
+
+// sfu returns the SFU, writing an error response when WebRTC is not running
+func (r *Router) sfu(w http.ResponseWriter) *internal.SFU {
+	r.mu.RLock()
+	sfu := r.sfuUnit
+	r.mu.RUnlock()
+	if sfu == nil {
+		r.errorResponse(w, http.StatusServiceUnavailable, "SFU not available")
+	}
+	return sfu
+}
+
+func sfuTrackToResponse(info internal.SFUTrackInfo) SFUTrackResponse {
+	layers := make([]SFULayerResponse, 0, len(info.Layers))
+	for _, layer := range info.Layers {
+		layers = append(layers, SFULayerResponse{
+			RID:     layer.RID,
+			SSRC:    layer.SSRC,
+			Bitrate: layer.Bitrate,
+			Packets: layer.Packets,
+			Bytes:   layer.Bytes,
+			Active:  layer.Active,
+		})
+	}
+	return SFUTrackResponse{
+		ID:          info.ID,
+		StreamID:    info.StreamID,
+		PublisherID: info.PublisherID,
+		MimeType:    info.MimeType,
+		Layers:      layers,
+		Subscribers: info.Subscribers,
+	}
+}
+
+func sfuSubscriberToResponse(info internal.SFUSubscriberInfo) SFUSubscriberResponse {
+	tracks := make([]SFUDownTrackResponse, 0, len(info.Tracks))
+	for _, dt := range info.Tracks {
+		tracks = append(tracks, SFUDownTrackResponse{
+			TrackID:      dt.TrackID,
+			PublisherID:  dt.PublisherID,
+			CurrentLayer: dt.CurrentLayer,
+			TargetLayer:  dt.TargetLayer,
+			PinnedLayer:  dt.PinnedLayer,
+			Estimate:     dt.Estimate,
+			Packets:      dt.Packets,
+			Bytes:        dt.Bytes,
+			PLIsReceived: dt.PLIsReceived,
+			FIRsReceived: dt.FIRsReceived,
+		})
+	}
+	return SFUSubscriberResponse{
+		ID:             info.ID,
+		Estimate:       info.Estimate,
+		EstimateSource: info.EstimateSource,
+		Tracks:         tracks,
+	}
+}
@@ -281,6 +281,11 @@ func (r *Router) handleHealth(w http.ResponseWriter, req *http.Request) {
 
 	health["components"] = components
 
+	// Per-proxy availability and OPTIONS latency
+	if proxies := internal.GetSIPProxyStatuses(); len(proxies) > 0 {
+		health["sip_proxies"] = proxies
+	}
+
 	// Add basic metrics
 	health["metrics"] = map[string]interface{}{
 		"active_calls": r.sessionRegistry.GetActiveCount(),
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"net/http"
+
+	"karl/internal"
+)
+
+// Tenant handlers - the tenants calls are served for and their sessions
+
+// TenantResponse represents a tenant in API responses
+type TenantResponse struct {
+	Name         string `json:"name"`
+	MetricsLabel string `json:"metrics_label"`
+	MinPort      int    `json:"min_port,omitempty"`
+	MaxPort      int    `json:"max_port,omitempty"`
+	OfferRate    int    `json:"offer_rate,omitempty"`
+	MaxSessions  int    `json:"max_sessions,omitempty"`
+	Sessions     int    `json:"sessions"`
+}
+
+// handleListTenants handles GET /api/v1/admin/tenants
+func (r *Router) handleListTenants(w http.ResponseWriter, req *http.Request) {
+	sessions := make(map[string]int)
+	for _, session := range r.sessionRegistry.ListSessions() {
+		session.RLock()
+		if session.Tenant != "" {
+			sessions[session.Tenant]++
+		}
+		session.RUnlock()
+	}
+
+	tenants := internal.ListTenants()
+	response := make([]TenantResponse, 0, len(tenants))
+	for _, tenant := range tenants {
+		response = append(response, TenantResponse{
+			Name:         tenant.Name,
+			MetricsLabel: tenant.Label(),
+			MinPort:      tenant.Config.MinPort,
+			MaxPort:      tenant.Config.MaxPort,
+			OfferRate:    tenant.Config.OfferRate,
+			MaxSessions:  tenant.Config.MaxSessions,
+			Sessions:     sessions[tenant.Name],
+		})
+	}
+
+	r.jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"tenants": response,
+		"total":   len(response),
+	})
+}
@@ -0,0 +1,164 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"karl/internal"
+)
+
+// Transcription handlers - call audio forked to a speech-to-text engine
+
+// StartTranscriptionRequest represents a start transcription request
+type StartTranscriptionRequest struct {
+	SessionID string   `json:"session_id"`
+	CallID    string   `json:"call_id"`
+	Language  string   `json:"language,omitempty"` // Overrides the configured language
+	Legs      []string `json:"legs,omitempty"`     // caller, callee or both if omitted
+}
+
+// TranscriptionResponse represents a transcribed call in API responses
+type TranscriptionResponse struct {
+	CallID    string                     `json:"call_id"`
+	Language  string                     `json:"language,omitempty"`
+	StartedAt time.Time                  `json:"started_at"`
+	Legs      []TranscriptionLegResponse `json:"legs"`
+}
+
+// TranscriptionLegResponse represents the stream of one leg in API responses
+type TranscriptionLegResponse struct {
+	Leg           string `json:"leg"`
+	State         string `json:"state"`
+	Error         string `json:"error,omitempty"`
+	FramesSent    uint64 `json:"frames_sent"`
+	FramesDropped uint64 `json:"frames_dropped"`
+	Segments      uint64 `json:"segments"`
+	Transcript    string `json:"transcript,omitempty"` // Last final segment
+}
+
+// handleListTranscriptions handles GET /api/v1/transcriptions
+func (r *Router) handleListTranscriptions(w http.ResponseWriter, req *http.Request) {
+	manager := r.transcriptions(w)
+	if manager == nil {
+		return
+	}
+
+	calls := manager.ListCalls()
+	response := make([]TranscriptionResponse, 0, len(calls))
+	for _, info := range calls {
+		response = append(response, transcriptionToResponse(info))
+	}
+
+	r.jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"transcriptions": response,
+		"total":          len(response),
+	})
+}
+
+// handleStartTranscription handles POST /api/v1/transcriptions
+func (r *Router) handleStartTranscription(w http.ResponseWriter, req *http.Request) {
+	manager := r.transcriptions(w)
+	if manager == nil {
+		return
+	}
+
+	var startReq StartTranscriptionRequest
+	if err := json.NewDecoder(req.Body).Decode(&startReq); err != nil {
+		r.errorResponse(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	callID, ok := r.resolveCaptureCallID(w, startReq.SessionID, startReq.CallID)
+	if !ok {
+		return
+	}
+	if len(r.sessionRegistry.GetSessionByCallID(callID)) == 0 {
+		r.errorResponse(w, http.StatusNotFound, "call not found")
+		return
+	}
+
+	info, err := manager.StartCall(callID, &internal.TranscriptionOptions{
+		Language: startReq.Language,
+		Legs:     startReq.Legs,
+	})
+	switch {
+	case errors.Is(err, internal.ErrTranscriptionRunning), errors.Is(err, internal.ErrTranscriptionLimit):
+		r.errorResponse(w, http.StatusConflict, err.Error())
+		return
+	case errors.Is(err, internal.ErrTranscriptionDisabled):
+		r.errorResponse(w, http.StatusServiceUnavailable, err.Error())
+		return
+	case err != nil:
+		r.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	r.jsonResponse(w, http.StatusCreated, transcriptionToResponse(*info))
+}
+
+// handleGetTranscription handles GET /api/v1/transcriptions/{call_id}
+func (r *Router) handleGetTranscription(w http.ResponseWriter, req *http.Request) {
+	manager := r.transcriptions(w)
+	if manager == nil {
+		return
+	}
+
+	info, ok := manager.GetCall(req.PathValue("call_id"))
+	if !ok {
+		r.errorResponse(w, http.StatusNotFound, "transcription not found")
+		return
+	}
+
+	r.jsonResponse(w, http.StatusOK, transcriptionToResponse(*info))
+}
+
+// handleStopTranscription handles DELETE /api/v1/transcriptions/{call_id}
+func (r *Router) handleStopTranscription(w http.ResponseWriter, req *http.Request) {
+	manager := r.transcriptions(w)
+	if manager == nil {
+		return
+	}
+
+	if err := manager.StopCall(req.PathValue("call_id")); err != nil {
+		r.errorResponse(w, http.StatusNotFound, "transcription not found")
+		return
+	}
+
+	r.jsonResponse(w, http.StatusOK, SuccessResponse{
+		Success: true,
+		Message: "Transcription stopped",
+	})
+}
+
+func (r *Router) transcriptions(w http.ResponseWriter) *internal.TranscriptionManager {
+	r.mu.RLock()
+	manager := r.transcriber
+	r.mu.RUnlock()
+	if manager == nil {
+		r.errorResponse(w, http.StatusServiceUnavailable, "transcription not available")
+	}
+	return manager
+}
+
+func transcriptionToResponse(info internal.TranscriptionInfo) TranscriptionResponse {
+	legs := make([]TranscriptionLegResponse, 0, len(info.Legs))
+	for _, leg := range info.Legs {
+		legs = append(legs, TranscriptionLegResponse{
+			Leg:           leg.Leg,
+			State:         leg.State,
+			Error:         leg.Error,
+			FramesSent:    leg.FramesSent,
+			FramesDropped: leg.FramesDropped,
+			Segments:      leg.Segments,
+			Transcript:    leg.Transcript,
+		})
+	}
+	return TranscriptionResponse{
+		CallID:    info.CallID,
+		Language:  info.Language,
+		StartedAt: info.StartedAt,
+		Legs:      legs,
+	}
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"karl/internal"
+)
+
+// WebRTC signaling handlers - tokens and sessions of browser clients
+
+// maxSignalingTokenTTL bounds the lifetime a client may ask for
+const maxSignalingTokenTTL = time.Hour
+
+// IssueTokenRequest represents a signaling token request
+type IssueTokenRequest struct {
+	TTLSeconds int `json:"ttl_seconds,omitempty"` // Default 60
+}
+
+// IssueTokenResponse represents an issued signaling token
+type IssueTokenResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Path      string    `json:"path"`
+}
+
+// SignalingSessionResponse represents a browser session in API responses
+type SignalingSessionResponse struct {
+	ID          string    `json:"id"`
+	RemoteAddr  string    `json:"remote_addr"`
+	ConnectedAt time.Time `json:"connected_at"`
+	State       string    `json:"state"`
+}
+
+// handleIssueSignalingToken handles POST /api/v1/webrtc/tokens
+func (r *Router) handleIssueSignalingToken(w http.ResponseWriter, req *http.Request) {
+	signaling := r.signalingServer(w)
+	if signaling == nil {
+		return
+	}
+
+	var tokenReq IssueTokenRequest
+	if err := json.NewDecoder(req.Body).Decode(&tokenReq); err != nil && err != io.EOF {
+		r.errorResponse(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	ttl := time.Duration(tokenReq.TTLSeconds) * time.Second
+	if ttl < 0 || ttl > maxSignalingTokenTTL {
+		r.errorResponse(w, http.StatusBadRequest, "ttl_seconds must be between 0 and 3600")
+		return
+	}
+
+	token, expires, err := signaling.IssueToken(ttl)
+	if err != nil {
+		r.errorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	r.jsonResponse(w, http.StatusCreated, IssueTokenResponse{
+		Token:     token,
+		ExpiresAt: expires,
+		Path:      internal.SignalingPath + "?token=" + token,
+	})
+}
+
+// handleListSignalingSessions handles GET /api/v1/webrtc/sessions
+func (r *Router) handleListSignalingSessions(w http.ResponseWriter, req *http.Request) {
+	signaling := r.signalingServer(w)
+	if signaling == nil {
+		return
+	}
+
+	sessions := signaling.ListSessions()
+	response := make([]SignalingSessionResponse, 0, len(sessions))
+	for _, info := range sessions {
+		response = append(response, SignalingSessionResponse{
+			ID:          info.ID,
+			RemoteAddr:  info.RemoteAddr,
+			ConnectedAt: info.ConnectedAt,
+			State:       info.State,
+		})
+	}
+
+	r.jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"sessions": response,
+		"total":    len(response),
+	})
+}
+
+// handleCloseSignalingSession handles DELETE /api/v1/webrtc/sessions/{id}
+func (r *Router) handleCloseSignalingSession(w http.ResponseWriter, req *http.Request) {
+	signaling := r.signalingServer(w)
+	if signaling == nil {
+		return
+	}
+
+	if err := signaling.CloseSession(req.PathValue("id")); err != nil {
+		r.errorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	r.jsonResponse(w, http.StatusOK, SuccessResponse{
+		Success: true,
+		Message: "WebRTC session closed",
+	})
+}
+
+// signalingServer returns the signaling server, writing an error response
+// when WebRTC signaling is not running
+func (r *Router) signalingServer(w http.ResponseWriter) *internal.SignalingServer {
+	r.mu.RLock()
+	signaling := r.signaling
+	r.mu.RUnlock()
+	if signaling == nil {
+		r.errorResponse(w, http.StatusServiceUnavailable, "WebRTC signaling not available")
+	}
+	return signaling
+}
@@ -40,10 +40,18 @@ var (
 
 // Router is the main API router
 type Router struct {
-	config          *internal.Config
-	sessionRegistry *internal.SessionRegistry
-	authenticator   *auth.Authenticator
-	rateLimiter     *auth.RateLimiter
+	config            *internal.Config
+	sessionRegistry   *internal.SessionRegistry
+	srtpRekeyer       *internal.SRTPRekeyer
+	pcapManager       *internal.CallCaptureManager
+	conferenceManager *internal.ConferenceManager
+	transcriber       *internal.TranscriptionManager
+	sfuUnit           *internal.SFU
+	signaling         *internal.SignalingServer
+	portAllocator     *internal.PortAllocator
+	sessionManager    *internal.SessionManager
+	authenticator     *auth.Authenticator
+	rateLimiter       *auth.RateLimiter
 
 	mux    *http.ServeMux
 	server *http.Server
@@ -60,7 +68,13 @@ func NewRouter(config *internal.Config, sessionRegistry *internal.SessionRegistr
 
 	// Initialize authenticator if auth is enabled
 	if config.API != nil && config.API.AuthEnabled {
-		r.authenticator = auth.NewAuthenticator(config.Database.MySQLDSN)
+		// API keys are looked up with MySQL queries; on PostgreSQL they
+		// are kept in memory only
+		keyDSN := ""
+		if driver, dsn := internal.DatabaseDriver(config.Database.DatabaseDSN()); driver == internal.DriverMySQL {
+			keyDSN = dsn
+		}
+		r.authenticator = auth.NewAuthenticator(keyDSN)
 	}
 
 	// Initialize rate limiter
@@ -76,6 +90,63 @@ func NewRouter(config *internal.Config, sessionRegistry *internal.SessionRegistr
 	return r
 }
 
+// SetSRTPRekeyer enables the per-session SRTP rekey endpoint
+func (r *Router) SetSRTPRekeyer(rekeyer *internal.SRTPRekeyer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.srtpRekeyer = rekeyer
+}
+
+// SetPCAPCaptureManager enables the per-call packet capture endpoints
+func (r *Router) SetPCAPCaptureManager(manager *internal.CallCaptureManager) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pcapManager = manager
+}
+
+// SetConferenceManager enables the conference endpoints
+func (r *Router) SetConferenceManager(manager *internal.ConferenceManager) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.conferenceManager = manager
+}
+
+// SetTranscriptionManager enables the transcription endpoints
+func (r *Router) SetTranscriptionManager(manager *internal.TranscriptionManager) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.transcriber = manager
+}
+
+// SetSFU enables the SFU track and subscriber endpoints
+func (r *Router) SetSFU(sfu *internal.SFU) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sfuUnit = sfu
+}
+
+// SetSignalingServer enables the WebRTC signaling token and session endpoints
+func (r *Router) SetSignalingServer(signaling *internal.SignalingServer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.signaling = signaling
+}
+
+// SetSessionManager lets media control changes move calls into or out of
+// kernel offload
+func (r *Router) SetSessionManager(manager *internal.SessionManager) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessionManager = manager
+}
+
+// SetPortAllocator enables the media port pool endpoint
+func (r *Router) SetPortAllocator(allocator *internal.PortAllocator) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.portAllocator = allocator
+}
+
 // registerRoutes registers all API routes
 func (r *Router) registerRoutes() {
 	// Health and metrics (no auth)
@@ -85,6 +156,12 @@ func (r *Router) registerRoutes() {
 	// Session endpoints
 	r.mux.HandleFunc("/api/v1/sessions", r.wrap(r.handleSessions, []string{"session:read", "session:write"}))
 	r.mux.HandleFunc("/api/v1/sessions/", r.wrap(r.handleSessionByID, []string{"session:read", "session:delete"}))
+	r.mux.HandleFunc("POST /api/v1/sessions/{id}/rekey", r.wrap(r.handleRekeySession, []string{"session:write"}))
+	r.mux.HandleFunc("GET /api/v1/sessions/{id}/legs/{leg}/media", r.wrap(r.handleGetMediaControl, []string{"session:read"}))
+	r.mux.HandleFunc("PATCH /api/v1/sessions/{id}/legs/{leg}/media", r.wrap(r.handleUpdateMediaControl, []string{"session:write"}))
+	r.mux.HandleFunc("POST /api/v1/sessions/{id}/legs/{leg}/park", r.wrap(r.handleParkLeg, []string{"session:write"}))
+	r.mux.HandleFunc("POST /api/v1/sessions/{id}/legs/{leg}/unpark", r.wrap(r.handleUnparkLeg, []string{"session:write"}))
+	r.mux.HandleFunc("GET /api/v1/parked", r.wrap(r.handleListParked, []string{"session:read"}))
 
 	// Statistics endpoints
 	r.mux.HandleFunc("/api/v1/stats", r.wrap(r.handleStats, []string{"stats:read"}))
@@ -96,6 +173,46 @@ func (r *Router) registerRoutes() {
 	r.mux.HandleFunc("/api/v1/recordings", r.wrap(r.handleListRecordings, []string{"recording:read"}))
 	r.mux.HandleFunc("/api/v1/recordings/", r.wrap(r.handleRecordingByID, []string{"recording:read"}))
 
+	// Packet capture endpoints
+	r.mux.HandleFunc("/api/v1/capture/start", r.wrap(r.handleStartCapture, []string{"recording:write"}))
+	r.mux.HandleFunc("/api/v1/capture/stop", r.wrap(r.handleStopCapture, []string{"recording:write"}))
+	r.mux.HandleFunc("/api/v1/captures", r.wrap(r.handleListCaptures, []string{"recording:read"}))
+
+	// Conference endpoints
+	r.mux.HandleFunc("GET /api/v1/conferences", r.wrap(r.handleListConferences, []string{"session:read"}))
+	r.mux.HandleFunc("POST /api/v1/conferences", r.wrap(r.handleCreateConference, []string{"session:write"}))
+	r.mux.HandleFunc("GET /api/v1/conferences/{room}", r.wrap(r.handleGetConference, []string{"session:read"}))
+	r.mux.HandleFunc("DELETE /api/v1/conferences/{room}", r.wrap(r.handleDeleteConference, []string{"session:write"}))
+	r.mux.HandleFunc("POST /api/v1/conferences/{room}/participants", r.wrap(r.handleJoinConference, []string{"session:write"}))
+	r.mux.HandleFunc("PATCH /api/v1/conferences/{room}/participants/{id}", r.wrap(r.handleUpdateParticipant, []string{"session:write"}))
+	r.mux.HandleFunc("DELETE /api/v1/conferences/{room}/participants/{id}", r.wrap(r.handleLeaveConference, []string{"session:write"}))
+
+	// Transcription endpoints
+	r.mux.HandleFunc("GET /api/v1/transcriptions", r.wrap(r.handleListTranscriptions, []string{"recording:read"}))
+	r.mux.HandleFunc("POST /api/v1/transcriptions", r.wrap(r.handleStartTranscription, []string{"recording:write"}))
+	r.mux.HandleFunc("GET /api/v1/transcriptions/{call_id}", r.wrap(r.handleGetTranscription, []string{"recording:read"}))
+	r.mux.HandleFunc("DELETE /api/v1/transcriptions/{call_id}", r.wrap(r.handleStopTranscription, []string{"recording:write"}))
+
+	// SFU endpoints
+	r.mux.HandleFunc("GET /api/v1/sfu/tracks", r.wrap(r.handleListSFUTracks, []string{"session:read"}))
+	r.mux.HandleFunc("GET /api/v1/sfu/subscribers", r.wrap(r.handleListSFUSubscribers, []string{"session:read"}))
+	r.mux.HandleFunc("GET /api/v1/sfu/subscribers/{id}", r.wrap(r.handleGetSFUSubscriber, []string{"session:read"}))
+	r.mux.HandleFunc("PUT /api/v1/sfu/subscribers/{id}/layer", r.wrap(r.handleSetSFULayer, []string{"session:write"}))
+
+	// WebRTC signaling endpoints
+	r.mux.HandleFunc("POST /api/v1/webrtc/tokens", r.wrap(r.handleIssueSignalingToken, []string{"session:write"}))
+	r.mux.HandleFunc("GET /api/v1/webrtc/sessions", r.wrap(r.handleListSignalingSessions, []string{"session:read"}))
+	r.mux.HandleFunc("DELETE /api/v1/webrtc/sessions/{id}", r.wrap(r.handleCloseSignalingSession, []string{"session:delete"}))
+
+	// Runtime configuration endpoints
+	r.mux.HandleFunc("GET /api/v1/config/logging", r.wrap(r.handleGetLogging, []string{"stats:read"}))
+	r.mux.HandleFunc("PUT /api/v1/config/logging", r.wrap(r.handleSetLogging, []string{"admin"}))
+	r.mux.HandleFunc("GET /api/v1/admin/tuning", r.wrap(r.handleGetTuning, []string{"stats:read"}))
+	r.mux.HandleFunc("PATCH /api/v1/admin/tuning", r.wrap(r.handlePatchTuning, []string{"admin"}))
+	r.mux.HandleFunc("GET /api/v1/admin/ports", r.wrap(r.handleGetPorts, []string{"stats:read"}))
+	r.mux.HandleFunc("GET /api/v1/admin/tenants", r.wrap(r.handleListTenants, []string{"stats:read"}))
+	r.mux.HandleFunc("GET /api/v1/admin/capacity", r.wrap(r.handleGetCapacity, []string{"stats:read"}))
+
 	// Real-time endpoints
 	r.mux.HandleFunc("/api/v1/active-calls", r.wrap(r.handleActiveCalls, []string{"session:read"}))
 	r.mux.HandleFunc("/api/v1/streams", r.wrap(r.handleStreams, []string{"session:read"}))
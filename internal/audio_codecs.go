@@ -0,0 +1,69 @@
+package internal
+
+import "strings"
+
+// audioEncoder encodes mono PCM at its codec's sample rate into an RTP
+// payload. An empty payload means discontinuous transmission suppressed
+// the audio
+type audioEncoder interface {
+	Encode(pcm []int16) ([]byte, error)
+	Close()
+}
+
+// audioDecoder decodes an RTP payload into mono PCM at its codec's sample
+// rate
+type audioDecoder interface {
+	Decode(payload []byte) ([]int16, error)
+	Close()
+}
+
+// nativeAudioCodec is an audio codec a C library provides. It is in the
+// build only with the library's build tag, e.g. G.729 with karl_g729
+type nativeAudioCodec struct {
+	// offer is the codec added to an offer by codec-transcode
+	offer CodecInfo
+	// sampleRate returns the rate PCM is exchanged at for a negotiated codec
+	sampleRate func(codec CodecInfo) int
+	newEncoder func(codec CodecInfo) (audioEncoder, error)
+	newDecoder func(codec CodecInfo) (audioDecoder, error)
+}
+
+// nativeAudioCodecs are the native codecs built in, by MIME type
+var nativeAudioCodecs = make(map[string]nativeAudioCodec)
+
+// registerAudioCodec makes a native codec available for transcoding. Codecs
+// register themselves from init functions of files built with their build
+// tag
+func registerAudioCodec(mimeType string, codec nativeAudioCodec) {
+	nativeAudioCodecs[mimeType] = codec
+	transcodableCodecs[strings.ToUpper(codec.offer.Name)] = codec.offer
+}
+
+// nativeAudioCodecFor returns the native codec of a negotiated codec
+func nativeAudioCodecFor(codec CodecInfo) (nativeAudioCodec, bool) {
+	native, ok := nativeAudioCodecs[codecMimeType(codec.Name)]
+	return native, ok
+}
+
+// pcmFramer cuts PCM into the whole frames a codec encodes, keeping the
+// samples left over for the next call
+type pcmFramer struct {
+	size    int
+	pending []int16
+}
+
+// frames returns the whole frames of the pending samples and pcm
+func (f *pcmFramer) frames(pcm []int16) [][]int16 {
+	f.pending = append(f.pending, pcm...)
+	var frames [][]int16
+	for len(f.pending) >= f.size {
+		frames = append(frames, f.pending[:f.size:f.size])
+		f.pending = f.pending[f.size:]
+	}
+	if len(f.pending) == 0 {
+		f.pending = nil
+	} else if len(frames) > 0 {
+		f.pending = append([]int16(nil), f.pending...)
+	}
+	return frames
+}
@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPCMFramer(t *testing.T) {
+	f := pcmFramer{size: 80}
+	if frames := f.frames(make([]int16, 60)); len(frames) != 0 {
+		t.Fatalf("expected no frame from 60 samples, got %d", len(frames))
+	}
+	pcm := make([]int16, 160)
+	for i := range pcm {
+		pcm[i] = int16(i)
+	}
+	frames := f.frames(pcm)
+	if len(frames) != 2 || len(frames[0]) != 80 || frames[1][0] != 20 || len(f.pending) != 60 {
+		t.Fatalf("expected 2 frames and 60 samples left, got %d and %d", len(frames), len(f.pending))
+	}
+	// Later frames do not overwrite the ones returned
+	f.frames(make([]int16, 100))
+	if frames[1][79] != 99 {
+		t.Errorf("expected the returned frame kept, got %d", frames[1][79])
+	}
+}
+
+// nativeRoundTrip encodes a second of a 440 Hz tone with a native codec in
+// 20 ms frames and decodes the payloads again, returning the payloads the
+// encoder did not suppress and the decoded audio
+func nativeRoundTrip(t *testing.T, codec CodecInfo) ([][]byte, []int16) {
+	t.Helper()
+	if _, ok := nativeAudioCodecFor(codec); !ok {
+		t.Fatalf("%s is not built in", codec.Name)
+	}
+	rate := codecSampleRate(codec)
+	tone := resamplerTone(440, rate, rate)
+	codecs := NewStreamCodecs()
+	defer codecs.close()
+
+	var payloads [][]byte
+	var decoded []int16
+	for frame := rate / 50; len(tone) >= frame; tone = tone[frame:] {
+		payload, err := encodeAudio(codec, tone[:frame], codecs)
+		if err != nil {
+			t.Fatalf("%s: encode: %v", codec.Name, err)
+		}
+		if len(payload) == 0 {
+			continue
+		}
+		pcm, err := decodeAudio(codec, payload, codecs)
+		if err != nil {
+			t.Fatalf("%s: decode: %v", codec.Name, err)
+		}
+		payloads = append(payloads, payload)
+		decoded = append(decoded, pcm...)
+	}
+	return payloads, decoded
+}
+
+// checkTone checks that decoded audio, past the codec's start-up, is a
+// 440 Hz tone at about the level of resamplerTone
+func checkTone(t *testing.T, name string, pcm []int16, rate int) {
+	t.Helper()
+	if len(pcm) < rate/2 {
+		t.Fatalf("%s: expected at least half a second decoded, got %d samples", name, len(pcm))
+	}
+	tail := pcm[len(pcm)-rate/2:]
+	if level := CalculateRMS(tail) / (10000 / math.Sqrt2); level < 0.3 || level > 2 {
+		t.Errorf("%s: expected the tone's level, got %.2f of it", name, level)
+	}
+	if crossings := zeroCrossings(tail); crossings < 400 || crossings > 480 {
+		t.Errorf("%s: expected about 440 zero crossings in half a second, got %d", name, crossings)
+	}
+}
@@ -0,0 +1,206 @@
+package internal
+
+import (
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Batched UDP I/O limits
+const (
+	defaultBatchSize = 32    // datagrams per recvmmsg or sendmmsg call
+	maxBatchSize     = 1024  // largest configurable batch
+	maxGSOSegments   = 64    // segments the kernel accepts in one UDP GSO send
+	maxGSOBytes      = 65000 // bytes the kernel accepts in one UDP GSO send
+)
+
+// BatchConfig configures batched UDP I/O. On Linux a batch of datagrams is
+// read with one recvmmsg and written with one sendmmsg call; other platforms
+// read and write one datagram at a time
+type BatchConfig struct {
+	Size int  // datagrams per call, 0 for the default of 32 and 1 to disable batching
+	GSO  bool // send runs of equally sized datagrams to one destination as a single UDP GSO write
+}
+
+// batchSize returns the configured batch size within its limits
+func (c BatchConfig) batchSize() int {
+	switch {
+	case c.Size <= 0:
+		return defaultBatchSize
+	case c.Size > maxBatchSize:
+		return maxBatchSize
+	}
+	return c.Size
+}
+
+// batchPacketConn is the batch API of ipv4.PacketConn and ipv6.PacketConn,
+// which share their Message type
+type batchPacketConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// receivedPacket is a datagram read into a pooled buffer. The reader
+// returns buf to the pool with putPacketBuffer once it is done with data
+type receivedPacket struct {
+	buf  *[]byte
+	data []byte
+	addr *net.UDPAddr
+}
+
+// batchConn reads and writes batches of datagrams on a UDP socket. A
+// batchConn has one reader; writers may share it, as the read loops of
+// SO_REUSEPORT shards do
+type batchConn struct {
+	conn *net.UDPConn
+	pc   batchPacketConn // nil when batching is disabled or unsupported
+	gso  atomic.Bool
+
+	rmsgs    []ipv4.Message
+	rbufs    []*[]byte
+	received []receivedPacket
+
+	wmu   sync.Mutex // guards wmsgs
+	wmsgs []ipv4.Message
+}
+
+// newBatchConn wraps a UDP socket for batched I/O
+func newBatchConn(conn *net.UDPConn, config BatchConfig) *batchConn {
+	size := config.batchSize()
+	b := &batchConn{conn: conn}
+	if size > 1 && runtime.GOOS != "windows" {
+		if local, ok := conn.LocalAddr().(*net.UDPAddr); ok && local.IP.To4() != nil {
+			b.pc = ipv4.NewPacketConn(conn)
+		} else {
+			b.pc = ipv6.NewPacketConn(conn)
+		}
+	} else {
+		size = 1
+	}
+	b.gso.Store(config.GSO && gsoSupported(conn))
+
+	b.rmsgs = make([]ipv4.Message, size)
+	b.rbufs = make([]*[]byte, size)
+	b.received = make([]receivedPacket, 0, size)
+	for i := range b.rmsgs {
+		b.rmsgs[i].Buffers = make([][]byte, 1)
+	}
+	return b
+}
+
+// readBatch blocks until at least one datagram arrives and returns up to a
+// batch of them. The returned slice is reused by the next call
+func (b *batchConn) readBatch() ([]receivedPacket, error) {
+	b.received = b.received[:0]
+	if b.pc == nil {
+		buf := getPacketBuffer()
+		n, addr, err := b.conn.ReadFromUDP(*buf)
+		if err != nil {
+			putPacketBuffer(buf)
+			return nil, err
+		}
+		return append(b.received, receivedPacket{buf: buf, data: (*buf)[:n], addr: addr}), nil
+	}
+
+	for i := range b.rmsgs {
+		if b.rbufs[i] == nil {
+			b.rbufs[i] = getPacketBuffer()
+		}
+		b.rmsgs[i].Buffers[0] = *b.rbufs[i]
+		b.rmsgs[i].Addr = nil
+	}
+	n, err := b.pc.ReadBatch(b.rmsgs, 0)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < n; i++ {
+		msg := &b.rmsgs[i]
+		addr, _ := msg.Addr.(*net.UDPAddr)
+		b.received = append(b.received, receivedPacket{buf: b.rbufs[i], data: (*b.rbufs[i])[:msg.N], addr: addr})
+		b.rbufs[i] = nil
+	}
+	return b.received, nil
+}
+
+// writeBatch sends datagrams to addr, or to the connected peer if addr is
+// nil, and returns the datagrams and bytes written. With GSO, runs of
+// equally sized datagrams go out as one write the kernel splits; if the
+// kernel rejects that, GSO is turned off and the rest is sent without it
+func (b *batchConn) writeBatch(packets [][]byte, addr *net.UDPAddr) (int, int, error) {
+	if len(packets) == 0 {
+		return 0, 0, nil
+	}
+	b.wmu.Lock()
+	defer b.wmu.Unlock()
+	return b.writeBatchLocked(packets, addr)
+}
+
+// writeBatchLocked is writeBatch with wmu held
+func (b *batchConn) writeBatchLocked(packets [][]byte, addr *net.UDPAddr) (int, int, error) {
+	if b.pc == nil {
+		return b.writeEach(packets, addr)
+	}
+
+	gso := b.gso.Load()
+	b.wmsgs = b.wmsgs[:0]
+	for i := 0; i < len(packets); {
+		j := i + 1
+		if gso {
+			size, total := len(packets[i]), len(packets[i])
+			for j < len(packets) && j-i < maxGSOSegments && len(packets[j]) == size && total+size <= maxGSOBytes {
+				total += size
+				j++
+			}
+		}
+		msg := ipv4.Message{Buffers: packets[i:j]}
+		if addr != nil {
+			msg.Addr = addr
+		}
+		if j-i > 1 {
+			msg.OOB = gsoControl(len(packets[i]))
+		}
+		b.wmsgs = append(b.wmsgs, msg)
+		i = j
+	}
+
+	count, written := 0, 0
+	for sent := 0; sent < len(b.wmsgs); {
+		n, err := b.pc.WriteBatch(b.wmsgs[sent:], 0)
+		if err != nil {
+			if gso && b.gso.CompareAndSwap(true, false) {
+				c, w, err := b.writeBatchLocked(packets[count:], addr)
+				return count + c, written + w, err
+			}
+			return count, written, err
+		}
+		for _, msg := range b.wmsgs[sent : sent+n] {
+			count += len(msg.Buffers)
+			written += msg.N
+		}
+		sent += n
+	}
+	return count, written, nil
+}
+
+// writeEach sends datagrams one write at a time
+func (b *batchConn) writeEach(packets [][]byte, addr *net.UDPAddr) (int, int, error) {
+	written := 0
+	for i, packet := range packets {
+		var n int
+		var err error
+		if addr != nil {
+			n, err = b.conn.WriteToUDP(packet, addr)
+		} else {
+			n, err = b.conn.Write(packet)
+		}
+		if err != nil {
+			return i, written, err
+		}
+		written += n
+	}
+	return len(packets), written, nil
+}
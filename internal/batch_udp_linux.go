@@ -0,0 +1,43 @@
+//go:build linux
+
+package internal
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// UDP GSO socket option, from linux/udp.h
+const (
+	solUDP     = 17
+	udpSegment = 103
+)
+
+// gsoSupported reports whether the kernel can split UDP sends on conn into
+// segments (Linux 4.18 and later)
+func gsoSupported(conn *net.UDPConn) bool {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var optErr error
+	if err := raw.Control(func(fd uintptr) {
+		_, optErr = syscall.GetsockoptInt(int(fd), solUDP, udpSegment)
+	}); err != nil {
+		return false
+	}
+	return optErr == nil
+}
+
+// gsoControl returns the control message asking the kernel to split a send
+// into datagrams of size bytes
+func gsoControl(size int) []byte {
+	oob := make([]byte, syscall.CmsgSpace(2))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = solUDP
+	h.Type = udpSegment
+	h.SetLen(syscall.CmsgLen(2))
+	*(*uint16)(unsafe.Pointer(&oob[syscall.CmsgLen(0)])) = uint16(size)
+	return oob
+}
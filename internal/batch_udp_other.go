@@ -0,0 +1,16 @@
+//go:build !linux
+
+package internal
+
+import "net"
+
+// gsoSupported reports whether the kernel can split UDP sends into
+// segments, which needs Linux
+func gsoSupported(conn *net.UDPConn) bool {
+	return false
+}
+
+// gsoControl is never used without GSO support
+func gsoControl(size int) []byte {
+	return nil
+}
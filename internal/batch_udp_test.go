@@ -0,0 +1,186 @@
+package internal
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// batchTestConns returns two connected loopback UDP sockets
+func batchTestConns(t *testing.T) (*net.UDPConn, *net.UDPConn) {
+	t.Helper()
+	rx, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	tx, err := net.DialUDP("udp4", nil, rx.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	t.Cleanup(func() {
+		rx.Close()
+		tx.Close()
+	})
+	return tx, rx
+}
+
+func TestBatchConn_RoundTrip(t *testing.T) {
+	for _, config := range []BatchConfig{{Size: 1}, {}, {Size: 4, GSO: true}} {
+		tx, rx := batchTestConns(t)
+		writer, reader := newBatchConn(tx, config), newBatchConn(rx, config)
+
+		// Equal sizes can be coalesced with GSO; the odd one ends a run
+		var packets [][]byte
+		for i := 0; i < 10; i++ {
+			size := 172
+			if i == 6 {
+				size = 60
+			}
+			packets = append(packets, bytes.Repeat([]byte{byte(i)}, size))
+		}
+		sent, written, err := writer.writeBatch(packets, nil)
+		if err != nil || sent != 10 || written != 9*172+60 {
+			t.Fatalf("batch %+v: sent %d packets, %d bytes: %v", config, sent, written, err)
+		}
+		if config.GSO && gsoSupported(tx) && !writer.gso.Load() {
+			t.Errorf("expected the kernel to accept GSO sends")
+		}
+
+		rx.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var got [][]byte
+		for len(got) < len(packets) {
+			batch, err := reader.readBatch()
+			if err != nil {
+				t.Fatalf("batch %+v: read failed after %d packets: %v", config, len(got), err)
+			}
+			if len(batch) > config.batchSize() && config.Size != 0 {
+				t.Errorf("batch %+v: read %d packets at once", config, len(batch))
+			}
+			for _, p := range batch {
+				if p.addr == nil || p.addr.Port != tx.LocalAddr().(*net.UDPAddr).Port {
+					t.Errorf("batch %+v: unexpected source %v", config, p.addr)
+				}
+				got = append(got, append([]byte(nil), p.data...))
+				putPacketBuffer(p.buf)
+			}
+		}
+		for i := range packets {
+			if !bytes.Equal(got[i], packets[i]) {
+				t.Errorf("batch %+v: packet %d arrived as %d bytes of %d", config, i, len(got[i]), got[i][0])
+			}
+		}
+	}
+}
+
+func TestBatchConfig_Size(t *testing.T) {
+	tests := []struct{ size, want int }{{0, 32}, {-1, 32}, {1, 1}, {64, 64}, {5000, maxBatchSize}}
+	for _, tt := range tests {
+		if got := (BatchConfig{Size: tt.size}).batchSize(); got != tt.want {
+			t.Errorf("batch size %d: expected %d, got %d", tt.size, tt.want, got)
+		}
+	}
+}
+
+func TestRTPControl_BatchForwarding(t *testing.T) {
+	control, err := NewRTPControl(nil, nil)
+	if err != nil {
+		t.Fatalf("NewRTPControl failed: %v", err)
+	}
+	defer control.Stop()
+	control.SetBatchConfig(BatchConfig{Size: 8})
+	forwardThroughPool(t, control)
+
+	sink, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	if err := control.AddDestination(sink.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if err := control.StartRTPListener("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	sender, err := net.DialUDP("udp4", nil, control.udpConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	for i := 0; i < 5; i++ {
+		packet := make([]byte, 172)
+		packet[0], packet[3], packet[11] = 0x80, byte(i), 0x42
+		sender.Write(packet)
+	}
+
+	sink.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	for i := 0; i < 5; i++ {
+		n, _, err := sink.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("expected 5 forwarded packets, got %d: %v", i, err)
+		}
+		if n != 172 || buf[3] != byte(i) {
+			t.Errorf("packet %d: forwarded %d bytes with sequence %d", i, n, buf[3])
+		}
+	}
+	if received, _, _, sent := control.GetStats(); received != 5 || sent != 5*172 {
+		t.Errorf("expected 5 packets in and %d bytes out, got %d and %d", 5*172, received, sent)
+	}
+}
+
+func TestRTPControl_SendBatchFrom(t *testing.T) {
+	control, err := NewRTPControl(nil, nil)
+	if err != nil {
+		t.Fatalf("NewRTPControl failed: %v", err)
+	}
+	defer control.Stop()
+	control.SetBatchConfig(BatchConfig{Size: 8, GSO: true})
+
+	rtpConn, rtcpConn, err := control.OpenMediaPorts(net.IPv4(127, 0, 0, 1), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rtpConn.Close()
+	defer rtcpConn.Close()
+	sink, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	// The fragments of a frame share a size and go out as one GSO write
+	// where the kernel supports it
+	var packets [][]byte
+	for i := 0; i < 6; i++ {
+		packet := make([]byte, 1200)
+		packet[0], packet[3] = 0x80, byte(i)
+		packets = append(packets, packet)
+	}
+	sent, err := control.SendBatchFrom(rtpConn, packets, sink.LocalAddr().(*net.UDPAddr))
+	if err != nil || sent != len(packets) {
+		t.Fatalf("expected %d packets sent, got %d: %v", len(packets), sent, err)
+	}
+
+	sink.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	for i := range packets {
+		n, from, err := sink.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("expected %d packets, got %d: %v", len(packets), i, err)
+		}
+		if n != 1200 || buf[3] != byte(i) || from.Port != rtpConn.LocalAddr().(*net.UDPAddr).Port {
+			t.Errorf("packet %d: %d bytes with sequence %d from %v", i, n, buf[3], from)
+		}
+	}
+	if _, _, _, bytesSent := control.GetStats(); bytesSent != 6*1200 {
+		t.Errorf("expected %d bytes sent, got %d", 6*1200, bytesSent)
+	}
+
+	// A packet over the MTU is not sent, and neither is what follows it
+	sent, err = control.SendBatchFrom(rtpConn, [][]byte{packets[0], make([]byte, 9000), packets[1]}, sink.LocalAddr().(*net.UDPAddr))
+	if err == nil || sent != 1 {
+		t.Errorf("expected one packet sent before the oversized one, got %d: %v", sent, err)
+	}
+}
@@ -0,0 +1,486 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	ng "karl/internal/ng_protocol"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+)
+
+// dispatchLog logs how NG commands are routed between nodes
+var dispatchLog = Logger(ComponentNG)
+
+var (
+	dispatchForwarded = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "karl_dispatch_forwarded_total",
+			Help: "NG commands forwarded to the node owning the call, by command",
+		},
+		[]string{"command"},
+	)
+
+	dispatchForwardErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "karl_dispatch_forward_errors_total",
+		Help: "NG commands that could not be forwarded to the owning node",
+	})
+
+	dispatchStoreErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "karl_dispatch_store_errors_total",
+			Help: "Failed ownership store operations by operation",
+		},
+		[]string{"operation"},
+	)
+
+	dispatchNodes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "karl_dispatch_nodes",
+		Help: "Nodes on this node's consistent hash ring",
+	})
+)
+
+// dispatchCookiePrefix marks a forwarded NG message. The owner handles it
+// itself even if its view of the ring differs, so messages never bounce
+const dispatchCookiePrefix = "karl-fwd."
+
+// CallOwnerStore keeps the node membership and call ownership shared by
+// all dispatching nodes
+type CallOwnerStore interface {
+	// Register announces nodeID at its NG address for ttl
+	Register(ctx context.Context, nodeID, addr string, ttl time.Duration) error
+	// Unregister removes nodeID
+	Unregister(ctx context.Context, nodeID string) error
+	// Nodes returns the registered nodes, node ID to NG address
+	Nodes(ctx context.Context) (map[string]string, error)
+	// Claim makes nodeID the owner of callID unless a registered node
+	// already owns it, and returns the owner
+	Claim(ctx context.Context, callID, nodeID string, ttl time.Duration) (string, error)
+	// Owner returns the owner of callID, empty when it has none
+	Owner(ctx context.Context, callID string) (string, error)
+	// Release drops the ownership of callID if nodeID holds it
+	Release(ctx context.Context, callID, nodeID string) error
+}
+
+var (
+	// KEYS[1] call key, KEYS[2] node key prefix; ARGV[1] node, ARGV[2] ttl ms.
+	// An owner whose node key expired has left, so its calls are reassigned
+	redisCallClaim = redis.NewScript(`
+local owner = redis.call('GET', KEYS[1])
+if owner and redis.call('EXISTS', KEYS[2] .. owner) == 1 then
+	return owner
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+return ARGV[1]`)
+
+	redisCallRelease = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0`)
+)
+
+// RedisCallOwnerStore keeps nodes in prefix:node:<id> keys holding their NG
+// address and call owners in prefix:call:<call-id>, all with TTLs
+type RedisCallOwnerStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedisCallOwnerStore creates an ownership store with keys under prefix
+func NewRedisCallOwnerStore(client *redis.Client, prefix string) *RedisCallOwnerStore {
+	return &RedisCallOwnerStore{client: client, prefix: prefix}
+}
+
+func (s *RedisCallOwnerStore) nodeKey(nodeID string) string {
+	return s.prefix + ":node:" + nodeID
+}
+
+func (s *RedisCallOwnerStore) callKey(callID string) string {
+	return s.prefix + ":call:" + callID
+}
+
+// Register implements CallOwnerStore
+func (s *RedisCallOwnerStore) Register(ctx context.Context, nodeID, addr string, ttl time.Duration) error {
+	return s.client.Set(ctx, s.nodeKey(nodeID), addr, ttl).Err()
+}
+
+// Unregister implements CallOwnerStore
+func (s *RedisCallOwnerStore) Unregister(ctx context.Context, nodeID string) error {
+	return s.client.Del(ctx, s.nodeKey(nodeID)).Err()
+}
+
+// Nodes implements CallOwnerStore
+func (s *RedisCallOwnerStore) Nodes(ctx context.Context) (map[string]string, error) {
+	var keys []string
+	iter := s.client.Scan(ctx, 0, s.nodeKey("*"), 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	nodes := make(map[string]string, len(keys))
+	if len(keys) == 0 {
+		return nodes, nil
+	}
+	values, err := s.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		if addr, ok := values[i].(string); ok {
+			nodes[strings.TrimPrefix(key, s.nodeKey(""))] = addr
+		}
+	}
+	return nodes, nil
+}
+
+// Claim implements CallOwnerStore
+func (s *RedisCallOwnerStore) Claim(ctx context.Context, callID, nodeID string, ttl time.Duration) (string, error) {
+	return redisCallClaim.Run(ctx, s.client, []string{s.callKey(callID), s.nodeKey("")},
+		nodeID, ttl.Milliseconds()).Text()
+}
+
+// Owner implements CallOwnerStore
+func (s *RedisCallOwnerStore) Owner(ctx context.Context, callID string) (string, error) {
+	owner, err := s.client.Get(ctx, s.callKey(callID)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return owner, err
+}
+
+// Release implements CallOwnerStore
+func (s *RedisCallOwnerStore) Release(ctx context.Context, callID, nodeID string) error {
+	return redisCallRelease.Run(ctx, s.client, []string{s.callKey(callID)}, nodeID).Err()
+}
+
+// CallDispatcher assigns call-ids to Karl nodes on a consistent hash ring
+// and forwards NG commands to the node owning the call, so any node can
+// serve as the single control endpoint of the proxies. With an ownership
+// store, the node chosen at the offer keeps the call when nodes join or
+// leave; without one, the static node list alone decides
+type CallDispatcher struct {
+	nodeID   string
+	address  string
+	static   map[string]string
+	store    CallOwnerStore
+	nodeTTL  time.Duration
+	ownerTTL time.Duration
+	timeout  time.Duration
+
+	mu       sync.RWMutex
+	ring     *HashRing
+	nodes    map[string]string
+	storeErr error
+
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+// NewCallDispatcher creates a dispatcher for cfg. store may be nil
+func NewCallDispatcher(cfg *DispatchConfig, store CallOwnerStore) *CallDispatcher {
+	d := &CallDispatcher{
+		nodeID:   cfg.NodeID,
+		address:  cfg.Address,
+		static:   cfg.Nodes,
+		store:    store,
+		nodeTTL:  time.Duration(cfg.NodeTTL) * time.Second,
+		ownerTTL: time.Duration(cfg.OwnerTTL) * time.Second,
+		timeout:  time.Duration(cfg.ForwardTimeout) * time.Millisecond,
+		stopCh:   make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+	d.setNodes(nil)
+	return d
+}
+
+// Start registers the node and keeps the ring in step with the store
+func (d *CallDispatcher) Start() {
+	d.refresh()
+	go d.run()
+}
+
+// Stop unregisters the node so the others stop sending it new calls
+func (d *CallDispatcher) Stop() {
+	select {
+	case <-d.stopCh:
+		return
+	default:
+	}
+	close(d.stopCh)
+	<-d.doneCh
+
+	if d.store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+		defer cancel()
+		if err := d.store.Unregister(ctx, d.nodeID); err != nil {
+			dispatchLog.Warn("Failed to unregister dispatch node", "node", d.nodeID, "error", err)
+		}
+	}
+}
+
+func (d *CallDispatcher) run() {
+	defer close(d.doneCh)
+	if d.store == nil {
+		return
+	}
+
+	ticker := time.NewTicker(d.nodeTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stopCh:
+			return
+		case <-ticker.C:
+			d.refresh()
+		}
+	}
+}
+
+// refresh renews this node's registration and reloads the ring
+func (d *CallDispatcher) refresh() {
+	if d.store == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+
+	err := d.store.Register(ctx, d.nodeID, d.address, d.nodeTTL)
+	if err != nil {
+		dispatchStoreErrors.WithLabelValues("register").Inc()
+	} else {
+		var nodes map[string]string
+		if nodes, err = d.store.Nodes(ctx); err != nil {
+			dispatchStoreErrors.WithLabelValues("nodes").Inc()
+		} else {
+			d.setNodes(nodes)
+		}
+	}
+
+	d.mu.Lock()
+	if err != nil && d.storeErr == nil {
+		dispatchLog.Warn("Dispatch store unavailable, keeping the last known ring", "error", err)
+	}
+	d.storeErr = err
+	d.mu.Unlock()
+}
+
+// setNodes rebuilds the ring from the static nodes, the registered nodes
+// and this node
+func (d *CallDispatcher) setNodes(registered map[string]string) {
+	nodes := make(map[string]string, len(d.static)+len(registered)+1)
+	for id, addr := range d.static {
+		nodes[id] = addr
+	}
+	for id, addr := range registered {
+		nodes[id] = addr
+	}
+	nodes[d.nodeID] = d.address
+
+	ring := NewHashRing(DefaultConsistentHashConfig())
+	for id, addr := range nodes {
+		ring.AddNode(&HashNode{ID: id, Address: addr, Weight: 1, Healthy: true})
+	}
+
+	d.mu.Lock()
+	d.ring = ring
+	d.nodes = nodes
+	d.mu.Unlock()
+	dispatchNodes.Set(float64(len(nodes)))
+}
+
+// Nodes returns the IDs of the nodes on the ring, sorted
+func (d *CallDispatcher) Nodes() []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	ids := make([]string, 0, len(d.nodes))
+	for id := range d.nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Route returns the node that handles command for callID and its NG
+// address. An offer claims the call for the node the ring picks; other
+// commands go to the recorded owner, or the ring's pick when there is none
+func (d *CallDispatcher) Route(command, callID string) (string, string) {
+	d.mu.RLock()
+	node := d.ring.GetNode(callID)
+	nodes := d.nodes
+	d.mu.RUnlock()
+	if node == nil {
+		return d.nodeID, d.address
+	}
+	owner := node.ID
+
+	if d.store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+		defer cancel()
+
+		var stored string
+		var err error
+		if command == ng.CmdOffer {
+			stored, err = d.store.Claim(ctx, callID, owner, d.ownerTTL)
+		} else {
+			stored, err = d.store.Owner(ctx, callID)
+		}
+		if err != nil {
+			dispatchStoreErrors.WithLabelValues("route").Inc()
+		} else if _, known := nodes[stored]; known {
+			owner = stored
+		}
+	}
+
+	return owner, nodes[owner]
+}
+
+// Dispatch forwards a message for a call owned by another node and returns
+// the owner's response. It returns false when this node handles it
+func (d *CallDispatcher) Dispatch(msg *ng.NGMessage, req *ng.NGRequest) ([]byte, bool) {
+	if req.CallID == "" || strings.HasPrefix(msg.Cookie, dispatchCookiePrefix) {
+		return nil, false
+	}
+
+	owner, addr := d.Route(req.Command, req.CallID)
+	if owner == d.nodeID {
+		return nil, false
+	}
+
+	resp, err := d.Forward(msg.RawBytes, addr)
+	if err != nil {
+		dispatchForwardErrors.Inc()
+		dispatchLog.Error("Failed to forward NG command", "command", req.Command, "call_id", req.CallID, "node", owner, "error", err)
+		resp, _ = ng.ErrorResponse(msg.Cookie, "owning node "+owner+" unreachable")
+		return resp, true
+	}
+	dispatchForwarded.WithLabelValues(req.Command).Inc()
+	return resp, true
+}
+
+// Forward sends a raw NG message to the NG UDP address of another node and
+// returns its response with the original cookie
+func (d *CallDispatcher) Forward(data []byte, addr string) ([]byte, error) {
+	if addr == "" {
+		return nil, fmt.Errorf("node has no NG address")
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	MarkSignalingConn(conn)
+	if err := conn.SetDeadline(time.Now().Add(d.timeout)); err != nil {
+		return nil, err
+	}
+
+	// The forwarded cookie is the original one behind the prefix
+	cookie := data
+	if i := bytes.IndexByte(data, ' '); i >= 0 {
+		cookie = data[:i]
+	}
+	prefixed := append([]byte(dispatchCookiePrefix), data...)
+	if _, err := conn.Write(prefixed); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 65536)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		resp := bytes.TrimPrefix(buf[:n], []byte(dispatchCookiePrefix))
+		if len(resp) < n && bytes.HasPrefix(resp, cookie) {
+			return append([]byte(nil), resp...), nil
+		}
+	}
+}
+
+// Handled records the outcome of a command this node handled: a deleted
+// call is released so its ownership record does not outlive it
+func (d *CallDispatcher) Handled(req *ng.NGRequest, resp *ng.NGResponse) {
+	if d.store == nil || req.Command != ng.CmdDelete || resp == nil || resp.Result != ng.ResultOK {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	if err := d.store.Release(ctx, req.CallID, d.nodeID); err != nil {
+		dispatchStoreErrors.WithLabelValues("release").Inc()
+	}
+}
+
+// CheckHealth reports the ring and the ownership store
+func (d *CallDispatcher) CheckHealth() ComponentHealth {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	health := CreateComponentHealth(StatusUp, fmt.Sprintf("Dispatching over %d nodes", len(d.nodes)))
+	health.Details["node_id"] = d.nodeID
+	health.Details["nodes"] = fmt.Sprintf("%d", len(d.nodes))
+	if d.storeErr != nil {
+		health.Status = StatusDegraded
+		health.Message = "Dispatch store unavailable: " + d.storeErr.Error()
+	}
+	return health
+}
+
+// InitDispatch builds the dispatcher for the dispatch config section, with
+// membership and ownership in Redis when an address is configured
+func InitDispatch(cfg *Config) (*CallDispatcher, error) {
+	dcfg := cfg.GetDispatchConfig()
+	if !dcfg.Enabled {
+		return nil, nil
+	}
+
+	var store CallOwnerStore
+	addr := dcfg.RedisAddr
+	if addr == "" {
+		addr = cfg.Database.RedisAddr
+	}
+	if addr != "" {
+		store = NewRedisCallOwnerStore(redis.NewClient(&redis.Options{Addr: addr}), dcfg.KeyPrefix)
+		dispatchLog.Info("Dispatch node sharing calls via Redis", "node", dcfg.NodeID, "addr", dcfg.Address, "redis", addr)
+	} else {
+		dispatchLog.Info("Dispatch node with static peers", "node", dcfg.NodeID, "addr", dcfg.Address, "peers", len(dcfg.Nodes))
+	}
+
+	return NewCallDispatcher(dcfg, store), nil
+}
+
+// ValidateDispatchConfig checks the dispatch section of an enabled
+// configuration
+func ValidateDispatchConfig(cfg *Config) error {
+	d := cfg.GetDispatchConfig()
+	if cfg.NGProtocol == nil || cfg.NGProtocol.UDPPort <= 0 {
+		return fmt.Errorf("dispatch needs ng_protocol.udp_port for forwarding between nodes")
+	}
+	if d.Address == "" {
+		return fmt.Errorf("dispatch enabled but no node address could be determined")
+	}
+	if _, _, err := net.SplitHostPort(d.Address); err != nil {
+		return fmt.Errorf("invalid dispatch address %q: %w", d.Address, err)
+	}
+	if d.RedisAddr == "" && cfg.Database.RedisAddr == "" && len(d.Nodes) == 0 {
+		return fmt.Errorf("dispatch enabled but neither nodes nor a Redis address specified")
+	}
+	if d.NodeTTL < 3 {
+		return fmt.Errorf("invalid dispatch node TTL: %ds", d.NodeTTL)
+	}
+	if d.ForwardTimeout <= 0 {
+		return fmt.Errorf("invalid dispatch forward timeout: %dms", d.ForwardTimeout)
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ng "karl/internal/ng_protocol"
+)
+
+// memoryCallOwnerStore is a CallOwnerStore without expiry
+type memoryCallOwnerStore struct {
+	mu     sync.Mutex
+	nodes  map[string]string
+	owners map[string]string
+}
+
+func newMemoryCallOwnerStore() *memoryCallOwnerStore {
+	return &memoryCallOwnerStore{nodes: make(map[string]string), owners: make(map[string]string)}
+}
+
+func (s *memoryCallOwnerStore) Register(ctx context.Context, nodeID, addr string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nodes[nodeID] = addr
+	return nil
+}
+
+func (s *memoryCallOwnerStore) Unregister(ctx context.Context, nodeID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.nodes, nodeID)
+	return nil
+}
+
+func (s *memoryCallOwnerStore) Nodes(ctx context.Context) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	nodes := make(map[string]string, len(s.nodes))
+	for id, addr := range s.nodes {
+		nodes[id] = addr
+	}
+	return nodes, nil
+}
+
+func (s *memoryCallOwnerStore) Claim(ctx context.Context, callID, nodeID string, ttl time.Duration) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if owner, ok := s.owners[callID]; ok {
+		if _, live := s.nodes[owner]; live {
+			return owner, nil
+		}
+	}
+	s.owners[callID] = nodeID
+	return nodeID, nil
+}
+
+func (s *memoryCallOwnerStore) Owner(ctx context.Context, callID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.owners[callID], nil
+}
+
+func (s *memoryCallOwnerStore) Release(ctx context.Context, callID, nodeID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.owners[callID] == nodeID {
+		delete(s.owners, callID)
+	}
+	return nil
+}
+
+func testDispatchConfig(nodeID, addr string) *DispatchConfig {
+	return &DispatchConfig{
+		Enabled:        true,
+		NodeID:         nodeID,
+		Address:        addr,
+		NodeTTL:        10,
+		OwnerTTL:       60,
+		ForwardTimeout: 1000,
+	}
+}
+
+func TestCallDispatcher_RouteKeepsOwner(t *testing.T) {
+	store := newMemoryCallOwnerStore()
+	store.Register(context.Background(), "b", "127.0.0.1:2224", time.Minute)
+	d := NewCallDispatcher(testDispatchConfig("a", "127.0.0.1:2223"), store)
+	d.refresh()
+
+	if nodes := d.Nodes(); len(nodes) != 2 {
+		t.Fatalf("expected 2 nodes on the ring, got %v", nodes)
+	}
+
+	owners := make(map[string]string)
+	counts := make(map[string]int)
+	for i := 0; i < 200; i++ {
+		callID := fmt.Sprintf("call-%d", i)
+		owner, _ := d.Route(ng.CmdOffer, callID)
+		owners[callID] = owner
+		counts[owner]++
+	}
+	if counts["a"] == 0 || counts["b"] == 0 {
+		t.Fatalf("expected calls on both nodes, got %v", counts)
+	}
+
+	// A joining node takes new calls but existing ones stay put
+	store.Register(context.Background(), "c", "127.0.0.1:2225", time.Minute)
+	d.refresh()
+	for callID, want := range owners {
+		if owner, addr := d.Route(ng.CmdQuery, callID); owner != want || addr == "" {
+			t.Fatalf("%s routed to %s (%s), want %s", callID, owner, addr, want)
+		}
+	}
+
+	// Calls of a node that left are reassigned at their next offer
+	store.Unregister(context.Background(), "b")
+	d.refresh()
+	for callID, was := range owners {
+		if was != "b" {
+			continue
+		}
+		if owner, _ := d.Route(ng.CmdOffer, callID); owner == "b" {
+			t.Fatalf("%s still routed to the departed node", callID)
+		}
+	}
+}
+
+func TestCallDispatcher_ReleaseOnDelete(t *testing.T) {
+	store := newMemoryCallOwnerStore()
+	d := NewCallDispatcher(testDispatchConfig("a", "127.0.0.1:2223"), store)
+	d.refresh()
+
+	d.Route(ng.CmdOffer, "call-1")
+	if owner, _ := store.Owner(context.Background(), "call-1"); owner != "a" {
+		t.Fatalf("expected the offer to claim the call, owner %q", owner)
+	}
+
+	d.Handled(&ng.NGRequest{Command: ng.CmdDelete, CallID: "call-1"}, &ng.NGResponse{Result: ng.ResultOK})
+	if owner, _ := store.Owner(context.Background(), "call-1"); owner != "" {
+		t.Errorf("expected delete to release the call, owner %q", owner)
+	}
+}
+
+// serveNG answers NG messages on a UDP socket with l, like the NG UDP
+// listener does
+func serveNG(t *testing.T, l *NGSocketListener) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(l.processMessage(append([]byte(nil), buf[:n]...), from), from)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestCallDispatcher_ForwardsToOwner(t *testing.T) {
+	config := &Config{Integration: IntegrationConfig{MediaIP: "127.0.0.1"}}
+	entry := NewNGSocketListener(config, NewSessionRegistry(time.Hour))
+	owner := NewNGSocketListener(config, NewSessionRegistry(time.Hour))
+	ownerAddr := serveNG(t, owner)
+
+	cfg := testDispatchConfig("entry", "127.0.0.1:1")
+	cfg.Nodes = map[string]string{"owner": ownerAddr}
+	entry.SetDispatcher(NewCallDispatcher(cfg, nil))
+
+	// Find a call the ring gives to the other node
+	var callID string
+	for i := 0; callID == ""; i++ {
+		id := fmt.Sprintf("call-%d", i)
+		if node, _ := entry.dispatcher.Route(ng.CmdOffer, id); node == "owner" {
+			callID = id
+		}
+	}
+
+	offer := &ng.NGRequest{Command: ng.CmdOffer, CallID: callID, FromTag: "from-tag", SDP: sipOfferSDP}
+	resp := entry.processMessage(encodeNGRequest(t, "cookie1", offer), nil)
+	if !strings.HasPrefix(string(resp), "cookie1 ") || !strings.Contains(string(resp), "m=audio") {
+		t.Fatalf("expected the owner's answer under the original cookie, got %q", resp)
+	}
+	if len(owner.sessionRegistry.GetSessionByCallID(callID)) != 1 || len(entry.sessionRegistry.GetSessionByCallID(callID)) != 0 {
+		t.Errorf("expected the session on the owner only")
+	}
+
+	del := &ng.NGRequest{Command: ng.CmdDelete, CallID: callID}
+	entry.processMessage(encodeNGRequest(t, "cookie2", del), nil)
+	if len(owner.sessionRegistry.GetSessionByCallID(callID)) != 0 {
+		t.Errorf("expected delete to reach the owner")
+	}
+}
+
+func TestCallDispatcher_UnreachableOwner(t *testing.T) {
+	config := &Config{Integration: IntegrationConfig{MediaIP: "127.0.0.1"}}
+	entry := NewNGSocketListener(config, NewSessionRegistry(time.Hour))
+
+	// Nothing answers on the owner's address
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer silent.Close()
+
+	cfg := testDispatchConfig("entry", "127.0.0.1:1")
+	cfg.ForwardTimeout = 100
+	cfg.Nodes = map[string]string{"owner": silent.LocalAddr().String()}
+	d := NewCallDispatcher(cfg, nil)
+
+	var callID string
+	for i := 0; callID == ""; i++ {
+		id := fmt.Sprintf("call-%d", i)
+		if node, _ := d.Route(ng.CmdQuery, id); node == "owner" {
+			callID = id
+		}
+	}
+	entry.SetDispatcher(d)
+
+	resp := entry.processMessage(encodeNGRequest(t, "cookie3", &ng.NGRequest{Command: ng.CmdQuery, CallID: callID}), nil)
+	if !strings.Contains(string(resp), "unreachable") {
+		t.Errorf("expected an error naming the unreachable owner, got %q", resp)
+	}
+}
+
+// encodeNGRequest builds the raw NG message for req
+func encodeNGRequest(t *testing.T, cookie string, req *ng.NGRequest) []byte {
+	t.Helper()
+	dict := map[string]interface{}{"command": req.Command, "call-id": req.CallID}
+	if req.FromTag != "" {
+		dict["from-tag"] = req.FromTag
+	}
+	if req.SDP != "" {
+		dict["sdp"] = req.SDP
+	}
+	data, err := ng.EncodeBencode(dict)
+	if err != nil {
+		t.Fatalf("failed to encode request: %v", err)
+	}
+	return append([]byte(cookie+" "), data...)
+}
@@ -0,0 +1,236 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// Call parking detaches one leg's media while the session and its ports
+// stay allocated, so a SIP proxy can transfer the party on the other side
+// to a new endpoint. The remaining party hears music on hold meanwhile, and
+// a parked leg that is not re-attached in time ends the call.
+
+// CallParkedFlag marks a call with a parked leg
+const CallParkedFlag = "parked"
+
+// DefaultParkTimeout is how long a parked leg waits for re-attachment
+// when sessions.park_timeout is unset
+const DefaultParkTimeout = 300 * time.Second
+
+var (
+	// ErrLegParked is returned when parking a leg that is already parked
+	ErrLegParked = errors.New("leg is already parked")
+	// ErrLegNotParked is returned when re-attaching a leg that is not parked
+	ErrLegNotParked = errors.New("leg is not parked")
+)
+
+// ParkInfo describes a parked leg
+type ParkInfo struct {
+	CallID    string
+	SessionID string
+	Leg       string // caller or callee
+	Tag       string
+	ParkedAt  time.Time
+	ExpiresAt time.Time
+	Music     bool // Music on hold plays to the remaining party
+}
+
+// parkedLeg is a parked leg and the timer that ends its call
+type parkedLeg struct {
+	info  ParkInfo
+	timer *time.Timer
+}
+
+// parkKey names a parked leg of a session
+func parkKey(sessionID, leg string) string {
+	return sessionID + "/" + leg
+}
+
+// parkMusicKey names the music on hold played to the party whose peer is
+// parked
+func parkMusicKey(callID string, caller bool) string {
+	return playbackKey(callID, caller) + "/park"
+}
+
+// ParkLeg detaches the media of a leg, named caller, callee or by its tag,
+// until UnparkLeg re-attaches it. Media from and to the leg is dropped and
+// the other party hears music on hold. If the leg is not re-attached within
+// timeout, DefaultParkTimeout when zero, the call ends
+func (m *SessionManager) ParkLeg(session *MediaSession, leg string, timeout time.Duration) (ParkInfo, error) {
+	if timeout <= 0 {
+		timeout = DefaultParkTimeout
+	}
+
+	session.mu.Lock()
+	l := session.legNamed(leg)
+	if l == nil {
+		session.mu.Unlock()
+		return ParkInfo{}, fmt.Errorf("%w: %q", ErrUnknownLeg, leg)
+	}
+	if l.Parked {
+		session.mu.Unlock()
+		return ParkInfo{}, ErrLegParked
+	}
+	caller := l == session.CallerLeg
+	peer := session.CalleeLeg
+	if !caller {
+		peer = session.CallerLeg
+	}
+	if peer == nil || peer == l {
+		session.mu.Unlock()
+		return ParkInfo{}, errors.New("call has no other party to hold")
+	}
+	l.Parked = true
+	session.Flags[CallParkedFlag] = true
+	now := time.Now()
+	info := ParkInfo{
+		CallID:    session.CallID,
+		SessionID: session.ID,
+		Leg:       legName(caller),
+		Tag:       l.Tag,
+		ParkedAt:  now,
+		ExpiresAt: now.Add(timeout),
+	}
+	remote, codecs := peer.mediaAddr(), peer.Codecs
+	session.mu.Unlock()
+
+	m.parkMu.Lock()
+	if m.parked == nil {
+		m.parked = make(map[string]*parkedLeg)
+	}
+	key := parkKey(session.ID, info.Leg)
+	m.parked[key] = &parkedLeg{info: info, timer: time.AfterFunc(timeout, func() { m.parkExpired(key) })}
+	m.parkMu.Unlock()
+
+	info.Music = playParkMusic(info.CallID, !caller, remote, codecs)
+	m.UpdateOffload(session)
+	log.Printf("Parked the %s of call %s for up to %s", info.Leg, info.CallID, timeout)
+	return info, nil
+}
+
+// UnparkLeg re-attaches a parked leg, named caller, callee or by its tag.
+// With a remote address its media goes to a new endpoint, whose RTP is
+// recognized by ssrc when it is not zero; otherwise the endpoint the last
+// offer or answer described is kept
+func (m *SessionManager) UnparkLeg(session *MediaSession, leg string, remote *net.UDPAddr, ssrc uint32) error {
+	session.mu.Lock()
+	l := session.legNamed(leg)
+	if l == nil {
+		session.mu.Unlock()
+		return fmt.Errorf("%w: %q", ErrUnknownLeg, leg)
+	}
+	if !l.Parked {
+		session.mu.Unlock()
+		return ErrLegNotParked
+	}
+	l.Parked = false
+	if remote != nil {
+		l.IP, l.Port, l.LatchedSource = remote.IP, remote.Port, nil
+		l.RTCPPort, l.RTCPIP = remote.Port+1, nil
+		if l.RTCPMux {
+			l.RTCPPort = remote.Port
+		}
+		if len(l.Streams) > 0 && l.Streams[0].LocalPort == l.LocalPort {
+			l.Streams[0].IP, l.Streams[0].Port, l.Streams[0].RTCPPort = remote.IP, l.Port, l.RTCPPort
+		}
+	}
+	caller := l == session.CallerLeg
+	session.Flags[CallParkedFlag] = session.CallerLeg != nil && session.CallerLeg.Parked ||
+		session.CalleeLeg != nil && session.CalleeLeg.Parked
+	callID := session.CallID
+	session.mu.Unlock()
+
+	if ssrc != 0 {
+		if err := m.registry.RegisterLegSSRC(session, l, ssrc); err != nil {
+			return err
+		}
+	}
+
+	m.parkMu.Lock()
+	if parked, ok := m.parked[parkKey(session.ID, legName(caller))]; ok {
+		parked.timer.Stop()
+		delete(m.parked, parkKey(session.ID, legName(caller)))
+	}
+	m.parkMu.Unlock()
+
+	_ = GetMediaPlayer().StopPlayback(parkMusicKey(callID, !caller))
+	m.UpdateOffload(session)
+	log.Printf("Re-attached the %s of call %s", legName(caller), callID)
+	return nil
+}
+
+// ListParked returns the parked legs
+func (m *SessionManager) ListParked() []ParkInfo {
+	m.parkMu.Lock()
+	defer m.parkMu.Unlock()
+
+	parked := make([]ParkInfo, 0, len(m.parked))
+	for _, p := range m.parked {
+		parked = append(parked, p.info)
+	}
+	return parked
+}
+
+// parkExpired ends the call of a leg that was not re-attached in time
+func (m *SessionManager) parkExpired(key string) {
+	m.parkMu.Lock()
+	parked, ok := m.parked[key]
+	delete(m.parked, key)
+	m.parkMu.Unlock()
+	if !ok {
+		return
+	}
+
+	log.Printf("Parked %s of call %s was not re-attached, ending the call", parked.info.Leg, parked.info.CallID)
+	GetMediaPlayer().StopCall(parked.info.CallID)
+	GetCodecNegotiator().RemoveCall(parked.info.CallID)
+	m.TerminateCall(parked.info.CallID)
+}
+
+// forgetParked drops the parked legs of a session that ended
+func (m *SessionManager) forgetParked(sessionID string) {
+	m.parkMu.Lock()
+	defer m.parkMu.Unlock()
+
+	for _, leg := range []string{LegCaller, LegCallee} {
+		if parked, ok := m.parked[parkKey(sessionID, leg)]; ok {
+			parked.timer.Stop()
+			delete(m.parked, parkKey(sessionID, leg))
+		}
+	}
+}
+
+// playParkMusic plays music on hold to the party left when its peer was
+// parked, if music on hold is configured. It reports whether it plays
+func playParkMusic(callID string, caller bool, remote *net.UDPAddr, codecs []CodecInfo) bool {
+	config := musicOnHoldConfig.Load()
+	if config == nil || !config.Enabled || config.File == "" || remote == nil {
+		return false
+	}
+	err := GetMediaPlayer().StartPlayback(parkMusicKey(callID, caller), &PlaybackConfig{
+		FilePath:  config.File,
+		Loop:      true,
+		TargetLeg: legName(caller),
+		CallID:    callID,
+		Target:    playbackLegCodec(callID, caller, codecs),
+		Remote:    remote,
+	})
+	if err != nil {
+		if musicOnHoldErrors.Allow() {
+			musicOnHoldErrors.Log("Failed to start music on hold", "call_id", callID, "leg", legName(caller), "error", err)
+		}
+		return false
+	}
+	return true
+}
+
+// legName names the caller or the callee leg
+func legName(caller bool) string {
+	if caller {
+		return LegCaller
+	}
+	return LegCallee
+}
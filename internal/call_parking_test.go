@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// parkingTestCall returns a session with a caller and a callee whose RTP is
+// relayed through the forwarder into a payload sink
+func parkingTestCall(t *testing.T, callID string) (*SessionManager, *SessionRegistry, *MediaSession, *payloadSink) {
+	t.Helper()
+	manager, registry, _ := newTestSessionManager(t)
+	session := registry.CreateSession(callID, "from-tag")
+
+	codecs := []CodecInfo{{PayloadType: 0, Name: "PCMU", ClockRate: 8000, Channels: 1}}
+	caller := &CallLeg{Tag: "from-tag", IP: net.ParseIP("192.0.2.10"), Port: 30000, LocalPort: 20000,
+		MediaType: MediaAudio, Transport: TransportRTP, Codecs: codecs}
+	callee := &CallLeg{Tag: "to-tag", IP: net.ParseIP("198.51.100.20"), Port: 40000, LocalPort: 21000,
+		MediaType: MediaAudio, Transport: TransportRTP, Codecs: codecs}
+	if err := registry.SetCallerLeg(session.ID, caller); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.SetCalleeLeg(session.ID, callee); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.RegisterSSRC(session.ID, 0xC1, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.RegisterSSRC(session.ID, 0xC2, false); err != nil {
+		t.Fatal(err)
+	}
+
+	sink := &payloadSink{sent: make(map[int][][]byte)}
+	registry.SetMediaSender(sink.send)
+	t.Cleanup(func() { registry.SetMediaSender(nil) })
+	return manager, registry, session, sink
+}
+
+func TestParkLeg_DetachAndReattach(t *testing.T) {
+	manager, registry, session, sink := parkingTestCall(t, "park-call")
+	handle := func(ssrc uint32) {
+		t.Helper()
+		if err := registry.forwarder.Handle(&RTPPacket{Version: 2, SSRC: ssrc, Payload: []byte{1, 2, 3, 4}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	info, err := manager.ParkLeg(session, "to-tag", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Leg != LegCallee || info.CallID != "park-call" || info.Music {
+		t.Errorf("unexpected park info %+v", info)
+	}
+	if !session.GetFlag(CallParkedFlag) {
+		t.Error("parked flag not set")
+	}
+	if parked := manager.ListParked(); len(parked) != 1 || parked[0].SessionID != session.ID {
+		t.Errorf("unexpected parked legs %+v", parked)
+	}
+	if _, err := manager.ParkLeg(session, LegCallee, 0); !errors.Is(err, ErrLegParked) {
+		t.Errorf("expected ErrLegParked, got %v", err)
+	}
+
+	// Media neither reaches nor leaves the parked leg
+	handle(0xC1)
+	handle(0xC2)
+	if got := len(sink.take(40000)) + len(sink.take(30000)); got != 0 {
+		t.Errorf("relayed %d packets while parked", got)
+	}
+
+	// The transferred party answers from a new endpoint with its own SSRC
+	remote := &net.UDPAddr{IP: net.ParseIP("203.0.113.30"), Port: 42000}
+	if err := manager.UnparkLeg(session, LegCallee, remote, 0xC3); err != nil {
+		t.Fatal(err)
+	}
+	handle(0xC1)
+	handle(0xC3)
+	if got := sink.take(42000); len(got) != 1 {
+		t.Errorf("re-attached leg received %d packets", len(got))
+	}
+	if got := sink.take(30000); len(got) != 1 {
+		t.Errorf("caller received %d packets from the re-attached leg", len(got))
+	}
+	if session.GetFlag(CallParkedFlag) || len(manager.ListParked()) != 0 {
+		t.Error("leg still parked after re-attachment")
+	}
+	if err := manager.UnparkLeg(session, LegCallee, nil, 0); !errors.Is(err, ErrLegNotParked) {
+		t.Errorf("expected ErrLegNotParked, got %v", err)
+	}
+	if _, err := manager.ParkLeg(session, "other-tag", 0); !errors.Is(err, ErrUnknownLeg) {
+		t.Errorf("expected ErrUnknownLeg, got %v", err)
+	}
+}
+
+func TestParkLeg_Expiry(t *testing.T) {
+	manager, registry, session, _ := parkingTestCall(t, "park-expiry")
+
+	if _, err := manager.ParkLeg(session, LegCaller, 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, ok := registry.GetSession(session.ID); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("call not ended after the park timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if parked := manager.ListParked(); len(parked) != 0 {
+		t.Errorf("expired leg still listed: %+v", parked)
+	}
+}
@@ -0,0 +1,406 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// sessionLog logs the life of media sessions
+var sessionLog = Logger(ComponentNG)
+
+// SessionManager metrics
+var (
+	sessionManagerCallsActive = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "karl_session_manager_calls_active",
+			Help: "Number of calls with media ports allocated",
+		},
+	)
+
+	sessionManagerPortsAllocated = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "karl_session_manager_ports_allocated",
+			Help: "Number of RTP/RTCP ports currently allocated to call legs",
+		},
+	)
+
+	sessionManagerAllocationFailures = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "karl_session_manager_port_allocation_failures_total",
+			Help: "Total number of failed RTP/RTCP port pair allocations",
+		},
+	)
+)
+
+// SessionManager ties call sessions to the media ports allocated for their legs.
+// Each leg receives its own RTP/RTCP port pair from the configured range and
+// all ports are returned to the allocator when the call is torn down.
+type SessionManager struct {
+	registry  *SessionRegistry
+	allocator *PortAllocator
+	localIP   net.IP
+	offload   *KernelOffload // nil unless kernel offload is enabled
+	offloadMu sync.RWMutex
+
+	// openPorts binds a leg's allocated ports, nil while media is received
+	// on the shared RTP listener only
+	openPorts func(ip net.IP, rtpPort, rtcpPort int) (*net.UDPConn, *net.UDPConn, error)
+	portsMu   sync.RWMutex
+
+	// Parked legs waiting to be re-attached, by session ID and leg
+	parked map[string]*parkedLeg
+	parkMu sync.Mutex
+
+	// Tenants' sessions, by session ID, with the tenant and metrics label
+	// they count under and the port allocator of their tenant's range.
+	// Tenants with the same range share its allocator
+	tenantSessions map[string]tenantSession
+	tenantCounts   map[string]int // Calls by tenant name
+	sessionPools   map[string]*PortAllocator
+	tenantPools    map[[2]int]*PortAllocator
+	tenantMu       sync.Mutex
+
+	// Serializes admission so that concurrent offers cannot overshoot a cap
+	admitMu sync.Mutex
+}
+
+// NewSessionManager creates a session manager on top of a registry and port allocator
+func NewSessionManager(registry *SessionRegistry, allocator *PortAllocator, localIP string) *SessionManager {
+	ip := net.ParseIP(localIP)
+	if ip == nil {
+		ip = net.IPv4(127, 0, 0, 1)
+	}
+
+	m := &SessionManager{
+		registry:  registry,
+		allocator: allocator,
+		localIP:   ip,
+	}
+
+	// Release ports for sessions removed by TTL cleanup as well
+	registry.SetOnSessionRemoved(func(session *MediaSession) {
+		m.releasePorts(session.ID)
+		m.forgetParked(session.ID)
+	})
+
+	return m
+}
+
+// AllocateLeg allocates an RTP/RTCP port pair for one side of a call.
+// If the leg already has ports (e.g. a re-INVITE), they are reused.
+func (m *SessionManager) AllocateLeg(session *MediaSession, tag string, isCaller bool) (*CallLeg, error) {
+	return m.AllocateLegOn(session, tag, isCaller, "", nil)
+}
+
+// AllocateLegOn allocates a leg whose media uses the named interface and is
+// bound to localIP, or to the manager's address when localIP is nil
+func (m *SessionManager) AllocateLegOn(session *MediaSession, tag string, isCaller bool, iface string, localIP net.IP) (*CallLeg, error) {
+	session.RLock()
+	existing := session.CalleeLeg
+	if isCaller {
+		existing = session.CallerLeg
+	}
+	session.RUnlock()
+
+	if existing != nil && existing.LocalPort > 0 {
+		return existing, nil
+	}
+
+	pool := m.portPool(session.ID)
+	rtpPort, rtcpPort, err := pool.AllocatePortPair(session.ID)
+	if err != nil {
+		sessionManagerAllocationFailures.Inc()
+		return nil, fmt.Errorf("failed to allocate port pair for call %s: %w", session.CallID, err)
+	}
+
+	if localIP == nil {
+		localIP = m.localIP
+	}
+	leg := &CallLeg{
+		Tag:           tag,
+		MediaType:     MediaAudio,
+		Interface:     iface,
+		LocalIP:       localIP,
+		LocalPort:     rtpPort,
+		LocalRTCPPort: rtcpPort,
+		LastActivity:  time.Now(),
+	}
+
+	if isCaller {
+		err = m.registry.SetCallerLeg(session.ID, leg)
+	} else {
+		err = m.registry.SetCalleeLeg(session.ID, leg)
+	}
+	if err != nil {
+		_ = pool.ReleasePort(rtpPort)
+		_ = pool.ReleasePort(rtcpPort)
+		return nil, err
+	}
+
+	m.updateMetrics()
+	return leg, nil
+}
+
+// AnswerBranch returns the callee leg for an answer with toTag. SIP forking
+// has several branches answer one offer, and each gets a leg of its own on
+// the ports of the first: the first branch to answer is the active one,
+// whose early media is relayed, and early answers of other branches wait.
+// A final answer makes its branch the active one and releases the others.
+// It reports whether the leg is the active one
+func (m *SessionManager) AnswerBranch(session *MediaSession, toTag, viaBranch string, early bool, iface string, localIP net.IP) (*CallLeg, bool, error) {
+	if _, err := m.AllocateLegOn(session, toTag, false, iface, localIP); err != nil {
+		return nil, false, err
+	}
+	leg, active := m.registry.answerBranch(session, toTag, viaBranch, early)
+	return leg, active, nil
+}
+
+// AllocateStreams gives every accepted m= section of a leg its own RTP/RTCP
+// port pair. The primary section uses the leg's ports, and sections keep the
+// ports of an earlier offer/answer.
+func (m *SessionManager) AllocateStreams(session *MediaSession, leg *CallLeg) error {
+	// Metrics read the registry, which must not be locked under the session
+	defer m.updateMetrics()
+
+	pool := m.portPool(session.ID)
+	session.Lock()
+	defer session.Unlock()
+
+	for _, stream := range leg.Streams {
+		if stream.Port == 0 || stream.LocalPort > 0 {
+			continue
+		}
+		rtpPort, rtcpPort, err := pool.AllocatePortPair(session.ID)
+		if err != nil {
+			sessionManagerAllocationFailures.Inc()
+			return fmt.Errorf("failed to allocate %s port pair for call %s: %w", stream.MediaType, session.CallID, err)
+		}
+		stream.LocalPort = rtpPort
+		stream.LocalRTCPPort = rtcpPort
+	}
+	return nil
+}
+
+// SetMediaPortOpener makes OpenMedia bind allocated ports with open, such as
+// RTPControl.OpenMediaPorts. nil leaves the ports unbound
+func (m *SessionManager) SetMediaPortOpener(open func(ip net.IP, rtpPort, rtcpPort int) (*net.UDPConn, *net.UDPConn, error)) {
+	m.portsMu.Lock()
+	defer m.portsMu.Unlock()
+	m.openPorts = open
+}
+
+// OpenMedia binds the port pairs of a leg and its streams that are not bound
+// yet, so the leg's media and RTCP arrive on the ports in its SDP and go out
+// from them. The sockets close when the ports are released. It is a no-op
+// without a media port opener
+func (m *SessionManager) OpenMedia(session *MediaSession, leg *CallLeg) error {
+	m.portsMu.RLock()
+	open := m.openPorts
+	m.portsMu.RUnlock()
+	if open == nil {
+		return nil
+	}
+
+	pool := m.portPool(session.ID)
+	session.Lock()
+	err := openLegMedia(pool, open, session, leg)
+	session.Unlock()
+
+	// Media arriving on the ports is tied to the party sending to them
+	m.registry.indexMediaPorts(session, leg)
+	return err
+}
+
+// openLegMedia binds the port pairs of a leg and its streams that are not
+// bound yet. The caller holds the session lock
+func openLegMedia(pool *PortAllocator, open func(ip net.IP, rtpPort, rtcpPort int) (*net.UDPConn, *net.UDPConn, error), session *MediaSession, leg *CallLeg) error {
+	// Only an interface's address is known to be local; otherwise LocalIP
+	// may be the advertised one, so bind every address
+	var ip net.IP
+	if leg.Interface != "" {
+		ip = leg.LocalIP
+	}
+
+	if leg.LocalPort > 0 && leg.Conn == nil {
+		rtpConn, rtcpConn, err := openPair(pool, open, ip, leg.LocalPort, leg.LocalRTCPPort)
+		if err != nil {
+			return fmt.Errorf("failed to open media ports for call %s: %w", session.CallID, err)
+		}
+		leg.Conn, leg.RTCPConn = rtpConn, rtcpConn
+	}
+	for _, stream := range leg.Streams {
+		if stream.LocalPort == leg.LocalPort {
+			stream.Conn, stream.RTCPConn = leg.Conn, leg.RTCPConn
+			continue
+		}
+		if stream.LocalPort == 0 || stream.Conn != nil || pool.hasConn(stream.LocalPort) {
+			continue
+		}
+		rtpConn, rtcpConn, err := openPair(pool, open, ip, stream.LocalPort, stream.LocalRTCPPort)
+		if err != nil {
+			return fmt.Errorf("failed to open %s ports for call %s: %w", stream.MediaType, session.CallID, err)
+		}
+		stream.Conn, stream.RTCPConn = rtpConn, rtcpConn
+	}
+	return nil
+}
+
+// openPair binds a port pair allocated from pool and hands the sockets to
+// the allocator, which closes them on release
+func openPair(pool *PortAllocator, open func(ip net.IP, rtpPort, rtcpPort int) (*net.UDPConn, *net.UDPConn, error), ip net.IP, rtpPort, rtcpPort int) (*net.UDPConn, *net.UDPConn, error) {
+	rtpConn, rtcpConn, err := open(ip, rtpPort, rtcpPort)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := pool.AttachConn(rtpPort, rtpConn); err != nil {
+		rtpConn.Close()
+		rtcpConn.Close()
+		return nil, nil, err
+	}
+	if err := pool.AttachConn(rtcpPort, rtcpConn); err != nil {
+		rtcpConn.Close()
+		return nil, nil, err
+	}
+	return rtpConn, rtcpConn, nil
+}
+
+// TerminateCall ends every session for a call-id and releases its ports.
+// It returns the number of sessions that were removed.
+func (m *SessionManager) TerminateCall(callID string) int {
+	sessions := m.registry.GetSessionByCallID(callID)
+	for _, session := range sessions {
+		m.terminateSession(session)
+	}
+
+	if len(sessions) > 0 {
+		sessionLog.Info("Terminated call", "call_id", callID, "sessions", len(sessions))
+	}
+	m.updateMetrics()
+	return len(sessions)
+}
+
+// terminateSession ends one session of a call and releases its ports and
+// its place under the admission caps
+func (m *SessionManager) terminateSession(session *MediaSession) {
+	_ = m.registry.UpdateSessionState(session.ID, string(SessionStateTerminated))
+	_ = m.registry.DeleteSession(session.ID)
+	m.releasePorts(session.ID)
+	m.forgetParked(session.ID)
+}
+
+// SetKernelOffload makes the manager relay eligible sessions in the kernel,
+// or stops doing so when offload is nil
+func (m *SessionManager) SetKernelOffload(offload *KernelOffload) {
+	m.offloadMu.Lock()
+	defer m.offloadMu.Unlock()
+	m.offload = offload
+}
+
+// UpdateOffload moves a session into or out of the kernel after its media
+// or flags changed. It is a no-op without kernel offload
+func (m *SessionManager) UpdateOffload(session *MediaSession) {
+	m.offloadMu.RLock()
+	offload := m.offload
+	m.offloadMu.RUnlock()
+	if offload == nil {
+		return
+	}
+	offloaded, err := offload.Update(session)
+	session.setKernelOffloaded(offloaded)
+	if err != nil {
+		sessionLog.Warn("Kernel offload failed", "call_id", session.CallID, "error", err)
+		return
+	}
+	if offloaded {
+		sessionLog.Info("Call relayed in the kernel", "call_id", session.CallID)
+	}
+}
+
+// setKernelOffloaded records whether a session is relayed in the kernel.
+// Its media timeout starts over when it comes back to user space, where
+// Karl sees its packets again
+func (session *MediaSession) setKernelOffloaded(offloaded bool) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.KernelOffloaded && !offloaded {
+		session.offloadEnded = time.Now()
+	}
+	session.KernelOffloaded = offloaded
+}
+
+// StopKernelOffload returns every offloaded session to user space and
+// closes the forwarder
+func (m *SessionManager) StopKernelOffload() error {
+	m.offloadMu.Lock()
+	offload := m.offload
+	m.offload = nil
+	m.offloadMu.Unlock()
+	if offload == nil {
+		return nil
+	}
+	err := offload.Close()
+	for _, session := range m.registry.ListSessions() {
+		session.setKernelOffloaded(false)
+	}
+	return err
+}
+
+// releasePorts returns all ports held by a session to the allocator
+func (m *SessionManager) releasePorts(sessionID string) {
+	m.offloadMu.RLock()
+	if m.offload != nil {
+		m.offload.Release(sessionID)
+	}
+	m.offloadMu.RUnlock()
+	if err := m.portPool(sessionID).ReleaseSessionPorts(sessionID); err != nil {
+		sessionLog.Error("Failed to release ports", "session_id", sessionID, "error", err)
+	}
+	m.releaseTenant(sessionID)
+	m.updateMetrics()
+}
+
+// updateMetrics refreshes the Prometheus gauges from the allocator state
+func (m *SessionManager) updateMetrics() {
+	sessionManagerCallsActive.Set(float64(m.registry.GetTotalCount()))
+	sessionManagerPortsAllocated.Set(float64(m.allocator.currentInUse.Load() + m.tenantPortsInUse()))
+	m.updateCapacity()
+}
+
+// GetCounts returns the number of tracked sessions and allocated ports
+func (m *SessionManager) GetCounts() (sessions int, ports int) {
+	return m.registry.GetTotalCount(), int(m.allocator.currentInUse.Load() + m.tenantPortsInUse())
+}
+
+// HealthCheck reports session and port allocation health
+func (m *SessionManager) HealthCheck() ComponentHealth {
+	sessions, ports := m.GetCounts()
+	utilization := m.allocator.GetUtilization()
+
+	status := StatusUp
+	message := "Session manager is healthy"
+	if m.allocator.IsNearExhaustion(0.9) {
+		status = StatusDegraded
+		message = fmt.Sprintf("Media port range nearly exhausted: %.1f%%", utilization*100)
+	}
+	if m.allocator.GetAvailableCount() <= 0 {
+		status = StatusDown
+		message = "Media port range exhausted"
+	}
+
+	health := CreateComponentHealth(status, message)
+	health.Details["sessions"] = fmt.Sprintf("%d", sessions)
+	health.Details["ports_allocated"] = fmt.Sprintf("%d", ports)
+	health.Details["ports_available"] = fmt.Sprintf("%d", m.allocator.GetAvailableCount())
+	health.Details["port_utilization"] = fmt.Sprintf("%.2f%%", utilization*100)
+	m.offloadMu.RLock()
+	if m.offload != nil {
+		health.Details["kernel_offload_sessions"] = fmt.Sprintf("%d", m.offload.Count())
+	}
+	m.offloadMu.RUnlock()
+	return health
+}
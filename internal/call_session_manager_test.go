@@ -0,0 +1,394 @@
+package internal
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestSessionManager(t *testing.T) (*SessionManager, *SessionRegistry, *PortAllocator) {
+	t.Helper()
+
+	registry := NewSessionRegistry(time.Hour)
+	allocator := NewPortAllocator(&PortAllocatorConfig{
+		MinPort:        41000,
+		MaxPort:        41100,
+		ReserveCount:   4,
+		MaxAllocations: 10,
+		EvenOnly:       true,
+	})
+	t.Cleanup(func() {
+		registry.Stop()
+		allocator.Close()
+	})
+
+	return NewSessionManager(registry, allocator, "192.0.2.10"), registry, allocator
+}
+
+func TestSessionManager_AllocateLegs(t *testing.T) {
+	manager, registry, _ := newTestSessionManager(t)
+	session := registry.CreateSession("call-1", "from-1")
+
+	caller, err := manager.AllocateLeg(session, "from-1", true)
+	if err != nil {
+		t.Fatalf("AllocateLeg(caller) failed: %v", err)
+	}
+	callee, err := manager.AllocateLeg(session, "to-1", false)
+	if err != nil {
+		t.Fatalf("AllocateLeg(callee) failed: %v", err)
+	}
+
+	if caller.LocalRTCPPort != caller.LocalPort+1 {
+		t.Errorf("expected RTCP port %d, got %d", caller.LocalPort+1, caller.LocalRTCPPort)
+	}
+	if caller.LocalPort == callee.LocalPort {
+		t.Error("expected each leg to have its own port pair")
+	}
+	if caller.LocalIP.String() != "192.0.2.10" {
+		t.Errorf("expected local IP 192.0.2.10, got %s", caller.LocalIP)
+	}
+	if session.CallerLeg != caller || session.CalleeLeg != callee {
+		t.Error("expected legs to be attached to the session")
+	}
+	if session.ToTag != "to-1" {
+		t.Errorf("expected to-tag to-1, got %s", session.ToTag)
+	}
+
+	sessions, ports := manager.GetCounts()
+	if sessions != 1 || ports != 4 {
+		t.Errorf("expected 1 session and 4 ports, got %d and %d", sessions, ports)
+	}
+}
+
+func TestSessionManager_ReuseLegPorts(t *testing.T) {
+	manager, registry, _ := newTestSessionManager(t)
+	session := registry.CreateSession("call-2", "from-2")
+
+	first, err := manager.AllocateLeg(session, "from-2", true)
+	if err != nil {
+		t.Fatalf("AllocateLeg failed: %v", err)
+	}
+	second, err := manager.AllocateLeg(session, "from-2", true)
+	if err != nil {
+		t.Fatalf("AllocateLeg failed: %v", err)
+	}
+
+	if first.LocalPort != second.LocalPort {
+		t.Errorf("expected re-offer to reuse port %d, got %d", first.LocalPort, second.LocalPort)
+	}
+	if _, ports := manager.GetCounts(); ports != 2 {
+		t.Errorf("expected 2 ports allocated, got %d", ports)
+	}
+}
+
+func TestSessionManager_TerminateCallReleasesPorts(t *testing.T) {
+	manager, registry, _ := newTestSessionManager(t)
+	session := registry.CreateSession("call-3", "from-3")
+
+	if _, err := manager.AllocateLeg(session, "from-3", true); err != nil {
+		t.Fatalf("AllocateLeg failed: %v", err)
+	}
+	if _, err := manager.AllocateLeg(session, "to-3", false); err != nil {
+		t.Fatalf("AllocateLeg failed: %v", err)
+	}
+
+	if removed := manager.TerminateCall("call-3"); removed != 1 {
+		t.Errorf("expected 1 session removed, got %d", removed)
+	}
+
+	sessions, ports := manager.GetCounts()
+	if sessions != 0 || ports != 0 {
+		t.Errorf("expected no sessions or ports after teardown, got %d and %d", sessions, ports)
+	}
+	if removed := manager.TerminateCall("call-3"); removed != 0 {
+		t.Errorf("expected no sessions on second delete, got %d", removed)
+	}
+}
+
+func TestSessionManager_OpenMediaRelaysOnLegPorts(t *testing.T) {
+	control, err := NewRTPControl(nil, nil)
+	if err != nil {
+		t.Fatalf("NewRTPControl failed: %v", err)
+	}
+	defer control.Stop()
+	forwardThroughPool(t, control)
+
+	manager, registry, _ := newTestSessionManager(t)
+	manager.SetMediaPortOpener(control.OpenMediaPorts)
+	registry.SetMediaSender(control.SendBatchFrom)
+	defer registry.SetMediaSender(nil)
+
+	endpoints := make([]*net.UDPConn, 2)
+	for i := range endpoints {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		endpoints[i] = conn
+	}
+
+	session := registry.CreateSession("call-ports", "from-p")
+	legs := make([]*CallLeg, 2)
+	for i, tag := range []string{"from-p", "to-p"} {
+		leg, err := manager.AllocateLeg(session, tag, i == 0)
+		if err != nil {
+			t.Fatalf("AllocateLeg failed: %v", err)
+		}
+		addr := endpoints[i].LocalAddr().(*net.UDPAddr)
+		session.Lock()
+		leg.IP, leg.Port = addr.IP, addr.Port
+		session.Unlock()
+		if err := manager.OpenMedia(session, leg); err != nil {
+			t.Fatalf("OpenMedia failed: %v", err)
+		}
+		legs[i] = leg
+	}
+	if err := registry.RegisterSSRC(session.ID, 0x61, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// The caller sends to the callee leg's port, from the answer it got,
+	// and the callee hears the call from the caller leg's port, the one in
+	// the offer it got
+	packet := make([]byte, 172)
+	packet[0], packet[3], packet[11] = 0x80, 9, 0x61
+	if _, err := endpoints[0].WriteToUDP(packet, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: legs[1].LocalPort}); err != nil {
+		t.Fatal(err)
+	}
+	endpoints[1].SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	n, from, err := endpoints[1].ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("callee received nothing: %v", err)
+	}
+	if n != 172 || buf[3] != 9 {
+		t.Errorf("callee received %d bytes with sequence %d", n, buf[3])
+	}
+	if from.Port != legs[0].LocalPort {
+		t.Errorf("relayed from port %d instead of the caller leg's port %d", from.Port, legs[0].LocalPort)
+	}
+
+	// Tearing the call down closes its sockets
+	manager.TerminateCall("call-ports")
+	for _, port := range []int{legs[0].LocalPort, legs[0].LocalRTCPPort, legs[1].LocalPort, legs[1].LocalRTCPPort} {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+		if err != nil {
+			t.Errorf("port %d still bound after the call ended: %v", port, err)
+			continue
+		}
+		conn.Close()
+	}
+}
+
+func TestSessionManager_OpenMediaLearnsSSRCs(t *testing.T) {
+	control, err := NewRTPControl(nil, nil)
+	if err != nil {
+		t.Fatalf("NewRTPControl failed: %v", err)
+	}
+	defer control.Stop()
+	forwardThroughPool(t, control)
+
+	manager, registry, _ := newTestSessionManager(t)
+	manager.SetMediaPortOpener(control.OpenMediaPorts)
+	registry.SetMediaSender(control.SendBatchFrom)
+	defer registry.SetMediaSender(nil)
+	control.SetSSRCLearner(registry.LearnSSRC)
+
+	endpoints := make([]*net.UDPConn, 2)
+	for i := range endpoints {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		endpoints[i] = conn
+	}
+
+	// Neither party's SDP announces its SSRC
+	session := registry.CreateSession("call-learn", "from-l")
+	defer manager.TerminateCall("call-learn")
+	legs := make([]*CallLeg, 2)
+	for i, tag := range []string{"from-l", "to-l"} {
+		leg, err := manager.AllocateLeg(session, tag, i == 0)
+		if err != nil {
+			t.Fatalf("AllocateLeg failed: %v", err)
+		}
+		addr := endpoints[i].LocalAddr().(*net.UDPAddr)
+		session.Lock()
+		leg.IP, leg.Port = addr.IP, addr.Port
+		session.Unlock()
+		if err := manager.OpenMedia(session, leg); err != nil {
+			t.Fatalf("OpenMedia failed: %v", err)
+		}
+		legs[i] = leg
+	}
+
+	relay := func(from, to int, ssrc byte) {
+		t.Helper()
+		packet := make([]byte, 172)
+		packet[0], packet[3], packet[11] = 0x80, 5, ssrc
+		if _, err := endpoints[from].WriteToUDP(packet, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: legs[to].LocalPort}); err != nil {
+			t.Fatal(err)
+		}
+		endpoints[to].SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, 1500)
+		n, _, err := endpoints[to].ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("SSRC %#x not relayed from party %d: %v", ssrc, from, err)
+		}
+		if n != 172 || buf[11] != ssrc {
+			t.Errorf("relayed %d bytes with SSRC %#x", n, buf[11])
+		}
+	}
+	relay(0, 1, 0x71)
+	relay(1, 0, 0x72)
+
+	session.RLock()
+	caller, callee := session.SSRCToLeg[0x71], session.SSRCToLeg[0x72]
+	session.RUnlock()
+	if caller != legs[0] || callee != legs[1] {
+		t.Errorf("learned SSRCs tied to the wrong legs")
+	}
+
+	// A stream of the caller cannot be claimed on the callee's port
+	if registry.LearnSSRC(legs[0].Conn, 0x71, endpoints[1].LocalAddr().(*net.UDPAddr)) {
+		t.Error("caller's SSRC accepted from the callee side")
+	}
+}
+
+func TestSessionManager_HealthCheck(t *testing.T) {
+	manager, registry, _ := newTestSessionManager(t)
+	session := registry.CreateSession("call-4", "from-4")
+	if _, err := manager.AllocateLeg(session, "from-4", true); err != nil {
+		t.Fatalf("AllocateLeg failed: %v", err)
+	}
+
+	health := manager.HealthCheck()
+	if health.Status != StatusUp {
+		t.Errorf("expected status UP, got %s", health.Status)
+	}
+	if health.Details["sessions"] != "1" {
+		t.Errorf("expected 1 session in details, got %s", health.Details["sessions"])
+	}
+	if health.Details["ports_allocated"] != "2" {
+		t.Errorf("expected 2 ports in details, got %s", health.Details["ports_allocated"])
+	}
+}
+
+func TestSessionManager_MediaTimeoutReapsCall(t *testing.T) {
+	manager, registry, _ := newTestSessionManager(t)
+	registry.SetMediaTimeout(30 * time.Second)
+
+	timedOut := make(chan string, 1)
+	registry.SetOnMediaTimeout(func(session *MediaSession, idle time.Duration) {
+		timedOut <- session.CallID
+	})
+
+	session := registry.CreateSession("call-5", "from-5")
+	leg, err := manager.AllocateLeg(session, "from-5", true)
+	if err != nil {
+		t.Fatalf("AllocateLeg failed: %v", err)
+	}
+	if err := registry.RegisterSSRC(session.ID, 0x5555, true); err != nil {
+		t.Fatalf("RegisterSSRC failed: %v", err)
+	}
+	_ = registry.UpdateSessionState(session.ID, string(SessionStateActive))
+
+	// Media within the timeout keeps the call alive
+	registry.RecordMediaActivity(0x5555, 172)
+	if reaped := registry.reapInactiveSessions(time.Now().Add(10 * time.Second)); reaped != 0 {
+		t.Fatalf("expected no sessions reaped while media flows, got %d", reaped)
+	}
+
+	session.Lock()
+	leg.LastActivity = time.Now().Add(-time.Minute)
+	session.Unlock()
+
+	if reaped := registry.reapInactiveSessions(time.Now()); reaped != 1 {
+		t.Fatalf("expected 1 session reaped, got %d", reaped)
+	}
+
+	select {
+	case callID := <-timedOut:
+		if callID != "call-5" {
+			t.Errorf("expected timeout event for call-5, got %s", callID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected media timeout event")
+	}
+
+	// Port release runs from the removal callback
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ports := manager.GetCounts(); ports == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected ports to be released after media timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSessionRegistry_ReapsCallsWithoutMedia(t *testing.T) {
+	manager, registry, _ := newTestSessionManager(t)
+	registry.SetMediaTimeout(30 * time.Second)
+
+	// Neither party announced an SSRC nor sent media since the answer
+	session := registry.CreateSession("call-7", "from-7")
+	if _, err := manager.AllocateLeg(session, "from-7", true); err != nil {
+		t.Fatalf("AllocateLeg failed: %v", err)
+	}
+	_ = registry.UpdateSessionState(session.ID, string(SessionStateActive))
+
+	if reaped := registry.reapInactiveSessions(time.Now().Add(10 * time.Second)); reaped != 0 {
+		t.Fatalf("expected a call answered within the timeout to survive, got %d reaped", reaped)
+	}
+
+	// A call relayed in the kernel is not seen by Karl, so it is left alone
+	session.setKernelOffloaded(true)
+	if reaped := registry.reapInactiveSessions(time.Now().Add(time.Hour)); reaped != 0 {
+		t.Fatalf("expected an offloaded call to survive, got %d reaped", reaped)
+	}
+
+	// Back in user space, its timeout starts over
+	session.setKernelOffloaded(false)
+	if reaped := registry.reapInactiveSessions(time.Now().Add(10 * time.Second)); reaped != 0 {
+		t.Fatalf("expected a call back from the kernel to survive, got %d reaped", reaped)
+	}
+	if reaped := registry.reapInactiveSessions(time.Now().Add(time.Minute)); reaped != 1 {
+		t.Fatalf("expected the silent call to be reaped, got %d", reaped)
+	}
+}
+
+func TestSessionRegistry_PerSessionMediaTimeout(t *testing.T) {
+	manager, registry, _ := newTestSessionManager(t)
+	registry.SetMediaTimeout(30 * time.Second)
+
+	session := registry.CreateSession("call-6", "from-6")
+	leg, err := manager.AllocateLeg(session, "from-6", true)
+	if err != nil {
+		t.Fatalf("AllocateLeg failed: %v", err)
+	}
+	_ = registry.RegisterSSRC(session.ID, 0x6666, true)
+	_ = registry.UpdateSessionState(session.ID, string(SessionStateActive))
+
+	// A media-timeout of 0 from the NG flags disables reaping for this call
+	session.Lock()
+	session.MediaTimeout = 0
+	leg.LastActivity = time.Now().Add(-time.Hour)
+	session.Unlock()
+
+	if reaped := registry.reapInactiveSessions(time.Now()); reaped != 0 {
+		t.Errorf("expected call with media timeout disabled to survive, got %d reaped", reaped)
+	}
+
+	session.Lock()
+	session.MediaTimeout = 120
+	leg.LastActivity = time.Now().Add(-time.Minute)
+	session.Unlock()
+	if reaped := registry.reapInactiveSessions(time.Now()); reaped != 0 {
+		t.Errorf("expected call within its own 120s timeout to survive, got %d reaped", reaped)
+	}
+}
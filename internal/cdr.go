@@ -134,6 +134,7 @@ func (c *CDR) ToCSVRow() []string {
 		fmt.Sprintf("%.2f", c.PacketsLostPct),
 		fmt.Sprintf("%.2f", c.Jitter),
 		fmt.Sprintf("%.2f", c.MOS),
+		fmt.Sprintf("%.1f", c.RFactor),
 		c.DisconnectCause,
 		fmt.Sprintf("%d", c.DisconnectCode),
 		c.Status,
@@ -164,6 +165,7 @@ func CSVHeader() []string {
 		"packets_lost_pct",
 		"jitter_ms",
 		"mos",
+		"r_factor",
 		"disconnect_cause",
 		"disconnect_code",
 		"status",
@@ -642,6 +644,21 @@ func (b *CDRBuilder) WithQuality(packetsLost uint64, jitter, mos float64) *CDRBu
 	return b
 }
 
+// WithCallQuality sets quality metrics measured on a session
+func (b *CDRBuilder) WithCallQuality(q SessionQuality) *CDRBuilder {
+	lost := int64(q.Caller.PacketsLost) + int64(q.Callee.PacketsLost)
+	if lost > 0 {
+		b.cdr.PacketsLost = uint64(lost)
+	}
+	b.cdr.Jitter = q.AvgJitterMs
+	b.cdr.MOS = q.MOS
+	b.cdr.RFactor = q.RFactor
+	if b.cdr.Codec == "" {
+		b.cdr.Codec = q.Caller.Codec
+	}
+	return b
+}
+
 // WithStatus sets call status
 func (b *CDRBuilder) WithStatus(status, cause string, code int) *CDRBuilder {
 	b.cdr.Status = status
@@ -154,6 +154,20 @@ type CDRQuality struct {
 	GapDensity   float64 `json:"gap_density,omitempty"`
 }
 
+// NewCDRQuality converts the measured quality of a session. Latency is
+// the one-way network delay, half the round trip
+func NewCDRQuality(q SessionQuality) *CDRQuality {
+	return &CDRQuality{
+		MOS:          q.MOS,
+		RFactor:      q.RFactor,
+		PacketLoss:   q.LossPercent,
+		Jitter:       q.AvgJitterMs,
+		Latency:      q.RTTMs / 2,
+		BurstDensity: q.BurstDensity,
+		GapDensity:   q.GapDensity,
+	}
+}
+
 // DistributedCDRExporter exports distributed CDRs to external systems
 type DistributedCDRExporter interface {
 	Export(ctx context.Context, cdr *DistributedCDR) error
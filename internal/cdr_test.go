@@ -87,8 +87,8 @@ func TestCDR_ToCSVRow(t *testing.T) {
 
 	row := cdr.ToCSVRow()
 
-	if len(row) != 24 {
-		t.Errorf("Expected 24 columns, got %d", len(row))
+	if len(row) != 25 {
+		t.Errorf("Expected 25 columns, got %d", len(row))
 	}
 	if row[0] != "cdr-123" {
 		t.Errorf("Expected id 'cdr-123', got %s", row[0])
@@ -101,8 +101,8 @@ func TestCDR_ToCSVRow(t *testing.T) {
 func TestCSVHeader(t *testing.T) {
 	header := CSVHeader()
 
-	if len(header) != 24 {
-		t.Errorf("Expected 24 header columns, got %d", len(header))
+	if len(header) != 25 {
+		t.Errorf("Expected 25 header columns, got %d", len(header))
 	}
 	if header[0] != "id" {
 		t.Error("First header should be 'id'")
@@ -363,6 +363,30 @@ func TestCDRBuilder(t *testing.T) {
 	}
 }
 
+func TestCDRBuilder_WithCallQuality(t *testing.T) {
+	quality := SessionQuality{
+		Caller:      LegQuality{Codec: "PCMA", PacketsLost: 12},
+		Callee:      LegQuality{Codec: "PCMA", PacketsLost: 3},
+		AvgJitterMs: 8.5,
+		RFactor:     78.4,
+		MOS:         3.91,
+	}
+	cdr := NewCDRBuilder().
+		WithMedia("", 985, 1000, 0, 0).
+		WithCallQuality(quality).
+		Build()
+
+	if cdr.Codec != "PCMA" || cdr.PacketsLost != 15 || cdr.Jitter != 8.5 {
+		t.Errorf("unexpected media fields %+v", cdr)
+	}
+	if cdr.MOS != 3.91 || cdr.RFactor != 78.4 {
+		t.Errorf("expected MOS 3.91 and R-factor 78.4, got %.2f and %.1f", cdr.MOS, cdr.RFactor)
+	}
+	if row := cdr.ToCSVRow(); row[19] != "78.4" || CSVHeader()[19] != "r_factor" {
+		t.Errorf("expected the R-factor column after the MOS, got %q", row[19])
+	}
+}
+
 func TestMemoryCDRExporter(t *testing.T) {
 	exporter := NewMemoryCDRExporter()
 
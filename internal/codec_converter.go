@@ -2,8 +2,11 @@ package internal
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"math"
+	"strings"
+	"sync"
 
 	"github.com/pion/webrtc/v3"
 )
@@ -32,21 +35,162 @@ func NewCodecConverter(sampleRate, channels, frameSize int) *CodecConverter {
 	}
 }
 
-// TranscodeAudio handles conversion between different audio codecs
+// MIME types of codecs pion does not define
+const (
+	MimeTypeG729  = "audio/G729"
+	MimeTypeAMR   = "audio/AMR"
+	MimeTypeAMRWB = "audio/AMR-WB"
+	MimeTypeILBC  = "audio/iLBC"
+	MimeTypeSpeex = "audio/speex"
+)
+
+// ErrFrameSuppressed is returned when the output codec's discontinuous
+// transmission decides a silent frame should not be sent
+var ErrFrameSuppressed = errors.New("frame suppressed by discontinuous transmission")
+
+// TranscodeAudio handles conversion between different audio codecs,
+// resampling whenever the codecs' clock rates differ
 // Exported for use in tests and other packages
 func TranscodeAudio(payload []byte, inputCodec, outputCodec string) ([]byte, error) {
+	return transcodeAudio(payload, mimeCodec(inputCodec), mimeCodec(outputCodec))
+}
+
+// mimeCodec describes a MIME type as a codec with default parameters
+func mimeCodec(mimeType string) CodecInfo {
+	return CodecInfo{Name: strings.TrimPrefix(mimeType, "audio/")}
+}
+
+// transcodeAudio is TranscodeAudio between negotiated codecs, honouring
+// their clock rates and fmtp parameters, e.g. the Opus encoder settings
+func transcodeAudio(payload []byte, input, output CodecInfo) ([]byte, error) {
+	return transcodeAudioWith(payload, input, output, nil, nil)
+}
+
+// transcodeAudioWith is transcodeAudio with a stream's own codec instances,
+// nil for the shared ones, and a stage that processes the decoded audio at
+// the input's sample rate, e.g. gain control. With a stage, even a payload
+// already in the output codec is decoded and encoded again
+func transcodeAudioWith(payload []byte, input, output CodecInfo, codecs *StreamCodecs, stage func([]int16) []int16) ([]byte, error) {
+	inputCodec, outputCodec := codecMimeType(input.Name), codecMimeType(output.Name)
 	switch {
-	case inputCodec == webrtc.MimeTypeOpus && outputCodec == webrtc.MimeTypePCMU:
-		return OpusToPCMU(payload)
-	case inputCodec == webrtc.MimeTypePCMU && outputCodec == webrtc.MimeTypeOpus:
-		return PCMUToOpus(payload)
+	case stage != nil:
 	case inputCodec == webrtc.MimeTypePCMA && outputCodec == webrtc.MimeTypePCMU:
 		return PCMAToPCMU(payload)
 	case inputCodec == webrtc.MimeTypePCMU && outputCodec == webrtc.MimeTypePCMA:
 		return PCMUToPCMA(payload)
-	default:
+	}
+
+	// An accelerator may convert codecs Karl has no software codec for,
+	// such as G.729 or AMR without their native codecs; without one those
+	// are relayed unchanged
+	inputRate, outputRate := codecSampleRate(input), codecSampleRate(output)
+	if inputCodec == outputCodec && inputRate == outputRate && stage == nil {
+		return payload, nil
+	}
+	if stage == nil {
+		if encoded, ok, err := accelerateAudio(payload, input, output); ok {
+			return encoded, err
+		}
+	}
+	if inputRate == 0 || outputRate == 0 {
 		return payload, nil
 	}
+	pcm, err := decodeAudio(input, payload, codecs)
+	if err != nil {
+		return nil, err
+	}
+	if stage != nil {
+		pcm = stage(pcm)
+	}
+	encoded, err := encodeAudio(output, codecs.resample(pcm, inputRate, outputRate), codecs)
+	if err == nil && len(encoded) == 0 {
+		return nil, ErrFrameSuppressed
+	}
+	return encoded, err
+}
+
+// audioSampleRate returns the sample rate TranscodeAudio decodes a codec at,
+// or 0 if the codec cannot be transcoded. G.729, AMR, AMR-WB, iLBC and
+// Speex are transcoded only with their native codecs built in, and
+// relayed otherwise
+func audioSampleRate(mimeType string) int {
+	switch mimeType {
+	case webrtc.MimeTypePCMU, webrtc.MimeTypePCMA:
+		return 8000
+	case webrtc.MimeTypeOpus:
+		return opusSampleRate
+	}
+	if native, ok := nativeAudioCodecs[mimeType]; ok {
+		return native.sampleRate(CodecInfo{})
+	}
+	return 0
+}
+
+// codecSampleRate is audioSampleRate for a negotiated codec
+func codecSampleRate(c CodecInfo) int {
+	if native, ok := nativeAudioCodecFor(c); ok {
+		return native.sampleRate(c)
+	}
+	return audioSampleRate(codecMimeType(c.Name))
+}
+
+// decodeAudio decodes a payload into mono PCM at the codec's sample rate
+func decodeAudio(codec CodecInfo, payload []byte, codecs *StreamCodecs) ([]int16, error) {
+	switch mimeType := codecMimeType(codec.Name); mimeType {
+	case webrtc.MimeTypePCMU, webrtc.MimeTypePCMA:
+		if len(payload) == 0 {
+			return nil, fmt.Errorf("empty payload")
+		}
+		return decodeG711(strings.TrimPrefix(mimeType, "audio/"), payload), nil
+	case webrtc.MimeTypeOpus:
+		pcm, err := codecs.OpusDecoder().Decode(payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode Opus: %v", err)
+		}
+		return stereoToMono(pcm), nil
+	default:
+		if native, ok := nativeAudioCodecFor(codec); ok {
+			return codecs.decodeNative(native, codec, payload)
+		}
+		return nil, fmt.Errorf("unsupported codec %s", mimeType)
+	}
+}
+
+// encodeAudio encodes mono PCM at the codec's sample rate
+func encodeAudio(codec CodecInfo, pcm []int16, codecs *StreamCodecs) ([]byte, error) {
+	switch mimeType := codecMimeType(codec.Name); mimeType {
+	case webrtc.MimeTypePCMU, webrtc.MimeTypePCMA:
+		if len(pcm) == 0 {
+			return nil, fmt.Errorf("empty PCM data")
+		}
+		return encodeG711(strings.TrimPrefix(mimeType, "audio/"), pcm), nil
+	case webrtc.MimeTypeOpus:
+		return codecs.OpusEncoder().Encode(monoToStereo(pcm), ParseOpusOptions(codec.Fmtp))
+	default:
+		if native, ok := nativeAudioCodecFor(codec); ok {
+			return codecs.encodeNative(native, codec, pcm)
+		}
+		return nil, fmt.Errorf("unsupported codec %s", mimeType)
+	}
+}
+
+// stereoToMono averages interleaved stereo samples
+func stereoToMono(stereo []int16) []int16 {
+	mono := make([]int16, len(stereo)/2)
+	for i := range mono {
+		mono[i] = int16((int32(stereo[2*i]) + int32(stereo[2*i+1])) / 2)
+	}
+	return mono
+}
+
+// monoToStereo duplicates mono samples into interleaved stereo
+func monoToStereo(mono []int16) []int16 {
+	stereo := make([]int16, len(mono)*2)
+	for i, s := range mono {
+		stereo[2*i] = s
+		stereo[2*i+1] = s
+	}
+	return stereo
 }
 
 // PCMUToPCMA converts G.711 μ-law to A-law
@@ -77,45 +221,38 @@ func PCMAToPCMU(payload []byte) ([]byte, error) {
 	return output, nil
 }
 
-// OpusToPCMU converts Opus to G.711 μ-law
-// Exported for testing
-func OpusToPCMU(payload []byte) ([]byte, error) {
-	pcm, err := DecodeToPCM(payload)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode Opus: %v", err)
-	}
-	return EncodePCMToPCMU(pcm)
-}
-
-// PCMUToOpus converts G.711 μ-law to Opus
-// Exported for testing
-func PCMUToOpus(payload []byte) ([]byte, error) {
-	pcm, err := DecodePCMUToPCM(payload)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode PCM-U: %v", err)
-	}
-	return EncodeToOpus(pcm)
-}
-
 // Opus codec parameters
 const (
 	opusSampleRate = 48000 // Opus works at 48kHz
 	opusChannels   = 2     // Stereo
 	opusFrameSize  = 960   // 20ms at 48kHz
 	opusBitrate    = 64000 // 64 kbps
+
+	// opusDTXThreshold is the frame RMS, about -60 dBFS, below which DTX
+	// treats a frame as silence
+	opusDTXThreshold = 0.001
+	// opusDTXInterval is the number of silent frames between the frames DTX
+	// still sends to keep comfort noise going: one every 400 ms
+	opusDTXInterval = 20
+	// opusMaxFECShare caps the share of the bitrate, in percent, inband FEC
+	// takes from the primary frame
+	opusMaxFECShare = 25
 )
 
 // OpusEncoder represents a stateful Opus encoder
 type OpusEncoder struct {
+	mu         sync.Mutex
 	sampleRate int
 	channels   int
 	frameSize  int
 	bitrate    int
+	packetLoss int
 	instance   *pureGoOpusEncoder
 }
 
 // OpusDecoder represents a stateful Opus decoder
 type OpusDecoder struct {
+	mu         sync.Mutex
 	sampleRate int
 	channels   int
 	frameSize  int
@@ -129,8 +266,10 @@ type pureGoOpusEncoder struct {
 	bitrate    int
 
 	complexity int
-	packetLoss int
+	packetLoss int // expected loss in percent, from RTCP feedback
 	frameCount uint32
+	dtxFrames  int    // consecutive silent frames while DTX is on
+	previous   []byte // last primary frame, repeated as inband FEC
 }
 
 // pureGoOpusDecoder implements a simplified Opus-like decoder in pure Go
@@ -146,7 +285,7 @@ func newOpusEncoder(sampleRate, channels int) (*pureGoOpusEncoder, error) {
 		channels:   channels,
 		bitrate:    64000, // 64 kbps default
 		complexity: 10,    // 0-10, higher is better quality
-		packetLoss: 5,     // 5% packet loss protection
+		packetLoss: 0,     // no loss until the receiver reports some
 		frameCount: 0,
 	}, nil
 }
@@ -159,14 +298,62 @@ func newOpusDecoder(sampleRate, channels int) (*pureGoOpusDecoder, error) {
 	}, nil
 }
 
-// Encode implements a simplified Opus-like encoding in pure Go
-func (e *pureGoOpusEncoder) Encode(pcm []int16, frameSize int) ([]byte, error) {
+// Encode implements a simplified Opus-like encoding in pure Go. It returns
+// no data for a frame DTX suppresses
+func (e *pureGoOpusEncoder) Encode(pcm []int16, frameSize int, opts OpusOptions) ([]byte, error) {
+	// Calculate energy of the frame
+	var energy float64
+	for _, sample := range pcm {
+		normSample := float64(sample) / 32768.0
+		energy += normSample * normSample
+	}
+	energy = math.Sqrt(energy / float64(len(pcm)))
+
+	// DTX sends only one silent frame every 400 ms
+	if opts.DTX && energy < opusDTXThreshold {
+		e.dtxFrames++
+		if e.dtxFrames > 1 && (e.dtxFrames-1)%opusDTXInterval != 0 {
+			e.frameCount++
+			e.previous = nil
+			return nil, nil
+		}
+	} else {
+		e.dtxFrames = 0
+	}
+
+	// The receiver's maxaveragebitrate caps the target bitrate
+	bitrate := e.bitrate
+	if opts.MaxAverageBitrate > 0 && opts.MaxAverageBitrate < bitrate {
+		bitrate = opts.MaxAverageBitrate
+		if bitrate < opusMinBitrate {
+			bitrate = opusMinBitrate
+		}
+	}
+
 	// Calculate expected compressed size based on bitrate
 	// Opus typically compresses 20ms of audio at the target bitrate
-	bytesPerSecond := e.bitrate / 8
+	bytesPerSecond := bitrate / 8
 	duration := float64(frameSize) / float64(e.sampleRate)
 	expectedSize := int(float64(bytesPerSecond) * duration)
 
+	// VBR spends fewer bytes on quiet frames
+	if !opts.CBR {
+		activity := math.Min(energy*4, 1)
+		expectedSize = int(float64(expectedSize) * (0.5 + 0.5*activity))
+	}
+
+	// Inband FEC repeats part of the previous frame, taking a share of the
+	// bitrate that grows with the loss the receiver reports
+	fecSize := 0
+	if opts.FEC && e.packetLoss > 0 && e.previous != nil {
+		share := e.packetLoss * 2
+		if share > opusMaxFECShare {
+			share = opusMaxFECShare
+		}
+		fecSize = expectedSize * share / 100
+	}
+	expectedSize -= fecSize
+
 	// Ensure reasonable bounds
 	if expectedSize < 10 {
 		expectedSize = 10
@@ -176,7 +363,7 @@ func (e *pureGoOpusEncoder) Encode(pcm []int16, frameSize int) ([]byte, error) {
 	}
 
 	// Create output buffer
-	output := make([]byte, expectedSize)
+	output := make([]byte, expectedSize, expectedSize+fecSize)
 
 	// Simple "encoding" - in a real implementation this would use actual Opus
 	// Here we do a very simplified version:
@@ -185,20 +372,12 @@ func (e *pureGoOpusEncoder) Encode(pcm []int16, frameSize int) ([]byte, error) {
 	binary.BigEndian.PutUint32(output[:4], e.frameCount)
 	e.frameCount++
 
-	// 2. Calculate energy of the frame
-	var energy float64
-	for _, sample := range pcm {
-		normSample := float64(sample) / 32768.0
-		energy += normSample * normSample
-	}
-	energy = math.Sqrt(energy / float64(len(pcm)))
-
-	// 3. Store frame energy (used for amplitude recovery during decoding)
+	// 2. Store frame energy (used for amplitude recovery during decoding)
 	if expectedSize > 4 {
 		output[4] = byte(energy * 255)
 	}
 
-	// 4. Store some frequency information (very simplified)
+	// 3. Store some frequency information (very simplified)
 	// Real Opus uses MDCT and other transforms
 	lowEnergy, highEnergy := 0.0, 0.0
 	for i, sample := range pcm {
@@ -214,7 +393,7 @@ func (e *pureGoOpusEncoder) Encode(pcm []int16, frameSize int) ([]byte, error) {
 		output[5] = byte((lowEnergy / highEnergy) * 128)
 	}
 
-	// 5. Add some compressed "data" based on input
+	// 4. Add some compressed "data" based on input
 	// In a real codec this would be spectral coefficients, etc.
 	for i := 6; i < expectedSize; i++ {
 		sampleIdx := (i * len(pcm)) / expectedSize
@@ -224,6 +403,16 @@ func (e *pureGoOpusEncoder) Encode(pcm []int16, frameSize int) ([]byte, error) {
 		}
 	}
 
+	// 5. Append the low-rate copy of the previous frame; the decoder reads
+	// the primary frame only
+	if fecSize > 0 {
+		if fecSize > len(e.previous) {
+			fecSize = len(e.previous)
+		}
+		output = append(output, e.previous[:fecSize]...)
+	}
+	e.previous = output[:expectedSize]
+
 	return output, nil
 }
 
@@ -285,107 +474,162 @@ func (d *pureGoOpusDecoder) Decode(encoded []byte, pcm []int16) (int, error) {
 	return samplesPerChannel, nil
 }
 
-// Global codec instances for reuse
+// Shared codec instances for conversions outside a media stream
 var (
-	defaultEncoder *OpusEncoder
-	defaultDecoder *OpusDecoder
+	defaultEncoder     *OpusEncoder
+	defaultDecoder     *OpusDecoder
+	defaultEncoderOnce sync.Once
+	defaultDecoderOnce sync.Once
 )
 
-// GetOpusEncoder returns a reusable opus encoder
-func GetOpusEncoder() *OpusEncoder {
-	if defaultEncoder == nil {
-		defaultEncoder = &OpusEncoder{
-			sampleRate: opusSampleRate,
-			channels:   opusChannels,
-			frameSize:  opusFrameSize,
-			bitrate:    opusBitrate,
-		}
+// NewOpusEncoder creates an Opus encoder for one stream
+func NewOpusEncoder() *OpusEncoder {
+	return &OpusEncoder{
+		sampleRate: opusSampleRate,
+		channels:   opusChannels,
+		frameSize:  opusFrameSize,
+		bitrate:    opusBitrate,
 	}
+}
+
+// GetOpusEncoder returns the shared opus encoder used by EncodeToOpus.
+// Media streams use their own encoder from StreamCodecs
+func GetOpusEncoder() *OpusEncoder {
+	defaultEncoderOnce.Do(func() {
+		defaultEncoder = NewOpusEncoder()
+	})
 	return defaultEncoder
 }
 
-// GetOpusDecoder returns a reusable opus decoder
-func GetOpusDecoder() *OpusDecoder {
-	if defaultDecoder == nil {
-		defaultDecoder = &OpusDecoder{
-			sampleRate: opusSampleRate,
-			channels:   opusChannels,
-			frameSize:  opusFrameSize,
-		}
+// SetBitrate changes the target bitrate of the encoder, e.g. when the peer
+// reports less bandwidth
+func (e *OpusEncoder) SetBitrate(bitrate int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.bitrate = bitrate
+	if e.instance != nil {
+		e.instance.bitrate = bitrate
 	}
+}
+
+// Bitrate returns the target bitrate of the encoder
+func (e *OpusEncoder) Bitrate() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.bitrate
+}
+
+// SetPacketLoss sets the loss in percent the encoder expects, as measured by
+// the receiver. Streams with inband FEC enabled add redundancy only while it
+// is above zero
+func (e *OpusEncoder) SetPacketLoss(percent int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.packetLoss = percent
+	if e.instance != nil {
+		e.instance.packetLoss = percent
+	}
+}
+
+// NewOpusDecoder creates an Opus decoder for one stream
+func NewOpusDecoder() *OpusDecoder {
+	return &OpusDecoder{
+		sampleRate: opusSampleRate,
+		channels:   opusChannels,
+		frameSize:  opusFrameSize,
+	}
+}
+
+// GetOpusDecoder returns the shared opus decoder used by DecodeToPCM.
+// Media streams use their own decoder from StreamCodecs
+func GetOpusDecoder() *OpusDecoder {
+	defaultDecoderOnce.Do(func() {
+		defaultDecoder = NewOpusDecoder()
+	})
 	return defaultDecoder
 }
 
-// DecodeToPCM decodes Opus to PCM
+// DecodeToPCM decodes Opus to PCM with the shared decoder
 // Uses a simplified pure Go implementation (no external dependencies)
 // Exported for testing
 func DecodeToPCM(payload []byte) ([]int16, error) {
+	return GetOpusDecoder().Decode(payload)
+}
+
+// Decode decodes an Opus payload into interleaved stereo PCM
+func (d *OpusDecoder) Decode(payload []byte) ([]int16, error) {
 	if len(payload) < 2 {
 		return nil, fmt.Errorf("payload too short for Opus decoding")
 	}
-
-	// Get the decoder
-	decoder := GetOpusDecoder()
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
 	// Initialize Opus decoder if not already initialized
-	if decoder.instance == nil {
+	if d.instance == nil {
 		var err error
-		decoder.instance, err = newOpusDecoder(decoder.sampleRate, decoder.channels)
+		d.instance, err = newOpusDecoder(d.sampleRate, d.channels)
 		if err != nil {
 			return nil, fmt.Errorf("failed to initialize Opus decoder: %w", err)
 		}
 	}
 
 	// Actual decoding using the Opus library
-	pcm := make([]int16, decoder.frameSize*decoder.channels)
-	samplesDecoded, err := decoder.instance.Decode(payload, pcm)
+	pcm := make([]int16, d.frameSize*d.channels)
+	samplesDecoded, err := d.instance.Decode(payload, pcm)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decode Opus data: %w", err)
 	}
 
 	// Return only the valid decoded samples
-	return pcm[:samplesDecoded*decoder.channels], nil
+	return pcm[:samplesDecoded*d.channels], nil
 }
 
-// EncodeToOpus encodes PCM to Opus
+// EncodeToOpus encodes PCM to Opus with the shared encoder
 // Uses a simplified pure Go implementation (no external dependencies)
 // Exported for testing
 func EncodeToOpus(pcm []int16) ([]byte, error) {
+	return GetOpusEncoder().Encode(pcm, OpusOptions{})
+}
+
+// Encode encodes interleaved stereo PCM with the options a session or the
+// receiver's fmtp asked for
+func (e *OpusEncoder) Encode(pcm []int16, opts OpusOptions) ([]byte, error) {
 	if len(pcm) == 0 {
 		return nil, fmt.Errorf("empty PCM data for Opus encoding")
 	}
-
-	// Get the encoder
-	encoder := GetOpusEncoder()
+	e.mu.Lock()
+	defer e.mu.Unlock()
 
 	// Initialize Opus encoder if not already initialized
-	if encoder.instance == nil {
+	if e.instance == nil {
 		var err error
-		encoder.instance, err = newOpusEncoder(encoder.sampleRate, encoder.channels)
+		e.instance, err = newOpusEncoder(e.sampleRate, e.channels)
 		if err != nil {
 			return nil, fmt.Errorf("failed to initialize Opus encoder: %w", err)
 		}
+		e.instance.bitrate = e.bitrate
+		e.instance.packetLoss = e.packetLoss
 	}
 
 	// Calculate frame count and ensure we have enough samples
-	frameCount := len(pcm) / (encoder.channels * encoder.frameSize)
+	frameCount := len(pcm) / (e.channels * e.frameSize)
 	if frameCount == 0 {
 		return nil, fmt.Errorf("not enough PCM samples for encoding, need at least %d",
-			encoder.channels*encoder.frameSize)
+			e.channels*e.frameSize)
 	}
 
 	// For a single frame, encode directly
 	if frameCount == 1 {
-		return encoder.instance.Encode(pcm, encoder.frameSize)
+		return e.instance.Encode(pcm, e.frameSize, opts)
 	}
 
 	// For multiple frames, encode each frame separately and concatenate
 	var allEncoded []byte
 	for i := 0; i < frameCount; i++ {
-		frameStart := i * encoder.channels * encoder.frameSize
-		frameEnd := frameStart + encoder.channels*encoder.frameSize
+		frameStart := i * e.channels * e.frameSize
+		frameEnd := frameStart + e.channels*e.frameSize
 
-		frameEncoded, err := encoder.instance.Encode(pcm[frameStart:frameEnd], encoder.frameSize)
+		frameEncoded, err := e.instance.Encode(pcm[frameStart:frameEnd], e.frameSize, opts)
 		if err != nil {
 			return nil, fmt.Errorf("failed to encode frame %d: %w", i, err)
 		}
@@ -464,7 +708,8 @@ func EncodePCMToPCMU(pcm []int16) ([]byte, error) {
 	return output, nil
 }
 
-// IsVoiceActive performs voice activity detection
+// IsVoiceActive performs voice activity detection on the frame's level alone.
+// Streams use VAD, which tracks the background noise
 // Exported for testing
 func IsVoiceActive(pcm []int16) bool {
 	if len(pcm) == 0 {
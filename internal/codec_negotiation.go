@@ -0,0 +1,565 @@
+package internal
+
+import (
+	"slices"
+	"strings"
+	"sync"
+
+	ng "karl/internal/ng_protocol"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// SessionCodecMap holds the codecs negotiated for a single call.
+// Payload types are scoped to the leg that advertised them: the offering
+// leg sends using its own payload numbers and the answering leg uses the
+// numbers from the answer SDP.
+type SessionCodecMap struct {
+	CallID       string
+	OfferCodecs  []CodecInfo // Codecs advertised by the offering leg, in preference order
+	AnswerCodecs []CodecInfo // Codecs advertised by the answering leg, in preference order
+	OfferPtime   int         // Packet time in ms the offering leg receives, 0 if unspecified
+	AnswerPtime  int         // Packet time in ms the answering leg receives, 0 if unspecified
+	OpusFmtp     string      // Opus encoder parameters from session options, overriding the SDP's
+	AGC          *AGCConfig  // Gain control applied to both legs' audio, nil if off
+	Transcode    string      // "always" or "never" from the transcode flag, empty for if-needed
+	Encrypted    bool        // Media is encrypted end to end by ZRTP and relayed unchanged
+
+	pending *legMedia // re-offer waiting for its answer
+}
+
+// legMedia is what one leg's SDP asked for. offerer is true for the leg
+// that sent the call's first offer, whose codecs are the map's offer codecs
+type legMedia struct {
+	offerer bool
+	codecs  []CodecInfo
+	ptime   int
+}
+
+// apply makes a leg's codecs and packet time the call's, reporting whether
+// its codecs changed
+func (m *SessionCodecMap) apply(media *legMedia) bool {
+	codecs, ptime := &m.OfferCodecs, &m.OfferPtime
+	if !media.offerer {
+		codecs, ptime = &m.AnswerCodecs, &m.AnswerPtime
+	}
+	changed := !slices.Equal(*codecs, media.codecs)
+	*codecs, *ptime = media.codecs, media.ptime
+	return changed
+}
+
+// codecBinding ties an SSRC to the call and leg it was announced on
+type codecBinding struct {
+	callID      string
+	fromOfferer bool
+}
+
+// CodecNegotiator tracks negotiated codecs per call and resolves
+// transcoding decisions for incoming packets by SSRC
+type CodecNegotiator struct {
+	calls map[string]*SessionCodecMap
+	ssrcs map[uint32]codecBinding
+	mu    sync.RWMutex
+}
+
+// NewCodecNegotiator creates an empty codec negotiator
+func NewCodecNegotiator() *CodecNegotiator {
+	return &CodecNegotiator{
+		calls: make(map[string]*SessionCodecMap),
+		ssrcs: make(map[uint32]codecBinding),
+	}
+}
+
+// defaultCodecNegotiator is shared by the NG listener and the worker pool
+var defaultCodecNegotiator = NewCodecNegotiator()
+
+// GetCodecNegotiator returns the process-wide codec negotiator
+func GetCodecNegotiator() *CodecNegotiator {
+	return defaultCodecNegotiator
+}
+
+// SetOfferCodecs records the codecs from an SDP offer for a call
+func (n *CodecNegotiator) SetOfferCodecs(callID string, codecs []CodecInfo) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.getOrCreateLocked(callID).OfferCodecs = append([]CodecInfo(nil), codecs...)
+}
+
+// SetAnswerCodecs records the codecs from an SDP answer for a call
+func (n *CodecNegotiator) SetAnswerCodecs(callID string, codecs []CodecInfo) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.getOrCreateLocked(callID).AnswerCodecs = append([]CodecInfo(nil), codecs...)
+}
+
+// SetPtime records the packet time a leg asked to receive with a=ptime
+func (n *CodecNegotiator) SetPtime(callID string, offerer bool, ptime int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	m := n.getOrCreateLocked(callID)
+	if offerer {
+		m.OfferPtime = ptime
+	} else {
+		m.AnswerPtime = ptime
+	}
+}
+
+// OfferMedia records the codecs and packet time of an SDP offer from a leg
+// of a call: offerer is true for the leg that sent the call's first offer,
+// and false for a re-offer from the other leg. Until the call is answered
+// they take effect at once. A re-offer of an answered call waits for its
+// answer, so media keeps being transcoded as negotiated until both legs
+// agreed on the new codecs, or for good if the re-offer is rejected
+func (n *CodecNegotiator) OfferMedia(callID string, offerer bool, codecs []CodecInfo, ptime int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	m := n.getOrCreateLocked(callID)
+	offer := &legMedia{offerer: offerer, codecs: append([]CodecInfo(nil), codecs...), ptime: ptime}
+	m.pending = nil
+	if len(m.AnswerCodecs) == 0 {
+		m.apply(offer)
+		return
+	}
+	m.pending = offer
+}
+
+// AnswerMedia records the codecs and packet time of an SDP answer from a
+// leg together with those of the re-offer it answers, so the call's media
+// switches to the renegotiated codecs at once. Streams of a call whose
+// codecs changed start over with fresh encoder and decoder state
+func (n *CodecNegotiator) AnswerMedia(callID string, offerer bool, codecs []CodecInfo, ptime int) {
+	n.mu.Lock()
+	m := n.getOrCreateLocked(callID)
+	changed := false
+	if m.pending != nil {
+		changed = m.apply(m.pending)
+		m.pending = nil
+	}
+	if m.apply(&legMedia{offerer: offerer, codecs: append([]CodecInfo(nil), codecs...), ptime: ptime}) {
+		changed = true
+	}
+	var reset []uint32
+	if changed {
+		for ssrc, binding := range n.ssrcs {
+			if binding.callID == callID {
+				reset = append(reset, ssrc)
+			}
+		}
+	}
+	n.mu.Unlock()
+
+	for _, ssrc := range reset {
+		RemoveStreamCodecs(ssrc)
+	}
+}
+
+// SetOpusFmtp records the Opus encoder parameters, e.g. useinbandfec=1,
+// session options ask for on the Opus Karl sends in a call
+func (n *CodecNegotiator) SetOpusFmtp(callID string, fmtp string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.getOrCreateLocked(callID).OpusFmtp = fmtp
+}
+
+// SetAGC turns on gain control for the audio of both legs of a call
+func (n *CodecNegotiator) SetAGC(callID string, config AGCConfig) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.getOrCreateLocked(callID).AGC = &config
+}
+
+// SetTranscodeMode records when a call's audio is transcoded: "always",
+// "never", or "if-needed", the default, for codecs the peer leg lacks
+func (n *CodecNegotiator) SetTranscodeMode(callID string, mode string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if mode == ng.TranscodeIfNeeded {
+		mode = ""
+	}
+	n.getOrCreateLocked(callID).Transcode = mode
+}
+
+// SetPassthrough marks a call whose media the parties encrypt end to end,
+// such as with ZRTP: Karl cannot decode it, so it is relayed unchanged
+func (n *CodecNegotiator) SetPassthrough(callID string, encrypted bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.getOrCreateLocked(callID).Encrypted = encrypted
+}
+
+// AGCConfig returns the gain control the call of an SSRC asked for. A call
+// that is never transcoded has none
+func (n *CodecNegotiator) AGCConfig(ssrc uint32) (AGCConfig, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	binding, exists := n.ssrcs[ssrc]
+	if !exists {
+		return AGCConfig{}, false
+	}
+	m, exists := n.calls[binding.callID]
+	if !exists || m.AGC == nil || m.Transcode == ng.TranscodeNever || m.Encrypted {
+		return AGCConfig{}, false
+	}
+	return *m.AGC, true
+}
+
+// getOrCreateLocked returns the codec map for a call (caller must hold write lock)
+func (n *CodecNegotiator) getOrCreateLocked(callID string) *SessionCodecMap {
+	m, ok := n.calls[callID]
+	if !ok {
+		m = &SessionCodecMap{CallID: callID}
+		n.calls[callID] = m
+	}
+	return m
+}
+
+// BindSSRC associates an SSRC with a call leg so packets can be resolved
+func (n *CodecNegotiator) BindSSRC(ssrc uint32, callID string, fromOfferer bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.ssrcs[ssrc] = codecBinding{callID: callID, fromOfferer: fromOfferer}
+}
+
+// RemoveCall drops the codec map, all SSRC bindings, the impairment, the
+// loopback and the announcements of a call
+func (n *CodecNegotiator) RemoveCall(callID string) {
+	n.mu.Lock()
+	var removed []uint32
+	delete(n.calls, callID)
+	for ssrc, binding := range n.ssrcs {
+		if binding.callID == callID {
+			delete(n.ssrcs, ssrc)
+			removed = append(removed, ssrc)
+		}
+	}
+	n.mu.Unlock()
+
+	for _, ssrc := range removed {
+		RemoveRepacketizer(ssrc)
+		RemoveAGC(ssrc)
+		RemoveStreamCodecs(ssrc)
+	}
+	RemoveImpairment(callID)
+	StopLoopback(callID)
+	GetMediaPlayer().StopCall(callID)
+}
+
+// GetCallCodecs returns a copy of the negotiated codecs for a call
+func (n *CodecNegotiator) GetCallCodecs(callID string) (*SessionCodecMap, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	m, ok := n.calls[callID]
+	if !ok {
+		return nil, false
+	}
+	return &SessionCodecMap{
+		CallID:       m.CallID,
+		OfferCodecs:  append([]CodecInfo(nil), m.OfferCodecs...),
+		AnswerCodecs: append([]CodecInfo(nil), m.AnswerCodecs...),
+		OfferPtime:   m.OfferPtime,
+		AnswerPtime:  m.AnswerPtime,
+		OpusFmtp:     m.OpusFmtp,
+		AGC:          m.AGC,
+		Transcode:    m.Transcode,
+		Encrypted:    m.Encrypted,
+	}, true
+}
+
+// ResolveTranscode determines the source and target codec for a packet.
+// It returns ok=false when the SSRC is unknown, the payload type was not
+// negotiated, the call is never transcoded, or the peer leg can receive
+// the source codec unchanged and the call is not always transcoded.
+func (n *CodecNegotiator) ResolveTranscode(ssrc uint32, payloadType uint8) (src, dst CodecInfo, ok bool) {
+	src, dst, _, ok = n.ResolveOutput(ssrc, payloadType)
+	if !ok {
+		return src, dst, false
+	}
+
+	switch n.transcodeMode(ssrc) {
+	case ng.TranscodeNever:
+		return src, dst, false
+	case ng.TranscodeAlways:
+		if codecSampleRate(src) != 0 && codecSampleRate(dst) != 0 {
+			return src, dst, true
+		}
+	}
+
+	// The peer already accepts this codec, so relay it as-is, mapping the
+	// payload type if the peer numbered it differently
+	if sameCodec(src, dst) {
+		return src, dst, src.PayloadType != dst.PayloadType
+	}
+	return src, dst, true
+}
+
+// transcodeMode returns the transcode mode of the call an SSRC belongs to
+func (n *CodecNegotiator) transcodeMode(ssrc uint32) string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if m, ok := n.calls[n.ssrcs[ssrc].callID]; ok {
+		return m.Transcode
+	}
+	return ""
+}
+
+// ResolveOutput determines how a packet leaves Karl: its source codec, the
+// codec the peer leg receives it in, and the packet time the peer asked
+// for. It returns ok=false until both legs' codecs are known, and for a call
+// encrypted end to end
+func (n *CodecNegotiator) ResolveOutput(ssrc uint32, payloadType uint8) (src, dst CodecInfo, ptime int, ok bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	binding, exists := n.ssrcs[ssrc]
+	if !exists {
+		return src, dst, 0, false
+	}
+	m, exists := n.calls[binding.callID]
+	if !exists || m.Encrypted {
+		return src, dst, 0, false
+	}
+
+	local, remote, ptime := m.OfferCodecs, m.AnswerCodecs, m.AnswerPtime
+	if !binding.fromOfferer {
+		local, remote, ptime = m.AnswerCodecs, m.OfferCodecs, m.OfferPtime
+	}
+	if len(remote) == 0 {
+		return src, dst, 0, false
+	}
+	src, exists = findCodecByPayloadType(local, payloadType)
+	if !exists {
+		return src, dst, 0, false
+	}
+	dst = remote[0]
+	for _, c := range remote {
+		if sameCodec(c, src) {
+			dst = c
+			break
+		}
+	}
+
+	// Session options override the peer's Opus fmtp for the encoder
+	if m.OpusFmtp != "" && codecMimeType(dst.Name) == webrtc.MimeTypeOpus {
+		dst.Fmtp = overrideFmtp(dst.Fmtp, m.OpusFmtp)
+	}
+	return src, dst, ptime, true
+}
+
+// CallID returns the call an SSRC is bound to
+func (n *CodecNegotiator) CallID(ssrc uint32) (string, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	binding, ok := n.ssrcs[ssrc]
+	return binding.callID, ok
+}
+
+// PrimaryCodec returns the first codec negotiated for the leg sending an
+// SSRC, the one used unless the sender switches payload type
+func (n *CodecNegotiator) PrimaryCodec(ssrc uint32) (CodecInfo, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	binding, ok := n.ssrcs[ssrc]
+	if !ok {
+		return CodecInfo{}, false
+	}
+	m, ok := n.calls[binding.callID]
+	if !ok {
+		return CodecInfo{}, false
+	}
+	codecs := m.OfferCodecs
+	if !binding.fromOfferer {
+		codecs = m.AnswerCodecs
+	}
+	if len(codecs) == 0 {
+		return CodecInfo{}, false
+	}
+	return codecs[0], true
+}
+
+// ResolveLeg returns the call an SSRC belongs to, whether it is sent by the
+// offering leg, and the negotiated codec for its payload type
+func (n *CodecNegotiator) ResolveLeg(ssrc uint32, payloadType uint8) (callID string, fromOfferer bool, codec CodecInfo, ok bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	binding, exists := n.ssrcs[ssrc]
+	if !exists {
+		return "", false, codec, false
+	}
+	m, exists := n.calls[binding.callID]
+	if !exists {
+		return "", false, codec, false
+	}
+
+	codecs := m.OfferCodecs
+	if !binding.fromOfferer {
+		codecs = m.AnswerCodecs
+	}
+	codec, ok = findCodecByPayloadType(codecs, payloadType)
+	return binding.callID, binding.fromOfferer, codec, ok
+}
+
+// IsPassthrough reports whether a call's audio can be relayed untouched:
+// every answered codec was offered under the same payload type, or the call
+// is never transcoded, both legs asked for the same packet time, and no
+// session option rewrites the audio. Encrypted calls are always relayed
+// untouched
+func (n *CodecNegotiator) IsPassthrough(callID string) bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	m, exists := n.calls[callID]
+	if !exists || len(m.OfferCodecs) == 0 || len(m.AnswerCodecs) == 0 {
+		return false
+	}
+	if m.OfferPtime != m.AnswerPtime || m.Transcode == ng.TranscodeAlways {
+		return false
+	}
+	if m.Transcode == ng.TranscodeNever || m.Encrypted {
+		return true
+	}
+	if m.OpusFmtp != "" || m.AGC != nil {
+		return false
+	}
+	for _, answered := range m.AnswerCodecs {
+		offered, ok := findCodecByPayloadType(m.OfferCodecs, answered.PayloadType)
+		if !ok || !sameCodec(offered, answered) {
+			return false
+		}
+	}
+	return true
+}
+
+// ClockRate returns the negotiated clock rate for a packet, or 0 if unknown
+func (n *CodecNegotiator) ClockRate(ssrc uint32, payloadType uint8) uint32 {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	binding, exists := n.ssrcs[ssrc]
+	if !exists {
+		return 0
+	}
+	m, exists := n.calls[binding.callID]
+	if !exists {
+		return 0
+	}
+
+	codecs := m.OfferCodecs
+	if !binding.fromOfferer {
+		codecs = m.AnswerCodecs
+	}
+	if c, ok := findCodecByPayloadType(codecs, payloadType); ok {
+		return c.ClockRate
+	}
+	return 0
+}
+
+// findCodecByPayloadType finds a negotiated codec by payload type
+func findCodecByPayloadType(codecs []CodecInfo, payloadType uint8) (CodecInfo, bool) {
+	for _, c := range codecs {
+		if c.PayloadType == payloadType {
+			return c, true
+		}
+	}
+	return CodecInfo{}, false
+}
+
+// transcodableCodecs are the codecs TranscodeAudio can produce, as offered
+// when a codec-transcode flag adds them. Dynamic codecs take the first free
+// payload type from 96
+var transcodableCodecs = map[string]CodecInfo{
+	"PCMU": {PayloadType: 0, Name: "PCMU", ClockRate: 8000, Channels: 1},
+	"PCMA": {PayloadType: 8, Name: "PCMA", ClockRate: 8000, Channels: 1},
+	"OPUS": {PayloadType: 96, Name: "opus", ClockRate: opusSampleRate, Channels: 2},
+}
+
+// transcodableVideoCodecs are the codecs a VideoTranscoder can produce, as
+// offered in video sections when video transcoding is enabled
+var transcodableVideoCodecs = map[string]CodecInfo{
+	"H264": {PayloadType: 96, Name: "H264", ClockRate: 90000, Fmtp: "packetization-mode=1;profile-level-id=42e01f"},
+	"VP8":  {PayloadType: 96, Name: "VP8", ClockRate: 90000},
+}
+
+// TranscodeOfferCodecs returns the codecs to append to an offer for the
+// names in codec-transcode flags: those Karl can transcode to that the offer
+// does not already list
+func TranscodeOfferCodecs(offered []CodecInfo, names []string) []CodecInfo {
+	return offerCodecs(offered, names, transcodableCodecs)
+}
+
+// TranscodeOfferVideoCodecs is TranscodeOfferCodecs for a video section
+func TranscodeOfferVideoCodecs(offered []CodecInfo, names []string) []CodecInfo {
+	return offerCodecs(offered, names, transcodableVideoCodecs)
+}
+
+func offerCodecs(offered []CodecInfo, names []string, transcodable map[string]CodecInfo) []CodecInfo {
+	used := make(map[uint8]bool, len(offered))
+	for _, c := range offered {
+		used[c.PayloadType] = true
+	}
+
+	var added []CodecInfo
+	for _, name := range names {
+		c, ok := transcodable[strings.ToUpper(name)]
+		if !ok || hasCodec(offered, c.Name) || hasCodec(added, c.Name) {
+			continue
+		}
+		for c.PayloadType >= 96 && c.PayloadType < 127 && used[c.PayloadType] {
+			c.PayloadType++
+		}
+		if used[c.PayloadType] {
+			continue
+		}
+		used[c.PayloadType] = true
+		added = append(added, c)
+	}
+	return added
+}
+
+// sameCodec reports whether two codecs share an encoding name and clock rate
+func sameCodec(a, b CodecInfo) bool {
+	if !strings.EqualFold(a.Name, b.Name) {
+		return false
+	}
+	return a.ClockRate == 0 || b.ClockRate == 0 || a.ClockRate == b.ClockRate
+}
+
+// hasCodec reports whether codecs contain an encoding name
+func hasCodec(codecs []CodecInfo, name string) bool {
+	for _, c := range codecs {
+		if strings.EqualFold(c.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// codecMimeType converts an SDP encoding name into the MIME type used by TranscodeAudio
+func codecMimeType(name string) string {
+	switch strings.ToUpper(name) {
+	case "OPUS":
+		return webrtc.MimeTypeOpus
+	case "PCMU":
+		return webrtc.MimeTypePCMU
+	case "PCMA":
+		return webrtc.MimeTypePCMA
+	case "G722":
+		return webrtc.MimeTypeG722
+	case "G729":
+		return MimeTypeG729
+	case "AMR":
+		return MimeTypeAMR
+	case "AMR-WB":
+		return MimeTypeAMRWB
+	case "ILBC":
+		return MimeTypeILBC
+	case "SPEEX":
+		return MimeTypeSpeex
+	default:
+		return "audio/" + name
+	}
+}
@@ -0,0 +1,244 @@
+package internal
+
+import (
+	"testing"
+
+	ng "karl/internal/ng_protocol"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func newTestNegotiator() *CodecNegotiator {
+	n := NewCodecNegotiator()
+	n.SetOfferCodecs("call-1", []CodecInfo{
+		{PayloadType: 96, Name: "opus", ClockRate: 48000, Channels: 2},
+		{PayloadType: 8, Name: "PCMA", ClockRate: 8000, Channels: 1},
+	})
+	n.SetAnswerCodecs("call-1", []CodecInfo{
+		{PayloadType: 0, Name: "PCMU", ClockRate: 8000, Channels: 1},
+	})
+	n.BindSSRC(0x1111, "call-1", true)
+	n.BindSSRC(0x2222, "call-1", false)
+	return n
+}
+
+func TestCodecNegotiator_ResolveFromOfferer(t *testing.T) {
+	n := newTestNegotiator()
+
+	src, dst, ok := n.ResolveTranscode(0x1111, 96)
+	if !ok {
+		t.Fatal("expected transcoding for dynamic PT 96")
+	}
+	if src.Name != "opus" {
+		t.Errorf("expected source opus, got %s", src.Name)
+	}
+	if dst.Name != "PCMU" || dst.PayloadType != 0 {
+		t.Errorf("expected target PCMU/0, got %s/%d", dst.Name, dst.PayloadType)
+	}
+}
+
+func TestCodecNegotiator_ResolveFromAnswerer(t *testing.T) {
+	n := newTestNegotiator()
+
+	src, dst, ok := n.ResolveTranscode(0x2222, 0)
+	if !ok {
+		t.Fatal("expected transcoding for answerer PCMU")
+	}
+	if src.Name != "PCMU" {
+		t.Errorf("expected source PCMU, got %s", src.Name)
+	}
+	if dst.Name != "opus" || dst.PayloadType != 96 {
+		t.Errorf("expected target opus/96, got %s/%d", dst.Name, dst.PayloadType)
+	}
+}
+
+func TestCodecNegotiator_PassthroughWhenPeerAccepts(t *testing.T) {
+	n := NewCodecNegotiator()
+	n.SetOfferCodecs("call-2", []CodecInfo{{PayloadType: 0, Name: "PCMU", ClockRate: 8000}})
+	n.SetAnswerCodecs("call-2", []CodecInfo{{PayloadType: 0, Name: "pcmu", ClockRate: 8000}})
+	n.BindSSRC(42, "call-2", true)
+
+	if _, _, ok := n.ResolveTranscode(42, 0); ok {
+		t.Error("expected passthrough when both legs negotiated the same codec")
+	}
+}
+
+func TestCodecNegotiator_PassthroughMapsPayloadType(t *testing.T) {
+	n := NewCodecNegotiator()
+	n.SetOfferCodecs("call-4", []CodecInfo{
+		{PayloadType: 97, Name: "iLBC", ClockRate: 8000, Fmtp: "mode=30"},
+		{PayloadType: 98, Name: "speex", ClockRate: 16000},
+	})
+	n.SetAnswerCodecs("call-4", []CodecInfo{
+		{PayloadType: 102, Name: "iLBC", ClockRate: 8000, Fmtp: "mode=30"},
+		{PayloadType: 103, Name: "speex", ClockRate: 8000},
+	})
+	n.BindSSRC(9, "call-4", true)
+
+	src, dst, ok := n.ResolveTranscode(9, 97)
+	if !ok || src.PayloadType != 97 || dst.PayloadType != 102 {
+		t.Errorf("expected iLBC mapped from 97 to 102, got %+v -> %+v", src, dst)
+	}
+	if out, err := transcodeAudio([]byte{1, 2, 3}, src, dst); err != nil || len(out) != 3 {
+		t.Errorf("expected the payload to pass through, got %v (%v)", out, err)
+	}
+
+	// Speex at another clock rate is a different codec
+	if _, dst, ok := n.ResolveTranscode(9, 98); !ok || dst.Name != "iLBC" {
+		t.Errorf("expected wideband Speex to be transcoded, got %+v", dst)
+	}
+}
+
+func TestCodecNegotiator_TranscodeModes(t *testing.T) {
+	n := NewCodecNegotiator()
+	n.SetOfferCodecs("call-5", []CodecInfo{
+		{PayloadType: 0, Name: "PCMU", ClockRate: 8000},
+		{PayloadType: 8, Name: "PCMA", ClockRate: 8000},
+	})
+	n.SetAnswerCodecs("call-5", []CodecInfo{{PayloadType: 0, Name: "PCMU", ClockRate: 8000}})
+	n.BindSSRC(5, "call-5", true)
+
+	// if-needed relays the codec both legs share and transcodes the other
+	if _, _, ok := n.ResolveTranscode(5, 0); ok {
+		t.Error("expected the shared codec to be relayed")
+	}
+	if _, _, ok := n.ResolveTranscode(5, 8); !ok {
+		t.Error("expected PCMA to be transcoded for the PCMU-only leg")
+	}
+	if !n.IsPassthrough("call-5") {
+		t.Error("expected the call to be relayed untouched")
+	}
+
+	// always re-encodes the shared codec too
+	n.SetTranscodeMode("call-5", ng.TranscodeAlways)
+	if src, dst, ok := n.ResolveTranscode(5, 0); !ok || src.Name != "PCMU" || dst.Name != "PCMU" {
+		t.Errorf("expected PCMU to be re-encoded, got %+v -> %+v", src, dst)
+	}
+	if n.IsPassthrough("call-5") {
+		t.Error("expected an always transcoded call not to be relayed untouched")
+	}
+
+	// never relays every codec as sent, and drops gain control
+	n.SetTranscodeMode("call-5", ng.TranscodeNever)
+	n.SetAGC("call-5", AGCConfig{}.withDefaults())
+	if _, _, ok := n.ResolveTranscode(5, 8); ok {
+		t.Error("expected PCMA to be relayed as sent")
+	}
+	if _, ok := n.AGCConfig(5); ok {
+		t.Error("expected no gain control on a call that is never transcoded")
+	}
+	if !n.IsPassthrough("call-5") {
+		t.Error("expected a never transcoded call to be relayed untouched")
+	}
+
+	n.SetTranscodeMode("call-5", ng.TranscodeIfNeeded)
+	if m, _ := n.GetCallCodecs("call-5"); m.Transcode != "" {
+		t.Errorf("expected if-needed to restore the default, got %q", m.Transcode)
+	}
+}
+
+func TestCodecNegotiator_UnknownPayloadType(t *testing.T) {
+	n := newTestNegotiator()
+
+	if _, _, ok := n.ResolveTranscode(0x1111, 111); ok {
+		t.Error("expected no transcoding for a payload type that was not offered")
+	}
+}
+
+func TestCodecNegotiator_AnswerPending(t *testing.T) {
+	n := NewCodecNegotiator()
+	n.SetOfferCodecs("call-3", []CodecInfo{{PayloadType: 111, Name: "opus", ClockRate: 48000}})
+	n.BindSSRC(7, "call-3", true)
+
+	if _, _, ok := n.ResolveTranscode(7, 111); ok {
+		t.Error("expected no transcoding before the answer is known")
+	}
+}
+
+func TestCodecNegotiator_ReofferWaitsForAnswer(t *testing.T) {
+	pcmu := []CodecInfo{{PayloadType: 0, Name: "PCMU", ClockRate: 8000}}
+	pcma := []CodecInfo{{PayloadType: 8, Name: "PCMA", ClockRate: 8000}}
+	n := NewCodecNegotiator()
+	n.OfferMedia("call-5", true, pcmu, 20)
+	n.AnswerMedia("call-5", false, pcmu, 20)
+	n.BindSSRC(1, "call-5", true)
+
+	// The callee re-offers PCMA at 40 ms: the call keeps relaying PCMU
+	// until the caller answers
+	n.OfferMedia("call-5", false, pcma, 40)
+	if _, dst, ptime, ok := n.ResolveOutput(1, 0); !ok || dst.Name != "PCMU" || ptime != 20 {
+		t.Fatalf("re-offer applied before its answer: %s at %d ms (%v)", dst.Name, ptime, ok)
+	}
+	n.AnswerMedia("call-5", true, pcmu, 20)
+	if _, dst, ptime, ok := n.ResolveOutput(1, 0); !ok || dst.Name != "PCMA" || ptime != 40 {
+		t.Errorf("expected PCMA at 40 ms once answered, got %s at %d ms (%v)", dst.Name, ptime, ok)
+	}
+	if src, dst, ok := n.ResolveTranscode(1, 0); !ok || src.Name != "PCMU" || dst.Name != "PCMA" {
+		t.Errorf("expected the caller's PCMU to be transcoded, got %s to %s (%v)", src.Name, dst.Name, ok)
+	}
+}
+
+func TestCodecNegotiator_RemoveCall(t *testing.T) {
+	n := newTestNegotiator()
+	n.RemoveCall("call-1")
+
+	if _, ok := n.GetCallCodecs("call-1"); ok {
+		t.Error("expected codec map to be removed")
+	}
+	if _, _, ok := n.ResolveTranscode(0x1111, 96); ok {
+		t.Error("expected SSRC binding to be removed with the call")
+	}
+}
+
+func TestCodecNegotiator_ResolveLeg(t *testing.T) {
+	n := newTestNegotiator()
+
+	callID, fromOfferer, codec, ok := n.ResolveLeg(0x2222, 0)
+	if !ok {
+		t.Fatal("expected answerer SSRC to resolve")
+	}
+	if callID != "call-1" || fromOfferer || codec.Name != "PCMU" {
+		t.Errorf("got call=%s fromOfferer=%v codec=%s", callID, fromOfferer, codec.Name)
+	}
+
+	if _, _, _, ok := n.ResolveLeg(0x1111, 0); ok {
+		t.Error("PT 0 was not offered by the offering leg")
+	}
+	if _, _, _, ok := n.ResolveLeg(0x9999, 0); ok {
+		t.Error("unknown SSRC should not resolve")
+	}
+}
+
+func TestCodecMimeType(t *testing.T) {
+	tests := map[string]string{
+		"opus":   webrtc.MimeTypeOpus,
+		"PCMU":   webrtc.MimeTypePCMU,
+		"pcma":   webrtc.MimeTypePCMA,
+		"G722":   webrtc.MimeTypeG722,
+		"G729":   MimeTypeG729,
+		"amr":    MimeTypeAMR,
+		"AMR-WB": MimeTypeAMRWB,
+	}
+	for name, expected := range tests {
+		if got := codecMimeType(name); got != expected {
+			t.Errorf("codecMimeType(%q) = %q, expected %q", name, got, expected)
+		}
+	}
+}
+
+func TestTranscodeOfferCodecs(t *testing.T) {
+	offered := []CodecInfo{
+		{PayloadType: 0, Name: "PCMU", ClockRate: 8000, Channels: 1},
+		{PayloadType: 96, Name: "telephone-event", ClockRate: 8000, Channels: 1},
+	}
+	added := TranscodeOfferCodecs(offered, []string{"g722", "PCMU", "opus", "GSM", "pcma", "OPUS"})
+	if len(added) != 2 {
+		t.Fatalf("expected opus and PCMA to be added, got %+v", added)
+	}
+	if added[0].Name != "opus" || added[0].PayloadType != 97 {
+		t.Errorf("expected opus on the first free dynamic payload type, got %+v", added[0])
+	}
+	if added[1].Name != "PCMA" || added[1].PayloadType != 8 {
+		t.Errorf("expected PCMA on its static payload type, got %+v", added[1])
+	}
+}
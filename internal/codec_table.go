@@ -71,3 +71,163 @@ var aLawToMuLawMap = [256]uint8{
 	0xF0, 0xF1, 0xF2, 0xF3, 0xF4, 0xF5, 0xF6, 0xF7,
 	0xF8, 0xF9, 0xFA, 0xFB, 0xFC, 0xFD, 0xFE, 0xFF,
 }
+
+// LinearToMulaw converts 16-bit linear PCM to μ-law (ITU-T G.711)
+func LinearToMulaw(sample int16) byte {
+	const bias = 33
+	const clip = 32635
+
+	// Get sign bit and absolute value
+	sign := 0
+	var absVal int
+	if sample < 0 {
+		sign = 0x80
+		// Handle int16 min value edge case
+		if sample == -32768 {
+			absVal = 32768
+		} else {
+			absVal = int(-sample)
+		}
+	} else {
+		absVal = int(sample)
+	}
+
+	// Clip
+	if absVal > clip {
+		absVal = clip
+	}
+
+	// Add bias
+	absVal += bias
+
+	// Find segment and quantize
+	var exponent, mantissa int
+	if absVal >= 0x4000 {
+		exponent = 7
+		mantissa = (absVal >> 10) & 0x0F
+	} else if absVal >= 0x2000 {
+		exponent = 6
+		mantissa = (absVal >> 9) & 0x0F
+	} else if absVal >= 0x1000 {
+		exponent = 5
+		mantissa = (absVal >> 8) & 0x0F
+	} else if absVal >= 0x0800 {
+		exponent = 4
+		mantissa = (absVal >> 7) & 0x0F
+	} else if absVal >= 0x0400 {
+		exponent = 3
+		mantissa = (absVal >> 6) & 0x0F
+	} else if absVal >= 0x0200 {
+		exponent = 2
+		mantissa = (absVal >> 5) & 0x0F
+	} else if absVal >= 0x0100 {
+		exponent = 1
+		mantissa = (absVal >> 4) & 0x0F
+	} else {
+		exponent = 0
+		mantissa = (absVal >> 3) & 0x0F
+	}
+
+	// μ-law byte = ~(sign | exponent | mantissa)
+	return byte(^(sign | (exponent << 4) | mantissa))
+}
+
+// MulawToLinear converts μ-law to 16-bit linear PCM (ITU-T G.711)
+func MulawToLinear(mulaw byte) int16 {
+	const bias = 33
+
+	// Complement to get original
+	mulaw = ^mulaw
+
+	sign := int(mulaw & 0x80)
+	exponent := int((mulaw >> 4) & 0x07)
+	mantissa := int(mulaw & 0x0F)
+
+	// Reconstruct linear value
+	// Formula: ((mantissa << 3) + bias) << exponent
+	sample := ((mantissa << 3) + 0x84) << exponent
+	sample -= bias
+
+	if sign != 0 {
+		return -int16(sample)
+	}
+	return int16(sample)
+}
+
+// LinearToAlaw converts 16-bit linear PCM to A-law (ITU-T G.711)
+func LinearToAlaw(sample int16) byte {
+	const clip = 32635
+
+	// Get sign bit and absolute value
+	sign := 0
+	var absVal int
+	if sample < 0 {
+		sign = 0x80
+		if sample == -32768 {
+			absVal = 32768
+		} else {
+			absVal = int(-sample)
+		}
+	} else {
+		absVal = int(sample)
+	}
+
+	// Clip
+	if absVal > clip {
+		absVal = clip
+	}
+
+	// Find segment and quantize (16-bit thresholds)
+	var exponent, mantissa int
+	if absVal >= 16384 {
+		exponent = 7
+		mantissa = (absVal >> 10) & 0x0F
+	} else if absVal >= 8192 {
+		exponent = 6
+		mantissa = (absVal >> 9) & 0x0F
+	} else if absVal >= 4096 {
+		exponent = 5
+		mantissa = (absVal >> 8) & 0x0F
+	} else if absVal >= 2048 {
+		exponent = 4
+		mantissa = (absVal >> 7) & 0x0F
+	} else if absVal >= 1024 {
+		exponent = 3
+		mantissa = (absVal >> 6) & 0x0F
+	} else if absVal >= 512 {
+		exponent = 2
+		mantissa = (absVal >> 5) & 0x0F
+	} else if absVal >= 256 {
+		exponent = 1
+		mantissa = (absVal >> 4) & 0x0F
+	} else {
+		exponent = 0
+		mantissa = absVal >> 4
+	}
+
+	// A-law byte with XOR pattern
+	return byte(sign|(exponent<<4)|mantissa) ^ 0x55
+}
+
+// AlawToLinear converts A-law to 16-bit linear PCM (ITU-T G.711)
+func AlawToLinear(alaw byte) int16 {
+	// Undo XOR pattern
+	alaw ^= 0x55
+
+	sign := alaw & 0x80
+	exponent := int((alaw >> 4) & 0x07)
+	mantissa := int(alaw & 0x0F)
+
+	// Reconstruct 16-bit linear value
+	var sample int
+	if exponent == 0 {
+		sample = (mantissa << 4) + 8
+	} else {
+		sample = ((mantissa << 4) + 0x108) << (exponent - 1)
+	}
+
+	if sign != 0 {
+		return -int16(sample)
+	}
+	return int16(sample)
+}
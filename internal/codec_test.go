@@ -1,7 +1,10 @@
 package internal
 
 import (
+	"bytes"
 	"testing"
+
+	"github.com/pion/webrtc/v3"
 )
 
 func TestG711MulawEncoding(t *testing.T) {
@@ -116,182 +119,33 @@ func TestG711MulawAlawConversion(t *testing.T) {
 	}
 }
 
-func TestILBCEncoderDecoder(t *testing.T) {
-	config := &ILBCConfig{
-		Mode:      ILBCMode30ms,
-		EnablePLC: true,
-	}
-
-	encoder, err := NewILBCEncoder(config)
-	if err != nil {
-		t.Fatalf("failed to create encoder: %v", err)
-	}
-	defer encoder.Close()
-
-	decoder, err := NewILBCDecoder(config)
-	if err != nil {
-		t.Fatalf("failed to create decoder: %v", err)
-	}
-	defer decoder.Close()
-
-	// Create test samples - 30ms at 8kHz = 240 samples
-	samples := make([]int16, 240)
-	for i := range samples {
-		samples[i] = int16(8000 * testSine(float64(i)*2*3.14159/120))
-	}
-
-	// Encode
-	encoded, err := encoder.Encode(samples)
-	if err != nil {
-		t.Fatalf("encoding failed: %v", err)
-	}
-
-	// iLBC 30ms mode = 50 bytes
-	if len(encoded) != 50 {
-		t.Errorf("expected 50 encoded bytes, got %d", len(encoded))
-	}
-
-	// Decode
-	decoded, err := decoder.Decode(encoded)
-	if err != nil {
-		t.Fatalf("decoding failed: %v", err)
-	}
-
-	if len(decoded) != len(samples) {
-		t.Errorf("expected %d decoded samples, got %d", len(samples), len(decoded))
-	}
-}
-
-func TestSpeexEncoderDecoder(t *testing.T) {
-	config := &SpeexConfig{
-		Mode:       SpeexModeNarrowband,
-		Quality:    5,
-		EnableVBR:  false,
-		EnableVAD:  false,
-		EnableDTX:  false,
-		Complexity: 3,
-	}
-
-	encoder, err := NewSpeexEncoder(config)
-	if err != nil {
-		t.Fatalf("failed to create encoder: %v", err)
-	}
-	defer encoder.Close()
-
-	decoder, err := NewSpeexDecoder(config)
-	if err != nil {
-		t.Fatalf("failed to create decoder: %v", err)
-	}
-	defer decoder.Close()
-
-	// Create test samples - 20ms at 8kHz = 160 samples
-	samples := make([]int16, 160)
-	for i := range samples {
-		samples[i] = int16(8000 * testSine(float64(i)*2*3.14159/80))
-	}
-
-	// Encode
-	encoded, err := encoder.Encode(samples)
-	if err != nil {
-		t.Fatalf("encoding failed: %v", err)
-	}
-
-	if len(encoded) == 0 {
-		t.Error("encoded data is empty")
-	}
-
-	// Decode
-	decoded, err := decoder.Decode(encoded)
-	if err != nil {
-		t.Fatalf("decoding failed: %v", err)
-	}
-
-	if len(decoded) != len(samples) {
-		t.Errorf("expected %d decoded samples, got %d", len(samples), len(decoded))
+func TestILBCFmtpMode(t *testing.T) {
+	if ILBCFmtpMode("mode=20") != ILBCMode20ms || ILBCFmtpMode("") != ILBCMode30ms {
+		t.Error("expected mode=20 to select 20 ms frames and 30 ms by default")
 	}
 }
 
-func TestAMREncoderDecoder(t *testing.T) {
-	config := &AMRConfig{
-		Mode:     AMRMode122,
-		Wideband: false,
-	}
-
-	encoder, err := NewAMREncoder(config)
-	if err != nil {
-		t.Fatalf("failed to create encoder: %v", err)
-	}
-	defer encoder.Close()
-
-	decoder, err := NewAMRDecoder(config)
-	if err != nil {
-		t.Fatalf("failed to create decoder: %v", err)
-	}
-	defer decoder.Close()
-
-	// Create test samples - 20ms at 8kHz = 160 samples
-	samples := make([]int16, 160)
-	for i := range samples {
-		samples[i] = int16(8000 * testSine(float64(i)*2*3.14159/80))
-	}
-
-	// Encode
-	encoded, err := encoder.Encode(samples)
-	if err != nil {
-		t.Fatalf("encoding failed: %v", err)
-	}
-
-	if len(encoded) == 0 {
-		t.Error("encoded data is empty")
-	}
-
-	// Decode
-	decoded, err := decoder.Decode(encoded)
-	if err != nil {
-		t.Fatalf("decoding failed: %v", err)
-	}
-
-	if len(decoded) != len(samples) {
-		t.Errorf("expected %d decoded samples, got %d", len(samples), len(decoded))
-	}
-}
-
-func TestILBCPLC(t *testing.T) {
-	config := &ILBCConfig{
-		Mode:      ILBCMode30ms,
-		EnablePLC: true,
-	}
-
-	decoder, err := NewILBCDecoder(config)
-	if err != nil {
-		t.Fatalf("failed to create decoder: %v", err)
-	}
-	defer decoder.Close()
-
-	// First decode a valid frame
-	samples := make([]int16, 240)
-	for i := range samples {
-		samples[i] = int16(8000 * testSine(float64(i)*2*3.14159/120))
-	}
-
-	encoder, _ := NewILBCEncoder(config)
-	validFrame, _ := encoder.Encode(samples)
-	encoder.Close()
-
-	// Decode valid frame
-	_, err = decoder.Decode(validFrame)
-	if err != nil {
-		t.Fatalf("failed to decode valid frame: %v", err)
-	}
-
-	// Now simulate packet loss (empty frame triggers PLC)
-	concealed, err := decoder.Decode(nil)
-	if err != nil {
-		t.Fatalf("PLC concealment failed: %v", err)
-	}
-
-	if len(concealed) != 240 {
-		t.Errorf("expected 240 concealed samples, got %d", len(concealed))
+func TestTranscodeAudio_RelayedCodecs(t *testing.T) {
+	pcmu := mimeCodec(webrtc.MimeTypePCMU)
+	frame := encodeG711("PCMU", resamplerTone(440, 8000, 160))
+
+	// Codecs whose native codec is not built in are relayed unchanged and
+	// not offered for transcoding
+	for _, codec := range []CodecInfo{
+		{Name: "AMR", ClockRate: AMRNBSampleRate, Fmtp: "octet-align=1"},
+		{Name: "AMR-WB", ClockRate: AMRWBSampleRate},
+		{Name: "iLBC", ClockRate: ILBCSampleRate, Fmtp: "mode=20"},
+		{Name: "speex", ClockRate: SpeexWBSampleRate},
+	} {
+		if _, ok := nativeAudioCodecFor(codec); ok {
+			continue
+		}
+		if out, err := transcodeAudio(frame, pcmu, codec); err != nil || !bytes.Equal(out, frame) {
+			t.Errorf("%s: expected the payload relayed unchanged, got %d bytes (%v)", codec.Name, len(out), err)
+		}
+		if added := TranscodeOfferCodecs(nil, []string{codec.Name}); len(added) != 0 {
+			t.Errorf("%s: expected no transcode offer, got %+v", codec.Name, added)
+		}
 	}
 }
 
@@ -0,0 +1,243 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// Comfort noise (RFC 3389) constants
+const (
+	CNPayloadType = 13 // static payload type for CN at 8000 Hz
+
+	cnMaxLevel        = 127 // quietest noise level in -dBov
+	cnFilterOrder     = 10  // reflection coefficients carried per SID
+	cnRefreshFrames   = 25  // silent frames between SID refreshes (500 ms at 20 ms)
+	cnLevelHysteresis = 3   // level change in dB that triggers a new SID
+)
+
+// CNPayload is an RFC 3389 silence insertion descriptor: the noise level and
+// the reflection coefficients describing its spectral envelope
+type CNPayload struct {
+	Level        uint8     // noise level in -dBov, 0..127
+	Coefficients []float64 // reflection coefficients in (-1, 1)
+}
+
+// ParseCNPayload decodes a CN payload. A payload with only the level byte
+// describes white noise
+func ParseCNPayload(payload []byte) (*CNPayload, error) {
+	if len(payload) == 0 {
+		return nil, fmt.Errorf("empty comfort noise payload")
+	}
+	cn := &CNPayload{Level: payload[0] & 0x7f}
+	for _, q := range payload[1:] {
+		cn.Coefficients = append(cn.Coefficients, dequantizeReflection(q))
+	}
+	return cn, nil
+}
+
+// Marshal encodes the CN payload
+func (cn *CNPayload) Marshal() []byte {
+	payload := make([]byte, 1, 1+len(cn.Coefficients))
+	payload[0] = cn.Level & 0x7f
+	for _, k := range cn.Coefficients {
+		payload = append(payload, quantizeReflection(k))
+	}
+	return payload
+}
+
+// quantizeReflection maps a reflection coefficient linearly onto 0..254,
+// with 127 representing zero
+func quantizeReflection(k float64) byte {
+	q := math.Round(k*128) + 127
+	if q < 0 {
+		q = 0
+	}
+	if q > 254 {
+		q = 254
+	}
+	return byte(q)
+}
+
+func dequantizeReflection(q byte) float64 {
+	if q > 254 {
+		q = 254
+	}
+	return float64(int(q)-127) / 128
+}
+
+// noiseLevel returns the level of pcm in -dBov, clamped to the CN range
+func noiseLevel(pcm []int16) uint8 {
+	if len(pcm) == 0 {
+		return cnMaxLevel
+	}
+	var sumSquares float64
+	for _, s := range pcm {
+		amplitude := float64(s) / pcmMaxAmplitude
+		sumSquares += amplitude * amplitude
+	}
+	rms := math.Sqrt(sumSquares / float64(len(pcm)))
+	if rms == 0 {
+		return cnMaxLevel
+	}
+	level := math.Round(-20 * math.Log10(rms))
+	if level < 0 {
+		return 0
+	}
+	if level > cnMaxLevel {
+		return cnMaxLevel
+	}
+	return uint8(level)
+}
+
+// reflectionCoefficients runs Levinson-Durbin over the autocorrelation of pcm
+// and returns up to order reflection coefficients
+func reflectionCoefficients(pcm []int16, order int) []float64 {
+	if len(pcm) <= order {
+		return nil
+	}
+	r := make([]float64, order+1)
+	for lag := range r {
+		for i := lag; i < len(pcm); i++ {
+			r[lag] += float64(pcm[i]) * float64(pcm[i-lag])
+		}
+	}
+	if r[0] == 0 {
+		return nil
+	}
+
+	k := make([]float64, 0, order)
+	a := make([]float64, order+1)
+	energy := r[0]
+	for i := 1; i <= order; i++ {
+		acc := r[i]
+		for j := 1; j < i; j++ {
+			acc -= a[j] * r[i-j]
+		}
+		ki := acc / energy
+		if math.Abs(ki) >= 1 {
+			break
+		}
+		a = stepUp(a, i, ki)
+		k = append(k, ki)
+		energy *= 1 - ki*ki
+		if energy <= 0 {
+			break
+		}
+	}
+	return k
+}
+
+// stepUp extends the predictor a of order i-1 to order i with reflection
+// coefficient k
+func stepUp(a []float64, i int, k float64) []float64 {
+	next := make([]float64, len(a))
+	copy(next, a)
+	next[i] = k
+	for j := 1; j < i; j++ {
+		next[j] = a[j] - k*a[i-j]
+	}
+	return next
+}
+
+// ComfortNoiseEncoder decides when to send SID frames while the sender is
+// silent: on the first silent frame, when the level moves, and periodically
+type ComfortNoiseEncoder struct {
+	silent bool
+	frames int
+	level  uint8
+}
+
+// NewComfortNoiseEncoder creates a comfort noise encoder
+func NewComfortNoiseEncoder() *ComfortNoiseEncoder {
+	return &ComfortNoiseEncoder{}
+}
+
+// Process takes a decoded frame and whether it carries voice. It returns the
+// SID payload to send in place of the frame, or nil if nothing should be sent
+func (e *ComfortNoiseEncoder) Process(pcm []int16, voice bool) []byte {
+	if voice {
+		e.silent = false
+		return nil
+	}
+
+	level := noiseLevel(pcm)
+	e.frames++
+	if e.silent && e.frames < cnRefreshFrames && absDiff(level, e.level) < cnLevelHysteresis {
+		return nil
+	}
+
+	e.silent = true
+	e.frames = 0
+	e.level = level
+	cn := &CNPayload{Level: level, Coefficients: reflectionCoefficients(pcm, cnFilterOrder)}
+	return cn.Marshal()
+}
+
+func absDiff(a, b uint8) uint8 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// ComfortNoiseGenerator synthesizes noise frames from received SID payloads
+type ComfortNoiseGenerator struct {
+	gain      float64
+	predictor []float64
+	history   []float64
+	rng       *rand.Rand
+}
+
+// NewComfortNoiseGenerator creates a generator producing silence until the
+// first SID arrives
+func NewComfortNoiseGenerator() *ComfortNoiseGenerator {
+	return &ComfortNoiseGenerator{rng: rand.New(rand.NewSource(rand.Int63()))}
+}
+
+// Update applies a received CN payload
+func (g *ComfortNoiseGenerator) Update(payload []byte) error {
+	cn, err := ParseCNPayload(payload)
+	if err != nil {
+		return err
+	}
+
+	g.gain = pcmMaxAmplitude * math.Pow(10, -float64(cn.Level)/20)
+	a := make([]float64, len(cn.Coefficients)+1)
+	for i, k := range cn.Coefficients {
+		a = stepUp(a, i+1, k)
+	}
+	g.predictor = a[1:]
+	if len(g.history) != len(g.predictor) {
+		g.history = make([]float64, len(g.predictor))
+	}
+	return nil
+}
+
+// Generate returns n samples of noise shaped by the last SID
+func (g *ComfortNoiseGenerator) Generate(n int) []int16 {
+	out := make([]float64, n)
+	var sumSquares float64
+	for i := range out {
+		x := g.rng.Float64()*2 - 1
+		for j, a := range g.predictor {
+			x += a * g.history[j]
+		}
+		if len(g.history) > 0 {
+			copy(g.history[1:], g.history)
+			g.history[0] = x
+		}
+		out[i] = x
+		sumSquares += x * x
+	}
+
+	samples := make([]int16, n)
+	if n == 0 || sumSquares == 0 || g.gain == 0 {
+		return samples
+	}
+	scale := g.gain / math.Sqrt(sumSquares/float64(n))
+	for i, x := range out {
+		samples[i] = clampSample(x * scale)
+	}
+	return samples
+}
@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestCNPayload_RoundTrip(t *testing.T) {
+	cn := &CNPayload{Level: 60, Coefficients: []float64{0.5, -0.25, 0}}
+	payload := cn.Marshal()
+	if len(payload) != 4 || payload[0] != 60 || payload[3] != 127 {
+		t.Fatalf("unexpected payload %v", payload)
+	}
+
+	parsed, err := ParseCNPayload(payload)
+	if err != nil {
+		t.Fatalf("ParseCNPayload failed: %v", err)
+	}
+	if parsed.Level != 60 || len(parsed.Coefficients) != 3 {
+		t.Fatalf("unexpected parse %+v", parsed)
+	}
+	for i, k := range cn.Coefficients {
+		if math.Abs(parsed.Coefficients[i]-k) > 1.0/128 {
+			t.Errorf("coefficient %d: expected %v, got %v", i, k, parsed.Coefficients[i])
+		}
+	}
+
+	if _, err := ParseCNPayload(nil); err == nil {
+		t.Error("expected error for empty payload")
+	}
+}
+
+func TestComfortNoiseEncoder_SIDSchedule(t *testing.T) {
+	encoder := NewComfortNoiseEncoder()
+	rng := rand.New(rand.NewSource(1))
+	noise := func(amplitude float64) []int16 {
+		frame := make([]int16, vadFrameSize)
+		for i := range frame {
+			frame[i] = int16((rng.Float64()*2 - 1) * amplitude)
+		}
+		return frame
+	}
+
+	if sid := encoder.Process(noise(10000), true); sid != nil {
+		t.Fatal("expected no SID while talking")
+	}
+	if sid := encoder.Process(noise(100), false); sid == nil {
+		t.Fatal("expected a SID on the first silent frame")
+	}
+
+	sent := 0
+	for i := 0; i < cnRefreshFrames*2; i++ {
+		if encoder.Process(noise(100), false) != nil {
+			sent++
+		}
+	}
+	if sent != 2 {
+		t.Errorf("expected 2 refresh SIDs over %d frames, got %d", cnRefreshFrames*2, sent)
+	}
+
+	if sid := encoder.Process(noise(1000), false); sid == nil {
+		t.Error("expected a SID when the noise level rises")
+	}
+
+	encoder.Process(noise(10000), true)
+	if sid := encoder.Process(noise(100), false); sid == nil {
+		t.Error("expected a SID when silence resumes after speech")
+	}
+}
+
+func TestComfortNoiseGenerator_Level(t *testing.T) {
+	generator := NewComfortNoiseGenerator()
+	if samples := generator.Generate(vadFrameSize); noiseLevel(samples) != cnMaxLevel {
+		t.Errorf("expected silence before the first SID, got level %d", noiseLevel(samples))
+	}
+
+	// Shape noise with the envelope of a low-pass signal
+	rng := rand.New(rand.NewSource(1))
+	source := make([]int16, 800)
+	var prev float64
+	for i := range source {
+		prev = 0.9*prev + (rng.Float64()*2-1)*1000
+		source[i] = int16(prev)
+	}
+	cn := &CNPayload{Level: 50, Coefficients: reflectionCoefficients(source, cnFilterOrder)}
+	if len(cn.Coefficients) == 0 || cn.Coefficients[0] < 0.5 {
+		t.Fatalf("expected strong first reflection coefficient, got %v", cn.Coefficients)
+	}
+	if err := generator.Update(cn.Marshal()); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+
+	samples := generator.Generate(vadFrameSize)
+	if level := noiseLevel(samples); absDiff(level, 50) > 1 {
+		t.Errorf("expected noise at -50 dBov, got -%d", level)
+	}
+	if IsVoiceActive(samples) {
+		t.Error("comfort noise should not register as voice")
+	}
+}
@@ -0,0 +1,882 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/rtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Conference metrics
+var (
+	conferenceRoomsActive = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "karl_conference_rooms_active",
+			Help: "Number of conference rooms",
+		},
+	)
+
+	conferenceParticipantsActive = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "karl_conference_participants_active",
+			Help: "Number of call legs joined to conference rooms",
+		},
+	)
+
+	conferenceFramesMixed = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "karl_conference_frames_mixed_total",
+			Help: "Total mix-minus frames sent to conference participants",
+		},
+	)
+
+	conferenceSendErrors = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "karl_conference_send_errors_total",
+			Help: "Total conference frames that could not be encoded or sent",
+		},
+	)
+)
+
+// Conference errors
+var (
+	ErrConferenceExists         = errors.New("conference room already exists")
+	ErrConferenceNotFound       = errors.New("conference room not found")
+	ErrConferenceFull           = errors.New("conference room is full")
+	ErrParticipantNotFound      = errors.New("conference participant not found")
+	ErrParticipantAlreadyJoined = errors.New("call leg already joined to a conference")
+)
+
+const (
+	// conferenceQueueFrames bounds the audio buffered per participant; older
+	// audio is dropped so a participant can never add more delay than this
+	conferenceQueueFrames = 5
+
+	// conferenceSpeakingHangover keeps a participant marked as speaking
+	// through short pauses between words
+	conferenceSpeakingHangover = 300 * time.Millisecond
+
+	// conferenceLimiterKnee is where the output limiter starts compressing
+	conferenceLimiterKnee = 24000
+
+	// conferenceSilenceLevel is the level reported for digital silence
+	conferenceSilenceLevel = -127.0
+)
+
+// ConferenceParticipantOptions controls how a leg is mixed into a room
+type ConferenceParticipantOptions struct {
+	Gain  float64 // Linear input gain, 0 selects unity
+	Muted bool    // Participant hears the room but is not heard
+}
+
+// ConferenceParticipant is one call leg joined to a conference room. It
+// receives the mix of every other participant (mix-minus) in the codec it
+// negotiated.
+type ConferenceParticipant struct {
+	ID          string
+	CallID      string
+	SessionID   string
+	FromOfferer bool
+	JoinedAt    time.Time
+
+	codec     CodecInfo
+	codecs    *StreamCodecs
+	remote    *net.UDPAddr
+	ssrc      uint32
+	seq       uint16
+	timestamp uint32
+
+	gain      float64
+	muted     bool
+	level     float64 // dBFS of the last mixed frame
+	speaking  bool
+	lastVoice time.Time
+	queue     []int16
+
+	// The level the participant's client reports in its audio level header
+	// extension (RFC 6464), preferred to the level of the decoded audio
+	audioLevelID  uint8 // a=extmap identifier, 0 if not negotiated
+	reportedLevel float64
+	reportedVoice bool
+	reportedAt    time.Time
+
+	packetsIn  uint64
+	packetsOut uint64
+	mu         sync.Mutex
+}
+
+// ConferenceParticipantInfo is a snapshot of a participant
+type ConferenceParticipantInfo struct {
+	ID         string
+	CallID     string
+	SessionID  string
+	Leg        string // caller or callee
+	Codec      string
+	Remote     string
+	Gain       float64
+	Muted      bool
+	Speaking   bool
+	Level      float64
+	JoinedAt   time.Time
+	PacketsIn  uint64
+	PacketsOut uint64
+}
+
+// legName names the leg a participant joined with
+func (p *ConferenceParticipant) legName() string {
+	if p.FromOfferer {
+		return "caller"
+	}
+	return "callee"
+}
+
+// Info returns a snapshot of the participant
+func (p *ConferenceParticipant) Info() ConferenceParticipantInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return ConferenceParticipantInfo{
+		ID:         p.ID,
+		CallID:     p.CallID,
+		SessionID:  p.SessionID,
+		Leg:        p.legName(),
+		Codec:      p.codec.Name,
+		Remote:     p.remote.String(),
+		Gain:       p.gain,
+		Muted:      p.muted,
+		Speaking:   p.speaking,
+		Level:      p.level,
+		JoinedAt:   p.JoinedAt,
+		PacketsIn:  p.packetsIn,
+		PacketsOut: p.packetsOut,
+	}
+}
+
+// push queues decoded audio received from the participant
+func (p *ConferenceParticipant) push(samples []int16, maxSamples int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.packetsIn++
+	p.queue = append(p.queue, samples...)
+	if over := len(p.queue) - maxSamples; over > 0 {
+		p.queue = p.queue[over:]
+	}
+}
+
+// reportLevel records the audio level the participant's client sent
+func (p *ConferenceParticipant) reportLevel(level float64, voice bool, at time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reportedLevel, p.reportedVoice, p.reportedAt = level, voice, at
+}
+
+// take removes one frame of input with gain applied and updates the
+// speaking indication. It returns nil when the participant is muted or has
+// nothing queued.
+func (p *ConferenceParticipant) take(frameSamples int, threshold float64, now time.Time) []int16 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.queue) < frameSamples {
+		p.level = conferenceSilenceLevel
+		p.speaking = p.speaking && now.Sub(p.lastVoice) < conferenceSpeakingHangover
+		return nil
+	}
+
+	frame := make([]int16, frameSamples)
+	copy(frame, p.queue)
+	p.queue = p.queue[frameSamples:]
+
+	if p.gain != 1 {
+		for i, s := range frame {
+			frame[i] = clampInt16(float64(s) * p.gain)
+		}
+	}
+
+	p.level = levelDBFS(frame)
+	voice := p.level >= threshold
+	if now.Sub(p.reportedAt) < conferenceSpeakingHangover {
+		p.level = p.reportedLevel
+		voice = p.reportedVoice || p.level >= threshold
+	}
+	if voice && !p.muted {
+		p.lastVoice = now
+	}
+	p.speaking = !p.muted && now.Sub(p.lastVoice) < conferenceSpeakingHangover
+
+	if p.muted {
+		return nil
+	}
+	return frame
+}
+
+// ConferenceRoom mixes audio between the participants joined to it
+type ConferenceRoom struct {
+	Name      string
+	CreatedAt time.Time
+
+	manager       *ConferenceManager
+	participants  map[string]*ConferenceParticipant
+	activeSpeaker string
+	stop          chan struct{}
+	done          chan struct{}
+	mu            sync.RWMutex
+}
+
+// ConferenceRoomInfo is a snapshot of a room and its participants
+type ConferenceRoomInfo struct {
+	Name          string
+	CreatedAt     time.Time
+	ActiveSpeaker string // ID of the loudest speaking participant
+	Participants  []ConferenceParticipantInfo
+}
+
+// Info returns a snapshot of the room
+func (r *ConferenceRoom) Info() ConferenceRoomInfo {
+	r.mu.RLock()
+	info := ConferenceRoomInfo{
+		Name:          r.Name,
+		CreatedAt:     r.CreatedAt,
+		ActiveSpeaker: r.activeSpeaker,
+	}
+	participants := make([]*ConferenceParticipant, 0, len(r.participants))
+	for _, p := range r.participants {
+		participants = append(participants, p)
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(participants, func(i, j int) bool {
+		return participants[i].JoinedAt.Before(participants[j].JoinedAt)
+	})
+	for _, p := range participants {
+		info.Participants = append(info.Participants, p.Info())
+	}
+	return info
+}
+
+// GetParticipant returns a participant of the room by ID
+func (r *ConferenceRoom) GetParticipant(id string) (*ConferenceParticipant, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	p, ok := r.participants[id]
+	return p, ok
+}
+
+// run mixes one frame per packet time until the room is closed
+func (r *ConferenceRoom) run() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.manager.packetTime())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			r.mixFrame(now)
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// publishActiveSpeaker publishes a change of the room's active speaker; a
+// nil speaker means no participant is speaking
+func (r *ConferenceRoom) publishActiveSpeaker(speaker *ConferenceParticipant, previous string) {
+	data := map[string]interface{}{
+		"conference":     r.Name,
+		"participant_id": "",
+		"previous":       previous,
+	}
+	callID := ""
+	if speaker != nil {
+		callID = speaker.CallID
+		data["participant_id"] = speaker.ID
+		data["session_id"] = speaker.SessionID
+		data["leg"] = speaker.legName()
+	}
+	PublishEvent(EventActiveSpeaker, callID, data)
+}
+
+// mixFrame sums one frame from every participant and sends each of them
+// the sum minus their own contribution
+func (r *ConferenceRoom) mixFrame(now time.Time) {
+	r.mu.RLock()
+	participants := make([]*ConferenceParticipant, 0, len(r.participants))
+	for _, p := range r.participants {
+		participants = append(participants, p)
+	}
+	r.mu.RUnlock()
+
+	if len(participants) == 0 {
+		return
+	}
+
+	frameSamples := r.manager.frameSamples()
+	threshold := r.manager.config.SpeakingThreshold
+	inputs := make([][]int16, len(participants))
+	total := make([]int32, frameSamples)
+
+	// The active speaker keeps the floor until it falls silent, then the
+	// loudest speaking participant takes it
+	r.mu.RLock()
+	previous := r.activeSpeaker
+	r.mu.RUnlock()
+	activeSpeaker, kept := "", false
+	var speaker *ConferenceParticipant
+	loudest := math.Inf(-1)
+	for i, p := range participants {
+		inputs[i] = p.take(frameSamples, threshold, now)
+		for j, s := range inputs[i] {
+			total[j] += int32(s)
+		}
+
+		p.mu.Lock()
+		if p.speaking && !kept && (p.ID == previous || p.level > loudest) {
+			loudest, kept = p.level, p.ID == previous
+			activeSpeaker, speaker = p.ID, p
+		}
+		p.mu.Unlock()
+	}
+
+	r.mu.Lock()
+	r.activeSpeaker = activeSpeaker
+	r.mu.Unlock()
+	if activeSpeaker != previous {
+		r.publishActiveSpeaker(speaker, previous)
+	}
+
+	out := make([]int16, frameSamples)
+	for i, p := range participants {
+		own := inputs[i]
+		for j := range out {
+			sum := total[j]
+			if own != nil {
+				sum -= int32(own[j])
+			}
+			out[j] = limitSample(sum)
+		}
+		if err := r.manager.sendFrame(p, out); err != nil {
+			conferenceSendErrors.Inc()
+			if IsDebugLoggingEnabled() {
+				log.Printf("Conference %s: failed to send to %s: %v", r.Name, p.ID, err)
+			}
+			continue
+		}
+		conferenceFramesMixed.Inc()
+	}
+}
+
+// ConferenceManager owns the conference rooms and routes RTP from joined
+// call legs into them
+type ConferenceManager struct {
+	config       *ConferenceConfig
+	registry     *SessionRegistry
+	negotiator   *CodecNegotiator
+	rooms        map[string]*ConferenceRoom
+	legs         map[string]*ConferenceParticipant // callID/leg -> participant
+	send         func(packet []byte, addr *net.UDPAddr) error
+	participants int32 // joined legs, read on the packet path
+	mu           sync.RWMutex
+}
+
+// NewConferenceManager creates a conference manager for the sessions in registry
+func NewConferenceManager(config *ConferenceConfig, registry *SessionRegistry) *ConferenceManager {
+	if config == nil {
+		config = (&Config{}).GetConferenceConfig()
+	}
+
+	// Fill in settings a partial config left unset
+	cfg := *config
+	defaults := (&Config{}).GetConferenceConfig()
+	if cfg.SampleRate != 8000 && cfg.SampleRate != 16000 && cfg.SampleRate != opusSampleRate {
+		cfg.SampleRate = defaults.SampleRate
+	}
+	if cfg.PacketTime <= 0 {
+		cfg.PacketTime = defaults.PacketTime
+	}
+	if cfg.SpeakingThreshold == 0 {
+		cfg.SpeakingThreshold = defaults.SpeakingThreshold
+	}
+
+	return &ConferenceManager{
+		config:     &cfg,
+		registry:   registry,
+		negotiator: GetCodecNegotiator(),
+		rooms:      make(map[string]*ConferenceRoom),
+		legs:       make(map[string]*ConferenceParticipant),
+	}
+}
+
+// SetSender sets the function used to send mixed RTP to participants
+func (m *ConferenceManager) SetSender(send func(packet []byte, addr *net.UDPAddr) error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.send = send
+}
+
+// packetTime returns the mixing interval
+func (m *ConferenceManager) packetTime() time.Duration {
+	return time.Duration(m.config.PacketTime) * time.Millisecond
+}
+
+// frameSamples returns the number of samples mixed per packet time
+func (m *ConferenceManager) frameSamples() int {
+	return m.config.SampleRate * m.config.PacketTime / 1000
+}
+
+// CreateRoom creates a named room and starts its mixer
+func (m *ConferenceManager) CreateRoom(name string) (*ConferenceRoom, error) {
+	if name == "" {
+		return nil, errors.New("conference room name required")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.rooms[name]; exists {
+		return nil, ErrConferenceExists
+	}
+	return m.createRoomLocked(name), nil
+}
+
+// createRoomLocked creates and starts a room (caller must hold write lock)
+func (m *ConferenceManager) createRoomLocked(name string) *ConferenceRoom {
+	room := &ConferenceRoom{
+		Name:         name,
+		CreatedAt:    time.Now(),
+		manager:      m,
+		participants: make(map[string]*ConferenceParticipant),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	m.rooms[name] = room
+	conferenceRoomsActive.Inc()
+
+	go room.run()
+	log.Printf("Conference room %s created", name)
+	return room
+}
+
+// GetRoom returns a room by name
+func (m *ConferenceManager) GetRoom(name string) (*ConferenceRoom, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	room, ok := m.rooms[name]
+	return room, ok
+}
+
+// ListRooms returns all rooms ordered by name
+func (m *ConferenceManager) ListRooms() []*ConferenceRoom {
+	m.mu.RLock()
+	rooms := make([]*ConferenceRoom, 0, len(m.rooms))
+	for _, room := range m.rooms {
+		rooms = append(rooms, room)
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].Name < rooms[j].Name })
+	return rooms
+}
+
+// DeleteRoom removes every participant from a room and stops its mixer
+func (m *ConferenceManager) DeleteRoom(name string) error {
+	m.mu.Lock()
+	room, ok := m.rooms[name]
+	if !ok {
+		m.mu.Unlock()
+		return ErrConferenceNotFound
+	}
+	delete(m.rooms, name)
+
+	room.mu.Lock()
+	for id, p := range room.participants {
+		m.removeLegLocked(p)
+		delete(room.participants, id)
+	}
+	room.mu.Unlock()
+	m.mu.Unlock()
+
+	close(room.stop)
+	<-room.done
+	conferenceRoomsActive.Dec()
+	log.Printf("Conference room %s deleted", name)
+	return nil
+}
+
+// Join adds one leg of a call session to a room, creating the room if it
+// does not exist. caller selects the offering leg, otherwise the answering
+// leg joins.
+func (m *ConferenceManager) Join(roomName, sessionID string, caller bool, opts ConferenceParticipantOptions) (*ConferenceParticipant, error) {
+	if roomName == "" {
+		return nil, errors.New("conference room name required")
+	}
+
+	session, ok := m.registry.GetSession(sessionID)
+	if !ok {
+		return nil, fmt.Errorf("session %s not found", sessionID)
+	}
+
+	session.RLock()
+	callID := session.CallID
+	leg := session.CalleeLeg
+	if caller {
+		leg = session.CallerLeg
+	}
+	var remote *net.UDPAddr
+	var legCodecs []CodecInfo
+	var audioLevelID uint8
+	if leg != nil && leg.IP != nil && leg.Port > 0 {
+		remote = &net.UDPAddr{IP: leg.IP, Port: leg.Port}
+		legCodecs = leg.Codecs
+		audioLevelID = leg.Extmap.ID(ExtmapAudioLevel)
+	}
+	session.RUnlock()
+
+	if remote == nil {
+		return nil, errors.New("call leg has no remote media address")
+	}
+
+	codec, err := m.legCodec(callID, caller, legCodecs)
+	if err != nil {
+		return nil, err
+	}
+
+	gain := opts.Gain
+	if gain <= 0 {
+		gain = 1
+	}
+
+	p := &ConferenceParticipant{
+		ID:          uuid.New().String(),
+		CallID:      callID,
+		SessionID:   sessionID,
+		FromOfferer: caller,
+		JoinedAt:    time.Now(),
+		codec:       codec,
+		codecs:      NewStreamCodecs(),
+		remote:      remote,
+		ssrc:        rand.Uint32(),
+		seq:         uint16(rand.Uint32()),
+		timestamp:   rand.Uint32(),
+		gain:        gain,
+		muted:       opts.Muted,
+		level:       conferenceSilenceLevel,
+
+		audioLevelID: audioLevelID,
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := conferenceLegKey(callID, caller)
+	if _, exists := m.legs[key]; exists {
+		return nil, ErrParticipantAlreadyJoined
+	}
+
+	room, ok := m.rooms[roomName]
+	if !ok {
+		room = m.createRoomLocked(roomName)
+	}
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if m.config.MaxParticipants > 0 && len(room.participants) >= m.config.MaxParticipants {
+		return nil, ErrConferenceFull
+	}
+
+	room.participants[p.ID] = p
+	m.legs[key] = p
+	atomic.AddInt32(&m.participants, 1)
+	conferenceParticipantsActive.Inc()
+
+	log.Printf("Call %s (%s) joined conference %s as %s using %s",
+		callID, p.legName(), roomName, p.ID, codec.Name)
+	return p, nil
+}
+
+// legCodec picks the codec a participant is sent: the first audio codec the
+// leg advertised in its own SDP
+func (m *ConferenceManager) legCodec(callID string, caller bool, legCodecs []CodecInfo) (CodecInfo, error) {
+	codecs := legCodecs
+	if negotiated, ok := m.negotiator.GetCallCodecs(callID); ok {
+		if caller && len(negotiated.OfferCodecs) > 0 {
+			codecs = negotiated.OfferCodecs
+		} else if !caller && len(negotiated.AnswerCodecs) > 0 {
+			codecs = negotiated.AnswerCodecs
+		}
+	}
+
+	codec, ok := firstAudioCodec(codecs)
+	if !ok {
+		codec = CodecInfo{PayloadType: 0, Name: "PCMU", ClockRate: 8000, Channels: 1}
+	}
+	if !conferenceCodecSupported(codec.Name) {
+		return CodecInfo{}, fmt.Errorf("codec %s is not supported for conferencing", codec.Name)
+	}
+	return codec, nil
+}
+
+// Leave removes a participant from a room
+func (m *ConferenceManager) Leave(roomName, participantID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	room, ok := m.rooms[roomName]
+	if !ok {
+		return ErrConferenceNotFound
+	}
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	p, ok := room.participants[participantID]
+	if !ok {
+		return ErrParticipantNotFound
+	}
+	delete(room.participants, participantID)
+	m.removeLegLocked(p)
+
+	log.Printf("Call %s (%s) left conference %s", p.CallID, p.legName(), roomName)
+	return nil
+}
+
+// UpdateParticipant changes the gain or mute state of a participant; nil
+// values are left unchanged
+func (m *ConferenceManager) UpdateParticipant(roomName, participantID string, gain *float64, muted *bool) error {
+	room, ok := m.GetRoom(roomName)
+	if !ok {
+		return ErrConferenceNotFound
+	}
+	p, ok := room.GetParticipant(participantID)
+	if !ok {
+		return ErrParticipantNotFound
+	}
+	if gain != nil && (*gain < 0 || *gain > 10) {
+		return errors.New("gain must be between 0 and 10")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if gain != nil {
+		p.gain = *gain
+	}
+	if muted != nil {
+		p.muted = *muted
+		if p.muted {
+			p.speaking = false
+		}
+	}
+	return nil
+}
+
+// RemoveCall removes both legs of a call from any room they joined
+func (m *ConferenceManager) RemoveCall(callID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, caller := range []bool{true, false} {
+		p, ok := m.legs[conferenceLegKey(callID, caller)]
+		if !ok {
+			continue
+		}
+		for _, room := range m.rooms {
+			room.mu.Lock()
+			if _, ok := room.participants[p.ID]; ok {
+				delete(room.participants, p.ID)
+				log.Printf("Call %s (%s) left conference %s on hangup", callID, p.legName(), room.Name)
+			}
+			room.mu.Unlock()
+		}
+		m.removeLegLocked(p)
+	}
+}
+
+// removeLegLocked forgets a participant's leg (caller must hold m.mu)
+func (m *ConferenceManager) removeLegLocked(p *ConferenceParticipant) {
+	key := conferenceLegKey(p.CallID, p.FromOfferer)
+	if m.legs[key] != p {
+		return
+	}
+	delete(m.legs, key)
+	atomic.AddInt32(&m.participants, -1)
+	conferenceParticipantsActive.Dec()
+}
+
+// HandleRTP feeds an RTP packet from a joined call leg into its room
+func (m *ConferenceManager) HandleRTP(packet *rtp.Packet) {
+	if atomic.LoadInt32(&m.participants) == 0 || len(packet.Payload) == 0 {
+		return
+	}
+
+	callID, fromOfferer, codec, ok := m.negotiator.ResolveLeg(packet.SSRC, packet.PayloadType)
+	if !ok {
+		return
+	}
+
+	m.mu.RLock()
+	p, ok := m.legs[conferenceLegKey(callID, fromOfferer)]
+	m.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	if p.audioLevelID != 0 {
+		if level, voice, ok := parseAudioLevel(packet.GetExtension(p.audioLevelID)); ok {
+			p.reportLevel(level, voice, time.Now())
+		}
+	}
+
+	samples, rate, err := decodeConferenceAudio(codec.Name, packet.Payload, p.codecs)
+	if err != nil || samples == nil {
+		return
+	}
+	samples = p.codecs.resample(samples, rate, m.config.SampleRate)
+	p.push(samples, m.frameSamples()*conferenceQueueFrames)
+}
+
+// sendFrame encodes a mixed frame in the participant's codec and sends it
+func (m *ConferenceManager) sendFrame(p *ConferenceParticipant, frame []int16) error {
+	m.mu.RLock()
+	send := m.send
+	m.mu.RUnlock()
+	if send == nil {
+		return errors.New("no RTP sender configured")
+	}
+
+	p.mu.Lock()
+	codec, remote := p.codec, p.remote
+	p.mu.Unlock()
+
+	payload, samples, err := encodeConferenceAudio(codec.Name, frame, m.config.SampleRate, p.codecs)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	pkt := &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			PayloadType:    codec.PayloadType,
+			SequenceNumber: p.seq,
+			Timestamp:      p.timestamp,
+			SSRC:           p.ssrc,
+		},
+		Payload: payload,
+	}
+	p.seq++
+	p.timestamp += uint32(samples)
+	p.packetsOut++
+	p.mu.Unlock()
+
+	data, err := pkt.Marshal()
+	if err != nil {
+		return err
+	}
+	return send(data, remote)
+}
+
+// Stop deletes every room
+func (m *ConferenceManager) Stop() {
+	for _, room := range m.ListRooms() {
+		_ = m.DeleteRoom(room.Name)
+	}
+}
+
+// conferenceLegKey identifies one leg of a call
+func conferenceLegKey(callID string, caller bool) string {
+	if caller {
+		return callID + "/caller"
+	}
+	return callID + "/callee"
+}
+
+// conferenceCodecSupported reports whether a codec can be decoded and
+// encoded by the conference mixer
+func conferenceCodecSupported(name string) bool {
+	return isG711(name) || strings.EqualFold(name, "opus")
+}
+
+// decodeConferenceAudio decodes an RTP payload into mono PCM with a
+// participant's codecs and returns its sample rate. Non-audio payloads
+// return nil samples.
+func decodeConferenceAudio(codec string, payload []byte, codecs *StreamCodecs) ([]int16, int, error) {
+	switch {
+	case isG711(codec):
+		return decodeG711(codec, payload), 8000, nil
+	case strings.EqualFold(codec, "opus"):
+		stereo, err := codecs.OpusDecoder().Decode(payload)
+		if err != nil {
+			return nil, 0, err
+		}
+		return stereoToMono(stereo), opusSampleRate, nil
+	case strings.EqualFold(codec, "telephone-event"), strings.EqualFold(codec, "CN"):
+		return nil, 0, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported conference codec %s", codec)
+	}
+}
+
+// encodeConferenceAudio encodes mono PCM at rate into a codec payload with a
+// participant's codecs and returns it with the number of RTP timestamp
+// units it covers
+func encodeConferenceAudio(codec string, frame []int16, rate int, codecs *StreamCodecs) ([]byte, int, error) {
+	switch {
+	case isG711(codec):
+		samples := codecs.resample(frame, rate, 8000)
+		return encodeG711(codec, samples), len(samples), nil
+	case strings.EqualFold(codec, "opus"):
+		mono := codecs.resample(frame, rate, opusSampleRate)
+		payload, err := codecs.OpusEncoder().Encode(monoToStereo(mono), OpusOptions{})
+		return payload, len(mono), err
+	default:
+		return nil, 0, fmt.Errorf("unsupported conference codec %s", codec)
+	}
+}
+
+// levelDBFS returns the RMS level of a frame in dB relative to full scale
+func levelDBFS(frame []int16) float64 {
+	rms := CalculateRMS(frame)
+	if rms == 0 {
+		return conferenceSilenceLevel
+	}
+	return math.Max(20*math.Log10(rms/pcmMaxAmplitude), conferenceSilenceLevel)
+}
+
+// limitSample soft-limits a mixed sample: values beyond the knee are
+// compressed towards full scale instead of clipping hard
+func limitSample(sum int32) int16 {
+	v := float64(sum)
+	sign := 1.0
+	if v < 0 {
+		v, sign = -v, -1
+	}
+	if v > conferenceLimiterKnee {
+		headroom := float64(pcmMaxAmplitude - conferenceLimiterKnee)
+		over := v - conferenceLimiterKnee
+		v = conferenceLimiterKnee + headroom*over/(over+headroom)
+	}
+	return int16(sign * v)
+}
+
+// clampInt16 converts a scaled sample to int16 with saturation
+func clampInt16(v float64) int16 {
+	if v > math.MaxInt16 {
+		return math.MaxInt16
+	}
+	if v < math.MinInt16 {
+		return math.MinInt16
+	}
+	return int16(v)
+}
@@ -0,0 +1,270 @@
+package internal
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// conferenceCapture collects the RTP packets a conference sends, by port
+type conferenceCapture struct {
+	packets map[int][]*rtp.Packet
+	mu      sync.Mutex
+}
+
+func (c *conferenceCapture) send(data []byte, addr *net.UDPAddr) error {
+	pkt := &rtp.Packet{}
+	if err := pkt.Unmarshal(data); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.packets[addr.Port] = append(c.packets[addr.Port], pkt)
+	return nil
+}
+
+func (c *conferenceCapture) last(port int) *rtp.Packet {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	packets := c.packets[port]
+	if len(packets) == 0 {
+		return nil
+	}
+	return packets[len(packets)-1]
+}
+
+func newTestConference(t *testing.T, maxParticipants int) (*ConferenceManager, *SessionRegistry, *conferenceCapture) {
+	t.Helper()
+
+	registry := NewSessionRegistry(time.Hour)
+	manager := NewConferenceManager(&ConferenceConfig{
+		SampleRate:        8000,
+		PacketTime:        20,
+		MaxParticipants:   maxParticipants,
+		SpeakingThreshold: -40,
+	}, registry)
+	manager.negotiator = NewCodecNegotiator()
+
+	capture := &conferenceCapture{packets: make(map[int][]*rtp.Packet)}
+	manager.SetSender(capture.send)
+
+	t.Cleanup(func() {
+		manager.Stop()
+		registry.Stop()
+	})
+	return manager, registry, capture
+}
+
+// addConferenceCall creates a session whose caller leg sends codec from port
+func addConferenceCall(t *testing.T, manager *ConferenceManager, registry *SessionRegistry, callID string, port int, codec CodecInfo, ssrc uint32) string {
+	t.Helper()
+
+	session := registry.CreateSession(callID, "from-"+callID)
+	session.Lock()
+	session.CallerLeg = &CallLeg{IP: net.ParseIP("192.0.2.1"), Port: port, Codecs: []CodecInfo{codec}}
+	session.Unlock()
+
+	manager.negotiator.SetOfferCodecs(callID, []CodecInfo{codec})
+	manager.negotiator.BindSSRC(ssrc, callID, true)
+	return session.ID
+}
+
+// pauseMixer stops a room's mixing goroutine so a test can drive it
+func pauseMixer(room *ConferenceRoom) {
+	close(room.stop)
+	<-room.done
+	room.stop = make(chan struct{})
+	go func() { <-room.stop }()
+}
+
+// sendTone feeds one frame of a constant sample value from a call leg
+func sendTone(manager *ConferenceManager, codec CodecInfo, ssrc uint32, value int16) {
+	samples := make([]int16, 160)
+	for i := range samples {
+		samples[i] = value
+	}
+	manager.HandleRTP(&rtp.Packet{
+		Header:  rtp.Header{Version: 2, PayloadType: codec.PayloadType, SSRC: ssrc},
+		Payload: encodeG711(codec.Name, samples),
+	})
+}
+
+func decodedLevel(t *testing.T, codec CodecInfo, pkt *rtp.Packet) int {
+	t.Helper()
+	if pkt == nil {
+		t.Fatal("expected a mixed packet")
+	}
+	samples := decodeG711(codec.Name, pkt.Payload)
+	return int(samples[len(samples)/2])
+}
+
+func TestConference_MixMinus(t *testing.T) {
+	manager, registry, capture := newTestConference(t, 0)
+	pcmu := CodecInfo{PayloadType: 0, Name: "PCMU", ClockRate: 8000, Channels: 1}
+	pcma := CodecInfo{PayloadType: 8, Name: "PCMA", ClockRate: 8000, Channels: 1}
+
+	ids := []string{
+		addConferenceCall(t, manager, registry, "conf-a", 5000, pcmu, 1),
+		addConferenceCall(t, manager, registry, "conf-b", 5002, pcma, 2),
+		addConferenceCall(t, manager, registry, "conf-c", 5004, pcmu, 3),
+	}
+	for _, id := range ids {
+		if _, err := manager.Join("room", id, true, ConferenceParticipantOptions{}); err != nil {
+			t.Fatalf("Join failed: %v", err)
+		}
+	}
+	room, _ := manager.GetRoom("room")
+	pauseMixer(room)
+
+	sendTone(manager, pcmu, 1, 1000)
+	sendTone(manager, pcma, 2, 2000)
+	sendTone(manager, pcmu, 3, 4000)
+	room.mixFrame(time.Now())
+
+	tests := []struct {
+		port  int
+		codec CodecInfo
+		want  int
+	}{
+		{5000, pcmu, 6000},
+		{5002, pcma, 5000},
+		{5004, pcmu, 3000},
+	}
+	for _, tt := range tests {
+		pkt := capture.last(tt.port)
+		got := decodedLevel(t, tt.codec, pkt)
+		if diff := got - tt.want; diff < -tt.want/20 || diff > tt.want/20 {
+			t.Errorf("port %d: expected mix-minus near %d, got %d", tt.port, tt.want, got)
+		}
+		if pkt.PayloadType != tt.codec.PayloadType {
+			t.Errorf("port %d: expected PT %d, got %d", tt.port, tt.codec.PayloadType, pkt.PayloadType)
+		}
+	}
+}
+
+func TestConference_MuteGainAndSpeaking(t *testing.T) {
+	manager, registry, capture := newTestConference(t, 0)
+	pcmu := CodecInfo{PayloadType: 0, Name: "PCMU", ClockRate: 8000, Channels: 1}
+	defer eventBus.Store(eventBus.Load())
+	bus := &EventBus{endpoints: []*webhookEndpoint{{queue: make(chan *Event, 10)}}}
+	eventBus.Store(bus)
+
+	loud := addConferenceCall(t, manager, registry, "conf-loud", 6000, pcmu, 10)
+	quiet := addConferenceCall(t, manager, registry, "conf-quiet", 6002, pcmu, 11)
+	pLoud, _ := manager.Join("room", loud, true, ConferenceParticipantOptions{Gain: 2})
+	pQuiet, _ := manager.Join("room", quiet, true, ConferenceParticipantOptions{})
+	room, _ := manager.GetRoom("room")
+	pauseMixer(room)
+
+	sendTone(manager, pcmu, 10, 2000)
+	sendTone(manager, pcmu, 11, 10)
+	room.mixFrame(time.Now())
+
+	if got := decodedLevel(t, pcmu, capture.last(6002)); got < 3800 || got > 4200 {
+		t.Errorf("expected gain 2 to double the loud leg to ~4000, got %d", got)
+	}
+	info := room.Info()
+	if info.ActiveSpeaker != pLoud.ID {
+		t.Errorf("expected active speaker %s, got %s", pLoud.ID, info.ActiveSpeaker)
+	}
+	if !pLoud.Info().Speaking || pQuiet.Info().Speaking {
+		t.Error("expected only the loud participant to be speaking")
+	}
+	select {
+	case event := <-bus.endpoints[0].queue:
+		if event.Type != EventActiveSpeaker || event.CallID != "conf-loud" || event.Data["conference"] != "room" ||
+			event.Data["participant_id"] != pLoud.ID || event.Data["leg"] != "caller" {
+			t.Errorf("unexpected event %+v", event)
+		}
+	default:
+		t.Error("no active-speaker event published")
+	}
+
+	muted := true
+	if err := manager.UpdateParticipant("room", pLoud.ID, nil, &muted); err != nil {
+		t.Fatalf("UpdateParticipant failed: %v", err)
+	}
+	sendTone(manager, pcmu, 10, 2000)
+	sendTone(manager, pcmu, 11, 10)
+	room.mixFrame(time.Now())
+
+	// G.711 mu-law decodes digital silence to a small bias, not zero
+	if got := decodedLevel(t, pcmu, capture.last(6002)); got > 200 {
+		t.Errorf("expected muted participant to be silent, got %d", got)
+	}
+	if pLoud.Info().Speaking {
+		t.Error("expected muted participant not to be speaking")
+	}
+}
+
+func TestConference_Membership(t *testing.T) {
+	manager, registry, _ := newTestConference(t, 1)
+	pcmu := CodecInfo{PayloadType: 0, Name: "PCMU", ClockRate: 8000, Channels: 1}
+
+	first := addConferenceCall(t, manager, registry, "conf-1", 7000, pcmu, 20)
+	second := addConferenceCall(t, manager, registry, "conf-2", 7002, pcmu, 21)
+
+	p, err := manager.Join("room", first, true, ConferenceParticipantOptions{})
+	if err != nil {
+		t.Fatalf("Join failed: %v", err)
+	}
+	if _, err := manager.Join("other", first, true, ConferenceParticipantOptions{}); !errors.Is(err, ErrParticipantAlreadyJoined) {
+		t.Errorf("expected ErrParticipantAlreadyJoined, got %v", err)
+	}
+	if _, err := manager.Join("room", second, true, ConferenceParticipantOptions{}); !errors.Is(err, ErrConferenceFull) {
+		t.Errorf("expected ErrConferenceFull, got %v", err)
+	}
+	if _, err := manager.Join("room", second, false, ConferenceParticipantOptions{}); err == nil {
+		t.Error("expected joining a leg without media to fail")
+	}
+	if _, err := manager.CreateRoom("room"); !errors.Is(err, ErrConferenceExists) {
+		t.Errorf("expected ErrConferenceExists, got %v", err)
+	}
+
+	manager.RemoveCall("conf-1")
+	room, _ := manager.GetRoom("room")
+	if _, ok := room.GetParticipant(p.ID); ok {
+		t.Error("expected hangup to remove the participant")
+	}
+	if _, err := manager.Join("room", second, true, ConferenceParticipantOptions{}); err != nil {
+		t.Errorf("expected room to have space after hangup, got %v", err)
+	}
+
+	if err := manager.DeleteRoom("room"); err != nil {
+		t.Fatalf("DeleteRoom failed: %v", err)
+	}
+	if err := manager.Leave("room", p.ID); !errors.Is(err, ErrConferenceNotFound) {
+		t.Errorf("expected ErrConferenceNotFound, got %v", err)
+	}
+	if len(manager.ListRooms()) != 0 {
+		t.Errorf("expected no rooms to remain, got %d", len(manager.ListRooms()))
+	}
+}
+
+func TestConference_LimiterAndResample(t *testing.T) {
+	if got := limitSample(1000); got != 1000 {
+		t.Errorf("expected samples below the knee unchanged, got %d", got)
+	}
+	prev := limitSample(conferenceLimiterKnee)
+	for _, v := range []int32{30000, 60000, 200000} {
+		got := limitSample(v)
+		if got <= prev || got > pcmMaxAmplitude {
+			t.Errorf("limitSample(%d) = %d, expected monotonic and below full scale", v, got)
+		}
+		if limitSample(-v) != -got {
+			t.Errorf("expected limiter to be symmetric at %d", v)
+		}
+		prev = got
+	}
+
+	if got := len(resamplePCM(make([]int16, 160), 8000, 48000)); got != 960 {
+		t.Errorf("expected 960 samples after upsampling, got %d", got)
+	}
+	if got := len(resamplePCM(make([]int16, 960), 48000, 8000)); got != 160 {
+		t.Errorf("expected 160 samples after downsampling, got %d", got)
+	}
+}
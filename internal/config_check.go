@@ -0,0 +1,237 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CheckConfigFile loads a configuration file as the server would, without
+// starting anything, and reports every problem found: settings the server
+// would ignore, validation failures, listeners sharing a port and missing
+// certificate files
+func CheckConfigFile(filePath string) *ValidationResult {
+	result := &ValidationResult{Valid: true}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		result.AddError("file", filePath, err.Error())
+		return result
+	}
+
+	tree, err := decodeConfigTree(filePath, data)
+	if err != nil {
+		result.AddError("file", filePath, fmt.Sprintf("failed to parse: %v", err))
+		return result
+	}
+	for _, key := range unknownConfigKeys(tree, reflect.TypeOf(Config{}), "") {
+		result.AddWarning(fmt.Sprintf("unknown setting %s is ignored", key))
+	}
+
+	var cfg Config
+	if err := decodeConfig(filePath, data, &cfg); err != nil {
+		result.AddError("file", filePath, fmt.Sprintf("failed to parse: %v", err))
+		return result
+	}
+	if err := ApplyEnvironmentPathOverrides(&cfg); err != nil {
+		result.AddError("environment", nil, err.Error())
+	}
+	ApplyEnvironmentOverrides(&cfg)
+
+	// Secret references are checked for syntax only, the check does not
+	// reach out to Vault
+	if err := ValidateConfigSecrets(&cfg); err != nil {
+		result.AddError("secrets", nil, err.Error())
+	}
+
+	if err := ValidateConfig(&cfg); err != nil {
+		result.AddError("config", nil, err.Error())
+	}
+	checkPortConflicts(&cfg, result)
+	checkCertFiles(&cfg, result)
+
+	if cfg.Integration.PublicIP == "" {
+		result.AddWarning("integration.public_ip is empty and will be detected at startup")
+	}
+	return result
+}
+
+// unknownConfigKeys returns the paths of the settings in tree that have no
+// field in t, sorted
+func unknownConfigKeys(tree map[string]interface{}, t reflect.Type, prefix string) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	var unknown []string
+	for key, value := range tree {
+		path := prefix + key
+		field, ok := fieldTypeByJSONName(t, key)
+		if !ok {
+			unknown = append(unknown, path)
+			continue
+		}
+		unknown = append(unknown, unknownInValue(value, field, path)...)
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// unknownInValue looks for unknown settings inside a section, a map of
+// sections or a list of sections
+func unknownInValue(value interface{}, t reflect.Type, path string) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	var unknown []string
+	switch v := value.(type) {
+	case map[string]interface{}:
+		switch {
+		case t.Kind() == reflect.Struct && t != reflect.TypeOf(time.Time{}):
+			unknown = unknownConfigKeys(v, t, path+".")
+		case t.Kind() == reflect.Map:
+			for key, item := range v {
+				unknown = append(unknown, unknownInValue(item, t.Elem(), path+"."+key)...)
+			}
+		}
+	case []interface{}:
+		if t.Kind() == reflect.Slice {
+			for i, item := range v {
+				unknown = append(unknown, unknownInValue(item, t.Elem(), path+"["+strconv.Itoa(i)+"]")...)
+			}
+		}
+	}
+	return unknown
+}
+
+// fieldTypeByJSONName returns the type of the struct field with the given
+// json name
+func fieldTypeByJSONName(t reflect.Type, name string) (reflect.Type, bool) {
+	if t.Kind() != reflect.Struct {
+		return nil, false
+	}
+	for i := 0; i < t.NumField(); i++ {
+		tag, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if tag == name && tag != "-" {
+			return t.Field(i).Type, true
+		}
+	}
+	return nil, false
+}
+
+// configListener is a port the server listens on
+type configListener struct {
+	setting string
+	network string
+	host    string
+	port    int
+}
+
+// checkPortConflicts reports listeners that would share a port, and UDP
+// listeners inside the RTP port range
+func checkPortConflicts(cfg *Config, result *ValidationResult) {
+	var listeners []configListener
+	add := func(setting, network string, port int) {
+		if port > 0 {
+			listeners = append(listeners, configListener{setting: setting, network: network, port: port})
+		}
+	}
+	addAddress := func(setting, network, address string) {
+		host, portStr, err := net.SplitHostPort(address)
+		if err != nil {
+			result.AddError(setting, address, "invalid listen address")
+			return
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			result.AddError(setting, address, "invalid listen port")
+			return
+		}
+		listeners = append(listeners, configListener{setting: setting, network: network, host: host, port: port})
+	}
+
+	if cfg.Transport.UDPEnabled {
+		add("transport.udp_port", "udp", cfg.Transport.UDPPort)
+	}
+	if cfg.Transport.TCPEnabled {
+		add("transport.tcp_port", "tcp", cfg.Transport.TCPPort)
+	}
+	if cfg.Transport.TLSEnabled {
+		add("transport.tls_port", "tcp", cfg.Transport.TLSPort)
+	}
+	if ng := cfg.GetNGProtocolConfig(); ng.Enabled {
+		add("ng_protocol.udp_port", "udp", ng.UDPPort)
+	}
+	if cfg.WebRTC.Enabled {
+		add("webrtc.webrtc_port", "tcp", cfg.WebRTC.WebRTCPort)
+	}
+	if cfg.API != nil && cfg.API.Enabled {
+		address := cfg.API.Address
+		if address == "" {
+			address = ":8080"
+		}
+		addAddress("api.address", "tcp", address)
+	}
+	if cfg.GRPC != nil && cfg.GRPC.Enabled {
+		address := cfg.GRPC.Address
+		if address == "" {
+			address = ":9090"
+		}
+		addAddress("grpc.address", "tcp", address)
+	}
+	addAddress("health (KARL_HEALTH_PORT)", "tcp", GetHealthPort())
+	addAddress("metrics (KARL_METRICS_PORT)", "tcp", GetMetricsPort())
+
+	for i, a := range listeners {
+		for _, b := range listeners[i+1:] {
+			if a.network == b.network && a.port == b.port && (a.host == "" || b.host == "" || a.host == b.host) {
+				result.AddError(b.setting, b.port, fmt.Sprintf("%s port already used by %s", strings.ToUpper(a.network), a.setting))
+			}
+		}
+	}
+
+	sessions := cfg.GetSessionConfig()
+	for _, l := range listeners {
+		if l.network == "udp" && l.port >= sessions.MinPort && l.port <= sessions.MaxPort {
+			result.AddError(l.setting, l.port, fmt.Sprintf("inside the RTP port range %d-%d", sessions.MinPort, sessions.MaxPort))
+		}
+	}
+}
+
+// checkCertFiles reports certificate and key files of enabled TLS listeners
+// that do not exist
+func checkCertFiles(cfg *Config, result *ValidationResult) {
+	check := func(setting, path string) {
+		if path == "" {
+			return
+		}
+		if _, err := os.Stat(path); err != nil {
+			result.AddError(setting, path, "file not found")
+		}
+	}
+
+	if cfg.API != nil && cfg.API.Enabled && cfg.API.TLSEnabled {
+		check("api.tls_cert", cfg.API.TLSCert)
+		check("api.tls_key", cfg.API.TLSKey)
+	}
+	if cfg.GRPC != nil && cfg.GRPC.Enabled && cfg.GRPC.TLSEnabled {
+		check("grpc.tls_cert", cfg.GRPC.TLSCert)
+		check("grpc.tls_key", cfg.GRPC.TLSKey)
+	}
+	checkEndpoint := func(name string, endpoint *EndpointTLSConfig) {
+		if endpoint == nil || !endpoint.Enabled {
+			return
+		}
+		check(name+".cert_file", endpoint.CertFile)
+		check(name+".key_file", endpoint.KeyFile)
+		check(name+".client_ca", endpoint.ClientCA)
+	}
+	checkEndpoint("metrics_tls", cfg.MetricsTLS)
+	checkEndpoint("health_tls", cfg.HealthTLS)
+}
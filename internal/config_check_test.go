@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckConfigFile(t *testing.T) {
+	t.Setenv("KARL_HEALTH_PORT", ":18086")
+	t.Setenv("KARL_METRICS_PORT", ":19091")
+	dir := t.TempDir()
+
+	valid := filepath.Join(dir, "valid.yaml")
+	os.WriteFile(valid, []byte(`
+rtp_settings: {min_jitter_buffer: 20, max_bandwidth: 1000}
+integration: {media_ip: 127.0.0.1, public_ip: 127.0.0.1}
+ng_protocol: {enabled: true, udp_port: 22222}
+`), 0644)
+	if result := CheckConfigFile(valid); !result.Valid || len(result.Warnings) != 0 {
+		t.Errorf("expected a clean file to pass, got %+v", result)
+	}
+
+	broken := filepath.Join(dir, "broken.json")
+	os.WriteFile(broken, []byte(`{
+  "rtp_settings": {"min_jitter_buffer": 20, "max_bandwidth": 1000, "max_jitter": 5},
+  "integration": {"media_ip": "127.0.0.1", "public_ip": "127.0.0.1"},
+  "ng_protocol": {"enabled": true, "udp_port": 31000},
+  "sessions": {"min_port": 30000, "max_port": 40000},
+  "api": {"enabled": true, "address": ":9090"},
+  "grpc": {"enabled": true, "tls_enabled": true, "tls_cert": "/nonexistent/grpc.pem", "tls_key": "/nonexistent/grpc.key"},
+  "tracing": {"enabled": true}
+}`), 0644)
+	result := CheckConfigFile(broken)
+	if result.Valid {
+		t.Fatal("expected the broken file to fail")
+	}
+
+	var problems []string
+	for _, e := range result.Errors {
+		problems = append(problems, e.Field+": "+e.Message)
+	}
+	problems = append(problems, result.Warnings...)
+	report := strings.Join(problems, "\n")
+	for _, want := range []string{
+		"ng_protocol.udp_port: inside the RTP port range 30000-40000",
+		"grpc.address: TCP port already used by api.address",
+		"grpc.tls_cert: file not found",
+		"grpc.tls_key: file not found",
+		"unknown setting rtp_settings.max_jitter is ignored",
+		"unknown setting tracing is ignored",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("expected %q in the report:\n%s", want, report)
+		}
+	}
+
+	if result := CheckConfigFile(filepath.Join(dir, "missing.toml")); result.Valid {
+		t.Error("expected a missing file to fail")
+	}
+	os.WriteFile(filepath.Join(dir, "bad.toml"), []byte("[transport\n"), 0644)
+	if result := CheckConfigFile(filepath.Join(dir, "bad.toml")); result.Valid {
+		t.Error("expected a TOML syntax error to fail")
+	}
+}
@@ -0,0 +1,204 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// configEnvPrefix starts the environment variables that set any config
+// setting by its path, with sections separated by a double underscore:
+// KARL_NG_PROTOCOL__UDP_PORT sets ng_protocol.udp_port
+const (
+	configEnvPrefix    = "KARL_"
+	configEnvSeparator = "__"
+)
+
+// defaultConfigPaths are tried in order when no config path is given
+var defaultConfigPaths = []string{
+	"config/config.json",
+	"config/config.yaml",
+	"config/config.yml",
+	"config/config.toml",
+}
+
+// decodeConfig parses a config file in the format given by its extension:
+// .yaml/.yml, .toml, or JSON for anything else. YAML and TOML use the same
+// setting names as JSON.
+func decodeConfig(filePath string, data []byte, cfg *Config) error {
+	if !isYAMLOrTOML(filePath) {
+		return json.Unmarshal(data, cfg)
+	}
+	tree, err := decodeConfigTree(filePath, data)
+	if err != nil {
+		return err
+	}
+	data, err = json.Marshal(tree)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, cfg)
+}
+
+func isYAMLOrTOML(filePath string) bool {
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".yaml", ".yml", ".toml":
+		return true
+	}
+	return false
+}
+
+// decodeConfigTree parses a config file into maps, for checks that need the
+// settings as written rather than as decoded
+func decodeConfigTree(filePath string, data []byte) (map[string]interface{}, error) {
+	var tree map[string]interface{}
+	var err error
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &tree)
+	case ".toml":
+		err = toml.Unmarshal(data, &tree)
+	default:
+		err = json.Unmarshal(data, &tree)
+	}
+	return tree, err
+}
+
+// ApplyEnvironmentPathOverrides sets the settings named by KARL_<SECTION>__<SETTING>
+// environment variables. A section missing from the file starts from its
+// defaults. Lists of strings are comma separated; other lists and objects
+// are given as JSON.
+func ApplyEnvironmentPathOverrides(cfg *Config) error {
+	env := os.Environ()
+	sort.Strings(env)
+	for _, kv := range env {
+		name, value, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(name, configEnvPrefix) || !strings.Contains(name, configEnvSeparator) {
+			continue
+		}
+		path := strings.Split(strings.ToLower(strings.TrimPrefix(name, configEnvPrefix)), configEnvSeparator)
+		if err := setConfigPath(cfg, path, value); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		log.Printf("Config setting %s overridden by %s", strings.Join(path, "."), name)
+	}
+	return nil
+}
+
+// setConfigPath sets the setting at a path of json names
+func setConfigPath(cfg *Config, path []string, value string) error {
+	v := reflect.ValueOf(cfg).Elem()
+	for i, name := range path {
+		field, ok := fieldByJSONName(v, name)
+		if !ok {
+			return fmt.Errorf("unknown setting %s", strings.Join(path[:i+1], "."))
+		}
+		if field.Kind() == reflect.Ptr && field.IsNil() && i < len(path)-1 {
+			field.Set(sectionDefaults(cfg, field.Type()))
+		}
+		if i == len(path)-1 {
+			return setConfigValue(field, value)
+		}
+		if field.Kind() == reflect.Ptr {
+			field = field.Elem()
+		}
+		if field.Kind() != reflect.Struct {
+			return fmt.Errorf("%s is not a section", strings.Join(path[:i+1], "."))
+		}
+		v = field
+	}
+	return nil
+}
+
+// fieldByJSONName returns the field of a struct with the given json name
+func fieldByJSONName(v reflect.Value, name string) (reflect.Value, bool) {
+	if v.Kind() != reflect.Struct {
+		return reflect.Value{}, false
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if tag == name && tag != "-" {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// sectionDefaults returns the defaults of a section from the Config getter
+// returning its type, or an empty section when it has none
+func sectionDefaults(cfg *Config, t reflect.Type) reflect.Value {
+	cv := reflect.ValueOf(cfg)
+	for i := 0; i < cv.NumMethod(); i++ {
+		m := cv.Method(i)
+		if m.Type().NumIn() == 0 && m.Type().NumOut() == 1 && m.Type().Out(0) == t {
+			return m.Call(nil)[0]
+		}
+	}
+	return reflect.New(t.Elem())
+}
+
+// setConfigValue parses an environment value into a setting
+func setConfigValue(field reflect.Value, value string) error {
+	if field.Kind() == reflect.Ptr {
+		if field.IsNil() {
+			field.Set(reflect.New(field.Type().Elem()))
+		}
+		field = field.Elem()
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid bool %q", value)
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		field.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		field.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+		field.SetFloat(f)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(value), "[") {
+			items := []string{}
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			field.Set(reflect.ValueOf(items).Convert(field.Type()))
+			return nil
+		}
+		fallthrough
+	default:
+		if err := json.Unmarshal([]byte(value), field.Addr().Interface()); err != nil {
+			return fmt.Errorf("invalid value %q: %w", value, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodeConfig_Formats(t *testing.T) {
+	files := map[string]string{
+		"config.json": `{
+  "transport": {"udp_enabled": true, "udp_port": 5060},
+  "ng_protocol": {"enabled": true, "udp_port": 22222, "allowed_uids": [0, 997]},
+  "media_acl": {"allow": ["10.0.0.0/8"], "rate_limit": 500}
+}`,
+		"config.yaml": `
+transport:
+  udp_enabled: true
+  udp_port: 5060
+ng_protocol:
+  enabled: true
+  udp_port: 22222
+  allowed_uids: [0, 997]
+media_acl:
+  allow:
+    - 10.0.0.0/8
+  rate_limit: 500
+`,
+		"config.toml": `
+[transport]
+udp_enabled = true
+udp_port = 5060
+
+[ng_protocol]
+enabled = true
+udp_port = 22222
+allowed_uids = [0, 997]
+
+[media_acl]
+allow = ["10.0.0.0/8"]
+rate_limit = 500
+`,
+	}
+
+	var want Config
+	if err := decodeConfig("config.json", []byte(files["config.json"]), &want); err != nil {
+		t.Fatalf("failed to decode JSON: %v", err)
+	}
+	for name, data := range files {
+		var got Config
+		if err := decodeConfig(name, []byte(data), &got); err != nil {
+			t.Errorf("failed to decode %s: %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s decoded to %+v, want %+v", name, got, want)
+		}
+	}
+
+	var cfg Config
+	if err := decodeConfig("config.yaml", []byte("transport: [not, a, section]"), &cfg); err == nil {
+		t.Error("expected a mistyped YAML section to be rejected")
+	}
+}
+
+func TestApplyEnvironmentPathOverrides(t *testing.T) {
+	t.Setenv("KARL_TRANSPORT__UDP_PORT", "5080")
+	t.Setenv("KARL_NG_PROTOCOL__SOCKET_MODE", "0660")
+	t.Setenv("KARL_NG_PROTOCOL__ALLOWED_UIDS", "[0, 997]")
+	t.Setenv("KARL_MEDIA_ACL__DENY", "192.0.2.0/24, 198.51.100.7")
+	t.Setenv("KARL_RTP_SETTINGS__MAX_BANDWIDTH", "2000")
+
+	cfg := &Config{}
+	if err := ApplyEnvironmentPathOverrides(cfg); err != nil {
+		t.Fatalf("ApplyEnvironmentPathOverrides failed: %v", err)
+	}
+
+	if cfg.Transport.UDPPort != 5080 || cfg.RTPSettings.MaxBandwidth != 2000 {
+		t.Errorf("expected the scalar overrides, got %+v %+v", cfg.Transport, cfg.RTPSettings)
+	}
+	// A section missing from the file starts from its defaults
+	if cfg.NGProtocol == nil || !cfg.NGProtocol.Enabled || cfg.NGProtocol.SocketPath == "" {
+		t.Errorf("expected ng_protocol defaults under the override, got %+v", cfg.NGProtocol)
+	}
+	if cfg.NGProtocol.SocketMode != "0660" || !reflect.DeepEqual(cfg.NGProtocol.AllowedUIDs, []int{0, 997}) {
+		t.Errorf("expected the ng_protocol overrides, got %+v", cfg.NGProtocol)
+	}
+	if !reflect.DeepEqual(cfg.MediaACL.Deny, []string{"192.0.2.0/24", "198.51.100.7"}) {
+		t.Errorf("expected a comma separated list, got %v", cfg.MediaACL.Deny)
+	}
+
+	for name, value := range map[string]string{
+		"KARL_TRANSPORT__NO_SUCH_SETTING":  "1",
+		"KARL_TRANSPORT__UDP_PORT":         "not-a-port",
+		"KARL_TRANSPORT__UDP_PORT__NESTED": "1",
+		"KARL_NG_PROTOCOL__ALLOWED_UIDS":   "[root]",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if err := ApplyEnvironmentPathOverrides(&Config{}); err == nil {
+				t.Errorf("expected %s=%s to be rejected", name, value)
+			}
+		})
+	}
+}
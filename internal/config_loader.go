@@ -1,7 +1,7 @@
 package internal
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"io"
 	"log"
@@ -18,7 +18,8 @@ var (
 	configMutex sync.RWMutex
 )
 
-// LoadConfig reads and validates the configuration
+// LoadConfig reads the configuration from a JSON, YAML or TOML file, applies
+// the environment overrides and validates the result
 func LoadConfig(filePath string) (*Config, error) {
 	data, err := os.ReadFile(filePath)
 	if err != nil {
@@ -26,7 +27,7 @@ func LoadConfig(filePath string) (*Config, error) {
 	}
 
 	var newConfig Config
-	if err := json.Unmarshal(data, &newConfig); err != nil {
+	if err := decodeConfig(filePath, data, &newConfig); err != nil {
 		return nil, fmt.Errorf("failed to parse config: %w", err)
 	}
 
@@ -35,13 +36,22 @@ func LoadConfig(filePath string) (*Config, error) {
 		newConfig.Version = ConfigVersion
 	}
 
+	// Environment variables override the file: KARL_<SECTION>__<SETTING>
+	// first, then the named shortcuts such as KARL_NG_PORT
+	if err := ApplyEnvironmentPathOverrides(&newConfig); err != nil {
+		return nil, fmt.Errorf("invalid environment override: %w", err)
+	}
+	ApplyEnvironmentOverrides(&newConfig)
+
+	// Secret settings may reference env:, file: or vault: values
+	if err := ResolveConfigSecrets(context.Background(), &newConfig); err != nil {
+		return nil, fmt.Errorf("failed to resolve secrets: %w", err)
+	}
+
 	if err := ValidateConfig(&newConfig); err != nil {
 		return nil, fmt.Errorf("invalid configuration: %w", err)
 	}
 
-	// Apply environment variable overrides
-	ApplyEnvironmentOverrides(&newConfig)
-
 	if newConfig.Integration.PublicIP == "" {
 		detectedIP, err := GetPublicIP()
 		if err != nil {
@@ -72,6 +82,36 @@ func ValidateConfig(cfg *Config) error {
 		return fmt.Errorf("invalid UDP port: %d", cfg.Transport.UDPPort)
 	}
 
+	if cfg.Transport.BatchSize < 0 || cfg.Transport.BatchSize > maxBatchSize {
+		return fmt.Errorf("invalid UDP batch size: %d", cfg.Transport.BatchSize)
+	}
+
+	if cfg.Transport.ReusePortShards < 0 {
+		return fmt.Errorf("invalid SO_REUSEPORT shard count: %d", cfg.Transport.ReusePortShards)
+	}
+
+	if cfg.Transport.Workers < 0 || cfg.Transport.Workers > maxWorkerPoolSize {
+		return fmt.Errorf("invalid worker count: %d", cfg.Transport.Workers)
+	}
+
+	if cfg.Transport.WorkerQueueSize < 0 || cfg.Transport.WorkerQueueSize > maxWorkerQueueSize {
+		return fmt.Errorf("invalid worker queue size: %d", cfg.Transport.WorkerQueueSize)
+	}
+
+	if _, err := ParseQueueDropPolicy(cfg.Transport.WorkerQueuePolicy); err != nil {
+		return err
+	}
+
+	if err := ValidateMTU(cfg); err != nil {
+		return err
+	}
+
+	if cfg.Logging != nil {
+		if err := ValidateLoggingConfig(cfg.Logging); err != nil {
+			return err
+		}
+	}
+
 	if cfg.Transport.TLSEnabled {
 		if _, err := os.Stat(cfg.Transport.TLSCert); err != nil {
 			return fmt.Errorf("TLS cert file not found: %s", cfg.Transport.TLSCert)
@@ -89,54 +129,142 @@ func ValidateConfig(cfg *Config) error {
 		return fmt.Errorf("invalid bandwidth: %d", cfg.RTPSettings.MaxBandwidth)
 	}
 
+	if cfg.RTPSettings.PLIInterval < 0 {
+		return fmt.Errorf("invalid PLI interval: %d", cfg.RTPSettings.PLIInterval)
+	}
+
 	if cfg.WebRTC.Enabled {
 		// Skip strict STUN server validation for now
 		// STUN servers are specified as URIs, not raw IP:port
 		log.Println("WebRTC enabled with STUN servers:", cfg.WebRTC.StunServers)
 	}
 
+	if err := ValidateAlertSettings(cfg); err != nil {
+		return err
+	}
+
 	if cfg.Database.RedisEnabled && cfg.Database.RedisAddr == "" {
 		return fmt.Errorf("Redis enabled but address not specified")
 	}
 
-	return nil
-}
+	if cfg.NGProtocol != nil {
+		if err := ValidateNGProtocolConfig(cfg.NGProtocol); err != nil {
+			return err
+		}
+	}
 
-// WatchConfig monitors for configuration changes
-func WatchConfig(filePath string) error {
-	lastMod := time.Now()
+	if cfg.HA != nil && cfg.HA.Enabled {
+		if err := ValidateHAConfig(cfg); err != nil {
+			return err
+		}
+	}
 
-	for {
-		time.Sleep(5 * time.Second)
+	if cfg.Dispatch != nil && cfg.Dispatch.Enabled {
+		if err := ValidateDispatchConfig(cfg); err != nil {
+			return err
+		}
+	}
 
-		info, err := os.Stat(filePath)
-		if err != nil {
-			log.Printf("❌ Error checking config file: %v", err)
-			continue
+	if cfg.MediaACL != nil {
+		if err := ValidateMediaACLConfig(cfg); err != nil {
+			return err
 		}
+	}
 
-		if info.ModTime().After(lastMod) {
-			log.Println("📝 Configuration file changed, reloading...")
+	if len(cfg.Transport.Interfaces) > 0 {
+		if err := ValidateTransportInterfaces(cfg); err != nil {
+			return err
+		}
+	}
 
-			newConfig, err := LoadConfig(filePath)
-			if err != nil {
-				log.Printf("❌ Failed to reload config: %v", err)
-				continue
-			}
+	if cfg.QoS != nil {
+		if err := ValidateQoSConfig(cfg); err != nil {
+			return err
+		}
+	}
+	if cfg.Impairment != nil {
+		if err := ValidateImpairmentConfig(cfg); err != nil {
+			return err
+		}
+	}
+	if cfg.MusicOnHold != nil {
+		if err := ValidateMusicOnHoldConfig(cfg); err != nil {
+			return err
+		}
+	}
+	if cfg.VideoTranscode != nil {
+		if err := ValidateVideoTranscodeConfig(cfg); err != nil {
+			return err
+		}
+	}
+	if cfg.HardwareAccel != nil {
+		if err := ValidateHardwareAccelConfig(cfg); err != nil {
+			return err
+		}
+	}
+	if cfg.Webhooks != nil {
+		if err := ValidateWebhooksConfig(cfg); err != nil {
+			return err
+		}
+	}
+	if cfg.EventStreaming != nil {
+		if err := ValidateEventStreamingConfig(cfg); err != nil {
+			return err
+		}
+	}
+	if cfg.ObjectStorage != nil {
+		if err := ValidateObjectStorageConfig(cfg); err != nil {
+			return err
+		}
+	}
+	if cfg.Transcription != nil {
+		if err := ValidateTranscriptionConfig(cfg); err != nil {
+			return err
+		}
+	}
+	if cfg.Metrics != nil {
+		if err := ValidateMetricsConfig(cfg); err != nil {
+			return err
+		}
+	}
+	if cfg.Debug != nil {
+		if err := ValidateDebugConfig(cfg); err != nil {
+			return err
+		}
+	}
+	if cfg.Sessions != nil {
+		if err := ValidateSessionPorts(cfg); err != nil {
+			return err
+		}
+		if err := ValidateAdmissionConfig(cfg); err != nil {
+			return err
+		}
+	}
+	if cfg.Tenants != nil {
+		if err := ValidateTenantsConfig(cfg); err != nil {
+			return err
+		}
+	}
 
-			configMutex.Lock()
-			config = newConfig
-			configMutex.Unlock()
+	if cfg.MetricsTLS != nil && cfg.MetricsTLS.Enabled {
+		if err := ValidateEndpointTLSConfig("metrics", cfg.MetricsTLS); err != nil {
+			return err
+		}
+	}
 
-			if err := ApplyNewConfig(*newConfig); err != nil {
-				log.Printf("❌ Failed to apply new config: %v", err)
-				continue
-			}
+	if cfg.HealthTLS != nil && cfg.HealthTLS.Enabled {
+		if err := ValidateEndpointTLSConfig("health", cfg.HealthTLS); err != nil {
+			return err
+		}
+	}
 
-			lastMod = info.ModTime()
-			log.Println("✅ Configuration updated successfully")
+	if cfg.GRPC != nil && cfg.GRPC.Enabled && cfg.GRPC.TLSEnabled {
+		if cfg.GRPC.TLSCert == "" || cfg.GRPC.TLSKey == "" {
+			return fmt.Errorf("gRPC TLS enabled but tls_cert or tls_key not specified")
 		}
 	}
+
+	return nil
 }
 
 // ApplyNewConfig applies the configuration dynamically
@@ -161,6 +289,10 @@ func ApplyNewConfig(newConfig Config) error {
 
 	UpdateAlertThresholds(newConfig.AlertSettings)
 
+	if err := ConfigureLogging(LoggingConfigFromEnv(newConfig.Logging)); err != nil {
+		return fmt.Errorf("failed to update logging settings: %w", err)
+	}
+
 	log.Println("✅ Configuration applied successfully")
 	return nil
 }
@@ -228,29 +360,23 @@ func updateIntegrationSettings(integration IntegrationConfig) error {
 
 	// Re-register with SIP proxies if configured
 	if integration.OpenSIPSIp != "" && integration.OpenSIPSPort > 0 {
-		if err := RegisterWithSIPProxy(integration.OpenSIPSIp, integration.OpenSIPSPort); err != nil {
+		if err := PingSIPProxy(context.Background(), integration.SIPKeepaliveSettings(integration.OpenSIPSIp, integration.OpenSIPSPort)); err != nil {
 			log.Printf("Failed to register with OpenSIPS at %s:%d: %v",
 				integration.OpenSIPSIp, integration.OpenSIPSPort, err)
 		} else {
-			log.Printf("Registered with OpenSIPS at %s:%d", integration.OpenSIPSIp, integration.OpenSIPSPort)
+			log.Printf("OpenSIPS at %s:%d answers OPTIONS", integration.OpenSIPSIp, integration.OpenSIPSPort)
 		}
 	}
 
 	if integration.KamailioIp != "" && integration.KamailioPort > 0 {
-		if err := RegisterWithSIPProxy(integration.KamailioIp, integration.KamailioPort); err != nil {
+		if err := PingSIPProxy(context.Background(), integration.SIPKeepaliveSettings(integration.KamailioIp, integration.KamailioPort)); err != nil {
 			log.Printf("Failed to register with Kamailio at %s:%d: %v",
 				integration.KamailioIp, integration.KamailioPort, err)
 		} else {
-			log.Printf("Registered with Kamailio at %s:%d", integration.KamailioIp, integration.KamailioPort)
+			log.Printf("Kamailio at %s:%d answers OPTIONS", integration.KamailioIp, integration.KamailioPort)
 		}
 	}
 
-	// Log failover configuration
-	if integration.FailoverEnabled && integration.BackupMediaIP != "" {
-		log.Printf("Failover configured: primary %s, backup %s",
-			integration.MediaIP, integration.BackupMediaIP)
-	}
-
 	return nil
 }
 
@@ -304,6 +430,7 @@ func ApplyEnvironmentOverrides(cfg *Config) {
 	// NG Protocol settings
 	if port := os.Getenv("KARL_NG_PORT"); port != "" {
 		if p, err := strconv.Atoi(port); err == nil {
+			cfg.NGProtocol = cfg.GetNGProtocolConfig()
 			cfg.NGProtocol.UDPPort = p
 			log.Printf("NG Protocol port overridden by KARL_NG_PORT: %d", p)
 		}
@@ -312,34 +439,93 @@ func ApplyEnvironmentOverrides(cfg *Config) {
 	// Session settings
 	if minPort := os.Getenv("KARL_RTP_MIN_PORT"); minPort != "" {
 		if p, err := strconv.Atoi(minPort); err == nil {
+			cfg.Sessions = cfg.GetSessionConfig()
 			cfg.Sessions.MinPort = p
 			log.Printf("RTP min port overridden by KARL_RTP_MIN_PORT: %d", p)
 		}
 	}
 	if maxPort := os.Getenv("KARL_RTP_MAX_PORT"); maxPort != "" {
 		if p, err := strconv.Atoi(maxPort); err == nil {
+			cfg.Sessions = cfg.GetSessionConfig()
 			cfg.Sessions.MaxPort = p
 			log.Printf("RTP max port overridden by KARL_RTP_MAX_PORT: %d", p)
 		}
 	}
 	if maxSessions := os.Getenv("KARL_MAX_SESSIONS"); maxSessions != "" {
 		if s, err := strconv.Atoi(maxSessions); err == nil {
+			cfg.Sessions = cfg.GetSessionConfig()
 			cfg.Sessions.MaxSessions = s
 			log.Printf("Max sessions overridden by KARL_MAX_SESSIONS: %d", s)
 		}
 	}
+	if mediaTimeout := os.Getenv("KARL_MEDIA_TIMEOUT"); mediaTimeout != "" {
+		if s, err := strconv.Atoi(mediaTimeout); err == nil {
+			cfg.Sessions = cfg.GetSessionConfig()
+			cfg.Sessions.MediaTimeout = s
+			log.Printf("Media timeout overridden by KARL_MEDIA_TIMEOUT: %ds", s)
+		}
+	}
+
+	// SRTP settings
+	if rekeyInterval := os.Getenv("KARL_SRTP_REKEY_INTERVAL"); rekeyInterval != "" {
+		if s, err := strconv.Atoi(rekeyInterval); err == nil {
+			cfg.SRTP.RekeyInterval = s
+			log.Printf("SRTP rekey interval overridden by KARL_SRTP_REKEY_INTERVAL: %ds", s)
+		}
+	}
 
 	// Recording settings
 	if recordingPath := os.Getenv("KARL_RECORDING_PATH"); recordingPath != "" {
+		cfg.Recording = cfg.GetRecordingConfig()
 		cfg.Recording.BasePath = recordingPath
 		log.Printf("Recording path overridden by KARL_RECORDING_PATH: %s", recordingPath)
 	}
 	if recordingEnabled := os.Getenv("KARL_RECORDING_ENABLED"); recordingEnabled != "" {
+		cfg.Recording = cfg.GetRecordingConfig()
 		cfg.Recording.Enabled = recordingEnabled == "true" || recordingEnabled == "1"
 		log.Printf("Recording enabled overridden by KARL_RECORDING_ENABLED: %v", cfg.Recording.Enabled)
 	}
 
+	// HEP capture settings
+	if hepEnabled := os.Getenv("KARL_HEP_ENABLED"); hepEnabled != "" {
+		cfg.HEP = cfg.GetHEPConfig()
+		cfg.HEP.Enabled = hepEnabled == "true" || hepEnabled == "1"
+		log.Printf("HEP enabled overridden by KARL_HEP_ENABLED: %v", cfg.HEP.Enabled)
+	}
+	if hepAddress := os.Getenv("KARL_HEP_ADDRESS"); hepAddress != "" {
+		cfg.HEP = cfg.GetHEPConfig()
+		cfg.HEP.Address = hepAddress
+		log.Printf("HEP address overridden by KARL_HEP_ADDRESS: %s", hepAddress)
+	}
+
+	// Conference settings
+	if conferenceEnabled := os.Getenv("KARL_CONFERENCE_ENABLED"); conferenceEnabled != "" {
+		cfg.Conference = cfg.GetConferenceConfig()
+		cfg.Conference.Enabled = conferenceEnabled == "true" || conferenceEnabled == "1"
+		log.Printf("Conference enabled overridden by KARL_CONFERENCE_ENABLED: %v", cfg.Conference.Enabled)
+	}
+
+	// DTLS certificate settings
+	if certFile := os.Getenv("KARL_DTLS_CERT_FILE"); certFile != "" {
+		cfg.DTLS = cfg.GetDTLSCertConfig()
+		cfg.DTLS.CertFile = certFile
+		log.Printf("DTLS certificate file overridden by KARL_DTLS_CERT_FILE: %s", certFile)
+	}
+	if keyFile := os.Getenv("KARL_DTLS_KEY_FILE"); keyFile != "" {
+		cfg.DTLS = cfg.GetDTLSCertConfig()
+		cfg.DTLS.KeyFile = keyFile
+		log.Printf("DTLS key file overridden by KARL_DTLS_KEY_FILE: %s", keyFile)
+	}
+
 	// Database settings
+	if dsn := os.Getenv("KARL_DATABASE_DSN"); dsn != "" {
+		cfg.Database.DSN = dsn
+		log.Printf("Database DSN overridden by KARL_DATABASE_DSN")
+	}
+	if sqlitePath := os.Getenv("KARL_SQLITE_PATH"); sqlitePath != "" {
+		cfg.Database.SQLitePath = sqlitePath
+		log.Printf("SQLite path overridden by KARL_SQLITE_PATH: %s", sqlitePath)
+	}
 	if mysqlDSN := os.Getenv("KARL_MYSQL_DSN"); mysqlDSN != "" {
 		cfg.Database.MySQLDSN = mysqlDSN
 		log.Printf("MySQL DSN overridden by KARL_MYSQL_DSN")
@@ -365,10 +551,12 @@ func ApplyEnvironmentOverrides(cfg *Config) {
 
 	// API settings
 	if apiEnabled := os.Getenv("KARL_API_ENABLED"); apiEnabled != "" {
+		cfg.API = cfg.GetAPIConfig()
 		cfg.API.Enabled = apiEnabled == "true" || apiEnabled == "1"
 		log.Printf("API enabled overridden by KARL_API_ENABLED: %v", cfg.API.Enabled)
 	}
 	if apiAuth := os.Getenv("KARL_API_AUTH_ENABLED"); apiAuth != "" {
+		cfg.API = cfg.GetAPIConfig()
 		cfg.API.AuthEnabled = apiAuth == "true" || apiAuth == "1"
 		log.Printf("API auth enabled overridden by KARL_API_AUTH_ENABLED: %v", cfg.API.AuthEnabled)
 	}
@@ -382,10 +570,16 @@ func ApplyEnvironmentOverrides(cfg *Config) {
 	}
 }
 
-// GetConfigPath returns the config file path from environment or default
+// GetConfigPath returns the config file path from environment, or the first
+// of config/config.{json,yaml,yml,toml} that exists
 func GetConfigPath() string {
 	if path := os.Getenv("KARL_CONFIG_PATH"); path != "" {
 		return path
 	}
-	return "config/config.json"
+	for _, path := range defaultConfigPaths {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return defaultConfigPaths[0]
 }
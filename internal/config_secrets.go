@@ -0,0 +1,271 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultVaultTimeout bounds each Vault read made while loading the config
+const defaultVaultTimeout = 10 * time.Second
+
+// VaultSecretProvider reads secrets from a HashiCorp Vault KV engine, v1 or
+// v2. Paths read once are cached for the life of the provider.
+type VaultSecretProvider struct {
+	address   string
+	token     string
+	namespace string
+	client    *http.Client
+
+	mu    sync.Mutex
+	cache map[string]map[string]interface{}
+}
+
+// NewVaultSecretProvider creates a Vault provider from the secrets settings,
+// falling back to VAULT_ADDR, VAULT_TOKEN and VAULT_NAMESPACE
+func NewVaultSecretProvider(config *SecretsConfig) (*VaultSecretProvider, error) {
+	if config == nil {
+		config = &SecretsConfig{}
+	}
+	p := &VaultSecretProvider{
+		address:   strings.TrimSuffix(firstNonEmpty(config.VaultAddress, os.Getenv("VAULT_ADDR")), "/"),
+		token:     firstNonEmpty(config.VaultToken, os.Getenv("VAULT_TOKEN")),
+		namespace: firstNonEmpty(config.VaultNamespace, os.Getenv("VAULT_NAMESPACE")),
+		client:    &http.Client{Timeout: defaultVaultTimeout},
+		cache:     make(map[string]map[string]interface{}),
+	}
+	if config.VaultTimeout > 0 {
+		p.client.Timeout = time.Duration(config.VaultTimeout) * time.Second
+	}
+	if config.VaultTokenFile != "" {
+		data, err := os.ReadFile(config.VaultTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Vault token file: %w", err)
+		}
+		p.token = strings.TrimSpace(string(data))
+	}
+	return p, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// GetSecret reads a field of a Vault secret, given as <path>#<field>
+func (p *VaultSecretProvider) GetSecret(ctx context.Context, key string) (string, error) {
+	path, field, ok := strings.Cut(key, "#")
+	if !ok || path == "" || field == "" {
+		return "", fmt.Errorf("invalid Vault reference %q, expected <path>#<field>", key)
+	}
+	if p.address == "" {
+		return "", fmt.Errorf("Vault address not configured")
+	}
+
+	data, err := p.readPath(ctx, strings.Trim(path, "/"))
+	if err != nil {
+		return "", err
+	}
+	value, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("Vault secret %s has no field %s", path, field)
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprint(value), nil
+}
+
+// readPath returns the data of a secret. A path without /data/ is tried as
+// KV v2, mount/data/rest, before being read as written for KV v1
+func (p *VaultSecretProvider) readPath(ctx context.Context, path string) (map[string]interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if data, ok := p.cache[path]; ok {
+		return data, nil
+	}
+
+	var data map[string]interface{}
+	var err error
+	if mount, rest, ok := strings.Cut(path, "/"); ok && !strings.Contains(path, "/data/") {
+		data, err = p.read(ctx, mount+"/data/"+rest)
+		if err == errVaultNotFound {
+			data, err = p.read(ctx, path)
+		}
+	} else {
+		data, err = p.read(ctx, path)
+	}
+	if err == errVaultNotFound {
+		err = fmt.Errorf("Vault secret %s not found", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.cache[path] = data
+	return data, nil
+}
+
+var errVaultNotFound = errors.New("not found")
+
+// read fetches one Vault path, unwrapping the KV v2 envelope
+func (p *VaultSecretProvider) read(ctx context.Context, path string) (map[string]interface{}, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.address+"/v1/"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if p.token != "" {
+		req.Header.Set("X-Vault-Token", p.token)
+	}
+	if p.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.namespace)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Vault secret %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errVaultNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("failed to read Vault secret %s: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return nil, fmt.Errorf("invalid Vault response for %s: %w", path, err)
+	}
+	if inner, ok := secret.Data["data"].(map[string]interface{}); ok {
+		if _, v2 := secret.Data["metadata"]; v2 {
+			return inner, nil
+		}
+	}
+	return secret.Data, nil
+}
+
+// configSecretTypes are the reference types a secret setting may use
+var configSecretTypes = map[string]bool{"env": true, "file": true, "vault": true}
+
+// configSecretReference parses a secret setting written as a reference:
+// env:NAME, file:/path or vault:<path>#<field>. Other values are literal
+func configSecretReference(value string) (*SecretReference, bool) {
+	typ, key, ok := strings.Cut(value, ":")
+	if !ok || !configSecretTypes[typ] || key == "" {
+		return nil, false
+	}
+	return &SecretReference{Type: typ, Key: key}, true
+}
+
+// forEachSecretSetting calls fn with the path and value of every string
+// setting tagged secret:"true", inside sections, lists and maps
+func forEachSecretSetting(cfg *Config, fn func(path string, v reflect.Value) error) error {
+	return walkSecretSettings(reflect.ValueOf(cfg).Elem(), "", false, fn)
+}
+
+func walkSecretSettings(v reflect.Value, path string, secret bool, fn func(path string, v reflect.Value) error) error {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return walkSecretSettings(v.Elem(), path, secret, fn)
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if !f.IsExported() || name == "" || name == "-" {
+				continue
+			}
+			if path != "" {
+				name = path + "." + name
+			}
+			if err := walkSecretSettings(v.Field(i), name, f.Tag.Get("secret") == "true", fn); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := walkSecretSettings(v.Index(i), fmt.Sprintf("%s[%d]", path, i), secret, fn); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			if err := walkSecretSettings(iter.Value(), path+"."+fmt.Sprint(iter.Key()), secret, fn); err != nil {
+				return err
+			}
+		}
+	case reflect.String:
+		if secret {
+			return fn(path, v)
+		}
+	}
+	return nil
+}
+
+// ResolveConfigSecrets replaces the secret settings written as references
+// with the values they point to. It runs on every load, so rotated secrets
+// are picked up by a reload.
+func ResolveConfigSecrets(ctx context.Context, cfg *Config) error {
+	var vault *VaultSecretProvider
+	return forEachSecretSetting(cfg, func(path string, v reflect.Value) error {
+		ref, ok := configSecretReference(v.String())
+		if !ok {
+			return nil
+		}
+
+		var value string
+		var err error
+		if ref.Type == "vault" {
+			if vault == nil {
+				if vault, err = NewVaultSecretProvider(cfg.Secrets); err != nil {
+					return err
+				}
+			}
+			value, err = vault.GetSecret(ctx, ref.Key)
+		} else {
+			value, err = ResolveSecretReference(ctx, ref, nil)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		// Settings inside a map are not addressable and keep the reference
+		if v.CanSet() {
+			v.SetString(value)
+		}
+		return nil
+	})
+}
+
+// ValidateConfigSecrets checks the syntax of the secret references without
+// resolving them
+func ValidateConfigSecrets(cfg *Config) error {
+	return forEachSecretSetting(cfg, func(path string, v reflect.Value) error {
+		ref, ok := configSecretReference(v.String())
+		if !ok || ref.Type != "vault" {
+			return nil
+		}
+		if secretPath, field, ok := strings.Cut(ref.Key, "#"); !ok || secretPath == "" || field == "" {
+			return fmt.Errorf("%s: invalid Vault reference %q, expected vault:<path>#<field>", path, v.String())
+		}
+		return nil
+	})
+}
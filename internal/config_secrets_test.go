@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeVault serves a KV v2 secret at kv/karl and a KV v1 secret at
+// legacy/karl, counting the reads
+func fakeVault(t *testing.T, reads *int) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*reads++
+		if r.Header.Get("X-Vault-Token") != "s.test" {
+			http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/kv/data/karl":
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+				"data":     map[string]interface{}{"srtp_key": "vault-key", "srtp_salt": "vault-salt"},
+				"metadata": map[string]interface{}{"version": 3},
+			}})
+		case "/v1/legacy/karl":
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"dsn": "postgres://karl@db/karl"}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestResolveConfigSecrets(t *testing.T) {
+	reads := 0
+	vault := fakeVault(t, &reads)
+	secretFile := filepath.Join(t.TempDir(), "hmac")
+	os.WriteFile(secretFile, []byte("file-secret\n"), 0600)
+	t.Setenv("KARL_TEST_HEP_PASSWORD", "env-secret")
+
+	cfg := &Config{
+		Secrets:    &SecretsConfig{VaultAddress: vault.URL, VaultToken: "s.test"},
+		SRTP:       SRTPConfig{Key: "vault:kv/karl#srtp_key", Salt: "vault:kv/karl#srtp_salt"},
+		Database:   DatabaseConfig{DSN: "vault:legacy/karl#dsn", MySQLDSN: "karl:literal@tcp(db:3306)/karl"},
+		NGProtocol: &NGProtocolConfig{HMACKey: "file:" + secretFile},
+		HEP:        &HEPConfig{Password: "env:KARL_TEST_HEP_PASSWORD"},
+		WebRTC:     WebRTCConfig{TurnServers: []TURNServer{{URL: "turn:turn.example.com", Credential: "env:KARL_TEST_HEP_PASSWORD"}}},
+	}
+	if err := ResolveConfigSecrets(context.Background(), cfg); err != nil {
+		t.Fatalf("ResolveConfigSecrets failed: %v", err)
+	}
+
+	if cfg.SRTP.Key != "vault-key" || cfg.SRTP.Salt != "vault-salt" {
+		t.Errorf("expected the KV v2 secrets, got %q/%q", cfg.SRTP.Key, cfg.SRTP.Salt)
+	}
+	if cfg.Database.DSN != "postgres://karl@db/karl" {
+		t.Errorf("expected the KV v1 secret, got %q", cfg.Database.DSN)
+	}
+	if cfg.Database.MySQLDSN != "karl:literal@tcp(db:3306)/karl" {
+		t.Errorf("expected a literal value to be kept, got %q", cfg.Database.MySQLDSN)
+	}
+	if cfg.NGProtocol.HMACKey != "file-secret" || cfg.HEP.Password != "env-secret" {
+		t.Errorf("expected the file and env secrets, got %q/%q", cfg.NGProtocol.HMACKey, cfg.HEP.Password)
+	}
+	if cfg.WebRTC.TurnServers[0].Credential != "env-secret" || cfg.WebRTC.TurnServers[0].URL != "turn:turn.example.com" {
+		t.Errorf("expected only the TURN credential to be resolved, got %+v", cfg.WebRTC.TurnServers[0])
+	}
+	// kv/karl is read once; legacy/karl is tried as KV v2 first
+	if reads != 3 {
+		t.Errorf("expected 3 Vault reads, got %d", reads)
+	}
+
+	for _, ref := range []string{"vault:kv/karl#missing", "vault:kv/other#srtp_key", "env:KARL_TEST_UNSET", "file:/nonexistent"} {
+		cfg := &Config{Secrets: &SecretsConfig{VaultAddress: vault.URL, VaultToken: "s.test"}, SRTP: SRTPConfig{Key: ref}}
+		if err := ResolveConfigSecrets(context.Background(), cfg); err == nil {
+			t.Errorf("expected %s to fail", ref)
+		}
+	}
+	cfg = &Config{Secrets: &SecretsConfig{VaultAddress: vault.URL, VaultToken: "wrong"}, SRTP: SRTPConfig{Key: "vault:kv/karl#srtp_key"}}
+	if err := ResolveConfigSecrets(context.Background(), cfg); err == nil {
+		t.Error("expected a rejected token to fail")
+	}
+}
+
+func TestValidateConfigSecrets(t *testing.T) {
+	if err := ValidateConfigSecrets(&Config{SRTP: SRTPConfig{Key: "vault:kv/karl#srtp_key"}}); err != nil {
+		t.Errorf("expected a valid reference to pass: %v", err)
+	}
+	if err := ValidateConfigSecrets(&Config{SRTP: SRTPConfig{Key: "vault:kv/karl"}}); err == nil {
+		t.Error("expected a reference without a field to fail")
+	}
+}
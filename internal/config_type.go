@@ -1,6 +1,11 @@
 package internal
 
-import "time"
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
 
 // Version information
 const (
@@ -13,13 +18,17 @@ const (
 
 // SRTPConfig defines secure RTP settings
 type SRTPConfig struct {
-	Key  string `json:"srtp_key"`
-	Salt string `json:"srtp_salt"`
+	Key           string `json:"srtp_key" secret:"true"`
+	Salt          string `json:"srtp_salt" secret:"true"`
+	RekeyInterval int    `json:"rekey_interval"` // Seconds between SRTP master key rotations, 0 disables
 }
 
-// DatabaseConfig defines MySQL and Redis settings
+// DatabaseConfig defines SQL database and Redis settings
 type DatabaseConfig struct {
-	MySQLDSN             string `json:"mysql_dsn"`
+	DSN                  string `json:"dsn" secret:"true"`       // mysql DSN, postgres:// or sqlite:// URL, the driver follows the scheme
+	MySQLDSN             string `json:"mysql_dsn" secret:"true"` // used when dsn is empty
+	SQLitePath           string `json:"sqlite_path"`     // SQLite file used when no DSN is set, default /var/lib/karl/karl.db
+	SQLiteDisabled       bool   `json:"sqlite_disabled"` // run without a database when no DSN is set
 	RedisEnabled         bool   `json:"redis_enabled"`
 	RedisAddr            string `json:"redis_addr"`
 	RedisCleanupInterval int    `json:"redis_cleanup_interval"`
@@ -29,16 +38,30 @@ type DatabaseConfig struct {
 
 // TransportConfig holds networking settings
 type TransportConfig struct {
-	UDPEnabled  bool   `json:"udp_enabled"`
-	UDPPort     int    `json:"udp_port"`
-	TCPEnabled  bool   `json:"tcp_enabled"`
-	TCPPort     int    `json:"tcp_port"`
-	TLSEnabled  bool   `json:"tls_enabled"`
-	TLSPort     int    `json:"tls_port"`
-	TLSCert     string `json:"tls_cert"`
-	TLSKey      string `json:"tls_key"`
-	IPv6Enabled bool   `json:"ipv6_enabled"`
-	MTU         int    `json:"mtu"`
+	UDPEnabled        bool   `json:"udp_enabled"`
+	UDPPort           int    `json:"udp_port"`
+	TCPEnabled        bool   `json:"tcp_enabled"`
+	TCPPort           int    `json:"tcp_port"`
+	TLSEnabled        bool   `json:"tls_enabled"`
+	TLSPort           int    `json:"tls_port"`
+	TLSCert           string `json:"tls_cert"`
+	TLSKey            string `json:"tls_key"`
+	IPv6Enabled       bool   `json:"ipv6_enabled"`
+	MTU               int    `json:"mtu"`                 // largest packet on the media path, 0 for 1500; generated packets stay below it
+	DontFragment      bool   `json:"dont_fragment"`       // set DF on media sockets and count sends rejected by the path MTU (Linux)
+	BatchSize         int    `json:"batch_size"`          // datagrams per recvmmsg/sendmmsg, 0 for 32 and 1 to disable
+	GSO               bool   `json:"gso"`                 // UDP generic segmentation offload for batched sends (Linux)
+	ReusePort         bool   `json:"reuse_port"`          // shard the RTP port across SO_REUSEPORT sockets (Linux)
+	ReusePortShards   int    `json:"reuse_port_shards"`   // sockets sharing the RTP port, 0 for one per CPU
+	KernelOffload     bool   `json:"kernel_offload"`      // forward pass-through sessions with the XDP program (Linux)
+	KernelOffloadMap  string `json:"kernel_offload_map"`  // pinned forwarding map of the XDP program
+	Workers           int    `json:"workers"`             // RTP workers, 0 for two per CPU
+	WorkerQueueSize   int    `json:"worker_queue_size"`   // packets queued per RTP worker, 0 for 256
+	WorkerQueuePolicy string `json:"worker_queue_policy"` // drop_oldest or drop_newest when a worker queue is full
+
+	// Named addresses of a multi-homed host, e.g. "core" and "access". The
+	// first is the default; address is an IP or an OS interface name
+	Interfaces []NetworkInterfaceConfig `json:"interfaces"`
 }
 
 // RTPSettings defines RTP media handling configurations
@@ -55,14 +78,16 @@ type RTPSettings struct {
 	REDEnabled          bool   `json:"red_enabled"`     // Redundant Encoding
 	RTCPInterval        int    `json:"rtcp_interval"`   // RTCP report interval in seconds
 	VADEnabled          bool   `json:"vad_enabled"`     // Voice Activity Detection
-	PLIInterval         int    `json:"pli_interval"`    // Picture Loss Indication interval
+	VADMode             int    `json:"vad_mode"`        // VAD aggressiveness, 0 (quality) to 3 (very aggressive)
+	VADHangover         int    `json:"vad_hangover_ms"` // Speech held after it ends, 0 for the mode's default
+	PLIInterval         int    `json:"pli_interval"`    // Least ms between keyframe requests to one video sender, 0 for 500
 }
 
 // TURNServer represents a TURN server configuration
 type TURNServer struct {
 	URL        string `json:"url"`
 	Username   string `json:"username"`
-	Credential string `json:"credential"`
+	Credential string `json:"credential" secret:"true"`
 	Weight     int    `json:"weight"` // For load balancing
 	Region     string `json:"region"` // Geographic region
 }
@@ -77,16 +102,20 @@ type WebRTCConfig struct {
 	StartBitrate     int          `json:"start_bitrate"`
 	BWEstimation     bool         `json:"bw_estimation"`
 	TCCEnabled       bool         `json:"tcc_enabled"` // Transport-CC feedback
+	SignalingAuth    bool         `json:"signaling_auth"` // Require a REST-issued token on /ws
 	RecordingEnabled bool         `json:"recording_enabled"`
 	RecordingPath    string       `json:"recording_path"`
 }
 
 // NetworkInterfaceConfig defines a named network interface for media
 type NetworkInterfaceConfig struct {
-	Name          string `json:"name"`
-	Address       string `json:"address"`
-	AdvertiseAddr string `json:"advertise_addr"`
-	Port          int    `json:"port"`
+	Name                  string   `json:"name"`
+	Address               string   `json:"address"`
+	AdvertiseAddr         string   `json:"advertise_addr"`          // advertised to external peers
+	InternalAdvertiseAddr string   `json:"internal_advertise_addr"` // advertised to peers in internal_networks
+	Port                  int      `json:"port"`
+	STUNServer            string   `json:"stun_server"` // discovers advertise_addr when set
+	Networks              []string `json:"networks"`    // destinations in these CIDRs are reached through this interface
 }
 
 // IntegrationConfig defines SIP proxy settings
@@ -98,10 +127,13 @@ type IntegrationConfig struct {
 	RTPengineSocket   string                             `json:"rtpengine_socket"`
 	MediaIP           string                             `json:"media_ip"`
 	PublicIP          string                             `json:"public_ip"`
-	BackupMediaIP     string                             `json:"backup_media_ip"`
-	FailoverEnabled   bool                               `json:"failover_enabled"`
 	KeepAliveInterval int                                `json:"keepalive_interval"`
+	SIPTransport      string                             `json:"sip_transport"`   // OPTIONS ping transport: udp, tcp or tls
+	OptionsTimeout    int                                `json:"options_timeout"` // OPTIONS transaction timeout in seconds
 	Interfaces        map[string]*NetworkInterfaceConfig `json:"interfaces"`
+	InternalNetworks  []string                           `json:"internal_networks"` // CIDRs sent the internal address; enables per-peer selection
+	STUNServer        string                             `json:"stun_server"`       // discovers public_ip when set
+	STUNRefresh       int                                `json:"stun_refresh"`      // STUN discovery interval in seconds
 }
 
 // AlertSettings defines monitoring thresholds
@@ -109,27 +141,37 @@ type AlertSettings struct {
 	PacketLossThreshold float64 `json:"packet_loss_threshold"`
 	JitterThreshold     float64 `json:"jitter_threshold"`
 	BandwidthThreshold  int     `json:"bandwidth_threshold"`
-	NotifyAdmin         bool    `json:"notify_admin"`
-	AdminEmail          string  `json:"admin_email"`
-	AlertInterval       int     `json:"alert_interval"` // Minimum time between alerts
-	MaxAlertsPerHour    int     `json:"max_alerts_per_hour"`
-	SlackWebhook        string  `json:"slack_webhook"`
-	PagerDutyKey        string  `json:"pagerduty_key"`
+	MOSThreshold        float64 `json:"mos_threshold"`       // alert when a call's MOS drops below, 0 disables
+	NotifyAdmin         bool    `json:"notify_admin"`        // Send alerts to email, Slack and PagerDuty
+	AdminEmail          string  `json:"admin_email"`         // Comma separated recipients
+	AlertInterval       int     `json:"alert_interval"`      // Minimum seconds between notifications of one alert type, 300 if unset
+	MaxAlertsPerHour    int     `json:"max_alerts_per_hour"` // Notifications sent per hour, 0 for no limit
+	SlackWebhook        string  `json:"slack_webhook" secret:"true"`
+	PagerDutyKey        string  `json:"pagerduty_key" secret:"true"` // Events API v2 routing key
+	SMTPServer          string  `json:"smtp_server"`                 // host:port for admin_email, localhost:25 if unset
+	SMTPUsername        string  `json:"smtp_username"`
+	SMTPPassword        string  `json:"smtp_password" secret:"true"`
+	SMTPFrom            string  `json:"smtp_from"`        // Sender address, karl@<hostname> if unset
+	MessageTemplate     string  `json:"message_template"` // Go text/template for the notification text
 }
 
 // NGProtocolConfig defines NG protocol settings
 type NGProtocolConfig struct {
-	Enabled    bool   `json:"enabled"`
-	SocketPath string `json:"socket_path"`
-	UDPPort    int    `json:"udp_port"`
-	Timeout    int    `json:"timeout"` // Request timeout in seconds
+	Enabled     bool   `json:"enabled"`
+	SocketPath  string `json:"socket_path"`
+	UDPPort     int    `json:"udp_port"`
+	Timeout     int    `json:"timeout"`      // Request timeout in seconds
+	SocketMode  string `json:"socket_mode"`  // Octal permissions of the Unix socket, default 0666
+	SocketOwner string `json:"socket_owner"` // user[:group] owning the Unix socket
+	AllowedUIDs []int  `json:"allowed_uids"` // Unix socket peers allowed to send commands, empty for any
+	HMACKey     string `json:"hmac_key" secret:"true"` // Require messages signed with this key
 }
 
 // RecordingConfig defines call recording settings
 type RecordingConfig struct {
 	Enabled       bool   `json:"enabled"`
 	BasePath      string `json:"base_path"`
-	Format        string `json:"format"`         // wav, pcm
+	Format        string `json:"format"`         // wav, pcm, opus (Ogg/Opus)
 	Mode          string `json:"mode"`           // mixed, stereo, separate
 	SampleRate    int    `json:"sample_rate"`    // 8000, 16000, 48000
 	BitsPerSample int    `json:"bits_per_sample"` // 8, 16
@@ -150,6 +192,16 @@ type APIConfig struct {
 	TLSKey          string `json:"tls_key"`
 }
 
+// GRPCConfig defines the gRPC control and management API
+type GRPCConfig struct {
+	Enabled     bool   `json:"enabled"`
+	Address     string `json:"address"`      // Listen address (e.g., ":9090")
+	AuthEnabled bool   `json:"auth_enabled"` // Require an API key, with the REST API's permissions
+	TLSEnabled  bool   `json:"tls_enabled"`
+	TLSCert     string `json:"tls_cert"`
+	TLSKey      string `json:"tls_key"`
+}
+
 // SessionConfig defines session management settings
 type SessionConfig struct {
 	MaxSessions   int `json:"max_sessions"`
@@ -157,6 +209,10 @@ type SessionConfig struct {
 	CleanupInterval int `json:"cleanup_interval"` // Cleanup interval in seconds
 	MinPort       int `json:"min_port"`        // Minimum RTP port
 	MaxPort       int `json:"max_port"`        // Maximum RTP port
+	MediaTimeout  int `json:"media_timeout"`   // Media inactivity timeout in seconds (0 disables)
+	PortReuseDelay int `json:"port_reuse_delay"` // Milliseconds a released port waits before reuse, 0 for 2000
+	ParkTimeout   int `json:"park_timeout"`    // Seconds a parked leg waits for re-attachment before the call ends, 0 for 300
+	MaxBandwidth  int `json:"max_bandwidth"`   // Mbit/s of received media above which new calls are refused, 0 for no limit
 }
 
 // JitterBufferConfig defines jitter buffer settings
@@ -175,6 +231,8 @@ type RTCPConfig struct {
 	Interval    int  `json:"interval"`     // Report interval in seconds
 	ReducedSize bool `json:"reduced_size"` // Use reduced-size RTCP
 	MuxEnabled  bool `json:"mux_enabled"`  // RTCP-mux support
+
+	ExtendedReports bool `json:"extended_reports"` // Add RTCP XR VoIP metrics blocks (RFC 3611)
 }
 
 // FECConfig defines Forward Error Correction settings
@@ -187,25 +245,335 @@ type FECConfig struct {
 	MinRedundancy float64 `json:"min_redundancy"` // Minimum redundancy
 }
 
+// HEPConfig defines HEP3/EEP capture export to a Homer/SIPCAPTURE server
+type HEPConfig struct {
+	Enabled        bool   `json:"enabled"`
+	Address        string `json:"address"`         // Capture server host:port
+	Transport      string `json:"transport"`       // udp or tcp
+	CaptureID      uint32 `json:"capture_id"`      // Capture agent ID
+	Password       string `json:"password" secret:"true"` // Capture server auth key
+	ReportInterval int    `json:"report_interval"` // Seconds between RTP quality summaries
+}
+
+// PCAPConfig defines per-call packet capture settings
+type PCAPConfig struct {
+	AutoCapture    bool   `json:"auto_capture"`    // Capture every call, not only API-requested ones
+	Path           string `json:"path"`            // Directory for capture files
+	RotateSize     int64  `json:"rotate_size"`     // Bytes per file before rotating (0 disables)
+	RotateInterval int    `json:"rotate_interval"` // Seconds per file before rotating (0 disables)
+	MaxFiles       int    `json:"max_files"`       // Files kept per call, oldest deleted first (0 keeps all)
+}
+
+// ConferenceConfig defines audio conference mixing settings
+type ConferenceConfig struct {
+	Enabled           bool    `json:"enabled"`
+	SampleRate        int     `json:"sample_rate"`        // Mixing rate in Hz (8000, 16000 or 48000)
+	PacketTime        int     `json:"packet_time"`        // Milliseconds of audio mixed per packet
+	MaxParticipants   int     `json:"max_participants"`   // Participants per room (0 is unlimited)
+	SpeakingThreshold float64 `json:"speaking_threshold"` // Level in dBFS above which a participant is speaking
+}
+
+// HAConfig defines active/standby failover of the media IP between two nodes
+type HAConfig struct {
+	Enabled       bool   `json:"enabled"`
+	NodeID        string `json:"node_id"`        // Defaults to the hostname
+	RedisAddr     string `json:"redis_addr"`     // Lease store, defaults to database.redis_addr
+	Key           string `json:"key"`            // Redis key holding the lease
+	VirtualIP     string `json:"virtual_ip"`     // Address (or CIDR) owned by the active node, empty to not manage one
+	Interface     string `json:"interface"`      // Interface the virtual IP is added to
+	Priority      int    `json:"priority"`       // 1-255, higher takes a free lease first
+	LeaseTTL      int    `json:"lease_ttl"`      // Milliseconds a lease lives without renewal
+	RenewInterval int    `json:"renew_interval"` // Milliseconds between renewals, at most a third of lease_ttl
+}
+
+// DispatchConfig spreads calls over several Karl instances sharing one NG
+// control endpoint. Call-ids are assigned to nodes by consistent hashing and
+// commands for a call are forwarded to the node that owns it
+type DispatchConfig struct {
+	Enabled        bool              `json:"enabled"`
+	NodeID         string            `json:"node_id"`         // Defaults to the hostname
+	Address        string            `json:"address"`         // NG UDP address peers forward to, defaults to POD_IP or media_ip with ng_protocol.udp_port
+	Nodes          map[string]string `json:"nodes"`           // Static peers, node ID to NG UDP address
+	RedisAddr      string            `json:"redis_addr"`      // Membership and call ownership, defaults to database.redis_addr
+	KeyPrefix      string            `json:"key_prefix"`      // Prefix of the Redis keys
+	NodeTTL        int               `json:"node_ttl"`        // Seconds a node stays registered without refresh
+	OwnerTTL       int               `json:"owner_ttl"`       // Seconds a call's ownership is kept
+	ForwardTimeout int               `json:"forward_timeout"` // Milliseconds to wait for the owning node
+}
+
+// DTLSCertConfig defines the certificate Karl presents in DTLS-SRTP handshakes
+type DTLSCertConfig struct {
+	CertFile          string `json:"cert_file"`          // PEM certificate, generated when missing
+	KeyFile           string `json:"key_file"`           // PEM private key, generated when missing
+	ValidityDays      int    `json:"validity_days"`      // Lifetime of generated certificates
+	RenewBeforeDays   int    `json:"renew_before_days"`  // Regenerate this long before expiry
+	VerifyFingerprint bool   `json:"verify_fingerprint"` // Check the peer certificate against the SDP fingerprint
+}
+
+// MediaACLConfig restricts which addresses may send media to the RTP ports
+type MediaACLConfig struct {
+	Allow       []string `json:"allow"`        // CIDRs allowed to send media, empty for any
+	Deny        []string `json:"deny"`         // CIDRs whose media is always dropped
+	SourceCheck string   `json:"source_check"` // off, sdp or learn
+	RateLimit   int      `json:"rate_limit"`   // Packets per second per source IP, 0 for no limit
+	Burst       int      `json:"burst"`        // Packets a source may send at once, default rate_limit
+}
+
+// EndpointTLSConfig serves the metrics or health endpoints over TLS,
+// optionally requiring client certificates
+type EndpointTLSConfig struct {
+	Enabled    bool   `json:"enabled"`
+	CertFile   string `json:"cert_file"`   // PEM certificate
+	KeyFile    string `json:"key_file"`    // PEM private key
+	ClientCA   string `json:"client_ca"`   // PEM CA bundle verifying client certificates
+	ClientAuth string `json:"client_auth"` // "require" (default with client_ca) or "optional"
+}
+
+// QoSConfig sets the DSCP marking of outgoing packets. Carriers commonly
+// expect 46 (EF) on media and 24 (CS3) on signaling
+type QoSConfig struct {
+	RTPDSCP       int `json:"rtp_dscp"`       // RTP media, including FEC; 0 leaves packets unmarked
+	RTCPDSCP      int `json:"rtcp_dscp"`      // RTCP on its own port
+	SignalingDSCP int `json:"signaling_dscp"` // NG protocol, call dispatch and SIP OPTIONS
+}
+
+// ImpairmentConfig allows calls to ask for simulated loss, reordering,
+// duplication and delay with the impair-* NG options, for testing how FEC,
+// NACK and jitter buffers cope. Leave it disabled in production.
+type ImpairmentConfig struct {
+	Enabled  bool `json:"enabled"`
+	MaxDelay int  `json:"max_delay"` // Longest delay in ms a packet may get, 1000 if unset
+}
+
+// MusicOnHoldConfig streams a file to the party left waiting when the other
+// puts a call on hold, instead of the silence a phone sends on hold
+type MusicOnHoldConfig struct {
+	Enabled bool   `json:"enabled"`
+	File    string `json:"file"` // WAV or raw G.711 u-law, played in a loop
+}
+
+// VideoTranscodeConfig lets Karl transcode relayed video between codecs,
+// e.g. VP8 from a browser to H.264 for a SIP video phone. It needs a build
+// with a video backend, such as -tags karl_video for libvpx and OpenH264,
+// and costs far more CPU than audio, so it is off by default
+type VideoTranscodeConfig struct {
+	Enabled    bool   `json:"enabled"`
+	Backend    string `json:"backend"`     // Registered video backend, "software" if unset
+	MaxWidth   int    `json:"max_width"`   // Larger pictures are scaled down to fit, 1280 if unset
+	MaxHeight  int    `json:"max_height"`  // 720 if unset
+	MaxBitrate int    `json:"max_bitrate"` // Encoder bitrate in kbps, 1500 if unset
+	MaxStreams int    `json:"max_streams"` // Streams transcoded at once, 8 if unset
+}
+
+// HardwareAccelConfig picks the accelerators SRTP crypto and audio codecs
+// run on. Video codecs are picked with video_transcoding.backend
+type HardwareAccelConfig struct {
+	Crypto string `json:"crypto"` // Accelerator for SRTP, "software" if unset
+	Audio  string `json:"audio"`  // Accelerator for audio transcoding, none if unset
+}
+
+// WebhooksConfig publishes call and node events to HTTP endpoints
+type WebhooksConfig struct {
+	Endpoints []WebhookEndpointConfig `json:"endpoints"`
+	QueueSize int                     `json:"queue_size"` // Events waiting per endpoint, 1000 if unset
+}
+
+// WebhookEndpointConfig is one endpoint events are POSTed to as JSON
+type WebhookEndpointConfig struct {
+	URL        string   `json:"url" secret:"true"`
+	Secret     string   `json:"secret" secret:"true"` // Signs the body with HMAC-SHA256 in X-Signature
+	Events     []string `json:"events"`               // Event types delivered, all if empty
+	Timeout    int      `json:"timeout"`              // Seconds per attempt, 5 if unset
+	MaxRetries int      `json:"max_retries"`          // Retries after a failed attempt, 3 if unset
+}
+
+// EventStreamingConfig publishes the webhook events as JSON to Kafka
+// topics, NATS subjects or Redis channels, for billing, analytics and IVR
+// consumers
+type EventStreamingConfig struct {
+	Kafka     *KafkaStreamConfig `json:"kafka"`
+	NATS      *NATSStreamConfig  `json:"nats"`
+	Redis     *RedisStreamConfig `json:"redis"`
+	QueueSize int                `json:"queue_size"` // Events waiting per stream, 1000 if unset
+}
+
+// KafkaStreamConfig publishes events to Kafka, keyed by call ID
+type KafkaStreamConfig struct {
+	Brokers       []string          `json:"brokers"`
+	Topic         string            `json:"topic"`          // Topic for event types not in topics, karl-events if unset
+	Topics        map[string]string `json:"topics"`         // Topic per event type; an empty topic skips the type
+	Events        []string          `json:"events"`         // Event types published, all if empty
+	TLS           bool              `json:"tls"`            // Connect to the brokers over TLS
+	SASLMechanism string            `json:"sasl_mechanism"` // plain, scram-sha-256 or scram-sha-512
+	Username      string            `json:"username"`
+	Password      string            `json:"password" secret:"true"`
+}
+
+// NATSStreamConfig publishes events to NATS subjects
+type NATSStreamConfig struct {
+	URL      string            `json:"url" secret:"true"` // nats:// or tls:// servers, comma separated
+	Subject  string            `json:"subject"`           // Subject for event types not in subjects, karl.events if unset
+	Subjects map[string]string `json:"subjects"`          // Subject per event type; an empty subject skips the type
+	Events   []string          `json:"events"`            // Event types published, all if empty
+	Token    string            `json:"token" secret:"true"`
+}
+
+// RedisStreamConfig publishes events to Redis pub/sub channels
+type RedisStreamConfig struct {
+	Addr     string            `json:"addr"` // host:port of the Redis server
+	Password string            `json:"password" secret:"true"`
+	DB       int               `json:"db"`
+	TLS      bool              `json:"tls"`      // Connect over TLS
+	Channel  string            `json:"channel"`  // Channel for event types not in channels, karl:events if unset
+	Channels map[string]string `json:"channels"` // Channel per event type; an empty channel skips the type
+	Events   []string          `json:"events"`   // Event types published, all if empty
+}
+
+// DTMFEventsConfig publishes the digits pressed in calls as dtmf events,
+// so IVR logic in the proxy layer can react to them
+type DTMFEventsConfig struct {
+	Enabled bool `json:"enabled"`
+	Inband  bool `json:"inband"` // Also detect tones in the G.711 audio of legs without telephone-event
+}
+
+// ObjectStorageConfig ships completed recordings and per-call captures to
+// an S3-compatible bucket: AWS S3, MinIO or GCS through its XML API with
+// HMAC keys. Local files are removed once their upload is confirmed
+type ObjectStorageConfig struct {
+	Enabled    bool              `json:"enabled"`
+	Endpoint   string            `json:"endpoint"` // https://s3.<region>.amazonaws.com if unset
+	Region     string            `json:"region"`   // us-east-1 if unset
+	Bucket     string            `json:"bucket"`
+	Prefix     string            `json:"prefix"` // Prepended to every object key
+	AccessKey  string            `json:"access_key" secret:"true"`
+	SecretKey  string            `json:"secret_key" secret:"true"`
+	PathStyle  bool              `json:"path_style"`  // Bucket in the URL path rather than the host name, as MinIO expects
+	Types      []string          `json:"types"`       // recording, pcap; both if empty
+	Tags       map[string]string `json:"tags"`        // Object tags for bucket lifecycle rules, besides karl-type
+	KeepLocal  bool              `json:"keep_local"`  // Keep local files after uploading them
+	Workers    int               `json:"workers"`     // Concurrent uploads, 2 if unset
+	QueueSize  int               `json:"queue_size"`  // Files waiting for upload, 1000 if unset
+	Timeout    int               `json:"timeout"`     // Seconds per attempt, 300 if unset
+	MaxRetries int               `json:"max_retries"` // Retries after a failed attempt, 5 if unset
+}
+
+// TranscriptionConfig forks the decoded audio of selected calls to a
+// speech-to-text engine, one stream per leg, and publishes the transcript
+// segments it returns as events
+type TranscriptionConfig struct {
+	Enabled    bool   `json:"enabled"`
+	Backend    string `json:"backend"`             // grpc or websocket
+	Address    string `json:"address"`             // host:port of the gRPC engine
+	URL        string `json:"url" secret:"true"`   // ws:// or wss:// URL of the WebSocket engine
+	TLS        bool   `json:"tls"`                 // Connect to the gRPC engine over TLS
+	Token      string `json:"token" secret:"true"` // Sent to the engine as a bearer token
+	SampleRate int    `json:"sample_rate"`         // Rate of the forked audio, 8000 or 16000 (default)
+	Language   string `json:"language"`            // BCP 47 language passed to the engine, its default if unset
+	AutoStart  bool   `json:"auto_start"`          // Transcribe every call, not only requested ones
+	MaxStreams int    `json:"max_streams"`         // Calls transcribed at once, 100 if unset
+}
+
+// TenantsConfig serves several customers through one media layer. An
+// offer names its tenant with the NG protocol's tenant key, and the call
+// gets that tenant's settings
+type TenantsConfig struct {
+	Default string                   `json:"default"` // Tenant of offers that name none, none if unset
+	Tenants map[string]*TenantConfig `json:"tenants"` // Settings by tenant name
+}
+
+// TenantConfig holds the settings of one tenant. Unset settings follow the
+// global ones
+type TenantConfig struct {
+	MinPort         int                    `json:"min_port"`         // Lowest media port of the tenant's calls, sessions.min_port if unset
+	MaxPort         int                    `json:"max_port"`         // Highest media port of the tenant's calls, sessions.max_port if unset
+	StripCodecs     []string               `json:"strip_codecs"`     // Codecs removed from the tenant's offers
+	AllowCodecs     []string               `json:"allow_codecs"`     // Codecs kept in the tenant's offers, all if empty
+	TranscodeCodecs []string               `json:"transcode_codecs"` // Codecs offered to the answerer and transcoded to
+	Recording       *TenantRecordingConfig `json:"recording"`
+	OfferRate       int                    `json:"offer_rate"`    // New calls accepted per second, 0 for no limit
+	MaxSessions     int                    `json:"max_sessions"`  // Concurrent calls of the tenant, 0 for no limit
+	MetricsLabel    string                 `json:"metrics_label"` // Value of the tenant label of metrics, the tenant name if unset
+}
+
+// TenantRecordingConfig holds the recording settings of a tenant. Its
+// recordings are kept under a directory named after the tenant
+type TenantRecordingConfig struct {
+	AutoStart bool   `json:"auto_start"` // Record every answered call
+	Disabled  bool   `json:"disabled"`   // Refuse to record the tenant's calls
+	Format    string `json:"format"`     // wav, pcm or opus, recording.format if unset
+	Mode      string `json:"mode"`       // mixed, stereo or separate, recording.mode if unset
+}
+
+// MetricsConfig tunes the Prometheus metrics
+type MetricsConfig struct {
+	SessionGauges int `json:"session_gauges"` // Calls with per-session quality gauges, lowest MOS first; 0 disables
+}
+
+// DebugConfig enables the profiling and diagnostics listener. It serves
+// /debug/pprof and /debug/status without authentication, so it listens on
+// loopback unless another address is set
+type DebugConfig struct {
+	Enabled              bool   `json:"enabled"`
+	Address              string `json:"address"`                // Listen address, defaults to 127.0.0.1:6060
+	BlockProfileRate     int    `json:"block_profile_rate"`     // runtime.SetBlockProfileRate; 0 leaves block profiling off
+	MutexProfileFraction int    `json:"mutex_profile_fraction"` // runtime.SetMutexProfileFraction; 0 leaves mutex profiling off
+}
+
+// SecretsConfig defines where secret references in other settings are
+// resolved. Settings such as srtp.srtp_key accept env:NAME, file:/path and
+// vault:<path>#<field> in place of the value.
+type SecretsConfig struct {
+	VaultAddress   string `json:"vault_address"`    // Vault URL, defaults to VAULT_ADDR
+	VaultToken     string `json:"vault_token"`      // Defaults to VAULT_TOKEN
+	VaultTokenFile string `json:"vault_token_file"` // File holding the token, e.g. from a Vault agent
+	VaultNamespace string `json:"vault_namespace"`  // Enterprise namespace, defaults to VAULT_NAMESPACE
+	VaultTimeout   int    `json:"vault_timeout"`    // Seconds per Vault read, default 10
+}
+
 // Config struct holds all settings
 type Config struct {
-	Version       string              `json:"version"`
-	LastUpdated   time.Time           `json:"last_updated"`
-	Environment   string              `json:"environment"` // prod, staging, dev
-	Transport     TransportConfig     `json:"transport"`
-	RTPSettings   RTPSettings         `json:"rtp_settings"`
-	WebRTC        WebRTCConfig        `json:"webrtc"`
-	Integration   IntegrationConfig   `json:"integration"`
-	AlertSettings AlertSettings       `json:"alert_settings"`
-	Database      DatabaseConfig      `json:"database"`
-	SRTP          SRTPConfig          `json:"srtp"`
-	NGProtocol    *NGProtocolConfig   `json:"ng_protocol"`
-	Recording     *RecordingConfig    `json:"recording"`
-	API           *APIConfig          `json:"api"`
-	Sessions      *SessionConfig      `json:"sessions"`
-	JitterBuffer  *JitterBufferConfig `json:"jitter_buffer"`
-	RTCP          *RTCPConfig         `json:"rtcp"`
-	FEC           *FECConfig          `json:"fec"`
+	Version        string                `json:"version"`
+	LastUpdated    time.Time             `json:"last_updated"`
+	Environment    string                `json:"environment"` // prod, staging, dev
+	Transport      TransportConfig       `json:"transport"`
+	RTPSettings    RTPSettings           `json:"rtp_settings"`
+	WebRTC         WebRTCConfig          `json:"webrtc"`
+	Integration    IntegrationConfig     `json:"integration"`
+	AlertSettings  AlertSettings         `json:"alert_settings"`
+	Database       DatabaseConfig        `json:"database"`
+	SRTP           SRTPConfig            `json:"srtp"`
+	NGProtocol     *NGProtocolConfig     `json:"ng_protocol"`
+	Recording      *RecordingConfig      `json:"recording"`
+	API            *APIConfig            `json:"api"`
+	Sessions       *SessionConfig        `json:"sessions"`
+	JitterBuffer   *JitterBufferConfig   `json:"jitter_buffer"`
+	RTCP           *RTCPConfig           `json:"rtcp"`
+	FEC            *FECConfig            `json:"fec"`
+	HEP            *HEPConfig            `json:"hep"`
+	PCAP           *PCAPConfig           `json:"pcap"`
+	Conference     *ConferenceConfig     `json:"conference"`
+	DTLS           *DTLSCertConfig       `json:"dtls"`
+	Logging        *LoggingConfig        `json:"logging"`
+	HA             *HAConfig             `json:"ha"`
+	Dispatch       *DispatchConfig       `json:"dispatch"`
+	GRPC           *GRPCConfig           `json:"grpc"`
+	MetricsTLS     *EndpointTLSConfig    `json:"metrics_tls"`
+	HealthTLS      *EndpointTLSConfig    `json:"health_tls"`
+	MediaACL       *MediaACLConfig       `json:"media_acl"`
+	Secrets        *SecretsConfig        `json:"secrets"`
+	QoS            *QoSConfig            `json:"qos"`
+	Impairment     *ImpairmentConfig     `json:"impairment"`
+	MusicOnHold    *MusicOnHoldConfig    `json:"music_on_hold"`
+	VideoTranscode *VideoTranscodeConfig `json:"video_transcoding"`
+	HardwareAccel  *HardwareAccelConfig  `json:"hardware_acceleration"`
+	Webhooks       *WebhooksConfig       `json:"webhooks"`
+	EventStreaming *EventStreamingConfig `json:"event_streaming"`
+	DTMFEvents     *DTMFEventsConfig     `json:"dtmf_events"`
+	ObjectStorage  *ObjectStorageConfig  `json:"object_storage"`
+	Transcription  *TranscriptionConfig  `json:"transcription"`
+	Tenants        *TenantsConfig        `json:"tenants"`
+	Metrics        *MetricsConfig        `json:"metrics"`
+	Debug          *DebugConfig          `json:"debug"`
 }
 
 // GetNGProtocolConfig returns NG protocol config with defaults
@@ -259,6 +627,7 @@ func (c *Config) GetSessionConfig() *SessionConfig {
 			CleanupInterval: 60,
 			MinPort:         30000,
 			MaxPort:         40000,
+			MediaTimeout:    30,
 		}
 	}
 	return c.Sessions
@@ -306,3 +675,150 @@ func (c *Config) GetFECConfig() *FECConfig {
 	}
 	return c.FEC
 }
+
+// GetHEPConfig returns HEP capture config with defaults
+func (c *Config) GetHEPConfig() *HEPConfig {
+	if c.HEP == nil {
+		return &HEPConfig{
+			Enabled:        false,
+			Address:        "127.0.0.1:9060",
+			Transport:      "udp",
+			CaptureID:      2001,
+			ReportInterval: 30,
+		}
+	}
+	return c.HEP
+}
+
+// GetPCAPConfig returns per-call capture config with defaults. The legacy
+// rtp_settings.enable_pcap flag turns on auto capture.
+func (c *Config) GetPCAPConfig() *PCAPConfig {
+	if c.PCAP == nil {
+		return &PCAPConfig{
+			AutoCapture: c.RTPSettings.EnablePCAP,
+			Path:        "logs/pcap",
+			RotateSize:  100 * 1024 * 1024, // 100MB
+			MaxFiles:    10,
+		}
+	}
+	return c.PCAP
+}
+
+// GetConferenceConfig returns conference config with defaults
+func (c *Config) GetConferenceConfig() *ConferenceConfig {
+	if c.Conference == nil {
+		return &ConferenceConfig{
+			Enabled:           false,
+			SampleRate:        8000,
+			PacketTime:        20,
+			MaxParticipants:   16,
+			SpeakingThreshold: -40,
+		}
+	}
+	return c.Conference
+}
+
+// GetVideoTranscodeConfig returns video transcoding config with defaults
+func (c *Config) GetVideoTranscodeConfig() *VideoTranscodeConfig {
+	if c.VideoTranscode == nil {
+		return &VideoTranscodeConfig{
+			Enabled:    false,
+			Backend:    defaultVideoBackend,
+			MaxWidth:   defaultVideoMaxWidth,
+			MaxHeight:  defaultVideoMaxHeight,
+			MaxBitrate: defaultVideoMaxBitrate,
+			MaxStreams: defaultVideoMaxStreams,
+		}
+	}
+	return c.VideoTranscode
+}
+
+// DatabaseDSN returns the SQL database DSN, preferring dsn over the older
+// mysql_dsn. Without either it falls back to the local SQLite file, unless
+// that is disabled
+func (d DatabaseConfig) DatabaseDSN() string {
+	if d.DSN != "" {
+		return d.DSN
+	}
+	if d.MySQLDSN != "" {
+		return d.MySQLDSN
+	}
+	if d.SQLiteDisabled {
+		return ""
+	}
+	if d.SQLitePath != "" {
+		return "sqlite://" + d.SQLitePath
+	}
+	return "sqlite://" + DefaultSQLitePath
+}
+
+// GetDispatchConfig returns the dispatch config with defaults filled in
+func (c *Config) GetDispatchConfig() *DispatchConfig {
+	d := DispatchConfig{}
+	if c.Dispatch != nil {
+		d = *c.Dispatch
+	}
+	if d.NodeID == "" {
+		d.NodeID = DefaultHANodeID()
+	}
+	if d.Address == "" && c.NGProtocol != nil && c.NGProtocol.UDPPort > 0 {
+		host := os.Getenv("POD_IP")
+		if host == "" {
+			host = c.Integration.MediaIP
+		}
+		if host != "" && host != "auto" {
+			d.Address = net.JoinHostPort(host, strconv.Itoa(c.NGProtocol.UDPPort))
+		}
+	}
+	if d.KeyPrefix == "" {
+		d.KeyPrefix = "karl:dispatch"
+	}
+	if d.NodeTTL == 0 {
+		d.NodeTTL = 10
+	}
+	if d.OwnerTTL == 0 {
+		d.OwnerTTL = 86400
+	}
+	if d.ForwardTimeout == 0 {
+		d.ForwardTimeout = 2000
+	}
+	return &d
+}
+
+// GetHAConfig returns HA config with defaults filled in
+func (c *Config) GetHAConfig() *HAConfig {
+	ha := HAConfig{}
+	if c.HA != nil {
+		ha = *c.HA
+	}
+	if ha.NodeID == "" {
+		ha.NodeID = DefaultHANodeID()
+	}
+	if ha.Key == "" {
+		ha.Key = "karl:ha:leader"
+	}
+	if ha.Priority == 0 {
+		ha.Priority = 100
+	}
+	if ha.LeaseTTL == 0 {
+		ha.LeaseTTL = 3000
+	}
+	if ha.RenewInterval == 0 {
+		ha.RenewInterval = ha.LeaseTTL / 3
+	}
+	return &ha
+}
+
+// GetDTLSCertConfig returns DTLS certificate config with defaults
+func (c *Config) GetDTLSCertConfig() *DTLSCertConfig {
+	if c.DTLS == nil {
+		return &DTLSCertConfig{
+			CertFile:          "/var/lib/karl/dtls/cert.pem",
+			KeyFile:           "/var/lib/karl/dtls/key.pem",
+			ValidityDays:      365,
+			RenewBeforeDays:   30,
+			VerifyFingerprint: true,
+		}
+	}
+	return c.DTLS
+}
@@ -0,0 +1,200 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var configReloads = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "karl_config_reloads_total",
+		Help: "Configuration reloads by trigger and result",
+	},
+	[]string{"trigger", "result"},
+)
+
+const (
+	// configReloadDebounce collapses the burst of events an editor or a
+	// ConfigMap update makes into one reload
+	configReloadDebounce = 500 * time.Millisecond
+	// configPollInterval is used when the file cannot be watched
+	configPollInterval = 5 * time.Second
+)
+
+// ConfigReloader applies a reloaded configuration to a subsystem. It is
+// called again with the arguments swapped to roll back when it or a later
+// subsystem rejects the change.
+type ConfigReloader func(oldConfig, newConfig *Config) error
+
+type namedConfigReloader struct {
+	name   string
+	reload ConfigReloader
+}
+
+var (
+	configReloaders   []namedConfigReloader
+	configReloadersMu sync.Mutex
+	// configReloadMu serializes reloads from file events and signals
+	configReloadMu sync.Mutex
+)
+
+// RegisterConfigReloader adds a subsystem to the reload transaction. The
+// reloaders run in registration order after the built-in settings.
+func RegisterConfigReloader(name string, reload ConfigReloader) {
+	configReloadersMu.Lock()
+	defer configReloadersMu.Unlock()
+	configReloaders = append(configReloaders, namedConfigReloader{name: name, reload: reload})
+}
+
+// WatchConfig reloads the configuration when the file changes or on SIGHUP
+// until ctx is done. initial is the configuration in use, restored when a
+// reload is rejected.
+func WatchConfig(ctx context.Context, filePath string, initial *Config) {
+	configMutex.Lock()
+	config = initial
+	configMutex.Unlock()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	defer signal.Stop(sigCh)
+
+	// The directory is watched so that files replaced by rename, as editors
+	// and Kubernetes ConfigMaps do, keep being seen
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	var poll <-chan time.Time
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = watcher.Add(filepath.Dir(filePath))
+	}
+	if err != nil {
+		log.Printf("⚠️ Cannot watch %s, polling every %v: %v", filePath, configPollInterval, err)
+		ticker := time.NewTicker(configPollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	} else {
+		defer watcher.Close()
+		events, errs = watcher.Events, watcher.Errors
+	}
+
+	lastMod := time.Now()
+	debounce := time.NewTimer(time.Hour)
+	debounce.Stop()
+	defer debounce.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigCh:
+			log.Println("📝 SIGHUP received, reloading configuration...")
+			_ = ReloadConfig(filePath, "signal")
+		case event := <-events:
+			if isConfigFileEvent(event, filePath) {
+				debounce.Reset(configReloadDebounce)
+			}
+		case err := <-errs:
+			log.Printf("❌ Error watching config file: %v", err)
+		case <-debounce.C:
+			log.Println("📝 Configuration file changed, reloading...")
+			_ = ReloadConfig(filePath, "file")
+		case <-poll:
+			info, err := os.Stat(filePath)
+			if err != nil {
+				log.Printf("❌ Error checking config file: %v", err)
+				continue
+			}
+			if info.ModTime().After(lastMod) {
+				lastMod = info.ModTime()
+				log.Println("📝 Configuration file changed, reloading...")
+				_ = ReloadConfig(filePath, "file")
+			}
+		}
+	}
+}
+
+// isConfigFileEvent reports whether a directory event may have changed the
+// config file: a write to it, its replacement, or the swap of the ..data
+// link a ConfigMap volume uses
+func isConfigFileEvent(event fsnotify.Event, filePath string) bool {
+	if !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) && !event.Has(fsnotify.Rename) {
+		return false
+	}
+	name := filepath.Base(event.Name)
+	return name == filepath.Base(filePath) || name == "..data"
+}
+
+// ReloadConfig loads, validates and applies the configuration as one
+// transaction: when a subsystem rejects the new configuration, the ones
+// already changed are rolled back and the previous configuration stays in
+// use
+func ReloadConfig(filePath, trigger string) error {
+	configReloadMu.Lock()
+	defer configReloadMu.Unlock()
+
+	newConfig, err := LoadConfig(filePath)
+	if err != nil {
+		configReloads.WithLabelValues(trigger, "invalid").Inc()
+		log.Printf("❌ Failed to reload config, keeping the current one: %v", err)
+		return err
+	}
+
+	configMutex.RLock()
+	oldConfig := config
+	configMutex.RUnlock()
+
+	if err := applyConfigTransaction(oldConfig, newConfig); err != nil {
+		configReloads.WithLabelValues(trigger, "rolled_back").Inc()
+		log.Printf("❌ Failed to apply new config, rolled back: %v", err)
+		return err
+	}
+
+	configMutex.Lock()
+	config = newConfig
+	configMutex.Unlock()
+
+	configReloads.WithLabelValues(trigger, "success").Inc()
+	log.Println("✅ Configuration updated successfully")
+	return nil
+}
+
+// applyConfigTransaction applies newConfig to the built-in settings and then
+// every registered subsystem, undoing the steps in reverse order from the
+// one that fails
+func applyConfigTransaction(oldConfig, newConfig *Config) error {
+	configReloadersMu.Lock()
+	steps := append([]namedConfigReloader{{name: "settings", reload: applySettings}}, configReloaders...)
+	configReloadersMu.Unlock()
+
+	for i, step := range steps {
+		err := step.reload(oldConfig, newConfig)
+		if err == nil {
+			continue
+		}
+		if oldConfig != nil {
+			for j := i; j >= 0; j-- {
+				if rbErr := steps[j].reload(newConfig, oldConfig); rbErr != nil {
+					log.Printf("❌ Failed to roll back %s: %v", steps[j].name, rbErr)
+				}
+			}
+		}
+		return fmt.Errorf("%s rejected the configuration: %w", step.name, err)
+	}
+	return nil
+}
+
+// applySettings applies the settings handled by ApplyNewConfig
+func applySettings(_, newConfig *Config) error {
+	return ApplyNewConfig(*newConfig)
+}
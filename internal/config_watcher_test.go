@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeReloadConfig writes a minimal valid config for the given environment
+func writeReloadConfig(t *testing.T, path, environment string) {
+	t.Helper()
+	data := fmt.Sprintf(`{
+  "environment": %q,
+  "rtp_settings": {"min_jitter_buffer": 20, "max_bandwidth": 1000},
+  "integration": {"media_ip": "127.0.0.1", "public_ip": "127.0.0.1"}
+}`, environment)
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+}
+
+func currentEnvironment() string {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	if config == nil {
+		return ""
+	}
+	return config.Environment
+}
+
+// withConfigReloader registers a reloader for the duration of a test
+func withConfigReloader(t *testing.T, name string, reload ConfigReloader) {
+	configReloadersMu.Lock()
+	saved := configReloaders
+	configReloadersMu.Unlock()
+	RegisterConfigReloader(name, reload)
+	t.Cleanup(func() {
+		configReloadersMu.Lock()
+		configReloaders = saved
+		configReloadersMu.Unlock()
+	})
+}
+
+func TestReloadConfig_RollsBack(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeReloadConfig(t, path, "staging")
+	initial, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	configMutex.Lock()
+	config = initial
+	configMutex.Unlock()
+
+	// The first subsystem accepts everything, the second rejects "prod"
+	var applied []string
+	withConfigReloader(t, "first", func(_, newConfig *Config) error {
+		applied = append(applied, newConfig.Environment)
+		return nil
+	})
+	withConfigReloader(t, "second", func(_, newConfig *Config) error {
+		if newConfig.Environment == "prod" {
+			return errors.New("not ready for prod")
+		}
+		return nil
+	})
+
+	writeReloadConfig(t, path, "prod")
+	if err := ReloadConfig(path, "signal"); err == nil {
+		t.Fatal("expected the rejected reload to fail")
+	}
+	if env := currentEnvironment(); env != "staging" {
+		t.Errorf("expected the previous config to stay in use, got %q", env)
+	}
+	if len(applied) != 2 || applied[0] != "prod" || applied[1] != "staging" {
+		t.Errorf("expected the first subsystem to be rolled back, got %v", applied)
+	}
+
+	// An invalid file never reaches the subsystems
+	applied = nil
+	os.WriteFile(path, []byte(`{"rtp_settings": {"min_jitter_buffer": 1}}`), 0644)
+	if err := ReloadConfig(path, "signal"); err == nil {
+		t.Error("expected an invalid config to be rejected")
+	}
+	if len(applied) != 0 {
+		t.Errorf("expected no subsystem to see an invalid config, got %v", applied)
+	}
+
+	writeReloadConfig(t, path, "dev")
+	if err := ReloadConfig(path, "signal"); err != nil {
+		t.Fatalf("ReloadConfig failed: %v", err)
+	}
+	if env := currentEnvironment(); env != "dev" {
+		t.Errorf("expected the new config in use, got %q", env)
+	}
+}
+
+func TestWatchConfig_FileChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeReloadConfig(t, path, "staging")
+	initial, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go WatchConfig(ctx, path, initial)
+	time.Sleep(100 * time.Millisecond)
+
+	// Replace the file by rename, as editors do
+	tmp := path + ".tmp"
+	writeReloadConfig(t, tmp, "dev")
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatalf("failed to replace config: %v", err)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for currentEnvironment() != "dev" {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the replaced file to be reloaded, got %q", currentEnvironment())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -9,152 +9,78 @@ import (
 	_ "github.com/go-sql-driver/mysql"
 )
 
-// RTPDatabase represents the MySQL database connection
+// RTPDatabase is the SQL implementation of Database, for MySQL, PostgreSQL
+// or SQLite depending on the DSN
 type RTPDatabase struct {
-	db *sql.DB
+	db     *sql.DB
+	driver string
 }
 
-// NewRTPDatabase initializes a connection to MySQL
+// NewRTPDatabase connects to the database named by the DSN, choosing the
+// driver from its scheme (see DatabaseDriver)
 func NewRTPDatabase(dsn string) (*RTPDatabase, error) {
-	db, err := sql.Open("mysql", dsn)
+	driver, driverDSN := DatabaseDriver(dsn)
+	if driver == DriverSQLite {
+		var err error
+		if driverDSN, err = prepareSQLite(driverDSN); err != nil {
+			log.Printf("Failed to prepare SQLite database: %v", err)
+			return nil, err
+		}
+	}
+	db, err := sql.Open(driver, driverDSN)
 	if err != nil {
-		log.Printf("Failed to connect to MySQL: %v", err)
+		log.Printf("Failed to connect to %s: %v", driver, err)
 		return nil, err
 	}
 
 	// Test the connection
 	if err = db.Ping(); err != nil {
-		log.Printf("MySQL connection test failed: %v", err)
+		log.Printf("%s connection test failed: %v", driver, err)
+		db.Close()
 		return nil, err
 	}
 
-	// Configure connection pool
-	db.SetMaxOpenConns(25)
-	db.SetMaxIdleConns(10)
-	db.SetConnMaxLifetime(5 * time.Minute)
+	// Configure connection pool. SQLite takes one writer at a time, so a
+	// single connection avoids busy errors between our own goroutines
+	if driver == DriverSQLite {
+		db.SetMaxOpenConns(1)
+	} else {
+		db.SetMaxOpenConns(25)
+		db.SetMaxIdleConns(10)
+		db.SetConnMaxLifetime(5 * time.Minute)
+	}
+
+	log.Printf("Connected to %s successfully", driver)
+	return &RTPDatabase{db: db, driver: driver}, nil
+}
+
+// Driver returns the database/sql driver name, mysql, postgres or sqlite
+func (r *RTPDatabase) Driver() string {
+	return r.driver
+}
+
+// exec, query and queryRow run a query written with ? placeholders
+func (r *RTPDatabase) exec(query string, args ...interface{}) (sql.Result, error) {
+	return r.db.Exec(rebind(r.driver, query), args...)
+}
+
+func (r *RTPDatabase) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return r.db.Query(rebind(r.driver, query), args...)
+}
 
-	log.Println("Connected to MySQL successfully")
-	return &RTPDatabase{db: db}, nil
+func (r *RTPDatabase) queryRow(query string, args ...interface{}) *sql.Row {
+	return r.db.QueryRow(rebind(r.driver, query), args...)
 }
 
-// InitSchema initializes the database schema
+// InitSchema initializes the database schema. SQLite databases are
+// migrated to the latest schema version instead
 func (r *RTPDatabase) InitSchema() error {
-	schemas := []string{
-		// Sessions table
-		`CREATE TABLE IF NOT EXISTS sessions (
-			id VARCHAR(36) PRIMARY KEY,
-			call_id VARCHAR(255) NOT NULL,
-			from_tag VARCHAR(255) NOT NULL,
-			to_tag VARCHAR(255),
-			via_branch VARCHAR(255),
-			state VARCHAR(20) NOT NULL DEFAULT 'new',
-			caller_ip VARCHAR(45),
-			caller_port INT,
-			callee_ip VARCHAR(45),
-			callee_port INT,
-			start_time DATETIME NOT NULL,
-			connect_time DATETIME,
-			end_time DATETIME,
-			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
-			updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
-			INDEX idx_call_id (call_id),
-			INDEX idx_state (state),
-			INDEX idx_start_time (start_time)
-		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
-
-		// CDR (Call Detail Records) table
-		`CREATE TABLE IF NOT EXISTS cdr (
-			id VARCHAR(36) PRIMARY KEY,
-			session_id VARCHAR(36),
-			call_id VARCHAR(255) NOT NULL,
-			from_tag VARCHAR(255),
-			to_tag VARCHAR(255),
-			caller_id VARCHAR(255),
-			callee_id VARCHAR(255),
-			caller_ip VARCHAR(45),
-			callee_ip VARCHAR(45),
-			start_time DATETIME NOT NULL,
-			connect_time DATETIME,
-			end_time DATETIME,
-			duration INT DEFAULT 0,
-			billable_duration INT DEFAULT 0,
-			termination_cause VARCHAR(100),
-			packets_sent BIGINT DEFAULT 0,
-			packets_recv BIGINT DEFAULT 0,
-			bytes_sent BIGINT DEFAULT 0,
-			bytes_recv BIGINT DEFAULT 0,
-			packets_lost INT DEFAULT 0,
-			avg_jitter DECIMAL(10,6) DEFAULT 0,
-			max_jitter DECIMAL(10,6) DEFAULT 0,
-			packet_loss_rate DECIMAL(5,4) DEFAULT 0,
-			rtt DECIMAL(10,6) DEFAULT 0,
-			mos DECIMAL(3,2) DEFAULT 0,
-			recording_path VARCHAR(500),
-			metadata JSON,
-			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
-			INDEX idx_session_id (session_id),
-			INDEX idx_call_id (call_id),
-			INDEX idx_start_time (start_time),
-			INDEX idx_end_time (end_time)
-		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
-
-		// Recordings table
-		`CREATE TABLE IF NOT EXISTS recordings (
-			id VARCHAR(36) PRIMARY KEY,
-			session_id VARCHAR(36),
-			call_id VARCHAR(255),
-			file_path VARCHAR(500) NOT NULL,
-			format VARCHAR(20) NOT NULL DEFAULT 'wav',
-			mode VARCHAR(20) NOT NULL DEFAULT 'mixed',
-			status VARCHAR(20) NOT NULL DEFAULT 'pending',
-			start_time DATETIME NOT NULL,
-			end_time DATETIME,
-			duration INT DEFAULT 0,
-			file_size BIGINT DEFAULT 0,
-			metadata JSON,
-			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
-			INDEX idx_session_id (session_id),
-			INDEX idx_call_id (call_id),
-			INDEX idx_status (status),
-			INDEX idx_start_time (start_time)
-		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
-
-		// API Keys table
-		`CREATE TABLE IF NOT EXISTS api_keys (
-			id VARCHAR(36) PRIMARY KEY,
-			key_hash VARCHAR(64) UNIQUE NOT NULL,
-			name VARCHAR(100) NOT NULL,
-			permissions JSON NOT NULL,
-			rate_limit INT DEFAULT 60,
-			enabled BOOLEAN DEFAULT TRUE,
-			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
-			last_used DATETIME,
-			INDEX idx_key_hash (key_hash),
-			INDEX idx_enabled (enabled)
-		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
-
-		// RTP sessions table (existing, updated)
-		`CREATE TABLE IF NOT EXISTS rtp_sessions (
-			id BIGINT AUTO_INCREMENT PRIMARY KEY,
-			call_id VARCHAR(255) NOT NULL,
-			ssrc INT UNSIGNED NOT NULL,
-			codec VARCHAR(50),
-			packet_loss INT DEFAULT 0,
-			jitter DECIMAL(10,6) DEFAULT 0,
-			start_time DATETIME NOT NULL,
-			end_time DATETIME,
-			packets_sent BIGINT DEFAULT 0,
-			packets_recv BIGINT DEFAULT 0,
-			bytes_sent BIGINT DEFAULT 0,
-			bytes_recv BIGINT DEFAULT 0,
-			INDEX idx_call_id (call_id),
-			INDEX idx_ssrc (ssrc),
-			INDEX idx_start_time (start_time)
-		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+	if r.driver == DriverSQLite {
+		return r.migrateSQLite()
 	}
 
-	for _, schema := range schemas {
-		if _, err := r.db.Exec(schema); err != nil {
+	for _, schema := range schemaFor(r.driver) {
+		if _, err := r.exec(schema); err != nil {
 			log.Printf("Schema creation error: %v", err)
 			// Continue with other schemas
 		}
@@ -164,13 +90,13 @@ func (r *RTPDatabase) InitSchema() error {
 	return nil
 }
 
-// InsertRTPStats logs RTP session statistics into the MySQL database
+// InsertRTPStats logs RTP session statistics into the database
 func (r *RTPDatabase) InsertRTPStats(callID string, ssrc uint32, codec string, packetLoss int, jitter float64) error {
 	query := `
         INSERT INTO rtp_sessions (call_id, ssrc, codec, packet_loss, jitter, start_time)
-        VALUES (?, ?, ?, ?, ?, NOW())
+        VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
     `
-	_, err := r.db.Exec(query, callID, ssrc, codec, packetLoss, jitter)
+	_, err := r.exec(query, callID, ssrc, codec, packetLoss, jitter)
 	if err != nil {
 		log.Printf("Failed to insert RTP stats: %v", err)
 		return err
@@ -183,7 +109,7 @@ func (r *RTPDatabase) InsertRTPStats(callID string, ssrc uint32, codec string, p
 // GetActiveSessions retrieves active RTP sessions
 func (r *RTPDatabase) GetActiveSessions() ([]string, error) {
 	query := `SELECT call_id FROM rtp_sessions WHERE end_time IS NULL`
-	rows, err := r.db.Query(query)
+	rows, err := r.query(query)
 	if err != nil {
 		log.Printf("Failed to fetch active RTP sessions: %v", err)
 		return nil, err
@@ -232,7 +158,7 @@ func (r *RTPDatabase) InsertSession(session *SessionRecord) error {
 			caller_ip, caller_port, callee_ip, callee_port, start_time)
 		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
-	_, err := r.db.Exec(query,
+	_, err := r.exec(query,
 		session.ID, session.CallID, session.FromTag, session.ToTag, session.ViaBranch,
 		session.State, session.CallerIP, session.CallerPort, session.CalleeIP,
 		session.CalleePort, session.StartTime)
@@ -244,10 +170,10 @@ func (r *RTPDatabase) UpdateSession(session *SessionRecord) error {
 	query := `
 		UPDATE sessions SET
 			to_tag = ?, state = ?, callee_ip = ?, callee_port = ?,
-			connect_time = ?, end_time = ?
+			connect_time = ?, end_time = ?, updated_at = CURRENT_TIMESTAMP
 		WHERE id = ?
 	`
-	_, err := r.db.Exec(query,
+	_, err := r.exec(query,
 		session.ToTag, session.State, session.CalleeIP, session.CalleePort,
 		session.ConnectTime, session.EndTime, session.ID)
 	return err
@@ -262,7 +188,7 @@ func (r *RTPDatabase) GetSession(id string) (*SessionRecord, error) {
 		FROM sessions WHERE id = ?
 	`
 	session := &SessionRecord{}
-	err := r.db.QueryRow(query, id).Scan(
+	err := r.queryRow(query, id).Scan(
 		&session.ID, &session.CallID, &session.FromTag, &session.ToTag,
 		&session.ViaBranch, &session.State, &session.CallerIP, &session.CallerPort,
 		&session.CalleeIP, &session.CalleePort, &session.StartTime,
@@ -275,7 +201,7 @@ func (r *RTPDatabase) GetSession(id string) (*SessionRecord, error) {
 
 // DeleteSession deletes a session
 func (r *RTPDatabase) DeleteSession(id string) error {
-	_, err := r.db.Exec("DELETE FROM sessions WHERE id = ?", id)
+	_, err := r.exec("DELETE FROM sessions WHERE id = ?", id)
 	return err
 }
 
@@ -325,7 +251,7 @@ func (r *RTPDatabase) InsertCDR(cdr *CDRRecord) error {
 			recording_path, metadata)
 		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
-	_, err := r.db.Exec(query,
+	_, err := r.exec(query,
 		cdr.ID, cdr.SessionID, cdr.CallID, cdr.FromTag, cdr.ToTag,
 		cdr.CallerID, cdr.CalleeID, cdr.CallerIP, cdr.CalleeIP,
 		cdr.StartTime, cdr.ConnectTime, cdr.EndTime, cdr.Duration, cdr.BillableDuration,
@@ -348,7 +274,7 @@ func (r *RTPDatabase) GetCDR(id string) (*CDRRecord, error) {
 	`
 	cdr := &CDRRecord{}
 	var metadataJSON string
-	err := r.db.QueryRow(query, id).Scan(
+	err := r.queryRow(query, id).Scan(
 		&cdr.ID, &cdr.SessionID, &cdr.CallID, &cdr.FromTag, &cdr.ToTag,
 		&cdr.CallerID, &cdr.CalleeID, &cdr.CallerIP, &cdr.CalleeIP,
 		&cdr.StartTime, &cdr.ConnectTime, &cdr.EndTime, &cdr.Duration, &cdr.BillableDuration,
@@ -395,7 +321,7 @@ func (r *RTPDatabase) ListCDRs(callID string, startFrom, startTo time.Time, limi
 		args = append(args, limit)
 	}
 
-	rows, err := r.db.Query(query, args...)
+	rows, err := r.query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -448,7 +374,7 @@ func (r *RTPDatabase) InsertRecording(rec *RecordingRecord) error {
 			status, start_time, end_time, duration, file_size, metadata)
 		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
-	_, err := r.db.Exec(query,
+	_, err := r.exec(query,
 		rec.ID, rec.SessionID, rec.CallID, rec.FilePath, rec.Format, rec.Mode,
 		rec.Status, rec.StartTime, rec.EndTime, rec.Duration, rec.FileSize,
 		string(metadataJSON))
@@ -462,7 +388,7 @@ func (r *RTPDatabase) UpdateRecording(rec *RecordingRecord) error {
 			status = ?, end_time = ?, duration = ?, file_size = ?
 		WHERE id = ?
 	`
-	_, err := r.db.Exec(query, rec.Status, rec.EndTime, rec.Duration, rec.FileSize, rec.ID)
+	_, err := r.exec(query, rec.Status, rec.EndTime, rec.Duration, rec.FileSize, rec.ID)
 	return err
 }
 
@@ -475,7 +401,7 @@ func (r *RTPDatabase) GetRecording(id string) (*RecordingRecord, error) {
 	`
 	rec := &RecordingRecord{}
 	var metadataJSON string
-	err := r.db.QueryRow(query, id).Scan(
+	err := r.queryRow(query, id).Scan(
 		&rec.ID, &rec.SessionID, &rec.CallID, &rec.FilePath, &rec.Format, &rec.Mode,
 		&rec.Status, &rec.StartTime, &rec.EndTime, &rec.Duration, &rec.FileSize,
 		&metadataJSON, &rec.CreatedAt)
@@ -511,7 +437,7 @@ func (r *RTPDatabase) ListRecordings(sessionID, status string, limit int) ([]*Re
 		args = append(args, limit)
 	}
 
-	rows, err := r.db.Query(query, args...)
+	rows, err := r.query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -535,7 +461,7 @@ func (r *RTPDatabase) ListRecordings(sessionID, status string, limit int) ([]*Re
 
 // DeleteRecording deletes a recording
 func (r *RTPDatabase) DeleteRecording(id string) error {
-	_, err := r.db.Exec("DELETE FROM recordings WHERE id = ?", id)
+	_, err := r.exec("DELETE FROM recordings WHERE id = ?", id)
 	return err
 }
 
@@ -547,49 +473,54 @@ func (r *RTPDatabase) GetAggregateStats() (map[string]interface{}, error) {
 
 	// Total sessions
 	var totalSessions int
-	if err := r.db.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&totalSessions); err == nil {
+	if err := r.queryRow("SELECT COUNT(*) FROM sessions").Scan(&totalSessions); err == nil {
 		stats["total_sessions"] = totalSessions
 	}
 
 	// Active sessions
 	var activeSessions int
-	if err := r.db.QueryRow("SELECT COUNT(*) FROM sessions WHERE state = 'active'").Scan(&activeSessions); err == nil {
+	if err := r.queryRow("SELECT COUNT(*) FROM sessions WHERE state = 'active'").Scan(&activeSessions); err == nil {
 		stats["active_sessions"] = activeSessions
 	}
 
 	// Total CDRs
 	var totalCDRs int
-	if err := r.db.QueryRow("SELECT COUNT(*) FROM cdr").Scan(&totalCDRs); err == nil {
+	if err := r.queryRow("SELECT COUNT(*) FROM cdr").Scan(&totalCDRs); err == nil {
 		stats["total_cdrs"] = totalCDRs
 	}
 
 	// Average call duration
 	var avgDuration float64
-	if err := r.db.QueryRow("SELECT COALESCE(AVG(duration), 0) FROM cdr").Scan(&avgDuration); err == nil {
+	if err := r.queryRow("SELECT COALESCE(AVG(duration), 0) FROM cdr").Scan(&avgDuration); err == nil {
 		stats["avg_duration"] = avgDuration
 	}
 
 	// Total recordings
 	var totalRecordings int
-	if err := r.db.QueryRow("SELECT COUNT(*) FROM recordings").Scan(&totalRecordings); err == nil {
+	if err := r.queryRow("SELECT COUNT(*) FROM recordings").Scan(&totalRecordings); err == nil {
 		stats["total_recordings"] = totalRecordings
 	}
 
 	// Total recording size
 	var totalRecordingSize int64
-	if err := r.db.QueryRow("SELECT COALESCE(SUM(file_size), 0) FROM recordings").Scan(&totalRecordingSize); err == nil {
+	if err := r.queryRow("SELECT COALESCE(SUM(file_size), 0) FROM recordings").Scan(&totalRecordingSize); err == nil {
 		stats["total_recording_size"] = totalRecordingSize
 	}
 
 	return stats, nil
 }
 
-// Close closes the MySQL database connection
+// Ping checks the connection
+func (r *RTPDatabase) Ping() error {
+	return r.db.Ping()
+}
+
+// Close closes the database connection
 func (r *RTPDatabase) Close() {
 	if err := r.db.Close(); err != nil {
-		log.Printf("Failed to close MySQL connection: %v", err)
+		log.Printf("Failed to close %s connection: %v", r.driver, err)
 	} else {
-		log.Println("MySQL connection closed")
+		log.Printf("%s connection closed", r.driver)
 	}
 }
 
@@ -597,3 +528,118 @@ func (r *RTPDatabase) Close() {
 func (r *RTPDatabase) GetDB() *sql.DB {
 	return r.db
 }
+
+// mysqlSchema creates the tables on MySQL
+var mysqlSchema = []string{
+	// Sessions table
+	`CREATE TABLE IF NOT EXISTS sessions (
+		id VARCHAR(36) PRIMARY KEY,
+		call_id VARCHAR(255) NOT NULL,
+		from_tag VARCHAR(255) NOT NULL,
+		to_tag VARCHAR(255),
+		via_branch VARCHAR(255),
+		state VARCHAR(20) NOT NULL DEFAULT 'new',
+		caller_ip VARCHAR(45),
+		caller_port INT,
+		callee_ip VARCHAR(45),
+		callee_port INT,
+		start_time DATETIME NOT NULL,
+		connect_time DATETIME,
+		end_time DATETIME,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		INDEX idx_call_id (call_id),
+		INDEX idx_state (state),
+		INDEX idx_start_time (start_time)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+
+	// CDR (Call Detail Records) table
+	`CREATE TABLE IF NOT EXISTS cdr (
+		id VARCHAR(36) PRIMARY KEY,
+		session_id VARCHAR(36),
+		call_id VARCHAR(255) NOT NULL,
+		from_tag VARCHAR(255),
+		to_tag VARCHAR(255),
+		caller_id VARCHAR(255),
+		callee_id VARCHAR(255),
+		caller_ip VARCHAR(45),
+		callee_ip VARCHAR(45),
+		start_time DATETIME NOT NULL,
+		connect_time DATETIME,
+		end_time DATETIME,
+		duration INT DEFAULT 0,
+		billable_duration INT DEFAULT 0,
+		termination_cause VARCHAR(100),
+		packets_sent BIGINT DEFAULT 0,
+		packets_recv BIGINT DEFAULT 0,
+		bytes_sent BIGINT DEFAULT 0,
+		bytes_recv BIGINT DEFAULT 0,
+		packets_lost INT DEFAULT 0,
+		avg_jitter DECIMAL(10,6) DEFAULT 0,
+		max_jitter DECIMAL(10,6) DEFAULT 0,
+		packet_loss_rate DECIMAL(5,4) DEFAULT 0,
+		rtt DECIMAL(10,6) DEFAULT 0,
+		mos DECIMAL(3,2) DEFAULT 0,
+		recording_path VARCHAR(500),
+		metadata JSON,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_session_id (session_id),
+		INDEX idx_call_id (call_id),
+		INDEX idx_start_time (start_time),
+		INDEX idx_end_time (end_time)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+
+	// Recordings table
+	`CREATE TABLE IF NOT EXISTS recordings (
+		id VARCHAR(36) PRIMARY KEY,
+		session_id VARCHAR(36),
+		call_id VARCHAR(255),
+		file_path VARCHAR(500) NOT NULL,
+		format VARCHAR(20) NOT NULL DEFAULT 'wav',
+		mode VARCHAR(20) NOT NULL DEFAULT 'mixed',
+		status VARCHAR(20) NOT NULL DEFAULT 'pending',
+		start_time DATETIME NOT NULL,
+		end_time DATETIME,
+		duration INT DEFAULT 0,
+		file_size BIGINT DEFAULT 0,
+		metadata JSON,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_session_id (session_id),
+		INDEX idx_call_id (call_id),
+		INDEX idx_status (status),
+		INDEX idx_start_time (start_time)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+
+	// API Keys table
+	`CREATE TABLE IF NOT EXISTS api_keys (
+		id VARCHAR(36) PRIMARY KEY,
+		key_hash VARCHAR(64) UNIQUE NOT NULL,
+		name VARCHAR(100) NOT NULL,
+		permissions JSON NOT NULL,
+		rate_limit INT DEFAULT 60,
+		enabled BOOLEAN DEFAULT TRUE,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		last_used DATETIME,
+		INDEX idx_key_hash (key_hash),
+		INDEX idx_enabled (enabled)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+
+	// RTP sessions table (existing, updated)
+	`CREATE TABLE IF NOT EXISTS rtp_sessions (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		call_id VARCHAR(255) NOT NULL,
+		ssrc INT UNSIGNED NOT NULL,
+		codec VARCHAR(50),
+		packet_loss INT DEFAULT 0,
+		jitter DECIMAL(10,6) DEFAULT 0,
+		start_time DATETIME NOT NULL,
+		end_time DATETIME,
+		packets_sent BIGINT DEFAULT 0,
+		packets_recv BIGINT DEFAULT 0,
+		bytes_sent BIGINT DEFAULT 0,
+		bytes_recv BIGINT DEFAULT 0,
+		INDEX idx_call_id (call_id),
+		INDEX idx_ssrc (ssrc),
+		INDEX idx_start_time (start_time)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+}
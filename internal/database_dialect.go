@@ -0,0 +1,209 @@
+package internal
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// Database is the storage behind sessions, CDRs, recordings and RTP stats.
+// RTPDatabase implements it for MySQL, PostgreSQL and SQLite
+type Database interface {
+	InitSchema() error
+	Driver() string
+
+	InsertRTPStats(callID string, ssrc uint32, codec string, packetLoss int, jitter float64) error
+	GetActiveSessions() ([]string, error)
+
+	InsertSession(session *SessionRecord) error
+	UpdateSession(session *SessionRecord) error
+	GetSession(id string) (*SessionRecord, error)
+	DeleteSession(id string) error
+
+	InsertCDR(cdr *CDRRecord) error
+	GetCDR(id string) (*CDRRecord, error)
+	ListCDRs(callID string, startFrom, startTo time.Time, limit int) ([]*CDRRecord, error)
+
+	InsertRecording(rec *RecordingRecord) error
+	UpdateRecording(rec *RecordingRecord) error
+	GetRecording(id string) (*RecordingRecord, error)
+	ListRecordings(sessionID, status string, limit int) ([]*RecordingRecord, error)
+	DeleteRecording(id string) error
+
+	GetAggregateStats() (map[string]interface{}, error)
+	Ping() error
+	Close()
+}
+
+var _ Database = (*RTPDatabase)(nil)
+
+// Supported database/sql driver names
+const (
+	DriverMySQL    = "mysql"
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite"
+)
+
+// DatabaseDriver picks the driver for a DSN by its scheme. postgres:// and
+// postgresql:// URLs select PostgreSQL and are passed to lib/pq as they are;
+// sqlite://path selects SQLite on the file at path; a mysql:// prefix is
+// stripped, and anything else is taken as a go-sql-driver/mysql DSN
+// (user:pass@tcp(host:3306)/db)
+func DatabaseDriver(dsn string) (driver, driverDSN string) {
+	switch {
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		return DriverPostgres, dsn
+	case strings.HasPrefix(dsn, "sqlite://"):
+		return DriverSQLite, strings.TrimPrefix(dsn, "sqlite://")
+	case strings.HasPrefix(dsn, "mysql://"):
+		return DriverMySQL, strings.TrimPrefix(dsn, "mysql://")
+	default:
+		return DriverMySQL, dsn
+	}
+}
+
+// rebind rewrites the ? placeholders of a query for the driver. The queries
+// in this package never contain a literal question mark
+func rebind(driver, query string) string {
+	if driver != DriverPostgres || !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	b.Grow(len(query) + 16)
+	n := 0
+	for i := 0; i < len(query); i++ {
+		if query[i] != '?' {
+			b.WriteByte(query[i])
+			continue
+		}
+		n++
+		b.WriteByte('$')
+		b.WriteString(strconv.Itoa(n))
+	}
+	return b.String()
+}
+
+// schemaFor returns the DDL creating the tables for the driver
+func schemaFor(driver string) []string {
+	switch driver {
+	case DriverPostgres:
+		return postgresSchema
+	case DriverSQLite:
+		return sqliteSchema
+	default:
+		return mysqlSchema
+	}
+}
+
+// postgresSchema mirrors mysqlSchema. Indexes are separate statements, and
+// sessions.updated_at is set by UpdateSession rather than ON UPDATE
+var postgresSchema = []string{
+	`CREATE TABLE IF NOT EXISTS sessions (
+		id VARCHAR(36) PRIMARY KEY,
+		call_id VARCHAR(255) NOT NULL,
+		from_tag VARCHAR(255) NOT NULL,
+		to_tag VARCHAR(255),
+		via_branch VARCHAR(255),
+		state VARCHAR(20) NOT NULL DEFAULT 'new',
+		caller_ip VARCHAR(45),
+		caller_port INTEGER,
+		callee_ip VARCHAR(45),
+		callee_port INTEGER,
+		start_time TIMESTAMP NOT NULL,
+		connect_time TIMESTAMP,
+		end_time TIMESTAMP,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_sessions_call_id ON sessions (call_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_sessions_state ON sessions (state)`,
+	`CREATE INDEX IF NOT EXISTS idx_sessions_start_time ON sessions (start_time)`,
+
+	`CREATE TABLE IF NOT EXISTS cdr (
+		id VARCHAR(36) PRIMARY KEY,
+		session_id VARCHAR(36),
+		call_id VARCHAR(255) NOT NULL,
+		from_tag VARCHAR(255),
+		to_tag VARCHAR(255),
+		caller_id VARCHAR(255),
+		callee_id VARCHAR(255),
+		caller_ip VARCHAR(45),
+		callee_ip VARCHAR(45),
+		start_time TIMESTAMP NOT NULL,
+		connect_time TIMESTAMP,
+		end_time TIMESTAMP,
+		duration INTEGER DEFAULT 0,
+		billable_duration INTEGER DEFAULT 0,
+		termination_cause VARCHAR(100),
+		packets_sent BIGINT DEFAULT 0,
+		packets_recv BIGINT DEFAULT 0,
+		bytes_sent BIGINT DEFAULT 0,
+		bytes_recv BIGINT DEFAULT 0,
+		packets_lost INTEGER DEFAULT 0,
+		avg_jitter NUMERIC(10,6) DEFAULT 0,
+		max_jitter NUMERIC(10,6) DEFAULT 0,
+		packet_loss_rate NUMERIC(5,4) DEFAULT 0,
+		rtt NUMERIC(10,6) DEFAULT 0,
+		mos NUMERIC(3,2) DEFAULT 0,
+		recording_path VARCHAR(500),
+		metadata JSONB,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_cdr_session_id ON cdr (session_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_cdr_call_id ON cdr (call_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_cdr_start_time ON cdr (start_time)`,
+	`CREATE INDEX IF NOT EXISTS idx_cdr_end_time ON cdr (end_time)`,
+
+	`CREATE TABLE IF NOT EXISTS recordings (
+		id VARCHAR(36) PRIMARY KEY,
+		session_id VARCHAR(36),
+		call_id VARCHAR(255),
+		file_path VARCHAR(500) NOT NULL,
+		format VARCHAR(20) NOT NULL DEFAULT 'wav',
+		mode VARCHAR(20) NOT NULL DEFAULT 'mixed',
+		status VARCHAR(20) NOT NULL DEFAULT 'pending',
+		start_time TIMESTAMP NOT NULL,
+		end_time TIMESTAMP,
+		duration INTEGER DEFAULT 0,
+		file_size BIGINT DEFAULT 0,
+		metadata JSONB,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_recordings_session_id ON recordings (session_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_recordings_call_id ON recordings (call_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_recordings_status ON recordings (status)`,
+	`CREATE INDEX IF NOT EXISTS idx_recordings_start_time ON recordings (start_time)`,
+
+	`CREATE TABLE IF NOT EXISTS api_keys (
+		id VARCHAR(36) PRIMARY KEY,
+		key_hash VARCHAR(64) UNIQUE NOT NULL,
+		name VARCHAR(100) NOT NULL,
+		permissions JSONB NOT NULL,
+		rate_limit INTEGER DEFAULT 60,
+		enabled BOOLEAN DEFAULT TRUE,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		last_used TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_api_keys_enabled ON api_keys (enabled)`,
+
+	// ssrc is BIGINT since PostgreSQL has no unsigned INTEGER
+	`CREATE TABLE IF NOT EXISTS rtp_sessions (
+		id BIGSERIAL PRIMARY KEY,
+		call_id VARCHAR(255) NOT NULL,
+		ssrc BIGINT NOT NULL,
+		codec VARCHAR(50),
+		packet_loss INTEGER DEFAULT 0,
+		jitter NUMERIC(10,6) DEFAULT 0,
+		start_time TIMESTAMP NOT NULL,
+		end_time TIMESTAMP,
+		packets_sent BIGINT DEFAULT 0,
+		packets_recv BIGINT DEFAULT 0,
+		bytes_sent BIGINT DEFAULT 0,
+		bytes_recv BIGINT DEFAULT 0
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_rtp_sessions_call_id ON rtp_sessions (call_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_rtp_sessions_ssrc ON rtp_sessions (ssrc)`,
+	`CREATE INDEX IF NOT EXISTS idx_rtp_sessions_start_time ON rtp_sessions (start_time)`,
+}
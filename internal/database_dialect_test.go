@@ -0,0 +1,64 @@
+package internal
+
+import "testing"
+
+func TestDatabaseDriver(t *testing.T) {
+	tests := []struct {
+		dsn       string
+		driver    string
+		driverDSN string
+	}{
+		{"karl:pw@tcp(127.0.0.1:3306)/karl?parseTime=true", DriverMySQL, "karl:pw@tcp(127.0.0.1:3306)/karl?parseTime=true"},
+		{"mysql://karl:pw@tcp(db:3306)/karl", DriverMySQL, "karl:pw@tcp(db:3306)/karl"},
+		{"postgres://karl:pw@db:5432/karl?sslmode=disable", DriverPostgres, "postgres://karl:pw@db:5432/karl?sslmode=disable"},
+		{"postgresql://db/karl", DriverPostgres, "postgresql://db/karl"},
+		{"sqlite:///var/lib/karl/karl.db", DriverSQLite, "/var/lib/karl/karl.db"},
+	}
+
+	for _, tt := range tests {
+		driver, driverDSN := DatabaseDriver(tt.dsn)
+		if driver != tt.driver || driverDSN != tt.driverDSN {
+			t.Errorf("DatabaseDriver(%q) = %q, %q, expected %q, %q", tt.dsn, driver, driverDSN, tt.driver, tt.driverDSN)
+		}
+	}
+}
+
+func TestRebind(t *testing.T) {
+	query := "SELECT id FROM cdr WHERE call_id = ? AND start_time >= ? LIMIT ?"
+
+	if got := rebind(DriverMySQL, query); got != query {
+		t.Errorf("rebind for mysql changed the query: %s", got)
+	}
+
+	expected := "SELECT id FROM cdr WHERE call_id = $1 AND start_time >= $2 LIMIT $3"
+	if got := rebind(DriverPostgres, query); got != expected {
+		t.Errorf("rebind for postgres = %s, expected %s", got, expected)
+	}
+}
+
+func TestDatabaseConfig_DatabaseDSN(t *testing.T) {
+	cfg := DatabaseConfig{}
+	if got := cfg.DatabaseDSN(); got != "sqlite://"+DefaultSQLitePath {
+		t.Errorf("DatabaseDSN() = %q, expected the default SQLite file", got)
+	}
+
+	cfg.SQLitePath = "/tmp/karl.db"
+	if got := cfg.DatabaseDSN(); got != "sqlite:///tmp/karl.db" {
+		t.Errorf("DatabaseDSN() = %q, expected sqlite_path", got)
+	}
+
+	cfg.SQLiteDisabled = true
+	if got := cfg.DatabaseDSN(); got != "" {
+		t.Errorf("DatabaseDSN() = %q, expected no database", got)
+	}
+
+	cfg.MySQLDSN = "karl@tcp(db:3306)/karl"
+	if got := cfg.DatabaseDSN(); got != cfg.MySQLDSN {
+		t.Errorf("DatabaseDSN() = %q, expected mysql_dsn fallback", got)
+	}
+
+	cfg.DSN = "postgres://db/karl"
+	if got := cfg.DatabaseDSN(); got != cfg.DSN {
+		t.Errorf("DatabaseDSN() = %q, expected dsn", got)
+	}
+}
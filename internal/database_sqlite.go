@@ -0,0 +1,189 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+// DefaultSQLitePath is the database file used when no DSN is configured
+const DefaultSQLitePath = "/var/lib/karl/karl.db"
+
+// sqlitePragmas are applied to every SQLite connection. WAL lets readers
+// run alongside the writer, and busy_timeout rides out short lock waits
+// instead of failing with SQLITE_BUSY
+const sqlitePragmas = "_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_time_format=sqlite"
+
+// prepareSQLite creates the directory holding the database file and adds
+// the connection pragmas unless the DSN already sets its own parameters
+func prepareSQLite(dsn string) (string, error) {
+	path := dsn
+	if i := strings.IndexByte(dsn, '?'); i >= 0 {
+		path = dsn[:i]
+	}
+	path = strings.TrimPrefix(path, "file:")
+
+	if path != "" && path != ":memory:" {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return "", fmt.Errorf("failed to create SQLite directory: %w", err)
+		}
+	}
+
+	if strings.Contains(dsn, "?") {
+		return dsn, nil
+	}
+	return dsn + "?" + sqlitePragmas, nil
+}
+
+// migrateSQLite brings the schema up to date. The applied version is kept in
+// PRAGMA user_version, and each pending migration runs in its own
+// transaction
+func (r *RTPDatabase) migrateSQLite() error {
+	var version int
+	if err := r.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("failed to read SQLite schema version: %w", err)
+	}
+
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := r.db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin SQLite migration %d: %w", i+1, err)
+		}
+		for _, stmt := range sqliteMigrations[i] {
+			if _, err := tx.Exec(stmt); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("SQLite migration %d failed: %w", i+1, err)
+			}
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to record SQLite schema version %d: %w", i+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit SQLite migration %d: %w", i+1, err)
+		}
+		log.Printf("SQLite schema migrated to version %d", i+1)
+	}
+
+	return nil
+}
+
+// sqliteMigrations holds the SQLite schema as ordered steps; entry i moves
+// the database from version i to i+1. Append new steps, never edit old ones
+var sqliteMigrations = [][]string{
+	sqliteSchema,
+}
+
+// sqliteSchema mirrors mysqlSchema with SQLite types. Indexes are separate
+// statements, and sessions.updated_at is set by UpdateSession
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS sessions (
+		id TEXT PRIMARY KEY,
+		call_id TEXT NOT NULL,
+		from_tag TEXT NOT NULL,
+		to_tag TEXT,
+		via_branch TEXT,
+		state TEXT NOT NULL DEFAULT 'new',
+		caller_ip TEXT,
+		caller_port INTEGER,
+		callee_ip TEXT,
+		callee_port INTEGER,
+		start_time DATETIME NOT NULL,
+		connect_time DATETIME,
+		end_time DATETIME,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_sessions_call_id ON sessions (call_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_sessions_state ON sessions (state)`,
+	`CREATE INDEX IF NOT EXISTS idx_sessions_start_time ON sessions (start_time)`,
+
+	`CREATE TABLE IF NOT EXISTS cdr (
+		id TEXT PRIMARY KEY,
+		session_id TEXT,
+		call_id TEXT NOT NULL,
+		from_tag TEXT,
+		to_tag TEXT,
+		caller_id TEXT,
+		callee_id TEXT,
+		caller_ip TEXT,
+		callee_ip TEXT,
+		start_time DATETIME NOT NULL,
+		connect_time DATETIME,
+		end_time DATETIME,
+		duration INTEGER DEFAULT 0,
+		billable_duration INTEGER DEFAULT 0,
+		termination_cause TEXT,
+		packets_sent INTEGER DEFAULT 0,
+		packets_recv INTEGER DEFAULT 0,
+		bytes_sent INTEGER DEFAULT 0,
+		bytes_recv INTEGER DEFAULT 0,
+		packets_lost INTEGER DEFAULT 0,
+		avg_jitter REAL DEFAULT 0,
+		max_jitter REAL DEFAULT 0,
+		packet_loss_rate REAL DEFAULT 0,
+		rtt REAL DEFAULT 0,
+		mos REAL DEFAULT 0,
+		recording_path TEXT,
+		metadata TEXT,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_cdr_session_id ON cdr (session_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_cdr_call_id ON cdr (call_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_cdr_start_time ON cdr (start_time)`,
+	`CREATE INDEX IF NOT EXISTS idx_cdr_end_time ON cdr (end_time)`,
+
+	`CREATE TABLE IF NOT EXISTS recordings (
+		id TEXT PRIMARY KEY,
+		session_id TEXT,
+		call_id TEXT,
+		file_path TEXT NOT NULL,
+		format TEXT NOT NULL DEFAULT 'wav',
+		mode TEXT NOT NULL DEFAULT 'mixed',
+		status TEXT NOT NULL DEFAULT 'pending',
+		start_time DATETIME NOT NULL,
+		end_time DATETIME,
+		duration INTEGER DEFAULT 0,
+		file_size INTEGER DEFAULT 0,
+		metadata TEXT,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_recordings_session_id ON recordings (session_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_recordings_call_id ON recordings (call_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_recordings_status ON recordings (status)`,
+	`CREATE INDEX IF NOT EXISTS idx_recordings_start_time ON recordings (start_time)`,
+
+	`CREATE TABLE IF NOT EXISTS api_keys (
+		id TEXT PRIMARY KEY,
+		key_hash TEXT UNIQUE NOT NULL,
+		name TEXT NOT NULL,
+		permissions TEXT NOT NULL,
+		rate_limit INTEGER DEFAULT 60,
+		enabled BOOLEAN DEFAULT TRUE,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		last_used DATETIME
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_api_keys_enabled ON api_keys (enabled)`,
+
+	`CREATE TABLE IF NOT EXISTS rtp_sessions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		call_id TEXT NOT NULL,
+		ssrc INTEGER NOT NULL,
+		codec TEXT,
+		packet_loss INTEGER DEFAULT 0,
+		jitter REAL DEFAULT 0,
+		start_time DATETIME NOT NULL,
+		end_time DATETIME,
+		packets_sent INTEGER DEFAULT 0,
+		packets_recv INTEGER DEFAULT 0,
+		bytes_sent INTEGER DEFAULT 0,
+		bytes_recv INTEGER DEFAULT 0
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_rtp_sessions_call_id ON rtp_sessions (call_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_rtp_sessions_ssrc ON rtp_sessions (ssrc)`,
+	`CREATE INDEX IF NOT EXISTS idx_rtp_sessions_start_time ON rtp_sessions (start_time)`,
+}
@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestSQLiteDatabase(t *testing.T) *RTPDatabase {
+	t.Helper()
+
+	db, err := NewRTPDatabase("sqlite://" + filepath.Join(t.TempDir(), "data", "karl.db"))
+	if err != nil {
+		t.Fatalf("NewRTPDatabase failed: %v", err)
+	}
+	t.Cleanup(db.Close)
+
+	if err := db.InitSchema(); err != nil {
+		t.Fatalf("InitSchema failed: %v", err)
+	}
+	return db
+}
+
+func TestSQLiteMigrate(t *testing.T) {
+	db := newTestSQLiteDatabase(t)
+
+	if db.Driver() != DriverSQLite {
+		t.Errorf("Driver() = %s, expected %s", db.Driver(), DriverSQLite)
+	}
+
+	var version int
+	if err := db.GetDB().QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		t.Fatalf("failed to read user_version: %v", err)
+	}
+	if version != len(sqliteMigrations) {
+		t.Errorf("schema version = %d, expected %d", version, len(sqliteMigrations))
+	}
+
+	// A second run finds nothing pending
+	if err := db.InitSchema(); err != nil {
+		t.Errorf("repeated InitSchema failed: %v", err)
+	}
+}
+
+func TestSQLiteSessionsAndCDRs(t *testing.T) {
+	db := newTestSQLiteDatabase(t)
+	start := time.Now().UTC().Truncate(time.Second)
+
+	session := &SessionRecord{
+		ID:         "sess-1",
+		CallID:     "call-1",
+		FromTag:    "from-1",
+		State:      "new",
+		CallerIP:   "192.0.2.10",
+		CallerPort: 30000,
+		StartTime:  start,
+	}
+	if err := db.InsertSession(session); err != nil {
+		t.Fatalf("InsertSession failed: %v", err)
+	}
+
+	connected := start.Add(2 * time.Second)
+	session.State = "active"
+	session.ToTag = "to-1"
+	session.ConnectTime = &connected
+	if err := db.UpdateSession(session); err != nil {
+		t.Fatalf("UpdateSession failed: %v", err)
+	}
+
+	got, err := db.GetSession("sess-1")
+	if err != nil {
+		t.Fatalf("GetSession failed: %v", err)
+	}
+	if got.State != "active" || got.ToTag != "to-1" || !got.StartTime.Equal(start) {
+		t.Errorf("GetSession returned %+v", got)
+	}
+	if got.ConnectTime == nil || !got.ConnectTime.Equal(connected) {
+		t.Errorf("ConnectTime = %v, expected %v", got.ConnectTime, connected)
+	}
+
+	cdr := &CDRRecord{
+		ID:          "cdr-1",
+		SessionID:   "sess-1",
+		CallID:      "call-1",
+		StartTime:   start,
+		Duration:    60,
+		PacketsSent: 3000,
+		MOS:         4.2,
+		Metadata:    map[string]string{"codec": "PCMU"},
+	}
+	if err := db.InsertCDR(cdr); err != nil {
+		t.Fatalf("InsertCDR failed: %v", err)
+	}
+
+	gotCDR, err := db.GetCDR("cdr-1")
+	if err != nil {
+		t.Fatalf("GetCDR failed: %v", err)
+	}
+	if gotCDR.PacketsSent != 3000 || gotCDR.MOS != 4.2 || gotCDR.Metadata["codec"] != "PCMU" {
+		t.Errorf("GetCDR returned %+v", gotCDR)
+	}
+
+	cdrs, err := db.ListCDRs("call-1", time.Time{}, time.Time{}, 10)
+	if err != nil {
+		t.Fatalf("ListCDRs failed: %v", err)
+	}
+	if len(cdrs) != 1 {
+		t.Errorf("ListCDRs returned %d records, expected 1", len(cdrs))
+	}
+
+	if err := db.InsertRTPStats("call-1", 0xdeadbeef, "PCMU", 2, 1.5); err != nil {
+		t.Fatalf("InsertRTPStats failed: %v", err)
+	}
+	active, err := db.GetActiveSessions()
+	if err != nil || len(active) != 1 {
+		t.Errorf("GetActiveSessions = %v, %v", active, err)
+	}
+
+	stats, err := db.GetAggregateStats()
+	if err != nil {
+		t.Fatalf("GetAggregateStats failed: %v", err)
+	}
+	if stats["total_sessions"] != 1 || stats["total_cdrs"] != 1 {
+		t.Errorf("GetAggregateStats = %v", stats)
+	}
+}
@@ -0,0 +1,204 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultDebugAddress keeps the debug listener on loopback
+const defaultDebugAddress = "127.0.0.1:6060"
+
+// DebugStatus is the /debug/status dump
+type DebugStatus struct {
+	Time       time.Time              `json:"time"`
+	Uptime     string                 `json:"uptime"`
+	Goroutines int                    `json:"goroutines"`
+	Subsystems map[string]int         `json:"goroutines_by_subsystem"`
+	Queues     map[string]QueueStatus `json:"queues"`
+	Sessions   *SessionSummary        `json:"sessions,omitempty"`
+}
+
+// QueueStatus is how full one queue is
+type QueueStatus struct {
+	Depth    int `json:"depth"`
+	Capacity int `json:"capacity"`
+}
+
+// SessionSummary counts the sessions in the registry
+type SessionSummary struct {
+	Total       int            `json:"total"`
+	ByState     map[string]int `json:"by_state"`
+	Recording   int            `json:"recording"`
+	Transcoding int            `json:"transcoding"`
+	OldestAge   string         `json:"oldest_age,omitempty"`
+}
+
+// ValidateDebugConfig checks the debug listen address and profile rates
+func ValidateDebugConfig(cfg *Config) error {
+	d := cfg.Debug
+	if d.Address != "" {
+		if _, _, err := net.SplitHostPort(d.Address); err != nil {
+			return fmt.Errorf("invalid debug.address %q: %v", d.Address, err)
+		}
+	}
+	if d.BlockProfileRate < 0 {
+		return fmt.Errorf("invalid debug.block_profile_rate %d", d.BlockProfileRate)
+	}
+	if d.MutexProfileFraction < 0 {
+		return fmt.Errorf("invalid debug.mutex_profile_fraction %d", d.MutexProfileFraction)
+	}
+	return nil
+}
+
+// CollectDebugStatus gathers the goroutine, queue and session figures; a
+// nil registry leaves out the sessions
+func CollectDebugStatus(registry *SessionRegistry) DebugStatus {
+	status := DebugStatus{
+		Time:       time.Now(),
+		Uptime:     time.Since(startTime).Round(time.Second).String(),
+		Goroutines: runtime.NumGoroutine(),
+		Subsystems: goroutinesBySubsystem(),
+		Queues:     queueStatuses(),
+	}
+	if registry != nil {
+		status.Sessions = summarizeSessions(registry)
+	}
+	return status
+}
+
+// statusHandler serves the debug status dump
+func (ps *PprofServer) statusHandler(w http.ResponseWriter, r *http.Request) {
+	ps.mu.RLock()
+	registry := ps.registry
+	ps.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(CollectDebugStatus(registry))
+}
+
+// goroutinesBySubsystem counts goroutines by the function they were started
+// in: the outermost karl frame of the stack, or the outermost frame for
+// goroutines that never enter karl code
+func goroutinesBySubsystem() map[string]int {
+	var buf bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 1); err != nil {
+		return nil
+	}
+	return parseGoroutineProfile(&buf)
+}
+
+// parseGoroutineProfile reads a goroutine profile written with debug=1,
+// where each stack is listed once with the number of goroutines on it
+func parseGoroutineProfile(profile *bytes.Buffer) map[string]int {
+	counts := make(map[string]int)
+	count, outermost, karl := 0, "", ""
+	flush := func() {
+		if count == 0 {
+			return
+		}
+		name := karl
+		if name == "" {
+			name = outermost
+		}
+		if name == "" {
+			name = "unknown"
+		}
+		counts[name] += count
+		count, outermost, karl = 0, "", ""
+	}
+
+	scanner := bufio.NewScanner(profile)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "#\t"):
+			// #	0x4b1d2f	karl/internal.(*X).run+0x8f	/path/file.go:123
+			fields := strings.Split(line, "\t")
+			if count == 0 || len(fields) < 3 {
+				continue
+			}
+			function, _, _ := strings.Cut(fields[2], "+0x")
+			outermost = function
+			if name, ok := strings.CutPrefix(function, "karl/"); ok {
+				karl = name
+			}
+		case strings.Contains(line, " @ "):
+			flush()
+			n, _, _ := strings.Cut(line, " @ ")
+			count, _ = strconv.Atoi(n)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return counts
+}
+
+// queueStatuses reports the RTP worker queues, summed over the workers,
+// and the webhook, event stream and alert queues
+func queueStatuses() map[string]QueueStatus {
+	queues := make(map[string]QueueStatus)
+	if jobs := rtpJobs.Load(); jobs != nil {
+		var bulk, priority QueueStatus
+		for _, q := range *jobs {
+			bulk.Depth += len(q.bulk.ch)
+			bulk.Capacity += cap(q.bulk.ch)
+			priority.Depth += len(q.priority.ch)
+			priority.Capacity += cap(q.priority.ch)
+		}
+		queues["rtp_"+laneBulk] = bulk
+		queues["rtp_"+lanePriority] = priority
+	}
+	if bus := eventBus.Load(); bus != nil {
+		for _, ep := range bus.endpoints {
+			// Endpoints on the same host are summed
+			q := queues["webhook:"+ep.host]
+			q.Depth += len(ep.queue)
+			q.Capacity += cap(ep.queue)
+			queues["webhook:"+ep.host] = q
+		}
+	}
+	if streamer := eventStreamer.Load(); streamer != nil {
+		for _, s := range streamer.streams {
+			queues["event_stream:"+s.name] = QueueStatus{Depth: len(s.queue), Capacity: cap(s.queue)}
+		}
+	}
+	queues["alerts"] = QueueStatus{Depth: len(alertChan), Capacity: cap(alertChan)}
+	return queues
+}
+
+// summarizeSessions counts the registry's sessions by state
+func summarizeSessions(registry *SessionRegistry) *SessionSummary {
+	summary := &SessionSummary{ByState: make(map[string]int)}
+	var oldest time.Time
+	for _, session := range registry.ListSessions() {
+		session.mu.RLock()
+		summary.Total++
+		summary.ByState[string(session.State)]++
+		if session.Recording != nil && session.Recording.Active {
+			summary.Recording++
+		}
+		if session.AlwaysTranscode || len(session.TranscodeCodecs) > 0 {
+			summary.Transcoding++
+		}
+		if oldest.IsZero() || session.CreatedAt.Before(oldest) {
+			oldest = session.CreatedAt
+		}
+		session.mu.RUnlock()
+	}
+	if !oldest.IsZero() {
+		summary.OldestAge = time.Since(oldest).Round(time.Second).String()
+	}
+	return summary
+}
@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// parkDebugGoroutine blocks until release is closed
+func parkDebugGoroutine(release chan struct{}) {
+	<-release
+}
+
+func TestDebugServer_Status(t *testing.T) {
+	registry := NewSessionRegistry(time.Hour)
+	defer registry.Stop()
+	registry.CreateSession("call-1", "from-1")
+	transcoded := registry.CreateSession("call-2", "from-2")
+	transcoded.mu.Lock()
+	transcoded.State = SessionStateActive
+	transcoded.AlwaysTranscode = true
+	transcoded.mu.Unlock()
+
+	release := make(chan struct{})
+	defer close(release)
+	for i := 0; i < 3; i++ {
+		go parkDebugGoroutine(release)
+	}
+
+	ps := NewPprofServer(PprofConfigFromDebug(&DebugConfig{Enabled: true, Address: "127.0.0.1:0"}))
+	ps.SetSessionRegistry(registry)
+	if err := ps.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Stop()
+
+	resp, err := http.Get("http://" + ps.Addr() + "/debug/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var status DebugStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := status.Subsystems["internal.parkDebugGoroutine"]; got != 3 {
+		t.Errorf("counted %d parked goroutines, want 3 in %v", got, status.Subsystems)
+	}
+	if status.Goroutines < 3 {
+		t.Errorf("%d goroutines in total", status.Goroutines)
+	}
+	if q, ok := status.Queues["alerts"]; !ok || q.Capacity != cap(alertChan) {
+		t.Errorf("alert queue %+v missing from %v", q, status.Queues)
+	}
+	s := status.Sessions
+	if s == nil || s.Total != 2 || s.ByState["active"] != 1 || s.Transcoding != 1 || s.OldestAge == "" {
+		t.Errorf("session summary %+v", s)
+	}
+
+	// pprof is served on the same listener
+	resp, err = http.Get("http://" + ps.Addr() + "/debug/pprof/goroutine?debug=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("pprof returned %d", resp.StatusCode)
+	}
+}
+
+func TestDebugServer_PortInUse(t *testing.T) {
+	first := NewPprofServer(&PprofConfig{Enabled: true, Port: "127.0.0.1:0"})
+	if err := first.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer first.Stop()
+
+	second := NewPprofServer(&PprofConfig{Enabled: true, Port: first.Addr()})
+	if err := second.Start(); err == nil {
+		second.Stop()
+		t.Fatal("expected the second server to fail to listen")
+	}
+}
+
+func TestValidateDebugConfig(t *testing.T) {
+	for _, tt := range []struct {
+		config DebugConfig
+		valid  bool
+	}{
+		{DebugConfig{}, true},
+		{DebugConfig{Enabled: true, Address: "127.0.0.1:6060", BlockProfileRate: 1, MutexProfileFraction: 5}, true},
+		{DebugConfig{Address: ":6060"}, true},
+		{DebugConfig{Address: "6060"}, false},
+		{DebugConfig{BlockProfileRate: -1}, false},
+		{DebugConfig{MutexProfileFraction: -1}, false},
+	} {
+		if err := ValidateDebugConfig(&Config{Debug: &tt.config}); (err == nil) != tt.valid {
+			t.Errorf("%+v: error %v", tt.config, err)
+		}
+	}
+}
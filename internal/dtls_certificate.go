@@ -0,0 +1,414 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// DTLS certificate errors
+var (
+	ErrFingerprintMismatch    = errors.New("remote certificate does not match the SDP fingerprint")
+	ErrUnsupportedFingerprint = errors.New("unsupported fingerprint hash function")
+	ErrNoPeerCertificate      = errors.New("remote sent no certificate")
+)
+
+const (
+	// dtlsCertCheckInterval is how often the certificate files are checked
+	// for renewal
+	dtlsCertCheckInterval = time.Hour
+
+	// dtlsCertCommonName is the subject of generated certificates
+	dtlsCertCommonName = "karl"
+)
+
+// DTLSCertificateManager holds the certificate Karl presents in DTLS-SRTP
+// handshakes, so every session advertises the same a=fingerprint. It
+// generates a self-signed certificate when none exists, persists it, renews
+// it before it expires and reloads it when the files are replaced.
+type DTLSCertificateManager struct {
+	config      DTLSCertConfig
+	certificate tls.Certificate
+	leaf        *x509.Certificate
+	fingerprint string // uppercase colon-separated SHA-256
+	modTime     time.Time
+	stop        chan struct{}
+	mu          sync.RWMutex
+}
+
+// NewDTLSCertificateManager loads the configured certificate, generating
+// and persisting one when the files do not exist. Without files the
+// certificate only lives in memory.
+func NewDTLSCertificateManager(config *DTLSCertConfig) (*DTLSCertificateManager, error) {
+	m := &DTLSCertificateManager{stop: make(chan struct{})}
+	if config != nil {
+		m.config = *config
+	}
+	if m.config.ValidityDays <= 0 {
+		m.config.ValidityDays = 365
+	}
+	if m.config.RenewBeforeDays <= 0 {
+		m.config.RenewBeforeDays = 30
+	}
+
+	if m.persistent() {
+		err := m.Reload()
+		if err == nil {
+			return m, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	if err := m.Renew(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// persistent reports whether the certificate is kept in files
+func (m *DTLSCertificateManager) persistent() bool {
+	return m.config.CertFile != "" && m.config.KeyFile != ""
+}
+
+// Reload reads the certificate and key files again, e.g. after an external
+// renewal
+func (m *DTLSCertificateManager) Reload() error {
+	if !m.persistent() {
+		return fmt.Errorf("no DTLS certificate files configured")
+	}
+	info, err := os.Stat(m.config.CertFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(m.config.CertFile, m.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load DTLS certificate: %w", err)
+	}
+	if err := m.set(cert, info.ModTime()); err != nil {
+		return err
+	}
+	log.Printf("DTLS certificate loaded from %s (fingerprint sha-256 %s)", m.config.CertFile, m.Fingerprint())
+	return nil
+}
+
+// Renew generates a new self-signed certificate and persists it when files
+// are configured
+func (m *DTLSCertificateManager) Renew() error {
+	cert, certPEM, keyPEM, err := generateDTLSCertificate(time.Duration(m.config.ValidityDays) * 24 * time.Hour)
+	if err != nil {
+		return err
+	}
+
+	modTime := time.Now()
+	if m.persistent() {
+		if err := writeDTLSCertificate(m.config.CertFile, m.config.KeyFile, certPEM, keyPEM); err != nil {
+			return err
+		}
+		if info, err := os.Stat(m.config.CertFile); err == nil {
+			modTime = info.ModTime()
+		}
+	}
+	if err := m.set(cert, modTime); err != nil {
+		return err
+	}
+	log.Printf("DTLS certificate generated (fingerprint sha-256 %s)", m.Fingerprint())
+	return nil
+}
+
+// set installs a certificate and its fingerprint
+func (m *DTLSCertificateManager) set(cert tls.Certificate, modTime time.Time) error {
+	if len(cert.Certificate) == 0 {
+		return fmt.Errorf("DTLS certificate is empty")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse DTLS certificate: %w", err)
+	}
+	cert.Leaf = leaf
+	sum := sha256.Sum256(leaf.Raw)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.certificate = cert
+	m.leaf = leaf
+	m.fingerprint = formatFingerprint(sum[:])
+	m.modTime = modTime
+	return nil
+}
+
+// Start checks periodically whether the certificate files were replaced or
+// the certificate is due for renewal
+func (m *DTLSCertificateManager) Start() {
+	go func() {
+		ticker := time.NewTicker(dtlsCertCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case now := <-ticker.C:
+				m.check(now)
+			}
+		}
+	}()
+}
+
+// Stop ends the renewal checks
+func (m *DTLSCertificateManager) Stop() {
+	select {
+	case <-m.stop:
+	default:
+		close(m.stop)
+	}
+}
+
+// check reloads replaced files and renews an expiring certificate
+func (m *DTLSCertificateManager) check(now time.Time) {
+	m.mu.RLock()
+	modTime := m.modTime
+	notAfter := m.leaf.NotAfter
+	m.mu.RUnlock()
+
+	if m.persistent() {
+		if info, err := os.Stat(m.config.CertFile); err == nil && !info.ModTime().Equal(modTime) {
+			if err := m.Reload(); err != nil {
+				log.Printf("Failed to reload DTLS certificate: %v", err)
+			}
+			return
+		}
+	}
+
+	renewAt := notAfter.Add(-time.Duration(m.config.RenewBeforeDays) * 24 * time.Hour)
+	if now.After(renewAt) {
+		if err := m.Renew(); err != nil {
+			log.Printf("Failed to renew DTLS certificate: %v", err)
+		}
+	}
+}
+
+// Certificate returns the current certificate
+func (m *DTLSCertificateManager) Certificate() tls.Certificate {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.certificate
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the current certificate as
+// used in SDP, e.g. "AB:CD:..."
+func (m *DTLSCertificateManager) Fingerprint() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.fingerprint
+}
+
+// SDPFingerprint returns the value of an a=fingerprint line for the
+// current certificate
+func (m *DTLSCertificateManager) SDPFingerprint() string {
+	return "sha-256 " + m.Fingerprint()
+}
+
+// NotAfter returns when the current certificate expires
+func (m *DTLSCertificateManager) NotAfter() time.Time {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.leaf.NotAfter
+}
+
+// WebRTCCertificate returns the certificate for pion peer connections
+func (m *DTLSCertificateManager) WebRTCCertificate() (webrtc.Certificate, error) {
+	m.mu.RLock()
+	cert := m.certificate
+	m.mu.RUnlock()
+
+	if cert.PrivateKey == nil {
+		return webrtc.Certificate{}, fmt.Errorf("DTLS certificate has no private key")
+	}
+	return webrtc.CertificateFromX509(cert.PrivateKey, cert.Leaf), nil
+}
+
+// SessionConfig returns a DTLS session config presenting the managed
+// certificate. The peer's SDP fingerprint is checked unless verification is
+// turned off.
+func (m *DTLSCertificateManager) SessionConfig(addr, remoteFingerprint string) DTLSConfig {
+	config := DefaultDTLSConfig()
+	config.Address = addr
+	config.Certificates = m
+	if m.config.VerifyFingerprint {
+		config.RemoteFingerprint = remoteFingerprint
+	}
+	return config
+}
+
+// VerifyPeerFingerprint returns a DTLS peer certificate check that accepts
+// only the certificate announced by an SDP a=fingerprint value such as
+// "sha-256 AB:CD:...". Self-signed WebRTC certificates cannot be chain
+// verified; the fingerprint binds the handshake to the signaled identity.
+func VerifyPeerFingerprint(sdpFingerprint string) (func(rawCerts [][]byte, _ [][]*x509.Certificate) error, error) {
+	algorithm, value, ok := strings.Cut(strings.TrimSpace(sdpFingerprint), " ")
+	if !ok {
+		return nil, fmt.Errorf("malformed fingerprint %q", sdpFingerprint)
+	}
+	newHash, err := fingerprintHash(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	expected, err := hex.DecodeString(strings.ReplaceAll(strings.TrimSpace(value), ":", ""))
+	if err != nil {
+		return nil, fmt.Errorf("malformed fingerprint %q: %w", sdpFingerprint, err)
+	}
+
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return ErrNoPeerCertificate
+		}
+		h := newHash()
+		h.Write(rawCerts[0])
+		if !bytes.Equal(h.Sum(nil), expected) {
+			return ErrFingerprintMismatch
+		}
+		return nil
+	}, nil
+}
+
+// fingerprintHash returns the hash function named in an a=fingerprint line
+func fingerprintHash(algorithm string) (func() hash.Hash, error) {
+	switch strings.ToLower(algorithm) {
+	case "sha-1":
+		return sha1.New, nil
+	case "sha-224":
+		return sha256.New224, nil
+	case "sha-256":
+		return sha256.New, nil
+	case "sha-384":
+		return sha512.New384, nil
+	case "sha-512":
+		return sha512.New, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedFingerprint, algorithm)
+	}
+}
+
+// formatFingerprint formats a digest as uppercase colon-separated hex
+func formatFingerprint(sum []byte) string {
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// generateDTLSCertificate creates a self-signed ECDSA P-256 certificate, the
+// key type browsers use for WebRTC
+func generateDTLSCertificate(validity time.Duration) (tls.Certificate, []byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, nil, fmt.Errorf("failed to generate DTLS key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 62))
+	if err != nil {
+		return tls.Certificate{}, nil, nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: dtlsCertCommonName},
+		NotBefore:    now.Add(-time.Hour), // Tolerate peers with clock skew
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, nil, fmt.Errorf("failed to create DTLS certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, nil, nil, fmt.Errorf("failed to encode DTLS key: %w", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, nil, nil, err
+	}
+	return cert, certPEM, keyPEM, nil
+}
+
+// writeDTLSCertificate persists a certificate and key, replacing the files
+// atomically so a concurrent reload never sees half a pair
+func writeDTLSCertificate(certFile, keyFile string, certPEM, keyPEM []byte) error {
+	for _, file := range []struct {
+		path string
+		data []byte
+		mode os.FileMode
+	}{
+		{keyFile, keyPEM, 0600},
+		{certFile, certPEM, 0644},
+	} {
+		if err := os.MkdirAll(filepath.Dir(file.path), 0755); err != nil {
+			return fmt.Errorf("failed to create %s: %w", filepath.Dir(file.path), err)
+		}
+		tmp := file.path + ".tmp"
+		if err := os.WriteFile(tmp, file.data, file.mode); err != nil {
+			return fmt.Errorf("failed to write %s: %w", tmp, err)
+		}
+		if err := os.Rename(tmp, file.path); err != nil {
+			return fmt.Errorf("failed to replace %s: %w", file.path, err)
+		}
+	}
+	return nil
+}
+
+// Process-wide certificate used by WebRTC sessions and SDP answers
+var (
+	defaultDTLSCertificates *DTLSCertificateManager
+	defaultDTLSMu           sync.Mutex
+)
+
+// SetDefaultDTLSCertificates sets the certificate manager used by WebRTC
+// sessions and by SDP that Karl writes for DTLS legs
+func SetDefaultDTLSCertificates(m *DTLSCertificateManager) {
+	defaultDTLSMu.Lock()
+	defer defaultDTLSMu.Unlock()
+	defaultDTLSCertificates = m
+}
+
+// DefaultDTLSCertificates returns the process-wide certificate manager,
+// generating an in-memory certificate if none was configured
+func DefaultDTLSCertificates() (*DTLSCertificateManager, error) {
+	defaultDTLSMu.Lock()
+	defer defaultDTLSMu.Unlock()
+
+	if defaultDTLSCertificates == nil {
+		m, err := NewDTLSCertificateManager(nil)
+		if err != nil {
+			return nil, err
+		}
+		defaultDTLSCertificates = m
+	}
+	return defaultDTLSCertificates, nil
+}
@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var fingerprintPattern = regexp.MustCompile(`^sha-256 ([0-9A-F]{2}:){31}[0-9A-F]{2}$`)
+
+func TestDTLSCertificateManager_GenerateAndPersist(t *testing.T) {
+	dir := t.TempDir()
+	config := &DTLSCertConfig{
+		CertFile: filepath.Join(dir, "dtls", "cert.pem"),
+		KeyFile:  filepath.Join(dir, "dtls", "key.pem"),
+	}
+
+	m, err := NewDTLSCertificateManager(config)
+	if err != nil {
+		t.Fatalf("NewDTLSCertificateManager failed: %v", err)
+	}
+	if !fingerprintPattern.MatchString(m.SDPFingerprint()) {
+		t.Errorf("unexpected fingerprint %q", m.SDPFingerprint())
+	}
+	if d := time.Until(m.NotAfter()); d < 364*24*time.Hour {
+		t.Errorf("expected a year of validity, got %v", d)
+	}
+	info, err := os.Stat(config.KeyFile)
+	if err != nil {
+		t.Fatalf("key was not persisted: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected key mode 0600, got %v", info.Mode().Perm())
+	}
+
+	// A restart loads the same certificate
+	again, err := NewDTLSCertificateManager(config)
+	if err != nil {
+		t.Fatalf("reloading failed: %v", err)
+	}
+	if again.Fingerprint() != m.Fingerprint() {
+		t.Error("expected the persisted certificate to be reused")
+	}
+
+	if _, err := m.WebRTCCertificate(); err != nil {
+		t.Errorf("WebRTCCertificate failed: %v", err)
+	}
+}
+
+func TestDTLSCertificateManager_Renewal(t *testing.T) {
+	dir := t.TempDir()
+	config := &DTLSCertConfig{
+		CertFile:        filepath.Join(dir, "cert.pem"),
+		KeyFile:         filepath.Join(dir, "key.pem"),
+		ValidityDays:    10,
+		RenewBeforeDays: 2,
+	}
+	m, err := NewDTLSCertificateManager(config)
+	if err != nil {
+		t.Fatalf("NewDTLSCertificateManager failed: %v", err)
+	}
+	first := m.Fingerprint()
+
+	// Nothing to do well before expiry
+	m.check(time.Now())
+	if m.Fingerprint() != first {
+		t.Fatal("expected the certificate to be kept")
+	}
+
+	// Inside the renewal window a new certificate is generated
+	m.check(time.Now().Add(9 * 24 * time.Hour))
+	renewed := m.Fingerprint()
+	if renewed == first {
+		t.Fatal("expected the certificate to be renewed")
+	}
+
+	// Files replaced by another process are picked up
+	other, err := NewDTLSCertificateManager(&DTLSCertConfig{
+		CertFile: filepath.Join(dir, "other-cert.pem"),
+		KeyFile:  filepath.Join(dir, "other-key.pem"),
+	})
+	if err != nil {
+		t.Fatalf("NewDTLSCertificateManager failed: %v", err)
+	}
+	for _, name := range []string{"cert.pem", "key.pem"} {
+		data, _ := os.ReadFile(filepath.Join(dir, "other-"+name))
+		os.WriteFile(filepath.Join(dir, name), data, 0600)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(config.CertFile, later, later)
+	m.check(time.Now())
+	if m.Fingerprint() != other.Fingerprint() {
+		t.Error("expected the replaced certificate to be reloaded")
+	}
+}
+
+func TestVerifyPeerFingerprint(t *testing.T) {
+	m, err := NewDTLSCertificateManager(nil)
+	if err != nil {
+		t.Fatalf("NewDTLSCertificateManager failed: %v", err)
+	}
+	raw := m.Certificate().Certificate[0]
+
+	verify, err := VerifyPeerFingerprint(m.SDPFingerprint())
+	if err != nil {
+		t.Fatalf("VerifyPeerFingerprint failed: %v", err)
+	}
+	if err := verify([][]byte{raw}, nil); err != nil {
+		t.Errorf("expected the announced certificate to verify, got %v", err)
+	}
+	if err := verify(nil, nil); err != ErrNoPeerCertificate {
+		t.Errorf("expected ErrNoPeerCertificate, got %v", err)
+	}
+
+	other, _ := NewDTLSCertificateManager(nil)
+	if err := verify([][]byte{other.Certificate().Certificate[0]}, nil); err != ErrFingerprintMismatch {
+		t.Errorf("expected ErrFingerprintMismatch, got %v", err)
+	}
+
+	// Other hash functions and lowercase hex are accepted
+	sum := sha1.Sum(raw)
+	verify, err = VerifyPeerFingerprint("SHA-1 " + strings.ToLower(formatFingerprint(sum[:])))
+	if err != nil {
+		t.Fatalf("VerifyPeerFingerprint failed: %v", err)
+	}
+	if err := verify([][]byte{raw}, nil); err != nil {
+		t.Errorf("expected sha-1 fingerprint to verify, got %v", err)
+	}
+
+	if _, err := VerifyPeerFingerprint("md5 " + hex.EncodeToString(sum[:16])); err == nil {
+		t.Error("expected md5 to be rejected")
+	}
+	if _, err := VerifyPeerFingerprint("sha-256"); err == nil {
+		t.Error("expected a fingerprint without a value to be rejected")
+	}
+}
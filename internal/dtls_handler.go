@@ -51,6 +51,8 @@ type DTLSConfig struct {
 	LogKeys            bool
 	MTU                int // Maximum Transmission Unit
 	RetransmitInterval time.Duration
+	Certificates       *DTLSCertificateManager // Used instead of CertFile/KeyFile when set
+	RemoteFingerprint  string                  // SDP a=fingerprint of the peer, checked when set
 }
 
 // DefaultDTLSConfig returns a DTLSConfig with sensible defaults
@@ -126,7 +128,7 @@ func StartDTLSSession(ctx context.Context, certFile, keyFile, addr string) (*DTL
 // StartDTLSSessionWithConfig initializes a DTLS-SRTP session with custom configuration
 func StartDTLSSessionWithConfig(ctx context.Context, config DTLSConfig) (*DTLSSession, error) {
 	// Input validation
-	if config.CertFile == "" || config.KeyFile == "" {
+	if config.Certificates == nil && (config.CertFile == "" || config.KeyFile == "") {
 		return nil, &DTLSError{Op: "validate", Err: errors.New("certificate and key files required")}
 	}
 	if config.Address == "" {
@@ -136,10 +138,16 @@ func StartDTLSSessionWithConfig(ctx context.Context, config DTLSConfig) (*DTLSSe
 	log.Println("🔒 Starting DTLS-SRTP handshake...")
 
 	// Load DTLS certificate
-	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
-	if err != nil {
-		log.Printf("❌ Failed to load DTLS certificate: %v", err)
-		return nil, &DTLSError{Op: "certificate_load", Err: err}
+	var cert tls.Certificate
+	if config.Certificates != nil {
+		cert = config.Certificates.Certificate()
+	} else {
+		var err error
+		cert, err = tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			log.Printf("❌ Failed to load DTLS certificate: %v", err)
+			return nil, &DTLSError{Op: "certificate_load", Err: err}
+		}
 	}
 
 	// Configure DTLS
@@ -157,6 +165,17 @@ func StartDTLSSessionWithConfig(ctx context.Context, config DTLSConfig) (*DTLSSe
 		FlightInterval:     config.RetransmitInterval,
 	}
 
+	// Bind the handshake to the certificate announced in the SDP
+	if config.RemoteFingerprint != "" {
+		verify, err := VerifyPeerFingerprint(config.RemoteFingerprint)
+		if err != nil {
+			return nil, &DTLSError{Op: "fingerprint", Err: err}
+		}
+		dtlsConfig.ClientAuth = dtls.RequireAnyClientCert
+		dtlsConfig.InsecureSkipVerify = true
+		dtlsConfig.VerifyPeerCertificate = verify
+	}
+
 	// Resolve UDP address
 	udpAddr, err := net.ResolveUDPAddr("udp", config.Address)
 	if err != nil {
@@ -0,0 +1,608 @@
+package internal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/pion/rtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// DTMF metrics
+var dtmfEventsTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "karl_dtmf_events_total",
+		Help: "Total DTMF digits handled by mode (relayed, synthesized, detected)",
+	},
+	[]string{"mode"},
+)
+
+const (
+	// defaultTelephoneEventPT is the payload type most endpoints use for RFC 4733
+	defaultTelephoneEventPT = 101
+
+	// telephoneEventSize is the size of an RFC 4733 event payload
+	telephoneEventSize = 4
+
+	// dtmfBlockSize is the Goertzel block length (~25.6ms at 8kHz)
+	dtmfBlockSize = 205
+
+	// dtmfEndRetransmits is how many times the final event packet is sent
+	dtmfEndRetransmits = 3
+
+	// dtmfDefaultVolume is the tone level in -dBm0 used for detected digits
+	dtmfDefaultVolume = 10
+)
+
+// dtmfRowFreqs and dtmfColFreqs are the DTMF keypad frequencies in Hz
+var (
+	dtmfRowFreqs = [4]float64{697, 770, 852, 941}
+	dtmfColFreqs = [4]float64{1209, 1336, 1477, 1633}
+	dtmfKeypad   = [4][4]byte{
+		{'1', '2', '3', 'A'},
+		{'4', '5', '6', 'B'},
+		{'7', '8', '9', 'C'},
+		{'*', '0', '#', 'D'},
+	}
+)
+
+// TelephoneEvent is an RFC 4733 named telephone event payload
+type TelephoneEvent struct {
+	Event    uint8  // 0-9, 10 (*), 11 (#), 12-15 (A-D)
+	End      bool   // Final packet(s) for the event
+	Volume   uint8  // Power level in -dBm0 (0-63)
+	Duration uint16 // Duration in timestamp units since the event began
+}
+
+// ParseTelephoneEvent decodes an RFC 4733 event payload
+func ParseTelephoneEvent(payload []byte) (*TelephoneEvent, error) {
+	if len(payload) < telephoneEventSize {
+		return nil, fmt.Errorf("telephone-event payload too short: %d bytes", len(payload))
+	}
+	return &TelephoneEvent{
+		Event:    payload[0],
+		End:      payload[1]&0x80 != 0,
+		Volume:   payload[1] & 0x3F,
+		Duration: binary.BigEndian.Uint16(payload[2:4]),
+	}, nil
+}
+
+// Marshal encodes the event as an RFC 4733 payload
+func (e *TelephoneEvent) Marshal() []byte {
+	buf := make([]byte, telephoneEventSize)
+	buf[0] = e.Event
+	buf[1] = e.Volume & 0x3F
+	if e.End {
+		buf[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(buf[2:4], e.Duration)
+	return buf
+}
+
+// DTMFDigitToEvent maps a keypad digit to its RFC 4733 event code
+func DTMFDigitToEvent(digit byte) (uint8, bool) {
+	switch {
+	case digit >= '0' && digit <= '9':
+		return digit - '0', true
+	case digit == '*':
+		return 10, true
+	case digit == '#':
+		return 11, true
+	case digit >= 'A' && digit <= 'D':
+		return 12 + digit - 'A', true
+	case digit >= 'a' && digit <= 'd':
+		return 12 + digit - 'a', true
+	}
+	return 0, false
+}
+
+// DTMFEventToDigit maps an RFC 4733 event code to its keypad digit
+func DTMFEventToDigit(event uint8) (byte, bool) {
+	switch {
+	case event <= 9:
+		return '0' + event, true
+	case event == 10:
+		return '*', true
+	case event == 11:
+		return '#', true
+	case event <= 15:
+		return 'A' + event - 12, true
+	}
+	return 0, false
+}
+
+// dtmfFrequencies returns the row and column frequency of a digit
+func dtmfFrequencies(digit byte) (row, col float64, ok bool) {
+	for r := range dtmfKeypad {
+		for c := range dtmfKeypad[r] {
+			if dtmfKeypad[r][c] == digit {
+				return dtmfRowFreqs[r], dtmfColFreqs[c], true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// GenerateDTMFTone synthesizes count samples of a dual-tone digit starting at
+// sample offset, so consecutive calls produce a continuous waveform
+func GenerateDTMFTone(digit byte, sampleRate int, offset, count int, volume uint8) []int16 {
+	samples := make([]int16, count)
+	row, col, ok := dtmfFrequencies(digit)
+	if !ok || sampleRate <= 0 {
+		return samples
+	}
+
+	// Each tone is half of the composite level; 3.14 dBm0 is full scale for G.711
+	amplitude := 32767 * math.Pow(10, (-float64(volume)-3.14)/20) / 2
+	for i := range samples {
+		t := float64(offset+i) / float64(sampleRate)
+		v := amplitude * (math.Sin(2*math.Pi*row*t) + math.Sin(2*math.Pi*col*t))
+		samples[i] = int16(v)
+	}
+	return samples
+}
+
+// DTMFDetection reports the start or end of an inband digit
+type DTMFDetection struct {
+	Digit byte
+	Ended bool
+}
+
+// DTMFDetector finds inband DTMF digits with Goertzel filters
+type DTMFDetector struct {
+	sampleRate int
+	rows       [4]*GoertzelFilter
+	cols       [4]*GoertzelFilter
+	block      []int16
+
+	// Debounce state: a digit must be seen in two consecutive blocks
+	candidate byte
+	active    byte
+	misses    int
+}
+
+// NewDTMFDetector creates a detector for the given sample rate
+func NewDTMFDetector(sampleRate int) *DTMFDetector {
+	if sampleRate <= 0 {
+		sampleRate = 8000
+	}
+	d := &DTMFDetector{
+		sampleRate: sampleRate,
+		block:      make([]int16, 0, dtmfBlockSize),
+	}
+	for i := range dtmfRowFreqs {
+		d.rows[i] = NewGoertzelFilter(dtmfRowFreqs[i], sampleRate, dtmfBlockSize)
+		d.cols[i] = NewGoertzelFilter(dtmfColFreqs[i], sampleRate, dtmfBlockSize)
+	}
+	return d
+}
+
+// Active returns the digit currently being detected, or 0
+func (d *DTMFDetector) Active() byte {
+	return d.active
+}
+
+// Process feeds PCM samples and returns digit start/end transitions
+func (d *DTMFDetector) Process(samples []int16) []DTMFDetection {
+	var detections []DTMFDetection
+	for _, s := range samples {
+		d.block = append(d.block, s)
+		if len(d.block) < dtmfBlockSize {
+			continue
+		}
+
+		digit := d.analyzeBlock()
+		d.block = d.block[:0]
+
+		if digit != 0 && digit == d.active {
+			d.misses = 0
+			continue
+		}
+
+		// Ending requires two blocks without the active digit
+		if d.active != 0 {
+			d.misses++
+			if d.misses < 2 && digit == 0 {
+				continue
+			}
+			detections = append(detections, DTMFDetection{Digit: d.active, Ended: true})
+			d.active = 0
+			d.misses = 0
+		}
+
+		if digit != 0 && digit == d.candidate {
+			d.active = digit
+			d.candidate = 0
+			detections = append(detections, DTMFDetection{Digit: digit})
+		} else {
+			d.candidate = digit
+		}
+	}
+	return detections
+}
+
+// analyzeBlock returns the digit present in the current block, or 0
+func (d *DTMFDetector) analyzeBlock() byte {
+	var rowMag, colMag [4]float64
+	var power float64
+	for _, s := range d.block {
+		v := float64(s)
+		power += v * v
+		for i := range d.rows {
+			d.rows[i].Process(v)
+			d.cols[i].Process(v)
+		}
+	}
+	power /= float64(len(d.block))
+
+	for i := range d.rows {
+		rowMag[i] = d.rows[i].GetMagnitude()
+		colMag[i] = d.cols[i].GetMagnitude()
+		d.rows[i].Reset()
+		d.cols[i].Reset()
+	}
+
+	row, rowSecond := strongest(rowMag)
+	col, colSecond := strongest(colMag)
+
+	// Minimum level (roughly -30 dBm0 per tone)
+	const minMagnitude = 100
+	if rowMag[row] < minMagnitude || colMag[col] < minMagnitude {
+		return 0
+	}
+
+	// Each group's peak must dominate the rest of its group
+	if rowMag[row] < 4*rowSecond || colMag[col] < 4*colSecond {
+		return 0
+	}
+
+	// Twist between the two tones must stay within about 8dB
+	if rowMag[row] > 2.5*colMag[col] || colMag[col] > 2.5*rowMag[row] {
+		return 0
+	}
+
+	// Magnitude is half the tone amplitude, so tone power is 2*mag^2;
+	// the two tones must carry most of the signal energy
+	tonePower := 2 * (rowMag[row]*rowMag[row] + colMag[col]*colMag[col])
+	if power == 0 || tonePower/power < 0.6 {
+		return 0
+	}
+
+	return dtmfKeypad[row][col]
+}
+
+// strongest returns the index of the largest magnitude and the runner-up value
+func strongest(mags [4]float64) (int, float64) {
+	best := 0
+	for i := 1; i < len(mags); i++ {
+		if mags[i] > mags[best] {
+			best = i
+		}
+	}
+	var second float64
+	for i, m := range mags {
+		if i != best && m > second {
+			second = m
+		}
+	}
+	return best, second
+}
+
+// DTMFRelayConfig describes what each side of a media direction negotiated
+type DTMFRelayConfig struct {
+	InputEventPT     uint8  // telephone-event PT from the sender, 0 if not negotiated
+	OutputEventPT    uint8  // telephone-event PT toward the receiver, 0 if not negotiated
+	InputAudioCodec  string // Sender's audio codec, used for inband detection
+	OutputAudioCodec string // Receiver's audio codec, used for tone synthesis
+	OutputAudioPT    uint8
+	ClockRate        uint32
+}
+
+// DTMFRelay converts DTMF for one media direction: it relays RFC 4733 events
+// between legs that both negotiated telephone-event, synthesizes inband tones
+// for receivers without it, and turns inband tones into events for receivers
+// that have it
+type DTMFRelay struct {
+	config   DTMFRelayConfig
+	detector *DTMFDetector
+
+	// Sequence numbers shift as packets are inserted or dropped
+	seqDelta uint16
+
+	// State for the last RFC 4733 event received; retransmitted end
+	// packets share its timestamp
+	eventTimestamp uint32
+	eventSeen      bool
+	synthGenerated int
+
+	// Event generation state for a detected inband digit
+	detectTimestamp uint32
+	detectEvent     uint8
+
+	onDigit func(digit byte)
+	mu      sync.Mutex
+}
+
+// NewDTMFRelay creates a relay for one media direction
+func NewDTMFRelay(config DTMFRelayConfig) *DTMFRelay {
+	if config.ClockRate == 0 {
+		config.ClockRate = 8000
+	}
+	relay := &DTMFRelay{config: config}
+	if config.InputEventPT == 0 && config.OutputEventPT != 0 && isG711(config.InputAudioCodec) {
+		relay.detector = NewDTMFDetector(int(config.ClockRate))
+	}
+	return relay
+}
+
+// NewDTMFRelayForLegs builds a relay for media flowing from one leg to another
+// from the codecs each leg negotiated
+func NewDTMFRelayForLegs(from, to *CallLeg) *DTMFRelay {
+	config := DTMFRelayConfig{}
+	config.InputEventPT, _ = telephoneEventPT(from.Codecs)
+	config.OutputEventPT, _ = telephoneEventPT(to.Codecs)
+	if audio, ok := firstAudioCodec(from.Codecs); ok {
+		config.InputAudioCodec = audio.Name
+		config.ClockRate = audio.ClockRate
+	}
+	if audio, ok := firstAudioCodec(to.Codecs); ok {
+		config.OutputAudioCodec = audio.Name
+		config.OutputAudioPT = audio.PayloadType
+	}
+	return NewDTMFRelay(config)
+}
+
+// SetDigitHandler sets a callback invoked once per digit seen in either form
+func (r *DTMFRelay) SetDigitHandler(handler func(digit byte)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onDigit = handler
+}
+
+// Process takes a packet from the sending leg and returns the packets to
+// forward to the receiving leg
+func (r *DTMFRelay) Process(pkt *rtp.Packet) []*rtp.Packet {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var out []*rtp.Packet
+	switch {
+	case r.config.InputEventPT != 0 && pkt.PayloadType == r.config.InputEventPT:
+		out = r.handleEvent(pkt)
+	case r.eventSeen && inTimestampRange(pkt.Timestamp, r.eventTimestamp, r.synthGenerated):
+		// Sender audio overlapping a synthesized tone is replaced by the tone
+		out = nil
+	case r.detector != nil:
+		out = r.detectInband(pkt)
+	default:
+		out = []*rtp.Packet{pkt}
+	}
+
+	// Renumber so inserted or dropped packets leave no gaps
+	for i, p := range out {
+		p.SequenceNumber = pkt.SequenceNumber + r.seqDelta + uint16(i)
+	}
+	r.seqDelta += uint16(len(out)) - 1
+	return out
+}
+
+// handleEvent relays or synthesizes an incoming RFC 4733 event packet
+func (r *DTMFRelay) handleEvent(pkt *rtp.Packet) []*rtp.Packet {
+	event, err := ParseTelephoneEvent(pkt.Payload)
+	if err != nil {
+		return nil
+	}
+
+	isNew := !r.eventSeen || pkt.Timestamp != r.eventTimestamp
+	if isNew {
+		r.eventSeen = true
+		r.eventTimestamp = pkt.Timestamp
+		r.synthGenerated = 0
+	}
+	if isNew && r.onDigit != nil {
+		if digit, ok := DTMFEventToDigit(event.Event); ok {
+			r.onDigit(digit)
+		}
+	}
+
+	// Both sides speak RFC 4733: relay with the receiver's payload type
+	if r.config.OutputEventPT != 0 {
+		if isNew {
+			dtmfEventsTotal.WithLabelValues("relayed").Inc()
+		}
+		relayed := *pkt
+		relayed.Header = pkt.Header.Clone()
+		relayed.PayloadType = r.config.OutputEventPT
+		return []*rtp.Packet{&relayed}
+	}
+
+	// Receiver has no telephone-event: play the digit inband
+	digit, ok := DTMFEventToDigit(event.Event)
+	if !ok || !isG711(r.config.OutputAudioCodec) {
+		return nil
+	}
+	if isNew {
+		dtmfEventsTotal.WithLabelValues("synthesized").Inc()
+	}
+
+	// Generate only the part of the event not yet played out
+	remaining := int(event.Duration) - r.synthGenerated
+	if remaining <= 0 {
+		return nil
+	}
+	tone := GenerateDTMFTone(digit, int(r.config.ClockRate), r.synthGenerated, remaining, event.Volume)
+	audio := &rtp.Packet{
+		Header: rtp.Header{
+			Version:     2,
+			PayloadType: r.config.OutputAudioPT,
+			Timestamp:   r.eventTimestamp + uint32(r.synthGenerated),
+			SSRC:        pkt.SSRC,
+			Marker:      r.synthGenerated == 0,
+		},
+		Payload: encodeG711(r.config.OutputAudioCodec, tone),
+	}
+	r.synthGenerated += remaining
+	return []*rtp.Packet{audio}
+}
+
+// detectInband looks for tones in sender audio and emits RFC 4733 events
+// for them, silencing the tone in the forwarded audio
+func (r *DTMFRelay) detectInband(pkt *rtp.Packet) []*rtp.Packet {
+	samples := decodeG711(r.config.InputAudioCodec, pkt.Payload)
+	out := []*rtp.Packet{pkt}
+
+	for _, d := range r.detector.Process(samples) {
+		event, _ := DTMFDigitToEvent(d.Digit)
+		if !d.Ended {
+			dtmfEventsTotal.WithLabelValues("detected").Inc()
+			if r.onDigit != nil {
+				r.onDigit(d.Digit)
+			}
+			r.detectTimestamp = pkt.Timestamp
+			r.detectEvent = event
+			out = append(out, r.eventPacket(pkt, false, true))
+			continue
+		}
+		for i := 0; i < dtmfEndRetransmits; i++ {
+			out = append(out, r.eventPacket(pkt, true, false))
+		}
+	}
+
+	if r.detector.Active() != 0 {
+		// Keep the event alive and strip the tone from the audio
+		silenced := *pkt
+		silenced.Payload = encodeG711(r.config.InputAudioCodec, make([]int16, len(samples)))
+		out[0] = &silenced
+		if len(out) == 1 {
+			out = append(out, r.eventPacket(pkt, false, false))
+		}
+	}
+	return out
+}
+
+// eventPacket builds an RFC 4733 packet for the digit being detected
+func (r *DTMFRelay) eventPacket(pkt *rtp.Packet, end, marker bool) *rtp.Packet {
+	duration := pkt.Timestamp - r.detectTimestamp + uint32(len(pkt.Payload))
+	if duration > math.MaxUint16 {
+		duration = math.MaxUint16
+	}
+	event := &TelephoneEvent{
+		Event:    r.detectEvent,
+		End:      end,
+		Volume:   dtmfDefaultVolume,
+		Duration: uint16(duration),
+	}
+	return &rtp.Packet{
+		Header: rtp.Header{
+			Version:     2,
+			PayloadType: r.config.OutputEventPT,
+			Timestamp:   r.detectTimestamp,
+			SSRC:        pkt.SSRC,
+			Marker:      marker,
+		},
+		Payload: event.Marshal(),
+	}
+}
+
+// GenerateTelephoneEvents builds the RFC 4733 packet train for one digit,
+// with an update every packetTime units and the end packet sent three times
+func GenerateTelephoneEvents(digit byte, payloadType uint8, ssrc, timestamp uint32, duration, packetTime uint16, volume uint8) ([]*rtp.Packet, error) {
+	event, ok := DTMFDigitToEvent(digit)
+	if !ok {
+		return nil, fmt.Errorf("invalid DTMF digit: %q", digit)
+	}
+	if packetTime == 0 {
+		packetTime = 160
+	}
+
+	var packets []*rtp.Packet
+	build := func(d uint16, end, marker bool) {
+		te := &TelephoneEvent{Event: event, End: end, Volume: volume, Duration: d}
+		packets = append(packets, &rtp.Packet{
+			Header: rtp.Header{
+				Version:     2,
+				PayloadType: payloadType,
+				Timestamp:   timestamp,
+				SSRC:        ssrc,
+				Marker:      marker,
+			},
+			Payload: te.Marshal(),
+		})
+	}
+
+	for d := packetTime; d < duration; d += packetTime {
+		build(d, false, d == packetTime)
+	}
+	for i := 0; i < dtmfEndRetransmits; i++ {
+		build(duration, true, len(packets) == 0)
+	}
+	return packets, nil
+}
+
+// telephoneEventPT finds the negotiated telephone-event payload type
+func telephoneEventPT(codecs []CodecInfo) (uint8, bool) {
+	for _, c := range codecs {
+		if strings.EqualFold(c.Name, "telephone-event") {
+			return c.PayloadType, true
+		}
+	}
+	return 0, false
+}
+
+// firstAudioCodec returns the first negotiated codec that carries audio
+func firstAudioCodec(codecs []CodecInfo) (CodecInfo, bool) {
+	for _, c := range codecs {
+		name := strings.ToLower(c.Name)
+		if name == "telephone-event" || name == "cn" || strings.HasPrefix(name, FlexFECMimeSubtype) {
+			continue
+		}
+		return c, true
+	}
+	return CodecInfo{}, false
+}
+
+// inTimestampRange reports whether ts falls within [start, start+length)
+func inTimestampRange(ts, start uint32, length int) bool {
+	return ts-start < uint32(length)
+}
+
+// isG711 reports whether a codec can be decoded for inband DTMF
+func isG711(codec string) bool {
+	switch strings.ToUpper(codec) {
+	case "PCMU", "PCMA":
+		return true
+	}
+	return false
+}
+
+// decodeG711 converts a G.711 payload to linear PCM
+func decodeG711(codec string, payload []byte) []int16 {
+	samples := make([]int16, len(payload))
+	alaw := strings.EqualFold(codec, "PCMA")
+	for i, b := range payload {
+		if alaw {
+			samples[i] = AlawToLinear(b)
+		} else {
+			samples[i] = MulawToLinear(b)
+		}
+	}
+	return samples
+}
+
+// encodeG711 converts linear PCM to a G.711 payload
+func encodeG711(codec string, samples []int16) []byte {
+	payload := make([]byte, len(samples))
+	alaw := strings.EqualFold(codec, "PCMA")
+	for i, s := range samples {
+		if alaw {
+			payload[i] = LinearToAlaw(s)
+		} else {
+			payload[i] = LinearToMulaw(s)
+		}
+	}
+	return payload
+}
@@ -0,0 +1,258 @@
+package internal
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Sources of a published DTMF digit
+const (
+	DTMFSourceRFC4733 = "rfc4733" // telephone-event packets
+	DTMFSourceInband  = "inband"  // tones detected in G.711 audio
+)
+
+var dtmfDigitsPublished = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "karl_dtmf_digits_published_total",
+		Help: "DTMF digits published as dtmf events, by source",
+	},
+	[]string{"source"},
+)
+
+var dtmfPublisher atomic.Pointer[DTMFPublisher]
+
+// DTMFPublisher watches the media of calls for DTMF and publishes each
+// digit as a dtmf event once it ends, so IVR logic outside Karl sees the
+// digits without a SIP INFO or a media server of its own
+type DTMFPublisher struct {
+	negotiator *CodecNegotiator
+	inband     bool
+
+	mu      sync.Mutex
+	streams map[uint32]*dtmfStream // by sender SSRC
+}
+
+// dtmfStream follows the digits of one sender
+type dtmfStream struct {
+	callID string
+	leg    string
+
+	// The RFC 4733 event in progress; retransmitted end packets share its
+	// timestamp
+	eventSeen bool
+	timestamp uint32
+	digit     byte
+	duration  uint16
+	volume    uint8
+	clockRate uint32
+	started   time.Time
+	published bool
+
+	// Inband detection, used until the sender is seen to send events
+	detector    *DTMFDetector
+	toneDigit   byte
+	toneStarted time.Time
+	toneSamples int
+	toneRate    int
+}
+
+// NewDTMFPublisher creates a publisher for the calls known to the codec
+// negotiator
+func NewDTMFPublisher(config *DTMFEventsConfig) *DTMFPublisher {
+	return &DTMFPublisher{
+		negotiator: GetCodecNegotiator(),
+		inband:     config.Inband,
+		streams:    make(map[uint32]*dtmfStream),
+	}
+}
+
+// HandleRTP follows the DTMF of a call's media and publishes each digit
+// when it ends
+func (p *DTMFPublisher) HandleRTP(packet *rtp.Packet) {
+	if len(packet.Payload) == 0 {
+		return
+	}
+	callID, fromOfferer, codec, ok := p.negotiator.ResolveLeg(packet.SSRC, packet.PayloadType)
+	if !ok {
+		return
+	}
+	event := strings.EqualFold(codec.Name, "telephone-event")
+	if !event && !(p.inband && isG711(codec.Name)) {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s, ok := p.streams[packet.SSRC]
+	if !ok || s.callID != callID {
+		s = &dtmfStream{callID: callID, leg: "callee"}
+		if fromOfferer {
+			s.leg = "caller"
+		}
+		p.streams[packet.SSRC] = s
+	}
+	if event {
+		s.handleEvent(packet, codec.ClockRate)
+		return
+	}
+	if !s.eventSeen {
+		s.handleAudio(codec, packet.Payload)
+	}
+}
+
+// RemoveCall publishes the digits of a call that ended while still pressed
+// and forgets its senders
+func (p *DTMFPublisher) RemoveCall(callID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for ssrc, s := range p.streams {
+		if s.callID != callID {
+			continue
+		}
+		s.flush()
+		delete(p.streams, ssrc)
+	}
+}
+
+// handleEvent follows an RFC 4733 event packet. A digit is published on
+// its first end packet, or when the next digit begins if every end packet
+// was lost
+func (s *dtmfStream) handleEvent(packet *rtp.Packet, clockRate uint32) {
+	event, err := ParseTelephoneEvent(packet.Payload)
+	if err != nil {
+		return
+	}
+	digit, ok := DTMFEventToDigit(event.Event)
+	if !ok {
+		return
+	}
+
+	if !s.eventSeen || packet.Timestamp != s.timestamp {
+		s.flush()
+		s.eventSeen = true
+		s.timestamp = packet.Timestamp
+		s.digit = digit
+		s.duration = 0
+		s.clockRate = clockRate
+		s.started = time.Now()
+		s.published = false
+	}
+	if s.published {
+		return
+	}
+	if event.Duration > s.duration {
+		s.duration = event.Duration
+	}
+	s.volume = event.Volume
+	if event.End {
+		s.publishEvent()
+	}
+}
+
+// flush publishes an event whose end packets were lost
+func (s *dtmfStream) flush() {
+	if s.eventSeen && !s.published {
+		s.publishEvent()
+	}
+	if s.toneDigit != 0 {
+		s.publishTone()
+	}
+}
+
+// publishEvent publishes the RFC 4733 digit in progress
+func (s *dtmfStream) publishEvent() {
+	s.published = true
+	clockRate := s.clockRate
+	if clockRate == 0 {
+		clockRate = 8000
+	}
+	s.publish(s.digit, DTMFSourceRFC4733, s.started, int64(s.duration)*1000/int64(clockRate), map[string]interface{}{
+		"volume": -int(s.volume), // dBm0
+	})
+}
+
+// handleAudio looks for DTMF tones in G.711 audio
+func (s *dtmfStream) handleAudio(codec CodecInfo, payload []byte) {
+	if s.detector == nil {
+		s.toneRate = int(codec.ClockRate)
+		if s.toneRate == 0 {
+			s.toneRate = 8000
+		}
+		s.detector = NewDTMFDetector(s.toneRate)
+	}
+	samples := decodeG711(codec.Name, payload)
+	if s.toneDigit != 0 {
+		s.toneSamples += len(samples)
+	}
+	for _, d := range s.detector.Process(samples) {
+		if !d.Ended {
+			s.toneDigit = d.Digit
+			s.toneStarted = time.Now()
+			s.toneSamples = 0
+			continue
+		}
+		if s.toneDigit != 0 {
+			s.publishTone()
+		}
+	}
+}
+
+// publishTone publishes the inband digit in progress
+func (s *dtmfStream) publishTone() {
+	s.publish(s.toneDigit, DTMFSourceInband, s.toneStarted, int64(s.toneSamples)*1000/int64(s.toneRate), nil)
+	s.toneDigit = 0
+}
+
+// publish sends a dtmf event for a digit
+func (s *dtmfStream) publish(digit byte, source string, started time.Time, durationMs int64, extra map[string]interface{}) {
+	data := map[string]interface{}{
+		"leg":         s.leg,
+		"digit":       string(digit),
+		"source":      source,
+		"started_at":  started.UTC(),
+		"duration_ms": durationMs,
+	}
+	for k, v := range extra {
+		data[k] = v
+	}
+	dtmfDigitsPublished.WithLabelValues(source).Inc()
+	PublishEvent(EventDTMF, s.callID, data)
+}
+
+// ConfigureDTMFEvents starts or stops publishing the digits of calls
+func ConfigureDTMFEvents(config *DTMFEventsConfig) {
+	var publisher *DTMFPublisher
+	if config != nil && config.Enabled {
+		publisher = NewDTMFPublisher(config)
+	}
+	dtmfPublisher.Store(publisher)
+}
+
+// HandleDTMFRTP is the media tap feeding the DTMF publisher, if one is
+// configured
+func HandleDTMFRTP(packet *rtp.Packet) {
+	if p := dtmfPublisher.Load(); p != nil {
+		p.HandleRTP(packet)
+	}
+}
+
+// RemoveDTMFCall publishes the pending digits of a call that ended
+func RemoveDTMFCall(callID string) {
+	if p := dtmfPublisher.Load(); p != nil {
+		p.RemoveCall(callID)
+	}
+}
+
+// dtmfEventsEnabled reports whether calls must stay in user space for the
+// publisher to see their DTMF
+func dtmfEventsEnabled() bool {
+	return dtmfPublisher.Load() != nil
+}
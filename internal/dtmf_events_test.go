@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// dtmfTestPublisher returns a publisher for a call offering PCMU and
+// telephone-event, and the queue its events are published to
+func dtmfTestPublisher(t *testing.T, inband bool) (*DTMFPublisher, chan *Event) {
+	t.Helper()
+	previous := eventBus.Load()
+	t.Cleanup(func() { eventBus.Store(previous) })
+	bus := &EventBus{endpoints: []*webhookEndpoint{{queue: make(chan *Event, 10)}}}
+	eventBus.Store(bus)
+
+	p := NewDTMFPublisher(&DTMFEventsConfig{Enabled: true, Inband: inband})
+	p.negotiator = NewCodecNegotiator()
+	p.negotiator.SetOfferCodecs("ivr-call", []CodecInfo{
+		{PayloadType: 0, Name: "PCMU", ClockRate: 8000, Channels: 1},
+		{PayloadType: 101, Name: "telephone-event", ClockRate: 8000, Channels: 1},
+	})
+	p.negotiator.BindSSRC(40, "ivr-call", true)
+	return p, bus.endpoints[0].queue
+}
+
+func TestDTMFPublisher_RFC4733(t *testing.T) {
+	p, queue := dtmfTestPublisher(t, false)
+
+	packets, err := GenerateTelephoneEvents('5', 101, 40, 1000, 800, 160, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, packet := range packets {
+		p.HandleRTP(packet)
+	}
+	// Every end packet of the second digit is lost; it is published when
+	// the call ends
+	packets, _ = GenerateTelephoneEvents('#', 101, 40, 3000, 800, 160, 10)
+	for _, packet := range packets[:3] {
+		p.HandleRTP(packet)
+	}
+	p.RemoveCall("ivr-call")
+
+	for _, want := range []struct {
+		digit    string
+		duration int64
+	}{{"5", 100}, {"#", 60}} {
+		select {
+		case event := <-queue:
+			if event.Type != EventDTMF || event.CallID != "ivr-call" || event.Data["leg"] != "caller" ||
+				event.Data["digit"] != want.digit || event.Data["source"] != DTMFSourceRFC4733 ||
+				event.Data["duration_ms"] != want.duration || event.Data["volume"] != -10 {
+				t.Errorf("unexpected event %+v", event)
+			}
+			if _, ok := event.Data["started_at"].(time.Time); !ok {
+				t.Errorf("started_at missing from %+v", event.Data)
+			}
+		default:
+			t.Fatalf("digit %s not published", want.digit)
+		}
+	}
+	select {
+	case event := <-queue:
+		t.Errorf("digit published twice: %+v", event)
+	default:
+	}
+}
+
+func TestDTMFPublisher_Inband(t *testing.T) {
+	p, queue := dtmfTestPublisher(t, true)
+
+	send := func(samples []int16) {
+		for len(samples) > 0 {
+			p.HandleRTP(&rtp.Packet{
+				Header:  rtp.Header{Version: 2, PayloadType: 0, SSRC: 40},
+				Payload: encodeG711("PCMU", samples[:160]),
+			})
+			samples = samples[160:]
+		}
+	}
+	send(GenerateDTMFTone('7', 8000, 0, 800, 10))
+	send(make([]int16, 800))
+
+	select {
+	case event := <-queue:
+		if event.Data["digit"] != "7" || event.Data["source"] != DTMFSourceInband {
+			t.Errorf("unexpected event %+v", event)
+		}
+		if d := event.Data["duration_ms"].(int64); d < 60 || d > 140 {
+			t.Errorf("duration %d ms, want about 100", d)
+		}
+	default:
+		t.Fatal("inband digit not published")
+	}
+}
+
+func TestDTMFPublisher_IgnoresUnknownCalls(t *testing.T) {
+	p, queue := dtmfTestPublisher(t, true)
+
+	packets, _ := GenerateTelephoneEvents('1', 101, 41, 0, 800, 160, 10)
+	for _, packet := range packets {
+		p.HandleRTP(packet)
+	}
+	if len(queue) != 0 {
+		t.Errorf("published %d events for an unknown sender", len(queue))
+	}
+}
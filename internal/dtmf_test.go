@@ -0,0 +1,206 @@
+package internal
+
+import (
+	"math"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+func TestTelephoneEvent_RoundTrip(t *testing.T) {
+	event := &TelephoneEvent{Event: 11, End: true, Volume: 10, Duration: 1280}
+	parsed, err := ParseTelephoneEvent(event.Marshal())
+	if err != nil {
+		t.Fatalf("ParseTelephoneEvent failed: %v", err)
+	}
+	if *parsed != *event {
+		t.Errorf("expected %+v, got %+v", event, parsed)
+	}
+
+	if _, err := ParseTelephoneEvent([]byte{1, 2}); err == nil {
+		t.Error("expected error for short payload")
+	}
+
+	for _, digit := range []byte("0123456789*#ABCD") {
+		code, ok := DTMFDigitToEvent(digit)
+		if !ok {
+			t.Fatalf("digit %q not mapped", digit)
+		}
+		if back, _ := DTMFEventToDigit(code); back != digit {
+			t.Errorf("digit %q mapped back to %q", digit, back)
+		}
+	}
+}
+
+func TestDTMFDetector_DetectsGeneratedTone(t *testing.T) {
+	for _, digit := range []byte("159#D") {
+		detector := NewDTMFDetector(8000)
+
+		var detections []DTMFDetection
+		detections = append(detections, detector.Process(GenerateDTMFTone(digit, 8000, 0, 800, 10))...)
+		detections = append(detections, detector.Process(make([]int16, 800))...)
+
+		if len(detections) != 2 {
+			t.Fatalf("digit %q: expected start and end, got %+v", digit, detections)
+		}
+		if detections[0].Digit != digit || detections[0].Ended {
+			t.Errorf("digit %q: unexpected start %+v", digit, detections[0])
+		}
+		if detections[1].Digit != digit || !detections[1].Ended {
+			t.Errorf("digit %q: unexpected end %+v", digit, detections[1])
+		}
+	}
+}
+
+func TestDTMFDetector_IgnoresSingleTone(t *testing.T) {
+	detector := NewDTMFDetector(8000)
+
+	// 697Hz alone is half of a digit and must not trigger
+	samples := make([]int16, 1600)
+	for i := range samples {
+		samples[i] = int16(8000 * math.Sin(2*math.Pi*697*float64(i)/8000))
+	}
+	if detections := detector.Process(samples); len(detections) != 0 {
+		t.Errorf("expected no detection for a single tone, got %+v", detections)
+	}
+}
+
+func TestGenerateTelephoneEvents(t *testing.T) {
+	packets, err := GenerateTelephoneEvents('5', 101, 0x42, 8000, 800, 160, 10)
+	if err != nil {
+		t.Fatalf("GenerateTelephoneEvents failed: %v", err)
+	}
+	// Updates at 160..640 plus three end packets
+	if len(packets) != 4+dtmfEndRetransmits {
+		t.Fatalf("expected %d packets, got %d", 4+dtmfEndRetransmits, len(packets))
+	}
+	if !packets[0].Marker || packets[1].Marker {
+		t.Error("expected marker only on the first packet")
+	}
+	for _, p := range packets {
+		if p.Timestamp != 8000 || p.PayloadType != 101 {
+			t.Errorf("unexpected header %+v", p.Header)
+		}
+	}
+	last, _ := ParseTelephoneEvent(packets[len(packets)-1].Payload)
+	if !last.End || last.Duration != 800 || last.Event != 5 {
+		t.Errorf("unexpected end packet %+v", last)
+	}
+
+	if _, err := GenerateTelephoneEvents('x', 101, 0, 0, 800, 160, 10); err == nil {
+		t.Error("expected error for invalid digit")
+	}
+}
+
+func TestDTMFRelay_EventToEvent(t *testing.T) {
+	relay := NewDTMFRelay(DTMFRelayConfig{InputEventPT: 101, OutputEventPT: 96})
+	packets, _ := GenerateTelephoneEvents('7', 101, 0x42, 1000, 320, 160, 10)
+
+	for i, p := range packets {
+		p.SequenceNumber = uint16(10 + i)
+		out := relay.Process(p)
+		if len(out) != 1 || out[0].PayloadType != 96 {
+			t.Fatalf("expected event relayed with PT 96, got %+v", out)
+		}
+		if out[0].SequenceNumber != uint16(10+i) {
+			t.Errorf("expected sequence %d, got %d", 10+i, out[0].SequenceNumber)
+		}
+	}
+}
+
+func TestDTMFRelay_EventToInband(t *testing.T) {
+	relay := NewDTMFRelay(DTMFRelayConfig{
+		InputEventPT:     101,
+		OutputAudioCodec: "PCMU",
+		OutputAudioPT:    0,
+	})
+	var digits []byte
+	relay.SetDigitHandler(func(d byte) { digits = append(digits, d) })
+
+	packets, _ := GenerateTelephoneEvents('3', 101, 0x42, 1000, 800, 160, 10)
+	detector := NewDTMFDetector(8000)
+	var audioSamples int
+	var detections []DTMFDetection
+	for _, p := range packets {
+		for _, out := range relay.Process(p) {
+			if out.PayloadType != 0 {
+				t.Fatalf("expected PCMU audio, got PT %d", out.PayloadType)
+			}
+			audioSamples += len(out.Payload)
+			detections = append(detections, detector.Process(decodeG711("PCMU", out.Payload))...)
+		}
+	}
+
+	// Retransmitted end packets must not extend the tone
+	if audioSamples != 800 {
+		t.Errorf("expected 800 tone samples, got %d", audioSamples)
+	}
+	if len(detections) == 0 || detections[0].Digit != '3' {
+		t.Errorf("expected synthesized tone to be detected as '3', got %+v", detections)
+	}
+	if len(digits) != 1 || digits[0] != '3' {
+		t.Errorf("expected digit handler called once with '3', got %q", digits)
+	}
+
+	// Sender audio overlapping the synthesized tone is dropped
+	overlap := &rtp.Packet{Header: rtp.Header{PayloadType: 0, Timestamp: 1160}, Payload: make([]byte, 160)}
+	if out := relay.Process(overlap); len(out) != 0 {
+		t.Errorf("expected overlapping audio to be dropped, got %d packets", len(out))
+	}
+}
+
+func TestDTMFRelay_InbandToEvent(t *testing.T) {
+	relay := NewDTMFRelay(DTMFRelayConfig{
+		InputAudioCodec: "PCMA",
+		OutputEventPT:   101,
+	})
+
+	tone := GenerateDTMFTone('8', 8000, 0, 1600, 10)
+	samples := append(tone, make([]int16, 800)...)
+
+	var events []*TelephoneEvent
+	var silenced bool
+	for i := 0; i*160 < len(samples); i++ {
+		pkt := &rtp.Packet{
+			Header:  rtp.Header{PayloadType: 8, SequenceNumber: uint16(i), Timestamp: uint32(i * 160)},
+			Payload: encodeG711("PCMA", samples[i*160:(i+1)*160]),
+		}
+		for _, out := range relay.Process(pkt) {
+			if out.PayloadType == 101 {
+				ev, err := ParseTelephoneEvent(out.Payload)
+				if err != nil {
+					t.Fatalf("bad event payload: %v", err)
+				}
+				events = append(events, ev)
+				continue
+			}
+			if relay.detector.Active() != 0 {
+				silenced = true
+				for _, s := range decodeG711("PCMA", out.Payload) {
+					if s > 16 || s < -16 {
+						t.Fatal("expected tone audio to be silenced")
+					}
+				}
+			}
+		}
+	}
+
+	if len(events) == 0 {
+		t.Fatal("expected telephone-event packets")
+	}
+	if events[0].Event != 8 || events[0].End {
+		t.Errorf("unexpected first event %+v", events[0])
+	}
+	ends := 0
+	for _, ev := range events {
+		if ev.End {
+			ends++
+		}
+	}
+	if ends != dtmfEndRetransmits {
+		t.Errorf("expected %d end packets, got %d", dtmfEndRetransmits, ends)
+	}
+	if !silenced {
+		t.Error("expected audio to be silenced while the digit was active")
+	}
+}
@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var endpointTLSReloads = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "karl_endpoint_tls_reloads_total",
+		Help: "Certificate loads for the metrics and health endpoints by endpoint and result",
+	},
+	[]string{"endpoint", "result"},
+)
+
+// EndpointTLS holds the TLS settings of the metrics or health server. The
+// certificate and client CA are read again by Reload, and handshakes after
+// a reload use the new files without restarting the server.
+type EndpointTLS struct {
+	name    string
+	config  EndpointTLSConfig
+	current atomic.Pointer[tls.Config]
+}
+
+// NewEndpointTLS loads the certificate for the named endpoint, returning
+// nil when TLS is not enabled
+func NewEndpointTLS(name string, config *EndpointTLSConfig) (*EndpointTLS, error) {
+	if config == nil || !config.Enabled {
+		return nil, nil
+	}
+	e := &EndpointTLS{name: name, config: *config}
+	if err := e.Reload(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// ValidateEndpointTLSConfig checks the TLS settings of the named endpoint
+func ValidateEndpointTLSConfig(name string, config *EndpointTLSConfig) error {
+	if config.CertFile == "" || config.KeyFile == "" {
+		return fmt.Errorf("%s TLS enabled but cert_file or key_file not specified", name)
+	}
+	switch config.ClientAuth {
+	case "", "require", "optional":
+	default:
+		return fmt.Errorf("invalid %s TLS client_auth: %s", name, config.ClientAuth)
+	}
+	if config.ClientAuth != "" && config.ClientCA == "" {
+		return fmt.Errorf("%s TLS client_auth needs client_ca", name)
+	}
+	return nil
+}
+
+// Reload reads the certificate, key and client CA files again. On failure
+// the previous files stay in use
+func (e *EndpointTLS) Reload() error {
+	opts := DefaultTLSConfigOptions()
+	opts.CertFile = e.config.CertFile
+	opts.KeyFile = e.config.KeyFile
+	opts.CAFile = e.config.ClientCA
+	if e.config.ClientCA != "" {
+		opts.ClientAuth = tls.RequireAndVerifyClientCert
+		if e.config.ClientAuth == "optional" {
+			opts.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+
+	config, err := NewTLSConfigBuilder(opts).BuildServer()
+	if err != nil {
+		endpointTLSReloads.WithLabelValues(e.name, "error").Inc()
+		return fmt.Errorf("failed to load %s TLS certificate: %w", e.name, err)
+	}
+	e.current.Store(config)
+	endpointTLSReloads.WithLabelValues(e.name, "success").Inc()
+	return nil
+}
+
+// TLSConfig returns the configuration for the endpoint's http.Server, which
+// hands each handshake the most recently loaded files
+func (e *EndpointTLS) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return e.current.Load(), nil
+		},
+	}
+}
+
+// ReloadEndpointTLSOnSIGHUP reloads the endpoints' certificates on every
+// SIGHUP until ctx is done. Nil endpoints are skipped
+func ReloadEndpointTLSOnSIGHUP(ctx context.Context, endpoints ...*EndpointTLS) {
+	enabled := false
+	for _, e := range endpoints {
+		enabled = enabled || e != nil
+	}
+	if !enabled {
+		return
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(sigCh)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sigCh:
+				for _, e := range endpoints {
+					if e == nil {
+						continue
+					}
+					if err := e.Reload(); err != nil {
+						log.Printf("Keeping the previous %s certificate: %v", e.name, err)
+						continue
+					}
+					log.Printf("Reloaded %s TLS certificate from %s", e.name, e.config.CertFile)
+				}
+			}
+		}
+	}()
+}
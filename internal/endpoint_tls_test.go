@@ -0,0 +1,198 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// issueTestCert creates a certificate for cn signed by parent, or a
+// self-signed CA when parent is nil
+func issueTestCert(t *testing.T, cn string, parent *tls.Certificate, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		DNSNames:              []string{cn},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{usage},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+
+	signer, signerKey := template, any(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// writeTestCert writes cert as PEM files in dir
+func writeTestCert(t *testing.T, dir string, cert tls.Certificate) (certFile, keyFile string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0644)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+func startEndpointTLSServer(t *testing.T, e *EndpointTLS) *httptest.Server {
+	t.Helper()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = e.TLSConfig()
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// serverCommonName connects to the server and returns the name in its
+// certificate
+func serverCommonName(t *testing.T, addr string) string {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestEndpointTLS_Reload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, issueTestCert(t, "first", nil, x509.ExtKeyUsageServerAuth))
+
+	e, err := NewEndpointTLS("metrics", &EndpointTLSConfig{Enabled: true, CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("NewEndpointTLS failed: %v", err)
+	}
+	server := startEndpointTLSServer(t, e)
+	addr := server.Listener.Addr().String()
+
+	if cn := serverCommonName(t, addr); cn != "first" {
+		t.Fatalf("expected the first certificate, got %q", cn)
+	}
+
+	writeTestCert(t, dir, issueTestCert(t, "second", nil, x509.ExtKeyUsageServerAuth))
+	if err := e.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if cn := serverCommonName(t, addr); cn != "second" {
+		t.Errorf("expected the reloaded certificate, got %q", cn)
+	}
+
+	// A broken file keeps the previous certificate in use
+	os.WriteFile(certFile, []byte("not a certificate"), 0644)
+	if err := e.Reload(); err == nil {
+		t.Error("expected Reload to fail on a broken certificate")
+	}
+	if cn := serverCommonName(t, addr); cn != "second" {
+		t.Errorf("expected the previous certificate after a failed reload, got %q", cn)
+	}
+}
+
+func TestEndpointTLS_ClientCertificates(t *testing.T) {
+	ca := issueTestCert(t, "karl-ca", nil, x509.ExtKeyUsageAny)
+	caDir, serverDir := t.TempDir(), t.TempDir()
+	caFile, _ := writeTestCert(t, caDir, ca)
+	certFile, keyFile := writeTestCert(t, serverDir, issueTestCert(t, "karl", &ca, x509.ExtKeyUsageServerAuth))
+
+	for _, tt := range []struct {
+		clientAuth    string
+		wantNoCertErr bool
+	}{
+		{"", true},
+		{"optional", false},
+	} {
+		e, err := NewEndpointTLS("health", &EndpointTLSConfig{
+			Enabled:    true,
+			CertFile:   certFile,
+			KeyFile:    keyFile,
+			ClientCA:   caFile,
+			ClientAuth: tt.clientAuth,
+		})
+		if err != nil {
+			t.Fatalf("NewEndpointTLS failed: %v", err)
+		}
+		server := startEndpointTLSServer(t, e)
+
+		pool := x509.NewCertPool()
+		pool.AddCert(ca.Leaf)
+		// get presents cert even when the server asks for another CA
+		get := func(cert *tls.Certificate) error {
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+				RootCAs:    pool,
+				ServerName: "karl",
+				GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+					if cert == nil {
+						return &tls.Certificate{}, nil
+					}
+					return cert, nil
+				},
+			}}}
+			resp, err := client.Get(server.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			return err
+		}
+
+		if err := get(nil); (err != nil) != tt.wantNoCertErr {
+			t.Errorf("client_auth %q without a client certificate: %v", tt.clientAuth, err)
+		}
+		prometheus := issueTestCert(t, "prometheus", &ca, x509.ExtKeyUsageClientAuth)
+		if err := get(&prometheus); err != nil {
+			t.Errorf("client_auth %q with a CA-signed client certificate: %v", tt.clientAuth, err)
+		}
+		intruder := issueTestCert(t, "intruder", nil, x509.ExtKeyUsageClientAuth)
+		if err := get(&intruder); err == nil {
+			t.Errorf("client_auth %q accepted a client certificate from another CA", tt.clientAuth)
+		}
+	}
+}
+
+func TestValidateEndpointTLSConfig(t *testing.T) {
+	tests := []struct {
+		config  EndpointTLSConfig
+		wantErr bool
+	}{
+		{EndpointTLSConfig{CertFile: "c.pem", KeyFile: "k.pem"}, false},
+		{EndpointTLSConfig{CertFile: "c.pem", KeyFile: "k.pem", ClientCA: "ca.pem", ClientAuth: "optional"}, false},
+		{EndpointTLSConfig{CertFile: "c.pem"}, true},
+		{EndpointTLSConfig{CertFile: "c.pem", KeyFile: "k.pem", ClientAuth: "require"}, true},
+		{EndpointTLSConfig{CertFile: "c.pem", KeyFile: "k.pem", ClientCA: "ca.pem", ClientAuth: "always"}, true},
+	}
+	for _, tt := range tests {
+		if err := ValidateEndpointTLSConfig("metrics", &tt.config); (err != nil) != tt.wantErr {
+			t.Errorf("ValidateEndpointTLSConfig(%+v) = %v, wantErr %v", tt.config, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,446 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+)
+
+// Event stream defaults
+const (
+	defaultKafkaTopic       = "karl-events"
+	defaultNATSSubject      = "karl.events"
+	defaultRedisChannel     = "karl:events"
+	defaultEventStreamQueue = 1000
+	kafkaDeliveryTimeout    = 30 * time.Second
+	eventStreamFlushTimeout = 5 * time.Second
+	maxKafkaTopicLength     = 249
+)
+
+var (
+	kafkaTopicPattern  = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+	natsSubjectPattern = regexp.MustCompile(`^[^\s.*>]+(\.[^\s.*>]+)*$`)
+)
+
+// Event stream metrics
+var eventStreamMessages = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "karl_event_stream_messages_total",
+		Help: "Events published to Kafka, NATS or Redis, by stream, event type and result",
+	},
+	[]string{"stream", "event", "result"},
+)
+
+var (
+	eventStreamer atomic.Pointer[EventStreamer]
+
+	// Failed and dropped events are reported at most once a minute
+	eventStreamErrors = NewLogSampler(Logger(ComponentKarl), slog.LevelWarn, 1, time.Minute)
+)
+
+// EventStreamer publishes events to Kafka topics, NATS subjects and Redis
+// channels. Each stream has its own queue and worker, so a stalled broker
+// does not hold up the other streams
+type EventStreamer struct {
+	streams []*eventStream
+	wg      sync.WaitGroup
+}
+
+// eventStream is one Kafka, NATS or Redis connection with its queue of
+// events
+type eventStream struct {
+	name   string            // kafka, nats or redis, the metrics label
+	topic  string            // topic or subject for event types not in topics
+	topics map[string]string // per event type; empty skips the type
+	events map[string]bool   // nil publishes every type
+	queue  chan *Event
+
+	// send publishes body to topic and calls done with the result, which
+	// may happen after it returns
+	send  func(topic string, event *Event, body []byte, done func(error))
+	flush func()
+}
+
+// NewEventStreamer connects the configured streams and starts their
+// workers. Brokers that are down are retried in the background
+func NewEventStreamer(config *EventStreamingConfig) (*EventStreamer, error) {
+	queueSize := config.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultEventStreamQueue
+	}
+	var streams []*eventStream
+	if config.Kafka != nil {
+		s, err := newKafkaStream(config.Kafka)
+		if err != nil {
+			return nil, fmt.Errorf("kafka: %w", err)
+		}
+		streams = append(streams, s)
+	}
+	if config.NATS != nil {
+		s, err := newNATSStream(config.NATS)
+		if err != nil {
+			for _, s := range streams {
+				s.flush()
+			}
+			return nil, fmt.Errorf("nats: %w", err)
+		}
+		streams = append(streams, s)
+	}
+	if config.Redis != nil {
+		streams = append(streams, newRedisStream(config.Redis))
+	}
+
+	streamer := &EventStreamer{streams: streams}
+	for _, s := range streams {
+		s.queue = make(chan *Event, queueSize)
+		streamer.wg.Add(1)
+		go func() {
+			defer streamer.wg.Done()
+			s.run()
+		}()
+	}
+	return streamer, nil
+}
+
+// newKafkaStream creates a producer for the brokers. Events are keyed by
+// call ID, so the events of a call stay in order on one partition
+func newKafkaStream(c *KafkaStreamConfig) (*eventStream, error) {
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(c.Brokers...),
+		kgo.ClientID("karl"),
+		kgo.RecordDeliveryTimeout(kafkaDeliveryTimeout),
+	}
+	if c.TLS {
+		opts = append(opts, kgo.DialTLSConfig(&tls.Config{MinVersion: tls.VersionTLS12}))
+	}
+	if c.SASLMechanism != "" {
+		mechanism, err := kafkaSASL(c)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, kgo.SASL(mechanism))
+	}
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	s := newEventStream("kafka", c.Topic, defaultKafkaTopic, c.Topics, c.Events)
+	s.send = func(topic string, event *Event, body []byte, done func(error)) {
+		record := &kgo.Record{
+			Topic:     topic,
+			Value:     body,
+			Timestamp: event.Timestamp,
+			Headers: []kgo.RecordHeader{
+				{Key: "event-type", Value: []byte(event.Type)},
+				{Key: "node", Value: []byte(event.Node)},
+			},
+		}
+		if event.CallID != "" {
+			record.Key = []byte(event.CallID)
+		}
+		client.Produce(context.Background(), record, func(_ *kgo.Record, err error) { done(err) })
+	}
+	s.flush = func() {
+		ctx, cancel := context.WithTimeout(context.Background(), eventStreamFlushTimeout)
+		defer cancel()
+		_ = client.Flush(ctx)
+		client.Close()
+	}
+	return s, nil
+}
+
+// kafkaSASL returns the SASL mechanism for the configured credentials
+func kafkaSASL(c *KafkaStreamConfig) (sasl.Mechanism, error) {
+	switch strings.ToLower(c.SASLMechanism) {
+	case "plain":
+		return plain.Auth{User: c.Username, Pass: c.Password}.AsMechanism(), nil
+	case "scram-sha-256":
+		return scram.Auth{User: c.Username, Pass: c.Password}.AsSha256Mechanism(), nil
+	case "scram-sha-512":
+		return scram.Auth{User: c.Username, Pass: c.Password}.AsSha512Mechanism(), nil
+	}
+	return nil, fmt.Errorf("unsupported SASL mechanism %q", c.SASLMechanism)
+}
+
+// newNATSStream connects to the NATS servers. Events published while the
+// connection is down are buffered until it reconnects
+func newNATSStream(c *NATSStreamConfig) (*eventStream, error) {
+	log := Logger(ComponentKarl)
+	opts := []nats.Option{
+		nats.Name("karl"),
+		nats.MaxReconnects(-1),
+		nats.RetryOnFailedConnect(true),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				log.Warn("Disconnected from NATS", "error", err)
+			}
+		}),
+		nats.ReconnectHandler(func(conn *nats.Conn) {
+			log.Info("Reconnected to NATS", "server", natsServerHost(conn.ConnectedUrl()))
+		}),
+	}
+	if c.Token != "" {
+		opts = append(opts, nats.Token(c.Token))
+	}
+	conn, err := nats.Connect(c.URL, opts...)
+	if err != nil {
+		// Leave the URL, which may hold credentials, out of the error
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, err
+	}
+
+	s := newEventStream("nats", c.Subject, defaultNATSSubject, c.Subjects, c.Events)
+	s.send = func(subject string, _ *Event, body []byte, done func(error)) {
+		done(conn.Publish(subject, body))
+	}
+	s.flush = func() {
+		_ = conn.FlushTimeout(eventStreamFlushTimeout)
+		conn.Close()
+	}
+	return s, nil
+}
+
+// newRedisStream publishes to Redis channels, for subscribers such as IVR
+// logic that react to events as they happen. Pub/sub keeps no history, so
+// events published while nobody subscribes are lost
+func newRedisStream(c *RedisStreamConfig) *eventStream {
+	opts := &redis.Options{Addr: c.Addr, Password: c.Password, DB: c.DB}
+	if c.TLS {
+		opts.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	client := redis.NewClient(opts)
+
+	s := newEventStream("redis", c.Channel, defaultRedisChannel, c.Channels, c.Events)
+	s.send = func(channel string, _ *Event, body []byte, done func(error)) {
+		ctx, cancel := context.WithTimeout(context.Background(), eventStreamFlushTimeout)
+		defer cancel()
+		done(client.Publish(ctx, channel, body).Err())
+	}
+	s.flush = func() {
+		_ = client.Close()
+	}
+	return s
+}
+
+// natsServerHost returns the host of a NATS URL without its credentials
+func natsServerHost(server string) string {
+	if u, err := url.Parse(server); err == nil {
+		return u.Host
+	}
+	return ""
+}
+
+func newEventStream(name, topic, defaultTopic string, topics map[string]string, events []string) *eventStream {
+	s := &eventStream{name: name, topic: topic, topics: topics}
+	if s.topic == "" {
+		s.topic = defaultTopic
+	}
+	if len(events) > 0 {
+		s.events = make(map[string]bool)
+		for _, e := range events {
+			s.events[e] = true
+		}
+	}
+	return s
+}
+
+// topicFor returns where an event type is published, or false when the
+// stream skips it
+func (s *eventStream) topicFor(eventType string) (string, bool) {
+	if s.events != nil && !s.events[eventType] {
+		return "", false
+	}
+	if topic, ok := s.topics[eventType]; ok {
+		return topic, topic != ""
+	}
+	return s.topic, true
+}
+
+// run publishes queued events in order until the queue is closed
+func (s *eventStream) run() {
+	for event := range s.queue {
+		topic, _ := s.topicFor(event.Type)
+		body, err := json.Marshal(event)
+		if err != nil {
+			eventStreamMessages.WithLabelValues(s.name, event.Type, "failed").Inc()
+			continue
+		}
+		s.send(topic, event, body, func(err error) {
+			if err == nil {
+				eventStreamMessages.WithLabelValues(s.name, event.Type, "published").Inc()
+				return
+			}
+			eventStreamMessages.WithLabelValues(s.name, event.Type, "failed").Inc()
+			if eventStreamErrors.Allow() {
+				eventStreamErrors.Log("Event stream publish failed", "stream", s.name, "topic", topic, "event", event.Type, "error", err)
+			}
+		})
+	}
+}
+
+// publish queues an event for every stream that takes its type. It never
+// blocks; a stream whose queue is full loses the event
+func (e *EventStreamer) publish(event *Event) {
+	for _, s := range e.streams {
+		if _, ok := s.topicFor(event.Type); !ok {
+			continue
+		}
+		select {
+		case s.queue <- event:
+		default:
+			eventStreamMessages.WithLabelValues(s.name, event.Type, "dropped").Inc()
+			if eventStreamErrors.Allow() {
+				eventStreamErrors.Log("Event stream queue is full, event dropped", "stream", s.name, "event", event.Type)
+			}
+		}
+	}
+}
+
+// Close stops taking events, publishes the queued ones and disconnects,
+// waiting a few seconds at most for brokers to acknowledge them
+func (e *EventStreamer) Close() {
+	for _, s := range e.streams {
+		close(s.queue)
+	}
+	e.wg.Wait()
+	for _, s := range e.streams {
+		s.flush()
+	}
+}
+
+// ConfigureEventStreaming replaces the event streamer with one for config;
+// nil or no streams stops publishing. Events queued on the old streamer
+// are still published
+func ConfigureEventStreaming(config *EventStreamingConfig) {
+	var streamer *EventStreamer
+	if config != nil && (config.Kafka != nil || config.NATS != nil || config.Redis != nil) {
+		var err error
+		if streamer, err = NewEventStreamer(config); err != nil {
+			Logger(ComponentKarl).Error("Event streaming disabled", "error", err)
+		}
+	}
+	if old := eventStreamer.Swap(streamer); old != nil {
+		go old.Close()
+	}
+}
+
+// CloseEventStreaming stops publishing and waits for the queued events to
+// reach the brokers, for use at shutdown
+func CloseEventStreaming() {
+	if old := eventStreamer.Swap(nil); old != nil {
+		old.Close()
+	}
+}
+
+// ValidateEventStreamingConfig checks the brokers, servers, topics and
+// event types of the configured streams
+func ValidateEventStreamingConfig(cfg *Config) error {
+	c := cfg.EventStreaming
+	if c.QueueSize < 0 {
+		return fmt.Errorf("invalid event_streaming.queue_size %d", c.QueueSize)
+	}
+	if k := c.Kafka; k != nil {
+		if len(k.Brokers) == 0 {
+			return errors.New("event_streaming.kafka.brokers is required")
+		}
+		for _, broker := range k.Brokers {
+			if host, port, err := net.SplitHostPort(broker); err != nil || host == "" || port == "" {
+				return fmt.Errorf("invalid event_streaming.kafka.brokers %q, expected host:port", broker)
+			}
+		}
+		switch strings.ToLower(k.SASLMechanism) {
+		case "":
+		case "plain", "scram-sha-256", "scram-sha-512":
+			if k.Username == "" {
+				return errors.New("event_streaming.kafka.username is required with sasl_mechanism")
+			}
+		default:
+			return fmt.Errorf("invalid event_streaming.kafka.sasl_mechanism %q, expected plain, scram-sha-256 or scram-sha-512", k.SASLMechanism)
+		}
+		if err := validateStreamTopics("event_streaming.kafka", "topic", k.Topic, k.Topics, k.Events, validKafkaTopic); err != nil {
+			return err
+		}
+	}
+	if n := c.NATS; n != nil {
+		if n.URL == "" {
+			return errors.New("event_streaming.nats.url is required")
+		}
+		for _, server := range strings.Split(n.URL, ",") {
+			u, err := url.Parse(strings.TrimSpace(server))
+			if err != nil || (u.Scheme != "nats" && u.Scheme != "tls") || u.Host == "" {
+				return errors.New("invalid event_streaming.nats.url, expected nats:// or tls:// URLs")
+			}
+		}
+		if err := validateStreamTopics("event_streaming.nats", "subject", n.Subject, n.Subjects, n.Events, natsSubjectPattern.MatchString); err != nil {
+			return err
+		}
+	}
+	if rc := c.Redis; rc != nil {
+		if host, port, err := net.SplitHostPort(rc.Addr); err != nil || host == "" || port == "" {
+			return fmt.Errorf("invalid event_streaming.redis.addr %q, expected host:port", rc.Addr)
+		}
+		if rc.DB < 0 {
+			return fmt.Errorf("invalid event_streaming.redis.db %d", rc.DB)
+		}
+		if err := validateStreamTopics("event_streaming.redis", "channel", rc.Channel, rc.Channels, rc.Events, validRedisChannel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateStreamTopics checks a stream's default topic, its per event type
+// topics and its event filter
+func validateStreamTopics(section, field, topic string, topics map[string]string, events []string, valid func(string) bool) error {
+	if topic != "" && !valid(topic) {
+		return fmt.Errorf("invalid %s.%s %q", section, field, topic)
+	}
+	for eventType, t := range topics {
+		if !eventTypes[eventType] {
+			return fmt.Errorf("invalid %s.%ss event type %q", section, field, eventType)
+		}
+		if t != "" && !valid(t) {
+			return fmt.Errorf("invalid %s.%ss %q for %s", section, field, t, eventType)
+		}
+	}
+	for _, e := range events {
+		if !eventTypes[e] {
+			return fmt.Errorf("invalid %s.events %q", section, e)
+		}
+	}
+	return nil
+}
+
+// validRedisChannel reports whether a channel name can be subscribed to
+// without glob patterns
+func validRedisChannel(channel string) bool {
+	return !strings.ContainsAny(channel, " \t\r\n*?[")
+}
+
+// validKafkaTopic reports whether Kafka accepts a topic name
+func validKafkaTopic(topic string) bool {
+	return len(topic) <= maxKafkaTopicLength && topic != "." && topic != ".." && kafkaTopicPattern.MatchString(topic)
+}
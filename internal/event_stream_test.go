@@ -0,0 +1,264 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// natsMessage is one PUB received by fakeNATSServer
+type natsMessage struct {
+	subject string
+	body    []byte
+}
+
+// fakeNATSServer speaks enough of the NATS protocol to accept publishes
+func fakeNATSServer(t *testing.T) (string, chan natsMessage) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	messages := make(chan natsMessage, 100)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				fmt.Fprintf(conn, "INFO {\"server_id\":\"fake\",\"version\":\"2.10.0\",\"proto\":1,\"max_payload\":1048576}\r\n")
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					fields := strings.Fields(line)
+					if len(fields) == 0 {
+						continue
+					}
+					switch strings.ToUpper(fields[0]) {
+					case "PING":
+						io.WriteString(conn, "PONG\r\n")
+					case "PUB":
+						size, _ := strconv.Atoi(fields[len(fields)-1])
+						body := make([]byte, size+2)
+						if _, err := io.ReadFull(r, body); err != nil {
+							return
+						}
+						messages <- natsMessage{subject: fields[1], body: body[:size]}
+					}
+				}
+			}()
+		}
+	}()
+	return "nats://" + ln.Addr().String(), messages
+}
+
+func TestEventStreamer_NATS(t *testing.T) {
+	server, messages := fakeNATSServer(t)
+	streamer, err := NewEventStreamer(&EventStreamingConfig{NATS: &NATSStreamConfig{
+		URL:      server,
+		Subjects: map[string]string{EventSessionEnd: "billing.calls", EventQualityAlert: ""},
+		Events:   []string{EventSessionStart, EventSessionEnd, EventQualityAlert},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamer.publish(newEvent("node-1", EventSessionStart, "call-1", nil))
+	streamer.publish(newEvent("node-1", EventQualityAlert, "call-1", nil)) // empty subject
+	streamer.publish(newEvent("node-1", EventFailover, "", nil))           // not in events
+	streamer.publish(newEvent("node-1", EventSessionEnd, "call-1", map[string]interface{}{"duration": 12.5}))
+	streamer.Close()
+
+	want := []struct{ subject, event string }{
+		{defaultNATSSubject, EventSessionStart},
+		{"billing.calls", EventSessionEnd},
+	}
+	for _, w := range want {
+		select {
+		case msg := <-messages:
+			var event Event
+			if err := json.Unmarshal(msg.body, &event); err != nil {
+				t.Fatalf("invalid body: %v", err)
+			}
+			if msg.subject != w.subject || event.Type != w.event || event.CallID != "call-1" || event.Node != "node-1" {
+				t.Errorf("got %s on %s, want %s on %s", event.Type, msg.subject, w.event, w.subject)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no %s event published", w.event)
+		}
+	}
+	select {
+	case msg := <-messages:
+		t.Errorf("unexpected publish on %s", msg.subject)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// fakeRedisServer speaks enough RESP to accept PUBLISH commands, refusing
+// HELLO so clients fall back to RESP2
+func fakeRedisServer(t *testing.T) (string, chan natsMessage) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	messages := make(chan natsMessage, 100)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil || !strings.HasPrefix(line, "*") {
+						return
+					}
+					n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+					args := make([]string, n)
+					for i := range args {
+						line, err := r.ReadString('\n')
+						if err != nil {
+							return
+						}
+						size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+						arg := make([]byte, size+2)
+						if _, err := io.ReadFull(r, arg); err != nil {
+							return
+						}
+						args[i] = string(arg[:size])
+					}
+					switch strings.ToUpper(args[0]) {
+					case "HELLO":
+						io.WriteString(conn, "-ERR unknown command 'HELLO'\r\n")
+					case "PUBLISH":
+						messages <- natsMessage{subject: args[1], body: []byte(args[2])}
+						io.WriteString(conn, ":1\r\n")
+					default:
+						io.WriteString(conn, "+OK\r\n")
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), messages
+}
+
+func TestEventStreamer_Redis(t *testing.T) {
+	addr, messages := fakeRedisServer(t)
+	streamer, err := NewEventStreamer(&EventStreamingConfig{Redis: &RedisStreamConfig{
+		Addr:     addr,
+		Channels: map[string]string{EventDTMF: "karl:dtmf"},
+		Events:   []string{EventDTMF, EventSessionEnd},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamer.publish(newEvent("node-1", EventDTMF, "call-1", map[string]interface{}{"digit": "5"}))
+	streamer.publish(newEvent("node-1", EventSessionStart, "call-1", nil)) // not in events
+	streamer.publish(newEvent("node-1", EventSessionEnd, "call-1", nil))
+	streamer.Close()
+
+	want := []struct{ channel, event string }{
+		{"karl:dtmf", EventDTMF},
+		{defaultRedisChannel, EventSessionEnd},
+	}
+	for _, w := range want {
+		select {
+		case msg := <-messages:
+			var event Event
+			if err := json.Unmarshal(msg.body, &event); err != nil {
+				t.Fatalf("invalid body: %v", err)
+			}
+			if msg.subject != w.channel || event.Type != w.event || event.CallID != "call-1" {
+				t.Errorf("got %s on %s, want %s on %s", event.Type, msg.subject, w.event, w.channel)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no %s event published", w.event)
+		}
+	}
+}
+
+func TestPublishEvent_SameEventToWebhooksAndStreams(t *testing.T) {
+	defer eventBus.Store(eventBus.Load())
+	defer eventStreamer.Store(eventStreamer.Load())
+
+	bus := &EventBus{endpoints: []*webhookEndpoint{{queue: make(chan *Event, 1)}}}
+	stream := newEventStream("kafka", "", defaultKafkaTopic, nil, nil)
+	stream.queue = make(chan *Event, 1)
+	eventBus.Store(bus)
+	eventStreamer.Store(&EventStreamer{streams: []*eventStream{stream}})
+
+	PublishEvent(EventFailover, "", map[string]interface{}{"role": "active"})
+	webhook, streamed := <-bus.endpoints[0].queue, <-stream.queue
+	if webhook != streamed || webhook.Type != EventFailover || webhook.Node != DefaultHANodeID() {
+		t.Errorf("webhook got %+v, stream got %+v", webhook, streamed)
+	}
+}
+
+func TestEventStream_TopicFor(t *testing.T) {
+	s := newEventStream("kafka", "", defaultKafkaTopic, map[string]string{
+		EventSessionEnd: "billing", EventRegistration: "",
+	}, nil)
+	for _, tt := range []struct {
+		event string
+		topic string
+		ok    bool
+	}{
+		{EventSessionStart, defaultKafkaTopic, true},
+		{EventSessionEnd, "billing", true},
+		{EventRegistration, "", false},
+	} {
+		if topic, ok := s.topicFor(tt.event); topic != tt.topic || ok != tt.ok {
+			t.Errorf("%s: got %q %v, want %q %v", tt.event, topic, ok, tt.topic, tt.ok)
+		}
+	}
+}
+
+func TestValidateEventStreamingConfig(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		config EventStreamingConfig
+		valid  bool
+	}{
+		{"kafka", EventStreamingConfig{Kafka: &KafkaStreamConfig{Brokers: []string{"kafka-1:9092", "kafka-2:9092"}, Topics: map[string]string{EventSessionEnd: "karl.billing"}}}, true},
+		{"kafka sasl", EventStreamingConfig{Kafka: &KafkaStreamConfig{Brokers: []string{"kafka:9093"}, TLS: true, SASLMechanism: "scram-sha-512", Username: "karl"}}, true},
+		{"nats", EventStreamingConfig{NATS: &NATSStreamConfig{URL: "nats://a:4222, tls://b:4222", Subjects: map[string]string{EventFailover: "ops.failover"}}}, true},
+		{"kafka without brokers", EventStreamingConfig{Kafka: &KafkaStreamConfig{}}, false},
+		{"kafka broker without port", EventStreamingConfig{Kafka: &KafkaStreamConfig{Brokers: []string{"kafka"}}}, false},
+		{"kafka bad topic", EventStreamingConfig{Kafka: &KafkaStreamConfig{Brokers: []string{"kafka:9092"}, Topic: "karl events"}}, false},
+		{"kafka unknown event", EventStreamingConfig{Kafka: &KafkaStreamConfig{Brokers: []string{"kafka:9092"}, Topics: map[string]string{"call-forwarded": "x"}}}, false},
+		{"kafka sasl without user", EventStreamingConfig{Kafka: &KafkaStreamConfig{Brokers: []string{"kafka:9092"}, SASLMechanism: "plain"}}, false},
+		{"kafka bad sasl", EventStreamingConfig{Kafka: &KafkaStreamConfig{Brokers: []string{"kafka:9092"}, SASLMechanism: "gssapi", Username: "karl"}}, false},
+		{"nats without url", EventStreamingConfig{NATS: &NATSStreamConfig{}}, false},
+		{"nats http url", EventStreamingConfig{NATS: &NATSStreamConfig{URL: "http://nats:4222"}}, false},
+		{"nats wildcard subject", EventStreamingConfig{NATS: &NATSStreamConfig{URL: "nats://nats:4222", Subject: "karl.*"}}, false},
+		{"nats unknown event", EventStreamingConfig{NATS: &NATSStreamConfig{URL: "nats://nats:4222", Events: []string{"call-forwarded"}}}, false},
+		{"redis", EventStreamingConfig{Redis: &RedisStreamConfig{Addr: "redis:6379", DB: 2, Channels: map[string]string{EventDTMF: "ivr:dtmf"}}}, true},
+		{"redis without addr", EventStreamingConfig{Redis: &RedisStreamConfig{}}, false},
+		{"redis negative db", EventStreamingConfig{Redis: &RedisStreamConfig{Addr: "redis:6379", DB: -1}}, false},
+		{"redis pattern channel", EventStreamingConfig{Redis: &RedisStreamConfig{Addr: "redis:6379", Channel: "karl:*"}}, false},
+		{"queue size", EventStreamingConfig{QueueSize: -1}, false},
+	} {
+		if err := ValidateEventStreamingConfig(&Config{EventStreaming: &tt.config}); (err == nil) != tt.valid {
+			t.Errorf("%s: error %v", tt.name, err)
+		}
+	}
+}
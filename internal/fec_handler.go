@@ -52,20 +52,46 @@ func DefaultFECConfig() *FECConfig {
 	}
 }
 
-// FECPacket represents a Forward Error Correction packet
+// FlexFEC (RFC 8627) constants
+const (
+	// fecFixedHeaderSize is the RTP fixed header, which FlexFEC protects separately
+	fecFixedHeaderSize = 12
+
+	// fecBaseHeaderSize is the FlexFEC header without any SN base/mask blocks
+	fecBaseHeaderSize = 8
+
+	// fecMaxMaskBits is the largest span a flexible mask can cover (15 + 31 + 64)
+	fecMaxMaskBits = 110
+
+	// fecMaxOverhead is the most a repair packet adds to the payload it
+	// protects: the CSRC, SN base and the longest mask
+	fecMaxOverhead = 4 + fecBaseHeaderSize + 2 + 14
+
+	// FlexFECMimeSubtype is the SDP encoding name for RFC 8627 repair streams
+	FlexFECMimeSubtype = "flexfec"
+)
+
+// FECPacket is an RFC 8627 FlexFEC repair packet using a flexible mask
+// (R=0, F=0) over a single protected source stream
 type FECPacket struct {
-	SequenceBase uint16   // Base sequence number of protected packets
-	ProtectedSeq []uint16 // List of protected sequence numbers
-	PayloadXOR   []byte   // XOR of all protected payloads
-	LengthXOR    uint16   // XOR of all payload lengths
-	TimestampXOR uint32   // XOR of all timestamps
-	PTMarkerXOR  byte     // XOR of PT and Marker bits
+	ProtectedSSRC     uint32   // SSRC of the source stream (CSRC of the repair packet)
+	SequenceBase      uint16   // SN base of the mask
+	ProtectedSeq      []uint16 // Sequence numbers covered by the mask
+	HeaderRecovery    [2]byte  // XOR of the first two header bytes (P, X, CC, M, PT)
+	LengthRecovery    uint16   // XOR of each packet's length after the fixed header
+	TimestampRecovery uint32   // XOR of all timestamps
+	PayloadRecovery   []byte   // XOR of everything after the fixed header
 }
 
-// FECHandler handles Forward Error Correction for RTP streams
+// FECHandler generates and recovers FlexFEC repair packets for one RTP stream
 type FECHandler struct {
 	config *FECConfig
 
+	// Repair stream negotiated in SDP
+	payloadType   uint8
+	fecSSRC       uint32
+	protectedSSRC uint32
+
 	// Encoding state
 	encodingBlock    []*RTPPacketData
 	encodingBlockSeq uint16
@@ -82,13 +108,56 @@ type FECHandler struct {
 	mu sync.Mutex
 }
 
-// RTPPacketData holds RTP packet data for FEC
+// RTPPacketData holds the fields of an RTP packet that FlexFEC protects
 type RTPPacketData struct {
+	SSRC           uint32
 	SequenceNumber uint16
 	Timestamp      uint32
 	PayloadType    uint8
 	Marker         bool
-	Payload        []byte
+	Flags          uint8  // P, X and CC bits of the first header byte
+	Payload        []byte // Everything after the fixed header: CSRCs, extension, payload, padding
+}
+
+// ParseRTPPacketData splits a raw RTP packet into the fields FlexFEC protects
+func ParseRTPPacketData(raw []byte) (*RTPPacketData, error) {
+	if len(raw) < fecFixedHeaderSize || raw[0]>>6 != 2 {
+		return nil, ErrInvalidPacket
+	}
+
+	return &RTPPacketData{
+		Flags:          raw[0] & 0x3F,
+		Marker:         raw[1]&0x80 != 0,
+		PayloadType:    raw[1] & 0x7F,
+		SequenceNumber: binary.BigEndian.Uint16(raw[2:4]),
+		Timestamp:      binary.BigEndian.Uint32(raw[4:8]),
+		SSRC:           binary.BigEndian.Uint32(raw[8:12]),
+		Payload:        append([]byte(nil), raw[fecFixedHeaderSize:]...),
+	}, nil
+}
+
+// Marshal rebuilds the raw RTP packet
+func (p *RTPPacketData) Marshal() []byte {
+	buf := make([]byte, fecFixedHeaderSize+len(p.Payload))
+	buf[0] = 0x80 | (p.Flags & 0x3F)
+	buf[1] = p.PayloadType & 0x7F
+	if p.Marker {
+		buf[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(buf[2:4], p.SequenceNumber)
+	binary.BigEndian.PutUint32(buf[4:8], p.Timestamp)
+	binary.BigEndian.PutUint32(buf[8:12], p.SSRC)
+	copy(buf[fecFixedHeaderSize:], p.Payload)
+	return buf
+}
+
+// headerBytes returns the first two RTP header bytes as protected by FlexFEC
+func (p *RTPPacketData) headerBytes() [2]byte {
+	b := [2]byte{0x80 | (p.Flags & 0x3F), p.PayloadType & 0x7F}
+	if p.Marker {
+		b[1] |= 0x80
+	}
+	return b
 }
 
 // FECDecodingBlock holds state for decoding an FEC block
@@ -104,6 +173,9 @@ func NewFECHandler(config *FECConfig) *FECHandler {
 	if config == nil {
 		config = DefaultFECConfig()
 	}
+	if config.BlockSize > fecMaxMaskBits {
+		config.BlockSize = fecMaxMaskBits
+	}
 
 	return &FECHandler{
 		config:          config,
@@ -114,15 +186,36 @@ func NewFECHandler(config *FECConfig) *FECHandler {
 	}
 }
 
-// AddMediaPacket adds a media packet to the encoding block
+// SetRepairStream configures the FlexFEC repair stream negotiated in SDP
+func (h *FECHandler) SetRepairStream(payloadType uint8, fecSSRC, protectedSSRC uint32) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.payloadType = payloadType
+	h.fecSSRC = fecSSRC
+	h.protectedSSRC = protectedSSRC
+}
+
+// AddMediaPacket adds a media packet to the encoding block and returns a
+// repair packet once the block is complete. A packet whose repair packet
+// would exceed the transport MTU is left unprotected
 func (h *FECHandler) AddMediaPacket(pkt *RTPPacketData) *FECPacket {
 	if !h.config.Enabled {
 		return nil
 	}
+	if !fitsMTU("fec", fecFixedHeaderSize+fecMaxOverhead+len(pkt.Payload)) {
+		return nil
+	}
 
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
+	// A packet outside the mask span closes the current block first
+	var fecPkt *FECPacket
+	if len(h.encodingBlock) > 0 && seqDistance(h.encodingBlockSeq, pkt.SequenceNumber) >= fecMaxMaskBits {
+		fecPkt = h.generateFECPacket()
+		h.encodingBlock = make([]*RTPPacketData, 0, h.config.BlockSize)
+	}
+
 	// Start new block if empty
 	if len(h.encodingBlock) == 0 {
 		h.encodingBlockSeq = pkt.SequenceNumber
@@ -131,22 +224,21 @@ func (h *FECHandler) AddMediaPacket(pkt *RTPPacketData) *FECPacket {
 	h.encodingBlock = append(h.encodingBlock, pkt)
 
 	// Generate FEC packet when block is complete
-	if len(h.encodingBlock) >= h.config.BlockSize {
-		fecPkt := h.generateFECPacket()
+	if fecPkt == nil && len(h.encodingBlock) >= h.config.BlockSize {
+		fecPkt = h.generateFECPacket()
 		h.encodingBlock = make([]*RTPPacketData, 0, h.config.BlockSize)
-		return fecPkt
 	}
 
-	return nil
+	return fecPkt
 }
 
-// generateFECPacket generates an FEC packet from the current block
+// generateFECPacket builds a FlexFEC repair packet from the current block
 func (h *FECHandler) generateFECPacket() *FECPacket {
 	if len(h.encodingBlock) == 0 {
 		return nil
 	}
 
-	// Find max payload length
+	// Find max length after the fixed header
 	maxLen := 0
 	for _, pkt := range h.encodingBlock {
 		if len(pkt.Payload) > maxLen {
@@ -155,28 +247,18 @@ func (h *FECHandler) generateFECPacket() *FECPacket {
 	}
 
 	fec := &FECPacket{
-		SequenceBase: h.encodingBlockSeq,
-		ProtectedSeq: make([]uint16, len(h.encodingBlock)),
-		PayloadXOR:   make([]byte, maxLen),
+		ProtectedSSRC:   h.encodingBlock[0].SSRC,
+		SequenceBase:    h.encodingBlockSeq,
+		ProtectedSeq:    make([]uint16, len(h.encodingBlock)),
+		PayloadRecovery: make([]byte, maxLen),
+	}
+	if h.protectedSSRC != 0 {
+		fec.ProtectedSSRC = h.protectedSSRC
 	}
 
-	// XOR all packets together
 	for i, pkt := range h.encodingBlock {
 		fec.ProtectedSeq[i] = pkt.SequenceNumber
-		fec.LengthXOR ^= uint16(len(pkt.Payload))
-		fec.TimestampXOR ^= pkt.Timestamp
-
-		// XOR PT and Marker
-		ptMarker := pkt.PayloadType
-		if pkt.Marker {
-			ptMarker |= 0x80
-		}
-		fec.PTMarkerXOR ^= ptMarker
-
-		// XOR payload
-		for j := 0; j < len(pkt.Payload); j++ {
-			fec.PayloadXOR[j] ^= pkt.Payload[j]
-		}
+		xorFECFields(fec, pkt)
 	}
 
 	h.fecSeqNum++
@@ -186,6 +268,37 @@ func (h *FECHandler) generateFECPacket() *FECPacket {
 	return fec
 }
 
+// xorFECFields applies the FlexFEC protection operation for one packet
+func xorFECFields(fec *FECPacket, pkt *RTPPacketData) {
+	header := pkt.headerBytes()
+	fec.HeaderRecovery[0] ^= header[0]
+	fec.HeaderRecovery[1] ^= header[1]
+	fec.LengthRecovery ^= uint16(len(pkt.Payload))
+	fec.TimestampRecovery ^= pkt.Timestamp
+	for j := 0; j < len(pkt.Payload) && j < len(fec.PayloadRecovery); j++ {
+		fec.PayloadRecovery[j] ^= pkt.Payload[j]
+	}
+}
+
+// PacketizeFEC wraps a repair packet in an RTP packet on the negotiated
+// repair stream, with the protected SSRC in the CSRC list (RFC 8627 Section 4.1)
+func (h *FECHandler) PacketizeFEC(fec *FECPacket, timestamp uint32) []byte {
+	h.mu.Lock()
+	payloadType, ssrc, seq := h.payloadType, h.fecSSRC, h.fecSeqNum
+	h.mu.Unlock()
+
+	payload := SerializeFECPacket(fec)
+	buf := make([]byte, fecFixedHeaderSize+4+len(payload))
+	buf[0] = 0x80 | 1 // V=2, CC=1
+	buf[1] = payloadType & 0x7F
+	binary.BigEndian.PutUint16(buf[2:4], seq)
+	binary.BigEndian.PutUint32(buf[4:8], timestamp)
+	binary.BigEndian.PutUint32(buf[8:12], ssrc)
+	binary.BigEndian.PutUint32(buf[12:16], fec.ProtectedSSRC)
+	copy(buf[16:], payload)
+	return buf
+}
+
 // ReceiveMediaPacket receives a media packet for potential recovery
 func (h *FECHandler) ReceiveMediaPacket(pkt *RTPPacketData) {
 	h.mu.Lock()
@@ -201,6 +314,28 @@ func (h *FECHandler) ReceiveMediaPacket(pkt *RTPPacketData) {
 	h.tryCompleteBlocks(pkt.SequenceNumber)
 }
 
+// ReceiveFECRTP parses a FlexFEC RTP packet from the repair stream and
+// returns any source packets it allowed to be recovered
+func (h *FECHandler) ReceiveFECRTP(raw []byte) ([]*RTPPacketData, error) {
+	if len(raw) < fecFixedHeaderSize || raw[0]>>6 != 2 {
+		return nil, ErrInvalidPacket
+	}
+
+	cc := int(raw[0] & 0x0F)
+	offset := fecFixedHeaderSize + cc*4
+	if cc == 0 || len(raw) < offset {
+		return nil, ErrInvalidPacket
+	}
+
+	fec, err := DeserializeFECPacket(raw[offset:])
+	if err != nil {
+		return nil, err
+	}
+	fec.ProtectedSSRC = binary.BigEndian.Uint32(raw[fecFixedHeaderSize:])
+
+	return h.ReceiveFECPacket(fec), nil
+}
+
 // ReceiveFECPacket receives an FEC packet for potential recovery
 func (h *FECHandler) ReceiveFECPacket(fec *FECPacket) []*RTPPacketData {
 	if !h.config.Enabled || fec == nil {
@@ -246,40 +381,34 @@ func (h *FECHandler) tryRecoverPackets(block *FECDecodingBlock) []*RTPPacketData
 	missingSeq := block.MissingPackets[0]
 	fec := block.FECPacket
 
-	// Recover the missing packet by XORing FEC with all received packets
-	recoveredPayload := make([]byte, len(fec.PayloadXOR))
-	copy(recoveredPayload, fec.PayloadXOR)
-
-	recoveredLengthXOR := fec.LengthXOR
-	recoveredTimestampXOR := fec.TimestampXOR
-	recoveredPTMarkerXOR := fec.PTMarkerXOR
-
+	// XOR the repair packet with every received packet to leave the missing one
+	recovered := &FECPacket{
+		HeaderRecovery:    fec.HeaderRecovery,
+		LengthRecovery:    fec.LengthRecovery,
+		TimestampRecovery: fec.TimestampRecovery,
+		PayloadRecovery:   append([]byte(nil), fec.PayloadRecovery...),
+	}
 	for seq, pkt := range block.ReceivedPackets {
 		if seq == missingSeq {
 			continue
 		}
+		xorFECFields(recovered, pkt)
+	}
 
-		recoveredLengthXOR ^= uint16(len(pkt.Payload))
-		recoveredTimestampXOR ^= pkt.Timestamp
-
-		ptMarker := pkt.PayloadType
-		if pkt.Marker {
-			ptMarker |= 0x80
-		}
-		recoveredPTMarkerXOR ^= ptMarker
-
-		for j := 0; j < len(pkt.Payload) && j < len(recoveredPayload); j++ {
-			recoveredPayload[j] ^= pkt.Payload[j]
-		}
+	if int(recovered.LengthRecovery) > len(recovered.PayloadRecovery) {
+		fecRecoveryFailures.Inc()
+		return nil
 	}
 
 	// Construct recovered packet
 	recoveredPkt := &RTPPacketData{
+		SSRC:           fec.ProtectedSSRC,
 		SequenceNumber: missingSeq,
-		Timestamp:      recoveredTimestampXOR,
-		PayloadType:    recoveredPTMarkerXOR & 0x7F,
-		Marker:         (recoveredPTMarkerXOR & 0x80) != 0,
-		Payload:        recoveredPayload[:recoveredLengthXOR],
+		Timestamp:      recovered.TimestampRecovery,
+		PayloadType:    recovered.HeaderRecovery[1] & 0x7F,
+		Marker:         recovered.HeaderRecovery[1]&0x80 != 0,
+		Flags:          recovered.HeaderRecovery[0] & 0x3F,
+		Payload:        recovered.PayloadRecovery[:recovered.LengthRecovery],
 	}
 
 	// Store recovered packet
@@ -392,8 +521,8 @@ func (h *FECHandler) adjustRedundancy() {
 	if newBlockSize < 2 {
 		newBlockSize = 2
 	}
-	if newBlockSize > 100 {
-		newBlockSize = 100
+	if newBlockSize > fecMaxMaskBits {
+		newBlockSize = fecMaxMaskBits
 	}
 
 	h.config.BlockSize = newBlockSize
@@ -437,6 +566,79 @@ func (h *FECHandler) SetEnabled(enabled bool) {
 	h.config.Enabled = enabled
 }
 
+// Handlers recovering received streams, keyed by the SSRCs of the repair
+// stream and the stream it protects
+var (
+	fecHandlers   = make(map[uint32]*FECHandler)
+	fecHandlersMu sync.RWMutex
+)
+
+// RegisterFECHandler makes the worker pool recover the stream a handler's
+// repair stream protects. Call it again after SetRepairStream
+func RegisterFECHandler(h *FECHandler) {
+	h.mu.Lock()
+	fecSSRC, protectedSSRC := h.fecSSRC, h.protectedSSRC
+	h.mu.Unlock()
+
+	fecHandlersMu.Lock()
+	defer fecHandlersMu.Unlock()
+	for ssrc, registered := range fecHandlers {
+		if registered == h {
+			delete(fecHandlers, ssrc)
+		}
+	}
+	if fecSSRC != 0 && protectedSSRC != 0 {
+		fecHandlers[fecSSRC] = h
+		fecHandlers[protectedSSRC] = h
+	}
+}
+
+// UnregisterFECHandler stops recovering the streams of a handler
+func UnregisterFECHandler(h *FECHandler) {
+	fecHandlersMu.Lock()
+	defer fecHandlersMu.Unlock()
+	for ssrc, registered := range fecHandlers {
+		if registered == h {
+			delete(fecHandlers, ssrc)
+		}
+	}
+}
+
+// fecHandlerFor returns the handler recovering an SSRC's stream, if any
+func fecHandlerFor(ssrc uint32) *FECHandler {
+	fecHandlersMu.RLock()
+	defer fecHandlersMu.RUnlock()
+	return fecHandlers[ssrc]
+}
+
+// receiveFEC passes a received packet to its stream's FEC handler and
+// reports whether it goes on to be forwarded. Repair packets do not; the
+// packets they recover are queued on the worker of the protected stream
+func receiveFEC(h *FECHandler, packet []byte, ssrc uint32, workerID int) bool {
+	h.mu.Lock()
+	repair := ssrc == h.fecSSRC
+	h.mu.Unlock()
+
+	if !repair {
+		if media, err := ParseRTPPacketData(packet); err == nil {
+			h.ReceiveMediaPacket(media)
+		}
+		return true
+	}
+
+	recovered, err := h.ReceiveFECRTP(packet)
+	if err != nil {
+		if workerErrors.Allow() {
+			workerErrors.Log("Invalid FEC packet", append(streamAttrs(ssrc), "worker", workerID, "error", err)...)
+		}
+		return false
+	}
+	for _, p := range recovered {
+		AddRTPJob(p.Marshal())
+	}
+	return false
+}
+
 // SetBlockSize sets the FEC block size
 func (h *FECHandler) SetBlockSize(blockSize int) {
 	h.mu.Lock()
@@ -444,8 +646,8 @@ func (h *FECHandler) SetBlockSize(blockSize int) {
 	if blockSize < 2 {
 		blockSize = 2
 	}
-	if blockSize > 100 {
-		blockSize = 100
+	if blockSize > fecMaxMaskBits {
+		blockSize = fecMaxMaskBits
 	}
 	h.config.BlockSize = blockSize
 	h.config.Redundancy = 1.0 / float64(blockSize)
@@ -464,112 +666,121 @@ func (h *FECHandler) Reset() {
 	h.currentLossRate = 0
 }
 
-// SerializeFECPacket serializes an FEC packet for transmission
+// SerializeFECPacket encodes the FlexFEC header (flexible mask, R=0, F=0)
+// followed by the repair payload, as carried in the RTP payload
 func SerializeFECPacket(fec *FECPacket) []byte {
-	// FEC packet format:
-	// [2 bytes: sequence base]
-	// [2 bytes: number of protected packets]
-	// [N * 2 bytes: protected sequence numbers]
-	// [2 bytes: length XOR]
-	// [4 bytes: timestamp XOR]
-	// [1 byte: PT/Marker XOR]
-	// [2 bytes: payload length]
-	// [M bytes: payload XOR]
-
-	numProtected := len(fec.ProtectedSeq)
-	headerSize := 2 + 2 + numProtected*2 + 2 + 4 + 1 + 2
-	totalSize := headerSize + len(fec.PayloadXOR)
-
-	buf := make([]byte, totalSize)
-	offset := 0
-
-	// Sequence base
-	binary.BigEndian.PutUint16(buf[offset:], fec.SequenceBase)
-	offset += 2
-
-	// Number of protected packets
-	binary.BigEndian.PutUint16(buf[offset:], uint16(numProtected))
-	offset += 2
-
-	// Protected sequence numbers
+	// Build the 110-bit mask relative to the SN base
+	var mask [2]uint64
 	for _, seq := range fec.ProtectedSeq {
-		binary.BigEndian.PutUint16(buf[offset:], seq)
-		offset += 2
+		bit := int(seqDistance(fec.SequenceBase, seq))
+		if bit >= fecMaxMaskBits {
+			continue
+		}
+		mask[bit/64] |= 1 << (63 - uint(bit%64))
 	}
 
-	// Length XOR
-	binary.BigEndian.PutUint16(buf[offset:], fec.LengthXOR)
-	offset += 2
+	// Use the shortest mask that covers every protected packet
+	maskBytes := 2
+	if mask[0]&((1<<49)-1) != 0 || mask[1] != 0 {
+		maskBytes = 6
+		if mask[0]&((1<<18)-1) != 0 || mask[1] != 0 {
+			maskBytes = 14
+		}
+	}
 
-	// Timestamp XOR
-	binary.BigEndian.PutUint32(buf[offset:], fec.TimestampXOR)
-	offset += 4
+	buf := make([]byte, fecBaseHeaderSize+2+maskBytes+len(fec.PayloadRecovery))
 
-	// PT/Marker XOR
-	buf[offset] = fec.PTMarkerXOR
-	offset++
+	// R and F are zero; the rest of the first two bytes are recovery bits
+	buf[0] = fec.HeaderRecovery[0] & 0x3F
+	buf[1] = fec.HeaderRecovery[1]
+	binary.BigEndian.PutUint16(buf[2:4], fec.LengthRecovery)
+	binary.BigEndian.PutUint32(buf[4:8], fec.TimestampRecovery)
+	binary.BigEndian.PutUint16(buf[8:10], fec.SequenceBase)
 
-	// Payload length
-	binary.BigEndian.PutUint16(buf[offset:], uint16(len(fec.PayloadXOR)))
+	// Mask bits 0-14, 15-45 and 46-109, each block led by its k bit
+	offset := 10
+	mask15 := uint16(mask[0] >> 49)
+	if maskBytes == 2 {
+		mask15 |= 0x8000
+	}
+	binary.BigEndian.PutUint16(buf[offset:], mask15)
 	offset += 2
 
-	// Payload XOR
-	copy(buf[offset:], fec.PayloadXOR)
+	if maskBytes >= 6 {
+		mask31 := uint32(mask[0]>>18) & 0x7FFFFFFF
+		if maskBytes == 6 {
+			mask31 |= 0x80000000
+		}
+		binary.BigEndian.PutUint32(buf[offset:], mask31)
+		offset += 4
+	}
+	if maskBytes == 14 {
+		mask64 := mask[0]<<46 | mask[1]>>18
+		binary.BigEndian.PutUint64(buf[offset:], mask64)
+		offset += 8
+	}
 
+	copy(buf[offset:], fec.PayloadRecovery)
 	return buf
 }
 
-// DeserializeFECPacket deserializes an FEC packet
+// DeserializeFECPacket decodes a FlexFEC header and repair payload
 func DeserializeFECPacket(data []byte) (*FECPacket, error) {
-	if len(data) < 11 {
+	if len(data) < fecBaseHeaderSize+4 {
 		return nil, ErrInvalidPacket
 	}
 
-	fec := &FECPacket{}
-	offset := 0
-
-	// Sequence base
-	fec.SequenceBase = binary.BigEndian.Uint16(data[offset:])
-	offset += 2
-
-	// Number of protected packets
-	numProtected := int(binary.BigEndian.Uint16(data[offset:]))
-	offset += 2
-
-	if len(data) < offset+numProtected*2+9 {
+	// Only the flexible mask variant is supported
+	if data[0]&0xC0 != 0 {
 		return nil, ErrInvalidPacket
 	}
 
-	// Protected sequence numbers
-	fec.ProtectedSeq = make([]uint16, numProtected)
-	for i := 0; i < numProtected; i++ {
-		fec.ProtectedSeq[i] = binary.BigEndian.Uint16(data[offset:])
-		offset += 2
+	fec := &FECPacket{
+		HeaderRecovery:    [2]byte{data[0] & 0x3F, data[1]},
+		LengthRecovery:    binary.BigEndian.Uint16(data[2:4]),
+		TimestampRecovery: binary.BigEndian.Uint32(data[4:8]),
+		SequenceBase:      binary.BigEndian.Uint16(data[8:10]),
 	}
 
-	// Length XOR
-	fec.LengthXOR = binary.BigEndian.Uint16(data[offset:])
+	// Walk the mask blocks until one has its k bit set
+	offset := 10
+	var bits []bool
+	mask15 := binary.BigEndian.Uint16(data[offset:])
 	offset += 2
+	for i := 14; i >= 0; i-- {
+		bits = append(bits, mask15&(1<<uint(i)) != 0)
+	}
 
-	// Timestamp XOR
-	fec.TimestampXOR = binary.BigEndian.Uint32(data[offset:])
-	offset += 4
-
-	// PT/Marker XOR
-	fec.PTMarkerXOR = data[offset]
-	offset++
+	if mask15&0x8000 == 0 {
+		if len(data) < offset+4 {
+			return nil, ErrInvalidPacket
+		}
+		mask31 := binary.BigEndian.Uint32(data[offset:])
+		offset += 4
+		for i := 30; i >= 0; i-- {
+			bits = append(bits, mask31&(1<<uint(i)) != 0)
+		}
 
-	// Payload length
-	payloadLen := int(binary.BigEndian.Uint16(data[offset:]))
-	offset += 2
+		if mask31&0x80000000 == 0 {
+			if len(data) < offset+8 {
+				return nil, ErrInvalidPacket
+			}
+			mask64 := binary.BigEndian.Uint64(data[offset:])
+			offset += 8
+			for i := 63; i >= 0; i-- {
+				bits = append(bits, mask64&(1<<uint(i)) != 0)
+			}
+		}
+	}
 
-	if len(data) < offset+payloadLen {
-		return nil, ErrInvalidPacket
+	for i, set := range bits {
+		if set {
+			fec.ProtectedSeq = append(fec.ProtectedSeq, fec.SequenceBase+uint16(i))
+		}
 	}
 
-	// Payload XOR
-	fec.PayloadXOR = make([]byte, payloadLen)
-	copy(fec.PayloadXOR, data[offset:offset+payloadLen])
+	fec.PayloadRecovery = make([]byte, len(data)-offset)
+	copy(fec.PayloadRecovery, data[offset:])
 
 	return fec, nil
 }
@@ -0,0 +1,238 @@
+package internal
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func newFECTestPacket(seq uint16) *RTPPacketData {
+	payload := make([]byte, 20+int(seq%7))
+	for i := range payload {
+		payload[i] = byte(int(seq) + i)
+	}
+	return &RTPPacketData{
+		SSRC:           0x1234,
+		SequenceNumber: seq,
+		Timestamp:      uint32(seq) * 160,
+		PayloadType:    111,
+		Payload:        payload,
+	}
+}
+
+func TestFlexFEC_SerializeMaskSizes(t *testing.T) {
+	tests := []struct {
+		name    string
+		offsets []uint16
+		hdrLen  int
+	}{
+		{"short mask", []uint16{0, 3, 14}, 12},
+		{"medium mask", []uint16{0, 15, 45}, 16},
+		{"long mask", []uint16{0, 46, 109}, 24},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fec := &FECPacket{
+				SequenceBase:      65530,
+				HeaderRecovery:    [2]byte{0x12, 0xEF},
+				LengthRecovery:    0x0102,
+				TimestampRecovery: 0xDEADBEEF,
+				PayloadRecovery:   []byte{1, 2, 3},
+			}
+			for _, off := range tt.offsets {
+				fec.ProtectedSeq = append(fec.ProtectedSeq, fec.SequenceBase+off)
+			}
+
+			data := SerializeFECPacket(fec)
+			if len(data) != tt.hdrLen+len(fec.PayloadRecovery) {
+				t.Fatalf("expected %d header bytes, got %d", tt.hdrLen, len(data)-len(fec.PayloadRecovery))
+			}
+			if data[0]&0xC0 != 0 {
+				t.Error("expected R and F bits to be zero")
+			}
+
+			decoded, err := DeserializeFECPacket(data)
+			if err != nil {
+				t.Fatalf("DeserializeFECPacket failed: %v", err)
+			}
+			if len(decoded.ProtectedSeq) != len(fec.ProtectedSeq) {
+				t.Fatalf("expected %v protected, got %v", fec.ProtectedSeq, decoded.ProtectedSeq)
+			}
+			for i := range fec.ProtectedSeq {
+				if decoded.ProtectedSeq[i] != fec.ProtectedSeq[i] {
+					t.Errorf("expected protected seq %d, got %d", fec.ProtectedSeq[i], decoded.ProtectedSeq[i])
+				}
+			}
+			if decoded.HeaderRecovery != [2]byte{0x12, 0xEF} || decoded.LengthRecovery != 0x0102 ||
+				decoded.TimestampRecovery != 0xDEADBEEF || !bytes.Equal(decoded.PayloadRecovery, fec.PayloadRecovery) {
+				t.Errorf("recovery fields did not round-trip: %+v", decoded)
+			}
+		})
+	}
+}
+
+func TestFlexFEC_RecoverLostPacket(t *testing.T) {
+	config := DefaultFECConfig()
+	config.BlockSize = 5
+	encoder := NewFECHandler(config)
+	decoder := NewFECHandler(DefaultFECConfig())
+
+	packets := make([]*RTPPacketData, 5)
+	var fec *FECPacket
+	for i := range packets {
+		packets[i] = newFECTestPacket(uint16(100 + i))
+		fec = encoder.AddMediaPacket(packets[i])
+	}
+	packets[2].Marker = true
+	packets[2].Flags = 0x10 // extension bit
+	if fec == nil {
+		t.Fatal("expected repair packet after a full block")
+	}
+
+	// Rebuild the repair packet now that packet 2 has changed
+	encoder.Reset()
+	for _, pkt := range packets {
+		fec = encoder.AddMediaPacket(pkt)
+	}
+
+	// Drop packet 2 on the wire
+	for i, pkt := range packets {
+		if i != 2 {
+			decoder.ReceiveMediaPacket(pkt)
+		}
+	}
+
+	raw := encoder.PacketizeFEC(fec, packets[4].Timestamp)
+	recovered, err := decoder.ReceiveFECRTP(raw)
+	if err != nil {
+		t.Fatalf("ReceiveFECRTP failed: %v", err)
+	}
+	if len(recovered) != 1 {
+		t.Fatalf("expected 1 recovered packet, got %d", len(recovered))
+	}
+
+	if !bytes.Equal(recovered[0].Marshal(), packets[2].Marshal()) {
+		t.Errorf("recovered packet differs from original:\n got %x\nwant %x", recovered[0].Marshal(), packets[2].Marshal())
+	}
+}
+
+// fecSeqHandler reports the streams and sequence numbers it forwards
+type fecSeqHandler chan [2]uint32
+
+func (h fecSeqHandler) Handle(packet *RTPPacket) error {
+	h <- [2]uint32{packet.SSRC, uint32(packet.SequenceNumber)}
+	return nil
+}
+
+func TestFlexFEC_WorkerPoolRecovery(t *testing.T) {
+	withWorkerPool(t)
+	const fecSSRC, mediaSSRC = 0x5678, 0x1234
+
+	config := DefaultFECConfig()
+	config.BlockSize = 5
+	encoder := NewFECHandler(config)
+	encoder.SetRepairStream(120, fecSSRC, mediaSSRC)
+	decoder := NewFECHandler(DefaultFECConfig())
+	decoder.SetRepairStream(120, fecSSRC, mediaSSRC)
+	RegisterFECHandler(decoder)
+	defer UnregisterFECHandler(decoder)
+
+	forwarded := make(fecSeqHandler, 16)
+	RegisterRTPHandler(mediaSSRC, forwarded)
+	defer UnregisterRTPHandler(mediaSSRC)
+	RegisterRTPHandler(fecSSRC, forwarded)
+	defer UnregisterRTPHandler(fecSSRC)
+
+	// Packet 102 is lost; the repair packet brings it back
+	var fec *FECPacket
+	for i := 0; i < 5; i++ {
+		pkt := newFECTestPacket(uint16(100 + i))
+		fec = encoder.AddMediaPacket(pkt)
+		if i != 2 {
+			AddRTPJob(pkt.Marshal())
+		}
+	}
+	// The repair stream has a worker of its own; let the media arrive first
+	time.Sleep(50 * time.Millisecond)
+	AddRTPJob(encoder.PacketizeFEC(fec, 104*160))
+
+	seen := make(map[uint32]bool)
+	for i := 0; i < 5; i++ {
+		select {
+		case got := <-forwarded:
+			if got[0] != mediaSSRC {
+				t.Fatalf("forwarded a packet of SSRC %#x", got[0])
+			}
+			seen[got[1]] = true
+		case <-time.After(2 * time.Second):
+			t.Fatalf("forwarded %d of 5 packets", i)
+		}
+	}
+	if !seen[102] {
+		t.Errorf("lost packet was not recovered, forwarded %v", seen)
+	}
+}
+
+func TestFlexFEC_TwoLossesNotRecoverable(t *testing.T) {
+	config := DefaultFECConfig()
+	config.BlockSize = 4
+	encoder := NewFECHandler(config)
+	decoder := NewFECHandler(DefaultFECConfig())
+
+	var fec *FECPacket
+	for i := 0; i < 4; i++ {
+		pkt := newFECTestPacket(uint16(i))
+		fec = encoder.AddMediaPacket(pkt)
+		if i < 2 {
+			decoder.ReceiveMediaPacket(pkt)
+		}
+	}
+
+	if recovered := decoder.ReceiveFECPacket(fec); len(recovered) != 0 {
+		t.Errorf("expected no recovery with two losses, got %d", len(recovered))
+	}
+}
+
+func TestFlexFEC_RTPPacketDataRoundTrip(t *testing.T) {
+	pkt := newFECTestPacket(42)
+	pkt.Marker = true
+
+	parsed, err := ParseRTPPacketData(pkt.Marshal())
+	if err != nil {
+		t.Fatalf("ParseRTPPacketData failed: %v", err)
+	}
+	if parsed.SSRC != pkt.SSRC || parsed.SequenceNumber != 42 || !parsed.Marker || parsed.PayloadType != 111 {
+		t.Errorf("unexpected parsed packet: %+v", parsed)
+	}
+
+	if _, err := ParseRTPPacketData([]byte{0x80, 0x00}); err == nil {
+		t.Error("expected error for truncated packet")
+	}
+}
+
+func TestNGSocketListener_ParseFlexFECOffer(t *testing.T) {
+	listener := &NGSocketListener{}
+	sdp := "v=0\r\n" +
+		"o=- 1 1 IN IP4 192.0.2.1\r\n" +
+		"s=-\r\n" +
+		"c=IN IP4 192.0.2.1\r\n" +
+		"t=0 0\r\n" +
+		"m=audio 5004 RTP/AVP 111 118\r\n" +
+		"a=rtpmap:111 opus/48000/2\r\n" +
+		"a=rtpmap:118 flexfec-03/48000\r\n" +
+		"a=ssrc-group:FEC-FR 1111 2222\r\n"
+
+	parsed, err := listener.parseSDP(sdp)
+	if err != nil {
+		t.Fatalf("parseSDP failed: %v", err)
+	}
+
+	pt, ok := parsed.flexFECPayloadType()
+	if !ok || pt != 118 {
+		t.Errorf("expected FlexFEC payload type 118, got %d (ok=%v)", pt, ok)
+	}
+	if parsed.SSRC != 1111 || parsed.FECSSRC != 2222 {
+		t.Errorf("expected FEC-FR group 1111/2222, got %d/%d", parsed.SSRC, parsed.FECSSRC)
+	}
+}
@@ -0,0 +1,129 @@
+//go:build karl_g729 && cgo
+
+package internal
+
+/*
+#cgo LDFLAGS: -lbcg729
+#include <stdint.h>
+#include <bcg729/encoder.h>
+#include <bcg729/decoder.h>
+*/
+import "C"
+
+import (
+	"fmt"
+	"runtime"
+	"unsafe"
+)
+
+// G.729 with Annex B from Belledonne's bcg729, which produces the ITU-T
+// bitstream. G.729 may need a patent license in some countries; check
+// before enabling it
+func init() {
+	registerAudioCodec(MimeTypeG729, nativeAudioCodec{
+		offer:      CodecInfo{PayloadType: G729PayloadType, Name: "G729", ClockRate: G729SampleRate, Channels: 1},
+		sampleRate: func(CodecInfo) int { return G729SampleRate },
+		newEncoder: newG729Encoder,
+		newDecoder: newG729Decoder,
+	})
+}
+
+// g729Encoder encodes 10 ms frames, sending a SID frame when Annex B
+// detects silence and nothing until the noise changes
+type g729Encoder struct {
+	ctx    *C.bcg729EncoderChannelContextStruct
+	framer pcmFramer
+}
+
+func newG729Encoder(codec CodecInfo) (audioEncoder, error) {
+	var vad C.uint8_t
+	if G729AnnexB(codec.Fmtp) {
+		vad = 1
+	}
+	ctx := C.initBcg729EncoderChannel(vad)
+	if ctx == nil {
+		return nil, fmt.Errorf("failed to create G.729 encoder")
+	}
+	e := &g729Encoder{ctx: ctx, framer: pcmFramer{size: G729FrameSamples}}
+	runtime.SetFinalizer(e, (*g729Encoder).Close)
+	return e, nil
+}
+
+// Encode returns the frames of pcm, empty while Annex B suppresses them. A
+// SID frame can only end a payload, so speech after it in the same payload
+// replaces it
+func (e *g729Encoder) Encode(pcm []int16) ([]byte, error) {
+	if e.ctx == nil {
+		return nil, fmt.Errorf("G.729 encoder closed")
+	}
+	var payload, sid []byte
+	for _, frame := range e.framer.frames(pcm) {
+		var bits [G729FrameSize]byte
+		var n C.uint8_t
+		C.bcg729Encoder(e.ctx, (*C.int16_t)(unsafe.Pointer(&frame[0])), (*C.uint8_t)(unsafe.Pointer(&bits[0])), &n)
+		switch int(n) {
+		case G729FrameSize:
+			payload = append(payload, bits[:]...)
+			sid = nil
+		case G729AnnexBSize:
+			sid = append(sid[:0], bits[:G729AnnexBSize]...)
+		}
+	}
+	return append(payload, sid...), nil
+}
+
+// Close frees the encoder
+func (e *g729Encoder) Close() {
+	if e.ctx != nil {
+		C.closeBcg729EncoderChannel(e.ctx)
+		e.ctx = nil
+	}
+	runtime.SetFinalizer(e, nil)
+}
+
+// g729Decoder decodes speech and SID frames, filling the gaps between SID
+// frames with comfort noise
+type g729Decoder struct {
+	ctx *C.bcg729DecoderChannelContextStruct
+}
+
+func newG729Decoder(CodecInfo) (audioDecoder, error) {
+	ctx := C.initBcg729DecoderChannel()
+	if ctx == nil {
+		return nil, fmt.Errorf("failed to create G.729 decoder")
+	}
+	d := &g729Decoder{ctx: ctx}
+	runtime.SetFinalizer(d, (*g729Decoder).Close)
+	return d, nil
+}
+
+// Decode decodes the frames of a payload, 10 ms of PCM each
+func (d *g729Decoder) Decode(payload []byte) ([]int16, error) {
+	if d.ctx == nil {
+		return nil, fmt.Errorf("G.729 decoder closed")
+	}
+	if !IsG729Frame(payload) {
+		return nil, fmt.Errorf("invalid G.729 payload of %d bytes", len(payload))
+	}
+	pcm := make([]int16, G729FrameCount(payload)*G729FrameSamples)
+	for i := 0; len(payload) > 0; i++ {
+		size, sid := G729FrameSize, C.uint8_t(0)
+		if len(payload) == G729AnnexBSize {
+			size, sid = G729AnnexBSize, 1
+		}
+		out := pcm[i*G729FrameSamples:]
+		C.bcg729Decoder(d.ctx, (*C.uint8_t)(unsafe.Pointer(&payload[0])), C.uint8_t(size), 0, sid, 0,
+			(*C.int16_t)(unsafe.Pointer(&out[0])))
+		payload = payload[size:]
+	}
+	return pcm, nil
+}
+
+// Close frees the decoder
+func (d *g729Decoder) Close() {
+	if d.ctx != nil {
+		C.closeBcg729DecoderChannel(d.ctx)
+		d.ctx = nil
+	}
+	runtime.SetFinalizer(d, nil)
+}
@@ -0,0 +1,71 @@
+//go:build karl_g729 && cgo
+
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestG729_RoundTrip(t *testing.T) {
+	codec := CodecInfo{Name: "G729", ClockRate: G729SampleRate, Fmtp: "annexb=no"}
+	payloads, pcm := nativeRoundTrip(t, codec)
+	if len(payloads) != 50 {
+		t.Fatalf("expected 50 payloads, got %d", len(payloads))
+	}
+	for _, p := range payloads {
+		if len(p) != 2*G729FrameSize {
+			t.Fatalf("expected two frames per payload, got %d bytes", len(p))
+		}
+	}
+	checkTone(t, "G.729", pcm, G729SampleRate)
+}
+
+func TestG729_AnnexBSilence(t *testing.T) {
+	codecs := NewStreamCodecs()
+	defer codecs.close()
+	codec := CodecInfo{Name: "G729", ClockRate: G729SampleRate}
+
+	var sid, suppressed int
+	for i := 0; i < 50; i++ {
+		payload, err := encodeAudio(codec, make([]int16, 160), codecs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case len(payload) == 0:
+			suppressed++
+			continue
+		case len(payload)%G729FrameSize == G729AnnexBSize:
+			sid++
+		}
+		pcm, err := decodeAudio(codec, payload, codecs)
+		if err != nil || len(pcm) != G729FrameCount(payload)*G729FrameSamples {
+			t.Fatalf("expected %d samples decoded, got %d (%v)", G729FrameCount(payload)*G729FrameSamples, len(pcm), err)
+		}
+	}
+	if sid == 0 || suppressed == 0 {
+		t.Errorf("expected silence sent as SID frames then suppressed, got %d SID and %d suppressed", sid, suppressed)
+	}
+}
+
+func TestTranscodeAudio_G729(t *testing.T) {
+	pcmu := encodeG711("PCMU", resamplerTone(440, 8000, 160))
+	g729, err := TranscodeAudio(pcmu, webrtc.MimeTypePCMU, MimeTypeG729)
+	if err != nil || len(g729) != 2*G729FrameSize {
+		t.Fatalf("expected two G.729 frames, got %d bytes (%v)", len(g729), err)
+	}
+	back, err := TranscodeAudio(g729, MimeTypeG729, webrtc.MimeTypePCMU)
+	if err != nil || len(back) != len(pcmu) || bytes.Equal(back, g729) {
+		t.Fatalf("expected 160 PCMU samples, got %d bytes (%v)", len(back), err)
+	}
+	if _, err := TranscodeAudio(make([]byte, 7), MimeTypeG729, webrtc.MimeTypePCMU); err == nil || errors.Is(err, ErrFrameSuppressed) {
+		t.Errorf("expected a malformed payload rejected, got %v", err)
+	}
+	if added := TranscodeOfferCodecs(nil, []string{"G729"}); len(added) != 1 || added[0].PayloadType != G729PayloadType {
+		t.Errorf("expected G.729 offered for transcoding, got %+v", added)
+	}
+}
@@ -0,0 +1,4 @@
+// Package karlpb holds the protobuf and gRPC code generated from karl.proto
+package karlpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative karl.proto
@@ -0,0 +1,1417 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: karl.proto
+
+package karlpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type Session struct {
+	state           protoimpl.MessageState `protogen:"open.v1"`
+	Id              string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	CallId          string                 `protobuf:"bytes,2,opt,name=call_id,json=callId,proto3" json:"call_id,omitempty"`
+	FromTag         string                 `protobuf:"bytes,3,opt,name=from_tag,json=fromTag,proto3" json:"from_tag,omitempty"`
+	ToTag           string                 `protobuf:"bytes,4,opt,name=to_tag,json=toTag,proto3" json:"to_tag,omitempty"`
+	State           string                 `protobuf:"bytes,5,opt,name=state,proto3" json:"state,omitempty"`
+	CreatedAt       *timestamppb.Timestamp `protobuf:"bytes,6,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`
+	UpdatedAt       *timestamppb.Timestamp `protobuf:"bytes,7,opt,name=updated_at,json=updatedAt,proto3" json:"updated_at,omitempty"`
+	DurationSeconds float64                `protobuf:"fixed64,8,opt,name=duration_seconds,json=durationSeconds,proto3" json:"duration_seconds,omitempty"`
+	CallerLeg       *Leg                   `protobuf:"bytes,9,opt,name=caller_leg,json=callerLeg,proto3" json:"caller_leg,omitempty"`
+	CalleeLeg       *Leg                   `protobuf:"bytes,10,opt,name=callee_leg,json=calleeLeg,proto3" json:"callee_leg,omitempty"`
+	Flags           map[string]bool        `protobuf:"bytes,11,rep,name=flags,proto3" json:"flags,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"varint,2,opt,name=value"`
+	Metadata        map[string]string      `protobuf:"bytes,12,rep,name=metadata,proto3" json:"metadata,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *Session) Reset() {
+	*x = Session{}
+	mi := &file_karl_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Session) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Session) ProtoMessage() {}
+
+func (x *Session) ProtoReflect() protoreflect.Message {
+	mi := &file_karl_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Session.ProtoReflect.Descriptor instead.
+func (*Session) Descriptor() ([]byte, []int) {
+	return file_karl_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Session) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *Session) GetCallId() string {
+	if x != nil {
+		return x.CallId
+	}
+	return ""
+}
+
+func (x *Session) GetFromTag() string {
+	if x != nil {
+		return x.FromTag
+	}
+	return ""
+}
+
+func (x *Session) GetToTag() string {
+	if x != nil {
+		return x.ToTag
+	}
+	return ""
+}
+
+func (x *Session) GetState() string {
+	if x != nil {
+		return x.State
+	}
+	return ""
+}
+
+func (x *Session) GetCreatedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.CreatedAt
+	}
+	return nil
+}
+
+func (x *Session) GetUpdatedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.UpdatedAt
+	}
+	return nil
+}
+
+func (x *Session) GetDurationSeconds() float64 {
+	if x != nil {
+		return x.DurationSeconds
+	}
+	return 0
+}
+
+func (x *Session) GetCallerLeg() *Leg {
+	if x != nil {
+		return x.CallerLeg
+	}
+	return nil
+}
+
+func (x *Session) GetCalleeLeg() *Leg {
+	if x != nil {
+		return x.CalleeLeg
+	}
+	return nil
+}
+
+func (x *Session) GetFlags() map[string]bool {
+	if x != nil {
+		return x.Flags
+	}
+	return nil
+}
+
+func (x *Session) GetMetadata() map[string]string {
+	if x != nil {
+		return x.Metadata
+	}
+	return nil
+}
+
+type Leg struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Tag           string                 `protobuf:"bytes,1,opt,name=tag,proto3" json:"tag,omitempty"`
+	Ip            string                 `protobuf:"bytes,2,opt,name=ip,proto3" json:"ip,omitempty"`
+	Port          int32                  `protobuf:"varint,3,opt,name=port,proto3" json:"port,omitempty"`
+	LocalIp       string                 `protobuf:"bytes,4,opt,name=local_ip,json=localIp,proto3" json:"local_ip,omitempty"`
+	LocalPort     int32                  `protobuf:"varint,5,opt,name=local_port,json=localPort,proto3" json:"local_port,omitempty"`
+	MediaType     string                 `protobuf:"bytes,6,opt,name=media_type,json=mediaType,proto3" json:"media_type,omitempty"`
+	Ssrc          uint32                 `protobuf:"varint,7,opt,name=ssrc,proto3" json:"ssrc,omitempty"`
+	Codecs        []string               `protobuf:"bytes,8,rep,name=codecs,proto3" json:"codecs,omitempty"`
+	PacketsSent   uint64                 `protobuf:"varint,9,opt,name=packets_sent,json=packetsSent,proto3" json:"packets_sent,omitempty"`
+	PacketsRecv   uint64                 `protobuf:"varint,10,opt,name=packets_recv,json=packetsRecv,proto3" json:"packets_recv,omitempty"`
+	BytesSent     uint64                 `protobuf:"varint,11,opt,name=bytes_sent,json=bytesSent,proto3" json:"bytes_sent,omitempty"`
+	BytesRecv     uint64                 `protobuf:"varint,12,opt,name=bytes_recv,json=bytesRecv,proto3" json:"bytes_recv,omitempty"`
+	PacketsLost   int32                  `protobuf:"varint,13,opt,name=packets_lost,json=packetsLost,proto3" json:"packets_lost,omitempty"`
+	JitterMs      float64                `protobuf:"fixed64,14,opt,name=jitter_ms,json=jitterMs,proto3" json:"jitter_ms,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Leg) Reset() {
+	*x = Leg{}
+	mi := &file_karl_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Leg) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Leg) ProtoMessage() {}
+
+func (x *Leg) ProtoReflect() protoreflect.Message {
+	mi := &file_karl_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Leg.ProtoReflect.Descriptor instead.
+func (*Leg) Descriptor() ([]byte, []int) {
+	return file_karl_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Leg) GetTag() string {
+	if x != nil {
+		return x.Tag
+	}
+	return ""
+}
+
+func (x *Leg) GetIp() string {
+	if x != nil {
+		return x.Ip
+	}
+	return ""
+}
+
+func (x *Leg) GetPort() int32 {
+	if x != nil {
+		return x.Port
+	}
+	return 0
+}
+
+func (x *Leg) GetLocalIp() string {
+	if x != nil {
+		return x.LocalIp
+	}
+	return ""
+}
+
+func (x *Leg) GetLocalPort() int32 {
+	if x != nil {
+		return x.LocalPort
+	}
+	return 0
+}
+
+func (x *Leg) GetMediaType() string {
+	if x != nil {
+		return x.MediaType
+	}
+	return ""
+}
+
+func (x *Leg) GetSsrc() uint32 {
+	if x != nil {
+		return x.Ssrc
+	}
+	return 0
+}
+
+func (x *Leg) GetCodecs() []string {
+	if x != nil {
+		return x.Codecs
+	}
+	return nil
+}
+
+func (x *Leg) GetPacketsSent() uint64 {
+	if x != nil {
+		return x.PacketsSent
+	}
+	return 0
+}
+
+func (x *Leg) GetPacketsRecv() uint64 {
+	if x != nil {
+		return x.PacketsRecv
+	}
+	return 0
+}
+
+func (x *Leg) GetBytesSent() uint64 {
+	if x != nil {
+		return x.BytesSent
+	}
+	return 0
+}
+
+func (x *Leg) GetBytesRecv() uint64 {
+	if x != nil {
+		return x.BytesRecv
+	}
+	return 0
+}
+
+func (x *Leg) GetPacketsLost() int32 {
+	if x != nil {
+		return x.PacketsLost
+	}
+	return 0
+}
+
+func (x *Leg) GetJitterMs() float64 {
+	if x != nil {
+		return x.JitterMs
+	}
+	return 0
+}
+
+type ListSessionsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	State         string                 `protobuf:"bytes,1,opt,name=state,proto3" json:"state,omitempty"`
+	CallId        string                 `protobuf:"bytes,2,opt,name=call_id,json=callId,proto3" json:"call_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListSessionsRequest) Reset() {
+	*x = ListSessionsRequest{}
+	mi := &file_karl_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListSessionsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListSessionsRequest) ProtoMessage() {}
+
+func (x *ListSessionsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_karl_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListSessionsRequest.ProtoReflect.Descriptor instead.
+func (*ListSessionsRequest) Descriptor() ([]byte, []int) {
+	return file_karl_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *ListSessionsRequest) GetState() string {
+	if x != nil {
+		return x.State
+	}
+	return ""
+}
+
+func (x *ListSessionsRequest) GetCallId() string {
+	if x != nil {
+		return x.CallId
+	}
+	return ""
+}
+
+type ListSessionsResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Sessions      []*Session             `protobuf:"bytes,1,rep,name=sessions,proto3" json:"sessions,omitempty"`
+	Total         int32                  `protobuf:"varint,2,opt,name=total,proto3" json:"total,omitempty"`
+	Active        int32                  `protobuf:"varint,3,opt,name=active,proto3" json:"active,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListSessionsResponse) Reset() {
+	*x = ListSessionsResponse{}
+	mi := &file_karl_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListSessionsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListSessionsResponse) ProtoMessage() {}
+
+func (x *ListSessionsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_karl_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListSessionsResponse.ProtoReflect.Descriptor instead.
+func (*ListSessionsResponse) Descriptor() ([]byte, []int) {
+	return file_karl_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *ListSessionsResponse) GetSessions() []*Session {
+	if x != nil {
+		return x.Sessions
+	}
+	return nil
+}
+
+func (x *ListSessionsResponse) GetTotal() int32 {
+	if x != nil {
+		return x.Total
+	}
+	return 0
+}
+
+func (x *ListSessionsResponse) GetActive() int32 {
+	if x != nil {
+		return x.Active
+	}
+	return 0
+}
+
+type GetSessionRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Session ID, or a Call-ID when no session has that ID
+	Id            string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetSessionRequest) Reset() {
+	*x = GetSessionRequest{}
+	mi := &file_karl_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetSessionRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetSessionRequest) ProtoMessage() {}
+
+func (x *GetSessionRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_karl_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetSessionRequest.ProtoReflect.Descriptor instead.
+func (*GetSessionRequest) Descriptor() ([]byte, []int) {
+	return file_karl_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *GetSessionRequest) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+type CreateSessionRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	CallId        string                 `protobuf:"bytes,1,opt,name=call_id,json=callId,proto3" json:"call_id,omitempty"`
+	FromTag       string                 `protobuf:"bytes,2,opt,name=from_tag,json=fromTag,proto3" json:"from_tag,omitempty"`
+	Metadata      map[string]string      `protobuf:"bytes,3,rep,name=metadata,proto3" json:"metadata,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CreateSessionRequest) Reset() {
+	*x = CreateSessionRequest{}
+	mi := &file_karl_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CreateSessionRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CreateSessionRequest) ProtoMessage() {}
+
+func (x *CreateSessionRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_karl_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CreateSessionRequest.ProtoReflect.Descriptor instead.
+func (*CreateSessionRequest) Descriptor() ([]byte, []int) {
+	return file_karl_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *CreateSessionRequest) GetCallId() string {
+	if x != nil {
+		return x.CallId
+	}
+	return ""
+}
+
+func (x *CreateSessionRequest) GetFromTag() string {
+	if x != nil {
+		return x.FromTag
+	}
+	return ""
+}
+
+func (x *CreateSessionRequest) GetMetadata() map[string]string {
+	if x != nil {
+		return x.Metadata
+	}
+	return nil
+}
+
+type DeleteSessionRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeleteSessionRequest) Reset() {
+	*x = DeleteSessionRequest{}
+	mi := &file_karl_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeleteSessionRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeleteSessionRequest) ProtoMessage() {}
+
+func (x *DeleteSessionRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_karl_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeleteSessionRequest.ProtoReflect.Descriptor instead.
+func (*DeleteSessionRequest) Descriptor() ([]byte, []int) {
+	return file_karl_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *DeleteSessionRequest) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+type DeleteSessionResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeleteSessionResponse) Reset() {
+	*x = DeleteSessionResponse{}
+	mi := &file_karl_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeleteSessionResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeleteSessionResponse) ProtoMessage() {}
+
+func (x *DeleteSessionResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_karl_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeleteSessionResponse.ProtoReflect.Descriptor instead.
+func (*DeleteSessionResponse) Descriptor() ([]byte, []int) {
+	return file_karl_proto_rawDescGZIP(), []int{7}
+}
+
+type GetStatsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetStatsRequest) Reset() {
+	*x = GetStatsRequest{}
+	mi := &file_karl_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetStatsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetStatsRequest) ProtoMessage() {}
+
+func (x *GetStatsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_karl_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetStatsRequest.ProtoReflect.Descriptor instead.
+func (*GetStatsRequest) Descriptor() ([]byte, []int) {
+	return file_karl_proto_rawDescGZIP(), []int{8}
+}
+
+type StreamStatsRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Milliseconds between updates, 1000 when zero
+	IntervalMs int32 `protobuf:"varint,1,opt,name=interval_ms,json=intervalMs,proto3" json:"interval_ms,omitempty"`
+	// Include per-session statistics
+	IncludeSessions bool `protobuf:"varint,2,opt,name=include_sessions,json=includeSessions,proto3" json:"include_sessions,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *StreamStatsRequest) Reset() {
+	*x = StreamStatsRequest{}
+	mi := &file_karl_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StreamStatsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StreamStatsRequest) ProtoMessage() {}
+
+func (x *StreamStatsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_karl_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StreamStatsRequest.ProtoReflect.Descriptor instead.
+func (*StreamStatsRequest) Descriptor() ([]byte, []int) {
+	return file_karl_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *StreamStatsRequest) GetIntervalMs() int32 {
+	if x != nil {
+		return x.IntervalMs
+	}
+	return 0
+}
+
+func (x *StreamStatsRequest) GetIncludeSessions() bool {
+	if x != nil {
+		return x.IncludeSessions
+	}
+	return false
+}
+
+type Stats struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Timestamp     *timestamppb.Timestamp `protobuf:"bytes,1,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	CurrentCalls  int32                  `protobuf:"varint,2,opt,name=current_calls,json=currentCalls,proto3" json:"current_calls,omitempty"`
+	TotalCalls    int32                  `protobuf:"varint,3,opt,name=total_calls,json=totalCalls,proto3" json:"total_calls,omitempty"`
+	PacketsSent   uint64                 `protobuf:"varint,4,opt,name=packets_sent,json=packetsSent,proto3" json:"packets_sent,omitempty"`
+	PacketsRecv   uint64                 `protobuf:"varint,5,opt,name=packets_recv,json=packetsRecv,proto3" json:"packets_recv,omitempty"`
+	BytesSent     uint64                 `protobuf:"varint,6,opt,name=bytes_sent,json=bytesSent,proto3" json:"bytes_sent,omitempty"`
+	BytesRecv     uint64                 `protobuf:"varint,7,opt,name=bytes_recv,json=bytesRecv,proto3" json:"bytes_recv,omitempty"`
+	PacketsLost   uint64                 `protobuf:"varint,8,opt,name=packets_lost,json=packetsLost,proto3" json:"packets_lost,omitempty"`
+	AvgJitterMs   float64                `protobuf:"fixed64,9,opt,name=avg_jitter_ms,json=avgJitterMs,proto3" json:"avg_jitter_ms,omitempty"`
+	AvgMos        float64                `protobuf:"fixed64,10,opt,name=avg_mos,json=avgMos,proto3" json:"avg_mos,omitempty"`
+	UptimeSeconds float64                `protobuf:"fixed64,11,opt,name=uptime_seconds,json=uptimeSeconds,proto3" json:"uptime_seconds,omitempty"`
+	Sessions      []*SessionStats        `protobuf:"bytes,12,rep,name=sessions,proto3" json:"sessions,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Stats) Reset() {
+	*x = Stats{}
+	mi := &file_karl_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Stats) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Stats) ProtoMessage() {}
+
+func (x *Stats) ProtoReflect() protoreflect.Message {
+	mi := &file_karl_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Stats.ProtoReflect.Descriptor instead.
+func (*Stats) Descriptor() ([]byte, []int) {
+	return file_karl_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *Stats) GetTimestamp() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Timestamp
+	}
+	return nil
+}
+
+func (x *Stats) GetCurrentCalls() int32 {
+	if x != nil {
+		return x.CurrentCalls
+	}
+	return 0
+}
+
+func (x *Stats) GetTotalCalls() int32 {
+	if x != nil {
+		return x.TotalCalls
+	}
+	return 0
+}
+
+func (x *Stats) GetPacketsSent() uint64 {
+	if x != nil {
+		return x.PacketsSent
+	}
+	return 0
+}
+
+func (x *Stats) GetPacketsRecv() uint64 {
+	if x != nil {
+		return x.PacketsRecv
+	}
+	return 0
+}
+
+func (x *Stats) GetBytesSent() uint64 {
+	if x != nil {
+		return x.BytesSent
+	}
+	return 0
+}
+
+func (x *Stats) GetBytesRecv() uint64 {
+	if x != nil {
+		return x.BytesRecv
+	}
+	return 0
+}
+
+func (x *Stats) GetPacketsLost() uint64 {
+	if x != nil {
+		return x.PacketsLost
+	}
+	return 0
+}
+
+func (x *Stats) GetAvgJitterMs() float64 {
+	if x != nil {
+		return x.AvgJitterMs
+	}
+	return 0
+}
+
+func (x *Stats) GetAvgMos() float64 {
+	if x != nil {
+		return x.AvgMos
+	}
+	return 0
+}
+
+func (x *Stats) GetUptimeSeconds() float64 {
+	if x != nil {
+		return x.UptimeSeconds
+	}
+	return 0
+}
+
+func (x *Stats) GetSessions() []*SessionStats {
+	if x != nil {
+		return x.Sessions
+	}
+	return nil
+}
+
+type SessionStats struct {
+	state           protoimpl.MessageState `protogen:"open.v1"`
+	SessionId       string                 `protobuf:"bytes,1,opt,name=session_id,json=sessionId,proto3" json:"session_id,omitempty"`
+	CallId          string                 `protobuf:"bytes,2,opt,name=call_id,json=callId,proto3" json:"call_id,omitempty"`
+	State           string                 `protobuf:"bytes,3,opt,name=state,proto3" json:"state,omitempty"`
+	DurationSeconds float64                `protobuf:"fixed64,4,opt,name=duration_seconds,json=durationSeconds,proto3" json:"duration_seconds,omitempty"`
+	PacketLossRate  float64                `protobuf:"fixed64,5,opt,name=packet_loss_rate,json=packetLossRate,proto3" json:"packet_loss_rate,omitempty"`
+	AvgJitterMs     float64                `protobuf:"fixed64,6,opt,name=avg_jitter_ms,json=avgJitterMs,proto3" json:"avg_jitter_ms,omitempty"`
+	RttMs           float64                `protobuf:"fixed64,7,opt,name=rtt_ms,json=rttMs,proto3" json:"rtt_ms,omitempty"`
+	Mos             float64                `protobuf:"fixed64,8,opt,name=mos,proto3" json:"mos,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *SessionStats) Reset() {
+	*x = SessionStats{}
+	mi := &file_karl_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SessionStats) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SessionStats) ProtoMessage() {}
+
+func (x *SessionStats) ProtoReflect() protoreflect.Message {
+	mi := &file_karl_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SessionStats.ProtoReflect.Descriptor instead.
+func (*SessionStats) Descriptor() ([]byte, []int) {
+	return file_karl_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *SessionStats) GetSessionId() string {
+	if x != nil {
+		return x.SessionId
+	}
+	return ""
+}
+
+func (x *SessionStats) GetCallId() string {
+	if x != nil {
+		return x.CallId
+	}
+	return ""
+}
+
+func (x *SessionStats) GetState() string {
+	if x != nil {
+		return x.State
+	}
+	return ""
+}
+
+func (x *SessionStats) GetDurationSeconds() float64 {
+	if x != nil {
+		return x.DurationSeconds
+	}
+	return 0
+}
+
+func (x *SessionStats) GetPacketLossRate() float64 {
+	if x != nil {
+		return x.PacketLossRate
+	}
+	return 0
+}
+
+func (x *SessionStats) GetAvgJitterMs() float64 {
+	if x != nil {
+		return x.AvgJitterMs
+	}
+	return 0
+}
+
+func (x *SessionStats) GetRttMs() float64 {
+	if x != nil {
+		return x.RttMs
+	}
+	return 0
+}
+
+func (x *SessionStats) GetMos() float64 {
+	if x != nil {
+		return x.Mos
+	}
+	return 0
+}
+
+type GetConfigRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetConfigRequest) Reset() {
+	*x = GetConfigRequest{}
+	mi := &file_karl_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetConfigRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetConfigRequest) ProtoMessage() {}
+
+func (x *GetConfigRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_karl_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetConfigRequest.ProtoReflect.Descriptor instead.
+func (*GetConfigRequest) Descriptor() ([]byte, []int) {
+	return file_karl_proto_rawDescGZIP(), []int{12}
+}
+
+type ConfigResponse struct {
+	state       protoimpl.MessageState `protogen:"open.v1"`
+	Version     string                 `protobuf:"bytes,1,opt,name=version,proto3" json:"version,omitempty"`
+	Environment string                 `protobuf:"bytes,2,opt,name=environment,proto3" json:"environment,omitempty"`
+	MediaIp     string                 `protobuf:"bytes,3,opt,name=media_ip,json=mediaIp,proto3" json:"media_ip,omitempty"`
+	PublicIp    string                 `protobuf:"bytes,4,opt,name=public_ip,json=publicIp,proto3" json:"public_ip,omitempty"`
+	MinPort     int32                  `protobuf:"varint,5,opt,name=min_port,json=minPort,proto3" json:"min_port,omitempty"`
+	MaxPort     int32                  `protobuf:"varint,6,opt,name=max_port,json=maxPort,proto3" json:"max_port,omitempty"`
+	NgUdpPort   int32                  `protobuf:"varint,7,opt,name=ng_udp_port,json=ngUdpPort,proto3" json:"ng_udp_port,omitempty"`
+	// The full configuration as JSON, with passwords, keys and DSNs removed
+	Json          string `protobuf:"bytes,8,opt,name=json,proto3" json:"json,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ConfigResponse) Reset() {
+	*x = ConfigResponse{}
+	mi := &file_karl_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ConfigResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ConfigResponse) ProtoMessage() {}
+
+func (x *ConfigResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_karl_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ConfigResponse.ProtoReflect.Descriptor instead.
+func (*ConfigResponse) Descriptor() ([]byte, []int) {
+	return file_karl_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *ConfigResponse) GetVersion() string {
+	if x != nil {
+		return x.Version
+	}
+	return ""
+}
+
+func (x *ConfigResponse) GetEnvironment() string {
+	if x != nil {
+		return x.Environment
+	}
+	return ""
+}
+
+func (x *ConfigResponse) GetMediaIp() string {
+	if x != nil {
+		return x.MediaIp
+	}
+	return ""
+}
+
+func (x *ConfigResponse) GetPublicIp() string {
+	if x != nil {
+		return x.PublicIp
+	}
+	return ""
+}
+
+func (x *ConfigResponse) GetMinPort() int32 {
+	if x != nil {
+		return x.MinPort
+	}
+	return 0
+}
+
+func (x *ConfigResponse) GetMaxPort() int32 {
+	if x != nil {
+		return x.MaxPort
+	}
+	return 0
+}
+
+func (x *ConfigResponse) GetNgUdpPort() int32 {
+	if x != nil {
+		return x.NgUdpPort
+	}
+	return 0
+}
+
+func (x *ConfigResponse) GetJson() string {
+	if x != nil {
+		return x.Json
+	}
+	return ""
+}
+
+type SetDrainRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Draining      bool                   `protobuf:"varint,1,opt,name=draining,proto3" json:"draining,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SetDrainRequest) Reset() {
+	*x = SetDrainRequest{}
+	mi := &file_karl_proto_msgTypes[14]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SetDrainRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SetDrainRequest) ProtoMessage() {}
+
+func (x *SetDrainRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_karl_proto_msgTypes[14]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SetDrainRequest.ProtoReflect.Descriptor instead.
+func (*SetDrainRequest) Descriptor() ([]byte, []int) {
+	return file_karl_proto_rawDescGZIP(), []int{14}
+}
+
+func (x *SetDrainRequest) GetDraining() bool {
+	if x != nil {
+		return x.Draining
+	}
+	return false
+}
+
+type GetDrainRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetDrainRequest) Reset() {
+	*x = GetDrainRequest{}
+	mi := &file_karl_proto_msgTypes[15]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetDrainRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetDrainRequest) ProtoMessage() {}
+
+func (x *GetDrainRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_karl_proto_msgTypes[15]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetDrainRequest.ProtoReflect.Descriptor instead.
+func (*GetDrainRequest) Descriptor() ([]byte, []int) {
+	return file_karl_proto_rawDescGZIP(), []int{15}
+}
+
+type DrainStatus struct {
+	state          protoimpl.MessageState `protogen:"open.v1"`
+	Draining       bool                   `protobuf:"varint,1,opt,name=draining,proto3" json:"draining,omitempty"`
+	ActiveSessions int32                  `protobuf:"varint,2,opt,name=active_sessions,json=activeSessions,proto3" json:"active_sessions,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *DrainStatus) Reset() {
+	*x = DrainStatus{}
+	mi := &file_karl_proto_msgTypes[16]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DrainStatus) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DrainStatus) ProtoMessage() {}
+
+func (x *DrainStatus) ProtoReflect() protoreflect.Message {
+	mi := &file_karl_proto_msgTypes[16]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DrainStatus.ProtoReflect.Descriptor instead.
+func (*DrainStatus) Descriptor() ([]byte, []int) {
+	return file_karl_proto_rawDescGZIP(), []int{16}
+}
+
+func (x *DrainStatus) GetDraining() bool {
+	if x != nil {
+		return x.Draining
+	}
+	return false
+}
+
+func (x *DrainStatus) GetActiveSessions() int32 {
+	if x != nil {
+		return x.ActiveSessions
+	}
+	return 0
+}
+
+var File_karl_proto protoreflect.FileDescriptor
+
+const file_karl_proto_rawDesc = "" +
+	"\n" +
+	"\n" +
+	"karl.proto\x12\akarl.v1\x1a\x1fgoogle/protobuf/timestamp.proto\"\xdb\x04\n" +
+	"\aSession\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x17\n" +
+	"\acall_id\x18\x02 \x01(\tR\x06callId\x12\x19\n" +
+	"\bfrom_tag\x18\x03 \x01(\tR\afromTag\x12\x15\n" +
+	"\x06to_tag\x18\x04 \x01(\tR\x05toTag\x12\x14\n" +
+	"\x05state\x18\x05 \x01(\tR\x05state\x129\n" +
+	"\n" +
+	"created_at\x18\x06 \x01(\v2\x1a.google.protobuf.TimestampR\tcreatedAt\x129\n" +
+	"\n" +
+	"updated_at\x18\a \x01(\v2\x1a.google.protobuf.TimestampR\tupdatedAt\x12)\n" +
+	"\x10duration_seconds\x18\b \x01(\x01R\x0fdurationSeconds\x12+\n" +
+	"\n" +
+	"caller_leg\x18\t \x01(\v2\f.karl.v1.LegR\tcallerLeg\x12+\n" +
+	"\n" +
+	"callee_leg\x18\n" +
+	" \x01(\v2\f.karl.v1.LegR\tcalleeLeg\x121\n" +
+	"\x05flags\x18\v \x03(\v2\x1b.karl.v1.Session.FlagsEntryR\x05flags\x12:\n" +
+	"\bmetadata\x18\f \x03(\v2\x1e.karl.v1.Session.MetadataEntryR\bmetadata\x1a8\n" +
+	"\n" +
+	"FlagsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\bR\x05value:\x028\x01\x1a;\n" +
+	"\rMetadataEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"\x84\x03\n" +
+	"\x03Leg\x12\x10\n" +
+	"\x03tag\x18\x01 \x01(\tR\x03tag\x12\x0e\n" +
+	"\x02ip\x18\x02 \x01(\tR\x02ip\x12\x12\n" +
+	"\x04port\x18\x03 \x01(\x05R\x04port\x12\x19\n" +
+	"\blocal_ip\x18\x04 \x01(\tR\alocalIp\x12\x1d\n" +
+	"\n" +
+	"local_port\x18\x05 \x01(\x05R\tlocalPort\x12\x1d\n" +
+	"\n" +
+	"media_type\x18\x06 \x01(\tR\tmediaType\x12\x12\n" +
+	"\x04ssrc\x18\a \x01(\rR\x04ssrc\x12\x16\n" +
+	"\x06codecs\x18\b \x03(\tR\x06codecs\x12!\n" +
+	"\fpackets_sent\x18\t \x01(\x04R\vpacketsSent\x12!\n" +
+	"\fpackets_recv\x18\n" +
+	" \x01(\x04R\vpacketsRecv\x12\x1d\n" +
+	"\n" +
+	"bytes_sent\x18\v \x01(\x04R\tbytesSent\x12\x1d\n" +
+	"\n" +
+	"bytes_recv\x18\f \x01(\x04R\tbytesRecv\x12!\n" +
+	"\fpackets_lost\x18\r \x01(\x05R\vpacketsLost\x12\x1b\n" +
+	"\tjitter_ms\x18\x0e \x01(\x01R\bjitterMs\"D\n" +
+	"\x13ListSessionsRequest\x12\x14\n" +
+	"\x05state\x18\x01 \x01(\tR\x05state\x12\x17\n" +
+	"\acall_id\x18\x02 \x01(\tR\x06callId\"r\n" +
+	"\x14ListSessionsResponse\x12,\n" +
+	"\bsessions\x18\x01 \x03(\v2\x10.karl.v1.SessionR\bsessions\x12\x14\n" +
+	"\x05total\x18\x02 \x01(\x05R\x05total\x12\x16\n" +
+	"\x06active\x18\x03 \x01(\x05R\x06active\"#\n" +
+	"\x11GetSessionRequest\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\"\xd0\x01\n" +
+	"\x14CreateSessionRequest\x12\x17\n" +
+	"\acall_id\x18\x01 \x01(\tR\x06callId\x12\x19\n" +
+	"\bfrom_tag\x18\x02 \x01(\tR\afromTag\x12G\n" +
+	"\bmetadata\x18\x03 \x03(\v2+.karl.v1.CreateSessionRequest.MetadataEntryR\bmetadata\x1a;\n" +
+	"\rMetadataEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"&\n" +
+	"\x14DeleteSessionRequest\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\"\x17\n" +
+	"\x15DeleteSessionResponse\"\x11\n" +
+	"\x0fGetStatsRequest\"`\n" +
+	"\x12StreamStatsRequest\x12\x1f\n" +
+	"\vinterval_ms\x18\x01 \x01(\x05R\n" +
+	"intervalMs\x12)\n" +
+	"\x10include_sessions\x18\x02 \x01(\bR\x0fincludeSessions\"\xc5\x03\n" +
+	"\x05Stats\x128\n" +
+	"\ttimestamp\x18\x01 \x01(\v2\x1a.google.protobuf.TimestampR\ttimestamp\x12#\n" +
+	"\rcurrent_calls\x18\x02 \x01(\x05R\fcurrentCalls\x12\x1f\n" +
+	"\vtotal_calls\x18\x03 \x01(\x05R\n" +
+	"totalCalls\x12!\n" +
+	"\fpackets_sent\x18\x04 \x01(\x04R\vpacketsSent\x12!\n" +
+	"\fpackets_recv\x18\x05 \x01(\x04R\vpacketsRecv\x12\x1d\n" +
+	"\n" +
+	"bytes_sent\x18\x06 \x01(\x04R\tbytesSent\x12\x1d\n" +
+	"\n" +
+	"bytes_recv\x18\a \x01(\x04R\tbytesRecv\x12!\n" +
+	"\fpackets_lost\x18\b \x01(\x04R\vpacketsLost\x12\"\n" +
+	"\ravg_jitter_ms\x18\t \x01(\x01R\vavgJitterMs\x12\x17\n" +
+	"\aavg_mos\x18\n" +
+	" \x01(\x01R\x06avgMos\x12%\n" +
+	"\x0euptime_seconds\x18\v \x01(\x01R\ruptimeSeconds\x121\n" +
+	"\bsessions\x18\f \x03(\v2\x15.karl.v1.SessionStatsR\bsessions\"\xfe\x01\n" +
+	"\fSessionStats\x12\x1d\n" +
+	"\n" +
+	"session_id\x18\x01 \x01(\tR\tsessionId\x12\x17\n" +
+	"\acall_id\x18\x02 \x01(\tR\x06callId\x12\x14\n" +
+	"\x05state\x18\x03 \x01(\tR\x05state\x12)\n" +
+	"\x10duration_seconds\x18\x04 \x01(\x01R\x0fdurationSeconds\x12(\n" +
+	"\x10packet_loss_rate\x18\x05 \x01(\x01R\x0epacketLossRate\x12\"\n" +
+	"\ravg_jitter_ms\x18\x06 \x01(\x01R\vavgJitterMs\x12\x15\n" +
+	"\x06rtt_ms\x18\a \x01(\x01R\x05rttMs\x12\x10\n" +
+	"\x03mos\x18\b \x01(\x01R\x03mos\"\x12\n" +
+	"\x10GetConfigRequest\"\xee\x01\n" +
+	"\x0eConfigResponse\x12\x18\n" +
+	"\aversion\x18\x01 \x01(\tR\aversion\x12 \n" +
+	"\venvironment\x18\x02 \x01(\tR\venvironment\x12\x19\n" +
+	"\bmedia_ip\x18\x03 \x01(\tR\amediaIp\x12\x1b\n" +
+	"\tpublic_ip\x18\x04 \x01(\tR\bpublicIp\x12\x19\n" +
+	"\bmin_port\x18\x05 \x01(\x05R\aminPort\x12\x19\n" +
+	"\bmax_port\x18\x06 \x01(\x05R\amaxPort\x12\x1e\n" +
+	"\vng_udp_port\x18\a \x01(\x05R\tngUdpPort\x12\x12\n" +
+	"\x04json\x18\b \x01(\tR\x04json\"-\n" +
+	"\x0fSetDrainRequest\x12\x1a\n" +
+	"\bdraining\x18\x01 \x01(\bR\bdraining\"\x11\n" +
+	"\x0fGetDrainRequest\"R\n" +
+	"\vDrainStatus\x12\x1a\n" +
+	"\bdraining\x18\x01 \x01(\bR\bdraining\x12'\n" +
+	"\x0factive_sessions\x18\x02 \x01(\x05R\x0eactiveSessions2\xd5\x04\n" +
+	"\vKarlControl\x12K\n" +
+	"\fListSessions\x12\x1c.karl.v1.ListSessionsRequest\x1a\x1d.karl.v1.ListSessionsResponse\x12:\n" +
+	"\n" +
+	"GetSession\x12\x1a.karl.v1.GetSessionRequest\x1a\x10.karl.v1.Session\x12@\n" +
+	"\rCreateSession\x12\x1d.karl.v1.CreateSessionRequest\x1a\x10.karl.v1.Session\x12N\n" +
+	"\rDeleteSession\x12\x1d.karl.v1.DeleteSessionRequest\x1a\x1e.karl.v1.DeleteSessionResponse\x124\n" +
+	"\bGetStats\x12\x18.karl.v1.GetStatsRequest\x1a\x0e.karl.v1.Stats\x12<\n" +
+	"\vStreamStats\x12\x1b.karl.v1.StreamStatsRequest\x1a\x0e.karl.v1.Stats0\x01\x12?\n" +
+	"\tGetConfig\x12\x19.karl.v1.GetConfigRequest\x1a\x17.karl.v1.ConfigResponse\x12:\n" +
+	"\bSetDrain\x12\x18.karl.v1.SetDrainRequest\x1a\x14.karl.v1.DrainStatus\x12:\n" +
+	"\bGetDrain\x12\x18.karl.v1.GetDrainRequest\x1a\x14.karl.v1.DrainStatusB\x1eZ\x1ckarl/internal/grpcapi/karlpbb\x06proto3"
+
+var (
+	file_karl_proto_rawDescOnce sync.Once
+	file_karl_proto_rawDescData []byte
+)
+
+func file_karl_proto_rawDescGZIP() []byte {
+	file_karl_proto_rawDescOnce.Do(func() {
+		file_karl_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_karl_proto_rawDesc), len(file_karl_proto_rawDesc)))
+	})
+	return file_karl_proto_rawDescData
+}
+
+var file_karl_proto_msgTypes = make([]protoimpl.MessageInfo, 20)
+var file_karl_proto_goTypes = []any{
+	(*Session)(nil),               // 0: karl.v1.Session
+	(*Leg)(nil),                   // 1: karl.v1.Leg
+	(*ListSessionsRequest)(nil),   // 2: karl.v1.ListSessionsRequest
+	(*ListSessionsResponse)(nil),  // 3: karl.v1.ListSessionsResponse
+	(*GetSessionRequest)(nil),     // 4: karl.v1.GetSessionRequest
+	(*CreateSessionRequest)(nil),  // 5: karl.v1.CreateSessionRequest
+	(*DeleteSessionRequest)(nil),  // 6: karl.v1.DeleteSessionRequest
+	(*DeleteSessionResponse)(nil), // 7: karl.v1.DeleteSessionResponse
+	(*GetStatsRequest)(nil),       // 8: karl.v1.GetStatsRequest
+	(*StreamStatsRequest)(nil),    // 9: karl.v1.StreamStatsRequest
+	(*Stats)(nil),                 // 10: karl.v1.Stats
+	(*SessionStats)(nil),          // 11: karl.v1.SessionStats
+	(*GetConfigRequest)(nil),      // 12: karl.v1.GetConfigRequest
+	(*ConfigResponse)(nil),        // 13: karl.v1.ConfigResponse
+	(*SetDrainRequest)(nil),       // 14: karl.v1.SetDrainRequest
+	(*GetDrainRequest)(nil),       // 15: karl.v1.GetDrainRequest
+	(*DrainStatus)(nil),           // 16: karl.v1.DrainStatus
+	nil,                           // 17: karl.v1.Session.FlagsEntry
+	nil,                           // 18: karl.v1.Session.MetadataEntry
+	nil,                           // 19: karl.v1.CreateSessionRequest.MetadataEntry
+	(*timestamppb.Timestamp)(nil), // 20: google.protobuf.Timestamp
+}
+var file_karl_proto_depIdxs = []int32{
+	20, // 0: karl.v1.Session.created_at:type_name -> google.protobuf.Timestamp
+	20, // 1: karl.v1.Session.updated_at:type_name -> google.protobuf.Timestamp
+	1,  // 2: karl.v1.Session.caller_leg:type_name -> karl.v1.Leg
+	1,  // 3: karl.v1.Session.callee_leg:type_name -> karl.v1.Leg
+	17, // 4: karl.v1.Session.flags:type_name -> karl.v1.Session.FlagsEntry
+	18, // 5: karl.v1.Session.metadata:type_name -> karl.v1.Session.MetadataEntry
+	0,  // 6: karl.v1.ListSessionsResponse.sessions:type_name -> karl.v1.Session
+	19, // 7: karl.v1.CreateSessionRequest.metadata:type_name -> karl.v1.CreateSessionRequest.MetadataEntry
+	20, // 8: karl.v1.Stats.timestamp:type_name -> google.protobuf.Timestamp
+	11, // 9: karl.v1.Stats.sessions:type_name -> karl.v1.SessionStats
+	2,  // 10: karl.v1.KarlControl.ListSessions:input_type -> karl.v1.ListSessionsRequest
+	4,  // 11: karl.v1.KarlControl.GetSession:input_type -> karl.v1.GetSessionRequest
+	5,  // 12: karl.v1.KarlControl.CreateSession:input_type -> karl.v1.CreateSessionRequest
+	6,  // 13: karl.v1.KarlControl.DeleteSession:input_type -> karl.v1.DeleteSessionRequest
+	8,  // 14: karl.v1.KarlControl.GetStats:input_type -> karl.v1.GetStatsRequest
+	9,  // 15: karl.v1.KarlControl.StreamStats:input_type -> karl.v1.StreamStatsRequest
+	12, // 16: karl.v1.KarlControl.GetConfig:input_type -> karl.v1.GetConfigRequest
+	14, // 17: karl.v1.KarlControl.SetDrain:input_type -> karl.v1.SetDrainRequest
+	15, // 18: karl.v1.KarlControl.GetDrain:input_type -> karl.v1.GetDrainRequest
+	3,  // 19: karl.v1.KarlControl.ListSessions:output_type -> karl.v1.ListSessionsResponse
+	0,  // 20: karl.v1.KarlControl.GetSession:output_type -> karl.v1.Session
+	0,  // 21: karl.v1.KarlControl.CreateSession:output_type -> karl.v1.Session
+	7,  // 22: karl.v1.KarlControl.DeleteSession:output_type -> karl.v1.DeleteSessionResponse
+	10, // 23: karl.v1.KarlControl.GetStats:output_type -> karl.v1.Stats
+	10, // 24: karl.v1.KarlControl.StreamStats:output_type -> karl.v1.Stats
+	13, // 25: karl.v1.KarlControl.GetConfig:output_type -> karl.v1.ConfigResponse
+	16, // 26: karl.v1.KarlControl.SetDrain:output_type -> karl.v1.DrainStatus
+	16, // 27: karl.v1.KarlControl.GetDrain:output_type -> karl.v1.DrainStatus
+	19, // [19:28] is the sub-list for method output_type
+	10, // [10:19] is the sub-list for method input_type
+	10, // [10:10] is the sub-list for extension type_name
+	10, // [10:10] is the sub-list for extension extendee
+	0,  // [0:10] is the sub-list for field type_name
+}
+
+func init() { file_karl_proto_init() }
+func file_karl_proto_init() {
+	if File_karl_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_karl_proto_rawDesc), len(file_karl_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   20,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_karl_proto_goTypes,
+		DependencyIndexes: file_karl_proto_depIdxs,
+		MessageInfos:      file_karl_proto_msgTypes,
+	}.Build()
+	File_karl_proto = out.File
+	file_karl_proto_goTypes = nil
+	file_karl_proto_depIdxs = nil
+}
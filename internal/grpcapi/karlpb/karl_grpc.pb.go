@@ -0,0 +1,457 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: karl.proto
+
+package karlpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	KarlControl_ListSessions_FullMethodName  = "/karl.v1.KarlControl/ListSessions"
+	KarlControl_GetSession_FullMethodName    = "/karl.v1.KarlControl/GetSession"
+	KarlControl_CreateSession_FullMethodName = "/karl.v1.KarlControl/CreateSession"
+	KarlControl_DeleteSession_FullMethodName = "/karl.v1.KarlControl/DeleteSession"
+	KarlControl_GetStats_FullMethodName      = "/karl.v1.KarlControl/GetStats"
+	KarlControl_StreamStats_FullMethodName   = "/karl.v1.KarlControl/StreamStats"
+	KarlControl_GetConfig_FullMethodName     = "/karl.v1.KarlControl/GetConfig"
+	KarlControl_SetDrain_FullMethodName      = "/karl.v1.KarlControl/SetDrain"
+	KarlControl_GetDrain_FullMethodName      = "/karl.v1.KarlControl/GetDrain"
+)
+
+// KarlControlClient is the client API for KarlControl service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// KarlControl manages a Karl node: its call sessions, statistics,
+// configuration and drain state
+type KarlControlClient interface {
+	// ListSessions returns the sessions, optionally filtered by state or Call-ID
+	ListSessions(ctx context.Context, in *ListSessionsRequest, opts ...grpc.CallOption) (*ListSessionsResponse, error)
+	// GetSession returns a session by session ID or Call-ID
+	GetSession(ctx context.Context, in *GetSessionRequest, opts ...grpc.CallOption) (*Session, error)
+	// CreateSession registers a session ahead of the NG offer
+	CreateSession(ctx context.Context, in *CreateSessionRequest, opts ...grpc.CallOption) (*Session, error)
+	// DeleteSession terminates and removes a session
+	DeleteSession(ctx context.Context, in *DeleteSessionRequest, opts ...grpc.CallOption) (*DeleteSessionResponse, error)
+	// GetStats returns the node's aggregate statistics
+	GetStats(ctx context.Context, in *GetStatsRequest, opts ...grpc.CallOption) (*Stats, error)
+	// StreamStats sends the aggregate statistics, and the sessions' statistics
+	// when asked, at a fixed interval until the client cancels
+	StreamStats(ctx context.Context, in *StreamStatsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Stats], error)
+	// GetConfig returns the running configuration
+	GetConfig(ctx context.Context, in *GetConfigRequest, opts ...grpc.CallOption) (*ConfigResponse, error)
+	// SetDrain starts or stops draining. A draining node fails /readyz so no
+	// new calls reach it, while calls in progress continue
+	SetDrain(ctx context.Context, in *SetDrainRequest, opts ...grpc.CallOption) (*DrainStatus, error)
+	// GetDrain reports the drain state and the calls still in progress
+	GetDrain(ctx context.Context, in *GetDrainRequest, opts ...grpc.CallOption) (*DrainStatus, error)
+}
+
+type karlControlClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewKarlControlClient(cc grpc.ClientConnInterface) KarlControlClient {
+	return &karlControlClient{cc}
+}
+
+func (c *karlControlClient) ListSessions(ctx context.Context, in *ListSessionsRequest, opts ...grpc.CallOption) (*ListSessionsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListSessionsResponse)
+	err := c.cc.Invoke(ctx, KarlControl_ListSessions_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *karlControlClient) GetSession(ctx context.Context, in *GetSessionRequest, opts ...grpc.CallOption) (*Session, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Session)
+	err := c.cc.Invoke(ctx, KarlControl_GetSession_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *karlControlClient) CreateSession(ctx context.Context, in *CreateSessionRequest, opts ...grpc.CallOption) (*Session, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Session)
+	err := c.cc.Invoke(ctx, KarlControl_CreateSession_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *karlControlClient) DeleteSession(ctx context.Context, in *DeleteSessionRequest, opts ...grpc.CallOption) (*DeleteSessionResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DeleteSessionResponse)
+	err := c.cc.Invoke(ctx, KarlControl_DeleteSession_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *karlControlClient) GetStats(ctx context.Context, in *GetStatsRequest, opts ...grpc.CallOption) (*Stats, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Stats)
+	err := c.cc.Invoke(ctx, KarlControl_GetStats_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *karlControlClient) StreamStats(ctx context.Context, in *StreamStatsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Stats], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &KarlControl_ServiceDesc.Streams[0], KarlControl_StreamStats_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[StreamStatsRequest, Stats]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type KarlControl_StreamStatsClient = grpc.ServerStreamingClient[Stats]
+
+func (c *karlControlClient) GetConfig(ctx context.Context, in *GetConfigRequest, opts ...grpc.CallOption) (*ConfigResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ConfigResponse)
+	err := c.cc.Invoke(ctx, KarlControl_GetConfig_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *karlControlClient) SetDrain(ctx context.Context, in *SetDrainRequest, opts ...grpc.CallOption) (*DrainStatus, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DrainStatus)
+	err := c.cc.Invoke(ctx, KarlControl_SetDrain_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *karlControlClient) GetDrain(ctx context.Context, in *GetDrainRequest, opts ...grpc.CallOption) (*DrainStatus, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DrainStatus)
+	err := c.cc.Invoke(ctx, KarlControl_GetDrain_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// KarlControlServer is the server API for KarlControl service.
+// All implementations must embed UnimplementedKarlControlServer
+// for forward compatibility.
+//
+// KarlControl manages a Karl node: its call sessions, statistics,
+// configuration and drain state
+type KarlControlServer interface {
+	// ListSessions returns the sessions, optionally filtered by state or Call-ID
+	ListSessions(context.Context, *ListSessionsRequest) (*ListSessionsResponse, error)
+	// GetSession returns a session by session ID or Call-ID
+	GetSession(context.Context, *GetSessionRequest) (*Session, error)
+	// CreateSession registers a session ahead of the NG offer
+	CreateSession(context.Context, *CreateSessionRequest) (*Session, error)
+	// DeleteSession terminates and removes a session
+	DeleteSession(context.Context, *DeleteSessionRequest) (*DeleteSessionResponse, error)
+	// GetStats returns the node's aggregate statistics
+	GetStats(context.Context, *GetStatsRequest) (*Stats, error)
+	// StreamStats sends the aggregate statistics, and the sessions' statistics
+	// when asked, at a fixed interval until the client cancels
+	StreamStats(*StreamStatsRequest, grpc.ServerStreamingServer[Stats]) error
+	// GetConfig returns the running configuration
+	GetConfig(context.Context, *GetConfigRequest) (*ConfigResponse, error)
+	// SetDrain starts or stops draining. A draining node fails /readyz so no
+	// new calls reach it, while calls in progress continue
+	SetDrain(context.Context, *SetDrainRequest) (*DrainStatus, error)
+	// GetDrain reports the drain state and the calls still in progress
+	GetDrain(context.Context, *GetDrainRequest) (*DrainStatus, error)
+	mustEmbedUnimplementedKarlControlServer()
+}
+
+// UnimplementedKarlControlServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedKarlControlServer struct{}
+
+func (UnimplementedKarlControlServer) ListSessions(context.Context, *ListSessionsRequest) (*ListSessionsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListSessions not implemented")
+}
+func (UnimplementedKarlControlServer) GetSession(context.Context, *GetSessionRequest) (*Session, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetSession not implemented")
+}
+func (UnimplementedKarlControlServer) CreateSession(context.Context, *CreateSessionRequest) (*Session, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateSession not implemented")
+}
+func (UnimplementedKarlControlServer) DeleteSession(context.Context, *DeleteSessionRequest) (*DeleteSessionResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteSession not implemented")
+}
+func (UnimplementedKarlControlServer) GetStats(context.Context, *GetStatsRequest) (*Stats, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetStats not implemented")
+}
+func (UnimplementedKarlControlServer) StreamStats(*StreamStatsRequest, grpc.ServerStreamingServer[Stats]) error {
+	return status.Errorf(codes.Unimplemented, "method StreamStats not implemented")
+}
+func (UnimplementedKarlControlServer) GetConfig(context.Context, *GetConfigRequest) (*ConfigResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetConfig not implemented")
+}
+func (UnimplementedKarlControlServer) SetDrain(context.Context, *SetDrainRequest) (*DrainStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetDrain not implemented")
+}
+func (UnimplementedKarlControlServer) GetDrain(context.Context, *GetDrainRequest) (*DrainStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetDrain not implemented")
+}
+func (UnimplementedKarlControlServer) mustEmbedUnimplementedKarlControlServer() {}
+func (UnimplementedKarlControlServer) testEmbeddedByValue()                     {}
+
+// UnsafeKarlControlServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to KarlControlServer will
+// result in compilation errors.
+type UnsafeKarlControlServer interface {
+	mustEmbedUnimplementedKarlControlServer()
+}
+
+func RegisterKarlControlServer(s grpc.ServiceRegistrar, srv KarlControlServer) {
+	// If the following call pancis, it indicates UnimplementedKarlControlServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&KarlControl_ServiceDesc, srv)
+}
+
+func _KarlControl_ListSessions_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListSessionsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KarlControlServer).ListSessions(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KarlControl_ListSessions_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KarlControlServer).ListSessions(ctx, req.(*ListSessionsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KarlControl_GetSession_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetSessionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KarlControlServer).GetSession(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KarlControl_GetSession_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KarlControlServer).GetSession(ctx, req.(*GetSessionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KarlControl_CreateSession_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateSessionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KarlControlServer).CreateSession(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KarlControl_CreateSession_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KarlControlServer).CreateSession(ctx, req.(*CreateSessionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KarlControl_DeleteSession_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteSessionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KarlControlServer).DeleteSession(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KarlControl_DeleteSession_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KarlControlServer).DeleteSession(ctx, req.(*DeleteSessionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KarlControl_GetStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KarlControlServer).GetStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KarlControl_GetStats_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KarlControlServer).GetStats(ctx, req.(*GetStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KarlControl_StreamStats_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamStatsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(KarlControlServer).StreamStats(m, &grpc.GenericServerStream[StreamStatsRequest, Stats]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type KarlControl_StreamStatsServer = grpc.ServerStreamingServer[Stats]
+
+func _KarlControl_GetConfig_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetConfigRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KarlControlServer).GetConfig(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KarlControl_GetConfig_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KarlControlServer).GetConfig(ctx, req.(*GetConfigRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KarlControl_SetDrain_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetDrainRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KarlControlServer).SetDrain(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KarlControl_SetDrain_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KarlControlServer).SetDrain(ctx, req.(*SetDrainRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KarlControl_GetDrain_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetDrainRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KarlControlServer).GetDrain(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KarlControl_GetDrain_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KarlControlServer).GetDrain(ctx, req.(*GetDrainRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// KarlControl_ServiceDesc is the grpc.ServiceDesc for KarlControl service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var KarlControl_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "karl.v1.KarlControl",
+	HandlerType: (*KarlControlServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListSessions",
+			Handler:    _KarlControl_ListSessions_Handler,
+		},
+		{
+			MethodName: "GetSession",
+			Handler:    _KarlControl_GetSession_Handler,
+		},
+		{
+			MethodName: "CreateSession",
+			Handler:    _KarlControl_CreateSession_Handler,
+		},
+		{
+			MethodName: "DeleteSession",
+			Handler:    _KarlControl_DeleteSession_Handler,
+		},
+		{
+			MethodName: "GetStats",
+			Handler:    _KarlControl_GetStats_Handler,
+		},
+		{
+			MethodName: "GetConfig",
+			Handler:    _KarlControl_GetConfig_Handler,
+		},
+		{
+			MethodName: "SetDrain",
+			Handler:    _KarlControl_SetDrain_Handler,
+		},
+		{
+			MethodName: "GetDrain",
+			Handler:    _KarlControl_GetDrain_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamStats",
+			Handler:       _KarlControl_StreamStats_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "karl.proto",
+}
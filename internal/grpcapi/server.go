@@ -0,0 +1,544 @@
+// Package grpcapi serves the KarlControl gRPC service, a typed alternative
+// to the REST API for orchestration systems
+package grpcapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"karl/internal"
+	"karl/internal/auth"
+	pb "karl/internal/grpcapi/karlpb"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var grpcRequestsTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "karl_grpc_requests_total",
+		Help: "Total gRPC requests by method and status code",
+	},
+	[]string{"method", "code"},
+)
+
+// methodPermissions are the API key permissions each method needs, the
+// same as the matching REST endpoints
+var methodPermissions = map[string]string{
+	pb.KarlControl_ListSessions_FullMethodName:  "session:read",
+	pb.KarlControl_GetSession_FullMethodName:    "session:read",
+	pb.KarlControl_CreateSession_FullMethodName: "session:write",
+	pb.KarlControl_DeleteSession_FullMethodName: "session:delete",
+	pb.KarlControl_GetStats_FullMethodName:      "stats:read",
+	pb.KarlControl_StreamStats_FullMethodName:   "stats:read",
+	pb.KarlControl_GetConfig_FullMethodName:     "admin",
+	pb.KarlControl_SetDrain_FullMethodName:      "admin",
+	pb.KarlControl_GetDrain_FullMethodName:      "stats:read",
+}
+
+// Server implements the KarlControl service
+type Server struct {
+	pb.UnimplementedKarlControlServer
+
+	config          *internal.Config
+	sessionRegistry *internal.SessionRegistry
+	sessionManager  *internal.SessionManager
+	authenticator   *auth.Authenticator
+	startTime       time.Time
+
+	mu     sync.Mutex
+	server *grpc.Server
+}
+
+// NewServer creates the gRPC control server
+func NewServer(config *internal.Config, sessionRegistry *internal.SessionRegistry) *Server {
+	s := &Server{
+		config:          config,
+		sessionRegistry: sessionRegistry,
+		startTime:       time.Now(),
+	}
+
+	if config.GRPC != nil && config.GRPC.AuthEnabled {
+		// API keys are looked up with MySQL queries; on other databases
+		// they are kept in memory only
+		keyDSN := ""
+		if driver, dsn := internal.DatabaseDriver(config.Database.DatabaseDSN()); driver == internal.DriverMySQL {
+			keyDSN = dsn
+		}
+		s.authenticator = auth.NewAuthenticator(keyDSN)
+	}
+	return s
+}
+
+// SetSessionManager sets the manager admitting the sessions CreateSession
+// creates under the admission caps
+func (s *Server) SetSessionManager(manager *internal.SessionManager) {
+	s.sessionManager = manager
+}
+
+// SetAuthenticator sets the authenticator checking API keys
+func (s *Server) SetAuthenticator(authenticator *auth.Authenticator) {
+	s.authenticator = authenticator
+}
+
+// Start listens on the configured address and serves in the background
+func (s *Server) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	addr := ":9090"
+	var opts []grpc.ServerOption
+	if cfg := s.config.GRPC; cfg != nil {
+		if cfg.Address != "" {
+			addr = cfg.Address
+		}
+		if cfg.TLSEnabled {
+			creds, err := credentials.NewServerTLSFromFile(cfg.TLSCert, cfg.TLSKey)
+			if err != nil {
+				return fmt.Errorf("failed to load gRPC TLS certificate: %w", err)
+			}
+			opts = append(opts, grpc.Creds(creds))
+		}
+	}
+	opts = append(opts,
+		grpc.UnaryInterceptor(s.unaryInterceptor),
+		grpc.StreamInterceptor(s.streamInterceptor),
+	)
+
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	s.server = grpc.NewServer(opts...)
+	pb.RegisterKarlControlServer(s.server, s)
+
+	go func() {
+		log.Printf("gRPC server starting on %s", addr)
+		if err := s.server.Serve(lis); err != nil {
+			log.Printf("gRPC server error: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Stop ends the open streams and stops the server
+func (s *Server) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.server == nil {
+		return
+	}
+	stopped := make(chan struct{})
+	go func() {
+		s.server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(10 * time.Second):
+		s.server.Stop()
+	}
+	s.server = nil
+	log.Println("gRPC server stopped")
+}
+
+// authorize checks the API key in the request metadata against the
+// permission the method needs
+func (s *Server) authorize(ctx context.Context, method string) error {
+	if s.authenticator == nil {
+		return nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	apiKey := ""
+	if values := md.Get("authorization"); len(values) > 0 && strings.HasPrefix(values[0], "Bearer ") {
+		apiKey = strings.TrimPrefix(values[0], "Bearer ")
+	} else if values := md.Get("x-api-key"); len(values) > 0 {
+		apiKey = values[0]
+	}
+	if apiKey == "" {
+		return status.Error(codes.Unauthenticated, "missing API key")
+	}
+
+	permissions, err := s.authenticator.ValidateKey(apiKey)
+	if err != nil {
+		return status.Error(codes.Unauthenticated, "invalid API key")
+	}
+	if required, ok := methodPermissions[method]; ok && !hasPermission(permissions, required) {
+		return status.Error(codes.PermissionDenied, "insufficient permissions")
+	}
+	return nil
+}
+
+func (s *Server) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := func() (interface{}, error) {
+		if err := s.authorize(ctx, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}()
+	s.record(ctx, info.FullMethod, err, start)
+	return resp, err
+}
+
+func (s *Server) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := s.authorize(ss.Context(), info.FullMethod)
+	if err == nil {
+		err = handler(srv, ss)
+	}
+	s.record(ss.Context(), info.FullMethod, err, start)
+	return err
+}
+
+// record counts and logs a finished call
+func (s *Server) record(ctx context.Context, method string, err error, start time.Time) {
+	code := status.Code(err)
+	grpcRequestsTotal.WithLabelValues(method, code.String()).Inc()
+
+	client := ""
+	if p, ok := peer.FromContext(ctx); ok {
+		client = p.Addr.String()
+	}
+	log.Printf("gRPC %s from %s %s %v", method, client, code, time.Since(start))
+}
+
+// hasPermission checks if permissions include required, honouring the "*"
+// and "category:*" wildcards
+func hasPermission(permissions []string, required string) bool {
+	for _, p := range permissions {
+		if p == "*" || p == required {
+			return true
+		}
+		if strings.HasSuffix(p, ":*") && strings.HasPrefix(required, strings.TrimSuffix(p, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// ListSessions implements KarlControl
+func (s *Server) ListSessions(ctx context.Context, req *pb.ListSessionsRequest) (*pb.ListSessionsResponse, error) {
+	sessions := s.sessionRegistry.ListSessions()
+	resp := &pb.ListSessionsResponse{
+		Sessions: make([]*pb.Session, 0, len(sessions)),
+		Total:    int32(len(sessions)),
+		Active:   int32(s.sessionRegistry.GetActiveCount()),
+	}
+
+	for _, session := range sessions {
+		session.Lock()
+		if (req.State == "" || string(session.State) == req.State) &&
+			(req.CallId == "" || session.CallID == req.CallId) {
+			resp.Sessions = append(resp.Sessions, sessionToProto(session))
+		}
+		session.Unlock()
+	}
+	return resp, nil
+}
+
+// GetSession implements KarlControl
+func (s *Server) GetSession(ctx context.Context, req *pb.GetSessionRequest) (*pb.Session, error) {
+	session, ok := s.sessionRegistry.GetSession(req.Id)
+	if !ok {
+		if sessions := s.sessionRegistry.GetSessionByCallID(req.Id); len(sessions) > 0 {
+			session, ok = sessions[0], true
+		}
+	}
+	if !ok {
+		return nil, status.Error(codes.NotFound, "session not found")
+	}
+
+	session.Lock()
+	defer session.Unlock()
+	return sessionToProto(session), nil
+}
+
+// CreateSession implements KarlControl
+func (s *Server) CreateSession(ctx context.Context, req *pb.CreateSessionRequest) (*pb.Session, error) {
+	if req.CallId == "" || req.FromTag == "" {
+		return nil, status.Error(codes.InvalidArgument, "call_id and from_tag are required")
+	}
+
+	if s.sessionManager == nil {
+		return nil, status.Error(codes.Unavailable, "admission control not available")
+	}
+	session, err := s.sessionManager.AdmitSession(req.CallId, req.FromTag, nil)
+	if errors.Is(err, internal.ErrCapacityExceeded) {
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	for k, v := range req.Metadata {
+		session.SetMetadata(k, v)
+	}
+
+	session.Lock()
+	defer session.Unlock()
+	return sessionToProto(session), nil
+}
+
+// DeleteSession implements KarlControl
+func (s *Server) DeleteSession(ctx context.Context, req *pb.DeleteSessionRequest) (*pb.DeleteSessionResponse, error) {
+	if _, ok := s.sessionRegistry.GetSession(req.Id); !ok {
+		return nil, status.Error(codes.NotFound, "session not found")
+	}
+
+	_ = s.sessionRegistry.UpdateSessionState(req.Id, string(internal.SessionStateTerminated))
+	if err := s.sessionRegistry.DeleteSession(req.Id); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &pb.DeleteSessionResponse{}, nil
+}
+
+// GetStats implements KarlControl
+func (s *Server) GetStats(ctx context.Context, req *pb.GetStatsRequest) (*pb.Stats, error) {
+	return s.collectStats(false), nil
+}
+
+// StreamStats implements KarlControl
+func (s *Server) StreamStats(req *pb.StreamStatsRequest, stream pb.KarlControl_StreamStatsServer) error {
+	interval := time.Second
+	if req.IntervalMs > 0 {
+		interval = time.Duration(req.IntervalMs) * time.Millisecond
+	}
+	if interval < 100*time.Millisecond {
+		return status.Error(codes.InvalidArgument, "interval_ms must be at least 100")
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := stream.Send(s.collectStats(req.IncludeSessions)); err != nil {
+			return err
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// collectStats sums the legs of every session, as GET /api/v1/stats does
+func (s *Server) collectStats(includeSessions bool) *pb.Stats {
+	sessions := s.sessionRegistry.ListSessions()
+	stats := &pb.Stats{
+		Timestamp:     timestamppb.Now(),
+		CurrentCalls:  int32(s.sessionRegistry.GetActiveCount()),
+		TotalCalls:    int32(len(sessions)),
+		UptimeSeconds: time.Since(s.startTime).Seconds(),
+	}
+
+	var totalJitter, totalMOS float64
+	var jitterCount, mosCount int
+	for _, session := range sessions {
+		session.Lock()
+		for _, leg := range []*internal.CallLeg{session.CallerLeg, session.CalleeLeg} {
+			if leg == nil {
+				continue
+			}
+			stats.PacketsSent += leg.PacketsSent
+			stats.PacketsRecv += leg.PacketsRecv
+			stats.BytesSent += leg.BytesSent
+			stats.BytesRecv += leg.BytesRecv
+			stats.PacketsLost += uint64(leg.PacketsLost)
+			if leg.Jitter > 0 {
+				totalJitter += leg.Jitter
+				jitterCount++
+			}
+		}
+		if session.Stats != nil && session.Stats.MOS > 0 {
+			totalMOS += session.Stats.MOS
+			mosCount++
+		}
+		if includeSessions {
+			stats.Sessions = append(stats.Sessions, sessionStatsToProto(session))
+		}
+		session.Unlock()
+	}
+
+	if jitterCount > 0 {
+		stats.AvgJitterMs = totalJitter / float64(jitterCount) * 1000
+	}
+	if mosCount > 0 {
+		stats.AvgMos = totalMOS / float64(mosCount)
+	}
+	return stats
+}
+
+// GetConfig implements KarlControl
+func (s *Server) GetConfig(ctx context.Context, req *pb.GetConfigRequest) (*pb.ConfigResponse, error) {
+	raw, err := RedactedConfigJSON(s.config)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	sessionConfig := s.config.GetSessionConfig()
+	resp := &pb.ConfigResponse{
+		Version:     s.config.Version,
+		Environment: s.config.Environment,
+		MediaIp:     s.config.Integration.MediaIP,
+		PublicIp:    s.config.Integration.PublicIP,
+		MinPort:     int32(sessionConfig.MinPort),
+		MaxPort:     int32(sessionConfig.MaxPort),
+		Json:        string(raw),
+	}
+	if s.config.NGProtocol != nil {
+		resp.NgUdpPort = int32(s.config.NGProtocol.UDPPort)
+	}
+	return resp, nil
+}
+
+// SetDrain implements KarlControl
+func (s *Server) SetDrain(ctx context.Context, req *pb.SetDrainRequest) (*pb.DrainStatus, error) {
+	internal.SetDraining(req.Draining)
+	log.Printf("Drain set to %v over gRPC", req.Draining)
+	return s.drainStatus(), nil
+}
+
+// GetDrain implements KarlControl
+func (s *Server) GetDrain(ctx context.Context, req *pb.GetDrainRequest) (*pb.DrainStatus, error) {
+	return s.drainStatus(), nil
+}
+
+func (s *Server) drainStatus() *pb.DrainStatus {
+	return &pb.DrainStatus{
+		Draining:       internal.IsDraining(),
+		ActiveSessions: int32(s.sessionRegistry.GetActiveCount()),
+	}
+}
+
+// secretKeys are the config keys whose values RedactedConfigJSON blanks
+var secretKeys = []string{"password", "secret", "token", "dsn", "_key"}
+
+// RedactedConfigJSON encodes config with passwords, keys and DSNs blanked
+func RedactedConfigJSON(config *internal.Config) ([]byte, error) {
+	raw, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	var tree interface{}
+	if err := json.Unmarshal(raw, &tree); err != nil {
+		return nil, err
+	}
+	redact(tree)
+	return json.Marshal(tree)
+}
+
+func redact(node interface{}) {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if s, ok := value.(string); ok && s != "" && isSecretKey(key) {
+				v[key] = "[redacted]"
+				continue
+			}
+			redact(value)
+		}
+	case []interface{}:
+		for _, value := range v {
+			redact(value)
+		}
+	}
+}
+
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, secret := range secretKeys {
+		if strings.Contains(key, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionToProto converts a session; the caller holds the session lock
+func sessionToProto(session *internal.MediaSession) *pb.Session {
+	quality := session.LiveQuality()
+	resp := &pb.Session{
+		Id:              session.ID,
+		CallId:          session.CallID,
+		FromTag:         session.FromTag,
+		ToTag:           session.ToTag,
+		State:           string(session.State),
+		CreatedAt:       timestamppb.New(session.CreatedAt),
+		UpdatedAt:       timestamppb.New(session.UpdatedAt),
+		DurationSeconds: quality.Duration.Seconds(),
+		Flags:           session.Flags,
+		Metadata:        session.Metadata,
+	}
+	if session.CallerLeg != nil {
+		resp.CallerLeg = legToProto(session.CallerLeg, quality.Caller)
+	}
+	if session.CalleeLeg != nil {
+		resp.CalleeLeg = legToProto(session.CalleeLeg, quality.Callee)
+	}
+	return resp
+}
+
+func legToProto(leg *internal.CallLeg, quality internal.LegQuality) *pb.Leg {
+	codecs := make([]string, len(leg.Codecs))
+	for i, c := range leg.Codecs {
+		codecs[i] = c.Name
+	}
+
+	resp := &pb.Leg{
+		Tag:         leg.Tag,
+		Port:        int32(leg.Port),
+		LocalPort:   int32(leg.LocalPort),
+		MediaType:   string(leg.MediaType),
+		Ssrc:        leg.SSRC,
+		Codecs:      codecs,
+		PacketsSent: leg.PacketsSent,
+		PacketsRecv: leg.PacketsRecv,
+		BytesSent:   leg.BytesSent,
+		BytesRecv:   leg.BytesRecv,
+		PacketsLost: quality.PacketsLost,
+		JitterMs:    quality.JitterMs,
+	}
+	if leg.IP != nil {
+		resp.Ip = leg.IP.String()
+	}
+	if leg.LocalIP != nil {
+		resp.LocalIp = leg.LocalIP.String()
+	}
+	return resp
+}
+
+// sessionStatsToProto converts a session's statistics; the caller holds the
+// session lock
+func sessionStatsToProto(session *internal.MediaSession) *pb.SessionStats {
+	quality := session.LiveQuality()
+	resp := &pb.SessionStats{
+		SessionId:       session.ID,
+		CallId:          session.CallID,
+		State:           string(session.State),
+		DurationSeconds: quality.Duration.Seconds(),
+	}
+	if session.Stats != nil {
+		resp.PacketLossRate = session.Stats.PacketLossRate
+		resp.AvgJitterMs = session.Stats.AvgJitter * 1000
+		resp.RttMs = session.Stats.RTT * 1000
+		resp.Mos = session.Stats.MOS
+	}
+	return resp
+}
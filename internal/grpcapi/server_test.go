@@ -0,0 +1,222 @@
+package grpcapi
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"karl/internal"
+	"karl/internal/auth"
+	pb "karl/internal/grpcapi/karlpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// startTestServer serves s over an in-memory connection and returns a client
+func startTestServer(t *testing.T, s *Server) pb.KarlControlClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(s.unaryInterceptor),
+		grpc.StreamInterceptor(s.streamInterceptor),
+	)
+	pb.RegisterKarlControlServer(server, s)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewKarlControlClient(conn)
+}
+
+func testConfig() *internal.Config {
+	return &internal.Config{
+		Integration: internal.IntegrationConfig{MediaIP: "10.0.0.1"},
+		Database:    internal.DatabaseConfig{MySQLDSN: "karl:hunter2@tcp(db:3306)/karl"},
+	}
+}
+
+func TestServer_SessionCRUD(t *testing.T) {
+	registry := internal.NewSessionRegistry(time.Hour)
+	server := NewServer(testConfig(), registry)
+	server.SetSessionManager(internal.NewSessionManager(registry, internal.NewPortAllocator(nil), ""))
+	client := startTestServer(t, server)
+	ctx := context.Background()
+
+	created, err := client.CreateSession(ctx, &pb.CreateSessionRequest{
+		CallId:   "call-1",
+		FromTag:  "tag-1",
+		Metadata: map[string]string{"tenant": "acme"},
+	})
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+	if created.CallId != "call-1" || created.Metadata["tenant"] != "acme" {
+		t.Errorf("unexpected session %+v", created)
+	}
+
+	// Sessions can be fetched by Call-ID as well as by ID
+	got, err := client.GetSession(ctx, &pb.GetSessionRequest{Id: "call-1"})
+	if err != nil || got.Id != created.Id {
+		t.Fatalf("GetSession by Call-ID = %v, %v", got, err)
+	}
+
+	list, err := client.ListSessions(ctx, &pb.ListSessionsRequest{CallId: "call-1"})
+	if err != nil || len(list.Sessions) != 1 {
+		t.Fatalf("ListSessions = %v, %v", list, err)
+	}
+
+	if _, err := client.DeleteSession(ctx, &pb.DeleteSessionRequest{Id: created.Id}); err != nil {
+		t.Fatalf("DeleteSession failed: %v", err)
+	}
+	if _, err := client.GetSession(ctx, &pb.GetSessionRequest{Id: created.Id}); status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound after delete, got %v", err)
+	}
+	if _, err := client.CreateSession(ctx, &pb.CreateSessionRequest{CallId: "call-2"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument without a from tag, got %v", err)
+	}
+}
+
+func TestServer_CreateSessionAdmission(t *testing.T) {
+	internal.ConfigureAdmission(&internal.SessionConfig{MaxSessions: 1})
+	t.Cleanup(func() { internal.ConfigureAdmission(nil) })
+
+	registry := internal.NewSessionRegistry(time.Hour)
+	server := NewServer(testConfig(), registry)
+	ctx := context.Background()
+
+	// Sessions are only created under admission control
+	client := startTestServer(t, server)
+	if _, err := client.CreateSession(ctx, &pb.CreateSessionRequest{CallId: "call-1", FromTag: "tag-1"}); status.Code(err) != codes.Unavailable {
+		t.Errorf("expected Unavailable without a session manager, got %v", err)
+	}
+
+	server.SetSessionManager(internal.NewSessionManager(registry, internal.NewPortAllocator(nil), ""))
+	if _, err := client.CreateSession(ctx, &pb.CreateSessionRequest{CallId: "call-1", FromTag: "tag-1"}); err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+	if _, err := client.CreateSession(ctx, &pb.CreateSessionRequest{CallId: "call-2", FromTag: "tag-2"}); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected ResourceExhausted beyond max_sessions, got %v", err)
+	}
+	if n := registry.GetTotalCount(); n != 1 {
+		t.Errorf("expected 1 session, got %d", n)
+	}
+}
+
+func TestServer_StreamStats(t *testing.T) {
+	registry := internal.NewSessionRegistry(time.Hour)
+	registry.CreateSession("call-1", "tag-1")
+	client := startTestServer(t, NewServer(testConfig(), registry))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.StreamStats(ctx, &pb.StreamStatsRequest{IntervalMs: 100, IncludeSessions: true})
+	if err != nil {
+		t.Fatalf("StreamStats failed: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		stats, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if stats.TotalCalls != 1 || len(stats.Sessions) != 1 || stats.Sessions[0].CallId != "call-1" {
+			t.Errorf("unexpected stats %+v", stats)
+		}
+	}
+
+	// Stream errors arrive with the first Recv
+	short, err := client.StreamStats(ctx, &pb.StreamStatsRequest{IntervalMs: 10})
+	if err == nil {
+		_, err = short.Recv()
+	}
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for a short interval, got %v", err)
+	}
+}
+
+func TestServer_ConfigRedactsSecrets(t *testing.T) {
+	client := startTestServer(t, NewServer(testConfig(), internal.NewSessionRegistry(time.Hour)))
+
+	resp, err := client.GetConfig(context.Background(), &pb.GetConfigRequest{})
+	if err != nil {
+		t.Fatalf("GetConfig failed: %v", err)
+	}
+	if resp.MediaIp != "10.0.0.1" {
+		t.Errorf("expected media IP 10.0.0.1, got %q", resp.MediaIp)
+	}
+
+	var tree map[string]interface{}
+	if err := json.Unmarshal([]byte(resp.Json), &tree); err != nil {
+		t.Fatalf("config is not JSON: %v", err)
+	}
+	if dsn := tree["database"].(map[string]interface{})["mysql_dsn"]; dsn != "[redacted]" {
+		t.Errorf("expected the DSN redacted, got %v", dsn)
+	}
+}
+
+func TestServer_Drain(t *testing.T) {
+	client := startTestServer(t, NewServer(testConfig(), internal.NewSessionRegistry(time.Hour)))
+	defer internal.SetDraining(false)
+
+	resp, err := client.SetDrain(context.Background(), &pb.SetDrainRequest{Draining: true})
+	if err != nil || !resp.Draining || !internal.IsDraining() {
+		t.Fatalf("SetDrain = %v, %v", resp, err)
+	}
+	resp, err = client.GetDrain(context.Background(), &pb.GetDrainRequest{})
+	if err != nil || !resp.Draining {
+		t.Fatalf("GetDrain = %v, %v", resp, err)
+	}
+}
+
+func TestServer_Auth(t *testing.T) {
+	s := NewServer(testConfig(), internal.NewSessionRegistry(time.Hour))
+	s.SetAuthenticator(auth.NewAuthenticator(""))
+	client := startTestServer(t, s)
+
+	if _, err := client.GetStats(context.Background(), &pb.GetStatsRequest{}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected Unauthenticated without a key, got %v", err)
+	}
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "wrong")
+	if _, err := client.GetStats(ctx, &pb.GetStatsRequest{}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected Unauthenticated with a bad key, got %v", err)
+	}
+
+	ctx = metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer karl-dev-key")
+	if _, err := client.GetStats(ctx, &pb.GetStatsRequest{}); err != nil {
+		t.Errorf("expected the dev key to be accepted, got %v", err)
+	}
+}
+
+func TestHasPermission(t *testing.T) {
+	tests := []struct {
+		permissions []string
+		required    string
+		want        bool
+	}{
+		{[]string{"*"}, "admin", true},
+		{[]string{"session:*"}, "session:delete", true},
+		{[]string{"session:read"}, "session:write", false},
+		{[]string{"stats:read"}, "admin", false},
+	}
+	for _, tt := range tests {
+		if got := hasPermission(tt.permissions, tt.required); got != tt.want {
+			t.Errorf("hasPermission(%v, %q) = %v, want %v", tt.permissions, tt.required, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,555 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+)
+
+// haLog logs the node's HA role changes
+var haLog = Logger(ComponentKarl)
+
+var (
+	haActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "karl_ha_active",
+		Help: "Whether this node owns the virtual media IP (1) or is standby (0)",
+	})
+
+	haEpoch = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "karl_ha_epoch",
+		Help: "Fencing epoch of the lease this node last held",
+	})
+
+	haFailovers = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "karl_ha_failovers_total",
+			Help: "Role changes of this node by new role and reason (acquired, lease_lost, renew_timeout, shutdown)",
+		},
+		[]string{"role", "reason"},
+	)
+
+	haLeaseErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "karl_ha_lease_errors_total",
+			Help: "Failed lease store operations by operation",
+		},
+		[]string{"operation"},
+	)
+)
+
+// HARole is this node's part in an active/standby pair
+type HARole int
+
+const (
+	// HARoleStandby waits for the lease to become free
+	HARoleStandby HARole = iota
+	// HARoleActive holds the lease and the virtual media IP
+	HARoleActive
+)
+
+func (r HARole) String() string {
+	switch r {
+	case HARoleStandby:
+		return "standby"
+	case HARoleActive:
+		return "active"
+	default:
+		return "unknown"
+	}
+}
+
+// HA failover reasons, as reported in karl_ha_failovers_total
+const (
+	HAReasonAcquired     = "acquired"
+	HAReasonLeaseLost    = "lease_lost"
+	HAReasonRenewTimeout = "renew_timeout"
+	HAReasonShutdown     = "shutdown"
+)
+
+// LeaseStore arbitrates which node is active. A lease carries a fencing
+// epoch that grows with every acquisition, so a node that lost the lease can
+// never renew it again
+type LeaseStore interface {
+	// Acquire takes the lease if it is free and returns its new epoch
+	Acquire(ctx context.Context, holder string, ttl time.Duration) (epoch int64, ok bool, err error)
+	// Renew extends the lease if holder still owns it at epoch
+	Renew(ctx context.Context, holder string, epoch int64, ttl time.Duration) (bool, error)
+	// Release gives the lease up if holder still owns it at epoch
+	Release(ctx context.Context, holder string, epoch int64) error
+	// Holder returns the current owner, empty when the lease is free
+	Holder(ctx context.Context) (holder string, epoch int64, err error)
+}
+
+// VirtualIP moves the shared media address between nodes
+type VirtualIP interface {
+	Add() error
+	Remove() error
+}
+
+var (
+	redisLeaseAcquire = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then return 0 end
+local epoch = redis.call('INCR', KEYS[2])
+redis.call('SET', KEYS[1], ARGV[1] .. '/' .. epoch, 'PX', ARGV[2])
+return epoch`)
+
+	redisLeaseRenew = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0`)
+
+	redisLeaseRelease = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0`)
+)
+
+// RedisLeaseStore keeps the lease in a Redis key holding "node/epoch" with a
+// TTL, and the epoch counter in key:epoch
+type RedisLeaseStore struct {
+	client *redis.Client
+	key    string
+}
+
+// NewRedisLeaseStore creates a lease store on the given key
+func NewRedisLeaseStore(client *redis.Client, key string) *RedisLeaseStore {
+	return &RedisLeaseStore{client: client, key: key}
+}
+
+func leaseValue(holder string, epoch int64) string {
+	return holder + "/" + strconv.FormatInt(epoch, 10)
+}
+
+// Acquire implements LeaseStore
+func (s *RedisLeaseStore) Acquire(ctx context.Context, holder string, ttl time.Duration) (int64, bool, error) {
+	epoch, err := redisLeaseAcquire.Run(ctx, s.client, []string{s.key, s.key + ":epoch"},
+		holder, ttl.Milliseconds()).Int64()
+	if err != nil {
+		return 0, false, err
+	}
+	return epoch, epoch > 0, nil
+}
+
+// Renew implements LeaseStore
+func (s *RedisLeaseStore) Renew(ctx context.Context, holder string, epoch int64, ttl time.Duration) (bool, error) {
+	n, err := redisLeaseRenew.Run(ctx, s.client, []string{s.key},
+		leaseValue(holder, epoch), ttl.Milliseconds()).Int64()
+	return n == 1, err
+}
+
+// Release implements LeaseStore
+func (s *RedisLeaseStore) Release(ctx context.Context, holder string, epoch int64) error {
+	return redisLeaseRelease.Run(ctx, s.client, []string{s.key}, leaseValue(holder, epoch)).Err()
+}
+
+// Holder implements LeaseStore
+func (s *RedisLeaseStore) Holder(ctx context.Context) (string, int64, error) {
+	value, err := s.client.Get(ctx, s.key).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", 0, nil
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	i := strings.LastIndexByte(value, '/')
+	if i < 0 {
+		return value, 0, nil
+	}
+	epoch, _ := strconv.ParseInt(value[i+1:], 10, 64)
+	return value[:i], epoch, nil
+}
+
+// ipVirtualIP adds the address to an interface with iproute2 and, for IPv4,
+// announces it with gratuitous ARP (arping)
+type ipVirtualIP struct {
+	addr  string // address with prefix length
+	iface string
+	ip    net.IP
+}
+
+// NewIPVirtualIP manages addr (a bare address or CIDR) on iface
+func NewIPVirtualIP(addr, iface string) (VirtualIP, error) {
+	ip, _, err := net.ParseCIDR(addr)
+	if err != nil {
+		if ip = net.ParseIP(addr); ip == nil {
+			return nil, fmt.Errorf("invalid virtual IP %q", addr)
+		}
+		if ip.To4() != nil {
+			addr += "/32"
+		} else {
+			addr += "/128"
+		}
+	}
+	if iface == "" {
+		return nil, fmt.Errorf("virtual IP %s needs an interface", addr)
+	}
+	return &ipVirtualIP{addr: addr, iface: iface, ip: ip}, nil
+}
+
+// Add implements VirtualIP
+func (v *ipVirtualIP) Add() error {
+	out, err := exec.Command("ip", "addr", "add", v.addr, "dev", v.iface).CombinedOutput()
+	if err != nil && !strings.Contains(string(out), "File exists") {
+		return fmt.Errorf("ip addr add %s dev %s: %v: %s", v.addr, v.iface, err, strings.TrimSpace(string(out)))
+	}
+
+	// Point neighbours at this node; best effort, the address works without it
+	if v.ip.To4() != nil {
+		if out, err := exec.Command("arping", "-U", "-c", "3", "-I", v.iface, v.ip.String()).CombinedOutput(); err != nil {
+			haLog.Warn("Gratuitous ARP failed", "ip", v.ip, "interface", v.iface, "error", err, "output", strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+// Remove implements VirtualIP
+func (v *ipVirtualIP) Remove() error {
+	out, err := exec.Command("ip", "addr", "del", v.addr, "dev", v.iface).CombinedOutput()
+	if err != nil && !strings.Contains(string(out), "Cannot assign requested address") {
+		return fmt.Errorf("ip addr del %s dev %s: %v: %s", v.addr, v.iface, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// HAElector runs VRRP-style active/standby election over a LeaseStore. The
+// active node renews the lease every interval; standbys take it once it
+// expires, higher priorities after a shorter skew so they win ties.
+//
+// Split brain is avoided on both sides: a node cut off from the store can
+// never become active, and an active node that cannot renew demotes itself
+// one interval before its lease could expire and be taken by the peer.
+type HAElector struct {
+	nodeID   string
+	store    LeaseStore
+	vip      VirtualIP
+	ttl      time.Duration
+	interval time.Duration
+	skew     time.Duration
+
+	mu           sync.RWMutex
+	role         HARole
+	epoch        int64
+	lastRenewed  time.Time // when the last successful renew was sent
+	freeSince    time.Time // when a standby first saw the lease free
+	leader       string
+	lastChange   time.Time
+	onRoleChange func(role HARole, reason string)
+
+	stopChan chan struct{}
+	doneChan chan struct{}
+}
+
+// NewHAElector creates an elector. vip may be nil when the address is moved
+// by something else (a cloud API, keepalived notify script)
+func NewHAElector(cfg *HAConfig, store LeaseStore, vip VirtualIP) *HAElector {
+	ttl := time.Duration(cfg.LeaseTTL) * time.Millisecond
+	interval := time.Duration(cfg.RenewInterval) * time.Millisecond
+	if interval <= 0 || interval >= ttl/2 {
+		interval = ttl / 3
+	}
+
+	priority := cfg.Priority
+	if priority < 1 || priority > 255 {
+		priority = 100
+	}
+
+	return &HAElector{
+		nodeID:   cfg.NodeID,
+		store:    store,
+		vip:      vip,
+		ttl:      ttl,
+		interval: interval,
+		// VRRP skew time: (256 - priority) / 256 of an interval
+		skew:     interval * time.Duration(256-priority) / 256,
+		stopChan: make(chan struct{}),
+		doneChan: make(chan struct{}),
+	}
+}
+
+// SetOnRoleChange registers a callback run after every role change
+func (e *HAElector) SetOnRoleChange(fn func(role HARole, reason string)) {
+	e.mu.Lock()
+	e.onRoleChange = fn
+	e.mu.Unlock()
+}
+
+// Start begins the election loop
+func (e *HAElector) Start() {
+	haActive.Set(0)
+	go e.run()
+}
+
+// Stop ends the election, giving up the lease and the virtual IP if held
+func (e *HAElector) Stop() {
+	close(e.stopChan)
+	<-e.doneChan
+
+	e.mu.RLock()
+	active := e.role == HARoleActive
+	e.mu.RUnlock()
+	if active {
+		e.demote(HAReasonShutdown, true)
+	}
+}
+
+// Role returns this node's current role
+func (e *HAElector) Role() HARole {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.role
+}
+
+// IsActive reports whether this node owns the virtual IP
+func (e *HAElector) IsActive() bool {
+	return e.Role() == HARoleActive
+}
+
+func (e *HAElector) run() {
+	defer close(e.doneChan)
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	e.tick(time.Now())
+	for {
+		select {
+		case <-e.stopChan:
+			return
+		case now := <-ticker.C:
+			e.tick(now)
+		}
+	}
+}
+
+// tick runs one election round
+func (e *HAElector) tick(now time.Time) {
+	if e.Role() == HARoleActive {
+		e.renew(now)
+	} else {
+		e.tryAcquire(now)
+	}
+}
+
+func (e *HAElector) renew(now time.Time) {
+	e.mu.RLock()
+	epoch, lastRenewed := e.epoch, e.lastRenewed
+	e.mu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.interval)
+	ok, err := e.store.Renew(ctx, e.nodeID, epoch, e.ttl)
+	cancel()
+
+	switch {
+	case err == nil && ok:
+		e.mu.Lock()
+		e.lastRenewed = now
+		e.mu.Unlock()
+	case err == nil:
+		haLog.Warn("HA lease was taken over, stepping down", "epoch", epoch)
+		e.demote(HAReasonLeaseLost, false)
+	default:
+		haLeaseErrors.WithLabelValues("renew").Inc()
+		// The lease may expire at lastRenewed+ttl; leave before the next
+		// round could be too late
+		if now.Add(e.interval).Sub(lastRenewed) >= e.ttl-e.interval {
+			haLog.Warn("HA lease not renewed, stepping down", "renewed", lastRenewed.Format(time.RFC3339), "error", err)
+			e.demote(HAReasonRenewTimeout, false)
+		}
+	}
+}
+
+func (e *HAElector) tryAcquire(now time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), e.interval)
+	defer cancel()
+
+	holder, _, err := e.store.Holder(ctx)
+	if err != nil {
+		haLeaseErrors.WithLabelValues("holder").Inc()
+		return
+	}
+
+	e.mu.Lock()
+	e.leader = holder
+	if holder != "" {
+		e.freeSince = time.Time{}
+		e.mu.Unlock()
+		return
+	}
+	if e.freeSince.IsZero() {
+		e.freeSince = now
+	}
+	wait := e.skew - now.Sub(e.freeSince)
+	e.mu.Unlock()
+	if wait > 0 {
+		return
+	}
+
+	epoch, ok, err := e.store.Acquire(ctx, e.nodeID, e.ttl)
+	if err != nil {
+		haLeaseErrors.WithLabelValues("acquire").Inc()
+		return
+	}
+	if !ok {
+		return
+	}
+
+	if e.vip != nil {
+		if err := e.vip.Add(); err != nil {
+			haLog.Error("HA failed to take the virtual IP", "error", err)
+			if err := e.store.Release(ctx, e.nodeID, epoch); err != nil {
+				haLeaseErrors.WithLabelValues("release").Inc()
+			}
+			return
+		}
+	}
+
+	e.mu.Lock()
+	e.role = HARoleActive
+	e.epoch = epoch
+	e.lastRenewed = now
+	e.freeSince = time.Time{}
+	e.leader = e.nodeID
+	e.lastChange = now
+	onRoleChange := e.onRoleChange
+	e.mu.Unlock()
+
+	haActive.Set(1)
+	haEpoch.Set(float64(epoch))
+	haFailovers.WithLabelValues(HARoleActive.String(), HAReasonAcquired).Inc()
+	haLog.Info("HA node is now active", "node", e.nodeID, "epoch", epoch)
+
+	if onRoleChange != nil {
+		onRoleChange(HARoleActive, HAReasonAcquired)
+	}
+}
+
+// demote drops the virtual IP and returns to standby. The lease is released
+// only when leaving voluntarily; otherwise it is no longer ours to release
+func (e *HAElector) demote(reason string, release bool) {
+	if e.vip != nil {
+		if err := e.vip.Remove(); err != nil {
+			haLog.Error("HA failed to drop the virtual IP", "error", err)
+		}
+	}
+
+	e.mu.Lock()
+	epoch := e.epoch
+	e.role = HARoleStandby
+	e.leader = ""
+	e.lastChange = time.Now()
+	onRoleChange := e.onRoleChange
+	e.mu.Unlock()
+
+	if release {
+		ctx, cancel := context.WithTimeout(context.Background(), e.interval)
+		if err := e.store.Release(ctx, e.nodeID, epoch); err != nil {
+			haLeaseErrors.WithLabelValues("release").Inc()
+		}
+		cancel()
+	}
+
+	haActive.Set(0)
+	haFailovers.WithLabelValues(HARoleStandby.String(), reason).Inc()
+	haLog.Info("HA node is now standby", "node", e.nodeID, "reason", reason)
+
+	if onRoleChange != nil {
+		onRoleChange(HARoleStandby, reason)
+	}
+}
+
+// CheckHealth reports the HA role for the health endpoint. Standby is a
+// healthy state; the component is degraded only while no leader is known
+func (e *HAElector) CheckHealth() ComponentHealth {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	health := CreateComponentHealth(StatusUp, "HA node is "+e.role.String())
+	health.Details["node_id"] = e.nodeID
+	health.Details["role"] = e.role.String()
+	health.Details["leader"] = e.leader
+	if e.role == HARoleActive {
+		health.Details["epoch"] = strconv.FormatInt(e.epoch, 10)
+	}
+	if !e.lastChange.IsZero() {
+		health.Details["last_change"] = e.lastChange.Format(time.RFC3339)
+	}
+	if e.leader == "" {
+		health.Status = StatusDegraded
+		health.Message = "HA has no active node"
+	}
+	return health
+}
+
+// DefaultHANodeID names the node after its host
+func DefaultHANodeID() string {
+	if host, err := os.Hostname(); err == nil && host != "" {
+		return host
+	}
+	return "karl"
+}
+
+// InitHA builds the elector for the ha config section, with the lease kept
+// in Redis and the virtual IP moved with iproute2
+func InitHA(cfg *Config) (*HAElector, error) {
+	haCfg := cfg.GetHAConfig()
+	if !haCfg.Enabled {
+		return nil, nil
+	}
+
+	addr := haCfg.RedisAddr
+	if addr == "" {
+		addr = cfg.Database.RedisAddr
+	}
+	if addr == "" {
+		return nil, fmt.Errorf("HA needs ha.redis_addr or database.redis_addr")
+	}
+
+	var vip VirtualIP
+	if haCfg.VirtualIP != "" {
+		var err error
+		if vip, err = NewIPVirtualIP(haCfg.VirtualIP, haCfg.Interface); err != nil {
+			return nil, err
+		}
+	}
+
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	elector := NewHAElector(haCfg, NewRedisLeaseStore(client, haCfg.Key), vip)
+	haLog.Info("HA node electing via Redis", "node", haCfg.NodeID, "redis", addr, "key", haCfg.Key, "priority", haCfg.Priority)
+	return elector, nil
+}
+
+// ValidateHAConfig checks the ha section of an enabled configuration
+func ValidateHAConfig(cfg *Config) error {
+	ha := cfg.GetHAConfig()
+	if ha.RedisAddr == "" && cfg.Database.RedisAddr == "" {
+		return fmt.Errorf("HA enabled but no Redis address specified")
+	}
+	if ha.Priority < 1 || ha.Priority > 255 {
+		return fmt.Errorf("invalid HA priority: %d", ha.Priority)
+	}
+	if ha.LeaseTTL < 300 {
+		return fmt.Errorf("invalid HA lease TTL: %dms", ha.LeaseTTL)
+	}
+	if ha.RenewInterval <= 0 || ha.RenewInterval*3 > ha.LeaseTTL {
+		return fmt.Errorf("HA renew interval %dms must be at most a third of the lease TTL", ha.RenewInterval)
+	}
+	if ha.VirtualIP != "" {
+		if _, err := NewIPVirtualIP(ha.VirtualIP, ha.Interface); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryLeaseStore is a LeaseStore with an injectable clock and failures
+type memoryLeaseStore struct {
+	mu      sync.Mutex
+	now     time.Time
+	holder  string
+	epoch   int64
+	expires time.Time
+	err     error
+}
+
+func (s *memoryLeaseStore) expire() {
+	if s.holder != "" && !s.now.Before(s.expires) {
+		s.holder = ""
+	}
+}
+
+func (s *memoryLeaseStore) Acquire(ctx context.Context, holder string, ttl time.Duration) (int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return 0, false, s.err
+	}
+	s.expire()
+	if s.holder != "" {
+		return 0, false, nil
+	}
+	s.epoch++
+	s.holder, s.expires = holder, s.now.Add(ttl)
+	return s.epoch, true, nil
+}
+
+func (s *memoryLeaseStore) Renew(ctx context.Context, holder string, epoch int64, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return false, s.err
+	}
+	s.expire()
+	if s.holder != holder || s.epoch != epoch {
+		return false, nil
+	}
+	s.expires = s.now.Add(ttl)
+	return true, nil
+}
+
+func (s *memoryLeaseStore) Release(ctx context.Context, holder string, epoch int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.holder == holder && s.epoch == epoch {
+		s.holder = ""
+	}
+	return s.err
+}
+
+func (s *memoryLeaseStore) Holder(ctx context.Context) (string, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return "", 0, s.err
+	}
+	s.expire()
+	return s.holder, s.epoch, nil
+}
+
+type fakeVirtualIP struct {
+	owned bool
+}
+
+func (v *fakeVirtualIP) Add() error    { v.owned = true; return nil }
+func (v *fakeVirtualIP) Remove() error { v.owned = false; return nil }
+
+func newTestElector(nodeID string, priority int, store LeaseStore) (*HAElector, *fakeVirtualIP) {
+	vip := &fakeVirtualIP{}
+	cfg := &HAConfig{NodeID: nodeID, Priority: priority, LeaseTTL: 3000, RenewInterval: 1000}
+	return NewHAElector(cfg, store, vip), vip
+}
+
+func TestHAElector_PriorityWinsFreeLease(t *testing.T) {
+	start := time.Now()
+	store := &memoryLeaseStore{now: start}
+	high, highVIP := newTestElector("a", 250, store)
+	low, lowVIP := newTestElector("b", 10, store)
+
+	// Both see the lease free; only the high priority skew has elapsed
+	low.tick(start)
+	high.tick(start)
+	now := start.Add(high.skew)
+	low.tick(now)
+	high.tick(now)
+
+	if !high.IsActive() || !highVIP.owned {
+		t.Fatal("expected the high priority node to become active")
+	}
+	if low.IsActive() || lowVIP.owned {
+		t.Fatal("expected the low priority node to stay standby")
+	}
+
+	// Renewals keep the lease away from the standby
+	for i := 1; i <= 5; i++ {
+		now = now.Add(time.Second)
+		store.now = now
+		high.tick(now)
+		low.tick(now)
+	}
+	if !high.IsActive() || low.IsActive() {
+		t.Error("expected roles to hold while the active node renews")
+	}
+	if low.CheckHealth().Details["leader"] != "a" {
+		t.Errorf("standby reports leader %q, expected a", low.CheckHealth().Details["leader"])
+	}
+}
+
+func TestHAElector_FailoverAfterLeaseExpiry(t *testing.T) {
+	start := time.Now()
+	store := &memoryLeaseStore{now: start}
+	a, _ := newTestElector("a", 100, store)
+	b, bVIP := newTestElector("b", 100, store)
+
+	a.tick(start)
+	a.tick(start.Add(a.skew))
+	if !a.IsActive() {
+		t.Fatal("expected a to become active")
+	}
+
+	// a dies; b takes over once the lease expires and its skew passes
+	now := start.Add(a.skew)
+	for i := 0; i < 10 && !b.IsActive(); i++ {
+		now = now.Add(time.Second)
+		store.now = now
+		b.tick(now)
+	}
+	if !b.IsActive() || !bVIP.owned {
+		t.Fatal("expected b to take over after the lease expired")
+	}
+	if now.Before(start.Add(a.skew + 3*time.Second)) {
+		t.Errorf("b took over at %v, before the lease expired", now.Sub(start))
+	}
+	if b.epoch != 2 {
+		t.Errorf("epoch = %d, expected 2", b.epoch)
+	}
+
+	// a comes back and finds its epoch superseded
+	a.tick(now)
+	if a.IsActive() {
+		t.Error("expected a to step down after losing the lease")
+	}
+}
+
+func TestHAElector_StepsDownBeforeLeaseExpires(t *testing.T) {
+	start := time.Now()
+	store := &memoryLeaseStore{now: start}
+	a, aVIP := newTestElector("a", 255, store)
+	a.tick(start)
+	a.tick(start.Add(a.skew))
+	if !a.IsActive() {
+		t.Fatal("expected a to become active")
+	}
+
+	// The store becomes unreachable; a must drop the IP while its lease is
+	// still valid, so the peer never sees two owners
+	store.err = errors.New("connection refused")
+	now := start
+	for a.IsActive() {
+		now = now.Add(time.Second)
+		store.now = now
+		a.tick(now)
+	}
+	if aVIP.owned {
+		t.Error("expected the virtual IP to be dropped")
+	}
+	if !now.Before(start.Add(3 * time.Second)) {
+		t.Errorf("stepped down at %v, not before the lease expired", now.Sub(start))
+	}
+}
+
+func TestHAElector_StopReleasesLease(t *testing.T) {
+	store := &memoryLeaseStore{now: time.Now()}
+	a, aVIP := newTestElector("a", 255, store)
+	a.Start()
+	deadline := time.Now().Add(3 * time.Second)
+	for !a.IsActive() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !a.IsActive() {
+		t.Fatal("expected a to become active")
+	}
+
+	a.Stop()
+	if a.IsActive() || aVIP.owned {
+		t.Error("expected a to be standby without the virtual IP after Stop")
+	}
+	if holder, _, _ := store.Holder(context.Background()); holder != "" {
+		t.Errorf("lease still held by %q after Stop", holder)
+	}
+}
+
+func TestValidateHAConfig(t *testing.T) {
+	cfg := &Config{HA: &HAConfig{Enabled: true}}
+	if err := ValidateHAConfig(cfg); err == nil {
+		t.Error("expected an error without a Redis address")
+	}
+
+	cfg.Database.RedisAddr = "127.0.0.1:6379"
+	if err := ValidateHAConfig(cfg); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	cfg.HA.VirtualIP = "192.0.2.100"
+	if err := ValidateHAConfig(cfg); err == nil {
+		t.Error("expected an error for a virtual IP without an interface")
+	}
+
+	cfg.HA.Interface = "eth0"
+	cfg.HA.RenewInterval = 2000
+	if err := ValidateHAConfig(cfg); err == nil {
+		t.Error("expected an error for a renew interval over a third of the TTL")
+	}
+}
@@ -4,8 +4,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -228,41 +230,71 @@ func CheckRTPService() ComponentHealth {
 
 // CheckSIPRegistration checks the health of SIP registration
 func CheckSIPRegistration() ComponentHealth {
-	registrationStatusLock.RLock()
-	defer registrationStatusLock.RUnlock()
-
-	// Get config to check which proxies should be registered
-	configMutex.RLock()
-	if config == nil {
-		configMutex.RUnlock()
+	// Get config to check which proxies should be probed
+	proxies, ok := configuredSIPProxies()
+	if !ok {
 		return CreateComponentHealth(StatusDown, "Config not loaded")
 	}
-	opensipsAddr := fmt.Sprintf("%s:%d", config.Integration.OpenSIPSIp, config.Integration.OpenSIPSPort)
-	kamailioAddr := fmt.Sprintf("%s:%d", config.Integration.KamailioIp, config.Integration.KamailioPort)
-	configMutex.RUnlock()
 
-	// Check if we're registered with the SIP proxies
-	opensipsRegistered := registrationStatus[opensipsAddr]
-	kamailioRegistered := registrationStatus[kamailioAddr]
+	health := CreateComponentHealth(StatusUp, "SIP proxies reachable")
+	if len(proxies) == 0 {
+		health.Message = "No SIP proxies configured"
+		return health
+	}
 
-	health := CreateComponentHealth(StatusUp, "SIP registrations active")
-	health.Details["opensips"] = fmt.Sprintf("%v", opensipsRegistered)
-	health.Details["kamailio"] = fmt.Sprintf("%v", kamailioRegistered)
+	// Report availability and OPTIONS latency per proxy
+	available := 0
+	for name, addr := range proxies {
+		status, ok := GetSIPProxyStatus(addr)
+		health.Details[name] = fmt.Sprintf("%v", ok && status.Available)
+		if !ok {
+			continue
+		}
+		health.Details[name+"_latency_ms"] = fmt.Sprintf("%.1f", status.LatencyMs)
+		if status.StatusCode != 0 {
+			health.Details[name+"_status_code"] = strconv.Itoa(status.StatusCode)
+		}
+		if status.LastError != "" {
+			health.Details[name+"_error"] = status.LastError
+		}
+		if status.Available {
+			available++
+		}
+	}
 
-	if !opensipsRegistered && !kamailioRegistered {
+	if available == 0 {
 		health.Status = StatusDown
-		health.Message = "Not registered with any SIP proxy"
+		health.Message = "No SIP proxy answers OPTIONS"
 		return health
 	}
 
-	if !opensipsRegistered || !kamailioRegistered {
+	if available < len(proxies) {
 		health.Status = StatusDegraded
-		health.Message = "Partially registered with SIP proxies"
+		health.Message = "Some SIP proxies do not answer OPTIONS"
 	}
 
 	return health
 }
 
+// configuredSIPProxies returns the host:port of each SIP proxy in the
+// config, keyed by proxy name; ok is false before the config is loaded
+func configuredSIPProxies() (proxies map[string]string, ok bool) {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	if config == nil {
+		return nil, false
+	}
+
+	proxies = map[string]string{}
+	if config.Integration.OpenSIPSIp != "" {
+		proxies["opensips"] = net.JoinHostPort(config.Integration.OpenSIPSIp, strconv.Itoa(config.Integration.OpenSIPSPort))
+	}
+	if config.Integration.KamailioIp != "" {
+		proxies["kamailio"] = net.JoinHostPort(config.Integration.KamailioIp, strconv.Itoa(config.Integration.KamailioPort))
+	}
+	return proxies, true
+}
+
 // RegisterDefaultHealthChecks registers the default health checks
 func RegisterDefaultHealthChecks() {
 	RegisterHealthCheck("rtp", CheckRTPService)
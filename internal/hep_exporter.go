@@ -0,0 +1,442 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// HEP exporter metrics
+var (
+	hepPacketsSent = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "karl_hep_packets_sent_total",
+			Help: "Total HEP packets sent to the capture server by payload (rtcp, rtp_stats)",
+		},
+		[]string{"payload"},
+	)
+
+	hepSendErrors = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "karl_hep_send_errors_total",
+			Help: "Total HEP packets that could not be sent to the capture server",
+		},
+	)
+)
+
+// HEP3 protocol types carried in chunk 0x000b
+const (
+	HEPProtoRTCP     uint8 = 5  // RTCP report as JSON
+	HEPProtoRTPStats uint8 = 34 // RTP quality summary as JSON
+)
+
+// HEP3 generic chunk types (vendor 0x0000)
+const (
+	hepChunkIPFamily      uint16 = 0x0001
+	hepChunkIPProtocol    uint16 = 0x0002
+	hepChunkIPv4Src       uint16 = 0x0003
+	hepChunkIPv4Dst       uint16 = 0x0004
+	hepChunkIPv6Src       uint16 = 0x0005
+	hepChunkIPv6Dst       uint16 = 0x0006
+	hepChunkSrcPort       uint16 = 0x0007
+	hepChunkDstPort       uint16 = 0x0008
+	hepChunkTimestampSec  uint16 = 0x0009
+	hepChunkTimestampUsec uint16 = 0x000a
+	hepChunkProtoType     uint16 = 0x000b
+	hepChunkCaptureID     uint16 = 0x000c
+	hepChunkAuthKey       uint16 = 0x000e
+	hepChunkPayload       uint16 = 0x000f
+	hepChunkCorrelationID uint16 = 0x0011
+
+	hepHeaderSize      = 6
+	hepChunkHeaderSize = 6
+)
+
+// HEPMessage is a captured event to encapsulate in HEP3
+type HEPMessage struct {
+	SrcIP         net.IP
+	DstIP         net.IP
+	SrcPort       uint16
+	DstPort       uint16
+	Timestamp     time.Time
+	ProtoType     uint8
+	CaptureID     uint32
+	Password      string
+	CorrelationID string // SIP Call-ID used by Homer to group events
+	Payload       []byte
+}
+
+// EncodeHEP3 serializes a message as a HEP3/EEP packet
+func EncodeHEP3(msg *HEPMessage) ([]byte, error) {
+	var body bytes.Buffer
+
+	srcIP, dstIP := msg.SrcIP, msg.DstIP
+	if srcIP == nil {
+		srcIP = net.IPv4zero
+	}
+	if dstIP == nil {
+		dstIP = net.IPv4zero
+	}
+
+	// Both addresses must share a family; fall back to IPv6 if either needs it
+	src4, dst4 := srcIP.To4(), dstIP.To4()
+	if src4 != nil && dst4 != nil {
+		writeHEPChunk(&body, hepChunkIPFamily, []byte{2}) // AF_INET
+		writeHEPChunk(&body, hepChunkIPv4Src, src4)
+		writeHEPChunk(&body, hepChunkIPv4Dst, dst4)
+	} else {
+		writeHEPChunk(&body, hepChunkIPFamily, []byte{10}) // AF_INET6
+		writeHEPChunk(&body, hepChunkIPv6Src, srcIP.To16())
+		writeHEPChunk(&body, hepChunkIPv6Dst, dstIP.To16())
+	}
+	writeHEPChunk(&body, hepChunkIPProtocol, []byte{17}) // UDP
+
+	writeHEPChunk(&body, hepChunkSrcPort, binary.BigEndian.AppendUint16(nil, msg.SrcPort))
+	writeHEPChunk(&body, hepChunkDstPort, binary.BigEndian.AppendUint16(nil, msg.DstPort))
+
+	ts := msg.Timestamp
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	writeHEPChunk(&body, hepChunkTimestampSec, binary.BigEndian.AppendUint32(nil, uint32(ts.Unix())))
+	writeHEPChunk(&body, hepChunkTimestampUsec, binary.BigEndian.AppendUint32(nil, uint32(ts.Nanosecond()/1000)))
+	writeHEPChunk(&body, hepChunkProtoType, []byte{msg.ProtoType})
+	writeHEPChunk(&body, hepChunkCaptureID, binary.BigEndian.AppendUint32(nil, msg.CaptureID))
+
+	if msg.Password != "" {
+		writeHEPChunk(&body, hepChunkAuthKey, []byte(msg.Password))
+	}
+	if msg.CorrelationID != "" {
+		writeHEPChunk(&body, hepChunkCorrelationID, []byte(msg.CorrelationID))
+	}
+	writeHEPChunk(&body, hepChunkPayload, msg.Payload)
+
+	total := hepHeaderSize + body.Len()
+	if total > 0xFFFF {
+		return nil, fmt.Errorf("HEP packet too large: %d bytes", total)
+	}
+
+	packet := make([]byte, hepHeaderSize, total)
+	copy(packet, "HEP3")
+	binary.BigEndian.PutUint16(packet[4:6], uint16(total))
+	return append(packet, body.Bytes()...), nil
+}
+
+// writeHEPChunk appends a generic-vendor chunk
+func writeHEPChunk(buf *bytes.Buffer, chunkType uint16, value []byte) {
+	var header [hepChunkHeaderSize]byte
+	binary.BigEndian.PutUint16(header[0:2], 0x0000)
+	binary.BigEndian.PutUint16(header[2:4], chunkType)
+	binary.BigEndian.PutUint16(header[4:6], uint16(hepChunkHeaderSize+len(value)))
+	buf.Write(header[:])
+	buf.Write(value)
+}
+
+// hepRTCPReport is the JSON layout Homer expects for RTCP (proto type 5)
+type hepRTCPReport struct {
+	Type         uint8                `json:"type"`
+	SSRC         uint32               `json:"ssrc"`
+	SenderInfo   *hepRTCPSenderInfo   `json:"sender_information,omitempty"`
+	ReportCount  int                  `json:"report_count"`
+	ReportBlocks []hepRTCPReportBlock `json:"report_blocks"`
+}
+
+type hepRTCPSenderInfo struct {
+	NTPTimestampSec  uint32 `json:"ntp_timestamp_sec"`
+	NTPTimestampUsec uint32 `json:"ntp_timestamp_usec"`
+	RTPTimestamp     uint32 `json:"rtp_timestamp"`
+	Packets          uint32 `json:"packets"`
+	Octets           uint32 `json:"octets"`
+}
+
+type hepRTCPReportBlock struct {
+	SourceSSRC   uint32 `json:"source_ssrc"`
+	HighestSeqNo uint32 `json:"highest_seq_no"`
+	FractionLost uint8  `json:"fraction_lost"`
+	PacketsLost  uint32 `json:"packets_lost"`
+	IAJitter     uint32 `json:"ia_jitter"`
+	LSR          uint32 `json:"lsr"`
+	DLSR         uint32 `json:"dlsr"`
+}
+
+// rtcpToHEPJSON converts the SR/RR packets of a compound RTCP packet to
+// Homer's JSON representation and returns the SSRCs it refers to
+func rtcpToHEPJSON(data []byte) ([][]byte, []uint32, error) {
+	packets, err := rtcp.Unmarshal(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var reports [][]byte
+	var ssrcs []uint32
+	for _, packet := range packets {
+		var report hepRTCPReport
+		var blocks []rtcp.ReceptionReport
+		switch p := packet.(type) {
+		case *rtcp.SenderReport:
+			report.Type = uint8(rtcp.TypeSenderReport)
+			report.SSRC = p.SSRC
+			report.SenderInfo = &hepRTCPSenderInfo{
+				NTPTimestampSec:  uint32(p.NTPTime >> 32),
+				NTPTimestampUsec: uint32((p.NTPTime & 0xFFFFFFFF) * 1000000 >> 32),
+				RTPTimestamp:     p.RTPTime,
+				Packets:          p.PacketCount,
+				Octets:           p.OctetCount,
+			}
+			blocks = p.Reports
+		case *rtcp.ReceiverReport:
+			report.Type = uint8(rtcp.TypeReceiverReport)
+			report.SSRC = p.SSRC
+			blocks = p.Reports
+		default:
+			continue
+		}
+
+		report.ReportCount = len(blocks)
+		report.ReportBlocks = make([]hepRTCPReportBlock, 0, len(blocks))
+		ssrcs = append(ssrcs, report.SSRC)
+		for _, b := range blocks {
+			report.ReportBlocks = append(report.ReportBlocks, hepRTCPReportBlock{
+				SourceSSRC:   b.SSRC,
+				HighestSeqNo: b.LastSequenceNumber,
+				FractionLost: b.FractionLost,
+				PacketsLost:  b.TotalLost,
+				IAJitter:     b.Jitter,
+				LSR:          b.LastSenderReport,
+				DLSR:         b.Delay,
+			})
+			ssrcs = append(ssrcs, b.SSRC)
+		}
+
+		encoded, err := json.Marshal(report)
+		if err != nil {
+			return nil, nil, err
+		}
+		reports = append(reports, encoded)
+	}
+	return reports, ssrcs, nil
+}
+
+// hepRTPStats is the periodic RTP quality summary (proto type 34)
+type hepRTPStats struct {
+	Type            string  `json:"TYPE"`
+	CorrelationID   string  `json:"CORRELATION_ID"`
+	SSRC            uint32  `json:"SSRC"`
+	PacketsReceived uint32  `json:"TOTAL_PK"`
+	PacketsLost     int32   `json:"PACKET_LOSS"`
+	LossPercent     float64 `json:"LOSS_PERCENT"`
+	JitterMs        float64 `json:"JITTER"`
+	Interval        int     `json:"DELTA"`
+}
+
+// HEPExporter ships RTCP reports and RTP quality summaries to a HEP capture server
+type HEPExporter struct {
+	config       HEPConfig
+	conn         net.Conn
+	stats        *ReceiveStatsTracker
+	callResolver func(ssrc uint32) (callID string, ok bool)
+
+	stopChan chan struct{}
+	stopOnce sync.Once
+	mu       sync.Mutex
+}
+
+// NewHEPExporter connects to the capture server configured in config
+func NewHEPExporter(config *HEPConfig, stats *ReceiveStatsTracker) (*HEPExporter, error) {
+	if config == nil || config.Address == "" {
+		return nil, fmt.Errorf("HEP capture server address not configured")
+	}
+
+	transport := strings.ToLower(config.Transport)
+	if transport == "" {
+		transport = "udp"
+	}
+	if transport != "udp" && transport != "tcp" {
+		return nil, fmt.Errorf("unsupported HEP transport: %s", config.Transport)
+	}
+
+	conn, err := net.DialTimeout(transport, config.Address, 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to HEP capture server %s: %w", config.Address, err)
+	}
+
+	cfg := *config
+	cfg.Transport = transport
+	return &HEPExporter{
+		config:   cfg,
+		conn:     conn,
+		stats:    stats,
+		stopChan: make(chan struct{}),
+	}, nil
+}
+
+// SetCallIDResolver sets the SSRC to Call-ID lookup used for correlation
+func (h *HEPExporter) SetCallIDResolver(resolver func(ssrc uint32) (callID string, ok bool)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.callResolver = resolver
+}
+
+// Start begins sending periodic RTP quality summaries
+func (h *HEPExporter) Start() {
+	if h.config.ReportInterval <= 0 || h.stats == nil {
+		return
+	}
+	go h.reportLoop()
+}
+
+// Stop halts reporting and closes the connection to the capture server
+func (h *HEPExporter) Stop() {
+	h.stopOnce.Do(func() {
+		close(h.stopChan)
+		h.mu.Lock()
+		_ = h.conn.Close()
+		h.mu.Unlock()
+	})
+}
+
+func (h *HEPExporter) reportLoop() {
+	ticker := time.NewTicker(time.Duration(h.config.ReportInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			h.SendQualityReports(time.Now())
+		case <-h.stopChan:
+			return
+		}
+	}
+}
+
+// CaptureRTCP exports the SR/RR packets of an RTCP packet received from src on dst
+func (h *HEPExporter) CaptureRTCP(data []byte, src, dst *net.UDPAddr) {
+	reports, ssrcs, err := rtcpToHEPJSON(data)
+	if err != nil || len(reports) == 0 {
+		return
+	}
+
+	callID := h.resolveCallID(ssrcs...)
+	now := time.Now()
+	for _, report := range reports {
+		msg := h.newMessage(HEPProtoRTCP, callID, report, now)
+		setHEPAddrs(msg, src, dst)
+		h.send(msg, "rtcp")
+	}
+}
+
+// SendQualityReports exports a receive-quality summary for every RTP source
+// that belongs to a call
+func (h *HEPExporter) SendQualityReports(now time.Time) int {
+	sent := 0
+	for _, snap := range h.stats.Snapshots() {
+		callID := h.resolveCallID(snap.SSRC)
+		if callID == "" {
+			continue
+		}
+
+		summary := hepRTPStats{
+			Type:            "PERIODIC",
+			CorrelationID:   callID,
+			SSRC:            snap.SSRC,
+			PacketsReceived: snap.PacketsReceived,
+			PacketsLost:     snap.PacketsLost,
+			JitterMs:        snap.Jitter * 1000,
+			Interval:        h.config.ReportInterval,
+		}
+		if expected := int64(snap.PacketsReceived) + int64(snap.PacketsLost); expected > 0 && snap.PacketsLost > 0 {
+			summary.LossPercent = float64(snap.PacketsLost) * 100 / float64(expected)
+		}
+
+		payload, err := json.Marshal(summary)
+		if err != nil {
+			continue
+		}
+		if h.send(h.newMessage(HEPProtoRTPStats, callID, payload, now), "rtp_stats") {
+			sent++
+		}
+	}
+	return sent
+}
+
+// resolveCallID returns the Call-ID of the first SSRC that belongs to a call
+func (h *HEPExporter) resolveCallID(ssrcs ...uint32) string {
+	h.mu.Lock()
+	resolver := h.callResolver
+	h.mu.Unlock()
+	if resolver == nil {
+		return ""
+	}
+	for _, ssrc := range ssrcs {
+		if callID, ok := resolver(ssrc); ok {
+			return callID
+		}
+	}
+	return ""
+}
+
+func (h *HEPExporter) newMessage(protoType uint8, callID string, payload []byte, now time.Time) *HEPMessage {
+	return &HEPMessage{
+		Timestamp:     now,
+		ProtoType:     protoType,
+		CaptureID:     h.config.CaptureID,
+		Password:      h.config.Password,
+		CorrelationID: callID,
+		Payload:       payload,
+	}
+}
+
+// setHEPAddrs fills the message's address chunks from UDP endpoints
+func setHEPAddrs(msg *HEPMessage, src, dst *net.UDPAddr) {
+	if src != nil {
+		msg.SrcIP = src.IP
+		msg.SrcPort = uint16(src.Port)
+	}
+	if dst != nil {
+		msg.DstIP = dst.IP
+		msg.DstPort = uint16(dst.Port)
+	}
+}
+
+// send encodes and writes one HEP packet
+func (h *HEPExporter) send(msg *HEPMessage, payload string) bool {
+	packet, err := EncodeHEP3(msg)
+	if err != nil {
+		hepSendErrors.Inc()
+		return false
+	}
+
+	h.mu.Lock()
+	_ = h.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_, err = h.conn.Write(packet)
+	if err != nil && h.config.Transport == "tcp" {
+		// Reconnect once if the capture server dropped the stream
+		if conn, dialErr := net.DialTimeout("tcp", h.config.Address, time.Second); dialErr == nil {
+			_ = h.conn.Close()
+			h.conn = conn
+			_ = h.conn.SetWriteDeadline(time.Now().Add(time.Second))
+			_, err = h.conn.Write(packet)
+		}
+	}
+	h.mu.Unlock()
+
+	if err != nil {
+		hepSendErrors.Inc()
+		if IsDebugLoggingEnabled() {
+			log.Printf("Failed to send HEP packet to %s: %v", h.config.Address, err)
+		}
+		return false
+	}
+	hepPacketsSent.WithLabelValues(payload).Inc()
+	return true
+}
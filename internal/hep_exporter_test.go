@@ -0,0 +1,321 @@
+package internal
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+// parseHEP3 splits a HEP3 packet into its generic chunks
+func parseHEP3(t *testing.T, packet []byte) map[uint16][]byte {
+	t.Helper()
+	if len(packet) < hepHeaderSize || string(packet[:4]) != "HEP3" {
+		t.Fatalf("missing HEP3 header")
+	}
+	if int(binary.BigEndian.Uint16(packet[4:6])) != len(packet) {
+		t.Fatalf("header length %d does not match packet length %d", binary.BigEndian.Uint16(packet[4:6]), len(packet))
+	}
+
+	chunks := make(map[uint16][]byte)
+	for offset := hepHeaderSize; offset < len(packet); {
+		if offset+hepChunkHeaderSize > len(packet) {
+			t.Fatalf("truncated chunk header at offset %d", offset)
+		}
+		chunkType := binary.BigEndian.Uint16(packet[offset+2 : offset+4])
+		length := int(binary.BigEndian.Uint16(packet[offset+4 : offset+6]))
+		if length < hepChunkHeaderSize || offset+length > len(packet) {
+			t.Fatalf("invalid chunk length %d at offset %d", length, offset)
+		}
+		chunks[chunkType] = packet[offset+hepChunkHeaderSize : offset+length]
+		offset += length
+	}
+	return chunks
+}
+
+func TestEncodeHEP3IPv4(t *testing.T) {
+	ts := time.Unix(1700000000, 123456000)
+	packet, err := EncodeHEP3(&HEPMessage{
+		SrcIP:         net.ParseIP("10.0.0.1"),
+		DstIP:         net.ParseIP("10.0.0.2"),
+		SrcPort:       30000,
+		DstPort:       30001,
+		Timestamp:     ts,
+		ProtoType:     HEPProtoRTCP,
+		CaptureID:     2001,
+		Password:      "secret",
+		CorrelationID: "call-1@example.com",
+		Payload:       []byte(`{"type":200}`),
+	})
+	if err != nil {
+		t.Fatalf("EncodeHEP3 failed: %v", err)
+	}
+
+	chunks := parseHEP3(t, packet)
+	if chunks[hepChunkIPFamily][0] != 2 {
+		t.Errorf("expected AF_INET, got %d", chunks[hepChunkIPFamily][0])
+	}
+	if !net.IP(chunks[hepChunkIPv4Src]).Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("unexpected source IP %v", net.IP(chunks[hepChunkIPv4Src]))
+	}
+	if !net.IP(chunks[hepChunkIPv4Dst]).Equal(net.ParseIP("10.0.0.2")) {
+		t.Errorf("unexpected destination IP %v", net.IP(chunks[hepChunkIPv4Dst]))
+	}
+	if port := binary.BigEndian.Uint16(chunks[hepChunkSrcPort]); port != 30000 {
+		t.Errorf("expected source port 30000, got %d", port)
+	}
+	if port := binary.BigEndian.Uint16(chunks[hepChunkDstPort]); port != 30001 {
+		t.Errorf("expected destination port 30001, got %d", port)
+	}
+	if sec := binary.BigEndian.Uint32(chunks[hepChunkTimestampSec]); sec != 1700000000 {
+		t.Errorf("unexpected timestamp seconds %d", sec)
+	}
+	if usec := binary.BigEndian.Uint32(chunks[hepChunkTimestampUsec]); usec != 123456 {
+		t.Errorf("unexpected timestamp microseconds %d", usec)
+	}
+	if chunks[hepChunkProtoType][0] != HEPProtoRTCP {
+		t.Errorf("unexpected proto type %d", chunks[hepChunkProtoType][0])
+	}
+	if id := binary.BigEndian.Uint32(chunks[hepChunkCaptureID]); id != 2001 {
+		t.Errorf("expected capture ID 2001, got %d", id)
+	}
+	if string(chunks[hepChunkAuthKey]) != "secret" {
+		t.Errorf("unexpected auth key %q", chunks[hepChunkAuthKey])
+	}
+	if string(chunks[hepChunkCorrelationID]) != "call-1@example.com" {
+		t.Errorf("unexpected correlation ID %q", chunks[hepChunkCorrelationID])
+	}
+	if string(chunks[hepChunkPayload]) != `{"type":200}` {
+		t.Errorf("unexpected payload %q", chunks[hepChunkPayload])
+	}
+}
+
+func TestEncodeHEP3IPv6(t *testing.T) {
+	packet, err := EncodeHEP3(&HEPMessage{
+		SrcIP:     net.ParseIP("2001:db8::1"),
+		DstIP:     net.ParseIP("10.0.0.2"),
+		ProtoType: HEPProtoRTPStats,
+		Payload:   []byte("{}"),
+	})
+	if err != nil {
+		t.Fatalf("EncodeHEP3 failed: %v", err)
+	}
+
+	chunks := parseHEP3(t, packet)
+	if chunks[hepChunkIPFamily][0] != 10 {
+		t.Errorf("expected AF_INET6, got %d", chunks[hepChunkIPFamily][0])
+	}
+	if len(chunks[hepChunkIPv6Src]) != 16 || len(chunks[hepChunkIPv6Dst]) != 16 {
+		t.Error("expected 16-byte IPv6 address chunks")
+	}
+	if _, ok := chunks[hepChunkAuthKey]; ok {
+		t.Error("auth key chunk should be omitted without a password")
+	}
+	if _, ok := chunks[hepChunkCorrelationID]; ok {
+		t.Error("correlation chunk should be omitted without a Call-ID")
+	}
+}
+
+func TestRTCPToHEPJSON(t *testing.T) {
+	compound := []rtcp.Packet{
+		&rtcp.SenderReport{
+			SSRC:        0x1111,
+			NTPTime:     uint64(1000)<<32 | 1<<31,
+			RTPTime:     8000,
+			PacketCount: 50,
+			OctetCount:  8000,
+			Reports: []rtcp.ReceptionReport{
+				{SSRC: 0x2222, FractionLost: 12, TotalLost: 3, LastSequenceNumber: 500, Jitter: 40},
+			},
+		},
+		&rtcp.SourceDescription{},
+		&rtcp.ReceiverReport{SSRC: 0x2222},
+	}
+	data, err := rtcp.Marshal(compound)
+	if err != nil {
+		t.Fatalf("rtcp.Marshal failed: %v", err)
+	}
+
+	reports, ssrcs, err := rtcpToHEPJSON(data)
+	if err != nil {
+		t.Fatalf("rtcpToHEPJSON failed: %v", err)
+	}
+	if len(reports) != 2 {
+		t.Fatalf("expected SR and RR only, got %d reports", len(reports))
+	}
+	if len(ssrcs) != 3 || ssrcs[0] != 0x1111 || ssrcs[1] != 0x2222 {
+		t.Errorf("unexpected SSRCs %v", ssrcs)
+	}
+
+	var sr hepRTCPReport
+	if err := json.Unmarshal(reports[0], &sr); err != nil {
+		t.Fatalf("invalid SR JSON: %v", err)
+	}
+	if sr.Type != uint8(rtcp.TypeSenderReport) || sr.SenderInfo == nil {
+		t.Fatalf("expected sender report with sender information, got %+v", sr)
+	}
+	if sr.SenderInfo.NTPTimestampSec != 1000 || sr.SenderInfo.NTPTimestampUsec != 500000 {
+		t.Errorf("unexpected NTP timestamp %d.%06d", sr.SenderInfo.NTPTimestampSec, sr.SenderInfo.NTPTimestampUsec)
+	}
+	if sr.ReportCount != 1 || sr.ReportBlocks[0].FractionLost != 12 || sr.ReportBlocks[0].PacketsLost != 3 {
+		t.Errorf("unexpected report blocks %+v", sr.ReportBlocks)
+	}
+
+	var rr hepRTCPReport
+	if err := json.Unmarshal(reports[1], &rr); err != nil {
+		t.Fatalf("invalid RR JSON: %v", err)
+	}
+	if rr.Type != uint8(rtcp.TypeReceiverReport) || rr.SenderInfo != nil || rr.ReportBlocks == nil {
+		t.Errorf("unexpected receiver report %s", reports[1])
+	}
+
+	if _, _, err := rtcpToHEPJSON([]byte{0x00}); err == nil {
+		t.Error("expected error for malformed RTCP")
+	}
+}
+
+func newTestHEPListener(t *testing.T) *net.UDPConn {
+	t.Helper()
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	return listener
+}
+
+func readHEPPacket(t *testing.T, conn *net.UDPConn) map[uint16][]byte {
+	t.Helper()
+	buf := make([]byte, 65535)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("no HEP packet received: %v", err)
+	}
+	return parseHEP3(t, buf[:n])
+}
+
+func TestHEPExporterCaptureRTCP(t *testing.T) {
+	listener := newTestHEPListener(t)
+
+	exporter, err := NewHEPExporter(&HEPConfig{
+		Address:   listener.LocalAddr().String(),
+		CaptureID: 42,
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewHEPExporter failed: %v", err)
+	}
+	defer exporter.Stop()
+	exporter.SetCallIDResolver(func(ssrc uint32) (string, bool) {
+		return "call-rtcp", ssrc == 0x2222
+	})
+
+	data, err := rtcp.Marshal([]rtcp.Packet{&rtcp.ReceiverReport{
+		SSRC:    0x1111,
+		Reports: []rtcp.ReceptionReport{{SSRC: 0x2222}},
+	}})
+	if err != nil {
+		t.Fatalf("rtcp.Marshal failed: %v", err)
+	}
+
+	src := &net.UDPAddr{IP: net.ParseIP("192.0.2.10"), Port: 4001}
+	dst := &net.UDPAddr{IP: net.ParseIP("192.0.2.20"), Port: 30001}
+	exporter.CaptureRTCP(data, src, dst)
+
+	chunks := readHEPPacket(t, listener)
+	if chunks[hepChunkProtoType][0] != HEPProtoRTCP {
+		t.Errorf("expected RTCP proto type, got %d", chunks[hepChunkProtoType][0])
+	}
+	if string(chunks[hepChunkCorrelationID]) != "call-rtcp" {
+		t.Errorf("expected Call-ID correlation from report block SSRC, got %q", chunks[hepChunkCorrelationID])
+	}
+	if binary.BigEndian.Uint16(chunks[hepChunkSrcPort]) != 4001 || binary.BigEndian.Uint16(chunks[hepChunkDstPort]) != 30001 {
+		t.Error("unexpected ports in HEP packet")
+	}
+	if binary.BigEndian.Uint32(chunks[hepChunkCaptureID]) != 42 {
+		t.Error("unexpected capture ID in HEP packet")
+	}
+}
+
+func TestHEPExporterSendQualityReports(t *testing.T) {
+	listener := newTestHEPListener(t)
+
+	stats := NewReceiveStatsTracker()
+	now := time.Now()
+	for seq := uint16(0); seq < 10; seq++ {
+		if seq == 4 {
+			continue // one lost packet
+		}
+		stats.Update(0xAAAA, seq, uint32(seq)*160, 8000, now.Add(time.Duration(seq)*20*time.Millisecond))
+	}
+	stats.Update(0xBBBB, 1, 160, 8000, now)
+
+	exporter, err := NewHEPExporter(&HEPConfig{
+		Address:        listener.LocalAddr().String(),
+		ReportInterval: 30,
+	}, stats)
+	if err != nil {
+		t.Fatalf("NewHEPExporter failed: %v", err)
+	}
+	defer exporter.Stop()
+
+	registry := NewSessionRegistry(time.Hour)
+	session := registry.CreateSession("call-stats", "from-stats")
+	if err := registry.SetCallerLeg(session.ID, &CallLeg{Tag: "from-stats", SSRC: 0xAAAA}); err != nil {
+		t.Fatalf("SetCallerLeg failed: %v", err)
+	}
+	exporter.SetCallIDResolver(registry.CallIDForSSRC)
+
+	// Only the SSRC that belongs to a call is reported
+	if sent := exporter.SendQualityReports(now); sent != 1 {
+		t.Fatalf("expected 1 quality report, got %d", sent)
+	}
+
+	chunks := readHEPPacket(t, listener)
+	if chunks[hepChunkProtoType][0] != HEPProtoRTPStats {
+		t.Errorf("expected RTP stats proto type, got %d", chunks[hepChunkProtoType][0])
+	}
+
+	var summary hepRTPStats
+	if err := json.Unmarshal(chunks[hepChunkPayload], &summary); err != nil {
+		t.Fatalf("invalid quality summary JSON: %v", err)
+	}
+	if summary.CorrelationID != "call-stats" || summary.SSRC != 0xAAAA {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+	source, _ := stats.Get(0xAAAA)
+	snap := source.Snapshot()
+	if summary.PacketsReceived != snap.PacketsReceived || summary.PacketsLost != 1 {
+		t.Errorf("expected %d received and 1 lost, got %d/%d", snap.PacketsReceived, summary.PacketsReceived, summary.PacketsLost)
+	}
+	if want := 100 / float64(snap.PacketsReceived+1); summary.LossPercent != want {
+		t.Errorf("expected %.2f%% loss, got %.2f", want, summary.LossPercent)
+	}
+}
+
+func TestCallIDForSSRC(t *testing.T) {
+	registry := NewSessionRegistry(time.Hour)
+	session := registry.CreateSession("call-ssrc", "from-ssrc")
+	if err := registry.SetCalleeLeg(session.ID, &CallLeg{Tag: "to-ssrc", SSRC: 0x1234}); err != nil {
+		t.Fatalf("SetCalleeLeg failed: %v", err)
+	}
+
+	if callID, ok := registry.CallIDForSSRC(0x1234); !ok || callID != "call-ssrc" {
+		t.Errorf("expected call-ssrc, got %q (%v)", callID, ok)
+	}
+	if _, ok := registry.CallIDForSSRC(0x9999); ok {
+		t.Error("unknown SSRC should not resolve")
+	}
+}
+
+func TestNewHEPExporterRejectsBadConfig(t *testing.T) {
+	if _, err := NewHEPExporter(nil, nil); err == nil {
+		t.Error("expected error without config")
+	}
+	if _, err := NewHEPExporter(&HEPConfig{Address: "127.0.0.1:9060", Transport: "sctp"}, nil); err == nil {
+		t.Error("expected error for unsupported transport")
+	}
+}
@@ -0,0 +1,378 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/srtp/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/sys/cpu"
+)
+
+// Hardware acceleration moves SRTP crypto and codec work off the relay's
+// CPU cores: to a crypto engine, a DSP board for audio, or VAAPI or NVENC
+// for video. Accelerators register by name, like video backends, and
+// hardware_acceleration picks the ones in use at startup or on a reload.
+// An accelerator that cannot run on the host is passed over for software.
+
+// defaultAccelerator runs everything on the CPU, with AES-NI or the ARMv8
+// crypto extensions where Go's crypto/aes finds them
+const defaultAccelerator = "software"
+
+// ErrAccelUnsupported is returned by an accelerator for work it does not
+// take, which then runs in software
+var ErrAccelUnsupported = errors.New("not supported by the accelerator")
+
+var acceleratorOffloads = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "karl_accelerator_offloads_total",
+		Help: "Total SRTP contexts created and audio frames transcoded on accelerators, by accelerator and kind (srtp_context, audio_frame)",
+	},
+	[]string{"accelerator", "kind"},
+)
+
+// AccelCapabilities is what an accelerator can take on
+type AccelCapabilities struct {
+	SRTPProfiles  []string `json:"srtp_profiles,omitempty"` // SDES crypto suite names
+	AudioCodecs   []string `json:"audio_codecs,omitempty"`
+	VideoDecoders []string `json:"video_decoders,omitempty"`
+	VideoEncoders []string `json:"video_encoders,omitempty"`
+	Features      []string `json:"features,omitempty"` // e.g. aes-ni
+}
+
+// Accelerator is a device, or a library driving one, that Karl can hand
+// work to. It also implements SRTPAccelerator, AudioAccelerator or both
+type Accelerator interface {
+	Name() string
+	// Available reports why the accelerator cannot run on this host, nil
+	// if it can
+	Available() error
+	Capabilities() AccelCapabilities
+}
+
+// SRTPAccelerator protects and unprotects SRTP
+type SRTPAccelerator interface {
+	Accelerator
+	NewSRTPCipher(key, salt []byte, profile srtp.ProtectionProfile) (SRTPCipher, error)
+}
+
+// SRTPCipher is the SRTP context of one key, as *srtp.Context. It is not
+// safe for concurrent use
+type SRTPCipher interface {
+	EncryptRTP(dst, packet []byte, header *rtp.Header) ([]byte, error)
+	DecryptRTP(dst, packet []byte, header *rtp.Header) ([]byte, error)
+	EncryptRTCP(dst, packet []byte, header *rtcp.Header) ([]byte, error)
+	DecryptRTCP(dst, packet []byte, header *rtcp.Header) ([]byte, error)
+}
+
+// SRTPBatchCipher is an SRTPCipher that protects a batch of packets in one
+// call, as crypto engines that pipeline AES blocks across packets do
+type SRTPBatchCipher interface {
+	SRTPCipher
+	// EncryptRTPBatch encrypts packets in order, appending each to the
+	// matching dst buffer
+	EncryptRTPBatch(dst, packets [][]byte) ([][]byte, error)
+}
+
+// AudioAccelerator transcodes audio frames, such as on a DSP board
+type AudioAccelerator interface {
+	Accelerator
+	// TranscodeAudio converts one frame. It returns ErrAccelUnsupported for
+	// a pair of codecs it does not take
+	TranscodeAudio(payload []byte, from, to CodecInfo) ([]byte, error)
+}
+
+var (
+	accelerators   = make(map[string]Accelerator)
+	acceleratorsMu sync.RWMutex
+
+	// activeSRTP and activeAudio are the accelerators in use, with the
+	// reasons configured ones were passed over
+	activeSRTP  atomic.Pointer[srtpAcceleration]
+	activeAudio atomic.Pointer[audioAcceleration]
+)
+
+type srtpAcceleration struct {
+	accel    SRTPAccelerator
+	fallback string // why the configured accelerator is not in use
+}
+
+type audioAcceleration struct {
+	accel    AudioAccelerator // nil for software
+	fallback string
+}
+
+func init() {
+	RegisterAccelerator(softwareAccelerator{})
+}
+
+// RegisterAccelerator makes an accelerator available by its name to
+// hardware_acceleration. Accelerators register themselves from init
+// functions of files built with their build tag
+func RegisterAccelerator(accel Accelerator) {
+	acceleratorsMu.Lock()
+	defer acceleratorsMu.Unlock()
+	accelerators[accel.Name()] = accel
+}
+
+// Accelerators returns the names of the registered accelerators
+func Accelerators() []string {
+	acceleratorsMu.RLock()
+	defer acceleratorsMu.RUnlock()
+	names := make([]string, 0, len(accelerators))
+	for name := range accelerators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func accelerator(name string) (Accelerator, bool) {
+	acceleratorsMu.RLock()
+	defer acceleratorsMu.RUnlock()
+	accel, ok := accelerators[name]
+	return accel, ok
+}
+
+// ValidateHardwareAccelConfig checks that the accelerators are built in and
+// take the work they are picked for
+func ValidateHardwareAccelConfig(cfg *Config) error {
+	c := cfg.HardwareAccel
+	if c.Crypto != "" {
+		accel, ok := accelerator(c.Crypto)
+		if !ok {
+			return fmt.Errorf("hardware_acceleration.crypto %q is not available, expected one of %s", c.Crypto, strings.Join(Accelerators(), ", "))
+		}
+		if _, ok := accel.(SRTPAccelerator); !ok {
+			return fmt.Errorf("hardware_acceleration.crypto %q does not accelerate SRTP", c.Crypto)
+		}
+	}
+	if c.Audio != "" && c.Audio != defaultAccelerator {
+		accel, ok := accelerator(c.Audio)
+		if !ok {
+			return fmt.Errorf("hardware_acceleration.audio %q is not available, expected one of %s", c.Audio, strings.Join(Accelerators(), ", "))
+		}
+		if _, ok := accel.(AudioAccelerator); !ok {
+			return fmt.Errorf("hardware_acceleration.audio %q does not accelerate audio", c.Audio)
+		}
+	}
+	return nil
+}
+
+// ConfigureAcceleration picks the accelerators in use; nil runs everything
+// in software. SRTP contexts created before a change keep their cipher
+func ConfigureAcceleration(config *HardwareAccelConfig) {
+	if config == nil {
+		config = &HardwareAccelConfig{}
+	}
+
+	srtpAccel := &srtpAcceleration{accel: softwareAccelerator{}}
+	if name := config.Crypto; name != "" && name != defaultAccelerator {
+		if accel, err := usableAccelerator(name); err != nil {
+			srtpAccel.fallback = err.Error()
+		} else if s, ok := accel.(SRTPAccelerator); ok {
+			srtpAccel.accel = s
+		} else {
+			srtpAccel.fallback = fmt.Sprintf("%s does not accelerate SRTP", name)
+		}
+	}
+	activeSRTP.Store(srtpAccel)
+
+	audioAccel := &audioAcceleration{}
+	if name := config.Audio; name != "" && name != defaultAccelerator {
+		if accel, err := usableAccelerator(name); err != nil {
+			audioAccel.fallback = err.Error()
+		} else if a, ok := accel.(AudioAccelerator); ok {
+			audioAccel.accel = a
+		} else {
+			audioAccel.fallback = fmt.Sprintf("%s does not accelerate audio", name)
+		}
+	}
+	activeAudio.Store(audioAccel)
+
+	if srtpAccel.fallback != "" {
+		log.Printf("⚠️ SRTP runs in software: %s", srtpAccel.fallback)
+	}
+	if audioAccel.fallback != "" {
+		log.Printf("⚠️ Audio transcoding runs in software: %s", audioAccel.fallback)
+	}
+}
+
+// usableAccelerator returns a registered accelerator that can run here
+func usableAccelerator(name string) (Accelerator, error) {
+	accel, ok := accelerator(name)
+	if !ok {
+		return nil, fmt.Errorf("accelerator %q is not built in", name)
+	}
+	if err := accel.Available(); err != nil {
+		return nil, fmt.Errorf("accelerator %q is unavailable: %w", name, err)
+	}
+	return accel, nil
+}
+
+// NewSRTPCipher creates an SRTP context on the SRTP accelerator in use,
+// falling back to software for a profile it does not take
+func NewSRTPCipher(key, salt []byte, profile srtp.ProtectionProfile) (SRTPCipher, error) {
+	if active := activeSRTP.Load(); active != nil {
+		cipher, err := active.accel.NewSRTPCipher(key, salt, profile)
+		if !errors.Is(err, ErrAccelUnsupported) {
+			if err == nil && active.accel.Name() != defaultAccelerator {
+				acceleratorOffloads.WithLabelValues(active.accel.Name(), "srtp_context").Inc()
+			}
+			return cipher, err
+		}
+	}
+	return softwareAccelerator{}.NewSRTPCipher(key, salt, profile)
+}
+
+// accelerateAudio transcodes a frame on the audio accelerator in use. It
+// reports false when there is none or it does not take the codecs
+func accelerateAudio(payload []byte, from, to CodecInfo) ([]byte, bool, error) {
+	active := activeAudio.Load()
+	if active == nil || active.accel == nil {
+		return nil, false, nil
+	}
+	out, err := active.accel.TranscodeAudio(payload, from, to)
+	if errors.Is(err, ErrAccelUnsupported) {
+		return nil, false, nil
+	}
+	acceleratorOffloads.WithLabelValues(active.accel.Name(), "audio_frame").Inc()
+	return out, true, err
+}
+
+// CheckAccelerators reports the accelerators in use and what each one
+// registered can take. It is degraded while a configured accelerator is
+// passed over for software
+func CheckAccelerators() ComponentHealth {
+	health := CreateComponentHealth(StatusUp, "")
+
+	var fallbacks []string
+	health.Details["crypto"] = defaultAccelerator
+	if active := activeSRTP.Load(); active != nil {
+		health.Details["crypto"] = active.accel.Name()
+		if active.fallback != "" {
+			fallbacks = append(fallbacks, "crypto: "+active.fallback)
+		}
+	}
+	health.Details["audio"] = defaultAccelerator
+	if active := activeAudio.Load(); active != nil {
+		if active.accel != nil {
+			health.Details["audio"] = active.accel.Name()
+		}
+		if active.fallback != "" {
+			fallbacks = append(fallbacks, "audio: "+active.fallback)
+		}
+	}
+
+	for _, name := range Accelerators() {
+		accel, _ := accelerator(name)
+		if err := accel.Available(); err != nil {
+			health.Details["accelerator."+name] = "unavailable: " + err.Error()
+			continue
+		}
+		health.Details["accelerator."+name] = describeCapabilities(accel.Capabilities())
+	}
+	for _, name := range VideoBackends() {
+		backend, _ := videoBackend(name)
+		health.Details["video."+name] = describeCapabilities(AccelCapabilities{
+			VideoDecoders: backend.Decoders(),
+			VideoEncoders: backend.Encoders(),
+		})
+	}
+
+	if len(fallbacks) > 0 {
+		health.Status = StatusDegraded
+		health.Message = strings.Join(fallbacks, "; ")
+	}
+	return health
+}
+
+// describeCapabilities renders capabilities for the health API, e.g.
+// "srtp=AES_CM_128_HMAC_SHA1_80 features=aes-ni"
+func describeCapabilities(c AccelCapabilities) string {
+	var parts []string
+	for _, list := range []struct {
+		name  string
+		items []string
+	}{
+		{"srtp", c.SRTPProfiles},
+		{"audio", c.AudioCodecs},
+		{"video_decode", c.VideoDecoders},
+		{"video_encode", c.VideoEncoders},
+		{"features", c.Features},
+	} {
+		if len(list.items) > 0 {
+			parts = append(parts, list.name+"="+strings.Join(list.items, ","))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// softwareAccelerator is the CPU. Go's AES uses AES-NI on amd64 and the
+// crypto extensions on arm64 when the CPU has them
+type softwareAccelerator struct{}
+
+// softwareSRTPProfiles are the SDES names of the profiles pion/srtp
+// implements
+var softwareSRTPProfiles = map[string]srtp.ProtectionProfile{
+	"AES_CM_128_HMAC_SHA1_80": srtp.ProtectionProfileAes128CmHmacSha1_80,
+	"AES_CM_128_HMAC_SHA1_32": srtp.ProtectionProfileAes128CmHmacSha1_32,
+	"AES_256_CM_HMAC_SHA1_80": srtp.ProtectionProfileAes256CmHmacSha1_80,
+	"AES_256_CM_HMAC_SHA1_32": srtp.ProtectionProfileAes256CmHmacSha1_32,
+	"AEAD_AES_128_GCM":        srtp.ProtectionProfileAeadAes128Gcm,
+	"AEAD_AES_256_GCM":        srtp.ProtectionProfileAeadAes256Gcm,
+}
+
+func (softwareAccelerator) Name() string     { return defaultAccelerator }
+func (softwareAccelerator) Available() error { return nil }
+
+func (softwareAccelerator) Capabilities() AccelCapabilities {
+	c := AccelCapabilities{}
+	for name := range softwareSRTPProfiles {
+		c.SRTPProfiles = append(c.SRTPProfiles, name)
+	}
+	sort.Strings(c.SRTPProfiles)
+	if cpu.X86.HasAES || cpu.ARM64.HasAES {
+		c.Features = append(c.Features, "aes-ni")
+	}
+	if cpu.X86.HasPCLMULQDQ || cpu.ARM64.HasPMULL {
+		c.Features = append(c.Features, "clmul") // GHASH for AES-GCM
+	}
+	return c
+}
+
+func (softwareAccelerator) NewSRTPCipher(key, salt []byte, profile srtp.ProtectionProfile) (SRTPCipher, error) {
+	ctx, err := srtp.CreateContext(key, salt, profile)
+	if err != nil {
+		return nil, err
+	}
+	return &softwareSRTPCipher{Context: ctx}, nil
+}
+
+// softwareSRTPCipher is a pion SRTP context that encrypts batches one
+// packet after another
+type softwareSRTPCipher struct {
+	*srtp.Context
+}
+
+func (c *softwareSRTPCipher) EncryptRTPBatch(dst, packets [][]byte) ([][]byte, error) {
+	if len(dst) < len(packets) {
+		dst = append(dst, make([][]byte, len(packets)-len(dst))...)
+	}
+	for i, packet := range packets {
+		encrypted, err := c.EncryptRTP(dst[i][:0], packet, nil)
+		if err != nil {
+			return dst[:i], err
+		}
+		dst[i] = encrypted
+	}
+	return dst[:len(packets)], nil
+}
@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/srtp/v2"
+)
+
+// fakeAccelerator takes AES-128 SRTP and PCMU to G.729 audio
+type fakeAccelerator struct {
+	name        string
+	unavailable error
+	ciphers     int
+	frames      int
+}
+
+func (a *fakeAccelerator) Name() string     { return a.name }
+func (a *fakeAccelerator) Available() error { return a.unavailable }
+
+func (a *fakeAccelerator) Capabilities() AccelCapabilities {
+	return AccelCapabilities{SRTPProfiles: []string{"AES_CM_128_HMAC_SHA1_80"}, AudioCodecs: []string{"PCMU", "G729"}}
+}
+
+func (a *fakeAccelerator) NewSRTPCipher(key, salt []byte, profile srtp.ProtectionProfile) (SRTPCipher, error) {
+	if profile != srtp.ProtectionProfileAes128CmHmacSha1_80 {
+		return nil, ErrAccelUnsupported
+	}
+	a.ciphers++
+	return srtp.CreateContext(key, salt, profile)
+}
+
+func (a *fakeAccelerator) TranscodeAudio(payload []byte, from, to CodecInfo) ([]byte, error) {
+	if from.Name != "PCMU" || to.Name != "G729" {
+		return nil, ErrAccelUnsupported
+	}
+	a.frames++
+	return []byte("dsp"), nil
+}
+
+func TestAcceleration_SelectAndFallback(t *testing.T) {
+	dsp := &fakeAccelerator{name: "test-dsp"}
+	RegisterAccelerator(dsp)
+	RegisterAccelerator(&fakeAccelerator{name: "test-missing", unavailable: errors.New("no device")})
+	defer ConfigureAcceleration(nil)
+
+	ConfigureAcceleration(&HardwareAccelConfig{Crypto: "test-dsp", Audio: "test-dsp"})
+	key, salt := make([]byte, 16), make([]byte, 14)
+	if _, err := NewSRTPCipher(key, salt, srtp.ProtectionProfileAes128CmHmacSha1_80); err != nil {
+		t.Fatal(err)
+	}
+	// A profile the accelerator does not take runs in software
+	if _, err := NewSRTPCipher(make([]byte, 32), salt, srtp.ProtectionProfileAes256CmHmacSha1_80); err != nil {
+		t.Fatal(err)
+	}
+	if dsp.ciphers != 1 {
+		t.Errorf("created %d ciphers on the accelerator, want 1", dsp.ciphers)
+	}
+
+	out, err := transcodeAudio(make([]byte, 160), CodecInfo{Name: "PCMU"}, CodecInfo{Name: "G729"})
+	if err != nil || string(out) != "dsp" {
+		t.Fatalf("expected the accelerator's frame, got %q, %v", out, err)
+	}
+	if out, err := transcodeAudio(make([]byte, 160), CodecInfo{Name: "PCMU"}, CodecInfo{Name: "opus"}); err != nil || string(out) == "dsp" {
+		t.Fatalf("expected Opus in software, got %q, %v", out, err)
+	}
+	if dsp.frames != 1 {
+		t.Errorf("transcoded %d frames on the accelerator, want 1", dsp.frames)
+	}
+
+	health := CheckAccelerators()
+	if health.Status != StatusUp || health.Details["crypto"] != "test-dsp" || health.Details["audio"] != "test-dsp" {
+		t.Errorf("unexpected health %+v", health)
+	}
+	if got := health.Details["accelerator.test-dsp"]; got != "srtp=AES_CM_128_HMAC_SHA1_80 audio=PCMU,G729" {
+		t.Errorf("reported capabilities %q", got)
+	}
+	if got := health.Details["accelerator.test-missing"]; got != "unavailable: no device" {
+		t.Errorf("reported %q for an unavailable accelerator", got)
+	}
+
+	// An accelerator missing from the host leaves the work in software
+	ConfigureAcceleration(&HardwareAccelConfig{Crypto: "test-missing"})
+	health = CheckAccelerators()
+	if health.Status != StatusDegraded || health.Details["crypto"] != "software" || !strings.Contains(health.Message, "no device") {
+		t.Errorf("unexpected health after fallback %+v", health)
+	}
+}
+
+func TestValidateHardwareAccelConfig(t *testing.T) {
+	RegisterAccelerator(&fakeAccelerator{name: "test-dsp"})
+	tests := []struct {
+		name    string
+		config  HardwareAccelConfig
+		wantErr bool
+	}{
+		{"software", HardwareAccelConfig{Crypto: "software", Audio: "software"}, false},
+		{"registered", HardwareAccelConfig{Crypto: "test-dsp", Audio: "test-dsp"}, false},
+		{"unknown crypto", HardwareAccelConfig{Crypto: "qat"}, true},
+		{"unknown audio", HardwareAccelConfig{Audio: "nvenc"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateHardwareAccelConfig(&Config{HardwareAccel: &tt.config})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSoftwareSRTPCipher_EncryptRTPBatch(t *testing.T) {
+	key, salt := bytes.Repeat([]byte{1}, 16), bytes.Repeat([]byte{2}, 14)
+	cipher, err := softwareAccelerator{}.NewSRTPCipher(key, salt, srtp.ProtectionProfileAes128CmHmacSha1_80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, ok := cipher.(SRTPBatchCipher)
+	if !ok {
+		t.Fatal("expected the software cipher to encrypt batches")
+	}
+
+	var packets [][]byte
+	for seq := uint16(1); seq <= 3; seq++ {
+		packet, _ := (&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: seq, SSRC: 7}, Payload: []byte{byte(seq)}}).Marshal()
+		packets = append(packets, packet)
+	}
+	encrypted, err := batch.EncryptRTPBatch(nil, packets)
+	if err != nil || len(encrypted) != 3 {
+		t.Fatalf("encrypted %d packets, %v", len(encrypted), err)
+	}
+
+	decrypter, _ := srtp.CreateContext(key, salt, srtp.ProtectionProfileAes128CmHmacSha1_80)
+	for i, packet := range encrypted {
+		plain, err := decrypter.DecryptRTP(nil, packet, nil)
+		if err != nil || !bytes.Equal(plain, packets[i]) {
+			t.Fatalf("packet %d did not decrypt: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/stun"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var iceConnectivityChecks = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "karl_ice_connectivity_checks_total",
+		Help: "ICE connectivity checks Karl ran towards parties by result",
+	},
+	[]string{"result"},
+)
+
+const (
+	// iceCheckInterval paces the checks of a party's candidates (Ta)
+	iceCheckInterval = 50 * time.Millisecond
+
+	// iceCheckTimeout ends the checks of a party none of whose candidates
+	// answered
+	iceCheckTimeout = 10 * time.Second
+
+	// icePeerReflexivePriority is the PRIORITY of Karl's checks: that of a
+	// peer-reflexive candidate the party may learn from them
+	icePeerReflexivePriority = (110 << 24) | (65535 << 8) | 255
+)
+
+// iceChecker runs Karl's connectivity checks towards a party's candidates
+// from the socket the party was given (RFC 8445 section 7.2.4). A
+// controlling Karl nominates the first pair that works; a controlled Karl
+// stops there and waits for the party's nomination
+type iceChecker struct {
+	conn          *net.UDPConn
+	local, remote *ICECredentials
+	candidates    []*net.UDPAddr
+	tiebreaker    uint64
+
+	// selected points the party's media at the nominated candidate
+	selected func(addr *net.UDPAddr)
+
+	mu          sync.Mutex
+	controlling bool
+	pending     map[[stun.TransactionIDSize]byte]iceCheck
+	nominating  *net.UDPAddr // Valid candidate a controlling Karl nominates
+	done        bool
+	stop        chan struct{}
+}
+
+// iceCheck is a check waiting for its response
+type iceCheck struct {
+	addr     *net.UDPAddr
+	nominate bool
+}
+
+// newICEChecker prepares checks of candidates, in order of preference
+func newICEChecker(conn *net.UDPConn, local, remote *ICECredentials, candidates []*net.UDPAddr, controlling bool, selected func(addr *net.UDPAddr)) *iceChecker {
+	var tiebreaker [8]byte
+	_, _ = rand.Read(tiebreaker[:])
+	return &iceChecker{
+		conn:        conn,
+		local:       local,
+		remote:      remote,
+		candidates:  candidates,
+		tiebreaker:  binary.BigEndian.Uint64(tiebreaker[:]),
+		selected:    selected,
+		controlling: controlling,
+		pending:     make(map[[stun.TransactionIDSize]byte]iceCheck),
+		stop:        make(chan struct{}),
+	}
+}
+
+// run checks the candidates in turn every Ta until a pair is valid, or
+// nominated when Karl controls, or the checks time out. A nomination is
+// sent again every Ta until it is answered
+func (c *iceChecker) run() {
+	ticker := time.NewTicker(iceCheckInterval)
+	defer ticker.Stop()
+	timeout := time.NewTimer(iceCheckTimeout)
+	defer timeout.Stop()
+
+	for next := 0; ; next++ {
+		c.mu.Lock()
+		nominating := c.nominating
+		c.mu.Unlock()
+		if nominating != nil {
+			c.send(nominating, true)
+		} else {
+			c.send(c.candidates[next%len(c.candidates)], false)
+		}
+		select {
+		case <-c.stop:
+			return
+		case <-timeout.C:
+			c.mu.Lock()
+			c.done = true
+			c.mu.Unlock()
+			iceConnectivityChecks.WithLabelValues("timeout").Inc()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// send sends a check to a candidate, nominating it when asked to
+func (c *iceChecker) send(addr *net.UDPAddr, nominate bool) {
+	c.mu.Lock()
+	if c.done {
+		c.mu.Unlock()
+		return
+	}
+	setters := []stun.Setter{
+		stun.TransactionID,
+		stun.BindingRequest,
+		stun.NewUsername(c.remote.Username + ":" + c.local.Username),
+		ice.PriorityAttr(icePeerReflexivePriority),
+	}
+	if c.controlling {
+		setters = append(setters, ice.AttrControlling(c.tiebreaker))
+	} else {
+		setters = append(setters, ice.AttrControlled(c.tiebreaker))
+	}
+	if nominate {
+		setters = append(setters, ice.UseCandidate())
+	}
+	setters = append(setters, stun.NewShortTermIntegrity(c.remote.Password), stun.Fingerprint)
+	request, err := stun.Build(setters...)
+	if err != nil {
+		c.mu.Unlock()
+		return
+	}
+	c.pending[request.TransactionID] = iceCheck{addr: addr, nominate: nominate}
+	c.mu.Unlock()
+
+	if _, err := c.conn.WriteToUDP(request.Raw, addr); err == nil {
+		iceConnectivityChecks.WithLabelValues("sent").Inc()
+	}
+}
+
+// response takes the response to one of Karl's checks. A success from the
+// candidate checked makes its pair valid; a role conflict (487) switches
+// Karl's role and the check is sent again
+func (c *iceChecker) response(response *stun.Message, from *net.UDPAddr) {
+	c.mu.Lock()
+	check, ok := c.pending[response.TransactionID]
+	if !ok || c.done {
+		c.mu.Unlock()
+		return
+	}
+	delete(c.pending, response.TransactionID)
+	c.mu.Unlock()
+
+	if stun.NewShortTermIntegrity(c.remote.Password).Check(response) != nil {
+		return
+	}
+	if response.Type == stun.BindingError {
+		var code stun.ErrorCodeAttribute
+		if code.GetFrom(response) == nil && code.Code == stun.CodeRoleConflict {
+			c.mu.Lock()
+			c.controlling = !c.controlling
+			c.mu.Unlock()
+			c.send(check.addr, false)
+		}
+		return
+	}
+	if response.Type != stun.BindingSuccess || !from.IP.Equal(check.addr.IP) || from.Port != check.addr.Port {
+		return
+	}
+
+	c.mu.Lock()
+	controlling, nominating := c.controlling, c.nominating
+	if controlling && !check.nominate && nominating == nil {
+		c.nominating = check.addr
+	}
+	c.mu.Unlock()
+	switch {
+	case controlling && !check.nominate:
+		if nominating == nil {
+			iceConnectivityChecks.WithLabelValues("succeeded").Inc()
+			c.send(check.addr, true)
+		}
+		return
+	case check.nominate:
+		iceConnectivityChecks.WithLabelValues("nominated").Inc()
+		c.selected(check.addr)
+	default:
+		iceConnectivityChecks.WithLabelValues("succeeded").Inc()
+	}
+	c.close()
+}
+
+// close ends the checks
+func (c *iceChecker) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.done = true
+	select {
+	case <-c.stop:
+	default:
+		close(c.stop)
+	}
+}
+
+// iceCandidateAddrs returns the UDP addresses of the RTP component of the
+// candidates in an m= section, highest priority first. Candidates with
+// hostnames, such as mDNS ones, are skipped
+func iceCandidateAddrs(values []string) []*net.UDPAddr {
+	type ranked struct {
+		addr     *net.UDPAddr
+		priority uint32
+	}
+	var candidates []ranked
+	for _, value := range values {
+		candidate, err := ice.UnmarshalCandidate(value)
+		if err != nil || candidate.Component() != 1 || candidate.NetworkType().IsTCP() {
+			continue
+		}
+		ip := net.ParseIP(candidate.Address())
+		if ip == nil {
+			continue
+		}
+		candidates = append(candidates, ranked{&net.UDPAddr{IP: ip, Port: candidate.Port()}, candidate.Priority()})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].priority > candidates[j].priority })
+	addrs := make([]*net.UDPAddr, len(candidates))
+	for i, candidate := range candidates {
+		addrs[i] = candidate.addr
+	}
+	return addrs
+}
@@ -0,0 +1,249 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	ng "karl/internal/ng_protocol"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/stun"
+)
+
+func TestICEManager_Candidates(t *testing.T) {
+	server := startTestSTUNServer(t, net.ParseIP("203.0.113.7"))
+	manager, err := NewICEManager(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager.servers = []string{server}
+	manager.Gather([]string{"127.0.0.1", "0.0.0.0"}, time.Second)
+
+	// A host candidate on the bound address, then the advertised and the
+	// discovered mappings of it
+	candidates := manager.Candidates(net.IPv4(127, 0, 0, 1), "198.51.100.1")
+	want := []ICECandidate{
+		{Type: "host", IP: "127.0.0.1"},
+		{Type: "srflx", IP: "198.51.100.1", Related: "127.0.0.1"},
+		{Type: "srflx", IP: "203.0.113.7", Related: "127.0.0.1"},
+	}
+	if len(candidates) != len(want) {
+		t.Fatalf("candidates %v, want %v", candidates, want)
+	}
+	for i := range want {
+		if candidates[i] != want[i] {
+			t.Errorf("candidate %d is %v, want %v", i, candidates[i], want[i])
+		}
+	}
+	if candidates := manager.Candidates(net.IPv4zero, "198.51.100.1"); len(candidates) != 1 || candidates[0].IP != "198.51.100.1" {
+		t.Errorf("ports bound to any address offered as %v", candidates)
+	}
+
+	desc, err := ParseSDP(sipOfferSDP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ice, _ := NewICECredentials(false)
+	out := RewriteSDP(desc, &SDPRewrite{LocalIP: "198.51.100.1", ICE: ice, Candidates: candidates,
+		Media: []SDPMediaRewrite{{RTPPort: 30000, RTCPPort: 30001, Protocol: "RTP/AVP"}}})
+	for _, line := range []string{
+		"a=candidate:1 1 UDP 2130706431 127.0.0.1 30000 typ host",
+		"a=candidate:5 2 UDP 1694498558 198.51.100.1 30001 typ srflx raddr 127.0.0.1 rport 30001",
+		"a=candidate:6 1 UDP 1694498303 203.0.113.7 30000 typ srflx raddr 127.0.0.1 rport 30000",
+	} {
+		if !strings.Contains(out, line+"\r\n") {
+			t.Errorf("missing %q in:\n%s", line, out)
+		}
+	}
+	if strings.Contains(out, "a=ice-lite") {
+		t.Error("a full ICE Karl advertised ice-lite")
+	}
+}
+
+func TestICECandidateAddrs(t *testing.T) {
+	addrs := iceCandidateAddrs([]string{
+		"1 1 udp 2122260223 192.0.2.10 50000 typ host",
+		"2 1 udp 1686052607 198.51.100.20 40000 typ srflx raddr 192.0.2.10 rport 50000",
+		"1 2 udp 2122260222 192.0.2.10 50001 typ host",
+		"3 1 tcp 1518280447 192.0.2.10 9 typ host tcptype active",
+		"4 1 udp 2122194687 3b1e6f0a-0f0e-4a4b-9b6e-2c5b6d7e8f90.local 50002 typ host",
+		"5 1 udp 2122262783 192.0.2.11 50003 typ host",
+	})
+	want := []string{"192.0.2.11:50003", "192.0.2.10:50000", "198.51.100.20:40000"}
+	if len(addrs) != len(want) {
+		t.Fatalf("candidates %v, want %v", addrs, want)
+	}
+	for i := range want {
+		if addrs[i].String() != want[i] {
+			t.Errorf("candidate %d is %v, want %s", i, addrs[i], want[i])
+		}
+	}
+}
+
+func TestMediaCrypto_ICEChecks(t *testing.T) {
+	karl, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer karl.Close()
+	party, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer party.Close()
+
+	local, _ := NewICECredentials(false)
+	remote, _ := NewICECredentials(false)
+	latched := make(chan *net.UDPAddr, 1)
+	crypto := NewPlainCrypto("RTP/AVP")
+	crypto.SetICE(local)
+	crypto.latch = func(addr *net.UDPAddr) { latched <- addr }
+	defer crypto.Close()
+
+	// Karl's receive path takes the responses to its checks
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := karl.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			crypto.receive(karl, buf[:n], from)
+		}
+	}()
+
+	// The party answers the checks signed with its password, the first one
+	// on an unreachable candidate staying unanswered
+	nominated := make(chan bool, 4)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := party.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			request := &stun.Message{Raw: append([]byte(nil), buf[:n]...)}
+			if request.Decode() != nil || request.Type != stun.BindingRequest {
+				continue
+			}
+			var username stun.Username
+			if username.GetFrom(request) != nil || username.String() != remote.Username+":"+local.Username ||
+				stun.NewShortTermIntegrity(remote.Password).Check(request) != nil {
+				t.Errorf("check not signed with the party's credentials")
+				continue
+			}
+			var controlling ice.AttrControlling
+			if controlling.GetFrom(request) != nil {
+				t.Errorf("a controlling Karl sent a check without ICE-CONTROLLING")
+			}
+			response, _ := stun.Build(stun.NewTransactionIDSetter(request.TransactionID), stun.BindingSuccess,
+				&stun.XORMappedAddress{IP: from.IP, Port: from.Port},
+				stun.NewShortTermIntegrity(remote.Password), stun.Fingerprint)
+			_, _ = party.WriteToUDP(response.Raw, from)
+			select {
+			case nominated <- ice.UseCandidateAttr{}.IsSet(request):
+			default:
+			}
+		}
+	}()
+
+	unreachable := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+	crypto.SetRemoteICE(remote, []*net.UDPAddr{unreachable, party.LocalAddr().(*net.UDPAddr)}, true)
+	crypto.Start(karl, nil)
+
+	select {
+	case addr := <-latched:
+		if addr.String() != party.LocalAddr().String() {
+			t.Errorf("latched to %v, want the answering candidate %v", addr, party.LocalAddr())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Karl nominated no candidate")
+	}
+	if first, second := <-nominated, <-nominated; first || !second {
+		t.Errorf("nominations %v %v, want a check and then its nomination", first, second)
+	}
+}
+
+func TestNGSocketListener_ICEChecksTowardsWebRTC(t *testing.T) {
+	control, err := NewRTPControl(nil, nil)
+	if err != nil {
+		t.Fatalf("NewRTPControl failed: %v", err)
+	}
+	defer control.Stop()
+	forwardThroughPool(t, control)
+
+	manager, registry, _ := newTestSessionManager(t)
+	manager.SetMediaPortOpener(control.OpenMediaPorts)
+	registry.SetMediaSender(control.SendBatchFrom)
+	defer registry.SetMediaSender(nil)
+	control.SetMediaCryptoResolver(registry.MediaCryptoFor)
+	iceManager, _ := NewICEManager(nil)
+	listener := &NGSocketListener{sessionRegistry: registry, sessionManager: manager, config: &Config{}, iceManager: iceManager}
+
+	parties := make([]*net.UDPConn, 2)
+	for i := range parties {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		parties[i] = conn
+	}
+
+	// A PBX calls a browser, which Karl offers full ICE
+	resp, err := listener.handleOffer(&ng.NGRequest{CallID: "ice-call", FromTag: "from-tag", SDP: endpointSDP(parties[0]), Transport: "UDP/TLS/RTP/SAVPF"})
+	if err != nil || resp.Result != ng.ResultOK {
+		t.Fatalf("handleOffer failed: %v %+v", err, resp)
+	}
+	defer GetCodecNegotiator().RemoveCall("ice-call")
+	if !strings.Contains(resp.SDP, "a=candidate:") || strings.Contains(resp.SDP, "a=ice-lite") {
+		t.Fatalf("expected a full ICE offer, got:\n%s", resp.SDP)
+	}
+	ufrag, _, _ := strings.Cut(resp.SDP[strings.Index(resp.SDP, "a=ice-ufrag:")+len("a=ice-ufrag:"):], "\r\n")
+	port, _, _ := strings.Cut(resp.SDP[strings.Index(resp.SDP, "m=audio ")+len("m=audio "):], " ")
+
+	cert, _, _, err := generateDTLSCertificate(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	browser, _ := NewICECredentials(false)
+	browserAddr := parties[1].LocalAddr().(*net.UDPAddr)
+	answer := strings.Replace(endpointSDP(parties[1]), "RTP/AVP", "UDP/TLS/RTP/SAVPF", 1) +
+		"a=ice-ufrag:" + browser.Username + "\r\na=ice-pwd:" + browser.Password + "\r\n" +
+		"a=candidate:1 1 udp 2122260223 127.0.0.1 " + strconv.Itoa(browserAddr.Port) + " typ host\r\n" +
+		"a=fingerprint:sha-256 " + formatFingerprint(sum[:]) + "\r\na=setup:passive\r\n"
+	if resp, err := listener.handleAnswer(&ng.NGRequest{CallID: "ice-call", FromTag: "from-tag", ToTag: "to-tag", SDP: answer}); err != nil || resp.Result != ng.ResultOK {
+		t.Fatalf("handleAnswer failed: %v %+v", err, resp)
+	}
+
+	// Karl checks the browser's candidate from the port it offered, as the
+	// controlling agent, and then nominates it
+	buf := make([]byte, 1500)
+	for nominated := false; !nominated; {
+		parties[1].SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, from, err := parties[1].ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("no connectivity check from Karl: %v", err)
+		}
+		request := &stun.Message{Raw: append([]byte(nil), buf[:n]...)}
+		if request.Decode() != nil || request.Type != stun.BindingRequest {
+			continue
+		}
+		var username stun.Username
+		var controlling ice.AttrControlling
+		if strconv.Itoa(from.Port) != port || username.GetFrom(request) != nil || username.String() != browser.Username+":"+ufrag ||
+			controlling.GetFrom(request) != nil || stun.NewShortTermIntegrity(browser.Password).Check(request) != nil {
+			t.Fatalf("unexpected check from %v: %v", from, request)
+		}
+		response, _ := stun.Build(stun.NewTransactionIDSetter(request.TransactionID), stun.BindingSuccess,
+			&stun.XORMappedAddress{IP: from.IP, Port: from.Port},
+			stun.NewShortTermIntegrity(browser.Password), stun.Fingerprint)
+		_, _ = parties[1].WriteToUDP(response.Raw, from)
+		nominated = ice.UseCandidateAttr{}.IsSet(request)
+	}
+}
@@ -1,62 +1,134 @@
 package internal
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"net"
+	"strings"
 	"sync"
+	"time"
 
-	"github.com/pion/ice/v2"
 	"github.com/pion/webrtc/v3"
 )
 
-// ICEManager handles ICE candidates dynamically
+// ICECandidate is an address Karl offers as an ICE candidate for a leg's
+// ports
+type ICECandidate struct {
+	Type    string // host or srflx
+	IP      string
+	Related string // Host address a server-reflexive candidate is mapped from
+}
+
+// ICEManager gathers Karl's ICE candidates on the media interfaces: a host
+// candidate on each interface's local address and a server-reflexive one
+// on the address STUN servers see it as. With an ICE manager Karl runs
+// full ICE towards WebRTC peers, checking their candidates from the session
+// sockets, instead of ICE-lite
 type ICEManager struct {
-	agent         *ice.Agent
-	bestCandidate ice.Candidate
-	mu            sync.Mutex
+	servers []string // STUN servers, host:port
+
+	mu        sync.RWMutex
+	reflexive map[string]net.IP // Server-reflexive address by local address
 }
 
-// NewICEManager initializes ICE with dynamic selection
+// NewICEManager takes the STUN servers among the ICE servers. TURN servers
+// are not used, since Karl's media sockets are public or behind a NAT that
+// keeps their ports
 func NewICEManager(iceServers []webrtc.ICEServer) (*ICEManager, error) {
-	log.Println("🌍 Initializing WebRTC ICE for NAT Traversal...")
-
-	// ICE Agent Configuration
-	config := &ice.AgentConfig{
-		NetworkTypes: []ice.NetworkType{ice.NetworkTypeUDP4, ice.NetworkTypeUDP6},
+	manager := &ICEManager{reflexive: make(map[string]net.IP)}
+	for _, server := range iceServers {
+		for _, url := range server.URLs {
+			host, ok := strings.CutPrefix(url, "stun:")
+			if !ok {
+				continue
+			}
+			if host == "" {
+				return nil, fmt.Errorf("invalid STUN server %q", url)
+			}
+			manager.servers = append(manager.servers, host)
+		}
 	}
+	return manager, nil
+}
 
-	// Create ICE Agent
-	agent, err := ice.NewAgent(config)
-	if err != nil {
-		return nil, fmt.Errorf("❌ Failed to create ICE agent: %v", err)
+// Gather discovers the server-reflexive address of each local address from
+// the first STUN server that answers. An address keeps its previous one
+// when no server answers
+func (m *ICEManager) Gather(addresses []string, timeout time.Duration) {
+	for _, address := range addresses {
+		ip := net.ParseIP(address)
+		if ip == nil || ip.IsUnspecified() {
+			continue
+		}
+		IncrementICECandidate("host")
+		for _, server := range m.servers {
+			mapped, err := DiscoverPublicIP(server, address, timeout)
+			if err != nil {
+				log.Printf("Warning: ICE gathering on %s from %s failed: %v", address, server, err)
+				continue
+			}
+			m.mu.Lock()
+			m.reflexive[ip.String()] = mapped
+			m.mu.Unlock()
+			IncrementICECandidate("srflx")
+			break
+		}
 	}
+}
 
-	manager := &ICEManager{agent: agent}
-
-	// Monitor candidate selection
-	_ = agent.OnCandidate(func(candidate ice.Candidate) {
-		if candidate != nil {
-			manager.selectBestCandidate(candidate)
+// StartGathering runs Gather on the local addresses of the interfaces now
+// and then every interval until ctx is done, following NAT mappings that
+// change
+func (m *ICEManager) StartGathering(ctx context.Context, interfaces *InterfaceSelector, interval time.Duration) {
+	if len(m.servers) == 0 || interfaces == nil {
+		return
+	}
+	gather := func() {
+		var addresses []string
+		for _, name := range interfaces.GetInterfaceNames() {
+			addresses = append(addresses, interfaces.GetLocalAddress(name))
 		}
-	})
-
-	return manager, nil
+		m.Gather(addresses, stunTimeout)
+	}
+	go func() {
+		gather()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				gather()
+			}
+		}
+	}()
 }
 
-// selectBestCandidate chooses the lowest-latency candidate
-func (i *ICEManager) selectBestCandidate(candidate ice.Candidate) {
-	i.mu.Lock()
-	defer i.mu.Unlock()
-
-	if i.bestCandidate == nil || candidate.Priority() > i.bestCandidate.Priority() {
-		i.bestCandidate = candidate
-		log.Printf("⭐ New Best ICE Candidate: %s (Priority: %d)", candidate.String(), candidate.Priority())
+// Candidates returns Karl's candidates for ports bound to host and
+// advertised as advertised: a host candidate, and a server-reflexive one
+// for each other address the ports are reached at. Ports bound to any
+// address are offered on the advertised one
+func (m *ICEManager) Candidates(host net.IP, advertised string) []ICECandidate {
+	if host == nil || host.IsUnspecified() {
+		return []ICECandidate{{Type: "host", IP: advertised}}
 	}
-}
 
-// GetBestCandidate returns the best ICE candidate
-func (i *ICEManager) GetBestCandidate() ice.Candidate {
-	i.mu.Lock()
-	defer i.mu.Unlock()
-	return i.bestCandidate
+	candidates := []ICECandidate{{Type: "host", IP: host.String()}}
+	seen := map[string]bool{host.String(): true}
+	addReflexive := func(ip string) {
+		if ip == "" || seen[ip] {
+			return
+		}
+		seen[ip] = true
+		candidates = append(candidates, ICECandidate{Type: "srflx", IP: ip, Related: host.String()})
+	}
+	addReflexive(advertised)
+	m.mu.RLock()
+	if mapped := m.reflexive[host.String()]; mapped != nil {
+		addReflexive(mapped.String())
+	}
+	m.mu.RUnlock()
+	return candidates
 }
@@ -0,0 +1,145 @@
+//go:build karl_ilbc && cgo
+
+package internal
+
+/*
+#cgo pkg-config: libilbc
+#include <stdint.h>
+#include <stddef.h>
+#include <ilbc.h>
+
+static IlbcEncoderInstance *karl_ilbc_enc_new(int16_t ms) {
+	IlbcEncoderInstance *enc = NULL;
+	if (WebRtcIlbcfix_EncoderCreate(&enc) != 0 || enc == NULL) {
+		return NULL;
+	}
+	if (WebRtcIlbcfix_EncoderInit(enc, ms) != 0) {
+		WebRtcIlbcfix_EncoderFree(enc);
+		return NULL;
+	}
+	return enc;
+}
+
+static IlbcDecoderInstance *karl_ilbc_dec_new(int16_t ms) {
+	IlbcDecoderInstance *dec = NULL;
+	if (WebRtcIlbcfix_DecoderCreate(&dec) != 0 || dec == NULL) {
+		return NULL;
+	}
+	if (WebRtcIlbcfix_DecoderInit(dec, ms) != 0) {
+		WebRtcIlbcfix_DecoderFree(dec);
+		return NULL;
+	}
+	return dec;
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"runtime"
+	"unsafe"
+)
+
+// iLBC from libilbc, the RFC 3951 reference code as maintained in WebRTC,
+// in 20 or 30 ms frames as the fmtp mode says
+func init() {
+	registerAudioCodec(MimeTypeILBC, nativeAudioCodec{
+		offer:      CodecInfo{PayloadType: 96, Name: "iLBC", ClockRate: ILBCSampleRate, Channels: 1, Fmtp: "mode=30"},
+		sampleRate: func(CodecInfo) int { return ILBCSampleRate },
+		newEncoder: newILBCEncoder,
+		newDecoder: newILBCDecoder,
+	})
+}
+
+// ilbcEncoder encodes frames of the fmtp's mode
+type ilbcEncoder struct {
+	enc    *C.IlbcEncoderInstance
+	size   int
+	framer pcmFramer
+}
+
+func newILBCEncoder(codec CodecInfo) (audioEncoder, error) {
+	mode := ILBCFmtpMode(codec.Fmtp)
+	enc := C.karl_ilbc_enc_new(C.int16_t(mode))
+	if enc == nil {
+		return nil, fmt.Errorf("failed to create iLBC encoder")
+	}
+	e := &ilbcEncoder{enc: enc, size: GetILBCFrameSize(mode), framer: pcmFramer{size: GetILBCFrameSamples(mode)}}
+	runtime.SetFinalizer(e, (*ilbcEncoder).Close)
+	return e, nil
+}
+
+// Encode returns the whole frames of pcm, keeping the rest for the next
+// call
+func (e *ilbcEncoder) Encode(pcm []int16) ([]byte, error) {
+	if e.enc == nil {
+		return nil, fmt.Errorf("iLBC encoder closed")
+	}
+	frames := e.framer.frames(pcm)
+	payload := make([]byte, len(frames)*e.size)
+	for i, frame := range frames {
+		n := C.WebRtcIlbcfix_Encode(e.enc, (*C.int16_t)(unsafe.Pointer(&frame[0])), C.size_t(len(frame)),
+			(*C.uint8_t)(unsafe.Pointer(&payload[i*e.size])))
+		if int(n) != e.size {
+			return nil, fmt.Errorf("iLBC encoder returned %d bytes", n)
+		}
+	}
+	return payload, nil
+}
+
+// Close frees the encoder
+func (e *ilbcEncoder) Close() {
+	if e.enc != nil {
+		C.WebRtcIlbcfix_EncoderFree(e.enc)
+		e.enc = nil
+	}
+	runtime.SetFinalizer(e, nil)
+}
+
+// ilbcDecoder decodes frames of the fmtp's mode
+type ilbcDecoder struct {
+	dec     *C.IlbcDecoderInstance
+	size    int
+	samples int
+}
+
+func newILBCDecoder(codec CodecInfo) (audioDecoder, error) {
+	mode := ILBCFmtpMode(codec.Fmtp)
+	dec := C.karl_ilbc_dec_new(C.int16_t(mode))
+	if dec == nil {
+		return nil, fmt.Errorf("failed to create iLBC decoder")
+	}
+	d := &ilbcDecoder{dec: dec, size: GetILBCFrameSize(mode), samples: GetILBCFrameSamples(mode)}
+	runtime.SetFinalizer(d, (*ilbcDecoder).Close)
+	return d, nil
+}
+
+// Decode decodes the frames of a payload
+func (d *ilbcDecoder) Decode(payload []byte) ([]int16, error) {
+	if d.dec == nil {
+		return nil, fmt.Errorf("iLBC decoder closed")
+	}
+	if len(payload) == 0 || len(payload)%d.size != 0 {
+		return nil, fmt.Errorf("invalid iLBC payload of %d bytes", len(payload))
+	}
+	frames := len(payload) / d.size
+	pcm := make([]int16, frames*d.samples)
+	for i := 0; i < frames; i++ {
+		var speechType C.int16_t
+		n := C.WebRtcIlbcfix_Decode(d.dec, (*C.uint8_t)(unsafe.Pointer(&payload[i*d.size])), C.size_t(d.size),
+			(*C.int16_t)(unsafe.Pointer(&pcm[i*d.samples])), &speechType)
+		if int(n) != d.samples {
+			return nil, fmt.Errorf("iLBC decoder returned %d samples", n)
+		}
+	}
+	return pcm, nil
+}
+
+// Close frees the decoder
+func (d *ilbcDecoder) Close() {
+	if d.dec != nil {
+		C.WebRtcIlbcfix_DecoderFree(d.dec)
+		d.dec = nil
+	}
+	runtime.SetFinalizer(d, nil)
+}
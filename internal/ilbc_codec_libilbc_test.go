@@ -0,0 +1,48 @@
+//go:build karl_ilbc && cgo
+
+package internal
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestILBC_RoundTrip(t *testing.T) {
+	for _, mode := range []ILBCMode{ILBCMode20ms, ILBCMode30ms} {
+		codec := CodecInfo{Name: "iLBC", ClockRate: ILBCSampleRate, Fmtp: "mode=30"}
+		if mode == ILBCMode20ms {
+			codec.Fmtp = "mode=20"
+		}
+		payloads, pcm := nativeRoundTrip(t, codec)
+		for _, p := range payloads {
+			if len(p)%GetILBCFrameSize(mode) != 0 {
+				t.Fatalf("mode %d: expected whole frames, got %d bytes", mode, len(p))
+			}
+		}
+		// 30 ms frames fill from 20 ms of audio every other packet
+		if want := 1000 / int(mode) * GetILBCFrameSamples(mode); len(pcm) < want-GetILBCFrameSamples(mode) {
+			t.Fatalf("mode %d: expected about %d samples decoded, got %d", mode, want, len(pcm))
+		}
+		checkTone(t, "iLBC", pcm, ILBCSampleRate)
+	}
+}
+
+func TestTranscodeAudio_ILBC(t *testing.T) {
+	pcmu := encodeG711("PCMU", resamplerTone(440, 8000, 160))
+	ilbc := CodecInfo{Name: "iLBC", ClockRate: ILBCSampleRate, Fmtp: "mode=20"}
+	encoded, err := transcodeAudio(pcmu, mimeCodec(webrtc.MimeTypePCMU), ilbc)
+	if err != nil || len(encoded) != ILBC20FrameSize {
+		t.Fatalf("expected a 20 ms iLBC frame, got %d bytes (%v)", len(encoded), err)
+	}
+	back, err := transcodeAudio(encoded, ilbc, mimeCodec(webrtc.MimeTypePCMU))
+	if err != nil || len(back) != len(pcmu) {
+		t.Fatalf("expected 160 PCMU samples, got %d bytes (%v)", len(back), err)
+	}
+	if _, err := transcodeAudio(make([]byte, 37), ilbc, mimeCodec(webrtc.MimeTypePCMU)); err == nil {
+		t.Error("expected a partial frame rejected")
+	}
+	if added := TranscodeOfferCodecs(nil, []string{"iLBC"}); len(added) != 1 || added[0].Fmtp != "mode=30" {
+		t.Errorf("expected iLBC offered for transcoding, got %+v", added)
+	}
+}
@@ -0,0 +1,392 @@
+package internal
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	ng "karl/internal/ng_protocol"
+)
+
+// Impairment defaults and limits
+const (
+	defaultImpairmentMaxDelay = 1000 // ms
+	maxImpairmentDelay        = 10000
+
+	// A packet held back for reordering goes out on its own if no later
+	// packet of its stream overtakes it within this time
+	impairmentReorderHold = 100 * time.Millisecond
+)
+
+// Jitter distributions
+const (
+	JitterUniform = "uniform"
+	JitterNormal  = "normal"
+)
+
+// Impairment metrics
+var (
+	impairedPackets = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "karl_impairment_packets_total",
+			Help: "Packets of impaired calls, by what the impairment did to them",
+		},
+		[]string{"action"},
+	)
+
+	impairedCalls = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "karl_impaired_calls",
+			Help: "Calls with network impairment applied",
+		},
+	)
+)
+
+var (
+	impairmentConfig atomic.Pointer[ImpairmentConfig]
+	// Impairment options refused while it is disabled are reported at most
+	// once a minute
+	impairmentRefused = NewLogSampler(Logger(ComponentNG), slog.LevelWarn, 1, time.Minute)
+
+	impairersMu sync.RWMutex
+	impairers   = make(map[string]*impairer)
+	// Number of impaired calls, so calls without impairment skip the lookup
+	impairerCount atomic.Int32
+)
+
+// ImpairmentSettings describe the network conditions simulated on a call's
+// media
+type ImpairmentSettings struct {
+	LossPercent      float64       // packets dropped
+	ReorderPercent   float64       // packets held back behind the next packet of their stream
+	DuplicatePercent float64       // packets sent twice
+	Delay            time.Duration // added to every packet
+	Jitter           time.Duration // random variation of the delay
+	Distribution     string        // of the jitter: uniform or normal
+}
+
+// ConfigureImpairment sets whether calls may ask for impairment; nil
+// disables it
+func ConfigureImpairment(config *ImpairmentConfig) {
+	if config == nil {
+		config = &ImpairmentConfig{}
+	}
+	impairmentConfig.Store(config)
+}
+
+// ValidateImpairmentConfig checks the delay limit
+func ValidateImpairmentConfig(cfg *Config) error {
+	if d := cfg.Impairment.MaxDelay; d < 0 || d > maxImpairmentDelay {
+		return fmt.Errorf("invalid impairment.max_delay %d, expected 0-%d ms", d, maxImpairmentDelay)
+	}
+	return nil
+}
+
+// impairmentMaxDelay returns the longest a packet may be delayed
+func impairmentMaxDelay() time.Duration {
+	ms := defaultImpairmentMaxDelay
+	if c := impairmentConfig.Load(); c != nil && c.MaxDelay > 0 {
+		ms = c.MaxDelay
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// impairmentFromFlags returns the impairment an offer or answer asked for
+// with the impair-* options
+func impairmentFromFlags(pf *ng.ParsedFlags) (ImpairmentSettings, bool) {
+	s := ImpairmentSettings{
+		LossPercent:      pf.ImpairLoss,
+		ReorderPercent:   pf.ImpairReorder,
+		DuplicatePercent: pf.ImpairDuplicate,
+		Delay:            time.Duration(pf.ImpairDelay) * time.Millisecond,
+		Jitter:           time.Duration(pf.ImpairJitter) * time.Millisecond,
+		Distribution:     pf.ImpairDistribution,
+	}
+	return s, s.active()
+}
+
+// active reports whether the settings change anything
+func (s ImpairmentSettings) active() bool {
+	return s.LossPercent > 0 || s.ReorderPercent > 0 || s.DuplicatePercent > 0 || s.Delay > 0 || s.Jitter > 0
+}
+
+// applyImpairmentFlags sets or removes a call's impairment from the
+// impair-* options of an offer or answer. An offer or answer without them
+// leaves the call's impairment as it was. The options are ignored unless
+// impairment is enabled in the configuration
+func applyImpairmentFlags(callID string, pf *ng.ParsedFlags) {
+	if pf.ImpairOff {
+		RemoveImpairment(callID)
+		return
+	}
+	settings, ok := impairmentFromFlags(pf)
+	if !ok {
+		return
+	}
+	if c := impairmentConfig.Load(); c == nil || !c.Enabled {
+		if impairmentRefused.Allow() {
+			impairmentRefused.Log("Impairment options ignored, impairment is not enabled", "call_id", callID)
+		}
+		return
+	}
+	SetImpairment(callID, settings)
+}
+
+// SetImpairment simulates the given network conditions on the media Karl
+// sends on for a call, in both directions. It replaces the call's previous
+// impairment; packets already delayed are still delivered
+func SetImpairment(callID string, settings ImpairmentSettings) {
+	if !settings.active() {
+		RemoveImpairment(callID)
+		return
+	}
+	impairersMu.Lock()
+	defer impairersMu.Unlock()
+	if current, ok := impairers[callID]; ok {
+		current.mu.Lock()
+		current.settings = settings
+		current.mu.Unlock()
+		return
+	}
+	impairers[callID] = newImpairer(settings)
+	impairerCount.Add(1)
+	impairedCalls.Inc()
+}
+
+// RemoveImpairment stops impairing a call. Packets it still holds back or
+// delays are dropped
+func RemoveImpairment(callID string) {
+	impairersMu.Lock()
+	i, ok := impairers[callID]
+	if ok {
+		delete(impairers, callID)
+		impairerCount.Add(-1)
+		impairedCalls.Dec()
+	}
+	impairersMu.Unlock()
+	if ok {
+		i.close()
+	}
+}
+
+// drainImpairment sends on what a call's impairment holds back or delays,
+// returning once it is all out
+func drainImpairment(callID string) {
+	impairersMu.RLock()
+	i := impairers[callID]
+	impairersMu.RUnlock()
+	if i != nil {
+		i.drain()
+	}
+}
+
+// CallImpairment returns the impairment applied to a call
+func CallImpairment(callID string) (ImpairmentSettings, bool) {
+	impairersMu.RLock()
+	defer impairersMu.RUnlock()
+	i, ok := impairers[callID]
+	if !ok {
+		return ImpairmentSettings{}, false
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.settings, true
+}
+
+// impairerFor returns the impairer of the call an SSRC belongs to, or nil
+func impairerFor(ssrc uint32) *impairer {
+	if impairerCount.Load() == 0 {
+		return nil
+	}
+	callID, ok := GetCodecNegotiator().CallID(ssrc)
+	if !ok {
+		return nil
+	}
+	impairersMu.RLock()
+	defer impairersMu.RUnlock()
+	return impairers[callID]
+}
+
+// impairer applies a call's impairment to its outgoing packets
+type impairer struct {
+	mu       sync.Mutex
+	settings ImpairmentSettings
+	rng      *rand.Rand
+	held     map[uint32]*heldPacket // per SSRC, waiting to be overtaken
+	closed   bool
+	pending  sync.WaitGroup // delayed packets not yet sent
+}
+
+// heldPacket is a packet held back for reordering
+type heldPacket struct {
+	packet *RTPPacket
+	copies int
+	send   func(*RTPPacket)
+	timer  *time.Timer
+}
+
+func newImpairer(settings ImpairmentSettings) *impairer {
+	return &impairer{
+		settings: settings,
+		rng:      rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64())),
+		held:     make(map[uint32]*heldPacket),
+	}
+}
+
+// impair passes a packet through the impairment, calling send for every
+// copy of it that goes out, now or later. The packet is copied when it is
+// held back or delayed, so the caller may reuse it
+func (i *impairer) impair(packet *RTPPacket, send func(*RTPPacket)) {
+	i.mu.Lock()
+	if i.closed {
+		i.mu.Unlock()
+		return
+	}
+	s := i.settings
+	if i.chance(s.LossPercent) {
+		i.mu.Unlock()
+		impairedPackets.WithLabelValues("dropped").Inc()
+		return
+	}
+	copies := 1
+	if i.chance(s.DuplicatePercent) {
+		copies = 2
+		impairedPackets.WithLabelValues("duplicated").Inc()
+	}
+
+	// A held packet of the stream goes out right behind this one
+	var out []*heldPacket
+	if held, ok := i.held[packet.SSRC]; ok {
+		held.timer.Stop()
+		delete(i.held, packet.SSRC)
+		out = append(out, &heldPacket{packet: packet, copies: copies, send: send}, held)
+	} else if i.chance(s.ReorderPercent) {
+		held := &heldPacket{packet: cloneRTPPacket(packet), copies: copies, send: send}
+		held.timer = time.AfterFunc(impairmentReorderHold, func() { i.release(packet.SSRC, held) })
+		i.held[packet.SSRC] = held
+		i.mu.Unlock()
+		impairedPackets.WithLabelValues("reordered").Inc()
+		return
+	} else {
+		out = append(out, &heldPacket{packet: packet, copies: copies, send: send})
+	}
+
+	// Schedule the delayed copies while holding the lock, and send the
+	// rest after releasing it
+	var now []*heldPacket
+	for _, h := range out {
+		for c := 0; c < h.copies; c++ {
+			if delay := i.delay(s); delay > 0 {
+				i.later(h, delay)
+			} else {
+				now = append(now, h)
+			}
+		}
+	}
+	i.mu.Unlock()
+	for _, h := range now {
+		h.send(h.packet)
+	}
+}
+
+// release sends a held packet no later packet overtook
+func (i *impairer) release(ssrc uint32, held *heldPacket) {
+	i.mu.Lock()
+	if i.closed || i.held[ssrc] != held {
+		i.mu.Unlock()
+		return
+	}
+	delete(i.held, ssrc)
+	s := i.settings
+	var now int
+	for c := 0; c < held.copies; c++ {
+		if delay := i.delay(s); delay > 0 {
+			i.later(held, delay)
+		} else {
+			now++
+		}
+	}
+	i.mu.Unlock()
+	for ; now > 0; now-- {
+		held.send(held.packet)
+	}
+}
+
+// later sends a copy of a packet after delay; the caller holds i.mu
+func (i *impairer) later(h *heldPacket, delay time.Duration) {
+	packet := cloneRTPPacket(h.packet)
+	i.pending.Add(1)
+	impairedPackets.WithLabelValues("delayed").Inc()
+	time.AfterFunc(delay, func() {
+		defer i.pending.Done()
+		i.mu.Lock()
+		closed := i.closed
+		i.mu.Unlock()
+		if !closed {
+			h.send(packet)
+		}
+	})
+}
+
+// chance returns true percent percent of the time; the caller holds i.mu
+func (i *impairer) chance(percent float64) bool {
+	return percent > 0 && i.rng.Float64()*100 < percent
+}
+
+// delay draws the delay of one packet, within 0 and the configured
+// maximum; the caller holds i.mu
+func (i *impairer) delay(s ImpairmentSettings) time.Duration {
+	d := float64(s.Delay)
+	if s.Jitter > 0 {
+		switch s.Distribution {
+		case JitterNormal:
+			d += i.rng.NormFloat64() * float64(s.Jitter)
+		default:
+			d += (i.rng.Float64()*2 - 1) * float64(s.Jitter)
+		}
+	}
+	return time.Duration(math.Min(math.Max(d, 0), float64(impairmentMaxDelay())))
+}
+
+// drain sends the packets held back for reordering and waits for the
+// delayed ones to go out
+func (i *impairer) drain() {
+	i.mu.Lock()
+	held := i.held
+	i.held = make(map[uint32]*heldPacket)
+	i.mu.Unlock()
+	for _, h := range held {
+		h.timer.Stop()
+		for c := 0; c < h.copies; c++ {
+			h.send(h.packet)
+		}
+	}
+	i.pending.Wait()
+}
+
+// close drops the packets still held back or delayed
+func (i *impairer) close() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.closed = true
+	for ssrc, h := range i.held {
+		h.timer.Stop()
+		delete(i.held, ssrc)
+	}
+}
+
+// cloneRTPPacket copies a packet and its buffers out of the pools
+func cloneRTPPacket(packet *RTPPacket) *RTPPacket {
+	clone := *packet
+	clone.CSRC = append([]uint32(nil), packet.CSRC...)
+	clone.ExtensionData = append([]byte(nil), packet.ExtensionData...)
+	clone.Payload = append([]byte(nil), packet.Payload...)
+	return &clone
+}
@@ -0,0 +1,180 @@
+package internal
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	ng "karl/internal/ng_protocol"
+)
+
+// sentPackets collects what an impairer sends, in order
+type sentPackets struct {
+	mu   sync.Mutex
+	seqs []uint16
+}
+
+func (s *sentPackets) send(p *RTPPacket) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seqs = append(s.seqs, p.SequenceNumber)
+}
+
+func (s *sentPackets) get() []uint16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]uint16(nil), s.seqs...)
+}
+
+func impairPackets(i *impairer, sent *sentPackets, count int) {
+	for seq := 1; seq <= count; seq++ {
+		i.impair(&RTPPacket{SSRC: 7, SequenceNumber: uint16(seq), Payload: []byte{byte(seq)}}, sent.send)
+	}
+}
+
+func TestImpairer_LossAndDuplication(t *testing.T) {
+	var sent sentPackets
+	impairPackets(newImpairer(ImpairmentSettings{LossPercent: 100}), &sent, 10)
+	if got := sent.get(); len(got) != 0 {
+		t.Errorf("sent %v with 100%% loss", got)
+	}
+
+	impairPackets(newImpairer(ImpairmentSettings{DuplicatePercent: 100}), &sent, 3)
+	if got := sent.get(); len(got) != 6 || got[0] != 1 || got[1] != 1 || got[5] != 3 {
+		t.Errorf("sent %v, want every packet twice", got)
+	}
+}
+
+func TestImpairer_Reorder(t *testing.T) {
+	var sent sentPackets
+	i := newImpairer(ImpairmentSettings{ReorderPercent: 100})
+	impairPackets(i, &sent, 5)
+
+	// Every other packet is held back and overtaken by the next; the last
+	// one goes out on its own
+	if got := sent.get(); len(got) != 4 || got[0] != 2 || got[1] != 1 || got[2] != 4 || got[3] != 3 {
+		t.Fatalf("sent %v, want 2 1 4 3", got)
+	}
+	time.Sleep(2 * impairmentReorderHold)
+	if got := sent.get(); len(got) != 5 || got[4] != 5 {
+		t.Errorf("sent %v, want the held packet released", got)
+	}
+}
+
+func TestImpairer_Delay(t *testing.T) {
+	var sent sentPackets
+	i := newImpairer(ImpairmentSettings{Delay: 30 * time.Millisecond})
+	start := time.Now()
+	impairPackets(i, &sent, 3)
+	if got := sent.get(); len(got) != 0 {
+		t.Fatalf("sent %v before the delay", got)
+	}
+	i.drain()
+	if got := sent.get(); len(got) != 3 {
+		t.Errorf("sent %v after draining, want 3 packets", got)
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("packets went out after %v, want 30ms", elapsed)
+	}
+
+	// Closing drops what is still delayed
+	i = newImpairer(ImpairmentSettings{Delay: 20 * time.Millisecond})
+	sent = sentPackets{}
+	impairPackets(i, &sent, 3)
+	i.close()
+	i.pending.Wait()
+	if got := sent.get(); len(got) != 0 {
+		t.Errorf("sent %v after close", got)
+	}
+}
+
+func TestImpairer_JitterBounds(t *testing.T) {
+	for _, distribution := range []string{JitterUniform, JitterNormal} {
+		s := ImpairmentSettings{Delay: 50 * time.Millisecond, Jitter: 40 * time.Millisecond, Distribution: distribution}
+		i := newImpairer(s)
+		var lowest, highest time.Duration = time.Hour, 0
+		for n := 0; n < 1000; n++ {
+			d := i.delay(s)
+			if d < 0 || d > impairmentMaxDelay() {
+				t.Fatalf("%s: delay %v out of bounds", distribution, d)
+			}
+			if distribution == JitterUniform && (d < 10*time.Millisecond || d > 90*time.Millisecond) {
+				t.Fatalf("uniform: delay %v outside 50ms ± 40ms", d)
+			}
+			lowest, highest = min(lowest, d), max(highest, d)
+		}
+		if highest-lowest < 40*time.Millisecond {
+			t.Errorf("%s: delays only spread %v-%v", distribution, lowest, highest)
+		}
+	}
+}
+
+func TestApplyImpairmentFlags(t *testing.T) {
+	defer ConfigureImpairment(nil)
+	const callID = "impairment-flags"
+	flags := ng.ParseFlags([]string{"impair-loss=5", "impair-delay=40", "impair-jitter=10"})
+
+	ConfigureImpairment(nil)
+	applyImpairmentFlags(callID, flags)
+	if _, ok := CallImpairment(callID); ok {
+		t.Fatal("impairment applied while disabled")
+	}
+
+	ConfigureImpairment(&ImpairmentConfig{Enabled: true})
+	applyImpairmentFlags(callID, flags)
+	s, ok := CallImpairment(callID)
+	if !ok || s.LossPercent != 5 || s.Delay != 40*time.Millisecond || s.Jitter != 10*time.Millisecond {
+		t.Fatalf("impairment = %+v %v", s, ok)
+	}
+
+	// Options without impairment leave it; impair-off removes it
+	applyImpairmentFlags(callID, ng.ParseFlags([]string{"agc"}))
+	if _, ok := CallImpairment(callID); !ok {
+		t.Fatal("impairment removed by an offer without impair options")
+	}
+	applyImpairmentFlags(callID, ng.ParseFlags([]string{"impair-off"}))
+	if _, ok := CallImpairment(callID); ok {
+		t.Fatal("impairment left after impair-off")
+	}
+
+	// Removing the call removes its impairment
+	applyImpairmentFlags(callID, flags)
+	GetCodecNegotiator().RemoveCall(callID)
+	if _, ok := CallImpairment(callID); ok {
+		t.Error("impairment left after the call was removed")
+	}
+}
+
+func TestForwardRTPPacket_Impaired(t *testing.T) {
+	const callID, ssrc = "impairment-forward", 0x494d5052
+	negotiator := GetCodecNegotiator()
+	negotiator.BindSSRC(ssrc, callID, true)
+	defer negotiator.RemoveCall(callID)
+	handler := &mockRTPHandler{}
+	RegisterRTPHandler(ssrc, handler)
+	defer UnregisterRTPHandler(ssrc)
+
+	SetImpairment(callID, ImpairmentSettings{LossPercent: 100})
+	forwardRTPPacket(&RTPPacket{SSRC: ssrc, SequenceNumber: 1}, 0)
+	if handler.handleCalled {
+		t.Fatal("packet forwarded through 100% loss")
+	}
+
+	SetImpairment(callID, ImpairmentSettings{})
+	forwardRTPPacket(&RTPPacket{SSRC: ssrc, SequenceNumber: 2}, 0)
+	if !handler.handleCalled {
+		t.Error("packet not forwarded once the impairment was cleared")
+	}
+}
+
+func TestValidateImpairmentConfig(t *testing.T) {
+	for _, tt := range []struct {
+		maxDelay int
+		valid    bool
+	}{{0, true}, {2000, true}, {-1, false}, {maxImpairmentDelay + 1, false}} {
+		cfg := &Config{Impairment: &ImpairmentConfig{Enabled: true, MaxDelay: tt.maxDelay}}
+		if err := ValidateImpairmentConfig(cfg); (err == nil) != tt.valid {
+			t.Errorf("max_delay %d: err = %v", tt.maxDelay, err)
+		}
+	}
+}
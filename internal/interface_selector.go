@@ -1,9 +1,13 @@
 package internal
 
 import (
+	"context"
+	"fmt"
+	"log"
 	"net"
 	"strings"
 	"sync"
+	"time"
 )
 
 // InterfaceSelector handles network interface selection for media routing
@@ -18,12 +22,14 @@ type InterfaceSelector struct {
 
 // InterfaceInfo holds interface configuration
 type InterfaceInfo struct {
-	Name          string
-	LocalAddress  string   // Address to bind to
-	AdvertiseAddr string   // Address to advertise in SDP (for NAT)
-	Port          int      // Optional port override
-	LocalAddrs    []string // Additional local addresses
-	IsInternal    bool     // Whether this is an internal interface
+	Name                  string
+	LocalAddress          string   // Address to bind to
+	AdvertiseAddr         string   // Address to advertise in SDP (for NAT)
+	InternalAdvertiseAddr string   // Address to advertise to internal peers
+	Port                  int      // Optional port override
+	LocalAddrs            []string // Additional local addresses
+	IsInternal            bool     // Whether this is an internal interface
+	STUNServer            string   // Server that discovers AdvertiseAddr
 }
 
 // PeerRule defines routing rules based on peer address
@@ -45,21 +51,52 @@ func NewInterfaceSelector(config *Config) *InterfaceSelector {
 	if config.Integration.Interfaces != nil {
 		for name, ifaceCfg := range config.Integration.Interfaces {
 			is.interfaces[name] = &InterfaceInfo{
-				Name:          name,
-				LocalAddress:  ifaceCfg.Address,
-				AdvertiseAddr: ifaceCfg.AdvertiseAddr,
-				Port:          ifaceCfg.Port,
-				IsInternal:    strings.Contains(strings.ToLower(name), "internal"),
+				Name:                  name,
+				LocalAddress:          ifaceCfg.Address,
+				AdvertiseAddr:         ifaceCfg.AdvertiseAddr,
+				InternalAdvertiseAddr: ifaceCfg.InternalAdvertiseAddr,
+				Port:                  ifaceCfg.Port,
+				IsInternal:            strings.Contains(strings.ToLower(name), "internal"),
+				STUNServer:            ifaceCfg.STUNServer,
 			}
+			is.addNetworks(name, ifaceCfg.Networks)
+		}
+	}
+
+	// Named bindings of a multi-homed host, e.g. "core" and "access"
+	for i, binding := range config.Transport.Interfaces {
+		address, err := ResolveInterfaceAddress(binding.Address)
+		if err != nil {
+			log.Printf("Warning: ignoring interface %q: %v", binding.Name, err)
+			continue
+		}
+		is.interfaces[binding.Name] = &InterfaceInfo{
+			Name:                  binding.Name,
+			LocalAddress:          address,
+			AdvertiseAddr:         binding.AdvertiseAddr,
+			InternalAdvertiseAddr: binding.InternalAdvertiseAddr,
+			Port:                  binding.Port,
+			IsInternal:            strings.Contains(strings.ToLower(binding.Name), "internal"),
+			STUNServer:            binding.STUNServer,
+		}
+		is.addNetworks(binding.Name, binding.Networks)
+		if i == 0 {
+			is.defaultIface = binding.Name
 		}
 	}
 
 	// Set up default interfaces based on config
-	if config.Integration.MediaIP != "" {
+	// With internal networks configured, peers inside them are sent the
+	// media IP instead of the public one
+	if config.Integration.MediaIP != "" && is.defaultIface == "" {
 		is.interfaces["default"] = &InterfaceInfo{
 			Name:          "default",
 			LocalAddress:  config.Integration.MediaIP,
 			AdvertiseAddr: config.Integration.PublicIP,
+			STUNServer:    config.Integration.STUNServer,
+		}
+		if len(config.Integration.InternalNetworks) > 0 {
+			is.interfaces["default"].InternalAdvertiseAddr = config.Integration.MediaIP
 		}
 		is.defaultIface = "default"
 	}
@@ -73,27 +110,33 @@ func NewInterfaceSelector(config *Config) *InterfaceSelector {
 			IsInternal:    true,
 		}
 	}
-	if config.Integration.PublicIP != "" {
+	if config.Integration.PublicIP != "" || config.Integration.STUNServer != "" {
 		is.interfaces["external"] = &InterfaceInfo{
 			Name:          "external",
 			LocalAddress:  config.Integration.MediaIP,
 			AdvertiseAddr: config.Integration.PublicIP,
 			IsInternal:    false,
+			STUNServer:    config.Integration.STUNServer,
 		}
 	}
 
-	// Add common private networks as internal
-	internalCIDRs := []string{
-		"10.0.0.0/8",
-		"172.16.0.0/12",
-		"192.168.0.0/16",
-		"127.0.0.0/8",
-		"fc00::/7",  // IPv6 ULA
-		"fe80::/10", // IPv6 link-local
+	// Configured internal networks replace the common private ranges
+	internalCIDRs := config.Integration.InternalNetworks
+	if len(internalCIDRs) == 0 {
+		internalCIDRs = []string{
+			"10.0.0.0/8",
+			"172.16.0.0/12",
+			"192.168.0.0/16",
+			"127.0.0.0/8",
+			"fc00::/7",  // IPv6 ULA
+			"fe80::/10", // IPv6 link-local
+		}
 	}
 	for _, cidr := range internalCIDRs {
 		if _, ipnet, err := net.ParseCIDR(cidr); err == nil {
 			is.internalNets = append(is.internalNets, ipnet)
+		} else {
+			log.Printf("Warning: ignoring invalid internal network %q: %v", cidr, err)
 		}
 	}
 
@@ -104,7 +147,11 @@ func NewInterfaceSelector(config *Config) *InterfaceSelector {
 func (is *InterfaceSelector) SelectInterface(interfaceName string, direction []string, peerAddr net.IP) *InterfaceInfo {
 	is.mu.RLock()
 	defer is.mu.RUnlock()
+	return is.selectInterface(interfaceName, direction, peerAddr)
+}
 
+// selectInterface implements SelectInterface; the caller holds is.mu
+func (is *InterfaceSelector) selectInterface(interfaceName string, direction []string, peerAddr net.IP) *InterfaceInfo {
 	// If explicit interface name is provided, use it
 	if interfaceName != "" {
 		if iface, ok := is.interfaces[interfaceName]; ok {
@@ -168,11 +215,25 @@ func (is *InterfaceSelector) SelectInterface(interfaceName string, direction []s
 
 // GetAdvertiseAddress returns the address to advertise in SDP
 func (is *InterfaceSelector) GetAdvertiseAddress(interfaceName string, peerAddr net.IP) string {
-	iface := is.SelectInterface(interfaceName, nil, peerAddr)
+	return is.AdvertiseAddressFor(interfaceName, nil, peerAddr)
+}
+
+// AdvertiseAddressFor returns the address to advertise in SDP sent to
+// peerAddr. Peers in an internal network get the interface's internal
+// address when it has one, everyone else its external (NAT) address
+func (is *InterfaceSelector) AdvertiseAddressFor(interfaceName string, direction []string, peerAddr net.IP) string {
+	is.mu.RLock()
+	defer is.mu.RUnlock()
+
+	iface := is.selectInterface(interfaceName, direction, peerAddr)
 	if iface == nil {
 		return ""
 	}
 
+	if peerAddr != nil && iface.InternalAdvertiseAddr != "" && is.isInternal(peerAddr) {
+		return iface.InternalAdvertiseAddr
+	}
+
 	// If we have an advertise address (NAT), use it
 	if iface.AdvertiseAddr != "" {
 		return iface.AdvertiseAddr
@@ -182,6 +243,197 @@ func (is *InterfaceSelector) GetAdvertiseAddress(interfaceName string, peerAddr
 	return iface.LocalAddress
 }
 
+// SetAdvertiseAddress replaces an interface's external advertised address
+func (is *InterfaceSelector) SetAdvertiseAddress(interfaceName, addr string) bool {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	iface, ok := is.interfaces[interfaceName]
+	if !ok {
+		return false
+	}
+	iface.AdvertiseAddr = addr
+	return true
+}
+
+// RefreshSTUN rediscovers the advertised address of every interface with a
+// STUN server. An interface keeps its previous address when discovery fails
+func (is *InterfaceSelector) RefreshSTUN(timeout time.Duration) {
+	is.mu.RLock()
+	targets := make(map[string]InterfaceInfo)
+	for name, iface := range is.interfaces {
+		if iface.STUNServer != "" {
+			targets[name] = *iface
+		}
+	}
+	is.mu.RUnlock()
+
+	for name, target := range targets {
+		ip, err := DiscoverPublicIP(target.STUNServer, target.LocalAddress, timeout)
+		if err != nil {
+			log.Printf("Warning: STUN discovery for interface %s failed: %v", name, err)
+			continue
+		}
+		is.mu.Lock()
+		if iface, ok := is.interfaces[name]; ok && iface.AdvertiseAddr != ip.String() {
+			log.Printf("Interface %s advertised address changed from %q to %s", name, iface.AdvertiseAddr, ip)
+			iface.AdvertiseAddr = ip.String()
+		}
+		is.mu.Unlock()
+	}
+}
+
+// HasSTUN reports whether any interface discovers its address by STUN
+func (is *InterfaceSelector) HasSTUN() bool {
+	is.mu.RLock()
+	defer is.mu.RUnlock()
+	for _, iface := range is.interfaces {
+		if iface.STUNServer != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// StartSTUNRefresh runs RefreshSTUN now and then every interval until ctx
+// is done, so a changed NAT mapping reaches new SDP without a restart
+func (is *InterfaceSelector) StartSTUNRefresh(ctx context.Context, interval time.Duration) {
+	if !is.HasSTUN() {
+		return
+	}
+	go func() {
+		is.RefreshSTUN(stunTimeout)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				is.RefreshSTUN(stunTimeout)
+			}
+		}
+	}()
+}
+
+// LocalAddressFor returns the interface a call leg uses, picked like its
+// advertised address, and the local address its media is bound to
+func (is *InterfaceSelector) LocalAddressFor(interfaceName string, direction []string, peerAddr net.IP) (name, address string) {
+	is.mu.RLock()
+	defer is.mu.RUnlock()
+
+	iface := is.selectInterface(interfaceName, direction, peerAddr)
+	if iface == nil {
+		return "", ""
+	}
+	return iface.Name, iface.LocalAddress
+}
+
+// EgressAddress returns the local address to send media to dst from: the
+// address of the interface whose networks contain dst, or of the interface
+// picked for its network. It returns nil to let the kernel choose
+func (is *InterfaceSelector) EgressAddress(dst net.IP) net.IP {
+	is.mu.RLock()
+	defer is.mu.RUnlock()
+
+	iface := is.selectInterface("", nil, dst)
+	if iface == nil {
+		return nil
+	}
+	ip := net.ParseIP(iface.LocalAddress)
+	if ip == nil || ip.IsUnspecified() || (ip.To4() == nil) != (dst.To4() == nil) {
+		return nil
+	}
+	return ip
+}
+
+// HasPeerRules reports whether any interface is picked by the peer's network
+func (is *InterfaceSelector) HasPeerRules() bool {
+	is.mu.RLock()
+	defer is.mu.RUnlock()
+	return len(is.peerRules) > 0
+}
+
+// HasInterface reports whether an interface is configured
+func (is *InterfaceSelector) HasInterface(name string) bool {
+	is.mu.RLock()
+	defer is.mu.RUnlock()
+	_, ok := is.interfaces[name]
+	return ok
+}
+
+// addNetworks routes the destinations in networks through an interface;
+// the caller holds is.mu or owns is
+func (is *InterfaceSelector) addNetworks(name string, networks []string) {
+	for _, cidr := range networks {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Printf("Warning: ignoring invalid network %q of interface %q: %v", cidr, name, err)
+			continue
+		}
+		is.peerRules = append(is.peerRules, PeerRule{Network: ipnet, Interface: name})
+	}
+}
+
+// ResolveInterfaceAddress returns address when it is an IP, or the first
+// address of the OS interface it names, preferring IPv4
+func ResolveInterfaceAddress(address string) (string, error) {
+	if address == "" {
+		return "", fmt.Errorf("no address")
+	}
+	if ip := net.ParseIP(address); ip != nil {
+		return address, nil
+	}
+	iface, err := net.InterfaceByName(address)
+	if err != nil {
+		return "", err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", err
+	}
+	var found net.IP
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			return ipnet.IP.String(), nil
+		}
+		if found == nil {
+			found = ipnet.IP
+		}
+	}
+	if found == nil {
+		return "", fmt.Errorf("interface %s has no usable address", address)
+	}
+	return found.String(), nil
+}
+
+// ValidateTransportInterfaces checks the named interface bindings
+func ValidateTransportInterfaces(cfg *Config) error {
+	seen := make(map[string]bool)
+	for i, binding := range cfg.Transport.Interfaces {
+		if binding.Name == "" {
+			return fmt.Errorf("transport.interfaces[%d]: name is required", i)
+		}
+		if seen[binding.Name] {
+			return fmt.Errorf("transport.interfaces[%d]: duplicate interface %q", i, binding.Name)
+		}
+		seen[binding.Name] = true
+		if _, err := ResolveInterfaceAddress(binding.Address); err != nil {
+			return fmt.Errorf("transport.interfaces[%d] %s: invalid address %q: %w", i, binding.Name, binding.Address, err)
+		}
+		for _, cidr := range binding.Networks {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return fmt.Errorf("transport.interfaces[%d] %s: invalid network %q", i, binding.Name, cidr)
+			}
+		}
+	}
+	return nil
+}
+
 // GetLocalAddress returns the local address to bind to
 func (is *InterfaceSelector) GetLocalAddress(interfaceName string) string {
 	is.mu.RLock()
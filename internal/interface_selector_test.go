@@ -3,6 +3,9 @@ package internal
 import (
 	"net"
 	"testing"
+	"time"
+
+	"github.com/pion/stun"
 )
 
 func TestNewInterfaceSelector(t *testing.T) {
@@ -348,3 +351,197 @@ func TestInterfaceSelector_GetInterfaceNames(t *testing.T) {
 		t.Errorf("Expected 3 interface names, got %d", len(names))
 	}
 }
+
+func TestInterfaceSelector_AdvertiseAddressByPeerNetwork(t *testing.T) {
+	config := &Config{
+		Integration: IntegrationConfig{
+			MediaIP:          "10.244.1.7",
+			PublicIP:         "203.0.113.50",
+			InternalNetworks: []string{"10.0.0.0/8"},
+			Interfaces: map[string]*NetworkInterfaceConfig{
+				"pbx": {
+					Address:               "10.244.1.7",
+					AdvertiseAddr:         "198.51.100.9",
+					InternalAdvertiseAddr: "10.96.0.20",
+				},
+			},
+		},
+	}
+	is := NewInterfaceSelector(config)
+
+	tests := []struct {
+		name  string
+		iface string
+		peer  net.IP
+		want  string
+	}{
+		{"default, no peer", "", nil, "203.0.113.50"},
+		{"default, internal peer", "", net.ParseIP("10.1.2.3"), "10.244.1.7"},
+		{"default, external peer", "", net.ParseIP("198.18.0.1"), "203.0.113.50"},
+		{"private peer outside internal_networks", "", net.ParseIP("192.168.1.10"), "203.0.113.50"},
+		{"named, internal peer", "pbx", net.ParseIP("10.1.2.3"), "10.96.0.20"},
+		{"named, external peer", "pbx", net.ParseIP("198.18.0.1"), "198.51.100.9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := is.AdvertiseAddressFor(tt.iface, nil, tt.peer); got != tt.want {
+				t.Errorf("AdvertiseAddressFor(%q, %v) = %s, want %s", tt.iface, tt.peer, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInterfaceSelector_AdvertiseAddressByDirection(t *testing.T) {
+	config := &Config{
+		Integration: IntegrationConfig{
+			MediaIP:  "10.244.1.7",
+			PublicIP: "203.0.113.50",
+		},
+	}
+	is := NewInterfaceSelector(config)
+
+	if got := is.AdvertiseAddressFor("", []string{"internal", "external"}, nil); got != "203.0.113.50" {
+		t.Errorf("towards external = %s, want 203.0.113.50", got)
+	}
+	if got := is.AdvertiseAddressFor("", []string{"internal"}, nil); got != "10.244.1.7" {
+		t.Errorf("towards internal = %s, want 10.244.1.7", got)
+	}
+}
+
+// startTestSTUNServer answers binding requests with mapped as the
+// XOR-MAPPED-ADDRESS and returns the server address
+func startTestSTUNServer(t *testing.T, mapped net.IP) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			req := &stun.Message{Raw: append([]byte(nil), buf[:n]...)}
+			if err := req.Decode(); err != nil {
+				continue
+			}
+			res, err := stun.Build(stun.NewTransactionIDSetter(req.TransactionID), stun.BindingSuccess,
+				&stun.XORMappedAddress{IP: mapped, Port: from.Port}, stun.Fingerprint)
+			if err != nil {
+				continue
+			}
+			conn.WriteToUDP(res.Raw, from)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestDiscoverPublicIP(t *testing.T) {
+	server := startTestSTUNServer(t, net.ParseIP("203.0.113.77"))
+
+	ip, err := DiscoverPublicIP("stun:"+server, "127.0.0.1", time.Second)
+	if err != nil {
+		t.Fatalf("DiscoverPublicIP failed: %v", err)
+	}
+	if ip.String() != "203.0.113.77" {
+		t.Errorf("DiscoverPublicIP = %s, want 203.0.113.77", ip)
+	}
+}
+
+func TestInterfaceSelector_RefreshSTUN(t *testing.T) {
+	server := startTestSTUNServer(t, net.ParseIP("203.0.113.77"))
+	config := &Config{
+		Integration: IntegrationConfig{
+			MediaIP:    "127.0.0.1",
+			STUNServer: server,
+		},
+	}
+	is := NewInterfaceSelector(config)
+
+	if got := is.GetAdvertiseAddress("external", nil); got != "127.0.0.1" {
+		t.Errorf("before discovery = %s, want the local address", got)
+	}
+
+	is.RefreshSTUN(time.Second)
+
+	for _, name := range []string{"default", "external"} {
+		if got := is.GetAdvertiseAddress(name, nil); got != "203.0.113.77" {
+			t.Errorf("%s after discovery = %s, want 203.0.113.77", name, got)
+		}
+	}
+}
+
+func TestInterfaceSelector_TransportInterfaces(t *testing.T) {
+	config := &Config{
+		Transport: TransportConfig{
+			Interfaces: []NetworkInterfaceConfig{
+				{Name: "core", Address: "10.0.0.1", Networks: []string{"10.0.0.0/8"}},
+				{Name: "access", Address: "192.0.2.1", AdvertiseAddr: "198.51.100.1", Networks: []string{"192.0.2.0/24"}},
+			},
+		},
+	}
+	is := NewInterfaceSelector(config)
+
+	if !is.HasInterface("core") || !is.HasInterface("access") {
+		t.Fatalf("interfaces = %v, want core and access", is.GetInterfaceNames())
+	}
+	if !is.HasPeerRules() {
+		t.Error("networks did not add peer rules")
+	}
+
+	// The first binding is the default
+	if name, addr := is.LocalAddressFor("", nil, nil); name != "core" || addr != "10.0.0.1" {
+		t.Errorf("default = %s %s, want core 10.0.0.1", name, addr)
+	}
+	if name, addr := is.LocalAddressFor("access", nil, nil); name != "access" || addr != "192.0.2.1" {
+		t.Errorf("by name = %s %s, want access 192.0.2.1", name, addr)
+	}
+	if got := is.AdvertiseAddressFor("access", nil, nil); got != "198.51.100.1" {
+		t.Errorf("advertised = %s, want 198.51.100.1", got)
+	}
+
+	tests := []struct {
+		dst  string
+		want string
+	}{
+		{"10.1.2.3", "10.0.0.1"},
+		{"192.0.2.50", "192.0.2.1"},
+		{"203.0.113.9", "10.0.0.1"},
+		{"2001:db8::1", ""},
+	}
+	for _, tt := range tests {
+		got := is.EgressAddress(net.ParseIP(tt.dst))
+		if (got == nil && tt.want != "") || (got != nil && got.String() != tt.want) {
+			t.Errorf("EgressAddress(%s) = %v, want %q", tt.dst, got, tt.want)
+		}
+	}
+}
+
+func TestValidateTransportInterfaces(t *testing.T) {
+	tests := []struct {
+		name       string
+		interfaces []NetworkInterfaceConfig
+		wantErr    bool
+	}{
+		{"valid", []NetworkInterfaceConfig{{Name: "core", Address: "10.0.0.1", Networks: []string{"10.0.0.0/8"}}}, false},
+		{"os interface", []NetworkInterfaceConfig{{Name: "local", Address: "lo"}}, false},
+		{"missing name", []NetworkInterfaceConfig{{Address: "10.0.0.1"}}, true},
+		{"duplicate", []NetworkInterfaceConfig{{Name: "a", Address: "10.0.0.1"}, {Name: "a", Address: "10.0.0.2"}}, true},
+		{"unknown interface", []NetworkInterfaceConfig{{Name: "a", Address: "no-such-if0"}}, true},
+		{"bad network", []NetworkInterfaceConfig{{Name: "a", Address: "10.0.0.1", Networks: []string{"10.0.0.0"}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{Transport: TransportConfig{Interfaces: tt.interfaces}}
+			err := ValidateTransportInterfaces(cfg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateTransportInterfaces() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Kernel offload moves pure relay sessions, which Karl forwards without
+// touching the payload, into the XDP program in deploy/xdp/karl_xdp.c.
+// The program rewrites the addresses of packets arriving on a leg's port
+// and sends them on to the peer without a trip through user space. Karl
+// only manages the program's forwarding map, the way rtpengine drives its
+// kernel module.
+
+// DefaultKernelOffloadMap is where the XDP program pins its forwarding map
+const DefaultKernelOffloadMap = "/sys/fs/bpf/karl_forward"
+
+// kernelOffloadFlags are session flags that need Karl to see every packet
+var kernelOffloadFlags = []string{
+	"recording", "media_blocked", "media_silenced", "dtmf_blocked",
+	"forwarding", "playing_media", T38FallbackFlag, MusicOnHoldFlag, TranscribingFlag, CallParkedFlag,
+}
+
+var kernelOffloadSessions = promauto.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "karl_kernel_offload_sessions",
+		Help: "Number of sessions relayed by the XDP forwarding program",
+	},
+)
+
+// KernelForwardRule is one direction of a relayed stream: packets arriving
+// at Karl's LocalIP:LocalPort are sent on from SourceIP:SourcePort to the
+// peer at DestIP:DestPort
+type KernelForwardRule struct {
+	LocalIP    net.IP
+	LocalPort  int
+	SourceIP   net.IP
+	SourcePort int
+	DestIP     net.IP
+	DestPort   int
+}
+
+// KernelForwarder installs forwarding rules in the kernel
+type KernelForwarder interface {
+	AddRule(rule KernelForwardRule) error
+	RemoveRule(localIP net.IP, localPort int) error
+	Close() error
+}
+
+// kernelRuleKey identifies a rule by the address packets arrive on
+type kernelRuleKey struct {
+	ip   [4]byte
+	port int
+}
+
+func ruleKey(rule KernelForwardRule) kernelRuleKey {
+	key := kernelRuleKey{port: rule.LocalPort}
+	copy(key.ip[:], rule.LocalIP.To4())
+	return key
+}
+
+// KernelOffload keeps a KernelForwarder's rules in step with the sessions
+// that can be relayed in the kernel
+type KernelOffload struct {
+	forwarder KernelForwarder
+	mu        sync.Mutex
+	sessions  map[string][]KernelForwardRule
+}
+
+// NewKernelOffload creates an offload manager on top of a forwarder
+func NewKernelOffload(forwarder KernelForwarder) *KernelOffload {
+	return &KernelOffload{
+		forwarder: forwarder,
+		sessions:  make(map[string][]KernelForwardRule),
+	}
+}
+
+// Update installs the rules of a session that can be relayed in the kernel
+// and removes those of a session that no longer can, such as one that
+// started recording. It reports whether the session is offloaded
+func (o *KernelOffload) Update(session *MediaSession) (bool, error) {
+	rules, ok := kernelForwardRules(session)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	// Drop the rules a re-INVITE or a flag change made stale
+	keep := make(map[kernelRuleKey]bool, len(rules))
+	for _, rule := range rules {
+		keep[ruleKey(rule)] = true
+	}
+	for _, old := range o.sessions[session.ID] {
+		if !ok || !keep[ruleKey(old)] {
+			_ = o.forwarder.RemoveRule(old.LocalIP, old.LocalPort)
+		}
+	}
+	delete(o.sessions, session.ID)
+
+	if ok {
+		for i, rule := range rules {
+			if err := o.forwarder.AddRule(rule); err != nil {
+				for _, added := range rules[:i] {
+					_ = o.forwarder.RemoveRule(added.LocalIP, added.LocalPort)
+				}
+				kernelOffloadSessions.Set(float64(len(o.sessions)))
+				return false, fmt.Errorf("failed to offload session %s: %w", session.ID, err)
+			}
+		}
+		o.sessions[session.ID] = rules
+	}
+	kernelOffloadSessions.Set(float64(len(o.sessions)))
+	return ok, nil
+}
+
+// Release removes a session's rules, returning its media to user space
+func (o *KernelOffload) Release(sessionID string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.releaseLocked(sessionID)
+	kernelOffloadSessions.Set(float64(len(o.sessions)))
+}
+
+func (o *KernelOffload) releaseLocked(sessionID string) {
+	for _, rule := range o.sessions[sessionID] {
+		if err := o.forwarder.RemoveRule(rule.LocalIP, rule.LocalPort); err != nil {
+			rtpLog.Error("Failed to remove kernel forwarding rule", "ip", rule.LocalIP, "port", rule.LocalPort, "error", err)
+		}
+	}
+	delete(o.sessions, sessionID)
+}
+
+// IsOffloaded reports whether a session is relayed in the kernel
+func (o *KernelOffload) IsOffloaded(sessionID string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	_, ok := o.sessions[sessionID]
+	return ok
+}
+
+// Count returns the number of offloaded sessions
+func (o *KernelOffload) Count() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.sessions)
+}
+
+// Close removes every rule and closes the forwarder
+func (o *KernelOffload) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for id := range o.sessions {
+		o.releaseLocked(id)
+	}
+	kernelOffloadSessions.Set(0)
+	return o.forwarder.Close()
+}
+
+// kernelForwardRules returns the rules relaying a session in the kernel,
+// or false if Karl has to handle its packets. The offer Karl passes to the
+// callee carries the caller leg's ports and the answer carries the callee
+// leg's, so packets arriving on one leg's ports go to that leg's peer from
+// the other leg's ports
+func kernelForwardRules(session *MediaSession) ([]KernelForwardRule, bool) {
+	session.RLock()
+	defer session.RUnlock()
+
+	caller, callee := session.CallerLeg, session.CalleeLeg
+	if caller == nil || callee == nil {
+		return nil, false
+	}
+	if session.AlwaysTranscode || len(session.TranscodeCodecs) > 0 || session.SIPREC ||
+		session.T38Enabled || session.T38Gateway || (session.Recording != nil && session.Recording.Active) ||
+		session.CallerCrypto != nil || session.CalleeCrypto != nil {
+		return nil, false
+	}
+	for _, flag := range kernelOffloadFlags {
+		if session.Flags[flag] {
+			return nil, false
+		}
+	}
+	if !relayableLeg(caller) || !relayableLeg(callee) || len(caller.Streams) > 1 || len(callee.Streams) > 1 {
+		return nil, false
+	}
+	if !GetCodecNegotiator().IsPassthrough(session.CallID) {
+		return nil, false
+	}
+	// Header extensions the legs negotiated differently are rewritten
+	if len(caller.Extmap) > 0 && !caller.Extmap.equal(callee.Extmap) ||
+		len(callee.Extmap) > 0 && !callee.Extmap.equal(caller.Extmap) {
+		return nil, false
+	}
+	if _, impaired := CallImpairment(session.CallID); impaired {
+		return nil, false
+	}
+	// Published DTMF is read from the media
+	if dtmfEventsEnabled() {
+		return nil, false
+	}
+	// The media ACL and the source checks drop packets in user space; the
+	// kernel rules match only the destination and would forward them
+	if mediaACLFiltersAddresses() {
+		return nil, false
+	}
+	for _, leg := range []*CallLeg{caller, callee} {
+		if mode := legSourceCheck(session, leg, mediaSourceCheck()); mode != SourceCheckOff && mode != SourceCheckAny {
+			return nil, false
+		}
+	}
+
+	rules := make([]KernelForwardRule, 0, 4)
+	for _, pair := range [][2]*CallLeg{{caller, callee}, {callee, caller}} {
+		in, out := pair[0], pair[1]
+		rules = append(rules, KernelForwardRule{
+			LocalIP: in.LocalIP, LocalPort: in.LocalPort,
+			SourceIP: out.LocalIP, SourcePort: out.LocalPort,
+			DestIP: in.IP, DestPort: in.Port,
+		})
+		if !in.RTCPMux && in.LocalRTCPPort > 0 && in.RTCPPort > 0 && out.LocalRTCPPort > 0 {
+			rules = append(rules, KernelForwardRule{
+				LocalIP: in.LocalIP, LocalPort: in.LocalRTCPPort,
+				SourceIP: out.LocalIP, SourcePort: out.LocalRTCPPort,
+				DestIP: in.IP, DestPort: in.RTCPPort,
+			})
+		}
+	}
+	return rules, true
+}
+
+// relayableLeg reports whether a leg's packets can pass through unchanged:
+// plain IPv4 RTP with no SRTP, ICE or per-leg media control
+func relayableLeg(leg *CallLeg) bool {
+	if leg.IP.To4() == nil || leg.IP.IsUnspecified() || leg.Port <= 0 ||
+		leg.LocalIP.To4() == nil || leg.LocalIP.IsUnspecified() || leg.LocalPort <= 0 {
+		return false
+	}
+	if leg.SRTPParams != nil || leg.ICECredentials != nil {
+		return false
+	}
+	switch leg.Transport {
+	case "", TransportRTP, "RTP/AVPF":
+	default:
+		return false
+	}
+	return !leg.mediaControlled() && !leg.Parked && !leg.DTMFBlocked && !leg.T38Enabled && !leg.T38Gateway
+}
@@ -0,0 +1,113 @@
+//go:build linux
+
+package internal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// bpfForwardKey and bpfForwardValue match struct forward_key and struct
+// forward_value in deploy/xdp/karl_xdp.c. Addresses and ports are in
+// network byte order
+type bpfForwardKey struct {
+	Addr [4]byte
+	Port [2]byte
+	_    uint16
+}
+
+type bpfForwardValue struct {
+	SrcAddr [4]byte
+	DstAddr [4]byte
+	SrcPort [2]byte
+	DstPort [2]byte
+}
+
+// bpfMapForwarder writes rules into the forwarding map the XDP program
+// pinned in the BPF filesystem
+type bpfMapForwarder struct {
+	fd int
+}
+
+// OpenKernelForwarder opens the forwarding map pinned at mapPath by the
+// loaded XDP program
+func OpenKernelForwarder(mapPath string) (KernelForwarder, error) {
+	path, err := unix.BytePtrFromString(mapPath)
+	if err != nil {
+		return nil, err
+	}
+	attr := struct {
+		Pathname  uint64
+		BpfFd     uint32
+		FileFlags uint32
+	}{Pathname: uint64(uintptr(unsafe.Pointer(path)))}
+	fd, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_OBJ_GET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	runtime.KeepAlive(path)
+	if errno != 0 {
+		return nil, fmt.Errorf("failed to open BPF map %s: %w", mapPath, errno)
+	}
+	return &bpfMapForwarder{fd: int(fd)}, nil
+}
+
+// AddRule adds or replaces the rule for packets arriving at rule.LocalIP:LocalPort
+func (f *bpfMapForwarder) AddRule(rule KernelForwardRule) error {
+	key, err := bpfKey(rule.LocalIP, rule.LocalPort)
+	if err != nil {
+		return err
+	}
+	var value bpfForwardValue
+	if copy(value.SrcAddr[:], rule.SourceIP.To4()) != 4 || copy(value.DstAddr[:], rule.DestIP.To4()) != 4 {
+		return fmt.Errorf("kernel forwarding needs IPv4 addresses, got %s and %s", rule.SourceIP, rule.DestIP)
+	}
+	binary.BigEndian.PutUint16(value.SrcPort[:], uint16(rule.SourcePort))
+	binary.BigEndian.PutUint16(value.DstPort[:], uint16(rule.DestPort))
+	return f.mapCall(unix.BPF_MAP_UPDATE_ELEM, unsafe.Pointer(&key), unsafe.Pointer(&value), unix.BPF_ANY)
+}
+
+// RemoveRule deletes the rule for packets arriving at localIP:localPort
+func (f *bpfMapForwarder) RemoveRule(localIP net.IP, localPort int) error {
+	key, err := bpfKey(localIP, localPort)
+	if err != nil {
+		return err
+	}
+	err = f.mapCall(unix.BPF_MAP_DELETE_ELEM, unsafe.Pointer(&key), nil, 0)
+	if err == unix.ENOENT {
+		return nil
+	}
+	return err
+}
+
+// Close closes the map; the rules stay with the pinned map
+func (f *bpfMapForwarder) Close() error {
+	return unix.Close(f.fd)
+}
+
+func bpfKey(ip net.IP, port int) (bpfForwardKey, error) {
+	var key bpfForwardKey
+	if copy(key.Addr[:], ip.To4()) != 4 {
+		return key, fmt.Errorf("kernel forwarding needs an IPv4 address, got %s", ip)
+	}
+	binary.BigEndian.PutUint16(key.Port[:], uint16(port))
+	return key, nil
+}
+
+// mapCall runs a bpf(2) map element command
+func (f *bpfMapForwarder) mapCall(cmd uintptr, key, value unsafe.Pointer, flags uint64) error {
+	attr := struct {
+		MapFd uint32
+		_     uint32
+		Key   uint64
+		Value uint64
+		Flags uint64
+	}{MapFd: uint32(f.fd), Key: uint64(uintptr(key)), Value: uint64(uintptr(value)), Flags: flags}
+	_, _, errno := unix.Syscall(unix.SYS_BPF, cmd, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
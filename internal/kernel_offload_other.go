@@ -0,0 +1,10 @@
+//go:build !linux
+
+package internal
+
+import "errors"
+
+// OpenKernelForwarder needs the Linux XDP program
+func OpenKernelForwarder(mapPath string) (KernelForwarder, error) {
+	return nil, errors.New("kernel offload is only supported on Linux")
+}
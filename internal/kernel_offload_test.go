@@ -0,0 +1,176 @@
+package internal
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// fakeForwarder records the rules an offload manager installs
+type fakeForwarder struct {
+	rules  map[kernelRuleKey]KernelForwardRule
+	fail   bool
+	closed bool
+}
+
+func newFakeForwarder() *fakeForwarder {
+	return &fakeForwarder{rules: make(map[kernelRuleKey]KernelForwardRule)}
+}
+
+func (f *fakeForwarder) AddRule(rule KernelForwardRule) error {
+	if f.fail {
+		return errors.New("map full")
+	}
+	f.rules[ruleKey(rule)] = rule
+	return nil
+}
+
+func (f *fakeForwarder) RemoveRule(localIP net.IP, localPort int) error {
+	delete(f.rules, ruleKey(KernelForwardRule{LocalIP: localIP, LocalPort: localPort}))
+	return nil
+}
+
+func (f *fakeForwarder) Close() error {
+	f.closed = true
+	return nil
+}
+
+// newOffloadSession sets up an answered G.711 relay call
+func newOffloadSession(t *testing.T, manager *SessionManager, registry *SessionRegistry, callID string) *MediaSession {
+	t.Helper()
+	session := registry.CreateSession(callID, "from-1")
+	caller, err := manager.AllocateLeg(session, "from-1", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	callee, err := manager.AllocateLeg(session, "to-1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caller.IP, caller.Port, caller.RTCPPort = net.ParseIP("198.51.100.1"), 20000, 20001
+	callee.IP, callee.Port, callee.RTCPPort = net.ParseIP("198.51.100.2"), 30000, 30001
+	caller.Transport, callee.Transport = TransportRTP, TransportRTP
+
+	n := GetCodecNegotiator()
+	n.SetOfferCodecs(callID, []CodecInfo{{PayloadType: 0, Name: "PCMU", ClockRate: 8000}, {PayloadType: 8, Name: "PCMA", ClockRate: 8000}})
+	n.SetAnswerCodecs(callID, []CodecInfo{{PayloadType: 0, Name: "PCMU", ClockRate: 8000}})
+	t.Cleanup(func() { n.RemoveCall(callID) })
+	return session
+}
+
+func TestKernelOffload_RelaySession(t *testing.T) {
+	manager, registry, _ := newTestSessionManager(t)
+	forwarder := newFakeForwarder()
+	offload := NewKernelOffload(forwarder)
+	manager.SetKernelOffload(offload)
+
+	session := newOffloadSession(t, manager, registry, "offload-call")
+	manager.UpdateOffload(session)
+	if !offload.IsOffloaded(session.ID) || len(forwarder.rules) != 4 {
+		t.Fatalf("expected RTP and RTCP rules for both legs, got %d", len(forwarder.rules))
+	}
+
+	// The callee sends to the caller leg's port and reaches the caller
+	// from the callee leg's port
+	caller, callee := session.CallerLeg, session.CalleeLeg
+	rule, ok := forwarder.rules[ruleKey(KernelForwardRule{LocalIP: caller.LocalIP, LocalPort: caller.LocalPort})]
+	if !ok {
+		t.Fatal("expected a rule for the caller leg's port")
+	}
+	if rule.DestPort != 20000 || !rule.DestIP.Equal(caller.IP) || rule.SourcePort != callee.LocalPort {
+		t.Errorf("unexpected rule %+v", rule)
+	}
+	rule = forwarder.rules[ruleKey(KernelForwardRule{LocalIP: callee.LocalIP, LocalPort: callee.LocalRTCPPort})]
+	if rule.DestPort != 30001 || rule.SourcePort != caller.LocalRTCPPort {
+		t.Errorf("unexpected RTCP rule %+v", rule)
+	}
+
+	// Recording needs every packet, so the session returns to user space
+	session.SetFlag("recording", true)
+	manager.UpdateOffload(session)
+	if offload.IsOffloaded(session.ID) || len(forwarder.rules) != 0 {
+		t.Errorf("expected recording to release the session, %d rules left", len(forwarder.rules))
+	}
+	session.SetFlag("recording", false)
+	manager.UpdateOffload(session)
+
+	manager.TerminateCall("offload-call")
+	if offload.Count() != 0 || len(forwarder.rules) != 0 {
+		t.Errorf("expected rules to be removed with the call, %d left", len(forwarder.rules))
+	}
+
+	if err := manager.StopKernelOffload(); err != nil || !forwarder.closed {
+		t.Errorf("expected the forwarder to be closed: %v", err)
+	}
+}
+
+func TestKernelOffload_Ineligible(t *testing.T) {
+	manager, registry, _ := newTestSessionManager(t)
+	forwarder := newFakeForwarder()
+	offload := NewKernelOffload(forwarder)
+	manager.SetKernelOffload(offload)
+
+	tests := []struct {
+		name  string
+		setup func(s *MediaSession)
+	}{
+		{"transcoding", func(s *MediaSession) {
+			GetCodecNegotiator().SetAnswerCodecs(s.CallID, []CodecInfo{{PayloadType: 111, Name: "opus", ClockRate: 48000}})
+		}},
+		{"srtp", func(s *MediaSession) { s.CallerLeg.SRTPParams = &SRTPParameters{} }},
+		{"bridged", func(s *MediaSession) { s.CallerCrypto = NewPlainCrypto("RTP/AVP") }},
+		{"ice", func(s *MediaSession) { s.CalleeLeg.ICECredentials = &ICECredentials{Username: "u"} }},
+		{"ipv6", func(s *MediaSession) { s.CalleeLeg.IP = net.ParseIP("2001:db8::1") }},
+		{"no answer", func(s *MediaSession) { s.CalleeLeg = nil }},
+		{"media blocked", func(s *MediaSession) { s.Flags["media_blocked"] = true }},
+		{"forced direction", func(s *MediaSession) { s.CalleeLeg.ForcedDirection = SDPDirectionSendOnly }},
+		{"ptime", func(s *MediaSession) { GetCodecNegotiator().SetPtime(s.CallID, true, 40) }},
+		{"impairment", func(s *MediaSession) { SetImpairment(s.CallID, ImpairmentSettings{LossPercent: 1}) }},
+	}
+	for i, tt := range tests {
+		session := newOffloadSession(t, manager, registry, "ineligible-"+string(rune('a'+i)))
+		tt.setup(session)
+		manager.UpdateOffload(session)
+		if offload.IsOffloaded(session.ID) {
+			t.Errorf("%s: expected the session to stay in user space", tt.name)
+		}
+	}
+
+	// The kernel cannot apply the media ACL or a source check
+	acl, err := NewMediaACL(&MediaACLConfig{Allow: []string{"198.51.100.0/24"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl.Start()
+	session := newOffloadSession(t, manager, registry, "offload-acl")
+	manager.UpdateOffload(session)
+	acl.Stop()
+	if offload.IsOffloaded(session.ID) {
+		t.Error("expected a session behind the media ACL to stay in user space")
+	}
+	session = newOffloadSession(t, manager, registry, "offload-source-check")
+	session.SourceCheck = SourceCheckSDP
+	manager.UpdateOffload(session)
+	if offload.IsOffloaded(session.ID) {
+		t.Error("expected a source checked session to stay in user space")
+	}
+	session = newOffloadSession(t, manager, registry, "offload-strict-source")
+	session.CalleeLeg.StrictSource = true
+	manager.UpdateOffload(session)
+	if offload.IsOffloaded(session.ID) {
+		t.Error("expected a strict-source session to stay in user space")
+	}
+
+	// A forwarder error leaves no partial rules behind
+	forwarder.fail = true
+	session = newOffloadSession(t, manager, registry, "offload-full")
+	if ok, err := offload.Update(session); ok || err == nil || len(forwarder.rules) != 0 {
+		t.Errorf("expected the offload to fail cleanly, got %v, %v and %d rules", ok, err, len(forwarder.rules))
+	}
+}
+
+func TestOpenKernelForwarder_MissingMap(t *testing.T) {
+	if _, err := OpenKernelForwarder("/nonexistent/karl_forward"); err == nil {
+		t.Error("expected an error without a pinned forwarding map")
+	}
+}
@@ -0,0 +1,226 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// defaultKeyframeInterval spaces the keyframe requests to one video sender
+// when rtp_settings.pli_interval is not set
+const defaultKeyframeInterval = 500 * time.Millisecond
+
+var keyframeRequestsSent = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "karl_keyframe_requests_total",
+		Help: "Total keyframe requests sent to the senders of relayed video",
+	},
+	[]string{"type", "reason"}, // pli, fir; forwarded, loss, receiver
+)
+
+// keyframeRequester asks the senders of relayed video for keyframes with
+// RTCP PLI or FIR: for a receiver that asked for one, after a packet was
+// lost on the way in, and when the video starts going to a new receiver
+type keyframeRequester struct {
+	registry *SessionRegistry
+	send     func(conn *net.UDPConn, packet []byte, addr *net.UDPAddr, mux bool) error
+	interval time.Duration
+
+	mu      sync.Mutex
+	streams map[uint32]*keyframeStream
+}
+
+// keyframeStream is the state of one relayed video stream
+type keyframeStream struct {
+	lastRequest time.Time
+	firSeq      uint8
+	lastSeq     uint16
+	started     bool
+	receiver    string // address the stream was last relayed to
+}
+
+// keyframeTarget is where the RTCP feedback about a video stream goes: the
+// RTCP address of the m= section its sender signalled it in
+type keyframeTarget struct {
+	addr       *net.UDPAddr
+	conn       *net.UDPConn
+	mux        bool
+	senderSSRC uint32 // the receiver's stream in the same section, 0 if unknown
+}
+
+// SetKeyframeSender makes the registry ask the senders of its video streams
+// for keyframes, sending RTCP through send, such as RTPControl.SendRTCPFrom,
+// at most once per interval for each stream. nil stops it
+func (sr *SessionRegistry) SetKeyframeSender(send func(conn *net.UDPConn, packet []byte, addr *net.UDPAddr, mux bool) error, interval time.Duration) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	sr.keyframes = nil
+	if send == nil {
+		return
+	}
+	if interval <= 0 {
+		interval = defaultKeyframeInterval
+	}
+	sr.keyframes = &keyframeRequester{
+		registry: sr,
+		send:     send,
+		interval: interval,
+		streams:  make(map[uint32]*keyframeStream),
+	}
+}
+
+// RequestKeyframe asks the sender of a relayed video stream for a keyframe,
+// with a FIR when fir is set and a PLI otherwise, such as on behalf of a
+// receiver that sent one. Requests closer together than the interval are
+// dropped
+func (sr *SessionRegistry) RequestKeyframe(mediaSSRC uint32, fir bool) error {
+	keyframes := sr.keyframeRequester()
+	if keyframes == nil {
+		return fmt.Errorf("keyframe requests are not enabled")
+	}
+	return keyframes.request(mediaSSRC, fir, "forwarded")
+}
+
+// keyframeRequester returns the registry's keyframe requester, nil if unset
+func (sr *SessionRegistry) keyframeRequester() *keyframeRequester {
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+	return sr.keyframes
+}
+
+// keyframeTarget returns where to send the feedback about a video stream
+func (sr *SessionRegistry) keyframeTarget(ssrc uint32) (keyframeTarget, bool) {
+	session, leg, ok := sr.GetSessionBySSRC(ssrc)
+	if !ok || leg == nil {
+		return keyframeTarget{}, false
+	}
+
+	session.mu.RLock()
+	defer session.mu.RUnlock()
+
+	stream := leg.streamOf(ssrc)
+	if stream == nil || stream.MediaType != MediaVideo {
+		return keyframeTarget{}, false
+	}
+	target := keyframeTarget{addr: stream.rtcpAddr(leg), mux: stream.RTCPMux}
+	if stream.LocalPort == leg.LocalPort {
+		target.addr, target.mux = leg.RTCPAddr(), leg.RTCPMux
+	}
+	if target.addr == nil {
+		return keyframeTarget{}, false
+	}
+
+	// The feedback goes out from the ports the sender was given: the peer
+	// leg's section
+	peer := session.CalleeLeg
+	if leg == session.CalleeLeg {
+		peer = session.CallerLeg
+	}
+	if peer != nil && peer != leg {
+		if out := peer.streamAt(stream.Index); out != nil {
+			target.senderSSRC = out.SSRC
+			target.conn = out.RTCPConn
+			if target.mux {
+				target.conn = out.Conn
+			}
+		}
+	}
+	return target, true
+}
+
+// request sends a PLI or FIR to the sender of a video stream unless one
+// went out less than the interval ago
+func (k *keyframeRequester) request(ssrc uint32, fir bool, reason string) error {
+	target, ok := k.registry.keyframeTarget(ssrc)
+	if !ok {
+		return fmt.Errorf("SSRC %d is not a relayed video stream", ssrc)
+	}
+
+	k.mu.Lock()
+	stream := k.streamLocked(ssrc)
+	now := time.Now()
+	if !stream.lastRequest.IsZero() && now.Sub(stream.lastRequest) < k.interval {
+		k.mu.Unlock()
+		return nil
+	}
+	stream.lastRequest = now
+	if fir {
+		stream.firSeq++
+	}
+	firSeq := stream.firSeq
+	k.mu.Unlock()
+
+	kind := "pli"
+	var packet rtcp.Packet = &rtcp.PictureLossIndication{SenderSSRC: target.senderSSRC, MediaSSRC: ssrc}
+	if fir {
+		kind = "fir"
+		packet = &rtcp.FullIntraRequest{
+			SenderSSRC: target.senderSSRC,
+			MediaSSRC:  ssrc,
+			FIR:        []rtcp.FIREntry{{SSRC: ssrc, SequenceNumber: firSeq}},
+		}
+	}
+	data, err := packet.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := k.send(target.conn, data, target.addr, target.mux); err != nil {
+		return err
+	}
+	keyframeRequestsSent.WithLabelValues(kind, reason).Inc()
+	return nil
+}
+
+// relayed notes a video packet relayed to addr. It asks for a keyframe when
+// packets were lost before it, or when the stream now goes to a receiver it
+// did not go to before, which cannot decode it until the next keyframe
+func (k *keyframeRequester) relayed(ssrc uint32, seq uint16, addr *net.UDPAddr) {
+	receiver := addr.String()
+
+	k.mu.Lock()
+	stream := k.streamLocked(ssrc)
+	reason := ""
+	delta := seq - stream.lastSeq
+	switch {
+	case stream.receiver != receiver:
+		reason = "receiver"
+	case stream.started && delta > 1 && delta < 0x8000:
+		reason = "loss"
+	}
+	if !stream.started || delta < 0x8000 {
+		stream.lastSeq, stream.started = seq, true
+	}
+	stream.receiver = receiver
+	k.mu.Unlock()
+
+	if reason == "" {
+		return
+	}
+	if err := k.request(ssrc, false, reason); err != nil && IsDebugLoggingEnabled() {
+		workerLog.Debug("Keyframe request failed", append(streamAttrs(ssrc), "reason", reason, "error", err)...)
+	}
+}
+
+// forget drops the state of a stream that left its session
+func (k *keyframeRequester) forget(ssrc uint32) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.streams, ssrc)
+}
+
+// streamLocked returns the state of a stream, creating it; the caller holds
+// k.mu
+func (k *keyframeRequester) streamLocked(ssrc uint32) *keyframeStream {
+	stream, ok := k.streams[ssrc]
+	if !ok {
+		stream = &keyframeStream{}
+		k.streams[ssrc] = stream
+	}
+	return stream
+}
@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+// mediaSink records where relayed RTP was sent
+type mediaSink struct {
+	mu   sync.Mutex
+	sent []string
+}
+
+func (s *mediaSink) send(conn *net.UDPConn, packets [][]byte, addr *net.UDPAddr) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for range packets {
+		s.sent = append(s.sent, addr.String())
+	}
+	return len(packets), nil
+}
+
+func TestSessionRegistry_VideoRelayAndKeyframeRequests(t *testing.T) {
+	registry := NewSessionRegistry(time.Hour)
+	defer registry.Stop()
+	session := registry.CreateSession("video-call", "from-tag")
+
+	caller := &CallLeg{Tag: "from-tag", IP: net.ParseIP("192.0.2.10"), Port: 30000, LocalPort: 20000,
+		Streams: []*MediaStream{
+			{Index: 0, MediaType: MediaAudio, Port: 30000, RTCPPort: 30001, SSRC: 0xA1, LocalPort: 20000},
+			{Index: 1, MediaType: MediaVideo, Port: 30002, RTCPPort: 30003, SSRC: 0xB1, LocalPort: 20002},
+		}}
+	callee := &CallLeg{Tag: "to-tag", IP: net.ParseIP("198.51.100.20"), Port: 40000, LocalPort: 21000,
+		Streams: []*MediaStream{
+			{Index: 0, MediaType: MediaAudio, Port: 40000, RTCPPort: 40001, SSRC: 0xA2, LocalPort: 21000},
+			{Index: 1, MediaType: MediaVideo, IP: net.ParseIP("198.51.100.21"), Port: 40002, RTCPPort: 40002,
+				RTCPMux: true, SSRC: 0xB2, LocalPort: 21002},
+		}}
+	if err := registry.SetCallerLeg(session.ID, caller); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.SetCalleeLeg(session.ID, callee); err != nil {
+		t.Fatal(err)
+	}
+	for _, ssrc := range []uint32{0xA1, 0xB1} {
+		if err := registry.RegisterSSRC(session.ID, ssrc, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, ssrc := range []uint32{0xA2, 0xB2} {
+		if err := registry.RegisterSSRC(session.ID, ssrc, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if caller.SSRC != 0xA1 || callee.SSRC != 0xA2 {
+		t.Fatalf("video SSRCs replaced the legs' audio SSRCs: %x, %x", caller.SSRC, callee.SSRC)
+	}
+
+	media := &mediaSink{}
+	feedback := &rtcpSink{packets: make(map[string][][]rtcp.Packet), mux: make(map[string]bool)}
+	registry.SetMediaSender(media.send)
+	defer registry.SetMediaSender(nil)
+	registry.SetKeyframeSender(feedback.send, time.Millisecond)
+
+	// Video goes to the callee's video section, not its audio port, and
+	// the caller is asked for a keyframe for the new receiver
+	forwarder := registry.forwarder
+	if err := forwarder.Handle(&RTPPacket{SSRC: 0xB1, SequenceNumber: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := forwarder.Handle(&RTPPacket{SSRC: 0xA1, SequenceNumber: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if len(media.sent) != 2 || media.sent[0] != "198.51.100.21:40002" || media.sent[1] != "198.51.100.20:40000" {
+		t.Fatalf("relayed to %v", media.sent)
+	}
+	toCaller := feedback.sent("192.0.2.10:30003")
+	if len(toCaller) != 1 {
+		t.Fatalf("sent %d keyframe requests to the caller's video RTCP port", len(toCaller))
+	}
+	if pli, ok := toCaller[0][0].(*rtcp.PictureLossIndication); !ok || pli.MediaSSRC != 0xB1 || pli.SenderSSRC != 0xB2 {
+		t.Errorf("expected a PLI for the caller's video, got %+v", toCaller[0][0])
+	}
+
+	// In-order packets need no keyframe, a gap does
+	time.Sleep(2 * time.Millisecond)
+	_ = forwarder.Handle(&RTPPacket{SSRC: 0xB1, SequenceNumber: 2})
+	if n := len(feedback.sent("192.0.2.10:30003")); n != 1 {
+		t.Fatalf("sent %d keyframe requests without loss", n)
+	}
+	_ = forwarder.Handle(&RTPPacket{SSRC: 0xB1, SequenceNumber: 5})
+	if n := len(feedback.sent("192.0.2.10:30003")); n != 2 {
+		t.Fatalf("sent %d keyframe requests after loss", n)
+	}
+
+	// A FIR from the caller is passed on to the callee's video sender on its
+	// muxed port; a second one within the interval is dropped
+	registry.SetKeyframeSender(feedback.send, time.Hour)
+	if err := registry.RequestKeyframe(0xB2, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.RequestKeyframe(0xB2, true); err != nil {
+		t.Fatal(err)
+	}
+	toCallee := feedback.sent("198.51.100.21:40002")
+	if len(toCallee) != 1 || !feedback.mux["198.51.100.21:40002"] {
+		t.Fatalf("sent %d keyframe requests to the callee", len(toCallee))
+	}
+	fir, ok := toCallee[0][0].(*rtcp.FullIntraRequest)
+	if !ok || len(fir.FIR) != 1 || fir.FIR[0].SSRC != 0xB2 || fir.FIR[0].SequenceNumber != 1 {
+		t.Errorf("expected a FIR for the callee's video, got %+v", toCallee[0][0])
+	}
+
+	// Audio is not video
+	if err := registry.RequestKeyframe(0xA1, false); err == nil {
+		t.Error("expected no keyframe request for an audio stream")
+	}
+}
@@ -0,0 +1,400 @@
+// Package loadtest originates simulated calls against a running Karl
+// instance: each call sets up two legs over the NG protocol, sends RTP in
+// both directions through Karl and measures what comes back out
+package loadtest
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"karl/internal"
+	ng "karl/internal/ng_protocol"
+)
+
+// Codec is a codec the simulated endpoints can send. The payload is filler
+// of the codec's size; Karl relays it without decoding
+type Codec struct {
+	Name        string
+	PayloadType uint8
+	ClockRate   uint32
+	BytesPerMs  int // payload bytes per millisecond of audio
+}
+
+// codecs lists the codecs a load test can offer
+var codecs = map[string]Codec{
+	"pcmu": {Name: "PCMU", PayloadType: 0, ClockRate: 8000, BytesPerMs: 8},
+	"pcma": {Name: "PCMA", PayloadType: 8, ClockRate: 8000, BytesPerMs: 8},
+	"g722": {Name: "G722", PayloadType: 9, ClockRate: 8000, BytesPerMs: 8},
+	"opus": {Name: "opus", PayloadType: 111, ClockRate: 48000, BytesPerMs: 4},
+}
+
+// LookupCodec returns a codec by name: pcmu, pcma, g722 or opus
+func LookupCodec(name string) (Codec, error) {
+	codec, ok := codecs[strings.ToLower(name)]
+	if !ok {
+		return Codec{}, fmt.Errorf("unknown codec %q, expected pcmu, pcma, g722 or opus", name)
+	}
+	return codec, nil
+}
+
+// Config describes a load test
+type Config struct {
+	NGAddr   string        // NG UDP address of the instance under test
+	Secret   string        // NG signing key, empty for unsigned messages
+	LocalIP  string        // address the simulated endpoints bind and put in their SDP
+	Calls    int           // calls to originate
+	Rate     float64       // calls started per second, 0 to start them all at once
+	Duration time.Duration // media time of each call
+	Codec    string        // pcmu, pcma, g722 or opus
+	Ptime    time.Duration // packetization time
+	Jitter   time.Duration // each packet is sent up to this much late
+	Loss     float64       // percent of packets the senders drop on purpose
+	Timeout  time.Duration // wait for each NG response
+}
+
+// DefaultConfig returns a ten call, 30 second PCMU test against a local
+// instance
+func DefaultConfig() Config {
+	return Config{
+		NGAddr:   "127.0.0.1:22222",
+		LocalIP:  "127.0.0.1",
+		Calls:    10,
+		Rate:     10,
+		Duration: 30 * time.Second,
+		Codec:    "pcmu",
+		Ptime:    20 * time.Millisecond,
+		Timeout:  2 * time.Second,
+	}
+}
+
+// Validate checks a load test configuration
+func (c *Config) Validate() error {
+	if c.NGAddr == "" {
+		return errors.New("NG address is required")
+	}
+	if net.ParseIP(c.LocalIP) == nil {
+		return fmt.Errorf("invalid local IP %q", c.LocalIP)
+	}
+	if c.Calls < 1 {
+		return fmt.Errorf("invalid call count %d", c.Calls)
+	}
+	if c.Rate < 0 {
+		return fmt.Errorf("invalid call rate %g", c.Rate)
+	}
+	if c.Duration <= 0 {
+		return fmt.Errorf("invalid call duration %s", c.Duration)
+	}
+	if _, err := LookupCodec(c.Codec); err != nil {
+		return err
+	}
+	if c.Ptime < 10*time.Millisecond || c.Ptime > 120*time.Millisecond {
+		return fmt.Errorf("invalid ptime %s, expected 10ms-120ms", c.Ptime)
+	}
+	if c.Jitter < 0 {
+		return fmt.Errorf("invalid jitter %s", c.Jitter)
+	}
+	if c.Loss < 0 || c.Loss > 100 {
+		return fmt.Errorf("invalid loss %g%%, expected 0-100", c.Loss)
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("invalid NG timeout %s", c.Timeout)
+	}
+	return nil
+}
+
+// drainTime is how long a receiver keeps reading after its call's media
+// ends, for packets still on their way through Karl
+const drainTime = 500 * time.Millisecond
+
+// Run originates the calls, ramping up at cfg.Rate, and returns once every
+// call has ended or ctx is done
+func Run(ctx context.Context, cfg Config) (*Report, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	codec, _ := LookupCodec(cfg.Codec)
+
+	results := make([]CallResult, cfg.Calls)
+	runID := strconv.FormatInt(time.Now().UnixNano(), 36)
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.Calls; i++ {
+		if cfg.Rate > 0 && i > 0 {
+			due := start.Add(time.Duration(float64(i) / cfg.Rate * float64(time.Second)))
+			select {
+			case <-time.After(time.Until(due)):
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			results = results[:i]
+			break
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			call := &simulatedCall{
+				cfg:    cfg,
+				codec:  codec,
+				callID: fmt.Sprintf("loadtest-%s-%d", runID, i),
+				rng:    rand.New(rand.NewSource(start.UnixNano() + int64(i))),
+			}
+			results[i] = call.run(ctx)
+		}(i)
+	}
+	wg.Wait()
+
+	return newReport(results, time.Since(start)), nil
+}
+
+// simulatedCall is one call: a caller and a callee endpoint, each with its
+// own media socket, connected through Karl
+type simulatedCall struct {
+	cfg    Config
+	codec  Codec
+	callID string
+	rng    *rand.Rand // used before the streams start, which get their own
+}
+
+func (c *simulatedCall) run(ctx context.Context) CallResult {
+	result := CallResult{CallID: c.callID}
+
+	caller, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(c.cfg.LocalIP)})
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer caller.Close()
+	callee, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(c.cfg.LocalIP)})
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer callee.Close()
+
+	client, err := newNGClient(c.cfg.NGAddr, c.cfg.Secret, c.callID, c.cfg.Timeout)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer client.close()
+
+	// The offer's SDP goes to the callee and names where it sends; the
+	// answer's goes to the caller
+	setupStart := time.Now()
+	calleeDst, err := c.negotiate(client, "offer", caller)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	callerDst, err := c.negotiate(client, "answer", callee)
+	if err != nil {
+		result.Error = err.Error()
+		c.delete(client)
+		return result
+	}
+	result.SetupMs = float64(time.Since(setupStart).Microseconds()) / 1000
+	result.Established = true
+
+	end := time.Now().Add(c.cfg.Duration)
+	forward := &stream{dst: callerDst, ssrc: c.rng.Uint32(), seed: c.rng.Int63()}
+	backward := &stream{dst: calleeDst, ssrc: c.rng.Uint32(), seed: c.rng.Int63()}
+
+	var wg sync.WaitGroup
+	wg.Add(4)
+	go func() { defer wg.Done(); forward.send(ctx, caller, c.cfg, c.codec, end) }()
+	go func() { defer wg.Done(); backward.send(ctx, callee, c.cfg, c.codec, end) }()
+	go func() { defer wg.Done(); forward.receive(callee, c.codec, end.Add(drainTime)) }()
+	go func() { defer wg.Done(); backward.receive(caller, c.codec, end.Add(drainTime)) }()
+	wg.Wait()
+
+	if err := c.delete(client); err != nil {
+		result.Error = err.Error()
+	}
+	result.CallerToCallee = forward.result(c.codec)
+	result.CalleeToCaller = backward.result(c.codec)
+	return result
+}
+
+// negotiate sends an offer or answer describing conn and returns the
+// media address in Karl's rewritten SDP
+func (c *simulatedCall) negotiate(client *ngClient, command string, conn *net.UDPConn) (*net.UDPAddr, error) {
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	desc := internal.NewSDPSession("karl-loadtest", uint64(c.rng.Int63()), 1, c.cfg.LocalIP, "karl loadtest")
+	media := internal.NewSDPMedia("audio", port, "RTP/AVP", []internal.CodecInfo{{
+		PayloadType: c.codec.PayloadType,
+		Name:        c.codec.Name,
+		ClockRate:   c.codec.ClockRate,
+		Channels:    1,
+	}})
+	media.WithValueAttribute("ptime", strconv.Itoa(int(c.cfg.Ptime/time.Millisecond)))
+	media.WithPropertyAttribute("sendrecv")
+	desc.MediaDescriptions = append(desc.MediaDescriptions, media)
+
+	req := map[string]interface{}{
+		"command":  command,
+		"call-id":  c.callID,
+		"from-tag": c.callID + "-caller",
+		"sdp":      internal.MarshalSDP(desc),
+	}
+	if command == "answer" {
+		req["to-tag"] = c.callID + "-callee"
+	}
+	resp, err := client.request(req)
+	if err != nil {
+		return nil, err
+	}
+
+	answered, err := internal.ParseSDP(ng.DictGetString(resp, "sdp"))
+	if err != nil {
+		return nil, fmt.Errorf("%s returned %w", command, err)
+	}
+	primary := internal.PrimaryMedia(answered)
+	if primary == nil {
+		return nil, fmt.Errorf("%s returned no audio stream", command)
+	}
+	ip := net.ParseIP(internal.SDPConnectionAddress(answered, primary))
+	if ip == nil {
+		return nil, fmt.Errorf("%s returned no media address", command)
+	}
+	return &net.UDPAddr{IP: ip, Port: primary.MediaName.Port.Value}, nil
+}
+
+func (c *simulatedCall) delete(client *ngClient) error {
+	_, err := client.request(map[string]interface{}{
+		"command":  "delete",
+		"call-id":  c.callID,
+		"from-tag": c.callID + "-caller",
+	})
+	return err
+}
+
+// stream is the media one endpoint sends and the other receives. The
+// first 8 payload bytes carry the send time, so the one-way delay through
+// Karl is measured on a single clock
+type stream struct {
+	dst  *net.UDPAddr
+	ssrc uint32
+	seed int64
+
+	// Written by the sender, read after both sides are done
+	expected int // packets due, including the ones dropped on purpose
+	sent     int
+
+	// Written by the receiver
+	received     int
+	jitter       float64 // RFC 3550 interarrival jitter, in ms
+	lastTransit  float64
+	firstArrival time.Time
+	firstTS      uint32
+	delaySum     time.Duration
+}
+
+func (s *stream) send(ctx context.Context, conn *net.UDPConn, cfg Config, codec Codec, end time.Time) {
+	rng := rand.New(rand.NewSource(s.seed))
+	packet := make([]byte, 12+int(cfg.Ptime/time.Millisecond)*codec.BytesPerMs)
+	packet[0] = 0x80
+	packet[1] = codec.PayloadType & 0x7f
+	binary.BigEndian.PutUint32(packet[8:12], s.ssrc)
+	timestampStep := uint32(uint64(codec.ClockRate) * uint64(cfg.Ptime) / uint64(time.Second))
+	seq, timestamp := uint16(rng.Uint32()), rng.Uint32()
+
+	start := time.Now()
+	for n := 0; ; n++ {
+		due := start.Add(time.Duration(n) * cfg.Ptime)
+		if !due.Before(end) {
+			return
+		}
+		if cfg.Jitter > 0 {
+			due = due.Add(time.Duration(rng.Int63n(int64(cfg.Jitter))))
+		}
+		select {
+		case <-time.After(time.Until(due)):
+		case <-ctx.Done():
+			return
+		}
+
+		s.expected++
+		binary.BigEndian.PutUint16(packet[2:4], seq)
+		binary.BigEndian.PutUint32(packet[4:8], timestamp)
+		seq++
+		timestamp += timestampStep
+		if cfg.Loss > 0 && rng.Float64()*100 < cfg.Loss {
+			continue
+		}
+		if len(packet) >= 20 {
+			binary.BigEndian.PutUint64(packet[12:20], uint64(time.Now().UnixNano()))
+		}
+		if _, err := conn.WriteToUDP(packet, s.dst); err == nil {
+			s.sent++
+		}
+	}
+}
+
+func (s *stream) receive(conn *net.UDPConn, codec Codec, deadline time.Time) {
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return
+	}
+	buf := make([]byte, 1500)
+	clockMs := float64(codec.ClockRate) / 1000
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if n < 12 || buf[0]>>6 != 2 || binary.BigEndian.Uint32(buf[8:12]) != s.ssrc {
+			continue
+		}
+		now := time.Now()
+
+		// Transit time in ms, relative to the first packet so timestamps
+		// may wrap
+		timestamp := binary.BigEndian.Uint32(buf[4:8])
+		if s.received == 0 {
+			s.firstArrival, s.firstTS = now, timestamp
+		}
+		transit := float64(now.Sub(s.firstArrival).Microseconds())/1000 - float64(int32(timestamp-s.firstTS))/clockMs
+		if s.received > 0 {
+			d := math.Abs(transit - s.lastTransit)
+			s.jitter += (d - s.jitter) / 16
+		}
+		s.lastTransit = transit
+		if n >= 20 {
+			s.delaySum += now.Sub(time.Unix(0, int64(binary.BigEndian.Uint64(buf[12:20]))))
+		}
+		s.received++
+	}
+}
+
+func (s *stream) result(codec Codec) StreamResult {
+	r := StreamResult{
+		Expected: s.expected,
+		Sent:     s.sent,
+		Received: s.received,
+		JitterMs: round(s.jitter, 2),
+	}
+	if s.expected > 0 {
+		r.LossPercent = round(math.Max(0, float64(s.expected-s.received))*100/float64(s.expected), 2)
+	}
+	if s.received > 0 {
+		r.DelayMs = round(float64(s.delaySum.Microseconds())/1000/float64(s.received), 2)
+		r.MOS = internal.EstimateMOS(codec.Name, r.LossPercent, r.JitterMs, 2*r.DelayMs)
+	}
+	return r
+}
+
+func round(v float64, places int) float64 {
+	scale := math.Pow(10, float64(places))
+	return math.Round(v*scale) / scale
+}
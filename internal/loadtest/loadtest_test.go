@@ -0,0 +1,153 @@
+package loadtest
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	ng "karl/internal/ng_protocol"
+)
+
+// startFakeNG answers offers and answers with the SDP it was sent, so each
+// endpoint sends straight to the other, as through a lossless relay.
+// Offers fail with reason when it is set
+func startFakeNG(t *testing.T, reason string) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			cookie, body, _ := bytes.Cut(buf[:n], []byte(" "))
+			value, err := ng.NewDecoder(body).Decode()
+			if err != nil {
+				continue
+			}
+			req, _ := ng.GetDict(value)
+			resp := map[string]interface{}{"result": "ok"}
+			switch ng.DictGetString(req, "command") {
+			case "offer", "answer":
+				if reason != "" {
+					resp = map[string]interface{}{"result": "error", "error-reason": reason}
+					break
+				}
+				resp["sdp"] = ng.DictGetString(req, "sdp")
+			}
+			encoded, _ := ng.NewEncoder().Encode(resp)
+			conn.WriteToUDP(append(append(cookie, ' '), encoded...), from)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func testConfig(ngAddr string) Config {
+	cfg := DefaultConfig()
+	cfg.NGAddr = ngAddr
+	cfg.Calls = 3
+	cfg.Rate = 0
+	cfg.Duration = 400 * time.Millisecond
+	cfg.Timeout = 500 * time.Millisecond
+	return cfg
+}
+
+func TestRun(t *testing.T) {
+	report, err := Run(context.Background(), testConfig(startFakeNG(t, "")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Calls != 3 || report.Established != 3 || report.Failed != 0 {
+		t.Fatalf("calls = %d established %d failed %d, want 3 3 0", report.Calls, report.Established, report.Failed)
+	}
+	for _, call := range report.Results {
+		for _, s := range []StreamResult{call.CallerToCallee, call.CalleeToCaller} {
+			if s.Expected == 0 || s.Received != s.Expected {
+				t.Errorf("%s: received %d of %d", call.CallID, s.Received, s.Expected)
+			}
+			if s.LossPercent != 0 {
+				t.Errorf("%s: loss = %v%%, want 0", call.CallID, s.LossPercent)
+			}
+			if s.MOS < 4 {
+				t.Errorf("%s: MOS = %v, want a clean call", call.CallID, s.MOS)
+			}
+		}
+	}
+	if report.SendPPS <= 0 || report.PacketsReceived != report.PacketsSent {
+		t.Errorf("sent %d (%v pps), received %d", report.PacketsSent, report.SendPPS, report.PacketsReceived)
+	}
+
+	var out strings.Builder
+	report.WriteText(&out, true)
+	if !strings.Contains(out.String(), "3 established, 0 failed of 3") {
+		t.Errorf("report:\n%s", out.String())
+	}
+}
+
+func TestRun_Loss(t *testing.T) {
+	cfg := testConfig(startFakeNG(t, ""))
+	cfg.Calls = 1
+	cfg.Loss = 50
+
+	report, err := Run(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := report.Results[0].CallerToCallee
+	if s.Sent >= s.Expected || s.Received != s.Sent {
+		t.Errorf("sent %d received %d of %d, want about half dropped", s.Sent, s.Received, s.Expected)
+	}
+	if s.LossPercent == 0 {
+		t.Error("loss was not reported")
+	}
+}
+
+func TestRun_OfferRejected(t *testing.T) {
+	report, err := Run(context.Background(), testConfig(startFakeNG(t, "No free ports")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Established != 0 || report.Failed != 3 {
+		t.Fatalf("established %d failed %d, want 0 3", report.Established, report.Failed)
+	}
+	if got := report.Results[0].Error; !strings.Contains(got, "No free ports") {
+		t.Errorf("error = %q", got)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Config)
+	}{
+		{"no NG address", func(c *Config) { c.NGAddr = "" }},
+		{"bad local IP", func(c *Config) { c.LocalIP = "localhost" }},
+		{"no calls", func(c *Config) { c.Calls = 0 }},
+		{"unknown codec", func(c *Config) { c.Codec = "g729" }},
+		{"short ptime", func(c *Config) { c.Ptime = 5 * time.Millisecond }},
+		{"loss over 100", func(c *Config) { c.Loss = 101 }},
+	}
+	cfg := DefaultConfig()
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("default config: %v", err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			tt.modify(&cfg)
+			if err := cfg.Validate(); err == nil {
+				t.Error("Validate() succeeded")
+			}
+		})
+	}
+}
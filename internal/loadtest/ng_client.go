@@ -0,0 +1,128 @@
+package loadtest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	ng "karl/internal/ng_protocol"
+)
+
+// ngAttempts is how many times a request is sent before it fails; NG runs
+// over UDP, so a lost request or response is retried once
+const ngAttempts = 2
+
+// ngClient sends NG commands for one simulated call from its own socket,
+// so concurrent calls never see each other's responses
+type ngClient struct {
+	conn    *net.UDPConn
+	secret  []byte
+	timeout time.Duration
+	prefix  string
+	seq     int
+	buf     []byte
+}
+
+func newNGClient(addr, secret, prefix string, timeout time.Duration) (*ngClient, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve NG address: %w", err)
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open NG socket: %w", err)
+	}
+	return &ngClient{
+		conn:    conn,
+		secret:  []byte(secret),
+		timeout: timeout,
+		prefix:  prefix,
+		buf:     make([]byte, 65535),
+	}, nil
+}
+
+// request sends a command and returns the response dictionary; a response
+// with a result other than ok or pong is an error
+func (c *ngClient) request(dict map[string]interface{}) (ng.BencodeDict, error) {
+	encoded, err := ng.NewEncoder().Encode(dict)
+	if err != nil {
+		return nil, err
+	}
+
+	c.seq++
+	id := c.prefix + "_" + strconv.Itoa(c.seq)
+	var msg []byte
+	if len(c.secret) > 0 {
+		msg = ng.SignMessage(id, encoded, c.secret)
+	} else {
+		msg = append([]byte(id+" "), encoded...)
+	}
+
+	for attempt := 0; attempt < ngAttempts; attempt++ {
+		if _, err := c.conn.Write(msg); err != nil {
+			return nil, err
+		}
+		resp, err := c.readResponse(id)
+		if errors.Is(err, errNGTimeout) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch result := ng.DictGetString(resp, "result"); result {
+		case "ok", "pong":
+			return resp, nil
+		case "error":
+			return nil, fmt.Errorf("%s failed: %s", dict["command"], ng.DictGetString(resp, "error-reason"))
+		default:
+			return nil, fmt.Errorf("%s failed: unexpected result %q", dict["command"], result)
+		}
+	}
+	return nil, fmt.Errorf("%s failed: %w", dict["command"], errNGTimeout)
+}
+
+var errNGTimeout = errors.New("no response from NG server")
+
+// readResponse waits for the response to the request with cookie id,
+// skipping late responses to earlier requests
+func (c *ngClient) readResponse(id string) (ng.BencodeDict, error) {
+	deadline := time.Now().Add(c.timeout)
+	for {
+		if err := c.conn.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+		n, err := c.conn.Read(c.buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return nil, errNGTimeout
+			}
+			return nil, err
+		}
+
+		cookie, body, ok := bytes.Cut(c.buf[:n], []byte(" "))
+		if !ok {
+			continue
+		}
+		// A signed request's cookie comes back with its signature
+		if name, _, _ := bytes.Cut(cookie, []byte(".")); string(name) != id {
+			continue
+		}
+		value, err := ng.NewDecoder(body).Decode()
+		if err != nil {
+			return nil, fmt.Errorf("invalid NG response: %w", err)
+		}
+		dict, ok := ng.GetDict(value)
+		if !ok {
+			return nil, fmt.Errorf("invalid NG response: not a dictionary")
+		}
+		return dict, nil
+	}
+}
+
+func (c *ngClient) close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,134 @@
+package loadtest
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// StreamResult is what one direction of a call delivered
+type StreamResult struct {
+	Expected    int     `json:"expected"` // packets due, including the ones dropped on purpose
+	Sent        int     `json:"sent"`
+	Received    int     `json:"received"`
+	LossPercent float64 `json:"loss_percent"`
+	JitterMs    float64 `json:"jitter_ms"`
+	DelayMs     float64 `json:"delay_ms"` // mean one-way delay through Karl
+	MOS         float64 `json:"mos"`      // estimated from loss, jitter and delay, 0 when nothing arrived
+}
+
+// CallResult is the outcome of one simulated call
+type CallResult struct {
+	CallID         string       `json:"call_id"`
+	Established    bool         `json:"established"`
+	Error          string       `json:"error,omitempty"`
+	SetupMs        float64      `json:"setup_ms"` // offer and answer round trips
+	CallerToCallee StreamResult `json:"caller_to_callee"`
+	CalleeToCaller StreamResult `json:"callee_to_caller"`
+}
+
+// Report summarizes a load test
+type Report struct {
+	Calls           int          `json:"calls"`
+	Established     int          `json:"established"`
+	Failed          int          `json:"failed"`
+	ElapsedSeconds  float64      `json:"elapsed_seconds"`
+	PacketsSent     int          `json:"packets_sent"`
+	PacketsReceived int          `json:"packets_received"`
+	SendPPS         float64      `json:"send_pps"`    // packets sent per second, over the whole run
+	ReceivePPS      float64      `json:"receive_pps"` // packets received back through Karl per second
+	LossPercent     float64      `json:"loss_percent"`
+	MeanJitterMs    float64      `json:"mean_jitter_ms"`
+	MaxJitterMs     float64      `json:"max_jitter_ms"`
+	MeanSetupMs     float64      `json:"mean_setup_ms"`
+	MeanMOS         float64      `json:"mean_mos"`
+	MinMOS          float64      `json:"min_mos"`
+	Results         []CallResult `json:"results"`
+}
+
+func newReport(results []CallResult, elapsed time.Duration) *Report {
+	r := &Report{
+		Calls:          len(results),
+		ElapsedSeconds: round(elapsed.Seconds(), 2),
+		Results:        results,
+	}
+
+	var expected, streams int
+	var jitterSum, setupSum, mosSum float64
+	r.MinMOS = math.Inf(1)
+	for _, call := range results {
+		if call.Established {
+			r.Established++
+			setupSum += call.SetupMs
+		}
+		if call.Error != "" {
+			r.Failed++
+		}
+		if !call.Established {
+			continue
+		}
+		for _, s := range []StreamResult{call.CallerToCallee, call.CalleeToCaller} {
+			expected += s.Expected
+			r.PacketsSent += s.Sent
+			r.PacketsReceived += s.Received
+			streams++
+			jitterSum += s.JitterMs
+			r.MaxJitterMs = math.Max(r.MaxJitterMs, s.JitterMs)
+			mosSum += s.MOS
+			r.MinMOS = math.Min(r.MinMOS, s.MOS)
+		}
+	}
+
+	if elapsed > 0 {
+		r.SendPPS = round(float64(r.PacketsSent)/elapsed.Seconds(), 1)
+		r.ReceivePPS = round(float64(r.PacketsReceived)/elapsed.Seconds(), 1)
+	}
+	if expected > 0 {
+		r.LossPercent = round(math.Max(0, float64(expected-r.PacketsReceived))*100/float64(expected), 2)
+	}
+	if r.Established > 0 {
+		r.MeanSetupMs = round(setupSum/float64(r.Established), 2)
+	}
+	if streams > 0 {
+		r.MeanJitterMs = round(jitterSum/float64(streams), 2)
+		r.MeanMOS = round(mosSum/float64(streams), 2)
+	} else {
+		r.MinMOS = 0
+	}
+	return r
+}
+
+// WriteText prints the summary and, with perCall, a line per call with the
+// worse of its two directions
+func (r *Report) WriteText(w io.Writer, perCall bool) {
+	if perCall {
+		results := append([]CallResult(nil), r.Results...)
+		sort.Slice(results, func(i, j int) bool { return results[i].CallID < results[j].CallID })
+		fmt.Fprintf(w, "%-36s %8s %8s %8s %6s %s\n", "CALL", "SETUP", "LOSS", "JITTER", "MOS", "ERROR")
+		for _, c := range results {
+			worst := c.CallerToCallee
+			if c.CalleeToCaller.MOS < worst.MOS {
+				worst = c.CalleeToCaller
+			}
+			fmt.Fprintf(w, "%-36s %6.1fms %7.2f%% %6.2fms %6.2f %s\n",
+				c.CallID, c.SetupMs, worst.LossPercent, worst.JitterMs, worst.MOS, c.Error)
+		}
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprintf(w, "Calls:       %d established, %d failed of %d\n", r.Established, r.Failed, r.Calls)
+	for _, c := range r.Results {
+		if c.Error != "" {
+			fmt.Fprintf(w, "First error: %s: %s\n", c.CallID, c.Error)
+			break
+		}
+	}
+	fmt.Fprintf(w, "Elapsed:     %.2fs\n", r.ElapsedSeconds)
+	fmt.Fprintf(w, "Packets:     %d sent (%.1f pps), %d received (%.1f pps)\n", r.PacketsSent, r.SendPPS, r.PacketsReceived, r.ReceivePPS)
+	fmt.Fprintf(w, "Loss:        %.2f%%\n", r.LossPercent)
+	fmt.Fprintf(w, "Jitter:      %.2fms mean, %.2fms max\n", r.MeanJitterMs, r.MaxJitterMs)
+	fmt.Fprintf(w, "Setup:       %.2fms mean\n", r.MeanSetupMs)
+	fmt.Fprintf(w, "MOS:         %.2f mean, %.2f min\n", r.MeanMOS, r.MinMOS)
+}
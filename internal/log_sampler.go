@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Packet path log sampling
+const (
+	packetTraceSampleRate = 1000        // packets per trace line at debug level
+	packetErrorInterval   = time.Second // shortest gap between repeated packet errors
+)
+
+// ParseLogLevel maps a level name such as "debug" to a level
+func ParseLogLevel(name string) (slog.Level, bool) {
+	switch strings.ToLower(name) {
+	case "error":
+		return slog.LevelError, true
+	case "warn", "warning":
+		return slog.LevelWarn, true
+	case "info":
+		return slog.LevelInfo, true
+	case "debug":
+		return slog.LevelDebug, true
+	case "trace":
+		return LevelTrace, true
+	}
+	return 0, false
+}
+
+// LogSampler thins out a repetitive log line so that per-packet events
+// can be logged without costing throughput. A line is logged only when
+// its component's level is enabled, for one event in every N, and at most
+// once per interval. Call sites check Allow before building attributes:
+//
+//	if rtpErrorLog.Allow() {
+//		rtpErrorLog.Log("Failed to forward", "error", err)
+//	}
+type LogSampler struct {
+	logger   *slog.Logger
+	level    slog.Level
+	every    uint64
+	interval time.Duration
+
+	events  atomic.Uint64
+	skipped atomic.Uint64
+	last    atomic.Int64 // when the last line was logged, in Unix nanoseconds
+}
+
+// NewLogSampler creates a sampler logging one event in every, at most
+// once per interval. An every of 1 or an interval of 0 disables that limit
+func NewLogSampler(logger *slog.Logger, level slog.Level, every uint64, interval time.Duration) *LogSampler {
+	if every < 1 {
+		every = 1
+	}
+	return &LogSampler{logger: logger, level: level, every: every, interval: interval}
+}
+
+// Allow reports whether the current event should be logged. Events left
+// out while the level is enabled are counted and reported by the next Log
+func (s *LogSampler) Allow() bool {
+	if !s.logger.Enabled(context.Background(), s.level) {
+		return false
+	}
+	if s.every > 1 && (s.events.Add(1)-1)%s.every != 0 {
+		s.skipped.Add(1)
+		return false
+	}
+	if s.interval > 0 {
+		now := time.Now().UnixNano()
+		last := s.last.Load()
+		if last != 0 && now-last < int64(s.interval) || !s.last.CompareAndSwap(last, now) {
+			s.skipped.Add(1)
+			return false
+		}
+	}
+	return true
+}
+
+// Log logs a line allowed by Allow, with a skipped attribute counting the
+// similar lines left out since the previous one
+func (s *LogSampler) Log(msg string, args ...any) {
+	if skipped := s.skipped.Swap(0); skipped > 0 {
+		args = append(args, "skipped", skipped)
+	}
+	s.logger.Log(context.Background(), s.level, msg, args...)
+}
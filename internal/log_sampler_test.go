@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestLogSampler_Sampling(t *testing.T) {
+	out := withLogOutput(t, &LoggingConfig{Level: "debug"})
+	s := NewLogSampler(Logger("sampler-test"), slog.LevelDebug, 10, 0)
+
+	printed := 0
+	for i := 0; i < 100; i++ {
+		if s.Allow() {
+			s.Log("packet", "n", i)
+			printed++
+		}
+	}
+	if printed != 10 {
+		t.Errorf("expected 1 in 10 events to print, got %d", printed)
+	}
+	lines := out.records(t)
+	if lines[0]["n"] != 0.0 || lines[0]["skipped"] != nil {
+		t.Errorf("unexpected first line %v", lines[0])
+	}
+	if lines[1]["n"] != 10.0 || lines[1]["skipped"] != 9.0 || lines[1]["component"] != "sampler-test" {
+		t.Errorf("unexpected second line %v", lines[1])
+	}
+}
+
+func TestLogSampler_Level(t *testing.T) {
+	out := withLogOutput(t, &LoggingConfig{Level: "info"})
+	s := NewLogSampler(Logger("sampler-test"), slog.LevelDebug, 1, 0)
+	if s.Allow() {
+		t.Error("expected debug lines to be off at info level")
+	}
+	SetLogLevels(slog.LevelInfo, map[string]slog.Level{"sampler-test": LevelTrace})
+	if !s.Allow() {
+		t.Error("expected debug lines to print with the component at trace level")
+	}
+	s.Log("traced")
+	if lines := out.records(t); len(lines) != 1 || lines[0]["skipped"] != nil {
+		t.Errorf("expected no skipped count for events below the level, got %v", lines)
+	}
+}
+
+func TestLogSampler_Interval(t *testing.T) {
+	withLogOutput(t, &LoggingConfig{Level: "info"})
+	s := NewLogSampler(Logger("sampler-test"), slog.LevelError, 1, 50*time.Millisecond)
+
+	printed := 0
+	for i := 0; i < 1000; i++ {
+		if s.Allow() {
+			printed++
+		}
+	}
+	if printed != 1 {
+		t.Errorf("expected one line per interval, got %d", printed)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !s.Allow() {
+		t.Error("expected a line once the interval passed")
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for name, want := range map[string]slog.Level{"error": slog.LevelError, "WARN": slog.LevelWarn, "debug": slog.LevelDebug, "trace": LevelTrace} {
+		if got, ok := ParseLogLevel(name); !ok || got != want {
+			t.Errorf("ParseLogLevel(%q) = %d, %v", name, got, ok)
+		}
+	}
+	if _, ok := ParseLogLevel("verbose"); ok {
+		t.Error("expected an unknown level to be rejected")
+	}
+}
+
+// sinkWriter drops log output after it has been formatted, which
+// io.Discard would skip
+type sinkWriter struct{}
+
+func (sinkWriter) Write(p []byte) (int, error) { return len(p), nil }
+
+// BenchmarkPacketLogging compares logging every packet, as the RTP path
+// used to, with the sampled packet trace and error lines
+func BenchmarkPacketLogging(b *testing.B) {
+	withLogOutput(b, &LoggingConfig{Level: "debug"})
+	setLogHandler(newLogHandler("text", sinkWriter{}), "text")
+	logger := Logger("bench")
+	err := errors.New("connection refused")
+
+	b.Run("every_packet", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			logger.Debug("RTP packet", "ssrc", 0x1234, "seq", i, "timestamp", i*160, "pt", 0)
+		}
+	})
+	b.Run("sampled_trace", func(b *testing.B) {
+		s := NewLogSampler(logger, slog.LevelDebug, packetTraceSampleRate, 0)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if s.Allow() {
+				s.Log("RTP packet", "ssrc", 0x1234, "seq", i, "timestamp", i*160, "pt", 0)
+			}
+		}
+	})
+	b.Run("rate_limited_errors", func(b *testing.B) {
+		s := NewLogSampler(logger, slog.LevelError, 1, packetErrorInterval)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if s.Allow() {
+				s.Log("Failed to forward packet", "addr", "192.0.2.1:4000", "error", err)
+			}
+		}
+	})
+	b.Run("trace_off", func(b *testing.B) {
+		SetLogLevels(slog.LevelInfo, nil)
+		s := NewLogSampler(logger, slog.LevelDebug, packetTraceSampleRate, 0)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if s.Allow() {
+				s.Log("RTP packet", "ssrc", 0x1234, "seq", i)
+			}
+		}
+	})
+}
@@ -0,0 +1,364 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode"
+)
+
+// LevelTrace is below debug, for per-packet detail
+const LevelTrace = slog.LevelDebug - 4
+
+// Components with their own loggers. Lines written with the standard log
+// package are attributed to ComponentKarl
+const (
+	ComponentKarl   = "karl"
+	ComponentRTP    = "rtp"
+	ComponentWorker = "worker"
+	ComponentNG     = "ng"
+	ComponentAPI    = "api"
+)
+
+// LoggingConfig selects the log format and the level of each component
+type LoggingConfig struct {
+	Level      string            `json:"level"`      // error, warn, info, debug or trace
+	Format     string            `json:"format"`     // text or json
+	Components map[string]string `json:"components"` // level overrides by component, e.g. {"rtp": "debug"}
+}
+
+// logOutput is the handler every component logger writes through. It is
+// replaced when the format changes, so component loggers rebuild their
+// handler chain when the generation moves on
+var (
+	logOutput     atomic.Pointer[logOutputHandler]
+	logGeneration atomic.Uint64
+)
+
+type logOutputHandler struct {
+	handler slog.Handler
+	format  string
+}
+
+func init() {
+	setLogHandler(newLogHandler("text", os.Stderr), "text")
+}
+
+// logLevels holds the default level and the per-component overrides
+var logLevels = struct {
+	sync.RWMutex
+	base       slog.Level
+	levels     map[string]*slog.LevelVar
+	overridden map[string]bool
+}{
+	base:       slog.LevelInfo,
+	levels:     make(map[string]*slog.LevelVar),
+	overridden: make(map[string]bool),
+}
+
+// componentLevel returns the level variable of a component, creating it at
+// the default level
+func componentLevel(component string) *slog.LevelVar {
+	logLevels.RLock()
+	level, ok := logLevels.levels[component]
+	logLevels.RUnlock()
+	if ok {
+		return level
+	}
+
+	logLevels.Lock()
+	defer logLevels.Unlock()
+	if level, ok = logLevels.levels[component]; !ok {
+		level = new(slog.LevelVar)
+		level.Set(logLevels.base)
+		logLevels.levels[component] = level
+	}
+	return level
+}
+
+// SetLogLevels sets the default level and replaces the per-component
+// overrides. Components without an override follow the default
+func SetLogLevels(base slog.Level, components map[string]slog.Level) {
+	logLevels.Lock()
+	defer logLevels.Unlock()
+	logLevels.base = base
+	logLevels.overridden = make(map[string]bool, len(components))
+	for component, level := range components {
+		if _, ok := logLevels.levels[component]; !ok {
+			logLevels.levels[component] = new(slog.LevelVar)
+		}
+		logLevels.levels[component].Set(level)
+		logLevels.overridden[component] = true
+	}
+	for component, level := range logLevels.levels {
+		if !logLevels.overridden[component] {
+			level.Set(base)
+		}
+	}
+}
+
+// CurrentLoggingConfig returns the format and levels in effect
+func CurrentLoggingConfig() LoggingConfig {
+	logLevels.RLock()
+	defer logLevels.RUnlock()
+	config := LoggingConfig{
+		Level:      LevelName(logLevels.base),
+		Format:     logOutput.Load().format,
+		Components: make(map[string]string, len(logLevels.overridden)),
+	}
+	for component := range logLevels.overridden {
+		config.Components[component] = LevelName(logLevels.levels[component].Level())
+	}
+	return config
+}
+
+// ConfigureLogging applies a logging configuration, writing to stderr. It
+// can be called again at runtime; nil keeps the format and resets the
+// levels to info
+func ConfigureLogging(config *LoggingConfig) error {
+	return configureLogging(config, os.Stderr)
+}
+
+func configureLogging(config *LoggingConfig, w io.Writer) error {
+	if config == nil {
+		config = &LoggingConfig{}
+	}
+	if err := ValidateLoggingConfig(config); err != nil {
+		return err
+	}
+
+	base := slog.LevelInfo
+	if level, ok := ParseLogLevel(config.Level); ok {
+		base = level
+	}
+	components := make(map[string]slog.Level, len(config.Components))
+	for component, name := range config.Components {
+		components[component], _ = ParseLogLevel(name)
+	}
+
+	format := strings.ToLower(config.Format)
+	if format == "" {
+		format = logOutput.Load().format
+	}
+	setLogHandler(newLogHandler(format, w), format)
+	SetLogLevels(base, components)
+
+	// Route the standard logger through the component loggers
+	log.SetFlags(0)
+	log.SetOutput(stdLogBridge{logger: Logger(ComponentKarl)})
+	return nil
+}
+
+// LoggingConfigFromEnv returns a copy of config with the level and format
+// replaced by KARL_LOG_LEVEL and KARL_LOG_FORMAT when they are set
+func LoggingConfigFromEnv(config *LoggingConfig) *LoggingConfig {
+	merged := LoggingConfig{}
+	if config != nil {
+		merged = *config
+	}
+	if level := os.Getenv("KARL_LOG_LEVEL"); level != "" {
+		merged.Level = level
+	}
+	if format := os.Getenv("KARL_LOG_FORMAT"); format != "" {
+		merged.Format = format
+	}
+	return &merged
+}
+
+// ValidateLoggingConfig checks the format and level names
+func ValidateLoggingConfig(config *LoggingConfig) error {
+	switch strings.ToLower(config.Format) {
+	case "", "text", "json":
+	default:
+		return fmt.Errorf("invalid log format %q, expected text or json", config.Format)
+	}
+	if _, ok := ParseLogLevel(config.Level); !ok && config.Level != "" {
+		return fmt.Errorf("invalid log level %q", config.Level)
+	}
+	for component, name := range config.Components {
+		if _, ok := ParseLogLevel(name); !ok {
+			return fmt.Errorf("invalid log level %q for component %s", name, component)
+		}
+	}
+	return nil
+}
+
+func newLogHandler(format string, w io.Writer) slog.Handler {
+	// Levels are checked per component, so the output handler passes all
+	options := &slog.HandlerOptions{
+		Level: LevelTrace,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.LevelKey && len(groups) == 0 {
+				if level, ok := a.Value.Any().(slog.Level); ok && level <= LevelTrace {
+					a.Value = slog.StringValue("TRACE")
+				}
+			}
+			return a
+		},
+	}
+	if format == "json" {
+		return slog.NewJSONHandler(w, options)
+	}
+	return slog.NewTextHandler(w, options)
+}
+
+func setLogHandler(handler slog.Handler, format string) {
+	logOutput.Store(&logOutputHandler{handler: handler, format: format})
+	logGeneration.Add(1)
+}
+
+// Logger returns the logger of a component. Its level follows the
+// component's setting, and its records carry a component attribute
+func Logger(component string) *slog.Logger {
+	return slog.New(&componentHandler{
+		component: component,
+		level:     componentLevel(component),
+		cache:     new(atomic.Pointer[cachedHandler]),
+	})
+}
+
+// componentHandler filters records by its component's level and writes
+// them through the current output handler
+type componentHandler struct {
+	component string
+	level     *slog.LevelVar
+	ops       []func(slog.Handler) slog.Handler // WithAttrs and WithGroup calls
+	cache     *atomic.Pointer[cachedHandler]
+}
+
+type cachedHandler struct {
+	generation uint64
+	handler    slog.Handler
+}
+
+func (h *componentHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *componentHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.output().Handle(ctx, r)
+}
+
+// output returns the output handler with this logger's attributes applied,
+// rebuilding it after the output changed
+func (h *componentHandler) output() slog.Handler {
+	generation := logGeneration.Load()
+	if cached := h.cache.Load(); cached != nil && cached.generation == generation {
+		return cached.handler
+	}
+	handler := logOutput.Load().handler.WithAttrs([]slog.Attr{slog.String("component", h.component)})
+	for _, op := range h.ops {
+		handler = op(handler)
+	}
+	h.cache.Store(&cachedHandler{generation: generation, handler: handler})
+	return handler
+}
+
+func (h *componentHandler) with(op func(slog.Handler) slog.Handler) *componentHandler {
+	ops := make([]func(slog.Handler) slog.Handler, len(h.ops), len(h.ops)+1)
+	copy(ops, h.ops)
+	return &componentHandler{
+		component: h.component,
+		level:     h.level,
+		ops:       append(ops, op),
+		cache:     new(atomic.Pointer[cachedHandler]),
+	}
+}
+
+func (h *componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithAttrs(attrs) })
+}
+
+func (h *componentHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithGroup(name) })
+}
+
+// stdLogBridge turns lines from the standard log package into records. The
+// emoji prefixes older code uses for severity set the level and are dropped
+type stdLogBridge struct {
+	logger *slog.Logger
+}
+
+// Emoji prefixes and the levels they stand for
+var legacyLogPrefixes = []struct {
+	prefix string
+	level  slog.Level
+}{
+	{"❌", slog.LevelError},
+	{"🚨", slog.LevelError},
+	{"⚠️", slog.LevelWarn},
+	{"⚠", slog.LevelWarn},
+	{"🔍", slog.LevelDebug},
+	{"🐞", slog.LevelDebug},
+}
+
+func (b stdLogBridge) Write(p []byte) (int, error) {
+	level, msg := legacyLogLevel(strings.TrimRight(string(p), "\n"))
+	if b.logger.Enabled(context.Background(), level) {
+		b.logger.Log(context.Background(), level, msg)
+	}
+	return len(p), nil
+}
+
+// legacyLogLevel returns the level of a free-text log line and the line
+// without its leading emoji
+func legacyLogLevel(line string) (slog.Level, string) {
+	level := slog.LevelInfo
+	for _, p := range legacyLogPrefixes {
+		if strings.HasPrefix(line, p.prefix) {
+			level = p.level
+			break
+		}
+	}
+	// Strip any leading symbols, such as ✅ or 📦, and the space after them
+	trimmed := strings.TrimLeftFunc(line, func(r rune) bool {
+		return r > unicode.MaxASCII && (unicode.IsSymbol(r) || unicode.Is(unicode.Mn, r) || r == '\u200d')
+	})
+	if trimmed != line {
+		line = strings.TrimLeft(trimmed, " ")
+	}
+	return level, line
+}
+
+// LevelName returns the configuration name of a level
+func LevelName(level slog.Level) string {
+	switch {
+	case level <= LevelTrace:
+		return "trace"
+	case level <= slog.LevelDebug:
+		return "debug"
+	case level <= slog.LevelInfo:
+		return "info"
+	case level <= slog.LevelWarn:
+		return "warn"
+	}
+	return "error"
+}
+
+// LogComponents returns the components that have a logger, sorted
+func LogComponents() []string {
+	logLevels.RLock()
+	defer logLevels.RUnlock()
+	components := make([]string, 0, len(logLevels.levels))
+	for component := range logLevels.levels {
+		components = append(components, component)
+	}
+	sort.Strings(components)
+	return components
+}
+
+// streamAttrs returns the logging attributes of an RTP stream: its SSRC
+// and, once negotiated, its call
+func streamAttrs(ssrc uint32) []any {
+	if callID, ok := GetCodecNegotiator().CallID(ssrc); ok {
+		return []any{"call_id", callID, "ssrc", ssrc}
+	}
+	return []any{"ssrc", ssrc}
+}
@@ -0,0 +1,182 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// logBuffer collects JSON log records
+type logBuffer struct {
+	bytes.Buffer
+}
+
+func (b *logBuffer) records(t *testing.T) []map[string]interface{} {
+	t.Helper()
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("invalid JSON log line %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// withLogOutput applies a logging configuration writing JSON to a buffer,
+// restoring the previous output and levels when the test ends
+func withLogOutput(t testing.TB, config *LoggingConfig) *logBuffer {
+	t.Helper()
+	oldOutput, oldConfig := logOutput.Load(), CurrentLoggingConfig()
+	oldWriter, oldFlags := log.Writer(), log.Flags()
+	t.Cleanup(func() {
+		logOutput.Store(oldOutput)
+		logGeneration.Add(1)
+		base, _ := ParseLogLevel(oldConfig.Level)
+		components := make(map[string]slog.Level)
+		for component, name := range oldConfig.Components {
+			components[component], _ = ParseLogLevel(name)
+		}
+		SetLogLevels(base, components)
+		log.SetOutput(oldWriter)
+		log.SetFlags(oldFlags)
+	})
+
+	out := new(logBuffer)
+	config.Format = "json"
+	if err := configureLogging(config, out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestLogging_ComponentLevels(t *testing.T) {
+	out := withLogOutput(t, &LoggingConfig{Level: "info", Components: map[string]string{"rtp-test": "debug"}})
+	rtp, worker := Logger("rtp-test"), Logger("worker-test")
+
+	rtp.Debug("rtp detail", "ssrc", 1)
+	worker.Debug("worker detail")
+	worker.Info("worker started", "workers", 4)
+
+	records := out.records(t)
+	if len(records) != 2 {
+		t.Fatalf("expected the rtp debug line and the worker info line, got %v", records)
+	}
+	if records[0]["component"] != "rtp-test" || records[0]["level"] != "DEBUG" || records[0]["ssrc"] != 1.0 {
+		t.Errorf("unexpected rtp record %v", records[0])
+	}
+	if records[1]["component"] != "worker-test" || records[1]["msg"] != "worker started" {
+		t.Errorf("unexpected worker record %v", records[1])
+	}
+
+	// Levels change at runtime for loggers that already exist
+	SetLogLevels(slog.LevelError, nil)
+	rtp.Info("quiet")
+	if len(out.records(t)) != 2 {
+		t.Error("expected the rtp override to be dropped with the new levels")
+	}
+	config := CurrentLoggingConfig()
+	if config.Level != "error" || len(config.Components) != 0 || config.Format != "json" {
+		t.Errorf("unexpected current config %+v", config)
+	}
+}
+
+func TestLogging_FormatChange(t *testing.T) {
+	out := withLogOutput(t, &LoggingConfig{Level: "info"})
+	logger := Logger("format-test").With("call_id", "abc")
+	logger.Info("as json")
+
+	var text bytes.Buffer
+	if err := configureLogging(&LoggingConfig{Level: "info", Format: "text"}, &text); err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("as text")
+
+	if records := out.records(t); len(records) != 1 || records[0]["call_id"] != "abc" {
+		t.Errorf("unexpected JSON output %v", records)
+	}
+	if line := text.String(); !strings.Contains(line, `msg="as text" component=format-test call_id=abc`) {
+		t.Errorf("unexpected text output %q", line)
+	}
+}
+
+func TestLogging_StandardLogBridge(t *testing.T) {
+	out := withLogOutput(t, &LoggingConfig{Level: "info"})
+
+	log.Printf("❌ Failed to bind port %d", 5060)
+	log.Println("⚠️ Redis unavailable")
+	log.Printf("✅ Session created")
+	log.Printf("🔍 Probing codecs")
+
+	records := out.records(t)
+	if len(records) != 3 {
+		t.Fatalf("expected the debug line to be filtered, got %v", records)
+	}
+	want := []struct{ level, msg string }{
+		{"ERROR", "Failed to bind port 5060"},
+		{"WARN", "Redis unavailable"},
+		{"INFO", "Session created"},
+	}
+	for i, w := range want {
+		if records[i]["level"] != w.level || records[i]["msg"] != w.msg || records[i]["component"] != ComponentKarl {
+			t.Errorf("line %d: expected %s %q, got %v", i, w.level, w.msg, records[i])
+		}
+	}
+}
+
+func TestLogging_StreamAttrs(t *testing.T) {
+	out := withLogOutput(t, &LoggingConfig{Level: "info"})
+	n := GetCodecNegotiator()
+	n.SetOfferCodecs("log-call", []CodecInfo{{PayloadType: 0, Name: "PCMU", ClockRate: 8000}})
+	n.BindSSRC(0xabc, "log-call", true)
+	t.Cleanup(func() { n.RemoveCall("log-call") })
+
+	Logger("stream-test").Info("bound", streamAttrs(0xabc)...)
+	Logger("stream-test").Info("unbound", streamAttrs(0xdef)...)
+
+	records := out.records(t)
+	if records[0]["call_id"] != "log-call" || records[0]["ssrc"] != float64(0xabc) {
+		t.Errorf("expected the call and SSRC, got %v", records[0])
+	}
+	if _, ok := records[1]["call_id"]; ok || records[1]["ssrc"] != float64(0xdef) {
+		t.Errorf("expected only the SSRC of an unknown stream, got %v", records[1])
+	}
+}
+
+func TestValidateLoggingConfig(t *testing.T) {
+	valid := []LoggingConfig{
+		{},
+		{Level: "trace", Format: "JSON", Components: map[string]string{"rtp": "debug"}},
+	}
+	for _, config := range valid {
+		if err := ValidateLoggingConfig(&config); err != nil {
+			t.Errorf("%+v: unexpected error %v", config, err)
+		}
+	}
+	invalid := []LoggingConfig{
+		{Level: "verbose"},
+		{Format: "xml"},
+		{Components: map[string]string{"rtp": ""}},
+	}
+	for _, config := range invalid {
+		if err := ValidateLoggingConfig(&config); err == nil {
+			t.Errorf("%+v: expected an error", config)
+		}
+	}
+}
+
+func TestLoggingConfigFromEnv(t *testing.T) {
+	t.Setenv("KARL_LOG_LEVEL", "debug")
+	t.Setenv("KARL_LOG_FORMAT", "")
+	config := LoggingConfigFromEnv(&LoggingConfig{Level: "warn", Format: "json", Components: map[string]string{"ng": "error"}})
+	if config.Level != "debug" || config.Format != "json" || config.Components["ng"] != "error" {
+		t.Errorf("unexpected config %+v", config)
+	}
+}
@@ -0,0 +1,377 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	ng "karl/internal/ng_protocol"
+)
+
+// Loopback limits
+const (
+	maxLoopbackDelay = 10000 // ms
+
+	// Reflected packets waiting out the delay; enough for the longest
+	// delay at 50 packets a second
+	loopbackQueueSize = 1024
+)
+
+// Loopback metrics
+var (
+	loopbackPackets = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "karl_loopback_packets_total",
+			Help: "RTP packets received on loopback calls, by whether they were reflected",
+		},
+		[]string{"result"},
+	)
+
+	loopbackCalls = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "karl_loopback_calls",
+			Help: "Loopback calls reflecting media",
+		},
+	)
+)
+
+var (
+	loopbacksMu sync.Mutex
+	loopbacks   = make(map[string]*loopback)
+
+	// Failures to transcode reflected media are reported at most once a minute
+	loopbackErrors = NewLogSampler(Logger(ComponentRTP), slog.LevelWarn, 1, time.Minute)
+)
+
+// LoopbackSettings describe how a loopback call reflects media
+type LoopbackSettings struct {
+	Delay  time.Duration // before a packet is sent back
+	Codecs []CodecInfo   // the offerer's, to resolve received payload types
+	Target *CodecInfo    // codec the media is transcoded to; nil reflects it unchanged
+}
+
+// loopbackSettingsFromFlags returns the loopback settings of an offer's
+// loopback options, given the offered codecs
+func loopbackSettingsFromFlags(pf *ng.ParsedFlags, offered []CodecInfo) (LoopbackSettings, error) {
+	if pf.LoopbackDelay > maxLoopbackDelay {
+		return LoopbackSettings{}, fmt.Errorf("invalid loopback-delay %d, expected 0-%d ms", pf.LoopbackDelay, maxLoopbackDelay)
+	}
+	settings := LoopbackSettings{
+		Delay:  time.Duration(pf.LoopbackDelay) * time.Millisecond,
+		Codecs: offered,
+	}
+	if pf.LoopbackCodec == "" {
+		return settings, nil
+	}
+	for _, c := range offered {
+		if strings.EqualFold(c.Name, pf.LoopbackCodec) {
+			if codecSampleRate(c) == 0 {
+				return LoopbackSettings{}, fmt.Errorf("loopback codec %s cannot be transcoded to", c.Name)
+			}
+			settings.Target = &c
+			return settings, nil
+		}
+	}
+	return LoopbackSettings{}, fmt.Errorf("loopback codec %s was not offered", pf.LoopbackCodec)
+}
+
+// StartLoopback reflects the RTP a call receives on rtpPort back to where
+// it came from, bound to ip or to every address when ip is nil. RTCP on
+// rtcpPort is read and dropped. activity is called for every RTP packet
+// received, so the call counts as having media. A call already looping
+// back on the same port only takes the new settings
+func StartLoopback(callID string, ip net.IP, rtpPort, rtcpPort int, settings LoopbackSettings, activity func(ssrc uint32, size int)) error {
+	loopbacksMu.Lock()
+	defer loopbacksMu.Unlock()
+	if current, ok := loopbacks[callID]; ok {
+		if current.port == rtpPort {
+			current.settings.Store(&settings)
+			return nil
+		}
+		current.close()
+		delete(loopbacks, callID)
+		loopbackCalls.Dec()
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: rtpPort})
+	if err != nil {
+		return fmt.Errorf("failed to bind loopback port %d: %w", rtpPort, err)
+	}
+	MarkRTPConn(conn)
+	SetDontFragment(conn)
+	var rtcpConn *net.UDPConn
+	if rtcpPort > 0 && rtcpPort != rtpPort {
+		if rtcpConn, err = net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: rtcpPort}); err != nil {
+			conn.Close()
+			return fmt.Errorf("failed to bind loopback port %d: %w", rtcpPort, err)
+		}
+		MarkRTCPConn(rtcpConn)
+	}
+
+	l := &loopback{
+		port:     rtpPort,
+		conn:     conn,
+		rtcpConn: rtcpConn,
+		activity: activity,
+		queue:    make(chan reflectedPacket, loopbackQueueSize),
+		done:     make(chan struct{}),
+		ssrc:     rand.Uint32(),
+		codecs:   NewStreamCodecs(),
+	}
+	l.settings.Store(&settings)
+	l.wg.Add(2)
+	go l.read()
+	go l.write()
+	if rtcpConn != nil {
+		l.wg.Add(1)
+		go l.drainRTCP()
+	}
+	loopbacks[callID] = l
+	loopbackCalls.Inc()
+	return nil
+}
+
+// StopLoopback stops reflecting a call's media and closes its sockets
+func StopLoopback(callID string) {
+	loopbacksMu.Lock()
+	l, ok := loopbacks[callID]
+	if ok {
+		delete(loopbacks, callID)
+		loopbackCalls.Dec()
+	}
+	loopbacksMu.Unlock()
+	if ok {
+		l.close()
+	}
+}
+
+// IsLoopback reports whether a call reflects its media
+func IsLoopback(callID string) bool {
+	loopbacksMu.Lock()
+	defer loopbacksMu.Unlock()
+	_, ok := loopbacks[callID]
+	return ok
+}
+
+// loopback reflects one call's media
+type loopback struct {
+	port     int
+	conn     *net.UDPConn
+	rtcpConn *net.UDPConn
+	settings atomic.Pointer[LoopbackSettings]
+	activity func(ssrc uint32, size int)
+	queue    chan reflectedPacket
+	done     chan struct{}
+	wg       sync.WaitGroup
+
+	// Owned by the read goroutine
+	ssrc   uint32 // of the reflected stream, so senders do not see their own
+	codecs *StreamCodecs
+	base   *timestampBase
+}
+
+// reflectedPacket is a packet waiting to be sent back
+type reflectedPacket struct {
+	data []byte
+	to   *net.UDPAddr
+	due  time.Time
+}
+
+// timestampBase maps a sender's timestamps onto the clock of the codec
+// the media is transcoded to
+type timestampBase struct {
+	ssrc    uint32
+	in, out uint32
+	inRate  int
+	outRate int
+}
+
+// read receives the call's RTP and queues it to be sent back
+func (l *loopback) read() {
+	defer l.wg.Done()
+	buf := make([]byte, rtpBufferSize)
+	for {
+		n, from, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		// RTCP of a multiplexed stream is not reflected
+		if n < 12 || IsRTCPPacket(buf[:n]) {
+			continue
+		}
+		var packet rtp.Packet
+		if err := packet.Unmarshal(buf[:n]); err != nil {
+			continue
+		}
+		if l.activity != nil {
+			l.activity(packet.SSRC, n)
+		}
+
+		settings := l.settings.Load()
+		if err := l.reflect(&packet, settings); err != nil {
+			loopbackPackets.WithLabelValues("dropped").Inc()
+			if !errors.Is(err, ErrFrameSuppressed) && loopbackErrors.Allow() {
+				loopbackErrors.Log("Loopback transcoding error", "ssrc", packet.SSRC, "error", err)
+			}
+			continue
+		}
+		data, err := packet.Marshal()
+		if err != nil {
+			continue
+		}
+		select {
+		case l.queue <- reflectedPacket{data: data, to: from, due: time.Now().Add(settings.Delay)}:
+			loopbackPackets.WithLabelValues("reflected").Inc()
+		default:
+			loopbackPackets.WithLabelValues("dropped").Inc()
+		}
+	}
+}
+
+// reflect turns a received packet into the one sent back: transcoded to
+// the target codec if the call has one, and on the loopback's own SSRC
+func (l *loopback) reflect(packet *rtp.Packet, settings *LoopbackSettings) error {
+	sender := packet.SSRC
+	packet.SSRC = l.ssrc
+	packet.CSRC = nil
+	if settings.Target == nil {
+		return nil
+	}
+	var src CodecInfo
+	found := false
+	for _, c := range settings.Codecs {
+		if c.PayloadType == packet.PayloadType {
+			src, found = c, true
+			break
+		}
+	}
+	// DTMF events, comfort noise and codecs Karl cannot decode go back as
+	// they came
+	if !found || src.PayloadType == settings.Target.PayloadType || codecSampleRate(src) == 0 {
+		return nil
+	}
+
+	payload, err := transcodeAudioWith(packet.Payload, src, *settings.Target, l.codecs, nil)
+	if err != nil {
+		return err
+	}
+	packet.Payload = payload
+	packet.PayloadType = settings.Target.PayloadType
+	packet.Timestamp = l.timestamp(sender, packet.Timestamp, rtpClockRate(src), rtpClockRate(*settings.Target))
+	return nil
+}
+
+// timestamp moves a sender's timestamp onto the output clock rate
+func (l *loopback) timestamp(ssrc, ts uint32, inRate, outRate int) uint32 {
+	if inRate == outRate || inRate == 0 {
+		return ts
+	}
+	b := l.base
+	if b == nil || b.ssrc != ssrc || b.inRate != inRate || b.outRate != outRate {
+		b = &timestampBase{ssrc: ssrc, in: ts, out: ts, inRate: inRate, outRate: outRate}
+		l.base = b
+	}
+	return b.out + uint32(uint64(ts-b.in)*uint64(outRate)/uint64(inRate))
+}
+
+// write sends the reflected packets once their delay is up
+func (l *loopback) write() {
+	defer l.wg.Done()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		var p reflectedPacket
+		select {
+		case p = <-l.queue:
+		case <-l.done:
+			return
+		}
+		if wait := time.Until(p.due); wait > 0 {
+			timer.Reset(wait)
+			select {
+			case <-timer.C:
+			case <-l.done:
+				return
+			}
+		}
+		_, _ = l.conn.WriteToUDP(p.data, p.to)
+	}
+}
+
+// drainRTCP reads and drops the call's RTCP, so the peer's reports do not
+// pile up in the socket
+func (l *loopback) drainRTCP() {
+	defer l.wg.Done()
+	buf := make([]byte, rtpBufferSize)
+	for {
+		if _, _, err := l.rtcpConn.ReadFromUDP(buf); err != nil {
+			return
+		}
+	}
+}
+
+// close stops the loopback, dropping the packets still delayed
+func (l *loopback) close() {
+	close(l.done)
+	l.conn.Close()
+	if l.rtcpConn != nil {
+		l.rtcpConn.Close()
+	}
+	l.wg.Wait()
+}
+
+// loopbackAnswerSDP answers an offer for a loopback call: the primary
+// audio section accepts the offered codecs on Karl's ports, and every
+// other section is rejected
+func loopbackAnswerSDP(parsed *parsedSDPInfo, leg *CallLeg, localIP string) string {
+	desc := NewSDPSession("karl", parsed.desc.Origin.SessionID, parsed.desc.Origin.SessionVersion, localIP, "Karl Loopback")
+	for i, offered := range parsed.desc.MediaDescriptions {
+		if i != parsed.primary {
+			desc.MediaDescriptions = append(desc.MediaDescriptions, &sdp.MediaDescription{
+				MediaName: sdp.MediaName{
+					Media:   offered.MediaName.Media,
+					Port:    sdp.RangedPort{Value: 0},
+					Protos:  offered.MediaName.Protos,
+					Formats: offered.MediaName.Formats,
+				},
+			})
+			continue
+		}
+		media := NewSDPMedia(parsed.MediaType, leg.LocalPort, parsed.Protocol, parsed.codecInfos())
+		if leg.RTCPMux {
+			media.Attributes = append(media.Attributes, sdp.NewPropertyAttribute("rtcp-mux"))
+		} else {
+			media.Attributes = append(media.Attributes, sdp.NewAttribute("rtcp", fmt.Sprint(leg.LocalRTCPPort)))
+		}
+		if parsed.Ptime > 0 {
+			media.Attributes = append(media.Attributes, sdp.NewAttribute("ptime", fmt.Sprint(parsed.Ptime)))
+		}
+		media.Attributes = append(media.Attributes, sdp.NewPropertyAttribute(loopbackDirection(parsed.Direction)))
+		desc.MediaDescriptions = append(desc.MediaDescriptions, media)
+	}
+	return MarshalSDP(desc)
+}
+
+// loopbackDirection answers the offerer's media direction
+func loopbackDirection(offered string) string {
+	switch offered {
+	case "sendonly":
+		return "recvonly"
+	case "recvonly":
+		return "sendonly"
+	case "inactive":
+		return "inactive"
+	}
+	return "sendrecv"
+}
@@ -0,0 +1,173 @@
+package internal
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+
+	ng "karl/internal/ng_protocol"
+)
+
+// echo sends one RTP packet to a loopback and returns what comes back
+func echo(t *testing.T, port int, packet *rtp.Packet) (*rtp.Packet, time.Duration) {
+	t.Helper()
+	client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		t.Fatalf("DialUDP: %v", err)
+	}
+	defer client.Close()
+
+	data, _ := packet.Marshal()
+	start := time.Now()
+	if _, err := client.Write(data); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, rtpBufferSize)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("no media reflected: %v", err)
+	}
+	var reflected rtp.Packet
+	if err := reflected.Unmarshal(buf[:n]); err != nil {
+		t.Fatalf("reflected packet: %v", err)
+	}
+	return &reflected, time.Since(start)
+}
+
+// freeUDPPort returns a port nothing is bound to
+func freeUDPPort(t *testing.T) int {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestLoopback_DelayAndTranscode(t *testing.T) {
+	const callID = "loopback-transcode"
+	offered := []CodecInfo{{PayloadType: 0, Name: "PCMU", ClockRate: 8000}, {PayloadType: 8, Name: "PCMA", ClockRate: 8000}}
+	settings, err := loopbackSettingsFromFlags(ng.ParseFlags([]string{"loopback-delay=50", "loopback-codec=pcma"}), offered)
+	if err != nil {
+		t.Fatalf("loopbackSettingsFromFlags: %v", err)
+	}
+	port := freeUDPPort(t)
+	var active atomic.Uint32
+	if err := StartLoopback(callID, net.IPv4(127, 0, 0, 1), port, 0, settings, func(ssrc uint32, _ int) { active.Store(ssrc) }); err != nil {
+		t.Fatalf("StartLoopback: %v", err)
+	}
+	defer StopLoopback(callID)
+
+	payload := make([]byte, 160)
+	for i := range payload {
+		payload[i] = 0xff // PCMU silence
+	}
+	sent := &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 0, SequenceNumber: 7, Timestamp: 160, SSRC: 0x11223344}, Payload: payload}
+	reflected, elapsed := echo(t, port, sent)
+	if elapsed < 50*time.Millisecond {
+		t.Errorf("reflected after %v, want the 50ms delay", elapsed)
+	}
+	want, _ := PCMUToPCMA(payload)
+	if reflected.PayloadType != 8 || string(reflected.Payload) != string(want) {
+		t.Errorf("reflected PT %d payload %x, want PCMA %x", reflected.PayloadType, reflected.Payload, want)
+	}
+	if reflected.SSRC == sent.SSRC || reflected.SequenceNumber != 7 || reflected.Timestamp != 160 {
+		t.Errorf("reflected header %+v", reflected.Header)
+	}
+	if got := active.Load(); got != sent.SSRC {
+		t.Errorf("activity reported for SSRC %x", got)
+	}
+
+	// DTMF events go back unchanged
+	sent = &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 101, SequenceNumber: 8, SSRC: 0x11223344}, Payload: []byte{1, 0, 0, 160}}
+	if reflected, _ = echo(t, port, sent); reflected.PayloadType != 101 || len(reflected.Payload) != 4 {
+		t.Errorf("DTMF reflected as PT %d %x", reflected.PayloadType, reflected.Payload)
+	}
+
+	StopLoopback(callID)
+	if IsLoopback(callID) {
+		t.Fatal("loopback left after StopLoopback")
+	}
+	// The port is free again
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		t.Fatalf("port still bound after StopLoopback: %v", err)
+	}
+	conn.Close()
+}
+
+func TestLoopbackSettingsFromFlags_Invalid(t *testing.T) {
+	offered := []CodecInfo{{PayloadType: 0, Name: "PCMU", ClockRate: 8000}, {PayloadType: 101, Name: "telephone-event", ClockRate: 8000}}
+	for _, flags := range [][]string{
+		{"loopback-delay=" + strconv.Itoa(maxLoopbackDelay+1)},
+		{"loopback-codec=PCMA"},
+		{"loopback-codec=telephone-event"},
+	} {
+		if _, err := loopbackSettingsFromFlags(ng.ParseFlags(flags), offered); err == nil {
+			t.Errorf("%v accepted", flags)
+		}
+	}
+}
+
+func TestNGSocketListener_LoopbackOffer(t *testing.T) {
+	manager, registry, _ := newTestSessionManager(t)
+	listener := &NGSocketListener{sessionRegistry: registry, sessionManager: manager, config: &Config{}}
+
+	resp, err := listener.handleOffer(&ng.NGRequest{CallID: "loopback-call", FromTag: "from-tag", SDP: sipOfferSDP, Flags: []string{"loopback"}})
+	if err != nil || resp.Result != ng.ResultOK {
+		t.Fatalf("handleOffer failed: %v %+v", err, resp)
+	}
+	defer GetCodecNegotiator().RemoveCall("loopback-call")
+
+	port := resp.Streams[0].LocalPort
+	for _, line := range []string{
+		"m=audio " + strconv.Itoa(port) + " RTP/AVP 0 101",
+		"a=rtpmap:0 PCMU/8000",
+		"a=rtcp:" + strconv.Itoa(port+1),
+		"a=sendrecv",
+	} {
+		if !strings.Contains(resp.SDP, line+"\r\n") {
+			t.Errorf("expected %q in:\n%s", line, resp.SDP)
+		}
+	}
+	if !IsLoopback("loopback-call") {
+		t.Fatal("offer did not start the loopback")
+	}
+
+	sent := &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 0, SequenceNumber: 1, SSRC: 0x4c4f4f50}, Payload: make([]byte, 160)}
+	if reflected, _ := echo(t, port, sent); reflected.PayloadType != 0 || len(reflected.Payload) != 160 {
+		t.Errorf("reflected PT %d with %d bytes", reflected.PayloadType, len(reflected.Payload))
+	}
+	session := registry.GetSessionByCallID("loopback-call")[0]
+	session.RLock()
+	state := session.State
+	session.RUnlock()
+	if state != SessionStateActive {
+		t.Errorf("loopback session state %s, want active", state)
+	}
+
+	if resp, _ := listener.handleDelete(&ng.NGRequest{CallID: "loopback-call"}); resp.Result != ng.ResultOK {
+		t.Fatalf("handleDelete failed: %+v", resp)
+	}
+	if IsLoopback("loopback-call") {
+		t.Error("loopback left after delete")
+	}
+}
+
+func TestNGSocketListener_LoopbackOfferSRTP(t *testing.T) {
+	manager, registry, _ := newTestSessionManager(t)
+	listener := &NGSocketListener{sessionRegistry: registry, sessionManager: manager, config: &Config{}}
+
+	offer := strings.Replace(sipOfferSDP, "RTP/AVP", "RTP/SAVP", 1) + "a=crypto:1 AES_CM_128_HMAC_SHA1_80 inline:PS1uQCVeeCFCanVmcjkpPywjNWhcYD0mXXtxaVBR\r\n"
+	resp, _ := listener.handleOffer(&ng.NGRequest{CallID: "loopback-srtp", FromTag: "from-tag", SDP: offer, Flags: []string{"loopback"}})
+	if resp.Result != ng.ResultError || IsLoopback("loopback-srtp") {
+		t.Errorf("SRTP loopback offer accepted: %+v", resp)
+	}
+}
@@ -0,0 +1,311 @@
+package internal
+
+import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	mediaACLDropped = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "karl_media_acl_dropped_total",
+			Help: "Media packets dropped by the source address checks by reason",
+		},
+		[]string{"reason"},
+	)
+	mediaSourceRejected = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "karl_media_source_rejected_total",
+			Help: "Media packets rejected by the expected source check of their call leg by mode",
+		},
+		[]string{"mode"},
+	)
+	mediaACLSources = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "karl_media_acl_sources",
+			Help: "Source IPs with a media rate limit bucket",
+		},
+	)
+)
+
+const (
+	// mediaACLCleanupInterval is how often idle rate limit buckets are
+	// removed
+	mediaACLCleanupInterval = time.Minute
+	// maxMediaACLSources bounds the rate limit buckets; a new source past
+	// it takes the bucket of the source heard from least recently
+	maxMediaACLSources = 65536
+)
+
+// activeMediaACL is the media ACL checking the media ports, nil before
+// Start
+var activeMediaACL atomic.Pointer[MediaACL]
+
+// SourceCheckMode selects which sources a session's media may come from
+type SourceCheckMode string
+
+const (
+	// SourceCheckOff checks only legs offered with strict-source
+	SourceCheckOff SourceCheckMode = "off"
+	// SourceCheckSDP accepts media only from the address in the leg's SDP
+	SourceCheckSDP SourceCheckMode = "sdp"
+	// SourceCheckLearn latches the first source of each leg and drops
+	// media from any other
+	SourceCheckLearn SourceCheckMode = "learn"
+	// SourceCheckAny accepts media from any source, even on legs offered
+	// with strict-source
+	SourceCheckAny SourceCheckMode = "any"
+)
+
+// ParseSourceCheckMode parses a media_acl source_check value, "" meaning off
+func ParseSourceCheckMode(s string) (SourceCheckMode, error) {
+	switch SourceCheckMode(s) {
+	case "", SourceCheckOff:
+		return SourceCheckOff, nil
+	case SourceCheckSDP, SourceCheckLearn, SourceCheckAny:
+		return SourceCheckMode(s), nil
+	default:
+		return "", fmt.Errorf("invalid media source check: %s", s)
+	}
+}
+
+// MediaACL decides which packets arriving on the media ports are accepted:
+// the global allow and deny lists, a token bucket per source IP and the
+// expected source of the session the packet belongs to
+type MediaACL struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+	mode  SourceCheckMode
+	rate  float64
+	burst int
+
+	// checkSource reports whether media arriving on a port may come from
+	// an address
+	checkSource func(conn *net.UDPConn, ssrc uint32, from *net.UDPAddr, mode SourceCheckMode, rtcp bool) bool
+
+	mu       sync.Mutex
+	buckets  map[netip.Addr]*list.Element // of the *sourceBucket in recent
+	recent   *list.List                   // buckets, most recently used first
+	capacity int
+	stop     chan struct{}
+}
+
+// sourceBucket is the rate limiter of a source IP
+type sourceBucket struct {
+	addr    netip.Addr
+	limiter *TokenBucketLimiter
+}
+
+// NewMediaACL builds the checks from config
+func NewMediaACL(config *MediaACLConfig) (*MediaACL, error) {
+	a := &MediaACL{
+		rate:     float64(config.RateLimit),
+		burst:    config.Burst,
+		buckets:  make(map[netip.Addr]*list.Element),
+		recent:   list.New(),
+		capacity: maxMediaACLSources,
+		stop:     make(chan struct{}),
+	}
+	if a.burst <= 0 {
+		a.burst = config.RateLimit
+	}
+
+	var err error
+	if a.mode, err = ParseSourceCheckMode(config.SourceCheck); err != nil {
+		return nil, err
+	}
+	if a.allow, err = parsePrefixes(config.Allow); err != nil {
+		return nil, err
+	}
+	if a.deny, err = parsePrefixes(config.Deny); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// InitMediaACL creates the media ACL. Without media_acl it only applies the
+// source checks calls ask for with strict-source or source-check
+func InitMediaACL(cfg *Config) (*MediaACL, error) {
+	if cfg.MediaACL == nil {
+		return NewMediaACL(&MediaACLConfig{})
+	}
+	return NewMediaACL(cfg.MediaACL)
+}
+
+// ValidateMediaACLConfig checks the media ACL settings
+func ValidateMediaACLConfig(cfg *Config) error {
+	a := cfg.MediaACL
+	if a.RateLimit < 0 || a.Burst < 0 {
+		return fmt.Errorf("invalid media rate limit: %d/s burst %d", a.RateLimit, a.Burst)
+	}
+	_, err := NewMediaACL(a)
+	return err
+}
+
+// parsePrefixes parses CIDRs, taking a bare address as a single host
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(cidr)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid media ACL CIDR %q: %w", cidr, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetSourceChecker sets the per-session lookup of expected sources
+func (a *MediaACL) SetSourceChecker(check func(conn *net.UDPConn, ssrc uint32, from *net.UDPAddr, mode SourceCheckMode, rtcp bool) bool) {
+	a.checkSource = check
+}
+
+// Allow reports whether an RTP or RTCP packet from the given address is
+// accepted on conn, nil for a stream connection, counting the drops by
+// reason
+func (a *MediaACL) Allow(conn *net.UDPConn, packet []byte, from *net.UDPAddr) bool {
+	if from == nil {
+		return true
+	}
+	addr := from.AddrPort().Addr().Unmap()
+
+	if containsAddr(a.deny, addr) {
+		mediaACLDropped.WithLabelValues("denylist").Inc()
+		return false
+	}
+	if len(a.allow) > 0 && !containsAddr(a.allow, addr) {
+		mediaACLDropped.WithLabelValues("allowlist").Inc()
+		return false
+	}
+	if a.rate > 0 && !a.bucket(addr).Allow() {
+		mediaACLDropped.WithLabelValues("rate_limit").Inc()
+		return false
+	}
+
+	if a.checkSource != nil {
+		// The sender SSRC sits at bytes 4-8 of RTCP and 8-12 of RTP
+		rtcp := IsRTCPPacket(packet)
+		var ssrc uint32
+		switch {
+		case rtcp && len(packet) >= 8:
+			ssrc = binary.BigEndian.Uint32(packet[4:8])
+		case !rtcp && len(packet) >= 12:
+			ssrc = binary.BigEndian.Uint32(packet[8:12])
+		default:
+			return true
+		}
+		if !a.checkSource(conn, ssrc, from, a.mode, rtcp) {
+			mediaACLDropped.WithLabelValues("source").Inc()
+			return false
+		}
+	}
+	return true
+}
+
+// bucket returns the rate limiter of a source IP. Once the table is full a
+// new source evicts the one heard from least recently, so a flood of
+// spoofed addresses cannot grow it without bound
+func (a *MediaACL) bucket(addr netip.Addr) *TokenBucketLimiter {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if e, ok := a.buckets[addr]; ok {
+		a.recent.MoveToFront(e)
+		return e.Value.(*sourceBucket).limiter
+	}
+
+	if len(a.buckets) >= a.capacity {
+		oldest := a.recent.Back()
+		delete(a.buckets, oldest.Value.(*sourceBucket).addr)
+		a.recent.Remove(oldest)
+	}
+	b := &sourceBucket{addr: addr, limiter: NewTokenBucketLimiter(a.rate, a.burst)}
+	a.buckets[addr] = a.recent.PushFront(b)
+	mediaACLSources.Set(float64(len(a.buckets)))
+	return b.limiter
+}
+
+// filtersAddresses reports whether the ACL drops packets by source address
+// or rate, which only happens in user space
+func (a *MediaACL) filtersAddresses() bool {
+	return len(a.allow) > 0 || len(a.deny) > 0 || a.rate > 0
+}
+
+// mediaSourceCheck returns the source check mode of the media ACL in use,
+// off without one
+func mediaSourceCheck() SourceCheckMode {
+	if a := activeMediaACL.Load(); a != nil {
+		return a.mode
+	}
+	return SourceCheckOff
+}
+
+// mediaACLFiltersAddresses reports whether the media ACL in use drops
+// packets by source address or rate
+func mediaACLFiltersAddresses() bool {
+	a := activeMediaACL.Load()
+	return a != nil && a.filtersAddresses()
+}
+
+// Start puts the ACL in use and removes idle rate limit buckets
+// periodically
+func (a *MediaACL) Start() {
+	activeMediaACL.Store(a)
+	go func() {
+		ticker := time.NewTicker(mediaACLCleanupInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.stop:
+				return
+			case <-ticker.C:
+				a.cleanup()
+			}
+		}
+	}()
+}
+
+// Stop takes the ACL out of use and ends the bucket cleanup
+func (a *MediaACL) Stop() {
+	activeMediaACL.CompareAndSwap(a, nil)
+	select {
+	case <-a.stop:
+	default:
+		close(a.stop)
+	}
+}
+
+// cleanup drops the buckets that have refilled, whose sources sent nothing
+// for at least the time a full refill takes
+func (a *MediaACL) cleanup() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for addr, e := range a.buckets {
+		if e.Value.(*sourceBucket).limiter.Available() >= float64(a.burst) {
+			delete(a.buckets, addr)
+			a.recent.Remove(e)
+		}
+	}
+	mediaACLSources.Set(float64(len(a.buckets)))
+}
@@ -0,0 +1,245 @@
+package internal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// rtpFrom builds a minimal RTP packet with the given SSRC
+func rtpFrom(ssrc uint32) []byte {
+	packet := make([]byte, 12)
+	packet[0] = 0x80
+	binary.BigEndian.PutUint32(packet[8:12], ssrc)
+	return packet
+}
+
+func udpAddr(s string) *net.UDPAddr {
+	addr, _ := net.ResolveUDPAddr("udp", s)
+	return addr
+}
+
+func TestMediaACL_AllowAndDenyLists(t *testing.T) {
+	acl, err := NewMediaACL(&MediaACLConfig{
+		Allow: []string{"10.0.0.0/8", "192.0.2.7"},
+		Deny:  []string{"10.6.6.0/24"},
+	})
+	if err != nil {
+		t.Fatalf("NewMediaACL failed: %v", err)
+	}
+
+	tests := []struct {
+		from string
+		want bool
+	}{
+		{"10.1.2.3:4000", true},
+		{"192.0.2.7:4000", true},
+		{"192.0.2.8:4000", false},
+		{"10.6.6.1:4000", false},
+		{"[::ffff:10.1.2.3]:4000", true},
+	}
+	for _, tt := range tests {
+		if got := acl.Allow(nil, rtpFrom(1), udpAddr(tt.from)); got != tt.want {
+			t.Errorf("Allow(%s) = %v, want %v", tt.from, got, tt.want)
+		}
+	}
+
+	if _, err := NewMediaACL(&MediaACLConfig{Deny: []string{"not-a-cidr"}}); err == nil {
+		t.Error("expected an invalid CIDR to be rejected")
+	}
+}
+
+func TestMediaACL_RateLimitPerSource(t *testing.T) {
+	acl, err := NewMediaACL(&MediaACLConfig{RateLimit: 1, Burst: 5})
+	if err != nil {
+		t.Fatalf("NewMediaACL failed: %v", err)
+	}
+
+	flooder, other := udpAddr("203.0.113.1:4000"), udpAddr("203.0.113.2:4000")
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		if acl.Allow(nil, rtpFrom(1), flooder) {
+			allowed++
+		}
+	}
+	if allowed != 5 {
+		t.Errorf("expected the burst of 5 packets through, got %d", allowed)
+	}
+	if !acl.Allow(nil, rtpFrom(1), other) {
+		t.Error("expected another source to have its own bucket")
+	}
+
+	// Only the full bucket of an idle source is removed
+	acl.cleanup()
+	if _, ok := acl.buckets[flooder.AddrPort().Addr().Unmap()]; !ok {
+		t.Error("expected the flooding source's bucket to be kept")
+	}
+}
+
+func TestMediaACL_RateLimitBucketsBounded(t *testing.T) {
+	acl, err := NewMediaACL(&MediaACLConfig{RateLimit: 1, Burst: 2, Deny: []string{"198.51.100.0/24"}})
+	if err != nil {
+		t.Fatalf("NewMediaACL failed: %v", err)
+	}
+	acl.capacity = 3
+
+	// Denied sources never get a bucket
+	acl.Allow(nil, rtpFrom(1), udpAddr("198.51.100.7:4000"))
+	if len(acl.buckets) != 0 {
+		t.Fatalf("expected no bucket for a denied source, got %d", len(acl.buckets))
+	}
+
+	flooder := udpAddr("203.0.113.1:4000")
+	acl.Allow(nil, rtpFrom(1), flooder)
+	acl.Allow(nil, rtpFrom(1), flooder)
+	for i := 2; i <= 3; i++ {
+		acl.Allow(nil, rtpFrom(1), udpAddr(fmt.Sprintf("203.0.113.%d:4000", i)))
+	}
+	// The flooder is heard from again, so the new source evicts .2
+	if acl.Allow(nil, rtpFrom(1), flooder) {
+		t.Error("expected the flooder past its burst")
+	}
+	acl.Allow(nil, rtpFrom(1), udpAddr("203.0.113.4:4000"))
+
+	if len(acl.buckets) != 3 || acl.recent.Len() != 3 {
+		t.Fatalf("expected 3 buckets, got %d", len(acl.buckets))
+	}
+	if _, ok := acl.buckets[udpAddr("203.0.113.2:4000").AddrPort().Addr()]; ok {
+		t.Error("expected the least recently used source evicted")
+	}
+	if acl.Allow(nil, rtpFrom(1), flooder) {
+		t.Error("expected the flooder to keep its empty bucket")
+	}
+}
+
+func TestSessionRegistry_CheckMediaSource(t *testing.T) {
+	sr := NewSessionRegistry(time.Hour)
+	defer sr.Stop()
+
+	session := sr.CreateSession("call-1", "tag-1")
+	sr.SetCallerLeg(session.ID, &CallLeg{Tag: "tag-1", IP: net.ParseIP("198.51.100.1"), Port: 5000, SSRC: 1111})
+	sr.SetCalleeLeg(session.ID, &CallLeg{Tag: "tag-2", IP: net.ParseIP("198.51.100.2"), Port: 6000, SSRC: 2222, StrictSource: true})
+
+	sdp, nat, spoof := udpAddr("198.51.100.1:5000"), udpAddr("203.0.113.9:31000"), udpAddr("203.0.113.66:31000")
+
+	// Media must come from the SDP address
+	if !sr.CheckMediaSource(nil, 1111, sdp, SourceCheckSDP, false) || sr.CheckMediaSource(nil, 1111, nat, SourceCheckSDP, false) {
+		t.Error("expected only the SDP address to pass the sdp check")
+	}
+	if !sr.CheckMediaSource(nil, 1111, udpAddr("198.51.100.1:5001"), SourceCheckSDP, true) {
+		t.Error("expected RTCP from the SDP IP to pass")
+	}
+
+	// Without a global check, legs without strict-source accept anyone
+	if !sr.CheckMediaSource(nil, 1111, spoof, SourceCheckOff, false) {
+		t.Error("expected no check on a leg without strict-source")
+	}
+
+	// The first source of a strict-source leg is latched
+	if !sr.CheckMediaSource(nil, 2222, nat, SourceCheckOff, false) {
+		t.Fatal("expected the first source to be learned")
+	}
+	if sr.CheckMediaSource(nil, 2222, spoof, SourceCheckOff, false) {
+		t.Error("expected another source to be dropped after learning")
+	}
+	if !sr.CheckMediaSource(nil, 2222, udpAddr("203.0.113.9:31001"), SourceCheckOff, true) {
+		t.Error("expected RTCP from the learned IP to pass")
+	}
+
+	// SSRCs outside any session are left to the global lists on the
+	// shared listener
+	if !sr.CheckMediaSource(nil, 3333, spoof, SourceCheckLearn, false) {
+		t.Error("expected an unknown SSRC to pass")
+	}
+}
+
+func TestSessionRegistry_CheckMediaSourceOnLegPort(t *testing.T) {
+	sr := NewSessionRegistry(time.Hour)
+	defer sr.Stop()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The callee sends to the caller leg's port
+	session := sr.CreateSession("call-1", "tag-1")
+	sr.SetCallerLeg(session.ID, &CallLeg{Tag: "tag-1", IP: net.ParseIP("198.51.100.1"), Port: 5000, SSRC: 1111, Conn: conn})
+	sr.SetCalleeLeg(session.ID, &CallLeg{Tag: "tag-2", IP: net.ParseIP("198.51.100.2"), Port: 6000, SSRC: 2222})
+	session.mu.RLock()
+	caller := session.CallerLeg
+	session.mu.RUnlock()
+	sr.indexMediaPorts(session, caller)
+
+	sdp, spoof := udpAddr("198.51.100.2:6000"), udpAddr("203.0.113.66:31000")
+	if !sr.CheckMediaSource(conn, 2222, sdp, SourceCheckSDP, false) {
+		t.Error("expected the callee's SDP address to pass")
+	}
+
+	// A fresh SSRC is checked against the party sending to the port
+	if sr.CheckMediaSource(conn, 3333, spoof, SourceCheckSDP, false) {
+		t.Error("expected an unknown SSRC from another address to be dropped")
+	}
+	if sr.CheckMediaSource(conn, 1111, udpAddr("198.51.100.1:5000"), SourceCheckSDP, false) {
+		t.Error("expected the caller's own address to be dropped on the port the callee sends to")
+	}
+	if !sr.CheckMediaSource(conn, 3333, sdp, SourceCheckSDP, false) {
+		t.Error("expected a new SSRC from the callee's SDP address to pass")
+	}
+}
+
+func TestSessionRegistry_SessionSourceCheck(t *testing.T) {
+	sr := NewSessionRegistry(time.Hour)
+	defer sr.Stop()
+
+	session := sr.CreateSession("call-1", "tag-1")
+	sr.SetCallerLeg(session.ID, &CallLeg{Tag: "tag-1", IP: net.ParseIP("198.51.100.1"), Port: 5000, SSRC: 1111, StrictSource: true})
+	nat, spoof := udpAddr("203.0.113.9:31000"), udpAddr("203.0.113.66:31000")
+	check := func(mode SourceCheckMode, from *net.UDPAddr) bool {
+		session.mu.Lock()
+		session.SourceCheck = mode
+		session.mu.Unlock()
+		return sr.CheckMediaSource(nil, 1111, from, SourceCheckOff, false)
+	}
+
+	// The call's own check overrides the global one and strict-source
+	if check(SourceCheckSDP, nat) {
+		t.Error("expected the sdp check of the call to drop a NATed source")
+	}
+	if !check(SourceCheckAny, nat) || !check(SourceCheckAny, spoof) {
+		t.Error("expected any source to pass when the call accepts any")
+	}
+	if !check(SourceCheckLearn, nat) || check(SourceCheckLearn, spoof) {
+		t.Error("expected the call to latch its first source")
+	}
+
+	session.mu.RLock()
+	rejected := session.CallerLeg.SourceRejected
+	session.mu.RUnlock()
+	if rejected != 2 {
+		t.Errorf("counted %d rejected packets, want 2", rejected)
+	}
+}
+
+func TestMediaACL_SourceCheck(t *testing.T) {
+	sr := NewSessionRegistry(time.Hour)
+	defer sr.Stop()
+	session := sr.CreateSession("call-1", "tag-1")
+	sr.SetCallerLeg(session.ID, &CallLeg{Tag: "tag-1", SSRC: 1111})
+
+	acl, err := NewMediaACL(&MediaACLConfig{SourceCheck: "learn"})
+	if err != nil {
+		t.Fatalf("NewMediaACL failed: %v", err)
+	}
+	acl.SetSourceChecker(sr.CheckMediaSource)
+
+	if !acl.Allow(nil, rtpFrom(1111), udpAddr("203.0.113.9:31000")) {
+		t.Fatal("expected the first source to be accepted")
+	}
+	if acl.Allow(nil, rtpFrom(1111), udpAddr("203.0.113.66:31000")) {
+		t.Error("expected an injected packet to be dropped")
+	}
+}
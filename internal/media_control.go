@@ -0,0 +1,150 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Per-leg media control: a moderator or a compliance trigger blocks, mutes
+// or forces the direction of one leg of a running call, the way rtpengine's
+// block media and silence media do. The forwarder applies it to every
+// packet, so calls under control stay out of kernel offload.
+
+// Leg names a media control accepts besides a leg's tag
+const (
+	LegCaller = "caller"
+	LegCallee = "callee"
+)
+
+// ErrUnknownLeg is returned when a media control names no leg of the call
+var ErrUnknownLeg = errors.New("unknown leg")
+
+// LegMediaControl is the media control state of one leg
+type LegMediaControl struct {
+	Blocked   bool   // Media from the leg is dropped
+	Silenced  bool   // Audio from the leg is replaced by silence
+	Direction string // sendonly, recvonly or inactive from the leg's side, empty to follow its SDP
+}
+
+// sends reports whether media from a leg is relayed under its forced direction
+func (c LegMediaControl) sends() bool {
+	return c.Direction != SDPDirectionRecvOnly && c.Direction != SDPDirectionInactive
+}
+
+// validLegDirection reports whether a direction can be forced on a leg.
+// sendrecv clears a forced direction
+func validLegDirection(direction string) bool {
+	switch direction {
+	case "", SDPDirectionSendRecv, SDPDirectionSendOnly, SDPDirectionRecvOnly, SDPDirectionInactive:
+		return true
+	}
+	return false
+}
+
+// legNamed returns the caller or callee leg, or the leg with the given tag.
+// The caller holds the session lock
+func (s *MediaSession) legNamed(name string) *CallLeg {
+	switch {
+	case name == LegCaller:
+		return s.CallerLeg
+	case name == LegCallee:
+		return s.CalleeLeg
+	case name == "":
+		return nil
+	case s.CallerLeg != nil && s.CallerLeg.Tag == name:
+		return s.CallerLeg
+	case s.CalleeLeg != nil && s.CalleeLeg.Tag == name:
+		return s.CalleeLeg
+	}
+	return nil
+}
+
+// MediaControl returns the media control state of a leg, named caller,
+// callee or by its tag
+func (s *MediaSession) MediaControl(leg string) (LegMediaControl, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	l := s.legNamed(leg)
+	if l == nil {
+		return LegMediaControl{}, fmt.Errorf("%w: %q", ErrUnknownLeg, leg)
+	}
+	return l.mediaControl(), nil
+}
+
+// SetMediaControl changes the media control state of a leg, named caller,
+// callee or by its tag. The media_blocked and media_silenced flags follow
+// the state of both legs
+func (s *MediaSession) SetMediaControl(leg string, control LegMediaControl) error {
+	if !validLegDirection(control.Direction) {
+		return fmt.Errorf("invalid direction %q, expected sendrecv, sendonly, recvonly or inactive", control.Direction)
+	}
+	if control.Direction == SDPDirectionSendRecv {
+		control.Direction = ""
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l := s.legNamed(leg)
+	if l == nil {
+		return fmt.Errorf("%w: %q", ErrUnknownLeg, leg)
+	}
+	l.MediaBlocked = control.Blocked
+	l.Silenced = control.Silenced
+	l.ForcedDirection = control.Direction
+
+	blocked, silenced := false, false
+	for _, l := range []*CallLeg{s.CallerLeg, s.CalleeLeg} {
+		if l != nil {
+			blocked = blocked || l.MediaBlocked
+			silenced = silenced || l.Silenced
+		}
+	}
+	s.Flags["media_blocked"] = blocked
+	s.Flags["media_silenced"] = silenced
+	return nil
+}
+
+// mediaControl returns the leg's media control state. The caller holds the
+// session lock
+func (leg *CallLeg) mediaControl() LegMediaControl {
+	return LegMediaControl{Blocked: leg.MediaBlocked, Silenced: leg.Silenced, Direction: leg.ForcedDirection}
+}
+
+// mediaControlled reports whether a leg is blocked, muted or has a forced
+// direction. The caller holds the session lock
+func (leg *CallLeg) mediaControlled() bool {
+	return leg.MediaBlocked || leg.Silenced || leg.ForcedDirection != ""
+}
+
+// relays reports whether media from leg to peer passes their media
+// controls: neither is parked, the sender is not blocked and sends, and
+// the receiver receives. The caller holds the session lock
+func relays(leg, peer *CallLeg) bool {
+	if leg.Parked || peer.Parked || leg.MediaBlocked || !leg.mediaControl().sends() {
+		return false
+	}
+	return peer.ForcedDirection != SDPDirectionSendOnly && peer.ForcedDirection != SDPDirectionInactive
+}
+
+// silencePacket returns a copy of an audio packet from a muted leg with
+// its G.711 payload replaced by silence. DTMF and comfort noise pass
+// unchanged; other codecs cannot be silenced in place, so their packets
+// are dropped (nil)
+func silencePacket(packet *RTPPacket, codecs []CodecInfo, decode bool) *RTPPacket {
+	codec, ok := findCodecByPayloadType(codecs, packet.PayloadType)
+	if !ok || !decode {
+		return nil
+	}
+	switch {
+	case strings.EqualFold(codec.Name, "telephone-event"), strings.EqualFold(codec.Name, "CN"):
+		return packet
+	case isG711(codec.Name):
+		silenced := *packet
+		silenced.Payload = encodeG711(codec.Name, make([]int16, len(packet.Payload)))
+		return &silenced
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// payloadSink records the payloads of relayed RTP by destination port
+type payloadSink struct {
+	mu   sync.Mutex
+	sent map[int][][]byte
+}
+
+func (s *payloadSink) send(conn *net.UDPConn, packets [][]byte, addr *net.UDPAddr) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, packet := range packets {
+		p, err := ParseRTPPacket(packet)
+		if err != nil {
+			return i, err
+		}
+		s.sent[addr.Port] = append(s.sent[addr.Port], append([]byte(nil), p.Payload...))
+	}
+	return len(packets), nil
+}
+
+// take returns and forgets what was sent to a port
+func (s *payloadSink) take(port int) [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sent := s.sent[port]
+	delete(s.sent, port)
+	return sent
+}
+
+func TestMediaControl_Forwarding(t *testing.T) {
+	registry := NewSessionRegistry(time.Hour)
+	defer registry.Stop()
+	session := registry.CreateSession("control-call", "from-tag")
+
+	codecs := []CodecInfo{
+		{PayloadType: 0, Name: "PCMU", ClockRate: 8000, Channels: 1},
+		{PayloadType: 101, Name: "telephone-event", ClockRate: 8000, Channels: 1},
+	}
+	caller := &CallLeg{Tag: "from-tag", IP: net.ParseIP("192.0.2.10"), Port: 30000, LocalPort: 20000,
+		MediaType: MediaAudio, Transport: TransportRTP, Codecs: codecs}
+	callee := &CallLeg{Tag: "to-tag", IP: net.ParseIP("198.51.100.20"), Port: 40000, LocalPort: 21000,
+		MediaType: MediaAudio, Transport: TransportRTP, Codecs: codecs}
+	if err := registry.SetCallerLeg(session.ID, caller); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.SetCalleeLeg(session.ID, callee); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.RegisterSSRC(session.ID, 0xC1, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.RegisterSSRC(session.ID, 0xC2, false); err != nil {
+		t.Fatal(err)
+	}
+
+	sink := &payloadSink{sent: make(map[int][][]byte)}
+	registry.SetMediaSender(sink.send)
+	defer registry.SetMediaSender(nil)
+	forwarder := registry.forwarder
+
+	speech := []byte{0x12, 0x34, 0x56, 0x78}
+	dtmf := (&TelephoneEvent{Event: 5, Duration: 160}).Marshal()
+	handle := func(ssrc uint32, pt uint8, payload []byte) {
+		t.Helper()
+		if err := forwarder.Handle(&RTPPacket{Version: 2, SSRC: ssrc, PayloadType: pt, Payload: payload}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A muted caller is heard as G.711 silence; its DTMF still passes and
+	// audio that cannot be silenced in place is dropped
+	if err := session.SetMediaControl(LegCaller, LegMediaControl{Silenced: true}); err != nil {
+		t.Fatal(err)
+	}
+	handle(0xC1, 0, speech)
+	handle(0xC1, 101, dtmf)
+	handle(0xC1, 18, speech)
+	got := sink.take(40000)
+	if len(got) != 2 || !bytes.Equal(got[0], encodeG711("PCMU", make([]int16, 4))) || !bytes.Equal(got[1], dtmf) {
+		t.Errorf("muted caller relayed %x", got)
+	}
+	if !session.GetFlag("media_silenced") {
+		t.Error("media_silenced flag not set")
+	}
+
+	// A callee forced to sendonly is heard but receives nothing
+	if err := session.SetMediaControl("to-tag", LegMediaControl{Direction: SDPDirectionSendOnly}); err != nil {
+		t.Fatal(err)
+	}
+	handle(0xC1, 0, speech)
+	handle(0xC2, 0, speech)
+	if got := sink.take(40000); len(got) != 0 {
+		t.Errorf("sendonly callee received %d packets", len(got))
+	}
+	if got := sink.take(30000); len(got) != 1 || !bytes.Equal(got[0], speech) {
+		t.Errorf("sendonly callee was not heard: %x", got)
+	}
+
+	// A blocked callee is not heard, and sendrecv clears its direction
+	if err := session.SetMediaControl(LegCallee, LegMediaControl{Blocked: true, Direction: SDPDirectionSendRecv}); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.SetMediaControl(LegCaller, LegMediaControl{}); err != nil {
+		t.Fatal(err)
+	}
+	handle(0xC1, 0, speech)
+	handle(0xC2, 0, speech)
+	if got := sink.take(30000); len(got) != 0 {
+		t.Errorf("blocked callee relayed %d packets", len(got))
+	}
+	if got := sink.take(40000); len(got) != 1 || !bytes.Equal(got[0], speech) {
+		t.Errorf("unmuted caller relayed %x", got)
+	}
+	if control, _ := session.MediaControl(LegCallee); control != (LegMediaControl{Blocked: true}) {
+		t.Errorf("unexpected callee control %+v", control)
+	}
+	if !session.GetFlag("media_blocked") || session.GetFlag("media_silenced") {
+		t.Errorf("unexpected flags %v", session.Flags)
+	}
+}
+
+func TestMediaControl_Errors(t *testing.T) {
+	registry := NewSessionRegistry(time.Hour)
+	defer registry.Stop()
+	session := registry.CreateSession("control-errors", "from-tag")
+	if err := registry.SetCallerLeg(session.ID, &CallLeg{Tag: "from-tag"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := session.MediaControl(LegCallee); !errors.Is(err, ErrUnknownLeg) {
+		t.Errorf("expected ErrUnknownLeg before the answer, got %v", err)
+	}
+	if err := session.SetMediaControl("other-tag", LegMediaControl{Blocked: true}); !errors.Is(err, ErrUnknownLeg) {
+		t.Errorf("expected ErrUnknownLeg for an unknown tag, got %v", err)
+	}
+	if err := session.SetMediaControl(LegCaller, LegMediaControl{Direction: "sendrecv-only"}); err == nil {
+		t.Error("expected an error for an invalid direction")
+	}
+}
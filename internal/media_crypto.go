@@ -0,0 +1,810 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/dtls/v2"
+	"github.com/pion/srtp/v2"
+	"github.com/pion/stun"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// A call whose parties protect their media differently, such as plain RTP
+// from a PBX and DTLS-SRTP from a browser, is bridged: Karl ends each
+// party's protection on the ports the party was given, decrypting what it
+// sends and encrypting what is relayed to it. Parties on the same transport
+// keep passing SRTP and DTLS through end to end.
+
+// CryptoMode is how a party protects its media
+type CryptoMode string
+
+const (
+	CryptoPlain CryptoMode = "plain" // RTP/AVP and RTP/AVPF
+	CryptoSDES  CryptoMode = "sdes"  // RTP/SAVP and RTP/SAVPF keyed with a=crypto
+	CryptoDTLS  CryptoMode = "dtls"  // UDP/TLS/RTP/SAVP and SAVPF, keyed by DTLS
+	CryptoZRTP  CryptoMode = "zrtp"  // RTP/AVP and RTP/AVPF, keyed in the media path by ZRTP
+)
+
+// defaultSDESSuite is the crypto suite Karl keys an SDES party with when
+// the other party used none
+const defaultSDESSuite = "AES_CM_128_HMAC_SHA1_80"
+
+// dtlsHandshakeTimeout bounds Karl's DTLS handshake with a party
+const dtlsHandshakeTimeout = 30 * time.Second
+
+// errMediaUnkeyed is returned for media of a party whose keys are not known
+// yet, such as before its DTLS handshake completed
+var errMediaUnkeyed = errors.New("bridged leg has no SRTP key yet")
+
+var (
+	mediaCryptoBridges = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "karl_media_crypto_bridges_total",
+			Help: "Total offers whose transport Karl bridged, by the offerer's and the answerer's protection (plain, sdes, dtls)",
+		},
+		[]string{"from", "to"},
+	)
+
+	mediaCryptoDropped = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "karl_media_crypto_dropped_total",
+			Help: "Total packets dropped on bridged legs, by protection and reason (unkeyed, decrypt, encrypt)",
+		},
+		[]string{"mode", "reason"},
+	)
+
+	mediaDTLSHandshakes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "karl_media_dtls_handshakes_total",
+			Help: "Total DTLS-SRTP handshakes Karl ran with bridged parties, by result (success, failure)",
+		},
+		[]string{"result"},
+	)
+)
+
+// protocolCryptoMode returns the protection an m= line transport calls for
+func protocolCryptoMode(protocol string) CryptoMode {
+	switch {
+	case strings.HasPrefix(protocol, "UDP/TLS/"):
+		return CryptoDTLS
+	case strings.Contains(protocol, "SAVP"):
+		return CryptoSDES
+	}
+	return CryptoPlain
+}
+
+// MediaCrypto is Karl's end of one party's protection on a bridged call. It
+// decrypts what the party sends and encrypts what is relayed to it, on the
+// ports the party was given
+type MediaCrypto struct {
+	Mode     CryptoMode
+	Protocol string // transport of the party's m= sections
+
+	// SDES: Karl's key, advertised to the party, and the party's own
+	Tag       string // a=crypto tag; an answer repeats the offer's
+	Suite     string
+	LocalKey  string // inline key-params, base64 of key || salt
+	RemoteKey string
+
+	// DTLS: Karl's a=setup role towards the party and the fingerprint of
+	// the party's certificate
+	Setup             string
+	RemoteFingerprint string
+
+	// ZRTP: the a=zrtp-hash of Karl's Hello, advertised to the party, and
+	// the party's own
+	ZRTPHash       string
+	RemoteZRTPHash string
+
+	// ICE holds the credentials the party was given, which Karl answers its
+	// connectivity checks with. Unless they are ICE-lite ones, Karl also
+	// checks the party's candidates, signed with its RemoteICE
+	ICE       *ICECredentials
+	RemoteICE *ICECredentials
+
+	mu        sync.Mutex
+	inbound   SRTPCipher // decrypts what the party sends
+	outbound  SRTPCipher // encrypts what is relayed to the party
+	transport *dtlsTransport
+	dtlsConn  *dtls.Conn
+	zrtp      *zrtpEndpoint
+	closed    bool
+
+	// latch points the party's media at the address ICE nominated
+	latch func(addr *net.UDPAddr)
+
+	// Karl's connectivity checks of the party's candidates, and whether
+	// Karl nominates the pair
+	candidates  []*net.UDPAddr
+	controlling bool
+	checks      *iceChecker
+
+	// An SRTPCipher is not safe for concurrent use
+	rxMu, txMu sync.Mutex
+}
+
+// NewPlainCrypto returns the end of a party that sends plain RTP
+func NewPlainCrypto(protocol string) *MediaCrypto {
+	return &MediaCrypto{Mode: CryptoPlain, Protocol: protocol}
+}
+
+// NewSDESCrypto returns the end of a party keyed with SDES. Karl generates
+// its own key in suite, the default one when empty; the party's key is set
+// from its SDP with SetRemoteKey
+func NewSDESCrypto(protocol, suite string) (*MediaCrypto, error) {
+	if suite == "" {
+		suite = defaultSDESSuite
+	}
+	suite = strings.ToUpper(suite)
+	profile, ok := softwareSRTPProfiles[suite]
+	if !ok {
+		return nil, fmt.Errorf("unsupported SRTP crypto suite: %s", suite)
+	}
+	key, salt, err := GenerateSRTPMasterKey(suite)
+	if err != nil {
+		return nil, err
+	}
+	outbound, err := NewSRTPCipher(key, salt, profile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create SRTP context: %w", err)
+	}
+	params := SRTPParameters{MasterKey: key, MasterSalt: salt}
+	return &MediaCrypto{
+		Mode:     CryptoSDES,
+		Protocol: protocol,
+		Tag:      "1",
+		Suite:    suite,
+		LocalKey: params.InlineKey(),
+		outbound: outbound,
+	}, nil
+}
+
+// NewDTLSCrypto returns the end of a party keyed by DTLS-SRTP. setup is
+// Karl's role, actpass until the party's answer settles it
+func NewDTLSCrypto(protocol, setup string) *MediaCrypto {
+	return &MediaCrypto{Mode: CryptoDTLS, Protocol: protocol, Setup: setup}
+}
+
+// NewZRTPCrypto returns the end of a party keyed by ZRTP. Until the key
+// agreement completes, the party's media is plain RTP both ways
+func NewZRTPCrypto(protocol string) (*MediaCrypto, error) {
+	endpoint, err := newZRTPEndpoint()
+	if err != nil {
+		return nil, err
+	}
+	c := &MediaCrypto{Mode: CryptoZRTP, Protocol: protocol, ZRTPHash: endpoint.helloHash(), zrtp: endpoint}
+	endpoint.key = c.setKeys
+	return c, nil
+}
+
+// newMediaCrypto returns Karl's end of a party protected with mode, keyed
+// with an SDES suite when mode is sdes
+func newMediaCrypto(mode CryptoMode, protocol, suite string) (*MediaCrypto, error) {
+	switch mode {
+	case CryptoSDES:
+		return NewSDESCrypto(protocol, suite)
+	case CryptoDTLS:
+		return NewDTLSCrypto(protocol, "actpass"), nil
+	case CryptoZRTP:
+		return NewZRTPCrypto(protocol)
+	}
+	return NewPlainCrypto(protocol), nil
+}
+
+// SetRemoteKey keys what the party sends with the inline key of its
+// a=crypto line
+func (c *MediaCrypto) SetRemoteKey(inline string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if inline == c.RemoteKey && c.inbound != nil {
+		return nil
+	}
+	key, salt, err := parseSDESInlineKey(c.Suite, inline)
+	if err != nil {
+		return err
+	}
+	inbound, err := NewSRTPCipher(key, salt, softwareSRTPProfiles[c.Suite])
+	if err != nil {
+		return fmt.Errorf("failed to create SRTP context: %w", err)
+	}
+	c.RemoteKey, c.inbound = inline, inbound
+	return nil
+}
+
+// SetRemoteDTLS records the party's certificate fingerprint and, from the
+// party's a=setup, the role Karl takes: active towards a passive party and
+// passive otherwise. A role of Karl's own set by a flag is kept
+func (c *MediaCrypto) SetRemoteDTLS(fingerprint, setup string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.RemoteFingerprint = fingerprint
+	if c.Setup != "actpass" && c.Setup != "" {
+		return
+	}
+	c.Setup = "passive"
+	if setup == "passive" {
+		c.Setup = "active"
+	}
+}
+
+// SetRemoteZRTP records the party's a=zrtp-hash, which the Hello it sends
+// must match; empty when its SDP had none
+func (c *MediaCrypto) SetRemoteZRTP(hash string) {
+	c.mu.Lock()
+	c.RemoteZRTPHash = hash
+	c.mu.Unlock()
+	c.zrtp.setPeerHash(hash)
+}
+
+// ZRTPInfo describes the ZRTP key agreement Karl ran with the party, such
+// as its SAS, nil when the party is not keyed by ZRTP
+func (c *MediaCrypto) ZRTPInfo() map[string]interface{} {
+	if c.zrtp == nil {
+		return nil
+	}
+	return c.zrtp.info()
+}
+
+// setKeys sets the SRTP contexts of either direction, leaving one that is
+// nil unchanged
+func (c *MediaCrypto) setKeys(inbound, outbound SRTPCipher) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if inbound != nil {
+		c.inbound = inbound
+	}
+	if outbound != nil {
+		c.outbound = outbound
+	}
+}
+
+// SetSetup sets Karl's DTLS role towards the party, such as from a
+// DTLS=active or DTLS=passive flag
+func (c *MediaCrypto) SetSetup(setup string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Setup = setup
+}
+
+// SetICE sets the ICE credentials the party was given
+func (c *MediaCrypto) SetICE(ice *ICECredentials) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ICE = ice
+}
+
+// SetRemoteICE sets the party's own ICE credentials and the candidates
+// Karl checks, and whether Karl is the controlling agent towards it
+func (c *MediaCrypto) SetRemoteICE(remote *ICECredentials, candidates []*net.UDPAddr, controlling bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.RemoteICE, c.candidates, c.controlling = remote, candidates, controlling
+}
+
+// Start begins Karl's DTLS handshake with the party at remote when Karl is
+// the client. A passive Karl waits for the party's handshake. A ZRTP Karl
+// sends its Hello. A full ICE Karl starts checking the party's candidates
+func (c *MediaCrypto) Start(conn *net.UDPConn, remote *net.UDPAddr) {
+	if c.Mode == CryptoZRTP && conn != nil {
+		c.zrtp.start(conn, remote)
+		return
+	}
+	c.mu.Lock()
+	active := c.Mode == CryptoDTLS && c.Setup == "active" && c.ICE == nil
+	c.mu.Unlock()
+	if active && conn != nil && remote != nil {
+		c.startDTLS(conn, remote)
+	}
+	if conn != nil {
+		c.startChecks(conn)
+	}
+}
+
+// startChecks runs Karl's connectivity checks towards the party, once per
+// set of the party's credentials. The nominated pair latches the party's
+// media and starts an active Karl's DTLS handshake
+func (c *MediaCrypto) startChecks(conn *net.UDPConn) {
+	c.mu.Lock()
+	local, remote := c.ICE, c.RemoteICE
+	if local == nil || local.Lite || remote == nil || len(c.candidates) == 0 || c.closed ||
+		(c.checks != nil && c.checks.remote.Username == remote.Username && c.checks.remote.Password == remote.Password) {
+		c.mu.Unlock()
+		return
+	}
+	if c.checks != nil {
+		c.checks.close()
+	}
+	checks := newICEChecker(conn, local, remote, c.candidates, c.controlling, func(addr *net.UDPAddr) {
+		c.mu.Lock()
+		latch, active := c.latch, c.Mode == CryptoDTLS && c.Setup == "active"
+		c.mu.Unlock()
+		if latch != nil {
+			latch(addr)
+		}
+		if active {
+			c.startDTLS(conn, addr)
+		}
+	})
+	c.checks = checks
+	c.mu.Unlock()
+	go checks.run()
+}
+
+// Keyed reports whether both directions of the party's media have keys
+func (c *MediaCrypto) Keyed() bool {
+	if c.Mode == CryptoPlain {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.inbound != nil && c.outbound != nil
+}
+
+// Close ends the party's DTLS association or ZRTP exchange
+func (c *MediaCrypto) Close() {
+	if c.zrtp != nil {
+		c.zrtp.close()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	if c.checks != nil {
+		c.checks.close()
+	}
+	if c.dtlsConn != nil {
+		c.dtlsConn.Close()
+		c.dtlsConn = nil
+	}
+	if c.transport != nil {
+		c.transport.Close()
+		c.transport = nil
+	}
+}
+
+// receive takes a packet the party sent to conn: it answers ICE checks and
+// runs DTLS (RFC 7983 demultiplexing) and ZRTP, and decrypts SRTP and
+// SRTCP in place. It returns false for a packet consumed or dropped
+func (c *MediaCrypto) receive(conn *net.UDPConn, packet []byte, from *net.UDPAddr) ([]byte, bool) {
+	if len(packet) == 0 {
+		return nil, false
+	}
+	if IsZRTPPacket(packet) {
+		if c.Mode == CryptoZRTP {
+			c.zrtp.receive(conn, packet, from)
+		}
+		return nil, false
+	}
+	switch first := packet[0]; {
+	case first <= 3:
+		c.answerICE(conn, packet, from)
+		return nil, false
+	case first >= 20 && first <= 63:
+		if c.Mode == CryptoDTLS {
+			c.receiveDTLS(conn, packet, from)
+		}
+		return nil, false
+	}
+	if c.Mode == CryptoPlain {
+		return packet, true
+	}
+
+	c.mu.Lock()
+	cipher := c.inbound
+	confirming := c.Mode == CryptoZRTP && c.outbound == nil
+	c.mu.Unlock()
+	if cipher == nil {
+		if c.Mode == CryptoZRTP {
+			return packet, true
+		}
+		mediaCryptoDropped.WithLabelValues(string(c.Mode), "unkeyed").Inc()
+		return nil, false
+	}
+
+	// A ZRTP responder keeps sending RTP in the clear until it has Karl's
+	// Confirm2
+	var clear []byte
+	if confirming {
+		clear = append(clear, packet...)
+	}
+
+	var plain []byte
+	var err error
+	c.rxMu.Lock()
+	if IsRTCPPacket(packet) {
+		plain, err = cipher.DecryptRTCP(packet[:0], packet, nil)
+	} else {
+		plain, err = cipher.DecryptRTP(packet[:0], packet, nil)
+	}
+	c.rxMu.Unlock()
+	if err != nil && clear != nil {
+		return packet[:copy(packet, clear)], true
+	}
+	if err != nil {
+		mediaCryptoDropped.WithLabelValues(string(c.Mode), "decrypt").Inc()
+		if rtpPacketErrors.Allow() {
+			rtpPacketErrors.Log("Failed to decrypt SRTP from bridged leg", "from", from, "error", err)
+		}
+		return nil, false
+	}
+	if confirming {
+		c.zrtp.confirmed()
+	}
+	return packet[:copy(packet, plain)], true
+}
+
+// protect encrypts RTP or RTCP relayed to the party
+func (c *MediaCrypto) protect(packet []byte, isRTCP bool) ([]byte, error) {
+	if c.Mode == CryptoPlain {
+		return packet, nil
+	}
+
+	c.mu.Lock()
+	cipher := c.outbound
+	c.mu.Unlock()
+	if cipher == nil && c.Mode == CryptoZRTP {
+		return packet, nil
+	}
+	if cipher == nil {
+		mediaCryptoDropped.WithLabelValues(string(c.Mode), "unkeyed").Inc()
+		return nil, errMediaUnkeyed
+	}
+
+	var encrypted []byte
+	var err error
+	c.txMu.Lock()
+	if isRTCP {
+		encrypted, err = cipher.EncryptRTCP(nil, packet, nil)
+	} else {
+		encrypted, err = cipher.EncryptRTP(nil, packet, nil)
+	}
+	c.txMu.Unlock()
+	if err != nil {
+		mediaCryptoDropped.WithLabelValues(string(c.Mode), "encrypt").Inc()
+		return nil, err
+	}
+	return encrypted, nil
+}
+
+// answerICE answers an ICE connectivity check signed with the password the
+// party was given, and passes responses to Karl's own checks on. A check
+// also starts Karl's DTLS handshake when Karl is the client, since it shows
+// where the party is reachable
+func (c *MediaCrypto) answerICE(conn *net.UDPConn, packet []byte, from *net.UDPAddr) {
+	c.mu.Lock()
+	ice, checks := c.ICE, c.checks
+	active := c.Mode == CryptoDTLS && c.Setup == "active"
+	c.mu.Unlock()
+	if ice == nil || from == nil {
+		return
+	}
+
+	request := &stun.Message{Raw: append([]byte(nil), packet...)}
+	if err := request.Decode(); err != nil {
+		return
+	}
+	if request.Type == stun.BindingSuccess || request.Type == stun.BindingError {
+		if checks != nil {
+			checks.response(request, from)
+		}
+		return
+	}
+	if request.Type != stun.BindingRequest {
+		return
+	}
+	var username stun.Username
+	if err := username.GetFrom(request); err != nil || !strings.HasPrefix(username.String(), ice.Username+":") {
+		return
+	}
+	integrity := stun.NewShortTermIntegrity(ice.Password)
+	if err := integrity.Check(request); err != nil {
+		return
+	}
+
+	response, err := stun.Build(
+		stun.NewTransactionIDSetter(request.TransactionID),
+		stun.BindingSuccess,
+		&stun.XORMappedAddress{IP: from.IP, Port: from.Port},
+		integrity,
+		stun.Fingerprint,
+	)
+	if err != nil {
+		return
+	}
+	_, _ = conn.WriteToUDP(response.Raw, from)
+
+	c.mu.Lock()
+	latch := c.latch
+	c.mu.Unlock()
+	if latch != nil && request.Contains(stun.AttrUseCandidate) {
+		latch(from)
+	}
+	if active {
+		c.startDTLS(conn, from)
+	}
+}
+
+// receiveDTLS passes a DTLS record to the party's association, starting it
+// as the server on the party's first record when Karl is passive
+func (c *MediaCrypto) receiveDTLS(conn *net.UDPConn, record []byte, from *net.UDPAddr) {
+	c.mu.Lock()
+	transport, active := c.transport, c.Setup == "active"
+	c.mu.Unlock()
+	if transport == nil {
+		if active {
+			return
+		}
+		if transport = c.startDTLS(conn, from); transport == nil {
+			return
+		}
+	}
+	transport.feed(record, from)
+}
+
+// startDTLS runs Karl's side of a handshake with the party at remote, as
+// the client when Karl is active and otherwise as the server. It returns
+// the association's transport, or nil when none can run
+func (c *MediaCrypto) startDTLS(conn *net.UDPConn, remote *net.UDPAddr) *dtlsTransport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	if c.transport != nil {
+		return c.transport
+	}
+	certs, err := DefaultDTLSCertificates()
+	if err != nil {
+		rtpLog.Error("No DTLS certificate for bridged leg", "error", err)
+		return nil
+	}
+	verify, err := VerifyPeerFingerprint(c.RemoteFingerprint)
+	if err != nil {
+		rtpLog.Error("Cannot verify bridged DTLS peer", "error", err)
+		return nil
+	}
+
+	config := &dtls.Config{
+		Certificates:           []tls.Certificate{certs.Certificate()},
+		SRTPProtectionProfiles: []dtls.SRTPProtectionProfile{dtls.SRTP_AEAD_AES_128_GCM, dtls.SRTP_AES128_CM_HMAC_SHA1_80},
+		ExtendedMasterSecret:   dtls.RequireExtendedMasterSecret,
+		ClientAuth:             dtls.RequireAnyClientCert,
+		InsecureSkipVerify:     true, // self-signed; the fingerprint is checked instead
+		VerifyPeerCertificate:  verify,
+	}
+	c.transport = &dtlsTransport{
+		conn:     conn,
+		remote:   remote,
+		incoming: make(chan []byte, 16),
+		done:     make(chan struct{}),
+	}
+	go c.handshake(c.transport, config, c.Setup == "active")
+	return c.transport
+}
+
+// handshake completes a DTLS association and keys SRTP from it (RFC 5764)
+func (c *MediaCrypto) handshake(transport *dtlsTransport, config *dtls.Config, client bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), dtlsHandshakeTimeout)
+	defer cancel()
+
+	var conn *dtls.Conn
+	var err error
+	if client {
+		conn, err = dtls.ClientWithContext(ctx, transport, config)
+	} else {
+		conn, err = dtls.ServerWithContext(ctx, transport, config)
+	}
+	if err == nil {
+		err = c.keyFromDTLS(conn, client)
+	}
+	if err != nil {
+		mediaDTLSHandshakes.WithLabelValues("failure").Inc()
+		rtpLog.Warn("DTLS handshake with bridged leg failed", "peer", transport.RemoteAddr(), "error", err)
+		if conn != nil {
+			conn.Close()
+		}
+		transport.Close()
+
+		// A new handshake may follow
+		c.mu.Lock()
+		if c.transport == transport {
+			c.transport = nil
+		}
+		c.mu.Unlock()
+		return
+	}
+	mediaDTLSHandshakes.WithLabelValues("success").Inc()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		conn.Close()
+		return
+	}
+	c.dtlsConn = conn
+}
+
+// keyFromDTLS exports the SRTP keys of a completed DTLS association
+func (c *MediaCrypto) keyFromDTLS(conn *dtls.Conn, client bool) error {
+	profile, ok := conn.SelectedSRTPProtectionProfile()
+	if !ok {
+		return errors.New("no SRTP protection profile negotiated")
+	}
+	state := conn.ConnectionState()
+	config := &srtp.Config{Profile: srtp.ProtectionProfile(profile)}
+	if err := config.ExtractSessionKeysFromDTLS(&state, client); err != nil {
+		return err
+	}
+	outbound, err := NewSRTPCipher(config.Keys.LocalMasterKey, config.Keys.LocalMasterSalt, config.Profile)
+	if err != nil {
+		return err
+	}
+	inbound, err := NewSRTPCipher(config.Keys.RemoteMasterKey, config.Keys.RemoteMasterSalt, config.Profile)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inbound, c.outbound = inbound, outbound
+	return nil
+}
+
+// dtlsTransport carries one party's DTLS records over the port it was
+// given: the receive path feeds it the records that arrive there, and it
+// writes to where the party last sent from
+type dtlsTransport struct {
+	conn     *net.UDPConn
+	mu       sync.Mutex
+	remote   *net.UDPAddr
+	incoming chan []byte
+	done     chan struct{}
+	once     sync.Once
+}
+
+// feed queues a record for the association; a full queue drops it, which
+// DTLS retransmission recovers from
+func (t *dtlsTransport) feed(record []byte, from *net.UDPAddr) {
+	if from != nil {
+		t.mu.Lock()
+		t.remote = from
+		t.mu.Unlock()
+	}
+	select {
+	case t.incoming <- append([]byte(nil), record...):
+	default:
+	}
+}
+
+func (t *dtlsTransport) Read(b []byte) (int, error) {
+	select {
+	case record := <-t.incoming:
+		return copy(b, record), nil
+	case <-t.done:
+		return 0, io.EOF
+	}
+}
+
+func (t *dtlsTransport) Write(b []byte) (int, error) {
+	t.mu.Lock()
+	remote := t.remote
+	t.mu.Unlock()
+	return t.conn.WriteToUDP(b, remote)
+}
+
+func (t *dtlsTransport) Close() error {
+	t.once.Do(func() { close(t.done) })
+	return nil
+}
+
+func (t *dtlsTransport) LocalAddr() net.Addr { return t.conn.LocalAddr() }
+
+func (t *dtlsTransport) RemoteAddr() net.Addr {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.remote
+}
+
+func (t *dtlsTransport) SetDeadline(time.Time) error      { return nil }
+func (t *dtlsTransport) SetReadDeadline(time.Time) error  { return nil }
+func (t *dtlsTransport) SetWriteDeadline(time.Time) error { return nil }
+
+// SetMediaCrypto sets the protection Karl ends with each party of a
+// session, nil for a party whose media passes through, and binds it to the
+// ports the party was given: those of the other leg. A replaced end is
+// closed
+func (sr *SessionRegistry) SetMediaCrypto(session *MediaSession, caller, callee *MediaCrypto) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	sr.unbindCryptoLocked(session)
+	for _, old := range []*MediaCrypto{session.CallerCrypto, session.CalleeCrypto} {
+		if old != nil && old != caller && old != callee {
+			old.Close()
+		}
+	}
+	session.CallerCrypto, session.CalleeCrypto = caller, callee
+	sr.bindCryptoLocked(caller, session, session.CallerLeg, session.CalleeLeg)
+	sr.bindCryptoLocked(callee, session, session.CalleeLeg, session.CallerLeg)
+}
+
+// MediaCryptoFor returns the protection Karl ends with the party that was
+// given a port, nil when its media passes through
+func (sr *SessionRegistry) MediaCryptoFor(conn *net.UDPConn) *MediaCrypto {
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+	return sr.cryptoIndex[conn]
+}
+
+// bindCryptoLocked maps the ports the party of a leg was given, the peer
+// leg's, to the party's protection, which latches the leg to the address
+// its ICE checks nominate. The caller holds sr.mu and the session lock
+func (sr *SessionRegistry) bindCryptoLocked(crypto *MediaCrypto, session *MediaSession, leg, peer *CallLeg) {
+	if crypto == nil {
+		return
+	}
+	crypto.mu.Lock()
+	crypto.latch = nil
+	if leg != nil {
+		crypto.latch = func(addr *net.UDPAddr) {
+			session.Lock()
+			defer session.Unlock()
+			if leg.LatchedSource == nil || !leg.LatchedSource.IP.Equal(addr.IP) || leg.LatchedSource.Port != addr.Port {
+				leg.LatchedSource = &net.UDPAddr{IP: append(net.IP(nil), addr.IP...), Port: addr.Port}
+			}
+		}
+	}
+	crypto.mu.Unlock()
+	if peer == nil {
+		return
+	}
+	for _, conn := range peer.conns() {
+		sr.cryptoIndex[conn] = crypto
+	}
+}
+
+// unbindCryptoLocked removes the ports of a session's legs from the index;
+// the caller holds sr.mu and the session lock
+func (sr *SessionRegistry) unbindCryptoLocked(session *MediaSession) {
+	for _, leg := range []*CallLeg{session.CallerLeg, session.CalleeLeg} {
+		if leg == nil {
+			continue
+		}
+		for _, conn := range leg.conns() {
+			delete(sr.cryptoIndex, conn)
+		}
+	}
+}
+
+// conns returns the bound RTP and RTCP ports of a leg and its m= sections.
+// The caller holds the session lock
+func (l *CallLeg) conns() []*net.UDPConn {
+	var conns []*net.UDPConn
+	for _, conn := range []*net.UDPConn{l.Conn, l.RTCPConn} {
+		if conn != nil {
+			conns = append(conns, conn)
+		}
+	}
+	for _, stream := range l.Streams {
+		for _, conn := range []*net.UDPConn{stream.Conn, stream.RTCPConn} {
+			if conn != nil {
+				conns = append(conns, conn)
+			}
+		}
+	}
+	return conns
+}
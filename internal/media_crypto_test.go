@@ -0,0 +1,242 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	ng "karl/internal/ng_protocol"
+
+	"github.com/pion/dtls/v2"
+	"github.com/pion/rtp"
+	"github.com/pion/srtp/v2"
+)
+
+const bridgeAnswerKey = "PS1uQCVeeCFCanVmcjkpPywjNWhcYD0mXXtxaVBR"
+
+func sdesContext(t *testing.T, inline string) *srtp.Context {
+	t.Helper()
+	key, salt, err := parseSDESInlineKey(defaultSDESSuite, inline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	context, err := srtp.CreateContext(key, salt, srtp.ProtectionProfileAes128CmHmacSha1_80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return context
+}
+
+// endpointSDP is sipOfferSDP for a party listening on conn
+func endpointSDP(conn *net.UDPConn) string {
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	sdp := strings.ReplaceAll(sipOfferSDP, "192.0.2.10", "127.0.0.1")
+	sdp = strings.Replace(sdp, "m=audio 49170", "m=audio "+strconv.Itoa(port), 1)
+	return strings.Replace(sdp, "a=rtcp:49171", "a=rtcp:"+strconv.Itoa(port+1), 1)
+}
+
+// relayed sends packet from one party to a port of Karl's and returns what
+// the other party receives
+func relayed(t *testing.T, from, to *net.UDPConn, port int, packet []byte) []byte {
+	t.Helper()
+	if _, err := from.WriteToUDP(packet, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}); err != nil {
+		t.Fatal(err)
+	}
+	to.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	n, _, err := to.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("nothing relayed: %v", err)
+	}
+	return buf[:n]
+}
+
+func TestNGSocketListener_BridgePlainToSDES(t *testing.T) {
+	control, err := NewRTPControl(nil, nil)
+	if err != nil {
+		t.Fatalf("NewRTPControl failed: %v", err)
+	}
+	defer control.Stop()
+	forwardThroughPool(t, control)
+
+	manager, registry, _ := newTestSessionManager(t)
+	manager.SetMediaPortOpener(control.OpenMediaPorts)
+	registry.SetMediaSender(control.SendBatchFrom)
+	defer registry.SetMediaSender(nil)
+	control.SetMediaCryptoResolver(registry.MediaCryptoFor)
+	listener := &NGSocketListener{sessionRegistry: registry, sessionManager: manager, config: &Config{}}
+
+	parties := make([]*net.UDPConn, 2)
+	for i := range parties {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		parties[i] = conn
+	}
+
+	// A PBX offers plain RTP to a party that takes SDES-SRTP only
+	resp, err := listener.handleOffer(&ng.NGRequest{CallID: "bridge-call", FromTag: "from-tag", SDP: endpointSDP(parties[0]), Transport: "RTP/SAVP"})
+	if err != nil || resp.Result != ng.ResultOK {
+		t.Fatalf("handleOffer failed: %v %+v", err, resp)
+	}
+	defer GetCodecNegotiator().RemoveCall("bridge-call")
+	if !strings.Contains(resp.SDP, " RTP/SAVP 0 101\r\n") || !strings.Contains(resp.SDP, "a=crypto:1 AES_CM_128_HMAC_SHA1_80 inline:") {
+		t.Fatalf("expected an SDES offer, got:\n%s", resp.SDP)
+	}
+
+	answer := strings.Replace(endpointSDP(parties[1]), "RTP/AVP", "RTP/SAVP", 1) + "a=crypto:1 AES_CM_128_HMAC_SHA1_80 inline:" + bridgeAnswerKey + "\r\n"
+	resp, err = listener.handleAnswer(&ng.NGRequest{CallID: "bridge-call", FromTag: "from-tag", ToTag: "to-tag", SDP: answer})
+	if err != nil || resp.Result != ng.ResultOK {
+		t.Fatalf("handleAnswer failed: %v %+v", err, resp)
+	}
+	if !strings.Contains(resp.SDP, " RTP/AVP 0 101\r\n") || strings.Contains(resp.SDP, "a=crypto") {
+		t.Fatalf("expected a plain answer, got:\n%s", resp.SDP)
+	}
+
+	session := registry.GetSessionByCallID("bridge-call")[0]
+	session.RLock()
+	caller, callee := session.CallerCrypto, session.CalleeCrypto
+	callerLeg, calleeLeg := session.CallerLeg, session.CalleeLeg
+	session.RUnlock()
+	if caller == nil || caller.Mode != CryptoPlain || callee == nil || callee.Mode != CryptoSDES || !callee.Keyed() {
+		t.Fatalf("unexpected bridge %+v / %+v", caller, callee)
+	}
+	if err := registry.RegisterSSRC(session.ID, 0xA, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.RegisterSSRC(session.ID, 0xB, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Plain RTP from the PBX reaches the other party encrypted with the key
+	// Karl offered it
+	plain, _ := (&rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 0, SequenceNumber: 1, Timestamp: 160, SSRC: 0xA}, Payload: make([]byte, 160)}).Marshal()
+	got, err := sdesContext(t, callee.LocalKey).DecryptRTP(nil, relayed(t, parties[0], parties[1], calleeLeg.LocalPort, plain), nil)
+	if err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("the answerer could not decrypt Karl's SRTP: %v", err)
+	}
+
+	// and its SRTP reaches the PBX as plain RTP
+	plain, _ = (&rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 0, SequenceNumber: 1, Timestamp: 160, SSRC: 0xB}, Payload: make([]byte, 160)}).Marshal()
+	encrypted, err := sdesContext(t, bridgeAnswerKey).EncryptRTP(nil, plain, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := relayed(t, parties[1], parties[0], callerLeg.LocalPort, encrypted); !bytes.Equal(got, plain) {
+		t.Fatalf("the PBX received %d bytes instead of the plain packet", len(got))
+	}
+
+	// A re-offer without a transport flag ends the bridge
+	if resp, err := listener.handleOffer(&ng.NGRequest{CallID: "bridge-call", FromTag: "from-tag", SDP: endpointSDP(parties[0])}); err != nil || resp.Result != ng.ResultOK {
+		t.Fatalf("re-offer failed: %v %+v", err, resp)
+	} else if strings.Contains(resp.SDP, "a=crypto") {
+		t.Errorf("re-offer still bridged:\n%s", resp.SDP)
+	}
+	if registry.MediaCryptoFor(callerLeg.Conn) != nil {
+		t.Error("bridge left bound after a plain re-offer")
+	}
+}
+
+func TestMediaCrypto_DTLSPassive(t *testing.T) {
+	karl, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer karl.Close()
+	certs, err := DefaultDTLSCertificates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, _, _, err := generateDTLSCertificate(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	crypto := NewDTLSCrypto("UDP/TLS/RTP/SAVPF", "actpass")
+	crypto.SetRemoteDTLS("sha-256 "+formatFingerprint(sum[:]), "active")
+	defer crypto.Close()
+	if crypto.Setup != "passive" {
+		t.Fatalf("Karl is %s towards an active party, want passive", crypto.Setup)
+	}
+
+	// Karl's receive path: DTLS records start the server, SRTP comes out
+	// decrypted
+	decrypted := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := karl.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if plain, ok := crypto.receive(karl, buf[:n], from); ok {
+				decrypted <- append([]byte(nil), plain...)
+			}
+		}
+	}()
+
+	party, err := net.DialUDP("udp4", nil, karl.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer party.Close()
+	verify, err := VerifyPeerFingerprint(certs.SDPFingerprint())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := dtls.Client(party, &dtls.Config{
+		Certificates:           []tls.Certificate{cert},
+		SRTPProtectionProfiles: []dtls.SRTPProtectionProfile{dtls.SRTP_AES128_CM_HMAC_SHA1_80},
+		ExtendedMasterSecret:   dtls.RequireExtendedMasterSecret,
+		InsecureSkipVerify:     true,
+		VerifyPeerCertificate:  verify,
+	})
+	if err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	defer client.Close()
+
+	state := client.ConnectionState()
+	config := &srtp.Config{Profile: srtp.ProtectionProfileAes128CmHmacSha1_80}
+	if err := config.ExtractSessionKeysFromDTLS(&state, true); err != nil {
+		t.Fatal(err)
+	}
+	outbound, err := srtp.CreateContext(config.Keys.LocalMasterKey, config.Keys.LocalMasterSalt, config.Profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Karl keys SRTP once its side of the handshake completes
+	deadline := time.Now().Add(2 * time.Second)
+	for !crypto.Keyed() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !crypto.Keyed() {
+		t.Fatal("Karl did not key SRTP from the handshake")
+	}
+
+	plain, _ := (&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: 1, SSRC: 0xD7}, Payload: []byte("media")}).Marshal()
+	encrypted, err := outbound.EncryptRTP(nil, plain, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := party.Write(encrypted); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-decrypted:
+		if !bytes.Equal(got, plain) {
+			t.Errorf("decrypted %x, want %x", got, plain)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Karl did not decrypt the party's SRTP")
+	}
+}
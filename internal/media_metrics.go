@@ -0,0 +1,183 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxSessionGauges bounds metrics.session_gauges
+const maxSessionGauges = 1000
+
+// sessionMetricLabels label the per-session gauges
+var sessionMetricLabels = []string{"call_id", "session_id"}
+
+// Codec names used as metric labels. Names come from SDP, so anything else
+// is counted as "other" to keep the label set bounded
+var codecMetricNames = map[string]bool{
+	"pcmu": true, "pcma": true, "g722": true, "g729": true, "g723": true, "gsm": true,
+	"opus": true, "amr": true, "amr-wb": true, "ilbc": true, "speex": true,
+	"telephone-event": true, "cn": true, "red": true, "ulpfec": true, "rtx": true,
+	"vp8": true, "vp9": true, "h264": true, "h265": true, "av1": true,
+}
+
+var (
+	metricsConfig atomic.Pointer[MetricsConfig]
+
+	// payloadTypeLabels are the payload types formatted once
+	payloadTypeLabels [128]string
+
+	// staticCodecLabels are the codec labels of the static payload types
+	staticCodecLabels [128]string
+
+	// Packet counters by payload type, looked up without allocating on
+	// the packet path
+	packetCounters [128]atomic.Pointer[[]codecCounter]
+
+	// Sessions currently exported with per-session gauges
+	sessionGaugesMu       sync.Mutex
+	sessionGaugesExported = make(map[string]string) // session ID -> call ID
+)
+
+func init() {
+	for pt := range payloadTypeLabels {
+		payloadTypeLabels[pt] = strconv.Itoa(pt)
+		staticCodecLabels[pt] = "unknown"
+	}
+	for pt, codec := range staticPayloadTypes {
+		staticCodecLabels[pt&0x7f] = codecMetricLabel(codec.Name)
+	}
+}
+
+// ConfigureMetrics applies the metrics settings; nil restores the defaults
+func ConfigureMetrics(config *MetricsConfig) {
+	if config == nil {
+		config = &MetricsConfig{}
+	}
+	metricsConfig.Store(config)
+	if config.SessionGauges == 0 {
+		updateSessionGauges(nil)
+	}
+}
+
+// ValidateMetricsConfig checks the metrics limits
+func ValidateMetricsConfig(cfg *Config) error {
+	if n := cfg.Metrics.SessionGauges; n < 0 || n > maxSessionGauges {
+		return fmt.Errorf("invalid metrics.session_gauges %d, expected 0-%d", n, maxSessionGauges)
+	}
+	return nil
+}
+
+// sessionGaugeLimit returns how many calls get per-session gauges
+func sessionGaugeLimit() int {
+	if config := metricsConfig.Load(); config != nil {
+		return config.SessionGauges
+	}
+	return 0
+}
+
+// mediaPorts returns the NG listener's port allocator, if there is one
+func mediaPorts() *PortAllocator {
+	if MediaPortsGetter == nil {
+		return nil
+	}
+	return MediaPortsGetter()
+}
+
+// codecMetricLabel returns the codec label for an SDP encoding name
+func codecMetricLabel(name string) string {
+	if name == "" {
+		return "unknown"
+	}
+	name = strings.ToLower(name)
+	if codecMetricNames[name] {
+		return name
+	}
+	return "other"
+}
+
+// packetCodecLabel names the codec of a packet, from the call's negotiated
+// codecs or else the static payload type table
+func packetCodecLabel(payloadType uint8, negotiated CodecInfo, ok bool) string {
+	if ok && negotiated.Name != "" {
+		return codecMetricLabel(negotiated.Name)
+	}
+	return staticCodecLabels[payloadType&0x7f]
+}
+
+// codecCounter is the packet counter of one codec on a payload type
+type codecCounter struct {
+	codec   string
+	counter prometheus.Counter
+}
+
+// packetCounter returns the packet counter for a payload type and codec
+func packetCounter(payloadType uint8, codec string) prometheus.Counter {
+	slot := &packetCounters[payloadType&0x7f]
+	for {
+		list := slot.Load()
+		var counters []codecCounter
+		if list != nil {
+			for _, c := range *list {
+				if c.codec == codec {
+					return c.counter
+				}
+			}
+			counters = *list
+		}
+		added := append(counters[:len(counters):len(counters)], codecCounter{
+			codec:   codec,
+			counter: rtpPacketsByCodec.WithLabelValues(payloadTypeLabels[payloadType&0x7f], codec),
+		})
+		if slot.CompareAndSwap(list, &added) {
+			return added[len(added)-1].counter
+		}
+	}
+}
+
+// sessionQualitySample is one active call's measurement
+type sessionQualitySample struct {
+	sessionID, callID string
+	quality           SessionQuality
+}
+
+// updateSessionGauges exports the configured number of measured calls with
+// the lowest MOS, and removes the gauges of calls no longer among them
+func updateSessionGauges(samples []sessionQualitySample) {
+	limit := sessionGaugeLimit()
+	measured := samples[:0:0]
+	for _, s := range samples {
+		if s.quality.MOS > 0 {
+			measured = append(measured, s)
+		}
+	}
+	sort.Slice(measured, func(i, j int) bool { return measured[i].quality.MOS < measured[j].quality.MOS })
+	if len(measured) > limit {
+		measured = measured[:limit]
+	}
+
+	sessionGaugesMu.Lock()
+	defer sessionGaugesMu.Unlock()
+	keep := make(map[string]bool, len(measured))
+	for _, s := range measured {
+		keep[s.sessionID] = true
+		sessionMOS.WithLabelValues(s.callID, s.sessionID).Set(s.quality.MOS)
+		sessionJitter.WithLabelValues(s.callID, s.sessionID).Set(s.quality.AvgJitterMs)
+		sessionPacketLoss.WithLabelValues(s.callID, s.sessionID).Set(s.quality.LossPercent)
+		sessionGaugesExported[s.sessionID] = s.callID
+	}
+	for sessionID, callID := range sessionGaugesExported {
+		if keep[sessionID] {
+			continue
+		}
+		sessionMOS.DeleteLabelValues(callID, sessionID)
+		sessionJitter.DeleteLabelValues(callID, sessionID)
+		sessionPacketLoss.DeleteLabelValues(callID, sessionID)
+		delete(sessionGaugesExported, sessionID)
+	}
+}
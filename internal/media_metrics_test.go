@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// seriesCount returns the number of series a collector exports
+func seriesCount(c prometheus.Collector) int {
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	return len(ch)
+}
+
+func TestUpdateSessionGauges(t *testing.T) {
+	ConfigureMetrics(&MetricsConfig{SessionGauges: 2})
+	defer ConfigureMetrics(nil)
+
+	sample := func(id string, mos float64) sessionQualitySample {
+		return sessionQualitySample{sessionID: id, callID: "call-" + id, quality: SessionQuality{MOS: mos, AvgJitterMs: 12, LossPercent: 1.5}}
+	}
+	updateSessionGauges([]sessionQualitySample{sample("a", 4.2), sample("b", 3.1), sample("c", 2.5), sample("d", 0)})
+
+	if got := seriesCount(sessionMOS); got != 2 {
+		t.Fatalf("exported %d sessions, want the 2 with the lowest MOS", got)
+	}
+	if got := metricValue(t, sessionMOS.WithLabelValues("call-c", "c")); got != 2.5 {
+		t.Errorf("MOS of c is %v", got)
+	}
+	if got := metricValue(t, sessionPacketLoss.WithLabelValues("call-b", "b")); got != 1.5 {
+		t.Errorf("loss of b is %v", got)
+	}
+
+	// b recovers past a, c ends
+	updateSessionGauges([]sessionQualitySample{sample("a", 4.2), sample("b", 4.4)})
+	if got := seriesCount(sessionJitter); got != 2 {
+		t.Errorf("exported %d sessions after c ended, want 2", got)
+	}
+
+	ConfigureMetrics(nil)
+	if got := seriesCount(sessionMOS); got != 0 {
+		t.Errorf("%d sessions still exported after disabling", got)
+	}
+}
+
+func TestUpdateRTPMetrics(t *testing.T) {
+	for _, tt := range []struct {
+		pt         uint8
+		negotiated CodecInfo
+		ok         bool
+		want       string
+	}{
+		{0, CodecInfo{}, false, "pcmu"},
+		{111, CodecInfo{Name: "opus"}, true, "opus"},
+		{101, CodecInfo{Name: "TELEPHONE-EVENT"}, true, "telephone-event"},
+		{96, CodecInfo{Name: "x-made-up"}, true, "other"},
+		{96, CodecInfo{}, false, "unknown"},
+	} {
+		if got := packetCodecLabel(tt.pt, tt.negotiated, tt.ok); got != tt.want {
+			t.Errorf("payload type %d %+v: got %q, want %q", tt.pt, tt.negotiated, got, tt.want)
+		}
+	}
+
+	before := metricValue(t, rtpPacketsByCodec.WithLabelValues("8", "pcma"))
+	UpdateRTPMetrics(&RTPPacket{PayloadType: 8}, "pcma")
+	if got := metricValue(t, rtpPacketsByCodec.WithLabelValues("8", "pcma")) - before; got != 1 {
+		t.Errorf("counted %v packets, want 1", got)
+	}
+}
+
+func TestPortPoolMetrics(t *testing.T) {
+	defer func(getter func() *PortAllocator) { MediaPortsGetter = getter }(MediaPortsGetter)
+	pa := NewPortAllocator(&PortAllocatorConfig{MinPort: 40000, MaxPort: 40019, MaxAllocations: 10, EvenOnly: true})
+	defer pa.Close()
+	MediaPortsGetter = func() *PortAllocator { return pa }
+
+	if _, _, err := pa.AllocatePortPair("metrics-session"); err != nil {
+		t.Fatal(err)
+	}
+	inUse, available := metricValue(t, portPoolInUse), metricValue(t, portPoolAvailable)
+	if inUse == 0 || inUse+available != float64(pa.GetInUseCount()+pa.GetAvailableCount()) {
+		t.Errorf("in use %v, available %v", inUse, available)
+	}
+	if got := metricValue(t, portPoolUtilization); got != pa.GetUtilization() || got <= 0 {
+		t.Errorf("utilization %v, want %v", got, pa.GetUtilization())
+	}
+}
+
+func TestValidateMetricsConfig(t *testing.T) {
+	for _, tt := range []struct {
+		gauges int
+		valid  bool
+	}{{0, true}, {50, true}, {-1, false}, {maxSessionGauges + 1, false}} {
+		if err := ValidateMetricsConfig(&Config{Metrics: &MetricsConfig{SessionGauges: tt.gauges}}); (err == nil) != tt.valid {
+			t.Errorf("session_gauges %d: error %v", tt.gauges, err)
+		}
+	}
+}
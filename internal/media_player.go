@@ -1,57 +1,131 @@
 package internal
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Playback packet timing
+const (
+	playbackPtime     = 20    // ms of audio in each packet
+	opusPlaybackClock = 48000 // RTP clock of Ogg Opus packets
+)
+
+// Media playback metrics
+var (
+	mediaPlaybacks = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "karl_media_playbacks",
+			Help: "Announcements being played into calls",
+		},
+	)
+
+	mediaPlaybackPackets = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "karl_media_playback_packets_total",
+			Help: "RTP packets of announcements played into calls, by whether they were sent",
+		},
+		[]string{"result"},
+	)
 )
 
+var (
+	defaultMediaPlayer = NewMediaPlayer()
+
+	// Legs whose audio is replaced by an announcement, keyed by
+	// playbackKey of the leg sending it, with the number of playbacks
+	replacedLegsMu    sync.RWMutex
+	replacedLegs      = make(map[string]int)
+	replacedLegsCount atomic.Int32
+
+	// Failures to encode or send announcements are reported at most once a minute
+	playbackErrors = NewLogSampler(Logger(ComponentRTP), slog.LevelWarn, 1, time.Minute)
+)
+
+// GetMediaPlayer returns the media player announcements are played with
+func GetMediaPlayer() *MediaPlayer {
+	return defaultMediaPlayer
+}
+
+// playbackKey names the playback to one leg of a call
+func playbackKey(callID string, caller bool) string {
+	if caller {
+		return callID + "/caller"
+	}
+	return callID + "/callee"
+}
+
 // MediaPlayer handles audio file playback into RTP streams
 type MediaPlayer struct {
 	sessions map[string]*PlaybackSession
 	mu       sync.RWMutex
 	stopCh   chan struct{}
+	send     func(packet []byte, addr *net.UDPAddr) error
 }
 
 // PlaybackSession represents an active media playback
 type PlaybackSession struct {
-	SessionID    string
-	FilePath     string
-	Codec        string
-	SampleRate   int
-	Channels     int
-	Loop         bool
+	SessionID     string
+	CallID        string
+	FilePath      string
+	Codec         string
+	SampleRate    int
+	Channels      int
+	Loop          bool
 	BlendOriginal bool // Mix with original audio instead of replacing
 
 	// Playback state
-	file         *os.File
-	audioData    []byte
-	position     int
-	playing      bool
-	paused       bool
-	seqNum       uint16
-	timestamp    uint32
-	ssrc         uint32
-	startTime    time.Time
+	pcm       []int16  // file audio, resampled to the target codec
+	frames    [][]byte // Ogg Opus packets, sent unchanged
+	position  int      // sample, or Opus packet, the next packet starts at
+	repeats   int      // plays of the file left after the current one
+	playing   bool
+	paused    bool
+	seqNum    uint16
+	timestamp uint32
+	ssrc      uint32
+	startTime time.Time
+	target    CodecInfo
+	codecs    *StreamCodecs
+	ptime     int
+	onDone    func()
 
 	// Target leg
-	TargetLeg    string // "caller", "callee", or "both"
+	TargetLeg string // "caller", "callee", or "both"
 
-	mu           sync.Mutex
-	stopCh       chan struct{}
+	mu     sync.Mutex
+	stopCh chan struct{}
 }
 
 // PlaybackConfig holds playback configuration
 type PlaybackConfig struct {
 	FilePath      string
-	Codec         string // PCMU, PCMA, or auto-detect
+	Codec         string // PCMU or PCMA when Target is unset
 	Loop          bool
 	BlendOriginal bool
 	TargetLeg     string
 	SSRC          uint32
+
+	CallID   string        // call the playback belongs to, for StopCall
+	Target   CodecInfo     // negotiated codec of the leg the audio is played to
+	StartPos time.Duration // offset into the file playback starts at
+	Repeat   int           // times the file is played; 0 plays it once
+	Remote   *net.UDPAddr  // where packets are sent; nil leaves them to GetNextPacket
+	OnDone   func()        // called when sent playback ends by itself
 }
 
 // NewMediaPlayer creates a new media player
@@ -62,51 +136,86 @@ func NewMediaPlayer() *MediaPlayer {
 	}
 }
 
-// StartPlayback starts playing media into a session
-func (mp *MediaPlayer) StartPlayback(sessionID string, config *PlaybackConfig) error {
+// SetSender sets how played packets with a Remote address are sent
+func (mp *MediaPlayer) SetSender(send func(packet []byte, addr *net.UDPAddr) error) {
 	mp.mu.Lock()
 	defer mp.mu.Unlock()
+	mp.send = send
+}
 
-	// Stop any existing playback for this session
-	if existing, ok := mp.sessions[sessionID]; ok {
-		existing.Stop()
-		delete(mp.sessions, sessionID)
-	}
-
-	// Load the audio file
-	audioData, sampleRate, channels, codec, err := mp.loadAudioFile(config.FilePath)
+// StartPlayback starts playing media into a session. With a Remote address
+// the packets are paced out through the sender; otherwise they are pulled
+// with GetNextPacket
+func (mp *MediaPlayer) StartPlayback(sessionID string, config *PlaybackConfig) error {
+	audio, err := loadPlaybackAudio(config.FilePath)
 	if err != nil {
 		return fmt.Errorf("failed to load audio file: %w", err)
 	}
-
-	// Override codec if specified
-	if config.Codec != "" {
-		codec = config.Codec
+	target, err := playbackTarget(config, audio)
+	if err != nil {
+		return err
 	}
 
 	ps := &PlaybackSession{
 		SessionID:     sessionID,
+		CallID:        config.CallID,
 		FilePath:      config.FilePath,
-		Codec:         codec,
-		SampleRate:    sampleRate,
-		Channels:      channels,
+		Codec:         target.Name,
+		SampleRate:    audio.rate,
+		Channels:      audio.channels,
 		Loop:          config.Loop,
 		BlendOriginal: config.BlendOriginal,
 		TargetLeg:     config.TargetLeg,
-		audioData:     audioData,
+		frames:        audio.frames,
+		repeats:       max(config.Repeat-1, 0),
 		playing:       true,
-		seqNum:        1000,
-		timestamp:     0,
+		seqNum:        uint16(rand.Uint32()),
+		timestamp:     rand.Uint32(),
 		ssrc:          config.SSRC,
 		startTime:     time.Now(),
+		target:        target,
+		codecs:        NewStreamCodecs(),
+		ptime:         playbackPtime,
+		onDone:        config.OnDone,
 		stopCh:        make(chan struct{}),
 	}
-
+	if audio.frames == nil {
+		ps.SampleRate = codecSampleRate(target)
+		ps.pcm = resamplePCM(audio.pcm, audio.rate, ps.SampleRate)
+	}
+	if err := ps.seek(config.StartPos); err != nil {
+		return err
+	}
 	if ps.ssrc == 0 {
-		ps.ssrc = uint32(time.Now().UnixNano() & 0xFFFFFFFF)
+		ps.ssrc = rand.Uint32()
 	}
 
+	mp.mu.Lock()
+	send := mp.send
+	if config.Remote != nil && send == nil {
+		mp.mu.Unlock()
+		return errors.New("media player has no sender")
+	}
+	if existing, ok := mp.sessions[sessionID]; ok {
+		existing.Stop()
+	}
 	mp.sessions[sessionID] = ps
+	mp.mu.Unlock()
+
+	if config.Remote != nil {
+		// Unless blended, the other leg's audio is replaced while playing
+		var replaced string
+		if config.CallID != "" && !config.BlendOriginal {
+			switch config.TargetLeg {
+			case "caller":
+				replaced = playbackKey(config.CallID, false)
+			case "callee":
+				replaced = playbackKey(config.CallID, true)
+			}
+		}
+		mediaPlaybacks.Inc()
+		go mp.run(ps, send, config.Remote, replaced)
+	}
 	return nil
 }
 
@@ -125,6 +234,19 @@ func (mp *MediaPlayer) StopPlayback(sessionID string) error {
 	return nil
 }
 
+// StopCall stops every playback into a call
+func (mp *MediaPlayer) StopCall(callID string) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	for id, ps := range mp.sessions {
+		if ps.CallID == callID {
+			ps.Stop()
+			delete(mp.sessions, id)
+		}
+	}
+}
+
 // PausePlayback pauses media playback
 func (mp *MediaPlayer) PausePlayback(sessionID string) error {
 	mp.mu.RLock()
@@ -175,6 +297,8 @@ func (mp *MediaPlayer) IsPlaying(sessionID string) bool {
 	if !ok {
 		return false
 	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
 	return ps.playing && !ps.paused
 }
 
@@ -190,82 +314,293 @@ func (mp *MediaPlayer) Stop() {
 	close(mp.stopCh)
 }
 
-// loadAudioFile loads and parses an audio file
-func (mp *MediaPlayer) loadAudioFile(filePath string) ([]byte, int, int, string, error) {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return nil, 0, 0, "", err
+// run sends a playback's packets to remote in real time until it ends or
+// is stopped, dropping the audio of the replaced leg meanwhile
+func (mp *MediaPlayer) run(ps *PlaybackSession, send func([]byte, *net.UDPAddr) error, remote *net.UDPAddr, replaced string) {
+	defer mediaPlaybacks.Dec()
+	if replaced != "" {
+		replaceLeg(replaced, 1)
+		defer replaceLeg(replaced, -1)
 	}
-	defer file.Close()
 
-	// Check if it's a WAV file
-	header := make([]byte, 44)
-	n, err := file.Read(header)
-	if err != nil && err != io.EOF {
-		return nil, 0, 0, "", err
+	next := time.Now()
+	for {
+		packet, duration, ok := ps.nextPacket()
+		if !ok {
+			if !ps.isPlaying() {
+				break
+			}
+			// Paused
+			duration = time.Duration(ps.ptime) * time.Millisecond
+		} else if err := send(packet, remote); err != nil {
+			mediaPlaybackPackets.WithLabelValues("failed").Inc()
+			if playbackErrors.Allow() {
+				playbackErrors.Log("Failed to send announcement", "call_id", ps.CallID, "remote", remote.String(), "error", err)
+			}
+		} else {
+			mediaPlaybackPackets.WithLabelValues("sent").Inc()
+		}
+
+		next = next.Add(duration)
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ps.stopCh:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
 	}
 
-	if n >= 44 && string(header[0:4]) == "RIFF" && string(header[8:12]) == "WAVE" {
-		return mp.loadWAVFile(file, header)
+	// Finished by itself: forget it, unless it was already replaced
+	mp.mu.Lock()
+	if mp.sessions[ps.SessionID] == ps {
+		delete(mp.sessions, ps.SessionID)
+	}
+	mp.mu.Unlock()
+	if ps.onDone != nil {
+		ps.onDone()
 	}
+}
 
-	// Assume raw PCM (G.711 u-law)
-	file.Seek(0, 0)
-	data, err := io.ReadAll(file)
-	if err != nil {
-		return nil, 0, 0, "", err
+// replaceLeg counts a playback that replaces the audio of a leg
+func replaceLeg(key string, delta int) {
+	replacedLegsMu.Lock()
+	defer replacedLegsMu.Unlock()
+	if replacedLegs[key] += delta; replacedLegs[key] <= 0 {
+		delete(replacedLegs, key)
+	}
+	replacedLegsCount.Store(int32(len(replacedLegs)))
+}
+
+// replacedByPlayback reports whether a packet's audio is replaced by an
+// announcement played to the other leg
+func replacedByPlayback(packet *RTPPacket) bool {
+	if replacedLegsCount.Load() == 0 {
+		return false
+	}
+	callID, fromOfferer, _, ok := GetCodecNegotiator().ResolveLeg(packet.SSRC, packet.PayloadType)
+	if !ok {
+		return false
 	}
+	replacedLegsMu.RLock()
+	defer replacedLegsMu.RUnlock()
+	return replacedLegs[playbackKey(callID, fromOfferer)] > 0
+}
 
-	return data, 8000, 1, "PCMU", nil
+// playbackAudio is the audio of a file to play
+type playbackAudio struct {
+	pcm      []int16 // mono PCM at rate
+	rate     int
+	channels int      // of the file
+	frames   [][]byte // Ogg Opus packets instead of PCM
 }
 
-// loadWAVFile parses a WAV file
-func (mp *MediaPlayer) loadWAVFile(file *os.File, header []byte) ([]byte, int, int, string, error) {
-	// Parse WAV header
-	// Bytes 22-23: Number of channels
-	channels := int(binary.LittleEndian.Uint16(header[22:24]))
-	// Bytes 24-27: Sample rate
-	sampleRate := int(binary.LittleEndian.Uint32(header[24:28]))
-	// Bytes 34-35: Bits per sample
-	bitsPerSample := int(binary.LittleEndian.Uint16(header[34:36]))
+// playbackTarget returns the codec a playback is encoded to
+func playbackTarget(config *PlaybackConfig, audio *playbackAudio) (CodecInfo, error) {
+	target := config.Target
+	if target.Name == "" {
+		switch strings.ToUpper(config.Codec) {
+		case "", "PCMU":
+			target = CodecInfo{PayloadType: 0, Name: "PCMU", ClockRate: 8000, Channels: 1}
+		case "PCMA":
+			target = CodecInfo{PayloadType: 8, Name: "PCMA", ClockRate: 8000, Channels: 1}
+		default:
+			return CodecInfo{}, fmt.Errorf("unsupported playback codec %s", config.Codec)
+		}
+	}
 
-	// Find data chunk
-	file.Seek(12, 0) // Skip RIFF header
+	if audio.frames != nil {
+		// The Opus codec here cannot decode real Opus, so the packets
+		// can only go to a leg that takes them as they are
+		if codecMimeType(target.Name) != webrtc.MimeTypeOpus {
+			return CodecInfo{}, fmt.Errorf("Ogg Opus files can only be played to Opus legs, not %s", target.Name)
+		}
+		return target, nil
+	}
+	if codecSampleRate(target) == 0 {
+		return CodecInfo{}, fmt.Errorf("cannot encode announcements to %s", target.Name)
+	}
+	return target, nil
+}
 
-	for {
-		chunkHeader := make([]byte, 8)
-		_, err := file.Read(chunkHeader)
+// loadPlaybackAudio loads a WAV, Ogg Opus or raw G.711 u-law file
+func loadPlaybackAudio(filePath string) (*playbackAudio, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var audio *playbackAudio
+	switch {
+	case len(data) >= 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WAVE":
+		if audio, err = loadWAVAudio(data); err != nil {
+			return nil, err
+		}
+	case bytes.HasPrefix(data, []byte("OggS")):
+		frames, err := readOggOpus(data)
 		if err != nil {
-			return nil, 0, 0, "", fmt.Errorf("failed to find data chunk: %w", err)
+			return nil, err
 		}
+		audio = &playbackAudio{frames: frames, rate: opusPlaybackClock}
+	default:
+		// Raw G.711 u-law at 8 kHz
+		audio = &playbackAudio{pcm: decodeG711("PCMU", data), rate: 8000, channels: 1}
+	}
 
-		chunkID := string(chunkHeader[0:4])
-		chunkSize := binary.LittleEndian.Uint32(chunkHeader[4:8])
+	if len(audio.pcm) == 0 && len(audio.frames) == 0 {
+		return nil, errors.New("file has no audio")
+	}
+	return audio, nil
+}
 
-		if chunkID == "data" {
-			data := make([]byte, chunkSize)
-			_, err := io.ReadFull(file, data)
+// loadWAVAudio decodes a WAV file of 8 or 16 bit PCM or G.711 to mono PCM
+func loadWAVAudio(data []byte) (*playbackAudio, error) {
+	var format, channels, bits, rate int
+	chunks := data[12:]
+	for len(chunks) >= 8 {
+		id := string(chunks[0:4])
+		size := int(binary.LittleEndian.Uint32(chunks[4:8]))
+		body := chunks[8:]
+		// A truncated last chunk is played as far as it goes
+		size = min(size, len(body))
+
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return nil, errors.New("invalid WAV fmt chunk")
+			}
+			format = int(binary.LittleEndian.Uint16(body[0:2]))
+			channels = int(binary.LittleEndian.Uint16(body[2:4]))
+			rate = int(binary.LittleEndian.Uint32(body[4:8]))
+			bits = int(binary.LittleEndian.Uint16(body[14:16]))
+			if format == 0xfffe && size >= 26 {
+				// WAVE_FORMAT_EXTENSIBLE: the format is the start of the sub-format GUID
+				format = int(binary.LittleEndian.Uint16(body[24:26]))
+			}
+		case "data":
+			if channels == 0 || rate == 0 {
+				return nil, errors.New("WAV file has no fmt chunk before its data")
+			}
+			pcm, err := decodeWAVSamples(body[:size], format, bits)
 			if err != nil {
-				return nil, 0, 0, "", err
+				return nil, err
 			}
+			return &playbackAudio{pcm: downmix(pcm, channels), rate: rate, channels: channels}, nil
+		}
 
-			// Determine codec based on format
-			codec := "PCMU"
-			if bitsPerSample == 16 {
-				// Convert 16-bit PCM to G.711 u-law
-				data = convertPCM16ToUlaw(data)
-			} else if bitsPerSample == 8 {
-				// Already 8-bit, check if it's a-law or u-law
-				// Default to u-law
-				codec = "PCMU"
-			}
+		// Chunks are padded to an even size
+		chunks = body[min(size+size&1, len(body)):]
+	}
+	return nil, errors.New("WAV file has no data chunk")
+}
+
+// decodeWAVSamples decodes WAV sample data to linear PCM
+func decodeWAVSamples(data []byte, format, bits int) ([]int16, error) {
+	switch {
+	case format == 1 && bits == 16:
+		pcm := make([]int16, len(data)/2)
+		for i := range pcm {
+			pcm[i] = int16(binary.LittleEndian.Uint16(data[2*i:]))
+		}
+		return pcm, nil
+	case format == 1 && bits == 8:
+		// 8 bit PCM is unsigned
+		pcm := make([]int16, len(data))
+		for i, b := range data {
+			pcm[i] = (int16(b) - 128) << 8
+		}
+		return pcm, nil
+	case format == 6 && bits == 8:
+		return decodeG711("PCMA", data), nil
+	case format == 7 && bits == 8:
+		return decodeG711("PCMU", data), nil
+	}
+	return nil, fmt.Errorf("unsupported WAV format %d with %d bits per sample", format, bits)
+}
 
-			return data, sampleRate, channels, codec, nil
+// downmix averages interleaved channels into mono
+func downmix(pcm []int16, channels int) []int16 {
+	if channels <= 1 {
+		return pcm
+	}
+	mono := make([]int16, len(pcm)/channels)
+	for i := range mono {
+		var sum int
+		for _, s := range pcm[i*channels : (i+1)*channels] {
+			sum += int(s)
+		}
+		mono[i] = int16(sum / channels)
+	}
+	return mono
+}
+
+// readOggOpus returns the audio packets of an Ogg Opus file. Pages are
+// split on their lacing values, as encoders put many packets on a page
+func readOggOpus(data []byte) ([][]byte, error) {
+	var packets [][]byte
+	var partial []byte
+	for len(data) > 0 {
+		if len(data) < 27 || string(data[0:4]) != "OggS" {
+			return nil, errors.New("invalid Ogg page")
 		}
+		segments := int(data[26])
+		if len(data) < 27+segments {
+			return nil, errors.New("truncated Ogg page")
+		}
+		lacing := data[27 : 27+segments]
+		body := data[27+segments:]
+		for _, n := range lacing {
+			if len(body) < int(n) {
+				return nil, errors.New("truncated Ogg page")
+			}
+			partial = append(partial, body[:n]...)
+			body = body[n:]
+			if n < 255 {
+				packets = append(packets, partial)
+				partial = nil
+			}
+		}
+		data = body
+	}
 
-		// Skip this chunk
-		file.Seek(int64(chunkSize), 1)
+	if len(packets) == 0 || !bytes.HasPrefix(packets[0], []byte("OpusHead")) {
+		return nil, errors.New("not an Ogg Opus file")
 	}
+	var frames [][]byte
+	for _, p := range packets[1:] {
+		if !bytes.HasPrefix(p, []byte("OpusTags")) && opusPacketSamples(p) > 0 {
+			frames = append(frames, p)
+		}
+	}
+	return frames, nil
+}
+
+// opusPacketSamples returns the 48 kHz samples an Opus packet carries, from
+// its TOC byte (RFC 6716 section 3.1)
+func opusPacketSamples(packet []byte) int {
+	if len(packet) == 0 {
+		return 0
+	}
+	config := packet[0] >> 3
+	var frame int
+	switch {
+	case config < 12: // SILK
+		frame = []int{480, 960, 1920, 2880}[config%4]
+	case config < 16: // Hybrid
+		frame = []int{480, 960}[config%2]
+	default: // CELT
+		frame = []int{120, 240, 480, 960}[config%4]
+	}
+	switch packet[0] & 3 {
+	case 0:
+		return frame
+	case 1, 2:
+		return 2 * frame
+	}
+	if len(packet) < 2 {
+		return 0
+	}
+	return int(packet[1]&0x3f) * frame
 }
 
 // convertPCM16ToUlaw converts 16-bit PCM to G.711 u-law
@@ -325,15 +660,15 @@ func (ps *PlaybackSession) Stop() {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 
+	ps.stopLocked()
+}
+
+// stopLocked ends the playback; the caller holds ps.mu
+func (ps *PlaybackSession) stopLocked() {
 	if ps.playing {
 		ps.playing = false
 		close(ps.stopCh)
 	}
-
-	if ps.file != nil {
-		ps.file.Close()
-		ps.file = nil
-	}
 }
 
 // Pause pauses the playback
@@ -350,65 +685,120 @@ func (ps *PlaybackSession) Resume() {
 	ps.paused = false
 }
 
-// GetNextPacket returns the next RTP packet
-func (ps *PlaybackSession) GetNextPacket() ([]byte, bool) {
+// isPlaying reports whether the playback has not ended, paused or not
+func (ps *PlaybackSession) isPlaying() bool {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
+	return ps.playing
+}
 
-	if !ps.playing || ps.paused {
-		return nil, false
+// seek moves playback to an offset into the file
+func (ps *PlaybackSession) seek(offset time.Duration) error {
+	if offset <= 0 {
+		return nil
+	}
+	if ps.frames == nil {
+		ps.position = int(offset.Milliseconds()) * ps.SampleRate / 1000
+		if ps.position >= len(ps.pcm) {
+			return fmt.Errorf("start position %v is beyond the end of the file", offset)
+		}
+		return nil
 	}
 
-	// Determine payload size based on codec and ptime (20ms default)
-	// G.711: 8000 Hz, 8 bits/sample = 160 bytes per 20ms
-	payloadSize := 160
-	if ps.SampleRate == 16000 {
-		payloadSize = 320
+	skipped := 0
+	for ps.position < len(ps.frames) && time.Duration(skipped)*time.Second/opusPlaybackClock < offset {
+		skipped += opusPacketSamples(ps.frames[ps.position])
+		ps.position++
+	}
+	if ps.position >= len(ps.frames) {
+		return fmt.Errorf("start position %v is beyond the end of the file", offset)
 	}
+	return nil
+}
 
-	// Check if we have enough data
-	if ps.position >= len(ps.audioData) {
-		if ps.Loop {
-			ps.position = 0
-		} else {
-			ps.playing = false
-			return nil, false
-		}
+// rewind starts the file over if it loops or is repeated
+func (ps *PlaybackSession) rewind() bool {
+	switch {
+	case ps.Loop:
+	case ps.repeats > 0:
+		ps.repeats--
+	default:
+		return false
 	}
+	ps.position = 0
+	return true
+}
 
-	// Calculate how much data to take
-	endPos := ps.position + payloadSize
-	if endPos > len(ps.audioData) {
-		if ps.Loop {
-			// Wrap around
-			payload := make([]byte, payloadSize)
-			firstPart := len(ps.audioData) - ps.position
-			copy(payload, ps.audioData[ps.position:])
-			copy(payload[firstPart:], ps.audioData[:payloadSize-firstPart])
-			ps.position = payloadSize - firstPart
-		} else {
-			endPos = len(ps.audioData)
+// take returns the next n samples of the file, padded with silence at its
+// end, or nil when it has been played out
+func (ps *PlaybackSession) take(n int) []int16 {
+	out := make([]int16, 0, n)
+	for len(out) < n {
+		if ps.position >= len(ps.pcm) && !ps.rewind() {
+			break
 		}
+		k := min(n-len(out), len(ps.pcm)-ps.position)
+		out = append(out, ps.pcm[ps.position:ps.position+k]...)
+		ps.position += k
+	}
+	if len(out) == 0 {
+		return nil
 	}
+	return append(out, make([]int16, n-len(out))...)
+}
 
-	payload := ps.audioData[ps.position:endPos]
-	ps.position = endPos
+// GetNextPacket returns the next RTP packet
+func (ps *PlaybackSession) GetNextPacket() ([]byte, bool) {
+	packet, _, ok := ps.nextPacket()
+	return packet, ok
+}
+
+// nextPacket returns the next RTP packet and the audio time it carries
+func (ps *PlaybackSession) nextPacket() ([]byte, time.Duration, bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if !ps.playing || ps.paused {
+		return nil, 0, false
+	}
+
+	var payload []byte
+	var ticks uint32
+	var duration time.Duration
+	if ps.frames != nil {
+		if ps.position >= len(ps.frames) && !ps.rewind() {
+			ps.stopLocked()
+			return nil, 0, false
+		}
+		payload = ps.frames[ps.position]
+		ps.position++
+		samples := opusPacketSamples(payload)
+		ticks = uint32(samples)
+		duration = time.Duration(samples) * time.Second / opusPlaybackClock
+	} else {
+		frame := ps.take(ps.SampleRate * ps.ptime / 1000)
+		if frame == nil {
+			ps.stopLocked()
+			return nil, 0, false
+		}
+		var err error
+		if payload, err = encodeAudio(ps.target, frame, ps.codecs); err != nil {
+			if playbackErrors.Allow() {
+				playbackErrors.Log("Failed to encode announcement", "call_id", ps.CallID, "codec", ps.target.Name, "error", err)
+			}
+			ps.stopLocked()
+			return nil, 0, false
+		}
+		ticks = uint32(rtpClockRate(ps.target) * ps.ptime / 1000)
+		duration = time.Duration(ps.ptime) * time.Millisecond
+	}
 
 	// Build RTP packet
 	packet := make([]byte, 12+len(payload))
 
 	// RTP header
 	packet[0] = 0x80 // Version 2, no padding, no extension, no CSRC
-
-	// Payload type based on codec
-	switch ps.Codec {
-	case "PCMU":
-		packet[1] = 0 // PT 0 for PCMU
-	case "PCMA":
-		packet[1] = 8 // PT 8 for PCMA
-	default:
-		packet[1] = 0
-	}
+	packet[1] = ps.target.PayloadType & 0x7f
 
 	// Sequence number
 	binary.BigEndian.PutUint16(packet[2:4], ps.seqNum)
@@ -416,7 +806,7 @@ func (ps *PlaybackSession) GetNextPacket() ([]byte, bool) {
 
 	// Timestamp
 	binary.BigEndian.PutUint32(packet[4:8], ps.timestamp)
-	ps.timestamp += uint32(payloadSize) // Increment by samples
+	ps.timestamp += ticks
 
 	// SSRC
 	binary.BigEndian.PutUint32(packet[8:12], ps.ssrc)
@@ -424,7 +814,7 @@ func (ps *PlaybackSession) GetNextPacket() ([]byte, bool) {
 	// Payload
 	copy(packet[12:], payload)
 
-	return packet, true
+	return packet, duration, true
 }
 
 // GetPlaybackStats returns playback statistics
@@ -432,9 +822,13 @@ func (ps *PlaybackSession) GetPlaybackStats() map[string]interface{} {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 
+	total := len(ps.pcm)
+	if ps.frames != nil {
+		total = len(ps.frames)
+	}
 	progress := float64(0)
-	if len(ps.audioData) > 0 {
-		progress = float64(ps.position) / float64(len(ps.audioData)) * 100
+	if total > 0 {
+		progress = float64(ps.position) / float64(total) * 100
 	}
 
 	return map[string]interface{}{
@@ -446,7 +840,7 @@ func (ps *PlaybackSession) GetPlaybackStats() map[string]interface{} {
 		"progress":   progress,
 		"duration":   time.Since(ps.startTime).Seconds(),
 		"position":   ps.position,
-		"total_size": len(ps.audioData),
+		"total_size": total,
 	}
 }
 
@@ -1,9 +1,15 @@
 package internal
 
 import (
+	"bytes"
+	"encoding/binary"
+	"net"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
+
+	ng "karl/internal/ng_protocol"
 )
 
 func TestNewMediaPlayer(t *testing.T) {
@@ -542,3 +548,251 @@ func TestPlaybackSession_PCMACodec(t *testing.T) {
 
 	mp.StopPlayback("session-1")
 }
+
+// wavFile builds a WAV file of 16 bit PCM
+func wavFile(rate, channels int, samples []int16) []byte {
+	data := make([]byte, 2*len(samples))
+	for i, s := range samples {
+		binary.LittleEndian.PutUint16(data[2*i:], uint16(s))
+	}
+	fmtChunk := make([]byte, 16)
+	binary.LittleEndian.PutUint16(fmtChunk[0:], 1)
+	binary.LittleEndian.PutUint16(fmtChunk[2:], uint16(channels))
+	binary.LittleEndian.PutUint32(fmtChunk[4:], uint32(rate))
+	binary.LittleEndian.PutUint32(fmtChunk[8:], uint32(rate*channels*2))
+	binary.LittleEndian.PutUint16(fmtChunk[12:], uint16(channels*2))
+	binary.LittleEndian.PutUint16(fmtChunk[14:], 16)
+
+	var b bytes.Buffer
+	b.WriteString("RIFF")
+	binary.Write(&b, binary.LittleEndian, uint32(4+8+len(fmtChunk)+8+len(data)))
+	b.WriteString("WAVEfmt ")
+	binary.Write(&b, binary.LittleEndian, uint32(len(fmtChunk)))
+	b.Write(fmtChunk)
+	b.WriteString("data")
+	binary.Write(&b, binary.LittleEndian, uint32(len(data)))
+	b.Write(data)
+	return b.Bytes()
+}
+
+// oggPage builds an Ogg page holding whole packets
+func oggPage(packets ...[]byte) []byte {
+	var lacing, body []byte
+	for _, p := range packets {
+		n := len(p)
+		for ; n >= 255; n -= 255 {
+			lacing = append(lacing, 255)
+		}
+		lacing = append(lacing, byte(n))
+		body = append(body, p...)
+	}
+	page := append([]byte("OggS"), make([]byte, 22)...)
+	page = append(page, byte(len(lacing)))
+	return append(append(page, lacing...), body...)
+}
+
+func TestMediaPlayer_WAVToLegCodec(t *testing.T) {
+	// 100ms of 16 kHz stereo
+	samples := make([]int16, 2*1600)
+	for i := range samples {
+		samples[i] = 1000
+	}
+	file := filepath.Join(t.TempDir(), "announcement.wav")
+	if err := os.WriteFile(file, wavFile(16000, 2, samples), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mp := NewMediaPlayer()
+	config := &PlaybackConfig{
+		FilePath: file,
+		Target:   CodecInfo{PayloadType: 8, Name: "PCMA", ClockRate: 8000},
+		StartPos: 40 * time.Millisecond,
+		Repeat:   2,
+	}
+	if err := mp.StartPlayback("session-1", config); err != nil {
+		t.Fatalf("StartPlayback failed: %v", err)
+	}
+
+	// 60ms are left of the first play and 100ms of the second: 8 packets
+	var packets [][]byte
+	for {
+		packet, ok := mp.GetNextPacket("session-1")
+		if !ok {
+			break
+		}
+		packets = append(packets, packet)
+	}
+	if len(packets) != 8 {
+		t.Fatalf("got %d packets, want 8", len(packets))
+	}
+	for _, p := range packets {
+		if p[1] != 8 || len(p) != 12+160 {
+			t.Fatalf("packet PT %d with %d bytes, want PCMA with 160", p[1], len(p)-12)
+		}
+	}
+	// The middle of a packet decodes back to the file's level
+	if s := AlawToLinear(packets[1][12+80]); s < 900 || s > 1100 {
+		t.Errorf("decoded sample %d, want about 1000", s)
+	}
+
+	config.StartPos = time.Second
+	if err := mp.StartPlayback("session-1", config); err == nil {
+		t.Error("start position beyond the file accepted")
+	}
+}
+
+func TestMediaPlayer_OggOpus(t *testing.T) {
+	// CELT 20ms frames (config 31) and one SILK 40ms frame (config 2)
+	frame20 := []byte{31 << 3, 1, 2, 3}
+	frame40 := []byte{2 << 3, 4, 5}
+	long := append([]byte{31 << 3}, make([]byte, 300)...)
+	data := oggPage([]byte("OpusHead\x01\x01\x38\x01\x80\xbb\x00\x00\x00\x00\x00"))
+	data = append(data, oggPage([]byte("OpusTags"))...)
+	data = append(data, oggPage(frame20, frame40, long)...)
+	file := filepath.Join(t.TempDir(), "announcement.opus")
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mp := NewMediaPlayer()
+	if err := mp.StartPlayback("session-1", &PlaybackConfig{FilePath: file}); err == nil {
+		t.Error("Ogg Opus played to a PCMU leg")
+	}
+	opus := CodecInfo{PayloadType: 111, Name: "opus", ClockRate: 48000, Channels: 2}
+	if err := mp.StartPlayback("session-1", &PlaybackConfig{FilePath: file, Target: opus}); err != nil {
+		t.Fatalf("StartPlayback failed: %v", err)
+	}
+
+	var last uint32
+	for i, want := range [][]byte{frame20, frame40, long} {
+		packet, ok := mp.GetNextPacket("session-1")
+		if !ok {
+			t.Fatalf("packet %d missing", i)
+		}
+		if packet[1] != 111 || !bytes.Equal(packet[12:], want) {
+			t.Errorf("packet %d PT %d payload % x", i, packet[1], packet[12:])
+		}
+		ts := binary.BigEndian.Uint32(packet[4:8])
+		if i == 2 && ts-last != 1920 {
+			t.Errorf("timestamp advanced %d after a 40ms frame, want 1920", ts-last)
+		}
+		last = ts
+	}
+	if _, ok := mp.GetNextPacket("session-1"); ok {
+		t.Error("packet after the end of the file")
+	}
+}
+
+func TestMediaPlayer_SendsPaced(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "beep.raw")
+	os.WriteFile(file, make([]byte, 800), 0644) // 100ms
+
+	sent := make(chan []byte, 10)
+	mp := NewMediaPlayer()
+	mp.SetSender(func(packet []byte, _ *net.UDPAddr) error {
+		sent <- packet
+		return nil
+	})
+	done := make(chan struct{})
+	start := time.Now()
+	err := mp.StartPlayback("session-1", &PlaybackConfig{
+		FilePath: file,
+		Remote:   &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4000},
+		OnDone:   func() { close(done) },
+	})
+	if err != nil {
+		t.Fatalf("StartPlayback failed: %v", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("playback did not finish")
+	}
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Errorf("100ms of audio sent in %v", elapsed)
+	}
+	if len(sent) != 5 {
+		t.Errorf("sent %d packets, want 5", len(sent))
+	}
+	if mp.IsPlaying("session-1") {
+		t.Error("finished playback still listed")
+	}
+}
+
+func TestNGSocketListener_PlayMedia(t *testing.T) {
+	manager, registry, _ := newTestSessionManager(t)
+	listener := &NGSocketListener{sessionRegistry: registry, sessionManager: manager, config: &Config{}}
+
+	type sentPacket struct {
+		packet []byte
+		addr   *net.UDPAddr
+	}
+	sent := make(chan sentPacket, 100)
+	GetMediaPlayer().SetSender(func(packet []byte, addr *net.UDPAddr) error {
+		sent <- sentPacket{packet, addr}
+		return nil
+	})
+	defer GetMediaPlayer().SetSender(nil)
+
+	resp, err := listener.handleOffer(&ng.NGRequest{CallID: "play-call", FromTag: "from-tag", SDP: sipOfferSDP})
+	if err != nil || resp.Result != ng.ResultOK {
+		t.Fatalf("handleOffer failed: %v %+v", err, resp)
+	}
+	defer GetCodecNegotiator().RemoveCall("play-call")
+
+	file := filepath.Join(t.TempDir(), "ringback.raw")
+	os.WriteFile(file, make([]byte, 8000), 0644)
+
+	if resp, _ := listener.handlePlayMedia(&ng.NGRequest{CallID: "play-call", FromTag: "from-tag"}); resp.Result != ng.ResultError {
+		t.Errorf("play media without a file accepted: %+v", resp)
+	}
+
+	// Before the answer, the caller hears it
+	resp, _ = listener.handlePlayMedia(&ng.NGRequest{
+		CallID:    "play-call",
+		FromTag:   "from-tag",
+		RawParams: ng.BencodeDict{"file": file, "repeat-times": int64(2)},
+	})
+	if resp.Result != ng.ResultOK {
+		t.Fatalf("handlePlayMedia failed: %+v", resp)
+	}
+	select {
+	case p := <-sent:
+		if p.addr.String() != "192.0.2.10:49170" || p.packet[1] != 0 {
+			t.Errorf("played PT %d to %v, want PCMU to the caller", p.packet[1], p.addr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no media played")
+	}
+	session := registry.GetSessionByCallID("play-call")[0]
+	if !session.GetFlag("playing_media") || !playingMedia("play-call") {
+		t.Error("call not marked as playing media")
+	}
+
+	if resp, _ := listener.handleStopMedia(&ng.NGRequest{CallID: "play-call"}); resp.Result != ng.ResultOK {
+		t.Fatalf("handleStopMedia failed: %+v", resp)
+	}
+	if session.GetFlag("playing_media") || playingMedia("play-call") {
+		t.Error("media still playing after stop media")
+	}
+}
+
+func TestReplacedByPlayback(t *testing.T) {
+	n := GetCodecNegotiator()
+	n.SetOfferCodecs("replaced-call", []CodecInfo{{PayloadType: 0, Name: "PCMU", ClockRate: 8000}})
+	n.SetAnswerCodecs("replaced-call", []CodecInfo{{PayloadType: 0, Name: "PCMU", ClockRate: 8000}})
+	n.BindSSRC(0xa1, "replaced-call", true)
+	n.BindSSRC(0xb2, "replaced-call", false)
+	defer n.RemoveCall("replaced-call")
+
+	// Playing to the callee replaces the caller's audio only
+	replaceLeg(playbackKey("replaced-call", true), 1)
+	if !replacedByPlayback(&RTPPacket{SSRC: 0xa1}) || replacedByPlayback(&RTPPacket{SSRC: 0xb2}) {
+		t.Error("wrong leg replaced")
+	}
+	replaceLeg(playbackKey("replaced-call", true), -1)
+	if replacedByPlayback(&RTPPacket{SSRC: 0xa1}) {
+		t.Error("audio still replaced after playback")
+	}
+}
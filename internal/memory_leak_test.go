@@ -131,49 +131,6 @@ func TestMemoryLeak_Codecs(t *testing.T) {
 	}
 }
 
-// TestMemoryLeak_ILBCCodec tests iLBC encoder/decoder for memory leaks
-func TestMemoryLeak_ILBCCodec(t *testing.T) {
-	runtime.GC()
-	debug.FreeOSMemory()
-	time.Sleep(100 * time.Millisecond)
-
-	var m1 runtime.MemStats
-	runtime.ReadMemStats(&m1)
-
-	config := &ILBCConfig{Mode: ILBCMode30ms, EnablePLC: true}
-	iterations := 500
-
-	samples := make([]int16, ILBC30FrameSamples)
-	for i := range samples {
-		samples[i] = int16(i * 50)
-	}
-
-	for i := 0; i < iterations; i++ {
-		encoder, _ := NewILBCEncoder(config)
-		decoder, _ := NewILBCDecoder(config)
-
-		encoded, _ := encoder.Encode(samples)
-		_, _ = decoder.Decode(encoded)
-
-		encoder.Close()
-		decoder.Close()
-	}
-
-	runtime.GC()
-	debug.FreeOSMemory()
-	time.Sleep(100 * time.Millisecond)
-
-	var m2 runtime.MemStats
-	runtime.ReadMemStats(&m2)
-
-	heapGrowth := int64(m2.HeapAlloc) - int64(m1.HeapAlloc)
-	maxAllowedGrowth := int64(5 * 1024 * 1024) // 5 MB
-
-	if heapGrowth > maxAllowedGrowth {
-		t.Errorf("iLBC codec may be leaking: heap grew by %d bytes", heapGrowth)
-	}
-}
-
 // TestMemoryLeak_V21Detector tests V.21 detector for memory leaks
 func TestMemoryLeak_V21Detector(t *testing.T) {
 	runtime.GC()
@@ -480,23 +437,6 @@ func BenchmarkMemoryAllocation_G711(b *testing.B) {
 	}
 }
 
-func BenchmarkMemoryAllocation_ILBCEncode(b *testing.B) {
-	b.ReportAllocs()
-	config := &ILBCConfig{Mode: ILBCMode30ms}
-	encoder, _ := NewILBCEncoder(config)
-	defer encoder.Close()
-
-	samples := make([]int16, ILBC30FrameSamples)
-	for i := range samples {
-		samples[i] = int16(i * 50)
-	}
-
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		encoder.Encode(samples)
-	}
-}
-
 func BenchmarkMemoryAllocation_BufferPool(b *testing.B) {
 	b.ReportAllocs()
 	pool := &sync.Pool{
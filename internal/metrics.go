@@ -2,6 +2,7 @@ package internal
 
 import (
 	"context"
+	"crypto/tls"
 	"log"
 	"net/http"
 	"runtime"
@@ -105,6 +106,109 @@ var (
 		Buckets: prometheus.ExponentialBuckets(1, 2, 15), // 1s to ~9 hours
 	})
 
+	sessionsTimedOut = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "karl_sessions_timed_out_total",
+		Help: "Total sessions torn down after media inactivity",
+	})
+
+	callMOS = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "karl_call_mos",
+		Help:    "Estimated MOS of ended calls, from the worse direction",
+		Buckets: prometheus.LinearBuckets(1, 0.25, 15), // 1 to 4.5
+	})
+
+	callJitter = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "karl_call_jitter_ms",
+		Help:    "Average interarrival jitter of ended calls in ms",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 10), // 1ms to ~0.5s
+	})
+
+	callPacketLoss = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "karl_call_packet_loss_percent",
+		Help:    "Average packet loss of ended calls in percent",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2, 3, 5, 10, 20, 50},
+	})
+
+	// Per-session gauges, kept for the worst calls only
+	sessionMOS = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "karl_session_mos",
+		Help: "Estimated MOS of an active call, for the calls with the lowest MOS",
+	}, sessionMetricLabels)
+
+	sessionJitter = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "karl_session_jitter_ms",
+		Help: "Average jitter in ms of an active call, for the calls with the lowest MOS",
+	}, sessionMetricLabels)
+
+	sessionPacketLoss = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "karl_session_packet_loss_percent",
+		Help: "Packet loss in percent of an active call, for the calls with the lowest MOS",
+	}, sessionMetricLabels)
+
+	// Packets by payload type and codec
+	rtpPacketsByCodec = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "karl_rtp_packets_by_codec_total",
+			Help: "RTP packets received by payload type and codec",
+		},
+		[]string{"payload_type", "codec"},
+	)
+
+	transcodeDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "karl_transcode_duration_seconds",
+			Help:    "Time taken to transcode one RTP payload, by source and target codec",
+			Buckets: prometheus.ExponentialBuckets(0.000005, 2, 12), // 5µs to ~10ms
+		},
+		[]string{"from", "to"},
+	)
+
+	// Media port pool of the NG listener
+	portPoolInUse = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "karl_port_pool_in_use",
+		Help: "Media ports allocated to calls",
+	}, func() float64 {
+		if pa := mediaPorts(); pa != nil {
+			return float64(pa.GetInUseCount())
+		}
+		return 0
+	})
+
+	portPoolAvailable = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "karl_port_pool_available",
+		Help: "Media ports left to allocate",
+	}, func() float64 {
+		if pa := mediaPorts(); pa != nil {
+			return float64(pa.GetAvailableCount())
+		}
+		return 0
+	})
+
+	portPoolUtilization = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "karl_port_pool_utilization",
+		Help: "Fraction of the media port pool in use, 0 to 1",
+	}, func() float64 {
+		if pa := mediaPorts(); pa != nil {
+			return pa.GetUtilization()
+		}
+		return 0
+	})
+
+	portPoolCooldown = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "karl_port_pool_cooldown",
+		Help: "Released media ports waiting out the reuse delay",
+	}, func() float64 {
+		if pa := mediaPorts(); pa != nil {
+			return float64(pa.GetCooldownCount())
+		}
+		return 0
+	})
+
+	portPoolExhausted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "karl_port_pool_exhausted_total",
+		Help: "Media port allocations refused because no port was free",
+	})
+
 	// RTCP metrics (additional)
 	rtcpPacketsSent = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "karl_rtcp_packets_sent_total",
@@ -178,6 +282,22 @@ func InitMetrics() {
 	prometheus.MustRegister(sessionsActive)
 	prometheus.MustRegister(sessionsTotal)
 	prometheus.MustRegister(sessionDuration)
+	prometheus.MustRegister(sessionsTimedOut)
+	prometheus.MustRegister(callMOS)
+	prometheus.MustRegister(callJitter)
+	prometheus.MustRegister(callPacketLoss)
+	prometheus.MustRegister(sessionMOS)
+	prometheus.MustRegister(sessionJitter)
+	prometheus.MustRegister(sessionPacketLoss)
+
+	// Register codec and port pool metrics
+	prometheus.MustRegister(rtpPacketsByCodec)
+	prometheus.MustRegister(transcodeDuration)
+	prometheus.MustRegister(portPoolInUse)
+	prometheus.MustRegister(portPoolAvailable)
+	prometheus.MustRegister(portPoolUtilization)
+	prometheus.MustRegister(portPoolCooldown)
+	prometheus.MustRegister(portPoolExhausted)
 
 	// Register RTCP metrics
 	prometheus.MustRegister(rtcpPacketsSent)
@@ -201,8 +321,9 @@ func InitMetrics() {
 	log.Println("Metrics system initialized")
 }
 
-// StartMetricsServer starts the metrics HTTP server with proper timeouts and error handling
-func StartMetricsServer(address string, mux *http.ServeMux) error {
+// StartMetricsServer starts the metrics HTTP server with proper timeouts and error handling.
+// The server uses TLS when tlsConfig is not nil
+func StartMetricsServer(address string, mux *http.ServeMux, tlsConfig *tls.Config) error {
 	if address == "" {
 		address = ":9091" // Default metrics port
 	}
@@ -226,12 +347,19 @@ func StartMetricsServer(address string, mux *http.ServeMux) error {
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
 		IdleTimeout:  120 * time.Second,
+		TLSConfig:    tlsConfig,
 	}
 
 	// Start server in a goroutine
 	go func() {
 		log.Printf("🔍 Starting metrics server on %s", address)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if tlsConfig != nil {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Printf("❌ Metrics server error: %v", err)
 		}
 	}()
@@ -334,6 +462,20 @@ func RecordSessionDuration(duration time.Duration) {
 	sessionDuration.Observe(duration.Seconds())
 }
 
+func IncrementSessionsTimedOut() {
+	sessionsTimedOut.Inc()
+}
+
+func RecordCallMOS(mos float64) {
+	callMOS.Observe(mos)
+}
+
+// RecordCallQuality records the jitter and loss of an ended call
+func RecordCallQuality(jitterMs, lossPercent float64) {
+	callJitter.Observe(jitterMs)
+	callPacketLoss.Observe(lossPercent)
+}
+
 // RTCP metrics helpers
 func IncrementRTCPSent() {
 	rtcpPacketsSent.Inc()
@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// MusicOnHoldFlag marks a call streaming music on hold to a held party
+const MusicOnHoldFlag = "music_on_hold"
+
+var (
+	musicOnHoldConfig atomic.Pointer[MusicOnHoldConfig]
+
+	// Failures to start music on hold are reported at most once a minute
+	musicOnHoldErrors = NewLogSampler(Logger(ComponentNG), slog.LevelWarn, 1, time.Minute)
+)
+
+// ConfigureMusicOnHold sets what is played to held parties; nil disables it
+func ConfigureMusicOnHold(config *MusicOnHoldConfig) {
+	if config == nil {
+		config = &MusicOnHoldConfig{}
+	}
+	musicOnHoldConfig.Store(config)
+}
+
+// ValidateMusicOnHoldConfig checks that an enabled music on hold has a
+// file that can be played
+func ValidateMusicOnHoldConfig(cfg *Config) error {
+	c := cfg.MusicOnHold
+	if !c.Enabled {
+		return nil
+	}
+	if c.File == "" {
+		return errors.New("music_on_hold.file is required when music on hold is enabled")
+	}
+	audio, err := loadPlaybackAudio(c.File)
+	if err != nil {
+		return fmt.Errorf("invalid music_on_hold.file: %w", err)
+	}
+	if audio.frames != nil {
+		return errors.New("invalid music_on_hold.file: Ogg Opus cannot be played to every leg, use WAV")
+	}
+	return nil
+}
+
+// musicOnHoldKey names the music on hold played to one leg of a call
+func musicOnHoldKey(callID string, caller bool) string {
+	return playbackKey(callID, caller) + "/moh"
+}
+
+// updateMusicOnHold plays music on hold to each party whose peer has put
+// the call on hold, and stops it once the hold ends. The holding party's
+// own audio is replaced while it plays. It returns whether any is playing
+func updateMusicOnHold(session *MediaSession) bool {
+	config := musicOnHoldConfig.Load()
+	enabled := config != nil && config.Enabled && config.File != ""
+
+	type heldLeg struct {
+		caller  bool
+		holding bool // the other leg holds the call
+		remote  *net.UDPAddr
+		codecs  []CodecInfo
+	}
+	session.RLock()
+	callID := session.CallID
+	var legs []heldLeg
+	for _, caller := range []bool{true, false} {
+		leg, peer := session.CallerLeg, session.CalleeLeg
+		if !caller {
+			leg, peer = peer, leg
+		}
+		h := heldLeg{caller: caller}
+		h.holding = peer != nil && peer.Direction != "" && IsSDPHold(peer.Direction, peer.IP.String())
+		if leg != nil && leg.IP != nil && !leg.IP.IsUnspecified() && leg.Port > 0 {
+			h.remote = &net.UDPAddr{IP: leg.IP, Port: leg.Port}
+			h.codecs = leg.Codecs
+		}
+		legs = append(legs, h)
+	}
+	session.RUnlock()
+
+	player := GetMediaPlayer()
+	playing := false
+	for _, h := range legs {
+		key := musicOnHoldKey(callID, h.caller)
+		if !enabled || !h.holding || h.remote == nil {
+			_ = player.StopPlayback(key)
+			continue
+		}
+		if player.IsPlaying(key) {
+			playing = true
+			continue
+		}
+
+		target := "callee"
+		if h.caller {
+			target = "caller"
+		}
+		err := player.StartPlayback(key, &PlaybackConfig{
+			FilePath:  config.File,
+			Loop:      true,
+			TargetLeg: target,
+			CallID:    callID,
+			Target:    playbackLegCodec(callID, h.caller, h.codecs),
+			Remote:    h.remote,
+		})
+		if err != nil {
+			if musicOnHoldErrors.Allow() {
+				musicOnHoldErrors.Log("Failed to start music on hold", "call_id", callID, "leg", target, "error", err)
+			}
+			continue
+		}
+		Logger(ComponentNG).Info("Playing music on hold", "call_id", callID, "leg", target)
+		playing = true
+	}
+	return playing
+}
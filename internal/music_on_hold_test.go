@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	ng "karl/internal/ng_protocol"
+)
+
+func TestNGSocketListener_MusicOnHold(t *testing.T) {
+	manager, registry, _ := newTestSessionManager(t)
+	listener := &NGSocketListener{sessionRegistry: registry, sessionManager: manager, config: &Config{}}
+
+	file := filepath.Join(t.TempDir(), "moh.raw")
+	os.WriteFile(file, make([]byte, 8000), 0644)
+	ConfigureMusicOnHold(&MusicOnHoldConfig{Enabled: true, File: file})
+	defer ConfigureMusicOnHold(nil)
+
+	sent := make(chan *net.UDPAddr, 1000)
+	GetMediaPlayer().SetSender(func(_ []byte, addr *net.UDPAddr) error {
+		sent <- addr
+		return nil
+	})
+	defer GetMediaPlayer().SetSender(nil)
+
+	offer := func(sdp string) {
+		t.Helper()
+		if resp, err := listener.handleOffer(&ng.NGRequest{CallID: "moh-call", FromTag: "from-tag", SDP: sdp}); err != nil || resp.Result != ng.ResultOK {
+			t.Fatalf("handleOffer failed: %v %+v", err, resp)
+		}
+	}
+	offer(sipOfferSDP)
+	defer GetCodecNegotiator().RemoveCall("moh-call")
+	answer := strings.ReplaceAll(sipOfferSDP, "192.0.2.10", "198.51.100.20")
+	if resp, err := listener.handleAnswer(&ng.NGRequest{CallID: "moh-call", FromTag: "from-tag", ToTag: "to-tag", SDP: answer}); err != nil || resp.Result != ng.ResultOK {
+		t.Fatalf("handleAnswer failed: %v %+v", err, resp)
+	}
+	session := registry.GetSessionByCallID("moh-call")[0]
+	if session.GetFlag(MusicOnHoldFlag) {
+		t.Fatal("music on hold before any hold")
+	}
+
+	// The caller holds: the callee hears music
+	offer(strings.Replace(sipOfferSDP, "a=sendrecv", "a=sendonly", 1))
+	select {
+	case addr := <-sent:
+		if addr.String() != "198.51.100.20:49170" {
+			t.Errorf("music on hold sent to %v, want the callee", addr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no music on hold played")
+	}
+	if !session.GetFlag(MusicOnHoldFlag) || !GetMediaPlayer().IsPlaying(musicOnHoldKey("moh-call", false)) {
+		t.Error("call not marked as playing music on hold")
+	}
+	// stop media leaves it alone
+	listener.handleStopMedia(&ng.NGRequest{CallID: "moh-call"})
+	if !GetMediaPlayer().IsPlaying(musicOnHoldKey("moh-call", false)) {
+		t.Error("stop media stopped music on hold")
+	}
+
+	// Resuming stops it
+	offer(sipOfferSDP)
+	if session.GetFlag(MusicOnHoldFlag) || GetMediaPlayer().IsPlaying(musicOnHoldKey("moh-call", false)) {
+		t.Error("music on hold still playing after resume")
+	}
+}
+
+func TestValidateMusicOnHoldConfig(t *testing.T) {
+	wav := filepath.Join(t.TempDir(), "moh.wav")
+	os.WriteFile(wav, wavFile(8000, 1, make([]int16, 800)), 0644)
+	for _, tt := range []struct {
+		config MusicOnHoldConfig
+		valid  bool
+	}{
+		{MusicOnHoldConfig{}, true},
+		{MusicOnHoldConfig{Enabled: true, File: wav}, true},
+		{MusicOnHoldConfig{Enabled: true}, false},
+		{MusicOnHoldConfig{Enabled: true, File: wav + ".missing"}, false},
+	} {
+		if err := ValidateMusicOnHoldConfig(&Config{MusicOnHold: &tt.config}); (err == nil) != tt.valid {
+			t.Errorf("%+v: error %v", tt.config, err)
+		}
+	}
+}
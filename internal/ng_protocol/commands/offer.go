@@ -4,10 +4,13 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"strconv"
 	"strings"
 
 	"karl/internal"
 	ng "karl/internal/ng_protocol"
+
+	"github.com/pion/sdp/v3"
 )
 
 // OfferHandler handles the offer command
@@ -469,7 +472,7 @@ func (h *OfferHandler) buildStreamInfo(leg *internal.CallLeg, localIP string, rt
 	// Add DTLS info if applicable
 	if leg.SRTPParams != nil && leg.SRTPParams.DTLS {
 		streams[0].Setup = "actpass"
-		streams[0].Fingerprint = "sha-256 XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX"
+		streams[0].Fingerprint = localFingerprint()
 		streams[0].FingerprintHash = "sha-256"
 	}
 
@@ -478,11 +481,6 @@ func (h *OfferHandler) buildStreamInfo(leg *internal.CallLeg, localIP string, rt
 
 // buildModifiedSDP creates the modified SDP for the offer response
 func (h *OfferHandler) buildModifiedSDP(parsed *ParsedSDP, localIP string, localPort int, flags *ng.ParsedFlags) string {
-	var sb strings.Builder
-
-	// Version
-	sb.WriteString("v=0\r\n")
-
 	// Origin line - handle replace-origin flag
 	sessionID := parsed.SessionID
 	sessionVersion := parsed.SessionVersion + 1
@@ -493,25 +491,19 @@ func (h *OfferHandler) buildModifiedSDP(parsed *ParsedSDP, localIP string, local
 	if originUsername == "" {
 		originUsername = "karl"
 	}
-	addressFamily := "IP4"
-	if flags.AddressFamily == "inet6" {
-		addressFamily = "IP6"
-	}
-	sb.WriteString(fmt.Sprintf("o=%s %d %d IN %s %s\r\n",
-		originUsername, sessionID, sessionVersion, addressFamily, localIP))
 
 	// Session name - handle replace-session-name flag
 	sessionName := parsed.SessionName
 	if flags.ReplaceSessionName || sessionName == "" {
 		sessionName = "Karl Media Server"
 	}
-	sb.WriteString(fmt.Sprintf("s=%s\r\n", sessionName))
 
-	// Connection - handle replace-session-connection flag
-	sb.WriteString(fmt.Sprintf("c=IN %s %s\r\n", addressFamily, localIP))
-
-	// Timing
-	sb.WriteString("t=0 0\r\n")
+	// Origin and connection carry Karl's address
+	desc := internal.NewSDPSession(originUsername, uint64(sessionID), uint64(sessionVersion), localIP, sessionName)
+	if flags.AddressFamily == "inet6" {
+		desc.Origin.AddressType = "IP6"
+		desc.ConnectionInformation.AddressType = "IP6"
+	}
 
 	// Determine transport protocol
 	protocol := h.determineProtocol(parsed, flags)
@@ -519,63 +511,43 @@ func (h *OfferHandler) buildModifiedSDP(parsed *ParsedSDP, localIP string, local
 	// Filter codecs based on flags
 	filteredCodecs := h.filterCodecsForSDP(parsed.Codecs, flags)
 
-	// Build payload type list
-	payloadTypes := make([]string, len(filteredCodecs))
-	for i, c := range filteredCodecs {
-		payloadTypes[i] = fmt.Sprintf("%d", c.PayloadType)
-	}
-
 	// Handle port 0 for inactive streams
 	mediaPort := localPort
 	if flags.Inactive {
 		mediaPort = 0
 	}
 
-	sb.WriteString(fmt.Sprintf("m=audio %d %s %s\r\n",
-		mediaPort, protocol, strings.Join(payloadTypes, " ")))
-
-	// Add rtpmap and fmtp for each codec
-	for _, c := range filteredCodecs {
-		if c.Channels > 1 {
-			sb.WriteString(fmt.Sprintf("a=rtpmap:%d %s/%d/%d\r\n",
-				c.PayloadType, c.Name, c.ClockRate, c.Channels))
-		} else {
-			sb.WriteString(fmt.Sprintf("a=rtpmap:%d %s/%d\r\n",
-				c.PayloadType, c.Name, c.ClockRate))
-		}
-		if c.Fmtp != "" {
-			sb.WriteString(fmt.Sprintf("a=fmtp:%d %s\r\n", c.PayloadType, c.Fmtp))
-		}
-	}
+	// Media line with rtpmap and fmtp for each codec
+	media := internal.NewSDPMedia("audio", mediaPort, protocol, sdpCodecs(filteredCodecs))
+	desc.MediaDescriptions = append(desc.MediaDescriptions, media)
 
 	// Ptime handling
 	if flags.Ptime > 0 {
-		sb.WriteString(fmt.Sprintf("a=ptime:%d\r\n", flags.Ptime))
+		media.WithValueAttribute("ptime", strconv.Itoa(flags.Ptime))
 	} else if parsed.Ptime > 0 {
-		sb.WriteString(fmt.Sprintf("a=ptime:%d\r\n", parsed.Ptime))
+		media.WithValueAttribute("ptime", strconv.Itoa(parsed.Ptime))
 	}
 
 	// Direction attribute
-	direction := h.buildDirection(flags, parsed)
-	sb.WriteString(fmt.Sprintf("a=%s\r\n", direction))
+	media.WithPropertyAttribute(h.buildDirection(flags, parsed))
 
 	// RTCP attribute - handle rtcp-mux variants
-	h.writeRTCPAttributes(&sb, localPort, flags, parsed)
+	h.writeRTCPAttributes(media, localPort, flags, parsed)
 
 	// ICE attributes if not removed
 	if !flags.ICERemove && (flags.ICEForce || parsed.HasICE) {
-		h.writeICEAttributes(&sb, localIP, localPort, flags, parsed)
+		h.writeICEAttributes(media, localIP, localPort, flags, parsed)
 	}
 
 	// DTLS/SRTP attributes
-	h.writeSecurityAttributes(&sb, parsed, flags)
+	h.writeSecurityAttributes(media, parsed, flags)
 
 	// MID attribute if requested
 	if flags.GenerateMID && parsed.MID != "" {
-		sb.WriteString(fmt.Sprintf("a=mid:%s\r\n", parsed.MID))
+		media.WithValueAttribute("mid", parsed.MID)
 	}
 
-	return sb.String()
+	return internal.MarshalSDP(desc)
 }
 
 // determineProtocol determines the SDP transport protocol
@@ -653,7 +625,7 @@ func (h *OfferHandler) buildDirection(flags *ng.ParsedFlags, parsed *ParsedSDP)
 }
 
 // writeRTCPAttributes writes RTCP-related SDP attributes
-func (h *OfferHandler) writeRTCPAttributes(sb *strings.Builder, localPort int, flags *ng.ParsedFlags, parsed *ParsedSDP) {
+func (h *OfferHandler) writeRTCPAttributes(media *sdp.MediaDescription, localPort int, flags *ng.ParsedFlags, parsed *ParsedSDP) {
 	// RTCP-mux handling
 	shouldMux := flags.RTCPMUX || flags.RTCPMUXRequire || flags.RTCPMUXOffer
 	shouldMux = shouldMux || (flags.RTCPMUXAccept && parsed.RTCPMux)
@@ -664,38 +636,37 @@ func (h *OfferHandler) writeRTCPAttributes(sb *strings.Builder, localPort int, f
 	}
 
 	if shouldMux {
-		sb.WriteString("a=rtcp-mux\r\n")
+		media.WithPropertyAttribute("rtcp-mux")
 	} else if !flags.NoRTCPAttribute {
 		// Include explicit RTCP port attribute
-		sb.WriteString(fmt.Sprintf("a=rtcp:%d\r\n", localPort+1))
+		media.WithValueAttribute("rtcp", strconv.Itoa(localPort+1))
 	}
 
 	// Full RTCP attribute if requested
 	if flags.FullRTCPAttribute {
-		sb.WriteString(fmt.Sprintf("a=rtcp:%d IN IP4 0.0.0.0\r\n", localPort+1))
+		media.WithValueAttribute("rtcp", strconv.Itoa(localPort+1)+" IN IP4 0.0.0.0")
 	}
 }
 
 // writeICEAttributes writes ICE-related SDP attributes
-func (h *OfferHandler) writeICEAttributes(sb *strings.Builder, localIP string, localPort int, flags *ng.ParsedFlags, parsed *ParsedSDP) {
+func (h *OfferHandler) writeICEAttributes(media *sdp.MediaDescription, localIP string, localPort int, flags *ng.ParsedFlags, parsed *ParsedSDP) {
 	iceUfrag, icePwd := generateICECredentials()
-	sb.WriteString(fmt.Sprintf("a=ice-ufrag:%s\r\n", iceUfrag))
-	sb.WriteString(fmt.Sprintf("a=ice-pwd:%s\r\n", icePwd))
+	media.WithValueAttribute("ice-ufrag", iceUfrag)
+	media.WithValueAttribute("ice-pwd", icePwd)
 
 	if flags.ICELite {
-		sb.WriteString("a=ice-lite\r\n")
+		media.WithPropertyAttribute("ice-lite")
 	}
 
 	// Add host candidate
-	sb.WriteString(fmt.Sprintf("a=candidate:1 1 UDP 2130706431 %s %d typ host\r\n",
-		localIP, localPort))
+	media.WithValueAttribute("candidate", fmt.Sprintf("1 1 UDP 2130706431 %s %d typ host", localIP, localPort))
 }
 
 // writeSecurityAttributes writes DTLS/SRTP SDP attributes
-func (h *OfferHandler) writeSecurityAttributes(sb *strings.Builder, parsed *ParsedSDP, flags *ng.ParsedFlags) {
+func (h *OfferHandler) writeSecurityAttributes(media *sdp.MediaDescription, parsed *ParsedSDP, flags *ng.ParsedFlags) {
 	// DTLS
 	if !flags.DTLSOff && parsed.HasDTLS {
-		sb.WriteString("a=fingerprint:sha-256 XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX:XX\r\n")
+		media.WithValueAttribute("fingerprint", localFingerprint())
 
 		setup := "actpass"
 		if flags.DTLSPassive {
@@ -703,7 +674,7 @@ func (h *OfferHandler) writeSecurityAttributes(sb *strings.Builder, parsed *Pars
 		} else if flags.DTLSActive {
 			setup = "active"
 		}
-		sb.WriteString(fmt.Sprintf("a=setup:%s\r\n", setup))
+		media.WithValueAttribute("setup", setup)
 		return
 	}
 
@@ -713,8 +684,7 @@ func (h *OfferHandler) writeSecurityAttributes(sb *strings.Builder, parsed *Pars
 		if cryptoSuite == "" {
 			cryptoSuite = "AES_CM_128_HMAC_SHA1_80"
 		}
-		sb.WriteString(fmt.Sprintf("a=crypto:1 %s inline:XXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXX\r\n",
-			cryptoSuite))
+		media.WithValueAttribute("crypto", "1 "+cryptoSuite+" inline:XXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXX")
 	}
 }
 
@@ -725,3 +695,13 @@ func generateICECredentials() (ufrag, pwd string) {
 	pwd = "karlpass" + fmt.Sprintf("%016x", uint64(9876543210123456789))
 	return
 }
+
+// localFingerprint returns the a=fingerprint value of Karl's DTLS certificate
+func localFingerprint() string {
+	certs, err := internal.DefaultDTLSCertificates()
+	if err != nil {
+		log.Printf("No DTLS certificate for SDP fingerprint: %v", err)
+		return ""
+	}
+	return certs.SDPFingerprint()
+}
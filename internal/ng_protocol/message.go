@@ -160,6 +160,9 @@ func (m *NGMessage) ToRequest() (*NGRequest, error) {
 	req.FromLabel = DictGetString(m.Data, "from-label")
 	req.ToLabel = DictGetString(m.Data, "to-label")
 
+	// Parse the tenant
+	req.Tenant = DictGetString(m.Data, "tenant")
+
 	// Parse DTMF options
 	req.DTMFDigit = DictGetString(m.Data, "digit")
 	if duration := DictGetInt(m.Data, "duration"); duration > 0 {
@@ -0,0 +1,162 @@
+package ng_protocol
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Signature errors
+var (
+	ErrUnsigned         = errors.New("message is not signed")
+	ErrInvalidSignature = errors.New("invalid message signature")
+	ErrStaleSignature   = errors.New("message time outside the allowed skew")
+)
+
+// ErrReasonSignature is the error-reason answered to unsigned, badly signed
+// or stale messages
+const ErrReasonSignature = "Invalid signature"
+
+// MaxSignatureSkew is how far the time in a signed message may be from
+// Karl's clock. Signed cookies are remembered for as long, so a message
+// replayed within the window is not executed again
+const MaxSignatureSkew = 30 * time.Second
+
+// A signed message carries the time it was signed, in Unix seconds, and
+// its HMAC in the cookie:
+//
+//	<id>.<time>.<hex HMAC-SHA256 of "<id>.<time> <bencode-dict>"> <bencode-dict>
+//
+// so the dictionary is signed byte for byte as sent and the whole cookie is
+// still echoed in the response.
+
+// SignMessage builds a signed NG message from a cookie id and an encoded
+// dictionary, signed now
+func SignMessage(id string, dict []byte, key []byte) []byte {
+	return signMessageAt(id, dict, key, time.Now())
+}
+
+func signMessageAt(id string, dict []byte, key []byte, at time.Time) []byte {
+	signed := id + "." + strconv.FormatInt(at.Unix(), 10)
+	msg := make([]byte, 0, len(signed)+1+2*sha256.Size+1+len(dict))
+	msg = append(msg, signed...)
+	msg = append(msg, '.')
+	msg = append(msg, hex.EncodeToString(messageMAC(signed, dict, key))...)
+	msg = append(msg, ' ')
+	return append(msg, dict...)
+}
+
+// VerifySignature checks the HMAC in the cookie of a raw NG message and
+// that it was signed within MaxSignatureSkew of now. It returns the signed
+// part of the cookie, which identifies the message for ReplayCache
+func VerifySignature(data []byte, key []byte, now time.Time) (string, error) {
+	space := bytes.IndexByte(data, ' ')
+	if space == -1 {
+		return "", ErrNoCookie
+	}
+	cookie, dict := data[:space], data[space+1:]
+
+	dot := bytes.LastIndexByte(cookie, '.')
+	if dot == -1 {
+		return "", ErrUnsigned
+	}
+	sig, err := hex.DecodeString(string(cookie[dot+1:]))
+	if err != nil || len(sig) != sha256.Size {
+		return "", ErrUnsigned
+	}
+	signed := string(cookie[:dot])
+	if !hmac.Equal(sig, messageMAC(signed, dict, key)) {
+		return "", ErrInvalidSignature
+	}
+
+	at, ok := signatureTime(signed)
+	if !ok {
+		return "", ErrUnsigned
+	}
+	if skew := now.Sub(at); skew > MaxSignatureSkew || skew < -MaxSignatureSkew {
+		return "", ErrStaleSignature
+	}
+	return signed, nil
+}
+
+// signatureTime returns the time in the signed part of a cookie
+func signatureTime(signed string) (time.Time, bool) {
+	dot := strings.LastIndexByte(signed, '.')
+	if dot == -1 {
+		return time.Time{}, false
+	}
+	sec, err := strconv.ParseInt(signed[dot+1:], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(sec, 0), true
+}
+
+func messageMAC(signed string, dict []byte, key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signed))
+	mac.Write([]byte{' '})
+	mac.Write(dict)
+	return mac.Sum(nil)
+}
+
+// ReplayCache remembers the signed messages received within the skew
+// window with their responses. A message received again, whether replayed
+// or retransmitted by a proxy that lost the response, gets the first
+// response instead of being executed twice. The zero value is ready to use
+type ReplayCache struct {
+	mu       sync.Mutex
+	messages map[string]*replayEntry // by signed cookie
+	pruned   time.Time
+}
+
+type replayEntry struct {
+	at       time.Time // when the message was signed
+	done     chan struct{}
+	response []byte
+}
+
+// Begin records a verified message by its signed cookie. For a new message
+// it returns a function to call with the response; for a message already
+// received it waits for the first response and returns it
+func (c *ReplayCache) Begin(signed string, now time.Time) (finish func(response []byte), response []byte, replayed bool) {
+	c.mu.Lock()
+	if c.messages == nil {
+		c.messages = make(map[string]*replayEntry)
+	}
+	if entry, ok := c.messages[signed]; ok {
+		c.mu.Unlock()
+		<-entry.done
+		return nil, entry.response, true
+	}
+
+	// Messages signed before the window are refused by VerifySignature,
+	// so they need not be remembered
+	if now.Sub(c.pruned) >= time.Second {
+		c.pruned = now
+		for cookie, entry := range c.messages {
+			select {
+			case <-entry.done:
+				if now.Sub(entry.at) > MaxSignatureSkew {
+					delete(c.messages, cookie)
+				}
+			default:
+			}
+		}
+	}
+	at, _ := signatureTime(signed)
+	entry := &replayEntry{at: at, done: make(chan struct{})}
+	c.messages[signed] = entry
+	c.mu.Unlock()
+
+	return func(response []byte) {
+		entry.response = response
+		close(entry.done)
+	}, nil, false
+}
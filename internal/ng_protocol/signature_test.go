@@ -0,0 +1,87 @@
+package ng_protocol
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestVerifySignature(t *testing.T) {
+	key := []byte("proxy-secret")
+	dict := []byte("d7:command4:pinge")
+	now := time.Now()
+
+	signed := SignMessage("abc123", dict, key)
+	if _, err := VerifySignature(signed, key, now); err != nil {
+		t.Fatalf("expected a valid signature, got %v", err)
+	}
+
+	msg, err := ParseMessage(signed, nil)
+	if err != nil || DictGetString(msg.Data, "command") != "ping" {
+		t.Fatalf("expected a signed message to parse, got %v", err)
+	}
+
+	tampered := append([]byte(nil), signed...)
+	tampered[len(tampered)-3] = 'o'
+	if _, err := VerifySignature(tampered, key, now); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("expected a tampered dictionary to fail, got %v", err)
+	}
+	if _, err := VerifySignature(signed, []byte("other"), now); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("expected another key to fail, got %v", err)
+	}
+	if _, err := VerifySignature([]byte("abc123 d7:command4:pinge"), key, now); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("expected an unsigned message to fail, got %v", err)
+	}
+}
+
+func TestVerifySignature_Skew(t *testing.T) {
+	key := []byte("proxy-secret")
+	dict := []byte("d7:command4:pinge")
+	now := time.Now()
+
+	if _, err := VerifySignature(signMessageAt("abc123", dict, key, now.Add(-MaxSignatureSkew+time.Second)), key, now); err != nil {
+		t.Errorf("expected a message within the skew to pass, got %v", err)
+	}
+	if _, err := VerifySignature(signMessageAt("abc123", dict, key, now.Add(-MaxSignatureSkew-time.Second)), key, now); !errors.Is(err, ErrStaleSignature) {
+		t.Errorf("expected an old message to fail, got %v", err)
+	}
+	if _, err := VerifySignature(signMessageAt("abc123", dict, key, now.Add(MaxSignatureSkew+time.Second)), key, now); !errors.Is(err, ErrStaleSignature) {
+		t.Errorf("expected a message from the future to fail, got %v", err)
+	}
+}
+
+func TestReplayCache(t *testing.T) {
+	var cache ReplayCache
+	now := time.Now()
+	signed, err := VerifySignature(signMessageAt("abc123", []byte("d7:command4:pinge"), []byte("k"), now), []byte("k"), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	finish, _, replayed := cache.Begin(signed, now)
+	if replayed {
+		t.Fatal("expected a new message not to be replayed")
+	}
+	done := make(chan []byte)
+	go func() {
+		_, resp, replayed := cache.Begin(signed, now)
+		if !replayed {
+			resp = nil
+		}
+		done <- resp
+	}()
+
+	// The repeat waits for the first message's response
+	finish([]byte("first"))
+	if resp := <-done; string(resp) != "first" {
+		t.Errorf("expected the first response, got %q", resp)
+	}
+
+	// Messages past the window are forgotten
+	later := now.Add(MaxSignatureSkew + 2*time.Second)
+	other, _, _ := cache.Begin("other.1", later)
+	other(nil)
+	if _, ok := cache.messages[signed]; ok {
+		t.Error("expected an expired message to be forgotten")
+	}
+}
@@ -2,6 +2,7 @@ package ng_protocol
 
 import (
 	"net"
+	"strconv"
 	"time"
 )
 
@@ -23,6 +24,7 @@ const (
 	CmdBlockMedia     = "block media"
 	CmdUnblockMedia   = "unblock media"
 	CmdSilenceMedia   = "silence media"
+	CmdUnsilenceMedia = "unsilence media"
 	CmdStartForward   = "start forwarding"
 	CmdStopForward    = "stop forwarding"
 	CmdPlayMedia      = "play media"
@@ -65,6 +67,23 @@ const (
 	ICEOptional = "optional"
 )
 
+// Transcode modes, set with transcode=MODE
+const (
+	TranscodeIfNeeded = "if-needed" // transcode only codecs the peer leg did not accept
+	TranscodeAlways   = "always"    // decode and re-encode all audio Karl can decode
+	TranscodeNever    = "never"     // relay media as it was sent
+)
+
+// IsTranscodeMode reports whether a transcode value is a mode rather than
+// a codec name
+func IsTranscodeMode(value string) bool {
+	switch value {
+	case TranscodeIfNeeded, TranscodeAlways, TranscodeNever:
+		return true
+	}
+	return false
+}
+
 // Transport protocols
 const (
 	TransportRTPAVP   = "RTP/AVP"
@@ -111,6 +130,10 @@ type NGRequest struct {
 	FromLabel       string
 	ToLabel         string
 
+	// Tenant the call belongs to, selecting its port range, codec policy,
+	// recording settings and rate limit
+	Tenant          string
+
 	// DTMF options
 	DTMFDigit       string
 	DTMFDuration    int
@@ -269,7 +292,8 @@ type ParsedFlags struct {
 	Unidirectional    bool
 	StrictSource      bool
 	MediaHandover     bool
-	Reset             bool // Reset port latching
+	SourceCheck       string // Expected media source of the call: off, sdp, learn or any
+	Reset             bool   // Reset port latching
 
 	// === ICE Handling ===
 	ICERemove      bool
@@ -321,6 +345,7 @@ type ParsedFlags struct {
 	StartRecording bool
 	StopRecording  bool
 	PauseRecording bool
+	Transcribe     bool // Fork the call's audio to the speech-to-text engine
 
 	// === Media Blocking ===
 	BlockMedia    bool
@@ -347,8 +372,11 @@ type ParsedFlags struct {
 	UDPTLS    bool
 
 	// === Loop/Echo ===
-	LoopProtect bool
-	MediaEcho   bool
+	LoopProtect   bool
+	MediaEcho     bool
+	Loopback      bool   // Karl answers the offer and reflects the offerer's media back
+	LoopbackDelay int    // Delay in ms before reflected media is sent back
+	LoopbackCodec string // Codec the reflected media is transcoded to
 
 	// === WebRTC ===
 	WebRTCEnabled bool
@@ -375,6 +403,7 @@ type ParsedFlags struct {
 
 	// === Codec Control ===
 	AlwaysTranscode  bool
+	TranscodeMode    string // TranscodeIfNeeded, TranscodeAlways or TranscodeNever, empty if not given
 	TranscodeCodecs  []string
 	StripCodecs      []string
 	StripAllCodecs   bool
@@ -384,6 +413,27 @@ type ParsedFlags struct {
 	ExceptCodecs     []string
 	Ptime            int // Packet time
 	PtimeReverse     bool
+	OpusFEC          bool // Inband FEC while the receiver reports loss
+	OpusDTX          bool
+	OpusCBR          bool
+	OpusVBR          bool
+	OpusMaxBitrate   int  // Max average Opus bitrate in bit/s
+
+	// === Gain Control ===
+	AGC              bool // Automatic gain control, also set by any agc-* option
+	AGCTarget        int  // Target speech level in -dBov
+	AGCMaxGain       int  // Largest boost in dB
+	AGCAttack        int  // Time in ms to lower the gain
+	AGCRelease       int  // Time in ms to raise the gain
+
+	// === Impairment ===
+	ImpairLoss         float64 // Percent of packets dropped
+	ImpairReorder      float64 // Percent of packets held back behind the next one
+	ImpairDuplicate    float64 // Percent of packets sent twice
+	ImpairDelay        int     // Delay in ms added to every packet
+	ImpairJitter       int     // Random variation of the delay in ms
+	ImpairDistribution string  // Jitter distribution: uniform or normal
+	ImpairOff          bool    // Remove the call's impairment
 
 	// === Address Selection ===
 	AddressFamily    string // inet, inet6
@@ -587,6 +637,8 @@ func ParseFlags(flags []string) *ParsedFlags {
 			pf.StopRecording = true
 		case "pause-recording":
 			pf.PauseRecording = true
+		case "transcribe":
+			pf.Transcribe = true
 		case "SIPREC", "siprec":
 			pf.SIPREC = true
 
@@ -637,6 +689,8 @@ func ParseFlags(flags []string) *ParsedFlags {
 			pf.LoopProtect = true
 		case "media-echo":
 			pf.MediaEcho = true
+		case "loopback":
+			pf.Loopback = true
 
 		// === WebRTC ===
 		case "webrtc":
@@ -653,10 +707,27 @@ func ParseFlags(flags []string) *ParsedFlags {
 		// === Codec ===
 		case "always-transcode":
 			pf.AlwaysTranscode = true
+			pf.TranscodeMode = TranscodeAlways
 		case "codec-strip-all", "strip-all-codecs":
 			pf.StripAllCodecs = true
 		case "ptime-reverse":
 			pf.PtimeReverse = true
+		case "opus-fec":
+			pf.OpusFEC = true
+		case "opus-dtx":
+			pf.OpusDTX = true
+		case "opus-cbr":
+			pf.OpusCBR = true
+		case "opus-vbr":
+			pf.OpusVBR = true
+
+		// === Gain Control ===
+		case "agc":
+			pf.AGC = true
+
+		// === Impairment ===
+		case "impair-off":
+			pf.ImpairOff = true
 
 		// === Labels ===
 		case "all":
@@ -759,6 +830,65 @@ func parseKeyValueFlag(pf *ParsedFlags, key, value string) {
 		if v := parseIntValue(value); v > 0 {
 			pf.Ptime = v
 		}
+	case "opus-max-bitrate":
+		if v := parseIntValue(value); v > 0 {
+			pf.OpusMaxBitrate = v
+		}
+
+	// Gain control
+	case "agc-target", "agc-max-gain", "agc-attack", "agc-release":
+		v := parseIntValue(value)
+		if v <= 0 {
+			break
+		}
+		pf.AGC = true
+		switch key {
+		case "agc-target":
+			pf.AGCTarget = v
+		case "agc-max-gain":
+			pf.AGCMaxGain = v
+		case "agc-attack":
+			pf.AGCAttack = v
+		case "agc-release":
+			pf.AGCRelease = v
+		}
+
+	// Impairment
+	case "impair-loss", "impair-reorder", "impair-duplicate":
+		v := parseFloatValue(value)
+		if v < 0 || v > 100 {
+			break
+		}
+		switch key {
+		case "impair-loss":
+			pf.ImpairLoss = v
+		case "impair-reorder":
+			pf.ImpairReorder = v
+		case "impair-duplicate":
+			pf.ImpairDuplicate = v
+		}
+	case "impair-delay":
+		if v := parseIntValue(value); v >= 0 {
+			pf.ImpairDelay = v
+		}
+	case "impair-jitter":
+		if v := parseIntValue(value); v >= 0 {
+			pf.ImpairJitter = v
+		}
+	case "impair-distribution":
+		pf.ImpairDistribution = value
+
+	// Loopback
+	case "loopback-delay":
+		if v := parseIntValue(value); v >= 0 {
+			pf.Loopback = true
+			pf.LoopbackDelay = v
+		}
+	case "loopback-codec":
+		if value != "" {
+			pf.Loopback = true
+			pf.LoopbackCodec = value
+		}
 
 	// Address selection
 	case "address-family":
@@ -786,6 +916,10 @@ func parseKeyValueFlag(pf *ParsedFlags, key, value string) {
 	case "via-branch":
 		pf.ViaBranch = value
 
+	// Media sources
+	case "source-check":
+		pf.SourceCheck = value
+
 	// Recording
 	case "recording-file":
 		pf.RecordingFile = value
@@ -802,6 +936,11 @@ func parseKeyValueFlag(pf *ParsedFlags, key, value string) {
 	case "codec-mask", "mask-codec":
 		pf.MaskCodecs = append(pf.MaskCodecs, value)
 	case "codec-transcode", "transcode":
+		if key == "transcode" && IsTranscodeMode(value) {
+			pf.TranscodeMode = value
+			pf.AlwaysTranscode = value == TranscodeAlways
+			break
+		}
 		pf.TranscodeCodecs = append(pf.TranscodeCodecs, value)
 	case "codec-set":
 		pf.SetCodecs = append(pf.SetCodecs, value)
@@ -830,6 +969,15 @@ func parseIntValue(s string) int {
 	return v
 }
 
+// parseFloatValue parses a non-negative decimal, returning -1 if invalid
+func parseFloatValue(s string) float64 {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || !(v >= 0) { // also rejects NaN
+		return -1
+	}
+	return v
+}
+
 // CallListEntry represents an entry in the call list
 type CallListEntry struct {
 	CallID     string
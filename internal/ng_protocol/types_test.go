@@ -45,6 +45,13 @@ func TestParseFlags_BasicFlags(t *testing.T) {
 				return pf.StrictSource == true
 			},
 		},
+		{
+			name:  "source-check value",
+			flags: []string{"source-check=learn"},
+			expected: func(pf *ParsedFlags) bool {
+				return pf.SourceCheck == "learn"
+			},
+		},
 		{
 			name:  "port-latching flag",
 			flags: []string{"port-latching"},
@@ -324,6 +331,49 @@ func TestParseFlags_KeyValueFlags(t *testing.T) {
 				return pf.Ptime == 20
 			},
 		},
+		{
+			name:  "opus options",
+			flags: []string{"opus-fec", "opus-dtx", "opus-cbr", "opus-max-bitrate=24000"},
+			expected: func(pf *ParsedFlags) bool {
+				return pf.OpusFEC && pf.OpusDTX && pf.OpusCBR && pf.OpusMaxBitrate == 24000
+			},
+		},
+		{
+			name:  "agc options",
+			flags: []string{"agc-target=20", "agc-max-gain=12", "agc-release=800"},
+			expected: func(pf *ParsedFlags) bool {
+				return pf.AGC && pf.AGCTarget == 20 && pf.AGCMaxGain == 12 && pf.AGCAttack == 0 && pf.AGCRelease == 800
+			},
+		},
+		{
+			name:  "impairment options",
+			flags: []string{"impair-loss=2.5", "impair-reorder=1", "impair-duplicate=150", "impair-delay=80", "impair-jitter=20", "impair-distribution=normal"},
+			expected: func(pf *ParsedFlags) bool {
+				return pf.ImpairLoss == 2.5 && pf.ImpairReorder == 1 && pf.ImpairDuplicate == 0 &&
+					pf.ImpairDelay == 80 && pf.ImpairJitter == 20 && pf.ImpairDistribution == "normal" && !pf.ImpairOff
+			},
+		},
+		{
+			name:  "impairment off",
+			flags: []string{"impair-off", "impair-loss=NaN"},
+			expected: func(pf *ParsedFlags) bool {
+				return pf.ImpairOff && pf.ImpairLoss == 0
+			},
+		},
+		{
+			name:  "loopback options",
+			flags: []string{"loopback-delay=500", "loopback-codec=PCMA"},
+			expected: func(pf *ParsedFlags) bool {
+				return pf.Loopback && pf.LoopbackDelay == 500 && pf.LoopbackCodec == "PCMA"
+			},
+		},
+		{
+			name:  "loopback",
+			flags: []string{"loopback", "loopback-delay=-1"},
+			expected: func(pf *ParsedFlags) bool {
+				return pf.Loopback && pf.LoopbackDelay == 0 && pf.LoopbackCodec == ""
+			},
+		},
 		{
 			name:  "interface value",
 			flags: []string{"interface=external"},
@@ -416,7 +466,15 @@ func TestParseFlags_CodecFlags(t *testing.T) {
 			name:  "always-transcode flag",
 			flags: []string{"always-transcode"},
 			expected: func(pf *ParsedFlags) bool {
-				return pf.AlwaysTranscode == true
+				return pf.AlwaysTranscode == true && pf.TranscodeMode == TranscodeAlways
+			},
+		},
+		{
+			name:  "transcode mode",
+			flags: []string{"transcode=never", "transcode=G722"},
+			expected: func(pf *ParsedFlags) bool {
+				return pf.TranscodeMode == TranscodeNever && !pf.AlwaysTranscode &&
+					len(pf.TranscodeCodecs) == 1 && pf.TranscodeCodecs[0] == "G722"
 			},
 		},
 	}
@@ -610,6 +668,13 @@ func TestParseFlags_RecordingFlags(t *testing.T) {
 				return pf.PauseRecording == true
 			},
 		},
+		{
+			name:  "transcribe flag",
+			flags: []string{"transcribe"},
+			expected: func(pf *ParsedFlags) bool {
+				return pf.Transcribe == true
+			},
+		},
 		{
 			name:  "SIPREC flag",
 			flags: []string{"SIPREC"},
@@ -1,17 +1,22 @@
 package internal
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"os/user"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	ng "karl/internal/ng_protocol"
 
+	"github.com/pion/sdp/v3"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -45,17 +50,53 @@ var (
 			Help: "Number of active NG protocol connections (for TCP mode)",
 		},
 	)
+
+	ngRejected = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "karl_ng_rejected_total",
+			Help: "NG protocol messages rejected by peer credential or signature checks, or answered without execution as replays",
+		},
+		[]string{"reason"},
+	)
 )
 
+// defaultNGSocketMode keeps the control socket open to local users unless
+// socket_mode narrows it
+const defaultNGSocketMode os.FileMode = 0666
+
 // NGCommandHandler is a function that handles an NG protocol command
 type NGCommandHandler func(req *ng.NGRequest) (*ng.NGResponse, error)
 
+// CallRecordingOptions carries the per-call options of a "start recording" command
+type CallRecordingOptions struct {
+	Format   string // wav, pcm, opus
+	Mode     string // mixed, stereo, separate
+	Metadata map[string]string
+}
+
+// CallRecorder records the media of a call on behalf of the NG listener
+type CallRecorder interface {
+	StartCallRecording(sessionID, callID string, opts CallRecordingOptions) (string, error)
+	StopCallRecording(sessionID string) (string, error)
+	PauseCallRecording(sessionID string) error
+}
+
 // NGSocketListener handles NG protocol communication via Unix socket or UDP
 type NGSocketListener struct {
 	config          *Config
 	sessionRegistry *SessionRegistry
 	handlers        map[string]NGCommandHandler
 	portAllocator   *PortAllocator
+	sessionManager  *SessionManager
+	callRecorder    CallRecorder
+	t38Gateway      *T38Gateway
+	interfaces      *InterfaceSelector
+	dispatcher      *CallDispatcher
+	iceManager      *ICEManager
+	transcriber     *TranscriptionManager
+
+	// replays holds the signed messages received within the skew window
+	replays ng.ReplayCache
 
 	// Socket connections
 	unixListener net.Listener
@@ -75,23 +116,22 @@ func NewNGSocketListener(config *Config, sessionRegistry *SessionRegistry) *NGSo
 	ctx, cancel := context.WithCancel(context.Background())
 
 	// Initialize port allocator for media ports
-	portConfig := DefaultPortAllocatorConfig()
-	sessionConfig := config.GetSessionConfig()
-	if sessionConfig.MinPort > 0 {
-		portConfig.MinPort = sessionConfig.MinPort
-	}
-	if sessionConfig.MaxPort > 0 {
-		portConfig.MaxPort = sessionConfig.MaxPort
-	}
+	portAllocator := NewPortAllocator(PortAllocatorConfigFromSessions(config.GetSessionConfig()))
 
 	l := &NGSocketListener{
 		config:          config,
 		sessionRegistry: sessionRegistry,
 		handlers:        make(map[string]NGCommandHandler),
-		portAllocator:   NewPortAllocator(portConfig),
+		portAllocator:   portAllocator,
 		ctx:             ctx,
 		cancel:          cancel,
 		startTime:       time.Now(),
+		t38Gateway:      NewT38Gateway(nil),
+		interfaces:      NewInterfaceSelector(config),
+	}
+	l.sessionManager = NewSessionManager(sessionRegistry, portAllocator, l.localMediaIP())
+	if config.Transport.KernelOffload {
+		l.enableKernelOffload(config.Transport.KernelOffloadMap)
 	}
 
 	// Register built-in command handlers
@@ -139,6 +179,7 @@ func (l *NGSocketListener) registerBuiltinHandlers() {
 	l.handlers[ng.CmdBlockMedia] = l.handleBlockMedia
 	l.handlers[ng.CmdUnblockMedia] = l.handleUnblockMedia
 	l.handlers[ng.CmdSilenceMedia] = l.handleSilenceMedia
+	l.handlers[ng.CmdUnsilenceMedia] = l.handleUnsilenceMedia
 	l.handlers[ng.CmdStartForward] = l.handleStartForwarding
 	l.handlers[ng.CmdStopForward] = l.handleStopForwarding
 	l.handlers[ng.CmdPlayMedia] = l.handlePlayMedia
@@ -184,6 +225,15 @@ func (l *NGSocketListener) Start() error {
 		}
 	}
 
+	refresh := DefaultSTUNRefresh
+	if l.config.Integration.STUNRefresh > 0 {
+		refresh = time.Duration(l.config.Integration.STUNRefresh) * time.Second
+	}
+	l.interfaces.StartSTUNRefresh(l.ctx, refresh)
+	if l.iceManager != nil {
+		l.iceManager.StartGathering(l.ctx, l.interfaces, refresh)
+	}
+
 	l.running = true
 	log.Printf("NG socket listener started on %s", socketPath)
 
@@ -212,9 +262,24 @@ func (l *NGSocketListener) startUnixListener(socketPath string) error {
 	}
 
 	// Set socket permissions
-	if err := os.Chmod(socketPath, 0666); err != nil {
+	mode, err := parseSocketMode(l.config.NGProtocol.SocketMode)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	if err := os.Chmod(socketPath, mode); err != nil {
 		log.Printf("Warning: could not set socket permissions: %v", err)
 	}
+	if owner := l.config.NGProtocol.SocketOwner; owner != "" {
+		uid, gid, err := lookupSocketOwner(owner)
+		if err == nil {
+			err = os.Chown(socketPath, uid, gid)
+		}
+		if err != nil {
+			listener.Close()
+			return fmt.Errorf("failed to set socket owner %s: %w", owner, err)
+		}
+	}
 
 	l.unixListener = listener
 
@@ -236,6 +301,7 @@ func (l *NGSocketListener) startUDPListener(port int) error {
 	if err != nil {
 		return fmt.Errorf("failed to create UDP socket: %w", err)
 	}
+	MarkSignalingConn(conn)
 
 	l.udpConn = conn
 
@@ -282,6 +348,20 @@ func (l *NGSocketListener) handleConnection(conn net.Conn) {
 	defer conn.Close()
 	defer ngConnectionsActive.Dec()
 
+	if allowed := l.config.NGProtocol.AllowedUIDs; len(allowed) > 0 {
+		uid, err := peerUID(conn)
+		if err != nil {
+			ngRejected.WithLabelValues("peer_uid").Inc()
+			log.Printf("Rejected NG socket connection without peer credentials: %v", err)
+			return
+		}
+		if !containsUID(allowed, uid) {
+			ngRejected.WithLabelValues("peer_uid").Inc()
+			log.Printf("Rejected NG socket connection from uid %d", uid)
+			return
+		}
+	}
+
 	// Set read deadline
 	if err := conn.SetReadDeadline(time.Now().Add(30 * time.Second)); err != nil {
 		log.Printf("Error setting read deadline: %v", err)
@@ -365,6 +445,47 @@ func (l *NGSocketListener) processMessage(data []byte, from *net.UDPAddr) []byte
 		return resp
 	}
 
+	// Only holders of the key may issue commands; forwarded messages are
+	// signed behind the dispatch prefix
+	if key := l.hmacKey(); key != nil {
+		now := time.Now()
+		signed, err := ng.VerifySignature(bytes.TrimPrefix(data, []byte(dispatchCookiePrefix)), key, now)
+		if err != nil {
+			ngRejected.WithLabelValues("signature").Inc()
+			log.Printf("Rejected NG message from %v: %v", from, err)
+			resp, _ := ng.ErrorResponse(msg.Cookie, ng.ErrReasonSignature)
+			return resp
+		}
+
+		// A message seen before is answered, not executed again
+		finish, resp, replayed := l.replays.Begin(signed, now)
+		if replayed {
+			ngRejected.WithLabelValues("replay").Inc()
+			return resp
+		}
+		return l.handleOnce(msg, finish)
+	}
+	return l.handleMessage(msg)
+}
+
+// handleOnce runs a message the replay cache has not seen and gives finish
+// its response, which retransmissions of the message wait for. A handler
+// that panics is answered with an internal error, so they never wait
+// forever
+func (l *NGSocketListener) handleOnce(msg *ng.NGMessage, finish func(response []byte)) (resp []byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			Logger(ComponentNG).Error("NG handler panicked", "cookie", msg.Cookie, "panic", r)
+			resp, _ = ng.ErrorResponse(msg.Cookie, ng.ErrReasonInternal)
+		}
+		finish(resp)
+	}()
+	return l.handleMessage(msg)
+}
+
+// handleMessage runs the command of a parsed NG message and returns the
+// response
+func (l *NGSocketListener) handleMessage(msg *ng.NGMessage) []byte {
 	// Convert to request
 	req, err := msg.ToRequest()
 	if err != nil {
@@ -377,8 +498,16 @@ func (l *NGSocketListener) processMessage(data []byte, from *net.UDPAddr) []byte
 	// Find handler
 	l.mu.RLock()
 	handler, ok := l.handlers[req.Command]
+	dispatcher := l.dispatcher
 	l.mu.RUnlock()
 
+	// Calls owned by another node are handled there
+	if ok && dispatcher != nil {
+		if resp, forwarded := dispatcher.Dispatch(msg, req); forwarded {
+			return resp
+		}
+	}
+
 	if !ok {
 		resp, _ := ng.ErrorResponse(req.Cookie, ng.ErrReasonUnsupported)
 		return resp
@@ -396,6 +525,9 @@ func (l *NGSocketListener) processMessage(data []byte, from *net.UDPAddr) []byte
 		resp, _ := ng.ErrorResponse(req.Cookie, err.Error())
 		return resp
 	}
+	if dispatcher != nil {
+		dispatcher.Handled(req, response)
+	}
 
 	// Build response
 	respBytes, err := ng.BuildResponse(req.Cookie, response)
@@ -413,6 +545,78 @@ func (l *NGSocketListener) processMessage(data []byte, from *net.UDPAddr) []byte
 	return respBytes
 }
 
+// hmacKey returns the key NG messages must be signed with, or nil
+func (l *NGSocketListener) hmacKey() []byte {
+	if l.config.NGProtocol == nil || l.config.NGProtocol.HMACKey == "" {
+		return nil
+	}
+	return []byte(l.config.NGProtocol.HMACKey)
+}
+
+// ValidateNGProtocolConfig checks the control socket settings
+func ValidateNGProtocolConfig(cfg *NGProtocolConfig) error {
+	if _, err := parseSocketMode(cfg.SocketMode); err != nil {
+		return err
+	}
+	if cfg.SocketOwner != "" {
+		if _, _, err := lookupSocketOwner(cfg.SocketOwner); err != nil {
+			return fmt.Errorf("invalid NG socket owner %s: %w", cfg.SocketOwner, err)
+		}
+	}
+	for _, uid := range cfg.AllowedUIDs {
+		if uid < 0 {
+			return fmt.Errorf("invalid NG allowed uid: %d", uid)
+		}
+	}
+	return nil
+}
+
+// parseSocketMode parses octal permissions such as "0660"
+func parseSocketMode(s string) (os.FileMode, error) {
+	if s == "" {
+		return defaultNGSocketMode, nil
+	}
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid NG socket mode: %s", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// lookupSocketOwner resolves user[:group], by name or number, to IDs. A
+// missing group leaves the group unchanged
+func lookupSocketOwner(owner string) (uid, gid int, err error) {
+	name, group, _ := strings.Cut(owner, ":")
+	if uid, err = strconv.Atoi(name); err != nil {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return 0, 0, err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+
+	gid = -1
+	if group != "" {
+		if gid, err = strconv.Atoi(group); err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return 0, 0, err
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+	return uid, gid, nil
+}
+
+func containsUID(uids []int, uid uint32) bool {
+	for _, u := range uids {
+		if u == int(uid) {
+			return true
+		}
+	}
+	return false
+}
+
 // Stop stops the NG socket listener
 func (l *NGSocketListener) Stop() error {
 	l.mu.Lock()
@@ -449,10 +653,32 @@ func (l *NGSocketListener) Stop() error {
 		log.Println("NG socket listener stop timed out")
 	}
 
+	if err := l.sessionManager.StopKernelOffload(); err != nil {
+		log.Printf("Failed to stop kernel offload: %v", err)
+	}
+	// Closes the media ports bound for call legs
+	l.portAllocator.Close()
+	l.sessionManager.closeTenantPools()
+
 	l.running = false
 	return nil
 }
 
+// enableKernelOffload relays eligible sessions through the XDP program
+// whose forwarding map is pinned at mapPath
+func (l *NGSocketListener) enableKernelOffload(mapPath string) {
+	if mapPath == "" {
+		mapPath = DefaultKernelOffloadMap
+	}
+	forwarder, err := OpenKernelForwarder(mapPath)
+	if err != nil {
+		log.Printf("⚠️ Kernel offload disabled: %v", err)
+		return
+	}
+	l.sessionManager.SetKernelOffload(NewKernelOffload(forwarder))
+	log.Printf("Kernel offload enabled with forwarding map %s", mapPath)
+}
+
 // IsRunning returns whether the listener is running
 func (l *NGSocketListener) IsRunning() bool {
 	l.mu.RLock()
@@ -460,6 +686,11 @@ func (l *NGSocketListener) IsRunning() bool {
 	return l.running
 }
 
+// GetPortAllocator returns the allocator of media ports
+func (l *NGSocketListener) GetPortAllocator() *PortAllocator {
+	return l.portAllocator
+}
+
 // GetSessionRegistry returns the session registry
 func (l *NGSocketListener) GetSessionRegistry() *SessionRegistry {
 	return l.sessionRegistry
@@ -501,13 +732,35 @@ func (l *NGSocketListener) handleOffer(req *ng.NGRequest) (*ng.NGResponse, error
 		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: ng.ErrReasonMissingParam + ": sdp"}, nil
 	}
 
-	// Create or get session
+	// Create or get session; a new call belongs to the tenant its offer
+	// names, and is admitted within the caps and the tenant's offer rate
 	session := l.sessionRegistry.GetSessionByTags(req.CallID, req.FromTag, req.ToTag)
-	if session == nil {
-		session = l.sessionRegistry.CreateSession(req.CallID, req.FromTag)
+	if session != nil {
+		return l.offerSession(req, session, SessionTenant(session))
+	}
+	tenant, err := LookupTenant(req.Tenant)
+	if err != nil {
+		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: err.Error()}, nil
 	}
+	if session, err = l.sessionManager.AdmitSession(req.CallID, req.FromTag, tenant); err != nil {
+		return admissionResponse(err), nil
+	}
+
+	// A new call whose offer fails gives its place under the caps back
+	resp, err := l.offerSession(req, session, tenant)
+	if err != nil || resp == nil || resp.Result != ng.ResultOK {
+		l.sessionManager.terminateSession(session)
+	}
+	return resp, err
+}
 
-	_ = l.sessionRegistry.UpdateSessionState(session.ID, string(SessionStatePending))
+// offerSession handles an offer for a session of a call, new or in
+// progress, that belongs to tenant, which may be nil
+func (l *NGSocketListener) offerSession(req *ng.NGRequest, session *MediaSession, tenant *Tenant) (*ng.NGResponse, error) {
+	// The tenant's codec policy comes before the offer's own codec flags
+	if tenant != nil {
+		req.Flags = tenant.Flags(req.Flags)
+	}
 
 	// Parse incoming SDP
 	parsedSDP, err := l.parseSDP(req.SDP)
@@ -515,36 +768,93 @@ func (l *NGSocketListener) handleOffer(req *ng.NGRequest) (*ng.NGResponse, error
 		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: "failed to parse SDP: " + err.Error()}, nil
 	}
 
-	// Allocate media ports for this session
-	rtpPort, err := l.portAllocator.AllocatePort(session.ID)
+	// With the T.38 gateway flag, a T.38 re-INVITE continues as G.711
+	if ng.ParseFlags(req.Flags).T38Gateway && parsedSDP.t38Section() >= 0 {
+		return l.handleT38FallbackOffer(req, session, parsedSDP)
+	}
+
+	// Karl answers a loopback offer itself and reflects the offerer's media
+	if pf := ng.ParseFlags(req.Flags); pf.Loopback {
+		return l.handleLoopbackOffer(req, session, parsedSDP, pf)
+	}
+
+	// A re-offer from the answerer renegotiates from the callee leg
+	caller := !fromAnswerer(session, req.FromTag)
+
+	// Record the offered codecs so the worker pool can resolve payload types
+	GetCodecNegotiator().OfferMedia(req.CallID, caller, parsedSDP.codecInfos(), receivePtime(parsedSDP, requestFlags(req)))
+	pf := ng.ParseFlags(requestFlags(req))
+	if codecs := parsedSDP.codecInfos(); len(codecs) > 0 && len(strippedPayloads(codecs, pf)) == len(codecs) &&
+		len(TranscodeOfferCodecs(codecs, pf.TranscodeCodecs)) == 0 {
+		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: "no codec left in the offer after codec-strip"}, nil
+	}
+	if fmtp := opusFlagsFmtp(pf); fmtp != "" {
+		GetCodecNegotiator().SetOpusFmtp(req.CallID, fmtp)
+	}
+	if agc, ok := agcConfigFromFlags(pf); ok {
+		GetCodecNegotiator().SetAGC(req.CallID, agc)
+	}
+	applyTranscodeMode(session, pf)
+	if err := applySourceCheck(session, pf); err != nil {
+		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: err.Error()}, nil
+	}
+	applyImpairmentFlags(req.CallID, pf)
+	l.applyTranscription(req.CallID, pf)
+	if parsedSDP.SSRC != 0 {
+		GetCodecNegotiator().BindSSRC(parsedSDP.SSRC, req.CallID, caller)
+	}
+
+	// Allocate an RTP/RTCP port pair for the offering leg, on the interface
+	// the offer is sent out of
+	toIface := pf.ToInterface
+	if toIface == "" {
+		toIface = pf.Interface
+	}
+	ifaceName, bindIP, err := l.legInterface(toIface, req.Direction, l.peerIP(session, !caller))
+	if err != nil {
+		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: err.Error()}, nil
+	}
+	leg, err := l.sessionManager.AllocateLegOn(session, req.FromTag, caller, ifaceName, bindIP)
 	if err != nil {
 		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: "failed to allocate port: " + err.Error()}, nil
 	}
-	rtcpPort := rtpPort + 1
-
-	// Get local IP
-	localIP := l.config.Integration.PublicIP
-	if localIP == "" {
-		localIP = l.config.Integration.MediaIP
+	previousSSRC := legSSRC(session, leg)
+	l.applyRemoteMedia(session, leg, parsedSDP, req.Flags)
+	if err := l.sessionManager.AllocateStreams(session, leg); err != nil {
+		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: "failed to allocate port: " + err.Error()}, nil
 	}
-	if localIP == "" {
-		localIP = "127.0.0.1"
+	if err := l.sessionManager.OpenMedia(session, leg); err != nil {
+		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: err.Error()}, nil
+	}
+	var crypto *MediaCrypto
+	if caller {
+		crypto, err = l.offerCrypto(session, leg, parsedSDP, requestFlags(req))
+	} else {
+		crypto, err = l.reofferCrypto(session, parsedSDP, false)
+	}
+	if err != nil {
+		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: "failed to bridge transports: " + err.Error()}, nil
+	}
+	l.trackZRTP(session, parsedSDP, crypto)
+	l.applyMediaTimeout(session, req.Flags)
+	for _, stream := range parsedSDP.Streams {
+		if stream.SSRC != 0 {
+			_ = l.sessionRegistry.RegisterSSRC(session.ID, stream.SSRC, caller)
+		}
 	}
+	session.continueSSRC(leg, previousSSRC, parsedSDP.SSRC)
+	// A parked leg is re-attached to the endpoint this SDP describes
+	_ = l.sessionManager.UnparkLeg(session, legName(caller), nil, 0)
+	l.updateHoldState(session, SessionStatePending)
+	l.sessionManager.UpdateOffload(session)
+	localIP := l.advertisedIP(toIface, req.Direction, l.peerIP(session, !caller))
 
-	// Build response SDP with Karl's address and ports
-	responseSDP := l.buildResponseSDP(parsedSDP, localIP, rtpPort, req.Flags)
+	// Rewrite the offer with Karl's address and ports
+	responseSDP := l.buildResponseSDP(parsedSDP, leg, localIP, requestFlags(req), true, crypto)
+	l.trackT38Offer(session, leg, parsedSDP)
 
 	// Build stream info for response
-	streams := []ng.StreamInfo{
-		{
-			LocalIP:       localIP,
-			LocalPort:     rtpPort,
-			LocalRTCPPort: rtcpPort,
-			MediaType:     parsedSDP.MediaType,
-			Protocol:      l.determineProtocol(parsedSDP, req.Flags),
-			Index:         0,
-		},
-	}
+	streams := l.mediaStreams(leg, localIP, parsedSDP, req.Flags)
 
 	return &ng.NGResponse{
 		Result:  ng.ResultOK,
@@ -567,48 +877,123 @@ func (l *NGSocketListener) handleAnswer(req *ng.NGRequest) (*ng.NGResponse, erro
 	}
 
 	session := l.sessionRegistry.GetSessionByTags(req.CallID, req.FromTag, req.ToTag)
+	if session == nil {
+		// Another branch of a forked call answers the offer
+		session = l.sessionRegistry.GetSessionByTags(req.CallID, req.FromTag, "")
+	}
 	if session == nil {
 		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: ng.ErrReasonNotFound}, nil
 	}
 
-	_ = l.sessionRegistry.UpdateSessionState(session.ID, string(SessionStateActive))
-
 	// Parse incoming SDP
 	parsedSDP, err := l.parseSDP(req.SDP)
 	if err != nil {
 		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: "failed to parse SDP: " + err.Error()}, nil
 	}
 
-	// Allocate media ports for the answering leg
-	rtpPort, err := l.portAllocator.AllocatePort(session.ID)
+	// The answer to a re-offer from the answerer comes from the caller leg
+	caller := fromAnswerer(session, req.FromTag)
+	pf := ng.ParseFlags(requestFlags(req))
+
+	// Allocate an RTP/RTCP port pair for the answering leg, on the interface
+	// the answer is sent out of. Each branch of a forked call has a leg
+	fromIface := pf.FromInterface
+	if fromIface == "" {
+		fromIface = pf.Interface
+	}
+	var direction []string
+	if len(req.Direction) > 0 {
+		direction = req.Direction[:1]
+	}
+	ifaceName, bindIP, err := l.legInterface(fromIface, direction, l.peerIP(session, !caller))
+	if err != nil {
+		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: err.Error()}, nil
+	}
+	var leg *CallLeg
+	active := true
+	if caller {
+		leg, err = l.sessionManager.AllocateLegOn(session, req.ToTag, true, ifaceName, bindIP)
+	} else {
+		viaBranch := pf.ViaBranch
+		if viaBranch == "" {
+			viaBranch = req.ViaBranch
+		}
+		leg, active, err = l.sessionManager.AnswerBranch(session, req.ToTag, viaBranch, pf.EarlyMedia, ifaceName, bindIP)
+	}
 	if err != nil {
 		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: "failed to allocate port: " + err.Error()}, nil
 	}
-	rtcpPort := rtpPort + 1
 
-	// Get local IP
-	localIP := l.config.Integration.PublicIP
-	if localIP == "" {
-		localIP = l.config.Integration.MediaIP
+	// Record the answered codecs to complete the call's codec map, switching
+	// to those of a re-offer with them. A waiting branch's codecs count once
+	// it becomes the active one
+	if active {
+		GetCodecNegotiator().AnswerMedia(req.CallID, caller, parsedSDP.codecInfos(), receivePtime(parsedSDP, requestFlags(req)))
 	}
-	if localIP == "" {
-		localIP = "127.0.0.1"
+	if fmtp := opusFlagsFmtp(pf); fmtp != "" {
+		GetCodecNegotiator().SetOpusFmtp(req.CallID, fmtp)
+	}
+	if agc, ok := agcConfigFromFlags(pf); ok {
+		GetCodecNegotiator().SetAGC(req.CallID, agc)
+	}
+	applyTranscodeMode(session, pf)
+	if err := applySourceCheck(session, pf); err != nil {
+		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: err.Error()}, nil
+	}
+	applyImpairmentFlags(req.CallID, pf)
+	l.applyTranscription(req.CallID, pf)
+	if parsedSDP.SSRC != 0 {
+		GetCodecNegotiator().BindSSRC(parsedSDP.SSRC, req.CallID, caller)
+	}
+	previousSSRC := legSSRC(session, leg)
+	l.applyRemoteMedia(session, leg, parsedSDP, req.Flags)
+	if err := l.sessionManager.AllocateStreams(session, leg); err != nil {
+		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: "failed to allocate port: " + err.Error()}, nil
 	}
+	if err := l.sessionManager.OpenMedia(session, leg); err != nil {
+		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: err.Error()}, nil
+	}
+	var crypto *MediaCrypto
+	switch {
+	case caller:
+		crypto, err = l.reofferCrypto(session, parsedSDP, true)
+	case !active:
+		// A waiting branch is keyed when it answers finally
+		crypto = bridgedCallerCrypto(session)
+	default:
+		crypto, err = l.answerCrypto(session, leg, parsedSDP, requestFlags(req))
+	}
+	if err != nil {
+		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: "failed to bridge transports: " + err.Error()}, nil
+	}
+	l.trackZRTP(session, parsedSDP, crypto)
+	l.applyMediaTimeout(session, req.Flags)
+	for _, stream := range parsedSDP.Streams {
+		if stream.SSRC != 0 {
+			_ = l.sessionRegistry.RegisterLegSSRC(session, leg, stream.SSRC)
+		}
+	}
+	session.continueSSRC(leg, previousSSRC, parsedSDP.SSRC)
+	if active {
+		_ = l.sessionManager.UnparkLeg(session, legName(caller), nil, 0)
+	}
+	l.updateHoldState(session, SessionStateActive)
+	localIP := l.advertisedIP(fromIface, direction, l.peerIP(session, !caller))
 
-	// Build response SDP
-	responseSDP := l.buildResponseSDP(parsedSDP, localIP, rtpPort, req.Flags)
+	// Rewrite the answer with Karl's address and ports
+	responseSDP := l.buildResponseSDP(parsedSDP, leg, localIP, requestFlags(req), false, crypto)
+	if session.GetFlag(T38FallbackFlag) {
+		responseSDP = l.declineT38(session, parsedSDP, localIP)
+	} else {
+		l.trackT38Answer(session, parsedSDP)
+	}
+	if active {
+		l.autoRecord(session)
+	}
+	l.sessionManager.UpdateOffload(session)
 
 	// Build stream info
-	streams := []ng.StreamInfo{
-		{
-			LocalIP:       localIP,
-			LocalPort:     rtpPort,
-			LocalRTCPPort: rtcpPort,
-			MediaType:     parsedSDP.MediaType,
-			Protocol:      l.determineProtocol(parsedSDP, req.Flags),
-			Index:         0,
-		},
-	}
+	streams := l.mediaStreams(leg, localIP, parsedSDP, req.Flags)
 
 	return &ng.NGResponse{
 		Result:  ng.ResultOK,
@@ -625,14 +1010,20 @@ func (l *NGSocketListener) handleDelete(req *ng.NGRequest) (*ng.NGResponse, erro
 		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: ng.ErrReasonMissingParam + ": call-id"}, nil
 	}
 
-	sessions := l.sessionRegistry.GetSessionByCallID(req.CallID)
-	if len(sessions) == 0 {
-		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: ng.ErrReasonNotFound}, nil
+	// A losing branch of a forked call is deleted on its own
+	if (req.ToTag != "" || req.ViaBranch != "") && l.sessionRegistry.RemoveBranch(req.CallID, req.FromTag, req.ToTag, req.ViaBranch) {
+		return &ng.NGResponse{Result: ng.ResultOK}, nil
 	}
 
-	for _, session := range sessions {
-		_ = l.sessionRegistry.UpdateSessionState(session.ID, string(SessionStateTerminated))
-		_ = l.sessionRegistry.DeleteSession(session.ID)
+	// Tear down all sessions for the call and return their ports
+	if l.sessionManager.TerminateCall(req.CallID) == 0 {
+		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: ng.ErrReasonNotFound}, nil
+	}
+	GetCodecNegotiator().RemoveCall(req.CallID)
+	if l.t38Gateway != nil {
+		for _, fax := range l.t38Gateway.GetSessionByCallID(req.CallID) {
+			l.t38Gateway.RemoveSession(fax.ID)
+		}
 	}
 
 	return &ng.NGResponse{Result: ng.ResultOK}, nil
@@ -655,14 +1046,48 @@ func (l *NGSocketListener) handleQuery(req *ng.NGRequest) (*ng.NGResponse, error
 		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: ng.ErrReasonNotFound}, nil
 	}
 
-	return &ng.NGResponse{
+	resp := &ng.NGResponse{
 		Result:     ng.ResultOK,
 		CallID:     session.CallID,
 		FromTag:    session.FromTag,
 		ToTag:      session.ToTag,
 		Created:    session.CreatedAt.Unix(),
 		LastSignal: session.UpdatedAt.Unix(),
-	}, nil
+	}
+
+	// Fax sessions of the call
+	if l.t38Gateway != nil {
+		if faxes := l.t38Gateway.GetSessionByCallID(session.CallID); len(faxes) > 0 {
+			t38 := make([]interface{}, 0, len(faxes))
+			for _, fax := range faxes {
+				t38 = append(t38, fax.Info())
+			}
+			resp.Extra = map[string]interface{}{"t38": t38}
+		}
+	}
+
+	// ZRTP the parties run end to end, or that Karl ends with one of them
+	session.RLock()
+	zrtp := session.ZRTP
+	parties := map[string]*MediaCrypto{"caller": session.CallerCrypto, "callee": session.CalleeCrypto}
+	session.RUnlock()
+	var info map[string]interface{}
+	if zrtp {
+		info = map[string]interface{}{"mode": "passthrough"}
+	}
+	for party, crypto := range parties {
+		if crypto != nil && crypto.Mode == CryptoZRTP {
+			info = crypto.ZRTPInfo()
+			info["party"] = party
+		}
+	}
+	if info != nil {
+		if resp.Extra == nil {
+			resp.Extra = map[string]interface{}{}
+		}
+		resp.Extra["zrtp"] = info
+	}
+	return resp, nil
 }
 
 func (l *NGSocketListener) handleList(req *ng.NGRequest) (*ng.NGResponse, error) {
@@ -700,8 +1125,63 @@ func (l *NGSocketListener) handleStartRecording(req *ng.NGRequest) (*ng.NGRespon
 	if session == nil {
 		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: ng.ErrReasonNotFound}, nil
 	}
+
+	recorder := l.getCallRecorder()
+	if recorder == nil {
+		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: "Recording not available"}, nil
+	}
+
+	opts := CallRecordingOptions{Metadata: req.RecordingMeta}
+	if req.RawParams != nil {
+		opts.Format = ng.DictGetString(req.RawParams, "output-format")
+		if opts.Format == "" {
+			opts.Format = ng.DictGetString(req.RawParams, "format")
+		}
+		opts.Mode = ng.DictGetString(req.RawParams, "mode")
+	}
+
+	recordingID, err := l.startRecording(recorder, session, opts)
+	if err != nil {
+		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: err.Error()}, nil
+	}
+	return &ng.NGResponse{
+		Result: ng.ResultOK,
+		Extra:  map[string]interface{}{"recording-id": recordingID},
+	}, nil
+}
+
+// startRecording records a call, with its tenant's settings if it has one
+func (l *NGSocketListener) startRecording(recorder CallRecorder, session *MediaSession, opts CallRecordingOptions) (string, error) {
+	if tenant := SessionTenant(session); tenant != nil {
+		var err error
+		if opts, err = tenant.RecordingOptions(opts); err != nil {
+			return "", err
+		}
+	}
+
+	recordingID, err := recorder.StartCallRecording(session.ID, session.CallID, opts)
+	if err != nil {
+		return "", err
+	}
+
 	session.SetFlag("recording", true)
-	return &ng.NGResponse{Result: ng.ResultOK}, nil
+	session.SetFlag("recording_paused", false)
+	session.SetMetadata("recording_id", recordingID)
+	l.sessionManager.UpdateOffload(session)
+	return recordingID, nil
+}
+
+// autoRecord starts recording an answered call whose tenant records every
+// call
+func (l *NGSocketListener) autoRecord(session *MediaSession) {
+	tenant := SessionTenant(session)
+	recorder := l.getCallRecorder()
+	if tenant == nil || !tenant.autoRecords() || recorder == nil || session.GetFlag("recording") {
+		return
+	}
+	if _, err := l.startRecording(recorder, session, CallRecordingOptions{}); err != nil {
+		log.Printf("Failed to record call %s of tenant %s: %v", session.CallID, tenant.Name, err)
+	}
 }
 
 func (l *NGSocketListener) handleStopRecording(req *ng.NGRequest) (*ng.NGResponse, error) {
@@ -709,8 +1189,23 @@ func (l *NGSocketListener) handleStopRecording(req *ng.NGRequest) (*ng.NGRespons
 	if session == nil {
 		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: ng.ErrReasonNotFound}, nil
 	}
+
+	recorder := l.getCallRecorder()
+	if recorder == nil {
+		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: "Recording not available"}, nil
+	}
+
+	recordingID, err := recorder.StopCallRecording(session.ID)
+	if err != nil {
+		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: err.Error()}, nil
+	}
+
 	session.SetFlag("recording", false)
-	return &ng.NGResponse{Result: ng.ResultOK}, nil
+	l.sessionManager.UpdateOffload(session)
+	return &ng.NGResponse{
+		Result: ng.ResultOK,
+		Extra:  map[string]interface{}{"recording-id": recordingID},
+	}, nil
 }
 
 func (l *NGSocketListener) handlePauseRecording(req *ng.NGRequest) (*ng.NGResponse, error) {
@@ -718,6 +1213,16 @@ func (l *NGSocketListener) handlePauseRecording(req *ng.NGRequest) (*ng.NGRespon
 	if session == nil {
 		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: ng.ErrReasonNotFound}, nil
 	}
+
+	recorder := l.getCallRecorder()
+	if recorder == nil {
+		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: "Recording not available"}, nil
+	}
+
+	if err := recorder.PauseCallRecording(session.ID); err != nil {
+		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: err.Error()}, nil
+	}
+
 	session.SetFlag("recording_paused", true)
 	return &ng.NGResponse{Result: ng.ResultOK}, nil
 }
@@ -728,6 +1233,7 @@ func (l *NGSocketListener) handleBlockDTMF(req *ng.NGRequest) (*ng.NGResponse, e
 		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: ng.ErrReasonNotFound}, nil
 	}
 	session.SetFlag("dtmf_blocked", true)
+	l.sessionManager.UpdateOffload(session)
 	return &ng.NGResponse{Result: ng.ResultOK}, nil
 }
 
@@ -737,6 +1243,7 @@ func (l *NGSocketListener) handleUnblockDTMF(req *ng.NGRequest) (*ng.NGResponse,
 		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: ng.ErrReasonNotFound}, nil
 	}
 	session.SetFlag("dtmf_blocked", false)
+	l.sessionManager.UpdateOffload(session)
 	return &ng.NGResponse{Result: ng.ResultOK}, nil
 }
 
@@ -748,34 +1255,55 @@ func (l *NGSocketListener) handlePlayDTMF(req *ng.NGRequest) (*ng.NGResponse, er
 	if req.DTMFDigit == "" {
 		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: ng.ErrReasonMissingParam + ": digit"}, nil
 	}
+	for i := 0; i < len(req.DTMFDigit); i++ {
+		if _, ok := DTMFDigitToEvent(req.DTMFDigit[i]); !ok {
+			return &ng.NGResponse{Result: ng.ResultError, ErrorReason: fmt.Sprintf("invalid DTMF digit: %q", req.DTMFDigit[i])}, nil
+		}
+	}
 	session.SetMetadata("pending_dtmf", req.DTMFDigit)
 	return &ng.NGResponse{Result: ng.ResultOK}, nil
 }
 
 func (l *NGSocketListener) handleBlockMedia(req *ng.NGRequest) (*ng.NGResponse, error) {
-	session := l.findSession(req)
-	if session == nil {
-		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: ng.ErrReasonNotFound}, nil
-	}
-	session.SetFlag("media_blocked", true)
-	return &ng.NGResponse{Result: ng.ResultOK}, nil
+	return l.controlMedia(req, func(c *LegMediaControl) { c.Blocked = true })
 }
 
 func (l *NGSocketListener) handleUnblockMedia(req *ng.NGRequest) (*ng.NGResponse, error) {
-	session := l.findSession(req)
-	if session == nil {
-		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: ng.ErrReasonNotFound}, nil
-	}
-	session.SetFlag("media_blocked", false)
-	return &ng.NGResponse{Result: ng.ResultOK}, nil
+	return l.controlMedia(req, func(c *LegMediaControl) { c.Blocked = false })
 }
 
 func (l *NGSocketListener) handleSilenceMedia(req *ng.NGRequest) (*ng.NGResponse, error) {
+	return l.controlMedia(req, func(c *LegMediaControl) { c.Silenced = true })
+}
+
+func (l *NGSocketListener) handleUnsilenceMedia(req *ng.NGRequest) (*ng.NGResponse, error) {
+	return l.controlMedia(req, func(c *LegMediaControl) { c.Silenced = false })
+}
+
+// controlMedia changes the media control of the party whose tag is the
+// request's from-tag, or of both legs with the all flag or when no leg has
+// that tag, like rtpengine's block and silence media
+func (l *NGSocketListener) controlMedia(req *ng.NGRequest, change func(*LegMediaControl)) (*ng.NGResponse, error) {
 	session := l.findSession(req)
 	if session == nil {
 		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: ng.ErrReasonNotFound}, nil
 	}
-	session.SetFlag("media_silenced", true)
+
+	legs := []string{LegCaller, LegCallee}
+	if _, err := session.MediaControl(req.FromTag); err == nil && !ng.ParseFlags(req.Flags).All {
+		legs = []string{req.FromTag}
+	}
+	for _, leg := range legs {
+		control, err := session.MediaControl(leg)
+		if err != nil {
+			continue // The callee leg before the answer
+		}
+		change(&control)
+		if err := session.SetMediaControl(leg, control); err != nil {
+			return &ng.NGResponse{Result: ng.ResultError, ErrorReason: err.Error()}, nil
+		}
+	}
+	l.sessionManager.UpdateOffload(session)
 	return &ng.NGResponse{Result: ng.ResultOK}, nil
 }
 
@@ -786,6 +1314,7 @@ func (l *NGSocketListener) handleStartForwarding(req *ng.NGRequest) (*ng.NGRespo
 	}
 	session.SetFlag("forwarding", true)
 	session.SetMetadata("forward_address", req.ForwardAddress)
+	l.sessionManager.UpdateOffload(session)
 	return &ng.NGResponse{Result: ng.ResultOK}, nil
 }
 
@@ -795,6 +1324,7 @@ func (l *NGSocketListener) handleStopForwarding(req *ng.NGRequest) (*ng.NGRespon
 		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: ng.ErrReasonNotFound}, nil
 	}
 	session.SetFlag("forwarding", false)
+	l.sessionManager.UpdateOffload(session)
 	return &ng.NGResponse{Result: ng.ResultOK}, nil
 }
 
@@ -803,7 +1333,79 @@ func (l *NGSocketListener) handlePlayMedia(req *ng.NGRequest) (*ng.NGResponse, e
 	if session == nil {
 		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: ng.ErrReasonNotFound}, nil
 	}
+	file := ng.DictGetString(req.RawParams, "file")
+	if file == "" {
+		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: ng.ErrReasonMissingParam + ": file"}, nil
+	}
+	startPos := ng.DictGetInt(req.RawParams, "start-pos")
+	repeat := ng.DictGetInt(req.RawParams, "repeat-times")
+	if startPos < 0 || repeat < 0 {
+		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: "invalid start-pos or repeat-times"}, nil
+	}
+
+	// The from-tag names the party that hears the media; without one
+	// both parties do
+	session.RLock()
+	callID := session.CallID
+	parties := []bool{true, false}
+	if req.FromTag != "" && req.FromTag == session.ToTag {
+		parties = []bool{false}
+	} else if req.FromTag != "" && req.FromTag == session.FromTag {
+		parties = []bool{true}
+	}
+	type playbackLeg struct {
+		caller bool
+		remote *net.UDPAddr
+		codecs []CodecInfo
+	}
+	var legs []playbackLeg
+	for _, caller := range parties {
+		leg := session.CalleeLeg
+		if caller {
+			leg = session.CallerLeg
+		}
+		// Before the answer only the caller has an address to play to
+		if leg != nil && leg.IP != nil && leg.Port > 0 {
+			legs = append(legs, playbackLeg{caller: caller, remote: &net.UDPAddr{IP: leg.IP, Port: leg.Port}, codecs: leg.Codecs})
+		}
+	}
+	session.RUnlock()
+	if len(legs) == 0 {
+		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: "call leg has no remote media address"}, nil
+	}
+
+	player := GetMediaPlayer()
+	done := func() {
+		if !playingMedia(callID) {
+			session.SetFlag("playing_media", false)
+			l.sessionManager.UpdateOffload(session)
+		}
+	}
+	for _, leg := range legs {
+		target := "callee"
+		if leg.caller {
+			target = "caller"
+		}
+		config := &PlaybackConfig{
+			FilePath:  file,
+			TargetLeg: target,
+			CallID:    callID,
+			Target:    playbackLegCodec(callID, leg.caller, leg.codecs),
+			StartPos:  time.Duration(startPos) * time.Millisecond,
+			Repeat:    int(repeat),
+			Remote:    leg.remote,
+			OnDone:    done,
+		}
+		if err := player.StartPlayback(playbackKey(callID, leg.caller), config); err != nil {
+			stopPlayMedia(callID)
+			done()
+			return &ng.NGResponse{Result: ng.ResultError, ErrorReason: "failed to play media: " + err.Error()}, nil
+		}
+	}
+
+	// Played media is sent from userspace, so keep the call off the kernel path
 	session.SetFlag("playing_media", true)
+	l.sessionManager.UpdateOffload(session)
 	return &ng.NGResponse{Result: ng.ResultOK}, nil
 }
 
@@ -812,17 +1414,632 @@ func (l *NGSocketListener) handleStopMedia(req *ng.NGRequest) (*ng.NGResponse, e
 	if session == nil {
 		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: ng.ErrReasonNotFound}, nil
 	}
+	session.RLock()
+	callID := session.CallID
+	session.RUnlock()
+	stopPlayMedia(callID)
 	session.SetFlag("playing_media", false)
+	l.sessionManager.UpdateOffload(session)
 	return &ng.NGResponse{Result: ng.ResultOK}, nil
 }
 
-func (l *NGSocketListener) findSession(req *ng.NGRequest) *MediaSession {
-	if req.CallID == "" {
-		return nil
-	}
-	session := l.sessionRegistry.GetSessionByTags(req.CallID, req.FromTag, req.ToTag)
-	if session == nil {
-		sessions := l.sessionRegistry.GetSessionByCallID(req.CallID)
+// playingMedia reports whether play media is still playing into a call
+func playingMedia(callID string) bool {
+	player := GetMediaPlayer()
+	return player.IsPlaying(playbackKey(callID, true)) || player.IsPlaying(playbackKey(callID, false))
+}
+
+// stopPlayMedia stops what play media plays into a call, leaving music on
+// hold alone
+func stopPlayMedia(callID string) {
+	player := GetMediaPlayer()
+	_ = player.StopPlayback(playbackKey(callID, true))
+	_ = player.StopPlayback(playbackKey(callID, false))
+}
+
+// playbackLegCodec returns the codec media is played to a leg in: its
+// first negotiated audio codec, or PCMU when none is known
+func playbackLegCodec(callID string, caller bool, legCodecs []CodecInfo) CodecInfo {
+	codecs := legCodecs
+	if negotiated, ok := GetCodecNegotiator().GetCallCodecs(callID); ok {
+		if caller && len(negotiated.OfferCodecs) > 0 {
+			codecs = negotiated.OfferCodecs
+		} else if !caller && len(negotiated.AnswerCodecs) > 0 {
+			codecs = negotiated.AnswerCodecs
+		}
+	}
+	if codec, ok := firstAudioCodec(codecs); ok {
+		return codec
+	}
+	return CodecInfo{PayloadType: 0, Name: "PCMU", ClockRate: 8000, Channels: 1}
+}
+
+// SetCallRecorder sets the recorder used by the recording commands
+func (l *NGSocketListener) SetCallRecorder(recorder CallRecorder) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.callRecorder = recorder
+}
+
+// getCallRecorder returns the configured call recorder, if any
+func (l *NGSocketListener) getCallRecorder() CallRecorder {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.callRecorder
+}
+
+// GetSessionManager returns the session manager used for port allocation
+func (l *NGSocketListener) GetSessionManager() *SessionManager {
+	return l.sessionManager
+}
+
+// advertisedIP returns the address to write into SDP sent towards the named
+// interface or direction, or the interface picked by the peer's network
+func (l *NGSocketListener) advertisedIP(iface string, direction []string, peer net.IP) string {
+	if l.interfaces == nil {
+		return l.localMediaIP()
+	}
+	peer = l.selectionPeer(peer)
+	if addr := l.interfaces.AdvertiseAddressFor(iface, direction, peer); addr != "" {
+		return addr
+	}
+	return l.localMediaIP()
+}
+
+// iceCandidates returns Karl's ICE candidates for the ports of a leg, nil
+// for an ICE-lite Karl: a host candidate on the address the leg's sockets
+// are bound to, or else its interface's, and server-reflexive ones on the
+// advertised address and the one the ICE manager discovered
+func (l *NGSocketListener) iceCandidates(leg *CallLeg, advertised string) []ICECandidate {
+	manager := l.getICEManager()
+	if manager == nil {
+		return nil
+	}
+	var host net.IP
+	if leg.Conn != nil {
+		if addr, ok := leg.Conn.LocalAddr().(*net.UDPAddr); ok && !addr.IP.IsUnspecified() {
+			host = addr.IP
+		}
+	}
+	if host == nil && l.interfaces != nil {
+		_, address := l.interfaces.LocalAddressFor(leg.Interface, nil, nil)
+		host = net.ParseIP(address)
+	}
+	return manager.Candidates(host, advertised)
+}
+
+// selectionPeer returns the peer address that picks an interface: only when
+// internal networks or interface networks are configured, since a private
+// c= address may be a phone behind NAT rather than a local peer
+func (l *NGSocketListener) selectionPeer(peer net.IP) net.IP {
+	if len(l.config.Integration.InternalNetworks) == 0 && !l.interfaces.HasPeerRules() {
+		return nil
+	}
+	return peer
+}
+
+// legInterface returns the named interface a call leg uses and the address
+// its media is bound to, nil for the default. An interface named by a flag
+// must exist; directions fall back like the advertised address does
+func (l *NGSocketListener) legInterface(iface string, direction []string, peer net.IP) (string, net.IP, error) {
+	if l.interfaces == nil {
+		return "", nil, nil
+	}
+	if iface != "" && !l.interfaces.HasInterface(iface) {
+		return "", nil, fmt.Errorf("unknown interface %q", iface)
+	}
+	peer = l.selectionPeer(peer)
+	name, address := l.interfaces.LocalAddressFor(iface, direction, peer)
+	ip := net.ParseIP(address)
+	if ip == nil || ip.IsUnspecified() {
+		return name, nil, nil
+	}
+	return name, ip, nil
+}
+
+// peerIP returns the media address of the caller or callee leg the rewritten
+// SDP goes to, nil until that leg has sent SDP
+func (l *NGSocketListener) peerIP(session *MediaSession, caller bool) net.IP {
+	session.RLock()
+	defer session.RUnlock()
+	leg := session.CalleeLeg
+	if caller {
+		leg = session.CallerLeg
+	}
+	if leg == nil || leg.IP == nil || leg.IP.IsUnspecified() {
+		return nil
+	}
+	return leg.IP
+}
+
+// fromAnswerer reports whether a message of a call comes from the party
+// that answered it, as a re-INVITE the callee sends, whose from-tag is the
+// call's to-tag
+func fromAnswerer(session *MediaSession, fromTag string) bool {
+	session.RLock()
+	defer session.RUnlock()
+	return session.ToTag != "" && fromTag == session.ToTag && fromTag != session.FromTag
+}
+
+// bridgedCallerCrypto returns Karl's end towards the caller of a bridged
+// call, nil while the call's media passes through
+func bridgedCallerCrypto(session *MediaSession) *MediaCrypto {
+	session.RLock()
+	defer session.RUnlock()
+	if session.CalleeCrypto == nil {
+		return nil
+	}
+	return session.CallerCrypto
+}
+
+// legSSRC returns the SSRC a leg's party last signalled
+func legSSRC(session *MediaSession, leg *CallLeg) uint32 {
+	session.RLock()
+	defer session.RUnlock()
+	return leg.SSRC
+}
+
+// SetDispatcher makes the listener forward commands for calls owned by
+// other nodes
+func (l *NGSocketListener) SetDispatcher(d *CallDispatcher) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.dispatcher = d
+}
+
+// SetICEManager makes Karl a full ICE agent towards WebRTC peers, offering
+// the candidates the manager gathers. Without one Karl runs ICE-lite
+func (l *NGSocketListener) SetICEManager(manager *ICEManager) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.iceManager = manager
+}
+
+// getICEManager returns the ICE manager, nil for ICE-lite
+func (l *NGSocketListener) getICEManager() *ICEManager {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.iceManager
+}
+
+// SetTranscriptionManager sets the manager started by the transcribe flag
+func (l *NGSocketListener) SetTranscriptionManager(manager *TranscriptionManager) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.transcriber = manager
+}
+
+// applyTranscription starts transcribing a call offered or answered with
+// the transcribe flag. A call that cannot be transcribed is still set up
+func (l *NGSocketListener) applyTranscription(callID string, pf *ng.ParsedFlags) {
+	if !pf.Transcribe {
+		return
+	}
+	l.mu.RLock()
+	transcriber := l.transcriber
+	l.mu.RUnlock()
+	if transcriber == nil {
+		log.Printf("Warning: transcription requested for call %s but not enabled", callID)
+		return
+	}
+	if _, err := transcriber.StartCall(callID, nil); err != nil && err != ErrTranscriptionRunning {
+		log.Printf("Warning: transcription of call %s not started: %v", callID, err)
+	}
+}
+
+// GetInterfaceSelector returns the selector choosing advertised addresses
+func (l *NGSocketListener) GetInterfaceSelector() *InterfaceSelector {
+	return l.interfaces
+}
+
+// localMediaIP returns the address advertised in SDP for media
+func (l *NGSocketListener) localMediaIP() string {
+	localIP := l.config.Integration.PublicIP
+	if localIP == "" {
+		localIP = l.config.Integration.MediaIP
+	}
+	if localIP == "" {
+		localIP = "127.0.0.1"
+	}
+	return localIP
+}
+
+// applyRemoteMedia records the peer's media address and codecs on a leg
+func (l *NGSocketListener) applyRemoteMedia(session *MediaSession, leg *CallLeg, parsed *parsedSDPInfo, flags []string) {
+	session.Lock()
+	defer session.Unlock()
+
+	// rtcp-mux-demux forces separate ports, rtcp-mux-require forces muxing
+	leg.RTCPMux = parsed.RTCPMux
+	if containsFlag(flags, "rtcp-mux-demux") {
+		leg.RTCPMux = false
+	} else if containsFlag(flags, "rtcp-mux-require") {
+		leg.RTCPMux = true
+	}
+
+	leg.IP = net.ParseIP(parsed.ConnectionIP)
+	leg.Port = parsed.MediaPort
+	leg.StrictSource = containsFlag(flags, "strict-source")
+	leg.RTCPPort, leg.RTCPIP = parsed.MediaPort+1, nil
+	if parsed.RTCPPort > 0 {
+		leg.RTCPPort, leg.RTCPIP = parsed.RTCPPort, net.ParseIP(parsed.RTCPIP)
+	}
+	if leg.RTCPMux {
+		leg.RTCPPort = parsed.MediaPort
+	}
+	leg.MediaType = MediaType(parsed.MediaType)
+	leg.Transport = TransportProtocol(parsed.Protocol)
+	leg.Direction = parsed.Direction
+	leg.Codecs = parsed.codecInfos()
+	leg.Extmap = parsed.Extmap
+	leg.Streams = remoteStreams(leg, parsed, flags)
+
+	// ICE: the peer's credentials, and Karl's kept stable across re-INVITEs
+	leg.ICECredentials, leg.ICECandidates = nil, nil
+	if parsed.HasICE {
+		leg.ICECredentials = &ICECredentials{Username: parsed.ICEUfrag, Password: parsed.ICEPwd, Lite: parsed.ICELite}
+		leg.ICECandidates = iceCandidateAddrs(parsed.Candidates)
+	}
+	if leg.LocalICE == nil {
+		if creds, err := NewICECredentials(l.getICEManager() == nil); err == nil {
+			leg.LocalICE = creds
+		}
+	}
+
+	// After a key rotation this offer/answer carries Karl's new SDES key
+	if applyNegotiatedSRTP(leg, parsed) {
+		parsed.CryptoKey = leg.SRTPParams.InlineKey()
+	}
+	if !srtpRekeyPending(session) {
+		delete(session.Flags, SRTPRekeyPendingFlag)
+	}
+
+	// Protect the stream with FlexFEC when the peer negotiated a repair stream
+	if fecPT, ok := parsed.flexFECPayloadType(); ok {
+		fecConfig := *l.config.GetFECConfig()
+		if fecConfig.Enabled {
+			if session.FECHandler == nil {
+				session.FECHandler = NewFECHandler(&fecConfig)
+			}
+			session.FECHandler.SetRepairStream(fecPT, parsed.FECSSRC, parsed.SSRC)
+			RegisterFECHandler(session.FECHandler)
+		}
+	}
+}
+
+// remoteStreams describes every m= section of the peer's SDP. Sections keep
+// the ports of an earlier offer/answer and the primary one uses the leg's.
+func remoteStreams(leg *CallLeg, parsed *parsedSDPInfo, flags []string) []*MediaStream {
+	streams := make([]*MediaStream, len(parsed.Streams))
+	for i, section := range parsed.Streams {
+		stream := &MediaStream{
+			Index:     i,
+			MediaType: MediaType(section.MediaType),
+			MID:       section.MID,
+			IP:        net.ParseIP(section.ConnectionIP),
+			Port:      section.MediaPort,
+			RTCPPort:  section.MediaPort + 1,
+			Transport: TransportProtocol(section.Protocol),
+			Direction: section.Direction,
+			RTCPMux:   section.RTCPMux,
+			SSRC:      section.SSRC,
+			Codecs:    section.Codecs,
+			Extmap:    section.Extmap,
+		}
+		if containsFlag(flags, "rtcp-mux-demux") {
+			stream.RTCPMux = false
+		} else if containsFlag(flags, "rtcp-mux-require") {
+			stream.RTCPMux = true
+		}
+		if section.RTCPPort > 0 {
+			stream.RTCPPort = section.RTCPPort
+		}
+		if stream.RTCPMux {
+			stream.RTCPPort = stream.Port
+		}
+
+		switch {
+		case i == parsed.primary:
+			stream.LocalPort, stream.LocalRTCPPort = leg.LocalPort, leg.LocalRTCPPort
+			stream.Conn, stream.RTCPConn = leg.Conn, leg.RTCPConn
+		case i < len(leg.Streams) && leg.Streams[i].MediaType == stream.MediaType:
+			stream.LocalPort, stream.LocalRTCPPort = leg.Streams[i].LocalPort, leg.Streams[i].LocalRTCPPort
+			stream.Conn, stream.RTCPConn = leg.Streams[i].Conn, leg.Streams[i].RTCPConn
+		}
+		streams[i] = stream
+	}
+	return streams
+}
+
+// updateHoldState moves the session to state, or to hold while either leg's
+// last SDP holds the other side (sendonly, inactive or a 0.0.0.0 address),
+// and starts or stops music on hold to match
+func (l *NGSocketListener) updateHoldState(session *MediaSession, state SessionState) {
+	session.RLock()
+	held := false
+	for _, leg := range []*CallLeg{session.CallerLeg, session.CalleeLeg} {
+		if leg != nil && leg.Direction != "" && IsSDPHold(leg.Direction, leg.IP.String()) {
+			held = true
+		}
+	}
+	wasHeld := session.State == SessionStateHold
+	session.RUnlock()
+
+	if held {
+		state = SessionStateHold
+		if !wasHeld {
+			log.Printf("Call %s put on hold", session.CallID)
+		}
+	} else if wasHeld {
+		log.Printf("Call %s resumed", session.CallID)
+	}
+	_ = l.sessionRegistry.UpdateSessionStateTyped(session.ID, state)
+
+	// Music on hold is sent from userspace, so keep the call off the kernel path
+	if moh := updateMusicOnHold(session); moh != session.GetFlag(MusicOnHoldFlag) {
+		session.SetFlag(MusicOnHoldFlag, moh)
+		l.sessionManager.UpdateOffload(session)
+	}
+}
+
+// T38FallbackFlag marks a call whose T.38 offer was passed on as G.711,
+// until the answer declines T.38 towards the offerer
+const T38FallbackFlag = "t38_g711_fallback"
+
+// handleT38FallbackOffer turns a T.38 re-INVITE into a G.711 pass-through
+// offer on the offerer's existing audio ports. Karl does not demodulate fax,
+// so the offerer keeps sending G.711 once the answer declines T.38.
+func (l *NGSocketListener) handleT38FallbackOffer(req *ng.NGRequest, session *MediaSession, parsed *parsedSDPInfo) (*ng.NGResponse, error) {
+	leg, err := l.sessionManager.AllocateLeg(session, req.FromTag, true)
+	if err != nil {
+		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: "failed to allocate port: " + err.Error()}, nil
+	}
+	localIP := l.localMediaIP()
+
+	session.RLock()
+	codecs := leg.Codecs
+	session.RUnlock()
+
+	index := parsed.t38Section()
+	faxConfig := T38ConfigFromMedia(parsed.desc.MediaDescriptions[index])
+	parsed.desc.MediaDescriptions[index] = NewT38FallbackMedia(leg.LocalPort, codecs)
+	rw := &SDPRewrite{
+		LocalIP:       localIP,
+		ReplaceOrigin: containsFlag(req.Flags, "replace-origin"),
+		Media:         make([]SDPMediaRewrite, len(parsed.desc.MediaDescriptions)),
+	}
+	rw.Media[index] = SDPMediaRewrite{RTPPort: leg.LocalPort, RTCPPort: leg.LocalRTCPPort, Protocol: "RTP/AVP"}
+	responseSDP := RewriteSDP(parsed.desc, rw)
+
+	if l.t38Gateway != nil {
+		fax, _ := l.t38Gateway.CreateSession(session.CallID, net.ParseIP(localIP), leg.LocalPort)
+		fax.setConfig(faxConfig)
+	}
+	session.SetFlag(T38FallbackFlag, true)
+	l.sessionManager.UpdateOffload(session)
+	log.Printf("Call %s: T.38 offered, continuing as G.711 pass-through", session.CallID)
+
+	return &ng.NGResponse{
+		Result:  ng.ResultOK,
+		SDP:     responseSDP,
+		CallID:  req.CallID,
+		FromTag: req.FromTag,
+		Streams: []ng.StreamInfo{{
+			LocalIP:       localIP,
+			LocalPort:     leg.LocalPort,
+			LocalRTCPPort: leg.LocalRTCPPort,
+			MediaType:     string(MediaAudio),
+			Protocol:      "RTP/AVP",
+			Index:         index,
+		}},
+	}, nil
+}
+
+// handleLoopbackOffer answers an offer with Karl's own ports and reflects
+// the media the offerer sends there back to it, after the loopback delay
+// and in the loopback codec if one was asked for. Only plain RTP audio can
+// be reflected: Karl does not terminate SRTP, DTLS or ICE of a loopback.
+func (l *NGSocketListener) handleLoopbackOffer(req *ng.NGRequest, session *MediaSession, parsed *parsedSDPInfo, pf *ng.ParsedFlags) (*ng.NGResponse, error) {
+	if parsed.MediaType != string(MediaAudio) || parsed.Protocol != string(TransportRTP) && parsed.Protocol != "RTP/AVPF" {
+		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: "loopback supports plain RTP audio only"}, nil
+	}
+	settings, err := loopbackSettingsFromFlags(pf, parsed.codecInfos())
+	if err != nil {
+		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: err.Error()}, nil
+	}
+
+	// The answer goes back to the offerer, as it would from a callee
+	fromIface := pf.FromInterface
+	if fromIface == "" {
+		fromIface = pf.Interface
+	}
+	var direction []string
+	if len(req.Direction) > 0 {
+		direction = req.Direction[:1]
+	}
+	ifaceName, bindIP, err := l.legInterface(fromIface, direction, net.ParseIP(parsed.ConnectionIP))
+	if err != nil {
+		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: err.Error()}, nil
+	}
+	leg, err := l.sessionManager.AllocateLegOn(session, req.FromTag, true, ifaceName, bindIP)
+	if err != nil {
+		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: "failed to allocate port: " + err.Error()}, nil
+	}
+	l.applyRemoteMedia(session, leg, parsed, req.Flags)
+	l.applyMediaTimeout(session, req.Flags)
+
+	// Reflected media keeps the call alive for the media timeout
+	activity := func(ssrc uint32, size int) {
+		_ = l.sessionRegistry.RegisterSSRC(session.ID, ssrc, true)
+		l.sessionRegistry.RecordMediaActivity(ssrc, size)
+	}
+	rtcpPort := leg.LocalRTCPPort
+	if leg.RTCPMux {
+		rtcpPort = 0
+	}
+	if err := StartLoopback(req.CallID, bindIP, leg.LocalPort, rtcpPort, settings, activity); err != nil {
+		return &ng.NGResponse{Result: ng.ResultError, ErrorReason: err.Error()}, nil
+	}
+	l.updateHoldState(session, SessionStateActive)
+	localIP := l.advertisedIP(fromIface, direction, net.ParseIP(parsed.ConnectionIP))
+
+	return &ng.NGResponse{
+		Result:  ng.ResultOK,
+		SDP:     loopbackAnswerSDP(parsed, leg, localIP),
+		CallID:  req.CallID,
+		FromTag: req.FromTag,
+		Streams: []ng.StreamInfo{{
+			LocalIP:       localIP,
+			LocalPort:     leg.LocalPort,
+			LocalRTCPPort: leg.LocalRTCPPort,
+			MediaType:     parsed.MediaType,
+			Protocol:      parsed.Protocol,
+			Index:         parsed.primary,
+		}},
+	}, nil
+}
+
+// declineT38 answers a T.38 offer that was passed on as G.711: every
+// section is rejected so the offerer keeps its G.711 audio session
+func (l *NGSocketListener) declineT38(session *MediaSession, parsed *parsedSDPInfo, localIP string) string {
+	desc := NewSDPSession("karl", parsed.desc.Origin.SessionID, parsed.desc.Origin.SessionVersion, localIP, "Karl Media Server")
+	desc.MediaDescriptions = append(desc.MediaDescriptions, &sdp.MediaDescription{
+		MediaName: sdp.MediaName{
+			Media:   "image",
+			Port:    sdp.RangedPort{Value: 0},
+			Protos:  []string{"udptl"},
+			Formats: []string{"t38"},
+		},
+	})
+
+	session.SetFlag(T38FallbackFlag, false)
+	if fax := l.currentT38Session(session.CallID); fax != nil {
+		_ = l.t38Gateway.SetState(fax.ID, T38StatePassThrough)
+	}
+	return MarshalSDP(desc)
+}
+
+// trackT38Offer starts a fax session when an offer switches to T.38 and
+// completes it when a later offer switches back to audio
+func (l *NGSocketListener) trackT38Offer(session *MediaSession, leg *CallLeg, parsed *parsedSDPInfo) {
+	if l.t38Gateway == nil {
+		return
+	}
+	current := l.currentT38Session(session.CallID)
+
+	index := parsed.t38Section()
+	if index < 0 {
+		if current != nil {
+			_ = l.t38Gateway.CompleteSession(current.ID)
+			log.Printf("Call %s: fax session %s complete", session.CallID, current.ID)
+		}
+		return
+	}
+	if current != nil {
+		return // Re-offer of the running fax session
+	}
+
+	session.RLock()
+	localPort := leg.Streams[index].LocalPort
+	session.RUnlock()
+
+	fax, _ := l.t38Gateway.CreateSession(session.CallID, net.ParseIP(l.localMediaIP()), localPort)
+	fax.setConfig(T38ConfigFromMedia(parsed.desc.MediaDescriptions[index]))
+	log.Printf("Call %s: T.38 offered, fax session %s", session.CallID, fax.ID)
+}
+
+// trackT38Answer activates the fax session when the answer accepts T.38
+func (l *NGSocketListener) trackT38Answer(session *MediaSession, parsed *parsedSDPInfo) {
+	if l.t38Gateway == nil {
+		return
+	}
+	fax := l.currentT38Session(session.CallID)
+	if fax == nil || fax.GetState() != T38StateSetup {
+		return
+	}
+
+	index := parsed.t38Section()
+	if index < 0 {
+		_ = l.t38Gateway.SetState(fax.ID, T38StateFailed)
+		log.Printf("Call %s: T.38 declined", session.CallID)
+		return
+	}
+	section := parsed.Streams[index]
+	_ = l.t38Gateway.SetRemoteEndpoint(fax.ID, net.ParseIP(section.ConnectionIP), section.MediaPort)
+}
+
+// currentT38Session returns the newest fax session of a call that is not
+// complete
+func (l *NGSocketListener) currentT38Session(callID string) *T38Session {
+	if l.t38Gateway == nil {
+		return nil
+	}
+	var current *T38Session
+	for _, fax := range l.t38Gateway.GetSessionByCallID(callID) {
+		if fax.GetState() == T38StateComplete {
+			continue
+		}
+		if current == nil || fax.CreatedAt.After(current.CreatedAt) {
+			current = fax
+		}
+	}
+	return current
+}
+
+// applyMediaTimeout stores a per-call media-timeout flag on the session
+func (l *NGSocketListener) applyMediaTimeout(session *MediaSession, flags []string) {
+	parsed := ng.ParseFlags(flags)
+	if parsed.MediaTimeout < 0 {
+		return
+	}
+
+	session.Lock()
+	session.MediaTimeout = parsed.MediaTimeout
+	session.Unlock()
+}
+
+// applyTranscodeMode records the transcode=never|always|if-needed option of
+// an offer or answer for the call. Without one the call keeps its mode
+func applyTranscodeMode(session *MediaSession, pf *ng.ParsedFlags) {
+	if pf.TranscodeMode == "" {
+		return
+	}
+	GetCodecNegotiator().SetTranscodeMode(session.CallID, pf.TranscodeMode)
+
+	session.Lock()
+	session.AlwaysTranscode = pf.TranscodeMode == ng.TranscodeAlways
+	session.Unlock()
+}
+
+// applySourceCheck records the source-check=off|sdp|learn|any option of an
+// offer or answer for the call; media-handover stands for any. Without one
+// the call keeps its check
+func applySourceCheck(session *MediaSession, pf *ng.ParsedFlags) error {
+	value := pf.SourceCheck
+	if value == "" && pf.MediaHandover {
+		value = string(SourceCheckAny)
+	}
+	if value == "" {
+		return nil
+	}
+	mode, err := ParseSourceCheckMode(value)
+	if err != nil {
+		return err
+	}
+
+	session.Lock()
+	session.SourceCheck = mode
+	session.Unlock()
+	return nil
+}
+
+func (l *NGSocketListener) findSession(req *ng.NGRequest) *MediaSession {
+	if req.CallID == "" {
+		return nil
+	}
+	session := l.sessionRegistry.GetSessionByTags(req.CallID, req.FromTag, req.ToTag)
+	if session == nil {
+		sessions := l.sessionRegistry.GetSessionByCallID(req.CallID)
 		if len(sessions) > 0 {
 			return sessions[0]
 		}
@@ -839,15 +2056,56 @@ type parsedSDPInfo struct {
 	HasICE       bool
 	ICEUfrag     string
 	ICEPwd       string
+	ICELite      bool     // a=ice-lite
+	Candidates   []string // a=candidate values
 	HasDTLS      bool
 	Fingerprint  string
 	Setup        string
+	ZRTPHash     string // a=zrtp-hash, empty if absent
 	HasSRTP      bool
 	CryptoSuite  string
 	CryptoKey    string
 	RTCPMux      bool
+	RTCPPort     int    // a=rtcp port, 0 if absent
+	RTCPIP       string // a=rtcp address, empty for the connection address
 	Direction    string
+	SSRC         uint32
+	FECSSRC      uint32 // Repair stream from a=ssrc-group:FEC-FR
+	Ptime        int    // a=ptime in ms, 0 if absent
 	Codecs       []sdpCodecInfo
+	Extmap       RTPExtmap
+
+	// Streams describes every m= section; the fields above describe the
+	// primary one at index primary
+	Streams []sdpStreamInfo
+	primary int
+	desc    *sdp.SessionDescription
+}
+
+// t38Section returns the index of the first accepted T.38 section, or -1
+func (p *parsedSDPInfo) t38Section() int {
+	for i, media := range p.desc.MediaDescriptions {
+		if IsT38Media(media) && media.MediaName.Port.Value != 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// sdpStreamInfo describes one m= section of a parsed SDP
+type sdpStreamInfo struct {
+	MediaType    string
+	MediaPort    int
+	Protocol     string
+	ConnectionIP string
+	Direction    string
+	RTCPMux      bool
+	RTCPPort     int // a=rtcp port, 0 if absent
+	MID          string
+	SSRC         uint32
+	Crypto       string // Value of the section's a=crypto line
+	Codecs       []CodecInfo
+	Extmap       RTPExtmap
 }
 
 type sdpCodecInfo struct {
@@ -858,292 +2116,526 @@ type sdpCodecInfo struct {
 	Fmtp        string
 }
 
-// parseSDP parses an SDP string and extracts relevant information
-func (l *NGSocketListener) parseSDP(sdp string) (*parsedSDPInfo, error) {
-	parsed := &parsedSDPInfo{
-		MediaType: "audio",
-		Protocol:  "RTP/AVP",
-		Direction: "sendrecv",
-		Codecs:    make([]sdpCodecInfo, 0),
-	}
-
-	lines := splitSDPLines(sdp)
-	var payloadTypes []int
+// codecInfos converts the parsed codecs into session codec descriptors
+// flexFECPayloadType returns the payload type of an offered FlexFEC repair stream
+func (p *parsedSDPInfo) flexFECPayloadType() (uint8, bool) {
+	return flexFECPayloadType(p.codecInfos())
+}
 
-	for _, line := range lines {
-		if len(line) < 2 || line[1] != '=' {
-			continue
+// flexFECPayloadType returns the payload type of a FlexFEC repair stream
+func flexFECPayloadType(codecs []CodecInfo) (uint8, bool) {
+	for _, c := range codecs {
+		if strings.HasPrefix(strings.ToLower(c.Name), FlexFECMimeSubtype) {
+			return c.PayloadType, true
 		}
+	}
+	return 0, false
+}
 
-		lineType := line[0]
-		value := line[2:]
-
-		switch lineType {
-		case 'c':
-			// c=IN IP4 <ip>
-			parts := splitFields(value)
-			if len(parts) >= 3 {
-				parsed.ConnectionIP = parts[2]
-				if idx := indexOf(parsed.ConnectionIP, "/"); idx != -1 {
-					parsed.ConnectionIP = parsed.ConnectionIP[:idx]
-				}
-			}
+func (p *parsedSDPInfo) codecInfos() []CodecInfo {
+	codecs := make([]CodecInfo, 0, len(p.Codecs))
+	for _, c := range p.Codecs {
+		codecs = append(codecs, CodecInfo{
+			PayloadType: c.PayloadType,
+			Name:        c.Name,
+			ClockRate:   c.ClockRate,
+			Channels:    c.Channels,
+			Fmtp:        c.Fmtp,
+		})
+	}
+	return codecs
+}
 
-		case 'm':
-			// m=<media> <port> <proto> <fmt> ...
-			parts := splitFields(value)
-			if len(parts) >= 4 {
-				parsed.MediaType = parts[0]
-				parsed.MediaPort = parseInt(parts[1])
-				parsed.Protocol = parts[2]
-				for _, pt := range parts[3:] {
-					if ptInt := parseInt(pt); ptInt >= 0 {
-						payloadTypes = append(payloadTypes, ptInt)
-					}
-				}
-			}
+// parseSDP parses an SDP string and extracts the media section Karl relays
+func (l *NGSocketListener) parseSDP(raw string) (*parsedSDPInfo, error) {
+	desc, err := ParseSDP(raw)
+	if err != nil {
+		return nil, err
+	}
+	media := PrimaryMedia(desc)
+	if media == nil {
+		return nil, fmt.Errorf("%w: no media section", ErrInvalidSDP)
+	}
 
-		case 'a':
-			l.parseSDPAttribute(value, parsed)
+	parsed := &parsedSDPInfo{
+		MediaType:    media.MediaName.Media,
+		MediaPort:    media.MediaName.Port.Value,
+		Protocol:     SDPProtocol(media),
+		ConnectionIP: SDPConnectionAddress(desc, media),
+		Direction:    SDPDirection(desc, media),
+		RTCPMux:      HasSDPAttribute(desc, media, "rtcp-mux"),
+		Codecs:       make([]sdpCodecInfo, 0),
+		desc:         desc,
+	}
+
+	parsed.ICEUfrag, _ = SDPAttribute(desc, media, "ice-ufrag")
+	parsed.ICEPwd, _ = SDPAttribute(desc, media, "ice-pwd")
+	parsed.HasICE = parsed.ICEUfrag != "" || parsed.ICEPwd != ""
+	parsed.ICELite = HasSDPAttribute(desc, media, "ice-lite")
+	for _, attr := range media.Attributes {
+		if attr.Key == "candidate" {
+			parsed.Candidates = append(parsed.Candidates, attr.Value)
+		}
+	}
+	parsed.Fingerprint, parsed.HasDTLS = SDPAttribute(desc, media, "fingerprint")
+	parsed.Setup, _ = SDPAttribute(desc, media, "setup")
+	parsed.ZRTPHash, _ = SDPAttribute(desc, media, "zrtp-hash")
+	parsed.CryptoSuite, parsed.CryptoKey, parsed.HasSRTP = SDPCrypto(media)
+	parsed.SSRC, parsed.FECSSRC = SDPSSRCs(media)
+	parsed.RTCPPort, parsed.RTCPIP, _ = SDPRTCPAddress(media)
+	parsed.Extmap = SDPExtmap(desc, media)
+	if ptime, ok := SDPAttribute(desc, media, "ptime"); ok {
+		if ms, err := strconv.ParseFloat(strings.TrimSpace(ptime), 64); err == nil && ms > 0 {
+			parsed.Ptime = int(ms)
 		}
 	}
 
-	// Add static codecs for payload types without rtpmap
-	l.fillStaticCodecs(parsed, payloadTypes)
+	for _, c := range SDPCodecs(media) {
+		parsed.Codecs = append(parsed.Codecs, sdpCodecInfo(c))
+	}
+
+	for i, m := range desc.MediaDescriptions {
+		if m == media {
+			parsed.primary = i
+		}
+		stream := sdpStreamInfo{
+			MediaType:    m.MediaName.Media,
+			MediaPort:    m.MediaName.Port.Value,
+			Protocol:     SDPProtocol(m),
+			ConnectionIP: SDPConnectionAddress(desc, m),
+			Direction:    SDPDirection(desc, m),
+			RTCPMux:      HasSDPAttribute(desc, m, "rtcp-mux"),
+			Codecs:       SDPCodecs(m),
+			Extmap:       SDPExtmap(desc, m),
+		}
+		stream.MID, _ = m.Attribute("mid")
+		stream.SSRC, _ = SDPSSRCs(m)
+		stream.RTCPPort, _, _ = SDPRTCPAddress(m)
+		stream.Crypto, _ = m.Attribute("crypto")
+		parsed.Streams = append(parsed.Streams, stream)
+	}
 
 	return parsed, nil
 }
 
-// parseSDPAttribute parses an SDP attribute line
-func (l *NGSocketListener) parseSDPAttribute(value string, parsed *parsedSDPInfo) {
-	colonIdx := indexOf(value, ":")
-	attrName := value
-	attrValue := ""
-	if colonIdx != -1 {
-		attrName = value[:colonIdx]
-		attrValue = value[colonIdx+1:]
-	}
-
-	switch attrName {
-	case "rtpmap":
-		// a=rtpmap:<pt> <encoding>/<clock>[/<channels>]
-		parts := splitFields(attrValue)
-		if len(parts) >= 2 {
-			pt := parseInt(parts[0])
-			codecParts := splitBy(parts[1], "/")
-			if len(codecParts) >= 2 {
-				codec := sdpCodecInfo{
-					PayloadType: uint8(pt),
-					Name:        codecParts[0],
-					ClockRate:   uint32(parseInt(codecParts[1])),
-					Channels:    1,
-				}
-				if len(codecParts) >= 3 {
-					codec.Channels = parseInt(codecParts[2])
-				}
-				parsed.Codecs = append(parsed.Codecs, codec)
-			}
+// buildResponseSDP rewrites the peer's SDP so the other side sends its media
+// to Karl: Karl's address and each section's ports, and the ICE and DTLS
+// attributes the other side's leg type expects. Directions pass through for
+// hold/resume. crypto is Karl's end of the other side's protection when Karl
+// bridges the call's transports, and nil when they pass through.
+func (l *NGSocketListener) buildResponseSDP(parsed *parsedSDPInfo, leg *CallLeg, localIP string, flags []string, offer bool, crypto *MediaCrypto) string {
+	webrtc := strings.HasPrefix(l.determineProtocol(parsed, flags), "UDP/TLS/")
+	if crypto != nil {
+		webrtc = crypto.Mode == CryptoDTLS
+	}
+
+	rw := &SDPRewrite{
+		LocalIP:       localIP,
+		ReplaceOrigin: containsFlag(flags, "replace-origin"),
+	}
+
+	// Karl runs ICE-lite towards WebRTC peers and peers that spoke ICE; the
+	// SDP's author's ICE says nothing of a bridged recipient
+	ice := parsed.HasICE || webrtc || containsFlag(flags, "ICE=force")
+	if crypto != nil {
+		ice = webrtc || containsFlag(flags, "ICE=force")
+	}
+	if !containsFlag(flags, "ICE=remove") && ice {
+		rw.ICE = leg.LocalICE
+		rw.Candidates = l.iceCandidates(leg, localIP)
+		if l.config.Transport.TCPEnabled {
+			rw.TCPPort = l.config.Transport.TCPPort
 		}
+	}
 
-	case "fmtp":
-		parts := splitFields(attrValue)
-		if len(parts) >= 2 {
-			pt := parseInt(parts[0])
-			fmtp := attrValue[len(parts[0])+1:]
-			for i := range parsed.Codecs {
-				if int(parsed.Codecs[i].PayloadType) == pt {
-					parsed.Codecs[i].Fmtp = fmtp
-					break
-				}
+	// DTLS-SRTP passes through end to end; a DTLS party of a bridged call
+	// gets Karl's certificate
+	if crypto != nil {
+		if crypto.Mode == CryptoDTLS {
+			if certs, err := DefaultDTLSCertificates(); err == nil {
+				rw.DTLS = true
+				rw.Fingerprint = certs.SDPFingerprint()
+				rw.Setup = crypto.Setup
 			}
 		}
+	} else if !containsFlag(flags, "DTLS=off") && parsed.HasDTLS {
+		rw.DTLS = true
+	}
 
-	case "ice-ufrag":
-		parsed.HasICE = true
-		parsed.ICEUfrag = attrValue
+	// ZRTP passes through end to end, and its media is relayed as sent; a
+	// ZRTP party of a bridged call gets the hash of Karl's Hello
+	zrtp := crypto == nil && parsed.ZRTPHash != ""
+	rw.StripZRTP = crypto != nil
 
-	case "ice-pwd":
-		parsed.HasICE = true
-		parsed.ICEPwd = attrValue
+	// RTP header extensions pass through, each leg's mapped to the other's
+	// identifiers; the answerer of an SDP without them is sent none
+	rw.StripExtmap = containsFlag(flags, "strip-extmap")
 
-	case "fingerprint":
-		parsed.HasDTLS = true
-		parsed.Fingerprint = attrValue
+	sdesOff := containsFlag(flags, "SDES=off") || containsFlag(flags, "SDES-off")
+	rtcpMux := webrtc || containsFlag(flags, "rtcp-mux-offer") || containsFlag(flags, "rtcp-mux-require")
+	rtcpDemux := containsFlag(flags, "rtcp-mux-demux")
+	parsedFlags := ng.ParseFlags(flags)
+	transcodeNames := parsedFlags.TranscodeCodecs
 
-	case "setup":
-		parsed.Setup = attrValue
+	// ptime asks the peer receiving this SDP for another packet time; Karl
+	// re-frames the media it sends back to what the SDP's author asked for
+	ptime := 0
+	if parsedFlags.Ptime > 0 && !parsedFlags.PtimeReverse {
+		ptime = parsedFlags.Ptime
+	}
 
-	case "crypto":
-		parsed.HasSRTP = true
-		// Parse: <tag> <suite> inline:<key>
-		parts := splitFields(attrValue)
-		if len(parts) >= 3 {
-			parsed.CryptoSuite = parts[1]
-			if hasPrefix(parts[2], "inline:") {
-				parsed.CryptoKey = parts[2][7:]
-			}
+	rw.Media = make([]SDPMediaRewrite, len(parsed.Streams))
+	for i, section := range parsed.Streams {
+		if i >= len(leg.Streams) || section.MediaPort == 0 {
+			continue
+		}
+		localPort, localRTCPPort := leg.Streams[i].LocalPort, leg.Streams[i].LocalRTCPPort
+		if i == parsed.primary {
+			localPort, localRTCPPort = leg.LocalPort, leg.LocalRTCPPort
+		}
+		if localPort == 0 {
+			continue
 		}
+		mrw := &rw.Media[i]
+		mrw.RTPPort = localPort
+		mrw.Protocol = section.Protocol
 
-	case "rtcp-mux":
-		parsed.RTCPMux = true
+		// T.38 and data channels keep their transport and have no RTCP
+		if !IsRTPProtocol(section.Protocol) {
+			continue
+		}
+		mrw.Protocol = transportProtocol(section.Protocol, parsed.HasDTLS, section.Crypto != "", flags)
+		if crypto != nil {
+			mrw.Protocol = crypto.Protocol
+		}
+		mrw.RTCPPort = localRTCPPort
+		if mrw.RTCPPort == 0 {
+			mrw.RTCPPort = mrw.RTPPort + 1
+		}
 
-	case "sendrecv", "sendonly", "recvonly", "inactive":
-		parsed.Direction = attrName
-	}
-}
+		// WebRTC requires rtcp-mux (RFC 8834)
+		mrw.RTCPMux = (section.RTCPMux || rtcpMux) && !rtcpDemux
 
-// fillStaticCodecs adds codec info for well-known static payload types
-func (l *NGSocketListener) fillStaticCodecs(parsed *parsedSDPInfo, payloadTypes []int) {
-	existing := make(map[uint8]bool)
-	for _, c := range parsed.Codecs {
-		existing[c.PayloadType] = true
-	}
+		// SDES-SRTP; after a key rotation the primary section carries Karl's
+		// new key, and a bridged SDES party gets Karl's own key
+		if crypto != nil {
+			if crypto.Mode == CryptoSDES {
+				mrw.Crypto = crypto.Tag + " " + crypto.Suite + " inline:" + crypto.LocalKey
+			}
+			if crypto.Mode == CryptoZRTP && i == parsed.primary {
+				mrw.ZRTPHash = crypto.ZRTPHash
+			}
+		} else if section.Crypto != "" && !rw.DTLS && !sdesOff {
+			mrw.Crypto = section.Crypto
+			if i == parsed.primary {
+				mrw.Crypto = "1 " + parsed.CryptoSuite + " inline:" + parsed.CryptoKey
+			}
+		}
 
-	staticCodecs := map[int]sdpCodecInfo{
-		0:  {PayloadType: 0, Name: "PCMU", ClockRate: 8000, Channels: 1},
-		8:  {PayloadType: 8, Name: "PCMA", ClockRate: 8000, Channels: 1},
-		9:  {PayloadType: 9, Name: "G722", ClockRate: 8000, Channels: 1},
-		18: {PayloadType: 18, Name: "G729", ClockRate: 8000, Channels: 1},
-	}
+		// Only keep a FlexFEC repair stream when FEC is enabled
+		if fecPT, ok := flexFECPayloadType(section.Codecs); ok && !l.config.GetFECConfig().Enabled {
+			mrw.DropPayloads = []uint8{fecPT}
+		}
+		if offer {
+			mrw.DropPayloads = append(mrw.DropPayloads, strippedPayloads(section.Codecs, parsedFlags)...)
+		}
 
-	for _, pt := range payloadTypes {
-		if !existing[uint8(pt)] {
-			if codec, ok := staticCodecs[pt]; ok {
-				parsed.Codecs = append(parsed.Codecs, codec)
+		if i == parsed.primary && section.MediaType == "audio" {
+			mrw.Ptime = ptime
+
+			// codec-transcode offers the callee codecs Karl converts to,
+			// unless the call is relayed as sent or encrypted end to end
+			if offer && parsedFlags.TranscodeMode != ng.TranscodeNever && !zrtp {
+				mrw.AddCodecs = TranscodeOfferCodecs(section.Codecs, transcodeNames)
 			}
 		}
+		if section.MediaType == "video" && offer && parsedFlags.TranscodeMode != ng.TranscodeNever && !zrtp &&
+			l.config.GetVideoTranscodeConfig().Enabled {
+			mrw.AddCodecs = TranscodeOfferVideoCodecs(section.Codecs, transcodeNames)
+		}
 	}
-}
-
-// buildResponseSDP builds an SDP response with Karl's address and ports
-func (l *NGSocketListener) buildResponseSDP(parsed *parsedSDPInfo, localIP string, rtpPort int, flags []string) string {
-	var sb []byte
 
-	// Check flags
-	removeICE := containsFlag(flags, "ICE=remove")
-	forceICE := containsFlag(flags, "ICE=force")
-	replaceOrigin := containsFlag(flags, "replace-origin")
-	replaceConnection := containsFlag(flags, "replace-session-connection")
+	return RewriteSDP(parsed.desc, rw)
+}
 
-	// Version
-	sb = append(sb, "v=0\r\n"...)
+// mediaStreams describes the relayed sections of a leg for an NG response
+func (l *NGSocketListener) mediaStreams(leg *CallLeg, localIP string, parsed *parsedSDPInfo, flags []string) []ng.StreamInfo {
+	streams := make([]ng.StreamInfo, 0, len(leg.Streams))
+	for i, stream := range leg.Streams {
+		if stream.LocalPort == 0 || i >= len(parsed.Streams) {
+			continue
+		}
+		protocol := parsed.Streams[i].Protocol
+		if IsRTPProtocol(protocol) {
+			protocol = transportProtocol(protocol, parsed.HasDTLS, parsed.Streams[i].Crypto != "", flags)
+		}
+		streams = append(streams, ng.StreamInfo{
+			LocalIP:       localIP,
+			LocalPort:     stream.LocalPort,
+			LocalRTCPPort: stream.LocalRTCPPort,
+			MediaType:     string(stream.MediaType),
+			Protocol:      protocol,
+			Index:         i,
+		})
+	}
+	return streams
+}
 
-	// Origin
-	sb = append(sb, "o=karl 1 1 IN IP4 "...)
-	sb = append(sb, localIP...)
-	sb = append(sb, "\r\n"...)
+// determineProtocol determines the RTP protocol based on SDP and flags
+func (l *NGSocketListener) determineProtocol(parsed *parsedSDPInfo, flags []string) string {
+	return transportProtocol(parsed.Protocol, parsed.HasDTLS, parsed.HasSRTP, flags)
+}
 
-	// Session name
-	sb = append(sb, "s=Karl Media Server\r\n"...)
+// sdpCryptoMode returns how the author of an SDP protects its media. An
+// a=zrtp-hash only counts when zrtp is set, since ZRTP otherwise passes
+// through end to end
+func sdpCryptoMode(parsed *parsedSDPInfo, zrtp bool) CryptoMode {
+	switch {
+	case parsed.HasDTLS:
+		return CryptoDTLS
+	case parsed.HasSRTP:
+		return CryptoSDES
+	case zrtp && parsed.ZRTPHash != "":
+		return CryptoZRTP
+	}
+	return CryptoPlain
+}
 
-	// Connection
-	if replaceConnection || replaceOrigin {
-		sb = append(sb, "c=IN IP4 "...)
-		sb = append(sb, localIP...)
-		sb = append(sb, "\r\n"...)
-	} else if parsed.ConnectionIP != "" {
-		sb = append(sb, "c=IN IP4 "...)
-		sb = append(sb, parsed.ConnectionIP...)
-		sb = append(sb, "\r\n"...)
-	} else {
-		sb = append(sb, "c=IN IP4 "...)
-		sb = append(sb, localIP...)
-		sb = append(sb, "\r\n"...)
+// avpProtocol returns the plain RTP profile of an m= section's transport,
+// which ZRTP runs over, and savpProtocol its SRTP profile
+func avpProtocol(protocol string) string {
+	if strings.HasSuffix(protocol, "F") {
+		return "RTP/AVPF"
 	}
+	return "RTP/AVP"
+}
 
-	// Timing
-	sb = append(sb, "t=0 0\r\n"...)
-
-	// Media line
-	protocol := l.determineProtocol(parsed, flags)
-	sb = append(sb, "m="...)
-	sb = append(sb, parsed.MediaType...)
-	sb = append(sb, " "...)
-	sb = append(sb, intToString(rtpPort)...)
-	sb = append(sb, " "...)
-	sb = append(sb, protocol...)
-
-	for _, c := range parsed.Codecs {
-		sb = append(sb, " "...)
-		sb = append(sb, intToString(int(c.PayloadType))...)
+func savpProtocol(protocol string) string {
+	if strings.HasSuffix(protocol, "F") {
+		return "RTP/SAVPF"
 	}
-	sb = append(sb, "\r\n"...)
+	return "RTP/SAVP"
+}
 
-	// rtpmap and fmtp for each codec
-	for _, c := range parsed.Codecs {
-		sb = append(sb, "a=rtpmap:"...)
-		sb = append(sb, intToString(int(c.PayloadType))...)
-		sb = append(sb, " "...)
-		sb = append(sb, c.Name...)
-		sb = append(sb, "/"...)
-		sb = append(sb, intToString(int(c.ClockRate))...)
-		if c.Channels > 1 {
-			sb = append(sb, "/"...)
-			sb = append(sb, intToString(c.Channels)...)
-		}
-		sb = append(sb, "\r\n"...)
+// forcedTransport returns the protocol a flag or transport-protocol asks
+// the recipient of an SDP to use, "" when none does
+func forcedTransport(flags []string) string {
+	if protocol := transportProtocol("", false, false, flags); IsRTPProtocol(protocol) {
+		return protocol
+	}
+	return ""
+}
 
-		if c.Fmtp != "" {
-			sb = append(sb, "a=fmtp:"...)
-			sb = append(sb, intToString(int(c.PayloadType))...)
-			sb = append(sb, " "...)
-			sb = append(sb, c.Fmtp...)
-			sb = append(sb, "\r\n"...)
+// offerCrypto decides how the media of an offer is protected. When a
+// protocol flag or transport-protocol asks the answerer for another
+// protection than the offerer's, such as DTLS-SRTP towards a browser for
+// a PBX sending plain RTP, Karl bridges them: it ends the offerer's
+// protection and its own towards the answerer, and returns the latter.
+// ZRTP=terminate has Karl end a ZRTP offerer's ZRTP, towards SDES-SRTP
+// unless a protocol flag says otherwise, or run ZRTP with a plain RTP
+// answerer for another offerer. Otherwise media passes through and it
+// returns nil
+func (l *NGSocketListener) offerCrypto(session *MediaSession, leg *CallLeg, parsed *parsedSDPInfo, flags []string) (*MediaCrypto, error) {
+	terminate := containsFlag(flags, "ZRTP=terminate")
+	target := forcedTransport(flags)
+	from, to := sdpCryptoMode(parsed, terminate), protocolCryptoMode(target)
+	switch {
+	case from == CryptoZRTP && target == "":
+		target, to = savpProtocol(parsed.Protocol), CryptoSDES
+	case terminate && from != CryptoZRTP && to == CryptoPlain:
+		if target == "" {
+			target = avpProtocol(parsed.Protocol)
 		}
+		to = CryptoZRTP
+	}
+	if target == "" || from == to || !IsRTPProtocol(parsed.Protocol) {
+		l.sessionRegistry.SetMediaCrypto(session, nil, nil)
+		return nil, nil
 	}
 
-	// Direction
-	sb = append(sb, "a="...)
-	sb = append(sb, parsed.Direction...)
-	sb = append(sb, "\r\n"...)
+	session.RLock()
+	caller, callee, ice := session.CallerCrypto, session.CalleeCrypto, leg.LocalICE
+	session.RUnlock()
 
-	// RTCP-mux
-	if parsed.RTCPMux || containsFlag(flags, "rtcp-mux-offer") {
-		sb = append(sb, "a=rtcp-mux\r\n"...)
+	// The offerer's end keeps its keys across re-INVITEs until its own
+	// keying changes
+	tag, suite, key := "", "", ""
+	if parsed.primary < len(parsed.desc.MediaDescriptions) {
+		media := parsed.desc.MediaDescriptions[parsed.primary]
+		suite, key, _ = SDPCrypto(media)
+		if value, ok := media.Attribute("crypto"); ok {
+			tag, _, _ = strings.Cut(value, " ")
+		}
 	}
-
-	// ICE attributes (unless removing)
-	if !removeICE && (parsed.HasICE || forceICE) {
-		if parsed.ICEUfrag != "" {
-			sb = append(sb, "a=ice-ufrag:"...)
-			sb = append(sb, parsed.ICEUfrag...)
-			sb = append(sb, "\r\n"...)
+	if caller == nil || caller.Mode != from || !strings.EqualFold(caller.Suite, suite) ||
+		caller.RemoteFingerprint != parsed.Fingerprint || (from == CryptoZRTP && caller.RemoteZRTPHash != parsed.ZRTPHash) {
+		var err error
+		if caller, err = newMediaCrypto(from, parsed.Protocol, suite); err != nil {
+			return nil, err
+		}
+	}
+	switch from {
+	case CryptoSDES:
+		caller.Tag = tag
+		if err := caller.SetRemoteKey(key); err != nil {
+			return nil, err
 		}
-		if parsed.ICEPwd != "" {
-			sb = append(sb, "a=ice-pwd:"...)
-			sb = append(sb, parsed.ICEPwd...)
-			sb = append(sb, "\r\n"...)
+	case CryptoDTLS:
+		caller.SetRemoteDTLS(parsed.Fingerprint, parsed.Setup)
+	case CryptoZRTP:
+		caller.SetRemoteZRTP(parsed.ZRTPHash)
+	}
+
+	// Karl's end towards the answerer, who gets the offerer leg's ICE
+	// credentials
+	if callee == nil || callee.Mode != to {
+		var err error
+		if callee, err = newMediaCrypto(to, target, ""); err != nil {
+			return nil, err
+		}
+	}
+	callee.Protocol = target
+	callee.SetICE(ice)
+	if to == CryptoDTLS {
+		if containsFlag(flags, "DTLS=active") {
+			callee.SetSetup("active")
+		} else if containsFlag(flags, "DTLS=passive") {
+			callee.SetSetup("passive")
 		}
 	}
 
-	// DTLS fingerprint
-	if parsed.HasDTLS && !containsFlag(flags, "DTLS=off") {
-		if parsed.Fingerprint != "" {
-			sb = append(sb, "a=fingerprint:"...)
-			sb = append(sb, parsed.Fingerprint...)
-			sb = append(sb, "\r\n"...)
+	l.sessionRegistry.SetMediaCrypto(session, caller, callee)
+	mediaCryptoBridges.WithLabelValues(string(from), string(to)).Inc()
+	return callee, nil
+}
+
+// answerCrypto completes a bridged call from the answer: it keys Karl's end
+// towards the answerer from the answer's SDP, and returns its end towards
+// the offerer for the answer Karl passes back. It returns nil when the call
+// is not bridged, or when the answer took the offerer's protection after all
+func (l *NGSocketListener) answerCrypto(session *MediaSession, leg *CallLeg, parsed *parsedSDPInfo, flags []string) (*MediaCrypto, error) {
+	session.RLock()
+	caller, callee := session.CallerCrypto, session.CalleeCrypto
+	session.RUnlock()
+	if caller == nil || callee == nil {
+		return nil, nil
+	}
+
+	// ZRTP need not be signalled: an answerer without a=zrtp-hash may still
+	// run it, and sends RTP in the clear until then
+	answered := sdpCryptoMode(parsed, callee.Mode == CryptoZRTP)
+	if answered == CryptoPlain && callee.Mode == CryptoZRTP && caller.Mode != CryptoPlain {
+		answered = CryptoZRTP
+	}
+	// and a ZRTP offerer's plain RTP transport may simply be accepted
+	if answered == CryptoPlain && caller.Mode == CryptoZRTP {
+		answered = CryptoZRTP
+	}
+	switch answered {
+	case caller.Mode:
+		l.sessionRegistry.SetMediaCrypto(session, nil, nil)
+		return nil, nil
+	case callee.Mode:
+	default:
+		return nil, fmt.Errorf("answer is %s where %s was offered", answered, callee.Mode)
+	}
+	switch answered {
+	case CryptoSDES:
+		if parsed.primary < len(parsed.desc.MediaDescriptions) {
+			_, key, _ := SDPCrypto(parsed.desc.MediaDescriptions[parsed.primary])
+			if err := callee.SetRemoteKey(key); err != nil {
+				return nil, err
+			}
 		}
-		if parsed.Setup != "" {
-			sb = append(sb, "a=setup:"...)
-			sb = append(sb, parsed.Setup...)
-			sb = append(sb, "\r\n"...)
+	case CryptoDTLS:
+		callee.SetRemoteDTLS(parsed.Fingerprint, parsed.Setup)
+	case CryptoZRTP:
+		callee.SetRemoteZRTP(parsed.ZRTPHash)
+	}
+
+	// Parties running ICE are answered with the credentials they were
+	// given: the offerer the answerer leg's and the answerer the offerer
+	// leg's. Karl's DTLS role in the answer may come from a flag
+	session.RLock()
+	offerer := session.CallerLeg
+	callerICE, calleeICE := leg.LocalICE, offerer.LocalICE
+	if offerer.ICECredentials == nil {
+		callerICE = nil
+	}
+	if leg.ICECredentials == nil {
+		calleeICE = nil
+	}
+	callerRemote, callerCandidates := offerer.ICECredentials, offerer.ICECandidates
+	calleeRemote, calleeCandidates := leg.ICECredentials, leg.ICECandidates
+	session.RUnlock()
+	caller.SetICE(callerICE)
+	callee.SetICE(calleeICE)
+
+	// A full ICE Karl controls the pairs of the answerer, whom it sent the
+	// offer, and of an ICE-lite offerer
+	caller.SetRemoteICE(callerRemote, callerCandidates, callerRemote != nil && callerRemote.Lite)
+	callee.SetRemoteICE(calleeRemote, calleeCandidates, true)
+	if caller.Mode == CryptoDTLS {
+		if containsFlag(flags, "DTLS=active") {
+			caller.SetSetup("active")
+		} else if containsFlag(flags, "DTLS=passive") {
+			caller.SetSetup("passive")
 		}
 	}
 
-	// SRTP crypto
-	if parsed.HasSRTP && !containsFlag(flags, "SDES=off") && !parsed.HasDTLS {
-		sb = append(sb, "a=crypto:1 "...)
-		sb = append(sb, parsed.CryptoSuite...)
-		sb = append(sb, " inline:"...)
-		sb = append(sb, parsed.CryptoKey...)
-		sb = append(sb, "\r\n"...)
+	l.sessionRegistry.SetMediaCrypto(session, caller, callee)
+
+	// An active Karl starts the handshakes with parties that do not run
+	// ICE, and a ZRTP Karl sends its Hello
+	session.RLock()
+	callerConn, callerAddr := leg.Conn, offerer.mediaAddr()
+	calleeConn, calleeAddr := offerer.Conn, leg.mediaAddr()
+	session.RUnlock()
+	caller.Start(callerConn, callerAddr)
+	callee.Start(calleeConn, calleeAddr)
+	return caller, nil
+}
+
+// reofferCrypto keeps a bridged call's transports through an offer/answer
+// the answerer started: both of Karl's ends keep their modes and keys, the
+// end towards the party whose SDP this is taking a new SDES key from it.
+// It returns Karl's end towards the other party, for the SDP passed on, or
+// nil when the call is not bridged
+func (l *NGSocketListener) reofferCrypto(session *MediaSession, parsed *parsedSDPInfo, fromCaller bool) (*MediaCrypto, error) {
+	session.RLock()
+	sender, receiver := session.CalleeCrypto, session.CallerCrypto
+	if fromCaller {
+		sender, receiver = receiver, sender
+	}
+	session.RUnlock()
+	if sender == nil || receiver == nil {
+		return nil, nil
+	}
+
+	if sender.Mode == CryptoSDES && parsed.primary < len(parsed.desc.MediaDescriptions) {
+		if _, key, _ := SDPCrypto(parsed.desc.MediaDescriptions[parsed.primary]); key != "" {
+			if err := sender.SetRemoteKey(key); err != nil {
+				return nil, err
+			}
+		}
 	}
+	return receiver, nil
+}
 
-	return string(sb)
+// trackZRTP marks a call whose parties signalled ZRTP and whose media
+// passes through, so it is relayed unchanged. A bridged call is not: Karl
+// ends any ZRTP in it
+func (l *NGSocketListener) trackZRTP(session *MediaSession, parsed *parsedSDPInfo, crypto *MediaCrypto) {
+	switch {
+	case crypto != nil:
+		l.sessionRegistry.SetZRTP(session, false)
+	case parsed.ZRTPHash != "":
+		l.sessionRegistry.SetZRTP(session, true)
+	}
 }
 
-// determineProtocol determines the RTP protocol based on SDP and flags
-func (l *NGSocketListener) determineProtocol(parsed *parsedSDPInfo, flags []string) string {
+// transportProtocol determines the RTP protocol of an m= section
+func transportProtocol(protocol string, hasDTLS, hasSRTP bool, flags []string) string {
 	// Check explicit protocol flags
 	for _, flag := range flags {
 		switch flag {
@@ -1155,124 +2647,79 @@ func (l *NGSocketListener) determineProtocol(parsed *parsedSDPInfo, flags []stri
 			return "RTP/SAVP"
 		case "RTP/SAVPF":
 			return "RTP/SAVPF"
+		case "UDP/TLS/RTP/SAVP":
+			return "UDP/TLS/RTP/SAVP"
+		case "UDP/TLS/RTP/SAVPF":
+			return "UDP/TLS/RTP/SAVPF"
 		}
 	}
 
 	// Determine based on SDP content
-	if parsed.HasDTLS {
+	if hasDTLS {
 		return "UDP/TLS/RTP/SAVPF"
 	}
-	if parsed.HasSRTP {
+	if hasSRTP {
 		return "RTP/SAVP"
 	}
-	return parsed.Protocol
+	return protocol
 }
 
-// Helper functions for SDP parsing
-func splitSDPLines(sdp string) []string {
-	// Normalize line endings and split
-	result := make([]string, 0)
-	start := 0
-	for i := 0; i < len(sdp); i++ {
-		if sdp[i] == '\n' {
-			line := sdp[start:i]
-			if len(line) > 0 && line[len(line)-1] == '\r' {
-				line = line[:len(line)-1]
-			}
-			if len(line) > 0 {
-				result = append(result, line)
-			}
-			start = i + 1
+// requestFlags returns the request's flags with its transcode list, ptime
+// and transport-protocol folded in as codec-transcode, transcode mode,
+// ptime and protocol flags
+func requestFlags(req *ng.NGRequest) []string {
+	if len(req.Transcode) == 0 && req.Ptime == 0 && req.Transport == "" {
+		return req.Flags
+	}
+	flags := append([]string(nil), req.Flags...)
+	for _, name := range req.Transcode {
+		if ng.IsTranscodeMode(name) {
+			flags = append(flags, "transcode="+name)
+			continue
 		}
+		flags = append(flags, "codec-transcode="+name)
 	}
-	if start < len(sdp) {
-		line := sdp[start:]
-		if len(line) > 0 && line[len(line)-1] == '\r' {
-			line = line[:len(line)-1]
-		}
-		if len(line) > 0 {
-			result = append(result, line)
-		}
+	if req.Ptime > 0 {
+		flags = append(flags, "ptime="+strconv.Itoa(req.Ptime))
 	}
-	return result
-}
-
-func splitFields(s string) []string {
-	result := make([]string, 0)
-	start := 0
-	inField := false
-	for i := 0; i < len(s); i++ {
-		if s[i] == ' ' || s[i] == '\t' {
-			if inField {
-				result = append(result, s[start:i])
-				inField = false
-			}
-		} else {
-			if !inField {
-				start = i
-				inField = true
-			}
-		}
-	}
-	if inField {
-		result = append(result, s[start:])
+	if req.Transport != "" {
+		flags = append(flags, req.Transport)
 	}
-	return result
+	return flags
 }
 
-func splitBy(s, sep string) []string {
-	result := make([]string, 0)
-	start := 0
-	for i := 0; i <= len(s)-len(sep); i++ {
-		if s[i:i+len(sep)] == sep {
-			result = append(result, s[start:i])
-			start = i + len(sep)
-			i += len(sep) - 1
+// strippedPayloads returns the payload types of the codecs an offer's
+// codec-strip flags remove: those codec-strip names, and with
+// codec-strip-all those codec-except does not name
+func strippedPayloads(codecs []CodecInfo, pf *ng.ParsedFlags) []uint8 {
+	stripAll := pf.StripAllCodecs || containsCodecName(pf.StripCodecs, "all")
+	var stripped []uint8
+	for _, codec := range codecs {
+		if containsCodecName(pf.StripCodecs, codec.Name) || stripAll && !containsCodecName(pf.ExceptCodecs, codec.Name) {
+			stripped = append(stripped, codec.PayloadType)
 		}
 	}
-	result = append(result, s[start:])
-	return result
+	return stripped
 }
 
-func indexOf(s, substr string) int {
-	for i := 0; i <= len(s)-len(substr); i++ {
-		if s[i:i+len(substr)] == substr {
-			return i
-		}
-	}
-	return -1
-}
-
-func hasPrefix(s, prefix string) bool {
-	return len(s) >= len(prefix) && s[:len(prefix)] == prefix
-}
-
-func parseInt(s string) int {
-	result := 0
-	for _, c := range s {
-		if c >= '0' && c <= '9' {
-			result = result*10 + int(c-'0')
-		} else {
-			break
+// containsCodecName reports whether names holds a codec name, in any case
+func containsCodecName(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
 		}
 	}
-	return result
+	return false
 }
 
-func intToString(n int) string {
-	if n == 0 {
-		return "0"
-	}
-	result := make([]byte, 0, 10)
-	for n > 0 {
-		result = append(result, byte('0'+n%10))
-		n /= 10
-	}
-	// Reverse
-	for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
-		result[i], result[j] = result[j], result[i]
+// receivePtime returns the packet time Karl re-frames media to when sending
+// it to the author of an SDP: its a=ptime, or the ptime option when
+// ptime-reverse applies it to this direction
+func receivePtime(parsed *parsedSDPInfo, flags []string) int {
+	if pf := ng.ParseFlags(flags); pf.PtimeReverse && pf.Ptime > 0 {
+		return pf.Ptime
 	}
-	return string(result)
+	return parsed.Ptime
 }
 
 func containsFlag(flags []string, flag string) bool {
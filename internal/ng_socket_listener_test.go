@@ -0,0 +1,363 @@
+package internal
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	ng "karl/internal/ng_protocol"
+)
+
+// startNGSocket starts a listener on a Unix socket in a temporary directory
+func startNGSocket(t *testing.T, ngConfig *NGProtocolConfig) (*NGSocketListener, string) {
+	t.Helper()
+	ngConfig.Enabled = true
+	ngConfig.SocketPath = filepath.Join(t.TempDir(), "karl.sock")
+	config := &Config{Integration: IntegrationConfig{MediaIP: "127.0.0.1"}, NGProtocol: ngConfig}
+
+	l := NewNGSocketListener(config, NewSessionRegistry(time.Hour))
+	if err := l.Start(); err != nil {
+		t.Fatalf("failed to start NG listener: %v", err)
+	}
+	t.Cleanup(func() { l.Stop() })
+	return l, ngConfig.SocketPath
+}
+
+// sendUnix sends one NG message over the socket and returns the response
+func sendUnix(t *testing.T, path string, msg []byte) string {
+	t.Helper()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	resp, _ := io.ReadAll(conn)
+	return string(resp)
+}
+
+func TestNGSocketListener_SocketMode(t *testing.T) {
+	_, path := startNGSocket(t, &NGProtocolConfig{SocketMode: "0660"})
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("socket missing: %v", err)
+	}
+	if mode := info.Mode().Perm(); mode != 0660 {
+		t.Errorf("expected mode 0660, got %o", mode)
+	}
+
+	if err := ValidateNGProtocolConfig(&NGProtocolConfig{SocketMode: "0999"}); err == nil {
+		t.Error("expected an invalid mode to be rejected")
+	}
+}
+
+func TestNGSocketListener_AllowedUIDs(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on Linux")
+	}
+	ping := []byte("c1 d7:command4:pinge")
+
+	_, path := startNGSocket(t, &NGProtocolConfig{AllowedUIDs: []int{os.Getuid()}})
+	if resp := sendUnix(t, path, ping); !strings.Contains(resp, "pong") {
+		t.Errorf("expected the allowed uid to get pong, got %q", resp)
+	}
+
+	_, path = startNGSocket(t, &NGProtocolConfig{AllowedUIDs: []int{os.Getuid() + 1}})
+	if resp := sendUnix(t, path, ping); resp != "" {
+		t.Errorf("expected another uid to be disconnected, got %q", resp)
+	}
+}
+
+func TestNGSocketListener_RequiresSignature(t *testing.T) {
+	key := "proxy-secret"
+	l, path := startNGSocket(t, &NGProtocolConfig{HMACKey: key})
+	dict := []byte("d7:command4:pinge")
+
+	if resp := sendUnix(t, path, ng.SignMessage("c1", dict, []byte(key))); !strings.Contains(resp, "pong") {
+		t.Errorf("expected a signed ping to get pong, got %q", resp)
+	}
+	if resp := sendUnix(t, path, append([]byte("c2 "), dict...)); !strings.Contains(resp, ng.ErrReasonSignature) {
+		t.Errorf("expected an unsigned ping to be rejected, got %q", resp)
+	}
+
+	// Forwarded messages keep the signature behind the dispatch prefix
+	forwarded := append([]byte(dispatchCookiePrefix), ng.SignMessage("c3", dict, []byte(key))...)
+	if resp := l.processMessage(forwarded, nil); !strings.Contains(string(resp), "pong") {
+		t.Errorf("expected a forwarded signed ping to get pong, got %q", resp)
+	}
+
+	// A message received again is answered with its first response
+	signed := ng.SignMessage("c4", dict, []byte(key))
+	first := l.processMessage(signed, nil)
+	if again := l.processMessage(signed, nil); string(again) != string(first) {
+		t.Errorf("expected a repeated message to get %q, got %q", first, again)
+	}
+}
+
+func TestNGSocketListener_ReplayAfterHandlerPanic(t *testing.T) {
+	key := "proxy-secret"
+	l, _ := startNGSocket(t, &NGProtocolConfig{HMACKey: key})
+	l.mu.Lock()
+	l.handlers[ng.CmdPing] = func(req *ng.NGRequest) (*ng.NGResponse, error) {
+		panic("handler bug")
+	}
+	l.mu.Unlock()
+
+	// The failed message is answered, and so is its retransmission
+	// instead of waiting for a response that never comes
+	signed := ng.SignMessage("c1", []byte("d7:command4:pinge"), []byte(key))
+	first := l.processMessage(signed, nil)
+	if !strings.Contains(string(first), ng.ErrReasonInternal) {
+		t.Fatalf("expected an internal error, got %q", first)
+	}
+	done := make(chan []byte)
+	go func() { done <- l.processMessage(signed, nil) }()
+	select {
+	case again := <-done:
+		if string(again) != string(first) {
+			t.Errorf("expected the retransmission to get %q, got %q", first, again)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("retransmission blocked waiting for the response")
+	}
+}
+
+func TestNGSocketListener_CalleeReInvite(t *testing.T) {
+	control, err := NewRTPControl(nil, nil)
+	if err != nil {
+		t.Fatalf("NewRTPControl failed: %v", err)
+	}
+	defer control.Stop()
+	forwardThroughPool(t, control)
+
+	manager, registry, _ := newTestSessionManager(t)
+	manager.SetMediaPortOpener(control.OpenMediaPorts)
+	registry.SetMediaSender(control.SendBatchFrom)
+	defer registry.SetMediaSender(nil)
+	listener := &NGSocketListener{sessionRegistry: registry, sessionManager: manager, config: &Config{}}
+
+	// The caller, the callee and the address the callee moves to
+	parties := make([]*net.UDPConn, 3)
+	for i := range parties {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		parties[i] = conn
+	}
+
+	offer := endpointSDP(parties[0]) + "a=ssrc:161 cname:caller\r\n"
+	if resp, err := listener.handleOffer(&ng.NGRequest{CallID: "reinvite-call", FromTag: "from-tag", SDP: offer}); err != nil || resp.Result != ng.ResultOK {
+		t.Fatalf("handleOffer failed: %v %+v", err, resp)
+	}
+	defer GetCodecNegotiator().RemoveCall("reinvite-call")
+	answer := endpointSDP(parties[1]) + "a=ssrc:177 cname:callee\r\n"
+	if resp, err := listener.handleAnswer(&ng.NGRequest{CallID: "reinvite-call", FromTag: "from-tag", ToTag: "to-tag", SDP: answer}); err != nil || resp.Result != ng.ResultOK {
+		t.Fatalf("handleAnswer failed: %v %+v", err, resp)
+	}
+	session := registry.GetSessionByCallID("reinvite-call")[0]
+	session.RLock()
+	callerLeg, calleeLeg := session.CallerLeg, session.CalleeLeg
+	session.RUnlock()
+
+	send := func(from *net.UDPConn, to *net.UDPConn, port int, ssrc uint32, seq uint16, ts uint32) *RTPPacket {
+		t.Helper()
+		packet := &RTPPacket{Version: 2, SSRC: ssrc, SequenceNumber: seq, Timestamp: ts, Payload: make([]byte, 160)}
+		got := &RTPPacket{}
+		if err := parseRTPPacketInto(relayed(t, from, to, port, marshalRTPPacket(packet, nil)), got); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	before := send(parties[1], parties[0], callerLeg.LocalPort, 177, 10, 1000)
+
+	// The callee re-INVITEs from a new address with a new SSRC; the tags
+	// come swapped
+	reoffer := endpointSDP(parties[2]) + "a=ssrc:178 cname:callee\r\n"
+	resp, err := listener.handleOffer(&ng.NGRequest{CallID: "reinvite-call", FromTag: "to-tag", ToTag: "from-tag", SDP: reoffer})
+	if err != nil || resp.Result != ng.ResultOK {
+		t.Fatalf("re-offer failed: %v %+v", err, resp)
+	}
+	if n := len(registry.GetSessionByCallID("reinvite-call")); n != 1 {
+		t.Fatalf("re-offer created a new session, %d in the call", n)
+	}
+	if !strings.Contains(resp.SDP, "m=audio "+strconv.Itoa(calleeLeg.LocalPort)+" ") {
+		t.Errorf("expected the caller to keep sending to port %d:\n%s", calleeLeg.LocalPort, resp.SDP)
+	}
+	if resp, err := listener.handleAnswer(&ng.NGRequest{CallID: "reinvite-call", FromTag: "to-tag", ToTag: "from-tag", SDP: offer}); err != nil || resp.Result != ng.ResultOK {
+		t.Fatalf("answer to the re-offer failed: %v %+v", err, resp)
+	}
+
+	// The caller sees the callee's new stream continue the old one, and
+	// its own media follows the callee to the new address
+	after := send(parties[2], parties[0], callerLeg.LocalPort, 178, 5000, 900000)
+	if after.SSRC != before.SSRC || after.SequenceNumber != before.SequenceNumber+1 {
+		t.Errorf("relayed SSRC %#x seq %d after the re-INVITE, want %#x seq %d",
+			after.SSRC, after.SequenceNumber, before.SSRC, before.SequenceNumber+1)
+	}
+	if int32(after.Timestamp-before.Timestamp) <= 0 {
+		t.Errorf("timestamp went from %d to %d", before.Timestamp, after.Timestamp)
+	}
+	send(parties[0], parties[2], calleeLeg.LocalPort, 161, 1, 160)
+}
+
+func TestNGSocketListener_ForkedCall(t *testing.T) {
+	control, err := NewRTPControl(nil, nil)
+	if err != nil {
+		t.Fatalf("NewRTPControl failed: %v", err)
+	}
+	defer control.Stop()
+	forwardThroughPool(t, control)
+
+	manager, registry, _ := newTestSessionManager(t)
+	manager.SetMediaPortOpener(control.OpenMediaPorts)
+	registry.SetMediaSender(control.SendBatchFrom)
+	defer registry.SetMediaSender(nil)
+	listener := &NGSocketListener{sessionRegistry: registry, sessionManager: manager, config: &Config{}}
+
+	// The caller and three branches the offer forked to
+	parties := make([]*net.UDPConn, 4)
+	for i := range parties {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		parties[i] = conn
+	}
+	caller := parties[0]
+
+	offer := endpointSDP(caller) + "a=ssrc:161 cname:caller\r\n"
+	if resp, err := listener.handleOffer(&ng.NGRequest{CallID: "forked-call", FromTag: "from-tag", SDP: offer}); err != nil || resp.Result != ng.ResultOK {
+		t.Fatalf("handleOffer failed: %v %+v", err, resp)
+	}
+	defer GetCodecNegotiator().RemoveCall("forked-call")
+	answer := func(branch int, flags []string) *ng.NGResponse {
+		t.Helper()
+		tag := "tag-" + strconv.Itoa(branch)
+		sdp := endpointSDP(parties[branch]) + "a=ssrc:" + strconv.Itoa(170+branch) + " cname:" + tag + "\r\n"
+		resp, err := listener.handleAnswer(&ng.NGRequest{CallID: "forked-call", FromTag: "from-tag", ToTag: tag,
+			ViaBranch: "z9hG4bK-" + tag, SDP: sdp, Flags: flags})
+		if err != nil || resp.Result != ng.ResultOK {
+			t.Fatalf("answer of branch %d failed: %v %+v", branch, err, resp)
+		}
+		return resp
+	}
+	early := []string{"early-media"}
+	first := answer(1, early)
+	mline := func(sdp string) string {
+		line, _, _ := strings.Cut(sdp[strings.Index(sdp, "m=audio"):], "\r\n")
+		return line
+	}
+	if second := answer(2, early); mline(second.SDP) != mline(first.SDP) {
+		t.Errorf("branches answered with %q and %q, want the same ports", mline(first.SDP), mline(second.SDP))
+	}
+	answer(3, early)
+
+	sessions := registry.GetSessionByCallID("forked-call")
+	if len(sessions) != 1 {
+		t.Fatalf("expected the branches to share one session, got %d", len(sessions))
+	}
+	session := sessions[0]
+	session.RLock()
+	callerLeg, calleeLeg, branches := session.CallerLeg, session.CalleeLeg, len(session.Branches)
+	session.RUnlock()
+	if branches != 3 || calleeLeg.Tag != "tag-1" {
+		t.Fatalf("%d branches with %s active, want 3 with the first to answer", branches, calleeLeg.Tag)
+	}
+
+	packet := func(ssrc uint32, seq uint16) []byte {
+		return marshalRTPPacket(&RTPPacket{Version: 2, SSRC: ssrc, SequenceNumber: seq, Timestamp: uint32(seq) * 160, Payload: make([]byte, 160)}, nil)
+	}
+	silent := func(from, to *net.UDPConn, port int, raw []byte) {
+		t.Helper()
+		if _, err := from.WriteToUDP(raw, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}); err != nil {
+			t.Fatal(err)
+		}
+		to.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if n, _, err := to.ReadFromUDP(make([]byte, 1500)); err == nil {
+			t.Errorf("relayed %d bytes from a branch that is not active", n)
+		}
+	}
+
+	// Only the first branch's early media reaches the caller, and the
+	// caller's media only that branch
+	relayed(t, parties[1], caller, callerLeg.LocalPort, packet(171, 1))
+	silent(parties[2], caller, callerLeg.LocalPort, packet(172, 1))
+	relayed(t, caller, parties[1], calleeLeg.LocalPort, packet(161, 1))
+
+	// The proxy cancels the third branch by its via-branch
+	if resp, err := listener.handleDelete(&ng.NGRequest{CallID: "forked-call", FromTag: "from-tag", ViaBranch: "z9hG4bK-tag-3"}); err != nil || resp.Result != ng.ResultOK {
+		t.Fatalf("deleting the branch failed: %v %+v", err, resp)
+	}
+	if registry.GetSessionByCallID("forked-call") == nil {
+		t.Fatal("deleting a branch ended the call")
+	}
+
+	// The second branch answers the call, and the others are released
+	answer(2, nil)
+	session.RLock()
+	active, branches := session.CalleeLeg, len(session.Branches)
+	session.RUnlock()
+	if active.Tag != "tag-2" || branches != 0 || session.ToTag != "tag-2" {
+		t.Fatalf("%s active with %d branches left, want the answering branch alone", active.Tag, branches)
+	}
+	relayed(t, parties[2], caller, callerLeg.LocalPort, packet(172, 2))
+	relayed(t, caller, parties[2], calleeLeg.LocalPort, packet(161, 2))
+	silent(parties[1], caller, callerLeg.LocalPort, packet(171, 2))
+}
+
+func TestNGSocketListener_BlockAndSilenceMedia(t *testing.T) {
+	manager, registry, _ := newTestSessionManager(t)
+	listener := &NGSocketListener{sessionRegistry: registry, sessionManager: manager, config: &Config{}}
+
+	session := registry.CreateSession("control-call", "from-tag")
+	if err := registry.SetCallerLeg(session.ID, &CallLeg{Tag: "from-tag"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.SetCalleeLeg(session.ID, &CallLeg{Tag: "to-tag"}); err != nil {
+		t.Fatal(err)
+	}
+	controls := func() (caller, callee LegMediaControl) {
+		caller, _ = session.MediaControl(LegCaller)
+		callee, _ = session.MediaControl(LegCallee)
+		return caller, callee
+	}
+
+	// The from-tag picks the party whose media is blocked
+	if resp, _ := listener.handleBlockMedia(&ng.NGRequest{CallID: "control-call", FromTag: "to-tag"}); resp.Result != ng.ResultOK {
+		t.Fatalf("block media failed: %+v", resp)
+	}
+	if caller, callee := controls(); caller.Blocked || !callee.Blocked {
+		t.Errorf("expected only the callee blocked, got %+v %+v", caller, callee)
+	}
+
+	// The all flag silences both parties, and unsilence lifts it
+	if resp, _ := listener.handleSilenceMedia(&ng.NGRequest{CallID: "control-call", FromTag: "from-tag", Flags: []string{"all"}}); resp.Result != ng.ResultOK {
+		t.Fatalf("silence media failed: %+v", resp)
+	}
+	if caller, callee := controls(); !caller.Silenced || !callee.Silenced {
+		t.Errorf("expected both legs silenced, got %+v %+v", caller, callee)
+	}
+	if resp, _ := listener.handleUnsilenceMedia(&ng.NGRequest{CallID: "control-call", FromTag: "from-tag"}); resp.Result != ng.ResultOK {
+		t.Fatalf("unsilence media failed: %+v", resp)
+	}
+	if caller, callee := controls(); caller.Silenced || !callee.Silenced || !callee.Blocked {
+		t.Errorf("expected only the caller unsilenced, got %+v %+v", caller, callee)
+	}
+
+	if resp, _ := listener.handleBlockMedia(&ng.NGRequest{CallID: "other-call"}); resp.ErrorReason != ng.ErrReasonNotFound {
+		t.Errorf("expected not found for an unknown call, got %+v", resp)
+	}
+}
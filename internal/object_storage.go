@@ -0,0 +1,492 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Types of files shipped to object storage
+const (
+	ObjectTypeRecording = "recording" // audio files and metadata of a completed recording
+	ObjectTypePCAP      = "pcap"      // files of a stopped per-call capture
+)
+
+// objectTypes are the file types object storage may be limited to
+var objectTypes = map[string]bool{ObjectTypeRecording: true, ObjectTypePCAP: true}
+
+// Object storage defaults and limits
+const (
+	defaultObjectRegion     = "us-east-1"
+	defaultObjectWorkers    = 2
+	defaultObjectQueueSize  = 1000
+	defaultObjectTimeout    = 300 // seconds
+	defaultObjectMaxRetries = 5
+	maxObjectRetries        = 20
+	maxObjectRetryDelay     = time.Minute
+)
+
+// Object storage metrics
+var (
+	objectUploads = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "karl_object_uploads_total",
+			Help: "Files shipped to object storage, by type and result",
+		},
+		[]string{"type", "result"},
+	)
+
+	objectUploadBytes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "karl_object_upload_bytes_total",
+			Help: "Bytes of files confirmed by object storage, by type",
+		},
+		[]string{"type"},
+	)
+)
+
+var (
+	objectUploader atomic.Pointer[ObjectUploader]
+
+	// First delay before a failed upload is retried; it doubles with every
+	// attempt
+	objectRetryDelay = time.Second
+
+	// Failed and dropped uploads are reported at most once a minute
+	objectErrors = NewLogSampler(Logger(ComponentKarl), slog.LevelWarn, 1, time.Minute)
+)
+
+// ObjectUploader ships files to an S3-compatible bucket in the background.
+// Each upload is a single PUT signed with AWS Signature Version 4, carrying
+// the MD5 and SHA-256 of the file so the store rejects a corrupted body. A
+// local file is removed only after the store confirmed it
+type ObjectUploader struct {
+	endpoint   *url.URL
+	region     string
+	bucket     string
+	prefix     string
+	accessKey  string
+	secretKey  string
+	pathStyle  bool
+	types      map[string]bool // nil uploads every type
+	tags       url.Values
+	keepLocal  bool
+	maxRetries int
+	client     *http.Client
+
+	queue chan objectUpload
+	wg    sync.WaitGroup
+}
+
+// objectUpload is a file waiting to be uploaded
+type objectUpload struct {
+	fileType string
+	callID   string
+	path     string
+}
+
+// NewObjectUploader creates an uploader for config and starts its workers
+func NewObjectUploader(config *ObjectStorageConfig) (*ObjectUploader, error) {
+	region := config.Region
+	if region == "" {
+		region = defaultObjectRegion
+	}
+	endpoint := config.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid object storage endpoint %q", endpoint)
+	}
+
+	uploader := &ObjectUploader{
+		endpoint:   u,
+		region:     region,
+		bucket:     config.Bucket,
+		prefix:     strings.Trim(config.Prefix, "/"),
+		accessKey:  config.AccessKey,
+		secretKey:  config.SecretKey,
+		pathStyle:  config.PathStyle,
+		tags:       url.Values{},
+		keepLocal:  config.KeepLocal,
+		maxRetries: config.MaxRetries,
+	}
+	if len(config.Types) > 0 {
+		uploader.types = make(map[string]bool)
+		for _, t := range config.Types {
+			uploader.types[t] = true
+		}
+	}
+	for key, value := range config.Tags {
+		uploader.tags.Set(key, value)
+	}
+	if uploader.maxRetries == 0 {
+		uploader.maxRetries = defaultObjectMaxRetries
+	}
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultObjectTimeout
+	}
+	uploader.client = &http.Client{Timeout: time.Duration(timeout) * time.Second}
+
+	queueSize := config.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultObjectQueueSize
+	}
+	uploader.queue = make(chan objectUpload, queueSize)
+	workers := config.Workers
+	if workers <= 0 {
+		workers = defaultObjectWorkers
+	}
+	for i := 0; i < workers; i++ {
+		uploader.wg.Add(1)
+		go func() {
+			defer uploader.wg.Done()
+			for upload := range uploader.queue {
+				uploader.upload(upload)
+			}
+		}()
+	}
+	return uploader, nil
+}
+
+// Upload queues a file of a call. It never blocks; when the queue is full
+// the file stays on local disk
+func (u *ObjectUploader) Upload(fileType, callID, path string) {
+	if u.types != nil && !u.types[fileType] {
+		return
+	}
+	select {
+	case u.queue <- objectUpload{fileType: fileType, callID: callID, path: path}:
+	default:
+		objectUploads.WithLabelValues(fileType, "dropped").Inc()
+		if objectErrors.Allow() {
+			objectErrors.Log("Object storage queue is full, file kept locally", "file", path)
+		}
+	}
+}
+
+// Close stops taking files and waits for the queued ones to be uploaded
+func (u *ObjectUploader) Close() {
+	close(u.queue)
+	u.wg.Wait()
+}
+
+// upload PUTs a file, retrying with exponential backoff on network errors,
+// 5xx and 429 responses, then removes it unless local files are kept
+func (u *ObjectUploader) upload(upload objectUpload) {
+	key := u.objectKey(upload)
+	delay := objectRetryDelay
+	for attempt := 0; ; attempt++ {
+		size, retry, err := u.put(upload, key)
+		if err == nil {
+			objectUploads.WithLabelValues(upload.fileType, "uploaded").Inc()
+			objectUploadBytes.WithLabelValues(upload.fileType).Add(float64(size))
+			if !u.keepLocal {
+				if err := os.Remove(upload.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+					Logger(ComponentKarl).Warn("Uploaded file not removed", "file", upload.path, "error", err)
+				}
+			}
+			return
+		}
+		if !retry || attempt >= u.maxRetries {
+			objectUploads.WithLabelValues(upload.fileType, "failed").Inc()
+			if objectErrors.Allow() {
+				objectErrors.Log("Object storage upload failed, file kept locally", "file", upload.path, "attempts", attempt+1, "error", err)
+			}
+			return
+		}
+		time.Sleep(delay)
+		delay = min(2*delay, maxObjectRetryDelay)
+	}
+}
+
+// objectKey names a file's object: prefix/type/YYYY/MM/DD/name, dated by
+// the file's last change
+func (u *ObjectUploader) objectKey(upload objectUpload) string {
+	date := time.Now()
+	if info, err := os.Stat(upload.path); err == nil {
+		date = info.ModTime()
+	}
+	return path.Join(u.prefix, upload.fileType, date.UTC().Format("2006/01/02"), filepath.Base(upload.path))
+}
+
+// put makes one upload attempt, returning the bytes uploaded and whether a
+// failure is worth retrying. The file is read twice, once to checksum it and
+// once to send it, so a file changed in between fails the MD5 check
+func (u *ObjectUploader) put(upload objectUpload, key string) (int64, bool, error) {
+	file, err := os.Open(upload.path)
+	if err != nil {
+		return 0, false, err
+	}
+	defer file.Close()
+
+	md5Sum, sha256Sum := md5.New(), sha256.New()
+	size, err := io.Copy(io.MultiWriter(md5Sum, sha256Sum), file)
+	if err != nil {
+		return 0, false, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, false, err
+	}
+	digest := md5Sum.Sum(nil)
+
+	req, err := http.NewRequest(http.MethodPut, u.objectURL(key), io.NopCloser(file))
+	if err != nil {
+		return 0, false, err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", objectContentType(upload.path))
+	req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(digest))
+	tags := url.Values{"karl-type": {upload.fileType}}
+	for name, values := range u.tags {
+		tags[name] = values
+	}
+	req.Header.Set("X-Amz-Tagging", tags.Encode())
+	if upload.callID != "" {
+		req.Header.Set("X-Amz-Meta-Call-Id", objectMetadataValue(upload.callID))
+	}
+	u.sign(req, hex.EncodeToString(sha256Sum.Sum(nil)), time.Now())
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return 0, true, err
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode < 300:
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return 0, true, fmt.Errorf("object storage returned %d%s", resp.StatusCode, objectErrorCode(body))
+	default:
+		return 0, false, fmt.Errorf("object storage returned %d%s", resp.StatusCode, objectErrorCode(body))
+	}
+
+	// The ETag of a single PUT is the MD5 of the object, unless the store
+	// encrypts with KMS keys; the store has checked Content-MD5 either way
+	etag := strings.Trim(resp.Header.Get("ETag"), `"`)
+	if len(etag) == 2*md5.Size && !strings.EqualFold(etag, hex.EncodeToString(digest)) {
+		return 0, true, fmt.Errorf("object storage stored ETag %s, expected MD5 %x", etag, digest)
+	}
+	return size, false, nil
+}
+
+// objectURL is the URL of an object, with the bucket in the host name or,
+// for path-style stores, in the path
+func (u *ObjectUploader) objectURL(key string) string {
+	target := *u.endpoint
+	objectPath := "/" + key
+	if u.pathStyle {
+		objectPath = "/" + u.bucket + objectPath
+	} else {
+		target.Host = u.bucket + "." + target.Host
+	}
+	target.Path = strings.TrimSuffix(target.Path, "/") + objectPath
+	target.RawPath = awsURIEscape(target.Path)
+	return target.String()
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req,
+// covering the host and every header set on it
+func (u *ObjectUploader) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsURIEscape(req.URL.Path),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := now.Format("20060102") + "/" + u.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + u.secretKey)
+	for _, part := range []string{now.Format("20060102"), u.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		u.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery sorts and escapes query parameters for signing
+func canonicalQuery(query url.Values) string {
+	var pairs []string
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, awsURIEscape(name)+"="+awsURIEscape(value))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// awsURIEscape escapes every byte but the unreserved characters and '/',
+// as Signature Version 4 expects of S3 paths
+func awsURIEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' || c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// objectContentType picks the Content-Type of a file from its extension
+func objectContentType(file string) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".wav":
+		return "audio/wav"
+	case ".ogg", ".opus":
+		return "audio/ogg"
+	case ".pcap":
+		return "application/vnd.tcpdump.pcap"
+	case ".json":
+		return "application/json"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+// objectMetadataValue keeps the printable ASCII of a metadata value, the
+// only characters S3 accepts in it
+func objectMetadataValue(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// objectErrorCode extracts the <Code> of an S3 error response, for logs
+func objectErrorCode(body []byte) string {
+	start := bytes.Index(body, []byte("<Code>"))
+	end := bytes.Index(body, []byte("</Code>"))
+	if start < 0 || end < start {
+		return ""
+	}
+	return " " + string(body[start+len("<Code>"):end])
+}
+
+// ConfigureObjectStorage replaces the uploader with one for config; nil or
+// disabled stops uploading. Files queued on the old uploader are still
+// uploaded
+func ConfigureObjectStorage(config *ObjectStorageConfig) {
+	var uploader *ObjectUploader
+	if config != nil && config.Enabled {
+		var err error
+		if uploader, err = NewObjectUploader(config); err != nil {
+			Logger(ComponentKarl).Error("Object storage disabled", "error", err)
+		}
+	}
+	if old := objectUploader.Swap(uploader); old != nil {
+		go old.Close()
+	}
+}
+
+// CloseObjectStorage stops uploading and waits for the queued files to be
+// uploaded, for use at shutdown
+func CloseObjectStorage() {
+	if old := objectUploader.Swap(nil); old != nil {
+		old.Close()
+	}
+}
+
+// UploadFile queues a completed file of a call for object storage, if it
+// is configured
+func UploadFile(fileType, callID, path string) {
+	if uploader := objectUploader.Load(); uploader != nil {
+		uploader.Upload(fileType, callID, path)
+	}
+}
+
+// ValidateObjectStorageConfig checks the bucket, endpoint, types and limits
+func ValidateObjectStorageConfig(cfg *Config) error {
+	o := cfg.ObjectStorage
+	if !o.Enabled {
+		return nil
+	}
+	if o.Bucket == "" {
+		return fmt.Errorf("object_storage.bucket is required")
+	}
+	if o.Endpoint != "" {
+		u, err := url.Parse(o.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid object_storage.endpoint, expected an http or https URL")
+		}
+	}
+	if o.AccessKey == "" || o.SecretKey == "" {
+		return fmt.Errorf("object_storage.access_key and secret_key are required")
+	}
+	for _, t := range o.Types {
+		if !objectTypes[t] {
+			return fmt.Errorf("invalid object_storage.types %q, expected recording or pcap", t)
+		}
+	}
+	if o.Workers < 0 || o.QueueSize < 0 || o.Timeout < 0 {
+		return fmt.Errorf("invalid object_storage workers, queue_size or timeout")
+	}
+	if o.MaxRetries < 0 || o.MaxRetries > maxObjectRetries {
+		return fmt.Errorf("invalid object_storage.max_retries %d, expected 0-%d", o.MaxRetries, maxObjectRetries)
+	}
+	return nil
+}
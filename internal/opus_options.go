@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	ng "karl/internal/ng_protocol"
+)
+
+// OpusOptions are the encoder settings Karl uses when it sends Opus. They
+// are named after the RFC 7587 fmtp parameters a receiver asks for them with
+type OpusOptions struct {
+	FEC               bool // useinbandfec: add inband FEC while the receiver reports loss
+	DTX               bool // usedtx: stop sending during silence
+	CBR               bool // cbr: constant instead of variable bitrate
+	MaxAverageBitrate int  // maxaveragebitrate in bit/s, 0 for the encoder's bitrate
+}
+
+// ParseOpusOptions reads the encoder settings from an Opus fmtp line
+func ParseOpusOptions(fmtp string) OpusOptions {
+	var opts OpusOptions
+	for _, param := range strings.Split(fmtp, ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(key) {
+		case "useinbandfec":
+			opts.FEC = value == "1"
+		case "usedtx":
+			opts.DTX = value == "1"
+		case "cbr":
+			opts.CBR = value == "1"
+		case "maxaveragebitrate":
+			if bitrate, err := strconv.Atoi(value); err == nil && bitrate > 0 {
+				opts.MaxAverageBitrate = bitrate
+			}
+		}
+	}
+	return opts
+}
+
+// opusFlagsFmtp returns the fmtp parameters set by the opus-fec, opus-dtx,
+// opus-cbr, opus-vbr and opus-max-bitrate session options, or "" if none
+// were given
+func opusFlagsFmtp(pf *ng.ParsedFlags) string {
+	var params []string
+	if pf.OpusFEC {
+		params = append(params, "useinbandfec=1")
+	}
+	if pf.OpusDTX {
+		params = append(params, "usedtx=1")
+	}
+	switch {
+	case pf.OpusCBR:
+		params = append(params, "cbr=1")
+	case pf.OpusVBR:
+		params = append(params, "cbr=0")
+	}
+	if pf.OpusMaxBitrate > 0 {
+		params = append(params, "maxaveragebitrate="+strconv.Itoa(pf.OpusMaxBitrate))
+	}
+	return strings.Join(params, ";")
+}
+
+// overrideFmtp sets the parameters of overrides in an fmtp line, keeping
+// the others
+func overrideFmtp(fmtp, overrides string) string {
+	var params []string
+	set := make(map[string]bool)
+	for _, param := range strings.Split(overrides, ";") {
+		if param = strings.TrimSpace(param); param != "" {
+			key, _, _ := strings.Cut(param, "=")
+			set[strings.ToLower(key)] = true
+			params = append(params, param)
+		}
+	}
+	var kept []string
+	for _, param := range strings.Split(fmtp, ";") {
+		if param = strings.TrimSpace(param); param != "" {
+			key, _, _ := strings.Cut(param, "=")
+			if !set[strings.ToLower(key)] {
+				kept = append(kept, param)
+			}
+		}
+	}
+	return strings.Join(append(kept, params...), ";")
+}
+
+// Receiver reports with loss above opusLossHigh percent cut the bitrate of
+// an Opus stream by a quarter; reports below opusLossLow let it grow by
+// opusIncrease, up to opusBitrate
+const (
+	opusLossHigh = 5.0
+	opusLossLow  = 1.0
+	opusIncrease = 1.1
+)
+
+// opusFeedbackBitrate returns the bitrate an Opus encoder sending at
+// bitrate moves to after a receiver reports lossPercent
+func opusFeedbackBitrate(bitrate int, lossPercent float64) int {
+	switch {
+	case lossPercent > opusLossHigh:
+		bitrate -= bitrate / 4
+	case lossPercent < opusLossLow:
+		bitrate = int(float64(bitrate) * opusIncrease)
+	}
+	return min(max(bitrate, opusMinBitrate), opusBitrate)
+}
+
+// opusPacketLoss converts a measured loss percentage into the expected loss
+// the Opus encoder tunes its inband FEC for
+func opusPacketLoss(lossPercent float64) int {
+	switch {
+	case lossPercent <= 0 || math.IsNaN(lossPercent):
+		return 0
+	case lossPercent >= 100:
+		return 100
+	}
+	return int(math.Ceil(lossPercent))
+}
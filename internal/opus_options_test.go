@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	ng "karl/internal/ng_protocol"
+)
+
+func TestParseOpusOptions(t *testing.T) {
+	opts := ParseOpusOptions("minptime=10; useinbandfec=1;usedtx=1;cbr=1;maxaveragebitrate=24000")
+	want := OpusOptions{FEC: true, DTX: true, CBR: true, MaxAverageBitrate: 24000}
+	if opts != want {
+		t.Errorf("expected %+v, got %+v", want, opts)
+	}
+	if opts := ParseOpusOptions("useinbandfec=0;maxaveragebitrate=x"); opts != (OpusOptions{}) {
+		t.Errorf("expected defaults, got %+v", opts)
+	}
+}
+
+func TestOpusFlagsFmtp(t *testing.T) {
+	pf := ng.ParseFlags([]string{"opus-fec", "opus-vbr", "opus-max-bitrate=32000"})
+	if got := opusFlagsFmtp(pf); got != "useinbandfec=1;cbr=0;maxaveragebitrate=32000" {
+		t.Errorf("unexpected fmtp %q", got)
+	}
+	if got := opusFlagsFmtp(ng.ParseFlags([]string{"ptime-reverse"})); got != "" {
+		t.Errorf("expected no fmtp without Opus options, got %q", got)
+	}
+
+	if got := overrideFmtp("minptime=10;useinbandfec=0", "useinbandfec=1;usedtx=1"); got != "minptime=10;useinbandfec=1;usedtx=1" {
+		t.Errorf("unexpected merged fmtp %q", got)
+	}
+}
+
+func TestCodecNegotiator_OpusSessionOptions(t *testing.T) {
+	n := NewCodecNegotiator()
+	n.SetOfferCodecs("opus-call", []CodecInfo{{PayloadType: 0, Name: "PCMU", ClockRate: 8000}})
+	n.SetAnswerCodecs("opus-call", []CodecInfo{{PayloadType: 111, Name: "opus", ClockRate: 48000, Channels: 2, Fmtp: "minptime=10;useinbandfec=0"}})
+	n.SetOpusFmtp("opus-call", "useinbandfec=1;usedtx=1")
+	n.BindSSRC(0x0F05, "opus-call", true)
+
+	_, dst, _, ok := n.ResolveOutput(0x0F05, 0)
+	if !ok {
+		t.Fatal("expected the call to resolve")
+	}
+	if opts := ParseOpusOptions(dst.Fmtp); !opts.FEC || !opts.DTX {
+		t.Errorf("expected session options to override the answer's fmtp, got %q", dst.Fmtp)
+	}
+}
+
+func TestEncodeOpus_Options(t *testing.T) {
+	encoder := getStreamCodecs(0x0F06).OpusEncoder()
+	defer RemoveStreamCodecs(0x0F06)
+	tone := monoToStereo(resamplerTone(440, opusSampleRate, opusFrameSize))
+
+	// 64 kbps for 20 ms, or 24 kbps when the receiver caps it
+	cbr, _ := encoder.Encode(tone, OpusOptions{CBR: true})
+	capped, _ := encoder.Encode(tone, OpusOptions{CBR: true, MaxAverageBitrate: 24000})
+	vbr, _ := encoder.Encode(tone, OpusOptions{})
+	if len(cbr) != 160 || len(capped) != 60 {
+		t.Errorf("expected 160 and 60 byte CBR frames, got %d and %d", len(cbr), len(capped))
+	}
+	if len(vbr) >= len(cbr) {
+		t.Errorf("expected VBR to spend less on a quiet tone, got %d bytes", len(vbr))
+	}
+
+	// FEC only adds redundancy once the receiver reports loss, and keeps
+	// the frame within the bitrate
+	fec := OpusOptions{FEC: true, CBR: true, MaxAverageBitrate: 24000}
+	encoder.Encode(tone, fec)
+	if frame, _ := encoder.Encode(tone, fec); len(frame) != 60 {
+		t.Errorf("expected a 60 byte frame without loss, got %d", len(frame))
+	}
+	GetRTCPFeedbackHandler(0x0F06).HandleFeedback(9.5, 0, 0)
+	defer RemoveRTCPFeedbackHandler(0x0F06)
+	frame, _ := encoder.Encode(tone, fec)
+	if len(frame) != 60 {
+		t.Errorf("expected FEC to share the 60 byte budget, got %d", len(frame))
+	}
+	if _, err := DecodeToPCM(frame); err != nil {
+		t.Errorf("expected a frame with FEC to decode: %v", err)
+	}
+	if loss := encoder.instance.packetLoss; loss != 10 {
+		t.Errorf("expected RTCP feedback to set 10%% expected loss, got %d", loss)
+	}
+
+	// High loss cuts the bitrate by a quarter, and it recovers to the
+	// default while the loss stays low
+	if bitrate := encoder.Bitrate(); bitrate != opusBitrate*3/4 {
+		t.Errorf("expected high loss to cut the bitrate to %d, got %d", opusBitrate*3/4, bitrate)
+	}
+	for i := 0; i < 5; i++ {
+		GetRTCPFeedbackHandler(0x0F06).HandleFeedback(0, 0, 0)
+	}
+	if bitrate := encoder.Bitrate(); bitrate != opusBitrate {
+		t.Errorf("expected the bitrate back at %d, got %d", opusBitrate, bitrate)
+	}
+}
+
+func TestOpusFeedbackBitrate(t *testing.T) {
+	tests := []struct {
+		bitrate int
+		loss    float64
+		want    int
+	}{
+		{64000, 10, 48000},
+		{64000, 3, 64000},
+		{48000, 0.5, 52800},
+		{62000, 0, opusBitrate},
+		{7000, 50, opusMinBitrate},
+	}
+	for _, tt := range tests {
+		if got := opusFeedbackBitrate(tt.bitrate, tt.loss); got != tt.want {
+			t.Errorf("%d bit/s at %.1f%% loss: expected %d, got %d", tt.bitrate, tt.loss, tt.want, got)
+		}
+	}
+}
+
+func TestTranscodeAudio_OpusDTX(t *testing.T) {
+	silence := bytes.Repeat([]byte{0xD5}, 160) // A-law idle pattern
+	opus := CodecInfo{Name: "opus", ClockRate: 48000, Channels: 2, Fmtp: "usedtx=1"}
+
+	sent := 0
+	for i := 0; i < 2*opusDTXInterval+1; i++ {
+		_, err := transcodeAudio(silence, mimeCodec("audio/PCMA"), opus)
+		switch {
+		case err == nil:
+			sent++
+		case !errors.Is(err, ErrFrameSuppressed):
+			t.Fatalf("frame %d: unexpected error %v", i, err)
+		}
+	}
+	if sent != 3 {
+		t.Errorf("expected a silent frame every 400 ms, sent %d of %d", sent, 2*opusDTXInterval+1)
+	}
+
+	// Speech ends DTX at once
+	tone := encodeG711("PCMU", resamplerTone(440, 8000, 160))
+	if _, err := transcodeAudio(tone, mimeCodec("audio/PCMU"), opus); err != nil {
+		t.Errorf("expected speech to be sent, got %v", err)
+	}
+}
@@ -1,84 +1,326 @@
 package internal
 
 import (
+	"encoding/binary"
+	"fmt"
 	"log"
+	"net"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcapgo"
 )
 
-// Global variables for PCAP file handling
+// Global per-call capture manager, nil until InitPCAPCapture runs
 var (
-	pcapFile    *os.File
-	pcapWriter  *pcapgo.Writer
-	pcapEnabled bool
+	pcapManager   *CallCaptureManager
+	pcapManagerMu sync.RWMutex
 )
 
-// InitPCAPCapture initializes packet capture and creates a PCAP file
-func InitPCAPCapture() {
-	var err error
+// CallCaptureManager writes a separate, rotating PCAP capture for each call,
+// keyed by Call-ID. Packets are routed to a call through their SSRC.
+type CallCaptureManager struct {
+	basePath    string
+	defaults    CallCaptureOptions
+	autoCapture atomic.Bool
+	resolver    func(ssrc uint32) (callID string, ok bool)
 
-	// Ensure logs directory exists
-	if err := os.MkdirAll("logs", 0755); err != nil {
-		log.Printf("Failed to create logs directory: %v", err)
-		return
+	captures map[string]*CallPCAPCapture
+	mu       sync.RWMutex
+}
+
+// NewCallCaptureManager creates a manager that writes captures under config.Path
+func NewCallCaptureManager(config *PCAPConfig) *CallCaptureManager {
+	m := &CallCaptureManager{
+		basePath: config.Path,
+		defaults: CallCaptureOptions{
+			RotateSize:     config.RotateSize,
+			RotateInterval: time.Duration(config.RotateInterval) * time.Second,
+			MaxFiles:       config.MaxFiles,
+		},
+		captures: make(map[string]*CallPCAPCapture),
+	}
+	m.autoCapture.Store(config.AutoCapture)
+	return m
+}
+
+// SetCallIDResolver sets the SSRC to Call-ID lookup used to route packets
+func (m *CallCaptureManager) SetCallIDResolver(resolver func(ssrc uint32) (callID string, ok bool)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.resolver = resolver
+}
+
+// SetAutoCapture enables or disables capturing every call without an API request
+func (m *CallCaptureManager) SetAutoCapture(enabled bool) {
+	m.autoCapture.Store(enabled)
+}
+
+// Active reports whether any packet may currently be captured
+func (m *CallCaptureManager) Active() bool {
+	if m.autoCapture.Load() {
+		return true
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.captures) > 0
+}
+
+// StartCall starts capturing a call. Zero rotation settings in opts fall back
+// to the configured defaults; a nil opts captures everything.
+func (m *CallCaptureManager) StartCall(callID string, opts *CallCaptureOptions) (*CallPCAPCapture, error) {
+	if callID == "" {
+		return nil, fmt.Errorf("call-id required")
 	}
 
-	pcapFile, err = os.Create("logs/karl_capture.pcap")
-	if err != nil {
-		log.Printf("Failed to create PCAP file: %v", err)
+	options := m.defaults
+	if opts != nil {
+		options.SSRCs = opts.SSRCs
+		options.PayloadTypes = opts.PayloadTypes
+		if opts.RotateSize > 0 {
+			options.RotateSize = opts.RotateSize
+		}
+		if opts.RotateInterval > 0 {
+			options.RotateInterval = opts.RotateInterval
+		}
+		if opts.MaxFiles > 0 {
+			options.MaxFiles = opts.MaxFiles
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.captures[callID]; exists {
+		return nil, ErrCaptureAlreadyRunning
+	}
+
+	outputPath := filepath.Join(m.basePath, fmt.Sprintf("%s_%s.pcap",
+		captureFileName(callID), time.Now().UTC().Format("20060102T150405")))
+	capture := NewCallPCAPCaptureWithOptions(callID, outputPath, options)
+	if err := capture.Start(); err != nil {
+		return nil, err
+	}
+
+	m.captures[callID] = capture
+	log.Printf("Packet capture started for call %s: %s", callID, outputPath)
+	return capture, nil
+}
+
+// StopCall stops the capture of a call and closes its file
+func (m *CallCaptureManager) StopCall(callID string) error {
+	m.mu.Lock()
+	capture, exists := m.captures[callID]
+	if !exists {
+		m.mu.Unlock()
+		return ErrCaptureNotRunning
+	}
+	delete(m.captures, callID)
+	m.mu.Unlock()
+
+	log.Printf("Packet capture stopped for call %s", callID)
+	if err := capture.Stop(); err != nil {
+		return err
+	}
+	uploadCapture(capture)
+	return nil
+}
+
+// GetCall returns the running capture of a call, or nil
+func (m *CallCaptureManager) GetCall(callID string) *CallPCAPCapture {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.captures[callID]
+}
+
+// ListCalls returns every running capture
+func (m *CallCaptureManager) ListCalls() []*CallPCAPCapture {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	captures := make([]*CallPCAPCapture, 0, len(m.captures))
+	for _, capture := range m.captures {
+		captures = append(captures, capture)
+	}
+	return captures
+}
+
+// Capture routes an RTP or RTCP packet received from src on dst to the
+// capture of its call, starting one when auto capture is enabled
+func (m *CallCaptureManager) Capture(packet []byte, src, dst *net.UDPAddr) {
+	ssrc, ok := captureSSRC(packet)
+	if !ok {
 		return
 	}
 
-	pcapWriter = pcapgo.NewWriter(pcapFile)
-	if err := pcapWriter.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
-		log.Printf("Failed to write PCAP header: %v", err)
-		pcapFile.Close()
-		pcapFile = nil
-		pcapWriter = nil
+	m.mu.RLock()
+	resolver := m.resolver
+	m.mu.RUnlock()
+	if resolver == nil {
+		return
+	}
+	callID, ok := resolver(ssrc)
+	if !ok {
 		return
 	}
 
-	pcapEnabled = true
-	log.Println("Packet capture initialized: logs/karl_capture.pcap")
+	capture := m.GetCall(callID)
+	if capture == nil {
+		if !m.autoCapture.Load() {
+			return
+		}
+		var err error
+		capture, err = m.StartCall(callID, nil)
+		if err == ErrCaptureAlreadyRunning {
+			capture = m.GetCall(callID)
+		} else if err != nil {
+			log.Printf("Failed to start packet capture for call %s: %v", callID, err)
+			return
+		}
+		if capture == nil {
+			return
+		}
+	}
+
+	captured := &CapturedPacket{
+		Timestamp:  time.Now(),
+		CaptureLen: uint32(len(packet)),
+		OrigLen:    uint32(len(packet)),
+		Data:       append([]byte(nil), packet...),
+		Direction:  "inbound",
+		SrcIP:      net.IPv4zero.String(),
+		DstIP:      net.IPv4zero.String(),
+		Protocol:   "RTP",
+	}
+	if IsRTCPPacket(packet) {
+		captured.Protocol = "RTCP"
+	}
+	if src != nil {
+		captured.SrcIP = src.IP.String()
+		captured.SrcPort = uint16(src.Port)
+	}
+	if dst != nil {
+		captured.DstIP = dst.IP.String()
+		captured.DstPort = uint16(dst.Port)
+	}
+	_ = capture.CapturePacket(captured)
+}
+
+// StopAll stops every running capture
+func (m *CallCaptureManager) StopAll() {
+	m.mu.Lock()
+	captures := m.captures
+	m.captures = make(map[string]*CallPCAPCapture)
+	m.mu.Unlock()
+
+	for _, capture := range captures {
+		if capture.Stop() == nil {
+			uploadCapture(capture)
+		}
+	}
+}
+
+// uploadCapture queues the files of a stopped capture for object storage
+func uploadCapture(capture *CallPCAPCapture) {
+	for _, file := range capture.GetStats().Files {
+		UploadFile(ObjectTypePCAP, capture.CallID(), file)
+	}
 }
 
-// IsPCAPEnabled returns whether packet capture is enabled
+// captureSSRC extracts the sender SSRC of an RTP or RTCP packet
+func captureSSRC(packet []byte) (uint32, bool) {
+	if len(packet) < 8 || packet[0]>>6 != 2 {
+		return 0, false
+	}
+	if IsRTCPPacket(packet) {
+		return binary.BigEndian.Uint32(packet[4:8]), true
+	}
+	if len(packet) < 12 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(packet[8:12]), true
+}
+
+// captureAddr converts a UDP or TCP address to the endpoint recorded in a capture
+func captureAddr(addr net.Addr) *net.UDPAddr {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a
+	case *net.TCPAddr:
+		return &net.UDPAddr{IP: a.IP, Port: a.Port}
+	default:
+		return nil
+	}
+}
+
+// captureFileName makes a Call-ID safe to use in a file name
+func captureFileName(callID string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		default:
+			return '_'
+		}
+	}, callID)
+}
+
+// InitPCAPCapture sets up per-call packet capture under config.Path
+func InitPCAPCapture(config *PCAPConfig) (*CallCaptureManager, error) {
+	if err := os.MkdirAll(config.Path, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create capture directory: %w", err)
+	}
+
+	manager := NewCallCaptureManager(config)
+
+	pcapManagerMu.Lock()
+	previous := pcapManager
+	pcapManager = manager
+	pcapManagerMu.Unlock()
+
+	if previous != nil {
+		previous.StopAll()
+	}
+
+	log.Printf("Per-call packet capture initialized: %s (auto capture: %v)", config.Path, config.AutoCapture)
+	return manager, nil
+}
+
+// GetPCAPCaptureManager returns the per-call capture manager, or nil
+func GetPCAPCaptureManager() *CallCaptureManager {
+	pcapManagerMu.RLock()
+	defer pcapManagerMu.RUnlock()
+	return pcapManager
+}
+
+// IsPCAPEnabled returns whether any packet may currently be captured
 func IsPCAPEnabled() bool {
-	return pcapEnabled
+	manager := GetPCAPCaptureManager()
+	return manager != nil && manager.Active()
 }
 
-// SetPCAPEnabled enables or disables packet capture
+// SetPCAPEnabled enables or disables capturing every call
 func SetPCAPEnabled(enabled bool) {
-	// If turning on and not already initialized
-	if enabled && !pcapEnabled && pcapWriter == nil {
-		InitPCAPCapture()
-	} else if !enabled && pcapEnabled {
-		ClosePCAPCapture()
-		pcapEnabled = false
+	if manager := GetPCAPCaptureManager(); manager != nil {
+		manager.SetAutoCapture(enabled)
 	}
 }
 
-// CapturePacket writes an RTP packet to the PCAP file
-func CapturePacket(packet []byte) {
-	if pcapWriter == nil {
+// CapturePacket writes an RTP or RTCP packet to the capture of its call
+func CapturePacket(packet []byte, src, dst *net.UDPAddr) {
+	manager := GetPCAPCaptureManager()
+	if manager == nil || !manager.Active() {
 		return
 	}
-
-	_ = pcapWriter.WritePacket(gopacket.CaptureInfo{
-		Timestamp:     time.Now(),
-		CaptureLength: len(packet),
-		Length:        len(packet),
-	}, packet)
+	manager.Capture(packet, src, dst)
 }
 
-// ClosePCAPCapture properly closes the PCAP file
+// ClosePCAPCapture stops every running call capture
 func ClosePCAPCapture() {
-	if pcapFile != nil {
-		pcapFile.Close()
-		log.Println("PCAP capture file closed.")
+	if manager := GetPCAPCaptureManager(); manager != nil {
+		manager.StopAll()
+		log.Println("PCAP capture files closed.")
 	}
 }
@@ -0,0 +1,219 @@
+package internal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Worker queue lanes
+const (
+	laneBulk     = "bulk"     // audio and video
+	lanePriority = "priority" // RTCP and DTMF events
+)
+
+// Worker queue metrics
+var (
+	queueDepth = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "karl_queue_depth",
+			Help: "Packets waiting in the RTP worker queues",
+		},
+		[]string{"lane"},
+	)
+
+	queueDropped = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "karl_queue_dropped_packets_total",
+			Help: "Packets dropped because an RTP worker queue was full",
+		},
+		[]string{"lane"},
+	)
+)
+
+// QueueConfig sizes the RTP worker queues and picks what to drop when a
+// worker falls behind
+type QueueConfig struct {
+	Size   int                  // packets per worker, 0 for the default of 256
+	Policy BackpressureStrategy // StrategyDropOldest or StrategyDrop (drop the newest)
+}
+
+// ParseQueueDropPolicy maps drop_oldest or drop_newest to a strategy; an
+// empty name selects drop_oldest
+func ParseQueueDropPolicy(name string) (BackpressureStrategy, error) {
+	switch strings.ToLower(name) {
+	case "", "drop_oldest":
+		return StrategyDropOldest, nil
+	case "drop_newest", "drop":
+		return StrategyDrop, nil
+	}
+	return 0, fmt.Errorf("invalid queue drop policy %q, expected drop_oldest or drop_newest", name)
+}
+
+// queueLane is one lane of a packetQueue with its metrics
+type queueLane struct {
+	ch      chan rtpJob
+	depth   prometheus.Gauge
+	dropped prometheus.Counter
+}
+
+func newQueueLane(name string, size int) queueLane {
+	return queueLane{
+		ch:      make(chan rtpJob, size),
+		depth:   queueDepth.WithLabelValues(name),
+		dropped: queueDropped.WithLabelValues(name),
+	}
+}
+
+// packetQueue is one worker's bounded job queue. RTCP and DTMF events go
+// in a priority lane that the worker drains before the bulk audio lane,
+// so feedback and digits are not stuck behind a backlog of media
+type packetQueue struct {
+	priority queueLane
+	bulk     queueLane
+	policy   BackpressureStrategy
+
+	// mu keeps producers from sending on a queue being closed
+	mu     sync.RWMutex
+	closed bool
+}
+
+// newPacketQueue creates a queue holding config.Size bulk packets, with a
+// priority lane a quarter of that
+func newPacketQueue(config QueueConfig) *packetQueue {
+	size := config.Size
+	if size <= 0 {
+		size = rtpQueueDepth
+	}
+	prioritySize := size / 4
+	if prioritySize < 16 {
+		prioritySize = 16
+	}
+	return &packetQueue{
+		priority: newQueueLane(lanePriority, prioritySize),
+		bulk:     newQueueLane(laneBulk, size),
+		policy:   config.Policy,
+	}
+}
+
+// push queues a packet, dropping one when its lane is full: the oldest
+// queued packet with StrategyDropOldest, or job itself otherwise. It
+// reports whether job was queued; a dropped buffer goes back to the pool
+func (q *packetQueue) push(job rtpJob, priority bool) bool {
+	queued, open := q.offer(job, priority)
+	if !open {
+		putPacketBuffer(job.buf)
+	}
+	return queued
+}
+
+// offer is push for producers that move to another queue when this one is
+// closed: it reports open as false, leaving the job's buffer with the
+// caller
+func (q *packetQueue) offer(job rtpJob, priority bool) (queued, open bool) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return false, false
+	}
+
+	lane := &q.bulk
+	if priority {
+		lane = &q.priority
+	}
+
+	for attempt := 0; ; attempt++ {
+		select {
+		case lane.ch <- job:
+			lane.depth.Inc()
+			return true, true
+		default:
+		}
+
+		// Make room by dropping the oldest packet; another producer may
+		// take the slot first, so give up after a few tries
+		if q.policy != StrategyDropOldest || attempt == 2 {
+			break
+		}
+		select {
+		case old := <-lane.ch:
+			lane.depth.Dec()
+			lane.dropped.Inc()
+			putPacketBuffer(old.buf)
+		default:
+		}
+	}
+
+	lane.dropped.Inc()
+	putPacketBuffer(job.buf)
+	return false, true
+}
+
+// pop returns the next packet, priority lane first, blocking until one
+// arrives. It returns false once the queue is closed and drained
+func (q *packetQueue) pop() (rtpJob, bool) {
+	select {
+	case job, ok := <-q.priority.ch:
+		if ok {
+			q.priority.depth.Dec()
+			return job, true
+		}
+	default:
+	}
+
+	priority, bulk := q.priority.ch, q.bulk.ch
+	for priority != nil || bulk != nil {
+		select {
+		case job, ok := <-priority:
+			if !ok {
+				priority = nil
+				continue
+			}
+			q.priority.depth.Dec()
+			return job, true
+		case job, ok := <-bulk:
+			if !ok {
+				bulk = nil
+				continue
+			}
+			q.bulk.depth.Dec()
+			return job, true
+		}
+	}
+	return rtpJob{}, false
+}
+
+// len returns the number of queued packets
+func (q *packetQueue) len() int {
+	return len(q.priority.ch) + len(q.bulk.ch)
+}
+
+// close stops the queue; the worker drains what is left
+func (q *packetQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	close(q.priority.ch)
+	close(q.bulk.ch)
+}
+
+// isPriorityPacket reports whether a packet goes in the priority lane:
+// RTCP, or an RFC 4733 telephone-event negotiated for its stream
+func isPriorityPacket(packet []byte) bool {
+	if IsRTCPPacket(packet) {
+		return true
+	}
+	if len(packet) < 12 {
+		return false
+	}
+	ssrc := binary.BigEndian.Uint32(packet[8:12])
+	_, _, codec, ok := GetCodecNegotiator().ResolveLeg(ssrc, packet[1]&0x7f)
+	return ok && strings.EqualFold(codec.Name, "telephone-event")
+}
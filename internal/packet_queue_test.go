@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// queuedPacket returns a job with a pooled buffer holding an RTP header
+// with seq
+func queuedPacket(seq uint16) rtpJob {
+	buf := getPacketBuffer()
+	*buf = (*buf)[:12]
+	(*buf)[0] = 0x80
+	binary.BigEndian.PutUint16((*buf)[2:4], seq)
+	return rtpJob{buf: buf, received: time.Now()}
+}
+
+func queuedSeq(job rtpJob) uint16 {
+	return binary.BigEndian.Uint16((*job.buf)[2:4])
+}
+
+// metricValue reads a gauge or counter
+func metricValue(t *testing.T, m prometheus.Metric) float64 {
+	t.Helper()
+	var out dto.Metric
+	if err := m.Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Gauge != nil {
+		return out.Gauge.GetValue()
+	}
+	return out.Counter.GetValue()
+}
+
+func TestPacketQueue_PriorityFirst(t *testing.T) {
+	q := newPacketQueue(QueueConfig{Size: 32})
+	depth := metricValue(t, queueDepth.WithLabelValues(laneBulk))
+	for seq := uint16(0); seq < 4; seq++ {
+		q.push(queuedPacket(seq), false)
+	}
+	if got := metricValue(t, queueDepth.WithLabelValues(laneBulk)) - depth; got != 4 {
+		t.Errorf("expected the bulk depth to grow by 4, got %v", got)
+	}
+	q.push(queuedPacket(100), true)
+
+	// The priority packet jumps the audio backlog, which stays in order
+	want := []uint16{100, 0, 1, 2, 3}
+	for _, seq := range want {
+		job, ok := q.pop()
+		if !ok || queuedSeq(job) != seq {
+			t.Fatalf("expected packet %d, got %v", seq, ok)
+		}
+		putPacketBuffer(job.buf)
+	}
+	if got := metricValue(t, queueDepth.WithLabelValues(laneBulk)); got != depth {
+		t.Errorf("expected the bulk depth back at %v, got %v", depth, got)
+	}
+
+	// A closed queue hands out what is left, then reports the end
+	q.push(queuedPacket(5), false)
+	q.close()
+	if job, ok := q.pop(); !ok || queuedSeq(job) != 5 {
+		t.Fatal("expected the queued packet after close")
+	}
+	if _, ok := q.pop(); ok {
+		t.Error("expected a closed, drained queue to report the end")
+	}
+}
+
+func TestPacketQueue_DropPolicy(t *testing.T) {
+	tests := []struct {
+		policy BackpressureStrategy
+		first  uint16 // oldest packet left after overflowing the queue
+	}{
+		{StrategyDropOldest, 4},
+		{StrategyDrop, 0},
+	}
+	for _, tt := range tests {
+		q := newPacketQueue(QueueConfig{Size: 16, Policy: tt.policy})
+		dropped := metricValue(t, queueDropped.WithLabelValues(laneBulk))
+		queued := 0
+		for seq := uint16(0); seq < 20; seq++ {
+			if q.push(queuedPacket(seq), false) {
+				queued++
+			}
+		}
+		if got := metricValue(t, queueDropped.WithLabelValues(laneBulk)) - dropped; got != 4 {
+			t.Errorf("policy %d: expected 4 drops, got %v", tt.policy, got)
+		}
+		if q.len() != 16 {
+			t.Errorf("policy %d: expected a full queue, got %d", tt.policy, q.len())
+		}
+		if tt.policy == StrategyDrop && queued != 16 {
+			t.Errorf("expected drop_newest to refuse 4 packets, queued %d", queued)
+		}
+		job, _ := q.pop()
+		if queuedSeq(job) != tt.first {
+			t.Errorf("policy %d: expected packet %d first, got %d", tt.policy, tt.first, queuedSeq(job))
+		}
+	}
+}
+
+func TestParseQueueDropPolicy(t *testing.T) {
+	tests := map[string]BackpressureStrategy{
+		"":            StrategyDropOldest,
+		"drop_oldest": StrategyDropOldest,
+		"DROP_NEWEST": StrategyDrop,
+	}
+	for name, want := range tests {
+		if got, err := ParseQueueDropPolicy(name); err != nil || got != want {
+			t.Errorf("%q: expected %d, got %d, %v", name, want, got, err)
+		}
+	}
+	if _, err := ParseQueueDropPolicy("block"); err == nil {
+		t.Error("expected an unknown policy to be rejected")
+	}
+}
+
+func TestIsPriorityPacket(t *testing.T) {
+	n := GetCodecNegotiator()
+	n.SetOfferCodecs("priority-call", []CodecInfo{
+		{PayloadType: 0, Name: "PCMU", ClockRate: 8000},
+		{PayloadType: 101, Name: "telephone-event", ClockRate: 8000},
+	})
+	n.BindSSRC(0x5151, "priority-call", true)
+	t.Cleanup(func() { n.RemoveCall("priority-call") })
+
+	audio := []byte{0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x51, 0x51}
+	event := []byte{0x80, 101, 0, 0, 0, 0, 0, 0, 0, 0, 0x51, 0x51}
+	rtcp := []byte{0x80, 200, 0, 6, 0, 0, 0x51, 0x51}
+	if isPriorityPacket(audio) || !isPriorityPacket(event) || !isPriorityPacket(rtcp) {
+		t.Error("expected RTCP and DTMF events, but not audio, in the priority lane")
+	}
+}
@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// MTU limits
+const (
+	DefaultMTU = 1500
+	minMTU     = 576
+	maxMTU     = 9216
+
+	// Headers a generated packet may still get after Karl builds it: IPv6
+	// and UDP, plus the longest SRTP authentication tag
+	packetOverhead = 40 + 8 + 16
+)
+
+// Path MTU metrics
+var (
+	mtuClampedPackets = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "karl_mtu_clamped_packets_total",
+			Help: "Packets generated by Karl that were not sent because they would exceed the transport MTU",
+		},
+		[]string{"kind"},
+	)
+
+	fragNeededTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "karl_icmp_frag_needed_total",
+			Help: "Sends rejected because the packet exceeds a path MTU lowered by ICMP fragmentation needed or packet too big",
+		},
+	)
+)
+
+var (
+	transportMTU atomic.Int64
+	dontFragment atomic.Bool
+	// A socket that cannot be set or a lowered path MTU is reported at most
+	// once a minute
+	pathMTUErrors = NewLogSampler(Logger(ComponentRTP), slog.LevelWarn, 1, time.Minute)
+)
+
+func init() {
+	transportMTU.Store(DefaultMTU)
+}
+
+// ConfigureMTU sets the MTU generated packets are kept under and whether
+// media sockets opened from now on set the don't fragment bit
+func ConfigureMTU(transport TransportConfig) {
+	mtu := transport.MTU
+	if mtu <= 0 {
+		mtu = DefaultMTU
+	}
+	transportMTU.Store(int64(mtu))
+	dontFragment.Store(transport.DontFragment)
+}
+
+// ValidateMTU checks that the transport MTU is a size IP can carry
+func ValidateMTU(cfg *Config) error {
+	if mtu := cfg.Transport.MTU; mtu != 0 && (mtu < minMTU || mtu > maxMTU) {
+		return fmt.Errorf("invalid transport MTU %d, expected %d-%d", mtu, minMTU, maxMTU)
+	}
+	return nil
+}
+
+// MaxGeneratedPacketSize returns the largest RTP packet Karl may generate,
+// leaving room for the IP, UDP and SRTP overhead added on the way out
+func MaxGeneratedPacketSize() int {
+	return int(transportMTU.Load()) - packetOverhead
+}
+
+// fitsMTU reports whether a packet Karl generated may be sent, counting it
+// as clamped when it may not
+func fitsMTU(kind string, size int) bool {
+	if size <= MaxGeneratedPacketSize() {
+		return true
+	}
+	mtuClampedPackets.WithLabelValues(kind).Inc()
+	return false
+}
+
+// SetDontFragment sets the don't fragment bit on a media socket when
+// transport.dont_fragment is enabled. The kernel then reports a path MTU
+// lowered by ICMP as an error on the next larger send instead of
+// fragmenting, so a blackholing tunnel shows up in the metrics
+func SetDontFragment(conn net.Conn) {
+	if conn == nil || !dontFragment.Load() {
+		return
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return
+	}
+	if err := setDontFragment(sc); err != nil && pathMTUErrors.Allow() {
+		pathMTUErrors.Log("Failed to set don't fragment", "error", err)
+	}
+}
+
+// notePathMTUError counts a send that failed because the packet exceeds
+// the path MTU, and reports the path MTU the kernel learned for addr
+func notePathMTUError(conn net.Conn, addr string, err error) {
+	if !errors.Is(err, syscall.EMSGSIZE) {
+		return
+	}
+	fragNeededTotal.Inc()
+	if !pathMTUErrors.Allow() {
+		return
+	}
+	mtu := 0
+	if sc, ok := conn.(syscall.Conn); ok {
+		mtu = pathMTU(sc)
+	}
+	pathMTUErrors.Log("Packet exceeds the path MTU", "addr", addr, "path_mtu", mtu, "mtu", transportMTU.Load())
+}
@@ -0,0 +1,48 @@
+//go:build linux
+
+package internal
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// setDontFragment turns on path MTU discovery with DF set and no local
+// fragmentation. A dual-stack socket takes both options, a socket of one
+// family only its own
+func setDontFragment(conn syscall.Conn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errV4, errV6 error
+	if err := raw.Control(func(fd uintptr) {
+		errV4 = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_DO)
+		errV6 = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_DO)
+	}); err != nil {
+		return err
+	}
+	if errV4 != nil && errV6 != nil {
+		return errV4
+	}
+	return nil
+}
+
+// pathMTU returns the path MTU the kernel knows for a connected socket, or
+// 0 when it is not known
+func pathMTU(conn syscall.Conn) int {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0
+	}
+	mtu := 0
+	raw.Control(func(fd uintptr) {
+		if v, err := unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU); err == nil {
+			mtu = v
+		} else if v, err := unix.GetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU); err == nil {
+			mtu = v
+		}
+	})
+	return mtu
+}
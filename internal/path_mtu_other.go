@@ -0,0 +1,19 @@
+//go:build !linux
+
+package internal
+
+import (
+	"errors"
+	"syscall"
+)
+
+// setDontFragment fails outside Linux, where Karl does not set path MTU
+// discovery options
+func setDontFragment(conn syscall.Conn) error {
+	return errors.New("don't fragment is only supported on Linux")
+}
+
+// pathMTU is not known outside Linux
+func pathMTU(conn syscall.Conn) int {
+	return 0
+}
@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+func TestValidateMTU(t *testing.T) {
+	tests := []struct {
+		mtu     int
+		wantErr bool
+	}{
+		{0, false},
+		{1500, false},
+		{1280, false},
+		{9000, false},
+		{500, true},
+		{65536, true},
+	}
+	for _, tt := range tests {
+		cfg := &Config{Transport: TransportConfig{MTU: tt.mtu}}
+		if err := ValidateMTU(cfg); (err != nil) != tt.wantErr {
+			t.Errorf("ValidateMTU(%d) error = %v, wantErr %v", tt.mtu, err, tt.wantErr)
+		}
+	}
+}
+
+func TestConfigureMTU(t *testing.T) {
+	defer ConfigureMTU(TransportConfig{})
+
+	ConfigureMTU(TransportConfig{})
+	if got := MaxGeneratedPacketSize(); got != DefaultMTU-packetOverhead {
+		t.Errorf("default = %d, want %d", got, DefaultMTU-packetOverhead)
+	}
+
+	ConfigureMTU(TransportConfig{MTU: 1280})
+	limit := MaxGeneratedPacketSize()
+	if limit != 1280-packetOverhead {
+		t.Fatalf("limit = %d, want %d", limit, 1280-packetOverhead)
+	}
+
+	clamped := mtuClampedPackets.WithLabelValues("rtp")
+	before := metricValue(t, clamped)
+	if !fitsMTU("rtp", limit) {
+		t.Error("packet at the limit was clamped")
+	}
+	if fitsMTU("rtp", limit+1) {
+		t.Error("packet over the limit was not clamped")
+	}
+	if got := metricValue(t, clamped) - before; got != 1 {
+		t.Errorf("clamped packets = %v, want 1", got)
+	}
+}
+
+func TestFECHandler_SkipsPacketsOverMTU(t *testing.T) {
+	defer ConfigureMTU(TransportConfig{})
+	ConfigureMTU(TransportConfig{MTU: 1280})
+
+	h := NewFECHandler(&FECConfig{Enabled: true, BlockSize: 2})
+	large := &RTPPacketData{SequenceNumber: 1, Payload: make([]byte, 1200)}
+	if fec := h.AddMediaPacket(large); fec != nil {
+		t.Fatal("unexpected repair packet")
+	}
+	for seq := uint16(2); seq <= 3; seq++ {
+		fec := h.AddMediaPacket(&RTPPacketData{SequenceNumber: seq, Payload: make([]byte, 160)})
+		if seq == 3 {
+			if fec == nil {
+				t.Fatal("no repair packet after two small packets")
+			}
+			if len(fec.ProtectedSeq) != 2 || fec.ProtectedSeq[0] != 2 {
+				t.Errorf("protected = %v, want [2 3]", fec.ProtectedSeq)
+			}
+			if size := len(h.PacketizeFEC(fec, 0)); size > MaxGeneratedPacketSize() {
+				t.Errorf("repair packet of %d bytes exceeds %d", size, MaxGeneratedPacketSize())
+			}
+		}
+	}
+}
+
+func TestNotePathMTUError(t *testing.T) {
+	before := metricValue(t, fragNeededTotal)
+	notePathMTUError(nil, "192.0.2.1:5004", fmt.Errorf("write: %w", syscall.ECONNREFUSED))
+	notePathMTUError(nil, "192.0.2.1:5004", &net.OpError{Op: "write", Net: "udp", Err: syscall.EMSGSIZE})
+	if got := metricValue(t, fragNeededTotal) - before; got != 1 {
+		t.Errorf("frag needed = %v, want 1", got)
+	}
+}
+
+func TestSetDontFragment(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("don't fragment is only set on Linux")
+	}
+
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := setDontFragment(conn); err != nil {
+		t.Fatalf("setDontFragment() error = %v", err)
+	}
+	if mtu := pathMTU(conn); mtu <= 0 {
+		t.Errorf("pathMTU() = %d, want the loopback MTU", mtu)
+	}
+}
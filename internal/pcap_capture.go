@@ -5,8 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log"
+	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -40,8 +43,9 @@ type PCAPCaptureConfig struct {
 	SnapLen        uint32
 	LinkType       PCAPLinkType
 	BufferSize     int
-	RotateSize     int64
-	RotateInterval time.Duration
+	RotateSize     int64         // Start a new file after this many bytes (0 disables)
+	RotateInterval time.Duration // Start a new file after this long (0 disables)
+	MaxFiles       int           // Rotated files to keep, oldest deleted first (0 keeps all)
 	Filter         PacketFilter
 }
 
@@ -89,6 +93,12 @@ type PCAPCapture struct {
 	byteCount   atomic.Int64
 	startTime   time.Time
 
+	// Rotation state, guarded by mu
+	fileIndex int
+	fileBytes int64
+	fileStart time.Time
+	files     []string
+
 	packetChan chan *CapturedPacket
 	stopChan   chan struct{}
 	doneChan   chan struct{}
@@ -144,35 +154,86 @@ func (pc *PCAPCapture) Start() error {
 		return fmt.Errorf("failed to create output directory: %w", err)
 	}
 
-	// Open output file
-	file, err := os.Create(pc.config.OutputPath)
+	pc.fileIndex = 0
+	pc.files = nil
+	if err := pc.openFile(pc.config.OutputPath); err != nil {
+		return err
+	}
+
+	pc.running = true
+	pc.startTime = time.Now()
+	pc.stopChan = make(chan struct{})
+	pc.doneChan = make(chan struct{})
+
+	go pc.captureLoop()
+
+	return nil
+}
+
+// openFile creates a capture file and writes the PCAP header. Caller holds mu.
+func (pc *PCAPCapture) openFile(path string) error {
+	file, err := os.Create(path)
 	if err != nil {
 		return fmt.Errorf("failed to create capture file: %w", err)
 	}
 
-	pc.file = file
-	pc.writer = &pcapFileWriter{
+	writer := &pcapFileWriter{
 		w:        file,
 		snapLen:  pc.config.SnapLen,
 		linkType: pc.config.LinkType,
 	}
-
-	// Write PCAP header
-	if err := pc.writer.writeHeader(); err != nil {
-		pc.file.Close()
+	if err := writer.writeHeader(); err != nil {
+		file.Close()
 		return fmt.Errorf("failed to write PCAP header: %w", err)
 	}
 
-	pc.running = true
-	pc.startTime = time.Now()
-	pc.stopChan = make(chan struct{})
-	pc.doneChan = make(chan struct{})
+	pc.file = file
+	pc.writer = writer
+	pc.fileBytes = pcapHeaderSize
+	pc.fileStart = time.Now()
+	pc.files = append(pc.files, path)
+	return nil
+}
 
-	go pc.captureLoop()
+// shouldRotate reports whether the current file has reached its size or age
+// limit. Caller holds mu.
+func (pc *PCAPCapture) shouldRotate(now time.Time) bool {
+	if pc.fileBytes <= pcapHeaderSize {
+		return false
+	}
+	if pc.config.RotateSize > 0 && pc.fileBytes >= pc.config.RotateSize {
+		return true
+	}
+	return pc.config.RotateInterval > 0 && now.Sub(pc.fileStart) >= pc.config.RotateInterval
+}
+
+// rotate closes the current file, opens the next one and prunes the oldest
+// files beyond MaxFiles. Caller holds mu.
+func (pc *PCAPCapture) rotate() error {
+	if pc.file != nil {
+		pc.file.Close()
+		pc.file = nil
+		pc.writer = nil
+	}
+
+	pc.fileIndex++
+	if err := pc.openFile(rotatedPCAPPath(pc.config.OutputPath, pc.fileIndex)); err != nil {
+		return err
+	}
 
+	for pc.config.MaxFiles > 0 && len(pc.files) > pc.config.MaxFiles {
+		_ = os.Remove(pc.files[0])
+		pc.files = pc.files[1:]
+	}
 	return nil
 }
 
+// rotatedPCAPPath numbers a rotated file: call.pcap becomes call.1.pcap
+func rotatedPCAPPath(path string, index int) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s.%d%s", strings.TrimSuffix(path, ext), index, ext)
+}
+
 // Stop stops the packet capture
 func (pc *PCAPCapture) Stop() error {
 	pc.mu.Lock()
@@ -271,12 +332,21 @@ func (pc *PCAPCapture) writePacket(packet *CapturedPacket) {
 		return
 	}
 
-	if err := pc.writer.writePacket(packet); err != nil {
+	if pc.shouldRotate(time.Now()) {
+		if err := pc.rotate(); err != nil {
+			log.Printf("Failed to rotate capture %s: %v", pc.config.OutputPath, err)
+			return
+		}
+	}
+
+	written, err := pc.writer.writePacket(packet)
+	if err != nil {
 		return
 	}
 
 	pc.packetCount.Add(1)
-	pc.byteCount.Add(int64(len(packet.Data) + pcapPacketHdrSize))
+	pc.byteCount.Add(int64(written))
+	pc.fileBytes += int64(written)
 }
 
 // GetStats returns capture statistics
@@ -284,6 +354,7 @@ func (pc *PCAPCapture) GetStats() *PCAPCaptureStats {
 	pc.mu.Lock()
 	running := pc.running
 	startTime := pc.startTime
+	files := append([]string(nil), pc.files...)
 	pc.mu.Unlock()
 
 	var duration time.Duration
@@ -296,6 +367,7 @@ func (pc *PCAPCapture) GetStats() *PCAPCaptureStats {
 		ByteCount:   pc.byteCount.Load(),
 		Duration:    duration,
 		Running:     running,
+		Files:       files,
 	}
 }
 
@@ -305,6 +377,7 @@ type PCAPCaptureStats struct {
 	ByteCount   int64
 	Duration    time.Duration
 	Running     bool
+	Files       []string // Capture files still on disk, oldest first
 }
 
 // pcapFileWriter methods
@@ -324,18 +397,28 @@ func (w *pcapFileWriter) writeHeader() error {
 	return err
 }
 
-func (w *pcapFileWriter) writePacket(packet *CapturedPacket) error {
+// writePacket writes one record and returns the number of bytes written
+func (w *pcapFileWriter) writePacket(packet *CapturedPacket) (int, error) {
+	data := packet.Data
+	origLen := packet.OrigLen
+	if origLen == 0 {
+		origLen = uint32(len(data))
+	}
+
+	// Raw IP captures need the IP/UDP headers the socket stripped
+	if w.linkType == LinkTypeRaw {
+		if encapsulated := encapsulateUDP(packet); encapsulated != nil {
+			origLen += uint32(len(encapsulated) - len(data))
+			data = encapsulated
+		}
+	}
+
 	// Calculate lengths
-	captureLen := uint32(len(packet.Data))
+	captureLen := uint32(len(data))
 	if captureLen > w.snapLen {
 		captureLen = w.snapLen
 	}
 
-	origLen := packet.OrigLen
-	if origLen == 0 {
-		origLen = uint32(len(packet.Data))
-	}
-
 	ts := packet.Timestamp
 	if ts.IsZero() {
 		ts = time.Now()
@@ -349,12 +432,64 @@ func (w *pcapFileWriter) writePacket(packet *CapturedPacket) error {
 	binary.LittleEndian.PutUint32(header[12:16], origLen)
 
 	if _, err := w.w.Write(header); err != nil {
-		return err
+		return 0, err
 	}
 
 	// Write packet data
-	_, err := w.w.Write(packet.Data[:captureLen])
-	return err
+	if _, err := w.w.Write(data[:captureLen]); err != nil {
+		return 0, err
+	}
+	return pcapPacketHdrSize + int(captureLen), nil
+}
+
+// encapsulateUDP prepends IPv4 or IPv6 and UDP headers built from the
+// packet's addresses. It returns nil when the addresses are missing.
+func encapsulateUDP(packet *CapturedPacket) []byte {
+	srcIP := net.ParseIP(packet.SrcIP)
+	dstIP := net.ParseIP(packet.DstIP)
+	if srcIP == nil || dstIP == nil {
+		return nil
+	}
+
+	udpLen := 8 + len(packet.Data)
+	udp := make([]byte, 8, udpLen)
+	binary.BigEndian.PutUint16(udp[0:2], packet.SrcPort)
+	binary.BigEndian.PutUint16(udp[2:4], packet.DstPort)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(udpLen))
+	udp = append(udp, packet.Data...) // checksum left as 0 (not computed)
+
+	src4, dst4 := srcIP.To4(), dstIP.To4()
+	if src4 != nil && dst4 != nil {
+		ip := make([]byte, 20, 20+udpLen)
+		ip[0] = 0x45 // IPv4, 5-word header
+		binary.BigEndian.PutUint16(ip[2:4], uint16(20+udpLen))
+		ip[8] = 64 // TTL
+		ip[9] = 17 // UDP
+		copy(ip[12:16], src4)
+		copy(ip[16:20], dst4)
+		binary.BigEndian.PutUint16(ip[10:12], ipv4Checksum(ip))
+		return append(ip, udp...)
+	}
+
+	ip := make([]byte, 40, 40+udpLen)
+	ip[0] = 0x60 // IPv6
+	binary.BigEndian.PutUint16(ip[4:6], uint16(udpLen))
+	ip[6] = 17 // UDP
+	ip[7] = 64 // Hop limit
+	copy(ip[8:24], srcIP.To16())
+	copy(ip[24:40], dstIP.To16())
+	return append(ip, udp...)
+}
+
+func ipv4Checksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i : i+2]))
+	}
+	for sum > 0xFFFF {
+		sum = (sum >> 16) + (sum & 0xFFFF)
+	}
+	return ^uint16(sum)
 }
 
 // PCAPCaptureManager manages multiple captures
@@ -446,11 +581,52 @@ func (m *PCAPCaptureManager) StopAll() {
 	}
 }
 
+// NewRTPPacketFilter keeps RTP packets whose SSRC and payload type are in the
+// given sets and RTCP packets sent by one of the SSRCs. An empty set matches
+// everything.
+func NewRTPPacketFilter(ssrcs []uint32, payloadTypes []uint8) PacketFilter {
+	if len(ssrcs) == 0 && len(payloadTypes) == 0 {
+		return nil
+	}
+
+	ssrcSet := make(map[uint32]bool, len(ssrcs))
+	for _, ssrc := range ssrcs {
+		ssrcSet[ssrc] = true
+	}
+	ptSet := make(map[uint8]bool, len(payloadTypes))
+	for _, pt := range payloadTypes {
+		ptSet[pt] = true
+	}
+
+	return func(p *CapturedPacket) bool {
+		if len(p.Data) < 12 || p.Data[0]>>6 != 2 {
+			return false
+		}
+		if IsRTCPPacket(p.Data) {
+			return len(ssrcSet) == 0 || ssrcSet[binary.BigEndian.Uint32(p.Data[4:8])]
+		}
+		if len(ssrcSet) > 0 && !ssrcSet[binary.BigEndian.Uint32(p.Data[8:12])] {
+			return false
+		}
+		return len(ptSet) == 0 || ptSet[p.Data[1]&0x7F]
+	}
+}
+
+// CallCaptureOptions selects and bounds what a per-call capture records
+type CallCaptureOptions struct {
+	SSRCs          []uint32
+	PayloadTypes   []uint8
+	RotateSize     int64
+	RotateInterval time.Duration
+	MaxFiles       int
+}
+
 // CallPCAPCapture captures packets for a specific call
 type CallPCAPCapture struct {
 	callID   string
 	capture  *PCAPCapture
 	started  time.Time
+	options  CallCaptureOptions
 }
 
 // NewCallPCAPCapture creates a capture for a specific call
@@ -475,6 +651,42 @@ func NewCallPCAPCapture(callID, outputPath string) (*CallPCAPCapture, error) {
 	}, nil
 }
 
+// NewCallPCAPCaptureWithOptions creates a rotating, optionally filtered
+// capture for a specific call
+func NewCallPCAPCaptureWithOptions(callID, outputPath string, opts CallCaptureOptions) *CallPCAPCapture {
+	config := &PCAPCaptureConfig{
+		OutputPath:     outputPath,
+		SnapLen:        65535,
+		LinkType:       LinkTypeRaw,
+		RotateSize:     opts.RotateSize,
+		RotateInterval: opts.RotateInterval,
+		MaxFiles:       opts.MaxFiles,
+		Filter:         NewRTPPacketFilter(opts.SSRCs, opts.PayloadTypes),
+	}
+
+	return &CallPCAPCapture{
+		callID:  callID,
+		capture: NewPCAPCapture(config),
+		started: time.Now(),
+		options: opts,
+	}
+}
+
+// CallID returns the Call-ID the capture belongs to
+func (c *CallPCAPCapture) CallID() string {
+	return c.callID
+}
+
+// StartedAt returns when the capture was created
+func (c *CallPCAPCapture) StartedAt() time.Time {
+	return c.started
+}
+
+// Options returns the filter and rotation settings of the capture
+func (c *CallPCAPCapture) Options() CallCaptureOptions {
+	return c.options
+}
+
 // Start starts the call capture
 func (c *CallPCAPCapture) Start() error {
 	return c.capture.Start()
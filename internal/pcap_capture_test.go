@@ -3,8 +3,10 @@ package internal
 import (
 	"bytes"
 	"encoding/binary"
+	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -389,7 +391,7 @@ func TestPCAPWriter_WritePacket(t *testing.T) {
 		Data:      []byte{0x01, 0x02, 0x03, 0x04},
 	}
 
-	if err := w.writePacket(packet); err != nil {
+	if _, err := w.writePacket(packet); err != nil {
 		t.Fatalf("failed to write packet: %v", err)
 	}
 
@@ -432,7 +434,7 @@ func TestPCAPWriter_SnapLength(t *testing.T) {
 		OrigLen:   8,
 	}
 
-	if err := w.writePacket(packet); err != nil {
+	if _, err := w.writePacket(packet); err != nil {
 		t.Fatalf("failed to write packet: %v", err)
 	}
 
@@ -715,3 +717,244 @@ func TestPCAPCapture_ValidPCAPFile(t *testing.T) {
 		t.Errorf("expected at least 1 packet in file, got %d", packetCount)
 	}
 }
+
+// testRTPBytes builds a minimal RTP packet with the given SSRC and payload type
+func testRTPBytes(ssrc uint32, pt uint8) []byte {
+	data := make([]byte, 20)
+	data[0] = 0x80
+	data[1] = pt
+	binary.BigEndian.PutUint32(data[8:12], ssrc)
+	return data
+}
+
+func TestPCAPCapture_RotateBySize(t *testing.T) {
+	tmpDir := t.TempDir()
+	outputPath := filepath.Join(tmpDir, "rotate.pcap")
+
+	capture := NewPCAPCapture(&PCAPCaptureConfig{
+		OutputPath: outputPath,
+		SnapLen:    65535,
+		LinkType:   LinkTypeRaw,
+		BufferSize: 100,
+		RotateSize: pcapHeaderSize + 2*(pcapPacketHdrSize+4), // Two packets per file
+		MaxFiles:   2,
+	})
+	if err := capture.Start(); err != nil {
+		t.Fatalf("failed to start capture: %v", err)
+	}
+
+	for i := 0; i < 7; i++ {
+		if err := capture.CapturePacket(&CapturedPacket{Data: []byte{byte(i), 0, 0, 0}}); err != nil {
+			t.Fatalf("failed to capture packet %d: %v", i, err)
+		}
+	}
+	if err := capture.Stop(); err != nil {
+		t.Fatalf("failed to stop capture: %v", err)
+	}
+
+	stats := capture.GetStats()
+	if stats.PacketCount != 7 {
+		t.Errorf("expected 7 packets, got %d", stats.PacketCount)
+	}
+
+	// Files 0..3 were written; only the newest two are kept
+	expected := []string{
+		filepath.Join(tmpDir, "rotate.2.pcap"),
+		filepath.Join(tmpDir, "rotate.3.pcap"),
+	}
+	if len(stats.Files) != len(expected) || stats.Files[0] != expected[0] || stats.Files[1] != expected[1] {
+		t.Fatalf("expected files %v, got %v", expected, stats.Files)
+	}
+	if _, err := os.Stat(outputPath); !os.IsNotExist(err) {
+		t.Error("expected oldest capture file to be pruned")
+	}
+
+	last, err := os.ReadFile(expected[1])
+	if err != nil {
+		t.Fatalf("failed to read rotated file: %v", err)
+	}
+	if binary.LittleEndian.Uint32(last[0:4]) != pcapMagicNumber {
+		t.Error("rotated file is missing the PCAP header")
+	}
+	if len(last) != pcapHeaderSize+pcapPacketHdrSize+4 {
+		t.Errorf("expected one packet in last file, got %d bytes", len(last))
+	}
+}
+
+func TestRotatedPCAPPath(t *testing.T) {
+	if got := rotatedPCAPPath("/tmp/call.pcap", 3); got != "/tmp/call.3.pcap" {
+		t.Errorf("unexpected rotated path %s", got)
+	}
+}
+
+func TestPCAPWriter_EncapsulatesUDP(t *testing.T) {
+	var buf bytes.Buffer
+	w := &pcapFileWriter{w: &buf, snapLen: 65535, linkType: LinkTypeRaw}
+
+	payload := testRTPBytes(0x1234, 0)
+	written, err := w.writePacket(&CapturedPacket{
+		Timestamp: time.Now(),
+		Data:      payload,
+		SrcIP:     "192.168.1.1",
+		DstIP:     "192.168.1.2",
+		SrcPort:   10000,
+		DstPort:   20000,
+	})
+	if err != nil {
+		t.Fatalf("failed to write packet: %v", err)
+	}
+
+	data := buf.Bytes()
+	if written != len(data) {
+		t.Errorf("reported %d bytes written, buffer has %d", written, len(data))
+	}
+	record := data[pcapPacketHdrSize:]
+	if len(record) != 20+8+len(payload) {
+		t.Fatalf("expected IPv4+UDP+RTP record, got %d bytes", len(record))
+	}
+	if binary.LittleEndian.Uint32(data[12:16]) != uint32(len(record)) {
+		t.Error("original length should include the added headers")
+	}
+	if record[0] != 0x45 || record[9] != 17 {
+		t.Errorf("unexpected IPv4 header %x", record[:20])
+	}
+	if ipv4Checksum(record[:20]) != 0 {
+		t.Error("invalid IPv4 header checksum")
+	}
+	if binary.BigEndian.Uint16(record[20:22]) != 10000 || binary.BigEndian.Uint16(record[22:24]) != 20000 {
+		t.Error("unexpected UDP ports")
+	}
+	if !bytes.Equal(record[28:], payload) {
+		t.Error("RTP payload mismatch")
+	}
+
+	buf.Reset()
+	if _, err := w.writePacket(&CapturedPacket{Data: payload, SrcIP: "2001:db8::1", DstIP: "2001:db8::2"}); err != nil {
+		t.Fatalf("failed to write IPv6 packet: %v", err)
+	}
+	if record := buf.Bytes()[pcapPacketHdrSize:]; len(record) != 40+8+len(payload) || record[0]>>4 != 6 {
+		t.Errorf("expected IPv6+UDP+RTP record, got %d bytes", len(record))
+	}
+}
+
+func TestRTPPacketFilter(t *testing.T) {
+	if NewRTPPacketFilter(nil, nil) != nil {
+		t.Error("expected no filter without criteria")
+	}
+
+	filter := NewRTPPacketFilter([]uint32{0xAAAA}, []uint8{0, 8})
+	cases := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"matching SSRC and payload type", testRTPBytes(0xAAAA, 8), true},
+		{"other SSRC", testRTPBytes(0xBBBB, 8), false},
+		{"other payload type", testRTPBytes(0xAAAA, 101), false},
+		{"marker bit ignored", testRTPBytes(0xAAAA, 0x80), true},
+		{"RTCP from SSRC", []byte{0x80, 200, 0, 6, 0, 0, 0xAA, 0xAA, 0, 0, 0, 0}, true},
+		{"RTCP from other SSRC", []byte{0x80, 201, 0, 1, 0, 0, 0xBB, 0xBB, 0, 0, 0, 0}, false},
+		{"not RTP", []byte{0x00, 0x01, 0x02}, false},
+	}
+	for _, tc := range cases {
+		if got := filter(&CapturedPacket{Data: tc.data}); got != tc.want {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, got)
+		}
+	}
+}
+
+func newTestCallCaptureManager(t *testing.T, autoCapture bool) (*CallCaptureManager, string) {
+	t.Helper()
+	tmpDir := t.TempDir()
+	manager := NewCallCaptureManager(&PCAPConfig{AutoCapture: autoCapture, Path: tmpDir})
+	manager.SetCallIDResolver(func(ssrc uint32) (string, bool) {
+		switch ssrc {
+		case 0x1111:
+			return "call-a@example.com", true
+		case 0x2222:
+			return "call-b", true
+		}
+		return "", false
+	})
+	t.Cleanup(manager.StopAll)
+	return manager, tmpDir
+}
+
+func waitForPackets(t *testing.T, capture *CallPCAPCapture, want int64) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for capture.GetStats().PacketCount < want {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d packets, got %d", want, capture.GetStats().PacketCount)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCallCaptureManager_RoutesByCall(t *testing.T) {
+	manager, tmpDir := newTestCallCaptureManager(t, false)
+
+	if manager.Active() {
+		t.Error("manager should be idle without captures")
+	}
+	manager.Capture(testRTPBytes(0x1111, 0), nil, nil)
+	if len(manager.ListCalls()) != 0 {
+		t.Fatal("packets should not start a capture without auto capture")
+	}
+
+	capture, err := manager.StartCall("call-a@example.com", &CallCaptureOptions{PayloadTypes: []uint8{0}})
+	if err != nil {
+		t.Fatalf("StartCall failed: %v", err)
+	}
+	if _, err := manager.StartCall("call-a@example.com", nil); err != ErrCaptureAlreadyRunning {
+		t.Errorf("expected ErrCaptureAlreadyRunning, got %v", err)
+	}
+	if !manager.Active() {
+		t.Error("manager should be active with a running capture")
+	}
+
+	src := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4000}
+	dst := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 30000}
+	manager.Capture(testRTPBytes(0x1111, 0), src, dst)   // captured
+	manager.Capture(testRTPBytes(0x1111, 101), src, dst) // filtered by payload type
+	manager.Capture(testRTPBytes(0x2222, 0), src, dst)   // other call, not captured
+	manager.Capture(testRTPBytes(0x9999, 0), src, dst)   // unknown SSRC
+	waitForPackets(t, capture, 1)
+
+	files := capture.GetStats().Files
+	if len(files) != 1 || filepath.Dir(files[0]) != tmpDir {
+		t.Fatalf("unexpected capture files %v", files)
+	}
+	if name := filepath.Base(files[0]); !strings.HasPrefix(name, "call-a_example.com_") {
+		t.Errorf("capture file name should be derived from the Call-ID, got %s", name)
+	}
+
+	if err := manager.StopCall("call-a@example.com"); err != nil {
+		t.Fatalf("StopCall failed: %v", err)
+	}
+	if err := manager.StopCall("call-a@example.com"); err != ErrCaptureNotRunning {
+		t.Errorf("expected ErrCaptureNotRunning, got %v", err)
+	}
+	if capture.GetStats().PacketCount != 1 {
+		t.Errorf("expected exactly 1 packet, got %d", capture.GetStats().PacketCount)
+	}
+}
+
+func TestCallCaptureManager_AutoCapture(t *testing.T) {
+	manager, _ := newTestCallCaptureManager(t, true)
+
+	manager.Capture(testRTPBytes(0x1111, 0), nil, nil)
+	manager.Capture(testRTPBytes(0x2222, 0), nil, nil)
+	manager.Capture([]byte{0x80, 200, 0, 6, 0, 0, 0x22, 0x22, 0, 0, 0, 0}, nil, nil)
+
+	if len(manager.ListCalls()) != 2 {
+		t.Fatalf("expected one capture per call, got %d", len(manager.ListCalls()))
+	}
+	waitForPackets(t, manager.GetCall("call-b"), 2)
+
+	manager.SetAutoCapture(false)
+	manager.StopAll()
+	if manager.Active() {
+		t.Error("manager should be idle after StopAll with auto capture off")
+	}
+}
@@ -0,0 +1,189 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Link types read but not written by Karl
+const (
+	linkTypeIPv4      PCAPLinkType = 228
+	linkTypeIPv6      PCAPLinkType = 229
+	linkTypeLinuxSLL2 PCAPLinkType = 276
+)
+
+// Magic numbers of classic pcap files; nanosecond files swap the low bytes
+const (
+	pcapMagicNanoseconds = 0xa1b23c4d
+	pcapngMagic          = 0x0a0d0d0a
+)
+
+// ErrUnsupportedPCAP is returned for capture files ReadPCAPDatagrams
+// cannot read
+var ErrUnsupportedPCAP = errors.New("unsupported capture file")
+
+// PCAPDatagram is a UDP datagram read from a capture file
+type PCAPDatagram struct {
+	Timestamp time.Time
+	Src       *net.UDPAddr
+	Dst       *net.UDPAddr
+	Payload   []byte
+}
+
+// ReadPCAPDatagrams reads the UDP datagrams of a classic pcap file, as
+// written by Karl or tcpdump, in capture order. Records that are not
+// complete IPv4 or IPv6 UDP datagrams, such as TCP segments and IP
+// fragments, are skipped
+func ReadPCAPDatagrams(r io.Reader) ([]PCAPDatagram, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, pcapHeaderSize)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedPCAP, err)
+	}
+
+	var order binary.ByteOrder
+	var nanos bool
+	switch {
+	case binary.LittleEndian.Uint32(header) == pcapMagicNumber:
+		order = binary.LittleEndian
+	case binary.BigEndian.Uint32(header) == pcapMagicNumber:
+		order = binary.BigEndian
+	case binary.LittleEndian.Uint32(header) == pcapMagicNanoseconds:
+		order, nanos = binary.LittleEndian, true
+	case binary.BigEndian.Uint32(header) == pcapMagicNanoseconds:
+		order, nanos = binary.BigEndian, true
+	case binary.BigEndian.Uint32(header) == pcapngMagic:
+		return nil, fmt.Errorf("%w: pcapng, convert it with editcap -F pcap", ErrUnsupportedPCAP)
+	default:
+		return nil, fmt.Errorf("%w: not a pcap file", ErrUnsupportedPCAP)
+	}
+	linkType := PCAPLinkType(order.Uint32(header[20:24]) & 0xffff)
+
+	var datagrams []PCAPDatagram
+	record := make([]byte, pcapPacketHdrSize)
+	for {
+		if _, err := io.ReadFull(br, record); err != nil {
+			if err == io.EOF {
+				return datagrams, nil
+			}
+			return datagrams, fmt.Errorf("truncated capture file: %w", err)
+		}
+		sec, frac := order.Uint32(record[0:4]), order.Uint32(record[4:8])
+		captureLen := order.Uint32(record[8:12])
+		if captureLen > 1<<18 {
+			return datagrams, fmt.Errorf("%w: record of %d bytes", ErrUnsupportedPCAP, captureLen)
+		}
+		data := make([]byte, captureLen)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return datagrams, fmt.Errorf("truncated capture file: %w", err)
+		}
+
+		ip, ok := linkPayload(linkType, data)
+		if !ok {
+			continue
+		}
+		d, ok := parseUDPDatagram(ip)
+		if !ok {
+			continue
+		}
+		if nanos {
+			d.Timestamp = time.Unix(int64(sec), int64(frac))
+		} else {
+			d.Timestamp = time.Unix(int64(sec), int64(frac)*1000)
+		}
+		datagrams = append(datagrams, d)
+	}
+}
+
+// linkPayload strips the link layer header of a record, returning the IP
+// packet it carries
+func linkPayload(linkType PCAPLinkType, data []byte) ([]byte, bool) {
+	switch linkType {
+	case LinkTypeRaw, linkTypeIPv4, linkTypeIPv6:
+		return data, true
+	case LinkTypeNull:
+		// 4-byte address family in the capturing host's byte order
+		if len(data) < 4 {
+			return nil, false
+		}
+		return data[4:], true
+	case LinkTypeEthernet:
+		if len(data) < 14 {
+			return nil, false
+		}
+		etherType, offset := binary.BigEndian.Uint16(data[12:14]), 14
+		for (etherType == 0x8100 || etherType == 0x88a8) && len(data) >= offset+4 {
+			etherType = binary.BigEndian.Uint16(data[offset+2 : offset+4])
+			offset += 4
+		}
+		if etherType != 0x0800 && etherType != 0x86dd {
+			return nil, false
+		}
+		return data[offset:], true
+	case LinkTypeLinuxSLL:
+		if len(data) < 16 {
+			return nil, false
+		}
+		return data[16:], true
+	case linkTypeLinuxSLL2:
+		if len(data) < 20 {
+			return nil, false
+		}
+		return data[20:], true
+	}
+	return nil, false
+}
+
+// parseUDPDatagram parses an unfragmented IPv4 or IPv6 UDP packet
+func parseUDPDatagram(ip []byte) (PCAPDatagram, bool) {
+	if len(ip) < 1 {
+		return PCAPDatagram{}, false
+	}
+	var src, dst net.IP
+	var udp []byte
+	switch ip[0] >> 4 {
+	case 4:
+		if len(ip) < 20 {
+			return PCAPDatagram{}, false
+		}
+		headerLen := int(ip[0]&0x0f) * 4
+		totalLen := int(binary.BigEndian.Uint16(ip[2:4]))
+		moreFragments := ip[6]&0x20 != 0
+		fragmentOffset := binary.BigEndian.Uint16(ip[6:8]) & 0x1fff
+		if ip[9] != 17 || moreFragments || fragmentOffset != 0 || headerLen < 20 || totalLen < headerLen || len(ip) < totalLen {
+			return PCAPDatagram{}, false
+		}
+		src, dst = net.IP(ip[12:16]), net.IP(ip[16:20])
+		udp = ip[headerLen:totalLen]
+	case 6:
+		if len(ip) < 40 || ip[6] != 17 {
+			return PCAPDatagram{}, false
+		}
+		payloadLen := int(binary.BigEndian.Uint16(ip[4:6]))
+		if len(ip) < 40+payloadLen {
+			return PCAPDatagram{}, false
+		}
+		src, dst = net.IP(ip[8:24]), net.IP(ip[24:40])
+		udp = ip[40 : 40+payloadLen]
+	default:
+		return PCAPDatagram{}, false
+	}
+
+	if len(udp) < 8 {
+		return PCAPDatagram{}, false
+	}
+	udpLen := int(binary.BigEndian.Uint16(udp[4:6]))
+	if udpLen < 8 || udpLen > len(udp) {
+		return PCAPDatagram{}, false
+	}
+	return PCAPDatagram{
+		Src:     &net.UDPAddr{IP: append(net.IP(nil), src...), Port: int(binary.BigEndian.Uint16(udp[0:2]))},
+		Dst:     &net.UDPAddr{IP: append(net.IP(nil), dst...), Port: int(binary.BigEndian.Uint16(udp[2:4]))},
+		Payload: udp[8:udpLen],
+	}, true
+}
@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReadPCAPDatagrams_RoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := &pcapFileWriter{w: &buf, snapLen: 65535, linkType: LinkTypeRaw}
+	if err := w.writeHeader(); err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Unix(1700000000, 123456000)
+	packets := []*CapturedPacket{
+		{Timestamp: ts, Data: []byte("first"), SrcIP: "10.0.0.1", DstIP: "10.0.0.2", SrcPort: 4000, DstPort: 5000},
+		{Timestamp: ts.Add(20 * time.Millisecond), Data: []byte("second"), SrcIP: "2001:db8::1", DstIP: "2001:db8::2", SrcPort: 4002, DstPort: 5002},
+	}
+	for _, p := range packets {
+		if _, err := w.writePacket(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	datagrams, err := ReadPCAPDatagrams(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(datagrams) != 2 {
+		t.Fatalf("read %d datagrams, want 2", len(datagrams))
+	}
+	for i, d := range datagrams {
+		p := packets[i]
+		if !d.Timestamp.Equal(p.Timestamp) {
+			t.Errorf("datagram %d: timestamp %v, want %v", i, d.Timestamp, p.Timestamp)
+		}
+		if d.Src.IP.String() != p.SrcIP || d.Src.Port != int(p.SrcPort) || d.Dst.IP.String() != p.DstIP || d.Dst.Port != int(p.DstPort) {
+			t.Errorf("datagram %d: %v -> %v", i, d.Src, d.Dst)
+		}
+		if string(d.Payload) != string(p.Data) {
+			t.Errorf("datagram %d: payload %q", i, d.Payload)
+		}
+	}
+}
+
+// buildPCAP writes a big-endian nanosecond capture of the given records
+func buildPCAP(linkType PCAPLinkType, records ...[]byte) []byte {
+	var buf bytes.Buffer
+	header := make([]byte, pcapHeaderSize)
+	binary.BigEndian.PutUint32(header[0:4], pcapMagicNanoseconds)
+	binary.BigEndian.PutUint16(header[4:6], pcapVersionMajor)
+	binary.BigEndian.PutUint16(header[6:8], pcapVersionMinor)
+	binary.BigEndian.PutUint32(header[16:20], 65535)
+	binary.BigEndian.PutUint32(header[20:24], uint32(linkType))
+	buf.Write(header)
+	for i, data := range records {
+		record := make([]byte, pcapPacketHdrSize)
+		binary.BigEndian.PutUint32(record[0:4], 1700000000)
+		binary.BigEndian.PutUint32(record[4:8], uint32(i*1000))
+		binary.BigEndian.PutUint32(record[8:12], uint32(len(data)))
+		binary.BigEndian.PutUint32(record[12:16], uint32(len(data)))
+		buf.Write(record)
+		buf.Write(data)
+	}
+	return buf.Bytes()
+}
+
+func TestReadPCAPDatagrams_LinkLayers(t *testing.T) {
+	ip := encapsulateUDP(&CapturedPacket{Data: []byte("rtp"), SrcIP: "10.0.0.1", DstIP: "10.0.0.2", SrcPort: 4000, DstPort: 5000})
+
+	// The same datagram as a fragment, which is skipped
+	fragment := append([]byte(nil), ip...)
+	fragment[6] |= 0x20
+
+	// Ethernet with a VLAN tag
+	vlan := []byte{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11,
+		0x81, 0x00, 0x00, 0x64,
+		0x08, 0x00,
+	}
+	ethernet := append(append([]byte(nil), vlan...), ip...)
+	ethernetFragment := append(append([]byte(nil), vlan...), fragment...)
+
+	datagrams, err := ReadPCAPDatagrams(bytes.NewReader(buildPCAP(LinkTypeEthernet, ethernet, ethernetFragment, ethernet)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(datagrams) != 2 {
+		t.Fatalf("read %d datagrams, want 2", len(datagrams))
+	}
+	if string(datagrams[1].Payload) != "rtp" || datagrams[1].Src.Port != 4000 {
+		t.Errorf("datagram: %v %q", datagrams[1].Src, datagrams[1].Payload)
+	}
+	if got := datagrams[1].Timestamp.Nanosecond(); got != 2000 {
+		t.Errorf("nanosecond timestamp = %d, want 2000", got)
+	}
+
+	datagrams, err = ReadPCAPDatagrams(bytes.NewReader(buildPCAP(LinkTypeRaw, fragment, ip)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(datagrams) != 1 {
+		t.Errorf("read %d datagrams, want the fragment skipped", len(datagrams))
+	}
+}
+
+func TestReadPCAPDatagrams_Unsupported(t *testing.T) {
+	pcapng := []byte{0x0a, 0x0d, 0x0d, 0x0a, 0, 0, 0, 28, 0x1a, 0x2b, 0x3c, 0x4d, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	for name, data := range map[string][]byte{
+		"pcapng": pcapng,
+		"text":   []byte("this is not a capture file at all"),
+		"short":  {0xd4, 0xc3},
+	} {
+		if _, err := ReadPCAPDatagrams(bytes.NewReader(data)); !errors.Is(err, ErrUnsupportedPCAP) {
+			t.Errorf("%s: err = %v, want ErrUnsupportedPCAP", name, err)
+		}
+	}
+}
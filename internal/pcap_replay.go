@@ -0,0 +1,467 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+
+	ng "karl/internal/ng_protocol"
+)
+
+// ReplayOptions configures ReplayPCAP
+type ReplayOptions struct {
+	CallID    string   // call whose signaling is looked up in the capture
+	OfferSDP  string   // used instead of the offer found in the capture
+	AnswerSDP string   // used instead of the answer found in the capture
+	Flags     []string // NG flags applied to the call, e.g. AGC and Opus options
+
+	// Streams sent by each leg, for captures whose addresses and a=ssrc
+	// lines do not tell, such as Karl's own per-call captures
+	OfferSSRCs  []uint32
+	AnswerSSRCs []uint32
+
+	Speed  float64   // 1 keeps the original timing, 2 replays twice as fast, 0 without pauses
+	Output io.Writer // optional pcap of the packets the pipeline sends on
+}
+
+// ReplayStream is what the pipeline made of one stream of the capture
+type ReplayStream struct {
+	SSRC            uint32  `json:"ssrc"`
+	Leg             string  `json:"leg"` // "offerer", "answerer" or "unbound"
+	Source          string  `json:"source,omitempty"`
+	PacketsIn       int     `json:"packets_in"`
+	PacketsOut      int     `json:"packets_out"`
+	PayloadTypesIn  []uint8 `json:"payload_types_in"`
+	PayloadTypesOut []uint8 `json:"payload_types_out"`
+}
+
+// ReplayResult summarizes a replay
+type ReplayResult struct {
+	CallID            string         `json:"call_id"`
+	Signaling         string         `json:"signaling"` // where the SDPs came from: "sip", "ng", "options" or "none"
+	Negotiated        bool           `json:"negotiated"`
+	MediaSeconds      float64        `json:"media_seconds"`
+	RTCPPackets       int            `json:"rtcp_packets"`
+	Skipped           int            `json:"skipped"` // datagrams that are neither media of the call nor signaling
+	TranscodingErrors uint64         `json:"transcoding_errors"`
+	ForwardingErrors  uint64         `json:"forwarding_errors"`
+	Streams           []ReplayStream `json:"streams"`
+}
+
+// callSignaling is the offer and answer of a call found in a capture
+type callSignaling struct {
+	source    string
+	offerSDP  string
+	answerSDP string
+	flags     []string
+	packets   map[int]bool // indexes of the signaling datagrams
+}
+
+// replayLeg is one side of the replayed call, as described by its SDP
+type replayLeg struct {
+	codecs   []CodecInfo
+	ptime    int
+	ssrc     uint32
+	endpoint *net.UDPAddr // where the leg receives RTP; it sends from there too
+}
+
+// ReplayPCAP feeds the RTP of a capture through the media pipeline with
+// its original timing, as though Karl had received it: the call's codecs
+// are negotiated from the SDPs in the capture or the options, so its
+// transcoding, re-framing and gain control run as they did in production.
+// Nothing is sent on the network; with Output set, the packets the
+// pipeline would have sent are written there as a pcap
+func ReplayPCAP(ctx context.Context, capture io.Reader, opts ReplayOptions) (*ReplayResult, error) {
+	datagrams, err := ReadPCAPDatagrams(capture)
+	if err != nil {
+		return nil, err
+	}
+
+	callID := opts.CallID
+	if callID == "" {
+		callID = "replay"
+	}
+	signaling := findCallSignaling(datagrams, opts.CallID)
+	if opts.OfferSDP != "" || opts.AnswerSDP != "" {
+		signaling.source = "options"
+	}
+	if opts.OfferSDP != "" {
+		signaling.offerSDP = opts.OfferSDP
+	}
+	if opts.AnswerSDP != "" {
+		signaling.answerSDP = opts.AnswerSDP
+	}
+	if opts.Flags != nil {
+		signaling.flags = opts.Flags
+	}
+	if opts.CallID != "" && signaling.offerSDP == "" && signaling.answerSDP == "" {
+		return nil, fmt.Errorf("no offer or answer for call %q in the capture; pass the SDPs instead", opts.CallID)
+	}
+
+	offerer, err := parseReplayLeg(signaling.offerSDP, signaling.flags)
+	if err != nil {
+		return nil, fmt.Errorf("offer: %w", err)
+	}
+	answerer, err := parseReplayLeg(signaling.answerSDP, signaling.flags)
+	if err != nil {
+		return nil, fmt.Errorf("answer: %w", err)
+	}
+
+	result := &ReplayResult{
+		CallID:     callID,
+		Signaling:  signaling.source,
+		Negotiated: offerer != nil && answerer != nil,
+	}
+	media := replayMedia(datagrams, signaling.packets, offerer, answerer)
+	result.Skipped = len(datagrams) - len(signaling.packets) - len(media)
+	if len(media) == 0 {
+		return result, errors.New("no RTP or RTCP in the capture")
+	}
+
+	// Negotiate the call as the NG listener does for an offer and answer
+	n := GetCodecNegotiator()
+	pf := ng.ParseFlags(signaling.flags)
+	for i, leg := range []*replayLeg{offerer, answerer} {
+		if leg == nil {
+			continue
+		}
+		if i == 0 {
+			n.SetOfferCodecs(callID, leg.codecs)
+		} else {
+			n.SetAnswerCodecs(callID, leg.codecs)
+		}
+		n.SetPtime(callID, i == 0, leg.ptime)
+	}
+	if fmtp := opusFlagsFmtp(pf); fmtp != "" {
+		n.SetOpusFmtp(callID, fmtp)
+	}
+	if agc, ok := agcConfigFromFlags(pf); ok {
+		n.SetAGC(callID, agc)
+	}
+	if pf.TranscodeMode != "" {
+		n.SetTranscodeMode(callID, pf.TranscodeMode)
+	}
+	if impairment, ok := impairmentFromFlags(pf); ok {
+		SetImpairment(callID, impairment)
+	}
+	defer n.RemoveCall(callID)
+
+	r := &replayer{streams: make(map[uint32]*ReplayStream), speed: opts.Speed}
+	if opts.Output != nil {
+		r.writer = &pcapFileWriter{w: opts.Output, snapLen: 65535, linkType: LinkTypeRaw}
+		if err := r.writer.writeHeader(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Bind every stream to its leg before the first packet, so none of it
+	// is relayed unnegotiated
+	for _, d := range media {
+		if IsRTCPPacket(d.Payload) {
+			continue
+		}
+		ssrc, _ := captureSSRC(d.Payload)
+		if _, ok := r.streams[ssrc]; ok {
+			continue
+		}
+		stream := &ReplayStream{SSRC: ssrc, Leg: "unbound", Source: d.Src.String()}
+		if fromOfferer, ok := replayLegOf(d, ssrc, offerer, answerer, opts); ok {
+			stream.Leg = "answerer"
+			if fromOfferer {
+				stream.Leg = "offerer"
+			}
+			n.BindSSRC(ssrc, callID, fromOfferer)
+		}
+		r.streams[ssrc] = stream
+		RegisterRTPHandler(ssrc, r)
+		defer UnregisterRTPHandler(ssrc)
+	}
+
+	before := [2]uint64{transcodingErrors.Load(), forwardingErrors.Load()}
+	start, first := time.Now(), media[0].Timestamp
+	r.start, r.first = start, first
+	for _, d := range media {
+		if opts.Speed > 0 {
+			due := start.Add(time.Duration(float64(d.Timestamp.Sub(first)) / opts.Speed))
+			if wait := time.Until(due); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+				}
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		r.mu.Lock()
+		r.current = d
+		if IsRTCPPacket(d.Payload) {
+			result.RTCPPackets++
+		} else if ssrc, _ := captureSSRC(d.Payload); r.streams[ssrc] != nil {
+			stream := r.streams[ssrc]
+			stream.PacketsIn++
+			stream.PayloadTypesIn = addPayloadType(stream.PayloadTypesIn, d.Payload[1]&0x7f)
+		}
+		r.mu.Unlock()
+
+		processRTPPacket(append([]byte(nil), d.Payload...), time.Now(), 0)
+		result.MediaSeconds = d.Timestamp.Sub(first).Seconds()
+	}
+	if ctx.Err() == nil {
+		drainImpairment(callID)
+	}
+	result.TranscodingErrors = transcodingErrors.Load() - before[0]
+	result.ForwardingErrors = forwardingErrors.Load() - before[1]
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, stream := range r.streams {
+		result.Streams = append(result.Streams, *stream)
+	}
+	sort.Slice(result.Streams, func(i, j int) bool { return result.Streams[i].SSRC < result.Streams[j].SSRC })
+	if r.err != nil {
+		return result, fmt.Errorf("writing output: %w", r.err)
+	}
+	return result, ctx.Err()
+}
+
+// replayer receives what the pipeline forwards during a replay
+type replayer struct {
+	mu      sync.Mutex
+	streams map[uint32]*ReplayStream
+	current PCAPDatagram // input datagram being processed
+	writer  *pcapFileWriter
+	err     error
+
+	// Replay clock, to stamp packets sent after their input was processed
+	start time.Time
+	first time.Time
+	speed float64
+}
+
+// Handle counts a forwarded packet and writes it to the output capture,
+// from the address its input was sent to
+func (r *replayer) Handle(packet *RTPPacket) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if stream := r.streams[packet.SSRC]; stream != nil {
+		stream.PacketsOut++
+		stream.PayloadTypesOut = addPayloadType(stream.PayloadTypesOut, packet.PayloadType)
+	}
+	if r.writer == nil || r.err != nil {
+		return nil
+	}
+
+	out := rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			Marker:         packet.Marker,
+			PayloadType:    packet.PayloadType,
+			SequenceNumber: packet.SequenceNumber,
+			Timestamp:      packet.Timestamp,
+			SSRC:           packet.SSRC,
+			CSRC:           packet.CSRC,
+		},
+		Payload: packet.Payload,
+	}
+	data, err := out.Marshal()
+	if err != nil {
+		return err
+	}
+	_, r.err = r.writer.writePacket(&CapturedPacket{
+		Timestamp: r.sentAt(),
+		Data:      data,
+		SrcIP:     r.current.Dst.IP.String(),
+		SrcPort:   uint16(r.current.Dst.Port),
+		DstIP:     r.current.Src.IP.String(),
+		DstPort:   uint16(r.current.Src.Port),
+		Protocol:  "RTP",
+	})
+	return r.err
+}
+
+// sentAt returns the capture time of a packet sent now; the caller holds
+// r.mu
+func (r *replayer) sentAt() time.Time {
+	if r.speed > 0 {
+		return r.first.Add(time.Duration(float64(time.Since(r.start)) * r.speed))
+	}
+	return r.current.Timestamp
+}
+
+// findCallSignaling looks for the offer and answer of a call in the SIP
+// and NG messages of a capture. The first of each is used
+func findCallSignaling(datagrams []PCAPDatagram, callID string) callSignaling {
+	found := callSignaling{source: "none", packets: make(map[int]bool)}
+	for i, d := range datagrams {
+		if _, media := captureSSRC(d.Payload); media {
+			continue
+		}
+		if isSIPMessage(d.Payload) {
+			found.packets[i] = true
+			if callID == "" {
+				continue
+			}
+			startLine, id, body := parseSIPMessage(d.Payload)
+			if id != callID || !strings.HasPrefix(strings.TrimSpace(body), "v=0") {
+				continue
+			}
+			if strings.HasPrefix(startLine, "INVITE ") && found.offerSDP == "" {
+				found.offerSDP, found.source = body, "sip"
+			} else if strings.HasPrefix(startLine, "SIP/2.0 ") && found.offerSDP != "" && found.answerSDP == "" {
+				found.answerSDP = body
+			}
+			continue
+		}
+
+		msg, err := ng.ParseMessage(d.Payload, d.Src)
+		if err != nil {
+			continue
+		}
+		found.packets[i] = true
+		req, err := msg.ToRequest()
+		if err != nil || callID == "" || req.CallID != callID || req.SDP == "" {
+			continue
+		}
+		switch req.Command {
+		case ng.CmdOffer:
+			if found.offerSDP == "" {
+				found.offerSDP, found.flags, found.source = req.SDP, requestFlags(req), "ng"
+			}
+		case ng.CmdAnswer:
+			if found.answerSDP == "" {
+				found.answerSDP = req.SDP
+			}
+		}
+	}
+	return found
+}
+
+// isSIPMessage reports whether a datagram starts with a SIP request or
+// status line
+func isSIPMessage(data []byte) bool {
+	line, _, _ := bytes.Cut(data, []byte("\n"))
+	return bytes.HasPrefix(line, []byte("SIP/2.0 ")) || bytes.Contains(line, []byte(" SIP/2.0"))
+}
+
+// parseSIPMessage returns the start line, Call-ID and body of a SIP message
+func parseSIPMessage(data []byte) (startLine, callID, body string) {
+	head, rest, _ := strings.Cut(string(data), "\r\n\r\n")
+	lines := strings.Split(head, "\r\n")
+	startLine = lines[0]
+	for _, line := range lines[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		if name = strings.TrimSpace(name); strings.EqualFold(name, "Call-ID") || name == "i" {
+			callID = strings.TrimSpace(value)
+		}
+	}
+	return startLine, callID, rest
+}
+
+// parseReplayLeg reads the codecs, packet time, SSRC and media address of
+// one leg from its SDP. It returns nil for an empty SDP
+func parseReplayLeg(raw string, flags []string) (*replayLeg, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	desc, err := ParseSDP(raw)
+	if err != nil {
+		return nil, err
+	}
+	media := PrimaryMedia(desc)
+	if media == nil {
+		return nil, fmt.Errorf("%w: no media section", ErrInvalidSDP)
+	}
+
+	leg := &replayLeg{codecs: SDPCodecs(media)}
+	leg.ssrc, _ = SDPSSRCs(media)
+	parsed := &parsedSDPInfo{}
+	if ptime, ok := SDPAttribute(desc, media, "ptime"); ok {
+		if ms, err := strconv.ParseFloat(strings.TrimSpace(ptime), 64); err == nil && ms > 0 {
+			parsed.Ptime = int(ms)
+		}
+	}
+	leg.ptime = receivePtime(parsed, flags)
+	if ip := net.ParseIP(SDPConnectionAddress(desc, media)); ip != nil && !ip.IsUnspecified() {
+		leg.endpoint = &net.UDPAddr{IP: ip, Port: media.MediaName.Port.Value}
+	}
+	return leg, nil
+}
+
+// sentBy reports whether a leg sent a datagram: it came from the leg's
+// RTP address or the RTCP port above it
+func (l *replayLeg) sentBy(d PCAPDatagram) bool {
+	if l == nil || l.endpoint == nil || !l.endpoint.IP.Equal(d.Src.IP) {
+		return false
+	}
+	return d.Src.Port == l.endpoint.Port || d.Src.Port == l.endpoint.Port+1
+}
+
+// replayMedia returns the RTP and RTCP datagrams to replay. When the SDPs'
+// addresses appear in the capture, only what the two legs sent is replayed,
+// which leaves out the packets Karl itself sent on
+func replayMedia(datagrams []PCAPDatagram, signaling map[int]bool, offerer, answerer *replayLeg) []PCAPDatagram {
+	var all, fromLegs []PCAPDatagram
+	for i, d := range datagrams {
+		if _, ok := captureSSRC(d.Payload); !ok || signaling[i] {
+			continue
+		}
+		all = append(all, d)
+		if offerer.sentBy(d) || answerer.sentBy(d) {
+			fromLegs = append(fromLegs, d)
+		}
+	}
+	if len(fromLegs) > 0 {
+		return fromLegs
+	}
+	return all
+}
+
+// replayLegOf works out which leg sent a stream: by the address it came
+// from, then by the SDPs' a=ssrc lines, then by the SSRCs in the options
+func replayLegOf(d PCAPDatagram, ssrc uint32, offerer, answerer *replayLeg, opts ReplayOptions) (fromOfferer, ok bool) {
+	switch {
+	case offerer.sentBy(d):
+		return true, true
+	case answerer.sentBy(d):
+		return false, true
+	case offerer != nil && offerer.ssrc == ssrc:
+		return true, true
+	case answerer != nil && answerer.ssrc == ssrc:
+		return false, true
+	}
+	for _, s := range opts.OfferSSRCs {
+		if s == ssrc {
+			return true, true
+		}
+	}
+	for _, s := range opts.AnswerSSRCs {
+		if s == ssrc {
+			return false, true
+		}
+	}
+	return false, false
+}
+
+func addPayloadType(types []uint8, pt uint8) []uint8 {
+	for _, t := range types {
+		if t == pt {
+			return types
+		}
+	}
+	return append(types, pt)
+}
@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+const replayOfferSDP = "v=0\r\no=- 1 1 IN IP4 10.0.0.1\r\ns=-\r\nc=IN IP4 10.0.0.1\r\nt=0 0\r\nm=audio 4000 RTP/AVP 0\r\na=rtpmap:0 PCMU/8000\r\n"
+const replayAnswerSDP = "v=0\r\no=- 2 1 IN IP4 10.0.0.2\r\ns=-\r\nc=IN IP4 10.0.0.2\r\nt=0 0\r\nm=audio 6000 RTP/AVP 8\r\na=rtpmap:8 PCMA/8000\r\n"
+
+// buildReplayCapture records a SIP call offering PCMU and answering PCMA,
+// the offerer's PCMU sent to Karl, and one packet Karl sent on
+func buildReplayCapture(t *testing.T, callID string, packets int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := &pcapFileWriter{w: &buf, snapLen: 65535, linkType: LinkTypeRaw}
+	if err := w.writeHeader(); err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Unix(1700000000, 0)
+	write := func(data []byte, src string, srcPort uint16, dst string, dstPort uint16) {
+		if _, err := w.writePacket(&CapturedPacket{Timestamp: ts, Data: data, SrcIP: src, SrcPort: srcPort, DstIP: dst, DstPort: dstPort}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sip := func(startLine, body string) []byte {
+		return []byte(startLine + "\r\nCall-ID: " + callID + "\r\nContent-Type: application/sdp\r\n\r\n" + body)
+	}
+	write(sip("INVITE sip:bob@10.0.0.2 SIP/2.0", replayOfferSDP), "10.0.0.1", 5060, "10.0.0.2", 5060)
+	write(sip("SIP/2.0 200 OK", replayAnswerSDP), "10.0.0.2", 5060, "10.0.0.1", 5060)
+
+	for i := 0; i < packets; i++ {
+		p := rtp.Packet{
+			Header:  rtp.Header{Version: 2, PayloadType: 0, SequenceNumber: uint16(i), Timestamp: uint32(i * 160), SSRC: 0x1234},
+			Payload: bytes.Repeat([]byte{0xff}, 160),
+		}
+		data, _ := p.Marshal()
+		write(data, "10.0.0.1", 4000, "10.0.0.9", 30000)
+		if i == 0 {
+			// Already through Karl; replaying it would transcode it twice
+			write(data, "10.0.0.9", 30002, "10.0.0.2", 6000)
+		}
+		ts = ts.Add(20 * time.Millisecond)
+	}
+	return buf.Bytes()
+}
+
+func TestReplayPCAP_Transcodes(t *testing.T) {
+	var output bytes.Buffer
+	result, err := ReplayPCAP(context.Background(), bytes.NewReader(buildReplayCapture(t, "replay-test@host", 10)), ReplayOptions{
+		CallID: "replay-test@host",
+		Output: &output,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Signaling != "sip" || !result.Negotiated {
+		t.Fatalf("signaling = %q negotiated %v, want the SIP offer and answer", result.Signaling, result.Negotiated)
+	}
+	if len(result.Streams) != 1 {
+		t.Fatalf("streams = %+v, want the offerer's only", result.Streams)
+	}
+	stream := result.Streams[0]
+	if stream.Leg != "offerer" || stream.PacketsIn != 10 || stream.PacketsOut != 10 {
+		t.Errorf("stream = %+v, want 10 packets in and out from the offerer", stream)
+	}
+	if len(stream.PayloadTypesOut) != 1 || stream.PayloadTypesOut[0] != 8 {
+		t.Errorf("payload types out = %v, want PCMA", stream.PayloadTypesOut)
+	}
+	if result.TranscodingErrors != 0 {
+		t.Errorf("transcoding errors = %d", result.TranscodingErrors)
+	}
+
+	sent, err := ReadPCAPDatagrams(&output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 10 {
+		t.Fatalf("output holds %d packets, want 10", len(sent))
+	}
+	if sent[0].Payload[1]&0x7f != 8 || sent[9].Timestamp.Sub(sent[0].Timestamp) != 180*time.Millisecond {
+		t.Errorf("output: pt %d, spread %v", sent[0].Payload[1]&0x7f, sent[9].Timestamp.Sub(sent[0].Timestamp))
+	}
+
+	// The call's negotiation does not outlive the replay
+	if _, ok := GetCodecNegotiator().GetCallCodecs("replay-test@host"); ok {
+		t.Error("call codecs left behind")
+	}
+}
+
+func TestReplayPCAP_OriginalTiming(t *testing.T) {
+	start := time.Now()
+	_, err := ReplayPCAP(context.Background(), bytes.NewReader(buildReplayCapture(t, "timing@host", 6)), ReplayOptions{
+		CallID: "timing@host",
+		Speed:  1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("replay took %v, want the 100ms the capture spans", elapsed)
+	}
+}
+
+func TestReplayPCAP_UnknownCall(t *testing.T) {
+	_, err := ReplayPCAP(context.Background(), bytes.NewReader(buildReplayCapture(t, "a@host", 1)), ReplayOptions{CallID: "b@host"})
+	if err == nil || !strings.Contains(err.Error(), "b@host") {
+		t.Errorf("err = %v, want no signaling for the call", err)
+	}
+}
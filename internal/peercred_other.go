@@ -0,0 +1,13 @@
+//go:build !linux
+
+package internal
+
+import (
+	"errors"
+	"net"
+)
+
+// peerUID fails outside Linux, where SO_PEERCRED is not available
+func peerUID(conn net.Conn) (uint32, error) {
+	return 0, errors.New("peer credentials are only supported on Linux")
+}
@@ -0,0 +1,141 @@
+package internal
+
+import "math"
+
+// Packet loss concealment constants, in 8 kHz samples
+const (
+	plcMinPitch     = 40              // 200 Hz
+	plcMaxPitch     = 120             // 66 Hz
+	plcHistory      = 3 * plcMaxPitch // good audio kept for pitch estimation
+	plcOverlap      = plcMinPitch     // samples crossfaded into the first good frame
+	plcAttenuation  = 0.2             // gain lost per concealed frame
+	plcMaxFrames    = 5               // concealed frames until the gain reaches zero
+	plcReorderDepth = 3               // packets buffered past a hole before it is declared lost
+)
+
+// PacketLossConcealer fills lost frames by repeating the last pitch period of
+// the decoded audio, fading out over consecutive losses, and crossfades the
+// first frame received after a loss so the splice does not click
+type PacketLossConcealer struct {
+	history []int16
+	pitch   int
+	offset  int
+	lost    int
+}
+
+// NewPacketLossConcealer creates a concealer with no audio history
+func NewPacketLossConcealer() *PacketLossConcealer {
+	return &PacketLossConcealer{}
+}
+
+// Good records a received frame. If it follows a loss the start of pcm is
+// crossfaded in place with the concealment and true is returned
+func (p *PacketLossConcealer) Good(pcm []int16) bool {
+	smoothed := false
+	if p.lost > 0 && p.pitch > 0 {
+		overlap := plcOverlap
+		if overlap > len(pcm) {
+			overlap = len(pcm)
+		}
+		gain := p.gain(p.lost)
+		for i := 0; i < overlap; i++ {
+			w := float64(i+1) / float64(overlap+1)
+			concealed := float64(p.periodSample(i)) * gain
+			pcm[i] = clampSample((1-w)*concealed + w*float64(pcm[i]))
+		}
+		smoothed = overlap > 0
+	}
+	p.lost = 0
+
+	p.history = append(p.history, pcm...)
+	if len(p.history) > plcHistory {
+		p.history = append(p.history[:0], p.history[len(p.history)-plcHistory:]...)
+	}
+	return smoothed
+}
+
+// Conceal returns n samples replacing a lost frame, or nil once the
+// concealment has faded out and nothing more should be sent
+func (p *PacketLossConcealer) Conceal(n int) []int16 {
+	if p.lost >= plcMaxFrames {
+		p.lost++
+		return nil
+	}
+	out := make([]int16, n)
+	if len(p.history) < 2*plcMinPitch {
+		p.lost++
+		return out
+	}
+	if p.lost == 0 {
+		p.pitch = estimatePitch(p.history)
+		p.offset = 0
+	}
+
+	// Ramp the gain across the frame so consecutive losses fade smoothly
+	from, to := p.gain(p.lost), p.gain(p.lost+1)
+	for i := range out {
+		gain := from + (to-from)*float64(i)/float64(n)
+		out[i] = clampSample(float64(p.periodSample(i)) * gain)
+	}
+	p.offset = (p.offset + n) % p.pitch
+	p.lost++
+	return out
+}
+
+// Lost returns the number of consecutive frames concealed so far
+func (p *PacketLossConcealer) Lost() int {
+	return p.lost
+}
+
+func (p *PacketLossConcealer) gain(lost int) float64 {
+	g := 1 - plcAttenuation*float64(lost)
+	if g < 0 {
+		return 0
+	}
+	return g
+}
+
+// periodSample returns sample i of the repeated last pitch period
+func (p *PacketLossConcealer) periodSample(i int) int16 {
+	period := p.history[len(p.history)-p.pitch:]
+	return period[(p.offset+i)%p.pitch]
+}
+
+// estimatePitch returns the lag in plcMinPitch..plcMaxPitch with the highest
+// normalized correlation between the end of history and the audio before it
+func estimatePitch(history []int16) int {
+	window := plcMinPitch
+	maxLag := plcMaxPitch
+	if maxLag > len(history)-window {
+		maxLag = len(history) - window
+	}
+
+	tail := history[len(history)-window:]
+	best, bestScore := plcMinPitch, -1.0
+	for lag := plcMinPitch; lag <= maxLag; lag++ {
+		past := history[len(history)-window-lag : len(history)-lag]
+		var corr, tailEnergy, pastEnergy float64
+		for i := range tail {
+			corr += float64(tail[i]) * float64(past[i])
+			tailEnergy += float64(tail[i]) * float64(tail[i])
+			pastEnergy += float64(past[i]) * float64(past[i])
+		}
+		if tailEnergy == 0 || pastEnergy == 0 {
+			continue
+		}
+		if score := corr / math.Sqrt(tailEnergy*pastEnergy); score > bestScore {
+			best, bestScore = lag, score
+		}
+	}
+	return best
+}
+
+func clampSample(v float64) int16 {
+	if v > pcmMaxAmplitude {
+		return pcmMaxAmplitude
+	}
+	if v < -pcmMaxAmplitude {
+		return -pcmMaxAmplitude
+	}
+	return int16(v)
+}
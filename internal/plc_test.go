@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"math"
+	"testing"
+)
+
+func plcSine(start, n int) []int16 {
+	frame := make([]int16, n)
+	for i := range frame {
+		frame[i] = int16(8000 * math.Sin(2*math.Pi*100*float64(start+i)/8000))
+	}
+	return frame
+}
+
+func TestPacketLossConcealer_RepeatsPitch(t *testing.T) {
+	plc := NewPacketLossConcealer()
+	for i := 0; i < 4; i++ {
+		plc.Good(plcSine(i*160, 160))
+	}
+	if pitch := estimatePitch(plc.history); pitch != 80 {
+		t.Fatalf("expected a 100 Hz pitch of 80 samples, got %d", pitch)
+	}
+
+	// The first concealed frame continues the waveform
+	concealed := plc.Conceal(160)
+	expected := plcSine(4*160, 160)
+	for i := 0; i < 20; i++ {
+		if diff := math.Abs(float64(concealed[i]) - float64(expected[i])); diff > 400 {
+			t.Fatalf("sample %d: expected about %d, got %d", i, expected[i], concealed[i])
+		}
+	}
+
+	// Later frames fade out and then stop
+	prev := noiseLevel(concealed)
+	for i := 1; i < plcMaxFrames; i++ {
+		frame := plc.Conceal(160)
+		if frame == nil {
+			t.Fatalf("frame %d: expected concealment", i)
+		}
+		if level := noiseLevel(frame); level <= prev {
+			t.Errorf("frame %d: expected attenuation, level -%d after -%d dBov", i, level, prev)
+		} else {
+			prev = level
+		}
+	}
+	if frame := plc.Conceal(160); frame != nil {
+		t.Errorf("expected nothing after %d concealed frames", plcMaxFrames)
+	}
+	if plc.Lost() != plcMaxFrames+1 {
+		t.Errorf("expected %d lost frames, got %d", plcMaxFrames+1, plc.Lost())
+	}
+}
+
+func TestPacketLossConcealer_SmoothsRecovery(t *testing.T) {
+	plc := NewPacketLossConcealer()
+	if frame := plc.Conceal(160); len(frame) != 160 || noiseLevel(frame) != cnMaxLevel {
+		t.Fatal("expected silence without audio history")
+	}
+
+	plc = NewPacketLossConcealer()
+	plc.Good(plcSine(0, 160))
+	plc.Good(plcSine(160, 160))
+	if plc.Good(plcSine(320, 160)) {
+		t.Error("expected no smoothing without a loss")
+	}
+
+	plc.Conceal(160)
+	frame := make([]int16, 160)
+	if !plc.Good(frame) {
+		t.Fatal("expected the first frame after a loss to be smoothed")
+	}
+	if frame[plcOverlap/2] == 0 || frame[plcOverlap] != 0 {
+		t.Errorf("expected a crossfade over %d samples, got %v", plcOverlap, frame[:plcOverlap+1])
+	}
+	if plc.Lost() != 0 {
+		t.Errorf("expected the loss count to reset, got %d", plc.Lost())
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -40,6 +41,52 @@ func DefaultPortAllocatorConfig() *PortAllocatorConfig {
 	}
 }
 
+// PortAllocatorConfigFromSessions returns the allocator settings for the
+// media port range of the session config
+func PortAllocatorConfigFromSessions(sc *SessionConfig) *PortAllocatorConfig {
+	config := DefaultPortAllocatorConfig()
+	if sc == nil {
+		return config
+	}
+	if sc.MinPort > 0 {
+		config.MinPort = sc.MinPort
+	}
+	if sc.MaxPort > 0 {
+		config.MaxPort = sc.MaxPort
+	}
+	if sc.PortReuseDelay > 0 {
+		config.ReuseDelay = time.Duration(sc.PortReuseDelay) * time.Millisecond
+	}
+	// The pre-allocated pool holds at most a tenth of the range
+	if pairs := (config.MaxPort - config.MinPort) / 20; pairs < config.ReserveCount {
+		config.ReserveCount = pairs
+	}
+	return config
+}
+
+// ValidateSessionPorts checks the media port range: it must hold at least
+// one even RTP port with its RTCP port, above the privileged ports
+func ValidateSessionPorts(cfg *Config) error {
+	sc := cfg.Sessions
+	if sc == nil || (sc.MinPort == 0 && sc.MaxPort == 0 && sc.PortReuseDelay == 0) {
+		return nil
+	}
+	if sc.MinPort < 1024 || sc.MinPort > 65535 {
+		return fmt.Errorf("sessions.min_port %d must be between 1024 and 65535", sc.MinPort)
+	}
+	if sc.MaxPort < 1024 || sc.MaxPort > 65535 {
+		return fmt.Errorf("sessions.max_port %d must be between 1024 and 65535", sc.MaxPort)
+	}
+	start := sc.MinPort + sc.MinPort%2
+	if start+1 >= sc.MaxPort {
+		return fmt.Errorf("sessions port range %d-%d has no RTP/RTCP port pair", sc.MinPort, sc.MaxPort)
+	}
+	if sc.PortReuseDelay < 0 {
+		return fmt.Errorf("sessions.port_reuse_delay must not be negative")
+	}
+	return nil
+}
+
 // portPair represents a pre-allocated RTP/RTCP port pair
 type portPair struct {
 	rtp  int
@@ -65,6 +112,7 @@ type PortAllocator struct {
 	totalReleased  atomic.Int64
 	totalFailed    atomic.Int64
 	currentInUse   atomic.Int64
+	slotsInUse     atomic.Int64 // even ports, and their RTCP partners, taken when EvenOnly
 	peakInUse      atomic.Int64
 	poolHits       atomic.Int64
 	poolMisses     atomic.Int64
@@ -256,14 +304,9 @@ func (pa *PortAllocator) AllocatePort(sessionID string) (int, error) {
 	select {
 	case pair := <-pa.pairPool:
 		pa.poolHits.Add(1)
-		// Return RTCP to pool for single port allocation
-		go func() {
-			select {
-			case pa.pairPool <- portPair{rtp: pair.rtcp, rtcp: pair.rtcp + 1}:
-			default:
-				pa.markPortAvailable(pair.rtcp)
-			}
-		}()
+		// The RTCP port stays with its even partner, so it is not handed
+		// out on its own
+		pa.markPortAvailable(pair.rtcp)
 		pa.recordAllocation(pair.rtp, sessionID, nil)
 		return pair.rtp, nil
 	default:
@@ -274,6 +317,7 @@ func (pa *PortAllocator) AllocatePort(sessionID string) (int, error) {
 	port, err := pa.findAndAllocatePort(sessionID)
 	if err != nil {
 		pa.totalFailed.Add(1)
+		portPoolExhausted.Inc()
 		return 0, err
 	}
 
@@ -312,6 +356,7 @@ func (pa *PortAllocator) AllocatePortPair(sessionID string) (rtpPort, rtcpPort i
 	pair, ok := pa.findAvailablePortPair()
 	if !ok {
 		pa.totalFailed.Add(2)
+		portPoolExhausted.Inc()
 		return 0, 0, ErrNoPortsAvailable
 	}
 
@@ -515,6 +560,9 @@ func (pa *PortAllocator) recordAllocationStats(port int, sessionID string) {
 
 	pa.totalAllocated.Add(1)
 	current := pa.currentInUse.Add(1)
+	if pa.usesSlot(port) {
+		pa.slotsInUse.Add(1)
+	}
 
 	// Update peak (lock-free)
 	for {
@@ -581,9 +629,34 @@ func (pa *PortAllocator) AllocateWithConnection(sessionID string, network string
 	}
 
 	pa.totalFailed.Add(1)
+	portPoolExhausted.Inc()
 	return 0, nil, ErrNoPortsAvailable
 }
 
+// AttachConn hands the socket bound to an allocated port to the allocator,
+// which closes it when the port is released
+func (pa *PortAllocator) AttachConn(port int, conn net.PacketConn) error {
+	shard := pa.getShard(port)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	info, exists := shard.allocated[port]
+	if !exists || info.sessionID == "" {
+		return ErrPortOutOfRange
+	}
+	info.conn = conn
+	shard.allocated[port] = info
+	return nil
+}
+
+// hasConn reports whether an allocated port has a socket attached
+func (pa *PortAllocator) hasConn(port int) bool {
+	shard := pa.getShard(port)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	return shard.allocated[port].conn != nil
+}
+
 // ReleasePort releases a previously allocated port
 func (pa *PortAllocator) ReleasePort(port int) error {
 	shard := pa.getShard(port)
@@ -625,6 +698,9 @@ func (pa *PortAllocator) ReleasePort(port int) error {
 
 	pa.totalReleased.Add(1)
 	pa.currentInUse.Add(-1)
+	if pa.usesSlot(port) {
+		pa.slotsInUse.Add(-1)
+	}
 
 	return nil
 }
@@ -647,22 +723,61 @@ func (pa *PortAllocator) ReleaseSessionPorts(sessionID string) error {
 	return lastErr
 }
 
+// PortRange returns the range ports are allocated from
+func (pa *PortAllocator) PortRange() (minPort, maxPort int) {
+	return pa.config.MinPort, pa.config.MaxPort
+}
+
+// GetInUseCount returns the number of ports currently allocated
+func (pa *PortAllocator) GetInUseCount() int {
+	return int(pa.currentInUse.Load())
+}
+
+// slots returns how many allocations the range holds: even RTP ports, each
+// with the odd RTCP port above it, when EvenOnly and single ports otherwise
+func (pa *PortAllocator) slots() int {
+	if pa.config.EvenOnly {
+		return (pa.config.MaxPort - pa.config.MinPort) / 2
+	}
+	return pa.config.MaxPort - pa.config.MinPort + 1
+}
+
+// usesSlot reports whether allocating a port takes a slot. With EvenOnly an
+// odd port belongs to the slot of the even port below it
+func (pa *PortAllocator) usesSlot(port int) bool {
+	return !pa.config.EvenOnly || port%2 == 0
+}
+
 // GetAvailableCount returns approximate number of available ports
 func (pa *PortAllocator) GetAvailableCount() int {
-	totalPorts := (pa.config.MaxPort - pa.config.MinPort) / 2
-	if !pa.config.EvenOnly {
-		totalPorts = pa.config.MaxPort - pa.config.MinPort + 1
+	free := pa.slots() - int(pa.slotsInUse.Load())
+	if pa.config.EvenOnly {
+		return free * 2
 	}
-	return totalPorts - int(pa.currentInUse.Load())
+	return free
+}
+
+// GetCooldownCount returns the number of released ports that cannot be
+// allocated again until the reuse delay has passed
+func (pa *PortAllocator) GetCooldownCount() int {
+	count := 0
+	now := time.Now()
+	pa.released.Range(func(key, value interface{}) bool {
+		if releaseTime, ok := value.(time.Time); ok && now.Sub(releaseTime) < pa.config.ReuseDelay {
+			count++
+		}
+		return true
+	})
+	return count
 }
 
 // GetUtilization returns the port pool utilization (0-1)
 func (pa *PortAllocator) GetUtilization() float64 {
-	totalPorts := (pa.config.MaxPort - pa.config.MinPort) / 2
-	if !pa.config.EvenOnly {
-		totalPorts = pa.config.MaxPort - pa.config.MinPort + 1
+	slots := pa.slots()
+	if slots <= 0 {
+		return 1
 	}
-	return float64(pa.currentInUse.Load()) / float64(totalPorts)
+	return float64(pa.slotsInUse.Load()) / float64(slots)
 }
 
 // IsNearExhaustion checks if the port pool is near exhaustion
@@ -707,6 +822,75 @@ func (pa *PortAllocator) GetStats() map[string]interface{} {
 	}
 }
 
+// SessionPorts is the ports one session holds
+type SessionPorts struct {
+	SessionID   string    `json:"session_id"`
+	Ports       []int     `json:"ports"`
+	AllocatedAt time.Time `json:"allocated_at"`
+}
+
+// PortPoolState describes the media port range and what is allocated from it
+type PortPoolState struct {
+	MinPort     int              `json:"min_port"`
+	MaxPort     int              `json:"max_port"`
+	ReuseDelay  string           `json:"reuse_delay"`
+	InUse       int              `json:"in_use"`
+	Available   int              `json:"available"`
+	Cooldown    int              `json:"cooldown"`
+	Reserved    int              `json:"reserved"` // Ports held by the pre-allocated pair pool
+	PeakInUse   int64            `json:"peak_in_use"`
+	Failed      int64            `json:"failed"`
+	Utilization float64          `json:"utilization"`
+	Sessions    []SessionPorts `json:"sessions"`
+}
+
+// State returns the range, counters and per-session allocations of the pool
+func (pa *PortAllocator) State() PortPoolState {
+	state := PortPoolState{
+		MinPort:     pa.config.MinPort,
+		MaxPort:     pa.config.MaxPort,
+		ReuseDelay:  pa.config.ReuseDelay.String(),
+		InUse:       pa.GetInUseCount(),
+		Available:   pa.GetAvailableCount(),
+		Cooldown:    pa.GetCooldownCount(),
+		Reserved:    len(pa.pairPool) * 2,
+		PeakInUse:   pa.peakInUse.Load(),
+		Failed:      pa.totalFailed.Load(),
+		Utilization: pa.GetUtilization(),
+		Sessions:    []SessionPorts{},
+	}
+
+	sessions := make(map[string]*SessionPorts)
+	for i := 0; i < 16; i++ {
+		shard := pa.shards[i]
+		shard.mu.RLock()
+		for port, info := range shard.allocated {
+			if info.sessionID == "" {
+				continue
+			}
+			alloc, ok := sessions[info.sessionID]
+			if !ok {
+				alloc = &SessionPorts{SessionID: info.sessionID, AllocatedAt: info.allocatedAt}
+				sessions[info.sessionID] = alloc
+			}
+			alloc.Ports = append(alloc.Ports, port)
+			if info.allocatedAt.Before(alloc.AllocatedAt) {
+				alloc.AllocatedAt = info.allocatedAt
+			}
+		}
+		shard.mu.RUnlock()
+	}
+
+	for _, alloc := range sessions {
+		sort.Ints(alloc.Ports)
+		state.Sessions = append(state.Sessions, *alloc)
+	}
+	sort.Slice(state.Sessions, func(i, j int) bool {
+		return state.Sessions[i].AllocatedAt.Before(state.Sessions[j].AllocatedAt)
+	})
+	return state
+}
+
 // Close closes the port allocator and releases all ports
 func (pa *PortAllocator) Close() error {
 	if !pa.closed.CompareAndSwap(false, true) {
@@ -737,6 +921,11 @@ drainDone:
 			delete(shard.allocated, port)
 		}
 		shard.mu.Unlock()
+
+		ss := pa.sessionShards[i]
+		ss.mu.Lock()
+		ss.ports = make(map[string][]int)
+		ss.mu.Unlock()
 	}
 
 	return nil
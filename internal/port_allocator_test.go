@@ -554,3 +554,77 @@ func TestPortAllocator_AllocateWithConnection(t *testing.T) {
 	// Release should close the connection
 	pa.ReleasePort(port)
 }
+
+func TestPortAllocator_PairsCooldownAndState(t *testing.T) {
+	pa := NewPortAllocator(&PortAllocatorConfig{
+		MinPort:        20201,
+		MaxPort:        20208,
+		ReserveCount:   0,
+		ReuseDelay:     time.Hour,
+		MaxAllocations: 10,
+		EvenOnly:       true,
+	})
+	defer pa.Close()
+
+	// The odd minimum is skipped: RTP is even with RTCP just above it
+	rtp, rtcp, err := pa.AllocatePortPair("session-a")
+	if err != nil {
+		t.Fatalf("AllocatePortPair failed: %v", err)
+	}
+	if rtp != 20202 || rtcp != 20203 {
+		t.Errorf("got pair %d/%d, want 20202/20203", rtp, rtcp)
+	}
+	if _, _, err := pa.AllocatePortPair("session-b"); err != nil {
+		t.Fatalf("AllocatePortPair failed: %v", err)
+	}
+
+	state := pa.State()
+	if state.InUse != 4 || state.Available != 2 || len(state.Sessions) != 2 {
+		t.Errorf("unexpected state %+v", state)
+	}
+	if got := state.Sessions[0]; got.SessionID != "session-a" || len(got.Ports) != 2 || got.Ports[0] != 20202 {
+		t.Errorf("unexpected first session %+v", got)
+	}
+
+	// Released ports wait out the reuse delay before another call gets them
+	if err := pa.ReleaseSessionPorts("session-a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := pa.GetCooldownCount(); got != 2 {
+		t.Errorf("%d ports in cooldown, want 2", got)
+	}
+	rtp, _, err = pa.AllocatePortPair("session-c")
+	if err != nil {
+		t.Fatalf("AllocatePortPair failed: %v", err)
+	}
+	if rtp == 20202 {
+		t.Error("a port in cooldown was handed out again")
+	}
+
+	// The last pair is in cooldown, so the range is exhausted
+	before := pa.totalFailed.Load()
+	if _, _, err := pa.AllocatePortPair("session-d"); err != ErrNoPortsAvailable {
+		t.Errorf("expected ErrNoPortsAvailable, got %v", err)
+	}
+	if pa.totalFailed.Load() == before || pa.State().Failed == 0 {
+		t.Error("exhaustion was not counted")
+	}
+}
+
+func TestValidateSessionPorts(t *testing.T) {
+	for _, tt := range []struct {
+		config SessionConfig
+		valid  bool
+	}{
+		{SessionConfig{}, true},
+		{SessionConfig{MinPort: 30000, MaxPort: 40000, PortReuseDelay: 500}, true},
+		{SessionConfig{MinPort: 80, MaxPort: 40000}, false},
+		{SessionConfig{MinPort: 30000, MaxPort: 70000}, false},
+		{SessionConfig{MinPort: 30001, MaxPort: 30002}, false},
+		{SessionConfig{MinPort: 30000, MaxPort: 40000, PortReuseDelay: -1}, false},
+	} {
+		if err := ValidateSessionPorts(&Config{Sessions: &tt.config}); (err == nil) != tt.valid {
+			t.Errorf("%+v: error %v", tt.config, err)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/http/pprof"
 	"os"
@@ -41,6 +42,8 @@ func DefaultPprofConfig() *PprofConfig {
 type PprofServer struct {
 	config   *PprofConfig
 	server   *http.Server
+	listener net.Listener
+	registry *SessionRegistry // summarized on /debug/status
 	rtpPool  *RTPBufferPool
 	rtcpPool *RTPBufferPool
 	mu       sync.RWMutex
@@ -128,6 +131,21 @@ func (bp *RTPBufferPool) Stats() map[string]interface{} {
 	}
 }
 
+// PprofConfigFromDebug maps the debug settings onto a pprof server config,
+// leaving the GC settings alone
+func PprofConfigFromDebug(config *DebugConfig) *PprofConfig {
+	address := config.Address
+	if address == "" {
+		address = defaultDebugAddress
+	}
+	return &PprofConfig{
+		Enabled:      config.Enabled,
+		Port:         address,
+		BlockProfile: config.BlockProfileRate,
+		MutexProfile: config.MutexProfileFraction,
+	}
+}
+
 // NewPprofServer creates a new pprof server
 func NewPprofServer(config *PprofConfig) *PprofServer {
 	if config == nil {
@@ -166,7 +184,15 @@ func (ps *PprofServer) applyGCSettings() {
 	}
 }
 
-// Start starts the pprof server
+// SetSessionRegistry sets the registry summarized on /debug/status
+func (ps *PprofServer) SetSessionRegistry(registry *SessionRegistry) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.registry = registry
+}
+
+// Start starts the pprof server. The listen address is bound before it
+// returns, so a port in use is reported to the caller
 func (ps *PprofServer) Start() error {
 	ps.mu.Lock()
 	if ps.running {
@@ -180,6 +206,14 @@ func (ps *PprofServer) Start() error {
 		return nil
 	}
 
+	listener, err := net.Listen("tcp", ps.config.Port)
+	if err != nil {
+		ps.mu.Lock()
+		ps.running = false
+		ps.mu.Unlock()
+		return fmt.Errorf("pprof server: %w", err)
+	}
+
 	mux := http.NewServeMux()
 
 	// Register pprof handlers
@@ -202,17 +236,21 @@ func (ps *PprofServer) Start() error {
 	mux.HandleFunc("/debug/gc", ps.gcHandler)
 	mux.HandleFunc("/debug/memory", ps.memoryHandler)
 	mux.HandleFunc("/debug/runtime", ps.runtimeHandler)
+	mux.HandleFunc("/debug/status", ps.statusHandler)
 
-	ps.server = &http.Server{
+	server := &http.Server{
 		Addr:         ps.config.Port,
 		Handler:      mux,
 		ReadTimeout:  30 * time.Second,
 		WriteTimeout: 60 * time.Second,
 	}
+	ps.mu.Lock()
+	ps.server, ps.listener = server, listener
+	ps.mu.Unlock()
 
 	go func() {
-		log.Printf("Starting pprof server on %s", ps.config.Port)
-		if err := ps.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Printf("Starting pprof server on %s", listener.Addr())
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
 			log.Printf("pprof server error: %v", err)
 		}
 	}()
@@ -220,6 +258,16 @@ func (ps *PprofServer) Start() error {
 	return nil
 }
 
+// Addr returns the address the server listens on, or "" before Start
+func (ps *PprofServer) Addr() string {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	if ps.listener == nil {
+		return ""
+	}
+	return ps.listener.Addr().String()
+}
+
 // poolStatsHandler returns buffer pool statistics
 func (ps *PprofServer) poolStatsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -362,12 +410,14 @@ func (ps *PprofServer) Stop() error {
 		return nil
 	}
 	ps.running = false
+	server := ps.server
+	ps.server, ps.listener = nil, nil
 	ps.mu.Unlock()
 
-	if ps.server != nil {
+	if server != nil {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
-		return ps.server.Shutdown(ctx)
+		return server.Shutdown(ctx)
 	}
 	return nil
 }
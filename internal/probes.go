@@ -0,0 +1,175 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// draining is set once shutdown starts, taking the node out of /readyz
+	// while calls in progress finish
+	draining atomic.Bool
+
+	// RTPListenerChecker reports whether the RTP listener is open - set by
+	// main application
+	RTPListenerChecker func() bool
+
+	// MediaPortsGetter returns the media port allocator, nil until the NG
+	// listener is up - set by main application
+	MediaPortsGetter func() *PortAllocator
+)
+
+// SetDraining marks the node as draining (or not)
+func SetDraining(d bool) {
+	draining.Store(d)
+}
+
+// IsDraining reports whether the node is draining, by SetDraining or the
+// shutdown manager
+func IsDraining() bool {
+	return draining.Load() || GetShutdownManager().IsDraining()
+}
+
+// SIPProxiesReady reports whether at least one configured SIP proxy answers
+// OPTIONS. It is true when no proxy is configured
+func SIPProxiesReady() bool {
+	proxies, ok := configuredSIPProxies()
+	if !ok {
+		return false
+	}
+	if len(proxies) == 0 {
+		return true
+	}
+	for _, addr := range proxies {
+		if status, ok := GetSIPProxyStatus(addr); ok && status.Available {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadyzHandler returns a handler for strict Kubernetes readiness probes.
+// The node is ready once startup has finished, the RTP listener and NG
+// control socket are up and a SIP proxy answers, and stays ready until it
+// starts draining. Database and Redis are left to /ready
+func ReadyzHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		readinessMu.RLock()
+		started := readinessState.Ready
+		readinessMu.RUnlock()
+
+		checks := map[string]bool{
+			"started":     started,
+			"rtp":         RTPListenerChecker != nil && RTPListenerChecker(),
+			"nglistener":  NGListenerChecker != nil && NGListenerChecker(),
+			"sip":         SIPProxiesReady(),
+			"notDraining": !IsDraining(),
+		}
+
+		ready := true
+		for _, ok := range checks {
+			ready = ready && ok
+		}
+
+		response := map[string]interface{}{
+			"ready":  ready,
+			"checks": checks,
+		}
+		if ready {
+			w.WriteHeader(http.StatusOK)
+			response["message"] = "Service is ready"
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			response["message"] = "Service is not ready to accept traffic"
+		}
+
+		_ = json.NewEncoder(w).Encode(response)
+	}
+}
+
+// LivezHandler returns a handler for Kubernetes liveness probes that only
+// checks the process is serving requests. Unlike /live it ignores
+// dependency health, so an unreachable proxy or database never restarts
+// the pod
+func LivezHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "UP",
+			"uptime": time.Since(startTime).Round(time.Second).String(),
+		})
+	}
+}
+
+// MediaPortStatus describes the media port range of this node
+type MediaPortStatus struct {
+	MinPort   int `json:"min_port"`
+	MaxPort   int `json:"max_port"`
+	InUse     int `json:"in_use"`
+	Available int `json:"available"`
+}
+
+// PodStatus identifies the pod, from the POD_NAME, POD_NAMESPACE, POD_IP
+// and NODE_NAME variables the Kubernetes downward API sets
+type PodStatus struct {
+	Name      string `json:"name,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	Node      string `json:"node,omitempty"`
+}
+
+// NodeStatus is the body of /status
+type NodeStatus struct {
+	Pod        PodStatus        `json:"pod"`
+	Ready      bool             `json:"ready"`
+	Draining   bool             `json:"draining"`
+	MediaPorts *MediaPortStatus `json:"media_ports,omitempty"`
+	Uptime     string           `json:"uptime"`
+}
+
+// GetNodeStatus collects the pod identity and media port range
+func GetNodeStatus() NodeStatus {
+	readinessMu.RLock()
+	ready := readinessState.Ready
+	readinessMu.RUnlock()
+
+	status := NodeStatus{
+		Pod: PodStatus{
+			Name:      os.Getenv("POD_NAME"),
+			Namespace: os.Getenv("POD_NAMESPACE"),
+			IP:        os.Getenv("POD_IP"),
+			Node:      os.Getenv("NODE_NAME"),
+		},
+		Ready:    ready,
+		Draining: IsDraining(),
+		Uptime:   time.Since(startTime).Round(time.Second).String(),
+	}
+
+	if MediaPortsGetter != nil {
+		if pa := MediaPortsGetter(); pa != nil {
+			minPort, maxPort := pa.PortRange()
+			status.MediaPorts = &MediaPortStatus{
+				MinPort:   minPort,
+				MaxPort:   maxPort,
+				InUse:     pa.GetInUseCount(),
+				Available: pa.GetAvailableCount(),
+			}
+		}
+	}
+	return status
+}
+
+// StatusHandler returns a handler publishing GetNodeStatus, which tooling
+// reads to generate Services covering the media port range
+func StatusHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(GetNodeStatus())
+	}
+}
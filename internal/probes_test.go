@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// setProbeStateForTest loads an empty config, marks startup finished and
+// reports the RTP and NG listeners as up
+func setProbeStateForTest(t *testing.T) {
+	t.Helper()
+	configMutex.Lock()
+	previousConfig := config
+	config = &Config{}
+	configMutex.Unlock()
+
+	readinessMu.Lock()
+	previousState := readinessState
+	readinessState.Ready = true
+	readinessMu.Unlock()
+
+	previousRTP, previousNG, previousPorts := RTPListenerChecker, NGListenerChecker, MediaPortsGetter
+	RTPListenerChecker = func() bool { return true }
+	NGListenerChecker = func() bool { return true }
+
+	t.Cleanup(func() {
+		configMutex.Lock()
+		config = previousConfig
+		configMutex.Unlock()
+		readinessMu.Lock()
+		readinessState = previousState
+		readinessMu.Unlock()
+		RTPListenerChecker, NGListenerChecker, MediaPortsGetter = previousRTP, previousNG, previousPorts
+		SetDraining(false)
+	})
+}
+
+func probe(t *testing.T, handler http.HandlerFunc, v interface{}) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if err := json.NewDecoder(rec.Body).Decode(v); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	return rec.Code
+}
+
+func TestReadyzHandler(t *testing.T) {
+	setProbeStateForTest(t)
+
+	var body struct {
+		Ready  bool            `json:"ready"`
+		Checks map[string]bool `json:"checks"`
+	}
+	if code := probe(t, ReadyzHandler(), &body); code != http.StatusOK || !body.Ready {
+		t.Fatalf("readyz = %d %+v, expected ready", code, body)
+	}
+
+	NGListenerChecker = func() bool { return false }
+	if code := probe(t, ReadyzHandler(), &body); code != http.StatusServiceUnavailable || body.Checks["nglistener"] {
+		t.Errorf("readyz = %d %+v, expected not ready without the NG listener", code, body)
+	}
+	NGListenerChecker = func() bool { return true }
+
+	SetDraining(true)
+	if code := probe(t, ReadyzHandler(), &body); code != http.StatusServiceUnavailable || body.Checks["notDraining"] {
+		t.Errorf("readyz = %d %+v, expected not ready while draining", code, body)
+	}
+}
+
+func TestReadyzHandler_SIPProxyUnreachable(t *testing.T) {
+	setProbeStateForTest(t)
+	configMutex.Lock()
+	config.Integration.KamailioIp = "192.0.2.1"
+	config.Integration.KamailioPort = 5060
+	configMutex.Unlock()
+
+	// No OPTIONS answer recorded for the proxy
+	var body struct {
+		Checks map[string]bool `json:"checks"`
+	}
+	if code := probe(t, ReadyzHandler(), &body); code != http.StatusServiceUnavailable || body.Checks["sip"] {
+		t.Errorf("readyz = %d %+v, expected not ready without a SIP proxy", code, body)
+	}
+}
+
+func TestLivezHandler_IgnoresDependencies(t *testing.T) {
+	setProbeStateForTest(t)
+	RTPListenerChecker = func() bool { return false }
+	SetDraining(true)
+
+	var body map[string]interface{}
+	if code := probe(t, LivezHandler(), &body); code != http.StatusOK || body["status"] != "UP" {
+		t.Errorf("livez = %d %v, expected alive", code, body)
+	}
+}
+
+func TestStatusHandler_MediaPorts(t *testing.T) {
+	setProbeStateForTest(t)
+	t.Setenv("POD_NAME", "karl-0")
+	t.Setenv("POD_IP", "10.1.2.3")
+
+	config := DefaultPortAllocatorConfig()
+	config.MinPort, config.MaxPort = 30000, 30100
+	pa := NewPortAllocator(config)
+	defer pa.Close()
+	if _, _, err := pa.AllocatePortPair("call-1"); err != nil {
+		t.Fatalf("AllocatePortPair failed: %v", err)
+	}
+	MediaPortsGetter = func() *PortAllocator { return pa }
+
+	var status NodeStatus
+	probe(t, StatusHandler(), &status)
+	if status.Pod.Name != "karl-0" || status.Pod.IP != "10.1.2.3" {
+		t.Errorf("pod = %+v", status.Pod)
+	}
+	if status.MediaPorts == nil {
+		t.Fatal("expected media ports in the status")
+	}
+	if status.MediaPorts.MinPort != 30000 || status.MediaPorts.MaxPort != 30100 || status.MediaPorts.InUse != 2 {
+		t.Errorf("media ports = %+v", status.MediaPorts)
+	}
+}
@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Common DSCP values
+const (
+	DSCPExpedited = 46 // EF, voice media
+	DSCPCS3       = 24 // CS3, call signaling
+	maxDSCP       = 63
+)
+
+var (
+	qosConfig atomic.Pointer[QoSConfig]
+	// A socket that cannot be marked is reported at most once a minute
+	qosErrors = NewLogSampler(Logger(ComponentRTP), slog.LevelWarn, 1, time.Minute)
+)
+
+// ConfigureQoS sets the DSCP values of the sockets opened from now on; nil
+// leaves them unmarked
+func ConfigureQoS(config *QoSConfig) {
+	if config == nil {
+		config = &QoSConfig{}
+	}
+	qosConfig.Store(config)
+}
+
+// ValidateQoSConfig checks that the DSCP values fit in six bits
+func ValidateQoSConfig(cfg *Config) error {
+	q := cfg.QoS
+	for _, s := range []struct {
+		name string
+		dscp int
+	}{{"rtp_dscp", q.RTPDSCP}, {"rtcp_dscp", q.RTCPDSCP}, {"signaling_dscp", q.SignalingDSCP}} {
+		if s.dscp < 0 || s.dscp > maxDSCP {
+			return fmt.Errorf("invalid qos.%s %d, expected 0-%d", s.name, s.dscp, maxDSCP)
+		}
+	}
+	return nil
+}
+
+// MarkRTPConn marks the packets sent on a media socket with the RTP DSCP
+func MarkRTPConn(conn net.Conn) {
+	if q := qosConfig.Load(); q != nil {
+		markConn(conn, q.RTPDSCP, "rtp")
+	}
+}
+
+// MarkRTCPConn marks the packets sent on an RTCP socket with the RTCP DSCP
+func MarkRTCPConn(conn net.Conn) {
+	if q := qosConfig.Load(); q != nil {
+		markConn(conn, q.RTCPDSCP, "rtcp")
+	}
+}
+
+// MarkSignalingConn marks the packets sent on a control socket with the
+// signaling DSCP
+func MarkSignalingConn(conn net.Conn) {
+	if q := qosConfig.Load(); q != nil {
+		markConn(conn, q.SignalingDSCP, "signaling")
+	}
+}
+
+func markConn(conn net.Conn, dscp int, kind string) {
+	if dscp == 0 || conn == nil {
+		return
+	}
+	if err := setDSCP(conn, dscp); err != nil && qosErrors.Allow() {
+		qosErrors.Log("Failed to set DSCP", "socket", kind, "dscp", dscp, "error", err)
+	}
+}
+
+// setDSCP sets IP_TOS and IPV6_TCLASS on a socket. A dual-stack socket
+// takes both, a socket of one family only its own
+func setDSCP(conn net.Conn, dscp int) error {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	tos := dscp << 2
+	errV4 := ipv4.NewConn(conn).SetTOS(tos)
+	errV6 := ipv6.NewConn(conn).SetTrafficClass(tos)
+	if errV4 != nil && errV6 != nil {
+		return errV4
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"net"
+	"runtime"
+	"testing"
+
+	"golang.org/x/net/ipv4"
+)
+
+func TestValidateQoSConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		qos     QoSConfig
+		wantErr bool
+	}{
+		{"unmarked", QoSConfig{}, false},
+		{"carrier", QoSConfig{RTPDSCP: DSCPExpedited, RTCPDSCP: DSCPExpedited, SignalingDSCP: DSCPCS3}, false},
+		{"too large", QoSConfig{RTPDSCP: 64}, true},
+		{"negative", QoSConfig{SignalingDSCP: -1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qos := tt.qos
+			if err := ValidateQoSConfig(&Config{QoS: &qos}); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateQoSConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMarkRTPConn(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("IP_TOS cannot be read back on Windows")
+	}
+	old := qosConfig.Load()
+	defer qosConfig.Store(old)
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer conn.Close()
+
+	ConfigureQoS(&QoSConfig{RTPDSCP: DSCPExpedited})
+	MarkRTPConn(conn)
+
+	tos, err := ipv4.NewConn(conn).TOS()
+	if err != nil {
+		t.Fatalf("TOS: %v", err)
+	}
+	if tos != DSCPExpedited<<2 {
+		t.Errorf("expected TOS 0x%x, got 0x%x", DSCPExpedited<<2, tos)
+	}
+
+	// A zero DSCP leaves the socket alone
+	ConfigureQoS(nil)
+	MarkRTPConn(conn)
+	if tos, _ := ipv4.NewConn(conn).TOS(); tos != DSCPExpedited<<2 {
+		t.Errorf("expected the mark to be kept, got 0x%x", tos)
+	}
+}
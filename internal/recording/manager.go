@@ -2,19 +2,20 @@ package recording
 
 import (
 	"errors"
+	"fmt"
 	"log"
-	"sync"
 	"time"
 
+	"karl/internal"
 	"karl/internal/api"
+
+	"github.com/pion/rtp"
 )
 
 // Manager manages the recording lifecycle
 type Manager struct {
 	recorder    *Recorder
-	mixer       *AudioMixer
 	config      *RecordingConfig
-	mu          sync.RWMutex
 	stopChan    chan struct{}
 	cleanupDone chan struct{}
 }
@@ -27,7 +28,6 @@ func NewManager(config *RecordingConfig) *Manager {
 
 	m := &Manager{
 		recorder:    NewRecorder(config),
-		mixer:       NewAudioMixer(config.SampleRate, config.BitsPerSample, config.Channels),
 		config:      config,
 		stopChan:    make(chan struct{}),
 		cleanupDone: make(chan struct{}),
@@ -93,20 +93,19 @@ func (m *Manager) cleanupLoop() {
 	}
 }
 
-// StartRecording starts a new recording
+// StartRecording starts a new recording; empty format or mode selects the
+// configured default
 func (m *Manager) StartRecording(sessionID, callID, format, mode string, metadata map[string]string) (string, error) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	// Override format/mode if specified
-	if format != "" {
-		m.config.Format = RecordingFormat(format)
+	recFormat, err := ParseRecordingFormat(format, m.config.Format)
+	if err != nil {
+		return "", err
 	}
-	if mode != "" {
-		m.config.Mode = RecordingMode(mode)
+	recMode, err := ParseRecordingMode(mode, m.config.Mode)
+	if err != nil {
+		return "", err
 	}
 
-	rec, err := m.recorder.StartRecording(sessionID, callID, metadata)
+	rec, err := m.recorder.StartRecording(sessionID, callID, recFormat, recMode, metadata)
 	if err != nil {
 		return "", err
 	}
@@ -177,62 +176,100 @@ func (m *Manager) GetRecordingStatus(recordingID string) (string, error) {
 	return string(rec.Status), nil
 }
 
-// WriteAudio writes audio data to a recording
+// WriteAudio writes simultaneous audio of both legs to a recording
 func (m *Manager) WriteAudio(sessionID string, callerData, calleeData []byte) error {
 	rec, ok := m.recorder.GetRecordingBySession(sessionID)
 	if !ok {
 		return nil // No recording for this session
 	}
 
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
 	if rec.Status != StatusRecording {
 		return nil
 	}
 
-	var audioData []byte
-
-	switch m.config.Mode {
-	case ModeMixed:
-		// Mix to mono
-		audioData = m.mixer.MixMono(callerData, calleeData)
-	case ModeStereo:
-		// Mix to stereo
-		audioData = m.mixer.MixStereo(callerData, calleeData)
-	case ModeSeparate:
-		// For separate mode, write both
-		// This would need separate files - simplified here
-		audioData = m.mixer.MixMono(callerData, calleeData)
-	default:
-		audioData = m.mixer.MixMono(callerData, calleeData)
-	}
-
-	return m.recorder.WriteAudio(rec.ID, audioData)
+	return rec.writeFrame(callerData, calleeData)
 }
 
-// WriteRTPPacket writes an RTP packet to a recording
+// WriteRTPPacket writes an RTP payload with a static payload type to a recording
 func (m *Manager) WriteRTPPacket(sessionID string, payload []byte, payloadType uint8, isCaller bool) error {
 	rec, ok := m.recorder.GetRecordingBySession(sessionID)
 	if !ok {
 		return nil // No recording for this session
 	}
 
-	if rec.Status != StatusRecording {
-		return nil
-	}
-
-	// Convert payload based on codec
-	var pcmData []byte
+	var codecName string
 	switch payloadType {
-	case 0: // PCMU (G.711 u-law)
-		pcmData = ConvertG711uToPCM(payload)
-	case 8: // PCMA (G.711 a-law)
-		pcmData = ConvertG711aToPCM(payload)
+	case 0:
+		codecName = "PCMU"
+	case 8:
+		codecName = "PCMA"
 	default:
-		// For other codecs, we'd need transcoding
-		// For now, just use raw payload
-		pcmData = payload
+		return fmt.Errorf("payload type %d requires a negotiated codec", payloadType)
+	}
+
+	return m.writeLeg(rec, codecName, payload, isCaller)
+}
+
+// HandleRTP records an RTP packet if its call is being recorded. The call
+// and leg are resolved from the SSRC bindings made during offer/answer, so
+// both directions of a call land in the same recording.
+func (m *Manager) HandleRTP(packet *rtp.Packet) {
+	if m.recorder.ActiveCount() == 0 || len(packet.Payload) == 0 {
+		return
+	}
+
+	callID, fromOfferer, codec, ok := internal.GetCodecNegotiator().ResolveLeg(packet.SSRC, packet.PayloadType)
+	if !ok {
+		return
+	}
+
+	rec, ok := m.recorder.GetRecordingByCall(callID)
+	if !ok {
+		return
+	}
+
+	if err := m.writeLeg(rec, codec.Name, packet.Payload, fromOfferer); err != nil {
+		recordingErrors.Inc()
+		if internal.IsDebugLoggingEnabled() {
+			log.Printf("Recording %s: %v", rec.ID, err)
+		}
+	}
+}
+
+// writeLeg decodes a payload from one leg and queues it for mixing
+func (m *Manager) writeLeg(rec *Recording, codecName string, payload []byte, fromCaller bool) error {
+	pcm, sampleRate, err := decodePayload(codecName, payload)
+	if err != nil || pcm == nil {
+		return err
+	}
+
+	if sampleRate != rec.SampleRate {
+		pcm = samplesToBytes(resampleLinear(bytesToSamples(pcm), sampleRate, rec.SampleRate))
 	}
 
-	return m.recorder.WriteAudio(rec.ID, pcmData)
+	return m.recorder.WriteLegAudio(rec.ID, pcm, fromCaller)
+}
+
+// StartCallRecording starts recording a call on behalf of the NG protocol
+func (m *Manager) StartCallRecording(sessionID, callID string, opts internal.CallRecordingOptions) (string, error) {
+	return m.StartRecording(sessionID, callID, opts.Format, opts.Mode, opts.Metadata)
+}
+
+// StopCallRecording stops the recording of a session and returns its ID
+func (m *Manager) StopCallRecording(sessionID string) (string, error) {
+	return m.recorder.StopRecordingBySession(sessionID)
+}
+
+// PauseCallRecording pauses the recording of a session
+func (m *Manager) PauseCallRecording(sessionID string) error {
+	rec, ok := m.recorder.GetRecordingBySession(sessionID)
+	if !ok {
+		return errors.New("no recording for session")
+	}
+	return m.recorder.PauseRecording(rec.ID)
 }
 
 // GetStats returns recording statistics
@@ -240,21 +277,34 @@ func (m *Manager) GetStats() RecorderStats {
 	return m.recorder.GetStats()
 }
 
+// uploadRecording queues the files of a completed recording for object
+// storage, the metadata sidecar last
+func uploadRecording(rec *Recording) {
+	for _, path := range rec.Files {
+		internal.UploadFile(internal.ObjectTypeRecording, rec.CallID, path)
+	}
+	if rec.MetadataPath != "" {
+		internal.UploadFile(internal.ObjectTypeRecording, rec.CallID, rec.MetadataPath)
+	}
+}
+
 // toRecordingInfo converts Recording to api.RecordingInfo
 func toRecordingInfo(rec *Recording) *api.RecordingInfo {
 	return &api.RecordingInfo{
-		ID:        rec.ID,
-		SessionID: rec.SessionID,
-		CallID:    rec.CallID,
-		Status:    string(rec.Status),
-		StartTime: rec.StartTime,
-		EndTime:   rec.EndTime,
-		Duration:  rec.Duration,
-		FilePath:  rec.FilePath,
-		FileSize:  rec.FileSize,
-		Format:    string(rec.Format),
-		Mode:      string(rec.Mode),
-		Metadata:  rec.Metadata,
+		ID:           rec.ID,
+		SessionID:    rec.SessionID,
+		CallID:       rec.CallID,
+		Status:       string(rec.Status),
+		StartTime:    rec.StartTime,
+		EndTime:      rec.EndTime,
+		Duration:     rec.Duration,
+		FilePath:     rec.FilePath,
+		Files:        rec.Files,
+		MetadataPath: rec.MetadataPath,
+		FileSize:     rec.FileSize,
+		Format:       string(rec.Format),
+		Mode:         string(rec.Mode),
+		Metadata:     rec.Metadata,
 	}
 }
 
@@ -0,0 +1,83 @@
+package recording
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// metadataFile is the JSON sidecar written next to a recording's audio
+// files. It is written when recording starts and rewritten when it stops,
+// so collectors can pick up completed recordings by watching for
+// "status": "completed".
+type metadataFile struct {
+	RecordingID     string            `json:"recording_id"`
+	SessionID       string            `json:"session_id"`
+	CallID          string            `json:"call_id"`
+	Status          string            `json:"status"`
+	Format          string            `json:"format"`
+	Mode            string            `json:"mode"`
+	SampleRate      int               `json:"sample_rate"`
+	Channels        int               `json:"channels"`
+	Files           []string          `json:"files"`
+	StartTime       time.Time         `json:"start_time"`
+	EndTime         *time.Time        `json:"end_time,omitempty"`
+	DurationSeconds float64           `json:"duration_seconds,omitempty"`
+	FileSize        int64             `json:"file_size_bytes,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+}
+
+// writeMetadataFile writes the sidecar for a recording, replacing any
+// previous version atomically (caller must hold rec.mu or own rec)
+func writeMetadataFile(rec *Recording) error {
+	meta := metadataFile{
+		RecordingID: rec.ID,
+		SessionID:   rec.SessionID,
+		CallID:      rec.CallID,
+		Status:      string(rec.Status),
+		Format:      string(rec.Format),
+		Mode:        string(rec.Mode),
+		SampleRate:  rec.SampleRate,
+		Channels:    rec.Channels,
+		Files:       rec.Files,
+		StartTime:   rec.StartTime,
+		FileSize:    rec.FileSize,
+		Metadata:    rec.Metadata,
+	}
+	if !rec.EndTime.IsZero() {
+		endTime := rec.EndTime
+		meta.EndTime = &endTime
+		meta.DurationSeconds = rec.Duration.Seconds()
+	}
+
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(rec.MetadataPath), ".recording-*.json")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), rec.MetadataPath)
+}
+
+// removeRecordingFiles deletes the audio files and sidecar of a recording
+func removeRecordingFiles(rec *Recording) {
+	for _, path := range rec.Files {
+		os.Remove(path)
+	}
+	if rec.MetadataPath != "" {
+		os.Remove(rec.MetadataPath)
+	}
+}
@@ -2,7 +2,11 @@ package recording
 
 import (
 	"encoding/binary"
+	"fmt"
 	"math"
+	"strings"
+
+	"karl/internal"
 )
 
 // AudioMixer mixes audio from multiple sources
@@ -305,3 +309,116 @@ func GenerateSilence(duration float64, sampleRate, bitsPerSample, channels int)
 
 	return data
 }
+
+// Leg alignment parameters
+const (
+	alignFrameDuration = 20 // ms of audio mixed per frame
+	alignMaxLagFrames  = 10 // frames one leg may run ahead before the other is padded
+)
+
+// legAligner pairs up audio from the two legs of a call so they can be
+// mixed frame by frame. When one leg stops sending (hold, silence
+// suppression, one-way audio) the other leg is written against silence
+// once it runs more than alignMaxLagFrames ahead.
+type legAligner struct {
+	frameBytes int
+	maxLag     int
+	caller     []byte
+	callee     []byte
+}
+
+// newLegAligner creates an aligner for 16-bit mono PCM at sampleRate
+func newLegAligner(sampleRate int) *legAligner {
+	frameBytes := sampleRate * alignFrameDuration / 1000 * 2
+	return &legAligner{
+		frameBytes: frameBytes,
+		maxLag:     frameBytes * alignMaxLagFrames,
+	}
+}
+
+// push queues audio from one leg and emits every frame that is ready
+func (a *legAligner) push(pcm []byte, fromCaller bool, emit func(caller, callee []byte) error) error {
+	if fromCaller {
+		a.caller = append(a.caller, pcm...)
+	} else {
+		a.callee = append(a.callee, pcm...)
+	}
+
+	for {
+		switch {
+		case len(a.caller) >= a.frameBytes && len(a.callee) >= a.frameBytes:
+			if err := emit(a.caller[:a.frameBytes], a.callee[:a.frameBytes]); err != nil {
+				return err
+			}
+			a.caller = a.caller[a.frameBytes:]
+			a.callee = a.callee[a.frameBytes:]
+		case len(a.caller) > a.maxLag:
+			if err := emit(a.caller[:a.frameBytes], a.silence(a.callee)); err != nil {
+				return err
+			}
+			a.caller = a.caller[a.frameBytes:]
+			a.callee = a.callee[:0]
+		case len(a.callee) > a.maxLag:
+			if err := emit(a.silence(a.caller), a.callee[:a.frameBytes]); err != nil {
+				return err
+			}
+			a.caller = a.caller[:0]
+			a.callee = a.callee[a.frameBytes:]
+		default:
+			return nil
+		}
+	}
+}
+
+// flush emits all queued audio, padding the shorter leg with silence
+func (a *legAligner) flush(emit func(caller, callee []byte) error) error {
+	for len(a.caller) > 0 || len(a.callee) > 0 {
+		caller, callee := a.take(&a.caller), a.take(&a.callee)
+		if err := emit(caller, callee); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// take removes up to one frame from buf, padded with silence to a full frame
+func (a *legAligner) take(buf *[]byte) []byte {
+	frame := make([]byte, a.frameBytes)
+	n := copy(frame, *buf)
+	*buf = (*buf)[n:]
+	return frame
+}
+
+// silence returns a frame holding what is left of a lagging leg followed by silence
+func (a *legAligner) silence(partial []byte) []byte {
+	frame := make([]byte, a.frameBytes)
+	copy(frame, partial)
+	return frame
+}
+
+// decodePayload decodes an RTP payload into 16-bit mono PCM and returns
+// it with its sample rate. Non-audio payloads such as telephone-event and
+// comfort noise return a nil slice.
+func decodePayload(codecName string, payload []byte) ([]byte, int, error) {
+	switch strings.ToUpper(codecName) {
+	case "PCMU":
+		return ConvertG711uToPCM(payload), 8000, nil
+	case "PCMA":
+		return ConvertG711aToPCM(payload), 8000, nil
+	case "OPUS":
+		stereo, err := internal.DecodeToPCM(payload)
+		if err != nil {
+			return nil, 0, err
+		}
+		left, right := splitChannels(stereo, 2)
+		mono := make([]int16, len(left))
+		for i := range mono {
+			mono[i] = int16((int32(left[i]) + int32(right[i])) / 2)
+		}
+		return samplesToBytes(mono), 48000, nil
+	case "TELEPHONE-EVENT", "CN":
+		return nil, 0, nil
+	default:
+		return nil, 0, fmt.Errorf("cannot decode %s for recording", codecName)
+	}
+}
@@ -8,9 +8,13 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"karl/internal"
+
 	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -51,10 +55,27 @@ var (
 type RecordingFormat string
 
 const (
-	FormatWAV RecordingFormat = "wav"
-	FormatPCM RecordingFormat = "pcm"
+	FormatWAV  RecordingFormat = "wav"
+	FormatPCM  RecordingFormat = "pcm"
+	FormatOpus RecordingFormat = "opus" // Ogg/Opus
 )
 
+// ParseRecordingFormat validates a format name; empty selects def
+func ParseRecordingFormat(name string, def RecordingFormat) (RecordingFormat, error) {
+	switch strings.ToLower(name) {
+	case "":
+		return def, nil
+	case "wav":
+		return FormatWAV, nil
+	case "pcm", "raw":
+		return FormatPCM, nil
+	case "opus", "ogg":
+		return FormatOpus, nil
+	default:
+		return "", fmt.Errorf("unsupported recording format: %s", name)
+	}
+}
+
 // RecordingMode represents how to record the call
 type RecordingMode string
 
@@ -64,6 +85,18 @@ const (
 	ModeSeparate RecordingMode = "separate" // Separate files for each leg
 )
 
+// ParseRecordingMode validates a mode name; empty selects def
+func ParseRecordingMode(name string, def RecordingMode) (RecordingMode, error) {
+	switch RecordingMode(strings.ToLower(name)) {
+	case "":
+		return def, nil
+	case ModeMixed, ModeStereo, ModeSeparate:
+		return RecordingMode(strings.ToLower(name)), nil
+	default:
+		return "", fmt.Errorf("unsupported recording mode: %s", name)
+	}
+}
+
 // RecordingStatus represents recording state
 type RecordingStatus string
 
@@ -103,24 +136,27 @@ func DefaultRecordingConfig() *RecordingConfig {
 
 // Recording represents an active or completed recording
 type Recording struct {
-	ID          string
-	SessionID   string
-	CallID      string
-	Status      RecordingStatus
-	Format      RecordingFormat
-	Mode        RecordingMode
-	StartTime   time.Time
-	EndTime     time.Time
-	Duration    time.Duration
-	FilePath    string
-	FileSize    int64
-	SampleRate  int
-	Channels    int
-	Metadata    map[string]string
+	ID           string
+	SessionID    string
+	CallID       string
+	Status       RecordingStatus
+	Format       RecordingFormat
+	Mode         RecordingMode
+	StartTime    time.Time
+	EndTime      time.Time
+	Duration     time.Duration
+	FilePath     string   // Mixed/stereo file, or the caller file in separate mode
+	Files        []string // All audio files written for the recording
+	MetadataPath string   // JSON sidecar describing the recording
+	FileSize     int64
+	SampleRate   int
+	Channels     int
+	Metadata     map[string]string
 
 	// Internal state
-	file        *os.File
-	writer      *WAVWriter
+	sinks       []audioSink
+	legs        *legAligner
+	mixer       *AudioMixer
 	mu          sync.Mutex
 	packetCount uint64
 	byteCount   uint64
@@ -131,6 +167,8 @@ type Recorder struct {
 	config      *RecordingConfig
 	recordings  map[string]*Recording
 	sessionRecs map[string]string // sessionID -> recordingID
+	callRecs    map[string]string // callID -> recordingID
+	active      int32             // recordings currently capturing, read on the packet path
 	mu          sync.RWMutex
 	stopChan    chan struct{}
 }
@@ -150,6 +188,7 @@ func NewRecorder(config *RecordingConfig) *Recorder {
 		config:      config,
 		recordings:  make(map[string]*Recording),
 		sessionRecs: make(map[string]string),
+		callRecs:    make(map[string]string),
 		stopChan:    make(chan struct{}),
 	}
 }
@@ -169,73 +208,99 @@ func (r *Recorder) Stop() error {
 	defer r.mu.Unlock()
 
 	for _, rec := range r.recordings {
-		if rec.Status == StatusRecording {
-			_ = r.stopRecordingInternal(rec)
-		}
+		_ = r.stopRecordingInternal(rec)
 	}
 
 	log.Println("Recording service stopped")
 	return nil
 }
 
-// StartRecording starts a new recording
-func (r *Recorder) StartRecording(sessionID, callID string, metadata map[string]string) (*Recording, error) {
+// StartRecording starts a new recording in the given format and mode
+func (r *Recorder) StartRecording(sessionID, callID string, format RecordingFormat, mode RecordingMode, metadata map[string]string) (*Recording, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
 	// Check if already recording
 	if recID, exists := r.sessionRecs[sessionID]; exists {
-		if rec, ok := r.recordings[recID]; ok && rec.Status == StatusRecording {
+		if rec, ok := r.recordings[recID]; ok && (rec.Status == StatusRecording || rec.Status == StatusPaused) {
 			return nil, errors.New("session already being recorded")
 		}
 	}
 
-	// Generate file path
+	// Generate file paths
 	now := time.Now()
 	dateDir := now.Format("2006/01/02")
-	fileName := fmt.Sprintf("%s_%s.wav", callID, now.Format("150405"))
-	filePath := filepath.Join(r.config.BasePath, dateDir, fileName)
+	baseName := fmt.Sprintf("%s_%s", safeFileName(callID), now.Format("150405"))
+	baseDir := r.config.BasePath
+	// A tenant's recordings are kept apart from other tenants'
+	if tenant := metadata[internal.TenantMetadataKey]; tenant != "" {
+		baseDir = filepath.Join(baseDir, safeFileName(tenant))
+	}
+	basePath := filepath.Join(baseDir, dateDir, baseName)
 
 	// Ensure directory exists
-	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+	if err := os.MkdirAll(filepath.Dir(basePath), 0755); err != nil {
 		return nil, fmt.Errorf("failed to create directory: %w", err)
 	}
 
+	sampleRate := r.config.SampleRate
+	if sampleRate <= 0 {
+		sampleRate = 8000
+	}
+
 	// Create recording
 	rec := &Recording{
-		ID:         uuid.New().String(),
-		SessionID:  sessionID,
-		CallID:     callID,
-		Status:     StatusRecording,
-		Format:     r.config.Format,
-		Mode:       r.config.Mode,
-		StartTime:  now,
-		FilePath:   filePath,
-		SampleRate: r.config.SampleRate,
-		Channels:   r.config.Channels,
-		Metadata:   metadata,
-	}
-
-	// Open file
-	file, err := os.Create(filePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create file: %w", err)
+		ID:           uuid.New().String(),
+		SessionID:    sessionID,
+		CallID:       callID,
+		Status:       StatusRecording,
+		Format:       format,
+		Mode:         mode,
+		StartTime:    now,
+		MetadataPath: basePath + ".json",
+		SampleRate:   sampleRate,
+		Channels:     1,
+		Metadata:     metadata,
+		legs:         newLegAligner(sampleRate),
+		mixer:        NewAudioMixer(sampleRate, 16, 1),
+	}
+
+	// Open one file per leg in separate mode, otherwise a single file
+	paths := []string{basePath + fileExtension(format)}
+	switch mode {
+	case ModeSeparate:
+		paths = []string{
+			basePath + "_caller" + fileExtension(format),
+			basePath + "_callee" + fileExtension(format),
+		}
+	case ModeStereo:
+		rec.Channels = 2
 	}
-	rec.file = file
 
-	// Create WAV writer
-	rec.writer = NewWAVWriter(file, r.config.SampleRate, r.config.BitsPerSample, r.config.Channels)
-	if err := rec.writer.WriteHeader(); err != nil {
-		file.Close()
-		os.Remove(filePath)
-		return nil, fmt.Errorf("failed to write WAV header: %w", err)
+	for _, path := range paths {
+		sink, err := newAudioSink(format, path, sampleRate, r.config.BitsPerSample, rec.Channels)
+		if err != nil {
+			closeSinks(rec.sinks, true)
+			return nil, err
+		}
+		rec.sinks = append(rec.sinks, sink)
+		rec.Files = append(rec.Files, path)
+	}
+	rec.FilePath = rec.Files[0]
+
+	if err := writeMetadataFile(rec); err != nil {
+		log.Printf("Warning: failed to write recording metadata %s: %v", rec.MetadataPath, err)
 	}
 
 	r.recordings[rec.ID] = rec
 	r.sessionRecs[sessionID] = rec.ID
+	if callID != "" {
+		r.callRecs[callID] = rec.ID
+	}
 
+	atomic.AddInt32(&r.active, 1)
 	activeRecordings.Inc()
-	log.Printf("Started recording %s for session %s", rec.ID, sessionID)
+	log.Printf("Started recording %s for session %s (%s, %s)", rec.ID, sessionID, format, mode)
 
 	return rec, nil
 }
@@ -253,22 +318,22 @@ func (r *Recorder) StopRecording(recordingID string) error {
 	return r.stopRecordingInternal(rec)
 }
 
-// StopRecordingBySession stops recording by session ID
-func (r *Recorder) StopRecordingBySession(sessionID string) error {
+// StopRecordingBySession stops recording by session ID and returns the recording ID
+func (r *Recorder) StopRecordingBySession(sessionID string) (string, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
 	recID, ok := r.sessionRecs[sessionID]
 	if !ok {
-		return errors.New("no recording for session")
+		return "", errors.New("no recording for session")
 	}
 
 	rec, ok := r.recordings[recID]
 	if !ok {
-		return errors.New("recording not found")
+		return "", errors.New("recording not found")
 	}
 
-	return r.stopRecordingInternal(rec)
+	return recID, r.stopRecordingInternal(rec)
 }
 
 // stopRecordingInternal stops a recording (must hold lock)
@@ -280,28 +345,38 @@ func (r *Recorder) stopRecordingInternal(rec *Recording) error {
 		return nil
 	}
 
-	// Finalize WAV file
-	if rec.writer != nil {
-		if err := rec.writer.Finalize(); err != nil {
-			log.Printf("Error finalizing WAV: %v", err)
-		}
+	// Write out audio still waiting for the other leg
+	if err := rec.legs.flush(rec.writeFrame); err != nil {
+		log.Printf("Error flushing recording %s: %v", rec.ID, err)
 	}
 
-	// Close file
-	if rec.file != nil {
-		rec.file.Close()
-		rec.file = nil
+	// Finalize and close the output files
+	if err := closeSinks(rec.sinks, false); err != nil {
+		log.Printf("Error finalizing recording %s: %v", rec.ID, err)
 	}
+	rec.sinks = nil
 
 	// Get file size
-	if info, err := os.Stat(rec.FilePath); err == nil {
-		rec.FileSize = info.Size()
+	rec.FileSize = 0
+	for _, path := range rec.Files {
+		if info, err := os.Stat(path); err == nil {
+			rec.FileSize += info.Size()
+		}
 	}
 
 	rec.EndTime = time.Now()
 	rec.Duration = rec.EndTime.Sub(rec.StartTime)
 	rec.Status = StatusCompleted
 
+	if err := writeMetadataFile(rec); err != nil {
+		log.Printf("Warning: failed to write recording metadata %s: %v", rec.MetadataPath, err)
+	}
+	if r.callRecs[rec.CallID] == rec.ID {
+		delete(r.callRecs, rec.CallID)
+	}
+	uploadRecording(rec)
+
+	atomic.AddInt32(&r.active, -1)
 	activeRecordings.Dec()
 	log.Printf("Stopped recording %s, duration: %v, size: %d bytes",
 		rec.ID, rec.Duration, rec.FileSize)
@@ -355,7 +430,7 @@ func (r *Recorder) ResumeRecording(recordingID string) error {
 	return nil
 }
 
-// WriteAudio writes audio data to a recording
+// WriteAudio writes already mixed audio data to a recording
 func (r *Recorder) WriteAudio(recordingID string, data []byte) error {
 	r.mu.RLock()
 	rec, ok := r.recordings[recordingID]
@@ -372,26 +447,34 @@ func (r *Recorder) WriteAudio(recordingID string, data []byte) error {
 		return nil // Silently ignore if not recording
 	}
 
-	if rec.writer == nil {
+	if len(rec.sinks) == 0 {
 		return errors.New("writer not initialized")
 	}
 
-	n, err := rec.writer.WriteData(data)
-	if err != nil {
-		recordingErrors.Inc()
-		return err
-	}
+	n, err := rec.sinks[0].Write(data)
+	rec.account(n, err)
+	return err
+}
 
-	rec.packetCount++
-	rec.byteCount += uint64(n)
+// WriteLegAudio queues 16-bit mono PCM from one leg of a call; it is
+// written once it can be paired with audio from the other leg
+func (r *Recorder) WriteLegAudio(recordingID string, pcm []byte, fromCaller bool) error {
+	r.mu.RLock()
+	rec, ok := r.recordings[recordingID]
+	r.mu.RUnlock()
 
-	recordingBytesTotal.Add(float64(n))
-	recordingPacketsTotal.Inc()
+	if !ok {
+		return errors.New("recording not found")
+	}
 
-	// Check file size for rotation (not yet implemented)
-	// When implemented, this will rotate to a new file when MaxFileSize is exceeded
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
 
-	return nil
+	if rec.Status != StatusRecording {
+		return nil
+	}
+
+	return rec.legs.push(pcm, fromCaller, rec.writeFrame)
 }
 
 // WriteAudioBySession writes audio to a recording by session ID
@@ -404,7 +487,50 @@ func (r *Recorder) WriteAudioBySession(sessionID string, data []byte, isCaller b
 		return nil // No recording for this session
 	}
 
-	return r.WriteAudio(recID, data)
+	return r.WriteLegAudio(recID, data, isCaller)
+}
+
+// writeFrame writes one aligned frame of both legs according to the
+// recording mode (must hold rec.mu)
+func (rec *Recording) writeFrame(caller, callee []byte) error {
+	var n int
+	var err error
+
+	switch rec.Mode {
+	case ModeStereo:
+		n, err = rec.sinks[0].Write(rec.mixer.MixStereo(caller, callee))
+	case ModeSeparate:
+		n, err = rec.sinks[0].Write(caller)
+		if err == nil {
+			var m int
+			m, err = rec.sinks[1].Write(callee)
+			n += m
+		}
+	default:
+		n, err = rec.sinks[0].Write(rec.mixer.MixMono(caller, callee))
+	}
+
+	rec.account(n, err)
+	return err
+}
+
+// account updates counters after a write (must hold rec.mu)
+func (rec *Recording) account(n int, err error) {
+	if err != nil {
+		recordingErrors.Inc()
+		return
+	}
+
+	rec.packetCount++
+	rec.byteCount += uint64(n)
+
+	recordingBytesTotal.Add(float64(n))
+	recordingPacketsTotal.Inc()
+}
+
+// ActiveCount returns the number of recordings currently capturing audio
+func (r *Recorder) ActiveCount() int {
+	return int(atomic.LoadInt32(&r.active))
 }
 
 // GetRecording returns a recording by ID
@@ -429,6 +555,20 @@ func (r *Recorder) GetRecordingBySession(sessionID string) (*Recording, bool) {
 	return rec, ok
 }
 
+// GetRecordingByCall returns the active recording of a call by Call-ID
+func (r *Recorder) GetRecordingByCall(callID string) (*Recording, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	recID, ok := r.callRecs[callID]
+	if !ok {
+		return nil, false
+	}
+
+	rec, ok := r.recordings[recID]
+	return rec, ok
+}
+
 // ListRecordings returns all recordings
 func (r *Recorder) ListRecordings() []*Recording {
 	r.mu.RLock()
@@ -452,14 +592,10 @@ func (r *Recorder) DeleteRecording(recordingID string) error {
 	}
 
 	// Stop if still recording
-	if rec.Status == StatusRecording {
-		_ = r.stopRecordingInternal(rec)
-	}
+	_ = r.stopRecordingInternal(rec)
 
-	// Delete file
-	if rec.FilePath != "" {
-		os.Remove(rec.FilePath)
-	}
+	// Delete files
+	removeRecordingFiles(rec)
 
 	// Remove from maps
 	delete(r.recordings, recordingID)
@@ -482,9 +618,7 @@ func (r *Recorder) CleanupOldRecordings() (int, error) {
 
 	for id, rec := range r.recordings {
 		if rec.Status == StatusCompleted && rec.EndTime.Before(cutoff) {
-			if rec.FilePath != "" {
-				os.Remove(rec.FilePath)
-			}
+			removeRecordingFiles(rec)
 			delete(r.recordings, id)
 			delete(r.sessionRecs, rec.SessionID)
 			count++
@@ -0,0 +1,238 @@
+package recording
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestRecorder(t *testing.T) *Recorder {
+	t.Helper()
+	config := DefaultRecordingConfig()
+	config.BasePath = t.TempDir()
+	return NewRecorder(config)
+}
+
+// tone returns n samples of constant 16-bit PCM
+func tone(n int, value int16) []byte {
+	samples := make([]int16, n)
+	for i := range samples {
+		samples[i] = value
+	}
+	return samplesToBytes(samples)
+}
+
+func readMetadata(t *testing.T, path string) metadataFile {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read metadata: %v", err)
+	}
+	var meta metadataFile
+	if err := json.Unmarshal(data, &meta); err != nil {
+		t.Fatalf("invalid metadata JSON: %v", err)
+	}
+	return meta
+}
+
+func TestRecorder_MixedWAV(t *testing.T) {
+	r := newTestRecorder(t)
+
+	rec, err := r.StartRecording("sess-1", "call/1@example.com", FormatWAV, ModeMixed, map[string]string{"agent": "42"})
+	if err != nil {
+		t.Fatalf("StartRecording failed: %v", err)
+	}
+	if !strings.HasPrefix(filepath.Base(rec.FilePath), "call_1@example.com_") || !strings.HasSuffix(rec.FilePath, ".wav") {
+		t.Errorf("unexpected file path %s", rec.FilePath)
+	}
+
+	meta := readMetadata(t, rec.MetadataPath)
+	if meta.Status != string(StatusRecording) || meta.Metadata["agent"] != "42" {
+		t.Errorf("unexpected start metadata: %+v", meta)
+	}
+
+	// 40ms from each leg at 8kHz
+	if err := r.WriteLegAudio(rec.ID, tone(320, 1000), true); err != nil {
+		t.Fatalf("WriteLegAudio failed: %v", err)
+	}
+	if err := r.WriteLegAudio(rec.ID, tone(320, 3000), false); err != nil {
+		t.Fatalf("WriteLegAudio failed: %v", err)
+	}
+
+	if _, err := r.StopRecordingBySession("sess-1"); err != nil {
+		t.Fatalf("StopRecordingBySession failed: %v", err)
+	}
+
+	data, err := os.ReadFile(rec.FilePath)
+	if err != nil {
+		t.Fatalf("failed to read WAV: %v", err)
+	}
+	if string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		t.Fatal("missing RIFF/WAVE header")
+	}
+	if size := binary.LittleEndian.Uint32(data[40:44]); size != 640 {
+		t.Errorf("expected 640 data bytes, got %d", size)
+	}
+	if sample := int16(binary.LittleEndian.Uint16(data[44:])); sample != 2000 {
+		t.Errorf("expected mixed sample 2000, got %d", sample)
+	}
+
+	meta = readMetadata(t, rec.MetadataPath)
+	if meta.Status != string(StatusCompleted) || meta.EndTime == nil || meta.FileSize != int64(len(data)) {
+		t.Errorf("unexpected final metadata: %+v", meta)
+	}
+}
+
+func TestRecorder_StereoPadsSilentLeg(t *testing.T) {
+	r := newTestRecorder(t)
+
+	rec, err := r.StartRecording("sess-2", "call-2", FormatWAV, ModeStereo, nil)
+	if err != nil {
+		t.Fatalf("StartRecording failed: %v", err)
+	}
+
+	// Only the caller sends; once it runs far enough ahead it is written against silence
+	for i := 0; i < alignMaxLagFrames+2; i++ {
+		if err := r.WriteLegAudio(rec.ID, tone(160, 500), true); err != nil {
+			t.Fatalf("WriteLegAudio failed: %v", err)
+		}
+	}
+	if rec.byteCount == 0 {
+		t.Error("expected caller audio to be written while callee is silent")
+	}
+
+	if err := r.StopRecording(rec.ID); err != nil {
+		t.Fatalf("StopRecording failed: %v", err)
+	}
+
+	data, _ := os.ReadFile(rec.FilePath)
+	if channels := binary.LittleEndian.Uint16(data[22:24]); channels != 2 {
+		t.Errorf("expected stereo header, got %d channels", channels)
+	}
+	// 12 caller frames of 160 samples, 2 channels, 2 bytes each
+	if size := binary.LittleEndian.Uint32(data[40:44]); size != 12*160*4 {
+		t.Errorf("unexpected data size %d", size)
+	}
+	left := int16(binary.LittleEndian.Uint16(data[44:]))
+	right := int16(binary.LittleEndian.Uint16(data[46:]))
+	if left != 500 || right != 0 {
+		t.Errorf("expected L=500 R=0, got L=%d R=%d", left, right)
+	}
+}
+
+func TestRecorder_SeparateFiles(t *testing.T) {
+	r := newTestRecorder(t)
+
+	rec, err := r.StartRecording("sess-3", "call-3", FormatPCM, ModeSeparate, nil)
+	if err != nil {
+		t.Fatalf("StartRecording failed: %v", err)
+	}
+	if len(rec.Files) != 2 {
+		t.Fatalf("expected 2 files, got %v", rec.Files)
+	}
+
+	_ = r.WriteLegAudio(rec.ID, tone(160, 7), true)
+	_ = r.WriteLegAudio(rec.ID, tone(160, 9), false)
+	_ = r.StopRecording(rec.ID)
+
+	caller, _ := os.ReadFile(rec.Files[0])
+	callee, _ := os.ReadFile(rec.Files[1])
+	if !bytes.Equal(caller, tone(160, 7)) || !bytes.Equal(callee, tone(160, 9)) {
+		t.Error("leg files do not hold their own leg's audio")
+	}
+
+	if err := r.DeleteRecording(rec.ID); err != nil {
+		t.Fatalf("DeleteRecording failed: %v", err)
+	}
+	for _, path := range append(rec.Files, rec.MetadataPath) {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s not removed", path)
+		}
+	}
+}
+
+func TestRecorder_OggOpus(t *testing.T) {
+	r := newTestRecorder(t)
+
+	rec, err := r.StartRecording("sess-4", "call-4", FormatOpus, ModeMixed, nil)
+	if err != nil {
+		t.Fatalf("StartRecording failed: %v", err)
+	}
+	_ = r.WriteLegAudio(rec.ID, tone(800, 2000), true)
+	_ = r.WriteLegAudio(rec.ID, tone(800, 2000), false)
+	_ = r.StopRecording(rec.ID)
+
+	data, err := os.ReadFile(rec.FilePath)
+	if err != nil {
+		t.Fatalf("failed to read Ogg file: %v", err)
+	}
+	if !strings.HasSuffix(rec.FilePath, ".ogg") || !bytes.HasPrefix(data, []byte("OggS")) {
+		t.Fatal("expected an Ogg stream")
+	}
+	if !bytes.Contains(data, []byte("OpusHead")) || !bytes.Contains(data, []byte("OpusTags")) {
+		t.Error("missing Opus identification/comment headers")
+	}
+}
+
+func TestRecorder_RejectsDuplicate(t *testing.T) {
+	r := newTestRecorder(t)
+
+	if _, err := r.StartRecording("sess-5", "call-5", FormatWAV, ModeMixed, nil); err != nil {
+		t.Fatalf("StartRecording failed: %v", err)
+	}
+	if _, err := r.StartRecording("sess-5", "call-5", FormatWAV, ModeMixed, nil); err == nil {
+		t.Error("expected error for a session already being recorded")
+	}
+	if rec, ok := r.GetRecordingByCall("call-5"); !ok || rec.SessionID != "sess-5" {
+		t.Error("expected recording to be found by call ID")
+	}
+	_ = r.Stop()
+	if _, ok := r.GetRecordingByCall("call-5"); ok {
+		t.Error("stopped recording should no longer be found by call ID")
+	}
+}
+
+func TestRecorder_TenantDirectory(t *testing.T) {
+	r := newTestRecorder(t)
+	defer r.Stop()
+
+	rec, err := r.StartRecording("sess-6", "call-6", FormatWAV, ModeMixed, map[string]string{"tenant": "acme"})
+	if err != nil {
+		t.Fatalf("StartRecording failed: %v", err)
+	}
+	if dir := filepath.Join(r.config.BasePath, "acme") + string(filepath.Separator); !strings.HasPrefix(rec.MetadataPath, dir) {
+		t.Errorf("recording %s is not under the tenant's directory %s", rec.MetadataPath, dir)
+	}
+}
+
+func TestParseRecordingOptions(t *testing.T) {
+	if f, err := ParseRecordingFormat("", FormatWAV); err != nil || f != FormatWAV {
+		t.Errorf("empty format should select default, got %s %v", f, err)
+	}
+	if f, err := ParseRecordingFormat("ogg", FormatWAV); err != nil || f != FormatOpus {
+		t.Errorf("ogg should map to opus, got %s %v", f, err)
+	}
+	if _, err := ParseRecordingFormat("mp3", FormatWAV); err == nil {
+		t.Error("expected error for unsupported format")
+	}
+	if _, err := ParseRecordingMode("quad", ModeMixed); err == nil {
+		t.Error("expected error for unsupported mode")
+	}
+}
+
+func TestDecodePayload(t *testing.T) {
+	pcm, rate, err := decodePayload("PCMU", []byte{0xFF, 0xFF})
+	if err != nil || rate != 8000 || len(pcm) != 4 {
+		t.Errorf("PCMU decode: len=%d rate=%d err=%v", len(pcm), rate, err)
+	}
+	if pcm, _, err := decodePayload("telephone-event", []byte{1, 2, 3, 4}); err != nil || pcm != nil {
+		t.Error("telephone-event should be skipped without error")
+	}
+	if _, _, err := decodePayload("H264", []byte{1}); err == nil {
+		t.Error("expected error for non-audio codec")
+	}
+}
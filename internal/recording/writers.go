@@ -0,0 +1,303 @@
+package recording
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+
+	"karl/internal"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+)
+
+// Ogg/Opus output parameters. The Opus encoder runs at 48kHz stereo with
+// 20ms frames, so recordings are resampled and upmixed before encoding.
+const (
+	oggOpusSampleRate = 48000
+	oggOpusChannels   = 2
+	oggOpusFrameSize  = 960
+)
+
+// audioSink is an open output file of a recording. Write takes 16-bit
+// little-endian PCM at the recording sample rate, interleaved when the
+// sink has more than one channel.
+type audioSink interface {
+	Write(pcm []byte) (int, error)
+	Close() error
+	Path() string
+}
+
+// newAudioSink creates the output file for a recording format
+func newAudioSink(format RecordingFormat, path string, sampleRate, bitsPerSample, channels int) (audioSink, error) {
+	switch format {
+	case FormatWAV:
+		return newWAVSink(path, sampleRate, bitsPerSample, channels)
+	case FormatPCM:
+		return newRawSink(path)
+	case FormatOpus:
+		return newOggOpusSink(path, sampleRate, channels)
+	default:
+		return nil, fmt.Errorf("unsupported recording format: %s", format)
+	}
+}
+
+// fileExtension returns the file name extension for a recording format
+func fileExtension(format RecordingFormat) string {
+	switch format {
+	case FormatPCM:
+		return ".pcm"
+	case FormatOpus:
+		return ".ogg"
+	default:
+		return ".wav"
+	}
+}
+
+// wavSink writes PCM into a RIFF/WAVE file
+type wavSink struct {
+	file          *os.File
+	writer        *WAVWriter
+	path          string
+	bitsPerSample int
+}
+
+func newWAVSink(path string, sampleRate, bitsPerSample, channels int) (*wavSink, error) {
+	if bitsPerSample != 8 {
+		bitsPerSample = 16
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file: %w", err)
+	}
+
+	writer := NewWAVWriter(file, sampleRate, bitsPerSample, channels)
+	if err := writer.WriteHeader(); err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, fmt.Errorf("failed to write WAV header: %w", err)
+	}
+
+	return &wavSink{file: file, writer: writer, path: path, bitsPerSample: bitsPerSample}, nil
+}
+
+func (s *wavSink) Write(pcm []byte) (int, error) {
+	if s.bitsPerSample == 8 {
+		pcm = pcm16To8(pcm)
+	}
+	return s.writer.WriteData(pcm)
+}
+
+func (s *wavSink) Close() error {
+	err := s.writer.Finalize()
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s *wavSink) Path() string {
+	return s.path
+}
+
+// rawSink writes headerless 16-bit PCM
+type rawSink struct {
+	file *os.File
+	path string
+}
+
+func newRawSink(path string) (*rawSink, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file: %w", err)
+	}
+	return &rawSink{file: file, path: path}, nil
+}
+
+func (s *rawSink) Write(pcm []byte) (int, error) {
+	return s.file.Write(pcm)
+}
+
+func (s *rawSink) Close() error {
+	return s.file.Close()
+}
+
+func (s *rawSink) Path() string {
+	return s.path
+}
+
+// oggOpusSink encodes PCM to Opus and writes it into an Ogg container (RFC 7845)
+type oggOpusSink struct {
+	writer     *oggwriter.OggWriter
+	path       string
+	sampleRate int
+	channels   int
+	pending    []int16 // 48kHz stereo samples waiting for a full frame
+	timestamp  uint32
+}
+
+func newOggOpusSink(path string, sampleRate, channels int) (*oggOpusSink, error) {
+	writer, err := oggwriter.New(path, oggOpusSampleRate, oggOpusChannels)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file: %w", err)
+	}
+	return &oggOpusSink{
+		writer:     writer,
+		path:       path,
+		sampleRate: sampleRate,
+		channels:   channels,
+	}, nil
+}
+
+func (s *oggOpusSink) Write(pcm []byte) (int, error) {
+	left, right := splitChannels(bytesToSamples(pcm), s.channels)
+	left = resampleLinear(left, s.sampleRate, oggOpusSampleRate)
+	right = resampleLinear(right, s.sampleRate, oggOpusSampleRate)
+
+	for i := range left {
+		s.pending = append(s.pending, left[i], right[i])
+	}
+
+	frameSamples := oggOpusFrameSize * oggOpusChannels
+	for len(s.pending) >= frameSamples {
+		if err := s.writeFrame(s.pending[:frameSamples]); err != nil {
+			return 0, err
+		}
+		s.pending = s.pending[frameSamples:]
+	}
+
+	return len(pcm), nil
+}
+
+// writeFrame encodes one 20ms stereo frame and appends it to the stream
+func (s *oggOpusSink) writeFrame(frame []int16) error {
+	encoded, err := internal.EncodeToOpus(frame)
+	if err != nil {
+		return err
+	}
+
+	packet := &rtp.Packet{
+		Header:  rtp.Header{Timestamp: s.timestamp},
+		Payload: encoded,
+	}
+	s.timestamp += oggOpusFrameSize
+	return s.writer.WriteRTP(packet)
+}
+
+func (s *oggOpusSink) Close() error {
+	var err error
+	if len(s.pending) > 0 {
+		// Pad the last partial frame with silence
+		frame := make([]int16, oggOpusFrameSize*oggOpusChannels)
+		copy(frame, s.pending)
+		s.pending = nil
+		err = s.writeFrame(frame)
+	}
+	if cerr := s.writer.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s *oggOpusSink) Path() string {
+	return s.path
+}
+
+// bytesToSamples converts 16-bit little-endian PCM to samples
+func bytesToSamples(pcm []byte) []int16 {
+	samples := make([]int16, len(pcm)/2)
+	for i := range samples {
+		samples[i] = int16(binary.LittleEndian.Uint16(pcm[i*2:]))
+	}
+	return samples
+}
+
+// samplesToBytes converts samples to 16-bit little-endian PCM
+func samplesToBytes(samples []int16) []byte {
+	pcm := make([]byte, len(samples)*2)
+	for i, sample := range samples {
+		binary.LittleEndian.PutUint16(pcm[i*2:], uint16(sample))
+	}
+	return pcm
+}
+
+// pcm16To8 converts signed 16-bit PCM to unsigned 8-bit PCM
+func pcm16To8(pcm []byte) []byte {
+	out := make([]byte, len(pcm)/2)
+	for i := range out {
+		sample := int16(binary.LittleEndian.Uint16(pcm[i*2:]))
+		out[i] = byte((sample >> 8) + 128)
+	}
+	return out
+}
+
+// splitChannels returns the left and right channels of interleaved
+// samples; mono input is returned as both channels
+func splitChannels(samples []int16, channels int) (left, right []int16) {
+	if channels != 2 {
+		return samples, samples
+	}
+	left = make([]int16, len(samples)/2)
+	right = make([]int16, len(samples)/2)
+	for i := range left {
+		left[i] = samples[i*2]
+		right[i] = samples[i*2+1]
+	}
+	return left, right
+}
+
+// resampleLinear converts samples between rates using linear interpolation
+func resampleLinear(samples []int16, from, to int) []int16 {
+	if from == to || from <= 0 || to <= 0 || len(samples) == 0 {
+		return samples
+	}
+
+	outLen := len(samples) * to / from
+	out := make([]int16, outLen)
+	step := float64(from) / float64(to)
+	for i := range out {
+		pos := float64(i) * step
+		idx := int(pos)
+		if idx >= len(samples)-1 {
+			out[i] = samples[len(samples)-1]
+			continue
+		}
+		frac := pos - float64(idx)
+		out[i] = int16(float64(samples[idx])*(1-frac) + float64(samples[idx+1])*frac)
+	}
+	return out
+}
+
+// closeSinks closes every sink, optionally deleting the files (used when a
+// recording fails to start). It returns the first error encountered.
+func closeSinks(sinks []audioSink, remove bool) error {
+	var firstErr error
+	for _, sink := range sinks {
+		if err := sink.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if remove {
+			os.Remove(sink.Path())
+		}
+	}
+	return firstErr
+}
+
+// safeFileName replaces characters of a Call-ID that are unsafe in file names
+func safeFileName(name string) string {
+	if name == "" {
+		return "unknown"
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '-', r == '_', r == '.', r == '@':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
@@ -0,0 +1,358 @@
+package internal
+
+import (
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// REMB metrics
+var (
+	rembSent = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "karl_remb_sent_total",
+			Help: "Total REMB messages sent to WebRTC publishers",
+		},
+	)
+
+	rembReceived = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "karl_remb_received_total",
+			Help: "Total REMB messages received for transcoded WebRTC tracks",
+		},
+	)
+)
+
+const (
+	// rembInterval is how often a receive-side estimate is computed and sent
+	rembInterval = time.Second
+
+	// rembMinBitrate is the lowest estimate sent to a publisher
+	rembMinBitrate = 30000
+
+	// rembDefaultStartBitrate is assumed before anything was measured when
+	// no start bitrate is configured
+	rembDefaultStartBitrate = 300000
+
+	// Loss above rembLossHigh cuts the estimate, loss below rembLossLow lets
+	// it grow by rembIncrease per interval
+	rembLossHigh = 0.10
+	rembLossLow  = 0.02
+	rembIncrease = 1.08
+
+	// rembOveruseDelay is the growth in one-way delay over one interval that
+	// is taken as queues building up on the path
+	rembOveruseDelay = 30 * time.Millisecond
+
+	// rembOveruseBackoff scales the measured receive rate on overuse
+	rembOveruseBackoff = 0.85
+
+	// rembMaxRateFactor keeps the estimate within reach of what the sender
+	// actually sends, so it does not grow unbounded while the sender idles
+	rembMaxRateFactor = 1.5
+
+	// opusMinBitrate is the lowest bitrate the Opus encoder is set to
+	opusMinBitrate = 6000
+
+	// opusPacketOverhead is the IP/UDP/RTP/SRTP overhead of one 20ms Opus
+	// packet stream (50 packets/s of ~50 bytes) that a REMB estimate covers
+	opusPacketOverhead = 20000
+)
+
+// rembStream is the receive state of one SSRC within an estimation interval
+type rembStream struct {
+	clockRate   uint32
+	started     bool
+	highestSeq  uint64 // extended sequence number
+	startSeq    uint64 // highest sequence number at the start of the interval
+	received    uint64
+	bytes       uint64
+	lastTS      uint32
+	lastArrival time.Time
+	delayGrowth time.Duration
+}
+
+// REMBEstimator estimates the bandwidth available from a remote sender from
+// the loss and the one-way delay trend of the packets it sends. It serves
+// peers that adapt their encoder to REMB rather than transport-cc feedback.
+type REMBEstimator struct {
+	estimate   uint64
+	min        uint64
+	max        uint64
+	streams    map[uint32]*rembStream
+	lastUpdate time.Time
+	mu         sync.Mutex
+}
+
+// NewREMBEstimator creates an estimator starting at startBitrate and kept
+// within [rembMinBitrate, maxBitrate]; 0 uses defaults
+func NewREMBEstimator(startBitrate, maxBitrate uint64) *REMBEstimator {
+	if startBitrate == 0 {
+		startBitrate = rembDefaultStartBitrate
+	}
+	if maxBitrate > 0 && startBitrate > maxBitrate {
+		startBitrate = maxBitrate
+	}
+	return &REMBEstimator{
+		estimate:   startBitrate,
+		min:        rembMinBitrate,
+		max:        maxBitrate,
+		streams:    make(map[uint32]*rembStream),
+		lastUpdate: time.Now(),
+	}
+}
+
+// OnPacket records a received RTP packet of size bytes
+func (e *REMBEstimator) OnPacket(header *rtp.Header, size int, clockRate uint32, arrival time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	stream, ok := e.streams[header.SSRC]
+	if !ok {
+		stream = &rembStream{clockRate: clockRate}
+		e.streams[header.SSRC] = stream
+	}
+	stream.received++
+	stream.bytes += uint64(size)
+
+	if !stream.started {
+		// Offset by one cycle so late packets never go below zero
+		stream.highestSeq = uint64(header.SequenceNumber) + 1<<16
+		stream.startSeq = stream.highestSeq - 1
+		stream.lastTS = header.Timestamp
+		stream.lastArrival = arrival
+		stream.started = true
+		return
+	}
+
+	diff := int16(header.SequenceNumber - uint16(stream.highestSeq))
+	if diff <= 0 {
+		return // Reordered or duplicate
+	}
+	stream.highestSeq += uint64(diff)
+
+	// Compare arrival spacing with send spacing once per frame
+	if header.Timestamp != stream.lastTS && stream.clockRate > 0 {
+		sent := time.Duration(int32(header.Timestamp-stream.lastTS)) * time.Second / time.Duration(stream.clockRate)
+		stream.delayGrowth += arrival.Sub(stream.lastArrival) - sent
+		stream.lastTS = header.Timestamp
+		stream.lastArrival = arrival
+	}
+}
+
+// RemoveStream stops accounting for an SSRC
+func (e *REMBEstimator) RemoveStream(ssrc uint32) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.streams, ssrc)
+}
+
+// Update closes the current interval and returns the new estimate
+func (e *REMBEstimator) Update(now time.Time) uint64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	elapsed := now.Sub(e.lastUpdate)
+	e.lastUpdate = now
+	if elapsed <= 0 || len(e.streams) == 0 {
+		return e.estimate
+	}
+
+	var received, expected, bytes uint64
+	var delayGrowth time.Duration
+	for _, stream := range e.streams {
+		received += stream.received
+		bytes += stream.bytes
+		if stream.started {
+			expected += stream.highestSeq - stream.startSeq
+		}
+		if stream.delayGrowth > delayGrowth {
+			delayGrowth = stream.delayGrowth
+		}
+		stream.received, stream.bytes, stream.delayGrowth = 0, 0, 0
+		stream.startSeq = stream.highestSeq
+	}
+	if received == 0 {
+		return e.estimate
+	}
+
+	loss := 0.0
+	if expected > received {
+		loss = float64(expected-received) / float64(expected)
+	}
+	rate := float64(bytes*8) / elapsed.Seconds()
+
+	estimate := float64(e.estimate)
+	switch {
+	case delayGrowth > rembOveruseDelay:
+		estimate = rate * rembOveruseBackoff
+	case loss > rembLossHigh:
+		estimate *= 1 - loss/2
+	case loss < rembLossLow:
+		// Grow, but not past what the sender could use; never shrink here
+		estimate *= rembIncrease
+		if limit := rate * rembMaxRateFactor; estimate > limit {
+			estimate = math.Max(limit, float64(e.estimate))
+		}
+	}
+
+	e.estimate = uint64(estimate)
+	if e.estimate < e.min {
+		e.estimate = e.min
+	}
+	if e.max > 0 && e.estimate > e.max {
+		e.estimate = e.max
+	}
+	return e.estimate
+}
+
+// Packet builds a REMB message with the current estimate for every stream
+func (e *REMBEstimator) Packet() *rtcp.ReceiverEstimatedMaximumBitrate {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ssrcs := make([]uint32, 0, len(e.streams))
+	for ssrc := range e.streams {
+		ssrcs = append(ssrcs, ssrc)
+	}
+	return &rtcp.ReceiverEstimatedMaximumBitrate{
+		Bitrate: float32(e.estimate),
+		SSRCs:   ssrcs,
+	}
+}
+
+// sfuPublisherBWE is the REMB estimator shared by the tracks of one
+// publisher peer connection; a sender applies REMB to all its streams
+type sfuPublisherBWE struct {
+	estimator *REMBEstimator
+	refs      int
+	stop      chan struct{}
+}
+
+// acquireREMB returns the estimator of a publisher connection, starting its
+// REMB sender for the first track
+func (s *SFU) acquireREMB(pc *webrtc.PeerConnection) *REMBEstimator {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bwe, ok := s.publisherBWE[pc]
+	if !ok {
+		bwe = &sfuPublisherBWE{
+			estimator: NewREMBEstimator(uint64(s.config.StartBitrate), uint64(s.config.MaxBitrate)),
+			stop:      make(chan struct{}),
+		}
+		s.publisherBWE[pc] = bwe
+		go sendREMB(pc, bwe.estimator, bwe.stop)
+	}
+	bwe.refs++
+	return bwe.estimator
+}
+
+// releaseREMB drops a track's reference, stopping the REMB sender after the
+// last one
+func (s *SFU) releaseREMB(pc *webrtc.PeerConnection, ssrc uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bwe, ok := s.publisherBWE[pc]
+	if !ok {
+		return
+	}
+	bwe.estimator.RemoveStream(ssrc)
+	bwe.refs--
+	if bwe.refs <= 0 {
+		close(bwe.stop)
+		delete(s.publisherBWE, pc)
+	}
+}
+
+// sendREMB periodically sends the receive-side estimate to a publisher
+func sendREMB(pc *webrtc.PeerConnection, estimator *REMBEstimator, stop <-chan struct{}) {
+	ticker := time.NewTicker(rembInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			estimator.Update(now)
+			packet := estimator.Packet()
+			if len(packet.SSRCs) == 0 {
+				continue
+			}
+			if err := pc.WriteRTCP([]rtcp.Packet{packet}); err != nil {
+				log.Printf("REMB: failed to send estimate: %v", err)
+				continue
+			}
+			rembSent.Inc()
+		}
+	}
+}
+
+// WatchSender reads RTCP feedback for the output track of a track pair and
+// adapts the Opus encoder bitrate to the REMB estimates of the peer
+func (t *RTPTranscoder) WatchSender(trackID string, sender *webrtc.RTPSender) {
+	pair, ok := t.GetTrackPair(trackID)
+	if !ok {
+		return
+	}
+
+	go func() {
+		for {
+			packets, _, err := sender.ReadRTCP()
+			if err != nil {
+				return
+			}
+			for _, packet := range packets {
+				if remb, ok := packet.(*rtcp.ReceiverEstimatedMaximumBitrate); ok {
+					rembReceived.Inc()
+					t.applyREMB(pair, uint64(remb.Bitrate))
+				}
+			}
+		}
+	}()
+}
+
+// applyREMB records a peer's estimate and sets the pair's encoder bitrate
+// from it
+func (t *RTPTranscoder) applyREMB(pair *trackPair, bitrate uint64) {
+	t.mu.Lock()
+	pair.estimate = bitrate
+	t.mu.Unlock()
+
+	if pair.codec == webrtc.MimeTypeOpus {
+		pair.codecs.OpusEncoder().SetBitrate(opusBitrateFor(bitrate))
+	}
+}
+
+// opusBitrateFor returns the Opus encoder bitrate that fits a REMB estimate
+// once packet overhead is taken off
+func opusBitrateFor(estimate uint64) int {
+	if estimate <= opusPacketOverhead+opusMinBitrate {
+		return opusMinBitrate
+	}
+	bitrate := int(estimate - opusPacketOverhead)
+	if bitrate > opusBitrate {
+		bitrate = opusBitrate
+	}
+	return bitrate
+}
+
+// hasRTCPFeedback reports whether a negotiated codec uses an RTCP feedback
+// type, e.g. goog-remb
+func hasRTCPFeedback(codec webrtc.RTPCodecParameters, feedbackType string) bool {
+	for _, fb := range codec.RTCPFeedback {
+		if fb.Type == feedbackType {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// feedREMB sends one second of 30fps video at 1000 bytes per packet. lost
+// packets are skipped and each frame arrives delay later than the previous
+func feedREMB(e *REMBEstimator, start time.Time, seq uint16, lost int, delay time.Duration) (time.Time, uint16) {
+	arrival := start
+	for frame := 0; frame < 30; frame++ {
+		arrival = arrival.Add(33*time.Millisecond + delay)
+		header := &rtp.Header{SSRC: 1, SequenceNumber: seq, Timestamp: uint32(seq) * 3000}
+		seq++
+		if frame < lost {
+			continue
+		}
+		e.OnPacket(header, 1000, 90000, arrival)
+	}
+	return arrival, seq
+}
+
+func TestREMBEstimator(t *testing.T) {
+	start := time.Now()
+	e := NewREMBEstimator(200000, 2000000)
+	e.lastUpdate = start
+
+	// No loss, no delay growth: grows by 8% a second
+	now, seq := feedREMB(e, start, 100, 0, 0)
+	if got := e.Update(start.Add(time.Second)); got != 216000 {
+		t.Errorf("expected estimate to grow to 216000, got %d", got)
+	}
+
+	// Growth stops at 1.5x the measured 240kbps receive rate
+	for i := 0; i < 10; i++ {
+		now, seq = feedREMB(e, now, seq, 0, 0)
+		e.Update(start.Add(time.Duration(i+2) * time.Second))
+	}
+	if got := e.estimate; got != 360000 {
+		t.Errorf("expected estimate capped at 360000, got %d", got)
+	}
+
+	// 20% loss takes 10% off
+	now, seq = feedREMB(e, now, seq, 6, 0)
+	if got := e.Update(start.Add(13 * time.Second)); got != 324000 {
+		t.Errorf("expected estimate of 324000 after loss, got %d", got)
+	}
+
+	// Growing delay backs off below the receive rate
+	_, _ = feedREMB(e, now, seq, 0, 5*time.Millisecond)
+	if got := e.Update(start.Add(14 * time.Second)); got != 204000 {
+		t.Errorf("expected estimate of 204000 on overuse, got %d", got)
+	}
+
+	packet := e.Packet()
+	if packet.Bitrate != 204000 || len(packet.SSRCs) != 1 || packet.SSRCs[0] != 1 {
+		t.Errorf("unexpected REMB packet %+v", packet)
+	}
+
+	e.RemoveStream(1)
+	if len(e.Packet().SSRCs) != 0 {
+		t.Error("expected removed stream to leave the REMB")
+	}
+}
+
+func TestREMBEstimator_Bounds(t *testing.T) {
+	start := time.Now()
+	e := NewREMBEstimator(0, 0)
+	if e.estimate != rembDefaultStartBitrate {
+		t.Errorf("expected default start bitrate, got %d", e.estimate)
+	}
+	e.lastUpdate = start
+
+	// Heavy loss repeatedly halves towards the floor
+	now, seq := start, uint16(65530)
+	for i := 0; i < 20; i++ {
+		now, seq = feedREMB(e, now, seq, 29, 0)
+		e.Update(start.Add(time.Duration(i+1) * time.Second))
+	}
+	if e.estimate != rembMinBitrate {
+		t.Errorf("expected estimate at the %d floor, got %d", rembMinBitrate, e.estimate)
+	}
+}
+
+func TestOpusBitrateForREMB(t *testing.T) {
+	tests := []struct {
+		estimate uint64
+		want     int
+	}{
+		{10000, opusMinBitrate},
+		{50000, 30000},
+		{1000000, opusBitrate},
+	}
+	for _, tt := range tests {
+		if got := opusBitrateFor(tt.estimate); got != tt.want {
+			t.Errorf("opusBitrateFor(%d) = %d, expected %d", tt.estimate, got, tt.want)
+		}
+	}
+
+	transcoder := NewRTPTranscoder(nil)
+	pair := &trackPair{codec: webrtc.MimeTypeOpus, codecs: NewStreamCodecs()}
+	transcoder.applyREMB(pair, 50000)
+	encoder := pair.codecs.OpusEncoder()
+	if pair.estimate != 50000 || encoder.bitrate != 30000 {
+		t.Errorf("expected REMB to set the encoder to 30000, got %d", encoder.bitrate)
+	}
+	if shared := GetOpusEncoder().bitrate; shared != opusBitrate {
+		t.Errorf("expected the shared encoder to keep %d, got %d", opusBitrate, shared)
+	}
+
+	codec := webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{
+		RTCPFeedback: []webrtc.RTCPFeedback{{Type: webrtc.TypeRTCPFBGoogREMB}},
+	}}
+	if !hasRTCPFeedback(codec, webrtc.TypeRTCPFBGoogREMB) || hasRTCPFeedback(codec, webrtc.TypeRTCPFBTransportCC) {
+		t.Error("hasRTCPFeedback did not match the negotiated feedback")
+	}
+}
@@ -0,0 +1,339 @@
+package internal
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// ptimeFramer splits a codec's payloads into frames that can be regrouped
+// into packets of another duration
+type ptimeFramer interface {
+	// split returns the frames of a payload, or false if it cannot be
+	// re-framed, e.g. a G.729 payload ending in a SID
+	split(payload []byte) ([][]byte, bool)
+	// join builds one payload from consecutive frames
+	join(frames [][]byte) []byte
+	// frameTicks is the duration of a frame in RTP clock ticks
+	frameTicks() int
+}
+
+// fixedFramer handles codecs whose payloads are a sequence of equally sized
+// frames
+type fixedFramer struct {
+	size  int // bytes per frame
+	ticks int // RTP clock ticks per frame
+}
+
+func (f fixedFramer) split(payload []byte) ([][]byte, bool) {
+	if len(payload) == 0 || len(payload)%f.size != 0 {
+		return nil, false
+	}
+	frames := make([][]byte, 0, len(payload)/f.size)
+	for i := 0; i < len(payload); i += f.size {
+		frames = append(frames, payload[i:i+f.size])
+	}
+	return frames, true
+}
+
+func (f fixedFramer) join(frames [][]byte) []byte {
+	payload := make([]byte, 0, len(frames)*f.size)
+	for _, frame := range frames {
+		payload = append(payload, frame...)
+	}
+	return payload
+}
+
+func (f fixedFramer) frameTicks() int {
+	return f.ticks
+}
+
+// amrFramer regroups the frames of RFC 4867 payloads. Each frame is kept as
+// a single-frame payload so it can carry its own table of contents entry
+type amrFramer struct {
+	format *AMRFormat
+}
+
+func (f amrFramer) split(payload []byte) ([][]byte, bool) {
+	p, err := ParseAMRPayload(payload, f.format)
+	if err != nil {
+		return nil, false
+	}
+	frames := make([][]byte, len(p.Frames))
+	for i, frame := range p.Frames {
+		single := &AMRPayload{CMR: p.CMR, Frames: []AMRFrame{frame}}
+		frames[i] = single.Marshal(f.format)
+	}
+	return frames, true
+}
+
+func (f amrFramer) join(frames [][]byte) []byte {
+	joined := &AMRPayload{CMR: AMRNoRequest}
+	for i, frame := range frames {
+		p, err := ParseAMRPayload(frame, f.format)
+		if err != nil {
+			continue
+		}
+		if i == 0 {
+			joined.CMR = p.CMR
+		}
+		joined.Frames = append(joined.Frames, p.Frames...)
+	}
+	return joined.Marshal(f.format)
+}
+
+func (f amrFramer) frameTicks() int {
+	if f.format.Wideband {
+		return AMRWBFrameSamples
+	}
+	return AMRNBFrameSamples
+}
+
+// newPtimeFramer returns the framer for a codec, or nil if its payloads
+// cannot be re-framed (e.g. Opus or Speex)
+func newPtimeFramer(codec CodecInfo) ptimeFramer {
+	switch mimeType := codecMimeType(codec.Name); mimeType {
+	case "audio/PCMU", "audio/PCMA", "audio/G722":
+		// One byte per clock tick; 1 ms frames allow any packet time
+		return fixedFramer{size: 8, ticks: 8}
+	case MimeTypeG729:
+		return fixedFramer{size: G729FrameSize, ticks: G729FrameSamples}
+	case MimeTypeILBC:
+		mode := ILBCFmtpMode(codec.Fmtp)
+		return fixedFramer{size: GetILBCFrameSize(mode), ticks: GetILBCFrameSamples(mode)}
+	case "audio/GSM":
+		return fixedFramer{size: 33, ticks: 160}
+	case MimeTypeAMR, MimeTypeAMRWB:
+		format, err := ParseAMRFormat(codec.Fmtp, mimeType == MimeTypeAMRWB)
+		if err != nil {
+			return nil
+		}
+		return amrFramer{format: format}
+	}
+	return nil
+}
+
+// rtpClockRate returns the RTP clock rate of a negotiated codec
+func rtpClockRate(codec CodecInfo) int {
+	if codec.ClockRate != 0 {
+		return int(codec.ClockRate)
+	}
+	return codecSampleRate(codec)
+}
+
+// Repacketizer re-frames one RTP stream to the packet time its receiver
+// asked for, buffering frames until a packet is full. Timestamps are moved
+// onto the output codec's clock and sequence numbers are renumbered, keeping
+// gaps for lost packets so the receiver still sees the loss. A new source
+// SSRC or clock rate, as after a re-INVITE, continues the output stream
+type Repacketizer struct {
+	mu      sync.Mutex
+	clock   rtpClock
+	offset  uint32 // added to converted timestamps to continue the output
+	framer  ptimeFramer
+	codec   CodecInfo
+	frames  [][]byte
+	header  RTPPacket // header of the first buffered packet
+	startTS uint32    // output timestamp of frames[0]
+	nextTS  uint32    // output timestamp following the buffered frames
+	source  uint32    // SSRC of the input stream
+	lastSeq uint16    // last input sequence number
+	seq     uint16    // next output sequence number
+	started bool
+	sentTS  uint32    // timestamp of the last packet sent
+	sentEnd uint32    // timestamp following its frames, if they are known
+	sentAt  time.Time // when it was sent, zero before the first
+}
+
+var (
+	repacketizersMu sync.Mutex
+	repacketizers   = make(map[uint32]*Repacketizer)
+)
+
+// getRepacketizer returns the repacketizer of an SSRC, creating it on first use
+func getRepacketizer(ssrc uint32) *Repacketizer {
+	repacketizersMu.Lock()
+	defer repacketizersMu.Unlock()
+
+	r, ok := repacketizers[ssrc]
+	if !ok {
+		r = &Repacketizer{}
+		repacketizers[ssrc] = r
+	}
+	return r
+}
+
+// ContinueRepacketizer makes an SSRC that replaces another, such as a
+// party's new stream after a re-INVITE, share its repacketizer, so the
+// stream relayed for it continues the sequence numbers and timestamps the
+// receiver already sees
+func ContinueRepacketizer(from, to uint32) {
+	repacketizersMu.Lock()
+	defer repacketizersMu.Unlock()
+
+	if r, ok := repacketizers[from]; ok {
+		repacketizers[to] = r
+	}
+}
+
+// RemoveRepacketizer drops the state kept for an SSRC
+func RemoveRepacketizer(ssrc uint32) {
+	repacketizersMu.Lock()
+	defer repacketizersMu.Unlock()
+	delete(repacketizers, ssrc)
+}
+
+// Push takes a packet already in the output codec and returns the packets to
+// send: none while a packet is being filled, or several when the input
+// packets are longer than ptime. With ptime 0, or a codec that cannot be
+// re-framed, packets keep their framing. Late and duplicate packets are
+// dropped since their audio has already been re-framed
+func (r *Repacketizer) Push(packet *RTPPacket, inputRate int, codec CodecInfo, ptime int) []*RTPPacket {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Another source's numbering continues where the last one stopped
+	var out []*RTPPacket
+	gap := uint16(1)
+	switched := r.started && packet.SSRC != r.source
+	switch {
+	case switched:
+		out = r.flush(out)
+	case r.started:
+		gap = packet.SequenceNumber - r.lastSeq
+		if gap == 0 || gap >= 0x8000 {
+			return nil
+		}
+	default:
+		r.started = true
+		r.seq = packet.SequenceNumber
+	}
+	r.source, r.lastSeq = packet.SSRC, packet.SequenceNumber
+
+	// A change of clock rates restarts the timestamp mapping, from where
+	// the output got to
+	outputRate := rtpClockRate(codec)
+	if switched || r.clock.inputRate != inputRate || r.clock.outputRate != outputRate {
+		out = r.flush(out)
+		r.restart(packet, inputRate, outputRate)
+	}
+	ts := r.clock.convert(packet.Timestamp) + r.offset
+
+	// Frames only join a packet if they continue it in the same codec
+	// without a gap
+	unchanged := strings.EqualFold(codec.Name, r.codec.Name) && codec.Fmtp == r.codec.Fmtp
+	if len(r.frames) > 0 && (!unchanged || ts != r.nextTS || packet.Marker || gap > 1) {
+		out = r.flush(out)
+	}
+	r.seq += gap - 1
+	if !unchanged {
+		r.codec = codec
+		r.framer = newPtimeFramer(codec)
+	}
+
+	// Telephone events, comfort noise and codecs without fixed frames keep
+	// their framing
+	var frames [][]byte
+	ok := false
+	if r.framer != nil && ptime > 0 {
+		frames, ok = r.framer.split(packet.Payload)
+	}
+	if !ok {
+		out = r.flush(out)
+		p := *packet
+		p.Timestamp = ts
+		p.SequenceNumber = r.seq
+		r.seq++
+		r.sent(&p, p.Timestamp, packet.Received)
+		return append(out, &p)
+	}
+
+	if len(r.frames) == 0 {
+		r.header = *packet
+		r.header.CSRC = append([]uint32(nil), packet.CSRC...)
+		r.header.ExtensionData = append([]byte(nil), packet.ExtensionData...)
+		r.header.Payload = nil
+		r.startTS = ts
+	}
+	r.frames = append(r.frames, frames...)
+	ticks := r.framer.frameTicks()
+	r.nextTS = ts + uint32(len(frames)*ticks)
+
+	perPacket := ptime * outputRate / 1000 / ticks
+	if perPacket < 1 {
+		perPacket = 1
+	}
+	for len(r.frames) >= perPacket {
+		out = r.emit(out, perPacket)
+	}
+
+	// The packet's buffer is reused once Push returns, so frames that wait
+	// for the next packet are copied
+	held := len(r.frames) - len(frames)
+	if held < 0 {
+		held = 0
+	}
+	for i := held; i < len(r.frames); i++ {
+		r.frames[i] = append([]byte(nil), r.frames[i]...)
+	}
+	return out
+}
+
+// flush sends the buffered frames as a short packet
+func (r *Repacketizer) flush(out []*RTPPacket) []*RTPPacket {
+	if len(r.frames) == 0 {
+		return out
+	}
+	return r.emit(out, len(r.frames))
+}
+
+// emit sends the first n buffered frames as one packet
+func (r *Repacketizer) emit(out []*RTPPacket, n int) []*RTPPacket {
+	p := r.header
+	p.Payload = r.framer.join(r.frames[:n])
+	p.Timestamp = r.startTS
+	p.SequenceNumber = r.seq
+	r.seq++
+
+	// Only the first packet of a talkspurt carries the marker
+	r.header.Marker = false
+	r.frames = r.frames[n:]
+	r.startTS += uint32(n * r.framer.frameTicks())
+	r.sent(&p, r.startTS, p.Received)
+	return append(out, &p)
+}
+
+// sent records the last packet sent, whose audio ends at end, and when its
+// first input packet was received
+func (r *Repacketizer) sent(p *RTPPacket, end uint32, received time.Time) {
+	if received.IsZero() {
+		received = time.Now()
+	}
+	r.sentTS, r.sentEnd, r.sentAt = p.Timestamp, end, received
+}
+
+// restart maps the timestamps of a new clock or source onto the output
+// clock. Once packets were sent, the packet continues the output by the
+// time that passed since the last one, so the receiver sees neither a
+// timestamp jump nor a new stream
+func (r *Repacketizer) restart(packet *RTPPacket, inputRate, outputRate int) {
+	r.clock = rtpClock{inputRate: inputRate, outputRate: outputRate}
+	r.offset = 0
+	if r.sentAt.IsZero() {
+		return
+	}
+	received := packet.Received
+	if received.IsZero() {
+		received = time.Now()
+	}
+	ticks := uint32(1)
+	if elapsed := received.Sub(r.sentAt); elapsed > 0 && outputRate > 0 {
+		ticks = max(uint32(int64(elapsed)*int64(outputRate)/int64(time.Second)), 1)
+	}
+	next := r.sentTS + ticks
+	if int32(r.sentEnd-next) > 0 {
+		next = r.sentEnd
+	}
+	mapped := r.clock
+	r.offset = next - mapped.convert(packet.Timestamp)
+}
@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+var repacketizerPCMU = CodecInfo{PayloadType: 0, Name: "PCMU", ClockRate: 8000}
+
+// repacketizerPacket returns a PCMU packet of ms milliseconds whose payload
+// bytes count up from the first sample's timestamp
+func repacketizerPacket(seq uint16, ts uint32, ms int) *RTPPacket {
+	payload := make([]byte, ms*8)
+	for i := range payload {
+		payload[i] = byte(ts + uint32(i))
+	}
+	return &RTPPacket{SSRC: 1, SequenceNumber: seq, Timestamp: ts, Payload: payload}
+}
+
+func TestRepacketizer_Merge(t *testing.T) {
+	r := &Repacketizer{}
+	first := repacketizerPacket(100, 8000, 20)
+	first.Marker = true
+	if out := r.Push(first, 8000, repacketizerPCMU, 40); len(out) != 0 {
+		t.Fatalf("expected the first 20 ms to be buffered, got %d packets", len(out))
+	}
+
+	out := r.Push(repacketizerPacket(101, 8160, 20), 8000, repacketizerPCMU, 40)
+	if len(out) != 1 {
+		t.Fatalf("expected one 40 ms packet, got %d", len(out))
+	}
+	p := out[0]
+	if len(p.Payload) != 320 || p.Timestamp != 8000 || p.SequenceNumber != 100 || !p.Marker {
+		t.Errorf("unexpected packet: %d bytes, ts %d, seq %d, marker %v",
+			len(p.Payload), p.Timestamp, p.SequenceNumber, p.Marker)
+	}
+	if !bytes.Equal(p.Payload[160:], repacketizerPacket(0, 8160, 20).Payload) {
+		t.Error("expected the second packet's audio to follow the first")
+	}
+
+	r.Push(repacketizerPacket(102, 8320, 20), 8000, repacketizerPCMU, 40)
+	out = r.Push(repacketizerPacket(103, 8480, 20), 8000, repacketizerPCMU, 40)
+	if len(out) != 1 || out[0].SequenceNumber != 101 || out[0].Timestamp != 8320 || out[0].Marker {
+		t.Errorf("expected the next packet to continue the stream, got %+v", out)
+	}
+}
+
+func TestRepacketizer_Split(t *testing.T) {
+	r := &Repacketizer{}
+	out := r.Push(repacketizerPacket(7, 0, 60), 8000, repacketizerPCMU, 20)
+	if len(out) != 3 {
+		t.Fatalf("expected three 20 ms packets, got %d", len(out))
+	}
+	for i, p := range out {
+		if len(p.Payload) != 160 || p.Timestamp != uint32(i*160) || p.SequenceNumber != uint16(7+i) {
+			t.Errorf("packet %d: %d bytes, ts %d, seq %d", i, len(p.Payload), p.Timestamp, p.SequenceNumber)
+		}
+	}
+
+	// The next packet keeps numbering after the split ones
+	out = r.Push(repacketizerPacket(8, 480, 20), 8000, repacketizerPCMU, 20)
+	if len(out) != 1 || out[0].SequenceNumber != 10 {
+		t.Errorf("expected sequence number 10, got %+v", out)
+	}
+}
+
+func TestRepacketizer_LossAndPassthrough(t *testing.T) {
+	r := &Repacketizer{}
+	r.Push(repacketizerPacket(1, 0, 20), 8000, repacketizerPCMU, 40)
+
+	// A lost packet flushes the partial packet and leaves a sequence gap
+	out := r.Push(repacketizerPacket(3, 320, 20), 8000, repacketizerPCMU, 40)
+	if len(out) != 1 || len(out[0].Payload) != 160 || out[0].SequenceNumber != 1 {
+		t.Fatalf("expected the buffered 20 ms to be flushed, got %+v", out)
+	}
+	out = r.Push(repacketizerPacket(4, 480, 20), 8000, repacketizerPCMU, 40)
+	if len(out) != 1 || out[0].SequenceNumber != 3 || out[0].Timestamp != 320 {
+		t.Errorf("expected the loss to stay visible as a gap, got %+v", out)
+	}
+
+	// Late packets are dropped; telephone events keep their framing
+	if out := r.Push(repacketizerPacket(2, 160, 20), 8000, repacketizerPCMU, 40); out != nil {
+		t.Errorf("expected a late packet to be dropped, got %+v", out)
+	}
+	event := &RTPPacket{SequenceNumber: 5, Timestamp: 640, Payload: []byte{1, 0, 0, 160}}
+	out = r.Push(event, 8000, CodecInfo{PayloadType: 101, Name: "telephone-event", ClockRate: 8000}, 40)
+	if len(out) != 1 || len(out[0].Payload) != 4 || out[0].SequenceNumber != 4 {
+		t.Errorf("expected the event to pass through, got %+v", out)
+	}
+}
+
+func TestRepacketizer_AMRAndClockRates(t *testing.T) {
+	format := &AMRFormat{OctetAligned: true}
+	amr := CodecInfo{PayloadType: 97, Name: "AMR", ClockRate: 8000, Fmtp: "octet-align=1"}
+	frame := AMRFrame{Type: AMRMode122, Quality: true, Data: make([]byte, 31)}
+	single := (&AMRPayload{CMR: AMRNoRequest, Frames: []AMRFrame{frame}}).Marshal(format)
+
+	// 20 ms AMR packets from a 16 kHz source leg
+	r := &Repacketizer{}
+	r.Push(&RTPPacket{SequenceNumber: 1, Timestamp: 32000, Payload: single}, 16000, amr, 40)
+	out := r.Push(&RTPPacket{SequenceNumber: 2, Timestamp: 32320, Payload: single}, 16000, amr, 40)
+	if len(out) != 1 {
+		t.Fatalf("expected one 40 ms packet, got %d", len(out))
+	}
+	if out[0].Timestamp != 16000 {
+		t.Errorf("expected the timestamp on the 8 kHz clock, got %d", out[0].Timestamp)
+	}
+	p, err := ParseAMRPayload(out[0].Payload, format)
+	if err != nil || len(p.Frames) != 2 {
+		t.Errorf("expected two AMR frames, got %+v (%v)", p, err)
+	}
+}
+
+func TestRepacketizer_CopiesHeldFrames(t *testing.T) {
+	r := &Repacketizer{}
+	first := repacketizerPacket(1, 0, 20)
+	want := append([]byte(nil), first.Payload...)
+	r.Push(first, 8000, repacketizerPCMU, 40)
+
+	// The caller reuses the buffer for the next packet
+	for i := range first.Payload {
+		first.Payload[i] = 0xFF
+	}
+	out := r.Push(repacketizerPacket(2, 160, 20), 8000, repacketizerPCMU, 40)
+	if len(out) != 1 || !bytes.Equal(out[0].Payload[:160], want) {
+		t.Error("expected buffered audio to survive the reuse of its packet buffer")
+	}
+}
+
+func TestRepacketizer_ContinuesAcrossSourcesAndClocks(t *testing.T) {
+	r := &Repacketizer{}
+	start := time.Now()
+	first := repacketizerPacket(100, 8000, 20)
+	first.Received = start
+	if out := r.Push(first, 8000, repacketizerPCMU, 20); len(out) != 1 || out[0].SequenceNumber != 100 {
+		t.Fatalf("unexpected first packet %+v", out)
+	}
+
+	// After a re-INVITE another source takes over 20 ms later
+	next := repacketizerPacket(5000, 123456, 20)
+	next.SSRC, next.Received = 2, start.Add(20*time.Millisecond)
+	out := r.Push(next, 8000, repacketizerPCMU, 20)
+	if len(out) != 1 || out[0].SequenceNumber != 101 || out[0].Timestamp != 8160 {
+		t.Fatalf("expected seq 101 at ts 8160, got %+v", out)
+	}
+	following := repacketizerPacket(5001, 123616, 20)
+	following.SSRC, following.Received = 2, start.Add(40*time.Millisecond)
+	if out := r.Push(following, 8000, repacketizerPCMU, 20); len(out) != 1 || out[0].SequenceNumber != 102 || out[0].Timestamp != 8320 {
+		t.Errorf("expected the new source to keep going, got %+v", out)
+	}
+
+	// and a transcoded 16 kHz source continues the 8 kHz output
+	wide := &RTPPacket{SSRC: 2, SequenceNumber: 5002, Timestamp: 900000, Payload: make([]byte, 160),
+		Received: start.Add(60 * time.Millisecond)}
+	if out := r.Push(wide, 16000, repacketizerPCMU, 20); len(out) != 1 || out[0].SequenceNumber != 103 || out[0].Timestamp != 8480 {
+		t.Errorf("expected the clock change to continue at ts 8480, got %+v", out)
+	}
+}
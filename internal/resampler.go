@@ -0,0 +1,194 @@
+package internal
+
+import (
+	"math"
+	"sync"
+)
+
+// resamplerZeroCrossings is the number of sinc lobes on each side of the
+// interpolation filter; more lobes give a steeper anti-aliasing cutoff
+const resamplerZeroCrossings = 8
+
+// resampleFilter is a windowed-sinc low-pass prototype for a rational rate
+// change of up/down, evaluated at the upsampled rate
+type resampleFilter struct {
+	up, down int
+	taps     []float64
+	delay    int // group delay in upsampled samples
+}
+
+var resampleFilters sync.Map // [from, to] -> *resampleFilter
+
+// getResampleFilter returns the cached filter for converting from -> to
+func getResampleFilter(from, to int) *resampleFilter {
+	key := [2]int{from, to}
+	if f, ok := resampleFilters.Load(key); ok {
+		return f.(*resampleFilter)
+	}
+
+	g := gcd(from, to)
+	up, down := to/g, from/g
+	factor := up
+	if down > factor {
+		factor = down
+	}
+
+	// Cut off just below the lower Nyquist frequency, normalized to the
+	// upsampled rate, and scale by up to keep unity gain after zero stuffing
+	cutoff := 0.5 / float64(factor) * 0.9
+	n := 2*resamplerZeroCrossings*factor + 1
+	center := float64(n-1) / 2
+	taps := make([]float64, n)
+	for k := range taps {
+		x := float64(k) - center
+		sinc := 2 * cutoff
+		if x != 0 {
+			sinc = math.Sin(2*math.Pi*cutoff*x) / (math.Pi * x)
+		}
+		// Blackman window
+		w := 0.42 - 0.5*math.Cos(2*math.Pi*float64(k)/float64(n-1)) +
+			0.08*math.Cos(4*math.Pi*float64(k)/float64(n-1))
+		taps[k] = float64(up) * sinc * w
+	}
+
+	f := &resampleFilter{up: up, down: down, taps: taps, delay: (n - 1) / 2}
+	actual, _ := resampleFilters.LoadOrStore(key, f)
+	return actual.(*resampleFilter)
+}
+
+// resamplePCM converts mono PCM between sample rates with a polyphase
+// windowed-sinc filter. The filter delay is compensated and the frame edges
+// are extended, so each frame can be converted on its own
+func resamplePCM(samples []int16, from, to int) []int16 {
+	if from == to || from <= 0 || to <= 0 || len(samples) == 0 {
+		return samples
+	}
+
+	f := getResampleFilter(from, to)
+	out := make([]int16, len(samples)*to/from)
+	last := len(samples) - 1
+	for n := range out {
+		// Output n sits at t in the upsampled signal; only every up-th
+		// upsampled sample is non-zero, so walk the input samples directly
+		t := n*f.down + f.delay
+		first := t - len(f.taps) + 1
+		i := first / f.up
+		if first > 0 && first%f.up != 0 {
+			i++
+		} else if first < 0 {
+			i = -((-first) / f.up)
+		}
+
+		var acc float64
+		for ; i*f.up <= t; i++ {
+			idx := i
+			if idx < 0 {
+				idx = 0
+			} else if idx > last {
+				idx = last
+			}
+			acc += f.taps[t-i*f.up] * float64(samples[idx])
+		}
+		out[n] = clampSample(math.Round(acc))
+	}
+	return out
+}
+
+// resampler converts the PCM of one stream between two sample rates frame
+// by frame with the filter of resamplePCM. It keeps the last input samples
+// across frames, so the filter runs over the frame edges as it would over
+// the whole stream, at the cost of a constant delay of half its length,
+// about a millisecond. A frame of n samples gives n*to/from samples when
+// the rates divide it, as codec frames do
+type resampler struct {
+	filter  *resampleFilter
+	history []int16 // last input samples, oldest first
+	next    int     // position of the next output in the upsampled signal, from the next frame's first sample
+}
+
+// newResampler creates a resampler for a stream converted from -> to
+func newResampler(from, to int) *resampler {
+	f := getResampleFilter(from, to)
+	return &resampler{
+		filter:  f,
+		history: make([]int16, (len(f.taps)+f.up-1)/f.up),
+	}
+}
+
+// resample converts the stream's next frame
+func (r *resampler) resample(samples []int16) []int16 {
+	f := r.filter
+	if len(samples) == 0 {
+		return samples
+	}
+
+	// Input i of the frame sits at i*up in the upsampled signal; outputs
+	// are taken every down samples up to the frame's last input
+	end := len(samples) * f.up
+	out := make([]int16, 0, (end-r.next+f.down-1)/f.down)
+	for t := r.next; t < end; t += f.down {
+		first := t - len(f.taps) + 1
+		i := -len(r.history)
+		if first > i*f.up {
+			i = (first + f.up - 1 + len(r.history)*f.up) / f.up
+			i -= len(r.history)
+		}
+
+		var acc float64
+		for ; i*f.up <= t; i++ {
+			var sample int16
+			if i < 0 {
+				sample = r.history[len(r.history)+i]
+			} else {
+				sample = samples[i]
+			}
+			acc += f.taps[t-i*f.up] * float64(sample)
+		}
+		out = append(out, clampSample(math.Round(acc)))
+		r.next = t + f.down
+	}
+	r.next -= end
+
+	if len(samples) >= len(r.history) {
+		copy(r.history, samples[len(samples)-len(r.history):])
+	} else {
+		copy(r.history, r.history[len(samples):])
+		copy(r.history[len(r.history)-len(samples):], samples)
+	}
+	return out
+}
+
+// rtpClock maps RTP timestamps from an input codec's clock onto an output
+// codec's clock, following the input's increments so the mapping survives
+// wraparound
+type rtpClock struct {
+	inputRate  int
+	outputRate int
+	mapped     bool
+	lastIn     uint32 // last input timestamp mapped to the output clock
+	lastOut    uint32
+}
+
+// convert returns the output timestamp for an input timestamp
+func (c *rtpClock) convert(ts uint32) uint32 {
+	if c.inputRate == 0 || c.outputRate == 0 || c.inputRate == c.outputRate {
+		return ts
+	}
+	if !c.mapped {
+		c.mapped = true
+		c.lastIn = ts
+		c.lastOut = uint32(uint64(ts) * uint64(c.outputRate) / uint64(c.inputRate))
+		return c.lastOut
+	}
+	delta := int64(int32(ts - c.lastIn))
+	c.lastIn = ts
+	c.lastOut += uint32(delta * int64(c.outputRate) / int64(c.inputRate))
+	return c.lastOut
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
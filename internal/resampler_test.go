@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"math"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func resamplerTone(freq float64, rate, n int) []int16 {
+	samples := make([]int16, n)
+	for i := range samples {
+		samples[i] = int16(10000 * math.Sin(2*math.Pi*freq*float64(i)/float64(rate)))
+	}
+	return samples
+}
+
+// zeroCrossings counts sign changes, ignoring the filter edges
+func zeroCrossings(samples []int16) int {
+	count := 0
+	for i := 1; i < len(samples); i++ {
+		if (samples[i-1] < 0) != (samples[i] < 0) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestResamplePCM_PreservesPitch(t *testing.T) {
+	// 20 ms of 1 kHz has 40 zero crossings at any rate
+	up := resamplePCM(resamplerTone(1000, 8000, 160), 8000, 48000)
+	if len(up) != 960 {
+		t.Fatalf("expected 960 samples, got %d", len(up))
+	}
+	if n := zeroCrossings(up); n < 38 || n > 41 {
+		t.Errorf("expected about 40 zero crossings after upsampling, got %d", n)
+	}
+
+	down := resamplePCM(resamplerTone(1000, 48000, 960), 48000, 8000)
+	if len(down) != 160 {
+		t.Fatalf("expected 160 samples, got %d", len(down))
+	}
+	if n := zeroCrossings(down); n < 38 || n > 41 {
+		t.Errorf("expected about 40 zero crossings after downsampling, got %d", n)
+	}
+	if level := noiseLevel(down[20:140]); level > 14 {
+		t.Errorf("expected the passband tone to keep its level, got -%d dBov", level)
+	}
+}
+
+func TestResamplePCM_RejectsAliases(t *testing.T) {
+	// 6 kHz is above the 4 kHz Nyquist limit of 8 kHz and must not fold
+	// back to 2 kHz
+	down := resamplePCM(resamplerTone(6000, 48000, 960), 48000, 8000)
+	if level := noiseLevel(down[20:140]); level < 50 {
+		t.Errorf("expected the out-of-band tone to be filtered, got -%d dBov", level)
+	}
+}
+
+func TestResampler_ContinuousAcrossFrames(t *testing.T) {
+	for _, rates := range [][2]int{{8000, 48000}, {48000, 8000}} {
+		from, to := rates[0], rates[1]
+		tone := resamplerTone(1000, from, from/10)
+		whole := resamplePCM(tone, from, to)
+
+		// Converted 20 ms at a time, the stream matches the whole signal
+		// converted at once, behind it by the filter's delay
+		r := newResampler(from, to)
+		frame := from / 50
+		var streamed []int16
+		for i := 0; i < len(tone); i += frame {
+			out := r.resample(tone[i : i+frame])
+			if len(out) != frame*to/from {
+				t.Fatalf("%d->%d: expected %d samples per frame, got %d", from, to, frame*to/from, len(out))
+			}
+			streamed = append(streamed, out...)
+		}
+
+		lag := r.filter.delay / r.filter.down
+		for n := len(whole) / 10; n < len(whole)-lag; n++ {
+			if diff := int(streamed[n+lag]) - int(whole[n]); diff < -1 || diff > 1 {
+				t.Fatalf("%d->%d: sample %d is %d, want %d", from, to, n, streamed[n+lag], whole[n])
+			}
+		}
+	}
+}
+
+func TestTranscodeAudio_OpusAndG711(t *testing.T) {
+	pcmu := encodeG711("PCMU", resamplerTone(440, 8000, 160))
+	opus, err := TranscodeAudio(pcmu, webrtc.MimeTypePCMU, webrtc.MimeTypeOpus)
+	if err != nil {
+		t.Fatalf("PCMU to Opus failed: %v", err)
+	}
+
+	back, err := TranscodeAudio(opus, webrtc.MimeTypeOpus, webrtc.MimeTypePCMA)
+	if err != nil {
+		t.Fatalf("Opus to PCMA failed: %v", err)
+	}
+	if len(back) != 160 {
+		t.Errorf("expected a 20 ms frame at 8 kHz, got %d samples", len(back))
+	}
+
+	if out, _ := TranscodeAudio(pcmu, webrtc.MimeTypePCMU, webrtc.MimeTypePCMU); &out[0] != &pcmu[0] {
+		t.Error("expected the same codec to pass through")
+	}
+}
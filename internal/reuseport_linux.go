@@ -0,0 +1,21 @@
+//go:build linux
+
+package internal
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// reusePortControl sets SO_REUSEPORT before a socket is bound, so several
+// sockets can share a port and the kernel spreads flows across them
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var optErr error
+	if err := c.Control(func(fd uintptr) {
+		optErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	}); err != nil {
+		return err
+	}
+	return optErr
+}
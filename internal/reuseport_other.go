@@ -0,0 +1,14 @@
+//go:build !linux
+
+package internal
+
+import (
+	"errors"
+	"syscall"
+)
+
+// reusePortControl fails outside Linux, where SO_REUSEPORT does not spread
+// flows across the sockets sharing a port
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT sharding is only supported on Linux")
+}
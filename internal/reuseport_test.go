@@ -0,0 +1,85 @@
+package internal
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestRTPControl_ReusePortShards(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_REUSEPORT sharding needs Linux")
+	}
+	control, err := NewRTPControl(nil, nil)
+	if err != nil {
+		t.Fatalf("NewRTPControl failed: %v", err)
+	}
+	defer control.Stop()
+	control.SetBatchConfig(BatchConfig{Size: 8})
+	control.SetReusePortShards(4)
+	forwardThroughPool(t, control)
+
+	sink, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	if err := control.AddDestination(sink.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if err := control.StartRTPListener("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(control.udpConns) != 4 {
+		t.Fatalf("expected 4 sockets, got %d", len(control.udpConns))
+	}
+	port := control.udpConn.LocalAddr().(*net.UDPAddr).Port
+	for i, conn := range control.udpConns {
+		if got := conn.LocalAddr().(*net.UDPAddr).Port; got != port {
+			t.Errorf("socket %d: expected port %d, got %d", i, port, got)
+		}
+	}
+
+	// Senders on different source ports are spread over the sockets; each
+	// sender's packets must still arrive in order
+	const senders, perSender = 16, 4
+	for s := 0; s < senders; s++ {
+		sender, err := net.DialUDP("udp4", nil, control.udpConn.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sender.Close()
+		for i := 0; i < perSender; i++ {
+			packet := make([]byte, 172)
+			packet[0], packet[3], packet[11] = 0x80, byte(i), byte(s)
+			sender.Write(packet)
+		}
+	}
+
+	next := make(map[byte]byte)
+	sink.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	for i := 0; i < senders*perSender; i++ {
+		if _, _, err := sink.ReadFromUDP(buf); err != nil {
+			t.Fatalf("expected %d forwarded packets, got %d: %v", senders*perSender, i, err)
+		}
+		ssrc, seq := buf[11], buf[3]
+		if seq != next[ssrc] {
+			t.Errorf("sender %d: expected sequence %d, got %d", ssrc, next[ssrc], seq)
+		}
+		next[ssrc] = seq + 1
+	}
+}
+
+func TestRTPControl_ReusePortShardsDefault(t *testing.T) {
+	control, err := NewRTPControl(nil, nil)
+	if err != nil {
+		t.Fatalf("NewRTPControl failed: %v", err)
+	}
+	control.SetReusePortShards(0)
+	if control.shards != runtime.NumCPU() {
+		t.Errorf("expected one shard per CPU (%d), got %d", runtime.NumCPU(), control.shards)
+	}
+}
@@ -0,0 +1,267 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// RTCP demuxer metrics
+var (
+	rtcpDemuxPackets = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "karl_rtcp_demux_packets_total",
+			Help: "Total RTCP packets parsed on the receive path by type",
+		},
+		[]string{"type"},
+	)
+
+	rtcpDemuxErrors = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "karl_rtcp_demux_errors_total",
+			Help: "Total RTCP packets that failed to parse",
+		},
+	)
+)
+
+// RTCPDemuxer parses RTCP arriving on the media sockets and feeds the
+// resulting loss, jitter and RTT into the feedback handlers and metrics
+type RTCPDemuxer struct {
+	stats *ReceiveStatsTracker
+
+	// Optional hooks for feedback that requires media-plane action
+	onNACK func(mediaSSRC uint32, lost []uint16)
+	onPLI  func(mediaSSRC uint32)
+	onFIR  func(mediaSSRC uint32)
+	onBye  func(ssrc uint32, reason string)
+
+	cnames      map[uint32]string
+	voipMetrics map[uint32]VoIPMetrics // XR reports by the source they describe
+	mu          sync.RWMutex
+}
+
+// NewRTCPDemuxer creates a demuxer that records SR timing in the given tracker
+func NewRTCPDemuxer(stats *ReceiveStatsTracker) *RTCPDemuxer {
+	return &RTCPDemuxer{
+		stats:       stats,
+		cnames:      make(map[uint32]string),
+		voipMetrics: make(map[uint32]VoIPMetrics),
+	}
+}
+
+// defaultRTCPDemuxer handles RTCP seen by the worker pool and RTP listeners
+var defaultRTCPDemuxer = NewRTCPDemuxer(receiveStats)
+
+// GetRTCPDemuxer returns the process-wide RTCP demuxer
+func GetRTCPDemuxer() *RTCPDemuxer {
+	return defaultRTCPDemuxer
+}
+
+// SetNACKHandler sets the callback for Generic NACK feedback
+func (d *RTCPDemuxer) SetNACKHandler(handler func(mediaSSRC uint32, lost []uint16)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.onNACK = handler
+}
+
+// SetPLIHandler sets the callback for Picture Loss Indication feedback
+func (d *RTCPDemuxer) SetPLIHandler(handler func(mediaSSRC uint32)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.onPLI = handler
+}
+
+// SetFIRHandler sets the callback for Full Intra Request feedback, called
+// once for each stream the request names
+func (d *RTCPDemuxer) SetFIRHandler(handler func(mediaSSRC uint32)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.onFIR = handler
+}
+
+// SetByeHandler sets the callback for RTCP BYE
+func (d *RTCPDemuxer) SetByeHandler(handler func(ssrc uint32, reason string)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.onBye = handler
+}
+
+// GetCNAME returns the CNAME announced by a source in SDES
+func (d *RTCPDemuxer) GetCNAME(ssrc uint32) (string, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	cname, ok := d.cnames[ssrc]
+	return cname, ok
+}
+
+// HandlePacket parses a compound RTCP packet and dispatches each part
+func (d *RTCPDemuxer) HandlePacket(data []byte) error {
+	if !IsRTCPPacket(data) {
+		return fmt.Errorf("not an RTCP packet")
+	}
+
+	packets, err := rtcp.Unmarshal(data)
+	if err != nil {
+		rtcpDemuxErrors.Inc()
+		return fmt.Errorf("failed to parse RTCP: %w", err)
+	}
+
+	IncrementRTCPRecv()
+	now := time.Now()
+
+	for _, pkt := range packets {
+		switch p := pkt.(type) {
+		case *rtcp.SenderReport:
+			rtcpDemuxPackets.WithLabelValues("sr").Inc()
+			d.stats.RecordSenderReport(p.SSRC, p.NTPTime, now)
+			d.handleReceptionReports(p.Reports, now)
+
+		case *rtcp.ReceiverReport:
+			rtcpDemuxPackets.WithLabelValues("rr").Inc()
+			d.handleReceptionReports(p.Reports, now)
+
+		case *rtcp.SourceDescription:
+			rtcpDemuxPackets.WithLabelValues("sdes").Inc()
+			d.handleSourceDescription(p)
+
+		case *rtcp.Goodbye:
+			rtcpDemuxPackets.WithLabelValues("bye").Inc()
+			d.handleGoodbye(p)
+
+		case *rtcp.TransportLayerNack:
+			rtcpDemuxPackets.WithLabelValues("nack").Inc()
+			d.handleNACK(p)
+
+		case *rtcp.ExtendedReport:
+			rtcpDemuxPackets.WithLabelValues("xr").Inc()
+			d.handleExtendedReport(p, now)
+
+		case *rtcp.PictureLossIndication:
+			rtcpDemuxPackets.WithLabelValues("pli").Inc()
+			d.mu.RLock()
+			onPLI := d.onPLI
+			d.mu.RUnlock()
+			if onPLI != nil {
+				onPLI(p.MediaSSRC)
+			}
+
+		case *rtcp.FullIntraRequest:
+			rtcpDemuxPackets.WithLabelValues("fir").Inc()
+			d.mu.RLock()
+			onFIR := d.onFIR
+			d.mu.RUnlock()
+			if onFIR != nil {
+				for _, entry := range p.FIR {
+					onFIR(entry.SSRC)
+				}
+			}
+
+		default:
+			rtcpDemuxPackets.WithLabelValues("other").Inc()
+		}
+	}
+
+	return nil
+}
+
+// handleReceptionReports converts report blocks into feedback for each reported source
+func (d *RTCPDemuxer) handleReceptionReports(reports []rtcp.ReceptionReport, now time.Time) {
+	for _, report := range reports {
+		lossPercent := float64(report.FractionLost) / 256.0 * 100
+
+		clockRate := uint32(defaultStatsClockRate)
+		if stats, ok := d.stats.Get(report.SSRC); ok && stats.clockRate > 0 {
+			clockRate = stats.clockRate
+		}
+		jitterMs := float64(report.Jitter) / float64(clockRate) * 1000
+
+		var rttMs float64
+		if rtt, ok := rttFromReceptionReport(report, now); ok {
+			rttMs = float64(rtt) / float64(time.Millisecond)
+			rtcpRTTSeconds.Observe(rtt.Seconds())
+		}
+
+		rtcpPacketLoss.Observe(float64(report.FractionLost) / 256.0)
+		rtcpJitterSeconds.Observe(jitterMs / 1000)
+
+		GetRTCPFeedbackHandler(report.SSRC).HandleFeedback(lossPercent, jitterMs, rttMs)
+		SetPacketLoss(lossPercent)
+		SetJitter(jitterMs)
+	}
+}
+
+// handleSourceDescription records CNAMEs announced by remote sources
+func (d *RTCPDemuxer) handleSourceDescription(sdes *rtcp.SourceDescription) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, chunk := range sdes.Chunks {
+		for _, item := range chunk.Items {
+			if item.Type == rtcp.SDESCNAME {
+				d.cnames[chunk.Source] = item.Text
+			}
+		}
+	}
+}
+
+// handleGoodbye drops state for sources that left the session
+func (d *RTCPDemuxer) handleGoodbye(bye *rtcp.Goodbye) {
+	d.mu.Lock()
+	for _, ssrc := range bye.Sources {
+		delete(d.cnames, ssrc)
+		delete(d.voipMetrics, ssrc)
+	}
+	onBye := d.onBye
+	d.mu.Unlock()
+
+	for _, ssrc := range bye.Sources {
+		d.stats.Remove(ssrc)
+		RemoveRTCPFeedbackHandler(ssrc)
+		if onBye != nil {
+			onBye(ssrc, bye.Reason)
+		}
+		if IsDebugLoggingEnabled() {
+			log.Printf("RTCP BYE received from SSRC %d, reason: %s", ssrc, bye.Reason)
+		}
+	}
+}
+
+// handleNACK expands Generic NACK pairs into the list of lost sequence numbers
+func (d *RTCPDemuxer) handleNACK(nack *rtcp.TransportLayerNack) {
+	d.mu.RLock()
+	onNACK := d.onNACK
+	d.mu.RUnlock()
+
+	if onNACK == nil {
+		return
+	}
+
+	var lost []uint16
+	for _, pair := range nack.Nacks {
+		lost = append(lost, pair.PacketList()...)
+	}
+	onNACK(nack.MediaSSRC, lost)
+}
+
+// rttFromReceptionReport computes round-trip time from the LSR and DLSR
+// fields of a report block (RFC 3550 Section 6.4.1)
+func rttFromReceptionReport(report rtcp.ReceptionReport, now time.Time) (time.Duration, bool) {
+	if report.LastSenderReport == 0 {
+		return 0, false
+	}
+
+	// All values are in the compact NTP format (1/65536 seconds); modular
+	// arithmetic handles the 18-hour wrap of the middle 32 NTP bits
+	compactNow := uint32(toNTPTime(now) >> 16)
+	rtt := compactNow - report.LastSenderReport - report.Delay
+	if rtt > 1<<31 {
+		return 0, false
+	}
+
+	return time.Duration(rtt) * time.Second / 65536, true
+}
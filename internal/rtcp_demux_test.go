@@ -0,0 +1,166 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+func marshalRTCP(t *testing.T, packets ...rtcp.Packet) []byte {
+	t.Helper()
+	data, err := rtcp.Marshal(packets)
+	if err != nil {
+		t.Fatalf("failed to marshal RTCP: %v", err)
+	}
+	return data
+}
+
+func TestRTCPDemuxer_ReceiverReportFeedsHandler(t *testing.T) {
+	demuxer := NewRTCPDemuxer(NewReceiveStatsTracker())
+	const ssrc = 0xD0001
+	defer RemoveRTCPFeedbackHandler(ssrc)
+
+	rr := &rtcp.ReceiverReport{
+		SSRC: 0x1,
+		Reports: []rtcp.ReceptionReport{{
+			SSRC:         ssrc,
+			FractionLost: 64,  // 25%
+			Jitter:       160, // 20ms at 8kHz
+		}},
+	}
+	if err := demuxer.HandlePacket(marshalRTCP(t, rr)); err != nil {
+		t.Fatalf("HandlePacket failed: %v", err)
+	}
+
+	loss, jitter, _, _ := GetRTCPFeedbackHandler(ssrc).GetFeedback()
+	if loss != 25 {
+		t.Errorf("expected 25%% loss, got %f", loss)
+	}
+	if jitter != 20 {
+		t.Errorf("expected 20ms jitter, got %f", jitter)
+	}
+}
+
+func TestRTTFromReceptionReport(t *testing.T) {
+	now := time.Now()
+	srSent := now.Add(-300 * time.Millisecond)
+
+	report := rtcp.ReceptionReport{
+		LastSenderReport: uint32(toNTPTime(srSent) >> 16),
+		Delay:            65536 / 10, // 100ms held by the receiver
+	}
+
+	rtt, ok := rttFromReceptionReport(report, now)
+	if !ok {
+		t.Fatal("expected RTT to be computed")
+	}
+	if rtt < 190*time.Millisecond || rtt > 210*time.Millisecond {
+		t.Errorf("expected RTT around 200ms, got %v", rtt)
+	}
+
+	if _, ok := rttFromReceptionReport(rtcp.ReceptionReport{}, now); ok {
+		t.Error("expected no RTT without LSR")
+	}
+}
+
+func TestRTCPDemuxer_SenderReportRecordsLSR(t *testing.T) {
+	tracker := NewReceiveStatsTracker()
+	demuxer := NewRTCPDemuxer(tracker)
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		tracker.Update(0xAB, uint16(i), uint32(i)*160, 8000, start.Add(time.Duration(i)*20*time.Millisecond))
+	}
+
+	ntp := toNTPTime(start)
+	sr := &rtcp.SenderReport{SSRC: 0xAB, NTPTime: ntp}
+	if err := demuxer.HandlePacket(marshalRTCP(t, sr)); err != nil {
+		t.Fatalf("HandlePacket failed: %v", err)
+	}
+
+	stats, _ := tracker.Get(0xAB)
+	report := stats.ReceptionReport(time.Now())
+	if report.LastSenderReport != uint32(ntp>>16) {
+		t.Errorf("expected LSR %d, got %d", uint32(ntp>>16), report.LastSenderReport)
+	}
+}
+
+func TestRTCPDemuxer_NACKAndPLI(t *testing.T) {
+	demuxer := NewRTCPDemuxer(NewReceiveStatsTracker())
+
+	var nackSSRC uint32
+	var lost []uint16
+	demuxer.SetNACKHandler(func(mediaSSRC uint32, seqs []uint16) {
+		nackSSRC = mediaSSRC
+		lost = seqs
+	})
+	var pliSSRC uint32
+	demuxer.SetPLIHandler(func(mediaSSRC uint32) {
+		pliSSRC = mediaSSRC
+	})
+
+	nack := &rtcp.TransportLayerNack{
+		SenderSSRC: 1,
+		MediaSSRC:  0x55,
+		Nacks:      []rtcp.NackPair{{PacketID: 100, LostPackets: 0x5}}, // 100, 101, 103
+	}
+	pli := &rtcp.PictureLossIndication{SenderSSRC: 1, MediaSSRC: 0x66}
+	if err := demuxer.HandlePacket(marshalRTCP(t, nack, pli)); err != nil {
+		t.Fatalf("HandlePacket failed: %v", err)
+	}
+
+	if nackSSRC != 0x55 {
+		t.Errorf("expected NACK for SSRC 0x55, got 0x%X", nackSSRC)
+	}
+	if len(lost) != 3 || lost[0] != 100 || lost[1] != 101 || lost[2] != 103 {
+		t.Errorf("expected lost packets [100 101 103], got %v", lost)
+	}
+	if pliSSRC != 0x66 {
+		t.Errorf("expected PLI for SSRC 0x66, got 0x%X", pliSSRC)
+	}
+}
+
+func TestRTCPDemuxer_SDESAndBye(t *testing.T) {
+	tracker := NewReceiveStatsTracker()
+	demuxer := NewRTCPDemuxer(tracker)
+	tracker.Update(0x77, 1, 160, 8000, time.Now())
+
+	sdes := &rtcp.SourceDescription{Chunks: []rtcp.SourceDescriptionChunk{{
+		Source: 0x77,
+		Items:  []rtcp.SourceDescriptionItem{{Type: rtcp.SDESCNAME, Text: "alice@example.com"}},
+	}}}
+	if err := demuxer.HandlePacket(marshalRTCP(t, sdes)); err != nil {
+		t.Fatalf("HandlePacket failed: %v", err)
+	}
+	if cname, ok := demuxer.GetCNAME(0x77); !ok || cname != "alice@example.com" {
+		t.Errorf("expected CNAME alice@example.com, got %q", cname)
+	}
+
+	var byeSSRC uint32
+	demuxer.SetByeHandler(func(ssrc uint32, reason string) {
+		byeSSRC = ssrc
+	})
+	bye := &rtcp.Goodbye{Sources: []uint32{0x77}, Reason: "hangup"}
+	if err := demuxer.HandlePacket(marshalRTCP(t, bye)); err != nil {
+		t.Fatalf("HandlePacket failed: %v", err)
+	}
+
+	if byeSSRC != 0x77 {
+		t.Errorf("expected BYE callback for 0x77, got 0x%X", byeSSRC)
+	}
+	if _, ok := tracker.Get(0x77); ok {
+		t.Error("expected receive stats to be dropped after BYE")
+	}
+	if _, ok := demuxer.GetCNAME(0x77); ok {
+		t.Error("expected CNAME to be dropped after BYE")
+	}
+}
+
+func TestRTCPDemuxer_RejectsRTP(t *testing.T) {
+	demuxer := NewRTCPDemuxer(NewReceiveStatsTracker())
+	rtpPacket := []byte{0x80, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0, 0, 1}
+	if err := demuxer.HandlePacket(rtpPacket); err == nil {
+		t.Error("expected error for RTP packet")
+	}
+}
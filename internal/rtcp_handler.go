@@ -1,6 +1,8 @@
 package internal
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/binary"
 	"log"
 	"math/rand"
@@ -29,6 +31,13 @@ var (
 		},
 	)
 
+	rtcpXRSent = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "karl_rtcp_xr_sent_total",
+			Help: "Total number of RTCP XR VoIP metrics reports sent",
+		},
+	)
+
 	rtcpSRRecv = promauto.NewCounter(
 		prometheus.CounterOpts{
 			Name: "karl_rtcp_sr_received_total",
@@ -70,10 +79,23 @@ var (
 
 // RTCPInternalConfig holds RTCP runtime configuration with time.Duration types
 type RTCPInternalConfig struct {
-	Enabled     bool
-	Interval    time.Duration
-	ReducedSize bool
-	MuxEnabled  bool
+	Enabled         bool
+	Interval        time.Duration
+	ReducedSize     bool
+	MuxEnabled      bool
+	ExtendedReports bool
+
+	// CNAME is carried in the SDES chunk of every report. Defaults to one
+	// derived from the host's node ID
+	CNAME string
+}
+
+// InstanceCNAME derives the RTCP CNAME of a Karl instance from a stable
+// identifier such as its node ID. It keeps the same value across restarts
+// without exposing the identifier itself (RFC 7022)
+func InstanceCNAME(instanceID string) string {
+	sum := sha256.Sum256([]byte(instanceID))
+	return "karl-" + base64.RawURLEncoding.EncodeToString(sum[:12])
 }
 
 // ToRTCPInternalConfig converts RTCPConfig (int seconds) to RTCPInternalConfig (time.Duration)
@@ -85,10 +107,11 @@ func ToRTCPInternalConfig(cfg *RTCPConfig) *RTCPInternalConfig {
 		}
 	}
 	return &RTCPInternalConfig{
-		Enabled:     cfg.Enabled,
-		Interval:    time.Duration(cfg.Interval) * time.Second,
-		ReducedSize: cfg.ReducedSize,
-		MuxEnabled:  cfg.MuxEnabled,
+		Enabled:         cfg.Enabled,
+		Interval:        time.Duration(cfg.Interval) * time.Second,
+		ReducedSize:     cfg.ReducedSize,
+		MuxEnabled:      cfg.MuxEnabled,
+		ExtendedReports: cfg.ExtendedReports,
 	}
 }
 
@@ -100,23 +123,26 @@ type RTCPSessionHandler struct {
 	remoteAddr    *net.UDPAddr
 	clockRate     uint32
 
+	// send replaces conn for reports written through another socket
+	send func(packet []byte, addr *net.UDPAddr) error
+
 	// Sender state
 	packetsSent   uint32
 	octetsSent    uint32
 	lastSRNTP     uint64
+
+	// RTP timestamp of the last packet sent and when, to extrapolate the
+	// RTP time of a report; zero until known
+	lastRTPTime   uint32
+	lastRTPSentAt time.Time
+	rtpClockRate  uint32
 	lastSRTime    time.Time
 
-	// Receiver state
-	packetsRecv     uint32
-	packetsLost     int32
-	lastSeq         uint16
-	highestSeq      uint16
-	seqCycles       uint32
-	jitter          float64
-	lastSRRecvNTP   uint64
-	lastSRRecvTime  time.Time
-	lastArrivalTime time.Time
-	lastTimestamp   uint32
+	// Receiver state for the remote source (RFC 3550 Appendix A)
+	recv *ReceiveStats
+
+	// extendedReports adds an RTCP XR VoIP metrics block to each report
+	extendedReports bool
 
 	// Calculated metrics
 	rtt           time.Duration
@@ -130,6 +156,13 @@ type RTCPHandler struct {
 	config       *RTCPInternalConfig
 	sessions     map[string]*RTCPSessionHandler
 	mu           sync.RWMutex
+
+	// Call legs reported on from the session registry
+	registry     *SessionRegistry
+	legSender    func(conn *net.UDPConn, packet []byte, addr *net.UDPAddr, mux bool) error
+	legs         map[string]*RTCPSessionHandler
+	cname        string
+
 	stopChan     chan struct{}
 	wg           sync.WaitGroup
 	running      bool
@@ -146,10 +179,16 @@ func NewRTCPHandler(config *RTCPInternalConfig) *RTCPHandler {
 	if config.Interval == 0 {
 		config.Interval = 5 * time.Second
 	}
+	cname := config.CNAME
+	if cname == "" {
+		cname = InstanceCNAME(DefaultHANodeID())
+	}
 
 	return &RTCPHandler{
 		config:   config,
 		sessions: make(map[string]*RTCPSessionHandler),
+		legs:     make(map[string]*RTCPSessionHandler),
+		cname:    cname,
 		stopChan: make(chan struct{}),
 	}
 }
@@ -165,6 +204,7 @@ func NewRTCPSessionHandler(ssrc uint32, cname string, clockRate uint32) *RTCPSes
 		ssrc:      ssrc,
 		cname:     cname,
 		clockRate: clockRate,
+		recv:      NewReceiveStats(0, clockRate),
 	}
 }
 
@@ -202,6 +242,8 @@ func (h *RTCPHandler) Stop() {
 
 // AddSession adds a session to the RTCP handler
 func (h *RTCPHandler) AddSession(sessionID string, handler *RTCPSessionHandler) {
+	handler.SetExtendedReports(h.config.ExtendedReports)
+
 	h.mu.Lock()
 	defer h.mu.Unlock()
 	h.sessions[sessionID] = handler
@@ -247,7 +289,7 @@ func (h *RTCPHandler) reportLoop() {
 // calculateInterval calculates RTCP report interval per RFC 3550 Section 6.2
 func (h *RTCPHandler) calculateInterval() time.Duration {
 	h.mu.RLock()
-	numSessions := len(h.sessions)
+	numSessions := len(h.sessions) + len(h.legs)
 	h.mu.RUnlock()
 
 	// Base interval
@@ -275,11 +317,16 @@ func (h *RTCPHandler) calculateInterval() time.Duration {
 
 // sendReports sends RTCP reports for all sessions
 func (h *RTCPHandler) sendReports() {
+	h.syncLegs()
+
 	h.mu.RLock()
-	sessions := make([]*RTCPSessionHandler, 0, len(h.sessions))
+	sessions := make([]*RTCPSessionHandler, 0, len(h.sessions)+len(h.legs))
 	for _, s := range h.sessions {
 		sessions = append(sessions, s)
 	}
+	for _, s := range h.legs {
+		sessions = append(sessions, s)
+	}
 	h.mu.RUnlock()
 
 	for _, session := range sessions {
@@ -297,6 +344,23 @@ func (s *RTCPSessionHandler) SetConnection(conn *net.UDPConn, remoteAddr *net.UD
 	s.remoteAddr = remoteAddr
 }
 
+// SetSender sends the session's reports through send instead of a connection
+func (s *RTCPSessionHandler) SetSender(send func(packet []byte, addr *net.UDPAddr) error, remoteAddr *net.UDPAddr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.send = send
+	s.remoteAddr = remoteAddr
+}
+
+// write sends a marshalled packet to the remote address; the caller holds s.mu
+func (s *RTCPSessionHandler) write(data []byte) error {
+	if s.send != nil {
+		return s.send(data, s.remoteAddr)
+	}
+	_, err := s.conn.WriteToUDP(data, s.remoteAddr)
+	return err
+}
+
 // UpdateSenderStats updates sender statistics
 func (s *RTCPSessionHandler) UpdateSenderStats(packetsSent, octetsSent uint32) {
 	s.mu.Lock()
@@ -305,58 +369,34 @@ func (s *RTCPSessionHandler) UpdateSenderStats(packetsSent, octetsSent uint32) {
 	s.octetsSent = octetsSent
 }
 
-// UpdateReceiverStats updates receiver statistics from an RTP packet
-func (s *RTCPSessionHandler) UpdateReceiverStats(seq uint16, timestamp uint32, arrivalTime time.Time) {
+// UpdateSenderClock records the RTP timestamp of the last packet sent, when
+// it was sent and the clock rate of its codec, so reports carry an RTP time
+// on the same timeline as the stream
+func (s *RTCPSessionHandler) UpdateSenderClock(timestamp uint32, sentAt time.Time, clockRate uint32) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.lastRTPTime = timestamp
+	s.lastRTPSentAt = sentAt
+	s.rtpClockRate = clockRate
+}
 
-	// Update sequence number tracking
-	if s.packetsRecv == 0 {
-		s.highestSeq = seq
-		s.lastSeq = seq
-	} else {
-		// Check for sequence wrap
-		diff := int32(seq) - int32(s.highestSeq)
-		if diff > 0 {
-			// Normal increment
-			s.highestSeq = seq
-		} else if diff < -32768 {
-			// Sequence number wrapped
-			s.seqCycles++
-			s.highestSeq = seq
-		}
-
-		// Calculate expected packets
-		expectedSeq := s.highestSeq + uint16(s.seqCycles*65536)
-		expected := int32(expectedSeq) - int32(s.lastSeq) + 1
-		received := int32(s.packetsRecv) + 1
-		s.packetsLost = expected - received
-		if s.packetsLost < 0 {
-			s.packetsLost = 0
-		}
-	}
-
-	s.packetsRecv++
-
-	// Calculate jitter per RFC 3550 Appendix A.8
-	if s.lastArrivalTime.IsZero() {
-		s.lastArrivalTime = arrivalTime
-		s.lastTimestamp = timestamp
-	} else {
-		// Calculate transit time difference
-		arrivalDiff := arrivalTime.Sub(s.lastArrivalTime).Seconds() * float64(s.clockRate)
-		timestampDiff := float64(int32(timestamp - s.lastTimestamp))
-		d := arrivalDiff - timestampDiff
-		if d < 0 {
-			d = -d
-		}
+// SetRemoteSSRC sets the SSRC of the remote source described in report blocks
+func (s *RTCPSessionHandler) SetRemoteSSRC(ssrc uint32) {
+	s.recv.mu.Lock()
+	defer s.recv.mu.Unlock()
+	s.recv.ssrc = ssrc
+}
 
-		// Update jitter estimate: J = J + (|D| - J) / 16
-		s.jitter += (d - s.jitter) / 16.0
+// SetExtendedReports enables RTCP XR VoIP metrics blocks in reports
+func (s *RTCPSessionHandler) SetExtendedReports(enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.extendedReports = enabled
+}
 
-		s.lastArrivalTime = arrivalTime
-		s.lastTimestamp = timestamp
-	}
+// UpdateReceiverStats updates receiver statistics from an RTP packet
+func (s *RTCPSessionHandler) UpdateReceiverStats(seq uint16, timestamp uint32, arrivalTime time.Time) {
+	s.recv.Update(seq, timestamp, arrivalTime)
 }
 
 // ProcessRTCP processes received RTCP packets
@@ -389,9 +429,8 @@ func (s *RTCPSessionHandler) processSenderReport(sr *rtcp.SenderReport) {
 
 	rtcpSRRecv.Inc()
 
-	// Store SR info for RTT calculation
-	s.lastSRRecvNTP = uint64(sr.NTPTime)
-	s.lastSRRecvTime = time.Now()
+	// Store SR info for the LSR/DLSR fields of our reception reports
+	s.recv.RecordSenderReport(sr.NTPTime, time.Now())
 
 	// Process any receiver reports in the SR
 	for _, rr := range sr.Reports {
@@ -468,7 +507,7 @@ func (s *RTCPSessionHandler) SendReport() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if s.conn == nil || s.remoteAddr == nil {
+	if (s.conn == nil && s.send == nil) || s.remoteAddr == nil {
 		return nil
 	}
 
@@ -501,14 +540,17 @@ func (s *RTCPSessionHandler) SendReport() error {
 	}
 	packets = append(packets, sdes)
 
+	if xr := s.buildExtendedReport(); xr != nil {
+		packets = append(packets, xr)
+	}
+
 	// Marshal and send
 	data, err := rtcp.Marshal(packets)
 	if err != nil {
 		return err
 	}
 
-	_, err = s.conn.WriteToUDP(data, s.remoteAddr)
-	return err
+	return s.write(data)
 }
 
 // buildSenderReport builds an RTCP Sender Report
@@ -527,9 +569,9 @@ func (s *RTCPSessionHandler) buildSenderReport() *rtcp.SenderReport {
 		OctetCount:  s.octetsSent,
 	}
 
-	// Add receiver report if we've received packets
-	if s.packetsRecv > 0 {
-		sr.Reports = append(sr.Reports, s.buildReceptionReport())
+	// Add a reception report block once the remote source is valid
+	if s.recv.Snapshot().PacketsReceived > 0 {
+		sr.Reports = append(sr.Reports, s.recv.ReceptionReport(now))
 	}
 
 	return sr
@@ -541,47 +583,29 @@ func (s *RTCPSessionHandler) buildReceiverReport() *rtcp.ReceiverReport {
 		SSRC: s.ssrc,
 	}
 
-	if s.packetsRecv > 0 {
-		rr.Reports = append(rr.Reports, s.buildReceptionReport())
+	if s.recv.Snapshot().PacketsReceived > 0 {
+		rr.Reports = append(rr.Reports, s.recv.ReceptionReport(time.Now()))
 	}
 
 	return rr
 }
 
-// buildReceptionReport builds a reception report block
-func (s *RTCPSessionHandler) buildReceptionReport() rtcp.ReceptionReport {
-	// Calculate fraction lost since last RR
-	// This is a simplified calculation
-	fractionLost := uint8(0)
-	if s.packetsLost > 0 && s.packetsRecv > 0 {
-		fractionLost = uint8(float64(s.packetsLost) / float64(s.packetsRecv+uint32(s.packetsLost)) * 256)
+// buildExtendedReport builds an RTCP XR with a VoIP metrics block for the
+// remote source, or nil when XR is off or nothing has been received
+func (s *RTCPSessionHandler) buildExtendedReport() *rtcp.ExtendedReport {
+	snap := s.recv.Snapshot()
+	if !s.extendedReports || snap.PacketsReceived == 0 {
+		return nil
 	}
 
-	// Calculate extended highest sequence number
-	extHighSeq := uint32(s.highestSeq) + s.seqCycles*65536
-
-	// Calculate interarrival jitter in timestamp units
-	jitterTS := uint32(s.jitter)
-
-	// Calculate LSR and DLSR
-	var lsr, dlsr uint32
-	if !s.lastSRRecvTime.IsZero() {
-		// LSR is middle 32 bits of NTP timestamp from last SR
-		lsr = uint32(s.lastSRRecvNTP >> 16)
-
-		// DLSR is delay since last SR in 1/65536 seconds
-		delay := time.Since(s.lastSRRecvTime)
-		dlsr = uint32(delay.Seconds() * 65536)
+	codec := "PCMU"
+	if primary, ok := GetCodecNegotiator().PrimaryCodec(snap.SSRC); ok {
+		codec = primary.Name
 	}
-
-	return rtcp.ReceptionReport{
-		SSRC:               s.ssrc,
-		FractionLost:       fractionLost,
-		TotalLost:          uint32(s.packetsLost),
-		LastSequenceNumber: extHighSeq,
-		Jitter:             jitterTS,
-		LastSenderReport:   lsr,
-		Delay:              dlsr,
+	rtcpXRSent.Inc()
+	return &rtcp.ExtendedReport{
+		SenderSSRC: s.ssrc,
+		Reports:    []rtcp.ReportBlock{s.recv.VoIPMetricsBlock(codec, s.rtt)},
 	}
 }
 
@@ -590,7 +614,7 @@ func (s *RTCPSessionHandler) SendBye(reason string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if s.conn == nil || s.remoteAddr == nil {
+	if (s.conn == nil && s.send == nil) || s.remoteAddr == nil {
 		return nil
 	}
 
@@ -604,8 +628,7 @@ func (s *RTCPSessionHandler) SendBye(reason string) error {
 		return err
 	}
 
-	_, err = s.conn.WriteToUDP(data, s.remoteAddr)
-	return err
+	return s.write(data)
 }
 
 // GetStats returns current RTCP statistics
@@ -613,14 +636,16 @@ func (s *RTCPSessionHandler) GetStats() RTCPStats {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
+	recv := s.recv.Snapshot()
+
 	return RTCPStats{
 		SSRC:          s.ssrc,
 		PacketsSent:   s.packetsSent,
 		OctetsSent:    s.octetsSent,
-		PacketsRecv:   s.packetsRecv,
-		PacketsLost:   s.packetsLost,
+		PacketsRecv:   recv.PacketsReceived,
+		PacketsLost:   recv.PacketsLost,
 		FractionLost:  s.fractionLost,
-		Jitter:        s.jitter / float64(s.clockRate), // Convert to seconds
+		Jitter:        recv.Jitter,
 		RTT:           s.rtt,
 	}
 }
@@ -637,8 +662,20 @@ type RTCPStats struct {
 	RTT          time.Duration
 }
 
-// calculateRTPTimestamp calculates RTP timestamp from wall clock
+// calculateRTPTimestamp calculates the RTP timestamp corresponding to t,
+// from the last packet sent when known and from the wall clock otherwise
 func (s *RTCPSessionHandler) calculateRTPTimestamp(t time.Time) uint32 {
+	if !s.lastRTPSentAt.IsZero() {
+		clockRate := s.rtpClockRate
+		if clockRate == 0 {
+			clockRate = s.clockRate
+		}
+		elapsed := t.Sub(s.lastRTPSentAt)
+		if elapsed < 0 {
+			elapsed = 0
+		}
+		return s.lastRTPTime + uint32(elapsed*time.Duration(clockRate)/time.Second)
+	}
 	// This is a simplified implementation
 	// In practice, this should be synchronized with the actual RTP timestamps being sent
 	elapsed := t.UnixNano()
@@ -0,0 +1,222 @@
+package internal
+
+import (
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+)
+
+// RTCPDestination is where the reports about one stream of a call leg are
+// sent: the RTCP address the leg signalled in its SDP for the m= section
+type RTCPDestination struct {
+	SessionID   string
+	Leg         string // "caller" or "callee"
+	Section     int    // index of a further m= section, -1 for the leg's primary one
+	SSRC        uint32 // the leg's own stream, described in report blocks
+	SenderSSRC  uint32 // the stream relayed to the leg, 0 if not yet known
+	Addr        *net.UDPAddr
+	Mux         bool
+	Conn        *net.UDPConn // the port the leg was given, from the peer leg; nil for the shared one
+	PacketsSent uint64
+	BytesSent   uint64 // payload octets
+
+	// RTP timestamp of the last packet relayed to the leg, when it was
+	// sent and its clock rate, to place sender reports on the RTP timeline
+	RTPTimestamp uint32
+	SentAt       time.Time
+	ClockRate    uint32
+}
+
+// key identifies the destination's report handler
+func (d RTCPDestination) key() string {
+	if d.Section < 0 {
+		return d.SessionID + "/" + d.Leg
+	}
+	return d.SessionID + "/" + d.Leg + "/" + strconv.Itoa(d.Section)
+}
+
+// setSent describes the stream relayed to the leg from what the forwarder
+// sent. Without any, such as for media offloaded to the kernel, the leg's
+// relay counters and the peer's signalled SSRC stand in
+func (d *RTCPDestination) setSent(sent SenderStats) {
+	if sent.SSRC == 0 {
+		return
+	}
+	d.SenderSSRC = sent.SSRC
+	d.PacketsSent, d.BytesSent = sent.Packets, sent.Octets
+	d.RTPTimestamp, d.SentAt, d.ClockRate = sent.Timestamp, sent.SentAt, sent.ClockRate
+}
+
+// RTCPDestinations returns the RTCP destination of every stream of a leg
+// with a known address: its primary m= section and each further section
+// relayed on its own ports
+func (sr *SessionRegistry) RTCPDestinations() []RTCPDestination {
+	var destinations []RTCPDestination
+	for _, session := range sr.ListSessions() {
+		session.mu.RLock()
+		for _, side := range []struct {
+			name      string
+			leg, peer *CallLeg
+		}{
+			{"caller", session.CallerLeg, session.CalleeLeg},
+			{"callee", session.CalleeLeg, session.CallerLeg},
+		} {
+			if side.leg == nil {
+				continue
+			}
+			paired := side.peer != nil && side.peer != side.leg
+			if addr := side.leg.RTCPAddr(); addr != nil {
+				dest := RTCPDestination{
+					SessionID:   session.ID,
+					Leg:         side.name,
+					Section:     -1,
+					SSRC:        side.leg.SSRC,
+					Addr:        addr,
+					Mux:         side.leg.RTCPMux,
+					PacketsSent: side.leg.PacketsSent,
+					BytesSent:   side.leg.BytesSent,
+				}
+				if paired {
+					dest.SenderSSRC = side.peer.SSRC
+					dest.Conn = side.peer.RTCPConn
+					if dest.Mux {
+						dest.Conn = side.peer.Conn
+					}
+				}
+				dest.setSent(side.leg.Sent)
+				destinations = append(destinations, dest)
+			}
+
+			for _, stream := range side.leg.Streams {
+				if stream.LocalPort == 0 || stream.LocalPort == side.leg.LocalPort || stream.Sent.SSRC == 0 || !paired {
+					continue
+				}
+				addr := stream.rtcpAddr(side.leg)
+				out := side.peer.streamAt(stream.Index)
+				if addr == nil || out == nil {
+					continue
+				}
+				dest := RTCPDestination{
+					SessionID: session.ID,
+					Leg:       side.name,
+					Section:   stream.Index,
+					SSRC:      stream.SSRC,
+					Addr:      addr,
+					Mux:       stream.RTCPMux,
+					Conn:      out.RTCPConn,
+				}
+				if dest.Mux {
+					dest.Conn = out.Conn
+				}
+				dest.setSent(stream.Sent)
+				destinations = append(destinations, dest)
+			}
+		}
+		session.mu.RUnlock()
+	}
+	return destinations
+}
+
+// RTCPAddr returns where a leg's RTCP goes: its RTP address with rtcp-mux,
+// otherwise the a=rtcp address or the port after its media port. The caller
+// holds the session lock
+func (l *CallLeg) RTCPAddr() *net.UDPAddr {
+	if l.RTCPMux {
+		return l.mediaAddr()
+	}
+
+	ip := l.RTCPIP
+	if ip == nil || ip.IsUnspecified() {
+		ip = l.IP
+	}
+	port := l.RTCPPort
+	if port <= 0 && l.Port > 0 {
+		port = l.Port + 1
+	}
+	if ip == nil || ip.IsUnspecified() || port <= 0 {
+		return nil
+	}
+	return &net.UDPAddr{IP: ip, Port: port}
+}
+
+// SetSessionRegistry makes the handler report on every call leg of the
+// registry, sending through send, such as RTPControl.SendRTCPFrom. nil stops it
+func (h *RTCPHandler) SetSessionRegistry(registry *SessionRegistry, send func(conn *net.UDPConn, packet []byte, addr *net.UDPAddr, mux bool) error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.registry = registry
+	h.legSender = send
+	if registry == nil || send == nil {
+		h.registry, h.legSender = nil, nil
+		h.legs = make(map[string]*RTCPSessionHandler)
+	}
+}
+
+// syncLegs brings the per-leg report handlers in line with the registry's
+// sessions, saying BYE to the legs that have gone
+func (h *RTCPHandler) syncLegs() {
+	h.mu.RLock()
+	registry, send := h.registry, h.legSender
+	h.mu.RUnlock()
+	if registry == nil {
+		return
+	}
+
+	destinations := registry.RTCPDestinations()
+	current := make(map[string]bool, len(destinations))
+	tracker := GetReceiveStatsTracker()
+
+	for _, dest := range destinations {
+		key := dest.key()
+		current[key] = true
+
+		h.mu.Lock()
+		handler, ok := h.legs[key]
+		if !ok {
+			ssrc := dest.SenderSSRC
+			if ssrc == 0 {
+				ssrc = rand.Uint32()
+			}
+			handler = NewRTCPSessionHandler(ssrc, h.cname, 8000)
+			handler.extendedReports = h.config.ExtendedReports
+			h.legs[key] = handler
+		}
+		h.mu.Unlock()
+
+		conn, mux := dest.Conn, dest.Mux
+		handler.SetSender(func(packet []byte, addr *net.UDPAddr) error {
+			return send(conn, packet, addr, mux)
+		}, dest.Addr)
+		handler.UpdateSenderStats(uint32(dest.PacketsSent), uint32(dest.BytesSent))
+		if !dest.SentAt.IsZero() {
+			handler.UpdateSenderClock(dest.RTPTimestamp, dest.SentAt, dest.ClockRate)
+		}
+
+		handler.mu.Lock()
+		if dest.SenderSSRC != 0 {
+			handler.ssrc = dest.SenderSSRC
+		}
+		if stats, ok := tracker.Get(dest.SSRC); ok && dest.SSRC != 0 {
+			handler.recv = stats
+		}
+		handler.mu.Unlock()
+	}
+
+	h.mu.Lock()
+	var gone []*RTCPSessionHandler
+	for key, handler := range h.legs {
+		if !current[key] {
+			gone = append(gone, handler)
+			delete(h.legs, key)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, handler := range gone {
+		if err := handler.SendBye("session ended"); err != nil {
+			log.Printf("Failed to send RTCP BYE: %v", err)
+		}
+	}
+}
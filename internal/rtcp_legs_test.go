@@ -0,0 +1,154 @@
+package internal
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+// rtcpSink records the RTCP packets sent to each address
+type rtcpSink struct {
+	mu      sync.Mutex
+	packets map[string][][]rtcp.Packet
+	mux     map[string]bool
+}
+
+func (s *rtcpSink) send(conn *net.UDPConn, packet []byte, addr *net.UDPAddr, mux bool) error {
+	packets, err := rtcp.Unmarshal(packet)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.packets[addr.String()] = append(s.packets[addr.String()], packets)
+	s.mux[addr.String()] = mux
+	return nil
+}
+
+func (s *rtcpSink) sent(addr string) [][]rtcp.Packet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.packets[addr]
+}
+
+func TestRTCPHandler_ReportsToLegAddresses(t *testing.T) {
+	registry := NewSessionRegistry(time.Hour)
+	defer registry.Stop()
+	session := registry.CreateSession("rtcp-legs", "from-tag")
+	caller := &CallLeg{Tag: "from-tag", IP: net.ParseIP("192.0.2.10"), Port: 30000, RTCPPort: 30011,
+		RTCPIP: net.ParseIP("192.0.2.11"), SSRC: 0xCA11}
+	callee := &CallLeg{Tag: "to-tag", IP: net.ParseIP("198.51.100.20"), Port: 40000, RTCPPort: 40000,
+		RTCPMux: true, SSRC: 0xCA1E}
+	if err := registry.SetCallerLeg(session.ID, caller); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.SetCalleeLeg(session.ID, callee); err != nil {
+		t.Fatal(err)
+	}
+
+	// Media from the caller is relayed to the callee
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		GetReceiveStatsTracker().Update(0xCA11, uint16(i), uint32(i)*160, 8000, start.Add(time.Duration(i)*20*time.Millisecond))
+		registry.RecordMediaActivity(0xCA11, 172)
+	}
+	defer GetReceiveStatsTracker().Remove(0xCA11)
+
+	sink := &rtcpSink{packets: make(map[string][][]rtcp.Packet), mux: make(map[string]bool)}
+	handler := NewRTCPHandler(&RTCPInternalConfig{Enabled: true, Interval: time.Second})
+	handler.SetSessionRegistry(registry, sink.send)
+	handler.sendReports()
+
+	// The caller gets a receiver report about its stream from the a=rtcp address
+	toCaller := sink.sent("192.0.2.11:30011")
+	if len(toCaller) != 1 {
+		t.Fatalf("sent %d reports to the caller's RTCP address, all: %v", len(toCaller), sink.packets)
+	}
+	rr, ok := toCaller[0][0].(*rtcp.ReceiverReport)
+	if !ok || rr.SSRC != 0xCA1E || len(rr.Reports) != 1 || rr.Reports[0].SSRC != 0xCA11 {
+		t.Errorf("unexpected report to the caller: %+v", toCaller[0][0])
+	}
+
+	// The callee, which multiplexes RTCP, gets a sender report on its RTP port
+	toCallee := sink.sent("198.51.100.20:40000")
+	if len(toCallee) != 1 || !sink.mux["198.51.100.20:40000"] {
+		t.Fatalf("sent %d reports to the callee's RTP address", len(toCallee))
+	}
+	sr, ok := toCallee[0][0].(*rtcp.SenderReport)
+	if !ok || sr.SSRC != 0xCA11 || sr.PacketCount != 10 || sr.OctetCount != 1720 {
+		t.Errorf("unexpected report to the callee: %+v", toCallee[0][0])
+	}
+
+	// Legs of a deleted session are sent a BYE and no further reports
+	if err := registry.DeleteSession(session.ID); err != nil {
+		t.Fatal(err)
+	}
+	handler.sendReports()
+	toCaller = sink.sent("192.0.2.11:30011")
+	if len(toCaller) != 2 {
+		t.Fatalf("sent %d packets to the caller after the session ended", len(toCaller))
+	}
+	if _, ok := toCaller[1][0].(*rtcp.Goodbye); !ok {
+		t.Errorf("expected a BYE, got %+v", toCaller[1][0])
+	}
+}
+
+func TestRTCPHandler_SenderReportsDescribeRelayedStream(t *testing.T) {
+	registry := NewSessionRegistry(time.Hour)
+	defer registry.Stop()
+	session := registry.CreateSession("rtcp-sent", "from-tag")
+	caller := &CallLeg{Tag: "from-tag", IP: net.ParseIP("192.0.2.10"), Port: 30000, RTCPPort: 30001, SSRC: 0x5E1}
+	callee := &CallLeg{Tag: "to-tag", IP: net.ParseIP("198.51.100.20"), Port: 40000, RTCPPort: 40001, SSRC: 0x5E2,
+		Codecs: []CodecInfo{{PayloadType: 111, Name: "opus", ClockRate: 48000, Channels: 2}}}
+	if err := registry.SetCallerLeg(session.ID, caller); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.SetCalleeLeg(session.ID, callee); err != nil {
+		t.Fatal(err)
+	}
+
+	// The forwarder sends the callee a transcoded stream under its own SSRC
+	var packets []*RTPPacket
+	for i := 0; i < 5; i++ {
+		packets = append(packets, &RTPPacket{PayloadType: 111, Timestamp: 96000 + uint32(i)*960, SSRC: 0x7AC0, Payload: make([]byte, 80)})
+	}
+	session.recordSent(caller, 0x5E1, packets)
+
+	sink := &rtcpSink{packets: make(map[string][][]rtcp.Packet), mux: make(map[string]bool)}
+	handler := NewRTCPHandler(&RTCPInternalConfig{Enabled: true, Interval: time.Second, CNAME: InstanceCNAME("node-1")})
+	handler.SetSessionRegistry(registry, sink.send)
+	handler.sendReports()
+
+	toCallee := sink.sent("198.51.100.20:40001")
+	if len(toCallee) != 1 {
+		t.Fatalf("sent %d reports to the callee", len(toCallee))
+	}
+	sr, ok := toCallee[0][0].(*rtcp.SenderReport)
+	if !ok || sr.SSRC != 0x7AC0 || sr.PacketCount != 5 || sr.OctetCount != 400 {
+		t.Fatalf("unexpected report to the callee: %+v", toCallee[0][0])
+	}
+	// on the stream's timeline, at its clock rate
+	if last := uint32(96000 + 4*960); sr.RTPTime < last || sr.RTPTime > last+48000 {
+		t.Errorf("RTP time %d is not just after the last packet's %d", sr.RTPTime, last)
+	}
+
+	var cname string
+	for _, packet := range toCallee[0] {
+		if sdes, ok := packet.(*rtcp.SourceDescription); ok && len(sdes.Chunks) > 0 {
+			if sdes.Chunks[0].Source != 0x7AC0 {
+				t.Errorf("SDES describes %#x, not the relayed stream", sdes.Chunks[0].Source)
+			}
+			for _, item := range sdes.Chunks[0].Items {
+				if item.Type == rtcp.SDESCNAME {
+					cname = item.Text
+				}
+			}
+		}
+	}
+	if cname != InstanceCNAME("node-1") || cname == InstanceCNAME("node-2") {
+		t.Errorf("CNAME %q is not the instance's", cname)
+	}
+}
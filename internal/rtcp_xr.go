@@ -0,0 +1,231 @@
+package internal
+
+import (
+	"math"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// RTCP XR metrics, from VoIP metrics blocks sent by peers
+var (
+	rtcpXRRFactor = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "karl_rtcp_xr_r_factor",
+			Help:    "R-factor reported by peers in RTCP XR VoIP metrics blocks",
+			Buckets: []float64{50, 60, 70, 80, 90, 100},
+		},
+	)
+
+	rtcpXRBurstDensity = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "karl_rtcp_xr_burst_density",
+			Help:    "Loss density within bursts reported by peers in RTCP XR",
+			Buckets: []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1},
+		},
+	)
+)
+
+// RFC 3611 section 4.7 constants
+const (
+	xrGmin        = 16  // received packets that end a burst
+	xrUnavailable = 127 // level, R-factor and MOS fields not measured
+)
+
+// lossPattern splits a stream into bursts and gaps as RFC 3611 4.7.2
+// defines them. A burst runs from one loss to another with fewer than
+// Gmin packets received in between; an isolated loss belongs to the gap
+// around it. The open burst is only settled by the next loss
+type lossPattern struct {
+	sinceLoss uint64 // packets received since the last loss
+
+	// The burst being built, which a single loss leaves in the gap
+	pendingPackets uint64
+	pendingLost    uint64
+
+	burstPackets uint64
+	burstLost    uint64
+	bursts       uint64
+	gapPackets   uint64
+	gapLost      uint64
+}
+
+// received records packets received in order
+func (p *lossPattern) received(n uint64) {
+	p.sinceLoss += n
+}
+
+// lost records a run of n consecutive lost packets
+func (p *lossPattern) lost(n uint64) {
+	if n == 0 {
+		return
+	}
+	if p.pendingLost > 0 && p.sinceLoss < xrGmin {
+		p.pendingPackets += p.sinceLoss + n
+		p.pendingLost += n
+	} else {
+		p.settle()
+		p.gapPackets += p.sinceLoss
+		p.pendingPackets, p.pendingLost = n, n
+	}
+	p.sinceLoss = 0
+}
+
+// settle closes the pending burst
+func (p *lossPattern) settle() {
+	switch {
+	case p.pendingLost == 1:
+		p.gapPackets++
+		p.gapLost++
+	case p.pendingLost > 1:
+		p.burstPackets += p.pendingPackets
+		p.burstLost += p.pendingLost
+		p.bursts++
+	}
+	p.pendingPackets, p.pendingLost = 0, 0
+}
+
+// summary returns the loss density of bursts and gaps as fractions, and
+// their mean lengths in packets, treating the pending burst as closed
+func (p lossPattern) summary() (burstDensity, gapDensity, burstLength, gapLength float64) {
+	p.settle()
+	p.gapPackets += p.sinceLoss
+
+	if p.burstPackets > 0 {
+		burstDensity = float64(p.burstLost) / float64(p.burstPackets)
+		burstLength = float64(p.burstPackets) / float64(p.bursts)
+	}
+	if p.gapPackets > 0 {
+		gapDensity = float64(p.gapLost) / float64(p.gapPackets)
+		gapLength = float64(p.gapPackets) / float64(p.bursts+1)
+	}
+	return burstDensity, gapDensity, burstLength, gapLength
+}
+
+// VoIPMetrics is the content of an RTCP XR VoIP metrics block (RFC 3611
+// 4.7) in natural units. Zero R-factor or MOS values were not reported
+type VoIPMetrics struct {
+	SSRC            uint32
+	LossRate        float64 // fraction of packets lost
+	DiscardRate     float64 // fraction discarded by the jitter buffer
+	BurstDensity    float64 // fraction lost within bursts
+	GapDensity      float64 // fraction lost within gaps
+	BurstDurationMs int
+	GapDurationMs   int
+	RoundTripMs     int
+	EndSystemMs     int
+	RFactor         float64
+	MOSLQ           float64 // listening quality
+	MOSCQ           float64 // conversational quality
+	Received        time.Time
+}
+
+// VoIPMetricsBlock builds an XR VoIP metrics block describing this source.
+// Karl relays without a jitter buffer, so nothing is discarded and the
+// jitter buffer and signal fields are left unavailable. MOS-LQ leaves out
+// the delay impairment; MOS-CQ and the R-factor include the round trip
+func (s *ReceiveStats) VoIPMetricsBlock(codec string, rtt time.Duration) *rtcp.VoIPMetricsReportBlock {
+	s.mu.Lock()
+	expected := s.extendedMax() - s.baseSeq + 1
+	lost := s.cumulativeLost()
+	pattern := s.loss
+	jitterMs := s.jitter / float64(s.clockRate) * 1000
+	frameMs := float64(packetizationDelay)
+	if s.frameTicks > 0 {
+		frameMs = float64(s.frameTicks) / float64(s.clockRate) * 1000
+	}
+	ssrc := s.ssrc
+	s.mu.Unlock()
+
+	var lossRate float64
+	if expected > 0 && lost > 0 {
+		lossRate = float64(lost) / float64(expected)
+	}
+	burstDensity, gapDensity, burstLength, gapLength := pattern.summary()
+	rttMs := float64(rtt) / float64(time.Millisecond)
+
+	r := EstimateRFactor(codec, lossRate*100, jitterMs, rttMs)
+	return &rtcp.VoIPMetricsReportBlock{
+		SSRC:           ssrc,
+		LossRate:       xrFraction(lossRate),
+		BurstDensity:   xrFraction(burstDensity),
+		GapDensity:     xrFraction(gapDensity),
+		BurstDuration:  xrUint16(burstLength * frameMs),
+		GapDuration:    xrUint16(gapLength * frameMs),
+		RoundTripDelay: xrUint16(rttMs),
+		SignalLevel:    xrUnavailable,
+		NoiseLevel:     xrUnavailable,
+		RERL:           xrUnavailable,
+		Gmin:           xrGmin,
+		RFactor:        uint8(math.Round(r)),
+		ExtRFactor:     xrUnavailable,
+		MOSLQ:          uint8(math.Round(EstimateMOS(codec, lossRate*100, jitterMs, 0) * 10)),
+		MOSCQ:          uint8(math.Round(RFactorToMOS(r) * 10)),
+	}
+}
+
+// ParseVoIPMetrics converts a received VoIP metrics block
+func ParseVoIPMetrics(block *rtcp.VoIPMetricsReportBlock, received time.Time) VoIPMetrics {
+	m := VoIPMetrics{
+		SSRC:            block.SSRC,
+		LossRate:        float64(block.LossRate) / 256,
+		DiscardRate:     float64(block.DiscardRate) / 256,
+		BurstDensity:    float64(block.BurstDensity) / 256,
+		GapDensity:      float64(block.GapDensity) / 256,
+		BurstDurationMs: int(block.BurstDuration),
+		GapDurationMs:   int(block.GapDuration),
+		RoundTripMs:     int(block.RoundTripDelay),
+		EndSystemMs:     int(block.EndSystemDelay),
+		Received:        received,
+	}
+	if block.RFactor != xrUnavailable {
+		m.RFactor = float64(block.RFactor)
+	}
+	if block.MOSLQ != xrUnavailable {
+		m.MOSLQ = float64(block.MOSLQ) / 10
+	}
+	if block.MOSCQ != xrUnavailable {
+		m.MOSCQ = float64(block.MOSCQ) / 10
+	}
+	return m
+}
+
+// handleExtendedReport records the VoIP metrics blocks of an XR packet
+func (d *RTCPDemuxer) handleExtendedReport(xr *rtcp.ExtendedReport, now time.Time) {
+	for _, block := range xr.Reports {
+		voip, ok := block.(*rtcp.VoIPMetricsReportBlock)
+		if !ok {
+			continue
+		}
+		metrics := ParseVoIPMetrics(voip, now)
+		if metrics.RFactor > 0 {
+			rtcpXRRFactor.Observe(metrics.RFactor)
+		}
+		rtcpXRBurstDensity.Observe(metrics.BurstDensity)
+
+		d.mu.Lock()
+		d.voipMetrics[metrics.SSRC] = metrics
+		d.mu.Unlock()
+	}
+}
+
+// GetVoIPMetrics returns the latest XR VoIP metrics a peer reported about
+// the given source
+func (d *RTCPDemuxer) GetVoIPMetrics(ssrc uint32) (VoIPMetrics, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	metrics, ok := d.voipMetrics[ssrc]
+	return metrics, ok
+}
+
+// xrFraction encodes a fraction in [0, 1] as an 8-bit fixed point value
+func xrFraction(f float64) uint8 {
+	return uint8(math.Min(255, math.Round(f*256)))
+}
+
+// xrUint16 clamps a millisecond value to a 16-bit field
+func xrUint16(v float64) uint16 {
+	return uint16(math.Min(math.MaxUint16, math.Round(v)))
+}
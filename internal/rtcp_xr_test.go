@@ -0,0 +1,158 @@
+package internal
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+func TestLossPattern_BurstsAndGaps(t *testing.T) {
+	var p lossPattern
+	p.received(100)
+	p.lost(1) // isolated, stays in the gap
+	p.received(50)
+	p.lost(2) // a burst: 2 lost, 3 received, 1 lost
+	p.received(3)
+	p.lost(1)
+	p.received(100)
+
+	burstDensity, gapDensity, burstLength, gapLength := p.summary()
+	if burstDensity != 0.5 || burstLength != 6 {
+		t.Errorf("expected one 6 packet burst with half lost, got density %.2f length %.1f", burstDensity, burstLength)
+	}
+	// 251 gap packets, one of them lost, in two gaps around the burst
+	if gapDensity != 1.0/251 || gapLength != 125.5 {
+		t.Errorf("expected gap density 1/251 over 125.5 packets, got %.4f over %.1f", gapDensity, gapLength)
+	}
+
+	var clean lossPattern
+	clean.received(500)
+	if burstDensity, gapDensity, _, _ := clean.summary(); burstDensity != 0 || gapDensity != 0 {
+		t.Errorf("expected no loss, got %.2f and %.2f", burstDensity, gapDensity)
+	}
+}
+
+func TestReceiveStats_VoIPMetricsBlock(t *testing.T) {
+	stats := NewReceiveStats(0xE0001, 8000)
+	start := time.Now()
+	for i := 0; i < 200; i++ {
+		// Lose packets 100-103 in one burst
+		if i >= 100 && i < 104 {
+			continue
+		}
+		stats.Update(uint16(i), uint32(i*160), start.Add(time.Duration(i)*20*time.Millisecond))
+	}
+
+	block := stats.VoIPMetricsBlock("PCMU", 60*time.Millisecond)
+	if block.SSRC != 0xE0001 || block.LossRate != 5 { // 4/200 of 256
+		t.Errorf("unexpected SSRC or loss rate: %+v", block)
+	}
+	if block.BurstDensity != 255 || block.BurstDuration != 80 {
+		t.Errorf("expected a fully lost 80ms burst, got density %d duration %d", block.BurstDensity, block.BurstDuration)
+	}
+	if block.Gmin != xrGmin || block.RoundTripDelay != 60 || block.SignalLevel != xrUnavailable {
+		t.Errorf("unexpected fixed fields: %+v", block)
+	}
+	if block.RFactor < 80 || block.MOSLQ < block.MOSCQ || block.MOSCQ < 38 {
+		t.Errorf("unexpected scores R=%d LQ=%d CQ=%d", block.RFactor, block.MOSLQ, block.MOSCQ)
+	}
+}
+
+func TestRTCPDemuxer_ExtendedReport(t *testing.T) {
+	demuxer := NewRTCPDemuxer(NewReceiveStatsTracker())
+	xr := &rtcp.ExtendedReport{
+		SenderSSRC: 0x1,
+		Reports: []rtcp.ReportBlock{
+			&rtcp.VoIPMetricsReportBlock{
+				SSRC:           0xE0002,
+				LossRate:       64,
+				BurstDensity:   128,
+				RoundTripDelay: 120,
+				RFactor:        75,
+				ExtRFactor:     xrUnavailable,
+				MOSLQ:          41,
+				MOSCQ:          xrUnavailable,
+			},
+		},
+	}
+	if err := demuxer.HandlePacket(marshalRTCP(t, xr)); err != nil {
+		t.Fatalf("HandlePacket failed: %v", err)
+	}
+
+	metrics, ok := demuxer.GetVoIPMetrics(0xE0002)
+	if !ok {
+		t.Fatal("expected the XR metrics to be recorded")
+	}
+	if metrics.LossRate != 0.25 || metrics.BurstDensity != 0.5 || metrics.RoundTripMs != 120 {
+		t.Errorf("unexpected metrics %+v", metrics)
+	}
+	if metrics.RFactor != 75 || metrics.MOSLQ != 4.1 || metrics.MOSCQ != 0 {
+		t.Errorf("expected unavailable scores to read as zero, got %+v", metrics)
+	}
+
+	bye := &rtcp.Goodbye{Sources: []uint32{0xE0002}}
+	if err := demuxer.HandlePacket(marshalRTCP(t, bye)); err != nil {
+		t.Fatalf("HandlePacket failed: %v", err)
+	}
+	if _, ok := demuxer.GetVoIPMetrics(0xE0002); ok {
+		t.Error("expected BYE to drop the XR metrics")
+	}
+}
+
+func TestRTCPSessionHandler_SendsExtendedReport(t *testing.T) {
+	receiver, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+	sender, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	handler := NewRTCPSessionHandler(0xE0003, "karl@test", 8000)
+	handler.SetConnection(sender, receiver.LocalAddr().(*net.UDPAddr))
+	handler.SetRemoteSSRC(0xE0004)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		handler.UpdateReceiverStats(uint16(i), uint32(i*160), start.Add(time.Duration(i)*20*time.Millisecond))
+	}
+
+	readTypes := func() []rtcp.Packet {
+		t.Helper()
+		buf := make([]byte, 1500)
+		_ = receiver.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := receiver.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("no report received: %v", err)
+		}
+		packets, err := rtcp.Unmarshal(buf[:n])
+		if err != nil {
+			t.Fatalf("invalid report: %v", err)
+		}
+		return packets
+	}
+
+	if err := handler.SendReport(); err != nil {
+		t.Fatal(err)
+	}
+	if packets := readTypes(); len(packets) != 2 {
+		t.Errorf("expected RR and SDES without XR, got %d packets", len(packets))
+	}
+
+	handler.SetExtendedReports(true)
+	if err := handler.SendReport(); err != nil {
+		t.Fatal(err)
+	}
+	packets := readTypes()
+	xr, ok := packets[len(packets)-1].(*rtcp.ExtendedReport)
+	if !ok || len(xr.Reports) != 1 {
+		t.Fatalf("expected a trailing XR, got %T", packets[len(packets)-1])
+	}
+	if block, ok := xr.Reports[0].(*rtcp.VoIPMetricsReportBlock); !ok || block.SSRC != 0xE0004 || xr.SenderSSRC != 0xE0003 {
+		t.Errorf("unexpected XR %+v", xr.Reports[0])
+	}
+}
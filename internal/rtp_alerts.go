@@ -1,7 +1,9 @@
 package internal
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"sync"
@@ -21,13 +23,21 @@ var (
 	alertChan     = make(chan RTPAlert, 10)
 	rtpStats      RTPStats
 	rtpStatsMutex sync.RWMutex
-	alertConfig   AlertSettings
+	alertConfig   AlertSettings // guarded by alertMutex
+
+	// Sessions alerted for a low MOS, until it recovers or the call ends
+	mosAlerted   = make(map[string]bool)
+	mosAlertedMu sync.Mutex
 )
 
+// callQualityInterval is how often MonitorCallQuality measures active calls
+const callQualityInterval = 5 * time.Second
+
 // RTPAlert represents an RTP-related issue detected in real-time
 type RTPAlert struct {
 	Timestamp   time.Time `json:"timestamp"`
 	Type        string    `json:"type"`
+	CallID      string    `json:"call_id,omitempty"`
 	Description string    `json:"description"`
 	Value       float64   `json:"value"`
 	Threshold   float64   `json:"threshold"`
@@ -42,34 +52,98 @@ func MonitorRTPAlerts() {
 		stats := rtpStats
 		rtpStatsMutex.RUnlock()
 
-		configMutex.RLock()
-		alertConfig = config.AlertSettings
-		configMutex.RUnlock()
+		checkForAlerts(stats, currentAlertSettings())
+	}
+}
+
+// MonitorCallQuality measures every active session until ctx is done,
+// which keeps their stats current for the API and CDRs, and raises an
+// alert when a call's MOS drops below the configured threshold
+func MonitorCallQuality(ctx context.Context, registry *SessionRegistry) {
+	ticker := time.NewTicker(callQualityInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			checkCallQuality(registry, currentAlertSettings().MOSThreshold)
+		}
+	}
+}
+
+// checkCallQuality measures the active sessions, alerts on low MOS and
+// updates the per-session gauges
+func checkCallQuality(registry *SessionRegistry, threshold float64) {
+	active := make(map[string]bool)
+	var samples []sessionQualitySample
+	for _, session := range registry.ListSessions() {
+		session.mu.Lock()
+		if session.State != SessionStateActive {
+			session.mu.Unlock()
+			continue
+		}
+		quality := session.LiveQuality()
+		id, callID := session.ID, session.CallID
+		session.mu.Unlock()
+
+		active[id] = true
+		samples = append(samples, sessionQualitySample{sessionID: id, callID: callID, quality: quality})
+		checkMOSAlert(id, callID, quality.MOS, threshold)
+	}
+	updateSessionGauges(samples)
+
+	mosAlertedMu.Lock()
+	for id := range mosAlerted {
+		if !active[id] {
+			delete(mosAlerted, id)
+		}
+	}
+	mosAlertedMu.Unlock()
+}
+
+// checkMOSAlert alerts once when a session's MOS falls below threshold,
+// and again only after it has recovered. A threshold of zero disables it
+func checkMOSAlert(sessionID, callID string, mos, threshold float64) {
+	low := threshold > 0 && mos > 0 && mos < threshold
+
+	mosAlertedMu.Lock()
+	alerted := mosAlerted[sessionID]
+	if low {
+		mosAlerted[sessionID] = true
+	} else {
+		delete(mosAlerted, sessionID)
+	}
+	mosAlertedMu.Unlock()
 
-		checkForAlerts(stats, alertConfig)
+	if low && !alerted {
+		triggerAlert("MOS", callID, fmt.Sprintf("Call quality degraded, MOS %.2f", mos), mos, threshold)
 	}
 }
 
 // checkForAlerts evaluates RTP statistics and triggers alerts if thresholds are exceeded
 func checkForAlerts(stats RTPStats, alertConfig AlertSettings) {
 	if stats.PacketLoss > alertConfig.PacketLossThreshold {
-		triggerAlert("Packet Loss", "High packet loss detected", stats.PacketLoss, alertConfig.PacketLossThreshold)
+		triggerAlert("Packet Loss", "", "High packet loss detected", stats.PacketLoss, alertConfig.PacketLossThreshold)
 	}
 
 	if stats.Jitter > alertConfig.JitterThreshold {
-		triggerAlert("Jitter", "High jitter detected", stats.Jitter, alertConfig.JitterThreshold)
+		triggerAlert("Jitter", "", "High jitter detected", stats.Jitter, alertConfig.JitterThreshold)
 	}
 
 	if stats.BandwidthUsage > alertConfig.BandwidthThreshold {
-		triggerAlert("Bandwidth", "High bandwidth usage detected", float64(stats.BandwidthUsage), float64(alertConfig.BandwidthThreshold))
+		triggerAlert("Bandwidth", "", "High bandwidth usage detected", float64(stats.BandwidthUsage), float64(alertConfig.BandwidthThreshold))
 	}
 }
 
-// triggerAlert logs an alert, saves it, and sends a real-time notification
-func triggerAlert(alertType, description string, value, threshold float64) {
+// triggerAlert logs an alert, saves it, sends a real-time notification
+// unless the notification queue is full, and publishes it to webhooks
+func triggerAlert(alertType, callID, description string, value, threshold float64) {
 	alert := RTPAlert{
 		Timestamp:   time.Now(),
 		Type:        alertType,
+		CallID:      callID,
 		Description: description,
 		Value:       value,
 		Threshold:   threshold,
@@ -82,8 +156,21 @@ func triggerAlert(alertType, description string, value, threshold float64) {
 	}
 	alertMutex.Unlock()
 
-	alertChan <- alert
-	log.Printf("ALERT: %s - %s (Value: %.2f, Threshold: %.2f)", alertType, description, value, threshold)
+	select {
+	case alertChan <- alert:
+	default:
+	}
+	PublishEvent(EventQualityAlert, callID, map[string]interface{}{
+		"alert":       alertType,
+		"description": description,
+		"value":       value,
+		"threshold":   threshold,
+	})
+	if callID != "" {
+		log.Printf("ALERT: %s - %s on call %s (Value: %.2f, Threshold: %.2f)", alertType, description, callID, value, threshold)
+	} else {
+		log.Printf("ALERT: %s - %s (Value: %.2f, Threshold: %.2f)", alertType, description, value, threshold)
+	}
 }
 
 // GetActiveAlerts API to retrieve all active alerts
@@ -98,8 +185,21 @@ func GetActiveAlerts(w http.ResponseWriter, r *http.Request) {
 // UpdateAlertThresholds updates alert thresholds dynamically
 func UpdateAlertThresholds(newConfig AlertSettings) {
 	configMutex.Lock()
-	config.AlertSettings = newConfig
+	if config != nil {
+		config.AlertSettings = newConfig
+	}
 	configMutex.Unlock()
 
+	alertMutex.Lock()
+	alertConfig = newConfig
+	alertMutex.Unlock()
+
 	log.Println("Updated RTP alert thresholds dynamically.")
 }
+
+// currentAlertSettings returns the thresholds the monitors check
+func currentAlertSettings() AlertSettings {
+	alertMutex.RLock()
+	defer alertMutex.RUnlock()
+	return alertConfig
+}
@@ -0,0 +1,48 @@
+package internal
+
+import "testing"
+
+func TestCheckMOSAlert(t *testing.T) {
+	alertMutex.Lock()
+	saved := alerts
+	alerts = nil
+	alertMutex.Unlock()
+	t.Cleanup(func() {
+		alertMutex.Lock()
+		alerts = saved
+		alertMutex.Unlock()
+		mosAlertedMu.Lock()
+		delete(mosAlerted, "mos-session")
+		mosAlertedMu.Unlock()
+	})
+	mosAlerts := func() []RTPAlert {
+		alertMutex.RLock()
+		defer alertMutex.RUnlock()
+		var found []RTPAlert
+		for _, alert := range alerts {
+			if alert.CallID == "mos-call" {
+				found = append(found, alert)
+			}
+		}
+		return found
+	}
+
+	checkMOSAlert("mos-session", "mos-call", 3.2, 3.5)
+	checkMOSAlert("mos-session", "mos-call", 3.1, 3.5)
+	if found := mosAlerts(); len(found) != 1 || found[0].Type != "MOS" || found[0].Value != 3.2 {
+		t.Fatalf("expected one alert while the MOS stays low, got %+v", found)
+	}
+
+	// A call with no media yet or a disabled threshold never alerts
+	checkMOSAlert("mos-session", "mos-call", 4.2, 3.5)
+	checkMOSAlert("mos-session", "mos-call", 0, 3.5)
+	checkMOSAlert("mos-session", "mos-call", 2.0, 0)
+	if found := mosAlerts(); len(found) != 1 {
+		t.Fatalf("expected no further alerts, got %+v", found)
+	}
+
+	checkMOSAlert("mos-session", "mos-call", 3.0, 3.5)
+	if found := mosAlerts(); len(found) != 2 {
+		t.Errorf("expected a new alert after the MOS recovered and dropped again, got %+v", found)
+	}
+}
@@ -1,52 +1,145 @@
 package internal
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"runtime"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/pion/rtp"
 	"github.com/pion/srtp/v2"
 	"github.com/pion/webrtc/v3"
 )
 
-// RTPControl manages RTP forwarding, SRTP handling, and conversions
+// mediaPacketPool reuses the parsed packets handed to media taps
+var mediaPacketPool = sync.Pool{New: func() interface{} { return new(rtp.Packet) }}
+
+// Per-packet log lines are sampled so they cost no throughput
+var (
+	rtpLog           = Logger(ComponentRTP)
+	rtpPacketTrace   = NewLogSampler(rtpLog, slog.LevelDebug, packetTraceSampleRate, 0)
+	rtpReadErrors    = NewLogSampler(rtpLog, slog.LevelError, 1, packetErrorInterval)
+	rtpPacketErrors  = NewLogSampler(rtpLog, slog.LevelError, 1, packetErrorInterval)
+	rtpForwardErrors = NewLogSampler(rtpLog, slog.LevelError, 1, packetErrorInterval)
+)
+
+// errRTPQueueFull is returned for a received packet the worker pool dropped
+var errRTPQueueFull = errors.New("RTP worker queue is full")
+
+// RTPControl manages RTP forwarding, SRTP handling, and conversions. Its
+// listeners queue received RTP on the worker pool; as the pool's default
+// handler it forwards the streams no session claims to its destinations
 type RTPControl struct {
-	srtpSession     *srtp.Context
+	srtpSession     SRTPCipher
+	srtpMu          sync.Mutex // an SRTPCipher is not safe for concurrent use
 	udpConn         *net.UDPConn
+	udpConns        []*net.UDPConn // every RTP socket, more than one with SO_REUSEPORT shards
+	rtcpConn        *net.UDPConn
 	destinations    map[string]*net.UDPConn
+	writers         map[*net.UDPConn]*batchConn // batched writers of the sockets media is read on
+	batch           BatchConfig
+	shards          int
 	mu              sync.RWMutex
 	stopped         bool
 	packetsReceived uint64
 	packetsDropped  uint64
 	bytesReceived   uint64
 	bytesSent       uint64
+
+	// RTP over TCP and TLS (RFC 4571)
+	streamListeners    []net.Listener
+	streamDestinations map[string]*rtpStreamConn
+
+	// rtcp-mux (RFC 5761): RTCP arriving on the RTP port
+	rtcpMux         bool
+	rtcpMuxResolver func(ssrc uint32) (enabled bool, known bool)
+	rtcpMuxed       uint64
+
+	// onMediaActivity is told the SSRC and size of every RTP packet received
+	onMediaActivity func(ssrc uint32, size int)
+
+	// rtcpTap sees every accepted RTCP packet with its source and local address
+	rtcpTap func(packet []byte, from, to *net.UDPAddr)
+
+	// mediaTaps see every parsed RTP packet before it is forwarded
+	mediaTaps []func(packet *rtp.Packet)
+
+	// sourceFilter decides whether a packet from a source is accepted
+	sourceFilter func(conn *net.UDPConn, packet []byte, from *net.UDPAddr) bool
+
+	// egress picks the local address destinations are sent from, nil to
+	// let the kernel choose
+	egress func(dst net.IP) net.IP
+
+	// mediaCrypto returns the protection Karl ends with the party a call
+	// leg's port was given to, nil when its media passes through
+	mediaCrypto func(conn *net.UDPConn) *MediaCrypto
+
+	// zrtpRelay passes ZRTP between the parties of a call, unchanged
+	zrtpRelay func(packet []byte) error
+
+	// ssrcLearner ties an RTP stream arriving on a call leg's port to the
+	// party sending it, and rejects streams of another party
+	ssrcLearner func(conn *net.UDPConn, ssrc uint32, from *net.UDPAddr) bool
 }
 
 // NewRTPControl initializes RTP handling with SRTP
 func NewRTPControl(srtpKey, srtpSalt []byte) (*RTPControl, error) {
-	var srtpSession *srtp.Context
+	var srtpSession SRTPCipher
 	var err error
 
 	if len(srtpKey) > 0 && len(srtpSalt) > 0 {
 		profile := srtp.ProtectionProfileAes128CmHmacSha1_80
-		srtpSession, err = srtp.CreateContext(srtpKey, srtpSalt, profile)
+		srtpSession, err = NewSRTPCipher(srtpKey, srtpSalt, profile)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create SRTP context: %w", err)
 		}
-		log.Println("✅ SRTP context initialized")
+		rtpLog.Info("SRTP context initialized")
 	}
 
 	return &RTPControl{
-		srtpSession:  srtpSession,
-		destinations: make(map[string]*net.UDPConn),
+		srtpSession:        srtpSession,
+		destinations:       make(map[string]*net.UDPConn),
+		writers:            make(map[*net.UDPConn]*batchConn),
+		streamDestinations: make(map[string]*rtpStreamConn),
+		rtcpMux:            true,
 	}, nil
 }
 
 // StartRTPListener listens for incoming RTP packets
 func (r *RTPControl) StartRTPListener(addr string) error {
+	r.mu.RLock()
+	batch, shards := r.batch, r.shards
+	r.mu.RUnlock()
+
+	// Each SO_REUSEPORT socket has its own read loop; the kernel keeps a
+	// flow on one socket, so packets of a stream reach the worker pool in
+	// order
+	if shards > 1 {
+		conns, err := listenReusePort(addr, shards)
+		if err == nil {
+			for _, conn := range conns {
+				MarkRTPConn(conn)
+				SetDontFragment(conn)
+			}
+			r.mu.Lock()
+			r.udpConn, r.udpConns = conns[0], conns
+			r.mu.Unlock()
+			rtpLog.Info("RTP listener started", "addr", addr, "sockets", len(conns))
+			for _, conn := range conns {
+				go r.packetHandlingLoop(r.addBatchConn(conn, batch))
+			}
+			return nil
+		}
+		rtpLog.Warn("RTP listener falling back to one socket", "error", err)
+	}
+
 	udpAddr, err := net.ResolveUDPAddr("udp", addr)
 	if err != nil {
 		return fmt.Errorf("failed to resolve UDP address: %w", err)
@@ -56,16 +149,173 @@ func (r *RTPControl) StartRTPListener(addr string) error {
 	if err != nil {
 		return fmt.Errorf("failed to start UDP listener: %w", err)
 	}
+	MarkRTPConn(r.udpConn)
+	SetDontFragment(r.udpConn)
+	r.udpConns = []*net.UDPConn{r.udpConn}
 
-	log.Printf("🎧 RTP Listener started on %s", addr)
+	rtpLog.Info("RTP listener started", "addr", addr)
 
-	go r.packetHandlingLoop()
+	go r.packetHandlingLoop(r.addBatchConn(r.udpConn, batch))
 	return nil
 }
 
-// packetHandlingLoop continuously reads and processes incoming packets
-func (r *RTPControl) packetHandlingLoop() {
-	buffer := make([]byte, 1500) // Standard MTU size
+// OpenMediaPorts binds a call leg's RTP and RTCP ports on ip, or on every
+// address when ip is nil, and reads them like the shared listeners. Closing
+// the sockets stops their read loops
+func (r *RTPControl) OpenMediaPorts(ip net.IP, rtpPort, rtcpPort int) (rtpConn, rtcpConn *net.UDPConn, err error) {
+	r.mu.RLock()
+	batch, stopped := r.batch, r.stopped
+	r.mu.RUnlock()
+	if stopped {
+		return nil, nil, fmt.Errorf("RTP engine is stopped")
+	}
+
+	rtpConn, err = net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: rtpPort})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to bind RTP port %d: %w", rtpPort, err)
+	}
+	rtcpConn, err = net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: rtcpPort})
+	if err != nil {
+		rtpConn.Close()
+		return nil, nil, fmt.Errorf("failed to bind RTCP port %d: %w", rtcpPort, err)
+	}
+	MarkRTPConn(rtpConn)
+	SetDontFragment(rtpConn)
+	MarkRTCPConn(rtcpConn)
+
+	go r.packetHandlingLoop(r.addBatchConn(rtpConn, batch))
+	go r.rtcpHandlingLoop(rtcpConn)
+	return rtpConn, rtcpConn, nil
+}
+
+// IsListening reports whether the RTP listener is open
+func (r *RTPControl) IsListening() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.udpConn != nil && !r.stopped
+}
+
+// SetReusePortShards makes the RTP listener open n sockets on its port with
+// SO_REUSEPORT, or one per CPU if n is 0 or less. It takes effect for a
+// listener started after the call; outside Linux the listener keeps one
+// socket
+func (r *RTPControl) SetReusePortShards(n int) {
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.shards = n
+}
+
+// listenReusePort opens n UDP sockets bound to the same address with
+// SO_REUSEPORT. A port of 0 binds them all to the port the first one got
+func listenReusePort(addr string, n int) ([]*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: reusePortControl}
+	conns := make([]*net.UDPConn, 0, n)
+	for i := 0; i < n; i++ {
+		pc, err := lc.ListenPacket(context.Background(), "udp", addr)
+		if err != nil {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return nil, fmt.Errorf("failed to open SO_REUSEPORT socket %d: %w", i, err)
+		}
+		conn := pc.(*net.UDPConn)
+		conns = append(conns, conn)
+		if i == 0 {
+			addr = conn.LocalAddr().String()
+		}
+	}
+	return conns, nil
+}
+
+// SetBatchConfig sets how the RTP listener and the call legs' ports batch
+// their reads and writes. It takes effect for sockets opened after the
+// call
+func (r *RTPControl) SetBatchConfig(config BatchConfig) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.batch = config
+}
+
+// addBatchConn wraps a socket media is read on for batched I/O, and keeps
+// the wrapper for the media sent from that socket until it closes
+func (r *RTPControl) addBatchConn(conn *net.UDPConn, config BatchConfig) *batchConn {
+	batch := newBatchConn(conn, config)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writers[conn] = batch
+	return batch
+}
+
+// StartRTCPListener listens for incoming RTCP packets on a separate port
+func (r *RTPControl) StartRTCPListener(addr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to resolve UDP address: %w", err)
+	}
+
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return fmt.Errorf("failed to start RTCP listener: %w", err)
+	}
+	MarkRTCPConn(conn)
+
+	r.mu.Lock()
+	r.rtcpConn = conn
+	r.mu.Unlock()
+
+	rtpLog.Info("RTCP listener started", "addr", addr)
+
+	go r.rtcpHandlingLoop(conn)
+	return nil
+}
+
+// rtcpHandlingLoop reads RTCP packets and hands them to the demuxer
+func (r *RTPControl) rtcpHandlingLoop(conn *net.UDPConn) {
+	buffer := make([]byte, 1500)
+
+	for {
+		n, remoteAddr, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			r.mu.RLock()
+			stopped := r.stopped
+			r.mu.RUnlock()
+			if stopped || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if rtpReadErrors.Allow() {
+				rtpReadErrors.Log("Error reading RTCP packet", "error", err)
+			}
+			continue
+		}
+
+		packet := buffer[:n]
+		if !r.sourceAllowed(conn, packet, remoteAddr) {
+			atomic.AddUint64(&r.packetsDropped, 1)
+			continue
+		}
+		if crypto := r.cryptoOf(conn); crypto != nil {
+			var ok bool
+			if packet, ok = crypto.receive(conn, packet, remoteAddr); !ok {
+				continue
+			}
+		}
+
+		r.tapRTCP(packet, remoteAddr, conn)
+
+		if err := GetRTCPDemuxer().HandlePacket(packet); err != nil && IsDebugLoggingEnabled() {
+			rtpLog.Debug("Dropped RTCP packet", "from", remoteAddr, "error", err)
+		}
+	}
+}
+
+// packetHandlingLoop reads packets, a batch at a time where the platform
+// supports it, and queues the RTP on the worker pool. Each packet's buffer
+// goes with it to the worker, which returns it to the pool
+func (r *RTPControl) packetHandlingLoop(conn *batchConn) {
+	local, _ := conn.conn.LocalAddr().(*net.UDPAddr)
 
 	for {
 		r.mu.RLock()
@@ -75,59 +325,336 @@ func (r *RTPControl) packetHandlingLoop() {
 		}
 		r.mu.RUnlock()
 
-		n, remoteAddr, err := r.udpConn.ReadFromUDP(buffer)
+		packets, err := conn.readBatch()
+		received := time.Now()
 		if err != nil {
-			log.Printf("❌ Error reading UDP packet: %v", err)
+			if errors.Is(err, net.ErrClosed) {
+				r.mu.Lock()
+				delete(r.writers, conn.conn)
+				r.mu.Unlock()
+				return
+			}
+			if rtpReadErrors.Allow() {
+				rtpReadErrors.Log("Error reading UDP packets", "error", err)
+			}
 			atomic.AddUint64(&r.packetsDropped, 1)
 			continue
 		}
 
-		atomic.AddUint64(&r.packetsReceived, 1)
-		atomic.AddUint64(&r.bytesReceived, uint64(n))
+		// A bridged party's packets are decrypted before anything sees them
+		crypto := r.cryptoOf(conn.conn)
+		for _, p := range packets {
+			atomic.AddUint64(&r.packetsReceived, 1)
+			atomic.AddUint64(&r.bytesReceived, uint64(len(p.data)))
+
+			if !r.sourceAllowed(conn.conn, p.data, p.addr) {
+				atomic.AddUint64(&r.packetsDropped, 1)
+				putPacketBuffer(p.buf)
+				continue
+			}
+			if crypto != nil {
+				var ok bool
+				if p.data, ok = crypto.receive(conn.conn, p.data, p.addr); !ok {
+					putPacketBuffer(p.buf)
+					continue
+				}
+			}
+			if IsZRTPPacket(p.data) {
+				r.relayZRTP(p.data)
+				putPacketBuffer(p.buf)
+				continue
+			}
+			if IsRTCPPacket(p.data) {
+				r.handleMuxedRTCP(p.data, p.addr)
+				putPacketBuffer(p.buf)
+				continue
+			}
+			if !r.learnSSRC(conn.conn, p.data, p.addr) {
+				atomic.AddUint64(&r.packetsDropped, 1)
+				putPacketBuffer(p.buf)
+				continue
+			}
+			*p.buf = p.data
+			_ = r.receiveRTPPacket(p.buf, p.addr, local, received)
+		}
+	}
+}
+
+// SetRTCPMux sets whether RTCP is accepted on the RTP port for sources that
+// do not belong to a known session
+func (r *RTPControl) SetRTCPMux(enabled bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rtcpMux = enabled
+}
+
+// SetRTCPMuxResolver sets the per-session lookup that decides whether a
+// sender negotiated rtcp-mux
+func (r *RTPControl) SetRTCPMuxResolver(resolver func(ssrc uint32) (enabled bool, known bool)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rtcpMuxResolver = resolver
+}
+
+// rtcpMuxAllowed reports whether RTCP from the given sender may share the RTP port
+func (r *RTPControl) rtcpMuxAllowed(senderSSRC uint32) bool {
+	r.mu.RLock()
+	resolver := r.rtcpMuxResolver
+	allowed := r.rtcpMux
+	r.mu.RUnlock()
+
+	if resolver != nil {
+		if enabled, known := resolver(senderSSRC); known {
+			return enabled
+		}
+	}
+	return allowed
+}
 
-		packet := make([]byte, n)
-		copy(packet, buffer[:n])
+// handleMuxedRTCP dispatches RTCP received on the RTP port to the RTCP demuxer
+func (r *RTPControl) handleMuxedRTCP(packet []byte, from *net.UDPAddr) {
+	if len(packet) < 8 {
+		atomic.AddUint64(&r.packetsDropped, 1)
+		return
+	}
 
-		go func() { _ = r.HandleRTPPacket(packet) }()
+	senderSSRC := binary.BigEndian.Uint32(packet[4:8])
+	if !r.rtcpMuxAllowed(senderSSRC) {
+		atomic.AddUint64(&r.packetsDropped, 1)
+		if IsDebugLoggingEnabled() {
+			rtpLog.Debug("Dropped muxed RTCP, rtcp-mux not negotiated", streamAttrs(senderSSRC)...)
+		}
+		return
+	}
 
-		if n > 0 {
-			log.Printf("📦 Received packet from %s, size: %d bytes", remoteAddr, n)
+	atomic.AddUint64(&r.rtcpMuxed, 1)
+	r.tapRTCP(packet, from, r.udpConn)
+	if err := GetRTCPDemuxer().HandlePacket(packet); err != nil {
+		atomic.AddUint64(&r.packetsDropped, 1)
+		if rtpPacketErrors.Allow() {
+			rtpPacketErrors.Log("Failed to handle muxed RTCP packet", append(streamAttrs(senderSSRC), "error", err)...)
 		}
 	}
 }
 
-// HandleRTPPacket processes an incoming RTP packet
+// SetMediaCryptoResolver sets the lookup of the protection Karl ends on a
+// call leg's port, such as SessionRegistry.MediaCryptoFor. Packets received
+// on the port are decrypted and packets sent from it encrypted
+func (r *RTPControl) SetMediaCryptoResolver(resolver func(conn *net.UDPConn) *MediaCrypto) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.mediaCrypto = resolver
+}
+
+// cryptoOf returns the protection ended on a port, nil if none
+func (r *RTPControl) cryptoOf(conn *net.UDPConn) *MediaCrypto {
+	r.mu.RLock()
+	resolver := r.mediaCrypto
+	r.mu.RUnlock()
+	if resolver == nil {
+		return nil
+	}
+	return resolver(conn)
+}
+
+// SetSSRCLearner sets how RTP arriving on a call leg's port is tied to the
+// leg of the party sending it, such as SessionRegistry.LearnSSRC, so that
+// streams the SDP did not announce are relayed. Packets it rejects are
+// dropped
+func (r *RTPControl) SetSSRCLearner(learn func(conn *net.UDPConn, ssrc uint32, from *net.UDPAddr) bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ssrcLearner = learn
+}
+
+// learnSSRC passes the SSRC of an RTP packet received on conn to the SSRC
+// learner, if one is set
+func (r *RTPControl) learnSSRC(conn *net.UDPConn, packet []byte, from *net.UDPAddr) bool {
+	r.mu.RLock()
+	learn := r.ssrcLearner
+	r.mu.RUnlock()
+	if learn == nil || len(packet) < 12 {
+		return true
+	}
+	return learn(conn, binary.BigEndian.Uint32(packet[8:12]), from)
+}
+
+// SetZRTPRelay sets how ZRTP the parties of a call exchange end to end is
+// relayed, such as SessionRegistry.RelayZRTP. Without one ZRTP is dropped
+// rather than handled as RTP
+func (r *RTPControl) SetZRTPRelay(relay func(packet []byte) error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.zrtpRelay = relay
+}
+
+// relayZRTP hands a ZRTP packet to the relay
+func (r *RTPControl) relayZRTP(packet []byte) {
+	r.mu.RLock()
+	relay := r.zrtpRelay
+	r.mu.RUnlock()
+
+	err := errors.New("no ZRTP relay")
+	if relay != nil {
+		err = relay(packet)
+	}
+	if err != nil {
+		atomic.AddUint64(&r.packetsDropped, 1)
+		zrtpRelayed.WithLabelValues("dropped").Inc()
+		if IsDebugLoggingEnabled() {
+			rtpLog.Debug("Dropped ZRTP packet", "error", err)
+		}
+		return
+	}
+	zrtpRelayed.WithLabelValues("relayed").Inc()
+}
+
+// SetSourceFilter sets the check every packet arriving on the RTP and RTCP
+// ports must pass, such as the media ACL. conn is the port the packet
+// arrived on, nil for RTP over TCP or TLS
+func (r *RTPControl) SetSourceFilter(filter func(conn *net.UDPConn, packet []byte, from *net.UDPAddr) bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sourceFilter = filter
+}
+
+// sourceAllowed applies the source filter, if one is set
+func (r *RTPControl) sourceAllowed(conn *net.UDPConn, packet []byte, from *net.UDPAddr) bool {
+	r.mu.RLock()
+	filter := r.sourceFilter
+	r.mu.RUnlock()
+	return filter == nil || filter(conn, packet, from)
+}
+
+// SetRTCPTap sets a callback that observes every accepted RTCP packet
+func (r *RTPControl) SetRTCPTap(tap func(packet []byte, from, to *net.UDPAddr)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rtcpTap = tap
+}
+
+// tapRTCP passes an RTCP packet received on conn to the capture and to the
+// tap, if one is set
+func (r *RTPControl) tapRTCP(packet []byte, from *net.UDPAddr, conn *net.UDPConn) {
+	var local *net.UDPAddr
+	if conn != nil {
+		local, _ = conn.LocalAddr().(*net.UDPAddr)
+	}
+	CapturePacket(packet, from, local)
+
+	r.mu.RLock()
+	tap := r.rtcpTap
+	r.mu.RUnlock()
+	if tap != nil {
+		tap(packet, from, local)
+	}
+}
+
+// SetMediaActivityHandler sets the callback used to track media activity per SSRC
+func (r *RTPControl) SetMediaActivityHandler(handler func(ssrc uint32, size int)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onMediaActivity = handler
+}
+
+// AddMediaTap adds a callback that observes every received RTP packet,
+// used by call recording and conferencing to pick up both legs of a call.
+// The packet and its payload are reused once the tap returns
+func (r *RTPControl) AddMediaTap(tap func(packet *rtp.Packet)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.mediaTaps = append(r.mediaTaps, tap)
+}
+
+// GetRTCPMuxedCount returns the number of RTCP packets received on the RTP port
+func (r *RTPControl) GetRTCPMuxedCount() uint64 {
+	return atomic.LoadUint64(&r.rtcpMuxed)
+}
+
+// HandleRTPPacket queues an RTP packet received outside the RTP listener,
+// such as from WebRTC, on the worker pool. The caller may reuse packet
 func (r *RTPControl) HandleRTPPacket(packet []byte) error {
-	rtpPacket := &rtp.Packet{}
+	return r.receiveRTPPacket(copyPacketBuffer(packet), nil, nil, time.Now())
+}
+
+// receiveRTPPacket passes an RTP packet received from the given address on
+// local at received to the taps and the capture, then queues it on the
+// worker pool, which takes over buf
+func (r *RTPControl) receiveRTPPacket(buf *[]byte, from, local *net.UDPAddr, received time.Time) error {
+	if err := r.ingestRTPPacket(*buf, from, local); err != nil {
+		putPacketBuffer(buf)
+		return err
+	}
+	if !queueRTPJob(buf, received) {
+		atomic.AddUint64(&r.packetsDropped, 1)
+		return errRTPQueueFull
+	}
+	return nil
+}
+
+// ingestRTPPacket checks an RTP packet parses and shows it to the media
+// activity handler, the media taps and the capture before it is queued
+func (r *RTPControl) ingestRTPPacket(packet []byte, from, local *net.UDPAddr) error {
+	rtpPacket := mediaPacketPool.Get().(*rtp.Packet)
+	defer mediaPacketPool.Put(rtpPacket)
 	if err := rtpPacket.Unmarshal(packet); err != nil {
 		atomic.AddUint64(&r.packetsDropped, 1)
-		log.Printf("❌ Failed to unmarshal RTP packet: %v", err)
+		if rtpPacketErrors.Allow() {
+			rtpPacketErrors.Log("Failed to unmarshal RTP packet", "from", from, "error", err)
+		}
 		return err
 	}
 
 	IncrementRTPPackets()
-	CapturePacket(packet)
+	if IsPCAPEnabled() {
+		CapturePacket(packet, from, local)
+	}
+
+	r.mu.RLock()
+	onMediaActivity := r.onMediaActivity
+	mediaTaps := r.mediaTaps
+	r.mu.RUnlock()
+	if onMediaActivity != nil {
+		onMediaActivity(rtpPacket.SSRC, len(packet))
+	}
+	for _, tap := range mediaTaps {
+		tap(rtpPacket)
+	}
 
-	log.Printf("📦 RTP Packet - SSRC: %d, SeqNum: %d, Timestamp: %d, PayloadType: %d",
-		rtpPacket.SSRC,
-		rtpPacket.SequenceNumber,
-		rtpPacket.Timestamp,
-		rtpPacket.PayloadType)
+	if rtpPacketTrace.Allow() {
+		rtpPacketTrace.Log("RTP packet", append(streamAttrs(rtpPacket.SSRC), "from", from, "seq", rtpPacket.SequenceNumber,
+			"timestamp", rtpPacket.Timestamp, "pt", rtpPacket.PayloadType, "size", len(packet))...)
+	}
+	return nil
+}
+
+// Handle forwards a packet the worker pool has processed to every
+// destination, encrypting it first when SRTP is configured
+func (r *RTPControl) Handle(packet *RTPPacket) error {
+	buf := getPacketBuffer()
+	defer putPacketBuffer(buf)
+	forward := marshalRTPPacket(packet, *buf)
 
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
 	if r.srtpSession != nil {
-		encrypted, err := r.srtpSession.EncryptRTP(nil, rtpPacket.Payload, &rtpPacket.Header)
+		out := getPacketBuffer()
+		defer putPacketBuffer(out)
+		r.srtpMu.Lock()
+		encrypted, err := r.srtpSession.EncryptRTP((*out)[:0], forward, nil)
+		r.srtpMu.Unlock()
 		if err != nil {
 			atomic.AddUint64(&r.packetsDropped, 1)
-			log.Printf("❌ Failed to encrypt RTP packet: %v", err)
+			if rtpPacketErrors.Allow() {
+				rtpPacketErrors.Log("Failed to encrypt RTP packet", append(streamAttrs(packet.SSRC), "error", err)...)
+			}
 			return err
 		}
-		return r.forwardPacket(encrypted)
+		forward = encrypted
 	}
 
-	return r.forwardPacket(packet)
+	return r.forwardPacket(forward)
 }
 
 // AddDestination adds a new destination for RTP forwarding
@@ -144,13 +671,36 @@ func (r *RTPControl) AddDestination(addr string) error {
 		return fmt.Errorf("failed to resolve destination address: %w", err)
 	}
 
-	conn, err := net.DialUDP("udp", nil, udpAddr)
+	conn, err := net.DialUDP("udp", r.egressAddr(udpAddr.IP), udpAddr)
 	if err != nil {
 		return fmt.Errorf("failed to create UDP connection: %w", err)
 	}
+	MarkRTPConn(conn)
+	SetDontFragment(conn)
 
 	r.destinations[addr] = conn
-	log.Printf("✅ Added RTP destination: %s", addr)
+	rtpLog.Info("Added RTP destination", "addr", addr)
+	return nil
+}
+
+// SetEgressSelector sets how the local address of a destination added
+// afterwards is picked, so a multi-homed host sends each destination's
+// media from the interface that reaches it
+func (r *RTPControl) SetEgressSelector(egress func(dst net.IP) net.IP) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.egress = egress
+}
+
+// egressAddr returns the local address to send to dst from, or nil; the
+// caller holds r.mu
+func (r *RTPControl) egressAddr(dst net.IP) *net.UDPAddr {
+	if r.egress == nil {
+		return nil
+	}
+	if ip := r.egress(dst); ip != nil {
+		return &net.UDPAddr{IP: ip}
+	}
 	return nil
 }
 
@@ -162,11 +712,17 @@ func (r *RTPControl) RemoveDestination(addr string) {
 	if conn, exists := r.destinations[addr]; exists {
 		conn.Close()
 		delete(r.destinations, addr)
-		log.Printf("❌ Removed RTP destination: %s", addr)
+		rtpLog.Info("Removed RTP destination", "addr", addr)
+	}
+	if stream, exists := r.streamDestinations[addr]; exists {
+		stream.conn.Close()
+		delete(r.streamDestinations, addr)
+		rtpLog.Info("Removed RTP stream destination", "addr", addr)
 	}
 }
 
-// forwardPacket sends the packet to all configured destinations
+// forwardPacket sends the packet to all configured destinations. Callers
+// hold r.mu
 func (r *RTPControl) forwardPacket(packet []byte) error {
 	var lastErr error
 
@@ -174,17 +730,156 @@ func (r *RTPControl) forwardPacket(packet []byte) error {
 		n, err := conn.Write(packet)
 		if err != nil {
 			atomic.AddUint64(&r.packetsDropped, 1)
-			log.Printf("❌ Failed to forward to %s: %v", addr, err)
+			if rtpForwardErrors.Allow() {
+				rtpForwardErrors.Log("Failed to forward packet", "addr", addr, "error", err)
+			}
+			notePathMTUError(conn, addr, err)
 			lastErr = err
 			IncrementDroppedPackets()
 		} else {
 			atomic.AddUint64(&r.bytesSent, uint64(n))
 		}
 	}
+	if err := r.forwardStreams(packet); err != nil {
+		lastErr = err
+	}
 
 	return lastErr
 }
 
+// SendTo sends an RTP packet generated by Karl (such as a conference mix)
+// from the RTP socket to addr, encrypting it when an SRTP key is configured
+func (r *RTPControl) SendTo(packet []byte, addr *net.UDPAddr) error {
+	return r.SendFrom(nil, packet, addr)
+}
+
+// SendFrom sends an RTP packet like SendTo, from conn, such as the port the
+// party it goes to was given, or from the RTP socket when conn is nil. On a
+// call leg's port the packet is protected the way Karl bridges that party,
+// and left as it is otherwise; the configured SRTP key applies only to the
+// RTP socket
+func (r *RTPControl) SendFrom(conn *net.UDPConn, packet []byte, addr *net.UDPAddr) error {
+	_, err := r.SendBatchFrom(conn, [][]byte{packet}, addr)
+	return err
+}
+
+// SendBatchFrom sends RTP packets to addr like SendFrom, with one sendmmsg
+// call where the platform supports it; with GSO, runs of equally sized
+// packets go out as one write. It returns how many packets were sent
+func (r *RTPControl) SendBatchFrom(conn *net.UDPConn, packets [][]byte, addr *net.UDPAddr) (int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	shared := conn == nil
+	if conn == nil {
+		conn = r.udpConn
+	}
+	if r.stopped || conn == nil {
+		return 0, fmt.Errorf("RTP socket is not open")
+	}
+
+	// The packets before one that cannot be sent still go out
+	out := make([][]byte, 0, len(packets))
+	var failed error
+	for _, packet := range packets {
+		protected, err := r.protectRTPLocked(conn, shared, packet)
+		if err != nil {
+			atomic.AddUint64(&r.packetsDropped, 1)
+			failed = err
+			break
+		}
+		out = append(out, protected)
+	}
+
+	writer := r.writers[conn]
+	if writer == nil {
+		writer = newBatchConn(conn, BatchConfig{Size: 1})
+	}
+	sent, n, err := writer.writeBatch(out, addr)
+	atomic.AddUint64(&r.bytesSent, uint64(n))
+	if err != nil {
+		notePathMTUError(conn, addr.String(), err)
+		atomic.AddUint64(&r.packetsDropped, uint64(len(out)-sent))
+		for i := sent; i < len(out); i++ {
+			IncrementDroppedPackets()
+		}
+		return sent, err
+	}
+	return sent, failed
+}
+
+// protectRTPLocked returns an RTP packet as it goes out of conn: protected
+// the way Karl bridges the party on a call leg's port, or with the
+// configured SRTP key on the RTP socket. The caller holds r.mu
+func (r *RTPControl) protectRTPLocked(conn *net.UDPConn, shared bool, packet []byte) ([]byte, error) {
+	if !fitsMTU("rtp", len(packet)) {
+		return nil, fmt.Errorf("packet of %d bytes exceeds the transport MTU", len(packet))
+	}
+
+	if crypto := r.legCryptoLocked(conn, shared); crypto != nil {
+		return crypto.protect(packet, false)
+	}
+	if shared && r.srtpSession != nil {
+		header := &rtp.Header{}
+		if _, err := header.Unmarshal(packet); err != nil {
+			return nil, err
+		}
+		r.srtpMu.Lock()
+		defer r.srtpMu.Unlock()
+		return r.srtpSession.EncryptRTP(nil, packet, header)
+	}
+	return packet, nil
+}
+
+// SendRTCPFrom sends an RTCP packet to addr from conn, such as the RTCP port
+// the party it goes to was given, protected like SendFrom. When conn is nil
+// it goes from the RTP socket if the destination multiplexes RTCP with RTP
+// and otherwise from the RTCP socket
+func (r *RTPControl) SendRTCPFrom(conn *net.UDPConn, packet []byte, addr *net.UDPAddr, mux bool) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	shared := conn == nil
+	if conn == nil {
+		conn = r.rtcpConn
+		if mux || conn == nil {
+			conn = r.udpConn
+		}
+	}
+	if r.stopped || conn == nil {
+		return fmt.Errorf("RTCP socket is not open")
+	}
+
+	if crypto := r.legCryptoLocked(conn, shared); crypto != nil {
+		encrypted, err := crypto.protect(packet, true)
+		if err != nil {
+			return err
+		}
+		packet = encrypted
+	} else if shared && r.srtpSession != nil {
+		r.srtpMu.Lock()
+		encrypted, err := r.srtpSession.EncryptRTCP(nil, packet, nil)
+		r.srtpMu.Unlock()
+		if err != nil {
+			return err
+		}
+		packet = encrypted
+	}
+
+	_, err := conn.WriteToUDP(packet, addr)
+	return err
+}
+
+// legCryptoLocked returns the protection Karl ends on a call leg's port, nil
+// for the shared sockets or a party whose media passes through. The caller
+// holds r.mu
+func (r *RTPControl) legCryptoLocked(conn *net.UDPConn, shared bool) *MediaCrypto {
+	if shared || r.mediaCrypto == nil {
+		return nil
+	}
+	return r.mediaCrypto(conn)
+}
+
 // GetStats returns the current RTP statistics
 func (r *RTPControl) GetStats() (uint64, uint64, uint64, uint64) {
 	return atomic.LoadUint64(&r.packetsReceived),
@@ -224,15 +919,32 @@ func (r *RTPControl) Stop() {
 
 	r.stopped = true
 
+	for _, conn := range r.udpConns {
+		conn.Close()
+	}
 	if r.udpConn != nil {
 		r.udpConn.Close()
 	}
+	if r.rtcpConn != nil {
+		r.rtcpConn.Close()
+	}
+
+	for _, listener := range r.streamListeners {
+		listener.Close()
+	}
+	r.streamListeners = nil
 
 	for addr, conn := range r.destinations {
 		conn.Close()
-		log.Printf("Closed connection to %s", addr)
+		rtpLog.Debug("Closed connection", "addr", addr)
+	}
+	for addr, stream := range r.streamDestinations {
+		stream.conn.Close()
+		rtpLog.Debug("Closed connection", "addr", addr)
 	}
 
 	r.destinations = make(map[string]*net.UDPConn)
-	log.Println("🛑 RTP Control stopped")
+	r.writers = make(map[*net.UDPConn]*batchConn)
+	r.streamDestinations = make(map[string]*rtpStreamConn)
+	rtpLog.Info("RTP control stopped")
 }
@@ -0,0 +1,199 @@
+package internal
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+func TestRTPControl_MuxedRTCPDispatch(t *testing.T) {
+	control, err := NewRTPControl(nil, nil)
+	if err != nil {
+		t.Fatalf("NewRTPControl failed: %v", err)
+	}
+
+	control.SetRTCPMuxResolver(func(ssrc uint32) (bool, bool) {
+		switch ssrc {
+		case 0x10:
+			return true, true
+		case 0x20:
+			return false, true
+		}
+		return false, false
+	})
+
+	muxed := marshalRTCP(t, &rtcp.ReceiverReport{SSRC: 0x10})
+	demuxed := marshalRTCP(t, &rtcp.ReceiverReport{SSRC: 0x20})
+	unknown := marshalRTCP(t, &rtcp.ReceiverReport{SSRC: 0x30})
+
+	control.handleMuxedRTCP(muxed, nil)
+	control.handleMuxedRTCP(demuxed, nil)
+	if got := control.GetRTCPMuxedCount(); got != 1 {
+		t.Errorf("expected only the muxed session's RTCP to be accepted, got %d", got)
+	}
+
+	// Unknown senders fall back to the listener default
+	control.handleMuxedRTCP(unknown, nil)
+	if got := control.GetRTCPMuxedCount(); got != 2 {
+		t.Errorf("expected unknown sender to be accepted by default, got %d", got)
+	}
+
+	control.SetRTCPMux(false)
+	control.handleMuxedRTCP(unknown, nil)
+	if got := control.GetRTCPMuxedCount(); got != 2 {
+		t.Errorf("expected unknown sender to be dropped with mux disabled, got %d", got)
+	}
+}
+
+func TestSessionRegistry_RTCPMuxForSSRC(t *testing.T) {
+	registry := NewSessionRegistry(time.Hour)
+	defer registry.Stop()
+
+	session := registry.CreateSession("mux-call", "from-tag")
+	if err := registry.SetCallerLeg(session.ID, &CallLeg{Tag: "from-tag", RTCPMux: true}); err != nil {
+		t.Fatalf("SetCallerLeg failed: %v", err)
+	}
+	if err := registry.RegisterSSRC(session.ID, 0xCAFE, true); err != nil {
+		t.Fatalf("RegisterSSRC failed: %v", err)
+	}
+
+	if enabled, known := registry.RTCPMuxForSSRC(0xCAFE); !known || !enabled {
+		t.Errorf("expected rtcp-mux enabled for registered SSRC, got enabled=%v known=%v", enabled, known)
+	}
+	if _, known := registry.RTCPMuxForSSRC(0xBEEF); known {
+		t.Error("expected unregistered SSRC to be unknown")
+	}
+}
+
+// forwardThroughPool starts the worker pool with control as its default
+// handler, as the RTP engine runs it
+func forwardThroughPool(t *testing.T, control *RTPControl) {
+	t.Helper()
+	withWorkerPool(t)
+	SetDefaultRTPHandler(control)
+	t.Cleanup(func() { SetDefaultRTPHandler(nil) })
+}
+
+func TestRTPControl_ForwardsThroughWorkerPool(t *testing.T) {
+	control, err := NewRTPControl(nil, nil)
+	if err != nil {
+		t.Fatalf("NewRTPControl failed: %v", err)
+	}
+	defer control.Stop()
+	control.SetBatchConfig(BatchConfig{Size: 1})
+	forwardThroughPool(t, control)
+
+	sink, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	if err := control.AddDestination(sink.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if err := control.StartRTPListener("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	sender, err := net.DialUDP("udp4", nil, control.udpConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	const perStream = 20
+	for i := 0; i < perStream; i++ {
+		for _, ssrc := range []byte{0x41, 0x42, 0x43} {
+			packet := make([]byte, 172)
+			packet[0], packet[3], packet[11] = 0x80, byte(i), ssrc
+			sender.Write(packet)
+		}
+	}
+
+	// Streams may interleave, but each arrives in order
+	next := make(map[byte]byte)
+	sink.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	for i := 0; i < 3*perStream; i++ {
+		if _, _, err := sink.ReadFromUDP(buf); err != nil {
+			t.Fatalf("expected %d forwarded packets, got %d: %v", 3*perStream, i, err)
+		}
+		ssrc, seq := buf[11], buf[3]
+		if seq != next[ssrc] {
+			t.Fatalf("stream %#x: got sequence %d, want %d", ssrc, seq, next[ssrc])
+		}
+		next[ssrc]++
+	}
+}
+
+func TestRTPControl_SessionForwarding(t *testing.T) {
+	control, err := NewRTPControl(nil, nil)
+	if err != nil {
+		t.Fatalf("NewRTPControl failed: %v", err)
+	}
+	defer control.Stop()
+	forwardThroughPool(t, control)
+
+	// The callee's media goes to the sink, and the engine's own
+	// destinations get nothing of the call
+	callee, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer callee.Close()
+	other, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if err := control.AddDestination(other.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	registry := NewSessionRegistry(time.Hour)
+	defer registry.Stop()
+	registry.SetMediaSender(control.SendBatchFrom)
+	defer registry.SetMediaSender(nil)
+	session := registry.CreateSession("forward-call", "from-tag")
+	calleeAddr := callee.LocalAddr().(*net.UDPAddr)
+	if err := registry.SetCallerLeg(session.ID, &CallLeg{Tag: "from-tag", SSRC: 0x51}); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.SetCalleeLeg(session.ID, &CallLeg{Tag: "to-tag", IP: calleeAddr.IP, Port: calleeAddr.Port}); err != nil {
+		t.Fatal(err)
+	}
+	if err := control.StartRTPListener("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	sender, err := net.DialUDP("udp4", nil, control.udpConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	packet := make([]byte, 172)
+	packet[0], packet[3], packet[11] = 0x80, 7, 0x51
+	sender.Write(packet)
+
+	callee.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	n, from, err := callee.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("callee received nothing: %v", err)
+	}
+	if n != 172 || buf[3] != 7 || buf[11] != 0x51 {
+		t.Errorf("callee received %d bytes with sequence %d from SSRC %#x", n, buf[3], buf[11])
+	}
+	if from.Port != control.udpConn.LocalAddr().(*net.UDPAddr).Port {
+		t.Errorf("relayed from port %d instead of the RTP port", from.Port)
+	}
+
+	// Once the session is gone its SSRC falls back to the destinations
+	registry.DeleteSession(session.ID)
+	sender.Write(packet)
+	other.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := other.ReadFromUDP(buf); err != nil {
+		t.Errorf("destination received nothing after the session ended: %v", err)
+	}
+}
@@ -0,0 +1,239 @@
+package internal
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// RTP header extensions Karl interprets, by their a=extmap URI
+const (
+	ExtmapAbsSendTime = "http://www.webrtc.org/experiments/rtp-hdrext/abs-send-time"
+	ExtmapMID         = "urn:ietf:params:rtp-hdrext:sdes:mid"
+	ExtmapRID         = "urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id"
+	ExtmapRepairedRID = "urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id"
+	ExtmapAudioLevel  = "urn:ietf:params:rtp-hdrext:ssrc-audio-level"
+)
+
+const (
+	// extensionProfileOneByte and extensionProfileTwoByte are the header
+	// extension profiles of RFC 8285 sections 4.2 and 4.3; the low 4 bits
+	// of the two-byte profile are application bits
+	extensionProfileOneByte = 0xBEDE
+	extensionProfileTwoByte = 0x1000
+)
+
+// ErrExtensionProfile reports a header extension not in an RFC 8285 format
+var ErrExtensionProfile = errors.New("RTP header extension is not in an RFC 8285 format")
+
+// RTPHeaderExtension is one element of an RFC 8285 header extension
+type RTPHeaderExtension struct {
+	ID      uint8
+	Payload []byte
+}
+
+// RTPExtmap holds the header extensions an m= section negotiated with
+// a=extmap (RFC 8285 section 5): the URI of each local identifier
+type RTPExtmap map[uint8]string
+
+// ID returns the identifier of an extension's URI, 0 if not negotiated
+func (m RTPExtmap) ID(uri string) uint8 {
+	for id, u := range m {
+		if u == uri {
+			return id
+		}
+	}
+	return 0
+}
+
+// equal reports whether two sections map the same identifiers to the same
+// extensions
+func (m RTPExtmap) equal(other RTPExtmap) bool {
+	if len(m) != len(other) {
+		return false
+	}
+	for id, uri := range m {
+		if other[id] != uri {
+			return false
+		}
+	}
+	return true
+}
+
+// HeaderExtensions parses the packet's header extension into its elements.
+// A packet without one has none
+func (p *RTPPacket) HeaderExtensions() ([]RTPHeaderExtension, error) {
+	if !p.Extension {
+		return nil, nil
+	}
+	return parseRTPHeaderExtensions(p.ExtensionID, p.ExtensionData)
+}
+
+// SetHeaderExtensions replaces the packet's header extension, in the
+// one-byte format when every element fits it and the two-byte one
+// otherwise. No elements remove the extension
+func (p *RTPPacket) SetHeaderExtensions(extensions []RTPHeaderExtension) {
+	if len(extensions) == 0 {
+		p.Extension, p.ExtensionID, p.ExtensionData = false, 0, nil
+		return
+	}
+	p.Extension = true
+	p.ExtensionID, p.ExtensionData = marshalRTPHeaderExtensions(extensions)
+}
+
+// parseRTPHeaderExtensions parses one-byte and two-byte header extensions,
+// skipping padding (RFC 8285 section 4)
+func parseRTPHeaderExtensions(profile uint16, data []byte) ([]RTPHeaderExtension, error) {
+	var extensions []RTPHeaderExtension
+	switch {
+	case profile == extensionProfileOneByte:
+		for i := 0; i < len(data); {
+			if data[i] == 0 {
+				i++
+				continue
+			}
+			id, length := data[i]>>4, int(data[i]&0x0F)+1
+			if id == 15 {
+				// Reserved: stop parsing (section 4.2)
+				break
+			}
+			if i+1+length > len(data) {
+				return nil, errors.New("RTP header extension element overruns the extension")
+			}
+			extensions = append(extensions, RTPHeaderExtension{ID: id, Payload: data[i+1 : i+1+length]})
+			i += 1 + length
+		}
+	case profile&0xFFF0 == extensionProfileTwoByte:
+		for i := 0; i < len(data); {
+			if data[i] == 0 {
+				i++
+				continue
+			}
+			if i+2 > len(data) {
+				return nil, errors.New("RTP header extension element overruns the extension")
+			}
+			id, length := data[i], int(data[i+1])
+			if i+2+length > len(data) {
+				return nil, errors.New("RTP header extension element overruns the extension")
+			}
+			extensions = append(extensions, RTPHeaderExtension{ID: id, Payload: data[i+2 : i+2+length]})
+			i += 2 + length
+		}
+	default:
+		return nil, ErrExtensionProfile
+	}
+	return extensions, nil
+}
+
+// marshalRTPHeaderExtensions encodes elements padded to 32-bit words
+func marshalRTPHeaderExtensions(extensions []RTPHeaderExtension) (uint16, []byte) {
+	oneByte := true
+	for _, e := range extensions {
+		if e.ID < 1 || e.ID > 14 || len(e.Payload) < 1 || len(e.Payload) > 16 {
+			oneByte = false
+		}
+	}
+
+	var data []byte
+	profile := uint16(extensionProfileOneByte)
+	if oneByte {
+		for _, e := range extensions {
+			data = append(data, e.ID<<4|byte(len(e.Payload)-1))
+			data = append(data, e.Payload...)
+		}
+	} else {
+		profile = extensionProfileTwoByte
+		for _, e := range extensions {
+			payload := e.Payload
+			if len(payload) > 255 {
+				payload = payload[:255]
+			}
+			data = append(data, e.ID, byte(len(payload)))
+			data = append(data, payload...)
+		}
+	}
+	for len(data)%4 != 0 {
+		data = append(data, 0)
+	}
+	return profile, data
+}
+
+// RewriteHeaderExtensions maps a relayed packet's header extensions from
+// the identifiers its sender negotiated to the receiver's, and drops those
+// the receiver did not negotiate. The mid extension is given the receiving
+// section's MID. A sender that negotiated none, or an extension in another
+// format, is relayed as sent. It reports whether the packet changed
+func RewriteHeaderExtensions(packet *RTPPacket, from, to RTPExtmap, mid string) bool {
+	if !packet.Extension || len(from) == 0 {
+		return false
+	}
+	extensions, err := packet.HeaderExtensions()
+	if err != nil {
+		return false
+	}
+
+	rewritten := make([]RTPHeaderExtension, 0, len(extensions))
+	for _, e := range extensions {
+		uri, ok := from[e.ID]
+		if !ok {
+			continue
+		}
+		id := to.ID(uri)
+		if id == 0 {
+			continue
+		}
+		if uri == ExtmapMID && mid != "" {
+			e.Payload = []byte(mid)
+		}
+		rewritten = append(rewritten, RTPHeaderExtension{ID: id, Payload: e.Payload})
+	}
+	packet.SetHeaderExtensions(rewritten)
+	return true
+}
+
+// headerExtension returns the payload of the element with an identifier
+func (p *RTPPacket) headerExtension(id uint8) ([]byte, bool) {
+	if id == 0 {
+		return nil, false
+	}
+	extensions, err := p.HeaderExtensions()
+	if err != nil {
+		return nil, false
+	}
+	for _, e := range extensions {
+		if e.ID == id {
+			return e.Payload, true
+		}
+	}
+	return nil, false
+}
+
+// AudioLevel returns the level of the audio in a packet from its
+// client-to-mixer audio level extension (RFC 6464): in dBov, 0 to -127, and
+// whether the sender detected voice
+func (p *RTPPacket) AudioLevel(id uint8) (level float64, voice bool, ok bool) {
+	payload, ok := p.headerExtension(id)
+	if !ok {
+		return 0, false, false
+	}
+	return parseAudioLevel(payload)
+}
+
+// parseAudioLevel parses the payload of an audio level extension
+func parseAudioLevel(payload []byte) (level float64, voice bool, ok bool) {
+	if len(payload) < 1 {
+		return 0, false, false
+	}
+	return -float64(payload[0] & 0x7F), payload[0]&0x80 != 0, true
+}
+
+// AbsSendTime returns the send time in an abs-send-time extension: a 6.18
+// fixed point fraction of seconds, wrapping every 64 seconds
+func (p *RTPPacket) AbsSendTime(id uint8) (time.Duration, bool) {
+	payload, ok := p.headerExtension(id)
+	if !ok || len(payload) < 3 {
+		return 0, false
+	}
+	value := uint64(payload[0])<<16 | uint64(binary.BigEndian.Uint16(payload[1:3]))
+	return time.Duration(value * uint64(time.Second) >> 18), true
+}
@@ -0,0 +1,196 @@
+package internal
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	ng "karl/internal/ng_protocol"
+
+	"github.com/pion/rtp"
+)
+
+func TestRTPHeaderExtensions_RoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		extensions []RTPHeaderExtension
+		profile    uint16
+	}{
+		{"one-byte", []RTPHeaderExtension{{ID: 1, Payload: []byte{0x85}}, {ID: 3, Payload: []byte{1, 2, 3}}}, 0xBEDE},
+		{"two-byte for a long element", []RTPHeaderExtension{{ID: 1, Payload: bytes.Repeat([]byte{7}, 17)}}, 0x1000},
+		{"two-byte for a high identifier", []RTPHeaderExtension{{ID: 20, Payload: []byte("a")}}, 0x1000},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			packet := &RTPPacket{}
+			packet.SetHeaderExtensions(tc.extensions)
+			if !packet.Extension || packet.ExtensionID != tc.profile || len(packet.ExtensionData)%4 != 0 {
+				t.Fatalf("profile %#x with %d bytes, want %#x in whole words", packet.ExtensionID, len(packet.ExtensionData), tc.profile)
+			}
+
+			// Karl's encoding parses the same as pion's
+			raw := marshalRTPPacket(packet, make([]byte, 0, 1500))
+			var decoded rtp.Packet
+			if err := decoded.Unmarshal(raw); err != nil {
+				t.Fatal(err)
+			}
+			got, err := packet.HeaderExtensions()
+			if err != nil || len(got) != len(tc.extensions) {
+				t.Fatalf("parsed %v, %v", got, err)
+			}
+			for i, e := range tc.extensions {
+				if got[i].ID != e.ID || !bytes.Equal(got[i].Payload, e.Payload) || !bytes.Equal(decoded.GetExtension(e.ID), e.Payload) {
+					t.Errorf("element %d: got %v, pion %x, want %v", i, got[i], decoded.GetExtension(e.ID), e)
+				}
+			}
+		})
+	}
+
+	packet := &RTPPacket{Extension: true, ExtensionID: 0xABAC, ExtensionData: make([]byte, 4)}
+	if _, err := packet.HeaderExtensions(); err != ErrExtensionProfile {
+		t.Errorf("parsed a non-RFC 8285 extension: %v", err)
+	}
+}
+
+func TestRewriteHeaderExtensions(t *testing.T) {
+	from := RTPExtmap{1: ExtmapAudioLevel, 2: ExtmapMID, 3: ExtmapAbsSendTime}
+	to := RTPExtmap{5: ExtmapAudioLevel, 6: ExtmapMID}
+
+	packet := &RTPPacket{}
+	packet.SetHeaderExtensions([]RTPHeaderExtension{
+		{ID: 1, Payload: []byte{0x80 | 30}},
+		{ID: 2, Payload: []byte("0")},
+		{ID: 3, Payload: []byte{0, 0, 1}},
+		{ID: 9, Payload: []byte{1}},
+	})
+	if !RewriteHeaderExtensions(packet, from, to, "audio") {
+		t.Fatal("packet not rewritten")
+	}
+	if level, voice, ok := packet.AudioLevel(5); !ok || level != -30 || !voice {
+		t.Errorf("audio level %v %v %v, want -30 dBov with voice", level, voice, ok)
+	}
+	if mid, _ := packet.headerExtension(6); string(mid) != "audio" {
+		t.Errorf("mid %q, want the receiving section's", mid)
+	}
+	if extensions, _ := packet.HeaderExtensions(); len(extensions) != 2 {
+		t.Errorf("kept %v, want only the receiver's extensions", extensions)
+	}
+
+	// A receiver without extensions gets none
+	RewriteHeaderExtensions(packet, to, nil, "")
+	if packet.Extension {
+		t.Error("extension kept towards a receiver that negotiated none")
+	}
+}
+
+func TestSDPExtmap(t *testing.T) {
+	desc, err := ParseSDP(sipOfferSDP +
+		"a=extmap:1 " + ExtmapAudioLevel + " vad=on\r\n" +
+		"a=extmap:2/sendonly " + ExtmapAbsSendTime + "\r\n" +
+		"a=extmap:3/inactive " + ExtmapMID + "\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	extmap := SDPExtmap(desc, desc.MediaDescriptions[0])
+	if len(extmap) != 2 || extmap[1] != ExtmapAudioLevel || extmap[2] != ExtmapAbsSendTime {
+		t.Errorf("unexpected extmap %v", extmap)
+	}
+
+	out := RewriteSDP(desc, &SDPRewrite{LocalIP: "198.51.100.1", StripExtmap: true,
+		Media: []SDPMediaRewrite{{RTPPort: 30000, RTCPPort: 30001, Protocol: "RTP/AVP"}}})
+	if strings.Contains(out, "a=extmap") {
+		t.Errorf("strip-extmap kept header extensions:\n%s", out)
+	}
+}
+
+func TestSessionForwarder_RewritesHeaderExtensions(t *testing.T) {
+	control, err := NewRTPControl(nil, nil)
+	if err != nil {
+		t.Fatalf("NewRTPControl failed: %v", err)
+	}
+	defer control.Stop()
+	forwardThroughPool(t, control)
+
+	manager, registry, _ := newTestSessionManager(t)
+	manager.SetMediaPortOpener(control.OpenMediaPorts)
+	registry.SetMediaSender(control.SendBatchFrom)
+	defer registry.SetMediaSender(nil)
+	listener := &NGSocketListener{sessionRegistry: registry, sessionManager: manager, config: &Config{}}
+
+	parties := make([]*net.UDPConn, 2)
+	for i := range parties {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		parties[i] = conn
+	}
+
+	// The offerer maps audio level to 1 and abs-send-time to 2; the
+	// answerer takes audio level only, as 4
+	offer := endpointSDP(parties[0]) + "a=extmap:1 " + ExtmapAudioLevel + "\r\na=extmap:2 " + ExtmapAbsSendTime + "\r\n"
+	resp, err := listener.handleOffer(&ng.NGRequest{CallID: "extmap-call", FromTag: "from-tag", SDP: offer})
+	if err != nil || resp.Result != ng.ResultOK {
+		t.Fatalf("handleOffer failed: %v %+v", err, resp)
+	}
+	defer GetCodecNegotiator().RemoveCall("extmap-call")
+	if !strings.Contains(resp.SDP, "a=extmap:1 "+ExtmapAudioLevel) {
+		t.Fatalf("extmap not passed to the answerer:\n%s", resp.SDP)
+	}
+	answer := endpointSDP(parties[1]) + "a=extmap:4 " + ExtmapAudioLevel + "\r\n"
+	if resp, err := listener.handleAnswer(&ng.NGRequest{CallID: "extmap-call", FromTag: "from-tag", ToTag: "to-tag", SDP: answer}); err != nil || resp.Result != ng.ResultOK {
+		t.Fatalf("handleAnswer failed: %v %+v", err, resp)
+	}
+
+	session := registry.GetSessionByCallID("extmap-call")[0]
+	session.RLock()
+	calleeLeg := session.CalleeLeg
+	session.RUnlock()
+	if err := registry.RegisterSSRC(session.ID, 0xE1, true); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := &rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: 1, Timestamp: 160, SSRC: 0xE1}, Payload: make([]byte, 160)}
+	if err := sent.SetExtension(1, []byte{0x80 | 25}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sent.SetExtension(2, []byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := sent.Marshal()
+
+	var got rtp.Packet
+	if err := got.Unmarshal(relayed(t, parties[0], parties[1], calleeLeg.LocalPort, raw)); err != nil {
+		t.Fatal(err)
+	}
+	if level := got.GetExtension(4); !bytes.Equal(level, []byte{0x80 | 25}) {
+		t.Errorf("audio level %x under the answerer's identifier, want %x", level, 0x80|25)
+	}
+	if ids := got.GetExtensionIDs(); len(ids) != 1 {
+		t.Errorf("relayed extensions %v, want only the one the answerer took", ids)
+	}
+	if !bytes.Equal(got.Payload, sent.Payload) {
+		t.Error("payload changed")
+	}
+}
+
+func TestConferenceParticipant_ReportedAudioLevel(t *testing.T) {
+	p := &ConferenceParticipant{gain: 1, level: conferenceSilenceLevel}
+	now := time.Now()
+
+	// Quiet decoded audio, but the client reports voice at -20 dBov
+	p.push(make([]int16, 160), 800)
+	p.reportLevel(-20, true, now)
+	if p.take(160, -50, now) == nil || !p.speaking || p.level != -20 {
+		t.Errorf("speaking %v at %v dBFS, want the reported level", p.speaking, p.level)
+	}
+
+	// A stale report no longer counts
+	p.push(make([]int16, 160), 800)
+	later := now.Add(time.Second)
+	if p.take(160, -50, later); p.speaking || p.level != conferenceSilenceLevel {
+		t.Errorf("speaking %v at %v dBFS after the report went stale", p.speaking, p.level)
+	}
+}
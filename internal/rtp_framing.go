@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// RFC 4571 carries RTP and RTCP over TCP and TLS with a 16-bit length in
+// network order before each packet, so packet boundaries survive the stream
+
+// maxRTPFrameSize is the largest packet a 16-bit length can frame
+const maxRTPFrameSize = 65535
+
+var errRTPFrameTooLarge = errors.New("packet too large for RFC 4571 framing")
+
+// readRTPFrame reads the next framed packet into buf, allocating a larger
+// buffer when the packet does not fit. An empty frame returns an empty
+// packet
+func readRTPFrame(r io.Reader, buf []byte) ([]byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(header[:]))
+	if n > cap(buf) {
+		buf = make([]byte, n)
+	}
+	buf = buf[:n]
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+// appendRTPFrame appends packet to dst behind its length
+func appendRTPFrame(dst, packet []byte) ([]byte, error) {
+	if len(packet) > maxRTPFrameSize {
+		return dst, errRTPFrameTooLarge
+	}
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(packet)))
+	return append(dst, packet...), nil
+}
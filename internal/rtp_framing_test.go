@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+func TestRTPFraming_RoundTrip(t *testing.T) {
+	packets := [][]byte{{0x80, 0, 0, 1}, {}, bytes.Repeat([]byte{0xAB}, 3000)}
+
+	var stream []byte
+	for _, p := range packets {
+		var err error
+		if stream, err = appendRTPFrame(stream, p); err != nil {
+			t.Fatalf("appendRTPFrame: %v", err)
+		}
+	}
+
+	// Frames survive being read a byte at a time, as TCP may deliver them
+	reader := iotest.OneByteReader(bytes.NewReader(stream))
+	buf := make([]byte, rtpBufferSize)
+	for i, want := range packets {
+		got, err := readRTPFrame(reader, buf)
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("frame %d: expected %d bytes, got %d", i, len(want), len(got))
+		}
+	}
+	if _, err := readRTPFrame(reader, buf); err != io.EOF {
+		t.Errorf("expected io.EOF at the end of the stream, got %v", err)
+	}
+}
+
+func TestRTPFraming_Errors(t *testing.T) {
+	if _, err := appendRTPFrame(nil, make([]byte, maxRTPFrameSize+1)); err != errRTPFrameTooLarge {
+		t.Errorf("expected errRTPFrameTooLarge, got %v", err)
+	}
+
+	// A stream cut inside a packet is an error, not a short packet
+	truncated := []byte{0, 10, 0x80, 0}
+	if _, err := readRTPFrame(bytes.NewReader(truncated), nil); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestRTPControl_StreamForwarding(t *testing.T) {
+	control, err := NewRTPControl(nil, nil)
+	if err != nil {
+		t.Fatalf("NewRTPControl failed: %v", err)
+	}
+	defer control.Stop()
+	forwardThroughPool(t, control)
+
+	// A TCP destination that collects what Karl forwards
+	destination, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer destination.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := destination.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	if err := control.AddStreamDestination(destination.Addr().String(), nil); err != nil {
+		t.Fatalf("AddStreamDestination: %v", err)
+	}
+
+	if err := control.StartRTPStreamListener("127.0.0.1:0", nil); err != nil {
+		t.Fatalf("StartRTPStreamListener: %v", err)
+	}
+	control.mu.RLock()
+	listenAddr := control.streamListeners[0].Addr().String()
+	control.mu.RUnlock()
+
+	// Two packets sent in one write arrive as two packets
+	var stream []byte
+	for seq := uint16(1); seq <= 2; seq++ {
+		packet, _ := (&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: seq, SSRC: 0x1234}, Payload: []byte{1, 2, 3}}).Marshal()
+		stream, _ = appendRTPFrame(stream, packet)
+	}
+	client, err := net.Dial("tcp", listenAddr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+	if _, err := client.Write(stream); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	var conn net.Conn
+	select {
+	case conn = <-accepted:
+	case <-time.After(time.Second):
+		t.Fatal("destination was not connected")
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(conn)
+	for seq := uint16(1); seq <= 2; seq++ {
+		frame, err := readRTPFrame(reader, nil)
+		if err != nil {
+			t.Fatalf("reading forwarded packet %d: %v", seq, err)
+		}
+		var packet rtp.Packet
+		if err := packet.Unmarshal(frame); err != nil {
+			t.Fatalf("forwarded packet %d: %v", seq, err)
+		}
+		if packet.SequenceNumber != seq || packet.SSRC != 0x1234 {
+			t.Errorf("expected sequence %d of SSRC 0x1234, got %d of 0x%x", seq, packet.SequenceNumber, packet.SSRC)
+		}
+	}
+}
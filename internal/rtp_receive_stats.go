@@ -0,0 +1,387 @@
+package internal
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+// Sequence validation constants from RFC 3550 Appendix A.1
+const (
+	rtpSeqMod        = 1 << 16
+	rtpMaxDropout    = 3000
+	rtpMaxMisorder   = 100
+	rtpMinSequential = 2
+
+	// maxReceptionReports is the largest report count an SR/RR can carry
+	maxReceptionReports = 31
+
+	// defaultStatsClockRate is used when the stream's codec is not known
+	defaultStatsClockRate = 8000
+)
+
+// ReceiveStats tracks reception statistics for a single RTP source as
+// described in RFC 3550 Appendix A.1 (sequence validation), A.3 (loss)
+// and A.8 (interarrival jitter)
+type ReceiveStats struct {
+	ssrc      uint32
+	clockRate uint32
+
+	// Sequence state
+	maxSeq    uint16
+	cycles    uint32
+	baseSeq   uint32
+	badSeq    uint32
+	probation int
+	received  uint32
+	started   bool
+
+	// Interval state for fraction lost
+	expectedPrior uint32
+	receivedPrior uint32
+
+	// Jitter state (in timestamp units)
+	transit     int64
+	jitter      float64
+	hasTransit  bool
+	reference   time.Time
+	lastArrival time.Time
+
+	// Loss pattern and packet spacing for RTCP XR
+	loss          lossPattern
+	lastTimestamp uint32
+	frameTicks    uint32 // timestamp step between consecutive packets
+
+	// Last SR received from this source, for LSR/DLSR
+	lastSRNTP  uint64
+	lastSRTime time.Time
+
+	mu sync.Mutex
+}
+
+// NewReceiveStats creates a receive statistics tracker for one source
+func NewReceiveStats(ssrc uint32, clockRate uint32) *ReceiveStats {
+	if clockRate == 0 {
+		clockRate = defaultStatsClockRate
+	}
+	return &ReceiveStats{
+		ssrc:      ssrc,
+		clockRate: clockRate,
+	}
+}
+
+// initSeq resets the sequence state to start at seq
+func (s *ReceiveStats) initSeq(seq uint16) {
+	s.baseSeq = uint32(seq)
+	s.maxSeq = seq
+	s.badSeq = rtpSeqMod + 1
+	s.cycles = 0
+	s.received = 0
+	s.receivedPrior = 0
+	s.expectedPrior = 0
+}
+
+// updateSeq validates a sequence number and reports whether the packet counts
+func (s *ReceiveStats) updateSeq(seq uint16) bool {
+	udelta := seq - s.maxSeq
+
+	if s.probation > 0 {
+		// Source is not valid until MIN_SEQUENTIAL packets in sequence are received
+		if seq == s.maxSeq+1 {
+			s.probation--
+			s.maxSeq = seq
+			if s.probation == 0 {
+				s.initSeq(seq)
+				s.received++
+				return true
+			}
+		} else {
+			s.probation = rtpMinSequential - 1
+			s.maxSeq = seq
+		}
+		return false
+	} else if udelta < rtpMaxDropout {
+		// In order, with permissible gap
+		if seq < s.maxSeq {
+			s.cycles += rtpSeqMod
+		}
+		s.maxSeq = seq
+	} else if uint32(udelta) <= rtpSeqMod-rtpMaxMisorder {
+		// The sequence number made a very large jump
+		if uint32(seq) == s.badSeq {
+			// Two sequential packets: assume the other side restarted
+			s.initSeq(seq)
+		} else {
+			s.badSeq = (uint32(seq) + 1) & (rtpSeqMod - 1)
+			return false
+		}
+	}
+	// Otherwise a duplicate or reordered packet, which still counts as received
+
+	s.received++
+	return true
+}
+
+// Update records an incoming RTP packet
+func (s *ReceiveStats) Update(seq uint16, timestamp uint32, arrival time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.started {
+		s.started = true
+		s.initSeq(seq)
+		s.maxSeq = seq - 1
+		s.probation = rtpMinSequential
+		s.reference = arrival
+	}
+
+	prevMax := s.extendedMax()
+	if !s.updateSeq(seq) {
+		return
+	}
+	s.lastArrival = arrival
+	s.updateLossPattern(prevMax, timestamp)
+
+	// Interarrival jitter per RFC 3550 A.8, with arrival expressed in timestamp units
+	arrivalTS := int64(arrival.Sub(s.reference).Seconds() * float64(s.clockRate))
+	transit := arrivalTS - int64(timestamp)
+	if s.hasTransit {
+		d := transit - s.transit
+		if d < 0 {
+			d = -d
+		}
+		s.jitter += (float64(d) - s.jitter) / 16.0
+	}
+	s.transit = transit
+	s.hasTransit = true
+}
+
+// updateLossPattern feeds the packet and any gap before it to the loss
+// pattern. Late packets were already counted as lost and are left out
+func (s *ReceiveStats) updateLossPattern(prevMax, timestamp uint32) {
+	ext := s.extendedMax()
+	switch {
+	case s.received == 1:
+		s.loss = lossPattern{}
+	case ext == prevMax+1:
+		if step := timestamp - s.lastTimestamp; step > 0 && step < s.clockRate {
+			s.frameTicks = step
+		}
+	case ext > prevMax+1:
+		s.loss.lost(uint64(ext - prevMax - 1))
+	default:
+		return
+	}
+	s.loss.received(1)
+	s.lastTimestamp = timestamp
+}
+
+// RecordSenderReport stores the NTP time of an SR received from this source
+func (s *ReceiveStats) RecordSenderReport(ntpTime uint64, received time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSRNTP = ntpTime
+	s.lastSRTime = received
+}
+
+// extendedMax returns the extended highest sequence number received
+func (s *ReceiveStats) extendedMax() uint32 {
+	return s.cycles + uint32(s.maxSeq)
+}
+
+// cumulativeLost returns the number of packets lost since the start of reception
+func (s *ReceiveStats) cumulativeLost() int32 {
+	expected := int64(s.extendedMax()) - int64(s.baseSeq) + 1
+	lost := expected - int64(s.received)
+
+	// Clamp to the 24-bit signed field in the report block
+	if lost > 0x7FFFFF {
+		lost = 0x7FFFFF
+	} else if lost < -0x800000 {
+		lost = -0x800000
+	}
+	return int32(lost)
+}
+
+// ReceptionReport builds a report block and advances the loss interval
+func (s *ReceiveStats) ReceptionReport(now time.Time) rtcp.ReceptionReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expected := s.extendedMax() - s.baseSeq + 1
+	expectedInterval := expected - s.expectedPrior
+	s.expectedPrior = expected
+	receivedInterval := s.received - s.receivedPrior
+	s.receivedPrior = s.received
+
+	var fraction uint8
+	lostInterval := int64(expectedInterval) - int64(receivedInterval)
+	if expectedInterval != 0 && lostInterval > 0 {
+		fraction = uint8((lostInterval << 8) / int64(expectedInterval))
+	}
+
+	var lsr, dlsr uint32
+	if !s.lastSRTime.IsZero() {
+		// LSR is the middle 32 bits of the NTP timestamp from the last SR
+		lsr = uint32(s.lastSRNTP >> 16)
+		// DLSR is expressed in units of 1/65536 seconds
+		dlsr = uint32(now.Sub(s.lastSRTime).Seconds() * 65536)
+	}
+
+	return rtcp.ReceptionReport{
+		SSRC:               s.ssrc,
+		FractionLost:       fraction,
+		TotalLost:          uint32(s.cumulativeLost()) & 0xFFFFFF,
+		LastSequenceNumber: s.extendedMax(),
+		Jitter:             uint32(s.jitter),
+		LastSenderReport:   lsr,
+		Delay:              dlsr,
+	}
+}
+
+// ReceiveStatsSnapshot is a point-in-time view of a source's statistics
+type ReceiveStatsSnapshot struct {
+	SSRC            uint32
+	PacketsReceived uint32
+	PacketsLost     int32
+	ExtendedMaxSeq  uint32
+	Jitter          float64 // Jitter in seconds
+	BurstDensity    float64 // fraction lost within loss bursts, RFC 3611 4.7.2
+	GapDensity      float64 // fraction lost between bursts
+	LastArrival     time.Time
+}
+
+// Snapshot returns the current statistics without advancing the loss interval
+func (s *ReceiveStats) Snapshot() ReceiveStatsSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap := ReceiveStatsSnapshot{
+		SSRC:            s.ssrc,
+		PacketsReceived: s.received,
+		ExtendedMaxSeq:  s.extendedMax(),
+		Jitter:          s.jitter / float64(s.clockRate),
+		LastArrival:     s.lastArrival,
+	}
+	if s.received > 0 {
+		snap.PacketsLost = s.cumulativeLost()
+		snap.BurstDensity, snap.GapDensity, _, _ = s.loss.summary()
+	}
+	return snap
+}
+
+// ReceiveStatsTracker holds receive statistics for every source seen by the worker pool
+type ReceiveStatsTracker struct {
+	streams map[uint32]*ReceiveStats
+	mu      sync.RWMutex
+}
+
+// NewReceiveStatsTracker creates an empty tracker
+func NewReceiveStatsTracker() *ReceiveStatsTracker {
+	return &ReceiveStatsTracker{
+		streams: make(map[uint32]*ReceiveStats),
+	}
+}
+
+// Update records a packet for the given source, creating its stats on first use
+func (t *ReceiveStatsTracker) Update(ssrc uint32, seq uint16, timestamp, clockRate uint32, arrival time.Time) {
+	t.mu.RLock()
+	stats, ok := t.streams[ssrc]
+	t.mu.RUnlock()
+
+	if !ok {
+		t.mu.Lock()
+		stats, ok = t.streams[ssrc]
+		if !ok {
+			stats = NewReceiveStats(ssrc, clockRate)
+			t.streams[ssrc] = stats
+		}
+		t.mu.Unlock()
+	}
+
+	stats.Update(seq, timestamp, arrival)
+}
+
+// Get returns the statistics for a source
+func (t *ReceiveStatsTracker) Get(ssrc uint32) (*ReceiveStats, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	stats, ok := t.streams[ssrc]
+	return stats, ok
+}
+
+// Remove stops tracking a source
+func (t *ReceiveStatsTracker) Remove(ssrc uint32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.streams, ssrc)
+}
+
+// RecordSenderReport stores SR timing for a source so LSR/DLSR can be reported
+func (t *ReceiveStatsTracker) RecordSenderReport(ssrc uint32, ntpTime uint64, received time.Time) {
+	if stats, ok := t.Get(ssrc); ok {
+		stats.RecordSenderReport(ntpTime, received)
+	}
+}
+
+// Snapshots returns the current statistics of every tracked source
+func (t *ReceiveStatsTracker) Snapshots() []ReceiveStatsSnapshot {
+	t.mu.RLock()
+	streams := make([]*ReceiveStats, 0, len(t.streams))
+	for _, stats := range t.streams {
+		streams = append(streams, stats)
+	}
+	t.mu.RUnlock()
+
+	snapshots := make([]ReceiveStatsSnapshot, 0, len(streams))
+	for _, stats := range streams {
+		snapshots = append(snapshots, stats.Snapshot())
+	}
+	return snapshots
+}
+
+// BuildReceptionReports builds report blocks for up to 31 tracked sources
+func (t *ReceiveStatsTracker) BuildReceptionReports(now time.Time) []rtcp.ReceptionReport {
+	t.mu.RLock()
+	streams := make([]*ReceiveStats, 0, len(t.streams))
+	for _, stats := range t.streams {
+		streams = append(streams, stats)
+	}
+	t.mu.RUnlock()
+
+	reports := make([]rtcp.ReceptionReport, 0, len(streams))
+	for _, stats := range streams {
+		if len(reports) == maxReceptionReports {
+			break
+		}
+		stats.mu.Lock()
+		valid := stats.received > 0
+		stats.mu.Unlock()
+		if valid {
+			reports = append(reports, stats.ReceptionReport(now))
+		}
+	}
+	return reports
+}
+
+// BuildReceiverReport builds an RR carrying report blocks for all tracked sources
+func (t *ReceiveStatsTracker) BuildReceiverReport(senderSSRC uint32) *rtcp.ReceiverReport {
+	return &rtcp.ReceiverReport{
+		SSRC:    senderSSRC,
+		Reports: t.BuildReceptionReports(time.Now()),
+	}
+}
+
+// BuildSenderReport builds an SR with the given sender info and report blocks
+func (t *ReceiveStatsTracker) BuildSenderReport(senderSSRC, rtpTime, packets, octets uint32) *rtcp.SenderReport {
+	now := time.Now()
+	return &rtcp.SenderReport{
+		SSRC:        senderSSRC,
+		NTPTime:     toNTPTime(now),
+		RTPTime:     rtpTime,
+		PacketCount: packets,
+		OctetCount:  octets,
+		Reports:     t.BuildReceptionReports(now),
+	}
+}
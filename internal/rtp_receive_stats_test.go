@@ -0,0 +1,183 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+// feedSequence feeds packets spaced 20ms apart with matching 8kHz timestamps
+func feedSequence(stats *ReceiveStats, start time.Time, seqs []uint16) {
+	for _, seq := range seqs {
+		offset := time.Duration(seq-seqs[0]) * 20 * time.Millisecond
+		stats.Update(seq, uint32(seq-seqs[0])*160, start.Add(offset))
+	}
+}
+
+func TestReceiveStats_NoLoss(t *testing.T) {
+	stats := NewReceiveStats(1234, 8000)
+	seqs := make([]uint16, 50)
+	for i := range seqs {
+		seqs[i] = uint16(100 + i)
+	}
+	feedSequence(stats, time.Now(), seqs)
+
+	snap := stats.Snapshot()
+	if snap.PacketsLost != 0 {
+		t.Errorf("expected no loss, got %d", snap.PacketsLost)
+	}
+	if snap.ExtendedMaxSeq != 149 {
+		t.Errorf("expected extended max seq 149, got %d", snap.ExtendedMaxSeq)
+	}
+	if snap.Jitter > 0.001 {
+		t.Errorf("expected near-zero jitter for evenly spaced packets, got %f", snap.Jitter)
+	}
+}
+
+func TestReceiveStats_CumulativeAndFractionLost(t *testing.T) {
+	stats := NewReceiveStats(1, 8000)
+	start := time.Now()
+
+	// Packets 0-9 with 2, 5 and 7 missing after the probation period
+	for _, seq := range []uint16{0, 1, 3, 4, 6, 8, 9} {
+		stats.Update(seq, uint32(seq)*160, start.Add(time.Duration(seq)*20*time.Millisecond))
+	}
+
+	report := stats.ReceptionReport(time.Now())
+	if report.SSRC != 1 {
+		t.Errorf("expected report SSRC 1, got %d", report.SSRC)
+	}
+	if report.TotalLost != 3 {
+		t.Errorf("expected 3 packets lost, got %d", report.TotalLost)
+	}
+	if report.LastSequenceNumber != 9 {
+		t.Errorf("expected highest seq 9, got %d", report.LastSequenceNumber)
+	}
+	// 3 lost of 9 expected since base seq 1
+	if expected := uint8(3 * 256 / 9); report.FractionLost != expected {
+		t.Errorf("expected fraction lost %d, got %d", expected, report.FractionLost)
+	}
+
+	// The next interval without loss should report zero fraction lost
+	for seq := uint16(10); seq < 20; seq++ {
+		stats.Update(seq, uint32(seq)*160, start.Add(time.Duration(seq)*20*time.Millisecond))
+	}
+	report = stats.ReceptionReport(time.Now())
+	if report.FractionLost != 0 {
+		t.Errorf("expected zero fraction lost for clean interval, got %d", report.FractionLost)
+	}
+	if report.TotalLost != 3 {
+		t.Errorf("expected cumulative loss to stay 3, got %d", report.TotalLost)
+	}
+}
+
+func TestReceiveStats_SequenceWrap(t *testing.T) {
+	stats := NewReceiveStats(1, 8000)
+	start := time.Now()
+
+	seq := uint16(65530)
+	for i := 0; i < 12; i++ {
+		stats.Update(seq, uint32(i)*160, start.Add(time.Duration(i)*20*time.Millisecond))
+		seq++
+	}
+
+	snap := stats.Snapshot()
+	if snap.ExtendedMaxSeq != 65536+5 {
+		t.Errorf("expected extended max seq %d, got %d", 65536+5, snap.ExtendedMaxSeq)
+	}
+	if snap.PacketsLost != 0 {
+		t.Errorf("expected no loss across wrap, got %d", snap.PacketsLost)
+	}
+}
+
+func TestReceiveStats_Jitter(t *testing.T) {
+	stats := NewReceiveStats(1, 8000)
+	start := time.Now()
+
+	// Alternate arrival offsets of 0ms and 10ms on a 20ms cadence
+	for i := 0; i < 200; i++ {
+		arrival := start.Add(time.Duration(i) * 20 * time.Millisecond)
+		if i%2 == 1 {
+			arrival = arrival.Add(10 * time.Millisecond)
+		}
+		stats.Update(uint16(i), uint32(i)*160, arrival)
+	}
+
+	// Every transit difference is 80 timestamp units (10ms at 8kHz)
+	jitter := stats.Snapshot().Jitter
+	if jitter < 0.009 || jitter > 0.011 {
+		t.Errorf("expected jitter around 10ms, got %fs", jitter)
+	}
+}
+
+func TestReceiveStats_LastSenderReport(t *testing.T) {
+	stats := NewReceiveStats(1, 8000)
+	feedSequence(stats, time.Now(), []uint16{1, 2, 3})
+
+	srTime := time.Now().Add(-500 * time.Millisecond)
+	ntp := toNTPTime(srTime)
+	stats.RecordSenderReport(ntp, srTime)
+
+	report := stats.ReceptionReport(time.Now())
+	if report.LastSenderReport != uint32(ntp>>16) {
+		t.Errorf("expected LSR %d, got %d", uint32(ntp>>16), report.LastSenderReport)
+	}
+	delay := float64(report.Delay) / 65536
+	if delay < 0.45 || delay > 1.0 {
+		t.Errorf("expected DLSR around 0.5s, got %fs", delay)
+	}
+}
+
+func TestReceiveStatsTracker_BuildReports(t *testing.T) {
+	tracker := NewReceiveStatsTracker()
+	start := time.Now()
+
+	for i := 0; i < 10; i++ {
+		arrival := start.Add(time.Duration(i) * 20 * time.Millisecond)
+		tracker.Update(0xAAAA, uint16(i), uint32(i)*160, 8000, arrival)
+		tracker.Update(0xBBBB, uint16(i+500), uint32(i)*960, 48000, arrival)
+	}
+
+	rr := tracker.BuildReceiverReport(0x1)
+	if rr.SSRC != 0x1 {
+		t.Errorf("expected RR sender SSRC 1, got %d", rr.SSRC)
+	}
+	if len(rr.Reports) != 2 {
+		t.Fatalf("expected 2 report blocks, got %d", len(rr.Reports))
+	}
+
+	sr := tracker.BuildSenderReport(0x1, 1000, 50, 8000)
+	if sr.PacketCount != 50 || sr.OctetCount != 8000 {
+		t.Errorf("expected sender counts 50/8000, got %d/%d", sr.PacketCount, sr.OctetCount)
+	}
+	if len(sr.Reports) != 2 {
+		t.Errorf("expected 2 report blocks in SR, got %d", len(sr.Reports))
+	}
+
+	tracker.Remove(0xAAAA)
+	if _, ok := tracker.Get(0xAAAA); ok {
+		t.Error("expected source to be removed")
+	}
+}
+
+func TestRTCPSessionHandler_ReportUsesRemoteSSRC(t *testing.T) {
+	handler := NewRTCPSessionHandler(0x1111, "karl@test", 8000)
+	handler.SetRemoteSSRC(0x2222)
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		handler.UpdateReceiverStats(uint16(i), uint32(i)*160, start.Add(time.Duration(i)*20*time.Millisecond))
+	}
+
+	rr := handler.buildReceiverReport()
+	if len(rr.Reports) != 1 {
+		t.Fatalf("expected 1 report block, got %d", len(rr.Reports))
+	}
+	if rr.Reports[0].SSRC != 0x2222 {
+		t.Errorf("expected report about remote SSRC 0x2222, got 0x%X", rr.Reports[0].SSRC)
+	}
+
+	stats := handler.GetStats()
+	if stats.PacketsRecv != 9 {
+		t.Errorf("expected 9 packets counted after probation, got %d", stats.PacketsRecv)
+	}
+}
@@ -0,0 +1,209 @@
+package internal
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// rtpStreamDialTimeout bounds connecting to a TCP or TLS destination
+	rtpStreamDialTimeout = 5 * time.Second
+	// rtpStreamWriteTimeout keeps a stalled TCP peer from holding up the
+	// other destinations; the connection is closed when it expires
+	rtpStreamWriteTimeout = 200 * time.Millisecond
+)
+
+// rtpStreamConn is a TCP or TLS forwarding destination. Each packet is
+// framed and written with one write, so concurrent forwarders never
+// interleave frames
+type rtpStreamConn struct {
+	conn   net.Conn
+	mu     sync.Mutex
+	frame  []byte
+	broken bool
+}
+
+// write sends one framed packet and returns the bytes written. A failed
+// write may have sent part of a frame, so the connection is closed and
+// every later write fails
+func (s *rtpStreamConn) write(packet []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.broken {
+		return 0, net.ErrClosed
+	}
+
+	var err error
+	if s.frame, err = appendRTPFrame(s.frame[:0], packet); err != nil {
+		return 0, err
+	}
+	_ = s.conn.SetWriteDeadline(time.Now().Add(rtpStreamWriteTimeout))
+	n, err := s.conn.Write(s.frame)
+	if err != nil {
+		s.broken = true
+		s.conn.Close()
+	}
+	return n, err
+}
+
+// StartRTPStreamListener accepts RTP over TCP, or over TLS when tlsConfig
+// is set, framed per RFC 4571. Packets read from the streams are handled
+// like packets arriving on the UDP port, RTCP included
+func (r *RTPControl) StartRTPStreamListener(addr string, tlsConfig *tls.Config) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to start RTP stream listener: %w", err)
+	}
+	transport := "tcp"
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+		transport = "tls"
+	}
+
+	r.mu.Lock()
+	if r.stopped {
+		r.mu.Unlock()
+		listener.Close()
+		return fmt.Errorf("RTP control is stopped")
+	}
+	r.streamListeners = append(r.streamListeners, listener)
+	r.mu.Unlock()
+
+	rtpLog.Info("RTP stream listener started", "addr", addr, "transport", transport)
+	go r.acceptRTPStreams(listener)
+	return nil
+}
+
+// acceptRTPStreams serves every connection of a stream listener until it
+// is closed
+func (r *RTPControl) acceptRTPStreams(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			r.mu.RLock()
+			stopped := r.stopped
+			r.mu.RUnlock()
+			if stopped {
+				return
+			}
+			if rtpReadErrors.Allow() {
+				rtpReadErrors.Log("RTP stream accept error", "error", err)
+			}
+			continue
+		}
+		go r.serveRTPStream(conn)
+	}
+}
+
+// serveRTPStream reads framed packets from one connection and queues them
+// on the worker pool in the order they arrived
+func (r *RTPControl) serveRTPStream(conn net.Conn) {
+	defer conn.Close()
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		MarkRTPConn(tcp)
+	}
+
+	// The source filter and RTCP demuxer key on UDP addresses
+	var from *net.UDPAddr
+	if tcp, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		from = &net.UDPAddr{IP: tcp.IP, Port: tcp.Port, Zone: tcp.Zone}
+	}
+	local := captureAddr(conn.LocalAddr())
+
+	reader := bufio.NewReader(conn)
+	buf := make([]byte, rtpBufferSize)
+	for {
+		packet, err := readRTPFrame(reader, buf)
+		if err != nil {
+			rtpLog.Debug("RTP stream closed", "from", conn.RemoteAddr(), "error", err)
+			return
+		}
+		if len(packet) == 0 {
+			continue
+		}
+
+		atomic.AddUint64(&r.packetsReceived, 1)
+		atomic.AddUint64(&r.bytesReceived, uint64(len(packet)))
+
+		if !r.sourceAllowed(nil, packet, from) {
+			atomic.AddUint64(&r.packetsDropped, 1)
+			continue
+		}
+		if IsRTCPPacket(packet) {
+			r.handleMuxedRTCP(packet, from)
+			continue
+		}
+		_ = r.receiveRTPPacket(copyPacketBuffer(packet), from, local, time.Now())
+	}
+}
+
+// AddStreamDestination adds a destination that RTP is forwarded to over
+// TCP, or over TLS when tlsConfig is set, framed per RFC 4571
+func (r *RTPControl) AddStreamDestination(addr string, tlsConfig *tls.Config) error {
+	r.mu.RLock()
+	_, exists := r.streamDestinations[addr]
+	var local *net.UDPAddr
+	if tcpAddr, err := net.ResolveTCPAddr("tcp", addr); err == nil {
+		local = r.egressAddr(tcpAddr.IP)
+	}
+	r.mu.RUnlock()
+	if exists {
+		return nil
+	}
+
+	dialer := &net.Dialer{Timeout: rtpStreamDialTimeout}
+	if local != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: local.IP}
+	}
+	var conn net.Conn
+	var err error
+	if tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to RTP stream destination: %w", err)
+	}
+	MarkRTPConn(conn)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.streamDestinations[addr]; exists || r.stopped {
+		conn.Close()
+		return nil
+	}
+	if r.streamDestinations == nil {
+		r.streamDestinations = make(map[string]*rtpStreamConn)
+	}
+	r.streamDestinations[addr] = &rtpStreamConn{conn: conn}
+	rtpLog.Info("Added RTP stream destination", "addr", addr, "tls", tlsConfig != nil)
+	return nil
+}
+
+// forwardStreams sends packets to every TCP and TLS destination. Callers
+// hold r.mu
+func (r *RTPControl) forwardStreams(packets ...[]byte) error {
+	var lastErr error
+	for addr, stream := range r.streamDestinations {
+		for _, packet := range packets {
+			n, err := stream.write(packet)
+			if err != nil {
+				atomic.AddUint64(&r.packetsDropped, 1)
+				IncrementDroppedPackets()
+				if rtpForwardErrors.Allow() {
+					rtpForwardErrors.Log("Failed to forward packet", "addr", addr, "error", err)
+				}
+				lastErr = err
+				continue
+			}
+			atomic.AddUint64(&r.bytesSent, uint64(n))
+		}
+	}
+	return lastErr
+}
@@ -1,10 +1,12 @@
 package internal
 
 import (
+	"bufio"
 	"crypto/tls"
 	"log"
 	"net"
 	"sync"
+	"time"
 )
 
 // RTP Transport settings
@@ -13,26 +15,39 @@ var (
 	rtpMutex     sync.Mutex
 )
 
-// StartRTPUDPListener starts a UDP listener for RTP traffic
+// StartRTPUDPListener starts a UDP listener for RTP traffic, reading a
+// batch of packets per system call where the platform supports it
 func StartRTPUDPListener(address string) {
-	conn, err := net.ListenPacket("udp", address)
+	udpAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		log.Fatalf("Failed to resolve UDP RTP address: %v", err)
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
 	if err != nil {
 		log.Fatalf("Failed to start UDP RTP listener: %v", err)
 	}
 	defer conn.Close()
+	MarkRTPConn(conn)
+	SetDontFragment(conn)
 
-	log.Println("RTP UDP listener started on", address)
+	rtpLog.Info("RTP UDP listener started", "addr", address)
 
-	buf := make([]byte, 1500)
+	batch := newBatchConn(conn, BatchConfig{})
 	for {
-		n, addr, err := conn.ReadFrom(buf)
+		packets, err := batch.readBatch()
+		received := time.Now()
 		if err != nil {
-			log.Println("UDP RTP read error:", err)
+			if rtpReadErrors.Allow() {
+				rtpReadErrors.Log("UDP RTP read error", "error", err)
+			}
 			continue
 		}
 
-		// Handle incoming RTP packet
-		go handleRTPPacket(buf[:n], addr)
+		// Handle incoming RTP packets; the worker pool takes over the buffers
+		for _, p := range packets {
+			*p.buf = p.data
+			handleRTPPacket(p.buf, p.addr, received)
+		}
 	}
 }
 
@@ -48,12 +63,12 @@ func StartRTPTCPListener(address string) {
 	rtpListeners[address] = listener
 	rtpMutex.Unlock()
 
-	log.Println("RTP TCP listener started on", address)
+	rtpLog.Info("RTP TCP listener started", "addr", address)
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Println("TCP RTP accept error:", err)
+			rtpLog.Error("TCP RTP accept error", "error", err)
 			continue
 		}
 		go handleRTPStream(conn)
@@ -79,44 +94,54 @@ func StartRTPTLSListener(address, certFile, keyFile string) {
 	rtpListeners[address] = listener
 	rtpMutex.Unlock()
 
-	log.Println("RTP TLS listener started on", address)
+	rtpLog.Info("RTP TLS listener started", "addr", address)
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Println("TLS RTP accept error:", err)
+			rtpLog.Error("TLS RTP accept error", "error", err)
 			continue
 		}
 		go handleRTPStream(conn)
 	}
 }
 
-// handleRTPPacket processes incoming RTP packets
-func handleRTPPacket(packet []byte, addr net.Addr) {
+// handleRTPPacket captures an incoming RTP packet read at received and
+// queues it on the worker pool, which takes over buf
+func handleRTPPacket(buf *[]byte, addr net.Addr, received time.Time) {
 	// Capture RTP packets for debugging if PCAP logging is enabled
-	CapturePacket(packet)
+	CapturePacket(*buf, captureAddr(addr), nil)
 
-	// Process RTP packet (this can include transcoding, forwarding, etc.)
-	log.Printf("Received RTP packet from %s, size: %d bytes", addr.String(), len(packet))
+	if rtpPacketTrace.Allow() {
+		rtpPacketTrace.Log("Received RTP packet", "from", addr, "size", len(*buf))
+	}
+	queueRTPJob(buf, received)
 }
 
-// handleRTPStream handles incoming RTP streams over TCP/TLS
+// handleRTPStream handles incoming RTP streams over TCP/TLS, one RFC 4571
+// framed packet at a time
 func handleRTPStream(conn net.Conn) {
 	defer conn.Close()
-	buf := make([]byte, 1500)
+	reader := bufio.NewReader(conn)
+	buf := make([]byte, rtpBufferSize)
 
 	for {
-		n, err := conn.Read(buf)
+		packet, err := readRTPFrame(reader, buf)
 		if err != nil {
-			log.Println("RTP stream read error:", err)
+			rtpLog.Debug("RTP stream closed", "from", conn.RemoteAddr(), "error", err)
 			break
 		}
+		if len(packet) == 0 {
+			continue
+		}
 
 		// Capture RTP packets for debugging if PCAP logging is enabled
-		CapturePacket(buf[:n])
+		CapturePacket(packet, captureAddr(conn.RemoteAddr()), captureAddr(conn.LocalAddr()))
 
-		// Process RTP stream packet
-		log.Printf("Received RTP stream packet, size: %d bytes", n)
+		if rtpPacketTrace.Allow() {
+			rtpPacketTrace.Log("Received RTP stream packet", "from", conn.RemoteAddr(), "size", len(packet))
+		}
+		AddRTPJob(packet)
 	}
 }
 
@@ -128,6 +153,6 @@ func StopRTPListener(address string) {
 	if listener, exists := rtpListeners[address]; exists {
 		listener.Close()
 		delete(rtpListeners, address)
-		log.Printf("Stopped RTP listener on %s", address)
+		rtpLog.Info("Stopped RTP listener", "addr", address)
 	}
 }
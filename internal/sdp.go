@@ -0,0 +1,414 @@
+package internal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+)
+
+// Media directions (RFC 3264)
+const (
+	SDPDirectionSendRecv = "sendrecv"
+	SDPDirectionSendOnly = "sendonly"
+	SDPDirectionRecvOnly = "recvonly"
+	SDPDirectionInactive = "inactive"
+)
+
+// staticPayloadTypes describes the static RTP/AVP payload types (RFC 3551)
+// used when an offer lists them without an rtpmap
+var staticPayloadTypes = map[uint8]CodecInfo{
+	0:  {PayloadType: 0, Name: "PCMU", ClockRate: 8000, Channels: 1},
+	3:  {PayloadType: 3, Name: "GSM", ClockRate: 8000, Channels: 1},
+	4:  {PayloadType: 4, Name: "G723", ClockRate: 8000, Channels: 1},
+	5:  {PayloadType: 5, Name: "DVI4", ClockRate: 8000, Channels: 1},
+	6:  {PayloadType: 6, Name: "DVI4", ClockRate: 16000, Channels: 1},
+	7:  {PayloadType: 7, Name: "LPC", ClockRate: 8000, Channels: 1},
+	8:  {PayloadType: 8, Name: "PCMA", ClockRate: 8000, Channels: 1},
+	9:  {PayloadType: 9, Name: "G722", ClockRate: 8000, Channels: 1},
+	10: {PayloadType: 10, Name: "L16", ClockRate: 44100, Channels: 2},
+	11: {PayloadType: 11, Name: "L16", ClockRate: 44100, Channels: 1},
+	12: {PayloadType: 12, Name: "QCELP", ClockRate: 8000, Channels: 1},
+	13: {PayloadType: 13, Name: "CN", ClockRate: 8000, Channels: 1},
+	14: {PayloadType: 14, Name: "MPA", ClockRate: 90000, Channels: 1},
+	15: {PayloadType: 15, Name: "G728", ClockRate: 8000, Channels: 1},
+	16: {PayloadType: 16, Name: "DVI4", ClockRate: 11025, Channels: 1},
+	17: {PayloadType: 17, Name: "DVI4", ClockRate: 22050, Channels: 1},
+	18: {PayloadType: 18, Name: "G729", ClockRate: 8000, Channels: 1},
+	26: {PayloadType: 26, Name: "JPEG", ClockRate: 90000, Channels: 1},
+	31: {PayloadType: 31, Name: "H261", ClockRate: 90000, Channels: 1},
+	32: {PayloadType: 32, Name: "MPV", ClockRate: 90000, Channels: 1},
+	34: {PayloadType: 34, Name: "H263", ClockRate: 90000, Channels: 1},
+}
+
+// ParseSDP parses a session description. Both CRLF and bare LF line endings
+// are accepted.
+func ParseSDP(raw string) (*sdp.SessionDescription, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, fmt.Errorf("%w: empty session description", ErrInvalidSDP)
+	}
+	if !strings.HasSuffix(raw, "\n") {
+		raw += "\r\n"
+	}
+	raw, restore := maskSDPMediaNames(raw)
+	desc := &sdp.SessionDescription{}
+	if err := desc.UnmarshalString(raw); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSDP, err)
+	}
+	for i, name := range restore {
+		if i < len(desc.MediaDescriptions) {
+			desc.MediaDescriptions[i].MediaName.Media = name.Media
+			desc.MediaDescriptions[i].MediaName.Protos = name.Protos
+		}
+	}
+	return desc, nil
+}
+
+// pionMediaTypes and pionProtocols are the m= line values pion/sdp accepts
+var (
+	pionMediaTypes = map[string]bool{"audio": true, "video": true, "text": true, "application": true, "message": true}
+	pionProtocols  = map[string]bool{
+		"UDP": true, "RTP": true, "AVP": true, "SAVP": true, "SAVPF": true, "TLS": true, "DTLS": true, "SCTP": true,
+		"AVPF": true, "TCP": true, "MSRP": true, "BFCP": true, "UDT": true, "IX": true, "MRCPv2": true, "FEC": true,
+	}
+)
+
+// maskSDPMediaNames hides m= lines pion/sdp rejects, such as T.38 (m=image
+// ... udptl t38, RFC 3362), behind a placeholder. It returns the original
+// media names by section index.
+func maskSDPMediaNames(raw string) (string, map[int]sdp.MediaName) {
+	restore := make(map[int]sdp.MediaName)
+	lines := strings.Split(raw, "\n")
+	section := 0
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "m=") {
+			continue
+		}
+		body, cr := strings.CutSuffix(line[2:], "\r")
+		fields := strings.Fields(body)
+		if len(fields) >= 3 && !(pionMediaTypes[fields[0]] && knownSDPProtocol(fields[2])) {
+			restore[section] = sdp.MediaName{Media: fields[0], Protos: strings.Split(fields[2], "/")}
+			fields[0], fields[2] = "application", "UDP"
+			lines[i] = "m=" + strings.Join(fields, " ")
+			if cr {
+				lines[i] += "\r"
+			}
+		}
+		section++
+	}
+	if len(restore) == 0 {
+		return raw, nil
+	}
+	return strings.Join(lines, "\n"), restore
+}
+
+// knownSDPProtocol reports whether pion/sdp accepts a transport protocol
+func knownSDPProtocol(protocol string) bool {
+	for _, part := range strings.Split(protocol, "/") {
+		if !pionProtocols[part] {
+			return false
+		}
+	}
+	return true
+}
+
+// MarshalSDP serializes a session description with CRLF line endings
+func MarshalSDP(desc *sdp.SessionDescription) string {
+	out, err := desc.Marshal()
+	if err != nil {
+		return ""
+	}
+	return string(out)
+}
+
+// NewSDPSession creates a session description with an origin, session-level
+// connection address and a t=0 0 timing line
+func NewSDPSession(username string, sessionID, sessionVersion uint64, ip, name string) *sdp.SessionDescription {
+	addressType := SDPAddressType(ip)
+	return &sdp.SessionDescription{
+		Origin: sdp.Origin{
+			Username:       username,
+			SessionID:      sessionID,
+			SessionVersion: sessionVersion,
+			NetworkType:    "IN",
+			AddressType:    addressType,
+			UnicastAddress: ip,
+		},
+		SessionName: sdp.SessionName(name),
+		ConnectionInformation: &sdp.ConnectionInformation{
+			NetworkType: "IN",
+			AddressType: addressType,
+			Address:     &sdp.Address{Address: ip},
+		},
+		TimeDescriptions: []sdp.TimeDescription{{Timing: sdp.Timing{}}},
+	}
+}
+
+// NewSDPMedia creates an m= section offering the given codecs, with an
+// rtpmap and fmtp attribute per codec
+func NewSDPMedia(mediaType string, port int, protocol string, codecs []CodecInfo) *sdp.MediaDescription {
+	media := &sdp.MediaDescription{
+		MediaName: sdp.MediaName{
+			Media:  mediaType,
+			Port:   sdp.RangedPort{Value: port},
+			Protos: strings.Split(protocol, "/"),
+		},
+	}
+	for _, c := range codecs {
+		media.MediaName.Formats = append(media.MediaName.Formats, strconv.Itoa(int(c.PayloadType)))
+		media.Attributes = append(media.Attributes, sdpCodecAttributes(c)...)
+	}
+	return media
+}
+
+// sdpCodecAttributes returns the rtpmap and, if set, fmtp attribute of a codec
+func sdpCodecAttributes(c CodecInfo) []sdp.Attribute {
+	pt := strconv.Itoa(int(c.PayloadType))
+	rtpmap := pt + " " + c.Name + "/" + strconv.FormatUint(uint64(c.ClockRate), 10)
+	if c.Channels > 1 {
+		rtpmap += "/" + strconv.Itoa(c.Channels)
+	}
+	attributes := []sdp.Attribute{sdp.NewAttribute("rtpmap", rtpmap)}
+	if c.Fmtp != "" {
+		attributes = append(attributes, sdp.NewAttribute("fmtp", pt+" "+c.Fmtp))
+	}
+	return attributes
+}
+
+// SDPAddressType returns the SDP address type of an IP address
+func SDPAddressType(ip string) string {
+	if strings.Contains(ip, ":") {
+		return "IP6"
+	}
+	return "IP4"
+}
+
+// SDPProtocol returns the transport protocol of an m= section, e.g. RTP/AVP
+func SDPProtocol(media *sdp.MediaDescription) string {
+	return strings.Join(media.MediaName.Protos, "/")
+}
+
+// PrimaryMedia returns the first audio section of a session description, or
+// its first section when it carries no audio
+func PrimaryMedia(desc *sdp.SessionDescription) *sdp.MediaDescription {
+	for _, media := range desc.MediaDescriptions {
+		if media.MediaName.Media == "audio" {
+			return media
+		}
+	}
+	if len(desc.MediaDescriptions) > 0 {
+		return desc.MediaDescriptions[0]
+	}
+	return nil
+}
+
+// SDPAttribute returns an attribute of an m= section, falling back to the
+// session level where RFC 4566 lets the attribute apply to all media
+func SDPAttribute(desc *sdp.SessionDescription, media *sdp.MediaDescription, key string) (string, bool) {
+	if media != nil {
+		if value, ok := media.Attribute(key); ok {
+			return value, true
+		}
+	}
+	return desc.Attribute(key)
+}
+
+// HasSDPAttribute reports whether an m= section or the session carries an
+// attribute
+func HasSDPAttribute(desc *sdp.SessionDescription, media *sdp.MediaDescription, key string) bool {
+	_, ok := SDPAttribute(desc, media, key)
+	return ok
+}
+
+// SDPConnectionAddress returns the connection address of an m= section,
+// which overrides the session-level c= line
+func SDPConnectionAddress(desc *sdp.SessionDescription, media *sdp.MediaDescription) string {
+	conn := desc.ConnectionInformation
+	if media != nil && media.ConnectionInformation != nil {
+		conn = media.ConnectionInformation
+	}
+	if conn == nil || conn.Address == nil {
+		return ""
+	}
+	return conn.Address.Address
+}
+
+// SDPRTCPAddress returns the port and, when given, the address of an m=
+// section's a=rtcp attribute (RFC 3605): a=rtcp:<port> [IN IP4 <address>]
+func SDPRTCPAddress(media *sdp.MediaDescription) (port int, address string, ok bool) {
+	value, found := media.Attribute("rtcp")
+	if !found {
+		return 0, "", false
+	}
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return 0, "", false
+	}
+	port, err := strconv.Atoi(fields[0])
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, "", false
+	}
+	if len(fields) >= 4 && fields[1] == "IN" {
+		address = fields[3]
+	}
+	return port, address, true
+}
+
+// SDPExtmap returns the RTP header extensions an m= section negotiated
+// with a=extmap, at session level or its own (RFC 8285 section 5).
+// Extensions marked inactive are left out
+func SDPExtmap(desc *sdp.SessionDescription, media *sdp.MediaDescription) RTPExtmap {
+	extmap := RTPExtmap{}
+	for _, attributes := range [][]sdp.Attribute{desc.Attributes, media.Attributes} {
+		for _, a := range attributes {
+			if a.Key != "extmap" {
+				continue
+			}
+			// a=extmap:<id>[/<direction>] <URI> [<attributes>]
+			fields := strings.Fields(a.Value)
+			if len(fields) < 2 {
+				continue
+			}
+			value, direction, _ := strings.Cut(fields[0], "/")
+			id, err := strconv.ParseUint(value, 10, 8)
+			if err != nil || id == 0 || direction == "inactive" {
+				continue
+			}
+			extmap[uint8(id)] = fields[1]
+		}
+	}
+	return extmap
+}
+
+// SDPDirection returns the media direction of an m= section, defaulting to
+// sendrecv
+func SDPDirection(desc *sdp.SessionDescription, media *sdp.MediaDescription) string {
+	if media != nil {
+		if direction := directionAttribute(media.Attributes); direction != "" {
+			return direction
+		}
+	}
+	if direction := directionAttribute(desc.Attributes); direction != "" {
+		return direction
+	}
+	return SDPDirectionSendRecv
+}
+
+// directionAttribute returns the direction attribute in a list, if any
+func directionAttribute(attributes []sdp.Attribute) string {
+	for _, a := range attributes {
+		switch a.Key {
+		case SDPDirectionSendRecv, SDPDirectionSendOnly, SDPDirectionRecvOnly, SDPDirectionInactive:
+			return a.Key
+		}
+	}
+	return ""
+}
+
+// SDPCodecs returns the codecs of an m= section in preference order. Static
+// payload types without an rtpmap are described from RFC 3551.
+func SDPCodecs(media *sdp.MediaDescription) []CodecInfo {
+	rtpmaps := make(map[uint8]CodecInfo)
+	fmtps := make(map[uint8]string)
+	for _, a := range media.Attributes {
+		switch a.Key {
+		case "rtpmap":
+			// a=rtpmap:<pt> <encoding>/<clock>[/<channels>]
+			pt, encoding, ok := strings.Cut(a.Value, " ")
+			ptInt, err := strconv.ParseUint(pt, 10, 8)
+			if !ok || err != nil {
+				continue
+			}
+			parts := strings.Split(strings.TrimSpace(encoding), "/")
+			if len(parts) < 2 {
+				continue
+			}
+			clockRate, _ := strconv.ParseUint(parts[1], 10, 32)
+			codec := CodecInfo{
+				PayloadType: uint8(ptInt),
+				Name:        parts[0],
+				ClockRate:   uint32(clockRate),
+				Channels:    1,
+			}
+			if len(parts) >= 3 {
+				if channels, err := strconv.Atoi(parts[2]); err == nil {
+					codec.Channels = channels
+				}
+			}
+			rtpmaps[codec.PayloadType] = codec
+
+		case "fmtp":
+			// a=fmtp:<pt> <parameters>
+			pt, params, ok := strings.Cut(a.Value, " ")
+			if ptInt, err := strconv.ParseUint(pt, 10, 8); ok && err == nil {
+				fmtps[uint8(ptInt)] = strings.TrimSpace(params)
+			}
+		}
+	}
+
+	codecs := make([]CodecInfo, 0, len(media.MediaName.Formats))
+	for _, format := range media.MediaName.Formats {
+		ptInt, err := strconv.ParseUint(format, 10, 8)
+		if err != nil {
+			continue // Not an RTP payload type, e.g. t38 or webrtc-datachannel
+		}
+		pt := uint8(ptInt)
+		codec, ok := rtpmaps[pt]
+		if !ok {
+			if codec, ok = staticPayloadTypes[pt]; !ok {
+				continue
+			}
+		}
+		codec.Fmtp = fmtps[pt]
+		codecs = append(codecs, codec)
+	}
+	return codecs
+}
+
+// SDPSSRCs returns the media source and the FlexFEC repair source of an m=
+// section. The FEC-FR group (RFC 5956) names both; otherwise the first
+// a=ssrc is the media source.
+func SDPSSRCs(media *sdp.MediaDescription) (ssrc, fecSSRC uint32) {
+	for _, a := range media.Attributes {
+		switch a.Key {
+		case "ssrc-group":
+			// a=ssrc-group:FEC-FR <source ssrc> <repair ssrc>
+			parts := strings.Fields(a.Value)
+			if len(parts) >= 3 && parts[0] == "FEC-FR" {
+				source, err1 := strconv.ParseUint(parts[1], 10, 32)
+				repair, err2 := strconv.ParseUint(parts[2], 10, 32)
+				if err1 == nil && err2 == nil {
+					return uint32(source), uint32(repair)
+				}
+			}
+		case "ssrc":
+			if ssrc != 0 {
+				continue
+			}
+			id, _, _ := strings.Cut(a.Value, " ")
+			if value, err := strconv.ParseUint(id, 10, 32); err == nil {
+				ssrc = uint32(value)
+			}
+		}
+	}
+	return ssrc, fecSSRC
+}
+
+// SDPCrypto returns the suite and inline key of the first a=crypto line
+// (RFC 4568) of an m= section
+func SDPCrypto(media *sdp.MediaDescription) (suite, key string, ok bool) {
+	value, found := media.Attribute("crypto")
+	if !found {
+		return "", "", false
+	}
+	// a=crypto:<tag> <suite> inline:<key>[|lifetime][|MKI]
+	parts := strings.Fields(value)
+	if len(parts) >= 2 {
+		suite = parts[1]
+	}
+	if len(parts) >= 3 && strings.HasPrefix(parts[2], "inline:") {
+		key = strings.TrimPrefix(parts[2], "inline:")
+	}
+	return suite, key, true
+}
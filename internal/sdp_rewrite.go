@@ -0,0 +1,370 @@
+package internal
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+)
+
+// sdpICEAttributes describe the peer's own ICE agent. They are never passed
+// on: the other side talks ICE to Karl, not to the peer.
+var sdpICEAttributes = []string{
+	"ice-ufrag", "ice-pwd", "ice-options", "ice-lite", "ice-mismatch",
+	"candidate", "end-of-candidates", "remote-candidates",
+}
+
+// sdpDTLSAttributes describe a DTLS-SRTP endpoint (RFC 5763, RFC 8842)
+var sdpDTLSAttributes = []string{"fingerprint", "setup", "tls-id"}
+
+const (
+	// iceChars are the characters allowed in ICE credentials (RFC 8839)
+	iceChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+	iceUfragLength = 8
+	icePwdLength   = 24
+)
+
+// SDPRewrite describes how Karl rewrites an offer or answer before passing
+// it on, so the other side sends its media to Karl
+type SDPRewrite struct {
+	LocalIP       string
+	ICE           *ICECredentials // Karl's ICE credentials; nil strips ICE
+	Candidates    []ICECandidate  // Karl's ICE candidates; a host candidate on LocalIP when empty
+	DTLS          bool            // Keep DTLS-SRTP attributes
+	Fingerprint   string          // Replaces the peer's a=fingerprint when set
+	Setup         string          // Replaces the peer's a=setup when set
+	ReplaceOrigin bool            // Put Karl's address in the o= line
+	TCPPort       int             // Port of the RTP over TCP listener, advertised as a passive ICE candidate when set
+	StripZRTP     bool            // Remove the peer's a=zrtp-hash, for a call whose ZRTP Karl ends
+	StripExtmap   bool            // Remove the peer's RTP header extensions (a=extmap)
+	Media         []SDPMediaRewrite
+}
+
+// SDPMediaRewrite holds the transport settings of one m= section, in SDP
+// order. Sections without a port are rejected.
+type SDPMediaRewrite struct {
+	RTPPort      int
+	RTCPPort     int
+	Protocol     string      // Transport of the section, e.g. RTP/AVP
+	RTCPMux      bool        // Advertise RTP and RTCP on one port
+	Crypto       string      // Value of the a=crypto line; empty strips SDES
+	DropPayloads []uint8     // Payload types removed from the section
+	AddCodecs    []CodecInfo // Codecs appended to the section, e.g. for transcoding
+	Ptime        int         // Value of a=ptime in ms; 0 keeps the section's own
+	ZRTPHash     string      // Value of Karl's a=zrtp-hash, when Karl is the recipient's ZRTP endpoint
+}
+
+// RewriteSDP rewrites a parsed description in place and returns it
+// serialized. Every relayed section gets Karl's address, its own ports and
+// transport attributes; the others are rejected with port 0. BUNDLE groups
+// are removed since each section is relayed on its own ports. Media
+// directions pass through unchanged so hold and resume reach the other side,
+// and a 0.0.0.0 connection address (RFC 2543 hold) is kept.
+func RewriteSDP(desc *sdp.SessionDescription, rw *SDPRewrite) string {
+	addressType := SDPAddressType(rw.LocalIP)
+
+	// Per-section DTLS attributes can be declared at session level
+	fingerprints := make([]string, len(desc.MediaDescriptions))
+	setups := make([]string, len(desc.MediaDescriptions))
+	for i, media := range desc.MediaDescriptions {
+		fingerprints[i], _ = SDPAttribute(desc, media, "fingerprint")
+		setups[i], _ = SDPAttribute(desc, media, "setup")
+		if rw.Fingerprint != "" {
+			fingerprints[i] = rw.Fingerprint
+		}
+		if rw.Setup != "" {
+			setups[i] = rw.Setup
+		}
+	}
+
+	if rw.ReplaceOrigin {
+		desc.Origin.AddressType = addressType
+		desc.Origin.UnicastAddress = rw.LocalIP
+	}
+	if desc.ConnectionInformation != nil {
+		rewriteConnection(desc.ConnectionInformation, rw.LocalIP, addressType)
+	}
+
+	desc.Attributes = removeSDPAttributes(desc.Attributes, sdpICEAttributes...)
+	desc.Attributes = removeSDPAttributes(desc.Attributes, sdpDTLSAttributes...)
+	desc.Attributes = removeBundleGroups(desc.Attributes)
+	if rw.StripZRTP {
+		desc.Attributes = removeSDPAttributes(desc.Attributes, "zrtp-hash")
+	}
+	if rw.StripExtmap {
+		desc.Attributes = removeSDPAttributes(desc.Attributes, "extmap", "extmap-allow-mixed")
+	}
+	if rw.ICE != nil && rw.ICE.Lite {
+		desc.Attributes = append(desc.Attributes, sdp.NewPropertyAttribute("ice-lite"))
+	}
+
+	for i, media := range desc.MediaDescriptions {
+		media.Attributes = removeSDPAttributes(media.Attributes, sdpICEAttributes...)
+		media.Attributes = removeSDPAttributes(media.Attributes, sdpDTLSAttributes...)
+		media.Attributes = removeSDPAttributes(media.Attributes, "bundle-only")
+		if rw.StripZRTP {
+			media.Attributes = removeSDPAttributes(media.Attributes, "zrtp-hash")
+		}
+		if rw.StripExtmap {
+			media.Attributes = removeSDPAttributes(media.Attributes, "extmap", "extmap-allow-mixed")
+		}
+
+		var mrw SDPMediaRewrite
+		if i < len(rw.Media) {
+			mrw = rw.Media[i]
+		}
+		if mrw.RTPPort == 0 {
+			// Not relayed: reject the stream (RFC 3264 section 6)
+			media.MediaName.Port = sdp.RangedPort{Value: 0}
+			continue
+		}
+
+		media.MediaName.Port = sdp.RangedPort{Value: mrw.RTPPort}
+		if mrw.Protocol != "" {
+			media.MediaName.Protos = strings.Split(mrw.Protocol, "/")
+		}
+		if media.ConnectionInformation != nil {
+			rewriteConnection(media.ConnectionInformation, rw.LocalIP, addressType)
+		} else if desc.ConnectionInformation == nil {
+			media.ConnectionInformation = &sdp.ConnectionInformation{
+				NetworkType: "IN",
+				AddressType: addressType,
+				Address:     &sdp.Address{Address: rw.LocalIP},
+			}
+		}
+		dropSDPPayloads(media, mrw.DropPayloads)
+		addSDPPayloads(media, mrw.AddCodecs)
+		if mrw.Ptime > 0 {
+			media.Attributes = removeSDPAttributes(media.Attributes, "ptime")
+			media.WithValueAttribute("ptime", strconv.Itoa(mrw.Ptime))
+		}
+
+		// RTCP
+		media.Attributes = removeSDPAttributes(media.Attributes, "rtcp", "rtcp-mux", "crypto")
+		if mrw.RTCPMux {
+			media.WithPropertyAttribute("rtcp-mux")
+		} else if mrw.RTCPPort > 0 {
+			media.WithValueAttribute("rtcp", strconv.Itoa(mrw.RTCPPort))
+		}
+
+		// ICE: Karl is the remote agent, with its candidates per component
+		if rw.ICE != nil {
+			media.WithValueAttribute("ice-ufrag", rw.ICE.Username)
+			media.WithValueAttribute("ice-pwd", rw.ICE.Password)
+			if len(rw.Candidates) == 0 {
+				media.WithCandidate(hostCandidate(1, rw.LocalIP, mrw.RTPPort))
+				if !mrw.RTCPMux && mrw.RTCPPort > 0 {
+					media.WithCandidate(hostCandidate(2, rw.LocalIP, mrw.RTCPPort))
+				}
+			}
+			for i, candidate := range rw.Candidates {
+				media.WithCandidate(iceCandidate(i, 1, candidate, mrw.RTPPort))
+				if !mrw.RTCPMux && mrw.RTCPPort > 0 {
+					media.WithCandidate(iceCandidate(i, 2, candidate, mrw.RTCPPort))
+				}
+			}
+			if rw.TCPPort > 0 {
+				media.WithCandidate(tcpHostCandidate(rw.LocalIP, rw.TCPPort))
+			}
+			media.WithPropertyAttribute("end-of-candidates")
+		}
+
+		// DTLS-SRTP
+		if rw.DTLS && fingerprints[i] != "" {
+			media.WithValueAttribute("fingerprint", fingerprints[i])
+			if setups[i] != "" {
+				media.WithValueAttribute("setup", setups[i])
+			}
+		}
+
+		// SDES-SRTP
+		if mrw.Crypto != "" {
+			media.WithValueAttribute("crypto", mrw.Crypto)
+		}
+
+		// ZRTP (RFC 6189 section 8.1)
+		if mrw.ZRTPHash != "" {
+			media.WithValueAttribute("zrtp-hash", mrw.ZRTPHash)
+		}
+	}
+
+	return MarshalSDP(desc)
+}
+
+// IsRTPProtocol reports whether an m= section carries RTP, as opposed to
+// e.g. T.38 over UDPTL or an SCTP data channel
+func IsRTPProtocol(protocol string) bool {
+	return strings.Contains(protocol, "RTP/")
+}
+
+// IsSDPHold reports whether a media section puts the other side on hold,
+// by direction (RFC 3264) or by a zero connection address (RFC 2543)
+func IsSDPHold(direction, connectionIP string) bool {
+	if direction == SDPDirectionSendOnly || direction == SDPDirectionInactive {
+		return true
+	}
+	ip := net.ParseIP(connectionIP)
+	return ip != nil && ip.IsUnspecified()
+}
+
+// NewICECredentials generates ICE credentials for Karl's side of a leg
+func NewICECredentials(lite bool) (*ICECredentials, error) {
+	ufrag, err := randomICEString(iceUfragLength)
+	if err != nil {
+		return nil, err
+	}
+	pwd, err := randomICEString(icePwdLength)
+	if err != nil {
+		return nil, err
+	}
+	return &ICECredentials{Username: ufrag, Password: pwd, Lite: lite}, nil
+}
+
+// randomICEString returns n random ICE characters
+func randomICEString(n int) (string, error) {
+	b := make([]byte, n)
+	max := big.NewInt(int64(len(iceChars)))
+	for i := range b {
+		idx, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate ICE credentials: %w", err)
+		}
+		b[i] = iceChars[idx.Int64()]
+	}
+	return string(b), nil
+}
+
+// hostCandidate returns a host candidate with the RFC 8445 recommended
+// priority for the component
+func hostCandidate(component int, ip string, port int) string {
+	priority := (126 << 24) | (65535 << 8) | (256 - component)
+	return fmt.Sprintf("%d %d UDP %d %s %d typ host", component, component, priority, ip, port)
+}
+
+// iceCandidate returns the i-th of Karl's gathered candidates for a
+// component: host candidates with the RFC 8445 recommended type preference
+// and server-reflexive ones below them, earlier ones ranked higher
+func iceCandidate(i, component int, candidate ICECandidate, port int) string {
+	if i == 0 && candidate.Type == "host" {
+		return hostCandidate(component, candidate.IP, port)
+	}
+	typePreference, related := 126, ""
+	if candidate.Type == "srflx" {
+		typePreference = 100
+		related = fmt.Sprintf(" raddr %s rport %d", candidate.Related, port)
+	}
+	priority := (typePreference << 24) | ((65535 - i) << 8) | (256 - component)
+	return fmt.Sprintf("%d %d UDP %d %s %d typ %s%s", 4+i, component, priority, candidate.IP, port, candidate.Type, related)
+}
+
+// tcpHostCandidate returns Karl's passive TCP host candidate (RFC 6544).
+// RTP and RTCP share the stream, so it is component 1 only, and its local
+// preference ranks it below the UDP candidates
+func tcpHostCandidate(ip string, port int) string {
+	localPreference := (4 << 13) | 8191 // passive direction, host type
+	priority := (126 << 24) | (localPreference << 8) | 255
+	return fmt.Sprintf("3 1 TCP %d %s %d typ host tcptype passive", priority, ip, port)
+}
+
+// rewriteConnection points a c= line at Karl unless it signals hold
+func rewriteConnection(conn *sdp.ConnectionInformation, ip, addressType string) {
+	if conn.Address != nil {
+		if addr := net.ParseIP(conn.Address.Address); addr != nil && addr.IsUnspecified() {
+			return
+		}
+	}
+	conn.NetworkType = "IN"
+	conn.AddressType = addressType
+	conn.Address = &sdp.Address{Address: ip}
+}
+
+// removeSDPAttributes returns attributes without the given keys
+func removeSDPAttributes(attributes []sdp.Attribute, keys ...string) []sdp.Attribute {
+	kept := attributes[:0]
+	for _, a := range attributes {
+		remove := false
+		for _, key := range keys {
+			if a.Key == key {
+				remove = true
+				break
+			}
+		}
+		if !remove {
+			kept = append(kept, a)
+		}
+	}
+	return kept
+}
+
+// removeBundleGroups removes a=group:BUNDLE lines (RFC 8843)
+func removeBundleGroups(attributes []sdp.Attribute) []sdp.Attribute {
+	kept := attributes[:0]
+	for _, a := range attributes {
+		if a.Key == "group" && strings.HasPrefix(a.Value, "BUNDLE") {
+			continue
+		}
+		kept = append(kept, a)
+	}
+	return kept
+}
+
+// addSDPPayloads appends codecs to a media section, with their rtpmap and
+// fmtp lines after the existing ones
+func addSDPPayloads(media *sdp.MediaDescription, codecs []CodecInfo) {
+	if len(codecs) == 0 {
+		return
+	}
+	var added []sdp.Attribute
+	for _, c := range codecs {
+		media.MediaName.Formats = append(media.MediaName.Formats, strconv.Itoa(int(c.PayloadType)))
+		added = append(added, sdpCodecAttributes(c)...)
+	}
+
+	insert := len(media.Attributes)
+	for i, a := range media.Attributes {
+		if a.Key == "rtpmap" || a.Key == "fmtp" {
+			insert = i + 1
+		}
+	}
+	attributes := make([]sdp.Attribute, 0, len(media.Attributes)+len(added))
+	attributes = append(attributes, media.Attributes[:insert]...)
+	attributes = append(attributes, added...)
+	media.Attributes = append(attributes, media.Attributes[insert:]...)
+}
+
+// dropSDPPayloads removes payload types and their rtpmap, fmtp and rtcp-fb
+// lines from a media section
+func dropSDPPayloads(media *sdp.MediaDescription, payloads []uint8) {
+	if len(payloads) == 0 {
+		return
+	}
+	drop := make(map[string]bool, len(payloads))
+	for _, pt := range payloads {
+		drop[strconv.Itoa(int(pt))] = true
+	}
+
+	formats := media.MediaName.Formats[:0]
+	for _, format := range media.MediaName.Formats {
+		if !drop[format] {
+			formats = append(formats, format)
+		}
+	}
+	media.MediaName.Formats = formats
+
+	attributes := media.Attributes[:0]
+	for _, a := range media.Attributes {
+		switch a.Key {
+		case "rtpmap", "fmtp", "rtcp-fb":
+			if pt, _, _ := strings.Cut(a.Value, " "); drop[pt] {
+				continue
+			}
+		}
+		attributes = append(attributes, a)
+	}
+	media.Attributes = attributes
+}
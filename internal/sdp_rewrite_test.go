@@ -0,0 +1,335 @@
+package internal
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	ng "karl/internal/ng_protocol"
+)
+
+const sipOfferSDP = "v=0\r\n" +
+	"o=alice 2890844526 2890844526 IN IP4 192.0.2.10\r\n" +
+	"s=-\r\n" +
+	"c=IN IP4 192.0.2.10\r\n" +
+	"t=0 0\r\n" +
+	"m=audio 49170 RTP/AVP 0 101\r\n" +
+	"a=rtpmap:0 PCMU/8000\r\n" +
+	"a=rtpmap:101 telephone-event/8000\r\n" +
+	"a=fmtp:101 0-16\r\n" +
+	"a=rtcp:49171\r\n" +
+	"a=sendrecv\r\n"
+
+func TestRewriteSDP_WebRTCToSIP(t *testing.T) {
+	desc, err := ParseSDP(webrtcOfferSDP)
+	if err != nil {
+		t.Fatalf("ParseSDP failed: %v", err)
+	}
+	out := RewriteSDP(desc, &SDPRewrite{
+		LocalIP: "198.51.100.1",
+		Media:   []SDPMediaRewrite{{RTPPort: 30000, RTCPPort: 30001, Protocol: "RTP/AVP"}},
+	})
+
+	for _, line := range []string{
+		"m=audio 30000 RTP/AVP 111 0",
+		"c=IN IP4 198.51.100.1",
+		"a=rtcp:30001",
+		"a=sendonly",
+		"m=video 0 UDP/TLS/RTP/SAVPF 96",
+		"c=IN IP4 0.0.0.0",
+	} {
+		if !strings.Contains(out, line+"\r\n") {
+			t.Errorf("expected %q in:\n%s", line, out)
+		}
+	}
+	for _, attr := range []string{"a=ice-", "a=candidate", "a=fingerprint", "a=setup", "a=rtcp-mux", "a=group:BUNDLE", "203.0.113.5"} {
+		if strings.Contains(out, attr) {
+			t.Errorf("expected %q to be stripped from:\n%s", attr, out)
+		}
+	}
+}
+
+func TestRewriteSDP_SIPToWebRTC(t *testing.T) {
+	desc, err := ParseSDP(sipOfferSDP)
+	if err != nil {
+		t.Fatalf("ParseSDP failed: %v", err)
+	}
+	ice, err := NewICECredentials(true)
+	if err != nil {
+		t.Fatalf("NewICECredentials failed: %v", err)
+	}
+	out := RewriteSDP(desc, &SDPRewrite{
+		LocalIP:       "198.51.100.1",
+		ICE:           ice,
+		DTLS:          true,
+		Fingerprint:   "sha-256 AB:CD",
+		Setup:         "actpass",
+		ReplaceOrigin: true,
+		Media: []SDPMediaRewrite{{
+			RTPPort:      30000,
+			RTCPPort:     30001,
+			Protocol:     "UDP/TLS/RTP/SAVPF",
+			RTCPMux:      true,
+			DropPayloads: []uint8{101},
+		}},
+	})
+
+	for _, line := range []string{
+		"o=alice 2890844526 2890844526 IN IP4 198.51.100.1",
+		"a=ice-lite",
+		"m=audio 30000 UDP/TLS/RTP/SAVPF 0",
+		"a=rtcp-mux",
+		"a=ice-ufrag:" + ice.Username,
+		"a=ice-pwd:" + ice.Password,
+		"a=candidate:1 1 UDP 2130706431 198.51.100.1 30000 typ host",
+		"a=end-of-candidates",
+		"a=fingerprint:sha-256 AB:CD",
+		"a=setup:actpass",
+	} {
+		if !strings.Contains(out, line+"\r\n") {
+			t.Errorf("expected %q in:\n%s", line, out)
+		}
+	}
+	if strings.Contains(out, "a=rtcp:") || strings.Contains(out, "telephone-event") {
+		t.Errorf("expected a=rtcp and the dropped payload to be removed:\n%s", out)
+	}
+	if len(ice.Username) != iceUfragLength || len(ice.Password) != icePwdLength {
+		t.Errorf("unexpected ICE credential lengths %q %q", ice.Username, ice.Password)
+	}
+}
+
+func TestIsSDPHold(t *testing.T) {
+	tests := []struct {
+		direction string
+		ip        string
+		held      bool
+	}{
+		{SDPDirectionSendRecv, "192.0.2.10", false},
+		{SDPDirectionRecvOnly, "192.0.2.10", false},
+		{SDPDirectionSendOnly, "192.0.2.10", true},
+		{SDPDirectionInactive, "192.0.2.10", true},
+		{SDPDirectionSendRecv, "0.0.0.0", true},
+		{SDPDirectionSendRecv, "", false},
+	}
+	for _, tt := range tests {
+		if got := IsSDPHold(tt.direction, tt.ip); got != tt.held {
+			t.Errorf("IsSDPHold(%q, %q) = %v, want %v", tt.direction, tt.ip, got, tt.held)
+		}
+	}
+}
+
+func TestNGSocketListener_HoldResume(t *testing.T) {
+	registry := NewSessionRegistry(time.Hour)
+	defer registry.Stop()
+	listener := &NGSocketListener{sessionRegistry: registry, config: &Config{}}
+
+	session := registry.CreateSession("hold-call", "from-tag")
+	caller := &CallLeg{Tag: "from-tag", LocalPort: 30000, LocalRTCPPort: 30001}
+	_ = registry.SetCallerLeg(session.ID, caller)
+
+	apply := func(sdp string, state SessionState) string {
+		t.Helper()
+		parsed, err := listener.parseSDP(sdp)
+		if err != nil {
+			t.Fatalf("parseSDP failed: %v", err)
+		}
+		listener.applyRemoteMedia(session, caller, parsed, nil)
+		listener.updateHoldState(session, state)
+		return listener.buildResponseSDP(parsed, caller, "198.51.100.1", nil, true, nil)
+	}
+
+	apply(sipOfferSDP, SessionStateActive)
+	if session.State != SessionStateActive {
+		t.Fatalf("expected active session, got %s", session.State)
+	}
+
+	out := apply(strings.Replace(sipOfferSDP, "a=sendrecv", "a=sendonly", 1), SessionStatePending)
+	if session.State != SessionStateHold {
+		t.Errorf("expected sendonly re-INVITE to hold the call, got %s", session.State)
+	}
+	if !strings.Contains(out, "a=sendonly\r\n") {
+		t.Errorf("expected the hold direction to pass through:\n%s", out)
+	}
+
+	out = apply(strings.ReplaceAll(sipOfferSDP, "c=IN IP4 192.0.2.10", "c=IN IP4 0.0.0.0"), SessionStatePending)
+	if session.State != SessionStateHold || !strings.Contains(out, "c=IN IP4 0.0.0.0\r\n") {
+		t.Errorf("expected RFC 2543 hold to be kept, state %s:\n%s", session.State, out)
+	}
+
+	apply(sipOfferSDP, SessionStateActive)
+	if session.State != SessionStateActive {
+		t.Errorf("expected sendrecv re-INVITE to resume the call, got %s", session.State)
+	}
+}
+
+func TestNGSocketListener_OfferAudioVideo(t *testing.T) {
+	manager, registry, _ := newTestSessionManager(t)
+	listener := &NGSocketListener{sessionRegistry: registry, sessionManager: manager, config: &Config{}}
+
+	offer := sipOfferSDP +
+		"m=video 49180 RTP/AVPF 96\r\n" +
+		"a=rtpmap:96 H264/90000\r\n" +
+		"a=rtcp-mux\r\n" +
+		"m=application 0 UDP/DTLS/SCTP webrtc-datachannel\r\n"
+
+	resp, err := listener.handleOffer(&ng.NGRequest{CallID: "video-call", FromTag: "from-tag", SDP: offer})
+	if err != nil || resp.Result != ng.ResultOK {
+		t.Fatalf("handleOffer failed: %v %+v", err, resp)
+	}
+	if len(resp.Streams) != 2 {
+		t.Fatalf("expected audio and video streams, got %+v", resp.Streams)
+	}
+	audio, video := resp.Streams[0], resp.Streams[1]
+	if video.MediaType != "video" || video.Index != 1 || video.LocalPort == audio.LocalPort {
+		t.Errorf("expected video on its own ports, got %+v", video)
+	}
+
+	for _, line := range []string{
+		"m=audio " + strconv.Itoa(audio.LocalPort) + " RTP/AVP 0 101",
+		"a=rtcp:" + strconv.Itoa(audio.LocalRTCPPort),
+		"m=video " + strconv.Itoa(video.LocalPort) + " RTP/AVPF 96",
+		"m=application 0 UDP/DTLS/SCTP webrtc-datachannel",
+	} {
+		if !strings.Contains(resp.SDP, line+"\r\n") {
+			t.Errorf("expected %q in:\n%s", line, resp.SDP)
+		}
+	}
+
+	// A re-INVITE keeps the video ports
+	again, _ := listener.handleOffer(&ng.NGRequest{CallID: "video-call", FromTag: "from-tag", SDP: offer})
+	if len(again.Streams) != 2 || again.Streams[1].LocalPort != video.LocalPort {
+		t.Errorf("expected re-offer to reuse video port %d, got %+v", video.LocalPort, again.Streams)
+	}
+	if _, ports := manager.GetCounts(); ports != 4 {
+		t.Errorf("expected 4 ports allocated, got %d", ports)
+	}
+}
+
+func TestNGSocketListener_OfferTranscode(t *testing.T) {
+	manager, registry, _ := newTestSessionManager(t)
+	listener := &NGSocketListener{sessionRegistry: registry, sessionManager: manager, config: &Config{}}
+
+	resp, err := listener.handleOffer(&ng.NGRequest{
+		CallID:    "transcode-call",
+		FromTag:   "from-tag",
+		SDP:       sipOfferSDP,
+		Flags:     []string{"codec-transcode=opus"},
+		Transcode: []string{"PCMA"},
+	})
+	if err != nil || resp.Result != ng.ResultOK {
+		t.Fatalf("handleOffer failed: %v %+v", err, resp)
+	}
+
+	port := strconv.Itoa(resp.Streams[0].LocalPort)
+	for _, line := range []string{
+		"m=audio " + port + " RTP/AVP 0 101 96 8",
+		"a=rtpmap:96 opus/48000/2",
+		"a=rtpmap:8 PCMA/8000",
+	} {
+		if !strings.Contains(resp.SDP, line+"\r\n") {
+			t.Errorf("expected %q in:\n%s", line, resp.SDP)
+		}
+	}
+	if strings.Index(resp.SDP, "a=rtpmap:8 ") > strings.Index(resp.SDP, "a=sendrecv") {
+		t.Errorf("expected added codecs next to the existing rtpmaps:\n%s", resp.SDP)
+	}
+}
+
+func TestNGSocketListener_OfferPtime(t *testing.T) {
+	manager, registry, _ := newTestSessionManager(t)
+	listener := &NGSocketListener{sessionRegistry: registry, sessionManager: manager, config: &Config{}}
+
+	offer := strings.Replace(sipOfferSDP, "a=sendrecv\r\n", "a=ptime:20\r\na=sendrecv\r\n", 1)
+	resp, err := listener.handleOffer(&ng.NGRequest{
+		CallID:  "ptime-call",
+		FromTag: "from-tag",
+		SDP:     offer,
+		Ptime:   30,
+	})
+	if err != nil || resp.Result != ng.ResultOK {
+		t.Fatalf("handleOffer failed: %v %+v", err, resp)
+	}
+	if !strings.Contains(resp.SDP, "a=ptime:30\r\n") || strings.Contains(resp.SDP, "a=ptime:20") {
+		t.Errorf("expected the callee to be asked for 30 ms packets:\n%s", resp.SDP)
+	}
+
+	// The offerer still receives the packet time it asked for
+	codecs, ok := GetCodecNegotiator().GetCallCodecs("ptime-call")
+	if !ok || codecs.OfferPtime != 20 {
+		t.Errorf("expected the offerer's 20 ms to be recorded, got %+v", codecs)
+	}
+
+	// ptime-reverse re-frames the media sent to the offerer instead
+	_, err = listener.handleOffer(&ng.NGRequest{
+		CallID:  "ptime-call",
+		FromTag: "from-tag",
+		SDP:     offer,
+		Flags:   []string{"ptime-reverse"},
+		Ptime:   40,
+	})
+	if err != nil {
+		t.Fatalf("handleOffer failed: %v", err)
+	}
+	if codecs, _ := GetCodecNegotiator().GetCallCodecs("ptime-call"); codecs.OfferPtime != 40 {
+		t.Errorf("expected ptime-reverse to set the offerer's packet time, got %d", codecs.OfferPtime)
+	}
+	GetCodecNegotiator().RemoveCall("ptime-call")
+}
+
+func TestNGSocketListener_AdvertisedAddressByPeer(t *testing.T) {
+	manager, registry, _ := newTestSessionManager(t)
+	config := &Config{Integration: IntegrationConfig{
+		MediaIP:          "10.244.1.7",
+		PublicIP:         "203.0.113.50",
+		InternalNetworks: []string{"10.0.0.0/8"},
+	}}
+	listener := &NGSocketListener{
+		sessionRegistry: registry,
+		sessionManager:  manager,
+		config:          config,
+		interfaces:      NewInterfaceSelector(config),
+	}
+
+	// The callee is not known yet, so the offer carries the public address
+	offer := strings.ReplaceAll(sipOfferSDP, "192.0.2.10", "10.1.2.3")
+	resp, err := listener.handleOffer(&ng.NGRequest{CallID: "pod-call", FromTag: "from-tag", SDP: offer})
+	if err != nil || resp.Result != ng.ResultOK {
+		t.Fatalf("handleOffer failed: %v %+v", err, resp)
+	}
+	if !strings.Contains(resp.SDP, "c=IN IP4 203.0.113.50\r\n") {
+		t.Errorf("expected the public address in the offer:\n%s", resp.SDP)
+	}
+
+	// The answer goes back to the caller inside the cluster
+	answer := strings.ReplaceAll(sipOfferSDP, "192.0.2.10", "198.18.0.20")
+	resp, err = listener.handleAnswer(&ng.NGRequest{CallID: "pod-call", FromTag: "from-tag", ToTag: "to-tag", SDP: answer})
+	if err != nil || resp.Result != ng.ResultOK {
+		t.Fatalf("handleAnswer failed: %v %+v", err, resp)
+	}
+	if !strings.Contains(resp.SDP, "c=IN IP4 10.244.1.7\r\n") {
+		t.Errorf("expected the pod address in the answer:\n%s", resp.SDP)
+	}
+}
+
+func TestRewriteSDP_TCPCandidate(t *testing.T) {
+	desc, err := ParseSDP(sipOfferSDP)
+	if err != nil {
+		t.Fatalf("ParseSDP failed: %v", err)
+	}
+	ice, err := NewICECredentials(true)
+	if err != nil {
+		t.Fatalf("NewICECredentials failed: %v", err)
+	}
+	out := RewriteSDP(desc, &SDPRewrite{
+		LocalIP: "198.51.100.1",
+		ICE:     ice,
+		TCPPort: 12001,
+		Media:   []SDPMediaRewrite{{RTPPort: 30000, RTCPPort: 30001, Protocol: "RTP/AVP"}},
+	})
+
+	want := "a=candidate:3 1 TCP 2124414975 198.51.100.1 12001 typ host tcptype passive\r\n"
+	if !strings.Contains(out, want) {
+		t.Errorf("expected %q in:\n%s", want, out)
+	}
+}
@@ -0,0 +1,183 @@
+package internal
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// webrtcOfferSDP is a browser-style offer: session-level ICE and DTLS
+// attributes, candidates, and a video section after the audio one
+const webrtcOfferSDP = "v=0\n" +
+	"o=- 4611731400430051336 2 IN IP4 127.0.0.1\n" +
+	"s=-\n" +
+	"t=0 0\n" +
+	"a=group:BUNDLE 0 1\n" +
+	"a=ice-ufrag:sess\n" +
+	"a=ice-pwd:sessionpasswordsessionpassword\n" +
+	"a=fingerprint:sha-256 AB:CD:EF:01:23:45:67:89:AB:CD:EF:01:23:45:67:89:AB:CD:EF:01:23:45:67:89:AB:CD:EF:01:23:45:67:89\n" +
+	"m=audio 9 UDP/TLS/RTP/SAVPF 111 0\n" +
+	"c=IN IP4 203.0.113.5\n" +
+	"a=rtpmap:111 opus/48000/2\n" +
+	"a=fmtp:111 minptime=10;useinbandfec=1\n" +
+	"a=candidate:1 1 udp 2130706431 203.0.113.5 50000 typ host\n" +
+	"a=ice-ufrag:audio\n" +
+	"a=setup:actpass\n" +
+	"a=rtcp-mux\n" +
+	"a=sendonly\n" +
+	"a=ssrc:1111 cname:audio\n" +
+	"m=video 9 UDP/TLS/RTP/SAVPF 96\n" +
+	"c=IN IP4 0.0.0.0\n" +
+	"a=rtpmap:96 VP8/90000\n" +
+	"a=setup:passive\n" +
+	"a=recvonly\n" +
+	"a=ssrc:2222 cname:video\n"
+
+func TestParseSDP_MediaScopes(t *testing.T) {
+	desc, err := ParseSDP(webrtcOfferSDP)
+	if err != nil {
+		t.Fatalf("ParseSDP failed: %v", err)
+	}
+	if len(desc.MediaDescriptions) != 2 {
+		t.Fatalf("expected 2 media sections, got %d", len(desc.MediaDescriptions))
+	}
+
+	audio := PrimaryMedia(desc)
+	if audio.MediaName.Media != "audio" || SDPProtocol(audio) != "UDP/TLS/RTP/SAVPF" {
+		t.Fatalf("unexpected primary media %v", audio.MediaName)
+	}
+	video := desc.MediaDescriptions[1]
+
+	// Media-level attributes override the session, others are inherited
+	if ufrag, _ := SDPAttribute(desc, audio, "ice-ufrag"); ufrag != "audio" {
+		t.Errorf("expected media-level ufrag, got %q", ufrag)
+	}
+	if ufrag, _ := SDPAttribute(desc, video, "ice-ufrag"); ufrag != "sess" {
+		t.Errorf("expected session-level ufrag for video, got %q", ufrag)
+	}
+	if !HasSDPAttribute(desc, video, "fingerprint") {
+		t.Error("expected the session fingerprint to apply to video")
+	}
+	if setup, _ := SDPAttribute(desc, audio, "setup"); setup != "actpass" {
+		t.Errorf("expected audio setup actpass, got %q", setup)
+	}
+	if SDPDirection(desc, audio) != SDPDirectionSendOnly || SDPDirection(desc, video) != SDPDirectionRecvOnly {
+		t.Error("expected directions to be scoped to their sections")
+	}
+	if HasSDPAttribute(desc, video, "rtcp-mux") {
+		t.Error("expected audio rtcp-mux not to leak into video")
+	}
+	if SDPConnectionAddress(desc, audio) != "203.0.113.5" {
+		t.Errorf("expected media-level connection address, got %q", SDPConnectionAddress(desc, audio))
+	}
+
+	codecs := SDPCodecs(audio)
+	if len(codecs) != 2 {
+		t.Fatalf("expected 2 audio codecs, got %+v", codecs)
+	}
+	if codecs[0].Name != "opus" || codecs[0].Channels != 2 || codecs[0].Fmtp != "minptime=10;useinbandfec=1" {
+		t.Errorf("unexpected opus codec %+v", codecs[0])
+	}
+	if codecs[1].Name != "PCMU" || codecs[1].ClockRate != 8000 {
+		t.Errorf("expected static PCMU without rtpmap, got %+v", codecs[1])
+	}
+
+	if ssrc, _ := SDPSSRCs(audio); ssrc != 1111 {
+		t.Errorf("expected audio SSRC 1111, got %d", ssrc)
+	}
+}
+
+func TestParseSDP_Invalid(t *testing.T) {
+	for _, raw := range []string{
+		"",
+		"m=audio 5004 RTP/AVP 0\r\n",
+		"v=0\r\no=- 1 1 IN IP4 192.0.2.1\r\ns=-\r\nt=0 0\r\nm=audio port RTP/AVP 0\r\n",
+	} {
+		if _, err := ParseSDP(raw); !errors.Is(err, ErrInvalidSDP) {
+			t.Errorf("expected ErrInvalidSDP for %q, got %v", raw, err)
+		}
+	}
+}
+
+func TestBuildSDP_RoundTrip(t *testing.T) {
+	desc := NewSDPSession("karl", 7, 8, "2001:db8::1", "Karl Media Server")
+	media := NewSDPMedia("audio", 30000, "RTP/SAVP", []CodecInfo{
+		{PayloadType: 8, Name: "PCMA", ClockRate: 8000, Channels: 1},
+		{PayloadType: 101, Name: "telephone-event", ClockRate: 8000, Channels: 1, Fmtp: "0-16"},
+	})
+	media.WithPropertyAttribute(SDPDirectionSendRecv)
+	desc.MediaDescriptions = append(desc.MediaDescriptions, media)
+
+	raw := MarshalSDP(desc)
+	for _, line := range []string{
+		"o=karl 7 8 IN IP6 2001:db8::1",
+		"c=IN IP6 2001:db8::1",
+		"t=0 0",
+		"m=audio 30000 RTP/SAVP 8 101",
+		"a=rtpmap:101 telephone-event/8000",
+		"a=fmtp:101 0-16",
+		"a=sendrecv",
+	} {
+		if !strings.Contains(raw, line+"\r\n") {
+			t.Errorf("expected %q in:\n%s", line, raw)
+		}
+	}
+
+	parsed, err := ParseSDP(raw)
+	if err != nil {
+		t.Fatalf("failed to parse built SDP: %v", err)
+	}
+	codecs := SDPCodecs(PrimaryMedia(parsed))
+	if len(codecs) != 2 || codecs[1].Fmtp != "0-16" {
+		t.Errorf("unexpected codecs after round trip: %+v", codecs)
+	}
+}
+
+func TestNGSocketListener_ParseSDPPrimaryMedia(t *testing.T) {
+	listener := &NGSocketListener{}
+	parsed, err := listener.parseSDP(webrtcOfferSDP)
+	if err != nil {
+		t.Fatalf("parseSDP failed: %v", err)
+	}
+	if parsed.MediaType != "audio" || parsed.ConnectionIP != "203.0.113.5" || parsed.SSRC != 1111 {
+		t.Errorf("unexpected primary media %+v", parsed)
+	}
+	if parsed.Setup != "actpass" || parsed.Direction != SDPDirectionSendOnly || !parsed.RTCPMux {
+		t.Errorf("expected audio attributes only, got setup=%s direction=%s", parsed.Setup, parsed.Direction)
+	}
+	if !parsed.HasICE || parsed.ICEPwd == "" || !parsed.HasDTLS {
+		t.Error("expected session-level ICE and DTLS attributes to be inherited")
+	}
+}
+
+func TestNGSocketListener_ParseSDPRTCPAttribute(t *testing.T) {
+	offer := "v=0\r\n" +
+		"o=- 1 1 IN IP4 192.0.2.10\r\n" +
+		"s=-\r\n" +
+		"c=IN IP4 192.0.2.10\r\n" +
+		"t=0 0\r\n" +
+		"m=audio 30000 RTP/AVP 0\r\n" +
+		"a=rtcp:30011 IN IP4 192.0.2.11\r\n"
+
+	listener := &NGSocketListener{}
+	parsed, err := listener.parseSDP(offer)
+	if err != nil {
+		t.Fatalf("parseSDP failed: %v", err)
+	}
+	if parsed.RTCPPort != 30011 || parsed.RTCPIP != "192.0.2.11" {
+		t.Errorf("a=rtcp parsed as %s:%d", parsed.RTCPIP, parsed.RTCPPort)
+	}
+
+	session, leg := &MediaSession{}, &CallLeg{}
+	listener.applyRemoteMedia(session, leg, parsed, nil)
+	if addr := leg.RTCPAddr(); addr == nil || addr.String() != "192.0.2.11:30011" {
+		t.Errorf("RTCP address %v, want 192.0.2.11:30011", addr)
+	}
+
+	// Without the attribute RTCP goes to the port after RTP
+	parsed.RTCPPort, parsed.RTCPIP = 0, ""
+	listener.applyRemoteMedia(session, leg, parsed, nil)
+	if addr := leg.RTCPAddr(); addr == nil || addr.String() != "192.0.2.10:30001" {
+		t.Errorf("RTCP address %v, want 192.0.2.10:30001", addr)
+	}
+}
@@ -714,6 +714,13 @@ func ResolveSecretReference(ctx context.Context, ref *SecretReference, manager *
 		}
 		return strings.TrimSpace(string(data)), nil
 
+	case "vault":
+		vault, err := NewVaultSecretProvider(nil)
+		if err != nil {
+			return "", err
+		}
+		return vault.GetSecret(ctx, ref.Key)
+
 	case "manager":
 		if manager == nil {
 			return "", errors.New("secrets manager not available")
@@ -0,0 +1,508 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// sessionForwarder is the worker pool handler of the SSRCs signalled in a
+// session: it relays each stream to the other leg of its call
+type sessionForwarder struct {
+	registry *SessionRegistry
+	send     func(conn *net.UDPConn, packets [][]byte, addr *net.UDPAddr) (int, error)
+}
+
+// SetMediaSender sets how the registry's sessions relay RTP to the peer
+// leg, such as RTPControl.SendBatchFrom, and hands the streams of its
+// sessions to the worker pool. send returns how many of the packets went
+// out; the packets a received one becomes, such as the fragments of a
+// transcoded video frame, are sent together. nil stops relaying
+func (sr *SessionRegistry) SetMediaSender(send func(conn *net.UDPConn, packets [][]byte, addr *net.UDPAddr) (int, error)) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	if sr.forwarder != nil {
+		for ssrc := range sr.ssrcIndex {
+			unregisterRTPHandlerOf(ssrc, sr.forwarder)
+		}
+		sr.forwarder = nil
+	}
+	if send == nil {
+		return
+	}
+	sr.forwarder = &sessionForwarder{registry: sr, send: send}
+	for ssrc := range sr.ssrcIndex {
+		RegisterRTPHandler(ssrc, sr.forwarder)
+	}
+}
+
+// indexSSRC maps an SSRC to its session and hands the stream to the
+// forwarder; the caller holds sr.mu
+func (sr *SessionRegistry) indexSSRC(ssrc uint32, session *MediaSession) {
+	sr.ssrcIndex[ssrc] = session
+	if sr.forwarder != nil {
+		RegisterRTPHandler(ssrc, sr.forwarder)
+	}
+}
+
+// unindexSSRC removes an SSRC from the index and the forwarder; the caller
+// holds sr.mu
+func (sr *SessionRegistry) unindexSSRC(ssrc uint32) {
+	delete(sr.ssrcIndex, ssrc)
+	if sr.forwarder != nil {
+		unregisterRTPHandlerOf(ssrc, sr.forwarder)
+	}
+	if sr.keyframes != nil {
+		sr.keyframes.forget(ssrc)
+	}
+	if sr.videoTranscoder != nil {
+		sr.videoTranscoder.Remove(ssrc)
+	}
+}
+
+// mediaPort is where the media arriving on a bound leg port comes from. A
+// leg's ports are the ones in the SDP the other party got, so the caller
+// sends to the callee leg's ports and the callee to the caller leg's
+type mediaPort struct {
+	session    *MediaSession
+	fromCaller bool
+	stream     int // Index of the m= section with its own port, -1 for the leg's ports
+	learned    int // SSRCs learned on the port
+}
+
+// maxLearnedSSRCs bounds the streams learned on one port, so that a sender
+// cycling through SSRCs cannot grow the index
+const maxLearnedSSRCs = 16
+
+// indexMediaPorts maps the bound ports of a leg and of its m= sections to
+// the party sending to them
+func (sr *SessionRegistry) indexMediaPorts(session *MediaSession, leg *CallLeg) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	session.mu.RLock()
+	defer session.mu.RUnlock()
+
+	if sr.sessions[session.ID] != session {
+		return
+	}
+	fromCaller := leg != session.CallerLeg
+	index := func(conn *net.UDPConn, stream int) {
+		if conn == nil {
+			return
+		}
+		if _, ok := sr.portIndex[conn]; !ok {
+			sr.portIndex[conn] = &mediaPort{session: session, fromCaller: fromCaller, stream: stream}
+		}
+	}
+	index(leg.Conn, -1)
+	index(leg.RTCPConn, -1)
+	for _, stream := range leg.Streams {
+		if stream.Conn != leg.Conn {
+			index(stream.Conn, stream.Index)
+			index(stream.RTCPConn, stream.Index)
+		}
+	}
+}
+
+// unindexMediaPortsLocked removes the ports of a session's legs from the
+// index; the caller holds sr.mu and the session lock
+func (sr *SessionRegistry) unindexMediaPortsLocked(session *MediaSession) {
+	for _, leg := range []*CallLeg{session.CallerLeg, session.CalleeLeg} {
+		if leg == nil {
+			continue
+		}
+		for _, conn := range leg.conns() {
+			delete(sr.portIndex, conn)
+		}
+	}
+}
+
+// mediaPortOf returns where the media arriving on a port comes from, nil
+// for a port of no leg, such as the shared RTP listener
+func (sr *SessionRegistry) mediaPortOf(conn *net.UDPConn) *mediaPort {
+	if conn == nil {
+		return nil
+	}
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+	return sr.portIndex[conn]
+}
+
+// sender returns the leg of the party sending media to the port: the
+// caller, or the callee's branch at the source address while a forked
+// call's branches answer. The caller holds the session lock
+func (p *mediaPort) sender(from *net.UDPAddr) *CallLeg {
+	s := p.session
+	if p.fromCaller {
+		return s.CallerLeg
+	}
+	if from != nil {
+		for _, branch := range s.Branches {
+			if branch.IP != nil && branch.IP.Equal(from.IP) {
+				return branch
+			}
+		}
+	}
+	return s.CalleeLeg
+}
+
+// sends reports whether a leg is on the side of the call sending to the
+// port. The caller holds the session lock
+func (p *mediaPort) sends(leg *CallLeg) bool {
+	return leg != nil && (leg == p.session.CallerLeg) == p.fromCaller
+}
+
+// LearnSSRC ties an RTP stream arriving on a leg's port to the party that
+// sends to the port, so that endpoints that do not announce their SSRCs
+// with a=ssrc are relayed. A stream already tied to the other party or to
+// another call is rejected, as are streams beyond maxLearnedSSRCs on a
+// port. Packets on ports of no leg are left to the SSRC index
+func (sr *SessionRegistry) LearnSSRC(conn *net.UDPConn, ssrc uint32, from *net.UDPAddr) bool {
+	sr.mu.RLock()
+	port := sr.portIndex[conn]
+	owner, known := sr.ssrcIndex[ssrc]
+	sr.mu.RUnlock()
+	if port == nil {
+		return true
+	}
+	if known {
+		if owner != port.session {
+			return false
+		}
+		owner.mu.RLock()
+		defer owner.mu.RUnlock()
+		return port.sends(owner.SSRCToLeg[ssrc])
+	}
+
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	if sr.portIndex[conn] != port || port.learned >= maxLearnedSSRCs {
+		return false
+	}
+	session := port.session
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if owner, known := sr.ssrcIndex[ssrc]; known {
+		return owner == session && port.sends(session.SSRCToLeg[ssrc])
+	}
+	leg := port.sender(from)
+	if leg == nil {
+		return false
+	}
+	if stream := leg.streamAt(port.stream); stream != nil && stream.SSRC == 0 {
+		stream.SSRC = ssrc
+	}
+	sr.registerSSRCLocked(session, leg, ssrc)
+	port.learned++
+	if IsDebugLoggingEnabled() {
+		workerLog.Debug("Learned SSRC", append(streamAttrs(ssrc), "call_id", session.CallID, "leg", leg.Tag)...)
+	}
+	return true
+}
+
+// SetVideoTranscoder makes the registry transcode the video of a call whose
+// legs share no video codec. The transcoder asks the senders for keyframes
+// through the keyframe sender when packets are lost. nil stops it
+func (sr *SessionRegistry) SetVideoTranscoder(transcoder *VideoTranscoder) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	if sr.videoTranscoder != nil && sr.videoTranscoder != transcoder {
+		sr.videoTranscoder.Close()
+	}
+	sr.videoTranscoder = transcoder
+	if transcoder == nil {
+		return
+	}
+	transcoder.requestKeyframe = func(ssrc uint32) {
+		if keyframes := sr.keyframeRequester(); keyframes != nil {
+			if err := keyframes.request(ssrc, false, "loss"); err != nil && IsDebugLoggingEnabled() {
+				workerLog.Debug("Keyframe request failed", append(streamAttrs(ssrc), "error", err)...)
+			}
+		}
+	}
+}
+
+// videoTranscoderOf returns the registry's video transcoder, nil if unset
+func (sr *SessionRegistry) videoTranscoderOf() *VideoTranscoder {
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+	return sr.videoTranscoder
+}
+
+// Handle sends a packet to the leg opposite the one whose SSRC it carries,
+// from the sending leg's own port when it has one: the port in the SDP the
+// receiver got, so each party sends and receives on one port. A stream of
+// another m= section goes to the same section of the peer leg. Media from a blocked leg, or
+// towards a leg with no address yet, is dropped, and audio from a muted leg
+// is silenced
+func (f *sessionForwarder) Handle(packet *RTPPacket) error {
+	session, leg, ok := f.registry.GetSessionBySSRC(packet.SSRC)
+	if !ok || leg == nil {
+		return fmt.Errorf("SSRC %d left its session", packet.SSRC)
+	}
+
+	session.mu.RLock()
+	addr, conn, stream, out := session.route(leg, packet.SSRC)
+	video := stream != nil && stream.MediaType == MediaVideo
+	var src, dst CodecInfo
+	transcode := false
+	if video && out != nil && !session.ZRTP {
+		src, dst, transcode = videoTranscodeCodecs(packet.PayloadType, stream, out)
+	}
+	fromExt, toExt, mid := session.headerExtensions(leg, stream, out)
+	audio, codecs, decode := session.speechSource(leg, stream)
+	relayed := leg.relayedSSRC[packet.SSRC]
+	silenced := audio && leg.Silenced
+	session.mu.RUnlock()
+	if addr == nil {
+		return nil
+	}
+	if silenced {
+		if packet = silencePacket(packet, codecs, decode); packet == nil {
+			return nil
+		}
+	}
+
+	packets := []*RTPPacket{packet}
+	if transcode {
+		if transcoder := f.registry.videoTranscoderOf(); transcoder != nil && transcoder.CanTranscode(src, dst) {
+			var err error
+			if packets, err = transcoder.Transcode(packet, src, dst); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Header extensions go out under the receiver's identifiers, and a
+	// stream that replaced an earlier one under that one's SSRC
+	rewrite := packet.Extension && (!fromExt.equal(toExt) || mid != "" && stream != nil && stream.MID != mid)
+	if rewrite || relayed != 0 {
+		for i, p := range packets {
+			rewritten := *p
+			changed := rewrite && RewriteHeaderExtensions(&rewritten, fromExt, toExt, mid)
+			if relayed != 0 {
+				rewritten.SSRC, changed = relayed, true
+			}
+			if changed {
+				packets[i] = &rewritten
+			}
+		}
+	}
+
+	bufs := make([]*[]byte, len(packets))
+	wire := make([][]byte, len(packets))
+	for i, out := range packets {
+		bufs[i] = getPacketBuffer()
+		wire[i] = marshalRTPPacket(out, *bufs[i])
+	}
+	sent, err := f.send(conn, wire, addr)
+	for _, buf := range bufs {
+		putPacketBuffer(buf)
+	}
+	session.recordSent(leg, packet.SSRC, packets[:sent])
+	if err != nil {
+		return err
+	}
+	if audio && !silenced {
+		if level, voice, ok := speechLevel(packet, fromExt, codecs, decode); ok {
+			if speaker, previous, changed := session.observeSpeech(leg, level, voice, time.Now()); changed {
+				publishActiveSpeaker(session, speaker, previous)
+			}
+		}
+	}
+	if video {
+		if keyframes := f.registry.keyframeRequester(); keyframes != nil {
+			keyframes.relayed(packet.SSRC, packet.SequenceNumber, addr)
+		}
+	}
+	return nil
+}
+
+// route returns where media of a leg's SSRC goes and the port it is sent
+// from, nil when it is dropped, and the m= sections it leaves and enters
+// when the SSRC was signalled in one. Media the legs' media controls stop
+// is dropped too. The caller holds the session lock
+func (s *MediaSession) route(leg *CallLeg, ssrc uint32) (addr *net.UDPAddr, conn *net.UDPConn, stream, out *MediaStream) {
+	peer := s.CalleeLeg
+	if leg == s.CalleeLeg {
+		peer = s.CallerLeg
+	}
+	// A branch of a forked call other than the active one is not relayed
+	if peer == nil || peer == leg || !relays(leg, peer) || leg != s.CallerLeg && leg != s.CalleeLeg {
+		return nil, nil, nil, nil
+	}
+	addr, conn = peer.mediaAddr(), leg.Conn
+	if stream = leg.streamOf(ssrc); stream != nil {
+		out = peer.streamAt(stream.Index)
+		if stream.LocalPort != leg.LocalPort {
+			addr, conn = nil, nil
+			if out != nil && out.MediaType == stream.MediaType {
+				addr, conn = out.mediaAddr(peer), stream.Conn
+			}
+		}
+	}
+	return addr, conn, stream, out
+}
+
+// headerExtensions returns the header extensions the sender and the
+// receiver of a leg's SSRC negotiated in their m= sections, and the MID of
+// the receiving section. The caller holds the session lock
+func (s *MediaSession) headerExtensions(leg *CallLeg, stream, out *MediaStream) (from, to RTPExtmap, mid string) {
+	peer := s.CalleeLeg
+	if leg == s.CalleeLeg {
+		peer = s.CallerLeg
+	}
+	from = leg.Extmap
+	if stream != nil {
+		from = stream.Extmap
+	}
+	if out != nil {
+		return from, out.Extmap, out.MID
+	}
+	if peer != nil {
+		to = peer.Extmap
+	}
+	return from, to, ""
+}
+
+// speechSource reports whether a leg's SSRC carries audio, the codecs of
+// its section, and whether its payload is in the clear so its level can be
+// measured. The caller holds the session lock
+func (s *MediaSession) speechSource(leg *CallLeg, stream *MediaStream) (audio bool, codecs []CodecInfo, decode bool) {
+	mediaType, codecs, transport := leg.MediaType, leg.Codecs, leg.Transport
+	if stream != nil {
+		mediaType, codecs, transport = stream.MediaType, stream.Codecs, stream.Transport
+	}
+	crypto := s.CallerCrypto
+	if leg == s.CalleeLeg {
+		crypto = s.CalleeCrypto
+	}
+	decode = !s.ZRTP && (crypto != nil || !strings.Contains(string(transport), "SAVP"))
+	return mediaType == MediaAudio, codecs, decode
+}
+
+// recordSent counts packets relayed from a leg's SSRC in the sender stats
+// of the stream they went to. A new SSRC towards the stream starts its
+// counts over
+func (s *MediaSession) recordSent(leg *CallLeg, ssrc uint32, packets []*RTPPacket) {
+	if len(packets) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peer := s.CalleeLeg
+	if leg == s.CalleeLeg {
+		peer = s.CallerLeg
+	}
+	if peer == nil || peer == leg {
+		return
+	}
+	stats, codecs := &peer.Sent, peer.Codecs
+	if stream := leg.streamOf(ssrc); stream != nil && stream.LocalPort != leg.LocalPort {
+		out := peer.streamAt(stream.Index)
+		if out == nil {
+			return
+		}
+		stats, codecs = &out.Sent, out.Codecs
+	}
+
+	now := time.Now()
+	for _, p := range packets {
+		if stats.SSRC != p.SSRC {
+			*stats = SenderStats{SSRC: p.SSRC}
+		}
+		stats.Packets++
+		stats.Octets += uint64(len(p.Payload))
+		stats.Timestamp, stats.SentAt = p.Timestamp, now
+		if codec, ok := findCodecByPayloadType(codecs, p.PayloadType); ok && codec.ClockRate > 0 {
+			stats.ClockRate = codec.ClockRate
+		}
+	}
+}
+
+// videoTranscodeCodecs picks the codecs to transcode a video packet
+// between: the sender's codec of its payload type, and the first codec the
+// receiver's section offers when that does not include the sender's. The
+// caller holds the session lock
+func videoTranscodeCodecs(payloadType uint8, in, out *MediaStream) (src, dst CodecInfo, ok bool) {
+	src, ok = findCodecByPayloadType(in.Codecs, payloadType)
+	if !ok || len(out.Codecs) == 0 {
+		return CodecInfo{}, CodecInfo{}, false
+	}
+	for _, codec := range out.Codecs {
+		if sameCodec(codec, src) {
+			return CodecInfo{}, CodecInfo{}, false
+		}
+	}
+	for _, codec := range out.Codecs {
+		switch strings.ToLower(codec.Name) {
+		case "rtx", "red", "ulpfec", "flexfec-03":
+			continue
+		}
+		return src, codec, true
+	}
+	return CodecInfo{}, CodecInfo{}, false
+}
+
+// mediaAddr returns where a leg's RTP goes: the source it was latched to,
+// or else the address in its SDP. The caller holds the session lock
+func (l *CallLeg) mediaAddr() *net.UDPAddr {
+	if l.LatchedSource != nil {
+		return l.LatchedSource
+	}
+	if l.IP == nil || l.IP.IsUnspecified() || l.Port <= 0 {
+		return nil
+	}
+	return &net.UDPAddr{IP: l.IP, Port: l.Port}
+}
+
+// streamOf returns the m= section of a leg whose SDP announced an SSRC, or
+// nil. The caller holds the session lock
+func (l *CallLeg) streamOf(ssrc uint32) *MediaStream {
+	for _, stream := range l.Streams {
+		if stream.SSRC == ssrc {
+			return stream
+		}
+	}
+	return nil
+}
+
+// streamAt returns the m= section of a leg at an index, or nil. The caller
+// holds the session lock
+func (l *CallLeg) streamAt(index int) *MediaStream {
+	if index < 0 || index >= len(l.Streams) {
+		return nil
+	}
+	return l.Streams[index]
+}
+
+// mediaAddr returns where the RTP of a leg's m= section goes: its port at
+// its own address or the leg's. The caller holds the session lock
+func (s *MediaStream) mediaAddr(leg *CallLeg) *net.UDPAddr {
+	return s.addr(leg, s.Port)
+}
+
+// rtcpAddr returns where the RTCP of a leg's m= section goes. The caller
+// holds the session lock
+func (s *MediaStream) rtcpAddr(leg *CallLeg) *net.UDPAddr {
+	port := s.RTCPPort
+	if s.RTCPMux {
+		port = s.Port
+	}
+	return s.addr(leg, port)
+}
+
+func (s *MediaStream) addr(leg *CallLeg, port int) *net.UDPAddr {
+	ip := s.IP
+	if ip == nil {
+		ip = leg.IP
+	}
+	if ip == nil || ip.IsUnspecified() || s.Port <= 0 || port <= 0 {
+		return nil
+	}
+	return &net.UDPAddr{IP: ip, Port: port}
+}
@@ -24,8 +24,9 @@ const (
 type MediaType string
 
 const (
-	MediaAudio MediaType = "audio"
-	MediaVideo MediaType = "video"
+	MediaAudio       MediaType = "audio"
+	MediaVideo       MediaType = "video"
+	MediaApplication MediaType = "application"
 )
 
 // TransportProtocol represents the transport protocol
@@ -45,11 +46,15 @@ type CallLeg struct {
 	IP            net.IP
 	Port          int
 	RTCPPort      int
+	RTCPIP        net.IP // a=rtcp address when it differs from IP
 	MediaType     MediaType
 	Codecs        []CodecInfo
+	Extmap        RTPExtmap // header extensions of the primary section
 	SSRC          uint32
 	Transport     TransportProtocol
 	ICECredentials *ICECredentials
+	ICECandidates []*net.UDPAddr // The peer's RTP candidates, highest priority first
+	LocalICE      *ICECredentials // Karl's credentials advertised to this leg
 	SRTPParams    *SRTPParameters
 	LocalIP       net.IP
 	LocalPort     int
@@ -63,26 +68,78 @@ type CallLeg struct {
 	BytesRecv     uint64
 	PacketsLost   uint32
 	Jitter        float64
+	Sent          SenderStats // RTP Karl relayed to the leg in its primary section
+
+	// Level of the leg's speech and when it last spoke, for the session's
+	// active speaker
+	speechLevel float64
+	lastVoice   time.Time
+
+	// SSRCs that replaced earlier streams of the leg, and the SSRC the peer
+	// keeps receiving them under
+	relayedSSRC map[uint32]uint32
 
 	// rtpengine compatible fields
 	Interface     string // Network interface name (internal/external)
 	AddressFamily string // inet or inet6
+	ViaBranch     string // via-branch of the answer of a forked call's branch
 	Direction     string // Direction: sendrecv, sendonly, recvonly, inactive
 
 	// Media control flags
 	Symmetric       bool // Force symmetric RTP
 	StrictSource    bool // Strict source checking
+	LatchedSource   *net.UDPAddr // First media source, enforced by learned source checks
+	SourceRejected  uint64 // Packets dropped by the expected source check
 	MediaHandover   bool // Allow media handover
 	PortLatching    bool // Port latching enabled
+	RTCPMux         bool // RTP and RTCP share one port (RFC 5761)
 
 	// Blocking
 	MediaBlocked  bool
 	DTMFBlocked   bool
 	Silenced      bool
+	ForcedDirection string // sendonly, recvonly or inactive set by a media control, empty to follow the SDP
+	Parked        bool // Media detached until the leg is re-attached
 
 	// T.38
 	T38Enabled    bool
 	T38Gateway    bool
+
+	// Every m= section of the leg's SDP in order. The primary audio
+	// section shares the leg's ports above.
+	Streams []*MediaStream
+}
+
+// MediaStream is one m= section of a call leg, relayed on its own ports
+type MediaStream struct {
+	Index         int
+	MediaType     MediaType
+	MID           string
+	IP            net.IP
+	Port          int // Zero when the peer rejected the section
+	RTCPPort      int
+	Transport     TransportProtocol
+	Direction     string
+	RTCPMux       bool
+	SSRC          uint32
+	Codecs        []CodecInfo
+	Extmap        RTPExtmap
+	LocalPort     int
+	LocalRTCPPort int
+	Conn          *net.UDPConn // the section's own RTP port, nil while unbound
+	RTCPConn      *net.UDPConn
+	Sent          SenderStats // RTP Karl relayed to the section
+}
+
+// SenderStats describes the RTP stream Karl sends a leg in one m= section,
+// for the sender reports about it (RFC 3550 section 6.4.1)
+type SenderStats struct {
+	SSRC      uint32 // as sent, after any transcoding
+	Packets   uint64
+	Octets    uint64    // payload octets
+	Timestamp uint32    // RTP timestamp of the last packet
+	SentAt    time.Time // when the last packet was sent
+	ClockRate uint32    // of the last packet's codec, 0 if unknown
 }
 
 // ICECredentials holds ICE authentication credentials
@@ -100,6 +157,11 @@ type SRTPParameters struct {
 	DTLS        bool
 	Fingerprint string
 	Setup       string // actpass, active, passive
+
+	// Re-keying state
+	KeyGeneration int       // Incremented on every master key rotation
+	RekeyedAt     time.Time // When the current key was installed
+	RekeyPending  bool      // New key not yet signalled in an offer/answer
 }
 
 // CodecInfo represents codec information
@@ -129,6 +191,7 @@ type SessionStats struct {
 	AvgJitter         float64
 	MaxJitter         float64
 	RTT               float64
+	RFactor           float64
 	MOS               float64
 }
 
@@ -168,6 +231,19 @@ type MediaSession struct {
 	TranscodeCodecs []string
 	AlwaysTranscode bool
 
+	// SourceCheck is the expected source check the call asked for with
+	// source-check, empty to follow media_acl's
+	SourceCheck SourceCheckMode
+
+	// Tenant is the tenant the call belongs to, empty for none
+	Tenant string
+
+	// KernelOffloaded is set while the XDP program relays the call, whose
+	// packets Karl then does not see; offloadEnded is when it last came
+	// back to user space
+	KernelOffloaded bool
+	offloadEnded    time.Time
+
 	// ICE session state
 	ICELite       bool
 	TrickleICE    bool
@@ -183,6 +259,24 @@ type MediaSession struct {
 	SDESOff  bool
 	SDESOnly bool
 
+	// Protection Karl ends with the caller and the callee when it bridges
+	// their transports, nil while their media passes through
+	CallerCrypto *MediaCrypto
+	CalleeCrypto *MediaCrypto
+
+	// ZRTP is set while the parties key their media end to end with ZRTP,
+	// which Karl then relays unchanged
+	ZRTP bool
+
+	// ActiveSpeaker is the leg that is speaking, "caller" or "callee", or
+	// empty while neither is
+	ActiveSpeaker string
+
+	// Branches holds the callee legs of a forked call's branches that
+	// answered with early media, by to-tag, the active CalleeLeg among
+	// them. It is empty once a branch answered finally
+	Branches map[string]*CallLeg
+
 	// T.38 session state
 	T38Enabled  bool
 	T38Gateway  bool
@@ -232,8 +326,42 @@ type SessionRegistry struct {
 	stopCleanup   chan struct{}
 	sessionTTL    time.Duration
 	onSessionEnd  func(*MediaSession)
+
+	// onSessionStart is called when a session first becomes active
+	onSessionStart func(*MediaSession)
+
+	// onSessionRemoved is called after a session leaves the registry
+	onSessionRemoved func(*MediaSession)
+
+	// forwarder relays the streams of the sessions, nil until a media
+	// sender is set
+	forwarder *sessionForwarder
+
+	// keyframes asks video senders for keyframes, nil until a keyframe
+	// sender is set
+	keyframes *keyframeRequester
+
+	// videoTranscoder converts video between codecs the legs do not share,
+	// nil unless video transcoding is enabled
+	videoTranscoder *VideoTranscoder
+
+	// cryptoIndex maps the ports of bridged calls to the protection of the
+	// party each was given to
+	cryptoIndex map[*net.UDPConn]*MediaCrypto
+
+	// portIndex maps the bound ports of the sessions' legs to the party
+	// sending to them
+	portIndex map[*net.UDPConn]*mediaPort
+
+	// Media inactivity reaping
+	mediaTimeout   time.Duration
+	mediaTicker    *time.Ticker
+	onMediaTimeout func(*MediaSession, time.Duration)
 }
 
+// mediaCheckInterval is how often active sessions are checked for media inactivity
+const mediaCheckInterval = 5 * time.Second
+
 // NewSessionRegistry creates a new session registry
 func NewSessionRegistry(sessionTTL time.Duration) *SessionRegistry {
 	sr := &SessionRegistry{
@@ -241,12 +369,15 @@ func NewSessionRegistry(sessionTTL time.Duration) *SessionRegistry {
 		callIDIndex:  make(map[string][]*MediaSession),
 		fromTagIndex: make(map[string]*MediaSession),
 		ssrcIndex:    make(map[uint32]*MediaSession),
+		cryptoIndex:  make(map[*net.UDPConn]*MediaCrypto),
+		portIndex:    make(map[*net.UDPConn]*mediaPort),
 		sessionTTL:   sessionTTL,
 		stopCleanup:  make(chan struct{}),
 	}
 
 	// Start cleanup goroutine
 	sr.cleanupTicker = time.NewTicker(30 * time.Second)
+	sr.mediaTicker = time.NewTicker(mediaCheckInterval)
 	go sr.cleanupLoop()
 
 	return sr
@@ -259,19 +390,168 @@ func (sr *SessionRegistry) SetOnSessionEnd(callback func(*MediaSession)) {
 	sr.onSessionEnd = callback
 }
 
+// SetOnSessionStart sets the callback for a session connecting, called
+// the first time it becomes active
+func (sr *SessionRegistry) SetOnSessionStart(callback func(*MediaSession)) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.onSessionStart = callback
+}
+
+// SetOnSessionRemoved sets the callback invoked when a session is removed,
+// whether by explicit delete, TTL cleanup or registry shutdown
+func (sr *SessionRegistry) SetOnSessionRemoved(callback func(*MediaSession)) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.onSessionRemoved = callback
+}
+
+// SetMediaTimeout sets the default media inactivity timeout for active
+// sessions. Sessions with their own media-timeout flag override it; zero disables.
+func (sr *SessionRegistry) SetMediaTimeout(timeout time.Duration) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.mediaTimeout = timeout
+}
+
+// SetOnMediaTimeout sets the callback invoked when a session is reaped for
+// media inactivity, with the idle time that triggered it
+func (sr *SessionRegistry) SetOnMediaTimeout(callback func(*MediaSession, time.Duration)) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.onMediaTimeout = callback
+}
+
+// RecordMediaActivity marks the leg sending an SSRC as having received media
+// and counts the packet as received from that leg and sent to its peer
+func (sr *SessionRegistry) RecordMediaActivity(ssrc uint32, size int) {
+	sr.mu.RLock()
+	session, ok := sr.ssrcIndex[ssrc]
+	sr.mu.RUnlock()
+	if !ok {
+		return
+	}
+	countReceivedMedia(size)
+
+	session.mu.Lock()
+	if leg := session.SSRCToLeg[ssrc]; leg != nil {
+		leg.LastActivity = time.Now()
+		leg.PacketsRecv++
+		leg.BytesRecv += uint64(size)
+
+		peer := session.CalleeLeg
+		if leg == session.CalleeLeg {
+			peer = session.CallerLeg
+		}
+		if peer != nil && peer != leg {
+			peer.PacketsSent++
+			peer.BytesSent += uint64(size)
+		}
+	}
+	session.mu.Unlock()
+}
+
 // cleanupLoop removes stale sessions
 func (sr *SessionRegistry) cleanupLoop() {
 	for {
 		select {
 		case <-sr.cleanupTicker.C:
 			sr.cleanupStaleSessions()
+		case <-sr.mediaTicker.C:
+			sr.reapInactiveSessions(time.Now())
 		case <-sr.stopCleanup:
 			sr.cleanupTicker.Stop()
+			sr.mediaTicker.Stop()
 			return
 		}
 	}
 }
 
+// mediaIdleTime returns how long since any leg of the session saw media.
+// A call whose legs have not received media yet, such as one whose
+// endpoints do not announce their SSRCs, is idle since it was answered,
+// or created when it never was. Calls relayed in the kernel report false,
+// as their media does not reach Karl. The caller must hold the session
+// lock.
+func (session *MediaSession) mediaIdleTime(now time.Time) (time.Duration, bool) {
+	if session.KernelOffloaded {
+		return 0, false
+	}
+
+	var last time.Time
+	for _, leg := range []*CallLeg{session.CallerLeg, session.CalleeLeg} {
+		if leg != nil && leg.PacketsRecv > 0 && leg.LastActivity.After(last) {
+			last = leg.LastActivity
+		}
+	}
+	if last.IsZero() {
+		last = session.CreatedAt
+		if session.Stats != nil && session.Stats.ConnectTime.After(last) {
+			last = session.Stats.ConnectTime
+		}
+	}
+	if session.offloadEnded.After(last) {
+		last = session.offloadEnded
+	}
+	if last.IsZero() {
+		return 0, false
+	}
+	return now.Sub(last), true
+}
+
+// reapInactiveSessions tears down active sessions whose media has stopped
+func (sr *SessionRegistry) reapInactiveSessions(now time.Time) int {
+	sr.mu.Lock()
+	defaultTimeout := sr.mediaTimeout
+	callback := sr.onMediaTimeout
+
+	type timedOut struct {
+		session *MediaSession
+		idle    time.Duration
+	}
+	var reaped []timedOut
+
+	for id, session := range sr.sessions {
+		session.mu.Lock()
+		timeout := defaultTimeout
+		if session.MediaTimeout >= 0 {
+			timeout = time.Duration(session.MediaTimeout) * time.Second
+		}
+
+		idle, hasMedia := session.mediaIdleTime(now)
+		expired := session.State == SessionStateActive && timeout > 0 && hasMedia && idle > timeout
+		if expired {
+			session.State = SessionStateTerminated
+			session.UpdatedAt = now
+			session.Stats.EndTime = now
+			if !session.Stats.ConnectTime.IsZero() {
+				session.Stats.Duration = now.Sub(session.Stats.ConnectTime)
+			}
+		}
+		session.mu.Unlock()
+
+		if expired {
+			_ = sr.removeSessionLocked(id)
+			reaped = append(reaped, timedOut{session: session, idle: idle})
+		}
+	}
+	endCallback := sr.onSessionEnd
+	sr.mu.Unlock()
+
+	for _, r := range reaped {
+		IncrementSessionsTimedOut()
+		sessionLog.Info("Session timed out without media", "session_id", r.session.ID, "call_id", r.session.CallID, "idle", r.idle.Round(time.Second))
+		if endCallback != nil {
+			go endCallback(r.session)
+		}
+		if callback != nil {
+			go callback(r.session, r.idle)
+		}
+	}
+
+	return len(reaped)
+}
+
 // cleanupStaleSessions removes sessions that have exceeded TTL
 func (sr *SessionRegistry) cleanupStaleSessions() {
 	sr.mu.Lock()
@@ -280,8 +560,10 @@ func (sr *SessionRegistry) cleanupStaleSessions() {
 	now := time.Now()
 	for id, session := range sr.sessions {
 		session.mu.RLock()
+		// Held calls are established and may stay silent for a long time
+		established := session.State == SessionStateActive || session.State == SessionStateHold
 		isStale := session.State == SessionStateTerminated ||
-			(session.State != SessionStateActive && now.Sub(session.UpdatedAt) > sr.sessionTTL)
+			(!established && now.Sub(session.UpdatedAt) > sr.sessionTTL)
 		session.mu.RUnlock()
 
 		if isStale {
@@ -346,7 +628,12 @@ func (sr *SessionRegistry) GetSessionByTags(callID, fromTag, toTag string) *Medi
 	sessions := sr.callIDIndex[callID]
 	for _, session := range sessions {
 		session.mu.RLock()
-		match := session.FromTag == fromTag && (toTag == "" || session.ToTag == toTag)
+		// A session without a to-tag yet matches the first answer
+		match := session.FromTag == fromTag && (toTag == "" || session.ToTag == "" || session.ToTag == toTag || session.Branches[toTag] != nil)
+		// as does a re-INVITE from the answerer, with the tags swapped
+		if session.ToTag != "" && session.ToTag == fromTag && (toTag == "" || session.FromTag == toTag) {
+			match = true
+		}
 		session.mu.RUnlock()
 		if match {
 			return session
@@ -372,6 +659,110 @@ func (sr *SessionRegistry) GetSessionBySSRC(ssrc uint32) (*MediaSession, *CallLe
 	return session, leg, true
 }
 
+// CallIDForSSRC returns the SIP Call-ID of the session an SSRC was signalled in
+func (sr *SessionRegistry) CallIDForSSRC(ssrc uint32) (string, bool) {
+	session, _, ok := sr.GetSessionBySSRC(ssrc)
+	if !ok {
+		return "", false
+	}
+	return session.CallID, true
+}
+
+// CheckMediaSource reports whether media arriving on conn may come from
+// addr. On a leg's port the expected source is that of the party sending
+// to the port, whatever the packet's SSRC, so that a fresh SSRC cannot get
+// around the check; on the shared listener the leg is found by the SSRC,
+// and SSRCs outside any session are allowed, as they are relayed nowhere.
+// The session's own source check takes precedence over mode. A leg is
+// checked when the mode asks for it or its offer carried strict-source:
+// SourceCheckSDP wants the address in the leg's SDP, while SourceCheckLearn
+// and strict-source latch the first RTP source and drop the others.
+// SourceCheckAny accepts every source. RTCP is matched on the IP only.
+// Rejected packets are counted on the leg
+func (sr *SessionRegistry) CheckMediaSource(conn *net.UDPConn, ssrc uint32, from *net.UDPAddr, mode SourceCheckMode, rtcp bool) bool {
+	if port := sr.mediaPortOf(conn); port != nil {
+		session := port.session
+		session.mu.Lock()
+		defer session.mu.Unlock()
+
+		leg := port.sender(from)
+		if leg == nil {
+			return false
+		}
+		expected := &net.UDPAddr{IP: leg.IP, Port: leg.Port}
+		if stream := leg.streamAt(port.stream); stream != nil {
+			if addr := stream.mediaAddr(leg); addr != nil {
+				expected = addr
+			}
+		}
+		return checkLegSource(session, leg, expected, from, mode, rtcp)
+	}
+
+	session, leg, ok := sr.GetSessionBySSRC(ssrc)
+	if !ok || leg == nil {
+		return true
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return checkLegSource(session, leg, &net.UDPAddr{IP: leg.IP, Port: leg.Port}, from, mode, rtcp)
+}
+
+// legSourceCheck returns the source check a leg gets under the media ACL
+// mode: the call's own source-check, and learn for strict-source legs the
+// mode leaves unchecked. The caller holds the session lock
+func legSourceCheck(session *MediaSession, leg *CallLeg, mode SourceCheckMode) SourceCheckMode {
+	if session.SourceCheck != "" {
+		mode = session.SourceCheck
+	}
+	if mode == SourceCheckOff && leg.StrictSource {
+		mode = SourceCheckLearn
+	}
+	return mode
+}
+
+// checkLegSource applies the source check of a leg whose SDP address is
+// expected. The caller holds the session lock
+func checkLegSource(session *MediaSession, leg *CallLeg, expected, from *net.UDPAddr, mode SourceCheckMode, rtcp bool) bool {
+	mode = legSourceCheck(session, leg, mode)
+
+	var allowed bool
+	switch mode {
+	case SourceCheckSDP:
+		allowed = expected.IP == nil || expected.IP.IsUnspecified() ||
+			expected.IP.Equal(from.IP) && (rtcp || expected.Port == 0 || expected.Port == from.Port)
+	case SourceCheckLearn:
+		if leg.LatchedSource == nil {
+			if !rtcp {
+				leg.LatchedSource = &net.UDPAddr{IP: append(net.IP(nil), from.IP...), Port: from.Port}
+			}
+			return true
+		}
+		allowed = leg.LatchedSource.IP.Equal(from.IP) && (rtcp || leg.LatchedSource.Port == from.Port)
+	default:
+		return true
+	}
+
+	if !allowed {
+		leg.SourceRejected++
+		mediaSourceRejected.WithLabelValues(string(mode)).Inc()
+	}
+	return allowed
+}
+
+// RTCPMuxForSSRC reports whether the leg sending an SSRC negotiated rtcp-mux.
+// known is false when the SSRC does not belong to any session.
+func (sr *SessionRegistry) RTCPMuxForSSRC(ssrc uint32) (enabled bool, known bool) {
+	session, leg, ok := sr.GetSessionBySSRC(ssrc)
+	if !ok || leg == nil {
+		return false, false
+	}
+
+	session.mu.RLock()
+	defer session.mu.RUnlock()
+	return leg.RTCPMux, true
+}
+
 // UpdateSessionState updates the session state (accepts string to match interface)
 func (sr *SessionRegistry) UpdateSessionState(sessionID string, state string) error {
 	return sr.UpdateSessionStateTyped(sessionID, SessionState(state))
@@ -392,7 +783,8 @@ func (sr *SessionRegistry) UpdateSessionStateTyped(sessionID string, state Sessi
 	session.State = state
 	session.UpdatedAt = time.Now()
 
-	if state == SessionStateActive && session.Stats.ConnectTime.IsZero() {
+	connected := state == SessionStateActive && session.Stats.ConnectTime.IsZero()
+	if connected {
 		session.Stats.ConnectTime = time.Now()
 	}
 	if state == SessionStateTerminated {
@@ -403,6 +795,15 @@ func (sr *SessionRegistry) UpdateSessionStateTyped(sessionID string, state Sessi
 	}
 	session.mu.Unlock()
 
+	if connected {
+		sr.mu.RLock()
+		callback := sr.onSessionStart
+		sr.mu.RUnlock()
+		if callback != nil {
+			go callback(session)
+		}
+	}
+
 	// Trigger callback on termination
 	if state == SessionStateTerminated && oldState != SessionStateTerminated {
 		sr.mu.RLock()
@@ -430,7 +831,7 @@ func (sr *SessionRegistry) SetCallerLeg(sessionID string, leg *CallLeg) error {
 	session.CallerLeg = leg
 	if leg.SSRC != 0 {
 		session.SSRCToLeg[leg.SSRC] = leg
-		sr.ssrcIndex[leg.SSRC] = session
+		sr.indexSSRC(leg.SSRC, session)
 	}
 	session.UpdatedAt = time.Now()
 	session.mu.Unlock()
@@ -453,7 +854,7 @@ func (sr *SessionRegistry) SetCalleeLeg(sessionID string, leg *CallLeg) error {
 	session.ToTag = leg.Tag
 	if leg.SSRC != 0 {
 		session.SSRCToLeg[leg.SSRC] = leg
-		sr.ssrcIndex[leg.SSRC] = session
+		sr.indexSSRC(leg.SSRC, session)
 	}
 	session.UpdatedAt = time.Now()
 	session.mu.Unlock()
@@ -484,11 +885,169 @@ func (sr *SessionRegistry) RegisterSSRC(sessionID string, ssrc uint32, isCaller
 	if leg == nil {
 		return fmt.Errorf("leg not found for session: %s", sessionID)
 	}
+	sr.registerSSRCLocked(session, leg, ssrc)
+	return nil
+}
 
-	leg.SSRC = ssrc
+// registerSSRCLocked maps an SSRC to a leg. The caller holds sr.mu and the
+// session lock
+func (sr *SessionRegistry) registerSSRCLocked(session *MediaSession, leg *CallLeg, ssrc uint32) {
+	// The leg's SSRC is its primary stream's; other sections keep their own
+	if stream := leg.streamOf(ssrc); stream == nil || stream.LocalPort == leg.LocalPort {
+		leg.SSRC = ssrc
+	}
 	session.SSRCToLeg[ssrc] = leg
-	sr.ssrcIndex[ssrc] = session
+	sr.indexSSRC(ssrc, session)
+}
+
+// answerBranch returns the callee leg of the branch of a call whose answer
+// has toTag, creating it on the ports of the call's callee leg, and makes it
+// the active branch if it is the first to answer or answers finally. A
+// final answer releases the other branches. It reports whether the leg is
+// the active one, whose media is relayed
+func (sr *SessionRegistry) answerBranch(session *MediaSession, toTag, viaBranch string, early bool) (*CallLeg, bool) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	callee := session.CalleeLeg
+	leg := callee
+	if toTag != "" && toTag != callee.Tag {
+		if leg = session.Branches[toTag]; leg == nil {
+			leg = newBranchLeg(callee, toTag)
+		}
+	}
+	if viaBranch != "" {
+		leg.ViaBranch = viaBranch
+	}
+
+	if early {
+		if session.Branches == nil {
+			session.Branches = map[string]*CallLeg{callee.Tag: callee}
+		}
+		session.Branches[leg.Tag] = leg
+		return leg, leg == callee
+	}
 
+	// The answering branch wins
+	for _, branch := range session.Branches {
+		if branch != leg {
+			sr.releaseBranchLocked(session, branch)
+		}
+	}
+	if callee != leg {
+		sr.releaseBranchLocked(session, callee)
+	}
+	session.Branches = nil
+	session.CalleeLeg, session.ToTag = leg, leg.Tag
+	session.UpdatedAt = time.Now()
+	return leg, true
+}
+
+// newBranchLeg creates the leg of another branch of a forked call. The
+// branches were all sent the same offer, and the caller is given the same
+// address whichever answers, so it shares the ports of the callee leg
+func newBranchLeg(callee *CallLeg, toTag string) *CallLeg {
+	leg := &CallLeg{
+		Tag:           toTag,
+		MediaType:     callee.MediaType,
+		Interface:     callee.Interface,
+		LocalIP:       callee.LocalIP,
+		LocalPort:     callee.LocalPort,
+		LocalRTCPPort: callee.LocalRTCPPort,
+		Conn:          callee.Conn,
+		RTCPConn:      callee.RTCPConn,
+		LocalICE:      callee.LocalICE,
+		LastActivity:  time.Now(),
+	}
+	for _, stream := range callee.Streams {
+		leg.Streams = append(leg.Streams, &MediaStream{
+			Index:         stream.Index,
+			MediaType:     stream.MediaType,
+			LocalPort:     stream.LocalPort,
+			LocalRTCPPort: stream.LocalRTCPPort,
+			Conn:          stream.Conn,
+			RTCPConn:      stream.RTCPConn,
+		})
+	}
+	return leg
+}
+
+// RemoveBranch drops the branch of a forked call with a to-tag, or with a
+// via-branch when toTag is empty, unless it is the active one. It reports
+// whether a branch was removed
+func (sr *SessionRegistry) RemoveBranch(callID, fromTag, toTag, viaBranch string) bool {
+	session := sr.GetSessionByTags(callID, fromTag, toTag)
+	if session == nil {
+		return false
+	}
+
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	for tag, branch := range session.Branches {
+		if branch == session.CalleeLeg || (toTag != "" && tag != toTag) ||
+			(toTag == "" && (viaBranch == "" || branch.ViaBranch != viaBranch)) {
+			continue
+		}
+		sr.releaseBranchLocked(session, branch)
+		delete(session.Branches, tag)
+		if len(session.Branches) == 1 {
+			session.Branches = nil
+		}
+		return true
+	}
+	return false
+}
+
+// releaseBranchLocked stops relaying the media of a branch that lost. Its
+// ports are the callee leg's and stay with the call. The caller holds
+// sr.mu and the session lock
+func (sr *SessionRegistry) releaseBranchLocked(session *MediaSession, branch *CallLeg) {
+	for ssrc, leg := range session.SSRCToLeg {
+		if leg == branch {
+			delete(session.SSRCToLeg, ssrc)
+			sr.unindexSSRC(ssrc)
+		}
+	}
+}
+
+// continueSSRC relays a leg's new SSRC, such as the one its party signals
+// in a re-INVITE, under the SSRC the peer already receives from the leg,
+// continuing that stream's sequence numbers and timestamps
+func (s *MediaSession) continueSSRC(leg *CallLeg, from, to uint32) {
+	if from == 0 || to == 0 || from == to {
+		return
+	}
+	s.mu.Lock()
+	relayed, ok := leg.relayedSSRC[from]
+	if !ok {
+		relayed = from
+	}
+	if leg.relayedSSRC == nil {
+		leg.relayedSSRC = make(map[uint32]uint32)
+	}
+	leg.relayedSSRC[to] = relayed
+	s.mu.Unlock()
+
+	ContinueRepacketizer(from, to)
+}
+
+// RegisterLegSSRC registers an SSRC for a leg of a session, such as one of
+// the branches of a forked call
+func (sr *SessionRegistry) RegisterLegSSRC(session *MediaSession, leg *CallLeg, ssrc uint32) error {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	if _, ok := sr.sessions[session.ID]; !ok {
+		return fmt.Errorf("session not found: %s", session.ID)
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	sr.registerSSRCLocked(session, leg, ssrc)
 	return nil
 }
 
@@ -527,7 +1086,17 @@ func (sr *SessionRegistry) removeSessionLocked(sessionID string) error {
 
 	// Remove SSRC mappings
 	for ssrc := range session.SSRCToLeg {
-		delete(sr.ssrcIndex, ssrc)
+		sr.unindexSSRC(ssrc)
+	}
+	if session.FECHandler != nil {
+		UnregisterFECHandler(session.FECHandler)
+	}
+	sr.unbindCryptoLocked(session)
+	sr.unindexMediaPortsLocked(session)
+	for _, crypto := range []*MediaCrypto{session.CallerCrypto, session.CalleeCrypto} {
+		if crypto != nil {
+			crypto.Close()
+		}
 	}
 
 	// Close connections
@@ -549,6 +1118,10 @@ func (sr *SessionRegistry) removeSessionLocked(sessionID string) error {
 	}
 
 	delete(sr.sessions, sessionID)
+
+	if sr.onSessionRemoved != nil {
+		go sr.onSessionRemoved(session)
+	}
 	return nil
 }
 
@@ -754,6 +1327,9 @@ func (sr *SessionRegistry) AllocateMediaPorts(localIP string, minPort, maxPort i
 			rtpConn.Close()
 			continue
 		}
+		MarkRTPConn(rtpConn)
+		MarkRTCPConn(rtcpConn)
+		SetDontFragment(rtpConn)
 
 		return port, port + 1, rtpConn, rtcpConn, nil
 	}
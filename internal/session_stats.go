@@ -0,0 +1,223 @@
+package internal
+
+import (
+	"math"
+	"strings"
+	"time"
+)
+
+// LegQuality is the live media quality of one call leg. Loss and jitter are
+// measured on the packets Karl receives from the leg; the round-trip time
+// and remote scores come from the leg's RTCP reports
+type LegQuality struct {
+	Codec        string  // negotiated codec of the leg's primary payload type
+	PacketsLost  int32   // cumulative, RFC 3550 A.3
+	LossPercent  float64 // packets lost out of those expected
+	BurstDensity float64 // fraction lost within loss bursts, RFC 3611 4.7.2
+	GapDensity   float64 // fraction lost between bursts
+	JitterMs     float64 // interarrival jitter, RFC 3550 A.8
+	RTTMs        float64 // zero until an RTCP report carries LSR/DLSR
+	RFactor      float64 // E-model rating, zero without media
+	MOS          float64 // derived from the R-factor, zero without media
+
+	// The leg's own view of the media Karl sends it, from RTCP XR; zero
+	// when the leg sends no XR VoIP metrics
+	RemoteRFactor float64
+	RemoteMOS     float64
+}
+
+// SessionQuality is the live media quality of a session. Loss and jitter
+// average both legs, and the R-factor and MOS are those of the worse
+// direction
+type SessionQuality struct {
+	Caller       LegQuality
+	Callee       LegQuality
+	LossPercent  float64
+	BurstDensity float64
+	GapDensity   float64
+	AvgJitterMs  float64
+	MaxJitterMs  float64
+	RTTMs        float64
+	RFactor      float64
+	MOS          float64
+	Duration     time.Duration // time since the call connected, or since creation while ringing
+}
+
+// LiveQuality gathers a session's media quality from the receive
+// statistics and RTCP feedback of its legs. It also records the result in
+// session.Stats, so NG query responses and CDRs carry it. The caller must
+// hold the session lock
+func (session *MediaSession) LiveQuality() SessionQuality {
+	var q SessionQuality
+	var legs []*LegQuality
+	if session.CallerLeg != nil {
+		q.Caller = legQuality(session.CallID, session.CallerLeg, session.CalleeLeg, true)
+		legs = append(legs, &q.Caller)
+	}
+	if session.CalleeLeg != nil {
+		q.Callee = legQuality(session.CallID, session.CalleeLeg, session.CallerLeg, false)
+		legs = append(legs, &q.Callee)
+	}
+
+	measured := 0
+	for _, leg := range legs {
+		if leg.MOS == 0 {
+			continue
+		}
+		measured++
+		q.LossPercent += leg.LossPercent
+		q.BurstDensity = math.Max(q.BurstDensity, leg.BurstDensity)
+		q.GapDensity = math.Max(q.GapDensity, leg.GapDensity)
+		q.AvgJitterMs += leg.JitterMs
+		q.MaxJitterMs = math.Max(q.MaxJitterMs, leg.JitterMs)
+		q.RTTMs = math.Max(q.RTTMs, leg.RTTMs)
+		if q.MOS == 0 || leg.MOS < q.MOS {
+			q.RFactor, q.MOS = leg.RFactor, leg.MOS
+		}
+	}
+	if measured > 0 {
+		q.LossPercent /= float64(measured)
+		q.AvgJitterMs /= float64(measured)
+	}
+
+	if session.Stats != nil {
+		switch {
+		case session.State == SessionStateActive && !session.Stats.ConnectTime.IsZero():
+			q.Duration = time.Since(session.Stats.ConnectTime)
+		case session.Stats.Duration > 0:
+			q.Duration = session.Stats.Duration
+		default:
+			q.Duration = time.Since(session.CreatedAt)
+		}
+		if leg := session.CallerLeg; leg != nil {
+			session.Stats.CallerPacketsSent, session.Stats.CallerPacketsRecv = leg.PacketsSent, leg.PacketsRecv
+			session.Stats.CallerBytesent, session.Stats.CallerBytesRecv = leg.BytesSent, leg.BytesRecv
+		}
+		if leg := session.CalleeLeg; leg != nil {
+			session.Stats.CalleePacketsSent, session.Stats.CalleePacketsRecv = leg.PacketsSent, leg.PacketsRecv
+			session.Stats.CalleeBytesent, session.Stats.CalleeBytesRecv = leg.BytesSent, leg.BytesRecv
+		}
+		if measured > 0 {
+			session.Stats.PacketLossRate = q.LossPercent / 100
+			session.Stats.AvgJitter = q.AvgJitterMs / 1000
+			session.Stats.MaxJitter = q.MaxJitterMs / 1000
+			session.Stats.RTT = q.RTTMs / 1000
+			session.Stats.RFactor = q.RFactor
+			session.Stats.MOS = q.MOS
+		}
+	}
+	return q
+}
+
+// legQuality measures one leg. RTCP reports from the leg describe the
+// stream Karl relays to it, which carries the peer leg's SSRC. Without a
+// round trip from the reception reports, XR's round trip delay is used
+func legQuality(callID string, leg, peer *CallLeg, offerer bool) LegQuality {
+	var q LegQuality
+	if codecs, ok := GetCodecNegotiator().GetCallCodecs(callID); ok {
+		negotiated := codecs.OfferCodecs
+		if !offerer {
+			negotiated = codecs.AnswerCodecs
+		}
+		if len(negotiated) > 0 {
+			q.Codec = negotiated[0].Name
+		}
+	}
+	if q.Codec == "" && len(leg.Codecs) > 0 {
+		q.Codec = leg.Codecs[0].Name
+	}
+
+	stats, ok := GetReceiveStatsTracker().Get(leg.SSRC)
+	if !ok || leg.SSRC == 0 {
+		return q
+	}
+	snap := stats.Snapshot()
+	if snap.PacketsReceived == 0 {
+		return q
+	}
+	q.PacketsLost = snap.PacketsLost
+	if expected := float64(snap.PacketsReceived) + float64(snap.PacketsLost); expected > 0 && snap.PacketsLost > 0 {
+		q.LossPercent = float64(snap.PacketsLost) / expected * 100
+	}
+	q.BurstDensity, q.GapDensity = snap.BurstDensity, snap.GapDensity
+	q.JitterMs = snap.Jitter * 1000
+
+	if peer != nil {
+		if handler, ok := lookupRTCPFeedbackHandler(peer.SSRC); ok {
+			_, _, q.RTTMs, _ = handler.GetFeedback()
+		}
+		if xr, ok := GetRTCPDemuxer().GetVoIPMetrics(peer.SSRC); ok {
+			q.RemoteRFactor, q.RemoteMOS = xr.RFactor, xr.MOSCQ
+			if q.RTTMs == 0 {
+				q.RTTMs = float64(xr.RoundTripMs)
+			}
+		}
+	}
+	q.RFactor = EstimateRFactor(q.Codec, q.LossPercent, q.JitterMs, q.RTTMs)
+	q.MOS = RFactorToMOS(q.RFactor)
+	return q
+}
+
+// codecImpairment holds the ITU-T G.113 Appendix I equipment impairment
+// factor (Ie) and packet-loss robustness (Bpl) of a codec
+type codecImpairment struct {
+	ie, bpl float64
+}
+
+// codecImpairments lists the codecs Karl negotiates, with wideband codecs
+// rated on the narrowband scale. G.711 and G.722 assume the endpoints
+// conceal lost packets; codecs missing from the table are treated like G.711
+var codecImpairments = map[string]codecImpairment{
+	"PCMU":   {0, 25.1},
+	"PCMA":   {0, 25.1},
+	"G722":   {0, 25.1},
+	"G729":   {11, 19},
+	"G723":   {15, 16.1},
+	"ILBC":   {10, 32},
+	"GSM":    {20, 10},
+	"AMR":    {5, 10},
+	"AMR-WB": {5, 10},
+	"OPUS":   {0, 30},
+}
+
+// packetizationDelay is the one-way delay added by framing, in ms
+const packetizationDelay = 20
+
+// EstimateRFactor computes the ITU-T G.107 E-model transmission rating of
+// a stream, simplified for VoIP: R = 93.2 - Id - Ie,eff. The one-way
+// delay is half the round trip plus a jitter buffer of twice the jitter
+// and the packetization delay; loss is taken as random
+func EstimateRFactor(codec string, lossPercent, jitterMs, rttMs float64) float64 {
+	impairment, ok := codecImpairments[strings.ToUpper(codec)]
+	if !ok {
+		impairment = codecImpairments["PCMU"]
+	}
+
+	delay := rttMs/2 + 2*jitterMs + packetizationDelay
+	id := 0.024 * delay
+	if delay > 177.3 {
+		id += 0.11 * (delay - 177.3)
+	}
+	ieEff := impairment.ie + (95-impairment.ie)*lossPercent/(lossPercent+impairment.bpl)
+
+	r := 93.2 - id - ieEff
+	return math.Round(math.Max(0, math.Min(100, r))*10) / 10
+}
+
+// RFactorToMOS converts an R-factor to a listening MOS, G.107 Annex B
+func RFactorToMOS(r float64) float64 {
+	switch {
+	case r <= 0:
+		return 1
+	case r >= 100:
+		return 4.5
+	}
+	mos := 1 + 0.035*r + 7e-6*r*(r-60)*(100-r)
+	return math.Round(math.Max(1, mos)*100) / 100
+}
+
+// EstimateMOS estimates the listening MOS of a stream from its codec,
+// loss, jitter and round trip
+func EstimateMOS(codec string, lossPercent, jitterMs, rttMs float64) float64 {
+	return RFactorToMOS(EstimateRFactor(codec, lossPercent, jitterMs, rttMs))
+}
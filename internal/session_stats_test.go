@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEstimateMOS(t *testing.T) {
+	clean := EstimateMOS("PCMU", 0, 0, 0)
+	if clean < 4.3 || clean > 4.5 {
+		t.Errorf("expected a clean G.711 call to score about 4.4, got %.2f", clean)
+	}
+	lossy := EstimateMOS("PCMU", 5, 20, 100)
+	if lossy >= clean || lossy < 3 {
+		t.Errorf("expected 5%% loss to score between 3 and %.2f, got %.2f", clean, lossy)
+	}
+	if worse := EstimateMOS("PCMU", 5, 20, 600); worse >= lossy {
+		t.Errorf("expected a long round trip to lower the score below %.2f, got %.2f", lossy, worse)
+	}
+	if bad := EstimateMOS("PCMU", 60, 0, 0); bad > 1.5 {
+		t.Errorf("expected 60%% loss to score about 1, got %.2f", bad)
+	}
+}
+
+func TestEstimateRFactor_Codecs(t *testing.T) {
+	if r := EstimateRFactor("PCMA", 0, 0, 0); r < 92 || r > 93.2 {
+		t.Errorf("expected a clean G.711 call to rate about 92.7, got %.1f", r)
+	}
+	// G.729 starts lower and suffers more from loss than G.711 with PLC
+	g711, g729 := EstimateRFactor("PCMU", 2, 10, 50), EstimateRFactor("G729", 2, 10, 50)
+	if g729 >= g711-10 {
+		t.Errorf("expected G.729 to rate well below G.711, got %.1f and %.1f", g729, g711)
+	}
+	if unknown := EstimateRFactor("x-unknown", 2, 10, 50); unknown != g711 {
+		t.Errorf("expected an unknown codec to rate like G.711, got %.1f", unknown)
+	}
+	if opus := EstimateRFactor("opus", 2, 10, 50); opus <= g729 {
+		t.Errorf("expected the codec name to be matched case-insensitively, got %.1f", opus)
+	}
+	if mos := RFactorToMOS(0); mos != 1 {
+		t.Errorf("expected the lowest rating to map to MOS 1, got %.2f", mos)
+	}
+}
+
+func TestSessionRegistry_RecordMediaActivityCounts(t *testing.T) {
+	manager, registry, _ := newTestSessionManager(t)
+	session := registry.CreateSession("call-stats", "from-stats")
+	caller, _ := manager.AllocateLeg(session, "from-stats", true)
+	callee, _ := manager.AllocateLeg(session, "to-stats", false)
+	if err := registry.RegisterSSRC(session.ID, 0x7001, true); err != nil {
+		t.Fatalf("RegisterSSRC failed: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		registry.RecordMediaActivity(0x7001, 172)
+	}
+
+	session.Lock()
+	defer session.Unlock()
+	if caller.PacketsRecv != 3 || caller.BytesRecv != 516 || caller.PacketsSent != 0 {
+		t.Errorf("unexpected caller counters %d/%d/%d", caller.PacketsRecv, caller.BytesRecv, caller.PacketsSent)
+	}
+	if callee.PacketsSent != 3 || callee.BytesSent != 516 || callee.PacketsRecv != 0 {
+		t.Errorf("unexpected callee counters %d/%d/%d", callee.PacketsSent, callee.BytesSent, callee.PacketsRecv)
+	}
+}
+
+func TestMediaSession_LiveQuality(t *testing.T) {
+	manager, registry, _ := newTestSessionManager(t)
+	session := registry.CreateSession("call-quality", "from-quality")
+	caller, _ := manager.AllocateLeg(session, "from-quality", true)
+	callee, _ := manager.AllocateLeg(session, "to-quality", false)
+
+	n := GetCodecNegotiator()
+	n.SetOfferCodecs("call-quality", []CodecInfo{{PayloadType: 0, Name: "PCMU", ClockRate: 8000}})
+	t.Cleanup(func() { n.RemoveCall("call-quality") })
+
+	// The caller's first packets arrive in order, then every other one is
+	// lost, 20ms apart
+	tracker := GetReceiveStatsTracker()
+	t.Cleanup(func() {
+		tracker.Remove(0x7101)
+		RemoveRTCPFeedbackHandler(0x7102)
+	})
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		if i >= 4 && i%2 == 1 {
+			continue
+		}
+		tracker.Update(0x7101, uint16(i), uint32(i*160), 8000, start.Add(time.Duration(i)*20*time.Millisecond))
+	}
+	// The caller's reports on the callee's stream carry the round trip
+	GetRTCPFeedbackHandler(0x7102).HandleFeedback(0, 0, 80)
+
+	session.Lock()
+	caller.SSRC, callee.SSRC = 0x7101, 0x7102
+	session.Stats.ConnectTime = time.Now().Add(-time.Minute)
+	session.State = SessionStateActive
+	quality := session.LiveQuality()
+	session.Unlock()
+
+	if quality.Caller.Codec != "PCMU" {
+		t.Errorf("expected the negotiated codec, got %q", quality.Caller.Codec)
+	}
+	if quality.Caller.PacketsLost != 47 || quality.Caller.LossPercent < 47 || quality.Caller.LossPercent > 49 {
+		t.Errorf("expected 47 of 99 packets lost, got %d (%.1f%%)", quality.Caller.PacketsLost, quality.Caller.LossPercent)
+	}
+	if quality.Caller.RTTMs != 80 || quality.Caller.RFactor == 0 || quality.Caller.MOS > 2 {
+		t.Errorf("expected a poor score with the RTCP round trip, got %+v", quality.Caller)
+	}
+	if quality.Callee.MOS != 0 {
+		t.Errorf("expected no score for a leg without media, got %+v", quality.Callee)
+	}
+	if quality.MOS != quality.Caller.MOS || quality.LossPercent != quality.Caller.LossPercent {
+		t.Errorf("expected the session to reflect the measured leg, got %+v", quality)
+	}
+	if quality.Duration < time.Minute {
+		t.Errorf("expected the duration since connect, got %v", quality.Duration)
+	}
+	if session.Stats.MOS != quality.MOS || session.Stats.RFactor != quality.RFactor || session.Stats.PacketLossRate != quality.LossPercent/100 {
+		t.Errorf("expected the quality to be recorded in the session stats, got %+v", session.Stats)
+	}
+}
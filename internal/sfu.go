@@ -0,0 +1,918 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// SFU metrics
+var (
+	sfuTracksActive = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "karl_sfu_tracks_active",
+			Help: "Number of published video tracks being forwarded",
+		},
+	)
+
+	sfuSubscribersActive = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "karl_sfu_subscribers_active",
+			Help: "Number of subscriber peer connections",
+		},
+	)
+
+	sfuPacketsForwarded = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "karl_sfu_packets_forwarded_total",
+			Help: "Total video RTP packets forwarded to subscribers",
+		},
+	)
+
+	sfuKeyframeRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "karl_sfu_keyframe_requests_total",
+			Help: "Total keyframe requests sent to publishers",
+		},
+		[]string{"type"}, // pli, fir
+	)
+
+	sfuLayerSwitches = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "karl_sfu_layer_switches_total",
+			Help: "Total simulcast layer switches made for subscribers",
+		},
+	)
+)
+
+// SFU errors
+var (
+	ErrSFUSubscriberExists   = errors.New("subscriber already exists")
+	ErrSFUSubscriberNotFound = errors.New("subscriber not found")
+	ErrSFUTrackNotFound      = errors.New("track not forwarded to subscriber")
+)
+
+const (
+	// sfuKeyframeInterval limits how often a publisher is asked for a
+	// keyframe on one layer, however many subscribers ask
+	sfuKeyframeInterval = 500 * time.Millisecond
+
+	// sfuBitrateWindow is the window over which layer bitrates are measured
+	sfuBitrateWindow = time.Second
+
+	// sfuLayerHeadroom is the share of a subscriber's estimated bandwidth
+	// that the selected layer may use
+	sfuLayerHeadroom = 0.9
+)
+
+// sfuRTPWriter sends RTP to one subscriber
+type sfuRTPWriter interface {
+	WriteRTP(packet *rtp.Packet) error
+}
+
+// sfuLayer is one encoding of a published track. Tracks without simulcast
+// have a single layer with an empty RID.
+type sfuLayer struct {
+	RID  string
+	SSRC uint32
+
+	packets     uint64
+	bytes       uint64
+	bitrate     uint64 // bits per second over the last window
+	windowStart time.Time
+	windowBytes uint64
+	lastPacket  time.Time
+	lastRequest time.Time // last keyframe request sent to the publisher
+	firSeq      uint8
+}
+
+// account adds a packet to the layer's counters and bitrate window
+func (l *sfuLayer) account(size int, now time.Time) {
+	l.packets++
+	l.bytes += uint64(size)
+	l.lastPacket = now
+	if l.windowStart.IsZero() {
+		l.windowStart = now
+	}
+	l.windowBytes += uint64(size)
+	if elapsed := now.Sub(l.windowStart); elapsed >= sfuBitrateWindow {
+		l.bitrate = uint64(float64(l.windowBytes*8) / elapsed.Seconds())
+		l.windowStart = now
+		l.windowBytes = 0
+	}
+}
+
+// SFUTrack is a published video track forwarded to subscribers
+type SFUTrack struct {
+	ID          string
+	StreamID    string
+	PublisherID string
+	Codec       webrtc.RTPCodecCapability
+
+	key             string
+	layers          map[string]*sfuLayer
+	downTracks      map[string]*sfuDownTrack // subscriber ID -> down track
+	requestKeyframe func(ssrc uint32, fir bool, firSeq uint8) error
+	mu              sync.RWMutex
+}
+
+// sortedLayersLocked returns the layers from lowest to highest bitrate
+// (caller must hold the lock)
+func (t *SFUTrack) sortedLayersLocked() []*sfuLayer {
+	layers := make([]*sfuLayer, 0, len(t.layers))
+	for _, l := range t.layers {
+		layers = append(layers, l)
+	}
+	sort.Slice(layers, func(i, j int) bool {
+		if layers[i].bitrate != layers[j].bitrate {
+			return layers[i].bitrate < layers[j].bitrate
+		}
+		return simulcastRank(layers[i].RID) < simulcastRank(layers[j].RID)
+	})
+	return layers
+}
+
+// keyframe asks the publisher for a keyframe on a layer, at most once per
+// sfuKeyframeInterval
+func (t *SFUTrack) keyframe(layer *sfuLayer, fir bool) {
+	t.mu.Lock()
+	now := time.Now()
+	if now.Sub(layer.lastRequest) < sfuKeyframeInterval || t.requestKeyframe == nil {
+		t.mu.Unlock()
+		return
+	}
+	layer.lastRequest = now
+	if fir {
+		layer.firSeq++
+	}
+	ssrc, seq, request := layer.SSRC, layer.firSeq, t.requestKeyframe
+	t.mu.Unlock()
+
+	kind := "pli"
+	if fir {
+		kind = "fir"
+	}
+	if err := request(ssrc, fir, seq); err != nil {
+		if IsDebugLoggingEnabled() {
+			log.Printf("SFU: keyframe request for track %s failed: %v", t.ID, err)
+		}
+		return
+	}
+	sfuKeyframeRequests.WithLabelValues(kind).Inc()
+}
+
+// sfuDownTrack forwards one published track to one subscriber, rewriting
+// sequence numbers and timestamps so layer switches look like one stream
+type sfuDownTrack struct {
+	subscriberID string
+	track        *SFUTrack
+	writer       sfuRTPWriter
+	sender       *webrtc.RTPSender
+
+	current  *sfuLayer // layer being forwarded, nil until the first keyframe
+	target   *sfuLayer // layer to switch to at the next keyframe
+	estimate uint64    // bandwidth available to this track in bps, 0 if unknown
+	pinned   string    // RID of a layer chosen through the API, "" selects by bandwidth
+
+	started   bool
+	seqOffset uint16
+	tsOffset  uint32
+	lastSeq   uint16
+	lastTS    uint32
+
+	packets      uint64
+	bytes        uint64
+	plisReceived uint64
+	firsReceived uint64
+}
+
+// SFUDownTrackInfo is a snapshot of a track forwarded to a subscriber
+type SFUDownTrackInfo struct {
+	TrackID      string
+	PublisherID  string
+	CurrentLayer string
+	TargetLayer  string
+	PinnedLayer  string
+	Estimate     uint64
+	Packets      uint64
+	Bytes        uint64
+	PLIsReceived uint64
+	FIRsReceived uint64
+}
+
+// SFUSubscriber is a peer connection receiving forwarded tracks
+type SFUSubscriber struct {
+	ID string
+
+	pc             *webrtc.PeerConnection
+	downTracks     map[string]*sfuDownTrack // track key -> down track
+	estimate       uint64                   // bandwidth estimate in bps, 0 if unknown
+	estimateSource string
+	mu             sync.Mutex
+}
+
+// SFU forwards published WebRTC video to subscriber peer connections
+// without decoding it. Subscribers pick a simulcast layer that fits the
+// bandwidth they report with REMB or TWCC, and their PLI/FIR requests are
+// relayed to the publisher.
+type SFU struct {
+	config              *WebRTCConfig
+	tracks              map[string]*SFUTrack
+	subscribers         map[string]*SFUSubscriber
+	estimators          map[*webrtc.PeerConnection]cc.BandwidthEstimator
+	publisherBWE        map[*webrtc.PeerConnection]*sfuPublisherBWE
+	onNegotiationNeeded func(subscriberID string)
+	mu                  sync.RWMutex
+}
+
+// NewSFU creates a forwarding unit; the WebRTC start and max bitrates bound
+// the bandwidth assumed for subscribers
+func NewSFU(config *WebRTCConfig) *SFU {
+	if config == nil {
+		config = &WebRTCConfig{}
+	}
+	return &SFU{
+		config:       config,
+		tracks:       make(map[string]*SFUTrack),
+		subscribers:  make(map[string]*SFUSubscriber),
+		estimators:   make(map[*webrtc.PeerConnection]cc.BandwidthEstimator),
+		publisherBWE: make(map[*webrtc.PeerConnection]*sfuPublisherBWE),
+	}
+}
+
+// SetOnNegotiationNeeded sets the callback told when tracks were added to or
+// removed from a subscriber, so its signaling can send a new offer
+func (s *SFU) SetOnNegotiationNeeded(handler func(subscriberID string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onNegotiationNeeded = handler
+}
+
+// Publish forwards a remote video track received on a publisher's peer
+// connection. It returns once the track ends. Simulcast layers of one track
+// share its ID and are published with one call each.
+func (s *SFU) Publish(publisherID string, pc *webrtc.PeerConnection, remote *webrtc.TrackRemote) error {
+	if remote.Kind() != webrtc.RTPCodecTypeVideo {
+		return fmt.Errorf("SFU only forwards video, got %s", remote.Kind())
+	}
+
+	track, layer := s.addLayer(publisherID, remote.StreamID(), remote.ID(), remote.RID(),
+		uint32(remote.SSRC()), remote.Codec().RTPCodecCapability,
+		func(ssrc uint32, fir bool, firSeq uint8) error {
+			if fir {
+				return pc.WriteRTCP([]rtcp.Packet{&rtcp.FullIntraRequest{
+					MediaSSRC: ssrc,
+					FIR:       []rtcp.FIREntry{{SSRC: ssrc, SequenceNumber: firSeq}},
+				}})
+			}
+			return pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: ssrc}})
+		})
+	defer s.removeLayer(track, layer)
+
+	// Publishers that negotiated goog-remb get a receive-side estimate, which
+	// browsers without transport-cc adapt their encoder to
+	var estimator *REMBEstimator
+	if s.config.BWEstimation && hasRTCPFeedback(remote.Codec(), webrtc.TypeRTCPFBGoogREMB) {
+		estimator = s.acquireREMB(pc)
+		defer s.releaseREMB(pc, layer.SSRC)
+	}
+	clockRate := remote.Codec().ClockRate
+
+	for {
+		packet, _, err := remote.ReadRTP()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if estimator != nil {
+			estimator.OnPacket(&packet.Header, packet.MarshalSize(), clockRate, time.Now())
+		}
+		s.forward(track, layer, packet)
+	}
+}
+
+// addLayer registers a layer of a published track, creating the track and
+// offering it to every subscriber when it is new
+func (s *SFU) addLayer(publisherID, streamID, trackID, rid string, ssrc uint32, codec webrtc.RTPCodecCapability,
+	requestKeyframe func(ssrc uint32, fir bool, firSeq uint8) error) (*SFUTrack, *sfuLayer) {
+	key := publisherID + "/" + streamID + "/" + trackID
+
+	s.mu.Lock()
+	track, exists := s.tracks[key]
+	if !exists {
+		track = &SFUTrack{
+			ID:              trackID,
+			StreamID:        streamID,
+			PublisherID:     publisherID,
+			Codec:           codec,
+			key:             key,
+			layers:          make(map[string]*sfuLayer),
+			downTracks:      make(map[string]*sfuDownTrack),
+			requestKeyframe: requestKeyframe,
+		}
+		s.tracks[key] = track
+		sfuTracksActive.Inc()
+	}
+	subscribers := make([]*SFUSubscriber, 0, len(s.subscribers))
+	for _, sub := range s.subscribers {
+		subscribers = append(subscribers, sub)
+	}
+	s.mu.Unlock()
+
+	layer := &sfuLayer{RID: rid, SSRC: ssrc}
+	track.mu.Lock()
+	track.layers[rid] = layer
+	track.mu.Unlock()
+
+	log.Printf("SFU: %s published video track %s (layer %q, %s)", publisherID, trackID, rid, codec.MimeType)
+
+	if !exists {
+		for _, sub := range subscribers {
+			if sub.ID == publisherID {
+				continue
+			}
+			if err := s.attach(track, sub); err != nil {
+				log.Printf("SFU: failed to forward track %s to %s: %v", trackID, sub.ID, err)
+			}
+		}
+	} else {
+		s.reselectLayers(track)
+	}
+	return track, layer
+}
+
+// removeLayer forgets an ended layer and removes the track from every
+// subscriber once its last layer is gone
+func (s *SFU) removeLayer(track *SFUTrack, layer *sfuLayer) {
+	track.mu.Lock()
+	if track.layers[layer.RID] == layer {
+		delete(track.layers, layer.RID)
+	}
+	remaining := len(track.layers)
+	track.mu.Unlock()
+
+	if remaining > 0 {
+		s.reselectLayers(track)
+		return
+	}
+
+	s.mu.Lock()
+	if s.tracks[track.key] != track {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.tracks, track.key)
+	s.mu.Unlock()
+	sfuTracksActive.Dec()
+
+	track.mu.Lock()
+	downTracks := track.downTracks
+	track.downTracks = make(map[string]*sfuDownTrack)
+	track.mu.Unlock()
+
+	for subscriberID, dt := range downTracks {
+		s.mu.RLock()
+		sub, ok := s.subscribers[subscriberID]
+		s.mu.RUnlock()
+		if ok {
+			s.detach(sub, dt)
+		}
+	}
+	log.Printf("SFU: video track %s of %s ended", track.ID, track.PublisherID)
+}
+
+// AddSubscriber starts forwarding every published track, and every track
+// published later, to a peer connection
+func (s *SFU) AddSubscriber(subscriberID string, pc *webrtc.PeerConnection) (*SFUSubscriber, error) {
+	s.mu.Lock()
+	if _, exists := s.subscribers[subscriberID]; exists {
+		s.mu.Unlock()
+		return nil, ErrSFUSubscriberExists
+	}
+	sub := &SFUSubscriber{
+		ID:         subscriberID,
+		pc:         pc,
+		downTracks: make(map[string]*sfuDownTrack),
+	}
+	s.subscribers[subscriberID] = sub
+	tracks := make([]*SFUTrack, 0, len(s.tracks))
+	for _, track := range s.tracks {
+		if track.PublisherID != subscriberID {
+			tracks = append(tracks, track)
+		}
+	}
+	s.mu.Unlock()
+	sfuSubscribersActive.Inc()
+	s.watchEstimator(sub)
+
+	for _, track := range tracks {
+		if err := s.attach(track, sub); err != nil {
+			log.Printf("SFU: failed to forward track %s to %s: %v", track.ID, subscriberID, err)
+		}
+	}
+
+	log.Printf("SFU: subscriber %s added with %d track(s)", subscriberID, len(tracks))
+	return sub, nil
+}
+
+// RemoveSubscriber stops forwarding to a subscriber
+func (s *SFU) RemoveSubscriber(subscriberID string) error {
+	s.mu.Lock()
+	sub, ok := s.subscribers[subscriberID]
+	if !ok {
+		s.mu.Unlock()
+		return ErrSFUSubscriberNotFound
+	}
+	delete(s.subscribers, subscriberID)
+	delete(s.estimators, sub.pc)
+	s.mu.Unlock()
+	sfuSubscribersActive.Dec()
+
+	sub.mu.Lock()
+	downTracks := make([]*sfuDownTrack, 0, len(sub.downTracks))
+	for _, dt := range sub.downTracks {
+		downTracks = append(downTracks, dt)
+	}
+	sub.mu.Unlock()
+
+	for _, dt := range downTracks {
+		dt.track.mu.Lock()
+		delete(dt.track.downTracks, subscriberID)
+		dt.track.mu.Unlock()
+		s.detach(sub, dt)
+	}
+
+	log.Printf("SFU: subscriber %s removed", subscriberID)
+	return nil
+}
+
+// attach adds a local track for a published track to a subscriber's peer
+// connection and starts relaying its RTCP feedback
+func (s *SFU) attach(track *SFUTrack, sub *SFUSubscriber) error {
+	local, err := webrtc.NewTrackLocalStaticRTP(track.Codec, track.ID, track.StreamID)
+	if err != nil {
+		return err
+	}
+	sender, err := sub.pc.AddTrack(local)
+	if err != nil {
+		return err
+	}
+
+	dt := s.addDownTrack(track, sub, local)
+	dt.sender = sender
+	go s.readFeedback(dt, sender)
+
+	s.negotiationNeeded(sub.ID)
+	return nil
+}
+
+// addDownTrack registers a down track and picks its first layer
+func (s *SFU) addDownTrack(track *SFUTrack, sub *SFUSubscriber, writer sfuRTPWriter) *sfuDownTrack {
+	dt := &sfuDownTrack{
+		subscriberID: sub.ID,
+		track:        track,
+		writer:       writer,
+		estimate:     uint64(s.config.StartBitrate),
+	}
+
+	sub.mu.Lock()
+	sub.downTracks[track.key] = dt
+	if sub.estimate > 0 {
+		dt.estimate = sub.estimate / uint64(len(sub.downTracks))
+	}
+	sub.mu.Unlock()
+
+	track.mu.Lock()
+	track.downTracks[sub.ID] = dt
+	target := s.selectLayerLocked(track, dt)
+	dt.target = target
+	track.mu.Unlock()
+
+	// A new subscriber cannot decode until the next keyframe
+	if target != nil {
+		track.keyframe(target, false)
+	}
+	return dt
+}
+
+// detach removes a down track from its subscriber
+func (s *SFU) detach(sub *SFUSubscriber, dt *sfuDownTrack) {
+	sub.mu.Lock()
+	if sub.downTracks[dt.track.key] == dt {
+		delete(sub.downTracks, dt.track.key)
+	}
+	sub.mu.Unlock()
+
+	if dt.sender != nil && sub.pc != nil {
+		if err := sub.pc.RemoveTrack(dt.sender); err != nil && IsDebugLoggingEnabled() {
+			log.Printf("SFU: failed to remove track from %s: %v", sub.ID, err)
+		}
+		s.negotiationNeeded(sub.ID)
+	}
+}
+
+// negotiationNeeded tells the signaling layer a subscriber's tracks changed
+func (s *SFU) negotiationNeeded(subscriberID string) {
+	s.mu.RLock()
+	handler := s.onNegotiationNeeded
+	s.mu.RUnlock()
+	if handler != nil {
+		handler(subscriberID)
+	}
+}
+
+// readFeedback relays a subscriber's keyframe requests to the publisher and
+// updates its bandwidth estimate from REMB
+func (s *SFU) readFeedback(dt *sfuDownTrack, sender *webrtc.RTPSender) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		s.handleFeedback(dt, packets)
+	}
+}
+
+// handleFeedback processes RTCP received from a subscriber for one down track
+func (s *SFU) handleFeedback(dt *sfuDownTrack, packets []rtcp.Packet) {
+	track := dt.track
+	for _, packet := range packets {
+		switch p := packet.(type) {
+		case *rtcp.PictureLossIndication:
+			track.mu.Lock()
+			dt.plisReceived++
+			layer := dt.requestLayer()
+			track.mu.Unlock()
+			if layer != nil {
+				track.keyframe(layer, false)
+			}
+		case *rtcp.FullIntraRequest:
+			track.mu.Lock()
+			dt.firsReceived++
+			layer := dt.requestLayer()
+			track.mu.Unlock()
+			if layer != nil {
+				track.keyframe(layer, true)
+			}
+		case *rtcp.ReceiverEstimatedMaximumBitrate:
+			if sub, ok := s.GetSubscriber(dt.subscriberID); ok {
+				s.setSubscriberEstimate(sub, uint64(p.Bitrate), estimateSourceREMB)
+			}
+		}
+	}
+}
+
+// requestLayer returns the layer a keyframe should be requested on: the
+// pending switch target, otherwise the current layer (caller must hold the
+// track lock)
+func (dt *sfuDownTrack) requestLayer() *sfuLayer {
+	if dt.target != nil {
+		return dt.target
+	}
+	return dt.current
+}
+
+// setEstimate updates a subscriber's bandwidth estimate and switches layer
+// when another one fits better
+func (s *SFU) setEstimate(dt *sfuDownTrack, bitrate uint64) {
+	track := dt.track
+	track.mu.Lock()
+	dt.estimate = bitrate
+	target := s.retargetLocked(track, dt)
+	track.mu.Unlock()
+
+	if target != nil {
+		track.keyframe(target, false)
+	}
+}
+
+// reselectLayers re-evaluates the layer of every subscriber of a track after
+// its layers changed
+func (s *SFU) reselectLayers(track *SFUTrack) {
+	var requests []*sfuLayer
+
+	track.mu.Lock()
+	for _, dt := range track.downTracks {
+		if dt.current != nil && track.layers[dt.current.RID] != dt.current {
+			dt.current = nil // layer ended, resume on the next keyframe
+		}
+		if target := s.retargetLocked(track, dt); target != nil {
+			requests = append(requests, target)
+		}
+	}
+	track.mu.Unlock()
+
+	for _, layer := range requests {
+		track.keyframe(layer, false)
+	}
+}
+
+// selectLayerLocked returns the pinned layer, otherwise the highest active
+// layer whose measured bitrate fits the subscriber's estimate, or the lowest
+// layer when none fits (caller must hold the track lock)
+func (s *SFU) selectLayerLocked(track *SFUTrack, dt *sfuDownTrack) *sfuLayer {
+	if layer, ok := track.layers[dt.pinned]; ok && dt.pinned != "" {
+		return layer
+	}
+
+	layers := track.sortedLayersLocked()
+	now := time.Now()
+	active := layers[:0:0]
+	for _, layer := range layers {
+		if layer.active(now) {
+			active = append(active, layer)
+		}
+	}
+	if len(active) > 0 {
+		layers = active
+	}
+	if len(layers) == 0 {
+		return nil
+	}
+
+	budget := dt.estimate
+	if max := uint64(s.config.MaxBitrate); max > 0 && (budget == 0 || budget > max) {
+		budget = max
+	}
+	if budget == 0 {
+		return layers[len(layers)-1]
+	}
+
+	selected := layers[0]
+	for _, layer := range layers[1:] {
+		if float64(layer.bitrate) <= float64(budget)*sfuLayerHeadroom {
+			selected = layer
+		}
+	}
+	return selected
+}
+
+// forward sends a packet of one layer to every subscriber receiving it
+func (s *SFU) forward(track *SFUTrack, layer *sfuLayer, packet *rtp.Packet) {
+	now := time.Now()
+
+	type delivery struct {
+		dt     *sfuDownTrack
+		packet rtp.Packet
+	}
+	var deliveries []delivery
+
+	track.mu.Lock()
+	layer.account(len(packet.Payload), now)
+	keyframe := -1 // evaluated lazily, only while a subscriber waits to switch
+	for _, dt := range track.downTracks {
+		if dt.target == layer {
+			if keyframe < 0 {
+				keyframe = 0
+				if isVideoKeyframe(track.Codec.MimeType, packet.Payload) {
+					keyframe = 1
+				}
+			}
+			if keyframe == 1 {
+				dt.switchTo(layer, packet, track.Codec.ClockRate)
+			}
+		}
+		if dt.current != layer {
+			continue
+		}
+
+		out := *packet
+		out.SequenceNumber += dt.seqOffset
+		out.Timestamp += dt.tsOffset
+		dt.lastSeq = out.SequenceNumber
+		dt.lastTS = out.Timestamp
+		dt.packets++
+		dt.bytes += uint64(len(packet.Payload))
+		deliveries = append(deliveries, delivery{dt: dt, packet: out})
+	}
+	track.mu.Unlock()
+
+	for i := range deliveries {
+		if err := deliveries[i].dt.writer.WriteRTP(&deliveries[i].packet); err != nil {
+			if IsDebugLoggingEnabled() {
+				log.Printf("SFU: failed to forward to %s: %v", deliveries[i].dt.subscriberID, err)
+			}
+			continue
+		}
+		sfuPacketsForwarded.Inc()
+	}
+}
+
+// switchTo makes layer the forwarded layer starting with packet. Offsets
+// keep sequence numbers and timestamps continuous across the switch.
+func (dt *sfuDownTrack) switchTo(layer *sfuLayer, packet *rtp.Packet, clockRate uint32) {
+	if dt.started {
+		frameTicks := uint32(3000) // one frame at 30fps on the 90kHz video clock
+		if clockRate > 0 {
+			frameTicks = clockRate / 30
+		}
+		dt.seqOffset = dt.lastSeq + 1 - packet.SequenceNumber
+		dt.tsOffset = dt.lastTS + frameTicks - packet.Timestamp
+		sfuLayerSwitches.Inc()
+	}
+	dt.started = true
+	dt.current = layer
+	dt.target = nil
+}
+
+// Info returns a snapshot of the subscriber's forwarded tracks
+func (sub *SFUSubscriber) Info() []SFUDownTrackInfo {
+	sub.mu.Lock()
+	downTracks := make([]*sfuDownTrack, 0, len(sub.downTracks))
+	for _, dt := range sub.downTracks {
+		downTracks = append(downTracks, dt)
+	}
+	sub.mu.Unlock()
+
+	infos := make([]SFUDownTrackInfo, 0, len(downTracks))
+	for _, dt := range downTracks {
+		dt.track.mu.RLock()
+		info := SFUDownTrackInfo{
+			TrackID:      dt.track.ID,
+			PublisherID:  dt.track.PublisherID,
+			PinnedLayer:  dt.pinned,
+			Estimate:     dt.estimate,
+			Packets:      dt.packets,
+			Bytes:        dt.bytes,
+			PLIsReceived: dt.plisReceived,
+			FIRsReceived: dt.firsReceived,
+		}
+		if dt.current != nil {
+			info.CurrentLayer = dt.current.RID
+		}
+		if dt.target != nil {
+			info.TargetLayer = dt.target.RID
+		}
+		dt.track.mu.RUnlock()
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].TrackID < infos[j].TrackID })
+	return infos
+}
+
+// GetSubscriber returns a subscriber by ID
+func (s *SFU) GetSubscriber(subscriberID string) (*SFUSubscriber, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sub, ok := s.subscribers[subscriberID]
+	return sub, ok
+}
+
+// ListTracks returns the published tracks
+func (s *SFU) ListTracks() []*SFUTrack {
+	s.mu.RLock()
+	tracks := make([]*SFUTrack, 0, len(s.tracks))
+	for _, track := range s.tracks {
+		tracks = append(tracks, track)
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(tracks, func(i, j int) bool { return tracks[i].key < tracks[j].key })
+	return tracks
+}
+
+// Stop removes every subscriber; publisher tracks end with their peer
+// connections
+func (s *SFU) Stop() {
+	s.mu.RLock()
+	ids := make([]string, 0, len(s.subscribers))
+	for id := range s.subscribers {
+		ids = append(ids, id)
+	}
+	s.mu.RUnlock()
+
+	for _, id := range ids {
+		_ = s.RemoveSubscriber(id)
+	}
+}
+
+// simulcastRank orders layers with equal measured bitrate by their RID, so
+// the conventional names q/h/f (and low/mid/high) sort from lowest up
+func simulcastRank(rid string) int {
+	switch strings.ToLower(rid) {
+	case "q", "low", "l", "0":
+		return 0
+	case "h", "mid", "m", "1":
+		return 1
+	case "f", "high", "2":
+		return 2
+	default:
+		return 1
+	}
+}
+
+// isVideoKeyframe reports whether an RTP payload starts a keyframe. Codecs
+// without a parser are treated as always switchable.
+func isVideoKeyframe(mimeType string, payload []byte) bool {
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		return isVP8Keyframe(payload)
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		return isVP9Keyframe(payload)
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return isH264Keyframe(payload)
+	default:
+		return true
+	}
+}
+
+// isVP8Keyframe parses the VP8 payload descriptor (RFC 7741) and checks the
+// inverse key frame flag of the first partition
+func isVP8Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	start := payload[0]&0x10 != 0
+	partition := payload[0] & 0x07
+	if !start || partition != 0 {
+		return false
+	}
+
+	offset := 1
+	if payload[0]&0x80 != 0 { // X: extended control bits present
+		if len(payload) <= offset {
+			return false
+		}
+		ext := payload[offset]
+		offset++
+		if ext&0x80 != 0 { // I: picture ID
+			if len(payload) <= offset {
+				return false
+			}
+			if payload[offset]&0x80 != 0 {
+				offset += 2
+			} else {
+				offset++
+			}
+		}
+		if ext&0x40 != 0 { // L: TL0PICIDX
+			offset++
+		}
+		if ext&0x30 != 0 { // T or K: TID/KEYIDX
+			offset++
+		}
+	}
+
+	if len(payload) <= offset {
+		return false
+	}
+	return payload[offset]&0x01 == 0
+}
+
+// isVP9Keyframe checks the VP9 payload descriptor for the start of a frame
+// that is not inter-picture predicted
+func isVP9Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	interPredicted := payload[0]&0x40 != 0
+	beginning := payload[0]&0x08 != 0
+	return !interPredicted && beginning
+}
+
+// isH264Keyframe looks for an IDR slice or SPS in single NAL unit, STAP-A
+// and FU-A packets (RFC 6184)
+func isH264Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+
+	switch nalType := payload[0] & 0x1F; nalType {
+	case 5, 7:
+		return true
+	case 24: // STAP-A
+		for offset := 1; offset+2 < len(payload); {
+			size := int(payload[offset])<<8 | int(payload[offset+1])
+			offset += 2
+			if offset >= len(payload) {
+				break
+			}
+			if t := payload[offset] & 0x1F; t == 5 || t == 7 {
+				return true
+			}
+			offset += size
+		}
+	case 28: // FU-A
+		if len(payload) < 2 {
+			return false
+		}
+		start := payload[1]&0x80 != 0
+		t := payload[1] & 0x1F
+		return start && (t == 5 || t == 7)
+	}
+	return false
+}
@@ -0,0 +1,244 @@
+package internal
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+type sfuTestWriter struct {
+	packets []rtp.Packet
+	mu      sync.Mutex
+}
+
+func (w *sfuTestWriter) WriteRTP(packet *rtp.Packet) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.packets = append(w.packets, *packet)
+	return nil
+}
+
+func (w *sfuTestWriter) count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.packets)
+}
+
+type sfuKeyframeLog struct {
+	requests []uint32
+	firs     int
+	mu       sync.Mutex
+}
+
+func (k *sfuKeyframeLog) request(ssrc uint32, fir bool, firSeq uint8) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.requests = append(k.requests, ssrc)
+	if fir {
+		k.firs++
+	}
+	return nil
+}
+
+func (k *sfuKeyframeLog) count() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return len(k.requests)
+}
+
+var sfuTestCodec = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+
+// vp8Packet builds a VP8 packet that starts a keyframe or an interframe
+func vp8Packet(seq uint16, ts uint32, keyframe bool) *rtp.Packet {
+	frameTag := byte(0x01)
+	if keyframe {
+		frameTag = 0x00
+	}
+	return &rtp.Packet{
+		Header:  rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: ts},
+		Payload: []byte{0x10, frameTag, 0x00, 0x00},
+	}
+}
+
+// addTestSubscriber registers a subscriber without a peer connection
+func addTestSubscriber(s *SFU, track *SFUTrack, id string) (*sfuDownTrack, *sfuTestWriter) {
+	sub := &SFUSubscriber{ID: id, downTracks: make(map[string]*sfuDownTrack)}
+	s.mu.Lock()
+	s.subscribers[id] = sub
+	s.mu.Unlock()
+
+	writer := &sfuTestWriter{}
+	return s.addDownTrack(track, sub, writer), writer
+}
+
+func TestSFU_ForwardsFromKeyframe(t *testing.T) {
+	s := NewSFU(nil)
+	keyframes := &sfuKeyframeLog{}
+	track, layer := s.addLayer("pub", "stream", "video", "", 1234, sfuTestCodec, keyframes.request)
+
+	_, writer := addTestSubscriber(s, track, "sub")
+	if keyframes.count() != 1 {
+		t.Fatalf("expected a keyframe request for the new subscriber, got %d", keyframes.count())
+	}
+
+	s.forward(track, layer, vp8Packet(10, 1000, false))
+	if writer.count() != 0 {
+		t.Fatal("expected packets before the first keyframe to be held back")
+	}
+
+	s.forward(track, layer, vp8Packet(11, 4000, true))
+	s.forward(track, layer, vp8Packet(12, 4000, false))
+	if writer.count() != 2 {
+		t.Fatalf("expected 2 forwarded packets, got %d", writer.count())
+	}
+	if got := writer.packets[0].SequenceNumber; got != 11 {
+		t.Errorf("expected sequence numbers to pass through, got %d", got)
+	}
+}
+
+func TestSFU_RelaysKeyframeRequests(t *testing.T) {
+	s := NewSFU(nil)
+	keyframes := &sfuKeyframeLog{}
+	track, layer := s.addLayer("pub", "stream", "video", "", 1234, sfuTestCodec, keyframes.request)
+	dt, _ := addTestSubscriber(s, track, "sub")
+	s.forward(track, layer, vp8Packet(1, 0, true))
+
+	// Requests within the throttle interval are collapsed
+	s.handleFeedback(dt, []rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: 1}})
+	if keyframes.count() != 1 {
+		t.Errorf("expected PLI to be throttled, got %d requests", keyframes.count())
+	}
+
+	track.mu.Lock()
+	layer.lastRequest = time.Time{}
+	track.mu.Unlock()
+	s.handleFeedback(dt, []rtcp.Packet{&rtcp.FullIntraRequest{MediaSSRC: 1}})
+	if keyframes.count() != 2 || keyframes.firs != 1 {
+		t.Errorf("expected FIR to be relayed, got %d requests (%d FIR)", keyframes.count(), keyframes.firs)
+	}
+	if keyframes.requests[1] != 1234 {
+		t.Errorf("expected request for publisher SSRC 1234, got %d", keyframes.requests[1])
+	}
+
+	info := sfuSubscriberInfo(t, s, "sub")
+	if info.PLIsReceived != 1 || info.FIRsReceived != 1 {
+		t.Errorf("expected 1 PLI and 1 FIR received, got %d and %d", info.PLIsReceived, info.FIRsReceived)
+	}
+}
+
+func sfuSubscriberInfo(t *testing.T, s *SFU, id string) SFUDownTrackInfo {
+	t.Helper()
+	sub, ok := s.GetSubscriber(id)
+	if !ok {
+		t.Fatalf("subscriber %s not found", id)
+	}
+	infos := sub.Info()
+	if len(infos) != 1 {
+		t.Fatalf("expected 1 down track, got %d", len(infos))
+	}
+	return infos[0]
+}
+
+func TestSFU_BandwidthLayerSelection(t *testing.T) {
+	s := NewSFU(&WebRTCConfig{MaxBitrate: 3000000})
+	keyframes := &sfuKeyframeLog{}
+	track, low := s.addLayer("pub", "stream", "video", "q", 1, sfuTestCodec, keyframes.request)
+	_, mid := s.addLayer("pub", "stream", "video", "h", 2, sfuTestCodec, keyframes.request)
+	_, high := s.addLayer("pub", "stream", "video", "f", 3, sfuTestCodec, keyframes.request)
+
+	now := time.Now()
+	track.mu.Lock()
+	low.bitrate, mid.bitrate, high.bitrate = 150000, 500000, 1500000
+	low.lastPacket, mid.lastPacket, high.lastPacket = now, now, now
+	track.mu.Unlock()
+
+	dt, writer := addTestSubscriber(s, track, "sub")
+	if dt.target != high {
+		t.Fatalf("expected the highest layer without an estimate, got %q", dt.target.RID)
+	}
+	s.forward(track, high, vp8Packet(100, 9000, true))
+
+	// A REMB of 600kbps only fits the middle layer
+	s.handleFeedback(dt, []rtcp.Packet{&rtcp.ReceiverEstimatedMaximumBitrate{Bitrate: 600000}})
+	if dt.target != mid {
+		t.Fatalf("expected switch target h, got %v", dt.target)
+	}
+
+	// Interframes of the target layer do not switch; its keyframe does
+	s.forward(track, mid, vp8Packet(5000, 70000, false))
+	s.forward(track, high, vp8Packet(101, 9000, false))
+	s.forward(track, mid, vp8Packet(5001, 73000, true))
+	s.forward(track, high, vp8Packet(102, 12000, false))
+
+	if dt.current != mid {
+		t.Fatalf("expected to forward layer h, got %q", dt.current.RID)
+	}
+	if writer.count() != 3 {
+		t.Fatalf("expected 3 forwarded packets, got %d", writer.count())
+	}
+	last := writer.packets[2]
+	if last.SequenceNumber != 102 {
+		t.Errorf("expected continuous sequence number 102 after switch, got %d", last.SequenceNumber)
+	}
+	if last.Timestamp != 9000+3000 {
+		t.Errorf("expected timestamp to advance one frame after switch, got %d", last.Timestamp)
+	}
+
+	// Too little bandwidth for any layer falls back to the lowest
+	s.setEstimate(dt, 50000)
+	if dt.target != low {
+		t.Errorf("expected fallback to layer q, got %v", dt.target)
+	}
+}
+
+func TestSFU_TrackEndRemovesDownTracks(t *testing.T) {
+	s := NewSFU(nil)
+	track, layer := s.addLayer("pub", "stream", "video", "", 1, sfuTestCodec, nil)
+	addTestSubscriber(s, track, "sub")
+
+	s.removeLayer(track, layer)
+	if len(s.ListTracks()) != 0 {
+		t.Error("expected the track to be removed")
+	}
+	sub, _ := s.GetSubscriber("sub")
+	if len(sub.Info()) != 0 {
+		t.Error("expected the subscriber's down track to be removed")
+	}
+	if err := s.RemoveSubscriber("sub"); err != nil {
+		t.Errorf("RemoveSubscriber failed: %v", err)
+	}
+	if err := s.RemoveSubscriber("sub"); err != ErrSFUSubscriberNotFound {
+		t.Errorf("expected ErrSFUSubscriberNotFound, got %v", err)
+	}
+}
+
+func TestIsVideoKeyframe(t *testing.T) {
+	tests := []struct {
+		name    string
+		mime    string
+		payload []byte
+		want    bool
+	}{
+		{"vp8 keyframe", webrtc.MimeTypeVP8, []byte{0x10, 0x00}, true},
+		{"vp8 interframe", webrtc.MimeTypeVP8, []byte{0x10, 0x01}, false},
+		{"vp8 continuation", webrtc.MimeTypeVP8, []byte{0x00, 0x00}, false},
+		{"vp8 extended picture id", webrtc.MimeTypeVP8, []byte{0x90, 0x80, 0x81, 0x23, 0x00}, true},
+		{"vp9 keyframe", webrtc.MimeTypeVP9, []byte{0x08}, true},
+		{"vp9 interframe", webrtc.MimeTypeVP9, []byte{0x48}, false},
+		{"h264 idr", webrtc.MimeTypeH264, []byte{0x65}, true},
+		{"h264 non-idr", webrtc.MimeTypeH264, []byte{0x41}, false},
+		{"h264 stap-a with sps", webrtc.MimeTypeH264, []byte{0x78, 0x00, 0x02, 0x67, 0x42}, true},
+		{"h264 fu-a idr start", webrtc.MimeTypeH264, []byte{0x7c, 0x85}, true},
+		{"h264 fu-a idr middle", webrtc.MimeTypeH264, []byte{0x7c, 0x05}, false},
+		{"unknown codec", "video/AV1", []byte{0x00}, true},
+	}
+	for _, tt := range tests {
+		if got := isVideoKeyframe(tt.mime, tt.payload); got != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
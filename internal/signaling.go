@@ -0,0 +1,556 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/net/websocket"
+)
+
+// Signaling metrics
+var (
+	signalingSessionsActive = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "karl_signaling_sessions_active",
+			Help: "Number of browser sessions connected to the WebSocket signaling endpoint",
+		},
+	)
+
+	signalingMessages = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "karl_signaling_messages_total",
+			Help: "Total signaling messages received from browser clients",
+		},
+		[]string{"type"},
+	)
+
+	signalingICERestarts = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "karl_signaling_ice_restarts_total",
+			Help: "Total ICE restarts offered to browser clients after connectivity failed",
+		},
+	)
+)
+
+// Signaling errors
+var (
+	ErrSignalingTokenInvalid    = errors.New("invalid or expired signaling token")
+	ErrSignalingSessionNotFound = errors.New("signaling session not found")
+)
+
+const (
+	// SignalingPath is where the WebSocket signaling endpoint is served
+	SignalingPath = "/ws"
+
+	// DefaultSignalingTokenTTL is how long an issued token may be used to
+	// connect
+	DefaultSignalingTokenTTL = time.Minute
+
+	// signalingMaxMessage bounds a single signaling message; SDP offers with
+	// several media sections stay well below it
+	signalingMaxMessage = 64 * 1024
+
+	// signalingMaxICERestarts is how many consecutive ICE restarts are tried
+	// before a failed session is closed
+	signalingMaxICERestarts = 3
+)
+
+// Signaling message types
+const (
+	SignalingTypeOffer     = "offer"
+	SignalingTypeAnswer    = "answer"
+	SignalingTypeCandidate = "candidate"
+	SignalingTypeState     = "state"
+	SignalingTypeBye       = "bye"
+	SignalingTypeError     = "error"
+)
+
+// SignalingMessage is a JSON message exchanged over the signaling WebSocket
+type SignalingMessage struct {
+	Type      string                   `json:"type"`
+	SessionID string                   `json:"session_id,omitempty"`
+	SDP       string                   `json:"sdp,omitempty"`
+	Candidate *webrtc.ICECandidateInit `json:"candidate,omitempty"`
+	State     string                   `json:"state,omitempty"`
+	Error     string                   `json:"error,omitempty"`
+}
+
+// SignalingServer accepts SDP offers and ICE candidates from browser clients
+// over a WebSocket and answers them with a WebRTC session each. When auth
+// tokens are required, clients connect with a single-use token issued over
+// the REST API.
+type SignalingServer struct {
+	config   *WebRTCConfig
+	tokens   map[string]time.Time // token -> expiry
+	sessions map[string]*SignalingSession
+	server   *http.Server
+	mu       sync.Mutex
+}
+
+// SignalingSession is one browser client and its peer connection
+type SignalingSession struct {
+	ID          string
+	RemoteAddr  string
+	ConnectedAt time.Time
+
+	conn     *websocket.Conn
+	pc       *webrtc.PeerConnection
+	pending  []webrtc.ICECandidateInit // candidates received before the offer
+	restarts int                       // consecutive ICE restarts
+	sendMu   sync.Mutex
+	mu       sync.Mutex
+}
+
+// SignalingSessionInfo is a snapshot of a signaling session
+type SignalingSessionInfo struct {
+	ID          string
+	RemoteAddr  string
+	ConnectedAt time.Time
+	State       string
+}
+
+// NewSignalingServer creates a signaling server for the WebRTC config
+func NewSignalingServer(config *WebRTCConfig) *SignalingServer {
+	if config == nil {
+		config = &WebRTCConfig{}
+	}
+	return &SignalingServer{
+		config:   config,
+		tokens:   make(map[string]time.Time),
+		sessions: make(map[string]*SignalingSession),
+	}
+}
+
+// Start serves the signaling endpoint on addr
+func (s *SignalingServer) Start(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(SignalingPath, s)
+
+	s.mu.Lock()
+	s.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	server := s.server
+	s.mu.Unlock()
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Signaling server error: %v", err)
+		}
+	}()
+	log.Printf("WebRTC signaling listening on ws://%s%s", listener.Addr(), SignalingPath)
+	return nil
+}
+
+// Stop closes the listener and every session
+func (s *SignalingServer) Stop() {
+	s.mu.Lock()
+	server := s.server
+	s.server = nil
+	sessions := make([]*SignalingSession, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	s.mu.Unlock()
+
+	if server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+	}
+	for _, session := range sessions {
+		session.send(SignalingMessage{Type: SignalingTypeBye, SessionID: session.ID})
+		session.conn.Close()
+	}
+}
+
+// IssueToken creates a single-use token that lets a client connect within ttl
+func (s *SignalingServer) IssueToken(ttl time.Duration) (string, time.Time, error) {
+	if ttl <= 0 {
+		ttl = DefaultSignalingTokenTTL
+	}
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to generate token: %w", err)
+	}
+	token := hex.EncodeToString(raw)
+	now := time.Now()
+	expires := now.Add(ttl)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for t, exp := range s.tokens {
+		if now.After(exp) {
+			delete(s.tokens, t)
+		}
+	}
+	s.tokens[token] = expires
+	return token, expires, nil
+}
+
+// consumeToken validates a token and removes it
+func (s *SignalingServer) consumeToken(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expires, ok := s.tokens[token]
+	if !ok {
+		return ErrSignalingTokenInvalid
+	}
+	delete(s.tokens, token)
+	if time.Now().After(expires) {
+		return ErrSignalingTokenInvalid
+	}
+	return nil
+}
+
+// ServeHTTP authenticates the client and upgrades to a WebSocket
+func (s *SignalingServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if s.config.SignalingAuth {
+		if err := s.consumeToken(signalingToken(req)); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	server := websocket.Server{
+		// Browsers connect from the application's origin; access is
+		// controlled by the token rather than the Origin header
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler:   s.serve,
+	}
+	server.ServeHTTP(w, req)
+}
+
+// signalingToken extracts a token from the query string or a bearer header
+func signalingToken(req *http.Request) string {
+	if token := req.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	return strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+}
+
+// serve runs one client connection until it closes or says bye
+func (s *SignalingServer) serve(conn *websocket.Conn) {
+	conn.MaxPayloadBytes = signalingMaxMessage
+	session := &SignalingSession{
+		ID:          uuid.New().String(),
+		RemoteAddr:  conn.Request().RemoteAddr,
+		ConnectedAt: time.Now(),
+		conn:        conn,
+	}
+
+	s.mu.Lock()
+	s.sessions[session.ID] = session
+	s.mu.Unlock()
+	signalingSessionsActive.Inc()
+	log.Printf("Signaling: session %s connected from %s", session.ID, session.RemoteAddr)
+
+	defer s.closeSession(session)
+
+	for {
+		var msg SignalingMessage
+		if err := websocket.JSON.Receive(conn, &msg); err != nil {
+			return
+		}
+		signalingMessages.WithLabelValues(msg.Type).Inc()
+
+		switch msg.Type {
+		case SignalingTypeOffer:
+			if err := s.handleOffer(session, msg.SDP); err != nil {
+				session.sendError(err)
+			}
+		case SignalingTypeAnswer:
+			if err := s.handleAnswer(session, msg.SDP); err != nil {
+				session.sendError(err)
+			}
+		case SignalingTypeCandidate:
+			if err := session.addCandidate(msg.Candidate); err != nil {
+				session.sendError(err)
+			}
+		case SignalingTypeBye:
+			return
+		default:
+			session.sendError(fmt.Errorf("unknown message type %q", msg.Type))
+		}
+	}
+}
+
+// handleOffer answers an offer, creating the session's peer connection for
+// the first one; later offers renegotiate it or restart ICE
+func (s *SignalingServer) handleOffer(session *SignalingSession, sdp string) error {
+	if sdp == "" {
+		return fmt.Errorf("offer without sdp")
+	}
+
+	pc, err := s.peerConnection(session)
+	if err != nil {
+		return err
+	}
+
+	// On glare Karl keeps its ICE restart offer; the client rolls back its
+	// own and answers
+	if pc.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+		return fmt.Errorf("offer from Karl awaiting an answer")
+	}
+
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sdp}
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		return fmt.Errorf("failed to set offer: %w", err)
+	}
+	session.addPendingCandidates(pc)
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return fmt.Errorf("failed to create answer: %w", err)
+	}
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return fmt.Errorf("failed to set answer: %w", err)
+	}
+
+	// Local candidates follow as they are gathered
+	session.send(SignalingMessage{
+		Type:      SignalingTypeAnswer,
+		SessionID: session.ID,
+		SDP:       answer.SDP,
+	})
+	return nil
+}
+
+// handleAnswer applies the client's answer to an offer sent by Karl
+func (s *SignalingServer) handleAnswer(session *SignalingSession, sdp string) error {
+	session.mu.Lock()
+	pc := session.pc
+	session.mu.Unlock()
+	if pc == nil || pc.SignalingState() != webrtc.SignalingStateHaveLocalOffer {
+		return fmt.Errorf("answer without an outstanding offer")
+	}
+
+	answer := webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: sdp}
+	if err := pc.SetRemoteDescription(answer); err != nil {
+		return fmt.Errorf("failed to set answer: %w", err)
+	}
+	session.addPendingCandidates(pc)
+	return nil
+}
+
+// peerConnection returns the session's peer connection, creating it with
+// trickle ICE and restart handling on first use
+func (s *SignalingServer) peerConnection(session *SignalingSession) (*webrtc.PeerConnection, error) {
+	session.mu.Lock()
+	pc := session.pc
+	session.mu.Unlock()
+	if pc != nil {
+		return pc, nil
+	}
+
+	pc, err := StartWebRTCSession()
+	if err != nil {
+		return nil, err
+	}
+
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		// A nil candidate ends gathering; it is sent as an empty candidate,
+		// like the browser's end-of-candidates indication
+		init := webrtc.ICECandidateInit{}
+		if candidate != nil {
+			init = candidate.ToJSON()
+		}
+		session.send(SignalingMessage{Type: SignalingTypeCandidate, SessionID: session.ID, Candidate: &init})
+	})
+
+	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		session.send(SignalingMessage{Type: SignalingTypeState, SessionID: session.ID, State: state.String()})
+		switch state {
+		case webrtc.ICEConnectionStateConnected, webrtc.ICEConnectionStateCompleted:
+			session.mu.Lock()
+			session.restarts = 0
+			session.mu.Unlock()
+		case webrtc.ICEConnectionStateFailed:
+			// Run outside the callback; pion holds internal locks here
+			go s.restartICE(session, pc)
+		}
+	})
+
+	session.mu.Lock()
+	session.pc = pc
+	session.mu.Unlock()
+	return pc, nil
+}
+
+// restartICE sends the client an offer with fresh ICE credentials after
+// connectivity failed, keeping the peer connection and its media. The
+// session is closed once signalingMaxICERestarts attempts have failed.
+func (s *SignalingServer) restartICE(session *SignalingSession, pc *webrtc.PeerConnection) {
+	session.mu.Lock()
+	session.restarts++
+	attempt := session.restarts
+	session.mu.Unlock()
+
+	if attempt > signalingMaxICERestarts {
+		log.Printf("Signaling: session %s: ICE failed after %d restarts", session.ID, signalingMaxICERestarts)
+		session.send(SignalingMessage{Type: SignalingTypeBye, SessionID: session.ID})
+		s.closeSession(session)
+		return
+	}
+	if pc.SignalingState() != webrtc.SignalingStateStable {
+		return // A negotiation is already under way
+	}
+
+	offer, err := pc.CreateOffer(&webrtc.OfferOptions{ICERestart: true})
+	if err != nil {
+		session.sendError(fmt.Errorf("failed to create ICE restart offer: %w", err))
+		return
+	}
+	if err := pc.SetLocalDescription(offer); err != nil {
+		session.sendError(fmt.Errorf("failed to set ICE restart offer: %w", err))
+		return
+	}
+
+	signalingICERestarts.Inc()
+	log.Printf("Signaling: session %s: restarting ICE (attempt %d)", session.ID, attempt)
+	session.send(SignalingMessage{Type: SignalingTypeOffer, SessionID: session.ID, SDP: offer.SDP})
+}
+
+// closeSession removes a session and closes its peer connection
+func (s *SignalingServer) closeSession(session *SignalingSession) {
+	s.mu.Lock()
+	if _, ok := s.sessions[session.ID]; !ok {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.sessions, session.ID)
+	s.mu.Unlock()
+	signalingSessionsActive.Dec()
+
+	session.mu.Lock()
+	pc := session.pc
+	session.pc = nil
+	session.mu.Unlock()
+	if pc != nil {
+		if err := pc.Close(); err != nil {
+			log.Printf("Signaling: session %s: failed to close peer connection: %v", session.ID, err)
+		}
+	}
+	session.conn.Close()
+	log.Printf("Signaling: session %s closed", session.ID)
+}
+
+// CloseSession ends a session, telling the client
+func (s *SignalingServer) CloseSession(sessionID string) error {
+	s.mu.Lock()
+	session, ok := s.sessions[sessionID]
+	s.mu.Unlock()
+	if !ok {
+		return ErrSignalingSessionNotFound
+	}
+
+	session.send(SignalingMessage{Type: SignalingTypeBye, SessionID: session.ID})
+	s.closeSession(session)
+	return nil
+}
+
+// ListSessions returns a snapshot of every connected session
+func (s *SignalingServer) ListSessions() []SignalingSessionInfo {
+	s.mu.Lock()
+	sessions := make([]*SignalingSession, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	s.mu.Unlock()
+
+	infos := make([]SignalingSessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		infos = append(infos, session.Info())
+	}
+	return infos
+}
+
+// Info returns a snapshot of the session
+func (session *SignalingSession) Info() SignalingSessionInfo {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	state := "new"
+	if session.pc != nil {
+		state = session.pc.ICEConnectionState().String()
+	}
+	return SignalingSessionInfo{
+		ID:          session.ID,
+		RemoteAddr:  session.RemoteAddr,
+		ConnectedAt: session.ConnectedAt,
+		State:       state,
+	}
+}
+
+// addCandidate adds a remote ICE candidate, holding it until the offer has
+// been applied
+func (session *SignalingSession) addCandidate(candidate *webrtc.ICECandidateInit) error {
+	if candidate == nil {
+		return fmt.Errorf("candidate message without candidate")
+	}
+
+	session.mu.Lock()
+	pc := session.pc
+	if pc == nil || pc.RemoteDescription() == nil {
+		session.pending = append(session.pending, *candidate)
+		session.mu.Unlock()
+		return nil
+	}
+	session.mu.Unlock()
+
+	if err := pc.AddICECandidate(*candidate); err != nil {
+		return fmt.Errorf("failed to add candidate: %w", err)
+	}
+	return nil
+}
+
+// addPendingCandidates adds candidates that arrived before the remote
+// description was set
+func (session *SignalingSession) addPendingCandidates(pc *webrtc.PeerConnection) {
+	session.mu.Lock()
+	pending := session.pending
+	session.pending = nil
+	session.mu.Unlock()
+
+	for _, candidate := range pending {
+		if err := pc.AddICECandidate(candidate); err != nil {
+			log.Printf("Signaling: session %s: failed to add candidate: %v", session.ID, err)
+		}
+	}
+}
+
+// send writes a message to the client; errors surface as the read loop
+// ending
+func (session *SignalingSession) send(msg SignalingMessage) {
+	session.sendMu.Lock()
+	defer session.sendMu.Unlock()
+	if err := websocket.JSON.Send(session.conn, msg); err != nil {
+		log.Printf("Signaling: session %s: failed to send %s: %v", session.ID, msg.Type, err)
+	}
+}
+
+// sendError reports a failed request to the client
+func (session *SignalingSession) sendError(err error) {
+	log.Printf("Signaling: session %s: %v", session.ID, err)
+	session.send(SignalingMessage{Type: SignalingTypeError, SessionID: session.ID, Error: err.Error()})
+}
@@ -0,0 +1,298 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"golang.org/x/net/websocket"
+)
+
+// enableWebRTCForTest turns WebRTC on in the global config
+func enableWebRTCForTest(t *testing.T) {
+	t.Helper()
+	configMutex.Lock()
+	previous := config
+	config = &Config{WebRTC: WebRTCConfig{Enabled: true}}
+	configMutex.Unlock()
+
+	t.Cleanup(func() {
+		configMutex.Lock()
+		config = previous
+		configMutex.Unlock()
+	})
+}
+
+func dialSignaling(t *testing.T, server *httptest.Server, query string) *websocket.Conn {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + SignalingPath + query
+	conn, err := websocket.Dial(url, "", server.URL)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func receiveSignaling(t *testing.T, conn *websocket.Conn, msgType string) SignalingMessage {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		var msg SignalingMessage
+		if err := websocket.JSON.Receive(conn, &msg); err != nil {
+			t.Fatalf("failed to receive %s: %v", msgType, err)
+		}
+		if msg.Type == msgType {
+			return msg
+		}
+	}
+}
+
+func TestSignaling_OfferAnswer(t *testing.T) {
+	enableWebRTCForTest(t)
+	signaling := NewSignalingServer(nil)
+	server := httptest.NewServer(signaling)
+	defer server.Close()
+	defer signaling.Stop()
+
+	client, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer client.Close()
+	if _, err := client.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio); err != nil {
+		t.Fatalf("failed to add transceiver: %v", err)
+	}
+	offer, err := client.CreateOffer(nil)
+	if err != nil {
+		t.Fatalf("failed to create offer: %v", err)
+	}
+	if err := client.SetLocalDescription(offer); err != nil {
+		t.Fatalf("failed to set offer: %v", err)
+	}
+
+	conn := dialSignaling(t, server, "")
+
+	// A candidate ahead of the offer is held, not rejected
+	early := SignalingMessage{Type: SignalingTypeCandidate, Candidate: &webrtc.ICECandidateInit{
+		Candidate: "candidate:1 1 udp 2130706431 192.0.2.10 40000 typ host",
+	}}
+	if err := websocket.JSON.Send(conn, early); err != nil {
+		t.Fatalf("failed to send candidate: %v", err)
+	}
+	if err := websocket.JSON.Send(conn, SignalingMessage{Type: SignalingTypeOffer, SDP: offer.SDP}); err != nil {
+		t.Fatalf("failed to send offer: %v", err)
+	}
+
+	answer := receiveSignaling(t, conn, SignalingTypeAnswer)
+	if answer.SessionID == "" || !strings.Contains(answer.SDP, "m=audio") {
+		t.Fatalf("unexpected answer %+v", answer)
+	}
+	if err := client.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer.SDP}); err != nil {
+		t.Fatalf("client rejected the answer: %v", err)
+	}
+
+	// Karl's candidates trickle in after the answer, then end-of-candidates
+	candidate := receiveSignaling(t, conn, SignalingTypeCandidate)
+	if candidate.Candidate == nil {
+		t.Fatal("expected a candidate")
+	}
+	for candidate.Candidate.Candidate != "" {
+		if !strings.HasPrefix(candidate.Candidate.Candidate, "candidate:") {
+			t.Errorf("unexpected candidate %q", candidate.Candidate.Candidate)
+		}
+		candidate = receiveSignaling(t, conn, SignalingTypeCandidate)
+	}
+
+	sessions := signaling.ListSessions()
+	if len(sessions) != 1 || sessions[0].ID != answer.SessionID {
+		t.Fatalf("expected session %s to be listed, got %+v", answer.SessionID, sessions)
+	}
+
+	if err := websocket.JSON.Send(conn, SignalingMessage{Type: "subscribe"}); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+	if msg := receiveSignaling(t, conn, SignalingTypeError); !strings.Contains(msg.Error, "unknown message type") {
+		t.Errorf("expected an unknown type error, got %q", msg.Error)
+	}
+
+	if err := signaling.CloseSession(answer.SessionID); err != nil {
+		t.Fatalf("CloseSession failed: %v", err)
+	}
+	receiveSignaling(t, conn, SignalingTypeBye)
+	if len(signaling.ListSessions()) != 0 {
+		t.Error("expected the session to be removed")
+	}
+	if err := signaling.CloseSession(answer.SessionID); err != ErrSignalingSessionNotFound {
+		t.Errorf("expected ErrSignalingSessionNotFound, got %v", err)
+	}
+}
+
+func TestSignaling_Tokens(t *testing.T) {
+	signaling := NewSignalingServer(&WebRTCConfig{SignalingAuth: true})
+	server := httptest.NewServer(signaling)
+	defer server.Close()
+	defer signaling.Stop()
+
+	resp, err := http.Get(server.URL + SignalingPath)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a token, got %d", resp.StatusCode)
+	}
+
+	token, expires, err := signaling.IssueToken(0)
+	if err != nil {
+		t.Fatalf("IssueToken failed: %v", err)
+	}
+	if d := time.Until(expires); d <= 0 || d > DefaultSignalingTokenTTL {
+		t.Errorf("expected default expiry, got %v", d)
+	}
+	dialSignaling(t, server, "?token="+token)
+
+	// Tokens are single use
+	if err := signaling.consumeToken(token); err != ErrSignalingTokenInvalid {
+		t.Errorf("expected a used token to be rejected, got %v", err)
+	}
+
+	expired, _, _ := signaling.IssueToken(time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if err := signaling.consumeToken(expired); err != ErrSignalingTokenInvalid {
+		t.Errorf("expected an expired token to be rejected, got %v", err)
+	}
+}
+
+// negotiateSignaling connects a client peer connection through the
+// signaling server and returns its socket and session
+func negotiateSignaling(t *testing.T, signaling *SignalingServer, server *httptest.Server) (*webrtc.PeerConnection, *websocket.Conn, *SignalingSession) {
+	t.Helper()
+	client, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	if _, err := client.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio); err != nil {
+		t.Fatalf("failed to add transceiver: %v", err)
+	}
+	offer, _ := client.CreateOffer(nil)
+	if err := client.SetLocalDescription(offer); err != nil {
+		t.Fatalf("failed to set offer: %v", err)
+	}
+
+	conn := dialSignaling(t, server, "")
+	if err := websocket.JSON.Send(conn, SignalingMessage{Type: SignalingTypeOffer, SDP: offer.SDP}); err != nil {
+		t.Fatalf("failed to send offer: %v", err)
+	}
+	answer := receiveSignaling(t, conn, SignalingTypeAnswer)
+	if err := client.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer.SDP}); err != nil {
+		t.Fatalf("client rejected the answer: %v", err)
+	}
+
+	signaling.mu.Lock()
+	session := signaling.sessions[answer.SessionID]
+	signaling.mu.Unlock()
+	return client, conn, session
+}
+
+func iceUfrag(sdp string) string {
+	for _, line := range strings.Split(sdp, "\r\n") {
+		if strings.HasPrefix(line, "a=ice-ufrag:") {
+			return line
+		}
+	}
+	return ""
+}
+
+func TestSignaling_ICERestart(t *testing.T) {
+	enableWebRTCForTest(t)
+	signaling := NewSignalingServer(nil)
+	server := httptest.NewServer(signaling)
+	defer server.Close()
+	defer signaling.Stop()
+
+	client, conn, session := negotiateSignaling(t, signaling, server)
+	pc := session.pc
+	before := iceUfrag(pc.LocalDescription().SDP)
+
+	// Karl offers fresh ICE credentials on the same peer connection
+	signaling.restartICE(session, pc)
+	offer := receiveSignaling(t, conn, SignalingTypeOffer)
+	if after := iceUfrag(offer.SDP); after == "" || after == before {
+		t.Fatalf("expected new ICE credentials, got %q (was %q)", after, before)
+	}
+
+	if err := client.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer.SDP}); err != nil {
+		t.Fatalf("client rejected the restart offer: %v", err)
+	}
+	answer, _ := client.CreateAnswer(nil)
+	if err := client.SetLocalDescription(answer); err != nil {
+		t.Fatalf("failed to set answer: %v", err)
+	}
+	if err := websocket.JSON.Send(conn, SignalingMessage{Type: SignalingTypeAnswer, SDP: answer.SDP}); err != nil {
+		t.Fatalf("failed to send answer: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for pc.SignalingState() != webrtc.SignalingStateStable && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if state := pc.SignalingState(); state != webrtc.SignalingStateStable {
+		t.Fatalf("expected stable signaling after the answer, got %s", state)
+	}
+	if session.pc != pc {
+		t.Error("expected the peer connection to be kept")
+	}
+
+	// The session gives up once the restarts are used up
+	session.mu.Lock()
+	session.restarts = signalingMaxICERestarts
+	session.mu.Unlock()
+	signaling.restartICE(session, pc)
+	receiveSignaling(t, conn, SignalingTypeBye)
+	if len(signaling.ListSessions()) != 0 {
+		t.Error("expected the session to be closed")
+	}
+}
+
+func TestSignaling_GlareKeepsRestartOffer(t *testing.T) {
+	enableWebRTCForTest(t)
+	signaling := NewSignalingServer(nil)
+	server := httptest.NewServer(signaling)
+	defer server.Close()
+	defer signaling.Stop()
+
+	client, conn, session := negotiateSignaling(t, signaling, server)
+	signaling.restartICE(session, session.pc)
+	restart := receiveSignaling(t, conn, SignalingTypeOffer)
+
+	// The client restarts ICE itself at the same time
+	offer, err := client.CreateOffer(&webrtc.OfferOptions{ICERestart: true})
+	if err != nil {
+		t.Fatalf("failed to create offer: %v", err)
+	}
+	if err := websocket.JSON.Send(conn, SignalingMessage{Type: SignalingTypeOffer, SDP: offer.SDP}); err != nil {
+		t.Fatalf("failed to send offer: %v", err)
+	}
+	if msg := receiveSignaling(t, conn, SignalingTypeError); !strings.Contains(msg.Error, "awaiting an answer") {
+		t.Fatalf("expected the client offer to be refused, got %q", msg.Error)
+	}
+
+	// Answering Karl's offer completes the restart
+	if err := client.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: restart.SDP}); err != nil {
+		t.Fatalf("client rejected the restart offer: %v", err)
+	}
+	answer, _ := client.CreateAnswer(nil)
+	if err := client.SetLocalDescription(answer); err != nil {
+		t.Fatalf("failed to set answer: %v", err)
+	}
+	if err := signaling.handleAnswer(session, answer.SDP); err != nil {
+		t.Fatalf("handleAnswer failed: %v", err)
+	}
+	if err := signaling.handleAnswer(session, answer.SDP); err == nil {
+		t.Error("expected an answer without an outstanding offer to fail")
+	}
+}
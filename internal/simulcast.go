@@ -0,0 +1,304 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// sfuLayerTimeout is how long a simulcast layer may go without packets
+	// before it is no longer selected; browsers pause upper layers when
+	// their own uplink is congested
+	sfuLayerTimeout = 2 * time.Second
+
+	// Estimate sources reported for subscribers
+	estimateSourceREMB = "remb"
+	estimateSourceTWCC = "twcc"
+)
+
+// SFULayerInfo is a snapshot of one simulcast layer
+type SFULayerInfo struct {
+	RID     string
+	SSRC    uint32
+	Bitrate uint64 // bits per second, 0 while paused
+	Packets uint64
+	Bytes   uint64
+	Active  bool
+}
+
+// SFUTrackInfo is a snapshot of a published track and its layers
+type SFUTrackInfo struct {
+	ID          string
+	StreamID    string
+	PublisherID string
+	MimeType    string
+	Layers      []SFULayerInfo // lowest to highest bitrate
+	Subscribers int
+}
+
+// SFUSubscriberInfo is a snapshot of a subscriber and its forwarded tracks
+type SFUSubscriberInfo struct {
+	ID             string
+	Estimate       uint64 // estimated bandwidth in bps, 0 if unknown
+	EstimateSource string // remb or twcc
+	Tracks         []SFUDownTrackInfo
+}
+
+// newMediaAPI builds a WebRTC API that accepts simulcast (rid/mid header
+// extensions) and runs the default NACK, RTCP report and TWCC interceptors.
+// A non-nil onEstimator also enables send-side bandwidth estimation from
+// TWCC feedback and receives the peer connection's estimator.
+func newMediaAPI(startBitrate, maxBitrate int, onEstimator func(cc.BandwidthEstimator)) (*webrtc.API, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+	if err := webrtc.ConfigureSimulcastExtensionHeaders(mediaEngine); err != nil {
+		return nil, err
+	}
+
+	registry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, registry); err != nil {
+		return nil, err
+	}
+
+	if onEstimator != nil {
+		if err := webrtc.ConfigureTWCCHeaderExtensionSender(mediaEngine, registry); err != nil {
+			return nil, err
+		}
+
+		opts := []gcc.Option{}
+		if startBitrate > 0 {
+			opts = append(opts, gcc.SendSideBWEInitialBitrate(startBitrate))
+		}
+		if maxBitrate > 0 {
+			opts = append(opts, gcc.SendSideBWEMaxBitrate(maxBitrate))
+		}
+		congestionController, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+			return gcc.NewSendSideBWE(opts...)
+		})
+		if err != nil {
+			return nil, err
+		}
+		congestionController.OnNewPeerConnection(func(_ string, estimator cc.BandwidthEstimator) {
+			onEstimator(estimator)
+		})
+		registry.Add(congestionController)
+	}
+
+	return webrtc.NewAPI(
+		webrtc.WithMediaEngine(mediaEngine),
+		webrtc.WithInterceptorRegistry(registry),
+	), nil
+}
+
+// NewPeerConnection creates a peer connection for an SFU participant. It
+// accepts simulcast from a publisher and, when used as a subscriber, feeds
+// its TWCC bandwidth estimate into layer selection.
+func (s *SFU) NewPeerConnection(configuration webrtc.Configuration) (*webrtc.PeerConnection, error) {
+	var estimator cc.BandwidthEstimator
+	api, err := newMediaAPI(s.config.StartBitrate, s.config.MaxBitrate, func(e cc.BandwidthEstimator) {
+		estimator = e
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create WebRTC API: %w", err)
+	}
+
+	pc, err := api.NewPeerConnection(configuration)
+	if err != nil {
+		return nil, err
+	}
+
+	if estimator != nil {
+		s.mu.Lock()
+		s.estimators[pc] = estimator
+		s.mu.Unlock()
+	}
+	return pc, nil
+}
+
+// watchEstimator feeds a subscriber's TWCC estimate into layer selection
+func (s *SFU) watchEstimator(sub *SFUSubscriber) {
+	s.mu.RLock()
+	estimator, ok := s.estimators[sub.pc]
+	s.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	estimator.OnTargetBitrateChange(func(bitrate int) {
+		s.setSubscriberEstimate(sub, uint64(bitrate), estimateSourceTWCC)
+	})
+}
+
+// setSubscriberEstimate records a subscriber's bandwidth estimate and
+// shares it between the tracks forwarded to it
+func (s *SFU) setSubscriberEstimate(sub *SFUSubscriber, bitrate uint64, source string) {
+	sub.mu.Lock()
+	sub.estimate = bitrate
+	sub.estimateSource = source
+	downTracks := make([]*sfuDownTrack, 0, len(sub.downTracks))
+	for _, dt := range sub.downTracks {
+		downTracks = append(downTracks, dt)
+	}
+	sub.mu.Unlock()
+
+	if len(downTracks) == 0 {
+		return
+	}
+	share := bitrate / uint64(len(downTracks))
+	for _, dt := range downTracks {
+		s.setEstimate(dt, share)
+	}
+}
+
+// PinLayer makes a subscriber receive one simulcast layer of a track
+// regardless of its bandwidth estimate. trackID is the published track ID.
+func (s *SFU) PinLayer(subscriberID, trackID, rid string) error {
+	dt, err := s.findDownTrack(subscriberID, trackID)
+	if err != nil {
+		return err
+	}
+
+	track := dt.track
+	track.mu.Lock()
+	if _, ok := track.layers[rid]; !ok {
+		track.mu.Unlock()
+		return fmt.Errorf("track %s has no layer %q", trackID, rid)
+	}
+	dt.pinned = rid
+	target := s.retargetLocked(track, dt)
+	track.mu.Unlock()
+
+	if target != nil {
+		track.keyframe(target, false)
+	}
+	log.Printf("SFU: subscriber %s pinned to layer %q of track %s", subscriberID, rid, trackID)
+	return nil
+}
+
+// UnpinLayer returns a subscriber's track to bandwidth-based layer selection
+func (s *SFU) UnpinLayer(subscriberID, trackID string) error {
+	dt, err := s.findDownTrack(subscriberID, trackID)
+	if err != nil {
+		return err
+	}
+
+	track := dt.track
+	track.mu.Lock()
+	dt.pinned = ""
+	target := s.retargetLocked(track, dt)
+	track.mu.Unlock()
+
+	if target != nil {
+		track.keyframe(target, false)
+	}
+	return nil
+}
+
+// retargetLocked re-runs layer selection for a down track and returns the
+// new target when a switch is needed (caller must hold the track lock)
+func (s *SFU) retargetLocked(track *SFUTrack, dt *sfuDownTrack) *sfuLayer {
+	target := s.selectLayerLocked(track, dt)
+	if target == nil || target == dt.current {
+		dt.target = nil
+		return nil
+	}
+	if target == dt.target {
+		return nil
+	}
+	dt.target = target
+	return target
+}
+
+// findDownTrack returns the down track of a published track for a subscriber
+func (s *SFU) findDownTrack(subscriberID, trackID string) (*sfuDownTrack, error) {
+	sub, ok := s.GetSubscriber(subscriberID)
+	if !ok {
+		return nil, ErrSFUSubscriberNotFound
+	}
+
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	for key, dt := range sub.downTracks {
+		if key == trackID || dt.track.ID == trackID {
+			return dt, nil
+		}
+	}
+	return nil, ErrSFUTrackNotFound
+}
+
+// Info returns a snapshot of the track and its layers
+func (t *SFUTrack) Info() SFUTrackInfo {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	now := time.Now()
+	info := SFUTrackInfo{
+		ID:          t.ID,
+		StreamID:    t.StreamID,
+		PublisherID: t.PublisherID,
+		MimeType:    t.Codec.MimeType,
+		Subscribers: len(t.downTracks),
+	}
+	for _, layer := range t.sortedLayersLocked() {
+		active := layer.active(now)
+		bitrate := layer.bitrate
+		if !active {
+			bitrate = 0
+		}
+		info.Layers = append(info.Layers, SFULayerInfo{
+			RID:     layer.RID,
+			SSRC:    layer.SSRC,
+			Bitrate: bitrate,
+			Packets: layer.packets,
+			Bytes:   layer.bytes,
+			Active:  active,
+		})
+	}
+	return info
+}
+
+// SubscriberInfo returns a snapshot of a subscriber
+func (s *SFU) SubscriberInfo(subscriberID string) (SFUSubscriberInfo, error) {
+	sub, ok := s.GetSubscriber(subscriberID)
+	if !ok {
+		return SFUSubscriberInfo{}, ErrSFUSubscriberNotFound
+	}
+
+	sub.mu.Lock()
+	info := SFUSubscriberInfo{
+		ID:             sub.ID,
+		Estimate:       sub.estimate,
+		EstimateSource: sub.estimateSource,
+	}
+	sub.mu.Unlock()
+
+	info.Tracks = sub.Info()
+	return info, nil
+}
+
+// ListSubscribers returns the IDs of all subscribers
+func (s *SFU) ListSubscribers() []string {
+	s.mu.RLock()
+	ids := make([]string, 0, len(s.subscribers))
+	for id := range s.subscribers {
+		ids = append(ids, id)
+	}
+	s.mu.RUnlock()
+
+	sort.Strings(ids)
+	return ids
+}
+
+// active reports whether a layer has received packets recently
+func (l *sfuLayer) active(now time.Time) bool {
+	return !l.lastPacket.IsZero() && now.Sub(l.lastPacket) < sfuLayerTimeout
+}
@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// addSimulcastTrack publishes a track with q/h/f layers that have all
+// received packets recently
+func addSimulcastTrack(s *SFU, trackID string, keyframes *sfuKeyframeLog) (*SFUTrack, map[string]*sfuLayer) {
+	layers := make(map[string]*sfuLayer)
+	var track *SFUTrack
+	for i, rid := range []string{"q", "h", "f"} {
+		track, layers[rid] = s.addLayer("pub", "stream", trackID, rid, uint32(100+i), sfuTestCodec, keyframes.request)
+	}
+
+	now := time.Now()
+	track.mu.Lock()
+	layers["q"].bitrate, layers["h"].bitrate, layers["f"].bitrate = 150000, 500000, 1500000
+	for _, layer := range layers {
+		layer.lastPacket = now
+	}
+	track.mu.Unlock()
+	return track, layers
+}
+
+func TestSFU_PinLayer(t *testing.T) {
+	s := NewSFU(nil)
+	keyframes := &sfuKeyframeLog{}
+	track, layers := addSimulcastTrack(s, "video", keyframes)
+	dt, _ := addTestSubscriber(s, track, "sub")
+
+	if err := s.PinLayer("sub", "video", "q"); err != nil {
+		t.Fatalf("PinLayer failed: %v", err)
+	}
+	if dt.target != layers["q"] {
+		t.Fatalf("expected pinned layer q as target, got %v", dt.target)
+	}
+
+	// Bandwidth changes do not move a pinned subscriber
+	s.handleFeedback(dt, []rtcp.Packet{&rtcp.ReceiverEstimatedMaximumBitrate{Bitrate: 5000000}})
+	if dt.target != layers["q"] {
+		t.Errorf("expected pinned layer to survive a REMB update, got %v", dt.target)
+	}
+
+	if err := s.PinLayer("sub", "video", "x"); err == nil {
+		t.Error("expected pinning an unknown layer to fail")
+	}
+	if err := s.PinLayer("sub", "other", "q"); err != ErrSFUTrackNotFound {
+		t.Errorf("expected ErrSFUTrackNotFound, got %v", err)
+	}
+	if err := s.PinLayer("nobody", "video", "q"); err != ErrSFUSubscriberNotFound {
+		t.Errorf("expected ErrSFUSubscriberNotFound, got %v", err)
+	}
+
+	if err := s.UnpinLayer("sub", "video"); err != nil {
+		t.Fatalf("UnpinLayer failed: %v", err)
+	}
+	if dt.target != layers["f"] {
+		t.Errorf("expected auto selection of layer f after unpinning, got %v", dt.target)
+	}
+
+	info, err := s.SubscriberInfo("sub")
+	if err != nil {
+		t.Fatalf("SubscriberInfo failed: %v", err)
+	}
+	if info.Estimate != 5000000 || info.EstimateSource != estimateSourceREMB {
+		t.Errorf("expected REMB estimate of 5Mbps, got %d from %q", info.Estimate, info.EstimateSource)
+	}
+}
+
+func TestSFU_SkipsPausedLayers(t *testing.T) {
+	s := NewSFU(nil)
+	track, layers := addSimulcastTrack(s, "video", &sfuKeyframeLog{})
+
+	// The publisher stopped sending its top layer
+	track.mu.Lock()
+	layers["f"].lastPacket = time.Now().Add(-2 * sfuLayerTimeout)
+	track.mu.Unlock()
+
+	dt, _ := addTestSubscriber(s, track, "sub")
+	if dt.target != layers["h"] {
+		t.Fatalf("expected highest active layer h, got %v", dt.target)
+	}
+
+	info := track.Info()
+	if len(info.Layers) != 3 {
+		t.Fatalf("expected 3 layers, got %d", len(info.Layers))
+	}
+	for _, layer := range info.Layers {
+		if layer.RID == "f" && (layer.Active || layer.Bitrate != 0) {
+			t.Errorf("expected paused layer f to report inactive at 0bps, got %+v", layer)
+		}
+	}
+	if info.Layers[0].RID != "q" || info.Subscribers != 1 {
+		t.Errorf("expected layers ordered from q with 1 subscriber, got %+v", info)
+	}
+}
+
+func TestSFU_EstimateSharedBetweenTracks(t *testing.T) {
+	s := NewSFU(nil)
+	camera, cameraLayers := addSimulcastTrack(s, "camera", &sfuKeyframeLog{})
+	screen, screenLayers := addSimulcastTrack(s, "screen", &sfuKeyframeLog{})
+
+	cameraDT, _ := addTestSubscriber(s, camera, "sub")
+	sub, _ := s.GetSubscriber("sub")
+	screenDT := s.addDownTrack(screen, sub, &sfuTestWriter{})
+
+	// 1.2Mbps fits h on each of two tracks, but not f on either
+	s.setSubscriberEstimate(sub, 1200000, estimateSourceTWCC)
+	if cameraDT.target != cameraLayers["h"] || screenDT.target != screenLayers["h"] {
+		t.Errorf("expected layer h on both tracks, got %v and %v", cameraDT.target, screenDT.target)
+	}
+	if cameraDT.estimate != 600000 {
+		t.Errorf("expected 600kbps per track, got %d", cameraDT.estimate)
+	}
+}
+
+func TestSFU_NewPeerConnectionTracksEstimate(t *testing.T) {
+	s := NewSFU(&WebRTCConfig{StartBitrate: 800000, MaxBitrate: 2000000})
+	pc, err := s.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("NewPeerConnection failed: %v", err)
+	}
+	defer pc.Close()
+
+	s.mu.RLock()
+	estimator, ok := s.estimators[pc]
+	s.mu.RUnlock()
+	if !ok {
+		t.Fatal("expected a TWCC bandwidth estimator for the peer connection")
+	}
+	if got := estimator.GetTargetBitrate(); got != 800000 {
+		t.Errorf("expected initial estimate of 800kbps, got %d", got)
+	}
+
+	if _, err := s.AddSubscriber("sub", pc); err != nil {
+		t.Fatalf("AddSubscriber failed: %v", err)
+	}
+	if err := s.RemoveSubscriber("sub"); err != nil {
+		t.Fatalf("RemoveSubscriber failed: %v", err)
+	}
+	s.mu.RLock()
+	_, ok = s.estimators[pc]
+	s.mu.RUnlock()
+	if ok {
+		t.Error("expected the estimator to be released with the subscriber")
+	}
+}
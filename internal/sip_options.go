@@ -0,0 +1,285 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// SIP proxy probe metrics
+var (
+	sipProxyUp = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "karl_sip_proxy_up",
+			Help: "Whether the SIP proxy answered the last OPTIONS ping (1) or not (0)",
+		},
+		[]string{"proxy", "transport"},
+	)
+
+	sipProxyLatency = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "karl_sip_proxy_options_latency_seconds",
+			Help:    "Round-trip time of SIP OPTIONS pings to proxies",
+			Buckets: []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2, 5},
+		},
+		[]string{"proxy", "transport"},
+	)
+
+	sipProxyProbes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "karl_sip_proxy_options_total",
+			Help: "Total SIP OPTIONS pings by result (success, error_response, timeout, error)",
+		},
+		[]string{"proxy", "transport", "result"},
+	)
+)
+
+const (
+	// sipT1 and sipT2 are the RFC 3261 retransmission timers for UDP
+	sipT1 = 500 * time.Millisecond
+	sipT2 = 4 * time.Second
+
+	// defaultSIPOptionsTimeout bounds an OPTIONS transaction (RFC 3261 Timer F is 64*T1)
+	defaultSIPOptionsTimeout = 5 * time.Second
+
+	// sipMaxMessageSize caps the size of a SIP response we are willing to read
+	sipMaxMessageSize = 65535
+)
+
+// ErrSIPTransactionTimeout is returned when no final response arrives in time
+var ErrSIPTransactionTimeout = errors.New("SIP transaction timed out")
+
+// SIPOptionsResult is the outcome of a completed OPTIONS transaction
+type SIPOptionsResult struct {
+	StatusCode int
+	Reason     string
+	Latency    time.Duration
+}
+
+// Available reports whether the response shows the proxy is able to serve
+// requests. Any final response proves reachability; 5xx/6xx mean overload or
+// refusal, so the proxy should not be used
+func (r *SIPOptionsResult) Available() bool {
+	return r.StatusCode >= 200 && r.StatusCode < 500
+}
+
+// SendSIPOptions runs an OPTIONS transaction against addr over udp, tcp or tls
+func SendSIPOptions(ctx context.Context, transport, addr string, timeout time.Duration) (*SIPOptionsResult, error) {
+	if timeout <= 0 {
+		timeout = defaultSIPOptionsTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	transport = strings.ToLower(transport)
+	if transport == "" {
+		transport = "udp"
+	}
+
+	var conn net.Conn
+	var err error
+	switch transport {
+	case "udp", "tcp":
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, transport, addr)
+	case "tls":
+		host, _, splitErr := net.SplitHostPort(addr)
+		if splitErr != nil {
+			return nil, fmt.Errorf("invalid SIP proxy address %s: %w", addr, splitErr)
+		}
+		dialer := tls.Dialer{Config: &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}}
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	default:
+		return nil, fmt.Errorf("unsupported SIP transport: %s", transport)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SIP proxy %s: %w", addr, err)
+	}
+	defer conn.Close()
+	MarkSignalingConn(conn)
+
+	deadline, _ := ctx.Deadline()
+	branch := "z9hG4bK" + randomSIPToken(8)
+	request := buildSIPOptions(transport, addr, conn.LocalAddr().String(), branch)
+
+	start := time.Now()
+	var result *SIPOptionsResult
+	if transport == "udp" {
+		result, err = runSIPOptionsUDP(conn, request, branch, deadline)
+	} else {
+		result, err = runSIPOptionsStream(conn, request, branch, deadline)
+	}
+	if err != nil {
+		return nil, err
+	}
+	result.Latency = time.Since(start)
+	return result, nil
+}
+
+// buildSIPOptions formats an out-of-dialog OPTIONS request
+func buildSIPOptions(transport, addr, localAddr, branch string) []byte {
+	requestURI := "sip:" + addr
+	if transport == "tls" {
+		requestURI += ";transport=tls"
+	} else if transport == "tcp" {
+		requestURI += ";transport=tcp"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "OPTIONS %s SIP/2.0\r\n", requestURI)
+	fmt.Fprintf(&b, "Via: SIP/2.0/%s %s;branch=%s;rport\r\n", strings.ToUpper(transport), localAddr, branch)
+	b.WriteString("Max-Forwards: 70\r\n")
+	fmt.Fprintf(&b, "From: <sip:karl@%s>;tag=%s\r\n", localAddr, randomSIPToken(4))
+	fmt.Fprintf(&b, "To: <sip:%s>\r\n", addr)
+	fmt.Fprintf(&b, "Call-ID: %s@%s\r\n", randomSIPToken(12), localAddr)
+	b.WriteString("CSeq: 1 OPTIONS\r\n")
+	fmt.Fprintf(&b, "Contact: <sip:karl@%s>\r\n", localAddr)
+	b.WriteString("Accept: application/sdp\r\n")
+	b.WriteString("User-Agent: Karl RTP Engine\r\n")
+	b.WriteString("Content-Length: 0\r\n\r\n")
+	return []byte(b.String())
+}
+
+// runSIPOptionsUDP sends the request with Timer E retransmissions until a
+// final response or the transaction deadline
+func runSIPOptionsUDP(conn net.Conn, request []byte, branch string, deadline time.Time) (*SIPOptionsResult, error) {
+	buf := make([]byte, sipMaxMessageSize)
+	interval := sipT1
+	nextSend := time.Now()
+
+	for {
+		now := time.Now()
+		if !now.Before(deadline) {
+			return nil, ErrSIPTransactionTimeout
+		}
+		if !now.Before(nextSend) {
+			if _, err := conn.Write(request); err != nil {
+				return nil, fmt.Errorf("failed to send OPTIONS: %w", err)
+			}
+			nextSend = now.Add(interval)
+			interval = min(interval*2, sipT2)
+		}
+
+		_ = conn.SetReadDeadline(minTime(nextSend, deadline))
+		n, err := conn.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return nil, fmt.Errorf("failed to read OPTIONS response: %w", err)
+		}
+
+		result, final, err := readSIPResponse(bufio.NewReader(bytes.NewReader(buf[:n])), branch)
+		if err != nil || !final {
+			// Stray datagrams and provisional responses keep the transaction open
+			continue
+		}
+		return result, nil
+	}
+}
+
+// runSIPOptionsStream sends the request once over a reliable transport and
+// waits for the final response
+func runSIPOptionsStream(conn net.Conn, request []byte, branch string, deadline time.Time) (*SIPOptionsResult, error) {
+	_ = conn.SetDeadline(deadline)
+	if _, err := conn.Write(request); err != nil {
+		return nil, fmt.Errorf("failed to send OPTIONS: %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	for {
+		result, final, err := readSIPResponse(reader, branch)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return nil, ErrSIPTransactionTimeout
+			}
+			return nil, err
+		}
+		if final {
+			return result, nil
+		}
+	}
+}
+
+// readSIPResponse parses one SIP response and reports whether it is a final
+// response belonging to our transaction
+func readSIPResponse(reader *bufio.Reader, branch string) (*SIPOptionsResult, bool, error) {
+	tp := textproto.NewReader(reader)
+	statusLine, err := tp.ReadLine()
+	if err != nil {
+		return nil, false, err
+	}
+
+	parts := strings.SplitN(statusLine, " ", 3)
+	if len(parts) < 2 || parts[0] != "SIP/2.0" {
+		return nil, false, fmt.Errorf("malformed SIP status line: %q", statusLine)
+	}
+	code, err := strconv.Atoi(parts[1])
+	if err != nil || code < 100 || code > 699 {
+		return nil, false, fmt.Errorf("invalid SIP status code: %q", parts[1])
+	}
+	reason := ""
+	if len(parts) == 3 {
+		reason = parts[2]
+	}
+
+	headers, err := tp.ReadMIMEHeader()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, false, fmt.Errorf("malformed SIP headers: %w", err)
+	}
+
+	// Consume the body so the next message on a stream starts cleanly
+	length := headers.Get("Content-Length")
+	if length == "" {
+		length = headers.Get("L")
+	}
+	if n, convErr := strconv.Atoi(strings.TrimSpace(length)); convErr == nil && n > 0 {
+		if n > sipMaxMessageSize {
+			return nil, false, fmt.Errorf("SIP body too large: %d bytes", n)
+		}
+		if _, err := io.CopyN(io.Discard, reader, int64(n)); err != nil {
+			return nil, false, err
+		}
+	}
+
+	via := headers.Get("Via")
+	if via == "" {
+		via = headers.Get("V")
+	}
+	cseq := headers.Get("Cseq")
+	if !strings.Contains(via, "branch="+branch) || !strings.HasSuffix(strings.TrimSpace(cseq), "OPTIONS") {
+		return nil, false, nil
+	}
+
+	return &SIPOptionsResult{StatusCode: code, Reason: reason}, code >= 200, nil
+}
+
+// randomSIPToken returns a random hex string for branches, tags and Call-IDs
+func randomSIPToken(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
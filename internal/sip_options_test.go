@@ -0,0 +1,176 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sipTestResponse builds a response echoing the request's transaction headers
+func sipTestResponse(request string, code int, reason string) []byte {
+	var via, from, to, callID, cseq string
+	for _, line := range strings.Split(request, "\r\n") {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(name) {
+		case "via":
+			via = value
+		case "from":
+			from = value
+		case "to":
+			to = value
+		case "call-id":
+			callID = value
+		case "cseq":
+			cseq = value
+		}
+	}
+	return []byte(fmt.Sprintf("SIP/2.0 %d %s\r\nVia: %s\r\nFrom: %s\r\nTo: %s;tag=proxy\r\nCall-ID: %s\r\nCSeq: %s\r\nContent-Length: 0\r\n\r\n",
+		code, reason, via, from, to, callID, cseq))
+}
+
+func TestSendSIPOptions_UDPRetransmit(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer conn.Close()
+
+	received := make(chan int, 1)
+	go func() {
+		buf := make([]byte, 4096)
+		for i := 1; ; i++ {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			// Drop the first transmission to force a Timer E retransmit
+			if i == 1 {
+				continue
+			}
+			request := string(buf[:n])
+			_, _ = conn.WriteTo(sipTestResponse(request, 100, "Trying"), addr)
+			_, _ = conn.WriteTo(sipTestResponse(request, 200, "OK"), addr)
+			received <- i
+			return
+		}
+	}()
+
+	result, err := SendSIPOptions(context.Background(), "udp", conn.LocalAddr().String(), 3*time.Second)
+	if err != nil {
+		t.Fatalf("SendSIPOptions failed: %v", err)
+	}
+	if result.StatusCode != 200 || !result.Available() {
+		t.Errorf("expected available 200 OK, got %+v", result)
+	}
+	if result.Latency < sipT1 {
+		t.Errorf("expected latency to include the retransmit interval, got %v", result.Latency)
+	}
+	if n := <-received; n != 2 {
+		t.Errorf("expected answer on the second transmission, got %d", n)
+	}
+}
+
+func TestSendSIPOptions_UDPTimeout(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer conn.Close()
+
+	_, err = SendSIPOptions(context.Background(), "udp", conn.LocalAddr().String(), 700*time.Millisecond)
+	if !errors.Is(err, ErrSIPTransactionTimeout) {
+		t.Errorf("expected transaction timeout, got %v", err)
+	}
+}
+
+func TestSendSIPOptions_TCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		tp := textproto.NewReader(bufio.NewReader(conn))
+		var lines []string
+		for {
+			line, err := tp.ReadLine()
+			if err != nil || line == "" {
+				break
+			}
+			lines = append(lines, line)
+		}
+		request := strings.Join(lines, "\r\n")
+		_, _ = conn.Write(sipTestResponse(request, 503, "Service Unavailable"))
+	}()
+
+	result, err := SendSIPOptions(context.Background(), "tcp", listener.Addr().String(), 2*time.Second)
+	if err != nil {
+		t.Fatalf("SendSIPOptions failed: %v", err)
+	}
+	if result.StatusCode != 503 || result.Available() {
+		t.Errorf("expected unavailable 503, got %+v", result)
+	}
+}
+
+func TestPingSIPProxy_RecordsStatus(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer conn.Close()
+
+	go func() {
+		buf := make([]byte, 4096)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		_, _ = conn.WriteTo(sipTestResponse(string(buf[:n]), 200, "OK"), addr)
+	}()
+
+	host, portStr, _ := net.SplitHostPort(conn.LocalAddr().String())
+	port, _ := strconv.Atoi(portStr)
+	settings := IntegrationConfig{OptionsTimeout: 2}.SIPKeepaliveSettings(host, port)
+
+	if err := PingSIPProxy(context.Background(), settings); err != nil {
+		t.Fatalf("PingSIPProxy failed: %v", err)
+	}
+
+	status, ok := GetSIPProxyStatus(conn.LocalAddr().String())
+	if !ok || !status.Available || status.StatusCode != 200 || status.Transport != "udp" {
+		t.Errorf("unexpected proxy status %+v", status)
+	}
+	if !IsRegisteredWithSIPProxy(conn.LocalAddr().String()) {
+		t.Error("expected proxy to be reported as available")
+	}
+}
+
+func TestReadSIPResponse_IgnoresOtherTransactions(t *testing.T) {
+	response := "SIP/2.0 200 OK\r\nVia: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bKother\r\nCSeq: 1 OPTIONS\r\nContent-Length: 0\r\n\r\n"
+	result, final, err := readSIPResponse(bufio.NewReader(strings.NewReader(response)), "z9hG4bKmine")
+	if err != nil || final || result != nil {
+		t.Errorf("expected response for another branch to be ignored, got %+v final=%v err=%v", result, final, err)
+	}
+
+	if _, _, err := readSIPResponse(bufio.NewReader(strings.NewReader("HTTP/1.1 200 OK\r\n\r\n")), "x"); err == nil {
+		t.Error("expected error for non-SIP status line")
+	}
+}
@@ -2,9 +2,13 @@ package internal
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -13,135 +17,223 @@ import (
 type SIPRegistrationSettings struct {
 	ProxyIP         string
 	ProxyPort       int
+	Transport       string // udp, tcp or tls
 	Interval        time.Duration
+	Timeout         time.Duration // OPTIONS transaction timeout
 	RetryCount      int
 	RetryBackoff    time.Duration
 	KeepAliveEnable bool
 }
 
+// SIPProxyStatus is the result of the latest OPTIONS ping to a proxy
+type SIPProxyStatus struct {
+	Address             string    `json:"address"`
+	Transport           string    `json:"transport"`
+	Available           bool      `json:"available"`
+	StatusCode          int       `json:"status_code,omitempty"`
+	LatencyMs           float64   `json:"latency_ms"`
+	LastError           string    `json:"last_error,omitempty"`
+	LastChecked         time.Time `json:"last_checked"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+}
+
 var (
 	// Default settings
 	defaultSIPSettings = SIPRegistrationSettings{
+		Transport:       "udp",
 		RetryCount:      5,
 		RetryBackoff:    time.Second * 2,
 		Interval:        time.Second * 30,
+		Timeout:         defaultSIPOptionsTimeout,
 		KeepAliveEnable: true,
 	}
 
-	// Track registration status
-	registrationStatus     map[string]bool
+	// Track proxy availability
+	registrationStatus     map[string]*SIPProxyStatus
 	registrationStatusLock sync.RWMutex
 )
 
 func init() {
-	registrationStatus = make(map[string]bool)
+	registrationStatus = make(map[string]*SIPProxyStatus)
 }
 
-// IsRegisteredWithSIPProxy checks if we're registered with a specific proxy
+// SIPKeepaliveSettings builds OPTIONS ping settings for a proxy from the
+// integration config
+func (c IntegrationConfig) SIPKeepaliveSettings(proxyIP string, proxyPort int) SIPRegistrationSettings {
+	settings := defaultSIPSettings
+	settings.ProxyIP = proxyIP
+	settings.ProxyPort = proxyPort
+	if c.SIPTransport != "" {
+		settings.Transport = c.SIPTransport
+	}
+	if c.KeepAliveInterval > 0 {
+		settings.Interval = time.Duration(c.KeepAliveInterval) * time.Second
+	}
+	if c.OptionsTimeout > 0 {
+		settings.Timeout = time.Duration(c.OptionsTimeout) * time.Second
+	}
+	return settings
+}
+
+// IsRegisteredWithSIPProxy checks if a specific proxy answered the last OPTIONS ping
 func IsRegisteredWithSIPProxy(proxyAddr string) bool {
 	registrationStatusLock.RLock()
 	defer registrationStatusLock.RUnlock()
-	return registrationStatus[proxyAddr]
+	status, ok := registrationStatus[proxyAddr]
+	return ok && status.Available
 }
 
-// RegisterWithSIPProxy registers Karl as an RTP media relay with OpenSIPS/Kamailio
-func RegisterWithSIPProxy(proxyIP string, proxyPort int) error {
-	proxyAddr := net.JoinHostPort(proxyIP, fmt.Sprint(proxyPort))
-
-	// Create a UDP connection to the SIP proxy with timeout
-	dialer := net.Dialer{Timeout: 5 * time.Second}
-	conn, err := dialer.Dial("udp", proxyAddr)
-	if err != nil {
-		// Update status
-		registrationStatusLock.Lock()
-		registrationStatus[proxyAddr] = false
-		registrationStatusLock.Unlock()
-
-		return fmt.Errorf("failed to connect to SIP proxy %s: %w", proxyAddr, err)
+// GetSIPProxyStatus returns the latest probe result for a proxy
+func GetSIPProxyStatus(proxyAddr string) (SIPProxyStatus, bool) {
+	registrationStatusLock.RLock()
+	defer registrationStatusLock.RUnlock()
+	status, known := registrationStatus[proxyAddr]
+	if !known {
+		return SIPProxyStatus{}, false
 	}
-	defer conn.Close()
+	return *status, true
+}
 
-	// Set read/write timeouts
-	deadline := time.Now().Add(5 * time.Second)
-	if tcpConn, ok := conn.(*net.TCPConn); ok {
-		_ = tcpConn.SetDeadline(deadline)
-	} else if udpConn, ok := conn.(*net.UDPConn); ok {
-		_ = udpConn.SetDeadline(deadline)
+// GetSIPProxyStatuses returns the latest probe results for all proxies
+func GetSIPProxyStatuses() []SIPProxyStatus {
+	registrationStatusLock.RLock()
+	defer registrationStatusLock.RUnlock()
+	statuses := make([]SIPProxyStatus, 0, len(registrationStatus))
+	for _, status := range registrationStatus {
+		statuses = append(statuses, *status)
 	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Address < statuses[j].Address
+	})
+	return statuses
+}
 
-	// Send a registration message with host information
-	localIP := GetLocalIPAddress()
-	hostname, _ := net.LookupAddr(localIP)
-	registrationMessage := fmt.Sprintf("REGISTER Karl RTP Engine %s", hostname)
-	_, err = conn.Write([]byte(registrationMessage))
-	if err != nil {
-		// Update status
-		registrationStatusLock.Lock()
-		registrationStatus[proxyAddr] = false
-		registrationStatusLock.Unlock()
+// RegisterWithSIPProxy checks that OpenSIPS/Kamailio is reachable with a SIP
+// OPTIONS ping over UDP using the default transaction timeout
+func RegisterWithSIPProxy(proxyIP string, proxyPort int) error {
+	settings := defaultSIPSettings
+	settings.ProxyIP = proxyIP
+	settings.ProxyPort = proxyPort
+	return PingSIPProxy(context.Background(), settings)
+}
 
-		return fmt.Errorf("failed to send registration to SIP proxy: %w", err)
+// PingSIPProxy sends a SIP OPTIONS ping and records the proxy's availability
+// and latency for the health API and Prometheus
+func PingSIPProxy(ctx context.Context, settings SIPRegistrationSettings) error {
+	proxyAddr := net.JoinHostPort(settings.ProxyIP, strconv.Itoa(settings.ProxyPort))
+	transport := strings.ToLower(settings.Transport)
+	if transport == "" {
+		transport = "udp"
 	}
 
-	// Read response (to confirm registration)
-	buffer := make([]byte, 1024)
-	_, err = conn.Read(buffer)
-	if err != nil {
-		// Update status
-		registrationStatusLock.Lock()
-		registrationStatus[proxyAddr] = false
-		registrationStatusLock.Unlock()
+	result, err := SendSIPOptions(ctx, transport, proxyAddr, settings.Timeout)
+	if err == nil && !result.Available() {
+		err = fmt.Errorf("SIP proxy %s answered %d %s", proxyAddr, result.StatusCode, result.Reason)
+	}
+	recordSIPProxyStatus(proxyAddr, transport, result, err)
 
-		return fmt.Errorf("failed to receive response from SIP proxy: %w", err)
+	if err != nil {
+		return fmt.Errorf("OPTIONS ping to SIP proxy %s failed: %w", proxyAddr, err)
 	}
+	return nil
+}
 
-	// Update status
+// recordSIPProxyStatus updates the proxy status table and metrics
+func recordSIPProxyStatus(proxyAddr, transport string, result *SIPOptionsResult, err error) {
 	registrationStatusLock.Lock()
-	registrationStatus[proxyAddr] = true
+	status, known := registrationStatus[proxyAddr]
+	if !known {
+		status = &SIPProxyStatus{Address: proxyAddr}
+		registrationStatus[proxyAddr] = status
+	}
+	wasAvailable := status.Available
+
+	status.Transport = transport
+	status.LastChecked = time.Now()
+	status.StatusCode = 0
+	if result != nil {
+		status.StatusCode = result.StatusCode
+		status.LatencyMs = float64(result.Latency.Microseconds()) / 1000
+	}
+	if err != nil {
+		status.Available = false
+		status.LastError = err.Error()
+		status.ConsecutiveFailures++
+	} else {
+		status.Available = true
+		status.LastError = ""
+		status.ConsecutiveFailures = 0
+	}
+	available := status.Available
 	registrationStatusLock.Unlock()
 
-	log.Printf("Successfully registered Karl with SIP proxy at %s", proxyAddr)
-	return nil
+	outcome := "success"
+	switch {
+	case errors.Is(err, ErrSIPTransactionTimeout):
+		outcome = "timeout"
+	case err != nil && result != nil:
+		outcome = "error_response"
+	case err != nil:
+		outcome = "error"
+	}
+	sipProxyProbes.WithLabelValues(proxyAddr, transport, outcome).Inc()
+	if result != nil {
+		sipProxyLatency.WithLabelValues(proxyAddr, transport).Observe(result.Latency.Seconds())
+	}
+	if available {
+		sipProxyUp.WithLabelValues(proxyAddr, transport).Set(1)
+	} else {
+		sipProxyUp.WithLabelValues(proxyAddr, transport).Set(0)
+	}
+
+	if available && !wasAvailable {
+		log.Printf("SIP proxy %s is reachable (%.1fms)", proxyAddr, float64(result.Latency.Microseconds())/1000)
+	}
+	// Webhooks hear of the first result and of every change
+	if !known || available != wasAvailable {
+		data := map[string]interface{}{"proxy": proxyAddr, "transport": transport, "available": available}
+		if err != nil {
+			data["error"] = err.Error()
+		}
+		PublishEvent(EventRegistration, "", data)
+	}
 }
 
 // PeriodicallyRegisterWithSIPProxy ensures Karl remains registered with OpenSIPS/Kamailio
 // with retries and exponential backoff
 func PeriodicallyRegisterWithSIPProxy(proxyIP string, proxyPort int, interval time.Duration) {
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
-
 	settings := defaultSIPSettings
 	settings.ProxyIP = proxyIP
 	settings.ProxyPort = proxyPort
 	settings.Interval = interval
 
-	// Initial registration attempt
-	registerWithRetries(settings)
-
-	// Periodic registration
-	for range ticker.C {
-		registerWithRetries(settings)
-	}
+	StartSIPKeepalive(context.Background(), settings)
 }
 
 // StartRegistrationService starts the SIP registration service with context for shutdown
 func StartRegistrationService(ctx context.Context, proxyIP string, proxyPort int, interval time.Duration) {
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
-
 	settings := defaultSIPSettings
 	settings.ProxyIP = proxyIP
 	settings.ProxyPort = proxyPort
 	settings.Interval = interval
 
-	// Initial registration attempt
-	registerWithRetries(settings)
+	StartSIPKeepalive(ctx, settings)
+}
+
+// StartSIPKeepalive pings a SIP proxy with OPTIONS every interval until the
+// context is cancelled
+func StartSIPKeepalive(ctx context.Context, settings SIPRegistrationSettings) {
+	ticker := time.NewTicker(settings.Interval)
+	defer ticker.Stop()
+
+	// Initial ping
+	registerWithRetries(ctx, settings)
 
-	// Periodic registration with cancellation support
+	// Periodic pings with cancellation support
 	for {
 		select {
 		case <-ticker.C:
-			registerWithRetries(settings)
+			registerWithRetries(ctx, settings)
 		case <-ctx.Done():
 			log.Println("SIP registration service shutting down")
 			return
@@ -149,22 +241,26 @@ func StartRegistrationService(ctx context.Context, proxyIP string, proxyPort int
 	}
 }
 
-// registerWithRetries attempts to register with exponential backoff
-func registerWithRetries(settings SIPRegistrationSettings) {
+// registerWithRetries pings the proxy, retrying with exponential backoff
+func registerWithRetries(ctx context.Context, settings SIPRegistrationSettings) {
 	backoff := settings.RetryBackoff
 
 	// First attempt
-	err := RegisterWithSIPProxy(settings.ProxyIP, settings.ProxyPort)
+	err := PingSIPProxy(ctx, settings)
 	if err == nil {
 		return
 	}
 
-	log.Printf("Initial registration with SIP proxy failed: %v, will retry", err)
+	log.Printf("Initial OPTIONS ping to SIP proxy failed: %v, will retry", err)
 
 	// Retry with exponential backoff
 	for i := 0; i < settings.RetryCount; i++ {
-		time.Sleep(backoff)
-		err = RegisterWithSIPProxy(settings.ProxyIP, settings.ProxyPort)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		err = PingSIPProxy(ctx, settings)
 		if err == nil {
 			return
 		}
@@ -173,7 +269,7 @@ func registerWithRetries(settings SIPRegistrationSettings) {
 		backoff *= 2 // Exponential backoff
 	}
 
-	log.Printf("Failed to register with SIP proxy %s:%d after %d retries",
+	log.Printf("SIP proxy %s:%d unreachable after %d retries",
 		settings.ProxyIP, settings.ProxyPort, settings.RetryCount)
 }
 
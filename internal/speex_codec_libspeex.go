@@ -0,0 +1,238 @@
+//go:build karl_speex && cgo
+
+package internal
+
+/*
+#cgo pkg-config: speex
+#include <stdlib.h>
+#include <speex/speex.h>
+
+typedef struct {
+	void *state;
+	SpeexBits bits;
+	int frame_size;
+} karl_speex;
+
+static karl_speex *karl_speex_new(int encoder, int mode_id, int quality, int vbr, int vad) {
+	karl_speex *s = calloc(1, sizeof(*s));
+	if (s == NULL) {
+		return NULL;
+	}
+	const SpeexMode *mode = speex_lib_get_mode(mode_id);
+	s->state = encoder ? speex_encoder_init(mode) : speex_decoder_init(mode);
+	if (s->state == NULL) {
+		free(s);
+		return NULL;
+	}
+	speex_bits_init(&s->bits);
+	if (encoder) {
+		speex_encoder_ctl(s->state, SPEEX_SET_QUALITY, &quality);
+		speex_encoder_ctl(s->state, SPEEX_SET_VBR, &vbr);
+		speex_encoder_ctl(s->state, SPEEX_SET_VAD, &vad);
+		speex_encoder_ctl(s->state, SPEEX_SET_DTX, &vad);
+		speex_encoder_ctl(s->state, SPEEX_GET_FRAME_SIZE, &s->frame_size);
+	} else {
+		int enhance = 1;
+		speex_decoder_ctl(s->state, SPEEX_SET_ENH, &enhance);
+		speex_decoder_ctl(s->state, SPEEX_GET_FRAME_SIZE, &s->frame_size);
+	}
+	return s;
+}
+
+static void karl_speex_free(karl_speex *s, int encoder) {
+	if (encoder) {
+		speex_encoder_destroy(s->state);
+	} else {
+		speex_decoder_destroy(s->state);
+	}
+	speex_bits_destroy(&s->bits);
+	free(s);
+}
+
+// karl_speex_encode adds a frame to the bits, returning 0 if discontinuous
+// transmission would not send it
+static int karl_speex_encode(karl_speex *s, short *pcm) {
+	return speex_encode_int(s->state, pcm, &s->bits);
+}
+
+// karl_speex_flush writes the frames encoded so far into out and starts a
+// new payload, returning its size
+static int karl_speex_flush(karl_speex *s, char *out, int max, int send) {
+	int n = 0;
+	if (send) {
+		n = speex_bits_write(&s->bits, out, max);
+	}
+	speex_bits_reset(&s->bits);
+	return n;
+}
+
+static void karl_speex_read(karl_speex *s, char *data, int len) {
+	speex_bits_read_from(&s->bits, data, len);
+}
+
+// karl_speex_decode decodes the next frame of the bits read, returning -1
+// after the last and -2 for a corrupt stream
+static int karl_speex_decode(karl_speex *s, short *out) {
+	if (speex_bits_remaining(&s->bits) < 5) {
+		return -1;
+	}
+	return speex_decode_int(s->state, &s->bits, out);
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"unsafe"
+)
+
+const (
+	// speexQuality is the encoder quality, 15 kbps in narrowband
+	speexQuality = 8
+	// speexMaxPayload bounds an encoded payload, and speexMaxFrames the
+	// frames decoded from one
+	speexMaxPayload = 1500
+	speexMaxFrames  = 16
+)
+
+// Speex from libspeex, at the clock rate the codec was negotiated with:
+// narrowband at 8 kHz, wideband at 16 kHz and ultra-wideband at 32 kHz
+func init() {
+	registerAudioCodec(MimeTypeSpeex, nativeAudioCodec{
+		offer:      CodecInfo{PayloadType: 96, Name: "speex", ClockRate: SpeexNBSampleRate, Channels: 1},
+		sampleRate: func(codec CodecInfo) int { return GetSpeexSampleRate(speexMode(codec)) },
+		newEncoder: newSpeexEncoder,
+		newDecoder: newSpeexDecoder,
+	})
+}
+
+// speexMode returns the Speex mode of a negotiated clock rate. Its values
+// are libspeex's mode IDs
+func speexMode(codec CodecInfo) SpeexMode {
+	switch codec.ClockRate {
+	case SpeexWBSampleRate:
+		return SpeexModeWideband
+	case SpeexUWBSampleRate:
+		return SpeexModeUltraWideband
+	}
+	return SpeexModeNarrowband
+}
+
+// speexVBR reads the vbr parameter of a Speex fmtp (RFC 5574): on for
+// variable bitrate, vad for voice activity detection with discontinuous
+// transmission
+func speexVBR(fmtp string) (vbr, vad bool) {
+	for _, param := range strings.Split(fmtp, ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if strings.EqualFold(key, "vbr") {
+			value = strings.ToLower(strings.TrimSpace(value))
+			return value == "on", value == "vad"
+		}
+	}
+	return false, false
+}
+
+func speexFlag(b bool) C.int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// speexEncoder encodes the frames of one payload together
+type speexEncoder struct {
+	s      *C.karl_speex
+	framer pcmFramer
+}
+
+func newSpeexEncoder(codec CodecInfo) (audioEncoder, error) {
+	vbr, vad := speexVBR(codec.Fmtp)
+	s := C.karl_speex_new(1, C.int(speexMode(codec)), speexQuality, speexFlag(vbr), speexFlag(vad))
+	if s == nil {
+		return nil, fmt.Errorf("failed to create Speex encoder")
+	}
+	e := &speexEncoder{s: s, framer: pcmFramer{size: int(s.frame_size)}}
+	runtime.SetFinalizer(e, (*speexEncoder).Close)
+	return e, nil
+}
+
+// Encode returns the whole frames of pcm, or none when discontinuous
+// transmission suppresses all of them
+func (e *speexEncoder) Encode(pcm []int16) ([]byte, error) {
+	if e.s == nil {
+		return nil, fmt.Errorf("Speex encoder closed")
+	}
+	send := false
+	for _, frame := range e.framer.frames(pcm) {
+		if C.karl_speex_encode(e.s, (*C.short)(unsafe.Pointer(&frame[0]))) != 0 {
+			send = true
+		}
+	}
+	out := make([]byte, speexMaxPayload)
+	n := C.karl_speex_flush(e.s, (*C.char)(unsafe.Pointer(&out[0])), speexMaxPayload, speexFlag(send))
+	return out[:n], nil
+}
+
+// Close frees the encoder
+func (e *speexEncoder) Close() {
+	if e.s != nil {
+		C.karl_speex_free(e.s, 1)
+		e.s = nil
+	}
+	runtime.SetFinalizer(e, nil)
+}
+
+// speexDecoder decodes payloads of one or more frames
+type speexDecoder struct {
+	s *C.karl_speex
+}
+
+func newSpeexDecoder(codec CodecInfo) (audioDecoder, error) {
+	s := C.karl_speex_new(0, C.int(speexMode(codec)), 0, 0, 0)
+	if s == nil {
+		return nil, fmt.Errorf("failed to create Speex decoder")
+	}
+	d := &speexDecoder{s: s}
+	runtime.SetFinalizer(d, (*speexDecoder).Close)
+	return d, nil
+}
+
+// Decode decodes the frames of a payload
+func (d *speexDecoder) Decode(payload []byte) ([]int16, error) {
+	if d.s == nil {
+		return nil, fmt.Errorf("Speex decoder closed")
+	}
+	if len(payload) == 0 {
+		return nil, fmt.Errorf("empty Speex payload")
+	}
+	C.karl_speex_read(d.s, (*C.char)(unsafe.Pointer(&payload[0])), C.int(len(payload)))
+
+	frame := int(d.s.frame_size)
+	var pcm []int16
+	out := make([]int16, frame)
+	for i := 0; i < speexMaxFrames; i++ {
+		ret := C.karl_speex_decode(d.s, (*C.short)(unsafe.Pointer(&out[0])))
+		if ret == -2 {
+			return nil, fmt.Errorf("corrupt Speex payload")
+		}
+		if ret != 0 {
+			break
+		}
+		pcm = append(pcm, out...)
+	}
+	if len(pcm) == 0 {
+		return nil, fmt.Errorf("Speex payload of %d bytes has no frame", len(payload))
+	}
+	return pcm, nil
+}
+
+// Close frees the decoder
+func (d *speexDecoder) Close() {
+	if d.s != nil {
+		C.karl_speex_free(d.s, 0)
+		d.s = nil
+	}
+	runtime.SetFinalizer(d, nil)
+}
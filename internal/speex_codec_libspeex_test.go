@@ -0,0 +1,59 @@
+//go:build karl_speex && cgo
+
+package internal
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestSpeex_RoundTrip(t *testing.T) {
+	for _, rate := range []uint32{SpeexNBSampleRate, SpeexWBSampleRate, SpeexUWBSampleRate} {
+		codec := CodecInfo{Name: "speex", ClockRate: rate}
+		payloads, pcm := nativeRoundTrip(t, codec)
+		if len(payloads) != 50 {
+			t.Fatalf("%d Hz: expected 50 payloads, got %d", rate, len(payloads))
+		}
+		checkTone(t, "Speex", pcm, int(rate))
+	}
+}
+
+func TestSpeex_DTX(t *testing.T) {
+	codecs := NewStreamCodecs()
+	defer codecs.close()
+	codec := CodecInfo{Name: "speex", ClockRate: SpeexNBSampleRate, Fmtp: "vbr=vad"}
+
+	suppressed := 0
+	for i := 0; i < 50; i++ {
+		payload, err := encodeAudio(codec, make([]int16, SpeexNBFrameSamples), codecs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(payload) == 0 {
+			suppressed++
+		}
+	}
+	if suppressed == 0 {
+		t.Error("expected silence suppressed with vbr=vad")
+	}
+}
+
+func TestTranscodeAudio_Speex(t *testing.T) {
+	opus, err := transcodeAudio(encodeG711("PCMU", resamplerTone(440, 8000, 160)), mimeCodec(webrtc.MimeTypePCMU), mimeCodec(webrtc.MimeTypeOpus))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb := CodecInfo{Name: "speex", ClockRate: SpeexWBSampleRate}
+	encoded, err := transcodeAudio(opus, mimeCodec(webrtc.MimeTypeOpus), wb)
+	if err != nil || len(encoded) == 0 {
+		t.Fatalf("expected wideband Speex, got %d bytes (%v)", len(encoded), err)
+	}
+	back, err := transcodeAudio(encoded, wb, mimeCodec(webrtc.MimeTypePCMU))
+	if err != nil || len(back) != 160 {
+		t.Fatalf("expected 160 PCMU samples, got %d bytes (%v)", len(back), err)
+	}
+	if added := TranscodeOfferCodecs(nil, []string{"speex"}); len(added) != 1 || added[0].ClockRate != SpeexNBSampleRate {
+		t.Errorf("expected narrowband Speex offered for transcoding, got %+v", added)
+	}
+}
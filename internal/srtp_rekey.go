@@ -0,0 +1,295 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// SRTP rekey metrics
+var srtpRekeysTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "karl_srtp_rekeys_total",
+		Help: "Total SRTP master key rotations by keying method (sdes, dtls)",
+	},
+	[]string{"method"},
+)
+
+// srtpRekeyCheckInterval is how often sessions are scanned for due rotations
+const srtpRekeyCheckInterval = 10 * time.Second
+
+// SRTPRekeyPendingFlag marks sessions waiting for a re-INVITE to apply new keys
+const SRTPRekeyPendingFlag = "srtp_rekey_pending"
+
+// srtpKeyLengths returns the master key and salt sizes for an SDES crypto suite
+func srtpKeyLengths(suite string) (keyLen, saltLen int, err error) {
+	switch strings.ToUpper(suite) {
+	case "AES_CM_128_HMAC_SHA1_80", "AES_CM_128_HMAC_SHA1_32":
+		return 16, 14, nil
+	case "AES_256_CM_HMAC_SHA1_80", "AES_256_CM_HMAC_SHA1_32":
+		return 32, 14, nil
+	case "AEAD_AES_128_GCM":
+		return 16, 12, nil
+	case "AEAD_AES_256_GCM":
+		return 32, 12, nil
+	}
+	return 0, 0, fmt.Errorf("unsupported SRTP crypto suite: %s", suite)
+}
+
+// GenerateSRTPMasterKey creates a random master key and salt for a crypto suite
+func GenerateSRTPMasterKey(suite string) (key, salt []byte, err error) {
+	keyLen, saltLen, err := srtpKeyLengths(suite)
+	if err != nil {
+		return nil, nil, err
+	}
+	material := make([]byte, keyLen+saltLen)
+	if _, err := rand.Read(material); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate SRTP key: %w", err)
+	}
+	return material[:keyLen], material[keyLen:], nil
+}
+
+// InlineKey returns the SDES inline key-params (base64 of key || salt)
+func (p *SRTPParameters) InlineKey() string {
+	if len(p.MasterKey) == 0 {
+		return ""
+	}
+	material := make([]byte, 0, len(p.MasterKey)+len(p.MasterSalt))
+	material = append(material, p.MasterKey...)
+	material = append(material, p.MasterSalt...)
+	return base64.StdEncoding.EncodeToString(material)
+}
+
+// parseSDESInlineKey splits an SDES inline key into master key and salt
+func parseSDESInlineKey(suite, inline string) (key, salt []byte, err error) {
+	// Drop optional lifetime and MKI parameters
+	if i := strings.IndexByte(inline, '|'); i >= 0 {
+		inline = inline[:i]
+	}
+	material, err := base64.StdEncoding.DecodeString(inline)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid SDES inline key: %w", err)
+	}
+	keyLen, saltLen, err := srtpKeyLengths(suite)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(material) != keyLen+saltLen {
+		return nil, nil, fmt.Errorf("SDES key is %d bytes, expected %d", len(material), keyLen+saltLen)
+	}
+	return material[:keyLen], material[keyLen:], nil
+}
+
+// SRTPRekeyer rotates SRTP master keys of long-running calls. SDES legs get a
+// fresh key to advertise on the next offer/answer; DTLS legs are flagged so
+// the next offer/answer performs a new handshake and key export
+type SRTPRekeyer struct {
+	registry *SessionRegistry
+	interval time.Duration
+	onRekey  func(session *MediaSession, legs []*CallLeg)
+
+	stopChan chan struct{}
+	stopOnce sync.Once
+	mu       sync.RWMutex
+}
+
+// NewSRTPRekeyer creates a rekeyer; an interval of zero disables scheduled rotation
+func NewSRTPRekeyer(registry *SessionRegistry, interval time.Duration) *SRTPRekeyer {
+	return &SRTPRekeyer{
+		registry: registry,
+		interval: interval,
+		stopChan: make(chan struct{}),
+	}
+}
+
+// SetOnRekey sets a callback invoked after a session's keys are rotated
+func (r *SRTPRekeyer) SetOnRekey(callback func(session *MediaSession, legs []*CallLeg)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onRekey = callback
+}
+
+// Start begins scheduled rotation if an interval is configured
+func (r *SRTPRekeyer) Start() {
+	if r.interval <= 0 {
+		return
+	}
+	go r.rekeyLoop()
+}
+
+// Stop halts scheduled rotation
+func (r *SRTPRekeyer) Stop() {
+	r.stopOnce.Do(func() {
+		close(r.stopChan)
+	})
+}
+
+func (r *SRTPRekeyer) rekeyLoop() {
+	ticker := time.NewTicker(srtpRekeyCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if n := r.rekeyDueSessions(time.Now()); n > 0 {
+				log.Printf("Rotated SRTP keys for %d session(s)", n)
+			}
+		case <-r.stopChan:
+			return
+		}
+	}
+}
+
+// rekeyDueSessions rotates keys of active sessions whose keys are older than
+// the interval and returns how many sessions were rekeyed
+func (r *SRTPRekeyer) rekeyDueSessions(now time.Time) int {
+	count := 0
+	for _, session := range r.registry.ListSessions() {
+		session.RLock()
+		due := session.State == SessionStateActive && r.keysExpired(session, now)
+		session.RUnlock()
+
+		if due {
+			if err := r.rekey(session, now); err == nil {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// keysExpired reports whether any SRTP leg's key has outlived the interval.
+// Caller must hold the session lock
+func (r *SRTPRekeyer) keysExpired(session *MediaSession, now time.Time) bool {
+	for _, leg := range []*CallLeg{session.CallerLeg, session.CalleeLeg} {
+		if leg == nil || leg.SRTPParams == nil || leg.SRTPParams.RekeyPending {
+			continue
+		}
+		installed := leg.SRTPParams.RekeyedAt
+		if installed.IsZero() {
+			installed = session.CreatedAt
+		}
+		if now.Sub(installed) >= r.interval {
+			return true
+		}
+	}
+	return false
+}
+
+// RekeySession rotates the SRTP keys of a session on demand
+func (r *SRTPRekeyer) RekeySession(sessionID string) error {
+	session, ok := r.registry.GetSession(sessionID)
+	if !ok {
+		return fmt.Errorf("session not found: %s", sessionID)
+	}
+	return r.rekey(session, time.Now())
+}
+
+// rekey rotates every SRTP leg of a session
+func (r *SRTPRekeyer) rekey(session *MediaSession, now time.Time) error {
+	session.Lock()
+	var rekeyed []*CallLeg
+	var rekeyErr error
+	for _, leg := range []*CallLeg{session.CallerLeg, session.CalleeLeg} {
+		if leg == nil || leg.SRTPParams == nil {
+			continue
+		}
+		if err := rekeyLeg(leg.SRTPParams, now); err != nil {
+			rekeyErr = err
+			continue
+		}
+		rekeyed = append(rekeyed, leg)
+	}
+	if len(rekeyed) > 0 {
+		session.Flags[SRTPRekeyPendingFlag] = true
+		session.UpdatedAt = now
+	}
+	session.Unlock()
+
+	if len(rekeyed) == 0 {
+		if rekeyErr != nil {
+			return rekeyErr
+		}
+		return fmt.Errorf("session %s has no SRTP legs", session.ID)
+	}
+
+	r.mu.RLock()
+	callback := r.onRekey
+	r.mu.RUnlock()
+	if callback != nil {
+		callback(session, rekeyed)
+	}
+	return nil
+}
+
+// rekeyLeg installs a new key for an SDES leg or requests a new DTLS handshake
+func rekeyLeg(params *SRTPParameters, now time.Time) error {
+	method := "dtls"
+	if !params.DTLS {
+		key, salt, err := GenerateSRTPMasterKey(params.CryptoSuite)
+		if err != nil {
+			return err
+		}
+		params.MasterKey = key
+		params.MasterSalt = salt
+		method = "sdes"
+	}
+	params.KeyGeneration++
+	params.RekeyedAt = now
+	params.RekeyPending = true
+	srtpRekeysTotal.WithLabelValues(method).Inc()
+	return nil
+}
+
+// applyNegotiatedSRTP records the SRTP parameters of a leg from its SDP. A
+// pending rotation keeps Karl's new SDES key so it is advertised on this
+// offer/answer, which completes the re-key; it reports whether that happened
+func applyNegotiatedSRTP(leg *CallLeg, parsed *parsedSDPInfo) bool {
+	if !parsed.HasSRTP && !parsed.HasDTLS {
+		leg.SRTPParams = nil
+		return false
+	}
+
+	params := leg.SRTPParams
+	if params == nil {
+		params = &SRTPParameters{}
+		leg.SRTPParams = params
+	}
+
+	pending := params.RekeyPending
+	params.RekeyPending = false
+	params.DTLS = parsed.HasDTLS
+	params.Fingerprint = parsed.Fingerprint
+	params.Setup = parsed.Setup
+	params.CryptoSuite = parsed.CryptoSuite
+
+	if params.DTLS {
+		return false
+	}
+	if pending && len(params.MasterKey) > 0 {
+		return true
+	}
+	if key, salt, err := parseSDESInlineKey(parsed.CryptoSuite, parsed.CryptoKey); err == nil {
+		params.MasterKey = key
+		params.MasterSalt = salt
+	}
+	return false
+}
+
+// srtpRekeyPending reports whether any leg still waits to signal new keys.
+// Caller must hold the session lock
+func srtpRekeyPending(session *MediaSession) bool {
+	for _, leg := range []*CallLeg{session.CallerLeg, session.CalleeLeg} {
+		if leg != nil && leg.SRTPParams != nil && leg.SRTPParams.RekeyPending {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSDESInlineKey(t *testing.T) {
+	key, salt, err := GenerateSRTPMasterKey("AES_CM_128_HMAC_SHA1_80")
+	if err != nil {
+		t.Fatalf("GenerateSRTPMasterKey failed: %v", err)
+	}
+	params := &SRTPParameters{MasterKey: key, MasterSalt: salt}
+
+	gotKey, gotSalt, err := parseSDESInlineKey("AES_CM_128_HMAC_SHA1_80", params.InlineKey()+"|2^31|1:1")
+	if err != nil {
+		t.Fatalf("parseSDESInlineKey failed: %v", err)
+	}
+	if !bytes.Equal(gotKey, key) || !bytes.Equal(gotSalt, salt) {
+		t.Error("inline key did not round-trip")
+	}
+
+	if _, _, err := parseSDESInlineKey("AEAD_AES_256_GCM", params.InlineKey()); err == nil {
+		t.Error("expected length mismatch for a different suite")
+	}
+	if _, _, err := GenerateSRTPMasterKey("NULL_CIPHER"); err == nil {
+		t.Error("expected error for unsupported suite")
+	}
+}
+
+func TestSRTPRekeyer_ScheduledSDESRotation(t *testing.T) {
+	registry := NewSessionRegistry(time.Hour)
+	defer registry.Stop()
+
+	session := registry.CreateSession("rekey-call", "from-tag")
+	original := &SRTPParameters{CryptoSuite: "AES_CM_128_HMAC_SHA1_80"}
+	original.MasterKey, original.MasterSalt, _ = GenerateSRTPMasterKey(original.CryptoSuite)
+	oldKey := original.InlineKey()
+	if err := registry.SetCallerLeg(session.ID, &CallLeg{Tag: "from-tag", SRTPParams: original}); err != nil {
+		t.Fatalf("SetCallerLeg failed: %v", err)
+	}
+	if err := registry.SetCalleeLeg(session.ID, &CallLeg{Tag: "to-tag", SRTPParams: &SRTPParameters{DTLS: true}}); err != nil {
+		t.Fatalf("SetCalleeLeg failed: %v", err)
+	}
+	_ = registry.UpdateSessionState(session.ID, string(SessionStateActive))
+
+	rekeyer := NewSRTPRekeyer(registry, time.Minute)
+	var notified int
+	rekeyer.SetOnRekey(func(s *MediaSession, legs []*CallLeg) {
+		notified = len(legs)
+	})
+
+	if n := rekeyer.rekeyDueSessions(time.Now()); n != 0 {
+		t.Fatalf("expected no rotation before the interval, got %d", n)
+	}
+	if n := rekeyer.rekeyDueSessions(time.Now().Add(2 * time.Minute)); n != 1 {
+		t.Fatalf("expected one session rotated, got %d", n)
+	}
+	if notified != 2 {
+		t.Errorf("expected both legs reported, got %d", notified)
+	}
+	if original.InlineKey() == oldKey || original.KeyGeneration != 1 || !original.RekeyPending {
+		t.Errorf("expected a new pending SDES key, got %+v", original)
+	}
+	if !session.GetFlag(SRTPRekeyPendingFlag) {
+		t.Error("expected session to be flagged for re-INVITE")
+	}
+
+	// Pending legs are not rotated again before the re-INVITE
+	if n := rekeyer.rekeyDueSessions(time.Now().Add(time.Hour)); n != 0 {
+		t.Errorf("expected pending session to be skipped, got %d", n)
+	}
+}
+
+func TestNGSocketListener_ReInviteAdvertisesNewKey(t *testing.T) {
+	listener := &NGSocketListener{config: &Config{}}
+	registry := NewSessionRegistry(time.Hour)
+	defer registry.Stop()
+
+	remoteKey, remoteSalt, _ := GenerateSRTPMasterKey("AES_CM_128_HMAC_SHA1_80")
+	remoteInline := (&SRTPParameters{MasterKey: remoteKey, MasterSalt: remoteSalt}).InlineKey()
+	sdp := "v=0\r\n" +
+		"o=- 1 1 IN IP4 192.0.2.1\r\n" +
+		"s=-\r\n" +
+		"c=IN IP4 192.0.2.1\r\n" +
+		"t=0 0\r\n" +
+		"m=audio 5004 RTP/SAVP 0\r\n" +
+		"a=rtpmap:0 PCMU/8000\r\n" +
+		"a=crypto:1 AES_CM_128_HMAC_SHA1_80 inline:" + remoteInline + "\r\n"
+
+	session := registry.CreateSession("reinvite-call", "from-tag")
+	leg := &CallLeg{Tag: "from-tag"}
+	_ = registry.SetCallerLeg(session.ID, leg)
+
+	parsed, err := listener.parseSDP(sdp)
+	if err != nil {
+		t.Fatalf("parseSDP failed: %v", err)
+	}
+	listener.applyRemoteMedia(session, leg, parsed, nil)
+	if !bytes.Equal(leg.SRTPParams.MasterKey, remoteKey) {
+		t.Fatal("expected the offered SDES key to be recorded")
+	}
+
+	rekeyer := NewSRTPRekeyer(registry, 0)
+	if err := rekeyer.RekeySession(session.ID); err != nil {
+		t.Fatalf("RekeySession failed: %v", err)
+	}
+	newInline := leg.SRTPParams.InlineKey()
+
+	// The re-INVITE still carries the old key; Karl answers with the new one
+	parsed, _ = listener.parseSDP(sdp)
+	listener.applyRemoteMedia(session, leg, parsed, nil)
+	leg.LocalPort = 30000
+	response := listener.buildResponseSDP(parsed, leg, "198.51.100.1", nil, false, nil)
+	if !strings.Contains(response, "inline:"+newInline) {
+		t.Errorf("expected response to advertise the rotated key, got:\n%s", response)
+	}
+	if leg.SRTPParams.RekeyPending || session.GetFlag(SRTPRekeyPendingFlag) {
+		t.Error("expected pending rekey to be cleared by the re-INVITE")
+	}
+}
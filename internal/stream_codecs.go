@@ -0,0 +1,175 @@
+package internal
+
+import "sync"
+
+// StreamCodecs holds the stateful codec instances of one media stream, so
+// concurrent streams do not share encoder history or the bitrate and loss
+// the stream's receiver reported. A nil *StreamCodecs uses the shared
+// instances of EncodeToOpus and DecodeToPCM
+type StreamCodecs struct {
+	opusEncoder *OpusEncoder
+	opusDecoder *OpusDecoder
+
+	mu         sync.Mutex
+	resamplers map[[2]int]*resampler // by [from, to] rate
+	encoders   map[CodecInfo]audioEncoder
+	decoders   map[CodecInfo]audioDecoder
+}
+
+// NewStreamCodecs creates the codec instances for a stream
+func NewStreamCodecs() *StreamCodecs {
+	return &StreamCodecs{
+		opusEncoder: NewOpusEncoder(),
+		opusDecoder: NewOpusDecoder(),
+	}
+}
+
+// OpusEncoder returns the stream's Opus encoder
+func (s *StreamCodecs) OpusEncoder() *OpusEncoder {
+	if s == nil {
+		return GetOpusEncoder()
+	}
+	return s.opusEncoder
+}
+
+// OpusDecoder returns the stream's Opus decoder
+func (s *StreamCodecs) OpusDecoder() *OpusDecoder {
+	if s == nil {
+		return GetOpusDecoder()
+	}
+	return s.opusDecoder
+}
+
+// resample converts a frame of the stream between sample rates, carrying
+// the filter history over from its previous frame at the same rates. A nil
+// *StreamCodecs converts each frame on its own
+func (s *StreamCodecs) resample(samples []int16, from, to int) []int16 {
+	if from == to || from <= 0 || to <= 0 || len(samples) == 0 {
+		return samples
+	}
+	if s == nil {
+		return resamplePCM(samples, from, to)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := [2]int{from, to}
+	r, ok := s.resamplers[key]
+	if !ok {
+		if s.resamplers == nil {
+			s.resamplers = make(map[[2]int]*resampler)
+		}
+		r = newResampler(from, to)
+		s.resamplers[key] = r
+	}
+	return r.resample(samples)
+}
+
+// encodeNative encodes a frame of the stream with a native codec, keeping
+// the encoder for the stream's next frame. A nil *StreamCodecs encodes each
+// frame with a new encoder
+func (s *StreamCodecs) encodeNative(native nativeAudioCodec, codec CodecInfo, pcm []int16) ([]byte, error) {
+	if s == nil {
+		enc, err := native.newEncoder(codec)
+		if err != nil {
+			return nil, err
+		}
+		defer enc.Close()
+		return enc.Encode(pcm)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	enc, ok := s.encoders[codec]
+	if !ok {
+		var err error
+		if enc, err = native.newEncoder(codec); err != nil {
+			return nil, err
+		}
+		if s.encoders == nil {
+			s.encoders = make(map[CodecInfo]audioEncoder)
+		}
+		s.encoders[codec] = enc
+	}
+	return enc.Encode(pcm)
+}
+
+// decodeNative is encodeNative for decoding a payload
+func (s *StreamCodecs) decodeNative(native nativeAudioCodec, codec CodecInfo, payload []byte) ([]int16, error) {
+	if s == nil {
+		dec, err := native.newDecoder(codec)
+		if err != nil {
+			return nil, err
+		}
+		defer dec.Close()
+		return dec.Decode(payload)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dec, ok := s.decoders[codec]
+	if !ok {
+		var err error
+		if dec, err = native.newDecoder(codec); err != nil {
+			return nil, err
+		}
+		if s.decoders == nil {
+			s.decoders = make(map[CodecInfo]audioDecoder)
+		}
+		s.decoders[codec] = dec
+	}
+	return dec.Decode(payload)
+}
+
+// close releases the stream's native codecs
+func (s *StreamCodecs) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for codec, enc := range s.encoders {
+		enc.Close()
+		delete(s.encoders, codec)
+	}
+	for codec, dec := range s.decoders {
+		dec.Close()
+		delete(s.decoders, codec)
+	}
+}
+
+var (
+	streamCodecsMu sync.Mutex
+	streamCodecs   = make(map[uint32]*StreamCodecs)
+)
+
+// getStreamCodecs returns the codec instances of an SSRC, creating them on
+// its first packet
+func getStreamCodecs(ssrc uint32) *StreamCodecs {
+	streamCodecsMu.Lock()
+	defer streamCodecsMu.Unlock()
+
+	s, ok := streamCodecs[ssrc]
+	if !ok {
+		s = NewStreamCodecs()
+		streamCodecs[ssrc] = s
+	}
+	return s
+}
+
+// lookupStreamCodecs returns the codec instances of an SSRC if it has sent
+// a packet that was transcoded
+func lookupStreamCodecs(ssrc uint32) (*StreamCodecs, bool) {
+	streamCodecsMu.Lock()
+	defer streamCodecsMu.Unlock()
+	s, ok := streamCodecs[ssrc]
+	return s, ok
+}
+
+// RemoveStreamCodecs releases the codec instances kept for an SSRC
+func RemoveStreamCodecs(ssrc uint32) {
+	streamCodecsMu.Lock()
+	s, ok := streamCodecs[ssrc]
+	delete(streamCodecs, ssrc)
+	streamCodecsMu.Unlock()
+	if ok {
+		s.close()
+	}
+}
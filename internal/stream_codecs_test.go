@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestStreamCodecs_Lifecycle(t *testing.T) {
+	n := GetCodecNegotiator()
+	n.SetOfferCodecs("codecs-call", []CodecInfo{{PayloadType: 0, Name: "PCMU", ClockRate: 8000}})
+	n.SetAnswerCodecs("codecs-call", []CodecInfo{{PayloadType: 111, Name: "opus", ClockRate: 48000, Channels: 2}})
+	n.BindSSRC(0x5C01, "codecs-call", true)
+	n.BindSSRC(0x5C02, "codecs-call", true)
+	defer n.RemoveCall("codecs-call")
+
+	if _, ok := lookupStreamCodecs(0x5C01); ok {
+		t.Fatal("expected no codecs before the first packet")
+	}
+	payload := encodeG711("PCMU", resamplerTone(440, 8000, 160))
+	for _, ssrc := range []uint32{0x5C01, 0x5C02} {
+		packet := &RTPPacket{SSRC: ssrc, PayloadType: 0, Payload: payload}
+		if err := TranscodeRTPPacket(packet); err != nil || packet.PayloadType != 111 {
+			t.Fatalf("expected PCMU to be transcoded to Opus: %v", err)
+		}
+	}
+
+	first, ok1 := lookupStreamCodecs(0x5C01)
+	second, ok2 := lookupStreamCodecs(0x5C02)
+	if !ok1 || !ok2 {
+		t.Fatal("expected each stream to get codecs on its first packet")
+	}
+	if first.OpusEncoder() == second.OpusEncoder() || first.OpusEncoder() == GetOpusEncoder() {
+		t.Error("expected each stream to have its own Opus encoder")
+	}
+
+	// Loss reported for one stream does not change another's encoder
+	GetRTCPFeedbackHandler(0x5C01).HandleFeedback(20, 0, 0)
+	defer RemoveRTCPFeedbackHandler(0x5C01)
+	if first.OpusEncoder().packetLoss != 20 || second.OpusEncoder().packetLoss != 0 {
+		t.Errorf("expected loss on the reported stream only, got %d and %d",
+			first.OpusEncoder().packetLoss, second.OpusEncoder().packetLoss)
+	}
+
+	n.RemoveCall("codecs-call")
+	if _, ok := lookupStreamCodecs(0x5C01); ok {
+		t.Error("expected the codecs to be released with the call")
+	}
+}
+
+func TestStreamCodecs_Concurrent(t *testing.T) {
+	tone := monoToStereo(resamplerTone(440, opusSampleRate, opusFrameSize))
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(codecs *StreamCodecs) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				frame, err := codecs.OpusEncoder().Encode(tone, OpusOptions{FEC: true})
+				if err == nil {
+					_, err = codecs.OpusDecoder().Decode(frame)
+				}
+				if err != nil {
+					t.Errorf("stream codec failed: %v", err)
+					return
+				}
+			}
+		}(NewStreamCodecs())
+	}
+	wg.Wait()
+
+	var shared *StreamCodecs
+	if shared.OpusEncoder() != GetOpusEncoder() || shared.OpusDecoder() != GetOpusDecoder() {
+		t.Error("expected nil codecs to use the shared instances")
+	}
+}
@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+const (
+	// defaultSTUNPort is used when a STUN server is given without a port
+	defaultSTUNPort = "3478"
+
+	// stunTimeout bounds a single discovery request
+	stunTimeout = 3 * time.Second
+
+	// DefaultSTUNRefresh is how often advertised addresses are rediscovered
+	DefaultSTUNRefresh = 5 * time.Minute
+)
+
+// DiscoverPublicIP asks a STUN server for the address a binding request
+// from localAddr is seen as, which is the public address of a node behind
+// NAT. The server may be written as host, host:port or a stun: URI, and an
+// empty localAddr binds to any local address
+func DiscoverPublicIP(server, localAddr string, timeout time.Duration) (net.IP, error) {
+	server = strings.TrimPrefix(server, "stun:")
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, defaultSTUNPort)
+	}
+	raddr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve STUN server %s: %w", server, err)
+	}
+
+	var laddr *net.UDPAddr
+	if localAddr != "" {
+		laddr = &net.UDPAddr{IP: net.ParseIP(localAddr)}
+	}
+	conn, err := net.DialUDP("udp", laddr, raddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach STUN server %s: %w", server, err)
+	}
+	defer conn.Close()
+
+	req, err := stun.Build(stun.TransactionID, stun.BindingRequest, stun.Fingerprint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build STUN request: %w", err)
+	}
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(req.Raw); err != nil {
+		return nil, fmt.Errorf("failed to send STUN request: %w", err)
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, fmt.Errorf("no STUN response from %s: %w", server, err)
+		}
+
+		res := &stun.Message{Raw: append([]byte(nil), buf[:n]...)}
+		if err := res.Decode(); err != nil || res.TransactionID != req.TransactionID {
+			continue
+		}
+		if res.Type != stun.BindingSuccess {
+			return nil, fmt.Errorf("STUN server %s answered %s", server, res.Type)
+		}
+
+		var xorAddr stun.XORMappedAddress
+		if err := xorAddr.GetFrom(res); err == nil {
+			return xorAddr.IP, nil
+		}
+		var mapped stun.MappedAddress
+		if err := mapped.GetFrom(res); err == nil {
+			return mapped.IP, nil
+		}
+		return nil, fmt.Errorf("STUN response from %s has no mapped address", server)
+	}
+}
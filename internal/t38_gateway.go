@@ -3,8 +3,12 @@ package internal
 import (
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/pion/sdp/v3"
 )
 
 // T38Gateway handles T.38 fax passthrough and gateway functionality
@@ -54,6 +58,10 @@ const (
 	T38StateActive    T38State = "active"
 	T38StateComplete  T38State = "complete"
 	T38StateFailed    T38State = "failed"
+
+	// T38StatePassThrough means T.38 was declined and the fax continues as
+	// G.711 audio
+	T38StatePassThrough T38State = "g711-passthrough"
 )
 
 // T38Direction represents the T.38 direction
@@ -365,14 +373,139 @@ func BuildT38SDP(config *T38Config, localIP string, localPort int) string {
 	return sdp
 }
 
-// ParseT38SDP parses T.38 attributes from SDP
-func ParseT38SDP(sdp string) *T38Config {
+// ParseT38SDP parses T.38 attributes from SDP. Attributes that are absent
+// or malformed keep their defaults.
+func ParseT38SDP(raw string) *T38Config {
+	desc, err := ParseSDP(raw)
+	if err != nil {
+		return DefaultT38Config()
+	}
+	for _, media := range desc.MediaDescriptions {
+		if IsT38Media(media) {
+			return T38ConfigFromMedia(media)
+		}
+	}
+	return DefaultT38Config()
+}
+
+// IsT38Media reports whether an m= section offers T.38 over UDPTL
+func IsT38Media(media *sdp.MediaDescription) bool {
+	if media.MediaName.Media != "image" || !strings.EqualFold(SDPProtocol(media), "udptl") {
+		return false
+	}
+	for _, format := range media.MediaName.Formats {
+		if strings.EqualFold(format, "t38") {
+			return true
+		}
+	}
+	return false
+}
+
+// T38ConfigFromMedia reads the T.38 attributes of an m=image section
+func T38ConfigFromMedia(media *sdp.MediaDescription) *T38Config {
 	config := DefaultT38Config()
-	// Basic parsing would be implemented here
-	// For now return default config
+	config.FillBitRemoval = false
+	for _, a := range media.Attributes {
+		// Attribute names are case-insensitive (ITU-T T.38 Annex D)
+		switch strings.ToLower(a.Key) {
+		case "t38maxbitrate":
+			if v, err := strconv.Atoi(strings.TrimSpace(a.Value)); err == nil {
+				config.MaxBitRate = v
+			}
+		case "t38faxratemanagement":
+			config.RateMgmt = strings.TrimSpace(a.Value)
+		case "t38faxmaxbuffer":
+			if v, err := strconv.Atoi(strings.TrimSpace(a.Value)); err == nil {
+				config.MaxBuffer = v
+			}
+		case "t38faxudpec":
+			config.UDPECMode = strings.TrimSpace(a.Value)
+		case "t38faxfillbitremoval":
+			config.FillBitRemoval = a.Value == "" || a.Value == "1"
+		case "t38faxtranscodingmmr":
+			config.TranscodingMMR = a.Value == "" || a.Value == "1"
+		case "t38faxtranscodingjbig":
+			config.TranscodingJBIG = a.Value == "" || a.Value == "1"
+		}
+	}
 	return config
 }
 
+// NewT38FallbackMedia builds the G.711 audio section that replaces a T.38
+// offer when the other side cannot do T.38. Silence suppression is turned
+// off so fax tones pass unmodified.
+func NewT38FallbackMedia(port int, codecs []CodecInfo) *sdp.MediaDescription {
+	g711 := make([]CodecInfo, 0, 2)
+	for _, c := range codecs {
+		if c.Name == "PCMU" || c.Name == "PCMA" {
+			g711 = append(g711, c)
+		}
+	}
+	if len(g711) == 0 {
+		g711 = append(g711, staticPayloadTypes[0], staticPayloadTypes[8])
+	}
+
+	media := NewSDPMedia("audio", port, "RTP/AVP", g711)
+	media.WithValueAttribute("ptime", "20")
+	media.WithValueAttribute("silenceSupp", "off - - - -")
+	media.WithPropertyAttribute(SDPDirectionSendRecv)
+	return media
+}
+
+// SetState moves a T.38 session to a new state
+func (gw *T38Gateway) SetState(sessionID string, state T38State) error {
+	gw.mu.RLock()
+	session, exists := gw.sessions[sessionID]
+	gw.mu.RUnlock()
+
+	if !exists {
+		return fmt.Errorf("T.38 session not found: %s", sessionID)
+	}
+
+	session.mu.Lock()
+	session.State = state
+	session.LastActivity = time.Now()
+	session.mu.Unlock()
+	return nil
+}
+
+// GetState returns the session state
+func (s *T38Session) GetState() T38State {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.State
+}
+
+// setConfig records the T.38 parameters negotiated in SDP
+func (s *T38Session) setConfig(config *T38Config) {
+	s.mu.Lock()
+	s.Config = config
+	s.mu.Unlock()
+}
+
+// Info describes a T.38 session for the control protocol
+func (s *T38Session) Info() map[string]interface{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	info := map[string]interface{}{
+		"id":          s.ID,
+		"state":       string(s.State),
+		"local-port":  s.LocalPort,
+		"max-bitrate": s.Config.MaxBitRate,
+		"udp-ec":      s.Config.UDPECMode,
+		"packets": map[string]interface{}{
+			"sent":     s.Stats.PacketsSent,
+			"received": s.Stats.PacketsRecv,
+		},
+		"errors": s.Stats.Errors,
+	}
+	if s.RemoteIP != nil {
+		info["remote"] = net.JoinHostPort(s.RemoteIP.String(), strconv.Itoa(s.RemotePort))
+	}
+	return info
+}
+
 // Cleanup removes old completed sessions
 func (gw *T38Gateway) Cleanup(maxAge time.Duration) int {
 	gw.mu.Lock()
@@ -2,9 +2,12 @@ package internal
 
 import (
 	"net"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
+
+	ng "karl/internal/ng_protocol"
 )
 
 func TestDefaultT38Config(t *testing.T) {
@@ -475,3 +478,121 @@ func TestT38IFPType_Constants(t *testing.T) {
 		t.Error("T38IFPControlData should be 8")
 	}
 }
+
+const t38ReInviteSDP = "v=0\r\n" +
+	"o=gw 100 101 IN IP4 192.0.2.20\r\n" +
+	"s=-\r\n" +
+	"c=IN IP4 192.0.2.20\r\n" +
+	"t=0 0\r\n" +
+	"m=image 40000 udptl t38\r\n" +
+	"a=T38FaxVersion:0\r\n" +
+	"a=T38MaxBitRate:9600\r\n" +
+	"a=T38FaxRateManagement:localTCF\r\n" +
+	"a=T38FaxMaxBuffer:262\r\n" +
+	"a=T38FaxUdpEC:t38UDPFEC\r\n"
+
+func TestParseT38SDP_Attributes(t *testing.T) {
+	config := ParseT38SDP(t38ReInviteSDP)
+	if config.MaxBitRate != 9600 || config.RateMgmt != "localTCF" || config.MaxBuffer != 262 {
+		t.Errorf("unexpected T.38 parameters %+v", config)
+	}
+	if config.UDPECMode != "t38UDPFEC" || config.FillBitRemoval {
+		t.Errorf("unexpected error correction or fill bit removal %+v", config)
+	}
+}
+
+func newT38TestListener(t *testing.T) *NGSocketListener {
+	t.Helper()
+	manager, registry, _ := newTestSessionManager(t)
+	return &NGSocketListener{
+		sessionRegistry: registry,
+		sessionManager:  manager,
+		config:          &Config{},
+		t38Gateway:      NewT38Gateway(nil),
+	}
+}
+
+func TestNGSocketListener_T38PassThrough(t *testing.T) {
+	l := newT38TestListener(t)
+	offer := func(sdp string) {
+		t.Helper()
+		resp, err := l.handleOffer(&ng.NGRequest{CallID: "fax-call", FromTag: "from-tag", SDP: sdp})
+		if err != nil || resp.Result != ng.ResultOK {
+			t.Fatalf("handleOffer failed: %v %+v", err, resp)
+		}
+	}
+
+	offer(sipOfferSDP)
+	if faxes := l.t38Gateway.GetSessionByCallID("fax-call"); len(faxes) != 0 {
+		t.Fatalf("expected no fax session for an audio call, got %d", len(faxes))
+	}
+
+	// Re-INVITE to T.38 starts a fax session
+	offer(t38ReInviteSDP)
+	fax := l.currentT38Session("fax-call")
+	if fax == nil || fax.GetState() != T38StateSetup || fax.Config.MaxBitRate != 9600 {
+		t.Fatalf("expected a fax session in setup, got %+v", fax)
+	}
+
+	answer := strings.Replace(t38ReInviteSDP, "192.0.2.20", "192.0.2.30", -1)
+	resp, err := l.handleAnswer(&ng.NGRequest{CallID: "fax-call", FromTag: "from-tag", ToTag: "to-tag", SDP: answer})
+	if err != nil || resp.Result != ng.ResultOK {
+		t.Fatalf("handleAnswer failed: %v %+v", err, resp)
+	}
+	if !strings.Contains(resp.SDP, "m=image ") || !strings.Contains(resp.SDP, " udptl t38\r\n") {
+		t.Errorf("expected the T.38 answer to be relayed:\n%s", resp.SDP)
+	}
+	if fax.GetState() != T38StateActive || fax.RemotePort != 40000 || !fax.RemoteIP.Equal(net.ParseIP("192.0.2.30")) {
+		t.Errorf("expected an active fax session towards the answerer, got %s", fax.GetState())
+	}
+
+	query, _ := l.handleQuery(&ng.NGRequest{CallID: "fax-call"})
+	t38, ok := query.Extra["t38"].([]interface{})
+	if !ok || len(t38) != 1 || t38[0].(map[string]interface{})["state"] != string(T38StateActive) {
+		t.Errorf("expected the query to report the fax session, got %+v", query.Extra)
+	}
+
+	// Switching back to audio ends the fax
+	offer(sipOfferSDP)
+	if fax.GetState() != T38StateComplete {
+		t.Errorf("expected the fax session to complete, got %s", fax.GetState())
+	}
+}
+
+func TestNGSocketListener_T38GatewayFallback(t *testing.T) {
+	l := newT38TestListener(t)
+	flags := []string{"T.38-gateway"}
+
+	first, _ := l.handleOffer(&ng.NGRequest{CallID: "gw-call", FromTag: "from-tag", SDP: sipOfferSDP, Flags: flags})
+	audioPort := first.Streams[0].LocalPort
+
+	resp, err := l.handleOffer(&ng.NGRequest{CallID: "gw-call", FromTag: "from-tag", SDP: t38ReInviteSDP, Flags: flags})
+	if err != nil || resp.Result != ng.ResultOK {
+		t.Fatalf("handleOffer failed: %v %+v", err, resp)
+	}
+	for _, line := range []string{
+		"m=audio " + strconv.Itoa(audioPort) + " RTP/AVP 0",
+		"a=silenceSupp:off - - - -",
+	} {
+		if !strings.Contains(resp.SDP, line) {
+			t.Errorf("expected %q in the G.711 offer:\n%s", line, resp.SDP)
+		}
+	}
+	if strings.Contains(resp.SDP, "m=image") || strings.Contains(resp.SDP, "telephone-event") {
+		t.Errorf("expected T.38 and non-G.711 codecs to be removed:\n%s", resp.SDP)
+	}
+
+	answer := strings.Replace(sipOfferSDP, "192.0.2.10", "192.0.2.30", -1)
+	resp, err = l.handleAnswer(&ng.NGRequest{CallID: "gw-call", FromTag: "from-tag", ToTag: "to-tag", SDP: answer, Flags: flags})
+	if err != nil || resp.Result != ng.ResultOK {
+		t.Fatalf("handleAnswer failed: %v %+v", err, resp)
+	}
+	if !strings.Contains(resp.SDP, "m=image 0 udptl t38\r\n") {
+		t.Errorf("expected T.38 to be declined towards the offerer:\n%s", resp.SDP)
+	}
+
+	fax := l.currentT38Session("gw-call")
+	if fax == nil || fax.GetState() != T38StatePassThrough {
+		t.Errorf("expected a G.711 pass-through fax session, got %+v", fax)
+	}
+}
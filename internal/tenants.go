@@ -0,0 +1,404 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Tenants let SaaS operators run many customers through one media layer.
+// An offer names its tenant with the NG protocol's tenant key; the call
+// then takes its media ports from the tenant's range, has the tenant's
+// codec policy applied to its SDP, is recorded with the tenant's settings
+// into the tenant's directory, counts towards the tenant's offer rate, and
+// shows up in metrics under the tenant's label.
+
+// TenantMetadataKey names the tenant in the metadata of a call's recording
+const TenantMetadataKey = "tenant"
+
+// Tenant metrics, labelled with each tenant's metrics label
+var (
+	tenantSessions = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "karl_tenant_sessions",
+			Help: "Sessions of each tenant",
+		},
+		[]string{"tenant"},
+	)
+
+	tenantOffers = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "karl_tenant_offers_total",
+			Help: "Offers for new calls of each tenant, by result",
+		},
+		[]string{"tenant", "result"},
+	)
+)
+
+var (
+	// ErrUnknownTenant is returned for an offer naming a tenant that is not
+	// configured
+	ErrUnknownTenant = errors.New("unknown tenant")
+	// ErrTenantOfferRate is returned for an offer beyond its tenant's rate
+	ErrTenantOfferRate = errors.New("tenant offer rate exceeded")
+	// ErrTenantRecordingDisabled is returned when recording a call of a
+	// tenant whose calls are not recorded
+	ErrTenantRecordingDisabled = errors.New("recording is disabled for the tenant")
+)
+
+// tenantNamePattern restricts tenant names to what is safe in a file path
+// and a metrics label
+var tenantNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.@-]*$`)
+
+// Tenant is a configured tenant
+type Tenant struct {
+	Name   string
+	Config *TenantConfig
+	offers *TokenBucket // nil without an offer rate
+}
+
+// tenantSet is the configured tenants
+type tenantSet struct {
+	tenants     map[string]*Tenant
+	defaultName string
+}
+
+var tenants atomic.Pointer[tenantSet]
+
+// tenantSession is the tenant a session counts towards
+type tenantSession struct {
+	name  string
+	label string
+}
+
+// ConfigureTenants sets the tenants calls may belong to; nil removes them.
+// Calls that already have a tenant keep its port range
+func ConfigureTenants(config *TenantsConfig) {
+	set := &tenantSet{tenants: make(map[string]*Tenant)}
+	if config != nil {
+		set.defaultName = config.Default
+		for name, c := range config.Tenants {
+			if c == nil {
+				c = &TenantConfig{}
+			}
+			t := &Tenant{Name: name, Config: c}
+			if c.OfferRate > 0 {
+				t.offers = NewTokenBucket(float64(c.OfferRate), float64(c.OfferRate))
+			}
+			set.tenants[name] = t
+		}
+	}
+	tenants.Store(set)
+}
+
+// LookupTenant returns the tenant of an offer naming name, the default
+// tenant for an empty name. It returns nil without an error when the offer
+// belongs to no tenant
+func LookupTenant(name string) (*Tenant, error) {
+	set := tenants.Load()
+	if name == "" {
+		if set == nil || set.defaultName == "" {
+			return nil, nil
+		}
+		name = set.defaultName
+	}
+	if set != nil {
+		if t, ok := set.tenants[name]; ok {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownTenant, name)
+}
+
+// ListTenants returns the configured tenants by name
+func ListTenants() []*Tenant {
+	set := tenants.Load()
+	if set == nil {
+		return nil
+	}
+	list := make([]*Tenant, 0, len(set.tenants))
+	for _, t := range set.tenants {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// SessionTenant returns the tenant of a call, nil when it has none or its
+// tenant is no longer configured
+func SessionTenant(session *MediaSession) *Tenant {
+	session.RLock()
+	name := session.Tenant
+	session.RUnlock()
+	if name == "" {
+		return nil
+	}
+	t, err := LookupTenant(name)
+	if err != nil {
+		return nil
+	}
+	return t
+}
+
+// Label returns the value of the tenant label of the tenant's metrics
+func (t *Tenant) Label() string {
+	if t.Config.MetricsLabel != "" {
+		return t.Config.MetricsLabel
+	}
+	return t.Name
+}
+
+// AllowOffer reports whether an offer for a new call is within the
+// tenant's offer rate, and counts it
+func (t *Tenant) AllowOffer() bool {
+	if t.offers != nil && !t.offers.Allow() {
+		tenantOffers.WithLabelValues(t.Label(), "rate_limited").Inc()
+		return false
+	}
+	tenantOffers.WithLabelValues(t.Label(), "accepted").Inc()
+	return true
+}
+
+// Flags returns the flags of an offer with the tenant's codec policy in
+// front of them. The policy works like the codec-strip, codec-except and
+// codec-transcode flags, which the offer may add to
+func (t *Tenant) Flags(flags []string) []string {
+	c := t.Config
+	if len(c.StripCodecs) == 0 && len(c.AllowCodecs) == 0 && len(c.TranscodeCodecs) == 0 {
+		return flags
+	}
+	policy := make([]string, 0, len(c.StripCodecs)+len(c.AllowCodecs)+len(c.TranscodeCodecs)+1+len(flags))
+	for _, name := range c.StripCodecs {
+		policy = append(policy, "codec-strip="+name)
+	}
+	if len(c.AllowCodecs) > 0 {
+		policy = append(policy, "codec-strip-all")
+		for _, name := range c.AllowCodecs {
+			policy = append(policy, "codec-except="+name)
+		}
+	}
+	for _, name := range c.TranscodeCodecs {
+		policy = append(policy, "codec-transcode="+name)
+	}
+	return append(policy, flags...)
+}
+
+// RecordingOptions returns the options of a recording of one of the
+// tenant's calls: the tenant's format and mode unless opts sets them, and
+// the tenant in its metadata, which places the files in the tenant's
+// directory
+func (t *Tenant) RecordingOptions(opts CallRecordingOptions) (CallRecordingOptions, error) {
+	if r := t.Config.Recording; r != nil {
+		if r.Disabled {
+			return opts, ErrTenantRecordingDisabled
+		}
+		if opts.Format == "" {
+			opts.Format = r.Format
+		}
+		if opts.Mode == "" {
+			opts.Mode = r.Mode
+		}
+	}
+	metadata := make(map[string]string, len(opts.Metadata)+1)
+	for k, v := range opts.Metadata {
+		metadata[k] = v
+	}
+	metadata[TenantMetadataKey] = t.Name
+	opts.Metadata = metadata
+	return opts, nil
+}
+
+// autoRecords reports whether every answered call of the tenant is recorded
+func (t *Tenant) autoRecords() bool {
+	r := t.Config.Recording
+	return r != nil && r.AutoStart && !r.Disabled
+}
+
+// portRange returns the tenant's own media port range, if it has one
+func (t *Tenant) portRange() (minPort, maxPort int, ok bool) {
+	if t.Config.MinPort == 0 && t.Config.MaxPort == 0 {
+		return 0, 0, false
+	}
+	return t.Config.MinPort, t.Config.MaxPort, true
+}
+
+// AssignTenant makes a new session a call of a tenant: its ports come from
+// the tenant's range, if it has one, and it counts towards the tenant's
+// sessions until it is removed
+func (m *SessionManager) AssignTenant(session *MediaSession, tenant *Tenant) {
+	session.Lock()
+	session.Tenant = tenant.Name
+	session.Unlock()
+
+	m.tenantMu.Lock()
+	defer m.tenantMu.Unlock()
+
+	if _, ok := m.tenantSessions[session.ID]; ok {
+		return
+	}
+	if m.tenantSessions == nil {
+		m.tenantSessions = make(map[string]tenantSession)
+		m.tenantCounts = make(map[string]int)
+		m.tenantPools = make(map[[2]int]*PortAllocator)
+		m.sessionPools = make(map[string]*PortAllocator)
+	}
+	label := tenant.Label()
+	m.tenantSessions[session.ID] = tenantSession{name: tenant.Name, label: label}
+	m.tenantCounts[tenant.Name]++
+	tenantSessions.WithLabelValues(label).Inc()
+
+	minPort, maxPort, ok := tenant.portRange()
+	if !ok {
+		return
+	}
+	key := [2]int{minPort, maxPort}
+	pool := m.tenantPools[key]
+	if pool == nil {
+		pool = NewPortAllocator(PortAllocatorConfigFromSessions(&SessionConfig{
+			MinPort:        minPort,
+			MaxPort:        maxPort,
+			PortReuseDelay: int(m.allocator.config.ReuseDelay / time.Millisecond),
+		}))
+		m.tenantPools[key] = pool
+		log.Printf("Opened the port range %d-%d of tenant %s", minPort, maxPort, tenant.Name)
+	}
+	m.sessionPools[session.ID] = pool
+}
+
+// tenantSessionCount returns the number of calls of a tenant
+func (m *SessionManager) tenantSessionCount(name string) int {
+	m.tenantMu.Lock()
+	defer m.tenantMu.Unlock()
+	return m.tenantCounts[name]
+}
+
+// portPool returns the port allocator of a session: its tenant's range,
+// or the sessions' range
+func (m *SessionManager) portPool(sessionID string) *PortAllocator {
+	m.tenantMu.Lock()
+	defer m.tenantMu.Unlock()
+
+	if pool, ok := m.sessionPools[sessionID]; ok {
+		return pool
+	}
+	return m.allocator
+}
+
+// releaseTenant stops counting a removed session towards its tenant
+func (m *SessionManager) releaseTenant(sessionID string) {
+	m.tenantMu.Lock()
+	defer m.tenantMu.Unlock()
+
+	if ts, ok := m.tenantSessions[sessionID]; ok {
+		tenantSessions.WithLabelValues(ts.label).Dec()
+		delete(m.tenantSessions, sessionID)
+		if m.tenantCounts[ts.name]--; m.tenantCounts[ts.name] <= 0 {
+			delete(m.tenantCounts, ts.name)
+		}
+	}
+	delete(m.sessionPools, sessionID)
+}
+
+// tenantPortsInUse returns the ports allocated from tenants' ranges
+func (m *SessionManager) tenantPortsInUse() int64 {
+	m.tenantMu.Lock()
+	defer m.tenantMu.Unlock()
+
+	var inUse int64
+	for _, pool := range m.tenantPools {
+		inUse += pool.currentInUse.Load()
+	}
+	return inUse
+}
+
+// closeTenantPools closes the port allocators of tenants' ranges and the
+// media ports bound from them
+func (m *SessionManager) closeTenantPools() {
+	m.tenantMu.Lock()
+	defer m.tenantMu.Unlock()
+
+	for key, pool := range m.tenantPools {
+		pool.Close()
+		delete(m.tenantPools, key)
+	}
+}
+
+// ValidateTenantsConfig checks the tenants: their names, a default that
+// exists, port ranges that stay out of the sessions' range and of each
+// other, and recording settings the recorder knows
+func ValidateTenantsConfig(cfg *Config) error {
+	c := cfg.Tenants
+	if c.Default != "" {
+		if _, ok := c.Tenants[c.Default]; !ok {
+			return fmt.Errorf("tenants.default %q is not a configured tenant", c.Default)
+		}
+	}
+
+	sc := PortAllocatorConfigFromSessions(cfg.GetSessionConfig())
+	names := make([]string, 0, len(c.Tenants))
+	for name := range c.Tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ranges := make(map[string][2]int)
+	for _, name := range names {
+		t := c.Tenants[name]
+		if !tenantNamePattern.MatchString(name) {
+			return fmt.Errorf("tenant name %q may only hold letters, digits and _.@-", name)
+		}
+		if t == nil {
+			continue
+		}
+		if t.OfferRate < 0 {
+			return fmt.Errorf("tenants.%s.offer_rate must not be negative", name)
+		}
+		if t.MaxSessions < 0 {
+			return fmt.Errorf("tenants.%s.max_sessions must not be negative", name)
+		}
+		for _, codecs := range [][]string{t.StripCodecs, t.AllowCodecs, t.TranscodeCodecs} {
+			for _, codec := range codecs {
+				if codec == "" {
+					return fmt.Errorf("tenants.%s has an empty codec name", name)
+				}
+			}
+		}
+		if r := t.Recording; r != nil {
+			switch r.Format {
+			case "", "wav", "pcm", "opus":
+			default:
+				return fmt.Errorf("tenants.%s.recording.format %q must be wav, pcm or opus", name, r.Format)
+			}
+			switch r.Mode {
+			case "", "mixed", "stereo", "separate":
+			default:
+				return fmt.Errorf("tenants.%s.recording.mode %q must be mixed, stereo or separate", name, r.Mode)
+			}
+		}
+
+		if t.MinPort == 0 && t.MaxPort == 0 {
+			continue
+		}
+		if t.MinPort < 1024 || t.MaxPort > 65535 || t.MinPort+t.MinPort%2+1 > t.MaxPort {
+			return fmt.Errorf("tenants.%s port range %d-%d must hold an RTP and RTCP port between 1024 and 65535", name, t.MinPort, t.MaxPort)
+		}
+		if t.MinPort <= sc.MaxPort && sc.MinPort <= t.MaxPort {
+			return fmt.Errorf("tenants.%s port range %d-%d overlaps the sessions' range %d-%d", name, t.MinPort, t.MaxPort, sc.MinPort, sc.MaxPort)
+		}
+		// Tenants with the same range share its ports
+		for other, r := range ranges {
+			if r != [2]int{t.MinPort, t.MaxPort} && t.MinPort <= r[1] && r[0] <= t.MaxPort {
+				return fmt.Errorf("tenants.%s port range %d-%d overlaps that of tenant %s", name, t.MinPort, t.MaxPort, other)
+			}
+		}
+		ranges[name] = [2]int{t.MinPort, t.MaxPort}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package internal
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	ng "karl/internal/ng_protocol"
+)
+
+// tenantRecorder records the options calls are recorded with
+type tenantRecorder struct {
+	started []CallRecordingOptions
+}
+
+func (r *tenantRecorder) StartCallRecording(sessionID, callID string, opts CallRecordingOptions) (string, error) {
+	r.started = append(r.started, opts)
+	return "rec-" + callID, nil
+}
+
+func (r *tenantRecorder) StopCallRecording(sessionID string) (string, error) { return "", nil }
+
+func (r *tenantRecorder) PauseCallRecording(sessionID string) error { return nil }
+
+func TestNGSocketListener_Tenants(t *testing.T) {
+	previous := tenants.Load()
+	t.Cleanup(func() { tenants.Store(previous) })
+	ConfigureTenants(&TenantsConfig{
+		Default: "beta",
+		Tenants: map[string]*TenantConfig{
+			"acme": {
+				MinPort:     46000,
+				MaxPort:     46100,
+				StripCodecs: []string{"telephone-event"},
+				OfferRate:   1,
+				Recording:   &TenantRecordingConfig{AutoStart: true, Format: "wav"},
+			},
+			"beta": {AllowCodecs: []string{"PCMA"}},
+		},
+	})
+
+	manager, registry, _ := newTestSessionManager(t)
+	recorder := &tenantRecorder{}
+	listener := &NGSocketListener{sessionRegistry: registry, sessionManager: manager, config: &Config{}, callRecorder: recorder}
+	defer GetCodecNegotiator().RemoveCall("acme-call")
+
+	resp, err := listener.handleOffer(&ng.NGRequest{CallID: "acme-call", FromTag: "from-tag", SDP: sipOfferSDP, Tenant: "acme"})
+	if err != nil || resp.Result != ng.ResultOK {
+		t.Fatalf("handleOffer failed: %v %+v", err, resp)
+	}
+	if strings.Contains(resp.SDP, "telephone-event") || !strings.Contains(resp.SDP, "PCMU/8000") {
+		t.Errorf("expected telephone-event stripped from the offer:\n%s", resp.SDP)
+	}
+	session := registry.GetSessionByCallID("acme-call")[0]
+	session.RLock()
+	tenant, port := session.Tenant, session.CallerLeg.LocalPort
+	session.RUnlock()
+	if tenant != "acme" || port < 46000 || port > 46100 {
+		t.Errorf("call has tenant %q and port %d, want acme in 46000-46100", tenant, port)
+	}
+
+	// The answer starts the tenant's recording, kept in its directory
+	answer := strings.Replace(sipOfferSDP, "m=audio 49170", "m=audio 50000", 1)
+	if resp, err := listener.handleAnswer(&ng.NGRequest{CallID: "acme-call", FromTag: "from-tag", ToTag: "to-tag", SDP: answer}); err != nil || resp.Result != ng.ResultOK {
+		t.Fatalf("handleAnswer failed: %v %+v", err, resp)
+	}
+	if len(recorder.started) != 1 || recorder.started[0].Format != "wav" || recorder.started[0].Metadata[TenantMetadataKey] != "acme" {
+		t.Errorf("unexpected recordings %+v", recorder.started)
+	}
+
+	// The tenant's offer rate admits one new call a second
+	resp, _ = listener.handleOffer(&ng.NGRequest{CallID: "acme-call-2", FromTag: "from-tag", SDP: sipOfferSDP, Tenant: "acme"})
+	if resp.ErrorReason != ErrTenantOfferRate.Error() {
+		t.Errorf("expected the second call to be rate limited, got %+v", resp)
+	}
+
+	// Offers naming no tenant belong to the default one, whose policy
+	// leaves this offer no codec
+	resp, _ = listener.handleOffer(&ng.NGRequest{CallID: "beta-call", FromTag: "from-tag", SDP: sipOfferSDP})
+	if resp.Result != ng.ResultError || !strings.Contains(resp.ErrorReason, "no codec") {
+		t.Errorf("expected the default tenant's policy to reject the offer, got %+v", resp)
+	}
+	resp, _ = listener.handleOffer(&ng.NGRequest{CallID: "other-call", FromTag: "from-tag", SDP: sipOfferSDP, Tenant: "other"})
+	if !strings.Contains(resp.ErrorReason, ErrUnknownTenant.Error()) {
+		t.Errorf("expected an unknown tenant error, got %+v", resp)
+	}
+
+	manager.TerminateCall("acme-call")
+	if inUse := manager.tenantPortsInUse(); inUse != 0 {
+		t.Errorf("%d ports of the tenant's range still in use", inUse)
+	}
+	if _, err := LookupTenant("other"); !errors.Is(err, ErrUnknownTenant) {
+		t.Errorf("expected ErrUnknownTenant, got %v", err)
+	}
+}
+
+func TestValidateTenantsConfig(t *testing.T) {
+	sessions := &SessionConfig{MinPort: 30000, MaxPort: 40000}
+	tests := []struct {
+		name    string
+		tenants *TenantsConfig
+		wantErr string
+	}{
+		{"shared range", &TenantsConfig{Default: "a", Tenants: map[string]*TenantConfig{
+			"a": {MinPort: 50000, MaxPort: 51000},
+			"b": {MinPort: 50000, MaxPort: 51000},
+		}}, ""},
+		{"unknown default", &TenantsConfig{Default: "c", Tenants: map[string]*TenantConfig{"a": {}}}, "tenants.default"},
+		{"invalid name", &TenantsConfig{Tenants: map[string]*TenantConfig{"../a": {}}}, "tenant name"},
+		{"overlaps sessions", &TenantsConfig{Tenants: map[string]*TenantConfig{"a": {MinPort: 39000, MaxPort: 41000}}}, "sessions' range"},
+		{"overlaps tenant", &TenantsConfig{Tenants: map[string]*TenantConfig{
+			"a": {MinPort: 50000, MaxPort: 51000},
+			"b": {MinPort: 50500, MaxPort: 52000},
+		}}, "overlaps that of tenant"},
+		{"recording format", &TenantsConfig{Tenants: map[string]*TenantConfig{
+			"a": {Recording: &TenantRecordingConfig{Format: "mp3"}},
+		}}, "recording.format"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateTenantsConfig(&Config{Sessions: sessions, Tenants: tt.tenants})
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("expected an error about %s, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
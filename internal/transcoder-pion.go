@@ -3,6 +3,7 @@ package internal
 import (
 	"fmt"
 	"log"
+	"strings"
 	"sync"
 	"time"
 
@@ -22,7 +23,10 @@ type RTPTranscoder struct {
 	peerConn      *webrtc.PeerConnection
 	packetBuffers map[string]*PacketBuffer
 	dtmfEnabled   bool
+	dtmfOutputPT  uint8
 	vadEnabled    bool
+	vadConfig     VADConfig
+	cnOutputPT    uint8
 	stats         *TranscoderStats
 }
 
@@ -32,7 +36,8 @@ type PacketBuffer struct {
 	packets     []*rtp.Packet
 	maxSize     int
 	initialized bool
-	lastSeq     uint16
+	lastSeq     uint16 // next sequence number to deliver
+	highSeq     uint16 // highest sequence number buffered
 	lastTS      uint32
 }
 
@@ -53,6 +58,19 @@ type trackPair struct {
 
 	payloadType uint8
 	codec       string
+	codecs      *StreamCodecs
+	dtmf        *DTMFRelay
+	vad         *VAD
+	vadDecoder  *OpusDecoder // decodes input for the VAD apart from codecs
+	cnEncoder   *ComfortNoiseEncoder
+	cnGenerator *ComfortNoiseGenerator
+	plc         *PacketLossConcealer
+	lastSeq     uint16   // last input sequence number delivered
+	lastTS      uint32   // last output timestamp
+	frameTS     uint32   // timestamp step between consecutive frames
+	frameLen    int      // samples in the last output frame
+	clock       rtpClock // maps input timestamps onto the output codec's clock
+	estimate    uint64   // latest REMB from the peer in bps, 0 if none
 }
 
 // NewRTPTranscoder creates a new transcoder instance
@@ -95,6 +113,27 @@ func (t *RTPTranscoder) AddTrackPair(inputTrack *webrtc.TrackRemote) (*webrtc.Tr
 		outputTrack: outputTrack,
 		ssrc:        inputTrack.SSRC(),
 		codec:       codec,
+		codecs:      NewStreamCodecs(),
+		cnGenerator: NewComfortNoiseGenerator(),
+		frameTS:     vadFrameSize,
+		frameLen:    vadFrameSize,
+		clock:       rtpClock{inputRate: int(inputTrack.Codec().ClockRate), outputRate: audioSampleRate(codec)},
+	}
+	if isG711(strings.TrimPrefix(codec, "audio/")) {
+		pair.plc = NewPacketLossConcealer()
+	}
+	if t.vadEnabled {
+		pair.vad = NewVAD(int(inputTrack.Codec().ClockRate), t.vadConfig)
+		pair.vadDecoder = NewOpusDecoder()
+		pair.cnEncoder = NewComfortNoiseEncoder()
+	}
+	if t.dtmfEnabled {
+		pair.dtmf = NewDTMFRelay(DTMFRelayConfig{
+			InputEventPT:     defaultTelephoneEventPT,
+			OutputEventPT:    t.dtmfOutputPT,
+			OutputAudioCodec: strings.TrimPrefix(codec, "audio/"),
+			OutputAudioPT:    pair.payloadType,
+		})
 	}
 	t.trackPairs[inputTrack.ID()] = pair
 
@@ -119,36 +158,19 @@ func (t *RTPTranscoder) processTrack(pair *trackPair) {
 
 		t.stats.PacketsReceived++
 
+		// Copy the packet so it can wait in the jitter buffer
 		packet := &rtp.Packet{}
-		if err := packet.Unmarshal(buffer[:n]); err != nil {
+		if err := packet.Unmarshal(append([]byte(nil), buffer[:n]...)); err != nil {
 			t.stats.PacketsDropped++
 			t.handleError(fmt.Errorf("packet unmarshal error: %v", err))
 			continue
 		}
 
-		// DTMF detection if enabled
-		if t.dtmfEnabled && isDTMFPacket(packet) {
-			t.handleDTMF(packet)
-			continue
-		}
-
-		// VAD processing if enabled
-		if t.vadEnabled {
-			// Convert RTP payload to PCM samples first
-			pcmSamples, err := DecodePCMUToPCM(packet.Payload)
-			if err != nil {
-				t.handleError(fmt.Errorf("VAD conversion error: %v", err))
-				continue
-			}
-			if !IsVoiceActive(pcmSamples) {
-				continue
-			}
-		}
-
 		// Handle packet ordering
 		if !packetBuffer.initialized {
 			packetBuffer.mu.Lock()
 			packetBuffer.lastSeq = packet.SequenceNumber
+			packetBuffer.highSeq = packet.SequenceNumber
 			packetBuffer.lastTS = packet.Timestamp
 			packetBuffer.initialized = true
 			packetBuffer.mu.Unlock()
@@ -159,16 +181,126 @@ func (t *RTPTranscoder) processTrack(pair *trackPair) {
 	}
 }
 
-func (t *RTPTranscoder) handleDTMF(packet *rtp.Packet) {
-	if len(packet.Payload) < 4 {
+// EnableDTMF turns on DTMF relay for track pairs added afterwards. Events are
+// forwarded as RFC 4733 with outputEventPT, or played inband if it is 0
+func (t *RTPTranscoder) EnableDTMF(outputEventPT uint8) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.dtmfEnabled = true
+	t.dtmfOutputPT = outputEventPT
+}
+
+// EnableVAD turns on voice activity detection for track pairs added
+// afterwards. Silent frames are replaced by RFC 3389 SID packets sent with
+// comfortNoisePT, or by locally generated noise in the output codec if it is 0
+func (t *RTPTranscoder) EnableVAD(comfortNoisePT uint8, config VADConfig) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.vadEnabled = true
+	t.vadConfig = config
+	t.cnOutputPT = comfortNoisePT
+}
+
+// decodeForVAD decodes a payload into mono PCM for voice activity detection,
+// Opus with the stream's VAD decoder. It returns nil samples for codecs it
+// cannot decode, which are always treated as voice
+func decodeForVAD(mimeType string, payload []byte, opus *OpusDecoder) ([]int16, error) {
+	codec := strings.TrimPrefix(mimeType, "audio/")
+	switch {
+	case isG711(codec):
+		return decodeG711(codec, payload), nil
+	case strings.EqualFold(mimeType, webrtc.MimeTypeOpus):
+		pcm, err := opus.Decode(payload)
+		if err != nil {
+			return nil, err
+		}
+		return stereoToMono(pcm), nil
+	}
+	return nil, nil
+}
+
+// handleComfortNoise relays a CN packet from the peer. It is forwarded as CN
+// if the output side negotiated it, otherwise expanded into a noise frame
+func (t *RTPTranscoder) handleComfortNoise(packet *rtp.Packet, pair *trackPair) {
+	t.mu.RLock()
+	cnPT := t.cnOutputPT
+	t.mu.RUnlock()
+
+	if cnPT != 0 {
+		t.writeComfortNoise(packet, pair, cnPT, packet.Payload)
 		return
 	}
+	if err := pair.cnGenerator.Update(packet.Payload); err != nil {
+		t.stats.PacketsDropped++
+		t.handleError(fmt.Errorf("comfort noise error: %v", err))
+		return
+	}
+	t.writeNoiseFrame(packet, pair, vadFrameSize)
+}
+
+// sendSilence replaces a silent frame. With CN negotiated only the SID
+// updates are sent; otherwise every frame becomes generated noise so the
+// peer's jitter buffer keeps running
+func (t *RTPTranscoder) sendSilence(packet *rtp.Packet, pair *trackPair, sid []byte) {
+	t.mu.RLock()
+	cnPT := t.cnOutputPT
+	t.mu.RUnlock()
+
+	if cnPT != 0 {
+		if sid != nil {
+			t.writeComfortNoise(packet, pair, cnPT, sid)
+		}
+		return
+	}
+	if sid != nil {
+		if err := pair.cnGenerator.Update(sid); err != nil {
+			t.handleError(fmt.Errorf("comfort noise error: %v", err))
+			return
+		}
+	}
+	t.writeNoiseFrame(packet, pair, vadFrameSize)
+}
+
+// writeNoiseFrame sends samples of generated comfort noise in the output
+// codec. Only G.711 outputs can carry generated noise
+func (t *RTPTranscoder) writeNoiseFrame(packet *rtp.Packet, pair *trackPair, samples int) {
+	codec := strings.TrimPrefix(pair.codec, "audio/")
+	if !isG711(codec) {
+		return
+	}
+	payload := encodeG711(codec, pair.cnGenerator.Generate(samples))
+	t.writeComfortNoise(packet, pair, pair.payloadType, payload)
+}
 
-	eventID := packet.Payload[0]                                         // DTMF digit
-	volume := packet.Payload[1]                                          // Volume
-	duration := uint16(packet.Payload[2])<<8 | uint16(packet.Payload[3]) // Duration
+func (t *RTPTranscoder) writeComfortNoise(packet *rtp.Packet, pair *trackPair, payloadType uint8, payload []byte) {
+	out := &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			PayloadType:    payloadType,
+			SequenceNumber: pair.sequenceNum,
+			Timestamp:      pair.clock.convert(packet.Timestamp),
+			SSRC:           uint32(pair.ssrc),
+		},
+		Payload: payload,
+	}
+	if err := pair.outputTrack.WriteRTP(out); err != nil {
+		t.handleError(fmt.Errorf("failed to write comfort noise packet: %v", err))
+		return
+	}
+	pair.sequenceNum++
+}
 
-	log.Printf("DTMF Event: digit=%d, volume=%d, duration=%d", eventID, volume, duration)
+// handleDTMF relays a telephone-event packet, bypassing audio transcoding
+func (t *RTPTranscoder) handleDTMF(packet *rtp.Packet, pair *trackPair) {
+	for _, out := range pair.dtmf.Process(packet) {
+		out.SequenceNumber = pair.sequenceNum
+		out.SSRC = uint32(pair.ssrc)
+		if err := pair.outputTrack.WriteRTP(out); err != nil {
+			t.handleError(fmt.Errorf("failed to write DTMF packet: %v", err))
+			return
+		}
+		pair.sequenceNum++
+	}
 }
 
 func (t *RTPTranscoder) handleJitterBuffer(buffer *PacketBuffer, packet *rtp.Packet, pair *trackPair) {
@@ -177,14 +309,25 @@ func (t *RTPTranscoder) handleJitterBuffer(buffer *PacketBuffer, packet *rtp.Pac
 
 	// Calculate position in buffer
 	diff := packet.SequenceNumber - buffer.lastSeq
-	if diff > uint16(buffer.maxSize) {
-		// Packet too old or too far ahead, process immediately
-		t.transcodeAndSend(packet, pair)
-		buffer.lastSeq = packet.SequenceNumber
-	} else {
+	switch {
+	case diff >= 0x8000:
+		// Duplicate, or arrived after its slot was concealed
+		t.stats.PacketsDropped++
+	case diff >= uint16(buffer.maxSize):
+		// Too far ahead, resynchronize on this packet
+		for i := range buffer.packets {
+			buffer.packets[i] = nil
+		}
+		t.deliver(packet, pair)
+		buffer.lastSeq = packet.SequenceNumber + 1
+		buffer.highSeq = packet.SequenceNumber
+	default:
 		// Store packet in buffer
 		idx := packet.SequenceNumber % uint16(buffer.maxSize)
 		buffer.packets[idx] = packet
+		if packet.SequenceNumber-buffer.highSeq < 0x8000 {
+			buffer.highSeq = packet.SequenceNumber
+		}
 
 		// Process any packets in order
 		t.processBufferedPackets(buffer, pair)
@@ -195,35 +338,121 @@ func (t *RTPTranscoder) processBufferedPackets(buffer *PacketBuffer, pair *track
 	for {
 		idx := buffer.lastSeq % uint16(buffer.maxSize)
 		packet := buffer.packets[idx]
-		if packet == nil {
-			break
+		if packet == nil || packet.SequenceNumber != buffer.lastSeq {
+			// A hole is declared lost once enough later packets are waiting
+			ahead := buffer.highSeq - buffer.lastSeq
+			if ahead >= 0x8000 || ahead < plcReorderDepth {
+				break
+			}
+			t.concealLoss(pair)
+			buffer.lastSeq++
+			continue
 		}
 
-		if packet.SequenceNumber == buffer.lastSeq {
-			t.transcodeAndSend(packet, pair)
-			buffer.packets[idx] = nil
-			buffer.lastSeq++
-		} else {
-			break
+		t.deliver(packet, pair)
+		buffer.packets[idx] = nil
+		buffer.lastSeq++
+	}
+}
+
+// deliver handles a packet in sequence order: DTMF and comfort noise are
+// relayed, silent frames are suppressed and audio is transcoded
+func (t *RTPTranscoder) deliver(packet *rtp.Packet, pair *trackPair) {
+	// DTMF relay if enabled
+	if pair.dtmf != nil && isDTMFPacket(packet) {
+		t.handleDTMF(packet, pair)
+		return
+	}
+
+	// Comfort noise from the peer
+	if packet.PayloadType == CNPayloadType {
+		t.handleComfortNoise(packet, pair)
+		return
+	}
+
+	// VAD processing if enabled
+	if pair.vad != nil {
+		// Convert RTP payload to PCM samples first
+		pcmSamples, err := decodeForVAD(pair.inputTrack.Codec().MimeType, packet.Payload, pair.vadDecoder)
+		if err != nil {
+			t.handleError(fmt.Errorf("VAD conversion error: %v", err))
+			return
 		}
+		if pcmSamples != nil {
+			voice := pair.vad.Process(pcmSamples)
+			sid := pair.cnEncoder.Process(pcmSamples, voice)
+			if !voice {
+				t.sendSilence(packet, pair, sid)
+				return
+			}
+		}
+	}
+
+	t.transcodeAndSend(packet, pair)
+}
+
+// concealLoss replaces a lost audio frame with a concealment frame in the
+// output codec. Nothing is sent once the concealment has faded out
+func (t *RTPTranscoder) concealLoss(pair *trackPair) {
+	t.stats.PacketsDropped++
+	if pair.plc == nil {
+		return
+	}
+	samples := pair.plc.Conceal(pair.frameLen)
+	pair.lastTS += pair.frameTS
+	if samples == nil {
+		return
+	}
+
+	out := &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			PayloadType:    pair.payloadType,
+			SequenceNumber: pair.sequenceNum,
+			Timestamp:      pair.lastTS,
+			SSRC:           uint32(pair.ssrc),
+		},
+		Payload: encodeG711(strings.TrimPrefix(pair.codec, "audio/"), samples),
+	}
+	if err := pair.outputTrack.WriteRTP(out); err != nil {
+		t.handleError(fmt.Errorf("failed to write concealment packet: %v", err))
+		return
 	}
+	pair.sequenceNum++
 }
 
 func (t *RTPTranscoder) transcodeAndSend(packet *rtp.Packet, pair *trackPair) {
 	// Transcode based on codec
-	transcodedPayload, err := TranscodeAudio(packet.Payload, pair.inputTrack.Codec().MimeType, pair.codec)
+	input, output := mimeCodec(pair.inputTrack.Codec().MimeType), mimeCodec(pair.codec)
+	transcodedPayload, err := transcodeAudioWith(packet.Payload, input, output, pair.codecs, nil)
 	if err != nil {
 		t.handleError(fmt.Errorf("transcoding error: %v", err))
 		return
 	}
 
+	// Keep the concealment history and smooth the splice after a loss
+	timestamp := pair.clock.convert(packet.Timestamp)
+	if pair.plc != nil {
+		codec := strings.TrimPrefix(pair.codec, "audio/")
+		pcm := decodeG711(codec, transcodedPayload)
+		if pair.plc.Good(pcm) {
+			transcodedPayload = encodeG711(codec, pcm)
+		}
+		if step := timestamp - pair.lastTS; packet.SequenceNumber == pair.lastSeq+1 && step > 0 && step < 0x8000 {
+			pair.frameTS = step
+		}
+		pair.lastSeq = packet.SequenceNumber
+		pair.lastTS = timestamp
+		pair.frameLen = len(pcm)
+	}
+
 	// Create output packet
 	outputPacket := &rtp.Packet{
 		Header: rtp.Header{
 			Version:        2,
 			PayloadType:    pair.payloadType,
 			SequenceNumber: pair.sequenceNum,
-			Timestamp:      packet.Timestamp,
+			Timestamp:      timestamp,
 			SSRC:           uint32(pair.ssrc),
 			Marker:         packet.Marker,
 		},
@@ -248,12 +477,13 @@ func (t *RTPTranscoder) handleError(err error) {
 }
 
 // Helper functions
+
+// getPreferredCodec picks the codec a track is transcoded to. Video passes
+// through; relayed calls convert video with a VideoTranscoder
 func getPreferredCodec(input webrtc.RTPCodecParameters) string {
 	switch input.MimeType {
 	case webrtc.MimeTypeOpus:
 		return webrtc.MimeTypePCMU // Convert Opus to G.711 μ-law
-	case webrtc.MimeTypeVP8:
-		return webrtc.MimeTypeH264 // Convert VP8 to H.264
 	default:
 		return input.MimeType // Pass through if no conversion needed
 	}
@@ -261,7 +491,7 @@ func getPreferredCodec(input webrtc.RTPCodecParameters) string {
 
 func isDTMFPacket(packet *rtp.Packet) bool {
 	// Check if packet contains DTMF (RFC 4733)
-	return packet.PayloadType == 101
+	return packet.PayloadType == defaultTelephoneEventPT
 }
 
 // RemoveTrack removes a track pair and stops processing
@@ -0,0 +1,833 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"karl/internal/transcriptionpb"
+
+	"github.com/pion/rtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/net/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+// TranscribingFlag marks a call whose audio is forked to a speech-to-text
+// engine
+const TranscribingFlag = "transcribing"
+
+// Transcription backends
+const (
+	TranscriptionBackendGRPC      = "grpc"
+	TranscriptionBackendWebSocket = "websocket"
+)
+
+// Transcription defaults and limits
+const (
+	defaultTranscriptionRate       = 16000
+	defaultTranscriptionMaxStreams = 100
+
+	// transcriptionQueueFrames bounds the packets buffered per leg while
+	// the engine is slow; newer packets are dropped beyond it
+	transcriptionQueueFrames = 250
+
+	// TranscriptionMethod is the bidirectional streaming method gRPC
+	// engines implement, see internal/transcriptionpb/transcription.proto
+	TranscriptionMethod = transcriptionpb.Transcriber_Transcribe_FullMethodName
+)
+
+// Transcription errors
+var (
+	ErrTranscriptionDisabled   = errors.New("transcription is not enabled")
+	ErrTranscriptionRunning    = errors.New("call is already transcribed")
+	ErrTranscriptionNotRunning = errors.New("call is not transcribed")
+	ErrTranscriptionLimit      = errors.New("transcription stream limit reached")
+)
+
+// Transcription metrics
+var (
+	transcriptionStreamsActive = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "karl_transcription_streams_active",
+			Help: "Number of call legs streamed to the speech-to-text engine",
+		},
+	)
+
+	transcriptionStreams = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "karl_transcription_streams_total",
+			Help: "Streams opened to the speech-to-text engine, by result",
+		},
+		[]string{"result"},
+	)
+
+	transcriptionSegments = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "karl_transcription_segments_total",
+			Help: "Transcript segments received from the speech-to-text engine, by kind",
+		},
+		[]string{"kind"},
+	)
+
+	transcriptionFramesDropped = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "karl_transcription_frames_dropped_total",
+			Help: "Audio packets not forked because the engine fell behind",
+		},
+	)
+)
+
+var (
+	// transcriptionDrainTimeout is how long a stopped stream waits for the
+	// engine's last segments
+	transcriptionDrainTimeout = 10 * time.Second
+
+	// Failed streams are reported at most once a minute
+	transcriptionErrors = NewLogSampler(Logger(ComponentKarl), slog.LevelWarn, 1, time.Minute)
+)
+
+// TranscriptSegment is text the engine recognized in the audio of a leg.
+// Partial segments are revised by later ones until a final segment closes
+// the utterance
+type TranscriptSegment struct {
+	Text       string  `json:"text"`
+	Final      bool    `json:"final"`
+	StartMs    int64   `json:"start_ms"` // Offset from the start of the stream
+	EndMs      int64   `json:"end_ms"`
+	Confidence float64 `json:"confidence,omitempty"`
+}
+
+// TranscriptionStreamInfo describes the audio of a stream to the engine
+type TranscriptionStreamInfo struct {
+	CallID     string
+	Leg        string // caller or callee
+	SampleRate int
+	Language   string
+}
+
+// TranscriptionStream carries the audio of one leg to the engine and its
+// transcript back. Send and CloseSend are called from one goroutine and
+// Recv from another
+type TranscriptionStream interface {
+	Send(pcm []byte) error             // 16-bit little-endian mono PCM
+	CloseSend() error                  // The audio ended; the engine sends its last segments
+	Recv() (*TranscriptSegment, error) // io.EOF once the engine is done
+	Close() error
+}
+
+// TranscriptionBackend opens streams to a speech-to-text engine
+type TranscriptionBackend interface {
+	Open(ctx context.Context, info TranscriptionStreamInfo) (TranscriptionStream, error)
+	Close() error
+}
+
+// NewTranscriptionBackend connects to the engine configured in config
+func NewTranscriptionBackend(config *TranscriptionConfig) (TranscriptionBackend, error) {
+	switch config.Backend {
+	case TranscriptionBackendGRPC:
+		return newGRPCTranscriber(config)
+	case TranscriptionBackendWebSocket:
+		return &websocketTranscriber{url: config.URL, token: config.Token}, nil
+	}
+	return nil, fmt.Errorf("unknown transcription backend %q", config.Backend)
+}
+
+// grpcTranscriber streams audio to an engine implementing the Transcriber
+// service of transcriptionpb
+type grpcTranscriber struct {
+	conn   *grpc.ClientConn
+	client transcriptionpb.TranscriberClient
+	token  string
+}
+
+func newGRPCTranscriber(config *TranscriptionConfig) (*grpcTranscriber, error) {
+	creds := insecure.NewCredentials()
+	if config.TLS {
+		creds = credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+	}
+	conn, err := grpc.NewClient(config.Address, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+	return &grpcTranscriber{conn: conn, client: transcriptionpb.NewTranscriberClient(conn), token: config.Token}, nil
+}
+
+func (t *grpcTranscriber) Open(ctx context.Context, info TranscriptionStreamInfo) (TranscriptionStream, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	if t.token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+t.token)
+	}
+	stream, err := t.client.Transcribe(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if err := stream.Send(transcriptionConfigRequest(info)); err != nil {
+		cancel()
+		return nil, err
+	}
+	return &grpcTranscriptionStream{stream: stream, cancel: cancel}, nil
+}
+
+func (t *grpcTranscriber) Close() error {
+	return t.conn.Close()
+}
+
+type grpcTranscriptionStream struct {
+	stream transcriptionpb.Transcriber_TranscribeClient
+	cancel context.CancelFunc
+}
+
+func (s *grpcTranscriptionStream) Send(pcm []byte) error {
+	return s.stream.Send(&transcriptionpb.AudioRequest{Request: &transcriptionpb.AudioRequest_Audio{Audio: pcm}})
+}
+
+func (s *grpcTranscriptionStream) CloseSend() error {
+	return s.stream.CloseSend()
+}
+
+func (s *grpcTranscriptionStream) Recv() (*TranscriptSegment, error) {
+	msg, err := s.stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	return &TranscriptSegment{
+		Text:       msg.GetText(),
+		Final:      msg.GetFinal(),
+		StartMs:    int64(msg.GetStartMs()),
+		EndMs:      int64(msg.GetEndMs()),
+		Confidence: float64(msg.GetConfidence()),
+	}, nil
+}
+
+func (s *grpcTranscriptionStream) Close() error {
+	s.cancel()
+	return nil
+}
+
+// transcriptionConfigRequest is the AudioRequest opening a stream
+func transcriptionConfigRequest(info TranscriptionStreamInfo) *transcriptionpb.AudioRequest {
+	return &transcriptionpb.AudioRequest{Request: &transcriptionpb.AudioRequest_Config{Config: &transcriptionpb.StreamConfig{
+		CallId:     info.CallID,
+		Leg:        info.Leg,
+		SampleRate: uint32(info.SampleRate),
+		Language:   info.Language,
+	}}}
+}
+
+// websocketTranscriber streams audio to an engine over a WebSocket per
+// leg: a JSON start message, binary PCM frames and a JSON stop message.
+// The engine answers with JSON transcript segments and closes the socket
+// after the last one
+type websocketTranscriber struct {
+	url   string
+	token string
+}
+
+// websocketTranscriptionControl is a start or stop message
+type websocketTranscriptionControl struct {
+	Type       string `json:"type"`
+	CallID     string `json:"call_id,omitempty"`
+	Leg        string `json:"leg,omitempty"`
+	SampleRate int    `json:"sample_rate,omitempty"`
+	Language   string `json:"language,omitempty"`
+	Encoding   string `json:"encoding,omitempty"`
+}
+
+func (t *websocketTranscriber) Open(ctx context.Context, info TranscriptionStreamInfo) (TranscriptionStream, error) {
+	origin := strings.Replace(t.url, "ws", "http", 1)
+	config, err := websocket.NewConfig(t.url, origin)
+	if err != nil {
+		return nil, err
+	}
+	if t.token != "" {
+		config.Header.Set("Authorization", "Bearer "+t.token)
+	}
+	conn, err := config.DialContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	start := websocketTranscriptionControl{Type: "start", CallID: info.CallID, Leg: info.Leg,
+		SampleRate: info.SampleRate, Language: info.Language, Encoding: "pcm_s16le"}
+	if err := websocket.JSON.Send(conn, start); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return &websocketTranscriptionStream{conn: conn}, nil
+}
+
+func (t *websocketTranscriber) Close() error {
+	return nil
+}
+
+type websocketTranscriptionStream struct {
+	conn *websocket.Conn
+}
+
+func (s *websocketTranscriptionStream) Send(pcm []byte) error {
+	return websocket.Message.Send(s.conn, pcm)
+}
+
+func (s *websocketTranscriptionStream) CloseSend() error {
+	return websocket.JSON.Send(s.conn, websocketTranscriptionControl{Type: "stop"})
+}
+
+func (s *websocketTranscriptionStream) Recv() (*TranscriptSegment, error) {
+	var segment TranscriptSegment
+	if err := websocket.JSON.Receive(s.conn, &segment); err != nil {
+		return nil, err
+	}
+	return &segment, nil
+}
+
+func (s *websocketTranscriptionStream) Close() error {
+	return s.conn.Close()
+}
+
+// TranscriptionOptions selects what is transcribed of a call
+type TranscriptionOptions struct {
+	Language string   // Overrides the configured language
+	Legs     []string // caller, callee or both if empty
+}
+
+// TranscriptionInfo describes a transcribed call
+type TranscriptionInfo struct {
+	CallID    string
+	Language  string
+	StartedAt time.Time
+	Legs      []TranscriptionLegInfo
+}
+
+// TranscriptionLegInfo describes the stream of one leg
+type TranscriptionLegInfo struct {
+	Leg           string
+	State         string // connecting, streaming, failed or stopped
+	Error         string
+	FramesSent    uint64
+	FramesDropped uint64
+	Segments      uint64
+	Transcript    string // Text of the last final segment
+}
+
+// TranscriptionManager forks the decoded audio of selected calls to a
+// speech-to-text engine and publishes the segments it returns as
+// transcript events. Each leg has its own stream, fed from a media tap
+type TranscriptionManager struct {
+	registry   *SessionRegistry
+	negotiator *CodecNegotiator
+
+	mu            sync.RWMutex
+	config        TranscriptionConfig
+	backend       *transcriptionBackendRef
+	calls         map[string]*callTranscription
+	stopped       map[string]bool // calls auto_start must not restart
+	active        int32           // transcribed calls, read on the packet path
+	autoStart     atomic.Bool
+	updateOffload func(session *MediaSession)
+	wg            sync.WaitGroup
+}
+
+// transcriptionBackendRef counts the streams of a backend, so a backend
+// replaced on reload is closed once its streams ended
+type transcriptionBackendRef struct {
+	TranscriptionBackend
+	streams sync.WaitGroup
+}
+
+// callTranscription is a transcribed call
+type callTranscription struct {
+	callID   string
+	language string
+	started  time.Time
+	legs     map[bool]*legTranscription // keyed by fromOfferer
+}
+
+// legTranscription streams the audio of one leg
+type legTranscription struct {
+	callID string
+	leg    string
+	frames chan transcriptionFrame
+	codecs *StreamCodecs
+
+	framesSent    atomic.Uint64
+	framesDropped atomic.Uint64
+	segments      atomic.Uint64
+
+	mu         sync.Mutex
+	state      string
+	err        string
+	transcript string
+}
+
+// transcriptionFrame is a copied packet payload waiting to be decoded
+type transcriptionFrame struct {
+	codec   string
+	payload []byte
+}
+
+// NewTranscriptionManager connects to the engine in config for the
+// sessions in registry
+func NewTranscriptionManager(config *TranscriptionConfig, registry *SessionRegistry) (*TranscriptionManager, error) {
+	m := &TranscriptionManager{
+		registry:   registry,
+		negotiator: GetCodecNegotiator(),
+		calls:      make(map[string]*callTranscription),
+		stopped:    make(map[string]bool),
+	}
+	if err := m.Configure(config); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Configure applies a changed config. Calls already transcribed keep the
+// engine they were started on; nil or disabled refuses new calls
+func (m *TranscriptionManager) Configure(config *TranscriptionConfig) error {
+	var backend *transcriptionBackendRef
+	cfg := TranscriptionConfig{}
+	if config != nil && config.Enabled {
+		cfg = *config
+		if cfg.SampleRate == 0 {
+			cfg.SampleRate = defaultTranscriptionRate
+		}
+		if cfg.MaxStreams == 0 {
+			cfg.MaxStreams = defaultTranscriptionMaxStreams
+		}
+		b, err := NewTranscriptionBackend(&cfg)
+		if err != nil {
+			return err
+		}
+		backend = &transcriptionBackendRef{TranscriptionBackend: b}
+	}
+
+	m.mu.Lock()
+	if reflect.DeepEqual(m.config, cfg) && m.backend != nil {
+		m.mu.Unlock()
+		if backend != nil {
+			_ = backend.Close()
+		}
+		return nil
+	}
+	old := m.backend
+	m.config = cfg
+	m.backend = backend
+	m.autoStart.Store(cfg.AutoStart)
+	m.mu.Unlock()
+
+	if old != nil {
+		go func() {
+			old.streams.Wait()
+			_ = old.Close()
+		}()
+	}
+	return nil
+}
+
+// SetOffloadUpdater sets the function that moves a session into user space
+// once the transcribing flag is set, and back when it is cleared
+func (m *TranscriptionManager) SetOffloadUpdater(update func(session *MediaSession)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.updateOffload = update
+}
+
+// StartCall starts streaming the legs of a call to the engine
+func (m *TranscriptionManager) StartCall(callID string, opts *TranscriptionOptions) (*TranscriptionInfo, error) {
+	if opts == nil {
+		opts = &TranscriptionOptions{}
+	}
+	legs := map[bool]string{true: "caller", false: "callee"}
+	if len(opts.Legs) > 0 {
+		legs = make(map[bool]string)
+		for _, leg := range opts.Legs {
+			switch leg {
+			case "caller":
+				legs[true] = leg
+			case "callee":
+				legs[false] = leg
+			default:
+				return nil, fmt.Errorf("invalid leg %q, expected caller or callee", leg)
+			}
+		}
+	}
+
+	m.mu.Lock()
+	if m.backend == nil {
+		m.mu.Unlock()
+		return nil, ErrTranscriptionDisabled
+	}
+	if _, exists := m.calls[callID]; exists {
+		m.mu.Unlock()
+		return nil, ErrTranscriptionRunning
+	}
+	if len(m.calls) >= m.config.MaxStreams {
+		m.mu.Unlock()
+		return nil, ErrTranscriptionLimit
+	}
+
+	call := &callTranscription{
+		callID:   callID,
+		language: m.config.Language,
+		started:  time.Now(),
+		legs:     make(map[bool]*legTranscription),
+	}
+	if opts.Language != "" {
+		call.language = opts.Language
+	}
+	for fromOfferer, name := range legs {
+		leg := &legTranscription{
+			callID: callID,
+			leg:    name,
+			frames: make(chan transcriptionFrame, transcriptionQueueFrames),
+			codecs: NewStreamCodecs(),
+			state:  "connecting",
+		}
+		call.legs[fromOfferer] = leg
+
+		info := TranscriptionStreamInfo{CallID: callID, Leg: name,
+			SampleRate: m.config.SampleRate, Language: call.language}
+		m.backend.streams.Add(1)
+		m.wg.Add(1)
+		go func(backend *transcriptionBackendRef) {
+			defer m.wg.Done()
+			defer backend.streams.Done()
+			leg.run(backend, info)
+		}(m.backend)
+	}
+	m.calls[callID] = call
+	delete(m.stopped, callID)
+	atomic.StoreInt32(&m.active, int32(len(m.calls)))
+	update := m.updateOffload
+	m.mu.Unlock()
+
+	m.setFlag(callID, true, update)
+	Logger(ComponentKarl).Info("Transcription started", "call_id", callID, "language", call.language)
+	info := call.info()
+	return &info, nil
+}
+
+// StopCall ends the streams of a call. The engine's last segments are
+// still published
+func (m *TranscriptionManager) StopCall(callID string) error {
+	return m.stopCall(callID, false)
+}
+
+// RemoveCall stops transcribing a call that ended
+func (m *TranscriptionManager) RemoveCall(callID string) {
+	_ = m.stopCall(callID, true)
+}
+
+// stopCall ends the streams of a call; a call stopped while it goes on is
+// not restarted by auto_start
+func (m *TranscriptionManager) stopCall(callID string, ended bool) error {
+	m.mu.Lock()
+	if ended {
+		delete(m.stopped, callID)
+	}
+	call, exists := m.calls[callID]
+	if !exists {
+		m.mu.Unlock()
+		return ErrTranscriptionNotRunning
+	}
+	if !ended {
+		m.stopped[callID] = true
+	}
+	delete(m.calls, callID)
+	atomic.StoreInt32(&m.active, int32(len(m.calls)))
+	for _, leg := range call.legs {
+		close(leg.frames)
+	}
+	update := m.updateOffload
+	m.mu.Unlock()
+
+	m.setFlag(callID, false, update)
+	Logger(ComponentKarl).Info("Transcription stopped", "call_id", callID)
+	return nil
+}
+
+// GetCall describes a transcribed call
+func (m *TranscriptionManager) GetCall(callID string) (*TranscriptionInfo, bool) {
+	m.mu.RLock()
+	call, exists := m.calls[callID]
+	m.mu.RUnlock()
+	if !exists {
+		return nil, false
+	}
+	info := call.info()
+	return &info, true
+}
+
+// ListCalls describes the transcribed calls, oldest first
+func (m *TranscriptionManager) ListCalls() []TranscriptionInfo {
+	m.mu.RLock()
+	infos := make([]TranscriptionInfo, 0, len(m.calls))
+	for _, call := range m.calls {
+		infos = append(infos, call.info())
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].StartedAt.Before(infos[j].StartedAt) })
+	return infos
+}
+
+// HandleRTP queues the audio of a transcribed leg for its stream. With
+// auto_start, the first audio of a call starts its transcription
+func (m *TranscriptionManager) HandleRTP(packet *rtp.Packet) {
+	if len(packet.Payload) == 0 || (atomic.LoadInt32(&m.active) == 0 && !m.autoStart.Load()) {
+		return
+	}
+
+	callID, fromOfferer, codec, ok := m.negotiator.ResolveLeg(packet.SSRC, packet.PayloadType)
+	if !ok {
+		return
+	}
+
+	m.mu.RLock()
+	call, exists := m.calls[callID]
+	if !exists {
+		stopped := m.stopped[callID]
+		m.mu.RUnlock()
+		if !m.autoStart.Load() || stopped {
+			return
+		}
+		if _, err := m.StartCall(callID, nil); err != nil && !errors.Is(err, ErrTranscriptionRunning) {
+			return
+		}
+		m.mu.RLock()
+		if call, exists = m.calls[callID]; !exists {
+			m.mu.RUnlock()
+			return
+		}
+	}
+	defer m.mu.RUnlock()
+
+	leg, ok := call.legs[fromOfferer]
+	if !ok {
+		return
+	}
+	// The packet is reused once the tap returns
+	frame := transcriptionFrame{codec: codec.Name, payload: append([]byte(nil), packet.Payload...)}
+	select {
+	case leg.frames <- frame:
+	default:
+		leg.framesDropped.Add(1)
+		transcriptionFramesDropped.Inc()
+	}
+}
+
+// Stop ends every stream, waits for the last segments and disconnects
+// from the engine
+func (m *TranscriptionManager) Stop() {
+	for _, info := range m.ListCalls() {
+		m.RemoveCall(info.CallID)
+	}
+	m.wg.Wait()
+
+	m.mu.Lock()
+	backend := m.backend
+	m.backend = nil
+	m.mu.Unlock()
+	if backend != nil {
+		_ = backend.Close()
+	}
+}
+
+// setFlag marks the sessions of a call as transcribed, so their media is
+// kept in user space where the tap sees it
+func (m *TranscriptionManager) setFlag(callID string, value bool, update func(session *MediaSession)) {
+	if m.registry == nil {
+		return
+	}
+	for _, session := range m.registry.GetSessionByCallID(callID) {
+		session.SetFlag(TranscribingFlag, value)
+		if update != nil {
+			update(session)
+		}
+	}
+}
+
+// info describes the call
+func (c *callTranscription) info() TranscriptionInfo {
+	info := TranscriptionInfo{CallID: c.callID, Language: c.language, StartedAt: c.started}
+	for _, fromOfferer := range []bool{true, false} {
+		if leg, ok := c.legs[fromOfferer]; ok {
+			info.Legs = append(info.Legs, leg.info())
+		}
+	}
+	return info
+}
+
+// info describes the stream of the leg
+func (l *legTranscription) info() TranscriptionLegInfo {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return TranscriptionLegInfo{
+		Leg:           l.leg,
+		State:         l.state,
+		Error:         l.err,
+		FramesSent:    l.framesSent.Load(),
+		FramesDropped: l.framesDropped.Load(),
+		Segments:      l.segments.Load(),
+		Transcript:    l.transcript,
+	}
+}
+
+// setState records the state of the stream and the error that ended it
+func (l *legTranscription) setState(state string, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.state = state
+	if err != nil {
+		l.err = err.Error()
+	}
+}
+
+// run streams the queued audio of the leg until its queue is closed, then
+// waits for the engine's last segments
+func (l *legTranscription) run(backend TranscriptionBackend, info TranscriptionStreamInfo) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := backend.Open(ctx, info)
+	if err != nil {
+		transcriptionStreams.WithLabelValues("failed").Inc()
+		if transcriptionErrors.Allow() {
+			transcriptionErrors.Log("Transcription stream failed", "call_id", l.callID, "leg", l.leg, "error", err)
+		}
+		l.setState("failed", err)
+		for range l.frames {
+		}
+		return
+	}
+	defer stream.Close()
+	transcriptionStreams.WithLabelValues("opened").Inc()
+	transcriptionStreamsActive.Inc()
+	defer transcriptionStreamsActive.Dec()
+	l.setState("streaming", nil)
+
+	received := make(chan struct{})
+	go func() {
+		defer close(received)
+		l.receive(stream)
+	}()
+
+	var sendErr error
+	for frame := range l.frames {
+		if sendErr != nil {
+			continue
+		}
+		samples, rate, err := decodeConferenceAudio(frame.codec, frame.payload, l.codecs)
+		if err != nil || samples == nil {
+			continue
+		}
+		samples = l.codecs.resample(samples, rate, info.SampleRate)
+		pcm := make([]byte, 2*len(samples))
+		for i, s := range samples {
+			binary.LittleEndian.PutUint16(pcm[2*i:], uint16(s))
+		}
+		if sendErr = stream.Send(pcm); sendErr != nil {
+			if transcriptionErrors.Allow() {
+				transcriptionErrors.Log("Transcription stream failed", "call_id", l.callID, "leg", l.leg, "error", sendErr)
+			}
+			l.setState("failed", sendErr)
+			continue
+		}
+		l.framesSent.Add(1)
+	}
+
+	if sendErr == nil {
+		_ = stream.CloseSend()
+	}
+	select {
+	case <-received:
+	case <-time.After(transcriptionDrainTimeout):
+	}
+	if sendErr == nil {
+		l.setState("stopped", nil)
+	}
+}
+
+// receive publishes the segments of the stream as transcript events
+func (l *legTranscription) receive(stream TranscriptionStream) {
+	for {
+		segment, err := stream.Recv()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, context.Canceled) {
+				l.mu.Lock()
+				if l.state == "streaming" {
+					l.err = err.Error()
+				}
+				l.mu.Unlock()
+			}
+			return
+		}
+
+		kind := "partial"
+		if segment.Final {
+			kind = "final"
+			l.mu.Lock()
+			l.transcript = segment.Text
+			l.mu.Unlock()
+		}
+		l.segments.Add(1)
+		transcriptionSegments.WithLabelValues(kind).Inc()
+
+		data := map[string]interface{}{
+			"leg":      l.leg,
+			"text":     segment.Text,
+			"final":    segment.Final,
+			"start_ms": segment.StartMs,
+			"end_ms":   segment.EndMs,
+		}
+		if segment.Confidence > 0 {
+			data["confidence"] = segment.Confidence
+		}
+		PublishEvent(EventTranscript, l.callID, data)
+	}
+}
+
+// ValidateTranscriptionConfig checks the backend, its address and the
+// audio format
+func ValidateTranscriptionConfig(cfg *Config) error {
+	t := cfg.Transcription
+	if !t.Enabled {
+		return nil
+	}
+	switch t.Backend {
+	case TranscriptionBackendGRPC:
+		if t.Address == "" {
+			return fmt.Errorf("transcription.address is required for the grpc backend")
+		}
+	case TranscriptionBackendWebSocket:
+		u, err := url.Parse(t.URL)
+		if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+			return fmt.Errorf("invalid transcription.url, expected a ws or wss URL")
+		}
+	default:
+		return fmt.Errorf("invalid transcription.backend %q, expected grpc or websocket", t.Backend)
+	}
+	if t.SampleRate != 0 && t.SampleRate != 8000 && t.SampleRate != 16000 {
+		return fmt.Errorf("invalid transcription.sample_rate %d, expected 8000 or 16000", t.SampleRate)
+	}
+	if t.MaxStreams < 0 {
+		return fmt.Errorf("invalid transcription.max_streams %d", t.MaxStreams)
+	}
+	return nil
+}
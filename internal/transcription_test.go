@@ -0,0 +1,262 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"karl/internal/transcriptionpb"
+
+	"github.com/pion/rtp"
+	"golang.org/x/net/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// engineStream is what a test engine received on a stream
+type engineStream struct {
+	token  string
+	config *transcriptionpb.StreamConfig // The config opening the stream
+	audio  int
+}
+
+// testTranscriber is an engine that answers each stream with two segments
+// once its audio ended
+type testTranscriber struct {
+	transcriptionpb.UnimplementedTranscriberServer
+	received chan engineStream
+}
+
+func (e *testTranscriber) Transcribe(stream transcriptionpb.Transcriber_TranscribeServer) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	got := engineStream{token: strings.Join(md.Get("authorization"), ",")}
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if config := req.GetConfig(); config != nil {
+			got.config = config
+		} else {
+			got.audio += len(req.GetAudio())
+		}
+	}
+	e.received <- got
+	for _, segment := range []*transcriptionpb.TranscriptSegment{
+		{Text: "hello", EndMs: 400},
+		{Text: "hello world", Final: true, EndMs: 900, Confidence: 0.5},
+	} {
+		if err := stream.Send(segment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestTranscriptionManager_GRPCEngine(t *testing.T) {
+	defer eventBus.Store(eventBus.Load())
+	bus := &EventBus{endpoints: []*webhookEndpoint{{queue: make(chan *Event, 10)}}}
+	eventBus.Store(bus)
+
+	received := make(chan engineStream, 1)
+	server := grpc.NewServer()
+	transcriptionpb.RegisterTranscriberServer(server, &testTranscriber{received: received})
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = server.Serve(lis) }()
+	defer server.Stop()
+
+	registry := NewSessionRegistry(time.Hour)
+	defer registry.Stop()
+	session := registry.CreateSession("stt-call", "from-stt")
+
+	manager, err := NewTranscriptionManager(&TranscriptionConfig{Enabled: true, Backend: TranscriptionBackendGRPC,
+		Address: lis.Addr().String(), Token: "secret", SampleRate: 8000, Language: "en-US"}, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Stop()
+	manager.negotiator = NewCodecNegotiator()
+	pcmu := CodecInfo{PayloadType: 0, Name: "PCMU", ClockRate: 8000, Channels: 1}
+	manager.negotiator.SetOfferCodecs("stt-call", []CodecInfo{pcmu})
+	manager.negotiator.BindSSRC(20, "stt-call", true)
+
+	if _, err := manager.StartCall("stt-call", &TranscriptionOptions{Legs: []string{"caller"}}); err != nil {
+		t.Fatalf("StartCall failed: %v", err)
+	}
+	if _, err := manager.StartCall("stt-call", nil); !errors.Is(err, ErrTranscriptionRunning) {
+		t.Errorf("expected ErrTranscriptionRunning, got %v", err)
+	}
+	if !session.GetFlag(TranscribingFlag) {
+		t.Error("transcribed session not flagged")
+	}
+
+	for i := 0; i < 5; i++ {
+		manager.HandleRTP(&rtp.Packet{
+			Header:  rtp.Header{Version: 2, PayloadType: 0, SSRC: 20},
+			Payload: encodeG711("PCMU", make([]int16, 160)),
+		})
+	}
+	if err := manager.StopCall("stt-call"); err != nil {
+		t.Fatalf("StopCall failed: %v", err)
+	}
+	if session.GetFlag(TranscribingFlag) {
+		t.Error("session still flagged after the transcription stopped")
+	}
+
+	var got engineStream
+	select {
+	case got = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("engine received no stream")
+	}
+	want := &transcriptionpb.StreamConfig{CallId: "stt-call", Leg: "caller", SampleRate: 8000, Language: "en-US"}
+	if got.token != "Bearer secret" || !proto.Equal(got.config, want) || got.audio != 5*320 {
+		t.Errorf("unexpected stream: token %q, config %v, %d audio bytes", got.token, got.config, got.audio)
+	}
+
+	// Stop waits for the engine's last segments
+	manager.Stop()
+	var events []*Event
+	for len(events) < 2 {
+		select {
+		case event := <-bus.endpoints[0].queue:
+			events = append(events, event)
+		default:
+			t.Fatalf("expected 2 transcript events, got %d", len(events))
+		}
+	}
+	final := events[1]
+	if events[0].Data["final"] != false || final.Type != EventTranscript || final.CallID != "stt-call" ||
+		final.Data["leg"] != "caller" || final.Data["text"] != "hello world" || final.Data["final"] != true ||
+		final.Data["end_ms"] != int64(900) || final.Data["confidence"] != 0.5 {
+		t.Errorf("unexpected events %+v %+v", events[0], final)
+	}
+}
+
+func TestTranscriptionManager_AutoStartAndLimit(t *testing.T) {
+	defer func(d time.Duration) { transcriptionDrainTimeout = d }(transcriptionDrainTimeout)
+	transcriptionDrainTimeout = 0
+
+	manager, err := NewTranscriptionManager(&TranscriptionConfig{Enabled: true, Backend: TranscriptionBackendWebSocket,
+		URL: "ws://127.0.0.1:1/stt", AutoStart: true, MaxStreams: 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Stop()
+	manager.negotiator = NewCodecNegotiator()
+	pcmu := CodecInfo{PayloadType: 0, Name: "PCMU", ClockRate: 8000, Channels: 1}
+	manager.negotiator.SetOfferCodecs("auto-call", []CodecInfo{pcmu})
+	manager.negotiator.BindSSRC(30, "auto-call", true)
+
+	manager.HandleRTP(&rtp.Packet{Header: rtp.Header{PayloadType: 0, SSRC: 30}, Payload: []byte{0xff}})
+	if _, ok := manager.GetCall("auto-call"); !ok {
+		t.Fatal("auto_start did not start transcribing the call")
+	}
+	if _, err := manager.StartCall("other-call", nil); !errors.Is(err, ErrTranscriptionLimit) {
+		t.Errorf("expected ErrTranscriptionLimit, got %v", err)
+	}
+
+	// A call stopped on request is not restarted by its next packet
+	if err := manager.StopCall("auto-call"); err != nil {
+		t.Fatal(err)
+	}
+	manager.HandleRTP(&rtp.Packet{Header: rtp.Header{PayloadType: 0, SSRC: 30}, Payload: []byte{0xff}})
+	if _, ok := manager.GetCall("auto-call"); ok {
+		t.Error("stopped call restarted by auto_start")
+	}
+}
+
+func TestWebSocketTranscriber(t *testing.T) {
+	server := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		var start websocketTranscriptionControl
+		if err := websocket.JSON.Receive(ws, &start); err != nil || start.Type != "start" ||
+			start.CallID != "ws-call" || start.Leg != "callee" || start.Encoding != "pcm_s16le" ||
+			ws.Request().Header.Get("Authorization") != "Bearer secret" {
+			return
+		}
+		audio := 0
+		for {
+			var msg []byte
+			if err := websocket.Message.Receive(ws, &msg); err != nil {
+				return
+			}
+			var stop websocketTranscriptionControl
+			if json.Unmarshal(msg, &stop) == nil && stop.Type == "stop" {
+				break
+			}
+			audio += len(msg)
+		}
+		_ = websocket.JSON.Send(ws, TranscriptSegment{Text: strings.Repeat("a", audio), Final: true, EndMs: 20})
+	}))
+	defer server.Close()
+
+	backend, err := NewTranscriptionBackend(&TranscriptionConfig{Backend: TranscriptionBackendWebSocket,
+		URL: "ws" + strings.TrimPrefix(server.URL, "http") + "/stt", Token: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	stream, err := backend.Open(context.Background(), TranscriptionStreamInfo{CallID: "ws-call", Leg: "callee", SampleRate: 16000})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer stream.Close()
+	if err := stream.Send(make([]byte, 640)); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+
+	segment, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if len(segment.Text) != 640 || !segment.Final || segment.EndMs != 20 {
+		t.Errorf("unexpected segment %+v", segment)
+	}
+	if _, err := stream.Recv(); !errors.Is(err, io.EOF) {
+		t.Errorf("expected io.EOF once the engine closed, got %v", err)
+	}
+}
+
+func TestValidateTranscriptionConfig(t *testing.T) {
+	valid := TranscriptionConfig{Enabled: true, Backend: TranscriptionBackendGRPC, Address: "stt:50051"}
+	tests := []struct {
+		name   string
+		modify func(c *TranscriptionConfig)
+		ok     bool
+	}{
+		{"valid", func(c *TranscriptionConfig) {}, true},
+		{"disabled", func(c *TranscriptionConfig) { *c = TranscriptionConfig{} }, true},
+		{"websocket", func(c *TranscriptionConfig) { c.Backend = "websocket"; c.URL = "wss://stt.example.com/v1" }, true},
+		{"no address", func(c *TranscriptionConfig) { c.Address = "" }, false},
+		{"http url", func(c *TranscriptionConfig) { c.Backend = "websocket"; c.URL = "https://stt.example.com" }, false},
+		{"bad backend", func(c *TranscriptionConfig) { c.Backend = "rest" }, false},
+		{"bad sample rate", func(c *TranscriptionConfig) { c.SampleRate = 48000 }, false},
+		{"negative max streams", func(c *TranscriptionConfig) { c.MaxStreams = -1 }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid
+			tt.modify(&c)
+			if err := ValidateTranscriptionConfig(&Config{Transcription: &c}); (err == nil) != tt.ok {
+				t.Errorf("ValidateTranscriptionConfig() error = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,5 @@
+// Package transcriptionpb holds the protobuf and gRPC code generated from
+// transcription.proto, the contract of gRPC speech-to-text engines
+package transcriptionpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative transcription.proto
@@ -0,0 +1,341 @@
+// Contract between Karl and a gRPC speech-to-text engine.
+//
+// Karl opens one Transcribe stream per transcribed call leg. The first
+// request carries the stream config, every later one 16-bit little-endian
+// mono PCM at the configured sample rate. Karl half-closes the stream when
+// the leg's audio ends; the engine then sends its last segments and ends
+// the call. A bearer token, when configured, is sent in the authorization
+// metadata.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: transcription.proto
+
+package transcriptionpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type AudioRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Request:
+	//
+	//	*AudioRequest_Config
+	//	*AudioRequest_Audio
+	Request       isAudioRequest_Request `protobuf_oneof:"request"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AudioRequest) Reset() {
+	*x = AudioRequest{}
+	mi := &file_transcription_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AudioRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AudioRequest) ProtoMessage() {}
+
+func (x *AudioRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_transcription_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AudioRequest.ProtoReflect.Descriptor instead.
+func (*AudioRequest) Descriptor() ([]byte, []int) {
+	return file_transcription_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *AudioRequest) GetRequest() isAudioRequest_Request {
+	if x != nil {
+		return x.Request
+	}
+	return nil
+}
+
+func (x *AudioRequest) GetConfig() *StreamConfig {
+	if x != nil {
+		if x, ok := x.Request.(*AudioRequest_Config); ok {
+			return x.Config
+		}
+	}
+	return nil
+}
+
+func (x *AudioRequest) GetAudio() []byte {
+	if x != nil {
+		if x, ok := x.Request.(*AudioRequest_Audio); ok {
+			return x.Audio
+		}
+	}
+	return nil
+}
+
+type isAudioRequest_Request interface {
+	isAudioRequest_Request()
+}
+
+type AudioRequest_Config struct {
+	Config *StreamConfig `protobuf:"bytes,1,opt,name=config,proto3,oneof"`
+}
+
+type AudioRequest_Audio struct {
+	Audio []byte `protobuf:"bytes,2,opt,name=audio,proto3,oneof"`
+}
+
+func (*AudioRequest_Config) isAudioRequest_Request() {}
+
+func (*AudioRequest_Audio) isAudioRequest_Request() {}
+
+type StreamConfig struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	CallId        string                 `protobuf:"bytes,1,opt,name=call_id,json=callId,proto3" json:"call_id,omitempty"`
+	Leg           string                 `protobuf:"bytes,2,opt,name=leg,proto3" json:"leg,omitempty"`                                  // caller or callee
+	SampleRate    uint32                 `protobuf:"varint,3,opt,name=sample_rate,json=sampleRate,proto3" json:"sample_rate,omitempty"` // 8000 or 16000
+	Language      string                 `protobuf:"bytes,4,opt,name=language,proto3" json:"language,omitempty"`                        // BCP 47 tag, empty for the engine's default
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StreamConfig) Reset() {
+	*x = StreamConfig{}
+	mi := &file_transcription_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StreamConfig) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StreamConfig) ProtoMessage() {}
+
+func (x *StreamConfig) ProtoReflect() protoreflect.Message {
+	mi := &file_transcription_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StreamConfig.ProtoReflect.Descriptor instead.
+func (*StreamConfig) Descriptor() ([]byte, []int) {
+	return file_transcription_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *StreamConfig) GetCallId() string {
+	if x != nil {
+		return x.CallId
+	}
+	return ""
+}
+
+func (x *StreamConfig) GetLeg() string {
+	if x != nil {
+		return x.Leg
+	}
+	return ""
+}
+
+func (x *StreamConfig) GetSampleRate() uint32 {
+	if x != nil {
+		return x.SampleRate
+	}
+	return 0
+}
+
+func (x *StreamConfig) GetLanguage() string {
+	if x != nil {
+		return x.Language
+	}
+	return ""
+}
+
+type TranscriptSegment struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Text          string                 `protobuf:"bytes,1,opt,name=text,proto3" json:"text,omitempty"`
+	Final         bool                   `protobuf:"varint,2,opt,name=final,proto3" json:"final,omitempty"`                    // Partial segments are revised until a final one
+	StartMs       uint64                 `protobuf:"varint,3,opt,name=start_ms,json=startMs,proto3" json:"start_ms,omitempty"` // Offsets from the start of the stream
+	EndMs         uint64                 `protobuf:"varint,4,opt,name=end_ms,json=endMs,proto3" json:"end_ms,omitempty"`
+	Confidence    float32                `protobuf:"fixed32,5,opt,name=confidence,proto3" json:"confidence,omitempty"` // 0 when unknown
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TranscriptSegment) Reset() {
+	*x = TranscriptSegment{}
+	mi := &file_transcription_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TranscriptSegment) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TranscriptSegment) ProtoMessage() {}
+
+func (x *TranscriptSegment) ProtoReflect() protoreflect.Message {
+	mi := &file_transcription_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TranscriptSegment.ProtoReflect.Descriptor instead.
+func (*TranscriptSegment) Descriptor() ([]byte, []int) {
+	return file_transcription_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *TranscriptSegment) GetText() string {
+	if x != nil {
+		return x.Text
+	}
+	return ""
+}
+
+func (x *TranscriptSegment) GetFinal() bool {
+	if x != nil {
+		return x.Final
+	}
+	return false
+}
+
+func (x *TranscriptSegment) GetStartMs() uint64 {
+	if x != nil {
+		return x.StartMs
+	}
+	return 0
+}
+
+func (x *TranscriptSegment) GetEndMs() uint64 {
+	if x != nil {
+		return x.EndMs
+	}
+	return 0
+}
+
+func (x *TranscriptSegment) GetConfidence() float32 {
+	if x != nil {
+		return x.Confidence
+	}
+	return 0
+}
+
+var File_transcription_proto protoreflect.FileDescriptor
+
+const file_transcription_proto_rawDesc = "" +
+	"\n" +
+	"\x13transcription.proto\x12\x15karl.transcription.v1\"p\n" +
+	"\fAudioRequest\x12=\n" +
+	"\x06config\x18\x01 \x01(\v2#.karl.transcription.v1.StreamConfigH\x00R\x06config\x12\x16\n" +
+	"\x05audio\x18\x02 \x01(\fH\x00R\x05audioB\t\n" +
+	"\arequest\"v\n" +
+	"\fStreamConfig\x12\x17\n" +
+	"\acall_id\x18\x01 \x01(\tR\x06callId\x12\x10\n" +
+	"\x03leg\x18\x02 \x01(\tR\x03leg\x12\x1f\n" +
+	"\vsample_rate\x18\x03 \x01(\rR\n" +
+	"sampleRate\x12\x1a\n" +
+	"\blanguage\x18\x04 \x01(\tR\blanguage\"\x8f\x01\n" +
+	"\x11TranscriptSegment\x12\x12\n" +
+	"\x04text\x18\x01 \x01(\tR\x04text\x12\x14\n" +
+	"\x05final\x18\x02 \x01(\bR\x05final\x12\x19\n" +
+	"\bstart_ms\x18\x03 \x01(\x04R\astartMs\x12\x15\n" +
+	"\x06end_ms\x18\x04 \x01(\x04R\x05endMs\x12\x1e\n" +
+	"\n" +
+	"confidence\x18\x05 \x01(\x02R\n" +
+	"confidence2n\n" +
+	"\vTranscriber\x12_\n" +
+	"\n" +
+	"Transcribe\x12#.karl.transcription.v1.AudioRequest\x1a(.karl.transcription.v1.TranscriptSegment(\x010\x01B\x1fZ\x1dkarl/internal/transcriptionpbb\x06proto3"
+
+var (
+	file_transcription_proto_rawDescOnce sync.Once
+	file_transcription_proto_rawDescData []byte
+)
+
+func file_transcription_proto_rawDescGZIP() []byte {
+	file_transcription_proto_rawDescOnce.Do(func() {
+		file_transcription_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_transcription_proto_rawDesc), len(file_transcription_proto_rawDesc)))
+	})
+	return file_transcription_proto_rawDescData
+}
+
+var file_transcription_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
+var file_transcription_proto_goTypes = []any{
+	(*AudioRequest)(nil),      // 0: karl.transcription.v1.AudioRequest
+	(*StreamConfig)(nil),      // 1: karl.transcription.v1.StreamConfig
+	(*TranscriptSegment)(nil), // 2: karl.transcription.v1.TranscriptSegment
+}
+var file_transcription_proto_depIdxs = []int32{
+	1, // 0: karl.transcription.v1.AudioRequest.config:type_name -> karl.transcription.v1.StreamConfig
+	0, // 1: karl.transcription.v1.Transcriber.Transcribe:input_type -> karl.transcription.v1.AudioRequest
+	2, // 2: karl.transcription.v1.Transcriber.Transcribe:output_type -> karl.transcription.v1.TranscriptSegment
+	2, // [2:3] is the sub-list for method output_type
+	1, // [1:2] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_transcription_proto_init() }
+func file_transcription_proto_init() {
+	if File_transcription_proto != nil {
+		return
+	}
+	file_transcription_proto_msgTypes[0].OneofWrappers = []any{
+		(*AudioRequest_Config)(nil),
+		(*AudioRequest_Audio)(nil),
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_transcription_proto_rawDesc), len(file_transcription_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   3,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_transcription_proto_goTypes,
+		DependencyIndexes: file_transcription_proto_depIdxs,
+		MessageInfos:      file_transcription_proto_msgTypes,
+	}.Build()
+	File_transcription_proto = out.File
+	file_transcription_proto_goTypes = nil
+	file_transcription_proto_depIdxs = nil
+}
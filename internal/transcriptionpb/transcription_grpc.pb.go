@@ -0,0 +1,124 @@
+// Contract between Karl and a gRPC speech-to-text engine.
+//
+// Karl opens one Transcribe stream per transcribed call leg. The first
+// request carries the stream config, every later one 16-bit little-endian
+// mono PCM at the configured sample rate. Karl half-closes the stream when
+// the leg's audio ends; the engine then sends its last segments and ends
+// the call. A bearer token, when configured, is sent in the authorization
+// metadata.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: transcription.proto
+
+package transcriptionpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Transcriber_Transcribe_FullMethodName = "/karl.transcription.v1.Transcriber/Transcribe"
+)
+
+// TranscriberClient is the client API for Transcriber service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type TranscriberClient interface {
+	Transcribe(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[AudioRequest, TranscriptSegment], error)
+}
+
+type transcriberClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewTranscriberClient(cc grpc.ClientConnInterface) TranscriberClient {
+	return &transcriberClient{cc}
+}
+
+func (c *transcriberClient) Transcribe(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[AudioRequest, TranscriptSegment], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Transcriber_ServiceDesc.Streams[0], Transcriber_Transcribe_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[AudioRequest, TranscriptSegment]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Transcriber_TranscribeClient = grpc.BidiStreamingClient[AudioRequest, TranscriptSegment]
+
+// TranscriberServer is the server API for Transcriber service.
+// All implementations must embed UnimplementedTranscriberServer
+// for forward compatibility.
+type TranscriberServer interface {
+	Transcribe(grpc.BidiStreamingServer[AudioRequest, TranscriptSegment]) error
+	mustEmbedUnimplementedTranscriberServer()
+}
+
+// UnimplementedTranscriberServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedTranscriberServer struct{}
+
+func (UnimplementedTranscriberServer) Transcribe(grpc.BidiStreamingServer[AudioRequest, TranscriptSegment]) error {
+	return status.Errorf(codes.Unimplemented, "method Transcribe not implemented")
+}
+func (UnimplementedTranscriberServer) mustEmbedUnimplementedTranscriberServer() {}
+func (UnimplementedTranscriberServer) testEmbeddedByValue()                     {}
+
+// UnsafeTranscriberServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to TranscriberServer will
+// result in compilation errors.
+type UnsafeTranscriberServer interface {
+	mustEmbedUnimplementedTranscriberServer()
+}
+
+func RegisterTranscriberServer(s grpc.ServiceRegistrar, srv TranscriberServer) {
+	// If the following call pancis, it indicates UnimplementedTranscriberServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Transcriber_ServiceDesc, srv)
+}
+
+func _Transcriber_Transcribe_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(TranscriberServer).Transcribe(&grpc.GenericServerStream[AudioRequest, TranscriptSegment]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Transcriber_TranscribeServer = grpc.BidiStreamingServer[AudioRequest, TranscriptSegment]
+
+// Transcriber_ServiceDesc is the grpc.ServiceDesc for Transcriber service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Transcriber_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "karl.transcription.v1.Transcriber",
+	HandlerType: (*TranscriberServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Transcribe",
+			Handler:       _Transcriber_Transcribe_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "transcription.proto",
+}
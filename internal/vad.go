@@ -0,0 +1,240 @@
+package internal
+
+import "math"
+
+// VADMode selects how readily the VAD classifies a frame as noise, like the
+// aggressiveness modes of the WebRTC VAD
+type VADMode int
+
+const (
+	VADModeQuality        VADMode = iota // keeps the most speech, the default
+	VADModeLowBitrate                    // suppresses some noise
+	VADModeAggressive                    // suppresses more noise
+	VADModeVeryAggressive                // suppresses the most noise
+)
+
+// VAD tuning
+const (
+	vadSilenceLevel  = -100.0 // band level in dBov of digital silence
+	vadStartupFloor  = -70.0  // noise floor assumed until a window has passed
+	vadSmoothing     = 0.5    // weight of the previous band level in smoothing
+	vadWindowMs      = 3000   // noise floor window
+	vadSubWindows    = 6      // the window is tracked in sub-window minima
+	vadMaxHangoverMs = 2000   // longest configurable hangover
+)
+
+// vadBandEdges are the analysis bands in Hz, as in the WebRTC VAD
+var vadBandEdges = []float64{80, 250, 500, 1000, 2000, 3000, 4000}
+
+// vadThresholds are the per-mode decision parameters
+var vadThresholds = [...]struct {
+	band       float64 // band SNR in dB that counts as speech
+	total      float64 // sum of band SNRs above zero that counts as speech
+	minLevel   float64 // frame level in dBov below which nothing is speech
+	hangoverMs int     // time speech is held after the last speech frame
+}{
+	VADModeQuality:        {band: 9, total: 15, minLevel: -60, hangoverMs: 300},
+	VADModeLowBitrate:     {band: 10, total: 18, minLevel: -55, hangoverMs: 200},
+	VADModeAggressive:     {band: 12, total: 22, minLevel: -50, hangoverMs: 120},
+	VADModeVeryAggressive: {band: 14, total: 26, minLevel: -45, hangoverMs: 60},
+}
+
+// VADConfig configures a VAD
+type VADConfig struct {
+	Mode       VADMode
+	HangoverMs int // time speech is held after it ends, 0 for the mode's default
+}
+
+// vadBand tracks one analysis band: a band-pass filter, its smoothed level
+// and the minima the noise floor is taken from
+type vadBand struct {
+	b0, b2, a1, a2 float64 // band-pass biquad, b1 is zero
+	x1, x2, y1, y2 float64
+
+	level   float64   // smoothed level in dBov
+	current float64   // minimum of the current sub-window
+	minima  []float64 // minima of the previous sub-windows
+}
+
+// VAD is a multi-band energy voice activity detector. Each band's noise
+// floor is the minimum of its level over the last few seconds, so steady
+// background noise is not mistaken for speech as it is by IsVoiceActive.
+// Speech is held for a hangover time so word endings are not clipped
+type VAD struct {
+	sampleRate int
+	mode       VADMode
+	hangover   int // hangover in samples
+	bands      []vadBand
+
+	subWindow int  // samples per sub-window
+	elapsed   int  // samples in the current sub-window
+	held      int  // hangover samples left
+	speech    bool // the last frame was speech, not hangover
+	started   bool
+}
+
+// NewVAD creates a VAD for mono PCM at sampleRate
+func NewVAD(sampleRate int, config VADConfig) *VAD {
+	mode := config.Mode
+	if mode < VADModeQuality || mode > VADModeVeryAggressive {
+		mode = VADModeQuality
+	}
+	hangoverMs := config.HangoverMs
+	if hangoverMs <= 0 {
+		hangoverMs = vadThresholds[mode].hangoverMs
+	}
+	if hangoverMs > vadMaxHangoverMs {
+		hangoverMs = vadMaxHangoverMs
+	}
+
+	v := &VAD{
+		sampleRate: sampleRate,
+		mode:       mode,
+		hangover:   hangoverMs * sampleRate / 1000,
+		subWindow:  vadWindowMs / vadSubWindows * sampleRate / 1000,
+	}
+	nyquist := float64(sampleRate) / 2
+	for i := 0; i+1 < len(vadBandEdges); i++ {
+		low, high := vadBandEdges[i], math.Min(vadBandEdges[i+1], nyquist*0.95)
+		if low >= high {
+			break
+		}
+		v.bands = append(v.bands, newVADBand(low, high, float64(sampleRate)))
+	}
+	return v
+}
+
+// newVADBand designs a constant 0 dB peak gain band-pass filter
+func newVADBand(low, high, sampleRate float64) vadBand {
+	center := math.Sqrt(low * high)
+	w0 := 2 * math.Pi * center / sampleRate
+	alpha := math.Sin(w0) / (2 * center / (high - low))
+	a0 := 1 + alpha
+	return vadBand{
+		b0:      alpha / a0,
+		b2:      -alpha / a0,
+		a1:      -2 * math.Cos(w0) / a0,
+		a2:      (1 - alpha) / a0,
+		level:   vadSilenceLevel,
+		current: math.Inf(1),
+	}
+}
+
+// Process classifies a frame of mono PCM, returning true for speech
+// (including the hangover after it)
+func (v *VAD) Process(pcm []int16) bool {
+	if len(pcm) == 0 || len(v.bands) == 0 {
+		return false
+	}
+	limits := vadThresholds[v.mode]
+	frameLevel := powerLevel(pcmPower(pcm))
+
+	var total float64
+	speechBands := 0
+	for i := range v.bands {
+		band := &v.bands[i]
+		level := powerLevel(band.filter(pcm))
+		if v.started {
+			level = vadSmoothing*band.level + (1-vadSmoothing)*level
+		}
+		band.level = level
+
+		snr := level - band.floor()
+		if snr > limits.band {
+			speechBands++
+		}
+		if snr > 0 {
+			total += snr
+		}
+		band.current = math.Min(band.current, level)
+	}
+	v.started = true
+
+	// Start a new sub-window, dropping the oldest once the window is full
+	v.elapsed += len(pcm)
+	if v.elapsed >= v.subWindow {
+		v.elapsed = 0
+		for i := range v.bands {
+			band := &v.bands[i]
+			band.minima = append(band.minima, band.current)
+			if len(band.minima) > vadSubWindows {
+				band.minima = band.minima[1:]
+			}
+			band.current = math.Inf(1)
+		}
+	}
+
+	v.speech = frameLevel > limits.minLevel && speechBands > 0 && total > limits.total
+	if v.speech {
+		v.held = v.hangover
+		return true
+	}
+	if v.held > 0 {
+		v.held -= len(pcm)
+		return true
+	}
+	return false
+}
+
+// calibrated reports whether the noise floor has been measured, rather than
+// assumed as at the start of a stream
+func (v *VAD) calibrated() bool {
+	return len(v.bands) > 0 && len(v.bands[0].minima) > 0
+}
+
+// Reset forgets the noise floor and any hangover, e.g. after a codec change
+func (v *VAD) Reset() {
+	for i := range v.bands {
+		band := &v.bands[i]
+		band.x1, band.x2, band.y1, band.y2 = 0, 0, 0, 0
+		band.level = vadSilenceLevel
+		band.current = math.Inf(1)
+		band.minima = nil
+	}
+	v.elapsed, v.held, v.speech, v.started = 0, 0, false, false
+}
+
+// filter runs a frame through the band's filter and returns its mean power
+func (b *vadBand) filter(pcm []int16) float64 {
+	var sum float64
+	for _, s := range pcm {
+		x := float64(s) / pcmMaxAmplitude
+		y := b.b0*x + b.b2*b.x2 - b.a1*b.y1 - b.a2*b.y2
+		b.x2, b.x1 = b.x1, x
+		b.y2, b.y1 = b.y1, y
+		sum += y * y
+	}
+	return sum / float64(len(pcm))
+}
+
+// floor returns the band's noise floor: the lowest level of the window.
+// Until the first sub-window has passed the floor is assumed low, so the
+// VAD leans towards speech at the start of a stream
+func (b *vadBand) floor() float64 {
+	floor := math.Min(b.current, vadStartupFloor)
+	if len(b.minima) > 0 {
+		floor = b.current
+		for _, m := range b.minima {
+			floor = math.Min(floor, m)
+		}
+	}
+	return floor
+}
+
+// pcmPower returns the mean power of PCM samples relative to full scale
+func pcmPower(pcm []int16) float64 {
+	var sum float64
+	for _, s := range pcm {
+		x := float64(s) / pcmMaxAmplitude
+		sum += x * x
+	}
+	return sum / float64(len(pcm))
+}
+
+// powerLevel converts a mean power into dBov
+func powerLevel(power float64) float64 {
+	if power <= 0 {
+		return vadSilenceLevel
+	}
+	return math.Max(10*math.Log10(power), vadSilenceLevel)
+}
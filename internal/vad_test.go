@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// vadNoise returns white noise at level dBov
+func vadNoise(r *rand.Rand, n int, level float64) []int16 {
+	amp := math.Pow(10, level/20) * pcmMaxAmplitude
+	samples := make([]int16, n)
+	for i := range samples {
+		samples[i] = int16(r.NormFloat64() * amp)
+	}
+	return samples
+}
+
+// vadSpeech returns a voiced, syllable-modulated signal: a 150 Hz harmonic
+// series at about level dBov with a 4 Hz envelope, added onto pcm
+func vadSpeech(pcm []int16, start, rate int, level float64) []int16 {
+	amp := math.Pow(10, level/20) * pcmMaxAmplitude
+	for i := range pcm {
+		t := float64(start+i) / float64(rate)
+		var s float64
+		for h := 1; h <= 10; h++ {
+			s += math.Sin(2*math.Pi*150*float64(h)*t) / float64(h)
+		}
+		envelope := 0.5 + 0.5*math.Sin(2*math.Pi*4*t)
+		pcm[i] += int16(amp * envelope * s / 2)
+	}
+	return pcm
+}
+
+func TestVAD_BackgroundNoise(t *testing.T) {
+	for _, rate := range []int{8000, 48000} {
+		frame := rate / 50
+		for mode := VADModeQuality; mode <= VADModeVeryAggressive; mode++ {
+			r := rand.New(rand.NewSource(1))
+			vad := NewVAD(rate, VADConfig{Mode: mode})
+
+			// -35 dBov noise is loud enough to fool the level threshold
+			if !IsVoiceActive(vadNoise(r, frame, -35)) {
+				t.Fatal("expected the noise to be above the RMS threshold")
+			}
+
+			falseAlarms := 0
+			for i := 0; i < 250; i++ {
+				if vad.Process(vadNoise(r, frame, -35)) && i >= 150 {
+					falseAlarms++
+				}
+			}
+			if falseAlarms > 0 {
+				t.Errorf("%d Hz mode %d: %d noise frames taken as speech", rate, mode, falseAlarms)
+			}
+
+			detected := 0
+			for i := 0; i < 50; i++ {
+				if vad.Process(vadSpeech(vadNoise(r, frame, -35), i*frame, rate, -20)) {
+					detected++
+				}
+			}
+			if detected < 35 {
+				t.Errorf("%d Hz mode %d: only %d of 50 speech frames detected", rate, mode, detected)
+			}
+		}
+	}
+}
+
+func TestVAD_Hangover(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	vad := NewVAD(8000, VADConfig{Mode: VADModeAggressive, HangoverMs: 100})
+	for i := 0; i < 100; i++ {
+		vad.Process(vadNoise(r, 160, -50))
+	}
+	if !vad.Process(vadSpeech(vadNoise(r, 160, -50), 400, 8000, -15)) {
+		t.Fatal("expected speech to be detected")
+	}
+
+	// 100 ms of hangover holds speech for five 20 ms frames once the
+	// smoothed band levels have fallen
+	held := 0
+	for i := 0; i < 10; i++ {
+		if vad.Process(vadNoise(r, 160, -50)) {
+			held++
+		}
+	}
+	if held < 5 || held > 7 {
+		t.Errorf("expected 5 frames of hangover, got %d", held)
+	}
+
+	vad.Reset()
+	if vad.Process(make([]int16, 160)) {
+		t.Error("expected digital silence to be noise")
+	}
+}
+
+func TestNewVAD_Defaults(t *testing.T) {
+	vad := NewVAD(8000, VADConfig{Mode: 7})
+	if vad.mode != VADModeQuality {
+		t.Errorf("expected an invalid mode to fall back to quality, got %d", vad.mode)
+	}
+	if vad.hangover != 300*8 {
+		t.Errorf("expected the mode's 300 ms hangover, got %d samples", vad.hangover)
+	}
+	if len(vad.bands) != 6 || len(NewVAD(16000, VADConfig{}).bands) != 6 {
+		t.Errorf("expected 6 analysis bands, got %d", len(vad.bands))
+	}
+}
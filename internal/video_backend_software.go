@@ -0,0 +1,383 @@
+//go:build karl_video && cgo
+
+package internal
+
+/*
+#cgo pkg-config: vpx openh264
+#include <stdlib.h>
+#include <string.h>
+#include <vpx/vpx_decoder.h>
+#include <vpx/vpx_encoder.h>
+#include <vpx/vp8dx.h>
+#include <vpx/vp8cx.h>
+#include <wels/codec_api.h>
+
+static int karl_vpx_dec_init(vpx_codec_ctx_t *ctx, int vp9) {
+	return vpx_codec_dec_init(ctx, vp9 ? vpx_codec_vp9_dx() : vpx_codec_vp8_dx(), NULL, 0);
+}
+
+static int karl_vpx_enc_init(vpx_codec_ctx_t *ctx, int width, int height, int bitrate) {
+	vpx_codec_enc_cfg_t cfg;
+	if (vpx_codec_enc_config_default(vpx_codec_vp8_cx(), &cfg, 0) != VPX_CODEC_OK) {
+		return -1;
+	}
+	cfg.g_w = width;
+	cfg.g_h = height;
+	cfg.g_timebase.num = 1;
+	cfg.g_timebase.den = 90000;
+	cfg.rc_target_bitrate = bitrate / 1000;
+	cfg.rc_end_usage = VPX_CBR;
+	cfg.g_lag_in_frames = 0;
+	cfg.g_error_resilient = VPX_ERROR_RESILIENT_DEFAULT;
+	cfg.kf_mode = VPX_KF_AUTO;
+	cfg.kf_max_dist = 3000;
+	if (vpx_codec_enc_init(ctx, vpx_codec_vp8_cx(), &cfg, 0) != VPX_CODEC_OK) {
+		return -1;
+	}
+	vpx_codec_control(ctx, VP8E_SET_CPUUSED, 8);
+	return 0;
+}
+
+// karl_vpx_encode encodes an I420 picture and copies the frame into out,
+// returning its size, 0 for none, or -1 on failure
+static int karl_vpx_encode(vpx_codec_ctx_t *ctx, unsigned char *picture, int width, int height,
+		long long pts, int keyframe, unsigned char *out, int out_size) {
+	vpx_image_t img;
+	vpx_img_wrap(&img, VPX_IMG_FMT_I420, width, height, 1, picture);
+	if (vpx_codec_encode(ctx, &img, pts, 3000, keyframe ? VPX_EFLAG_FORCE_KF : 0, VPX_DL_REALTIME) != VPX_CODEC_OK) {
+		return -1;
+	}
+	int size = 0;
+	vpx_codec_iter_t iter = NULL;
+	const vpx_codec_cx_pkt_t *pkt;
+	while ((pkt = vpx_codec_get_cx_data(ctx, &iter)) != NULL) {
+		if (pkt->kind != VPX_CODEC_CX_FRAME_PKT) {
+			continue;
+		}
+		if (size + (int)pkt->data.frame.sz > out_size) {
+			return -1;
+		}
+		memcpy(out + size, pkt->data.frame.buf, pkt->data.frame.sz);
+		size += pkt->data.frame.sz;
+	}
+	return size;
+}
+
+static int karl_h264_enc_init(ISVCEncoder **enc, int width, int height, int bitrate) {
+	if (WelsCreateSVCEncoder(enc) != 0) {
+		return -1;
+	}
+	SEncParamBase param;
+	memset(&param, 0, sizeof(param));
+	param.iUsageType = CAMERA_VIDEO_REAL_TIME;
+	param.iPicWidth = width;
+	param.iPicHeight = height;
+	param.iTargetBitrate = bitrate;
+	param.iRCMode = RC_BITRATE_MODE;
+	param.fMaxFrameRate = 30;
+	if ((**enc)->Initialize(*enc, &param) != 0) {
+		WelsDestroySVCEncoder(*enc);
+		return -1;
+	}
+	return 0;
+}
+
+// karl_h264_encode encodes an I420 picture into an Annex B access unit in
+// out, returning its size, 0 for a skipped picture, or -1 on failure
+static int karl_h264_encode(ISVCEncoder *enc, unsigned char *picture, int width, int height,
+		long long ms, int keyframe, unsigned char *out, int out_size) {
+	if (keyframe) {
+		(*enc)->ForceIntraFrame(enc, 1);
+	}
+	SSourcePicture pic;
+	memset(&pic, 0, sizeof(pic));
+	pic.iColorFormat = videoFormatI420;
+	pic.iPicWidth = width;
+	pic.iPicHeight = height;
+	pic.iStride[0] = width;
+	pic.iStride[1] = pic.iStride[2] = width / 2;
+	pic.pData[0] = picture;
+	pic.pData[1] = picture + width * height;
+	pic.pData[2] = pic.pData[1] + (width / 2) * (height / 2);
+	pic.uiTimeStamp = ms;
+
+	SFrameBSInfo info;
+	memset(&info, 0, sizeof(info));
+	if ((*enc)->EncodeFrame(enc, &pic, &info) != cmResultSuccess) {
+		return -1;
+	}
+	if (info.eFrameType == videoFrameTypeSkip) {
+		return 0;
+	}
+	int size = 0;
+	for (int i = 0; i < info.iLayerNum; i++) {
+		SLayerBSInfo *layer = &info.sLayerInfo[i];
+		int layerSize = 0;
+		for (int j = 0; j < layer->iNalCount; j++) {
+			layerSize += layer->pNalLengthInByte[j];
+		}
+		if (size + layerSize > out_size) {
+			return -1;
+		}
+		memcpy(out + size, layer->pBsBuf, layerSize);
+		size += layerSize;
+	}
+	return size;
+}
+
+static void karl_h264_enc_close(ISVCEncoder *enc) {
+	(*enc)->Uninitialize(enc);
+	WelsDestroySVCEncoder(enc);
+}
+
+static int karl_h264_dec_init(ISVCDecoder **dec) {
+	if (WelsCreateDecoder(dec) != 0) {
+		return -1;
+	}
+	SDecodingParam param;
+	memset(&param, 0, sizeof(param));
+	param.sVideoProperty.eVideoBsType = VIDEO_BITSTREAM_AVC;
+	if ((**dec)->Initialize(*dec, &param) != 0) {
+		WelsDestroyDecoder(*dec);
+		return -1;
+	}
+	return 0;
+}
+
+// karl_h264_decode decodes an access unit, returning 1 with the planes of
+// the picture in planes, 0 while there is none, or -1 on failure
+static int karl_h264_decode(ISVCDecoder *dec, unsigned char *frame, int size,
+		unsigned char **planes, int *width, int *height, int *strides) {
+	SBufferInfo info;
+	memset(&info, 0, sizeof(info));
+	if ((*dec)->DecodeFrameNoDelay(dec, frame, size, planes, &info) != dsErrorFree) {
+		return -1;
+	}
+	if (info.iBufferStatus != 1) {
+		return 0;
+	}
+	*width = info.UsrData.sSystemBuffer.iWidth;
+	*height = info.UsrData.sSystemBuffer.iHeight;
+	strides[0] = info.UsrData.sSystemBuffer.iStride[0];
+	strides[1] = info.UsrData.sSystemBuffer.iStride[1];
+	return 1;
+}
+
+static void karl_h264_dec_close(ISVCDecoder *dec) {
+	(*dec)->Uninitialize(dec);
+	WelsDestroyDecoder(dec);
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// Software video codecs: libvpx decodes VP8 and VP9 and encodes VP8, and
+// Cisco's OpenH264 decodes and encodes H.264 (Constrained Baseline).
+// OpenH264 is BSD licensed, but only Cisco's prebuilt library is covered
+// by its H.264 patent license; check your distribution's terms
+func init() {
+	RegisterVideoBackend(softwareVideoBackend{})
+}
+
+type softwareVideoBackend struct{}
+
+func (softwareVideoBackend) Name() string       { return "software" }
+func (softwareVideoBackend) Decoders() []string { return []string{"VP8", "VP9", "H264"} }
+func (softwareVideoBackend) Encoders() []string { return []string{"VP8", "H264"} }
+
+func (softwareVideoBackend) NewDecoder(codec string) (VideoDecoder, error) {
+	switch codec {
+	case "VP8", "VP9":
+		d := &vpxDecoder{ctx: (*C.vpx_codec_ctx_t)(C.calloc(1, C.sizeof_vpx_codec_ctx_t))}
+		vp9 := C.int(0)
+		if codec == "VP9" {
+			vp9 = 1
+		}
+		if C.karl_vpx_dec_init(d.ctx, vp9) != 0 {
+			C.free(unsafe.Pointer(d.ctx))
+			return nil, fmt.Errorf("libvpx failed to start a %s decoder", codec)
+		}
+		return d, nil
+	case "H264":
+		d := &h264Decoder{}
+		if C.karl_h264_dec_init(&d.dec) != 0 {
+			return nil, fmt.Errorf("OpenH264 failed to start a decoder")
+		}
+		return d, nil
+	}
+	return nil, fmt.Errorf("no software decoder for %s", codec)
+}
+
+func (softwareVideoBackend) NewEncoder(codec string, config VideoEncoderConfig) (VideoEncoder, error) {
+	switch codec {
+	case "VP8":
+		e := &vpxEncoder{ctx: (*C.vpx_codec_ctx_t)(C.calloc(1, C.sizeof_vpx_codec_ctx_t)), config: config}
+		if C.karl_vpx_enc_init(e.ctx, C.int(config.Width), C.int(config.Height), C.int(config.Bitrate)) != 0 {
+			C.free(unsafe.Pointer(e.ctx))
+			return nil, fmt.Errorf("libvpx failed to start a VP8 encoder")
+		}
+		return e, nil
+	case "H264":
+		e := &h264Encoder{config: config}
+		if C.karl_h264_enc_init(&e.enc, C.int(config.Width), C.int(config.Height), C.int(config.Bitrate)) != 0 {
+			return nil, fmt.Errorf("OpenH264 failed to start an encoder")
+		}
+		return e, nil
+	}
+	return nil, fmt.Errorf("no software encoder for %s", codec)
+}
+
+// vpxDecoder decodes VP8 or VP9 with libvpx
+type vpxDecoder struct {
+	ctx *C.vpx_codec_ctx_t
+}
+
+func (d *vpxDecoder) Decode(frame []byte) (*VideoFrame, error) {
+	if len(frame) == 0 {
+		return nil, nil
+	}
+	if C.vpx_codec_decode(d.ctx, (*C.uint8_t)(unsafe.Pointer(&frame[0])), C.uint(len(frame)), nil, 0) != C.VPX_CODEC_OK {
+		return nil, fmt.Errorf("%s", C.GoString(C.vpx_codec_error(d.ctx)))
+	}
+	var iter C.vpx_codec_iter_t
+	img := C.vpx_codec_get_frame(d.ctx, &iter)
+	if img == nil {
+		return nil, nil
+	}
+	width, height := int(img.d_w), int(img.d_h)
+	return &VideoFrame{
+		Width:  width,
+		Height: height,
+		Y:      copyPlane(unsafe.Pointer(img.planes[0]), int(img.stride[0]), width, height),
+		U:      copyPlane(unsafe.Pointer(img.planes[1]), int(img.stride[1]), (width+1)/2, (height+1)/2),
+		V:      copyPlane(unsafe.Pointer(img.planes[2]), int(img.stride[2]), (width+1)/2, (height+1)/2),
+	}, nil
+}
+
+func (d *vpxDecoder) Close() error {
+	C.vpx_codec_destroy(d.ctx)
+	C.free(unsafe.Pointer(d.ctx))
+	return nil
+}
+
+// vpxEncoder encodes VP8 with libvpx
+type vpxEncoder struct {
+	ctx    *C.vpx_codec_ctx_t
+	config VideoEncoderConfig
+	out    []byte
+}
+
+func (e *vpxEncoder) Encode(picture *VideoFrame, keyframe bool) ([]byte, error) {
+	buf := packI420(picture)
+	e.out = growFrameBuffer(e.out, len(buf))
+	n := C.karl_vpx_encode(e.ctx, (*C.uchar)(unsafe.Pointer(&buf[0])), C.int(picture.Width), C.int(picture.Height),
+		C.longlong(picture.Timestamp), cBool(keyframe), (*C.uchar)(unsafe.Pointer(&e.out[0])), C.int(len(e.out)))
+	if n < 0 {
+		return nil, fmt.Errorf("%s", C.GoString(C.vpx_codec_error(e.ctx)))
+	}
+	return append([]byte(nil), e.out[:n]...), nil
+}
+
+func (e *vpxEncoder) Close() error {
+	C.vpx_codec_destroy(e.ctx)
+	C.free(unsafe.Pointer(e.ctx))
+	return nil
+}
+
+// h264Decoder decodes H.264 with OpenH264
+type h264Decoder struct {
+	dec *C.ISVCDecoder
+}
+
+func (d *h264Decoder) Decode(frame []byte) (*VideoFrame, error) {
+	if len(frame) == 0 {
+		return nil, nil
+	}
+	var planes [3]*C.uchar
+	var width, height C.int
+	var strides [2]C.int
+	switch C.karl_h264_decode(d.dec, (*C.uchar)(unsafe.Pointer(&frame[0])), C.int(len(frame)),
+		&planes[0], &width, &height, &strides[0]) {
+	case -1:
+		return nil, fmt.Errorf("OpenH264 failed to decode a frame")
+	case 0:
+		return nil, nil
+	}
+	w, h := int(width), int(height)
+	return &VideoFrame{
+		Width:  w,
+		Height: h,
+		Y:      copyPlane(unsafe.Pointer(planes[0]), int(strides[0]), w, h),
+		U:      copyPlane(unsafe.Pointer(planes[1]), int(strides[1]), (w+1)/2, (h+1)/2),
+		V:      copyPlane(unsafe.Pointer(planes[2]), int(strides[1]), (w+1)/2, (h+1)/2),
+	}, nil
+}
+
+func (d *h264Decoder) Close() error {
+	C.karl_h264_dec_close(d.dec)
+	return nil
+}
+
+// h264Encoder encodes H.264 with OpenH264
+type h264Encoder struct {
+	enc    *C.ISVCEncoder
+	config VideoEncoderConfig
+	out    []byte
+}
+
+func (e *h264Encoder) Encode(picture *VideoFrame, keyframe bool) ([]byte, error) {
+	buf := packI420(picture)
+	e.out = growFrameBuffer(e.out, len(buf))
+	ms := C.longlong(picture.Timestamp / 90)
+	n := C.karl_h264_encode(e.enc, (*C.uchar)(unsafe.Pointer(&buf[0])), C.int(picture.Width), C.int(picture.Height),
+		ms, cBool(keyframe), (*C.uchar)(unsafe.Pointer(&e.out[0])), C.int(len(e.out)))
+	if n < 0 {
+		return nil, fmt.Errorf("OpenH264 failed to encode a frame")
+	}
+	return append([]byte(nil), e.out[:n]...), nil
+}
+
+func (e *h264Encoder) Close() error {
+	C.karl_h264_enc_close(e.enc)
+	return nil
+}
+
+// copyPlane copies a plane of a decoded picture out of the decoder's
+// buffer, dropping the row padding
+func copyPlane(data unsafe.Pointer, stride, width, height int) []byte {
+	src := unsafe.Slice((*byte)(data), stride*height)
+	plane := make([]byte, width*height)
+	for y := 0; y < height; y++ {
+		copy(plane[y*width:(y+1)*width], src[y*stride:])
+	}
+	return plane
+}
+
+// packI420 lays out the planes of a picture one after another, as the
+// encoders read them
+func packI420(picture *VideoFrame) []byte {
+	buf := make([]byte, 0, len(picture.Y)+len(picture.U)+len(picture.V))
+	buf = append(buf, picture.Y...)
+	buf = append(buf, picture.U...)
+	return append(buf, picture.V...)
+}
+
+// growFrameBuffer returns a buffer for an encoded frame, which is never
+// larger than the raw picture plus headers
+func growFrameBuffer(buf []byte, raw int) []byte {
+	if len(buf) < raw+4096 {
+		buf = make([]byte, raw+4096)
+	}
+	return buf
+}
+
+func cBool(b bool) C.int {
+	if b {
+		return 1
+	}
+	return 0
+}
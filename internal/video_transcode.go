@@ -0,0 +1,525 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Video transcoding defaults
+const (
+	defaultVideoBackend    = "software"
+	defaultVideoMaxWidth   = 1280
+	defaultVideoMaxHeight  = 720
+	defaultVideoMaxBitrate = 1500 // kbps
+	defaultVideoMaxStreams = 8
+	videoMTU               = 1200 // largest RTP payload Karl sends
+)
+
+// ErrVideoTranscodeLimit is returned for a stream beyond max_streams
+var ErrVideoTranscodeLimit = errors.New("too many video streams being transcoded")
+
+var (
+	videoTranscodeFrames = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "karl_video_transcode_frames_total",
+			Help: "Total video frames transcoded, by source and target codec",
+		},
+		[]string{"from", "to"},
+	)
+
+	videoTranscodeErrors = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "karl_video_transcode_errors_total",
+			Help: "Total video frames that failed to decode or encode",
+		},
+	)
+
+	videoTranscodeStreams = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "karl_video_transcode_streams",
+			Help: "Number of video streams being transcoded",
+		},
+	)
+)
+
+// VideoFrame is a decoded picture in I420: a full-size luma plane and
+// quarter-size chroma planes, each row packed without padding
+type VideoFrame struct {
+	Width, Height int
+	Y, U, V       []byte
+	Timestamp     uint32 // RTP timestamp on the 90 kHz video clock
+}
+
+// VideoDecoder decodes the frames of one stream
+type VideoDecoder interface {
+	// Decode decodes one frame as depacketized from RTP, in Annex B for
+	// H.264. It returns nil while there is no picture to show
+	Decode(frame []byte) (*VideoFrame, error)
+	Close() error
+}
+
+// VideoEncoder encodes the pictures of one stream at a fixed size
+type VideoEncoder interface {
+	// Encode encodes a picture, as a keyframe when asked, into a frame to
+	// packetize for RTP, in Annex B for H.264. It returns nil for a
+	// skipped picture
+	Encode(picture *VideoFrame, keyframe bool) ([]byte, error)
+	Close() error
+}
+
+// VideoEncoderConfig sets up an encoder
+type VideoEncoderConfig struct {
+	Width, Height int
+	Bitrate       int // bps
+}
+
+// VideoBackend provides video codecs, in software or on a hardware
+// accelerator. Codec names are upper case, e.g. "VP8" and "H264"
+type VideoBackend interface {
+	Name() string
+	Decoders() []string
+	Encoders() []string
+	NewDecoder(codec string) (VideoDecoder, error)
+	NewEncoder(codec string, config VideoEncoderConfig) (VideoEncoder, error)
+}
+
+var (
+	videoBackends   = make(map[string]VideoBackend)
+	videoBackendsMu sync.RWMutex
+)
+
+// RegisterVideoBackend makes a video backend available by its name to
+// video_transcoding.backend. Backends register themselves from init
+// functions of files built with their build tag
+func RegisterVideoBackend(backend VideoBackend) {
+	videoBackendsMu.Lock()
+	defer videoBackendsMu.Unlock()
+	videoBackends[backend.Name()] = backend
+}
+
+// VideoBackends returns the names of the registered video backends
+func VideoBackends() []string {
+	videoBackendsMu.RLock()
+	defer videoBackendsMu.RUnlock()
+	names := make([]string, 0, len(videoBackends))
+	for name := range videoBackends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func videoBackend(name string) (VideoBackend, bool) {
+	videoBackendsMu.RLock()
+	defer videoBackendsMu.RUnlock()
+	backend, ok := videoBackends[name]
+	return backend, ok
+}
+
+// ValidateVideoTranscodeConfig checks the limits, and that the backend is
+// built in when video transcoding is enabled
+func ValidateVideoTranscodeConfig(cfg *Config) error {
+	c := cfg.VideoTranscode
+	if c.MaxWidth < 0 || c.MaxHeight < 0 || c.MaxBitrate < 0 || c.MaxStreams < 0 {
+		return fmt.Errorf("invalid video_transcoding limits: %dx%d, %d kbps, %d streams",
+			c.MaxWidth, c.MaxHeight, c.MaxBitrate, c.MaxStreams)
+	}
+	if c.MaxWidth%2 != 0 || c.MaxHeight%2 != 0 {
+		return fmt.Errorf("invalid video_transcoding size %dx%d, expected even dimensions", c.MaxWidth, c.MaxHeight)
+	}
+	if !c.Enabled {
+		return nil
+	}
+	name := c.Backend
+	if name == "" {
+		name = defaultVideoBackend
+	}
+	if _, ok := videoBackend(name); !ok {
+		if len(VideoBackends()) == 0 {
+			return fmt.Errorf("video_transcoding.backend %q is not available: Karl was built without video codecs (build with -tags karl_video)", name)
+		}
+		return fmt.Errorf("video_transcoding.backend %q is not available, expected one of %s", name, strings.Join(VideoBackends(), ", "))
+	}
+	return nil
+}
+
+// VideoTranscoder converts relayed video between codecs the two legs of a
+// call do not share. Each stream has its own pipeline: it reassembles
+// frames from RTP, decodes them, scales the pictures down to the size
+// limit, encodes them for the receiver and packetizes them again
+type VideoTranscoder struct {
+	backend   VideoBackend
+	maxWidth  int
+	maxHeight int
+	bitrate   int // bps
+	maxCount  int
+
+	// requestKeyframe asks a stream's sender for a keyframe, nil if unset
+	requestKeyframe func(ssrc uint32)
+
+	mu      sync.Mutex
+	streams map[uint32]*videoPipeline
+}
+
+// NewVideoTranscoder creates a transcoder on the configured backend
+func NewVideoTranscoder(config *VideoTranscodeConfig) (*VideoTranscoder, error) {
+	name := config.Backend
+	if name == "" {
+		name = defaultVideoBackend
+	}
+	backend, ok := videoBackend(name)
+	if !ok {
+		return nil, fmt.Errorf("video backend %q is not built in", name)
+	}
+
+	t := &VideoTranscoder{
+		backend:   backend,
+		maxWidth:  config.MaxWidth,
+		maxHeight: config.MaxHeight,
+		bitrate:   config.MaxBitrate * 1000,
+		maxCount:  config.MaxStreams,
+		streams:   make(map[uint32]*videoPipeline),
+	}
+	if t.maxWidth <= 0 {
+		t.maxWidth = defaultVideoMaxWidth
+	}
+	if t.maxHeight <= 0 {
+		t.maxHeight = defaultVideoMaxHeight
+	}
+	if t.bitrate <= 0 {
+		t.bitrate = defaultVideoMaxBitrate * 1000
+	}
+	if t.maxCount <= 0 {
+		t.maxCount = defaultVideoMaxStreams
+	}
+	return t, nil
+}
+
+// CanTranscode reports whether the backend decodes src and encodes dst
+// and the payload formats of both are known
+func (t *VideoTranscoder) CanTranscode(src, dst CodecInfo) bool {
+	from, to := strings.ToUpper(src.Name), strings.ToUpper(dst.Name)
+	return videoDepacketizer(from) != nil && videoPayloader(to) != nil &&
+		containsFold(t.backend.Decoders(), from) && containsFold(t.backend.Encoders(), to)
+}
+
+// Transcode pushes a packet of a stream through its pipeline and returns
+// the packets to send the receiver, none until a frame is complete
+func (t *VideoTranscoder) Transcode(packet *RTPPacket, src, dst CodecInfo) ([]*RTPPacket, error) {
+	pipeline, err := t.pipeline(packet.SSRC, src, dst)
+	if err != nil {
+		return nil, err
+	}
+	return pipeline.push(packet)
+}
+
+// pipeline returns the pipeline of a stream, starting one when the stream
+// is new or its codecs changed
+func (t *VideoTranscoder) pipeline(ssrc uint32, src, dst CodecInfo) (*videoPipeline, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if p, ok := t.streams[ssrc]; ok {
+		if sameCodec(p.src, src) && sameCodec(p.dst, dst) && p.dst.PayloadType == dst.PayloadType {
+			return p, nil
+		}
+		p.close()
+		delete(t.streams, ssrc)
+	}
+	if len(t.streams) >= t.maxCount {
+		return nil, ErrVideoTranscodeLimit
+	}
+
+	from, to := strings.ToUpper(src.Name), strings.ToUpper(dst.Name)
+	depacketizer, payloader := videoDepacketizer(from), videoPayloader(to)
+	if depacketizer == nil || payloader == nil {
+		return nil, fmt.Errorf("cannot transcode video from %s to %s", src.Name, dst.Name)
+	}
+	decoder, err := t.backend.NewDecoder(from)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s decoder: %w", from, err)
+	}
+
+	p := &videoPipeline{
+		transcoder:   t,
+		ssrc:         ssrc,
+		src:          src,
+		dst:          dst,
+		from:         from,
+		to:           to,
+		depacketizer: depacketizer,
+		payloader:    payloader,
+		decoder:      decoder,
+		waitKeyframe: true,
+	}
+	t.streams[ssrc] = p
+	videoTranscodeStreams.Set(float64(len(t.streams)))
+	return p, nil
+}
+
+// Remove stops transcoding a stream
+func (t *VideoTranscoder) Remove(ssrc uint32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p, ok := t.streams[ssrc]; ok {
+		p.close()
+		delete(t.streams, ssrc)
+		videoTranscodeStreams.Set(float64(len(t.streams)))
+	}
+}
+
+// Close stops transcoding every stream
+func (t *VideoTranscoder) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for ssrc, p := range t.streams {
+		p.close()
+		delete(t.streams, ssrc)
+	}
+	videoTranscodeStreams.Set(0)
+}
+
+// videoPipeline transcodes one stream. The worker pool hands a stream's
+// packets to one worker, but Remove may run alongside
+type videoPipeline struct {
+	transcoder *VideoTranscoder
+	ssrc       uint32
+	src, dst   CodecInfo
+	from, to   string
+
+	mu           sync.Mutex
+	depacketizer rtp.Depacketizer
+	payloader    rtp.Payloader
+	decoder      VideoDecoder
+	encoder      VideoEncoder
+	width        int // size the encoder was created for
+	height       int
+
+	started      bool
+	nextSeq      uint16
+	frame        []byte // the frame being reassembled
+	frameTS      uint32
+	inFrame      bool // the frame's first packet arrived
+	keyframe     bool // the frame is a keyframe
+	waitKeyframe bool // frames are dropped until the next keyframe
+	outSeq       uint16
+	closed       bool
+}
+
+// push adds a packet to the frame being reassembled and transcodes the
+// frame once its last packet, the one with the marker bit, arrives
+func (p *videoPipeline) push(packet *RTPPacket) ([]*RTPPacket, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, nil
+	}
+
+	// A lost packet breaks the frame, and every frame after it until the
+	// next keyframe, so ask the sender for one
+	if p.started && packet.SequenceNumber != p.nextSeq {
+		if int16(packet.SequenceNumber-p.nextSeq) < 0 {
+			return nil, nil // late or duplicated
+		}
+		p.inFrame = false
+		p.lostFrame()
+	}
+	p.started = true
+	p.nextSeq = packet.SequenceNumber + 1
+
+	if !p.inFrame || packet.Timestamp != p.frameTS {
+		p.frame = p.frame[:0]
+		p.frameTS = packet.Timestamp
+		p.inFrame = p.depacketizer.IsPartitionHead(packet.Payload)
+		if !p.inFrame {
+			return nil, nil
+		}
+		p.keyframe = false
+	}
+	if isVideoKeyframe("video/"+p.from, packet.Payload) {
+		p.keyframe = true
+	}
+	data, err := p.depacketizer.Unmarshal(packet.Payload)
+	if err != nil {
+		p.inFrame = false
+		p.lostFrame()
+		return nil, err
+	}
+	p.frame = append(p.frame, data...)
+	if !packet.Marker {
+		return nil, nil
+	}
+	p.inFrame = false
+
+	if p.waitKeyframe && !p.keyframe {
+		return nil, nil
+	}
+	p.waitKeyframe = false
+	return p.transcodeFrame(packet)
+}
+
+// transcodeFrame decodes the reassembled frame and encodes it for the
+// receiver
+func (p *videoPipeline) transcodeFrame(last *RTPPacket) ([]*RTPPacket, error) {
+	picture, err := p.decoder.Decode(p.frame)
+	if err != nil {
+		videoTranscodeErrors.Inc()
+		p.lostFrame()
+		return nil, fmt.Errorf("failed to decode %s: %w", p.from, err)
+	}
+	if picture == nil {
+		return nil, nil
+	}
+	picture.Timestamp = last.Timestamp
+	picture = scaleVideoFrame(picture, p.transcoder.maxWidth, p.transcoder.maxHeight)
+
+	// A new size needs a new encoder, which starts with a keyframe
+	keyframe := p.keyframe
+	if p.encoder == nil || picture.Width != p.width || picture.Height != p.height {
+		if p.encoder != nil {
+			_ = p.encoder.Close()
+			p.encoder = nil
+		}
+		encoder, err := p.transcoder.backend.NewEncoder(p.to, VideoEncoderConfig{
+			Width: picture.Width, Height: picture.Height, Bitrate: p.transcoder.bitrate,
+		})
+		if err != nil {
+			videoTranscodeErrors.Inc()
+			return nil, fmt.Errorf("failed to create %s encoder: %w", p.to, err)
+		}
+		p.encoder, p.width, p.height = encoder, picture.Width, picture.Height
+		keyframe = true
+	}
+
+	frame, err := p.encoder.Encode(picture, keyframe)
+	if err != nil {
+		videoTranscodeErrors.Inc()
+		return nil, fmt.Errorf("failed to encode %s: %w", p.to, err)
+	}
+	if len(frame) == 0 {
+		return nil, nil
+	}
+	videoTranscodeFrames.WithLabelValues(p.from, p.to).Inc()
+
+	payloads := p.payloader.Payload(videoMTU, frame)
+	packets := make([]*RTPPacket, len(payloads))
+	for i, payload := range payloads {
+		packets[i] = &RTPPacket{
+			Version:        2,
+			Marker:         i == len(payloads)-1,
+			PayloadType:    p.dst.PayloadType,
+			SequenceNumber: p.outSeq,
+			Timestamp:      last.Timestamp,
+			SSRC:           p.ssrc,
+			Payload:        payload,
+			Received:       last.Received,
+		}
+		p.outSeq++
+	}
+	return packets, nil
+}
+
+// lostFrame drops frames until the next keyframe, and asks for one
+func (p *videoPipeline) lostFrame() {
+	p.waitKeyframe = true
+	if request := p.transcoder.requestKeyframe; request != nil {
+		request(p.ssrc)
+	}
+}
+
+func (p *videoPipeline) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	if p.decoder != nil {
+		_ = p.decoder.Close()
+	}
+	if p.encoder != nil {
+		_ = p.encoder.Close()
+	}
+}
+
+// videoDepacketizer returns the RTP depacketizer of a video codec
+func videoDepacketizer(codec string) rtp.Depacketizer {
+	switch codec {
+	case "VP8":
+		return &codecs.VP8Packet{}
+	case "VP9":
+		return &codecs.VP9Packet{}
+	case "H264":
+		return &codecs.H264Packet{}
+	}
+	return nil
+}
+
+// videoPayloader returns the RTP payloader of a video codec
+func videoPayloader(codec string) rtp.Payloader {
+	switch codec {
+	case "VP8":
+		return &codecs.VP8Payloader{EnablePictureID: true}
+	case "VP9":
+		return &codecs.VP9Payloader{}
+	case "H264":
+		return &codecs.H264Payloader{}
+	}
+	return nil
+}
+
+// scaleVideoFrame scales a picture down to fit within maxWidth by
+// maxHeight, keeping its aspect ratio and even dimensions. A picture that
+// fits is returned as it is
+func scaleVideoFrame(f *VideoFrame, maxWidth, maxHeight int) *VideoFrame {
+	if f.Width <= maxWidth && f.Height <= maxHeight {
+		return f
+	}
+	width, height := maxWidth, f.Height*maxWidth/f.Width
+	if height > maxHeight {
+		width, height = f.Width*maxHeight/f.Height, maxHeight
+	}
+	width, height = max(width&^1, 2), max(height&^1, 2)
+
+	scaled := &VideoFrame{Width: width, Height: height, Timestamp: f.Timestamp}
+	scaled.Y = scalePlane(f.Y, f.Width, f.Height, width, height)
+	scaled.U = scalePlane(f.U, (f.Width+1)/2, (f.Height+1)/2, width/2, height/2)
+	scaled.V = scalePlane(f.V, (f.Width+1)/2, (f.Height+1)/2, width/2, height/2)
+	return scaled
+}
+
+// scalePlane resamples a plane by averaging the source pixels each target
+// pixel covers
+func scalePlane(src []byte, srcWidth, srcHeight, width, height int) []byte {
+	dst := make([]byte, width*height)
+	for y := 0; y < height; y++ {
+		y0, y1 := y*srcHeight/height, max((y+1)*srcHeight/height, y*srcHeight/height+1)
+		for x := 0; x < width; x++ {
+			x0, x1 := x*srcWidth/width, max((x+1)*srcWidth/width, x*srcWidth/width+1)
+			sum, n := 0, 0
+			for sy := y0; sy < y1; sy++ {
+				row := src[sy*srcWidth:]
+				for sx := x0; sx < x1; sx++ {
+					sum += int(row[sx])
+					n++
+				}
+			}
+			dst[y*width+x] = byte(sum / n)
+		}
+	}
+	return dst
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,177 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+)
+
+// fakeVideoBackend decodes every frame to a 1080p picture and encodes each
+// picture to a single H.264 NAL unit, an IDR slice for a keyframe
+type fakeVideoBackend struct {
+	encoders []VideoEncoderConfig
+	encoded  []bool // keyframe flag of each encoded picture
+}
+
+func (b *fakeVideoBackend) Name() string       { return "fake" }
+func (b *fakeVideoBackend) Decoders() []string { return []string{"VP8"} }
+func (b *fakeVideoBackend) Encoders() []string { return []string{"H264"} }
+
+func (b *fakeVideoBackend) NewDecoder(codec string) (VideoDecoder, error) {
+	return fakeVideoDecoder{}, nil
+}
+
+func (b *fakeVideoBackend) NewEncoder(codec string, config VideoEncoderConfig) (VideoEncoder, error) {
+	b.encoders = append(b.encoders, config)
+	return &fakeVideoEncoder{backend: b}, nil
+}
+
+type fakeVideoDecoder struct{}
+
+func (fakeVideoDecoder) Decode(frame []byte) (*VideoFrame, error) {
+	return &VideoFrame{
+		Width: 1920, Height: 1080,
+		Y: make([]byte, 1920*1080), U: make([]byte, 960*540), V: make([]byte, 960*540),
+	}, nil
+}
+
+func (fakeVideoDecoder) Close() error { return nil }
+
+type fakeVideoEncoder struct {
+	backend *fakeVideoBackend
+}
+
+func (e *fakeVideoEncoder) Encode(picture *VideoFrame, keyframe bool) ([]byte, error) {
+	e.backend.encoded = append(e.backend.encoded, keyframe)
+	nal := byte(0x41) // non-IDR slice
+	if keyframe {
+		nal = 0x65
+	}
+	return []byte{0, 0, 0, 1, nal, 0x88, 0x84}, nil
+}
+
+func (e *fakeVideoEncoder) Close() error { return nil }
+
+func TestVideoTranscoder_VP8ToH264(t *testing.T) {
+	backend := &fakeVideoBackend{}
+	RegisterVideoBackend(backend)
+	transcoder, err := NewVideoTranscoder(&VideoTranscodeConfig{Backend: "fake", MaxStreams: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transcoder.Close()
+
+	var requested []uint32
+	transcoder.requestKeyframe = func(ssrc uint32) { requested = append(requested, ssrc) }
+
+	vp8 := CodecInfo{PayloadType: 100, Name: "VP8", ClockRate: 90000}
+	h264 := CodecInfo{PayloadType: 102, Name: "H264", ClockRate: 90000}
+	if !transcoder.CanTranscode(vp8, h264) || transcoder.CanTranscode(h264, vp8) {
+		t.Fatal("expected to transcode VP8 to H.264 only")
+	}
+
+	// VP8 payload descriptors: S set, partition 0; the frame tag's P bit
+	// is 0 for a keyframe
+	keyframe := []byte{0x10, 0x00, 0x9d, 0x01}
+	interframe := []byte{0x10, 0x01, 0x00}
+	send := func(seq uint16, ts uint32, payload []byte) []*RTPPacket {
+		t.Helper()
+		packets, err := transcoder.Transcode(&RTPPacket{
+			SSRC: 0xB1, PayloadType: 100, SequenceNumber: seq, Timestamp: ts, Marker: true, Payload: payload,
+		}, vp8, h264)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return packets
+	}
+
+	// Frames before the first keyframe cannot be decoded
+	if packets := send(1, 1000, interframe); len(packets) != 0 {
+		t.Fatalf("transcoded %d packets before a keyframe", len(packets))
+	}
+	packets := send(2, 4000, keyframe)
+	if len(packets) != 1 {
+		t.Fatalf("expected one H.264 packet, got %d", len(packets))
+	}
+	p := packets[0]
+	if p.PayloadType != 102 || p.SSRC != 0xB1 || p.Timestamp != 4000 || !p.Marker || p.Payload[0]&0x1F != 5 {
+		t.Errorf("unexpected H.264 packet %+v", p)
+	}
+
+	// 1080p is scaled down to the 720p default
+	if len(backend.encoders) != 1 || backend.encoders[0].Width != 1280 || backend.encoders[0].Height != 720 ||
+		backend.encoders[0].Bitrate != 1500000 {
+		t.Fatalf("unexpected encoders %+v", backend.encoders)
+	}
+
+	next := send(3, 7000, interframe)
+	if len(next) != 1 || next[0].SequenceNumber != p.SequenceNumber+1 || next[0].Payload[0]&0x1F != 1 {
+		t.Fatalf("unexpected packets after the keyframe: %+v", next)
+	}
+
+	// A lost packet drops frames until the next keyframe, which is asked for
+	if packets := send(5, 13000, interframe); len(packets) != 0 {
+		t.Fatal("transcoded a frame after loss")
+	}
+	if len(requested) != 1 || requested[0] != 0xB1 {
+		t.Fatalf("keyframe requests %v", requested)
+	}
+	if packets := send(6, 16000, keyframe); len(packets) != 1 {
+		t.Fatal("expected the keyframe after loss to be transcoded")
+	}
+	if want := []bool{true, false, true}; len(backend.encoded) != len(want) ||
+		backend.encoded[0] != want[0] || backend.encoded[1] != want[1] || backend.encoded[2] != want[2] {
+		t.Errorf("encoded keyframes %v, want %v", backend.encoded, want)
+	}
+
+	// One stream at a time
+	if _, err := transcoder.Transcode(&RTPPacket{SSRC: 0xB2, Marker: true, Payload: keyframe}, vp8, h264); !errors.Is(err, ErrVideoTranscodeLimit) {
+		t.Errorf("expected the stream limit, got %v", err)
+	}
+	transcoder.Remove(0xB1)
+	if _, err := transcoder.Transcode(&RTPPacket{SSRC: 0xB2, Marker: true, Payload: keyframe}, vp8, h264); err != nil {
+		t.Errorf("expected a stream after removal, got %v", err)
+	}
+}
+
+func TestVideoTranscodeCodecs(t *testing.T) {
+	in := &MediaStream{Codecs: []CodecInfo{{PayloadType: 96, Name: "VP8", ClockRate: 90000}}}
+	out := &MediaStream{Codecs: []CodecInfo{
+		{PayloadType: 97, Name: "rtx", ClockRate: 90000},
+		{PayloadType: 98, Name: "H264", ClockRate: 90000},
+	}}
+	src, dst, ok := videoTranscodeCodecs(96, in, out)
+	if !ok || src.Name != "VP8" || dst.PayloadType != 98 {
+		t.Fatalf("got %+v -> %+v, %v", src, dst, ok)
+	}
+
+	out.Codecs = append(out.Codecs, CodecInfo{PayloadType: 100, Name: "vp8", ClockRate: 90000})
+	if _, _, ok := videoTranscodeCodecs(96, in, out); ok {
+		t.Error("expected a shared codec to be relayed")
+	}
+
+	added := TranscodeOfferVideoCodecs(in.Codecs, []string{"H264", "VP8", "opus"})
+	if len(added) != 1 || added[0].Name != "H264" || added[0].PayloadType != 97 {
+		t.Errorf("offered %+v", added)
+	}
+}
+
+func TestValidateVideoTranscodeConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  VideoTranscodeConfig
+		wantErr bool
+	}{
+		{"disabled", VideoTranscodeConfig{Backend: "missing"}, false},
+		{"negative bitrate", VideoTranscodeConfig{MaxBitrate: -1}, true},
+		{"odd width", VideoTranscodeConfig{MaxWidth: 641}, true},
+		{"missing backend", VideoTranscodeConfig{Enabled: true, Backend: "missing"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateVideoTranscodeConfig(&Config{VideoTranscode: &tt.config})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,329 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Event types published to webhooks
+const (
+	EventSessionStart  = "session-start"  // a call connected
+	EventSessionEnd    = "session-end"    // a call ended
+	EventQualityAlert  = "quality-alert"  // an alert threshold was crossed
+	EventFailover      = "failover"       // the HA role of this node changed
+	EventRegistration  = "registration"   // a SIP proxy became reachable or unreachable
+	EventActiveSpeaker = "active-speaker" // the active speaker of a call or conference changed
+	EventTranscript    = "transcript"     // the speech-to-text engine recognized speech in a call
+	EventDTMF          = "dtmf"           // a party of a call pressed a DTMF digit
+)
+
+// eventTypes are the event types an endpoint may subscribe to
+var eventTypes = map[string]bool{
+	EventSessionStart: true, EventSessionEnd: true, EventQualityAlert: true,
+	EventFailover: true, EventRegistration: true, EventActiveSpeaker: true,
+	EventTranscript: true, EventDTMF: true,
+}
+
+// Webhook defaults and limits
+const (
+	defaultWebhookQueueSize  = 1000
+	defaultWebhookTimeout    = 5 // seconds
+	defaultWebhookMaxRetries = 3
+	maxWebhookRetries        = 10
+	maxWebhookRetryDelay     = 30 * time.Second
+)
+
+// Webhook metrics
+var (
+	webhookDeliveries = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "karl_webhook_deliveries_total",
+			Help: "Events delivered to webhooks, by event type and result",
+		},
+		[]string{"event", "result"},
+	)
+
+	webhookRetries = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "karl_webhook_retries_total",
+			Help: "Webhook delivery attempts retried after a failure, by event type",
+		},
+		[]string{"event"},
+	)
+
+	webhookDuration = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "karl_webhook_delivery_duration_seconds",
+			Help:    "Time from publishing an event to its delivery, retries included",
+			Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+		},
+	)
+)
+
+var (
+	eventBus atomic.Pointer[EventBus]
+
+	// First delay before a failed delivery is retried; it doubles with
+	// every attempt
+	webhookRetryDelay = time.Second
+
+	// Failed and dropped deliveries are reported at most once a minute
+	webhookErrors = NewLogSampler(Logger(ComponentKarl), slog.LevelWarn, 1, time.Minute)
+)
+
+// Event is the JSON body POSTed to webhooks and published to event streams
+type Event struct {
+	ID        string                 `json:"id"`
+	Type      string                 `json:"type"`
+	Timestamp time.Time              `json:"timestamp"`
+	Node      string                 `json:"node"`
+	CallID    string                 `json:"call_id,omitempty"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+}
+
+// EventBus delivers published events to the configured webhook endpoints.
+// Each endpoint has its own queue and worker, so a slow endpoint does not
+// hold up the others
+type EventBus struct {
+	node      string
+	endpoints []*webhookEndpoint
+	wg        sync.WaitGroup
+}
+
+// webhookEndpoint is one endpoint with its queue of events
+type webhookEndpoint struct {
+	url        string
+	host       string // logged instead of the URL, which may hold a token
+	secret     string
+	events     map[string]bool // nil delivers every type
+	maxRetries int
+	client     *http.Client
+	queue      chan *Event
+}
+
+// NewEventBus creates a bus for a webhooks config and starts its workers
+func NewEventBus(config *WebhooksConfig, node string) *EventBus {
+	queueSize := config.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultWebhookQueueSize
+	}
+	bus := &EventBus{node: node}
+	for _, c := range config.Endpoints {
+		ep := &webhookEndpoint{
+			url:        c.URL,
+			secret:     c.Secret,
+			maxRetries: c.MaxRetries,
+			queue:      make(chan *Event, queueSize),
+		}
+		if u, err := url.Parse(c.URL); err == nil {
+			ep.host = u.Host
+		}
+		if len(c.Events) > 0 {
+			ep.events = make(map[string]bool)
+			for _, e := range c.Events {
+				ep.events[e] = true
+			}
+		}
+		if ep.maxRetries == 0 {
+			ep.maxRetries = defaultWebhookMaxRetries
+		}
+		timeout := c.Timeout
+		if timeout <= 0 {
+			timeout = defaultWebhookTimeout
+		}
+		ep.client = &http.Client{Timeout: time.Duration(timeout) * time.Second}
+		bus.endpoints = append(bus.endpoints, ep)
+
+		bus.wg.Add(1)
+		go func() {
+			defer bus.wg.Done()
+			ep.run()
+		}()
+	}
+	return bus
+}
+
+// newEvent stamps an event with a unique ID and the time
+func newEvent(node, eventType, callID string, data map[string]interface{}) *Event {
+	return &Event{
+		ID:        uuid.New().String(),
+		Type:      eventType,
+		Timestamp: time.Now().UTC(),
+		Node:      node,
+		CallID:    callID,
+		Data:      data,
+	}
+}
+
+// Publish queues an event for every endpoint subscribed to its type. It
+// never blocks; an endpoint whose queue is full loses the event
+func (b *EventBus) Publish(eventType, callID string, data map[string]interface{}) {
+	b.publish(newEvent(b.node, eventType, callID, data))
+}
+
+func (b *EventBus) publish(event *Event) {
+	for _, ep := range b.endpoints {
+		if ep.events != nil && !ep.events[event.Type] {
+			continue
+		}
+		select {
+		case ep.queue <- event:
+		default:
+			webhookDeliveries.WithLabelValues(event.Type, "dropped").Inc()
+			if webhookErrors.Allow() {
+				webhookErrors.Log("Webhook queue is full, event dropped", "endpoint", ep.host, "event", event.Type)
+			}
+		}
+	}
+}
+
+// Close stops taking events and waits for the queued ones to be delivered
+func (b *EventBus) Close() {
+	for _, ep := range b.endpoints {
+		close(ep.queue)
+	}
+	b.wg.Wait()
+}
+
+// run delivers queued events in order until the queue is closed
+func (ep *webhookEndpoint) run() {
+	for event := range ep.queue {
+		ep.deliver(event)
+	}
+}
+
+// deliver POSTs an event, retrying with exponential backoff on network
+// errors, 5xx and 429 responses. Other 4xx responses are not retried
+func (ep *webhookEndpoint) deliver(event *Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		webhookDeliveries.WithLabelValues(event.Type, "failed").Inc()
+		return
+	}
+
+	delay := webhookRetryDelay
+	for attempt := 0; ; attempt++ {
+		retry, err := ep.post(event, body)
+		if err == nil {
+			webhookDeliveries.WithLabelValues(event.Type, "delivered").Inc()
+			webhookDuration.Observe(time.Since(event.Timestamp).Seconds())
+			return
+		}
+		if !retry || attempt >= ep.maxRetries {
+			webhookDeliveries.WithLabelValues(event.Type, "failed").Inc()
+			if webhookErrors.Allow() {
+				webhookErrors.Log("Webhook delivery failed", "endpoint", ep.host, "event", event.Type, "attempts", attempt+1, "error", err)
+			}
+			return
+		}
+
+		webhookRetries.WithLabelValues(event.Type).Inc()
+		time.Sleep(delay)
+		delay = min(2*delay, maxWebhookRetryDelay)
+	}
+}
+
+// post makes one delivery attempt, reporting whether a failure is worth
+// retrying
+func (ep *webhookEndpoint) post(event *Event, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, ep.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Node-ID", event.Node)
+	req.Header.Set("X-Event-Type", event.Type)
+	req.Header.Set("X-Event-ID", event.ID)
+	if ep.secret != "" {
+		req.Header.Set("X-Signature", computeHMAC(body, ep.secret))
+	}
+
+	resp, err := ep.client.Do(req)
+	if err != nil {
+		// Leave the URL, which may hold a token, out of the error
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return true, err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("webhook returned %d", resp.StatusCode)
+	default:
+		return false, fmt.Errorf("webhook returned %d", resp.StatusCode)
+	}
+}
+
+// ConfigureWebhooks replaces the event bus with one for config; nil or no
+// endpoints stops publishing. Events queued on the old bus are still
+// delivered
+func ConfigureWebhooks(config *WebhooksConfig) {
+	var bus *EventBus
+	if config != nil && len(config.Endpoints) > 0 {
+		bus = NewEventBus(config, DefaultHANodeID())
+	}
+	if old := eventBus.Swap(bus); old != nil {
+		go old.Close()
+	}
+}
+
+// ValidateWebhooksConfig checks the endpoint URLs, event types and limits
+func ValidateWebhooksConfig(cfg *Config) error {
+	w := cfg.Webhooks
+	if w.QueueSize < 0 {
+		return fmt.Errorf("invalid webhooks.queue_size %d", w.QueueSize)
+	}
+	for i, ep := range w.Endpoints {
+		u, err := url.Parse(ep.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid webhooks.endpoints[%d].url, expected an http or https URL", i)
+		}
+		for _, e := range ep.Events {
+			if !eventTypes[e] {
+				return fmt.Errorf("invalid webhooks.endpoints[%d].events %q", i, e)
+			}
+		}
+		if ep.Timeout < 0 {
+			return fmt.Errorf("invalid webhooks.endpoints[%d].timeout %d", i, ep.Timeout)
+		}
+		if ep.MaxRetries < 0 || ep.MaxRetries > maxWebhookRetries {
+			return fmt.Errorf("invalid webhooks.endpoints[%d].max_retries %d, expected 0-%d", i, ep.MaxRetries, maxWebhookRetries)
+		}
+	}
+	return nil
+}
+
+// PublishEvent sends an event to the configured webhooks and event
+// streams, if any. Both see the same event ID
+func PublishEvent(eventType, callID string, data map[string]interface{}) {
+	bus, streamer := eventBus.Load(), eventStreamer.Load()
+	if bus == nil && streamer == nil {
+		return
+	}
+	event := newEvent(DefaultHANodeID(), eventType, callID, data)
+	if bus != nil {
+		bus.publish(event)
+	}
+	if streamer != nil {
+		streamer.publish(event)
+	}
+}
@@ -0,0 +1,150 @@
+package internal
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEventBus_DeliversSignedEvents(t *testing.T) {
+	received := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer server.Close()
+
+	bus := NewEventBus(&WebhooksConfig{Endpoints: []WebhookEndpointConfig{
+		{URL: server.URL, Secret: "s3cret", Events: []string{EventSessionEnd}},
+	}}, "node-1")
+	bus.Publish(EventSessionStart, "call-1", nil)
+	bus.Publish(EventSessionEnd, "call-1", map[string]interface{}{"duration": 12.5})
+	bus.Close()
+
+	if len(received) != 1 {
+		t.Fatalf("got %d deliveries, want only the subscribed session-end", len(received))
+	}
+	r, body := <-received, <-bodies
+	if r.Header.Get("X-Signature") != computeHMAC(body, "s3cret") {
+		t.Error("signature does not match the body")
+	}
+	var event Event
+	if err := json.Unmarshal(body, &event); err != nil {
+		t.Fatalf("invalid body: %v", err)
+	}
+	if event.Type != EventSessionEnd || event.CallID != "call-1" || event.Node != "node-1" || event.Data["duration"] != 12.5 {
+		t.Errorf("unexpected event %+v", event)
+	}
+	if r.Header.Get("X-Event-Type") != EventSessionEnd || r.Header.Get("X-Event-ID") != event.ID {
+		t.Errorf("unexpected headers %v", r.Header)
+	}
+}
+
+func TestEventBus_Retries(t *testing.T) {
+	defer func(d time.Duration) { webhookRetryDelay = d }(webhookRetryDelay)
+	webhookRetryDelay = time.Millisecond
+
+	var attempts, rejected atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Event-Type") == EventFailover {
+			// Client errors are not retried
+			rejected.Add(1)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if attempts.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	bus := NewEventBus(&WebhooksConfig{Endpoints: []WebhookEndpointConfig{{URL: server.URL}}}, "node-1")
+	bus.Publish(EventQualityAlert, "", nil)
+	bus.Publish(EventFailover, "", nil)
+	bus.Close()
+
+	if got := attempts.Load(); got != 3 {
+		t.Errorf("delivered after %d attempts, want 3", got)
+	}
+	if got := rejected.Load(); got != 1 {
+		t.Errorf("rejected event tried %d times, want once", got)
+	}
+}
+
+func TestEventBus_DropsWhenQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	var delivered atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		delivered.Add(1)
+	}))
+	defer server.Close()
+
+	bus := NewEventBus(&WebhooksConfig{QueueSize: 1, Endpoints: []WebhookEndpointConfig{{URL: server.URL}}}, "node-1")
+	bus.Publish(EventRegistration, "", nil)
+	// Wait for the worker to take the first event off the queue
+	deadline := time.Now().Add(time.Second)
+	for len(bus.endpoints[0].queue) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	bus.Publish(EventRegistration, "", nil) // queued
+	bus.Publish(EventRegistration, "", nil) // dropped
+	close(release)
+	bus.Close()
+
+	if got := delivered.Load(); got != 2 {
+		t.Errorf("delivered %d events, want 2", got)
+	}
+}
+
+func TestSessionRegistry_OnSessionStart(t *testing.T) {
+	registry := NewSessionRegistry(time.Hour)
+	defer registry.Stop()
+
+	started := make(chan string, 10)
+	registry.SetOnSessionStart(func(s *MediaSession) { started <- s.CallID })
+	session := registry.CreateSession("start-call", "from-tag")
+	for _, state := range []SessionState{SessionStatePending, SessionStateActive, SessionStateHold, SessionStateActive} {
+		_ = registry.UpdateSessionStateTyped(session.ID, state)
+	}
+
+	select {
+	case callID := <-started:
+		if callID != "start-call" {
+			t.Errorf("started %s", callID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no session start")
+	}
+	select {
+	case <-started:
+		t.Error("session started again after resuming from hold")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestValidateWebhooksConfig(t *testing.T) {
+	for _, tt := range []struct {
+		endpoint WebhookEndpointConfig
+		valid    bool
+	}{
+		{WebhookEndpointConfig{URL: "https://hooks.example.com/karl"}, true},
+		{WebhookEndpointConfig{URL: "http://10.0.0.5:8080/events", Events: []string{EventFailover, EventSessionEnd}}, true},
+		{WebhookEndpointConfig{URL: "ftp://hooks.example.com"}, false},
+		{WebhookEndpointConfig{URL: "hooks.example.com"}, false},
+		{WebhookEndpointConfig{URL: "https://hooks.example.com", Events: []string{"call-forwarded"}}, false},
+		{WebhookEndpointConfig{URL: "https://hooks.example.com", MaxRetries: maxWebhookRetries + 1}, false},
+		{WebhookEndpointConfig{URL: "https://hooks.example.com", Timeout: -1}, false},
+	} {
+		cfg := &Config{Webhooks: &WebhooksConfig{Endpoints: []WebhookEndpointConfig{tt.endpoint}}}
+		if err := ValidateWebhooksConfig(cfg); (err == nil) != tt.valid {
+			t.Errorf("%+v: error %v", tt.endpoint, err)
+		}
+	}
+}
@@ -24,6 +24,11 @@ func StartWebRTCSession() (*webrtc.PeerConnection, error) {
 	}
 	stunServers := config.WebRTC.StunServers
 	turnServers := config.WebRTC.TurnServers
+	vadEnabled := config.RTPSettings.VADEnabled
+	vadConfig := VADConfig{
+		Mode:       VADMode(config.RTPSettings.VADMode),
+		HangoverMs: config.RTPSettings.VADHangover,
+	}
 	configMutex.RUnlock()
 
 	// Create WebRTC configuration with STUN/TURN servers
@@ -43,8 +48,21 @@ func StartWebRTCSession() (*webrtc.PeerConnection, error) {
 		ICEServers: iceServers,
 	}
 
-	// Create a new WebRTC PeerConnection
-	peerConnection, err := webrtc.NewPeerConnection(webrtcConfig)
+	// Present the managed certificate so the fingerprint is stable
+	if certs, err := DefaultDTLSCertificates(); err == nil {
+		if cert, err := certs.WebRTCCertificate(); err == nil {
+			webrtcConfig.Certificates = []webrtc.Certificate{cert}
+		}
+	} else {
+		log.Printf("Using a per-session DTLS certificate: %v", err)
+	}
+
+	// Create a new WebRTC PeerConnection that accepts simulcast video
+	api, err := newMediaAPI(0, 0, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create WebRTC API: %w", err)
+	}
+	peerConnection, err := api.NewPeerConnection(webrtcConfig)
 	if err != nil {
 		atomic.AddInt32(&sessions, -1)
 		log.Printf("Failed to create WebRTC session: %v", err)
@@ -71,6 +89,11 @@ func StartWebRTCSession() (*webrtc.PeerConnection, error) {
 
 	// Initialize transcoder with the peer connection
 	transcoder = NewRTPTranscoder(peerConnection)
+	if vadEnabled {
+		// The output track rewrites every packet to its negotiated payload
+		// type, so silence is filled with generated noise rather than CN
+		transcoder.EnableVAD(0, vadConfig)
+	}
 
 	// Set up track handling for transcoding
 	peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
@@ -85,10 +108,12 @@ func StartWebRTCSession() (*webrtc.PeerConnection, error) {
 			}
 
 			// Add the transcoded track to the peer connection
-			if _, err := peerConnection.AddTrack(outputTrack); err != nil {
+			sender, err := peerConnection.AddTrack(outputTrack)
+			if err != nil {
 				log.Printf("Failed to add transcoded track: %v", err)
 				return
 			}
+			transcoder.WatchSender(track.ID(), sender)
 
 			log.Printf("Added transcoded track for: %s", track.ID())
 		}
@@ -101,26 +126,32 @@ func StartWebRTCSession() (*webrtc.PeerConnection, error) {
 		}
 	})
 
-	// Set up connection state handling
+	// Set up connection state handling. A failed or disconnected connection
+	// keeps its transcoder so media resumes after an ICE restart; resources
+	// are released when the connection is closed.
+	var connected int32
 	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
 		log.Printf("WebRTC connection state changed to: %s", state.String())
 
 		switch state {
-		case webrtc.PeerConnectionStateDisconnected:
-			log.Println("WebRTC disconnected - cleaning up transcoder")
-			if transcoder != nil {
-				transcoder.Close()
+		case webrtc.PeerConnectionStateConnected:
+			log.Println("WebRTC connected successfully")
+			if atomic.CompareAndSwapInt32(&connected, 0, 1) {
+				atomic.AddInt32(&sessions, 1)
+			}
+		case webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateFailed:
+			log.Printf("WebRTC %s - waiting for ICE to recover or restart", state.String())
+			if atomic.CompareAndSwapInt32(&connected, 1, 0) {
+				atomic.AddInt32(&sessions, -1)
+			}
+		case webrtc.PeerConnectionStateClosed:
+			log.Println("WebRTC closed - cleaning up transcoder")
+			if atomic.CompareAndSwapInt32(&connected, 1, 0) {
+				atomic.AddInt32(&sessions, -1)
 			}
-			atomic.AddInt32(&sessions, -1)
-		case webrtc.PeerConnectionStateFailed:
-			log.Println("WebRTC failed - cleaning up transcoder")
 			if transcoder != nil {
 				transcoder.Close()
 			}
-			atomic.AddInt32(&sessions, -1)
-		case webrtc.PeerConnectionStateConnected:
-			log.Println("WebRTC connected successfully")
-			atomic.AddInt32(&sessions, 1)
 		}
 	})
 
@@ -2,21 +2,33 @@ package internal
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"runtime"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 // WorkerPool settings
 var (
-	workerPoolSize = runtime.NumCPU() * 2    // Number of concurrent workers (adjust as needed)
-	rtpJobs        = make(chan []byte, 1000) // Buffered channel for incoming RTP packets
-	wg             sync.WaitGroup
+	workerPoolSize = defaultWorkerPoolSize()      // Number of concurrent workers
+	queueConfig    QueueConfig                    // Per-worker queue size and drop policy
+	rtpJobs        atomic.Pointer[[]*packetQueue] // Per-worker queues of pooled packet buffers, swapped on resize
+	rtpWorkersDone chan struct{}                  // Closed once the workers of the current queues exit, nil before InitWorkerPool
+	workerPoolMu   sync.Mutex                     // Serializes starting, resizing and stopping the pool
+
+	// Packet buffers and parsed packets are reused so the packet path does
+	// not allocate per packet
+	rtpBufferPool = sync.Pool{New: func() interface{} {
+		buf := make([]byte, rtpBufferSize)
+		return &buf
+	}}
+	rtpPacketPool = sync.Pool{New: func() interface{} { return new(RTPPacket) }}
 
 	// Metrics counters
 	packetsProcessed  atomic.Uint64
@@ -28,9 +40,24 @@ var (
 	// Debug settings
 	debugLogging = false
 
-	// RTP handler registry (mapping SSRC to handlers)
-	rtpHandlers     = make(map[uint32]RTPPacketHandler)
-	rtpHandlersLock sync.RWMutex
+	// RTP handler registry (mapping SSRC to handlers), and the handler of
+	// streams that have none
+	rtpHandlers       = make(map[uint32]RTPPacketHandler)
+	defaultRTPHandler RTPPacketHandler
+	rtpHandlersLock   sync.RWMutex
+
+	// Per-SSRC reception statistics used for RTCP reports
+	receiveStats = NewReceiveStatsTracker()
+
+	// Per-packet failures are logged at most once a second
+	workerLog    = Logger(ComponentWorker)
+	workerErrors = NewLogSampler(workerLog, slog.LevelError, 1, packetErrorInterval)
+	rtpJobDrops  = NewLogSampler(workerLog, slog.LevelWarn, 1, packetErrorInterval)
+)
+
+const (
+	rtpBufferSize = 1500 // fits any packet received on a standard MTU
+	rtpQueueDepth = 256  // packets queued per worker
 )
 
 // RTPPacket represents a parsed RTP packet
@@ -38,6 +65,7 @@ type RTPPacket struct {
 	Version        uint8
 	Padding        bool
 	Extension      bool
+	ExtensionID    uint16 // profile of the header extension
 	CSRCCount      uint8
 	Marker         bool
 	PayloadType    uint8
@@ -50,7 +78,9 @@ type RTPPacket struct {
 	Received       time.Time
 }
 
-// RTPPacketHandler defines the interface for RTP packet processing
+// RTPPacketHandler defines the interface for RTP packet processing. The
+// packet and its payload are reused once Handle returns, so a handler that
+// keeps them must copy them
 type RTPPacketHandler interface {
 	Handle(*RTPPacket) error
 }
@@ -69,78 +99,314 @@ func UnregisterRTPHandler(ssrc uint32) {
 	delete(rtpHandlers, ssrc)
 }
 
+// unregisterRTPHandlerOf removes the handler of an SSRC if it is still
+// handler, leaving one registered since in place
+func unregisterRTPHandlerOf(ssrc uint32, handler RTPPacketHandler) {
+	rtpHandlersLock.Lock()
+	defer rtpHandlersLock.Unlock()
+	if rtpHandlers[ssrc] == handler {
+		delete(rtpHandlers, ssrc)
+	}
+}
+
+// SetDefaultRTPHandler sets the handler of streams with no handler of their
+// own; nil leaves them unforwarded
+func SetDefaultRTPHandler(handler RTPPacketHandler) {
+	rtpHandlersLock.Lock()
+	defer rtpHandlersLock.Unlock()
+	defaultRTPHandler = handler
+}
+
+// rtpHandlerFor returns the handler of an SSRC, or the default handler
+func rtpHandlerFor(ssrc uint32) (RTPPacketHandler, bool) {
+	rtpHandlersLock.RLock()
+	defer rtpHandlersLock.RUnlock()
+	if handler, ok := rtpHandlers[ssrc]; ok {
+		return handler, true
+	}
+	return defaultRTPHandler, defaultRTPHandler != nil
+}
+
+func init() {
+	queues := newRTPQueues(workerPoolSize, queueConfig)
+	rtpJobs.Store(&queues)
+}
+
+// defaultWorkerPoolSize is two workers per CPU
+func defaultWorkerPoolSize() int {
+	return runtime.NumCPU() * 2
+}
+
 // InitWorkerPool initializes a pool of workers to process RTP packets concurrently
 func InitWorkerPool() {
-	log.Printf("Initializing RTP worker pool with %d workers", workerPoolSize)
-
-	for i := 0; i < workerPoolSize; i++ {
-		wg.Add(1)
-		go func(workerID int) {
-			defer wg.Done()
-			for packet := range rtpJobs {
-				processRTPPacket(packet, workerID)
+	workerPoolMu.Lock()
+	defer workerPoolMu.Unlock()
+
+	workerLog.Info("Initializing RTP worker pool", "workers", workerPoolSize)
+	rtpWorkersDone = startRTPWorkers(*rtpJobs.Load(), nil)
+	updateWorkerPoolMetrics()
+}
+
+// startRTPWorkers starts one worker per queue. The workers wait for after
+// to close before taking packets, so a stream moved to another queue by a
+// resize is still handled in order. The returned channel closes once every
+// worker has exited
+func startRTPWorkers(queues []*packetQueue, after <-chan struct{}) chan struct{} {
+	var workers sync.WaitGroup
+	for i, queue := range queues {
+		workers.Add(1)
+		go func(workerID int, queue *packetQueue) {
+			defer workers.Done()
+			if after != nil {
+				<-after
+			}
+			for {
+				job, ok := queue.pop()
+				if !ok {
+					return
+				}
+				processRTPPacket(*job.buf, job.received, workerID)
+				putPacketBuffer(job.buf)
 			}
-		}(i)
+		}(i, queue)
 	}
+
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+	return done
 }
 
-// processRTPPacket handles an RTP packet (can include transcoding, forwarding, etc.)
-func processRTPPacket(packet []byte, workerID int) {
-	// Capture packet for debugging if PCAP logging is enabled
-	if IsPCAPEnabled() {
-		CapturePacket(packet)
+// ConfigureWorkerQueue sets the size and drop policy of the worker queues.
+// It must be called before InitWorkerPool
+func ConfigureWorkerQueue(config QueueConfig) {
+	workerPoolMu.Lock()
+	defer workerPoolMu.Unlock()
+	queueConfig = config
+	queues := newRTPQueues(workerPoolSize, config)
+	rtpJobs.Store(&queues)
+}
+
+// newRTPQueues creates one job queue per worker
+func newRTPQueues(workers int, config QueueConfig) []*packetQueue {
+	if workers < 1 {
+		workers = 1
+	}
+	queues := make([]*packetQueue, workers)
+	for i := range queues {
+		queues[i] = newPacketQueue(config)
 	}
+	return queues
+}
 
-	// Parse the RTP packet
-	rtpPacket, err := ParseRTPPacket(packet)
-	if err != nil {
-		log.Printf("Worker %d failed to parse RTP packet: %v", workerID, err)
+// rtpQueueFor picks the worker queue for a packet by its SSRC, so every
+// packet of a stream is handled by the same worker and stays in order.
+// RTCP is keyed by its sender SSRC
+func rtpQueueFor(packet []byte, queues int) int {
+	var ssrc uint32
+	switch {
+	case IsRTCPPacket(packet) && len(packet) >= 8:
+		ssrc = binary.BigEndian.Uint32(packet[4:8])
+	case len(packet) >= 12:
+		ssrc = binary.BigEndian.Uint32(packet[8:12])
+	}
+	// Fibonacci hashing lets every bit of the SSRC choose the queue
+	h := uint64(ssrc) * 0x9E3779B97F4A7C15
+	return int((h >> 32) % uint64(queues))
+}
+
+// processRTPPacket handles an RTP packet (can include transcoding, forwarding, etc.).
+// Listeners capture and tap packets before queueing them, so this does not.
+// received is when the packet was read, before it waited in the queue
+func processRTPPacket(packet []byte, received time.Time, workerID int) {
+	// RTCP shares the queue with RTP on multiplexed sockets
+	if IsRTCPPacket(packet) {
+		if err := HandleRTCPPacket(packet); err != nil {
+			if workerErrors.Allow() {
+				workerErrors.Log("RTCP error", "worker", workerID, "error", err)
+			}
+		}
 		return
 	}
 
+	// Parse the RTP packet into a pooled struct
+	rtpPacket := rtpPacketPool.Get().(*RTPPacket)
+	defer releaseRTPPacket(rtpPacket)
+	if err := parseRTPPacketInto(packet, rtpPacket); err != nil {
+		if workerErrors.Allow() {
+			workerErrors.Log("Failed to parse RTP packet", "worker", workerID, "error", err)
+		}
+		return
+	}
+	rtpPacket.Received = received
+
+	// A FlexFEC repair packet is consumed here and the packets it recovers
+	// are queued like received ones
+	if fec := fecHandlerFor(rtpPacket.SSRC); fec != nil && !receiveFEC(fec, packet, rtpPacket.SSRC, workerID) {
+		return
+	}
+
+	// Track sequence, loss and jitter for RTCP reception reports
+	clockRate := GetCodecNegotiator().ClockRate(rtpPacket.SSRC, rtpPacket.PayloadType)
+	receiveStats.Update(rtpPacket.SSRC, rtpPacket.SequenceNumber, rtpPacket.Timestamp, clockRate, rtpPacket.Received)
+
+	// Resolve the outgoing codec before transcoding renumbers the payload type
+	src, dst, ptime, negotiated := GetCodecNegotiator().ResolveOutput(rtpPacket.SSRC, rtpPacket.PayloadType)
+
 	// Update metrics
-	UpdateRTPMetrics(rtpPacket)
+	UpdateRTPMetrics(rtpPacket, packetCodecLabel(rtpPacket.PayloadType, src, negotiated))
 
 	// Check if this packet should be processed for transcoding
+	transcoded := false
 	if ShouldTranscodePacket(rtpPacket) {
 		// Perform audio transcoding if needed
-		if err := TranscodeRTPPacket(rtpPacket); err != nil {
-			log.Printf("Worker %d transcoding error: %v", workerID, err)
+		if err := TranscodeRTPPacket(rtpPacket); errors.Is(err, ErrFrameSuppressed) {
+			// Silence the peer's codec does not transmit
+			return
+		} else if err != nil {
+			if workerErrors.Allow() {
+				workerErrors.Log("Transcoding error", append(streamAttrs(rtpPacket.SSRC), "worker", workerID, "error", err)...)
+			}
+		} else {
+			transcoded = true
 		}
 	}
 
-	// Check if packet needs to be forwarded to another destination
-	if ShouldForwardPacket(rtpPacket) {
-		if err := ForwardRTPPacket(rtpPacket); err != nil {
-			log.Printf("Worker %d forwarding error: %v", workerID, err)
+	// Re-frame to the packet time the receiving leg asked for, and check
+	// if the packets need to be forwarded to another destination
+	forward := ShouldForwardPacket(rtpPacket)
+	if !negotiated {
+		if forward {
+			forwardRTPPacket(rtpPacket, workerID)
+		}
+	} else {
+		out := src
+		if transcoded {
+			out = dst
+		}
+		packets := getRepacketizer(rtpPacket.SSRC).Push(rtpPacket, rtpClockRate(src), out, ptime)
+		if forward {
+			for _, p := range packets {
+				forwardRTPPacket(p, workerID)
+			}
 		}
 	}
 
-	// Check for RTCP feedback messages and update statistics
-	HandleRTCPFeedback(rtpPacket)
-
 	// Log detailed packet info at debug level only
 	if IsDebugLoggingEnabled() {
-		log.Printf("Worker %d processed RTP packet: SSRC=%d, seq=%d, ts=%d, pt=%d, size=%d bytes",
-			workerID, rtpPacket.SSRC, rtpPacket.SequenceNumber, rtpPacket.Timestamp,
-			rtpPacket.PayloadType, len(packet))
+		workerLog.Debug("Processed RTP packet", append(streamAttrs(rtpPacket.SSRC), "worker", workerID,
+			"seq", rtpPacket.SequenceNumber, "timestamp", rtpPacket.Timestamp,
+			"pt", rtpPacket.PayloadType, "size", len(packet))...)
+	}
+}
+
+// forwardRTPPacket forwards a packet, through the call's impairment if it
+// has one, logging a failure. Audio replaced by an announcement is dropped
+func forwardRTPPacket(packet *RTPPacket, workerID int) {
+	if replacedByPlayback(packet) {
+		return
 	}
+	if impairer := impairerFor(packet.SSRC); impairer != nil {
+		impairer.impair(packet, func(p *RTPPacket) { sendRTPPacket(p, workerID) })
+		return
+	}
+	sendRTPPacket(packet, workerID)
 }
 
-// AddRTPJob sends an RTP packet to the worker pool for processing
+// sendRTPPacket hands a packet to its handler, logging a failure
+func sendRTPPacket(packet *RTPPacket, workerID int) {
+	if err := ForwardRTPPacket(packet); err != nil {
+		if workerErrors.Allow() {
+			workerErrors.Log("Forwarding error", append(streamAttrs(packet.SSRC), "worker", workerID, "error", err)...)
+		}
+	}
+}
+
+// AddRTPJob sends an RTP packet to the worker that handles its stream. The
+// packet is copied into a pooled buffer, so the caller may reuse it. RTCP
+// and DTMF events are queued ahead of audio; when a worker falls behind,
+// packets are dropped by the configured policy
 func AddRTPJob(packet []byte) {
-	select {
-	case rtpJobs <- append([]byte(nil), packet...): // Copy packet before sending to avoid data race
-	default:
-		log.Println("RTP job queue is full, packet dropped")
+	queueRTPJob(copyPacketBuffer(packet), time.Now())
+}
+
+// rtpJob is a packet in a pooled buffer waiting for its worker, with the
+// time it was read, so queueing delay does not count as network jitter
+type rtpJob struct {
+	buf      *[]byte
+	received time.Time
+}
+
+// queueRTPJob is AddRTPJob for a packet already in a pooled buffer, which
+// the worker returns to the pool, read at received. It reports whether the
+// packet was queued
+func queueRTPJob(buf *[]byte, received time.Time) bool {
+	packet := *buf
+	priority := isPriorityPacket(packet)
+	for {
+		jobs := rtpJobs.Load()
+		queues := *jobs
+		queued, open := queues[rtpQueueFor(packet, len(queues))].offer(rtpJob{buf: buf, received: received}, priority)
+		if !open {
+			if rtpJobs.Load() == jobs {
+				// The pool is stopped
+				putPacketBuffer(buf)
+				return false
+			}
+			// The pool was resized; queue on the new workers
+			continue
+		}
+		if !queued && rtpJobDrops.Allow() {
+			rtpJobDrops.Log("RTP job queue is full, packet dropped")
+		}
+		return queued
 	}
 }
 
+// getPacketBuffer returns a pooled buffer of at least rtpBufferSize bytes
+func getPacketBuffer() *[]byte {
+	buf := rtpBufferPool.Get().(*[]byte)
+	*buf = (*buf)[:cap(*buf)]
+	return buf
+}
+
+// copyPacketBuffer copies a packet into a pooled buffer
+func copyPacketBuffer(packet []byte) *[]byte {
+	buf := getPacketBuffer()
+	*buf = append((*buf)[:0], packet...)
+	return buf
+}
+
+// putPacketBuffer returns a buffer to the pool once nothing refers to it
+func putPacketBuffer(buf *[]byte) {
+	rtpBufferPool.Put(buf)
+}
+
+// releaseRTPPacket returns a parsed packet to the pool, keeping its CSRC
+// slice for reuse
+func releaseRTPPacket(packet *RTPPacket) {
+	*packet = RTPPacket{CSRC: packet.CSRC[:0]}
+	rtpPacketPool.Put(packet)
+}
+
+// GetReceiveStatsTracker returns the per-SSRC reception statistics
+func GetReceiveStatsTracker() *ReceiveStatsTracker {
+	return receiveStats
+}
+
 // StopWorkerPool shuts down the worker pool gracefully
 func StopWorkerPool() {
-	close(rtpJobs)
-	wg.Wait()
-	log.Println("RTP worker pool stopped")
+	workerPoolMu.Lock()
+	defer workerPoolMu.Unlock()
+	for _, queue := range *rtpJobs.Load() {
+		queue.close()
+	}
+	if rtpWorkersDone != nil {
+		<-rtpWorkersDone
+	}
+	workerLog.Info("RTP worker pool stopped")
 }
 
 // EnableDebugLogging enables or disables debug-level logging
@@ -170,11 +436,23 @@ func GetWorkerPoolMetrics() map[string]uint64 {
 	return GetMetrics()
 }
 
-// ParseRTPPacket parses a raw RTP packet into a structured RTPPacket
+// ParseRTPPacket parses a raw RTP packet into a structured RTPPacket,
+// received now
 func ParseRTPPacket(data []byte) (*RTPPacket, error) {
+	packet := &RTPPacket{}
+	if err := parseRTPPacketInto(data, packet); err != nil {
+		return nil, err
+	}
+	packet.Received = time.Now()
+	return packet, nil
+}
+
+// parseRTPPacketInto parses a raw RTP packet into an existing RTPPacket,
+// reusing its CSRC slice. The extension data and payload refer to data
+func parseRTPPacketInto(data []byte, packet *RTPPacket) error {
 	if len(data) < 12 {
 		packetErrors.Add(1)
-		return nil, fmt.Errorf("packet too short for RTP header")
+		return fmt.Errorf("packet too short for RTP header")
 	}
 
 	// Parse header fields
@@ -193,7 +471,7 @@ func ParseRTPPacket(data []byte) (*RTPPacket, error) {
 	ssrc := binary.BigEndian.Uint32(data[8:12])
 
 	// Initialize packet
-	packet := &RTPPacket{
+	*packet = RTPPacket{
 		Version:        version,
 		Padding:        hasPadding,
 		Extension:      hasExtension,
@@ -203,7 +481,7 @@ func ParseRTPPacket(data []byte) (*RTPPacket, error) {
 		SequenceNumber: sequenceNumber,
 		Timestamp:      timestamp,
 		SSRC:           ssrc,
-		Received:       time.Now(),
+		CSRC:           packet.CSRC[:0],
 	}
 
 	// Calculate header size
@@ -212,16 +490,13 @@ func ParseRTPPacket(data []byte) (*RTPPacket, error) {
 	// Check if packet is long enough for header + CSRC
 	if len(data) < headerSize {
 		packetErrors.Add(1)
-		return nil, fmt.Errorf("packet too short for CSRC list")
+		return fmt.Errorf("packet too short for CSRC list")
 	}
 
 	// Extract CSRC list
-	if csrcCount > 0 {
-		packet.CSRC = make([]uint32, csrcCount)
-		for i := uint8(0); i < csrcCount; i++ {
-			offset := 12 + 4*i
-			packet.CSRC[i] = binary.BigEndian.Uint32(data[offset : offset+4])
-		}
+	for i := uint8(0); i < csrcCount; i++ {
+		offset := 12 + 4*i
+		packet.CSRC = append(packet.CSRC, binary.BigEndian.Uint32(data[offset:offset+4]))
 	}
 
 	// Handle extension header if present
@@ -229,16 +504,17 @@ func ParseRTPPacket(data []byte) (*RTPPacket, error) {
 		// Check if packet is long enough for extension header
 		if len(data) < headerSize+4 {
 			packetErrors.Add(1)
-			return nil, fmt.Errorf("packet too short for extension header")
+			return fmt.Errorf("packet too short for extension header")
 		}
 
 		extHeaderOffset := headerSize
+		packet.ExtensionID = binary.BigEndian.Uint16(data[extHeaderOffset : extHeaderOffset+2])
 		extLength := int(binary.BigEndian.Uint16(data[extHeaderOffset+2:extHeaderOffset+4])) * 4
 
 		// Check if packet is long enough for extension data
 		if len(data) < headerSize+4+extLength {
 			packetErrors.Add(1)
-			return nil, fmt.Errorf("packet too short for extension data")
+			return fmt.Errorf("packet too short for extension data")
 		}
 
 		packet.ExtensionData = data[extHeaderOffset+4 : extHeaderOffset+4+extLength]
@@ -265,68 +541,94 @@ func ParseRTPPacket(data []byte) (*RTPPacket, error) {
 	packetsProcessed.Add(1)
 	bytesProcessed.Add(uint64(len(data)))
 
-	return packet, nil
+	return nil
 }
 
-// UpdateRTPMetrics updates metrics for the processed RTP packet
-func UpdateRTPMetrics(packet *RTPPacket) {
-	// Update Prometheus metrics here
-	// This would be integrated with the metrics.go implementation
+// marshalRTPPacket writes a packet into buf, which must hold the packet,
+// and returns the bytes written. Padding removed by parsing is not restored
+func marshalRTPPacket(packet *RTPPacket, buf []byte) []byte {
+	out := append(buf[:0], 2<<6|byte(len(packet.CSRC))&0x0F, packet.PayloadType&0x7F)
+	if packet.Extension {
+		out[0] |= 0x10
+	}
+	if packet.Marker {
+		out[1] |= 0x80
+	}
+	out = binary.BigEndian.AppendUint16(out, packet.SequenceNumber)
+	out = binary.BigEndian.AppendUint32(out, packet.Timestamp)
+	out = binary.BigEndian.AppendUint32(out, packet.SSRC)
+	for _, csrc := range packet.CSRC {
+		out = binary.BigEndian.AppendUint32(out, csrc)
+	}
+	if packet.Extension {
+		out = binary.BigEndian.AppendUint16(out, packet.ExtensionID)
+		out = binary.BigEndian.AppendUint16(out, uint16(len(packet.ExtensionData)/4))
+		out = append(out, packet.ExtensionData...)
+	}
+	return append(out, packet.Payload...)
+}
 
-	// Example: rtpPacketsTotal.WithLabelValues(fmt.Sprintf("%d", packet.PayloadType)).Inc()
+// UpdateRTPMetrics counts a received RTP packet by payload type and codec
+func UpdateRTPMetrics(packet *RTPPacket, codec string) {
+	packetCounter(packet.PayloadType, codec).Inc()
 }
 
 // ShouldTranscodePacket determines if a packet needs transcoding
 func ShouldTranscodePacket(packet *RTPPacket) bool {
-	// Check if this packet's payload type requires transcoding
-	// This would be based on configured transcoding rules
+	// Only transcode when the call's negotiated codecs or gain control
+	// require it; payload type numbers alone do not identify a dynamic codec
+	_, _, _, ok := resolveTranscode(packet)
+	return ok
+}
+
+// resolveTranscode returns the codecs a packet is transcoded between and the
+// gain control applied on the way, if any. In a call with AGC, audio Karl
+// can decode is re-encoded even when both legs use the same codec
+func resolveTranscode(packet *RTPPacket) (src, dst CodecInfo, agc *AGC, ok bool) {
+	n := GetCodecNegotiator()
+	src, dst, ok = n.ResolveTranscode(packet.SSRC, packet.PayloadType)
+	config, hasAGC := n.AGCConfig(packet.SSRC)
+	if !hasAGC {
+		return src, dst, nil, ok
+	}
 
-	// For now, a simple implementation that checks for common audio codecs
-	switch packet.PayloadType {
-	case 0, 8: // PCMU, PCMA
-		return true
-	case 111, 96, 97, 98, 99, 100, 101, 102: // Typical dynamic payload types for Opus
-		return true
-	default:
-		return false
+	src, dst, _, negotiated := n.ResolveOutput(packet.SSRC, packet.PayloadType)
+	rate := codecSampleRate(src)
+	if !negotiated || rate == 0 || codecSampleRate(dst) == 0 {
+		return src, dst, nil, ok
 	}
+	return src, dst, getAGC(packet.SSRC, rate, config), true
 }
 
 // TranscodeRTPPacket performs transcoding on an RTP packet's payload
 func TranscodeRTPPacket(packet *RTPPacket) error {
-	// Identify source and target codecs based on payload type
-	var srcCodec, dstCodec string
-
-	switch packet.PayloadType {
-	case 0:
-		srcCodec = "PCMU" // G.711 μ-law
-		dstCodec = "opus"
-	case 8:
-		srcCodec = "PCMA" // G.711 A-law
-		dstCodec = "opus"
-	case 111, 96, 97, 98, 99, 100, 101, 102:
-		srcCodec = "opus" // Assuming dynamic types are Opus
-		dstCodec = "PCMU" // Target G.711 μ-law
-	default:
-		return fmt.Errorf("unsupported codec for transcoding: %d", packet.PayloadType)
+	// Look up the negotiated source and target codecs for this stream
+	src, dst, agc, ok := resolveTranscode(packet)
+	if !ok {
+		return fmt.Errorf("no negotiated transcoding for SSRC %d payload type %d",
+			packet.SSRC, packet.PayloadType)
+	}
+	var stage func([]int16) []int16
+	if agc != nil {
+		stage = agc.Process
 	}
 
 	// Perform the actual transcoding using the codec_converter.go implementations
-	transcodedPayload, err := TranscodeAudio(packet.Payload, srcCodec, dstCodec)
+	codecs := getStreamCodecs(packet.SSRC)
+	start := time.Now()
+	transcodedPayload, err := transcodeAudioWith(packet.Payload, src, dst, codecs, stage)
+	transcodeDuration.WithLabelValues(codecMetricLabel(src.Name), codecMetricLabel(dst.Name)).Observe(time.Since(start).Seconds())
+	if errors.Is(err, ErrFrameSuppressed) {
+		return err
+	}
 	if err != nil {
 		transcodingErrors.Add(1)
 		return fmt.Errorf("failed to transcode audio: %w", err)
 	}
 
-	// Update the packet with the transcoded payload
+	// Update the packet with the transcoded payload and the peer's payload type
 	packet.Payload = transcodedPayload
-
-	// Update payload type to reflect the new codec
-	if srcCodec == "PCMU" || srcCodec == "PCMA" {
-		packet.PayloadType = 111 // Example dynamic type for Opus
-	} else {
-		packet.PayloadType = 0 // PCMU
-	}
+	packet.PayloadType = dst.PayloadType
 
 	return nil
 }
@@ -334,20 +636,14 @@ func TranscodeRTPPacket(packet *RTPPacket) error {
 // ShouldForwardPacket determines if a packet should be forwarded
 func ShouldForwardPacket(packet *RTPPacket) bool {
 	// Check if this packet's SSRC has a registered forwarding destination
-	rtpHandlersLock.RLock()
-	_, hasHandler := rtpHandlers[packet.SSRC]
-	rtpHandlersLock.RUnlock()
-
+	_, hasHandler := rtpHandlerFor(packet.SSRC)
 	return hasHandler
 }
 
 // ForwardRTPPacket forwards an RTP packet to its destination
 func ForwardRTPPacket(packet *RTPPacket) error {
 	// Get handler for this SSRC
-	rtpHandlersLock.RLock()
-	handler, exists := rtpHandlers[packet.SSRC]
-	rtpHandlersLock.RUnlock()
-
+	handler, exists := rtpHandlerFor(packet.SSRC)
 	if !exists {
 		return fmt.Errorf("no handler for SSRC %d", packet.SSRC)
 	}
@@ -361,6 +657,17 @@ func ForwardRTPPacket(packet *RTPPacket) error {
 	return nil
 }
 
+// rtcpQualityMetrics is shared by all feedback handlers, labelled by SSRC
+var rtcpQualityMetrics = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "karl",
+		Subsystem: "rtcp",
+		Name:      "quality_metrics",
+		Help:      "RTCP quality metrics (packet loss, jitter, RTT)",
+	},
+	[]string{"ssrc", "metric"},
+)
+
 // RTCPFeedbackHandler processes RTCP feedback messages
 type RTCPFeedbackHandler struct {
 	ssrc           uint32
@@ -369,30 +676,23 @@ type RTCPFeedbackHandler struct {
 	jitter         float64
 	rtt            float64
 	mu             sync.RWMutex
-	qualityMetrics prometheus.GaugeVec
+	qualityMetrics *prometheus.GaugeVec
 }
 
 // NewRTCPFeedbackHandler creates a feedback handler for a specific SSRC
 func NewRTCPFeedbackHandler(ssrc uint32) *RTCPFeedbackHandler {
-	// Create the handler with metrics
-	handler := &RTCPFeedbackHandler{
-		ssrc:         ssrc,
-		lastFeedback: time.Now(),
-		qualityMetrics: *prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Namespace: "karl",
-				Subsystem: "rtcp",
-				Name:      "quality_metrics",
-				Help:      "RTCP quality metrics (packet loss, jitter, RTT)",
-			},
-			[]string{"ssrc", "metric"},
-		),
-	}
-
-	// Register with Prometheus
-	prometheus.MustRegister(&handler.qualityMetrics)
+	return &RTCPFeedbackHandler{
+		ssrc:           ssrc,
+		lastFeedback:   time.Now(),
+		qualityMetrics: rtcpQualityMetrics,
+	}
+}
 
-	return handler
+// GetFeedback returns the most recent loss (%), jitter (ms) and RTT (ms)
+func (h *RTCPFeedbackHandler) GetFeedback() (packetLoss, jitter, rtt float64, lastFeedback time.Time) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.packetLoss, h.jitter, h.rtt, h.lastFeedback
 }
 
 // HandleFeedback processes an RTCP feedback message
@@ -412,12 +712,20 @@ func (h *RTCPFeedbackHandler) HandleFeedback(packetLoss, jitter, rtt float64) {
 	h.qualityMetrics.WithLabelValues(ssrcStr, "jitter").Set(jitter)
 	h.qualityMetrics.WithLabelValues(ssrcStr, "rtt").Set(rtt)
 
-	// Implement congestion control based on feedback
-	if packetLoss > 5.0 {
-		// High packet loss - reduce bitrate
-		log.Printf("⚠️ High packet loss (%.2f%%) for SSRC %d - reducing bitrate",
-			packetLoss, h.ssrc)
-		// In production would adjust encoder settings
+	// Tune the stream's Opus encoder to the measured loss: inband FEC for
+	// the loss, and a lower bitrate while it is high
+	codecs, ok := lookupStreamCodecs(h.ssrc)
+	if !ok {
+		return
+	}
+	encoder := codecs.OpusEncoder()
+	encoder.SetPacketLoss(opusPacketLoss(packetLoss))
+	current := encoder.Bitrate()
+	if bitrate := opusFeedbackBitrate(current, packetLoss); bitrate != current {
+		encoder.SetBitrate(bitrate)
+		if bitrate < current {
+			workerLog.Warn("High packet loss, reducing Opus bitrate", append(streamAttrs(h.ssrc), "loss_percent", packetLoss, "bitrate", bitrate)...)
+		}
 	}
 }
 
@@ -453,17 +761,29 @@ func GetRTCPFeedbackHandler(ssrc uint32) *RTCPFeedbackHandler {
 	return handler
 }
 
-// HandleRTCPFeedback processes RTCP feedback for this RTP stream
-func HandleRTCPFeedback(packet *RTPPacket) {
-	// Get the feedback handler for this SSRC
-	handler := GetRTCPFeedbackHandler(packet.SSRC)
+// lookupRTCPFeedbackHandler returns the handler for an SSRC without
+// creating one
+func lookupRTCPFeedbackHandler(ssrc uint32) (*RTCPFeedbackHandler, bool) {
+	rtcpFeedbackMu.RLock()
+	defer rtcpFeedbackMu.RUnlock()
+	handler, ok := rtcpFeedbackHandlers[ssrc]
+	return handler, ok
+}
 
-	// For now, we're just using simple metrics based on packet sequence
-	// In a real implementation, we'd parse actual RTCP packets with feedback
+// RemoveRTCPFeedbackHandler drops the handler and metric series for an SSRC
+func RemoveRTCPFeedbackHandler(ssrc uint32) {
+	rtcpFeedbackMu.Lock()
+	delete(rtcpFeedbackHandlers, ssrc)
+	rtcpFeedbackMu.Unlock()
 
-	// Calculate simple jitter metric based on packet arrival time
-	jitter := 0.0
+	ssrcStr := fmt.Sprintf("%d", ssrc)
+	for _, metric := range []string{"packet_loss", "jitter", "rtt"} {
+		rtcpQualityMetrics.DeleteLabelValues(ssrcStr, metric)
+	}
+}
 
-	// Process with the handler
-	handler.HandleFeedback(0.0, jitter, 0.0)
+// HandleRTCPPacket parses an RTCP packet and feeds its reports into the
+// per-SSRC feedback handlers
+func HandleRTCPPacket(packet []byte) error {
+	return GetRTCPDemuxer().HandlePacket(packet)
 }
@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"bytes"
 	"encoding/binary"
 	"sync"
 	"testing"
@@ -59,6 +60,23 @@ func TestParseRTPPacket_Valid(t *testing.T) {
 	}
 }
 
+func TestMarshalRTPPacket_RoundTrip(t *testing.T) {
+	// Marker, PT=96, two CSRCs and a one-word header extension
+	packet := []byte{
+		0x92, 0xE0, 0x00, 0x07, 0x00, 0x00, 0x01, 0x40, 0xDE, 0xAD, 0xBE, 0xEF,
+		0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x02,
+		0xBE, 0xDE, 0x00, 0x01, 0x10, 0xAA, 0x00, 0x00,
+		0x01, 0x02, 0x03,
+	}
+	parsed, err := ParseRTPPacket(packet)
+	if err != nil {
+		t.Fatalf("ParseRTPPacket failed: %v", err)
+	}
+	if got := marshalRTPPacket(parsed, make([]byte, 0, 64)); !bytes.Equal(got, packet) {
+		t.Errorf("marshalled\n %x\nwant\n %x", got, packet)
+	}
+}
+
 func TestParseRTPPacket_WithMarker(t *testing.T) {
 	packet := make([]byte, 12)
 	packet[0] = 0x80
@@ -275,27 +293,39 @@ func (h *mockRTPHandler) Handle(packet *RTPPacket) error {
 }
 
 func TestShouldTranscodePacket(t *testing.T) {
+	negotiator := GetCodecNegotiator()
+	negotiator.SetOfferCodecs("transcode-test", []CodecInfo{
+		{PayloadType: 111, Name: "opus", ClockRate: 48000, Channels: 2},
+		{PayloadType: 13, Name: "CN", ClockRate: 8000, Channels: 1},
+	})
+	negotiator.SetAnswerCodecs("transcode-test", []CodecInfo{
+		{PayloadType: 0, Name: "PCMU", ClockRate: 8000, Channels: 1},
+		{PayloadType: 13, Name: "CN", ClockRate: 8000, Channels: 1},
+	})
+	negotiator.BindSSRC(1001, "transcode-test", true)
+	negotiator.BindSSRC(1002, "transcode-test", false)
+	defer negotiator.RemoveCall("transcode-test")
+
 	tests := []struct {
+		ssrc        uint32
 		payloadType uint8
 		expected    bool
 		desc        string
 	}{
-		{0, true, "PCMU should transcode"},
-		{8, true, "PCMA should transcode"},
-		{111, true, "Opus dynamic PT should transcode"},
-		{96, true, "Dynamic PT 96 should transcode"},
-		{13, false, "CN (comfort noise) should not transcode"},
-		{18, false, "G.729 should not transcode"},
-		{3, false, "GSM should not transcode"},
+		{1001, 111, true, "Negotiated Opus toward PCMU leg should transcode"},
+		{1002, 0, true, "Negotiated PCMU toward Opus leg should transcode"},
+		{1001, 13, false, "CN accepted by both legs should not transcode"},
+		{1001, 96, false, "Non-negotiated dynamic PT should not transcode"},
+		{9999, 0, false, "Unknown SSRC should not transcode"},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.desc, func(t *testing.T) {
-			packet := &RTPPacket{PayloadType: tt.payloadType}
+			packet := &RTPPacket{SSRC: tt.ssrc, PayloadType: tt.payloadType}
 			result := ShouldTranscodePacket(packet)
 			if result != tt.expected {
-				t.Errorf("ShouldTranscodePacket(PT=%d) = %v, expected %v",
-					tt.payloadType, result, tt.expected)
+				t.Errorf("ShouldTranscodePacket(SSRC=%d, PT=%d) = %v, expected %v",
+					tt.ssrc, tt.payloadType, result, tt.expected)
 			}
 		})
 	}
@@ -425,10 +455,10 @@ func TestDebugLogging(t *testing.T) {
 }
 
 func TestAddRTPJob_NonBlocking(t *testing.T) {
-	// Create a fresh channel for testing
-	oldRtpJobs := rtpJobs
-	rtpJobs = make(chan []byte, 10)
-	defer func() { rtpJobs = oldRtpJobs }()
+	// Create fresh queues for testing
+	queues := newRTPQueues(1, QueueConfig{})
+	oldRtpJobs := rtpJobs.Swap(&queues)
+	defer rtpJobs.Store(oldRtpJobs)
 
 	// Add a few packets
 	for i := 0; i < 5; i++ {
@@ -439,21 +469,21 @@ func TestAddRTPJob_NonBlocking(t *testing.T) {
 	}
 
 	// Verify packets were queued
-	if len(rtpJobs) != 5 {
-		t.Errorf("Expected 5 packets in queue, got %d", len(rtpJobs))
+	if queues[0].len() != 5 {
+		t.Errorf("Expected 5 packets in queue, got %d", queues[0].len())
 	}
 
-	// Drain the channel
-	for len(rtpJobs) > 0 {
-		<-rtpJobs
+	// Drain the queue
+	for queues[0].len() > 0 {
+		queues[0].pop()
 	}
 }
 
 func TestAddRTPJob_PacketCopy(t *testing.T) {
 	// Test that AddRTPJob creates a copy of the packet
-	oldRtpJobs := rtpJobs
-	rtpJobs = make(chan []byte, 10)
-	defer func() { rtpJobs = oldRtpJobs }()
+	queues := newRTPQueues(1, QueueConfig{})
+	oldRtpJobs := rtpJobs.Swap(&queues)
+	defer rtpJobs.Store(oldRtpJobs)
 
 	packet := make([]byte, 12)
 	packet[0] = 0x80
@@ -465,12 +495,62 @@ func TestAddRTPJob_PacketCopy(t *testing.T) {
 	packet[11] = 0x00
 
 	// Verify queued packet has original value
-	queued := <-rtpJobs
-	if queued[11] != 0xFF {
+	queued, _ := queues[0].pop()
+	if (*queued.buf)[11] != 0xFF {
 		t.Error("AddRTPJob should copy packet, not reference it")
 	}
 }
 
+func TestAddRTPJob_SSRCAffinity(t *testing.T) {
+	queues := newRTPQueues(4, QueueConfig{})
+	oldRtpJobs := rtpJobs.Swap(&queues)
+	defer rtpJobs.Store(oldRtpJobs)
+
+	// Every packet of a stream lands in one queue, in order
+	for seq := 0; seq < 20; seq++ {
+		for ssrc := uint32(1); ssrc <= 8; ssrc++ {
+			packet := make([]byte, 12)
+			packet[0] = 0x80
+			binary.BigEndian.PutUint16(packet[2:4], uint16(seq))
+			binary.BigEndian.PutUint32(packet[8:12], ssrc)
+			AddRTPJob(packet)
+		}
+	}
+
+	home := make(map[uint32]int)
+	next := make(map[uint32]uint16)
+	for i, queue := range queues {
+		for queue.len() > 0 {
+			job, _ := queue.pop()
+			ssrc := binary.BigEndian.Uint32((*job.buf)[8:12])
+			seq := binary.BigEndian.Uint16((*job.buf)[2:4])
+			if q, ok := home[ssrc]; ok && q != i {
+				t.Errorf("SSRC %d queued on workers %d and %d", ssrc, q, i)
+			}
+			home[ssrc] = i
+			if seq != next[ssrc] {
+				t.Errorf("SSRC %d: expected sequence %d, got %d", ssrc, next[ssrc], seq)
+			}
+			next[ssrc] = seq + 1
+		}
+	}
+
+	used := make(map[int]bool)
+	for _, q := range home {
+		used[q] = true
+	}
+	if len(home) != 8 || len(used) < 2 {
+		t.Errorf("expected 8 streams spread over several workers, got %d streams on %d", len(home), len(used))
+	}
+
+	// RTCP follows the stream of its sender SSRC
+	rtcp := []byte{0x80, 200, 0, 6, 0, 0, 0, 3}
+	rtp := []byte{0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 3}
+	if rtpQueueFor(rtcp, 4) != rtpQueueFor(rtp, 4) {
+		t.Error("expected RTCP to share its sender's worker")
+	}
+}
+
 func TestRTCPFeedbackHandler_BasicFields(t *testing.T) {
 	// Test basic handler struct fields without prometheus metrics
 	handler := &RTCPFeedbackHandler{
@@ -628,3 +708,65 @@ func TestConcurrentPacketParsing(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestParseRTPPacketInto_Reuse(t *testing.T) {
+	packet := &RTPPacket{}
+	withCSRC := []byte{0x82, 0x00, 0, 1, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3, 0, 0, 0, 4, 0xAA}
+	if err := parseRTPPacketInto(withCSRC, packet); err != nil || len(packet.CSRC) != 2 || packet.CSRC[1] != 4 {
+		t.Fatalf("unexpected CSRC list %v: %v", packet.CSRC, err)
+	}
+
+	plain := []byte{0x80, 0x08, 0, 2, 0, 0, 0, 1, 0, 0, 0, 2, 0xBB, 0xCC}
+	if err := parseRTPPacketInto(plain, packet); err != nil {
+		t.Fatal(err)
+	}
+	if len(packet.CSRC) != 0 || packet.PayloadType != 8 || !bytes.Equal(packet.Payload, []byte{0xBB, 0xCC}) {
+		t.Errorf("expected the previous packet's fields to be cleared, got %+v", packet)
+	}
+}
+
+func TestProcessRTPPacket_NoAllocations(t *testing.T) {
+	packet := []byte{0x80, 0x00, 0, 1, 0, 0, 0, 160, 0, 0, 0xA1, 0x0C}
+	packet = append(packet, make([]byte, 160)...)
+	processRTPPacket(packet, time.Now(), 0)
+	defer GetReceiveStatsTracker().Remove(0xA10C)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		processRTPPacket(packet, time.Now(), 0)
+	})
+	if allocs > 0 {
+		t.Errorf("expected an unnegotiated packet to be processed without allocating, got %.1f", allocs)
+	}
+}
+
+// receivedTimeHandler records when the packets it handles were received
+type receivedTimeHandler struct {
+	received []time.Time
+}
+
+func (h *receivedTimeHandler) Handle(packet *RTPPacket) error {
+	h.received = append(h.received, packet.Received)
+	return nil
+}
+
+func TestProcessRTPPacket_ReceivedAtRead(t *testing.T) {
+	handler := &receivedTimeHandler{}
+	RegisterRTPHandler(0xA10D, handler)
+	defer UnregisterRTPHandler(0xA10D)
+	defer GetReceiveStatsTracker().Remove(0xA10D)
+
+	// A packet that waited in the queue keeps the time it was read
+	queues := newRTPQueues(1, QueueConfig{})
+	oldRtpJobs := rtpJobs.Swap(&queues)
+	defer rtpJobs.Store(oldRtpJobs)
+	read := time.Now().Add(-40 * time.Millisecond)
+	packet := append([]byte{0x80, 0x00, 0, 1, 0, 0, 0, 160, 0, 0, 0xA1, 0x0D}, make([]byte, 160)...)
+	queueRTPJob(copyPacketBuffer(packet), read)
+
+	job, _ := queues[0].pop()
+	processRTPPacket(*job.buf, job.received, 0)
+	putPacketBuffer(job.buf)
+	if len(handler.received) != 1 || !handler.received[0].Equal(read) {
+		t.Errorf("expected the packet stamped at %v, got %v", read, handler.received)
+	}
+}
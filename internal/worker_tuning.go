@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	maxWorkerPoolSize  = 1024  // RTP workers
+	maxWorkerQueueSize = 65536 // packets queued per RTP worker
+)
+
+var (
+	workerPoolWorkers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "karl_worker_pool_workers",
+		Help: "RTP workers in the worker pool",
+	})
+	workerQueueSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "karl_worker_queue_size",
+		Help: "Packets each RTP worker queue holds",
+	})
+)
+
+// WorkerPoolTuning is the size of the RTP worker pool and of its queues
+type WorkerPoolTuning struct {
+	Workers     int    `json:"workers"`
+	QueueSize   int    `json:"queue_size"`
+	QueuePolicy string `json:"queue_policy"`
+}
+
+// WorkerPoolTuningFromConfig returns the tuning set by the transport
+// settings, with defaults for the ones left at 0
+func WorkerPoolTuningFromConfig(transport TransportConfig) WorkerPoolTuning {
+	t := WorkerPoolTuning{
+		Workers:     transport.Workers,
+		QueueSize:   transport.WorkerQueueSize,
+		QueuePolicy: transport.WorkerQueuePolicy,
+	}
+	if t.Workers == 0 {
+		t.Workers = defaultWorkerPoolSize()
+	}
+	if t.QueueSize == 0 {
+		t.QueueSize = rtpQueueDepth
+	}
+	if t.QueuePolicy == "" {
+		t.QueuePolicy = queueDropPolicyName(StrategyDropOldest)
+	}
+	return t
+}
+
+// Validate checks that the tuning is within bounds
+func (t WorkerPoolTuning) Validate() error {
+	if t.Workers < 1 || t.Workers > maxWorkerPoolSize {
+		return fmt.Errorf("invalid worker count %d, expected 1-%d", t.Workers, maxWorkerPoolSize)
+	}
+	if t.QueueSize < 1 || t.QueueSize > maxWorkerQueueSize {
+		return fmt.Errorf("invalid worker queue size %d, expected 1-%d", t.QueueSize, maxWorkerQueueSize)
+	}
+	_, err := ParseQueueDropPolicy(t.QueuePolicy)
+	return err
+}
+
+// CurrentWorkerPoolTuning returns the size of the running pool
+func CurrentWorkerPoolTuning() WorkerPoolTuning {
+	workerPoolMu.Lock()
+	defer workerPoolMu.Unlock()
+	size := queueConfig.Size
+	if size <= 0 {
+		size = rtpQueueDepth
+	}
+	return WorkerPoolTuning{
+		Workers:     workerPoolSize,
+		QueueSize:   size,
+		QueuePolicy: queueDropPolicyName(queueConfig.Policy),
+	}
+}
+
+// TuneWorkerPool resizes the RTP worker pool and its queues. Producers move
+// to a new set of queues at once; the old workers drain what is queued and
+// exit, and the new workers start once they have, so each stream stays in
+// order
+func TuneWorkerPool(t WorkerPoolTuning) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	policy, _ := ParseQueueDropPolicy(t.QueuePolicy)
+
+	workerPoolMu.Lock()
+	defer workerPoolMu.Unlock()
+
+	config := QueueConfig{Size: t.QueueSize, Policy: policy}
+	if t.Workers == workerPoolSize && config == queueConfig {
+		return nil
+	}
+
+	queues := newRTPQueues(t.Workers, config)
+	old := rtpJobs.Swap(&queues)
+	workerPoolSize, queueConfig = t.Workers, config
+	if rtpWorkersDone != nil {
+		rtpWorkersDone = startRTPWorkers(queues, rtpWorkersDone)
+	}
+	for _, queue := range *old {
+		queue.close()
+	}
+
+	updateWorkerPoolMetrics()
+	workerLog.Info("RTP worker pool resized", "workers", t.Workers, "queue_size", t.QueueSize, "queue_policy", t.QueuePolicy)
+	return nil
+}
+
+// updateWorkerPoolMetrics publishes the pool size; callers hold workerPoolMu
+func updateWorkerPoolMetrics() {
+	size := queueConfig.Size
+	if size <= 0 {
+		size = rtpQueueDepth
+	}
+	workerPoolWorkers.Set(float64(workerPoolSize))
+	workerQueueSize.Set(float64(size))
+}
+
+// queueDropPolicyName is the config name of a queue drop strategy
+func queueDropPolicyName(policy BackpressureStrategy) string {
+	if policy == StrategyDropOldest {
+		return "drop_oldest"
+	}
+	return "drop_newest"
+}
@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+)
+
+// withWorkerPool runs a test against a started pool and restores the idle
+// default pool afterwards
+func withWorkerPool(t *testing.T) {
+	t.Helper()
+	oldSize, oldConfig := workerPoolSize, queueConfig
+	InitWorkerPool()
+	t.Cleanup(func() {
+		StopWorkerPool()
+		workerPoolMu.Lock()
+		defer workerPoolMu.Unlock()
+		workerPoolSize, queueConfig, rtpWorkersDone = oldSize, oldConfig, nil
+		queues := newRTPQueues(oldSize, oldConfig)
+		rtpJobs.Store(&queues)
+	})
+}
+
+func TestWorkerPoolTuning_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		tuning  WorkerPoolTuning
+		wantErr bool
+	}{
+		{"valid", WorkerPoolTuning{Workers: 4, QueueSize: 512, QueuePolicy: "drop_newest"}, false},
+		{"no workers", WorkerPoolTuning{Workers: 0, QueueSize: 512}, true},
+		{"too many workers", WorkerPoolTuning{Workers: maxWorkerPoolSize + 1, QueueSize: 512}, true},
+		{"no queue", WorkerPoolTuning{Workers: 4, QueueSize: 0}, true},
+		{"bad policy", WorkerPoolTuning{Workers: 4, QueueSize: 512, QueuePolicy: "block"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.tuning.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWorkerPoolTuningFromConfig_Defaults(t *testing.T) {
+	tuning := WorkerPoolTuningFromConfig(TransportConfig{})
+	if tuning.Workers != defaultWorkerPoolSize() || tuning.QueueSize != rtpQueueDepth || tuning.QueuePolicy != "drop_oldest" {
+		t.Errorf("unexpected defaults: %+v", tuning)
+	}
+}
+
+func TestTuneWorkerPool_Resize(t *testing.T) {
+	withWorkerPool(t)
+
+	want := WorkerPoolTuning{Workers: 3, QueueSize: 64, QueuePolicy: "drop_newest"}
+	if err := TuneWorkerPool(want); err != nil {
+		t.Fatalf("TuneWorkerPool: %v", err)
+	}
+	if got := CurrentWorkerPoolTuning(); got != want {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+	queues := *rtpJobs.Load()
+	if len(queues) != 3 || cap(queues[0].bulk.ch) != 64 {
+		t.Errorf("expected 3 queues of 64 packets, got %d of %d", len(queues), cap(queues[0].bulk.ch))
+	}
+
+	if err := TuneWorkerPool(WorkerPoolTuning{Workers: 0, QueueSize: 64, QueuePolicy: "drop_newest"}); err == nil {
+		t.Error("expected an invalid tuning to be rejected")
+	}
+	if got := CurrentWorkerPoolTuning(); got != want {
+		t.Errorf("rejected tuning changed the pool: %+v", got)
+	}
+}
+
+func TestTuneWorkerPool_ResizeUnderLoad(t *testing.T) {
+	withWorkerPool(t)
+
+	stop := make(chan struct{})
+	var producers sync.WaitGroup
+	for p := 0; p < 4; p++ {
+		producers.Add(1)
+		go func(p int) {
+			defer producers.Done()
+			packet := make([]byte, 12)
+			packet[0] = 0x80
+			binary.BigEndian.PutUint32(packet[8:12], uint32(p))
+			for seq := uint16(0); ; seq++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				binary.BigEndian.PutUint16(packet[2:4], seq)
+				AddRTPJob(packet)
+			}
+		}(p)
+	}
+
+	// Growing and shrinking while packets flow must not panic on a closed queue
+	for _, workers := range []int{1, 8, 2, 16, 4} {
+		if err := TuneWorkerPool(WorkerPoolTuning{Workers: workers, QueueSize: 32, QueuePolicy: "drop_oldest"}); err != nil {
+			t.Fatalf("TuneWorkerPool(%d): %v", workers, err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(stop)
+	producers.Wait()
+}
+
+func TestStartRTPWorkers_WaitForPreviousWorkers(t *testing.T) {
+	// New workers hold their packets until the old workers have drained,
+	// so a stream moved by a resize is not reordered
+	previous := make(chan struct{})
+	queues := newRTPQueues(1, QueueConfig{})
+	done := startRTPWorkers(queues, previous)
+
+	packet := []byte{0x80, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1}
+	buf := getPacketBuffer()
+	*buf = append((*buf)[:0], packet...)
+	queues[0].push(rtpJob{buf: buf, received: time.Now()}, false)
+
+	time.Sleep(20 * time.Millisecond)
+	if queues[0].len() != 1 {
+		t.Fatal("expected the packet to wait for the previous workers")
+	}
+
+	close(previous)
+	queues[0].close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("workers did not exit")
+	}
+	if queues[0].len() != 0 {
+		t.Error("expected the packet to be processed once the previous workers exited")
+	}
+}
+
+func TestPacketQueue_OfferAfterClose(t *testing.T) {
+	queue := newPacketQueue(QueueConfig{Size: 4})
+	queue.close()
+
+	buf := getPacketBuffer()
+	if queued, open := queue.offer(rtpJob{buf: buf}, false); queued || open {
+		t.Errorf("expected a closed queue to refuse the packet, got queued=%v open=%v", queued, open)
+	}
+	if queue.push(rtpJob{buf: buf}, false) {
+		t.Error("expected push on a closed queue to drop the packet")
+	}
+}
@@ -0,0 +1,996 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/srtp/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ZRTP (RFC 6189) keys SRTP in the media path: the parties exchange
+// Diffie-Hellman values in ZRTP packets on their RTP ports and compare a
+// short authentication string (SAS) by voice. Karl relays ZRTP between the
+// parties of a call unchanged, so their end-to-end encryption survives it.
+// With the ZRTP=terminate flag Karl is itself the ZRTP endpoint of a party
+// instead, and bridges the call to SRTP.
+
+const (
+	zrtpMagicCookie = 0x5a525450 // "ZRTP"
+	zrtpPreamble    = 0x505a
+	zrtpVersion     = "1.10"
+	zrtpClientID    = "Karl"
+	zrtpHeaderLen   = 12
+	zrtpCRCLen      = 4
+	zrtpMACLen      = 8
+	zrtpZIDLen      = 12
+
+	// Message types, 8 characters each
+	zrtpHello    = "Hello   "
+	zrtpHelloACK = "HelloACK"
+	zrtpCommit   = "Commit  "
+	zrtpDHPart1  = "DHPart1 "
+	zrtpDHPart2  = "DHPart2 "
+	zrtpConfirm1 = "Confirm1"
+	zrtpConfirm2 = "Confirm2"
+	zrtpConf2ACK = "Conf2ACK"
+	zrtpError    = "Error   "
+	zrtpErrorACK = "ErrorACK"
+
+	// Retransmission of Hello, and of Commit, DHPart2 and Confirm2: the
+	// interval doubles up to its maximum (RFC 6189 section 6)
+	zrtpT1        = 50 * time.Millisecond
+	zrtpT1Max     = 200 * time.Millisecond
+	zrtpT1Retries = 20
+	zrtpT2        = 150 * time.Millisecond
+	zrtpT2Max     = 1200 * time.Millisecond
+	zrtpT2Retries = 10
+)
+
+// Error codes of the ZRTP Error message
+const (
+	zrtpErrMalformed       = 0x10
+	zrtpErrHashType        = 0x51
+	zrtpErrCipherType      = 0x52
+	zrtpErrKeyAgreement    = 0x53
+	zrtpErrAuthTag         = 0x54
+	zrtpErrSASType         = 0x55
+	zrtpErrBadDHValue      = 0x61
+	zrtpErrHviMismatch     = 0x62
+	zrtpErrConfirmMAC      = 0x70
+	zrtpErrEqualZID        = 0x90
+	zrtpErrProtocolTimeout = 0xB0
+)
+
+// The algorithms Karl offers, preferred first. S256, AES1, HS32, HS80,
+// DH3k and B32 are mandatory and implied when a Hello omits them
+var (
+	zrtpHashes        = []string{"S256"}
+	zrtpCiphers       = []string{"AES1"}
+	zrtpAuthTags      = []string{"HS80", "HS32"}
+	zrtpKeyAgreements = []string{"EC25", "DH3k"}
+	zrtpSASTypes      = []string{"B32 "}
+)
+
+// zrtpSASAlphabet renders a B32 SAS (RFC 6189 section 5.1.6)
+const zrtpSASAlphabet = "ybndrfg8ejkmcpqxot1uwisza345h769"
+
+// zrtpDH3kPrime is the 3072-bit MODP group of RFC 3526, generator 2
+var zrtpDH3kPrime, _ = new(big.Int).SetString(
+	"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74"+
+		"020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F1437"+
+		"4FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED"+
+		"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF05"+
+		"98DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB"+
+		"9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3B"+
+		"E39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF695581718"+
+		"3995497CEA956AE515D2261898FA051015728E5A8AAAC42DAD33170D04507A33"+
+		"A85521ABDF1CBA64ECFB850458DBEF0A8AEA71575D060C7DB3970F85A6E1E4C7"+
+		"ABF5AE8CDB0933D71E8C94E04A25619DCEE3D2261AD2EE6BF12FFA06D98A0864"+
+		"D87602733EC86A64521F2B18177B200CBBE117577A615D6C770988C0BAD946E2"+
+		"08E24FA074E5AB3143DB5BFCE0FD108E4B82D120A93AD2CAFFFFFFFFFFFFFFFF", 16)
+
+var zrtpCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	zrtpHandshakes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "karl_zrtp_handshakes_total",
+			Help: "Total ZRTP key agreements Karl ran as a party's endpoint, by result (success, failure)",
+		},
+		[]string{"result"},
+	)
+
+	zrtpRelayed = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "karl_zrtp_relayed_total",
+			Help: "Total ZRTP packets between the parties of a call, by result (relayed, dropped)",
+		},
+		[]string{"result"},
+	)
+)
+
+// IsZRTPPacket reports whether a packet received on an RTP port is ZRTP
+// rather than RTP: version bits 0001 and the magic cookie
+func IsZRTPPacket(packet []byte) bool {
+	return len(packet) >= zrtpHeaderLen+zrtpCRCLen && packet[0]&0xF0 == 0x10 &&
+		binary.BigEndian.Uint32(packet[4:8]) == zrtpMagicCookie
+}
+
+// zrtpPacket frames a message with the ZRTP packet header and its CRC-32C,
+// which like SCTP's is sent least significant byte first
+func zrtpPacket(seq uint16, ssrc uint32, message []byte) []byte {
+	packet := make([]byte, zrtpHeaderLen, zrtpHeaderLen+len(message)+zrtpCRCLen)
+	packet[0] = 0x10
+	binary.BigEndian.PutUint16(packet[2:], seq)
+	binary.BigEndian.PutUint32(packet[4:], zrtpMagicCookie)
+	binary.BigEndian.PutUint32(packet[8:], ssrc)
+	packet = append(packet, message...)
+	return binary.LittleEndian.AppendUint32(packet, crc32.Checksum(packet, zrtpCRCTable))
+}
+
+// parseZRTPPacket checks a ZRTP packet's CRC and returns its message and
+// the message type
+func parseZRTPPacket(packet []byte) ([]byte, string, error) {
+	if !IsZRTPPacket(packet) {
+		return nil, "", errors.New("not a ZRTP packet")
+	}
+	body := packet[:len(packet)-zrtpCRCLen]
+	if binary.LittleEndian.Uint32(packet[len(body):]) != crc32.Checksum(body, zrtpCRCTable) {
+		return nil, "", errors.New("ZRTP CRC mismatch")
+	}
+	message := body[zrtpHeaderLen:]
+	if len(message) < 12 || binary.BigEndian.Uint16(message) != zrtpPreamble ||
+		int(binary.BigEndian.Uint16(message[2:]))*4 != len(message) {
+		return nil, "", errors.New("malformed ZRTP message")
+	}
+	return message, string(message[4:12]), nil
+}
+
+// zrtpMessage assembles a message from its fields after the type block.
+// A message with a MAC ends with zrtpMACLen bytes for zrtpSign to fill
+func zrtpMessage(msgType string, fields ...[]byte) []byte {
+	n := 12
+	for _, f := range fields {
+		n += len(f)
+	}
+	message := make([]byte, 12, n)
+	binary.BigEndian.PutUint16(message, zrtpPreamble)
+	binary.BigEndian.PutUint16(message[2:], uint16(n/4))
+	copy(message[4:], msgType)
+	for _, f := range fields {
+		message = append(message, f...)
+	}
+	return message
+}
+
+// zrtpMAC is the truncated HMAC-SHA-256 of the negotiated S256 hash
+func zrtpMAC(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)[:zrtpMACLen]
+}
+
+// zrtpSign fills a message's trailing MAC, keyed with a hash image
+func zrtpSign(message, key []byte) []byte {
+	copy(message[len(message)-zrtpMACLen:], zrtpMAC(key, message[:len(message)-zrtpMACLen]))
+	return message
+}
+
+// zrtpVerify checks a message's trailing MAC against the hash image the
+// sender revealed later in the exchange
+func zrtpVerify(message, key []byte) bool {
+	if len(message) < 12+zrtpMACLen {
+		return false
+	}
+	n := len(message) - zrtpMACLen
+	return hmac.Equal(message[n:], zrtpMAC(key, message[:n]))
+}
+
+func zrtpHash(data ...[]byte) []byte {
+	h := sha256.New()
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// zrtpKDF is the key derivation function of RFC 6189 section 4.5.1
+func zrtpKDF(key []byte, label string, context []byte, bits int) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte{0, 0, 0, 1})
+	mac.Write([]byte(label))
+	mac.Write([]byte{0})
+	mac.Write(context)
+	_ = binary.Write(mac, binary.BigEndian, uint32(bits))
+	return mac.Sum(nil)[:bits/8]
+}
+
+// parsedZRTPHello is a party's Hello message
+type parsedZRTPHello struct {
+	raw           []byte
+	version       string
+	clientID      string
+	h3            []byte
+	zid           []byte
+	hashes        []string
+	ciphers       []string
+	authTags      []string
+	keyAgreements []string
+	sasTypes      []string
+}
+
+func parseZRTPHello(message []byte) (*parsedZRTPHello, error) {
+	if len(message) < 88 {
+		return nil, errors.New("short ZRTP Hello")
+	}
+	counts := binary.BigEndian.Uint32(message[76:80])
+	lists := make([][]string, 5)
+	offset := 80
+	for i := range lists {
+		n := int(counts >> (16 - 4*i) & 0xF)
+		if offset+4*n > len(message)-zrtpMACLen {
+			return nil, errors.New("malformed ZRTP Hello")
+		}
+		for j := 0; j < n; j++ {
+			lists[i] = append(lists[i], string(message[offset:offset+4]))
+			offset += 4
+		}
+	}
+	if offset+zrtpMACLen != len(message) {
+		return nil, errors.New("malformed ZRTP Hello")
+	}
+	return &parsedZRTPHello{
+		raw:           message,
+		version:       string(message[12:16]),
+		clientID:      strings.TrimSpace(string(message[16:32])),
+		h3:            message[32:64],
+		zid:           message[64:76],
+		hashes:        lists[0],
+		ciphers:       lists[1],
+		authTags:      lists[2],
+		keyAgreements: lists[3],
+		sasTypes:      lists[4],
+	}, nil
+}
+
+// zrtpChoose returns Karl's first algorithm the other side supports, its
+// list or the mandatory ones
+func zrtpChoose(ours, theirs []string, mandatory ...string) string {
+	for _, algorithm := range ours {
+		for _, other := range append(theirs, mandatory...) {
+			if algorithm == other {
+				return algorithm
+			}
+		}
+	}
+	return ""
+}
+
+func zrtpSupports(ours []string, algorithm string) bool {
+	for _, a := range ours {
+		if a == algorithm {
+			return true
+		}
+	}
+	return false
+}
+
+// zrtpKeyAgreement is one side's Diffie-Hellman key pair
+type zrtpKeyAgreement interface {
+	public() []byte
+	agree(peer []byte) ([]byte, error)
+}
+
+func newZRTPKeyAgreement(kind string) (zrtpKeyAgreement, error) {
+	switch kind {
+	case "EC25":
+		key, err := ecdh.P256().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return ec25{key}, nil
+	case "DH3k":
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		return dh3k{new(big.Int).SetBytes(secret)}, nil
+	}
+	return nil, fmt.Errorf("unsupported ZRTP key agreement %q", kind)
+}
+
+// ec25 is ECDH on P-256; public values are x || y
+type ec25 struct{ key *ecdh.PrivateKey }
+
+func (k ec25) public() []byte { return k.key.PublicKey().Bytes()[1:] }
+
+func (k ec25) agree(peer []byte) ([]byte, error) {
+	if len(peer) != 64 {
+		return nil, errors.New("bad EC25 public value")
+	}
+	public, err := ecdh.P256().NewPublicKey(append([]byte{4}, peer...))
+	if err != nil {
+		return nil, err
+	}
+	return k.key.ECDH(public)
+}
+
+// dh3k is finite field Diffie-Hellman in the 3072-bit MODP group
+type dh3k struct{ secret *big.Int }
+
+func (k dh3k) public() []byte {
+	return new(big.Int).Exp(big.NewInt(2), k.secret, zrtpDH3kPrime).FillBytes(make([]byte, 384))
+}
+
+func (k dh3k) agree(peer []byte) ([]byte, error) {
+	value := new(big.Int).SetBytes(peer)
+	limit := new(big.Int).Sub(zrtpDH3kPrime, big.NewInt(1))
+	if len(peer) != 384 || value.Cmp(big.NewInt(1)) <= 0 || value.Cmp(limit) >= 0 {
+		return nil, errors.New("bad DH3k public value")
+	}
+	return new(big.Int).Exp(value, k.secret, zrtpDH3kPrime).FillBytes(make([]byte, 384)), nil
+}
+
+// zrtpKeys are derived from a completed key agreement (RFC 6189 section
+// 4.5.3). Karl keeps no retained secrets, so s1, s2 and s3 are empty
+type zrtpKeys struct {
+	srtpKeyI, srtpSaltI []byte
+	srtpKeyR, srtpSaltR []byte
+	macKeyI, macKeyR    []byte
+	zrtpKeyI, zrtpKeyR  []byte
+	sas                 string
+}
+
+func deriveZRTPKeys(dhResult, zidi, zidr, totalHash []byte) *zrtpKeys {
+	s0 := zrtpHash([]byte{0, 0, 0, 1}, dhResult, []byte("ZRTP-HMAC-KDF"), zidi, zidr, totalHash, make([]byte, 12))
+	context := append(append(append([]byte(nil), zidi...), zidr...), totalHash...)
+	kdf := func(label string, bits int) []byte { return zrtpKDF(s0, label, context, bits) }
+
+	sasValue := binary.BigEndian.Uint32(kdf("SAS", 256))
+	var sas [4]byte
+	for i := range sas {
+		sas[i] = zrtpSASAlphabet[sasValue>>(27-5*i)&0x1F]
+	}
+	return &zrtpKeys{
+		srtpKeyI:  kdf("Initiator SRTP master key", 128),
+		srtpSaltI: kdf("Initiator SRTP master salt", 112),
+		srtpKeyR:  kdf("Responder SRTP master key", 128),
+		srtpSaltR: kdf("Responder SRTP master salt", 112),
+		macKeyI:   kdf("Initiator HMAC key", 256),
+		macKeyR:   kdf("Responder HMAC key", 256),
+		zrtpKeyI:  kdf("Initiator ZRTP key", 128),
+		zrtpKeyR:  kdf("Responder ZRTP key", 128),
+		sas:       string(sas[:]),
+	}
+}
+
+// zrtpConfirm builds a Confirm1 or Confirm2 revealing h0, encrypted with
+// AES-CFB. Karl sets the disclosure flag, since a party's media is
+// decrypted in Karl, and asks for no secret to be cached
+func zrtpConfirm(msgType string, h0, key, macKey []byte) ([]byte, error) {
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, 40)
+	copy(plain, h0)
+	plain[35] = 0x01 // D
+	encrypted := make([]byte, len(plain))
+	cipher.NewCFBEncrypter(block, iv).XORKeyStream(encrypted, plain)
+	return zrtpMessage(msgType, zrtpMAC(macKey, encrypted), iv, encrypted), nil
+}
+
+// openZRTPConfirm checks a Confirm message's MAC and returns the hash
+// image H0 it reveals
+func openZRTPConfirm(message, key, macKey []byte) ([]byte, error) {
+	if len(message) < 76 {
+		return nil, errors.New("short ZRTP Confirm")
+	}
+	mac, iv, encrypted := message[12:20], message[20:36], message[36:]
+	if !hmac.Equal(mac, zrtpMAC(macKey, encrypted)) {
+		return nil, errors.New("ZRTP Confirm MAC mismatch")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(encrypted))
+	cipher.NewCFBDecrypter(block, iv).XORKeyStream(plain, encrypted)
+	return plain[:32], nil
+}
+
+// zrtpState is the progress of a ZRTP endpoint's key agreement
+type zrtpState int
+
+const (
+	zrtpDiscovery    zrtpState = iota // exchanging Hellos
+	zrtpCommitSent                    // initiator, waiting for DHPart1
+	zrtpDHPart1Sent                   // responder, waiting for DHPart2
+	zrtpDHPart2Sent                   // initiator, waiting for Confirm1
+	zrtpConfirm1Sent                  // responder, waiting for Confirm2
+	zrtpConfirm2Sent                  // initiator, waiting for Conf2ACK
+	zrtpSecure
+	zrtpFailed
+)
+
+func (s zrtpState) String() string {
+	switch s {
+	case zrtpDiscovery:
+		return "discovery"
+	case zrtpCommitSent, zrtpDHPart1Sent:
+		return "key-agreement"
+	case zrtpDHPart2Sent, zrtpConfirm1Sent, zrtpConfirm2Sent:
+		return "confirm"
+	case zrtpSecure:
+		return "secure"
+	}
+	return "failed"
+}
+
+// zrtpEndpoint is Karl's ZRTP endpoint towards one party. Karl keeps no
+// cache of retained secrets, so the parties' SAS is always unverified
+type zrtpEndpoint struct {
+	mu sync.Mutex
+
+	zid            []byte
+	h0, h1, h2, h3 []byte
+	hello          []byte
+	ssrc           uint32
+	seq            uint16
+
+	conn   *net.UDPConn
+	remote *net.UDPAddr
+
+	peerHash   string // the party's a=zrtp-hash, empty if not signalled
+	peerHello  *parsedZRTPHello
+	helloAcked bool
+
+	state        zrtpState
+	initiator    bool
+	keyAgreement string
+	authTag      string
+	dh           zrtpKeyAgreement
+	commit       []byte
+	dhPart1      []byte
+	dhPart2      []byte
+	peerH1       []byte // from the party's DHPart
+	peerH2       []byte // from the party's Commit
+	keys         *zrtpKeys
+
+	// reply is Karl's last answer, sent again when the party retransmits
+	// the message it answered; pending is retransmitted until answered
+	reply      []byte
+	replyTo    []byte
+	pending    []byte
+	generation int
+	timer      *time.Timer
+	closed     bool
+
+	// key is called with the SRTP contexts of each direction as they are
+	// settled, nil for one left unchanged
+	key func(inbound, outbound SRTPCipher)
+}
+
+func newZRTPEndpoint() (*zrtpEndpoint, error) {
+	random := make([]byte, zrtpZIDLen+32+6)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	e := &zrtpEndpoint{
+		zid:  random[:zrtpZIDLen],
+		h0:   random[zrtpZIDLen : zrtpZIDLen+32],
+		ssrc: binary.BigEndian.Uint32(random[zrtpZIDLen+32:]),
+		seq:  binary.BigEndian.Uint16(random[zrtpZIDLen+36:]),
+	}
+	e.h1 = zrtpHash(e.h0)
+	e.h2 = zrtpHash(e.h1)
+	e.h3 = zrtpHash(e.h2)
+
+	var algorithms [][]byte
+	var counts uint32
+	for i, list := range [][]string{zrtpHashes, zrtpCiphers, zrtpAuthTags, zrtpKeyAgreements, zrtpSASTypes} {
+		counts |= uint32(len(list)) << (16 - 4*i)
+		for _, algorithm := range list {
+			algorithms = append(algorithms, []byte(algorithm))
+		}
+	}
+	clientID := []byte(fmt.Sprintf("%-16s", zrtpClientID))
+	fields := [][]byte{[]byte(zrtpVersion), clientID, e.h3, e.zid, binary.BigEndian.AppendUint32(nil, counts)}
+	fields = append(append(fields, algorithms...), make([]byte, zrtpMACLen))
+	e.hello = zrtpSign(zrtpMessage(zrtpHello, fields...), e.h2)
+	return e, nil
+}
+
+// helloHash is the value of Karl's a=zrtp-hash
+func (e *zrtpEndpoint) helloHash() string {
+	return zrtpVersion + " " + hex.EncodeToString(zrtpHash(e.hello))
+}
+
+// setPeerHash records the party's a=zrtp-hash, which its Hello must match
+func (e *zrtpEndpoint) setPeerHash(hash string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.peerHash = hash
+}
+
+// start sends Karl's Hello to the party from the port it was given, at
+// remote until the party is heard from
+func (e *zrtpEndpoint) start(conn *net.UDPConn, remote *net.UDPAddr) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.conn == nil {
+		e.conn = conn
+	}
+	if e.remote == nil {
+		e.remote = remote
+	}
+	if e.state == zrtpDiscovery && !e.helloAcked && e.pending == nil && e.remote != nil {
+		e.retransmitLocked(e.hello, zrtpT1, zrtpT1Max, zrtpT1Retries)
+	}
+}
+
+// close stops the endpoint's retransmissions
+func (e *zrtpEndpoint) close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closed = true
+	e.stopLocked()
+}
+
+// receive handles a ZRTP packet the party sent to conn
+func (e *zrtpEndpoint) receive(conn *net.UDPConn, packet []byte, from *net.UDPAddr) {
+	message, msgType, err := parseZRTPPacket(packet)
+	if err != nil {
+		if rtpPacketErrors.Allow() {
+			rtpPacketErrors.Log("Dropped ZRTP packet", "from", from, "error", err)
+		}
+		return
+	}
+	message = append([]byte(nil), message...)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return
+	}
+	e.conn = conn
+	if from != nil {
+		e.remote = from
+	}
+
+	// A retransmission of what Karl already answered gets the answer again
+	if e.replyTo != nil && bytes.Equal(message, e.replyTo) {
+		e.sendLocked(e.reply)
+		return
+	}
+
+	switch msgType {
+	case zrtpHello:
+		e.onHelloLocked(message)
+	case zrtpHelloACK:
+		if !e.helloAcked {
+			e.helloAcked = true
+			if e.state == zrtpDiscovery {
+				e.stopLocked()
+			}
+			e.commitLocked()
+		}
+	case zrtpCommit:
+		e.onCommitLocked(message)
+	case zrtpDHPart1:
+		e.onDHPart1Locked(message)
+	case zrtpDHPart2:
+		e.onDHPart2Locked(message)
+	case zrtpConfirm1:
+		e.onConfirm1Locked(message)
+	case zrtpConfirm2:
+		e.onConfirm2Locked(message)
+	case zrtpConf2ACK:
+		if e.state == zrtpConfirm2Sent {
+			e.secureLocked()
+		}
+	case zrtpError:
+		e.sendLocked(zrtpMessage(zrtpErrorACK))
+		if e.state != zrtpFailed {
+			code := uint32(0)
+			if len(message) >= 16 {
+				code = binary.BigEndian.Uint32(message[12:16])
+			}
+			e.failedLocked(fmt.Errorf("party sent ZRTP error 0x%x", code))
+		}
+	}
+}
+
+func (e *zrtpEndpoint) onHelloLocked(message []byte) {
+	hello, err := parseZRTPHello(message)
+	if err != nil || !strings.HasPrefix(hello.version, "1.") {
+		return
+	}
+	if e.peerHash != "" {
+		if _, value, _ := strings.Cut(e.peerHash, " "); !strings.EqualFold(value, hex.EncodeToString(zrtpHash(message))) {
+			rtpLog.Warn("ZRTP Hello does not match the party's a=zrtp-hash", "peer", e.remote)
+			return
+		}
+	}
+	if bytes.Equal(hello.zid, e.zid) {
+		e.failLocked(zrtpErrEqualZID)
+		return
+	}
+	if e.peerHello == nil || e.state == zrtpDiscovery {
+		e.peerHello = hello
+	}
+	e.sendLocked(zrtpMessage(zrtpHelloACK))
+	e.commitLocked()
+}
+
+// commitLocked starts the key agreement as the initiator once both sides
+// have each other's Hello. Should the party commit too, the Commit with
+// the lower hvi yields (RFC 6189 section 4.2)
+func (e *zrtpEndpoint) commitLocked() {
+	if e.state != zrtpDiscovery || e.peerHello == nil || !e.helloAcked {
+		return
+	}
+	hello := e.peerHello
+	hash := zrtpChoose(zrtpHashes, hello.hashes, "S256")
+	cipherType := zrtpChoose(zrtpCiphers, hello.ciphers, "AES1")
+	authTag := zrtpChoose(zrtpAuthTags, hello.authTags, "HS32", "HS80")
+	keyAgreement := zrtpChoose(zrtpKeyAgreements, hello.keyAgreements, "DH3k")
+	sasType := zrtpChoose(zrtpSASTypes, hello.sasTypes, "B32 ")
+	dh, err := newZRTPKeyAgreement(keyAgreement)
+	if err != nil {
+		e.failedLocked(err)
+		return
+	}
+
+	e.dhPart2 = e.dhPartLocked(zrtpDHPart2, dh)
+	hvi := zrtpHash(e.dhPart2, hello.raw)
+	e.commit = zrtpSign(zrtpMessage(zrtpCommit, e.h2, e.zid, []byte(hash), []byte(cipherType), []byte(authTag),
+		[]byte(keyAgreement), []byte(sasType), hvi, make([]byte, zrtpMACLen)), e.h1)
+	e.initiator, e.dh, e.keyAgreement, e.authTag = true, dh, keyAgreement, authTag
+	e.state = zrtpCommitSent
+	e.retransmitLocked(e.commit, zrtpT2, zrtpT2Max, zrtpT2Retries)
+}
+
+// dhPartLocked builds Karl's DHPart1 or DHPart2. Without retained secrets
+// their IDs are random
+func (e *zrtpEndpoint) dhPartLocked(msgType string, dh zrtpKeyAgreement) []byte {
+	ids := make([]byte, 32)
+	_, _ = rand.Read(ids)
+	return zrtpSign(zrtpMessage(msgType, e.h1, ids, dh.public(), make([]byte, zrtpMACLen)), e.h0)
+}
+
+func (e *zrtpEndpoint) onCommitLocked(message []byte) {
+	if e.peerHello == nil || len(message) != 116 {
+		return
+	}
+	h2 := message[12:44]
+	if !bytes.Equal(zrtpHash(h2), e.peerHello.h3) || !zrtpVerify(e.peerHello.raw, h2) {
+		return
+	}
+
+	switch e.state {
+	case zrtpDiscovery:
+	case zrtpCommitSent:
+		// Both committed: the higher hvi stays initiator
+		if bytes.Compare(e.commit[76:108], message[76:108]) > 0 {
+			return
+		}
+		e.stopLocked()
+	default:
+		return
+	}
+
+	hash, cipherType, authTag := string(message[56:60]), string(message[60:64]), string(message[64:68])
+	keyAgreement, sasType := string(message[68:72]), string(message[72:76])
+	switch {
+	case !zrtpSupports(zrtpHashes, hash):
+		e.failLocked(zrtpErrHashType)
+		return
+	case !zrtpSupports(zrtpCiphers, cipherType):
+		e.failLocked(zrtpErrCipherType)
+		return
+	case !zrtpSupports(zrtpAuthTags, authTag):
+		e.failLocked(zrtpErrAuthTag)
+		return
+	case !zrtpSupports(zrtpKeyAgreements, keyAgreement):
+		e.failLocked(zrtpErrKeyAgreement)
+		return
+	case !zrtpSupports(zrtpSASTypes, sasType):
+		e.failLocked(zrtpErrSASType)
+		return
+	}
+	dh, err := newZRTPKeyAgreement(keyAgreement)
+	if err != nil {
+		e.failedLocked(err)
+		return
+	}
+
+	e.initiator, e.dh, e.keyAgreement, e.authTag = false, dh, keyAgreement, authTag
+	e.commit, e.peerH2, e.dhPart2 = message, h2, nil
+	e.dhPart1 = e.dhPartLocked(zrtpDHPart1, dh)
+	e.state = zrtpDHPart1Sent
+	e.answerLocked(message, e.dhPart1)
+}
+
+func (e *zrtpEndpoint) onDHPart1Locked(message []byte) {
+	if e.state != zrtpCommitSent || len(message) < 84 {
+		return
+	}
+	h1 := message[12:44]
+	if !bytes.Equal(zrtpHash(zrtpHash(h1)), e.peerHello.h3) || !zrtpVerify(e.peerHello.raw, zrtpHash(h1)) {
+		return
+	}
+	result, err := e.dh.agree(message[76 : len(message)-zrtpMACLen])
+	if err != nil {
+		e.failLocked(zrtpErrBadDHValue)
+		return
+	}
+
+	e.dhPart1, e.peerH1 = message, h1
+	totalHash := zrtpHash(e.peerHello.raw, e.commit, e.dhPart1, e.dhPart2)
+	e.keys = deriveZRTPKeys(result, e.zid, e.peerHello.zid, totalHash)
+	e.state = zrtpDHPart2Sent
+	e.retransmitLocked(e.dhPart2, zrtpT2, zrtpT2Max, zrtpT2Retries)
+}
+
+func (e *zrtpEndpoint) onDHPart2Locked(message []byte) {
+	if e.state != zrtpDHPart1Sent || len(message) < 84 {
+		return
+	}
+	h1 := message[12:44]
+	if !bytes.Equal(zrtpHash(h1), e.peerH2) || !zrtpVerify(e.commit, h1) {
+		return
+	}
+	if !bytes.Equal(zrtpHash(message, e.hello), e.commit[76:108]) {
+		e.failLocked(zrtpErrHviMismatch)
+		return
+	}
+	result, err := e.dh.agree(message[76 : len(message)-zrtpMACLen])
+	if err != nil {
+		e.failLocked(zrtpErrBadDHValue)
+		return
+	}
+
+	e.dhPart2, e.peerH1 = message, h1
+	totalHash := zrtpHash(e.hello, e.commit, e.dhPart1, e.dhPart2)
+	e.keys = deriveZRTPKeys(result, e.peerHello.zid, e.zid, totalHash)
+	confirm, err := zrtpConfirm(zrtpConfirm1, e.h0, e.keys.zrtpKeyR, e.keys.macKeyR)
+	if err != nil {
+		e.failedLocked(err)
+		return
+	}
+	e.state = zrtpConfirm1Sent
+	e.answerLocked(message, confirm)
+}
+
+func (e *zrtpEndpoint) onConfirm1Locked(message []byte) {
+	if e.state != zrtpDHPart2Sent {
+		return
+	}
+	h0, err := openZRTPConfirm(message, e.keys.zrtpKeyR, e.keys.macKeyR)
+	if err != nil || !bytes.Equal(zrtpHash(h0), e.peerH1) || !zrtpVerify(e.dhPart1, h0) {
+		e.failLocked(zrtpErrConfirmMAC)
+		return
+	}
+	confirm, err := zrtpConfirm(zrtpConfirm2, e.h0, e.keys.zrtpKeyI, e.keys.macKeyI)
+	if err != nil {
+		e.failedLocked(err)
+		return
+	}
+
+	// The responder may send SRTP before Karl's Conf2ACK arrives
+	inbound, err := e.cipherLocked(e.keys.srtpKeyR, e.keys.srtpSaltR)
+	if err != nil {
+		e.failedLocked(err)
+		return
+	}
+	e.key(inbound, nil)
+	e.state = zrtpConfirm2Sent
+	e.retransmitLocked(confirm, zrtpT2, zrtpT2Max, zrtpT2Retries)
+}
+
+func (e *zrtpEndpoint) onConfirm2Locked(message []byte) {
+	if e.state != zrtpConfirm1Sent {
+		return
+	}
+	h0, err := openZRTPConfirm(message, e.keys.zrtpKeyI, e.keys.macKeyI)
+	if err != nil || !bytes.Equal(zrtpHash(h0), e.peerH1) || !zrtpVerify(e.dhPart2, h0) {
+		e.failLocked(zrtpErrConfirmMAC)
+		return
+	}
+	e.answerLocked(message, zrtpMessage(zrtpConf2ACK))
+	e.secureLocked()
+}
+
+// confirmed takes SRTP the responder sent as the Conf2ACK that may have
+// been lost
+func (e *zrtpEndpoint) confirmed() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.state == zrtpConfirm2Sent {
+		e.secureLocked()
+	}
+}
+
+// secureLocked keys SRTP once the key agreement is confirmed: the
+// initiator sends with the initiator's keys and the responder with its own
+func (e *zrtpEndpoint) secureLocked() {
+	e.stopLocked()
+	local, localSalt, remote, remoteSalt := e.keys.srtpKeyR, e.keys.srtpSaltR, e.keys.srtpKeyI, e.keys.srtpSaltI
+	if e.initiator {
+		local, localSalt, remote, remoteSalt = remote, remoteSalt, local, localSalt
+	}
+	outbound, err := e.cipherLocked(local, localSalt)
+	if err != nil {
+		e.failedLocked(err)
+		return
+	}
+	var inbound SRTPCipher
+	if !e.initiator {
+		if inbound, err = e.cipherLocked(remote, remoteSalt); err != nil {
+			e.failedLocked(err)
+			return
+		}
+	}
+	e.key(inbound, outbound)
+	e.state = zrtpSecure
+	zrtpHandshakes.WithLabelValues("success").Inc()
+	rtpLog.Info("ZRTP secured", "peer", e.remote, "client", e.peerHello.clientID, "key_agreement", e.keyAgreement, "sas", e.keys.sas)
+}
+
+// cipherLocked creates an SRTP context with the negotiated auth tag
+func (e *zrtpEndpoint) cipherLocked(key, salt []byte) (SRTPCipher, error) {
+	profile := srtp.ProtectionProfileAes128CmHmacSha1_80
+	if e.authTag == "HS32" {
+		profile = srtp.ProtectionProfileAes128CmHmacSha1_32
+	}
+	return NewSRTPCipher(key, salt, profile)
+}
+
+// failLocked sends the party an Error and gives up the key agreement
+func (e *zrtpEndpoint) failLocked(code uint32) {
+	e.sendLocked(zrtpMessage(zrtpError, binary.BigEndian.AppendUint32(nil, code)))
+	e.failedLocked(fmt.Errorf("ZRTP error 0x%x", code))
+}
+
+func (e *zrtpEndpoint) failedLocked(err error) {
+	e.stopLocked()
+	e.state = zrtpFailed
+	zrtpHandshakes.WithLabelValues("failure").Inc()
+	rtpLog.Warn("ZRTP key agreement failed", "peer", e.remote, "error", err)
+}
+
+// answerLocked sends Karl's answer to a message of the party, and again
+// whenever the party retransmits that message
+func (e *zrtpEndpoint) answerLocked(message, reply []byte) {
+	e.replyTo, e.reply = message, reply
+	e.sendLocked(reply)
+}
+
+// retransmitLocked sends a message and repeats it, at a doubling interval,
+// until stopLocked. A key agreement message left unanswered fails
+func (e *zrtpEndpoint) retransmitLocked(message []byte, interval, maxInterval time.Duration, retries int) {
+	e.stopLocked()
+	e.pending = message
+	e.sendLocked(message)
+
+	generation := e.generation
+	var tick func()
+	tick = func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if e.generation != generation || e.closed {
+			return
+		}
+		if retries == 0 {
+			e.pending = nil
+			if e.state != zrtpDiscovery {
+				e.failLocked(zrtpErrProtocolTimeout)
+			}
+			return
+		}
+		retries--
+		e.sendLocked(message)
+		if interval = 2 * interval; interval > maxInterval {
+			interval = maxInterval
+		}
+		e.timer = time.AfterFunc(interval, tick)
+	}
+	e.timer = time.AfterFunc(interval, tick)
+}
+
+// stopLocked ends the retransmission of the pending message
+func (e *zrtpEndpoint) stopLocked() {
+	e.generation++
+	e.pending = nil
+	if e.timer != nil {
+		e.timer.Stop()
+		e.timer = nil
+	}
+}
+
+func (e *zrtpEndpoint) sendLocked(message []byte) {
+	if e.conn == nil || e.remote == nil {
+		return
+	}
+	e.seq++
+	_, _ = e.conn.WriteToUDP(zrtpPacket(e.seq, e.ssrc, message), e.remote)
+}
+
+// info describes the key agreement for a query
+func (e *zrtpEndpoint) info() map[string]interface{} {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	info := map[string]interface{}{"mode": "terminated", "state": e.state.String()}
+	if e.peerHello != nil {
+		info["client"] = e.peerHello.clientID
+	}
+	if e.keys != nil {
+		info["key_agreement"] = e.keyAgreement
+		info["auth_tag"] = e.authTag
+		info["sas"] = e.keys.sas
+	}
+	return info
+}
+
+// SetZRTP marks whether the parties of a session run ZRTP end to end. Their
+// media is then SRTP Karl cannot decrypt, so it is relayed unchanged: no
+// transcoding, payload type mapping or re-framing
+func (sr *SessionRegistry) SetZRTP(session *MediaSession, zrtp bool) {
+	session.Lock()
+	changed := session.ZRTP != zrtp
+	session.ZRTP = zrtp
+	session.Unlock()
+	if changed {
+		GetCodecNegotiator().SetPassthrough(session.CallID, zrtp)
+	}
+}
+
+// RelayZRTP passes a ZRTP packet to the other party of the call whose SSRC
+// it carries, unchanged, like the forwarder does the RTP of the stream
+func (sr *SessionRegistry) RelayZRTP(packet []byte) error {
+	ssrc := binary.BigEndian.Uint32(packet[8:12])
+	session, leg, ok := sr.GetSessionBySSRC(ssrc)
+	if !ok || leg == nil {
+		return fmt.Errorf("ZRTP from unknown SSRC %d", ssrc)
+	}
+	sr.mu.RLock()
+	forwarder := sr.forwarder
+	sr.mu.RUnlock()
+	if forwarder == nil {
+		return errors.New("media relay is stopped")
+	}
+
+	sr.SetZRTP(session, true)
+	session.mu.RLock()
+	addr, conn, _, _ := session.route(leg, ssrc)
+	session.mu.RUnlock()
+	if addr == nil {
+		return nil
+	}
+	_, err := forwarder.send(conn, [][]byte{packet}, addr)
+	return err
+}
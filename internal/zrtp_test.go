@@ -0,0 +1,295 @@
+package internal
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	ng "karl/internal/ng_protocol"
+
+	"github.com/pion/rtp"
+)
+
+// zrtpParty runs a ZRTP MediaCrypto on its own port, as a softphone would
+func zrtpParty(t *testing.T) (*MediaCrypto, *net.UDPConn) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	crypto, err := NewZRTPCrypto("RTP/AVP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		crypto.Close()
+		conn.Close()
+	})
+	return crypto, conn
+}
+
+// receiveZRTP feeds what arrives on conn to the party's receive path and
+// passes on the media that comes out of it
+func receiveZRTP(crypto *MediaCrypto, conn *net.UDPConn) <-chan []byte {
+	media := make(chan []byte, 16)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if packet, ok := crypto.receive(conn, buf[:n], from); ok {
+				select {
+				case media <- append([]byte(nil), packet...):
+				default:
+				}
+			}
+		}
+	}()
+	return media
+}
+
+func waitKeyed(t *testing.T, parties ...*MediaCrypto) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for _, party := range parties {
+		for !party.Keyed() && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if !party.Keyed() {
+			t.Fatalf("ZRTP did not key SRTP: %v", party.ZRTPInfo())
+		}
+	}
+}
+
+func TestIsZRTPPacket(t *testing.T) {
+	packet := zrtpPacket(1, 0xA, zrtpMessage(zrtpHelloACK))
+	if !IsZRTPPacket(packet) {
+		t.Fatal("ZRTP packet not detected")
+	}
+	if _, msgType, err := parseZRTPPacket(packet); err != nil || msgType != zrtpHelloACK {
+		t.Fatalf("parsed %q, %v", msgType, err)
+	}
+	packet[len(packet)-1] ^= 0xFF
+	if _, _, err := parseZRTPPacket(packet); err == nil {
+		t.Error("accepted a packet with a bad CRC")
+	}
+
+	plain, _ := (&rtp.Packet{Header: rtp.Header{Version: 2, SSRC: 0xA}, Payload: make([]byte, 160)}).Marshal()
+	if IsZRTPPacket(plain) {
+		t.Error("RTP taken for ZRTP")
+	}
+}
+
+func TestZRTPEndpoint_KeyAgreement(t *testing.T) {
+	for _, keyAgreement := range []string{"EC25", "DH3k"} {
+		t.Run(keyAgreement, func(t *testing.T) {
+			defer func(saved []string) { zrtpKeyAgreements = saved }(zrtpKeyAgreements)
+			zrtpKeyAgreements = []string{keyAgreement}
+
+			alice, aliceConn := zrtpParty(t)
+			bob, bobConn := zrtpParty(t)
+			alice.SetRemoteZRTP(bob.ZRTPHash)
+			bob.SetRemoteZRTP(alice.ZRTPHash)
+			receiveZRTP(alice, aliceConn)
+			media := receiveZRTP(bob, bobConn)
+
+			// Both send Hello and both commit; the key agreement settles
+			// which one initiates
+			alice.Start(aliceConn, bobConn.LocalAddr().(*net.UDPAddr))
+			bob.Start(bobConn, aliceConn.LocalAddr().(*net.UDPAddr))
+			waitKeyed(t, alice, bob)
+
+			aliceInfo, bobInfo := alice.ZRTPInfo(), bob.ZRTPInfo()
+			if aliceInfo["state"] != "secure" || aliceInfo["key_agreement"] != keyAgreement || aliceInfo["client"] != zrtpClientID {
+				t.Fatalf("unexpected key agreement %v", aliceInfo)
+			}
+			if aliceInfo["sas"] != bobInfo["sas"] || len(aliceInfo["sas"].(string)) != 4 {
+				t.Fatalf("SAS %v and %v differ", aliceInfo["sas"], bobInfo["sas"])
+			}
+
+			plain, _ := (&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: 1, SSRC: 0xA}, Payload: []byte("media")}).Marshal()
+			encrypted, err := alice.protect(append([]byte(nil), plain...), false)
+			if err != nil || bytes.Equal(encrypted, plain) {
+				t.Fatalf("media not encrypted: %v", err)
+			}
+			if _, err := aliceConn.WriteToUDP(encrypted, bobConn.LocalAddr().(*net.UDPAddr)); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case got := <-media:
+				if !bytes.Equal(got, plain) {
+					t.Errorf("decrypted %x, want %x", got, plain)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("SRTP keyed by ZRTP did not decrypt")
+			}
+		})
+	}
+}
+
+func TestZRTPEndpoint_RejectsHelloNotSignalled(t *testing.T) {
+	alice, aliceConn := zrtpParty(t)
+	bob, bobConn := zrtpParty(t)
+	alice.SetRemoteZRTP("1.10 " + strings.Repeat("00", 32))
+	receiveZRTP(alice, aliceConn)
+	receiveZRTP(bob, bobConn)
+
+	alice.Start(aliceConn, bobConn.LocalAddr().(*net.UDPAddr))
+	bob.Start(bobConn, aliceConn.LocalAddr().(*net.UDPAddr))
+	time.Sleep(500 * time.Millisecond)
+	if alice.Keyed() || bob.Keyed() {
+		t.Fatal("keyed with a party whose Hello does not match its a=zrtp-hash")
+	}
+	if state := alice.ZRTPInfo()["state"]; state != "discovery" {
+		t.Errorf("state %v, want discovery", state)
+	}
+}
+
+func TestNGSocketListener_ZRTPPassthrough(t *testing.T) {
+	control, err := NewRTPControl(nil, nil)
+	if err != nil {
+		t.Fatalf("NewRTPControl failed: %v", err)
+	}
+	defer control.Stop()
+	forwardThroughPool(t, control)
+
+	manager, registry, _ := newTestSessionManager(t)
+	manager.SetMediaPortOpener(control.OpenMediaPorts)
+	registry.SetMediaSender(control.SendBatchFrom)
+	defer registry.SetMediaSender(nil)
+	control.SetZRTPRelay(registry.RelayZRTP)
+	listener := &NGSocketListener{sessionRegistry: registry, sessionManager: manager, config: &Config{}}
+
+	parties := make([]*net.UDPConn, 2)
+	for i := range parties {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		parties[i] = conn
+	}
+
+	// Two softphones run ZRTP end to end; Karl offers no codecs of its own
+	zrtpHash := "a=zrtp-hash:1.10 " + strings.Repeat("ab", 32) + "\r\n"
+	resp, err := listener.handleOffer(&ng.NGRequest{CallID: "zrtp-call", FromTag: "from-tag", SDP: endpointSDP(parties[0]) + zrtpHash, Transcode: []string{"opus"}})
+	if err != nil || resp.Result != ng.ResultOK {
+		t.Fatalf("handleOffer failed: %v %+v", err, resp)
+	}
+	defer GetCodecNegotiator().RemoveCall("zrtp-call")
+	if !strings.Contains(resp.SDP, zrtpHash) || strings.Contains(resp.SDP, "opus") {
+		t.Fatalf("expected the offer relayed as sent, got:\n%s", resp.SDP)
+	}
+	if resp, err := listener.handleAnswer(&ng.NGRequest{CallID: "zrtp-call", FromTag: "from-tag", ToTag: "to-tag", SDP: endpointSDP(parties[1])}); err != nil || resp.Result != ng.ResultOK {
+		t.Fatalf("handleAnswer failed: %v %+v", err, resp)
+	}
+
+	session := registry.GetSessionByCallID("zrtp-call")[0]
+	session.RLock()
+	zrtp, calleeLeg := session.ZRTP, session.CalleeLeg
+	session.RUnlock()
+	if !zrtp {
+		t.Fatal("call not marked as ZRTP")
+	}
+	if err := registry.RegisterSSRC(session.ID, 0xA, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, ok := GetCodecNegotiator().ResolveOutput(0xA, 0); ok {
+		t.Error("media of a ZRTP call would be rewritten")
+	}
+
+	// ZRTP reaches the other party byte for byte
+	hello := zrtpPacket(7, 0xA, zrtpMessage(zrtpHelloACK))
+	if got := relayed(t, parties[0], parties[1], calleeLeg.LocalPort, hello); !bytes.Equal(got, hello) {
+		t.Fatalf("relayed %x, want %x", got, hello)
+	}
+
+	query, err := listener.handleQuery(&ng.NGRequest{CallID: "zrtp-call"})
+	if err != nil || query.Extra["zrtp"].(map[string]interface{})["mode"] != "passthrough" {
+		t.Errorf("unexpected query %+v, %v", query, err)
+	}
+}
+
+func TestNGSocketListener_ZRTPTerminate(t *testing.T) {
+	control, err := NewRTPControl(nil, nil)
+	if err != nil {
+		t.Fatalf("NewRTPControl failed: %v", err)
+	}
+	defer control.Stop()
+	forwardThroughPool(t, control)
+
+	manager, registry, _ := newTestSessionManager(t)
+	manager.SetMediaPortOpener(control.OpenMediaPorts)
+	registry.SetMediaSender(control.SendBatchFrom)
+	defer registry.SetMediaSender(nil)
+	control.SetMediaCryptoResolver(registry.MediaCryptoFor)
+	control.SetZRTPRelay(registry.RelayZRTP)
+	listener := &NGSocketListener{sessionRegistry: registry, sessionManager: manager, config: &Config{}}
+
+	phone, phoneConn := zrtpParty(t)
+	answerer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer answerer.Close()
+
+	// A ZRTP softphone calls a party that takes SDES-SRTP
+	offer := endpointSDP(phoneConn) + "a=zrtp-hash:" + phone.ZRTPHash + "\r\n"
+	resp, err := listener.handleOffer(&ng.NGRequest{CallID: "zrtp-terminate", FromTag: "from-tag", SDP: offer, Flags: []string{"ZRTP=terminate"}})
+	if err != nil || resp.Result != ng.ResultOK {
+		t.Fatalf("handleOffer failed: %v %+v", err, resp)
+	}
+	defer GetCodecNegotiator().RemoveCall("zrtp-terminate")
+	if !strings.Contains(resp.SDP, " RTP/SAVP 0 101\r\n") || !strings.Contains(resp.SDP, "a=crypto:") || strings.Contains(resp.SDP, "zrtp-hash") {
+		t.Fatalf("expected an SDES offer, got:\n%s", resp.SDP)
+	}
+
+	answer := strings.Replace(endpointSDP(answerer), "RTP/AVP", "RTP/SAVP", 1) + "a=crypto:1 AES_CM_128_HMAC_SHA1_80 inline:" + bridgeAnswerKey + "\r\n"
+	resp, err = listener.handleAnswer(&ng.NGRequest{CallID: "zrtp-terminate", FromTag: "from-tag", ToTag: "to-tag", SDP: answer})
+	if err != nil || resp.Result != ng.ResultOK {
+		t.Fatalf("handleAnswer failed: %v %+v", err, resp)
+	}
+
+	session := registry.GetSessionByCallID("zrtp-terminate")[0]
+	session.RLock()
+	caller, callee, calleeLeg := session.CallerCrypto, session.CalleeCrypto, session.CalleeLeg
+	session.RUnlock()
+	if caller == nil || caller.Mode != CryptoZRTP || callee == nil || callee.Mode != CryptoSDES {
+		t.Fatalf("unexpected bridge %+v / %+v", caller, callee)
+	}
+	if !strings.Contains(resp.SDP, " RTP/AVP 0 101\r\n") || !strings.Contains(resp.SDP, "a=zrtp-hash:"+caller.ZRTPHash+"\r\n") || strings.Contains(resp.SDP, "a=crypto") {
+		t.Fatalf("expected a ZRTP answer, got:\n%s", resp.SDP)
+	}
+
+	// The softphone and Karl agree on keys and show the same SAS
+	phone.SetRemoteZRTP(caller.ZRTPHash)
+	receiveZRTP(phone, phoneConn)
+	phone.Start(phoneConn, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: calleeLeg.LocalPort})
+	waitKeyed(t, phone, caller)
+	if phone.ZRTPInfo()["sas"] != caller.ZRTPInfo()["sas"] {
+		t.Fatalf("SAS %v and %v differ", phone.ZRTPInfo()["sas"], caller.ZRTPInfo()["sas"])
+	}
+	if err := registry.RegisterSSRC(session.ID, 0xA, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// and the softphone's SRTP reaches the answerer under Karl's SDES key
+	plain, _ := (&rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 0, SequenceNumber: 1, Timestamp: 160, SSRC: 0xA}, Payload: make([]byte, 160)}).Marshal()
+	encrypted, err := phone.protect(append([]byte(nil), plain...), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := sdesContext(t, callee.LocalKey).DecryptRTP(nil, relayed(t, phoneConn, answerer, calleeLeg.LocalPort, encrypted), nil)
+	if err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("the answerer could not decrypt Karl's SRTP: %v", err)
+	}
+
+	query, err := listener.handleQuery(&ng.NGRequest{CallID: "zrtp-terminate"})
+	if info, _ := query.Extra["zrtp"].(map[string]interface{}); err != nil || info["state"] != "secure" || info["party"] != "caller" {
+		t.Errorf("unexpected query %+v, %v", query, err)
+	}
+}
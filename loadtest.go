@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"karl/internal/loadtest"
+)
+
+// runLoadTest runs `karl loadtest`: it originates simulated calls against
+// a running instance and prints what they achieved. It returns 0 when
+// every call was set up, 1 when some failed and 2 on bad arguments
+func runLoadTest(args []string) int {
+	cfg := loadtest.DefaultConfig()
+	fs := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+	fs.StringVar(&cfg.NGAddr, "ng", cfg.NGAddr, "NG UDP address of the instance under test")
+	fs.StringVar(&cfg.Secret, "ng-secret", os.Getenv("KARL_NG_SECRET"), "NG signing key, when the instance requires signed messages")
+	fs.StringVar(&cfg.LocalIP, "local-ip", cfg.LocalIP, "address the simulated endpoints bind and advertise")
+	fs.IntVar(&cfg.Calls, "calls", cfg.Calls, "calls to originate")
+	fs.Float64Var(&cfg.Rate, "rate", cfg.Rate, "calls started per second, 0 to start all at once")
+	fs.DurationVar(&cfg.Duration, "duration", cfg.Duration, "media time of each call")
+	fs.StringVar(&cfg.Codec, "codec", cfg.Codec, "codec to send: pcmu, pcma, g722 or opus")
+	fs.DurationVar(&cfg.Ptime, "ptime", cfg.Ptime, "packetization time")
+	fs.DurationVar(&cfg.Jitter, "jitter", cfg.Jitter, "send each packet up to this much late")
+	fs.Float64Var(&cfg.Loss, "loss", cfg.Loss, "percent of packets to drop before sending")
+	fs.DurationVar(&cfg.Timeout, "timeout", cfg.Timeout, "wait for each NG response")
+	jsonOutput := fs.Bool("json", false, "print the report as JSON")
+	perCall := fs.Bool("per-call", false, "print a line per call")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "karl loadtest: %v\n", err)
+		return 2
+	}
+
+	// Ctrl-C stops new calls and cuts the running ones short; the report
+	// covers what was sent
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if !*jsonOutput {
+		fmt.Printf("Originating %d %s calls of %s against %s\n", cfg.Calls, cfg.Codec, cfg.Duration, cfg.NGAddr)
+	}
+	report, err := loadtest.Run(ctx, cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "karl loadtest: %v\n", err)
+		return 2
+	}
+
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(report)
+	} else {
+		report.WriteText(os.Stdout, *perCall)
+	}
+
+	if report.Failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"os"
 )
@@ -27,6 +28,23 @@ func ensureRunDir() error {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "loadtest" {
+		os.Exit(runLoadTest(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "ports" {
+		os.Exit(runPorts(os.Args[2:]))
+	}
+
+	checkConfig := flag.Bool("check-config", false, "validate the configuration file given as argument, or the default one, and exit")
+	jsonOutput := flag.Bool("json", false, "print the -check-config result as JSON")
+	flag.Parse()
+	if *checkConfig {
+		os.Exit(runConfigCheck(flag.Arg(0), *jsonOutput))
+	}
+
 	log.Println("Starting Karl RTP Engine...")
 
 	// Ensure run directory exists before starting
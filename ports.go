@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"karl/internal"
+)
+
+// runPorts runs `karl ports`: it asks a running instance's REST API for the
+// state of its media port pool and prints it. It returns 0 on success, 1
+// when the instance could not be queried and 2 on bad arguments
+func runPorts(args []string) int {
+	fs := flag.NewFlagSet("ports", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: karl ports [options]")
+		fs.PrintDefaults()
+	}
+	api := fs.String("api", "http://127.0.0.1:8080", "REST API address of the instance")
+	apiKey := fs.String("api-key", os.Getenv("KARL_API_KEY"), "API key with stats:read, when the API requires one")
+	timeout := fs.Duration("timeout", 5*time.Second, "wait for the API response")
+	jsonOutput := fs.Bool("json", false, "print the pool state as JSON")
+	sessions := fs.Bool("sessions", false, "list the ports held by each session")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+
+	state, err := fetchPortPoolState(strings.TrimSuffix(*api, "/"), *apiKey, *timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "karl ports: %v\n", err)
+		return 1
+	}
+
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(state)
+		return 0
+	}
+	writePortPoolState(os.Stdout, state, *sessions)
+	return 0
+}
+
+func fetchPortPoolState(api, apiKey string, timeout time.Duration) (*internal.PortPoolState, error) {
+	req, err := http.NewRequest(http.MethodGet, api+"/api/v1/admin/ports", nil)
+	if err != nil {
+		return nil, err
+	}
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var state internal.PortPoolState
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	return &state, nil
+}
+
+func writePortPoolState(w io.Writer, s *internal.PortPoolState, sessions bool) {
+	fmt.Fprintf(w, "Range:       %d-%d\n", s.MinPort, s.MaxPort)
+	fmt.Fprintf(w, "In use:      %d ports (%.1f%%), peak %d\n", s.InUse, s.Utilization*100, s.PeakInUse)
+	fmt.Fprintf(w, "Available:   %d ports, %d more reserved for fast allocation\n", s.Available, s.Reserved)
+	fmt.Fprintf(w, "Cooldown:    %d ports, reusable after %s\n", s.Cooldown, s.ReuseDelay)
+	fmt.Fprintf(w, "Failed:      %d allocations\n", s.Failed)
+	if !sessions {
+		return
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "%-38s %-10s %s\n", "SESSION", "AGE", "PORTS")
+	for _, alloc := range s.Sessions {
+		age := time.Since(alloc.AllocatedAt).Truncate(time.Second)
+		fmt.Fprintf(w, "%-38s %-10s %v\n", alloc.SessionID, age, alloc.Ports)
+	}
+}
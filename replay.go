@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"karl/internal"
+)
+
+// runReplay runs `karl replay`: it feeds the RTP of a capture through the
+// media pipeline with the original timing and prints what came out, to
+// reproduce codec and transcoding problems from production. It returns 0
+// on success, 1 when the replay failed or hit errors and 2 on bad arguments
+func runReplay(args []string) int {
+	var opts internal.ReplayOptions
+	var offerSDP, answerSDP, flags, offerSSRCs, answerSSRCs, output string
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: karl replay [options] file.pcap")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&opts.CallID, "call-id", "", "call to replay; its offer and answer are looked up in the capture's SIP or NG messages")
+	fs.StringVar(&offerSDP, "offer-sdp", "", "file holding the offerer's SDP, when the capture has no signaling")
+	fs.StringVar(&answerSDP, "answer-sdp", "", "file holding the answerer's SDP, when the capture has no signaling")
+	fs.StringVar(&flags, "flags", "", "comma-separated NG flags of the call, e.g. AGC and Opus options")
+	fs.StringVar(&offerSSRCs, "offer-ssrc", "", "comma-separated SSRCs the offerer sent, when addresses do not tell")
+	fs.StringVar(&answerSSRCs, "answer-ssrc", "", "comma-separated SSRCs the answerer sent, when addresses do not tell")
+	fs.Float64Var(&opts.Speed, "speed", 1, "replay speed; 1 keeps the original timing, 0 replays without pauses")
+	fs.StringVar(&output, "o", "", "write the packets the pipeline sends on to this pcap file")
+	jsonOutput := fs.Bool("json", false, "print the result as JSON")
+
+	// The capture may come before or after the options
+	var files []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return 2
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		files = append(files, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(files) != 1 {
+		fs.Usage()
+		return 2
+	}
+	if opts.Speed < 0 {
+		fmt.Fprintln(os.Stderr, "karl replay: -speed must not be negative")
+		return 2
+	}
+
+	var err error
+	if opts.OfferSDP, err = readOptionalFile(offerSDP); err == nil {
+		opts.AnswerSDP, err = readOptionalFile(answerSDP)
+	}
+	if err == nil {
+		opts.OfferSSRCs, err = parseSSRCList(offerSSRCs)
+	}
+	if err == nil {
+		opts.AnswerSSRCs, err = parseSSRCList(answerSSRCs)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "karl replay: %v\n", err)
+		return 2
+	}
+	if flags != "" {
+		opts.Flags = strings.Split(flags, ",")
+	}
+
+	capture, err := os.Open(files[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "karl replay: %v\n", err)
+		return 2
+	}
+	defer capture.Close()
+	if output != "" {
+		out, err := os.Create(output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "karl replay: %v\n", err)
+			return 2
+		}
+		defer out.Close()
+		opts.Output = out
+	}
+
+	// Ctrl-C stops the replay; the result covers what was fed in
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	result, err := internal.ReplayPCAP(ctx, capture, opts)
+	if result != nil {
+		if *jsonOutput {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			_ = enc.Encode(result)
+		} else {
+			writeReplayResult(os.Stdout, result)
+		}
+	}
+	if err != nil && err != context.Canceled {
+		fmt.Fprintf(os.Stderr, "karl replay: %v\n", err)
+		return 1
+	}
+	if result.TranscodingErrors > 0 || result.ForwardingErrors > 0 {
+		return 1
+	}
+	return 0
+}
+
+func writeReplayResult(w io.Writer, r *internal.ReplayResult) {
+	negotiated := "not negotiated, media relayed unchanged"
+	if r.Negotiated {
+		negotiated = "negotiated"
+	}
+	fmt.Fprintf(w, "Call:        %s (SDPs from %s, %s)\n", r.CallID, r.Signaling, negotiated)
+	fmt.Fprintf(w, "Media:       %.2fs, %d RTCP packets, %d other datagrams skipped\n", r.MediaSeconds, r.RTCPPackets, r.Skipped)
+	fmt.Fprintf(w, "Errors:      %d transcoding, %d forwarding\n", r.TranscodingErrors, r.ForwardingErrors)
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "%-10s %-9s %-22s %8s %8s %s\n", "SSRC", "LEG", "SOURCE", "IN", "OUT", "PAYLOAD TYPES")
+	for _, s := range r.Streams {
+		fmt.Fprintf(w, "%-10d %-9s %-22s %8d %8d %v -> %v\n",
+			s.SSRC, s.Leg, s.Source, s.PacketsIn, s.PacketsOut, s.PayloadTypesIn, s.PayloadTypesOut)
+	}
+}
+
+func readOptionalFile(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(path)
+	return string(data), err
+}
+
+func parseSSRCList(list string) ([]uint32, error) {
+	var ssrcs []uint32
+	for _, field := range strings.Split(list, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		ssrc, err := strconv.ParseUint(field, 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SSRC %q", field)
+		}
+		ssrcs = append(ssrcs, uint32(ssrc))
+	}
+	return ssrcs, nil
+}
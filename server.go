@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net/http"
@@ -12,6 +13,8 @@ import (
 	"time"
 
 	"karl/internal"
+	"karl/internal/grpcapi"
+	"karl/internal/recording"
 
 	"github.com/pion/webrtc/v3"
 )
@@ -25,9 +28,12 @@ type KarlServer struct {
 	webrtcStats    *internal.WebRTCStats
 	srtpTranscoder *internal.SRTPTranscoder
 	transcoder     *internal.RTPTranscoder
+	sfu            *internal.SFU
+	signaling      *internal.SignalingServer
+	dtlsCerts      *internal.DTLSCertificateManager
 	rtpSocket      *internal.RTPengineSocketListener
 	redisCache     *internal.RTPRedisCache
-	database       *internal.RTPDatabase
+	database       internal.Database
 	wg             sync.WaitGroup
 	ctx            context.Context
 	cancel         context.CancelFunc
@@ -37,10 +43,22 @@ type KarlServer struct {
 	healthServer   *http.Server            // Health check server
 
 	// New components
-	sessionRegistry *internal.SessionRegistry
-	ngListener      *internal.NGSocketListener
-	rtcpHandler     *internal.RTCPHandler
-	fecHandler      *internal.FECHandler
+	sessionRegistry  *internal.SessionRegistry
+	ngListener       *internal.NGSocketListener
+	rtcpHandler      *internal.RTCPHandler
+	fecHandler       *internal.FECHandler
+	srtpRekeyer      *internal.SRTPRekeyer
+	hepExporter      *internal.HEPExporter
+	pcapManager      *internal.CallCaptureManager
+	recordingManager *recording.Manager
+
+	conferenceManager    *internal.ConferenceManager
+	transcriptionManager *internal.TranscriptionManager
+	haElector            *internal.HAElector
+	dispatcher           *internal.CallDispatcher
+	grpcServer           *grpcapi.Server
+	mediaACL             *internal.MediaACL
+	debugServer          *internal.PprofServer
 }
 
 // NewKarlServer creates and initializes a new KarlServer instance
@@ -64,11 +82,26 @@ func (k *KarlServer) Start() error {
 	// Set up signal handling
 	k.setupSignalHandler()
 
+	// Load the metrics and health certificates, reloaded on SIGHUP
+	metricsTLS, err := internal.NewEndpointTLS("metrics", k.config.MetricsTLS)
+	if err != nil {
+		return err
+	}
+	healthTLS, err := internal.NewEndpointTLS("health", k.config.HealthTLS)
+	if err != nil {
+		return err
+	}
+	internal.ReloadEndpointTLSOnSIGHUP(k.ctx, metricsTLS, healthTLS)
+
 	// Initialize metrics with configurable port
 	internal.InitMetrics()
 	mux := internal.SetupRoutes()
 	metricsPort := internal.GetMetricsPort()
-	err := internal.StartMetricsServer(metricsPort, mux)
+	var metricsTLSConfig *tls.Config
+	if metricsTLS != nil {
+		metricsTLSConfig = metricsTLS.TLSConfig()
+	}
+	err = internal.StartMetricsServer(metricsPort, mux, metricsTLSConfig)
 	if err != nil {
 		log.Printf("Failed to start metrics server: %v", err)
 	} else {
@@ -98,13 +131,17 @@ func (k *KarlServer) Start() error {
 		mux.HandleFunc("/health", internal.SimpleHealthHandler())
 		mux.HandleFunc("/health/detail", internal.HealthHandler())
 
-		// Kubernetes probe endpoints
+		// Kubernetes probe endpoints; /livez and /readyz are the strict
+		// variants, /live and /ready also weigh dependency health
 		mux.HandleFunc("/live", internal.LivenessHandler())
-		mux.HandleFunc("/livez", internal.LivenessHandler())
+		mux.HandleFunc("/livez", internal.LivezHandler())
 		mux.HandleFunc("/ready", internal.ReadinessHandler())
-		mux.HandleFunc("/readyz", internal.ReadinessHandler())
+		mux.HandleFunc("/readyz", internal.ReadyzHandler())
 		mux.HandleFunc("/startup", internal.StartupHandler())
 
+		// Pod identity and media port range for Service generation
+		mux.HandleFunc("/status", internal.StatusHandler())
+
 		// Get health port from environment or use default
 		healthPort := internal.GetHealthPort()
 
@@ -116,11 +153,20 @@ func (k *KarlServer) Start() error {
 			WriteTimeout: 10 * time.Second,
 			IdleTimeout:  60 * time.Second,
 		}
+		if healthTLS != nil {
+			k.healthServer.TLSConfig = healthTLS.TLSConfig()
+		}
 
 		// Start server in a goroutine
 		go func() {
 			log.Printf("Starting health check server on %s", k.healthServer.Addr)
-			if err := k.healthServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			var err error
+			if k.healthServer.TLSConfig != nil {
+				err = k.healthServer.ListenAndServeTLS("", "")
+			} else {
+				err = k.healthServer.ListenAndServe()
+			}
+			if err != nil && err != http.ErrServerClosed {
 				log.Printf("Health check server error: %v", err)
 			}
 		}()
@@ -161,6 +207,9 @@ func (k *KarlServer) setupSignalHandler() {
 		k.isShuttingDown = true
 		k.mu.Unlock()
 
+		// Fail /readyz first so no new calls are routed here
+		internal.SetDraining(true)
+
 		log.Println("🛑 Shutdown signal received")
 		k.Shutdown()
 	}()
@@ -177,6 +226,7 @@ func (k *KarlServer) Shutdown() {
 	}
 	k.isShuttingDown = true
 	k.mu.Unlock()
+	internal.SetDraining(true)
 
 	// Cancel context to stop all operations
 	k.cancel()
@@ -188,6 +238,21 @@ func (k *KarlServer) Shutdown() {
 		k.webrtcStats = nil
 	}
 
+	// Stop accepting browser sessions
+	if k.signaling != nil {
+		k.signaling.Stop()
+	}
+
+	// Stop watching the DTLS certificate for renewal
+	if k.dtlsCerts != nil {
+		k.dtlsCerts.Stop()
+	}
+
+	// Stop forwarding video to SFU subscribers
+	if k.sfu != nil {
+		k.sfu.Stop()
+	}
+
 	// Clean up SRTP transcoder
 	if k.srtpTranscoder != nil {
 		k.srtpTranscoder.Context = nil // ✅ Reset context instead of calling Close()
@@ -209,10 +274,44 @@ func (k *KarlServer) Shutdown() {
 
 	// Stop RTP control
 	if k.rtpControl != nil {
+		internal.SetDefaultRTPHandler(nil)
+		if k.rtcpHandler != nil {
+			k.rtcpHandler.SetSessionRegistry(nil, nil)
+		}
+		if k.sessionRegistry != nil {
+			internal.GetRTCPDemuxer().SetPLIHandler(nil)
+			internal.GetRTCPDemuxer().SetFIRHandler(nil)
+			k.sessionRegistry.SetKeyframeSender(nil, 0)
+			k.sessionRegistry.SetVideoTranscoder(nil)
+			k.sessionRegistry.SetMediaSender(nil)
+		}
 		k.rtpControl.Stop()
 		k.rtpControl = nil
 	}
 
+	if k.mediaACL != nil {
+		k.mediaACL.Stop()
+		k.mediaACL = nil
+	}
+
+	// Close control streams before sessions go away
+	if k.grpcServer != nil {
+		k.grpcServer.Stop()
+		k.grpcServer = nil
+	}
+
+	// Leave the dispatch ring so peers stop sending this node new calls
+	if k.dispatcher != nil {
+		k.dispatcher.Stop()
+		k.dispatcher = nil
+	}
+
+	// Hand the virtual media IP to the standby first
+	if k.haElector != nil {
+		k.haElector.Stop()
+		k.haElector = nil
+	}
+
 	// Close database connections
 	if k.database != nil {
 		k.database.Close()
@@ -240,13 +339,57 @@ func (k *KarlServer) Shutdown() {
 		k.rtcpHandler.Stop()
 	}
 
+	// Stop HEP capture export
+	if k.hepExporter != nil {
+		k.hepExporter.Stop()
+	}
+
+	// Finalize recordings before their sessions are torn down
+	if k.recordingManager != nil {
+		if err := k.recordingManager.Stop(); err != nil {
+			log.Printf("⚠️ Error stopping recording manager: %v", err)
+		}
+	}
+
+	// Close conference rooms while the RTP socket is still open
+	if k.conferenceManager != nil {
+		k.conferenceManager.Stop()
+	}
+
+	// End transcription streams, publishing the engine's last segments
+	if k.transcriptionManager != nil {
+		k.transcriptionManager.Stop()
+	}
+
+	// Close per-call packet captures
+	if k.pcapManager != nil {
+		k.pcapManager.StopAll()
+	}
+
+	// Stop SRTP key rotation
+	if k.srtpRekeyer != nil {
+		k.srtpRekeyer.Stop()
+	}
+
 	// Stop session registry
 	if k.sessionRegistry != nil {
 		k.sessionRegistry.Stop()
 	}
 
+	// Stop the profiling listener
+	if k.debugServer != nil {
+		_ = k.debugServer.Stop()
+		k.debugServer = nil
+	}
+
 	k.mu.Unlock()
 
+	// Publish the events of the calls ended above before exiting
+	internal.CloseEventStreaming()
+
+	// Upload the recordings and captures of the calls ended above
+	internal.CloseObjectStorage()
+
 	// Stop the worker pool
 	internal.StopWorkerPool()
 
@@ -311,10 +454,7 @@ func (k *KarlServer) setupHealthCheckers() {
 		}
 
 		// Try to ping the database
-		if db.GetDB() != nil {
-			return db.GetDB().Ping() == nil
-		}
-		return false
+		return db.Ping() == nil
 	}
 
 	// Redis health checker
@@ -339,7 +479,28 @@ func (k *KarlServer) setupHealthCheckers() {
 		k.mu.RUnlock()
 
 		// NG Listener should be running for readiness
-		return listener != nil
+		return listener != nil && listener.IsRunning()
+	}
+
+	// RTP listener health checker
+	internal.RTPListenerChecker = func() bool {
+		k.mu.RLock()
+		rtpControl := k.rtpControl
+		k.mu.RUnlock()
+
+		return rtpControl != nil && rtpControl.IsListening()
+	}
+
+	// Media ports published on /status
+	internal.MediaPortsGetter = func() *internal.PortAllocator {
+		k.mu.RLock()
+		listener := k.ngListener
+		k.mu.RUnlock()
+
+		if listener == nil {
+			return nil
+		}
+		return listener.GetPortAllocator()
 	}
 
 	// Mark initial readiness state
@@ -353,7 +514,7 @@ func (k *KarlServer) MarkReady() {
 
 	// Check database
 	if k.database != nil {
-		internal.SetDatabaseReady(k.database.GetDB().Ping() == nil)
+		internal.SetDatabaseReady(k.database.Ping() == nil)
 	} else {
 		internal.SetDatabaseReady(true) // Not configured = OK
 	}
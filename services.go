@@ -1,25 +1,164 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"log"
+	"reflect"
 	"time"
 
 	"karl/internal"
 	"karl/internal/api"
+	"karl/internal/grpcapi"
 	"karl/internal/recording"
 )
 
 // initializeServices initializes all service components
 func (k *KarlServer) initializeServices() error {
-	// Initialize Worker Pool
+	k.mu.RLock()
+	logging, transport, qos, impairment := k.config.Logging, k.config.Transport, k.config.QoS, k.config.Impairment
+	musicOnHold, webhooks, eventStreaming := k.config.MusicOnHold, k.config.Webhooks, k.config.EventStreaming
+	dtmfEvents, tenants, sessions := k.config.DTMFEvents, k.config.Tenants, k.config.GetSessionConfig()
+	metrics, accel, objectStorage := k.config.Metrics, k.config.HardwareAccel, k.config.ObjectStorage
+	k.mu.RUnlock()
+
+	// Structured logging, with KARL_LOG_LEVEL and KARL_LOG_FORMAT taking
+	// precedence over the config file
+	if err := internal.ConfigureLogging(internal.LoggingConfigFromEnv(logging)); err != nil {
+		return err
+	}
+
+	// Mark outgoing media and signaling before any socket is opened; a
+	// reload applies to the sockets opened after it
+	internal.ConfigureQoS(qos)
+	internal.RegisterConfigReloader("qos", func(_, newConfig *internal.Config) error {
+		internal.ConfigureQoS(newConfig.QoS)
+		return nil
+	})
+
+	// Keep generated packets under the transport MTU; like QoS, the don't
+	// fragment bit applies to the sockets opened after a reload
+	internal.ConfigureMTU(transport)
+	internal.RegisterConfigReloader("mtu", func(_, newConfig *internal.Config) error {
+		internal.ConfigureMTU(newConfig.Transport)
+		return nil
+	})
+
+	// Bound the per-session gauges
+	internal.ConfigureMetrics(metrics)
+	internal.RegisterConfigReloader("metrics", func(_, newConfig *internal.Config) error {
+		internal.ConfigureMetrics(newConfig.Metrics)
+		return nil
+	})
+
+	// Allow calls to ask for simulated network impairment
+	internal.ConfigureImpairment(impairment)
+	internal.RegisterConfigReloader("impairment", func(_, newConfig *internal.Config) error {
+		internal.ConfigureImpairment(newConfig.Impairment)
+		return nil
+	})
+
+	// Hand SRTP crypto and audio codecs to the configured accelerators; a
+	// reload applies to the SRTP contexts created after it
+	internal.ConfigureAcceleration(accel)
+	internal.RegisterConfigReloader("hardware_acceleration", func(_, newConfig *internal.Config) error {
+		internal.ConfigureAcceleration(newConfig.HardwareAccel)
+		return nil
+	})
+	internal.RegisterHealthCheck("acceleration", internal.CheckAccelerators)
+
+	// Stream music to held parties
+	internal.ConfigureMusicOnHold(musicOnHold)
+	internal.RegisterConfigReloader("music_on_hold", func(_, newConfig *internal.Config) error {
+		internal.ConfigureMusicOnHold(newConfig.MusicOnHold)
+		return nil
+	})
+
+	// Publish call and node events to webhooks; events queued before a
+	// reload are still delivered to the old endpoints
+	internal.ConfigureWebhooks(webhooks)
+	internal.RegisterConfigReloader("webhooks", func(_, newConfig *internal.Config) error {
+		internal.ConfigureWebhooks(newConfig.Webhooks)
+		return nil
+	})
+
+	// Publish the same events to Kafka, NATS and Redis; a reload reconnects
+	// only when the streaming settings changed
+	internal.ConfigureEventStreaming(eventStreaming)
+	internal.RegisterConfigReloader("event_streaming", func(oldConfig, newConfig *internal.Config) error {
+		if !reflect.DeepEqual(oldConfig.EventStreaming, newConfig.EventStreaming) {
+			internal.ConfigureEventStreaming(newConfig.EventStreaming)
+		}
+		return nil
+	})
+
+	// Publish the DTMF digits of calls as events for IVR logic
+	internal.ConfigureDTMFEvents(dtmfEvents)
+	internal.RegisterConfigReloader("dtmf_events", func(oldConfig, newConfig *internal.Config) error {
+		if !reflect.DeepEqual(oldConfig.DTMFEvents, newConfig.DTMFEvents) {
+			internal.ConfigureDTMFEvents(newConfig.DTMFEvents)
+		}
+		return nil
+	})
+
+	// Serve calls for the configured tenants; a reload resets their offer
+	// rates only when the tenants changed
+	internal.ConfigureTenants(tenants)
+	internal.RegisterConfigReloader("tenants", func(oldConfig, newConfig *internal.Config) error {
+		if !reflect.DeepEqual(oldConfig.Tenants, newConfig.Tenants) {
+			internal.ConfigureTenants(newConfig.Tenants)
+		}
+		return nil
+	})
+
+	// Refuse new calls beyond the session and bandwidth caps; a reload
+	// applies to the offers that follow it
+	internal.ConfigureAdmission(sessions)
+	internal.RegisterConfigReloader("admission", func(_, newConfig *internal.Config) error {
+		internal.ConfigureAdmission(newConfig.GetSessionConfig())
+		return nil
+	})
+
+	// Ship completed recordings and captures to object storage; files
+	// queued before a reload are still uploaded with the old settings
+	internal.ConfigureObjectStorage(objectStorage)
+	internal.RegisterConfigReloader("object_storage", func(oldConfig, newConfig *internal.Config) error {
+		if !reflect.DeepEqual(oldConfig.ObjectStorage, newConfig.ObjectStorage) {
+			internal.ConfigureObjectStorage(newConfig.ObjectStorage)
+		}
+		return nil
+	})
+
+	// Initialize Worker Pool, with workers and queues sized and drained as
+	// configured; a reload resizes it in place
+	if err := internal.TuneWorkerPool(internal.WorkerPoolTuningFromConfig(transport)); err != nil {
+		return err
+	}
 	internal.InitWorkerPool()
+	internal.RegisterConfigReloader("worker_pool", func(oldConfig, newConfig *internal.Config) error {
+		tuning := internal.WorkerPoolTuningFromConfig(newConfig.Transport)
+		if oldConfig != nil && tuning == internal.WorkerPoolTuningFromConfig(oldConfig.Transport) {
+			// Leave sizes set through the tuning API alone
+			return nil
+		}
+		return internal.TuneWorkerPool(tuning)
+	})
+
+	// Initialize Recording System; the RTP engine and NG listener feed it
+	if err := k.initializeRecording(); err != nil {
+		log.Printf("Warning: Recording system not started: %v", err)
+	}
 
 	// Initialize Session Registry
 	if err := k.initializeSessionRegistry(); err != nil {
 		return err
 	}
 
+	// Initialize the profiling and diagnostics listener
+	if err := k.initializeDebugServer(); err != nil {
+		log.Printf("Warning: debug server not started: %v", err)
+	}
+
 	// Initialize RTP Engine
 	if err := k.startRTPEngine(); err != nil {
 		return err
@@ -33,6 +172,9 @@ func (k *KarlServer) initializeServices() error {
 	// Initialize FEC Handler
 	k.initializeFECHandler()
 
+	// Initialize the DTLS certificate before any session advertises it
+	k.initializeDTLSCertificates()
+
 	// Initialize WebRTC
 	if err := k.startWebRTC(); err != nil {
 		return err
@@ -43,6 +185,11 @@ func (k *KarlServer) initializeServices() error {
 		return err
 	}
 
+	// Initialize active/standby election of the media IP
+	if err := k.initializeHA(); err != nil {
+		return err
+	}
+
 	// Initialize NG Socket Listener
 	if err := k.initializeNGSocketListener(); err != nil {
 		log.Printf("Warning: NG socket listener not started: %v", err)
@@ -56,9 +203,9 @@ func (k *KarlServer) initializeServices() error {
 		log.Printf("Warning: REST API not started: %v", err)
 	}
 
-	// Initialize Recording System
-	if err := k.initializeRecording(); err != nil {
-		log.Printf("Warning: Recording system not started: %v", err)
+	// Initialize gRPC API
+	if err := k.initializeGRPC(); err != nil {
+		log.Printf("Warning: gRPC API not started: %v", err)
 	}
 
 	// Initialize API endpoints
@@ -84,24 +231,169 @@ func (k *KarlServer) initializeSessionRegistry() error {
 
 	k.sessionRegistry = internal.NewSessionRegistry(sessionTTL)
 
+	// Tear down calls whose media has stopped
+	mediaTimeout := config.GetSessionConfig().MediaTimeout
+	k.sessionRegistry.SetMediaTimeout(time.Duration(mediaTimeout) * time.Second)
+	k.sessionRegistry.SetOnMediaTimeout(func(session *internal.MediaSession, idle time.Duration) {
+		internal.GetCodecNegotiator().RemoveCall(session.CallID)
+	})
+
+	// Rotate SRTP keys of long-running calls; the proxy applies them with a re-INVITE
+	k.srtpRekeyer = internal.NewSRTPRekeyer(k.sessionRegistry, time.Duration(config.SRTP.RekeyInterval)*time.Second)
+	k.srtpRekeyer.SetOnRekey(func(session *internal.MediaSession, legs []*internal.CallLeg) {
+		log.Printf("SRTP keys rotated for call %s (%d leg(s)), awaiting re-INVITE", session.CallID, len(legs))
+	})
+	k.srtpRekeyer.Start()
+
+	// Per-call packet capture, routed to calls by SSRC
+	pcapManager, err := internal.InitPCAPCapture(config.GetPCAPConfig())
+	if err != nil {
+		log.Printf("⚠️ Packet capture disabled: %v", err)
+	} else {
+		pcapManager.SetCallIDResolver(k.sessionRegistry.CallIDForSSRC)
+		k.pcapManager = pcapManager
+	}
+
+	// Audio conference rooms mix the call legs joined to them
+	var conferenceManager *internal.ConferenceManager
+	if conferenceConfig := config.GetConferenceConfig(); conferenceConfig.Enabled {
+		conferenceManager = internal.NewConferenceManager(conferenceConfig, k.sessionRegistry)
+		k.conferenceManager = conferenceManager
+		log.Printf("Conference mixer enabled (%d Hz, %d ms)", conferenceConfig.SampleRate, conferenceConfig.PacketTime)
+	}
+
+	// Selected calls have their audio forked to a speech-to-text engine
+	var transcriptionManager *internal.TranscriptionManager
+	if transcriptionConfig := config.Transcription; transcriptionConfig != nil && transcriptionConfig.Enabled {
+		if transcriptionManager, err = internal.NewTranscriptionManager(transcriptionConfig, k.sessionRegistry); err != nil {
+			log.Printf("⚠️ Transcription disabled: %v", err)
+		} else {
+			k.transcriptionManager = transcriptionManager
+			log.Printf("Transcription enabled (%s backend)", transcriptionConfig.Backend)
+			internal.RegisterConfigReloader("transcription", func(oldConfig, newConfig *internal.Config) error {
+				if !reflect.DeepEqual(oldConfig.Transcription, newConfig.Transcription) {
+					return transcriptionManager.Configure(newConfig.Transcription)
+				}
+				return nil
+			})
+		}
+	}
+
+	k.sessionRegistry.SetOnSessionStart(func(session *internal.MediaSession) {
+		session.RLock()
+		callID, data := session.CallID, map[string]interface{}{
+			"session_id": session.ID,
+			"from_tag":   session.FromTag,
+			"to_tag":     session.ToTag,
+		}
+		session.RUnlock()
+		internal.PublishEvent(internal.EventSessionStart, callID, data)
+	})
+
 	// Set callback for session termination metrics
+	recordingManager := k.recordingManager
 	k.sessionRegistry.SetOnSessionEnd(func(session *internal.MediaSession) {
 		session.Lock()
 		if session.Stats.Duration > 0 {
 			internal.RecordSessionDuration(session.Stats.Duration)
 		}
+		// The final measurement, or the last one taken while media flowed
+		quality := session.LiveQuality()
+		if session.Stats.MOS > 0 {
+			internal.RecordCallMOS(session.Stats.MOS)
+		}
+		if quality.MOS > 0 {
+			internal.RecordCallQuality(quality.AvgJitterMs, quality.LossPercent)
+		}
+		callID, data := session.CallID, map[string]interface{}{
+			"session_id": session.ID,
+			"from_tag":   session.FromTag,
+			"to_tag":     session.ToTag,
+			"duration":   session.Stats.Duration.Seconds(),
+			"mos":        session.Stats.MOS,
+		}
 		session.Unlock()
+		internal.PublishEvent(internal.EventSessionEnd, callID, data)
 		internal.SetActiveSessionCount(k.sessionRegistry.GetActiveCount())
+		if pcapManager != nil {
+			_ = pcapManager.StopCall(callID)
+		}
+		if recordingManager != nil {
+			_, _ = recordingManager.StopCallRecording(session.ID)
+		}
+		if conferenceManager != nil {
+			conferenceManager.RemoveCall(callID)
+		}
+		if transcriptionManager != nil {
+			transcriptionManager.RemoveCall(callID)
+		}
+		internal.RemoveDTMFCall(callID)
 	})
 
+	// Measure call quality and alert on calls whose MOS drops
+	internal.UpdateAlertThresholds(config.AlertSettings)
+	k.AddWorker()
+	go func() {
+		defer k.WorkerDone()
+		internal.MonitorCallQuality(k.ctx, k.sessionRegistry)
+	}()
+
+	// Send the alerts to email, Slack and PagerDuty as configured
+	k.AddWorker()
+	go func() {
+		defer k.WorkerDone()
+		internal.RunAlertNotifier(k.ctx)
+	}()
+
 	log.Println("Session registry initialized")
 	return nil
 }
 
+// initializeDebugServer starts the /debug/pprof and /debug/status listener
+// when enabled. A reload restarts it only when the debug settings changed
+func (k *KarlServer) initializeDebugServer() error {
+	k.mu.RLock()
+	debug := k.config.Debug
+	k.mu.RUnlock()
+
+	internal.RegisterConfigReloader("debug", func(oldConfig, newConfig *internal.Config) error {
+		if reflect.DeepEqual(oldConfig.Debug, newConfig.Debug) {
+			return nil
+		}
+		return k.startDebugServer(newConfig.Debug)
+	})
+	return k.startDebugServer(debug)
+}
+
+// startDebugServer replaces the debug listener with one for config; nil or
+// disabled only stops it
+func (k *KarlServer) startDebugServer(config *internal.DebugConfig) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.debugServer != nil {
+		_ = k.debugServer.Stop()
+		k.debugServer = nil
+	}
+	if config == nil || !config.Enabled {
+		return nil
+	}
+
+	server := internal.NewPprofServer(internal.PprofConfigFromDebug(config))
+	server.SetSessionRegistry(k.sessionRegistry)
+	if err := server.Start(); err != nil {
+		return err
+	}
+	k.debugServer = server
+	log.Printf("Debug server listening on %s", server.Addr())
+	return nil
+}
+
 // initializeRTCPHandler initializes the RTCP handler
 func (k *KarlServer) initializeRTCPHandler() error {
 	k.mu.RLock()
 	config := k.config
+	rtpControl := k.rtpControl
 	k.mu.RUnlock()
 
 	rtcpConfig := &internal.RTCPInternalConfig{
@@ -109,6 +401,7 @@ func (k *KarlServer) initializeRTCPHandler() error {
 		Interval:    5 * time.Second,
 		ReducedSize: false,
 		MuxEnabled:  true,
+		CNAME:       internal.InstanceCNAME(config.GetHAConfig().NodeID),
 	}
 
 	if config.RTCP != nil {
@@ -118,9 +411,14 @@ func (k *KarlServer) initializeRTCPHandler() error {
 		}
 		rtcpConfig.ReducedSize = config.RTCP.ReducedSize
 		rtcpConfig.MuxEnabled = config.RTCP.MuxEnabled
+		rtcpConfig.ExtendedReports = config.RTCP.ExtendedReports
 	}
 
 	k.rtcpHandler = internal.NewRTCPHandler(rtcpConfig)
+	if rtpControl != nil && k.sessionRegistry != nil {
+		// Report on each call leg at the RTCP address from its SDP
+		k.rtcpHandler.SetSessionRegistry(k.sessionRegistry, rtpControl.SendRTCPFrom)
+	}
 	k.rtcpHandler.Start()
 
 	log.Println("RTCP handler initialized")
@@ -156,6 +454,29 @@ func (k *KarlServer) initializeFECHandler() {
 	log.Println("FEC handler initialized")
 }
 
+// initializeDTLSCertificates loads or generates the DTLS certificate shared
+// by all sessions
+func (k *KarlServer) initializeDTLSCertificates() {
+	k.mu.RLock()
+	config := k.config
+	k.mu.RUnlock()
+
+	certs, err := internal.NewDTLSCertificateManager(config.GetDTLSCertConfig())
+	if err != nil {
+		// An in-memory certificate still gives every session one fingerprint
+		log.Printf("Warning: DTLS certificate files unusable, using an in-memory certificate: %v", err)
+		certs, err = internal.NewDTLSCertificateManager(nil)
+		if err != nil {
+			log.Printf("Warning: DTLS certificate not generated: %v", err)
+			return
+		}
+	}
+	certs.Start()
+	k.dtlsCerts = certs
+	internal.SetDefaultDTLSCertificates(certs)
+	log.Printf("DTLS certificate ready (expires %s)", certs.NotAfter().Format(time.RFC3339))
+}
+
 // initializeNGSocketListener initializes the NG protocol socket listener
 func (k *KarlServer) initializeNGSocketListener() error {
 	k.mu.RLock()
@@ -168,10 +489,41 @@ func (k *KarlServer) initializeNGSocketListener() error {
 	}
 
 	k.ngListener = internal.NewNGSocketListener(config, k.sessionRegistry)
+	if k.rtpControl != nil {
+		// Each call leg receives and sends its media on its own port pair
+		k.ngListener.GetSessionManager().SetMediaPortOpener(k.rtpControl.OpenMediaPorts)
+	}
+	if k.recordingManager != nil {
+		k.ngListener.SetCallRecorder(k.recordingManager)
+	}
+	if k.iceManager != nil {
+		// WebRTC peers get full ICE with the gathered candidates
+		k.ngListener.SetICEManager(k.iceManager)
+	}
+	if k.transcriptionManager != nil {
+		// Transcribed calls are kept out of kernel offload so the tap sees their audio
+		k.ngListener.SetTranscriptionManager(k.transcriptionManager)
+		k.transcriptionManager.SetOffloadUpdater(k.ngListener.GetSessionManager().UpdateOffload)
+	}
 	if err := k.ngListener.Start(); err != nil {
 		return fmt.Errorf("failed to start NG socket listener: %w", err)
 	}
 
+	// Expose call session and port allocation health
+	internal.RegisterHealthCheck("sessions", k.ngListener.GetSessionManager().HealthCheck)
+
+	// Share the control endpoint with the other nodes
+	dispatcher, err := internal.InitDispatch(config)
+	if err != nil {
+		return fmt.Errorf("failed to initialize dispatch: %w", err)
+	}
+	if dispatcher != nil {
+		dispatcher.Start()
+		k.ngListener.SetDispatcher(dispatcher)
+		internal.RegisterHealthCheck("dispatch", dispatcher.CheckHealth)
+		k.dispatcher = dispatcher
+	}
+
 	log.Println("NG socket listener initialized")
 	return nil
 }
@@ -188,6 +540,24 @@ func (k *KarlServer) initializeRESTAPI() error {
 	}
 
 	router := api.NewRouter(config, k.sessionRegistry)
+	router.SetSRTPRekeyer(k.srtpRekeyer)
+	router.SetPCAPCaptureManager(k.pcapManager)
+	if k.conferenceManager != nil {
+		router.SetConferenceManager(k.conferenceManager)
+	}
+	if k.transcriptionManager != nil {
+		router.SetTranscriptionManager(k.transcriptionManager)
+	}
+	if k.sfu != nil {
+		router.SetSFU(k.sfu)
+	}
+	if k.signaling != nil {
+		router.SetSignalingServer(k.signaling)
+	}
+	if k.ngListener != nil {
+		router.SetPortAllocator(k.ngListener.GetPortAllocator())
+		router.SetSessionManager(k.ngListener.GetSessionManager())
+	}
 	if err := router.Start(); err != nil {
 		return fmt.Errorf("failed to start REST API: %w", err)
 	}
@@ -196,25 +566,64 @@ func (k *KarlServer) initializeRESTAPI() error {
 	return nil
 }
 
+// initializeGRPC starts the gRPC control API when grpc is enabled
+func (k *KarlServer) initializeGRPC() error {
+	k.mu.RLock()
+	config := k.config
+	k.mu.RUnlock()
+
+	if config.GRPC == nil || !config.GRPC.Enabled {
+		return nil
+	}
+
+	server := grpcapi.NewServer(config, k.sessionRegistry)
+	if k.ngListener != nil {
+		server.SetSessionManager(k.ngListener.GetSessionManager())
+	}
+	if err := server.Start(); err != nil {
+		return fmt.Errorf("failed to start gRPC API: %w", err)
+	}
+	k.grpcServer = server
+
+	log.Println("gRPC API initialized")
+	return nil
+}
+
 // initializeRecording initializes the recording system
 func (k *KarlServer) initializeRecording() error {
 	k.mu.RLock()
 	config := k.config
 	k.mu.RUnlock()
 
-	if config.Recording == nil || !config.Recording.Enabled {
+	recCfg := config.GetRecordingConfig()
+	if !recCfg.Enabled && !config.WebRTC.RecordingEnabled {
 		log.Println("Recording disabled in configuration")
 		return nil
 	}
 
-	recConfig := &recording.RecordingConfig{
-		BasePath:      config.Recording.BasePath,
-		Format:        recording.RecordingFormat(config.Recording.Format),
-		Mode:          recording.RecordingMode(config.Recording.Mode),
-		SampleRate:    config.Recording.SampleRate,
-		BitsPerSample: config.Recording.BitsPerSample,
-		MaxFileSize:   config.Recording.MaxFileSize,
-		RetentionDays: config.Recording.RetentionDays,
+	// Recordings go to the WebRTC recording path when one is configured
+	basePath := recCfg.BasePath
+	if config.WebRTC.RecordingPath != "" {
+		basePath = config.WebRTC.RecordingPath
+	}
+
+	recConfig := recording.DefaultRecordingConfig()
+	recConfig.BasePath = basePath
+	recConfig.MaxFileSize = recCfg.MaxFileSize
+	recConfig.RetentionDays = recCfg.RetentionDays
+	if recCfg.SampleRate > 0 {
+		recConfig.SampleRate = recCfg.SampleRate
+	}
+	if recCfg.BitsPerSample > 0 {
+		recConfig.BitsPerSample = recCfg.BitsPerSample
+	}
+
+	var err error
+	if recConfig.Format, err = recording.ParseRecordingFormat(recCfg.Format, recording.FormatWAV); err != nil {
+		return err
+	}
+	if recConfig.Mode, err = recording.ParseRecordingMode(recCfg.Mode, recording.ModeMixed); err != nil {
+		return err
 	}
 
 	manager := recording.NewManager(recConfig)
@@ -222,7 +631,11 @@ func (k *KarlServer) initializeRecording() error {
 		return fmt.Errorf("failed to start recording manager: %w", err)
 	}
 
-	log.Println("Recording system initialized")
+	k.mu.Lock()
+	k.recordingManager = manager
+	k.mu.Unlock()
+
+	log.Printf("Recording system initialized (%s, %s) in %s", recConfig.Format, recConfig.Mode, basePath)
 	return nil
 }
 
@@ -254,15 +667,135 @@ func (k *KarlServer) startRTPEngine() error {
 		return fmt.Errorf("❌ Failed to initialize RTP Control: %w", err)
 	}
 
+	rtpControl.SetBatchConfig(internal.BatchConfig{
+		Size: config.Transport.BatchSize,
+		GSO:  config.Transport.GSO,
+	})
+	if config.Transport.ReusePort {
+		rtpControl.SetReusePortShards(config.Transport.ReusePortShards)
+	}
+	// Send each destination's media from the named interface that reaches it
+	if len(config.Transport.Interfaces) > 0 {
+		rtpControl.SetEgressSelector(internal.NewInterfaceSelector(config).EgressAddress)
+	}
+	// Filter media sources before the first packet is read
+	mediaACL, err := internal.InitMediaACL(config)
+	if err != nil {
+		rtpControl.Stop()
+		return fmt.Errorf("❌ Failed to initialize media ACL: %w", err)
+	}
+	if mediaACL != nil {
+		if k.sessionRegistry != nil {
+			mediaACL.SetSourceChecker(k.sessionRegistry.CheckMediaSource)
+		}
+		mediaACL.Start()
+		rtpControl.SetSourceFilter(mediaACL.Allow)
+		k.mediaACL = mediaACL
+	}
+
 	addr := fmt.Sprintf(":%d", config.Transport.UDPPort)
 	if err := rtpControl.StartRTPListener(addr); err != nil {
 		rtpControl.Stop()
 		return fmt.Errorf("❌ RTP Listener failed to start: %w", err)
 	}
 
+	// RTP over TCP and TLS, framed per RFC 4571; media still flows over UDP
+	// without them
+	if config.Transport.TCPEnabled {
+		if err := rtpControl.StartRTPStreamListener(fmt.Sprintf(":%d", config.Transport.TCPPort), nil); err != nil {
+			log.Printf("⚠️ RTP TCP listener failed to start: %v", err)
+		}
+	}
+	if config.Transport.TLSEnabled {
+		cert, err := tls.LoadX509KeyPair(config.Transport.TLSCert, config.Transport.TLSKey)
+		if err != nil {
+			log.Printf("⚠️ RTP TLS listener failed to start: %v", err)
+		} else {
+			tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+			if err := rtpControl.StartRTPStreamListener(fmt.Sprintf(":%d", config.Transport.TLSPort), tlsConfig); err != nil {
+				log.Printf("⚠️ RTP TLS listener failed to start: %v", err)
+			}
+		}
+	}
+
+	// Let negotiated rtcp-mux decide per session whether RTCP may share the RTP port
+	rtpControl.SetRTCPMux(config.GetRTCPConfig().MuxEnabled)
+	if k.sessionRegistry != nil {
+		rtpControl.SetRTCPMuxResolver(k.sessionRegistry.RTCPMuxForSSRC)
+		rtpControl.SetMediaActivityHandler(k.sessionRegistry.RecordMediaActivity)
+	}
+	if k.recordingManager != nil {
+		rtpControl.AddMediaTap(k.recordingManager.HandleRTP)
+	}
+	if k.conferenceManager != nil {
+		k.conferenceManager.SetSender(rtpControl.SendTo)
+		rtpControl.AddMediaTap(k.conferenceManager.HandleRTP)
+	}
+	if k.transcriptionManager != nil {
+		rtpControl.AddMediaTap(k.transcriptionManager.HandleRTP)
+	}
+	rtpControl.AddMediaTap(internal.HandleDTMFRTP)
+	internal.GetMediaPlayer().SetSender(rtpControl.SendTo)
+
+	// The worker pool relays each session's streams to the peer leg after
+	// transcoding and FEC recovery, and hands other streams to the
+	// configured destinations
+	if k.sessionRegistry != nil {
+		k.sessionRegistry.SetMediaSender(rtpControl.SendBatchFrom)
+		// Streams on a leg's ports belong to the party sending to them,
+		// whether or not its SDP announced their SSRCs
+		rtpControl.SetSSRCLearner(k.sessionRegistry.LearnSSRC)
+
+		// Bridged calls are decrypted and encrypted per leg with the keys
+		// each party negotiated; ZRTP the parties run end to end is relayed
+		// unchanged
+		rtpControl.SetMediaCryptoResolver(k.sessionRegistry.MediaCryptoFor)
+		rtpControl.SetZRTPRelay(k.sessionRegistry.RelayZRTP)
+
+		// Keyframe requests from video receivers, and Karl's own after loss
+		// or for a new receiver, go to the video's sender
+		registry := k.sessionRegistry
+		registry.SetKeyframeSender(rtpControl.SendRTCPFrom, time.Duration(config.RTPSettings.PLIInterval)*time.Millisecond)
+		internal.GetRTCPDemuxer().SetPLIHandler(func(ssrc uint32) { _ = registry.RequestKeyframe(ssrc, false) })
+		internal.GetRTCPDemuxer().SetFIRHandler(func(ssrc uint32) { _ = registry.RequestKeyframe(ssrc, true) })
+
+		// Video between legs with no codec in common, when built in
+		if videoConfig := config.GetVideoTranscodeConfig(); videoConfig.Enabled {
+			if transcoder, err := internal.NewVideoTranscoder(videoConfig); err != nil {
+				log.Printf("⚠️ Video transcoding disabled: %v", err)
+			} else {
+				registry.SetVideoTranscoder(transcoder)
+			}
+		}
+	}
+	internal.SetDefaultRTPHandler(rtpControl)
+
+	// RTCP runs on the next port up; media still flows without it
+	rtcpAddr := fmt.Sprintf(":%d", config.Transport.UDPPort+1)
+	if err := rtpControl.StartRTCPListener(rtcpAddr); err != nil {
+		log.Printf("⚠️ RTCP Listener failed to start: %v", err)
+	}
+
+	// Mirror RTCP and RTP quality summaries to a Homer capture server
+	var hepExporter *internal.HEPExporter
+	if hepConfig := config.GetHEPConfig(); hepConfig.Enabled {
+		hepExporter, err = internal.NewHEPExporter(hepConfig, internal.GetReceiveStatsTracker())
+		if err != nil {
+			log.Printf("⚠️ HEP exporter disabled: %v", err)
+		} else {
+			if k.sessionRegistry != nil {
+				hepExporter.SetCallIDResolver(k.sessionRegistry.CallIDForSSRC)
+			}
+			rtpControl.SetRTCPTap(hepExporter.CaptureRTCP)
+			hepExporter.Start()
+			log.Printf("✅ HEP capture export to %s (%s)", hepConfig.Address, hepConfig.Transport)
+		}
+	}
+
 	k.mu.Lock()
 	k.rtpControl = rtpControl
 	k.srtpTranscoder = srtpTranscoder
+	k.hepExporter = hepExporter
 	k.mu.Unlock()
 
 	log.Printf("✅ RTP Engine started on UDP port %d", config.Transport.UDPPort)
@@ -279,15 +812,27 @@ func (k *KarlServer) initializeDatabases() error {
 		return fmt.Errorf("❌ Configuration not loaded")
 	}
 
-	// Initialize MySQL if DSN is provided
-	if config.Database.MySQLDSN != "" {
-		db, err := internal.NewRTPDatabase(config.Database.MySQLDSN)
-		if err != nil {
-			return fmt.Errorf("❌ Failed to initialize MySQL: %w", err)
+	// Initialize the SQL database: MySQL or PostgreSQL by DSN scheme, or
+	// the local SQLite file when no DSN is provided
+	if dsn := config.Database.DatabaseDSN(); dsn != "" {
+		// The implicit SQLite file is best effort, a configured DSN is not
+		fallback := config.Database.DSN == "" && config.Database.MySQLDSN == ""
+		db, err := internal.NewRTPDatabase(dsn)
+		if err == nil {
+			if err = db.InitSchema(); err != nil {
+				db.Close()
+			}
+		}
+		switch {
+		case err == nil:
+			k.database = db
+		case fallback:
+			log.Printf("⚠️ SQLite database unavailable, running without one: %v", err)
+		default:
+			return fmt.Errorf("❌ Failed to initialize database: %w", err)
 		}
-		k.database = db
 	} else {
-		log.Println("⚠️ MySQL database connection disabled (no DSN provided)")
+		log.Println("⚠️ Database connection disabled (no DSN provided, SQLite disabled)")
 	}
 
 	// Initialize Redis if enabled
@@ -308,6 +853,32 @@ func (k *KarlServer) initializeDatabases() error {
 	return nil
 }
 
+// initializeHA starts the active/standby elector when ha is enabled
+func (k *KarlServer) initializeHA() error {
+	k.mu.RLock()
+	config := k.config
+	k.mu.RUnlock()
+
+	elector, err := internal.InitHA(config)
+	if err != nil {
+		return fmt.Errorf("❌ Failed to initialize HA: %w", err)
+	}
+	if elector == nil {
+		return nil
+	}
+
+	internal.RegisterHealthCheck("ha", elector.CheckHealth)
+	elector.SetOnRoleChange(func(role internal.HARole, reason string) {
+		internal.PublishEvent(internal.EventFailover, "", map[string]interface{}{
+			"role":   role.String(),
+			"reason": reason,
+		})
+	})
+	elector.Start()
+	k.haElector = elector
+	return nil
+}
+
 // startAPIServer initializes and starts the HTTP API server
 func (k *KarlServer) initializeAPIServer() {
 	// Skip API server initialization here, it's already started in loadConfig
@@ -320,53 +891,41 @@ func (k *KarlServer) initializeUnixSocketListener() {
 	log.Println("✅ Unix socket listener already initialized")
 }
 
-
-
-// startSIPRegistration starts periodic SIP proxy registration
+// startSIPRegistration starts periodic SIP OPTIONS keepalives to the proxies
 func (k *KarlServer) startSIPRegistration() {
 	k.mu.RLock()
 	config := k.config
 	k.mu.RUnlock()
 
-	interval := 30 * time.Second
-	if config.Integration.KeepAliveInterval > 0 {
-		interval = time.Duration(config.Integration.KeepAliveInterval) * time.Second
-	}
+	integration := config.Integration
 
-	// Use the new context-aware registration service
-	// Register with OpenSIPS
-	if config.Integration.OpenSIPSIp != "" && config.Integration.OpenSIPSPort > 0 {
+	// Ping OpenSIPS
+	if integration.OpenSIPSIp != "" && integration.OpenSIPSPort > 0 {
+		settings := integration.SIPKeepaliveSettings(integration.OpenSIPSIp, integration.OpenSIPSPort)
 		k.AddWorker() // Track this in the waitgroup
 		go func() {
 			defer k.WorkerDone()
-			internal.StartRegistrationService(
-				k.ctx,
-				config.Integration.OpenSIPSIp,
-				config.Integration.OpenSIPSPort,
-				interval,
-			)
+			internal.StartSIPKeepalive(k.ctx, settings)
 		}()
-		log.Printf("✅ OpenSIPS registration service started for %s:%d",
-			config.Integration.OpenSIPSIp,
-			config.Integration.OpenSIPSPort)
+		log.Printf("✅ OpenSIPS OPTIONS keepalive started for %s:%d over %s",
+			integration.OpenSIPSIp,
+			integration.OpenSIPSPort,
+			settings.Transport)
 	}
 
-	// Register with Kamailio
-	if config.Integration.KamailioIp != "" && config.Integration.KamailioPort > 0 {
+	// Ping Kamailio
+	if integration.KamailioIp != "" && integration.KamailioPort > 0 {
+		settings := integration.SIPKeepaliveSettings(integration.KamailioIp, integration.KamailioPort)
 		k.AddWorker() // Track this in the waitgroup
 		go func() {
 			defer k.WorkerDone()
-			internal.StartRegistrationService(
-				k.ctx,
-				config.Integration.KamailioIp,
-				config.Integration.KamailioPort,
-				interval,
-			)
+			internal.StartSIPKeepalive(k.ctx, settings)
 		}()
-		log.Printf("✅ Kamailio registration service started for %s:%d",
-			config.Integration.KamailioIp,
-			config.Integration.KamailioPort)
+		log.Printf("✅ Kamailio OPTIONS keepalive started for %s:%d over %s",
+			integration.KamailioIp,
+			integration.KamailioPort,
+			settings.Transport)
 	}
 
-	log.Println("✅ SIP registration services started")
+	log.Println("✅ SIP keepalive services started")
 }
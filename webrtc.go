@@ -10,6 +10,9 @@ import (
 	"github.com/pion/webrtc/v3"
 )
 
+// webrtcPublisherID identifies the server's WebRTC session as an SFU publisher
+const webrtcPublisherID = "webrtc"
+
 // startWebRTC initializes and starts the WebRTC service
 func (k *KarlServer) startWebRTC() error {
 	k.mu.RLock()
@@ -64,9 +67,10 @@ func (k *KarlServer) startWebRTC() error {
 		return fmt.Errorf("❌ Failed to initialize SRTP transcoder: %w", err)
 	}
 
-	// Initialize RTP Transcoder
+	// Initialize RTP Transcoder and the video forwarding unit
 	k.mu.Lock()
 	k.transcoder = internal.NewRTPTranscoder(k.webrtcSession)
+	k.sfu = internal.NewSFU(&config.WebRTC)
 	k.mu.Unlock()
 
 	// Initialize WebRTC stats monitoring
@@ -103,6 +107,17 @@ func (k *KarlServer) startWebRTC() error {
 	// Set up WebRTC callbacks
 	k.setupWebRTCCallbacks()
 
+	// Serve browser signaling over WebSocket
+	if config.WebRTC.WebRTCPort > 0 {
+		signaling := internal.NewSignalingServer(&config.WebRTC)
+		if err := signaling.Start(fmt.Sprintf(":%d", config.WebRTC.WebRTCPort)); err != nil {
+			return fmt.Errorf("❌ Failed to start WebRTC signaling: %w", err)
+		}
+		k.mu.Lock()
+		k.signaling = signaling
+		k.mu.Unlock()
+	}
+
 	log.Println("✅ WebRTC initialized successfully")
 	return nil
 }
@@ -165,10 +180,13 @@ func (k *KarlServer) setupWebRTCCallbacks() {
 
 		switch state {
 		case webrtc.PeerConnectionStateFailed:
-			log.Println("❌ WebRTC connection failed")
-		case webrtc.PeerConnectionStateDisconnected:
-			log.Println("⚠️ WebRTC disconnected, attempting reconnection...")
+			// Without a signaling channel ICE cannot be restarted, so the
+			// session is recreated
+			log.Println("❌ WebRTC connection failed, attempting reconnection...")
 			go k.handleWebRTCReconnect()
+		case webrtc.PeerConnectionStateDisconnected:
+			// Usually transient; ICE recovers or moves on to failed
+			log.Println("⚠️ WebRTC disconnected, waiting for ICE to recover")
 		case webrtc.PeerConnectionStateConnected:
 			log.Println("✅ WebRTC connected")
 		}
@@ -177,19 +195,28 @@ func (k *KarlServer) setupWebRTCCallbacks() {
 	session.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
 		log.Printf("📡 New track received: %s", track.Kind().String())
 		k.wg.Add(1)
-		go k.handleIncomingTrack(track)
+		go k.handleIncomingTrack(session, track)
 	})
 }
 
 // handleIncomingTrack handles incoming WebRTC tracks
-func (k *KarlServer) handleIncomingTrack(track *webrtc.TrackRemote) {
+func (k *KarlServer) handleIncomingTrack(session *webrtc.PeerConnection, track *webrtc.TrackRemote) {
 	defer k.wg.Done()
 
 	k.mu.RLock()
 	transcoder := k.transcoder
 	srtpTranscoder := k.srtpTranscoder
+	sfu := k.sfu
 	k.mu.RUnlock()
 
+	// Video is forwarded to SFU subscribers as is
+	if track.Kind() == webrtc.RTPCodecTypeVideo && sfu != nil {
+		if err := sfu.Publish(webrtcPublisherID, session, track); err != nil {
+			log.Printf("❌ Error forwarding video track %s: %v", track.ID(), err)
+		}
+		return
+	}
+
 	if track.Kind() == webrtc.RTPCodecTypeAudio && transcoder != nil {
 		outputTrack, err := transcoder.AddTrackPair(track)
 		if err != nil {
@@ -202,10 +229,12 @@ func (k *KarlServer) handleIncomingTrack(track *webrtc.TrackRemote) {
 		k.mu.RUnlock()
 
 		if session != nil {
-			if _, err := session.AddTrack(outputTrack); err != nil {
+			sender, err := session.AddTrack(outputTrack)
+			if err != nil {
 				log.Printf("❌ Failed to add transcoded track: %v", err)
 				return
 			}
+			transcoder.WatchSender(track.ID(), sender)
 		}
 
 		log.Printf("✅ Added transcoded track for: %s", track.ID())